@@ -0,0 +1,100 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// baas-simulator registers simulated machines with a control server, which boot, download and report the way the
+// management OS does. It prints the latencies and errors of their requests at the end, to see how the control server
+// holds up under the load of many machines.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	server    = flag.String("server", "http://localhost:4848", "URL of the control server.")
+	machines  = flag.Int("machines", 10, "Number of simulated machines.")
+	macPrefix = flag.String("mac-prefix", "02:ba:a5", "First three bytes of the MAC addresses of the machines.")
+	image     = flag.String("image", "", "Default image of the machines, without it they only boot what is queued.")
+
+	duration = flag.Duration("duration", time.Minute, "How long the simulation runs.")
+	rampUp   = flag.Duration("ramp-up", 10*time.Second, "How long it takes until all machines started.")
+
+	poll            = flag.Duration("poll", 5*time.Second, "How often a machine looks for boot work.")
+	bootProbability = flag.Float64("boot-probability", 0.5, "Chance a machine asks for boot work when it looks.")
+	heartbeat       = flag.Duration("heartbeat", 10*time.Second, "How often a flashing machine sends a heartbeat.")
+	bandwidth       = flag.Uint64("bandwidth", 0, "Bytes per second a machine downloads at, 0 does not limit it.")
+	machineImages   = flag.Bool("machine-images", false, "Download the machine images along with every boot.")
+
+	seed      = flag.Int64("seed", 1, "Seed of the behaviour of the machines.")
+	maxErrors = flag.Float64("max-errors", 0, "Fraction of the requests which may fail before exiting with 1.")
+	verbose   = flag.Bool("verbose", false, "Log the requests of the machines.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *machines <= 0 || *machines > 1<<24 {
+		fmt.Fprintln(os.Stderr, "baas-simulator: -machines has to be between 1 and 16777216")
+		os.Exit(2)
+	}
+
+	if *bootProbability < 0 || *bootProbability > 1 {
+		fmt.Fprintln(os.Stderr, "baas-simulator: -boot-probability has to be between 0 and 1")
+		os.Exit(2)
+	}
+
+	// The client logs every request, which drowns out the statistics
+	log.SetLevel(log.ErrorLevel)
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	// Every machine keeps its connection open, like the machines do
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = *machines
+
+	// Interrupting the simulation still prints what happened until then
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	sim := newSimulator(options{
+		Server:          *server,
+		Machines:        *machines,
+		MACPrefix:       *macPrefix,
+		Image:           *image,
+		Duration:        *duration,
+		RampUp:          *rampUp,
+		Poll:            *poll,
+		BootProbability: *bootProbability,
+		Heartbeat:       *heartbeat,
+		Bandwidth:       *bandwidth,
+		MachineImages:   *machineImages,
+		Seed:            *seed,
+	})
+
+	start := time.Now()
+	result := sim.Run(ctx)
+	if err := result.write(os.Stdout, time.Since(start)); err != nil {
+		fmt.Fprintf(os.Stderr, "baas-simulator: %v\n", err)
+		os.Exit(1)
+	}
+
+	if rate := result.errorRate(); rate > *maxErrors {
+		fmt.Fprintf(os.Stderr, "baas-simulator: %.2f%% of the requests failed\n", rate*100)
+		os.Exit(1)
+	}
+}
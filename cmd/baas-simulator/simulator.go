@@ -0,0 +1,279 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+)
+
+// chunkSize is how much of an image is read at a time, the bandwidth is kept to after every chunk
+const chunkSize = 32 * 1024
+
+// options describe the machines and how they behave
+type options struct {
+	// Server is the URL of the control server
+	Server string
+	// Machines is the number of simulated machines, their MAC addresses start with MACPrefix
+	Machines  int
+	MACPrefix string
+	// Image is the default image the machines are registered with, without it they only boot what is queued
+	Image string
+
+	// Duration is how long the machines keep going, RampUp how long it takes until all of them started
+	Duration time.Duration
+	RampUp   time.Duration
+
+	// Poll is how often a machine looks for boot work, BootProbability the chance it asks the control server
+	Poll            time.Duration
+	BootProbability float64
+	// Heartbeat is how often a machine which is flashing reports its progress
+	Heartbeat time.Duration
+	// Bandwidth is how many bytes per second a machine downloads, zero does not limit it
+	Bandwidth uint64
+	// MachineImages downloads the machine images as well, which the management OS flashes along with every boot
+	MachineImages bool
+
+	// Seed makes the behaviour of the machines repeatable
+	Seed int64
+}
+
+// simulator runs the machines and collects the statistics of their requests
+type simulator struct {
+	opts  options
+	stats *stats
+}
+
+func newSimulator(opts options) *simulator {
+	return &simulator{opts: opts, stats: newStats()}
+}
+
+// macAddress is the MAC address of the i-th machine
+func macAddress(prefix string, i int) string {
+	return fmt.Sprintf("%s:%02x:%02x:%02x", prefix, (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+// sleep waits for d, it returns false when the simulation ends first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// jitter spreads out the requests of the machines, it is d give or take a quarter
+func jitter(rnd *rand.Rand, d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d*3/4 + time.Duration(rnd.Int63n(int64(d/2)+1))
+}
+
+// Run starts the machines one by one over the ramp-up and lets them run until the duration is over
+func (s *simulator) Run(ctx context.Context) *stats {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.opts.Machines; i++ {
+		m := &simulatedMachine{
+			sim:    s,
+			mac:    macAddress(s.opts.MACPrefix, i),
+			client: client.New(s.opts.Server),
+			rnd:    rand.New(rand.NewSource(s.opts.Seed + int64(i))),
+		}
+
+		start := time.Duration(0)
+		if s.opts.Machines > 1 {
+			start = s.opts.RampUp * time.Duration(i) / time.Duration(s.opts.Machines-1)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sleep(ctx, start) {
+				m.run(ctx)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return s.stats
+}
+
+// simulatedMachine behaves like a machine running the management OS
+type simulatedMachine struct {
+	sim    *simulator
+	mac    string
+	client *client.Client
+	rnd    *rand.Rand
+}
+
+// run registers the machine and then keeps looking for boot work until the simulation ends
+func (m *simulatedMachine) run(ctx context.Context) {
+	err := m.sim.stats.time("register", func() error {
+		err := m.client.RegisterMachine(&machine.MachineModel{
+			Name:         "simulated-" + m.mac,
+			MacAddress:   util.MacAddress{Address: m.mac},
+			DefaultImage: machine.DefaultImage{ImageUUID: m.sim.opts.Image},
+		})
+		if err == client.ErrMachineExists {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	for sleep(ctx, jitter(m.rnd, m.sim.opts.Poll)) {
+		if m.rnd.Float64() < m.sim.opts.BootProbability {
+			m.boot()
+		}
+	}
+}
+
+// boot asks for the next boot, downloads its images while sending heartbeats and reports how it went
+func (m *simulatedMachine) boot() {
+	var setup *images.ImageSetup
+	err := m.sim.stats.time("inform", func() (err error) {
+		setup, err = m.client.BootInform(m.mac, "")
+		if err == client.ErrNoBootSetup {
+			return nil
+		}
+		return err
+	})
+	if err != nil || setup == nil {
+		return
+	}
+	m.sim.stats.addBoot()
+
+	// The boot is flashed to the end even when the simulation ends, the control server would otherwise keep the
+	// images locked until the janitor gives up on it
+	flashing, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.heartbeats(flashing, cancel)
+	}()
+
+	report := images.BootReport{State: images.BootCompleted}
+	for i := range setup.Images {
+		frozen := &setup.Images[i]
+		if frozen.Export != nil || (frozen.Image.Type == "machine" && !m.sim.opts.MachineImages) {
+			continue
+		}
+
+		if err = m.download(flashing, frozen); err != nil {
+			report.State, report.FailureReason = images.BootFailed, images.FailureDownload
+			if flashing.Err() != nil {
+				report.State, report.FailureReason = images.BootCancelled, images.FailureCancelled
+			}
+			report.FailureDetail = err.Error()
+			break
+		}
+
+		report.Flashed = append(report.Flashed, images.ResolvedVersion{
+			ImageUUID: frozen.Image.UUID,
+			Version:   frozen.Version.Version,
+		})
+	}
+
+	cancel()
+	wg.Wait()
+
+	_ = m.sim.stats.time("state", func() error {
+		_, err := m.client.SetBootState(m.mac, &report)
+		return err
+	})
+}
+
+// heartbeats reports that the machine is still flashing until ctx is done, the boot is stopped when the control
+// server asks to cancel it
+func (m *simulatedMachine) heartbeats(ctx context.Context, cancel context.CancelFunc) {
+	for sleep(ctx, jitter(m.rnd, m.sim.opts.Heartbeat)) {
+		var control *images.BootControl
+		err := m.sim.stats.time("heartbeat", func() (err error) {
+			control, err = m.client.BootHeartbeat(m.mac, nil)
+			return err
+		})
+
+		if err == nil && control != nil && control.CancelRequested {
+			cancel()
+			return
+		}
+	}
+}
+
+// download fetches a version of an image at the bandwidth of the machine and throws it away
+func (m *simulatedMachine) download(ctx context.Context, frozen *images.ImageFrozen) error {
+	var reader io.ReadCloser
+	err := m.sim.stats.time("download", func() (err error) {
+		reader, err = m.client.DownloadDiskHTTP(frozen.Image.UUID, frozen.Version.Version, "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	start := time.Now()
+	n, err := throttledCopy(ctx, ioutil.Discard, reader, m.sim.opts.Bandwidth)
+	m.sim.stats.addBytes(n)
+	m.sim.stats.record("transfer", time.Since(start), err)
+	return err
+}
+
+// throttledCopy copies src to dst at no more than bandwidth bytes per second, it stops when ctx is done
+func throttledCopy(ctx context.Context, dst io.Writer, src io.Reader, bandwidth uint64) (int64, error) {
+	buf := make([]byte, chunkSize)
+	start := time.Now()
+	var copied int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return copied, werr
+			}
+			copied += int64(n)
+		}
+
+		if err == io.EOF {
+			return copied, nil
+		} else if err != nil {
+			return copied, err
+		}
+
+		if bandwidth != 0 {
+			due := time.Duration(float64(copied) / float64(bandwidth) * float64(time.Second))
+			if ahead := due - time.Since(start); ahead > 0 && !sleep(ctx, ahead) {
+				return copied, ctx.Err()
+			}
+		}
+	}
+}
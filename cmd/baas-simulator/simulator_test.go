@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/api"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSimulator runs a few machines against a control server, as a smoke test of the whole boot flow
+func TestSimulator(t *testing.T) {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+
+	diskpath, err := ioutil.TempDir("", "simulator")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+	image := images.ImageModel{Name: "lab", Username: "test", UUID: "lab"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "lab", Size: 64 * 1024}))
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(1), make([]byte, 64*1024), 0644))
+
+	server := httptest.NewServer(api.NewHandler(store, "", diskpath, config.Default()))
+	defer server.Close()
+
+	opts := options{
+		Server:          server.URL,
+		Machines:        3,
+		MACPrefix:       "02:ba:a5",
+		Image:           "lab",
+		Duration:        time.Second,
+		RampUp:          100 * time.Millisecond,
+		Poll:            20 * time.Millisecond,
+		BootProbability: 1,
+		Heartbeat:       10 * time.Millisecond,
+		Bandwidth:       1 << 20,
+	}
+	result := newSimulator(opts).Run(context.Background())
+
+	summaries := result.summaries()
+	assert.Equal(t, 3, summaries["register"].Count)
+	assert.NotZero(t, summaries["inform"].Count)
+	assert.NotZero(t, summaries["download"].Count)
+	assert.NotZero(t, summaries["heartbeat"].Count)
+	assert.Equal(t, summaries["inform"].Count, summaries["state"].Count)
+	assert.Zero(t, result.errorRate())
+	assert.Equal(t, int64(summaries["transfer"].Count)*64*1024, result.bytes)
+
+	var out bytes.Buffer
+	assert.NoError(t, result.write(&out, time.Second))
+	assert.True(t, strings.Contains(out.String(), "heartbeat"))
+
+	// The machines are registered already when the simulation runs again
+	opts.Duration = 200 * time.Millisecond
+	again := newSimulator(opts).Run(context.Background())
+	assert.Zero(t, again.summaries()["register"].Errors)
+
+	history, err := store.GetBootHistory("02:ba:a5:00:00:00", database.BootFilter{}, database.ListOptions{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, history)
+	assert.Equal(t, images.BootCompleted, history[0].State)
+}
+
+func TestThrottledCopy(t *testing.T) {
+	var out bytes.Buffer
+	start := time.Now()
+	n, err := throttledCopy(context.Background(), &out, bytes.NewReader(make([]byte, 96*1024)), 256*1024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(96*1024), n)
+	assert.True(t, time.Since(start) >= 250*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = throttledCopy(ctx, &out, bytes.NewReader(make([]byte, 1024)), 0)
+	assert.Equal(t, context.Canceled, err)
+}
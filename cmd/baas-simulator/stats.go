@@ -0,0 +1,174 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// operation is a kind of request the machines send, its latencies are kept to compute the percentiles at the end
+type operation struct {
+	latencies []time.Duration
+	errors    int
+	lastError string
+}
+
+// stats collects what happened to the requests of all machines
+type stats struct {
+	mu         sync.Mutex
+	operations map[string]*operation
+	boots      int
+	bytes      int64
+}
+
+func newStats() *stats {
+	return &stats{operations: map[string]*operation{}}
+}
+
+// record adds a request which took the given time, it failed when err is not nil
+func (s *stats) record(name string, took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.operations[name]
+	if !ok {
+		op = &operation{}
+		s.operations[name] = op
+	}
+
+	op.latencies = append(op.latencies, took)
+	if err != nil {
+		op.errors++
+		op.lastError = err.Error()
+	}
+}
+
+// time runs a request and records how long it took
+func (s *stats) time(name string, request func() error) error {
+	start := time.Now()
+	err := request()
+	s.record(name, time.Since(start), err)
+	return err
+}
+
+// addBoot counts a boot the machines picked up
+func (s *stats) addBoot() {
+	s.mu.Lock()
+	s.boots++
+	s.mu.Unlock()
+}
+
+// addBytes counts the bytes the machines downloaded
+func (s *stats) addBytes(n int64) {
+	s.mu.Lock()
+	s.bytes += n
+	s.mu.Unlock()
+}
+
+// summary is what is reported about an operation
+type summary struct {
+	Count  int
+	Errors int
+	P50    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+// percentile is the latency which the given fraction of the sorted latencies do not exceed
+func percentile(sorted []time.Duration, fraction float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(fraction*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+// summaries sums up the operations by name
+func (s *stats) summaries() map[string]summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summaries := map[string]summary{}
+	for name, op := range s.operations {
+		sorted := append([]time.Duration{}, op.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		summaries[name] = summary{
+			Count:  len(sorted),
+			Errors: op.errors,
+			P50:    percentile(sorted, 0.50),
+			P95:    percentile(sorted, 0.95),
+			P99:    percentile(sorted, 0.99),
+			Max:    percentile(sorted, 1),
+		}
+	}
+
+	return summaries
+}
+
+// errorRate is the fraction of all requests which failed
+func (s *stats) errorRate() float64 {
+	requests, errors := 0, 0
+	for _, summary := range s.summaries() {
+		requests += summary.Count
+		errors += summary.Errors
+	}
+
+	if requests == 0 {
+		return 0
+	}
+
+	return float64(errors) / float64(requests)
+}
+
+// write prints a table of the operations, followed by the last error of each operation which failed
+func (s *stats) write(w io.Writer, elapsed time.Duration) error {
+	summaries := s.summaries()
+	names := make([]string, 0, len(summaries))
+	for name := range summaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "operation\tcount\terrors\tp50\tp95\tp99\tmax\t")
+	for _, name := range names {
+		sum := summaries[name]
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n", name, sum.Count, sum.Errors,
+			sum.P50.Round(time.Microsecond), sum.P95.Round(time.Microsecond), sum.P99.Round(time.Microsecond),
+			sum.Max.Round(time.Microsecond))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seconds := elapsed.Seconds()
+	if seconds == 0 {
+		seconds = 1
+	}
+	fmt.Fprintf(w, "\n%d boots, %d bytes downloaded (%.0f bytes/s) in %s\n", s.boots, s.bytes,
+		float64(s.bytes)/seconds, elapsed.Round(time.Millisecond))
+
+	for _, name := range names {
+		if op := s.operations[name]; op.errors != 0 {
+			fmt.Fprintf(w, "last error of %s: %s\n", name, op.lastError)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"gorm.io/gorm"
+)
+
+// accessRoute is the route a request for an action on a resource goes through, its roles are checked before the
+// handler decides about the resource itself
+type accessRoute struct {
+	Method string
+	URI    string
+}
+
+// accessRoutes are the routes of each action on images and machines. Booting an image has no route of its own, it
+// is decided when an image setup or a favorite is used.
+var accessRoutes = map[string]map[authz.Action]accessRoute{
+	"image": {
+		authz.Read:  {http.MethodGet, "/image/{uuid}"},
+		authz.Write: {http.MethodPut, "/image/{uuid}"},
+	},
+	"machine": {
+		authz.Read:  {http.MethodGet, "/machine/{mac}"},
+		authz.Write: {http.MethodPut, "/machine"},
+		authz.Boot:  {http.MethodPost, "/machine/{mac}/boot"},
+	},
+}
+
+// accessCheck is the decision about a user doing something with a resource
+type accessCheck struct {
+	User         string
+	ResourceType string
+	ResourceID   string
+	Action       authz.Action
+	authz.Decision
+}
+
+// routeDecision decides about the roles of the route of an action, it allows actions without a route
+func (api_ *API) routeDecision(subject authz.Subject, resourceType string, action authz.Action) authz.Decision {
+	target, ok := accessRoutes[resourceType][action]
+	if !ok {
+		return authz.Decision{Allowed: true}
+	}
+
+	for _, route := range api_.Routes {
+		if route.Method == target.Method && route.URI == target.URI {
+			return authz.Route(subject, route.Permissions)
+		}
+	}
+
+	return authz.Decision{}
+}
+
+// resourceDecision decides about the resource itself, like the handlers do. The resource is not found when it does not
+// exist.
+func (api_ *API) resourceDecision(subject authz.Subject, resourceType string, id string,
+	action authz.Action) (authz.Decision, error) {
+	switch resourceType {
+	case "image":
+		image, err := api_.store.GetImageByUUID(images.ImageUUID(id))
+		if err != nil {
+			return authz.Decision{}, err
+		}
+
+		return authz.Image(subject, image, action), nil
+	case "machine":
+		machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: id})
+		if err != nil || action != authz.Boot {
+			return authz.Decision{Allowed: true}, err
+		}
+
+		return authz.BootMachine(api_.store, subject, machine, time.Now())
+	}
+
+	return authz.Decision{}, nil
+}
+
+// CheckAccess tells whether a user may do something with an image or a machine, and the rules which decided it. It
+// asks the same questions the API asks when the user makes the request: whether the route admits their role, and
+// then about ownership, public images, grants, courses and the scopes of moderators. Moderators who are scoped to
+// courses may only check the members of their courses.
+// Example request: GET /admin/access-check?user=jan&resource_type=machine&resource_id=52:54:00:d9:71:93&action=boot
+// Example response: {"User": "jan", "ResourceType": "machine", "ResourceID": "52:54:00:d9:71:93", "Action": "boot",
+// "Allowed": false, "Rules": [{"Rule": "role", "Matched": true, "Detail": "the route admits user, moderator, admin"},
+// {"Rule": "unrestricted", "Matched": false}, {"Rule": "role", "Matched": false, ...}, ...]}
+func (api_ *API) CheckAccess(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	check := accessCheck{User: query.Get("user"), ResourceType: query.Get("resource_type"),
+		ResourceID: query.Get("resource_id"), Action: authz.Action(query.Get("action"))}
+
+	if _, ok := accessRoutes[check.ResourceType]; !ok {
+		http.Error(w, "resource_type has to be image or machine", http.StatusBadRequest)
+		return
+	}
+
+	if !check.Action.Valid() {
+		http.Error(w, "action has to be read, write or boot", http.StatusBadRequest)
+		return
+	}
+
+	if check.User == "" || check.ResourceID == "" {
+		http.Error(w, "Give the user and the resource_id", http.StatusBadRequest)
+		return
+	}
+
+	u, err := api_.storeFor(r).GetUserByUsername(check.User)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "There is no such user", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the user") != nil {
+		return
+	}
+
+	scopes, err := api_.moderatorScopes(r)
+	if ErrorWrite(w, err, "Cannot fetch the scopes of the moderator") != nil {
+		return
+	}
+
+	if len(scopes) != 0 {
+		scope, err := api_.storeFor(r).GetModeratorScopeOfUser(api_.principal(r).Name, u.Username)
+		if ErrorWrite(w, err, "Cannot fetch the scopes of the moderator") != nil {
+			return
+		} else if scope == "" {
+			http.Error(w, "The user is outside the scope of the moderator", http.StatusForbidden)
+			return
+		}
+	}
+
+	subject := authz.Subject{Username: u.Username, Role: u.Role}
+	resource, err := api_.resourceDecision(subject, check.ResourceType, check.ResourceID, check.Action)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "There is no such "+check.ResourceType, http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot check the access") != nil {
+		return
+	}
+
+	check.Decision = api_.routeDecision(subject, check.ResourceType, check.Action).Then(resource)
+	writeJSON(w, http.StatusOK, check)
+}
+
+// RegisterAccessHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterAccessHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:             "/admin/access-check",
+		Permissions:     []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed:     false,
+		ModeratorScoped: true,
+		Scope:           user.ScopeAdmin,
+		Handler:         api_.CheckAccess,
+		Method:          http.MethodGet,
+		Description:     "Tells whether a user may read, write or boot an image or a machine, and why",
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_AccessCheck(t *testing.T) {
+	store := newTestStore(t)
+
+	users := map[string]*user.UserModel{}
+	for _, u := range []user.UserModel{
+		{Username: "admin", Role: user.Admin},
+		{Username: "ta", Role: user.Moderator},
+		{Username: "alice", Role: user.User},
+		{Username: "bob", Role: user.User},
+	} {
+		u := u
+		u.Email = u.Username + "@example.com"
+		assert.NoError(t, store.CreateUser(&u))
+		users[u.Username] = &u
+	}
+
+	lab := "52:54:00:d9:71:93"
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: "lab",
+		MacAddress: util.MacAddress{Address: lab}, Architecture: machinemodel.X86_64}))
+	assert.NoError(t, store.CreateCourse(&course.CourseModel{Name: "os", Owner: "admin",
+		ExpiresAt: time.Now().Add(30 * 24 * time.Hour), Members: []course.CourseMember{{Username: "alice"}}}))
+	assert.NoError(t, store.AddCourseMachine("os", lab))
+	assert.NoError(t, store.AddModeratorScope("ta", "os"))
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "ubuntu", Username: "bob", UUID: "ubuntu"}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	check := func(caller string, query string) (*httptest.ResponseRecorder, accessCheck) {
+		resp := s.requestAs(users[caller], http.MethodGet, "/admin/access-check?"+query, "")
+
+		var result accessCheck
+		if resp.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp, result
+	}
+
+	// alice boots the machine of her course, bob is not in it
+	resp, result := check("admin", "user=alice&resource_type=machine&resource_id="+lab+"&action=boot")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, result.Allowed)
+	last := result.Rules[len(result.Rules)-1]
+	assert.Equal(t, authz.Rule{Rule: authz.RuleCourse, Matched: true, Detail: "the machine belongs to course os"}, last)
+
+	_, result = check("admin", "user=bob&resource_type=machine&resource_id="+lab+"&action=boot")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, authz.RuleRole, result.Rules[0].Rule)
+	assert.True(t, result.Rules[0].Matched)
+
+	// The check agrees with the boot request itself
+	resp = s.requestAs(users["bob"], http.MethodPost, "/machine/"+lab+"/boot", "")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// Only administrators change machines, the route decides before the machine is looked at
+	_, result = check("admin", "user=alice&resource_type=machine&resource_id="+lab+"&action=write")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, []authz.Rule{{Rule: authz.RuleRole, Detail: "the route admits admin"}}, result.Rules)
+
+	// Images are read by their owner, and booted by everyone once they are public
+	_, result = check("admin", "user=bob&resource_type=image&resource_id=ubuntu&action=read")
+	assert.True(t, result.Allowed)
+	_, result = check("admin", "user=alice&resource_type=image&resource_id=ubuntu&action=boot")
+	assert.False(t, result.Allowed)
+	assert.Len(t, result.Rules, 3)
+
+	// A scoped moderator only checks the members of their courses
+	resp, _ = check("ta", "user=alice&resource_type=image&resource_id=ubuntu&action=write")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp, _ = check("ta", "user=bob&resource_type=image&resource_id=ubuntu&action=write")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp, _ = check("alice", "user=alice&resource_type=image&resource_id=ubuntu&action=write")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	for query, code := range map[string]int{
+		"user=alice&resource_type=disk&resource_id=ubuntu&action=read":     http.StatusBadRequest,
+		"user=alice&resource_type=image&resource_id=ubuntu&action=delete":  http.StatusBadRequest,
+		"user=alice&resource_type=image&action=read":                       http.StatusBadRequest,
+		"user=nobody&resource_type=image&resource_id=ubuntu&action=read":   http.StatusNotFound,
+		"user=alice&resource_type=image&resource_id=missing&action=read":   http.StatusNotFound,
+		"user=alice&resource_type=machine&resource_id=missing&action=boot": http.StatusNotFound,
+	} {
+		resp, _ := check("admin", query)
+		assert.Equal(t, code, resp.Code, query)
+	}
+}
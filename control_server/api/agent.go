@@ -0,0 +1,348 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// agentName restricts architectures and versions to names which are safe to use as file names
+var agentName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// agentReleases are the releases of the agent and how they are rolled out, as shown to administrators
+type agentReleases struct {
+	Releases []agent.Release
+	Channels []agent.Channel
+}
+
+// agentPath is where a release of the agent is stored
+func (api_ *API) agentPath(architecture string, version string) string {
+	return filepath.Join(api_.diskpath, "agent", architecture, version)
+}
+
+// getAgentName fetches a part of the URI which names a release and answers the request when it is not valid
+func getAgentName(tag string, w http.ResponseWriter, r *http.Request) (string, error) {
+	name, err := GetTag(tag, r)
+	if TagErrorWrite(w, err) != nil {
+		return "", err
+	}
+
+	if !agentName.MatchString(name) {
+		http.Error(w, "invalid "+tag, http.StatusBadRequest)
+		return "", errors.New("invalid " + tag)
+	}
+
+	return name, nil
+}
+
+// verifyAgentSignature checks the signature of the digest of a release against the configured key
+func (api_ *API) verifyAgentSignature(digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("the signature is not a base64 encoded Ed25519 signature")
+	}
+
+	if api_.config.AgentPublicKey == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(api_.config.AgentPublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("the configured agent public key is not a base64 encoded Ed25519 key")
+	}
+
+	if !ed25519.Verify(key, digest, sig) {
+		return errors.New("the signature does not match the release")
+	}
+
+	return nil
+}
+
+// UploadAgent stores a new signed release of the management OS agent
+// Example request: POST admin/agent/amd64/1.4.0 -H "X-BAAS-Signature: 3q2+7w..." --data-binary @entrypoint
+// Example response: {"Architecture": "amd64", "Version": "1.4.0", "Size": 10485760, "SHA256": "9f86d0...",
+//
+//	"Signature": "3q2+7w...", "CreatedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) UploadAgent(w http.ResponseWriter, r *http.Request) {
+	architecture, err := getAgentName("arch", w, r)
+	if err != nil {
+		return
+	}
+
+	version, err := getAgentName("version", w, r)
+	if err != nil {
+		return
+	}
+
+	// Releases are never replaced, agents which already verified one would otherwise run something else
+	_, err = api_.storeFor(r).GetAgentRelease(architecture, version)
+	if err == nil {
+		http.Error(w, "this version has already been released", http.StatusConflict)
+		return
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		_ = ErrorWrite(w, err, "Cannot fetch the release")
+		return
+	}
+
+	path := api_.agentPath(architecture, version)
+	if ErrorWrite(w, os.MkdirAll(filepath.Dir(path), os.ModePerm), "Cannot store the release") != nil {
+		return
+	}
+
+	done, ok := api_.admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	dest, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if ErrorWrite(w, err, "Cannot store the release") != nil {
+		return
+	}
+
+	hash := sha256.New()
+	size, err := fs.Copy(io.MultiWriter(dest, hash), r.Body)
+	if cerr := dest.Close(); cerr != nil {
+		log.Errorf("Cannot close the release: %v", cerr)
+	}
+
+	if ErrorWrite(w, err, "Cannot store the release") != nil {
+		_ = os.Remove(path + ".part")
+		return
+	}
+
+	signature := r.Header.Get("X-BAAS-Signature")
+	if err = api_.verifyAgentSignature(hash.Sum(nil), signature); err != nil {
+		_ = os.Remove(path + ".part")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Warnf("Refused agent release %s for %s: %v", version, architecture, err)
+		return
+	}
+
+	if ErrorWrite(w, os.Rename(path+".part", path), "Cannot store the release") != nil {
+		return
+	}
+
+	release := agent.Release{
+		Architecture: architecture,
+		Version:      version,
+		Size:         uint64(size),
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		Signature:    signature,
+	}
+	if StoreErrorWrite(w, api_.storeFor(r).CreateAgentRelease(&release), "Cannot store the release") != nil {
+		_ = os.Remove(path)
+		return
+	}
+
+	log.Infof("Released version %s of the agent for %s", version, architecture)
+	writeJSON(w, http.StatusCreated, release)
+}
+
+// GetAgentReleases lists every release of the agent together with the channels of each architecture
+// Example request: GET admin/agents
+// Example response: {"Releases": [{"Architecture": "amd64", "Version": "1.4.0", ...}],
+//
+//	"Channels": [{"Architecture": "amd64", "Default": "1.3.2", "Canary": "1.4.0", "CanaryPercent": 10,
+//	              "CanaryMachines": ["52:54:00:d9:71:93"]}]}
+func (api_ *API) GetAgentReleases(w http.ResponseWriter, _ *http.Request) {
+	releases, err := api_.store.GetAgentReleases()
+	if ErrorWrite(w, err, "Cannot fetch the releases") != nil {
+		return
+	}
+
+	channels, err := api_.store.GetAgentChannels()
+	if ErrorWrite(w, err, "Cannot fetch the channels") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, agentReleases{Releases: releases, Channels: channels})
+}
+
+// SetAgentChannel decides which release the machines of an architecture run, setting an older version as the
+// default downgrades them.
+// Example request: PUT admin/agent/amd64/channel {"Default": "1.3.2", "Canary": "1.4.0", "CanaryPercent": 10}
+// Example response: {"Architecture": "amd64", "Default": "1.3.2", "Canary": "1.4.0", "CanaryPercent": 10,
+//
+//	"CanaryMachines": []}
+func (api_ *API) SetAgentChannel(w http.ResponseWriter, r *http.Request) {
+	architecture, err := getAgentName("arch", w, r)
+	if err != nil {
+		return
+	}
+
+	var channel agent.Channel
+	if err = json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		http.Error(w, "invalid channel", http.StatusBadRequest)
+		return
+	}
+	channel.Architecture = architecture
+
+	if channel.CanaryPercent > 100 {
+		http.Error(w, "the canary percentage can be at most 100", http.StatusBadRequest)
+		return
+	}
+
+	for _, version := range []string{channel.Default, channel.Canary} {
+		if version == "" {
+			continue
+		}
+
+		_, err = api_.storeFor(r).GetAgentRelease(architecture, version)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, fmt.Sprintf("version %s has not been released for %s", version, architecture),
+				http.StatusBadRequest)
+			return
+		} else if ErrorWrite(w, err, "Cannot fetch the release") != nil {
+			return
+		}
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).SetAgentChannel(&channel), "Cannot store the channel") != nil {
+		return
+	}
+
+	log.Infof("Agent channel of %s: default %q, canary %q for %d%% and %d machines", architecture,
+		channel.Default, channel.Canary, channel.CanaryPercent, len(channel.CanaryMachines))
+	writeJSON(w, http.StatusOK, channel)
+}
+
+// GetAgentUpdate tells the agent on a machine which release it should run
+// Example request: GET agent/latest?arch=amd64&mac=52:54:00:d9:71:93
+// Example response: {"Version": "1.4.0", "Architecture": "amd64", "URL": "/agent/amd64/1.4.0", "Size": 10485760,
+//
+//	"SHA256": "9f86d0...", "Signature": "3q2+7w...", "Canary": true}
+func (api_ *API) GetAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	architecture := r.URL.Query().Get("arch")
+	if !agentName.MatchString(architecture) {
+		http.Error(w, "invalid arch", http.StatusBadRequest)
+		return
+	}
+
+	mac := r.URL.Query().Get("mac")
+	channel, err := api_.storeFor(r).GetAgentChannel(architecture)
+	if ErrorWrite(w, err, "Cannot fetch the channel") != nil {
+		return
+	}
+
+	version := channel.VersionFor(mac)
+	if version == "" {
+		http.Error(w, "no release of the agent for "+architecture, http.StatusNotFound)
+		return
+	}
+
+	release, err := api_.storeFor(r).GetAgentRelease(architecture, version)
+	if ErrorWrite(w, err, "Cannot fetch the release") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, agent.Update{
+		Version:      release.Version,
+		Architecture: release.Architecture,
+		URL:          fmt.Sprintf("/agent/%s/%s", release.Architecture, release.Version),
+		Size:         release.Size,
+		SHA256:       release.SHA256,
+		Signature:    release.Signature,
+		Canary:       channel.IsCanary(mac),
+	})
+}
+
+// DownloadAgent serves a release of the agent
+// Example request: GET agent/amd64/1.4.0
+func (api_ *API) DownloadAgent(w http.ResponseWriter, r *http.Request) {
+	architecture, err := getAgentName("arch", w, r)
+	if err != nil {
+		return
+	}
+
+	version, err := getAgentName("version", w, r)
+	if err != nil {
+		return
+	}
+
+	if _, err = api_.storeFor(r).GetAgentRelease(architecture, version); err != nil {
+		http.Error(w, "cannot find the release", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, api_.agentPath(architecture, version))
+}
+
+// RegisterAgentHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterAgentHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/agents",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetAgentReleases,
+		Method:      http.MethodGet,
+		Description: "Lists the releases of the management OS agent",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/agent/{arch}/channel",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetAgentChannel,
+		Method:      http.MethodPut,
+		Schema:      "agent-channel",
+		Description: "Sets which release of the management OS agent the machines run",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/agent/{arch}/{version}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.UploadAgent,
+		Method:      http.MethodPost,
+		Schema:      schemaFile,
+		Description: "Uploads a signed release of the management OS agent",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/agent/latest",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetAgentUpdate,
+		Method:      http.MethodGet,
+		Description: "Gets the release of the management OS agent a machine should run",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/agent/{arch}/{version}",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.DownloadAgent,
+		Method:      http.MethodGet,
+		Description: "Downloads a release of the management OS agent",
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_AgentReleases(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "agent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	conf := config.Default()
+	conf.AgentPublicKey = base64.StdEncoding.EncodeToString(public)
+	s := newTestServer(t, store, diskpath, conf)
+
+	signed := func(binary string) http.Header {
+		digest := sha256.Sum256([]byte(binary))
+		return http.Header{"X-BAAS-Signature": {base64.StdEncoding.EncodeToString(ed25519.Sign(private, digest[:]))}}
+	}
+
+	// Nothing is released yet
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/agent/latest?arch=amd64&mac=aa", "").Code)
+
+	assert.Equal(t, http.StatusCreated, s.requestWith(signed("old"), http.MethodPost, "/admin/agent/amd64/1.0",
+		"old").Code)
+	assert.Equal(t, http.StatusCreated, s.requestWith(signed("new"), http.MethodPost, "/admin/agent/amd64/2.0",
+		"new").Code)
+	assert.Equal(t, http.StatusConflict, s.requestWith(signed("new"), http.MethodPost, "/admin/agent/amd64/2.0",
+		"new").Code)
+
+	// Releases signed with another key, or not at all, are refused
+	assert.Equal(t, http.StatusBadRequest, s.requestWith(signed("new"), http.MethodPost, "/admin/agent/amd64/3.0",
+		"bad").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/admin/agent/amd64/3.0", "bad").Code)
+	_, err = os.Stat(diskpath + "/agent/amd64/3.0")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/admin/agent/amd64/channel",
+		`{"Default": "1.0", "Canary": "3.0"}`).Code)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/admin/agent/amd64/channel",
+		`{"Default": "1.0", "Canary": "2.0", "CanaryMachines": ["AA"]}`).Code)
+
+	latest := func(mac string) agent.Update {
+		resp := s.request(http.MethodGet, "/agent/latest?arch=amd64&mac="+mac, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var update agent.Update
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&update))
+		return update
+	}
+
+	// The canary machines get the new release, the others the default one
+	update := latest("aa")
+	assert.Equal(t, "2.0", update.Version)
+	assert.True(t, update.Canary)
+	assert.Equal(t, "old", s.request(http.MethodGet, latest("bb").URL, "").Body.String())
+	assert.Equal(t, "new", s.request(http.MethodGet, update.URL, "").Body.String())
+
+	digest := sha256.Sum256([]byte("new"))
+	signature, err := base64.StdEncoding.DecodeString(update.Signature)
+	assert.NoError(t, err)
+	assert.True(t, ed25519.Verify(public, digest[:], signature))
+
+	// Every machine is a canary at 100 percent, and downgrading is re-tagging an older version
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/admin/agent/amd64/channel",
+		`{"Default": "1.0", "Canary": "2.0", "CanaryPercent": 100}`).Code)
+	assert.Equal(t, "2.0", latest("bb").Version)
+
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/admin/agent/amd64/channel", `{"Default": "1.0"}`).Code)
+	assert.Equal(t, "1.0", latest("aa").Version)
+
+	resp := s.request(http.MethodGet, "/admin/agents", "")
+	var releases agentReleases
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&releases))
+	assert.Len(t, releases.Releases, 2)
+	assert.Len(t, releases.Channels, 1)
+}
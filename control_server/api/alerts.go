@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/notify"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// notifyTestResult is the response to a test notification
+type notifyTestResult struct {
+	Channel string
+	Sent    bool
+	Error   string `json:",omitempty"`
+}
+
+// alert tells the operators about an event through the channels NotifyRoutes send it to. It does not wait for the
+// channels, so a slow webhook holds up neither the request nor the janitor.
+func (api_ *API) alert(event string, key string, subject string, body string) {
+	go api_.alerts.Publish(notify.Message{Event: event, Key: key, Subject: subject, Body: body})
+}
+
+// alertExceeded tells the operators that a request of a user was refused because of their limits
+func (api_ *API) alertExceeded(username string, reason string) {
+	api_.alert(config.EventQuotaExceeded, username, fmt.Sprintf("%s ran into a limit", username),
+		fmt.Sprintf("A request of %s was refused: %s.", username, reason))
+}
+
+// TestNotification sends a message to one of the NotifyChannels, to check that it is configured correctly. The
+// routes and their rate limits do not apply. When the channel refuses the message the response is 502 Bad Gateway
+// and tells why.
+// Example request: POST /admin/notify/test?channel=ops
+// Example response: {"Channel": "ops", "Sent": true}
+func (api_ *API) TestNotification(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("channel")
+	if name == "" {
+		http.Error(w, "Give the channel to test with ?channel=", http.StatusBadRequest)
+		return
+	}
+
+	err := api_.alerts.Test(name)
+	if errors.Is(err, notify.ErrUnknownChannel) {
+		http.Error(w, "The channel is not in NotifyChannels", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		requestLog(r).Warnf("Test notification to %s failed: %v", name, err)
+		writeJSON(w, http.StatusBadGateway, notifyTestResult{Channel: name, Error: err.Error()})
+		return
+	}
+
+	requestLog(r).Infof("Sent a test notification to %s", name)
+	writeJSON(w, http.StatusOK, notifyTestResult{Channel: name, Sent: true})
+}
+
+// RegisterNotifyHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterNotifyHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/notify/test",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.TestNotification,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Sends a test message to a notification channel",
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// chatServer records the messages posted to a webhook or a Matrix room
+type chatServer struct {
+	lock     sync.Mutex
+	messages []string
+	requests []*http.Request
+}
+
+func (c *chatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests = append(c.requests, r)
+	c.messages = append(c.messages, body["text"]+body["body"])
+}
+
+func (c *chatServer) received() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.messages...)
+}
+
+func TestApi_Notifications(t *testing.T) {
+	mattermost, matrix := &chatServer{}, &chatServer{}
+	mattermostServer := httptest.NewServer(mattermost)
+	defer mattermostServer.Close()
+	matrixServer := httptest.NewServer(matrix)
+	defer matrixServer.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such hook", http.StatusNotFound)
+	}))
+	defer broken.Close()
+
+	conf := config.Default()
+	conf.NotifyChannels = map[string]config.NotifyChannel{
+		"ops":    {Kind: config.NotifyWebhook, URL: mattermostServer.URL, Template: "[{{.Event}}] {{.Subject}}"},
+		"matrix": {Kind: config.NotifyMatrix, URL: matrixServer.URL + "/", Room: "!ops:example.org", Token: "secret"},
+		"broken": {Kind: config.NotifyWebhook, URL: broken.URL},
+	}
+	conf.NotifyRoutes = []config.NotifyRoute{
+		{Events: []string{config.EventBootFailure}, Channels: []string{"ops", "matrix"}, RateLimit: 2,
+			RateLimitMinutes: 60},
+		{Events: []string{config.EventBootFailure, config.EventScrubCorruption}, Channels: []string{"ops"}},
+	}
+	assert.NoError(t, conf.Validate())
+
+	store := newTestStore(t)
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, test} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+	for _, mac := range []string{"abc", "def"} {
+		assert.NoError(t, store.CreateMachine(&machine.MachineModel{Name: mac, MacAddress: util.MacAddress{Address: mac}}))
+	}
+
+	s := newTestServer(t, store, "/tmp", conf)
+
+	// Testing a channel does not go through the routes
+	resp := s.requestAs(admin, http.MethodPost, "/admin/notify/test?channel=matrix", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"Channel": "matrix", "Sent": true}`, resp.Body.String())
+	assert.Equal(t, []string{"Test notification from BAAS\nThe channel matrix of the BAAS control server works."},
+		matrix.received())
+	assert.Equal(t, "Bearer secret", matrix.requests[0].Header.Get("Authorization"))
+	assert.Equal(t, http.MethodPut, matrix.requests[0].Method)
+	assert.True(t, strings.HasPrefix(matrix.requests[0].URL.EscapedPath(),
+		"/_matrix/client/v3/rooms/%21ops:example.org/send/m.room.message/baas-"), matrix.requests[0].URL.EscapedPath())
+	assert.Empty(t, mattermost.received())
+
+	resp = s.requestAs(admin, http.MethodPost, "/admin/notify/test?channel=broken", "")
+	assert.Equal(t, http.StatusBadGateway, resp.Code)
+	assert.Contains(t, resp.Body.String(), "no such hook")
+	assert.Equal(t, http.StatusNotFound, s.requestAs(admin, http.MethodPost, "/admin/notify/test?channel=none", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(admin, http.MethodPost, "/admin/notify/test", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(test, http.MethodPost, "/admin/notify/test?channel=ops", "").Code)
+
+	// A machine failing its boots over and over only makes it through the rate limit twice. The route without a
+	// limit sends to ops as well, which hears about every failure once.
+	fail := func(mac string) {
+		assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: mac, SetupUUID: "setup",
+			State: images.BootInProgress, LastSeen: time.Now()}))
+		assert.Equal(t, http.StatusOK, s.requestAs(nil, http.MethodPut, "/machine/"+mac+"/boot/state",
+			`{"State": "failed", "FailureReason": "write_error", "FailureDetail": "disk full"}`).Code)
+	}
+	for i := 0; i < 3; i++ {
+		fail("abc")
+	}
+	fail("def")
+
+	// Matrix got the test message, two failures of abc and the one of def
+	assert.Eventually(t, func() bool { return len(mattermost.received()) == 4 && len(matrix.received()) == 4 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, mattermost.received(), "[boot_failure] Boot of abc failed")
+	assert.Contains(t, matrix.received(), "Boot of def failed\nThe boot of image setup setup on def failed (write_error): "+
+		"disk full")
+
+	// Events which are not routed anywhere are dropped
+	s.api.alertExceeded("test", "limit MaxActiveBoots of 5 exceeded")
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, mattermost.received(), 4)
+}
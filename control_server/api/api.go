@@ -9,12 +9,24 @@ package api
 
 import (
 	"fmt"
-	"math/rand"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/control_server/builder"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/downloads"
+	"github.com/baas-project/baas/control_server/logtail"
+	"github.com/baas-project/baas/control_server/nbd"
+	"github.com/baas-project/baas/control_server/notify"
 	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/user"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
 )
 
 /*func NewAPI(store database.Store, diskpath path) *API {
@@ -28,52 +40,246 @@ import (
 type API struct {
 	store    database.Store
 	diskpath string
+	config   *config.Config
 	session  *sessions.CookieStore
 	Routes   []Route
+
+	// downloads limits the image downloads which stream at once and the bandwidth they use
+	downloads *downloads.Coordinator
+	// cache keeps copies of the downloaded versions on a fast disk, it is nil when that is disabled
+	cache *downloads.Cache
+	// uploads holds a token for every upload which is streaming, it is nil when they are not limited
+	uploads chan struct{}
+	// peers plans which machines download images from one another, it is nil when that is disabled
+	peers *peerTracker
+	// providers are the OAuth providers users can log in with
+	providers map[user.OAuthProvider]*oauthProvider
+	// devLogin serves the dev login provider, it is nil unless DevLogin is enabled
+	devLogin *devLogin
+	// frontends are the web frontends which may call the API from the browser and which logins return to
+	frontends frontends
+	// proxies are the trusted proxies whose X-Forwarded-For header tells the address of the client
+	proxies []*net.IPNet
+	// touches keeps track of when the use of the sessions was last recorded
+	touches *sessionTouches
+	// users caches the current roles of the users, the roles in the sessions may be outdated
+	users *userCache
+	// stats are the statistics last served to the admin dashboard
+	stats *statsCache
+	// reports are the usage reports last served, per period
+	reports *usageCache
+	// directory is where the LDAP synchronization finds the users, it is read from the configuration when nil
+	directory memberDirectory
+	// exports serves image versions over NBD for diskless boots, it is nil when that is disabled
+	exports *nbd.Server
+	// builds turns container images and root file systems into new versions of images
+	builds *builder.Queue
+	// moves keeps the migrations of images between storage tiers apart from the requests writing their files
+	moves *tierMoves
+	// rebalancing moves the images of the flat layout into the shards of their tier
+	rebalancing *rebalancer
+	// manifests hash the blocks of versions in the background, for the comparisons of versions
+	manifests *manifestJobs
+	// jobs are the uploads and other work which users follow through GET /jobs/{id} and GET /events
+	jobs *jobTracker
+	// comparisons are the last comparisons of versions, by the checksums of the versions they compared
+	comparisons *comparisonCache
+	// scrub reads the stored versions back to find the ones which no longer match their checksum
+	scrub *scrubber
+	// backups copy the versions of the images with a backup policy to their targets
+	backups *backupWorker
+	// notifier tells users about what happens to their images
+	notifier notify.Notifier
+	// alerts tells the operators about the events NotifyRoutes send to their channels
+	alerts *notify.Router
+	// agents counts the machines by the release of the agent they last checked in with
+	agents *agentTracker
+	// webhooks posts the events of the images to their webhooks
+	webhooks *webhookSender
+	// logs keeps the last log entries for the admins, it is nil when LogBufferEntries is zero
+	logs *logtail.Buffer
+	// replica tells whether the database is a copy of another control server, the API only serves reads then
+	replica *replicaState
+	// enqueue keeps the boots which are queued at the same time apart, so they cannot both pass the limits
+	enqueue sync.Mutex
+	// janitor keeps the runs of the janitor in the background and the ones asked for by admins apart
+	janitor sync.Mutex
 }
 
-// NewAPI creates a new API struct.
-func NewAPI(store database.Store, diskpath string) *API {
-	session := sessions.NewCookieStore([]byte(fmt.Sprint(rand.Intn(2_000_000))))
+// sameSiteModes are the SameSite attributes of the session cookie, by SessionCookieSameSite
+var sameSiteModes = map[string]http.SameSite{
+	"":                    http.SameSiteDefaultMode,
+	config.SameSiteLax:    http.SameSiteLaxMode,
+	config.SameSiteStrict: http.SameSiteStrictMode,
+	config.SameSiteNone:   http.SameSiteNoneMode,
+}
+
+// newSessionStore keeps the sessions in cookies sealed with SessionKeys. Cookies sealed with any of the keys are
+// accepted, so sessions outlive restarts and key rotations until one of their keys is removed.
+func newSessionStore(conf *config.Config) *sessions.CookieStore {
+	// The configuration was validated when it was loaded, only configurations made up in code can fail here
+	keys, err := conf.SessionKeyPairs()
+	if err != nil {
+		log.Errorf("Not using SessionKeys: %v", err)
+	}
+
+	if len(keys) == 0 {
+		log.Warn("No SessionKeys are configured, the sessions end when the control server restarts")
+		keys = [][]byte{securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)}
+	}
+
+	session := sessions.NewCookieStore(keys...)
 	session.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600 * 8,
-		HttpOnly: true,
+		Path:     conf.SessionCookiePath,
+		Secure:   conf.SecureSessionCookie(),
+		HttpOnly: conf.SessionCookieHTTPOnly,
+		SameSite: sameSiteModes[conf.SessionCookieSameSite],
+	}
+	session.MaxAge(int(conf.SessionCookieMaxAgeHours) * 3600)
+	return session
+}
+
+// NewAPI creates a new API struct.
+func NewAPI(store database.Store, diskpath string, conf *config.Config) *API {
+	session := newSessionStore(conf)
+
+	var peers *peerTracker
+	if conf.PeerDistribution {
+		peers = newPeerTracker(int(conf.PeerServerSeeds), int(conf.PeerMaxUploads))
+	}
+
+	var dev *devLogin
+	if conf.DevLogin && conf.Production {
+		log.Error("Not enabling DevLogin, since this is a production deployment")
+	} else if conf.DevLogin {
+		log.Warn("DevLogin is enabled, anyone can log in as anyone")
+		dev = newDevLogin(conf.DevLoginURL)
+	}
+
+	// The configuration was validated when it was loaded, only configurations made up in code can fail here
+	alerts, err := notify.NewRouter(conf)
+	if err != nil {
+		log.Errorf("Not sending notifications to the operators: %v", err)
+		alerts = &notify.Router{}
+	}
+
+	var cache *downloads.Cache
+	if conf.DownloadCacheDir != "" {
+		if cache, err = downloads.NewCache(conf.DownloadCacheDir, int64(conf.DownloadCacheBytes)); err != nil {
+			log.Errorf("Not caching the downloads: %v", err)
+		}
+	}
+
+	var exports *nbd.Server
+	if conf.NBDEnabled {
+		exports = nbd.NewServer(time.Duration(conf.NBDIdleMinutes) * time.Minute)
 	}
 
-	return &API{
+	var logs *logtail.Buffer
+	if conf.LogBufferEntries != 0 {
+		logs = logtail.New(int(conf.LogBufferEntries), int(conf.LogBufferBytes))
+	}
+
+	webhooks := newWebhookSender(time.Duration(conf.WebhookTimeoutSeconds)*time.Second,
+		int(conf.WebhookDeliveriesKept))
+
+	api_ := &API{
 		store:    store,
 		diskpath: diskpath,
+		config:   conf,
 		session:  session,
+		downloads: downloads.NewCoordinator(int(conf.DownloadMaxActive), int(conf.DownloadMaxQueued),
+			conf.DownloadBytesPerSecond),
+		cache:       cache,
+		uploads:     newUploadSlots(conf.UploadMaxActive),
+		peers:       peers,
+		providers:   loginProviders(conf.PublicURL, dev),
+		devLogin:    dev,
+		frontends:   newFrontends(conf),
+		proxies:     parseProxies(conf.TrustedProxies),
+		touches:     newSessionTouches(),
+		users:       newUserCache(),
+		stats:       &statsCache{},
+		reports:     &usageCache{},
+		exports:     exports,
+		moves:       newTierMoves(),
+		rebalancing: &rebalancer{},
+		manifests:   newManifestJobs(),
+		jobs:        newJobTracker(),
+		comparisons: newComparisonCache(),
+		scrub:       newScrubber(conf.ScrubBytesPerSecond),
+		backups:     newBackupWorker(),
+		notifier:    notify.New(conf),
+		alerts:      alerts,
+		agents:      newAgentTracker(),
+		webhooks:    webhooks,
+		logs:        logs,
+		replica:     &replicaState{},
 	}
+
+	// The builds register their versions through the API
+	api_.builds = api_.newBuildQueue(conf)
+	return api_
 }
 
 // CheckRole verifies whether a user is allowed to use this particular route or not.
 // lint:
 func (api_ *API) CheckRole(route Route, next http.HandlerFunc) http.HandlerFunc { // nolint
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: dear god, security here needs to be done beter.
-		if r.Header.Get("type") == "system" {
-			next.ServeHTTP(w, r)
+		principal, err := api_.resolvePrincipal(r)
+		if refusePrincipal(w, err) {
 			return
 		}
-		// else if !route.UserAllowed {
-		// 	http.Error(w, "Users are not allowed to access this endpoint", http.StatusBadRequest)
-		// 	return
-		// }
+		r = withPrincipal(r, principal)
 
-		session, _ := api_.session.Get(r, "session-name")
-		role, ok := session.Values["Role"].(string)
+		switch principal.Kind {
+		case PrincipalMachine:
+			if !api_.permits(principal, route) {
+				http.Error(w, "The replica may only read", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		case PrincipalAnonymous:
+			// Visitors without a session are only let through in demo mode, and only on routes which opted in.
+			if api_.permits(principal, route) {
+				next.ServeHTTP(w, r)
+				return
+			}
 
-		if !ok {
 			http.Error(w, "User's role not found", http.StatusNotFound)
 			return
 		}
 
-		found := false
-		for _, b := range route.Permissions {
-			if role == string(b) {
-				found = true
+		session, _ := api_.session.Get(r, api_.config.SessionCookieName)
+		api_.touchSession(r, session)
+		role := principal.Role
+
+		// Scoped tokens only reach the part of what their owner may do they were made for
+		if needed := route.requiredScope(); !principal.scoped(needed) {
+			http.Error(w, fmt.Sprintf("The token is not scoped for this route, it needs the scope %s", needed),
+				http.StatusForbidden)
+			return
+		}
+
+		found := authz.Admits(route.Permissions, role)
+		userPermitted := authz.Admits(route.Permissions, user.User)
+
+		// Routes users may use as well need no moderator powers, on the others scoped moderators only moderate
+		// the members of their courses
+		if found && role == user.Moderator && !userPermitted {
+			scope, err := api_.scopeModerator(route, r)
+			if err != nil {
+				log.Errorf("Cannot look up the scope of the moderator: %v", err)
+				http.Error(w, "Cannot look up the scope of the moderator", http.StatusInternalServerError)
+				return
+			}
+
+			if scope == "" {
+				found = false
+			} else {
+				r = auditModerator(r, api_.sessionUsername(r), scope)
 			}
 		}
 
@@ -88,6 +294,12 @@ func (api_ *API) CheckRole(route Route, next http.HandlerFunc) http.HandlerFunc
 	}
 }
 
+// isAdmin reports whether the request was made by an administrator or the system itself
+func (api_ *API) isAdmin(r *http.Request) bool {
+	principal := api_.principal(r)
+	return principal.Kind == PrincipalMachine || (principal.Kind == PrincipalUser && principal.Role == user.Admin)
+}
+
 // checkSameUser checks if this resource is owned by the same issue. It only works for when the user is in the URI, database needs to be checked manually
 func checkSameUser(route Route, _ http.ResponseWriter, r *http.Request, api *API) bool {
 	// Check if the same user exception applies this method
@@ -95,10 +307,8 @@ func checkSameUser(route Route, _ http.ResponseWriter, r *http.Request, api *API
 		return false
 	}
 
-	session, _ := api.session.Get(r, "session-name")
-	username, ok := session.Values["Username"].(string)
-
-	if !ok {
+	username := api.sessionUsername(r)
+	if username == "" {
 		return false
 	}
 
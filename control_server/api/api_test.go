@@ -0,0 +1,119 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_AnonymousAccess(t *testing.T) {
+	store := newTestStore(t)
+
+	request := func(s *testServer, method string, uri string) int {
+		return s.serve(httptest.NewRequest(method, uri, nil)).Code
+	}
+
+	// Without demo mode nothing is accessible without a session
+	closed := newTestServer(t, store, "/tmp", config.Default())
+	assert.Equal(t, http.StatusNotFound, request(closed, http.MethodGet, "/machines"))
+
+	conf := config.Default()
+	conf.AnonymousAccess = true
+	demo := newTestServer(t, store, "/tmp", conf)
+	assert.Equal(t, http.StatusOK, request(demo, http.MethodGet, "/machines"))
+	assert.Equal(t, http.StatusOK, request(demo, http.MethodGet, "/images/public"))
+	assert.Equal(t, http.StatusOK, request(demo, http.MethodGet, "/version"))
+
+	// Routes which did not opt in stay closed
+	assert.Equal(t, http.StatusNotFound, request(demo, http.MethodGet, "/users"))
+	assert.Equal(t, http.StatusNotFound, request(demo, http.MethodPost, "/machine"))
+}
+
+func TestRoute_CheckAnonymous(t *testing.T) {
+	ok := Route{URI: "/machines", Method: http.MethodGet, AnonymousAllowed: true}
+	assert.NoError(t, ok.checkAnonymous())
+
+	mutating := Route{URI: "/machine", Method: http.MethodPost, AnonymousAllowed: true}
+	assert.Error(t, mutating.checkAnonymous())
+
+	role := Route{URI: "/users", Method: http.MethodGet, Permissions: []user.UserRole{user.Anonymous}}
+	assert.Error(t, role.checkAnonymous())
+}
+
+func TestRouter_MethodsAndSlashes(t *testing.T) {
+	store := newTestStore(t)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	// Requests without a session are refused before any handler runs
+	request := func(method string, uri string) *httptest.ResponseRecorder {
+		return s.serve(httptest.NewRequest(method, uri, nil))
+	}
+
+	// The templates are filled in with a value which matches any variable and no fixed part of a path
+	variable := regexp.MustCompile(`{[^}]+}`)
+	templates := map[string]*regexp.Regexp{}
+	for _, route := range s.api.Routes {
+		templates[route.URI] = regexp.MustCompile("^" + variable.ReplaceAllString(route.URI, "[^/]+") + "$")
+	}
+
+	for _, route := range s.api.Routes {
+		path := variable.ReplaceAllString(route.URI, "x0")
+		accepted := map[string]bool{}
+		for _, other := range s.api.Routes {
+			if templates[other.URI].MatchString(path) {
+				accepted[other.Method] = true
+			}
+		}
+
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete,
+			http.MethodPatch} {
+			resp := request(method, path)
+			if accepted[method] {
+				assert.NotEqual(t, http.StatusMethodNotAllowed, resp.Code, "%s %s", method, path)
+				assert.NotContains(t, resp.Body.String(), "there is no such route", "%s %s", method, path)
+				continue
+			}
+
+			if !assert.Equal(t, http.StatusMethodNotAllowed, resp.Code, "%s %s", method, path) {
+				continue
+			}
+
+			var body routeError
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body), "%s %s", method, path)
+			assert.Equal(t, method, body.Method)
+			assert.Contains(t, body.Allowed, http.MethodOptions)
+			for allowed := range accepted {
+				assert.Contains(t, body.Allowed, allowed, "%s %s", method, path)
+			}
+			assert.Equal(t, strings.Join(body.Allowed, ", "), resp.Header().Get("Allow"))
+		}
+
+		resp := request(http.MethodOptions, path)
+		assert.Equal(t, http.StatusNoContent, resp.Code, "OPTIONS %s", path)
+		assert.Contains(t, resp.Header().Get("Allow"), route.Method, "OPTIONS %s", path)
+	}
+
+	// A trailing slash reaches the same route instead of redirecting
+	assert.Equal(t, request(http.MethodGet, "/users").Code, request(http.MethodGet, "/users/").Code)
+	resp := request(http.MethodPost, "/users/")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, "GET, OPTIONS", resp.Header().Get("Allow"))
+
+	resp = request(http.MethodGet, "/no/such/route")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	var body routeError
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+	assert.Equal(t, routeError{Error: "there is no such route", Method: http.MethodGet, Path: "/no/such/route"}, body)
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// artifactExpiryInterval is how often the artifacts which outlived their retention period are removed
+const artifactExpiryInterval = time.Hour
+
+// artifactDir holds the files of the artifacts attached to the boots of a machine, it goes with the machine
+func artifactDir(diskpath string, mac string) string {
+	return filepath.Join(diskpath, "artifacts", mac)
+}
+
+// artifactPath is where the content of an artifact is stored
+func artifactPath(diskpath string, artifact *images.BootArtifact) string {
+	return filepath.Join(artifactDir(diskpath, artifact.MachineMAC),
+		fmt.Sprintf("%d-%d", artifact.BootHistoryID, artifact.ID))
+}
+
+// ExpireBootArtifacts removes the artifacts which were attached before the retention period started
+func ExpireBootArtifacts(store database.Store, diskpath string, retention time.Duration) error {
+	expired, err := store.DeleteBootArtifactsBefore(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+
+	for i := range expired {
+		if err = os.Remove(artifactPath(diskpath, &expired[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if len(expired) != 0 {
+		log.Infof("Removed %d expired boot artifacts", len(expired))
+	}
+
+	return nil
+}
+
+// StartArtifactExpiry periodically removes the expired artifacts in the background
+func StartArtifactExpiry(store database.Store, diskpath string, retention time.Duration) {
+	go func() {
+		for {
+			if err := ExpireBootArtifacts(store, diskpath, retention); err != nil {
+				log.Errorf("expire boot artifacts: %v", err)
+			}
+
+			time.Sleep(artifactExpiryInterval)
+		}
+	}()
+}
+
+// findArtifactBoot finds the boot in the path of the request, it answers the request itself when there is none
+func (api_ *API) findArtifactBoot(w http.ResponseWriter, r *http.Request) (*images.BootHistory, error) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	tag, err := GetTag("id", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseUint(tag, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid boot id", http.StatusBadRequest)
+		return nil, err
+	}
+
+	boot, err := api_.storeFor(r).GetBootHistoryEntry(mac, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find the boot", http.StatusNotFound)
+		return nil, err
+	}
+
+	return boot, ErrorWrite(w, err, "Cannot fetch the boot")
+}
+
+// uploadedArtifact is an artifact which was read from the request but not stored yet
+type uploadedArtifact struct {
+	name        string
+	contentType string
+	content     []byte
+}
+
+// readArtifacts reads the files of a multipart upload, it answers the request itself when they are refused
+func (api_ *API) readArtifacts(w http.ResponseWriter, r *http.Request, room int) ([]uploadedArtifact, bool) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Artifacts must be uploaded as multipart/form-data", http.StatusBadRequest)
+		return nil, false
+	}
+
+	limit := int64(api_.config.ArtifactMaxBytes)
+	var uploaded []uploadedArtifact
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, "Invalid multipart upload", http.StatusBadRequest)
+			return nil, false
+		}
+
+		if part.FileName() == "" {
+			continue
+		}
+
+		if len(uploaded) == room {
+			http.Error(w, fmt.Sprintf("A boot can have at most %d artifacts", api_.config.ArtifactMaxCount),
+				http.StatusConflict)
+			return nil, false
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(part, limit+1))
+		if err != nil {
+			http.Error(w, "Cannot read the artifact", http.StatusBadRequest)
+			return nil, false
+		}
+
+		if int64(len(content)) > limit {
+			http.Error(w, fmt.Sprintf("Artifacts can be at most %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if _, _, err = mime.ParseMediaType(contentType); err != nil {
+			contentType = "application/octet-stream"
+		}
+
+		uploaded = append(uploaded, uploadedArtifact{filepath.Base(part.FileName()), contentType, content})
+	}
+
+	if len(uploaded) == 0 {
+		http.Error(w, "No artifacts were uploaded", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return uploaded, true
+}
+
+// AddBootArtifacts attaches the files of a multipart upload to a boot. The management OS sends the last screenshot
+// of the console and the tail of the serial log of boots which failed.
+// Example request: POST /machine/52:54:00:d9:71:93/boot/12/artifacts -F screen=@screen.png -F serial=@serial.log
+// Example response: [{"ID": 3, "BootHistoryID": 12, "Name": "screen.png", "ContentType": "image/png", ...}]
+func (api_ *API) AddBootArtifacts(w http.ResponseWriter, r *http.Request) {
+	boot, err := api_.findArtifactBoot(w, r)
+	if err != nil {
+		return
+	}
+
+	artifacts, err := api_.storeFor(r).GetBootArtifacts(boot.ID)
+	if ErrorWrite(w, err, "Cannot fetch the artifacts") != nil {
+		return
+	}
+
+	room := int(api_.config.ArtifactMaxCount) - len(artifacts)
+	if room <= 0 {
+		http.Error(w, fmt.Sprintf("A boot can have at most %d artifacts", api_.config.ArtifactMaxCount),
+			http.StatusConflict)
+		return
+	}
+
+	// The parts are checked one by one, this only keeps a client from sending much more than could be accepted
+	r.Body = http.MaxBytesReader(w, r.Body, int64(room)*(int64(api_.config.ArtifactMaxBytes)+64*1024))
+	uploaded, ok := api_.readArtifacts(w, r, room)
+	if !ok {
+		return
+	}
+
+	dir := artifactDir(api_.diskpath, boot.MachineMAC)
+	if ErrorWrite(w, os.MkdirAll(dir, 0755), "Cannot store the artifacts") != nil {
+		return
+	}
+
+	for _, upload := range uploaded {
+		artifact := images.BootArtifact{
+			BootHistoryID: boot.ID,
+			MachineMAC:    boot.MachineMAC,
+			Name:          upload.name,
+			ContentType:   upload.contentType,
+			Size:          int64(len(upload.content)),
+		}
+
+		if ErrorWrite(w, api_.storeFor(r).AddBootArtifact(&artifact), "Cannot store the artifacts") != nil {
+			return
+		}
+
+		err = ioutil.WriteFile(artifactPath(api_.diskpath, &artifact), upload.content, 0644)
+		if ErrorWrite(w, err, "Cannot store the artifacts") != nil {
+			return
+		}
+
+		artifacts = append(artifacts, artifact)
+	}
+
+	requestLog(r).Infof("Attached %d artifacts to boot %d of %s", len(uploaded), boot.ID, boot.MachineMAC)
+	writeJSON(w, http.StatusCreated, artifacts)
+}
+
+// GetBootArtifacts lists the artifacts attached to a boot
+// Example request: GET /machine/52:54:00:d9:71:93/boot/12/artifacts
+// Example response: [{"ID": 3, "BootHistoryID": 12, "Name": "screen.png", "ContentType": "image/png",
+//
+//	"Size": 48213, "CreatedAt": "2022-01-10T12:00:00Z", ...}]
+func (api_ *API) GetBootArtifacts(w http.ResponseWriter, r *http.Request) {
+	boot, err := api_.findArtifactBoot(w, r)
+	if err != nil {
+		return
+	}
+
+	artifacts, err := api_.storeFor(r).GetBootArtifacts(boot.ID)
+	if ErrorWrite(w, err, "Cannot fetch the artifacts") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, artifacts)
+}
+
+// GetBootArtifact downloads an artifact of a boot. It is sent as an attachment, the management OS picked its
+// content type.
+// Example request: GET /machine/52:54:00:d9:71:93/boot/12/artifacts/3
+func (api_ *API) GetBootArtifact(w http.ResponseWriter, r *http.Request) {
+	boot, err := api_.findArtifactBoot(w, r)
+	if err != nil {
+		return
+	}
+
+	tag, err := GetTag("artifact", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	id, err := strconv.ParseUint(tag, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid artifact id", http.StatusBadRequest)
+		return
+	}
+
+	artifact, err := api_.storeFor(r).GetBootArtifact(boot.ID, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The boot has no such artifact", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the artifact") != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", artifact.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": artifact.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, artifactPath(api_.diskpath, artifact))
+}
+
+// RegisterArtifactHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterArtifactHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/{id}/artifacts",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeMachinesWrite,
+		Handler:     api_.AddBootArtifacts,
+		Method:      http.MethodPost,
+		Schema:      schemaMultipart,
+		Description: "Attaches artifacts such as a console screenshot to a boot",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/{id}/artifacts",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetBootArtifacts,
+		Method:      http.MethodGet,
+		Description: "Lists the artifacts attached to a boot",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/{id}/artifacts/{artifact}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetBootArtifact,
+		Method:      http.MethodGet,
+		Description: "Downloads an artifact attached to a boot",
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_BootArtifacts(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	machine := machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "52:54:00:00:00:01"}}
+	assert.NoError(t, store.CreateMachine(&machine))
+	boot := images.BootHistory{MachineMAC: "52:54:00:00:00:01", SetupUUID: "setup", State: images.BootFailed}
+	assert.NoError(t, store.AddBootHistory(&boot))
+
+	conf := config.Default()
+	conf.ArtifactMaxBytes = 16
+	conf.ArtifactMaxCount = 2
+	s := newTestServer(t, store, diskpath, conf)
+
+	upload := func(files map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for name, content := range files {
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="artifact"; filename=%q`, name))
+			header.Set("Content-Type", "text/plain")
+			part, err := form.CreatePart(header)
+			assert.NoError(t, err)
+			_, err = part.Write([]byte(content))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, form.Close())
+
+		return s.requestWith(http.Header{"Content-Type": {form.FormDataContentType()}}, http.MethodPost,
+			fmt.Sprintf("/machine/52:54:00:00:00:01/boot/%d/artifacts", boot.ID), body.String())
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(map[string]string{"big.log": "way more than 16 bytes"}).Code)
+	assert.Equal(t, http.StatusConflict, upload(map[string]string{"a": "1", "b": "2", "c": "3"}).Code)
+	assert.Equal(t, http.StatusBadRequest, upload(map[string]string{}).Code)
+
+	resp := upload(map[string]string{"../serial.log": "kernel panic"})
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var artifacts []images.BootArtifact
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &artifacts))
+	assert.Len(t, artifacts, 1)
+	assert.Equal(t, "serial.log", artifacts[0].Name)
+	assert.Equal(t, int64(12), artifacts[0].Size)
+
+	assert.Equal(t, http.StatusCreated, upload(map[string]string{"screen.png": "png"}).Code)
+	assert.Equal(t, http.StatusConflict, upload(map[string]string{"more": "1"}).Code)
+
+	resp = s.request(http.MethodGet, fmt.Sprintf("/machine/52:54:00:00:00:01/boot/%d/artifacts", boot.ID), "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &artifacts))
+	assert.Len(t, artifacts, 2)
+
+	resp = s.request(http.MethodGet, fmt.Sprintf("/machine/52:54:00:00:00:01/boot/%d/artifacts/%d", boot.ID,
+		artifacts[0].ID), "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "kernel panic", resp.Body.String())
+	assert.Equal(t, "text/plain", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=serial.log`, resp.Header().Get("Content-Disposition"))
+
+	// Artifacts are only found through the boot they are attached to
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet,
+		fmt.Sprintf("/machine/52:54:00:00:00:02/boot/%d/artifacts", boot.ID), "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet,
+		fmt.Sprintf("/machine/52:54:00:00:00:01/boot/%d/artifacts/99", boot.ID), "").Code)
+
+	// Expired artifacts are removed together with their files
+	path := artifactPath(diskpath, &artifacts[0])
+	assert.FileExists(t, path)
+	assert.NoError(t, ExpireBootArtifacts(store, diskpath, time.Hour))
+	assert.FileExists(t, path)
+	assert.NoError(t, ExpireBootArtifacts(store, diskpath, -time.Hour))
+	assert.NoFileExists(t, path)
+	remaining, err := store.GetBootArtifacts(boot.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+
+	// They go with the history of their machine
+	assert.Equal(t, http.StatusCreated, upload(map[string]string{"serial.log": "again"}).Code)
+	assert.NoError(t, store.DeleteMachine(&machine))
+	remaining, err = store.GetBootArtifacts(boot.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+}
@@ -0,0 +1,662 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// backupInterval is how often the backups look for versions which are due without being woken up
+const backupInterval = time.Minute
+
+// backupCopyTimeout bounds the copy of a single version, an rsync which hangs is tried again later
+const backupCopyTimeout = 6 * time.Hour
+
+// backupTarget stores the copies of versions off the control server
+type backupTarget interface {
+	// put copies the file at path to the target under name and checks that the copy holds the same bytes
+	put(ctx context.Context, path string, name string) error
+	// remove deletes the copy under name, a copy which is not there is not an error
+	remove(ctx context.Context, name string) error
+}
+
+// directoryTarget keeps the copies in a directory, such as the mount of another storage backend
+type directoryTarget struct {
+	dir string
+}
+
+// put copies the file next to its place first, so a copy which is cut off never takes the place of a complete one
+func (t directoryTarget) put(_ context.Context, path string, name string) error {
+	if err := os.MkdirAll(t.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dest := filepath.Join(t.dir, name)
+	out, err := os.Create(dest + ".part")
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = storage.CopySparse(out, io.TeeReader(in, hash))
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(dest+".part", dest)
+	}
+	if err != nil {
+		_ = os.Remove(dest + ".part")
+		return err
+	}
+
+	copied, err := fileChecksum(dest)
+	if err != nil {
+		return err
+	}
+
+	if source := hex.EncodeToString(hash.Sum(nil)); copied != source {
+		return fmt.Errorf("the copy has the checksum %s rather than %s", copied, source)
+	}
+
+	return nil
+}
+
+func (t directoryTarget) remove(_ context.Context, name string) error {
+	err := os.Remove(filepath.Join(t.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// rsyncTarget copies the versions with rsync, to another host over SSH or to a local destination
+type rsyncTarget struct {
+	rsync string
+	dest  string
+}
+
+// run runs rsync and returns what it printed, its errors are part of the returned error
+func (t rsyncTarget) run(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.rsync, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", t.rsync, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// put copies the file, and then asks rsync to compare the checksums of both sides. The second run changes nothing,
+// it only lists the files which differ.
+func (t rsyncTarget) put(ctx context.Context, path string, name string) error {
+	remote := strings.TrimSuffix(t.dest, "/") + "/" + name
+	if _, err := t.run(ctx, "--checksum", "--sparse", "--times", path, remote); err != nil {
+		return err
+	}
+
+	differs, err := t.run(ctx, "--checksum", "--dry-run", "--itemize-changes", path, remote)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(differs) != "" {
+		return fmt.Errorf("the copy does not match the stored file: %s", strings.TrimSpace(differs))
+	}
+
+	return nil
+}
+
+// remove syncs an empty directory to the destination, with a filter which only lets the copy be deleted
+func (t rsyncTarget) remove(ctx context.Context, name string) error {
+	empty, err := ioutil.TempDir("", "baas-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(empty)
+
+	_, err = t.run(ctx, "--recursive", "--delete", "--include=/"+name, "--exclude=*", empty+"/",
+		strings.TrimSuffix(t.dest, "/")+"/")
+	return err
+}
+
+// fileChecksum is the hex encoded SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// backupFileName is the name of the copy of a version on its target, the copies of all images share the target
+func backupFileName(uuid images.ImageUUID, version uint64) string {
+	return string(uuid) + "-" + fmt.Sprintf(images.VersionFileFmt, version)
+}
+
+// backupTarget is the configured target with the name, it is nil when there is none
+func (api_ *API) backupTarget(name string) backupTarget {
+	target, ok := api_.config.BackupTargets[name]
+	switch {
+	case !ok:
+		return nil
+	case target.Kind == config.BackupRsync:
+		return rsyncTarget{rsync: api_.config.BackupRsync, dest: target.Path}
+	default:
+		return directoryTarget{dir: target.Path}
+	}
+}
+
+// backupWorker copies the versions of the images with a backup policy in the background
+type backupWorker struct {
+	wake chan struct{}
+	// pass keeps the passes of the worker and the ones of the tests apart
+	pass sync.Mutex
+}
+
+func newBackupWorker() *backupWorker {
+	return &backupWorker{wake: make(chan struct{}, 1)}
+}
+
+// wakeBackups has the worker look for versions which are due now, rather than at its next round
+func (api_ *API) wakeBackups() {
+	select {
+	case api_.backups.wake <- struct{}{}:
+	default:
+	}
+}
+
+// lastNightly is the last time the nightly backups were due at or before now
+func lastNightly(now time.Time, hour uint) time.Time {
+	due := time.Date(now.Year(), now.Month(), now.Day(), int(hour), 0, 0, 0, now.Location())
+	if due.After(now) {
+		due = due.AddDate(0, 0, -1)
+	}
+
+	return due
+}
+
+// backupRetryDelay is how long the copy of a version waits after failing attempts times, it doubles with every
+// failure
+func (api_ *API) backupRetryDelay(attempts uint) time.Duration {
+	delay := time.Duration(api_.config.BackupRetryMinutes) * time.Minute
+	for i := uint(1); i < attempts && delay < 24*time.Hour; i++ {
+		delay *= 2
+	}
+
+	return delay
+}
+
+// backupCurrent reports whether the copy of a version is the one the policy asks for, a version is copied again
+// when its image gets another target or its file changed
+func backupCurrent(backup *images.VersionBackup, policy *images.BackupPolicy, version *images.Version) bool {
+	return backup.Target == policy.Target && (version.SHA256 == "" || backup.SHA256 == "" ||
+		strings.EqualFold(backup.SHA256, version.SHA256))
+}
+
+// backupStatus tells whether a version of an image with a backup policy was copied to its target
+func backupStatus(backup *images.VersionBackup, policy *images.BackupPolicy,
+	version *images.Version) types.BackupStatus {
+	switch {
+	case version.Corrupt:
+		return types.BackupStatusFailed
+	case backup == nil || !backupCurrent(backup, policy, version):
+		return types.BackupStatusPending
+	case backup.State == images.BackupDone:
+		return types.BackupStatusDone
+	case backup.State == images.BackupFailed:
+		return types.BackupStatusFailed
+	default:
+		return types.BackupStatusPending
+	}
+}
+
+// backupDue reports whether a version is copied in a pass at now. Versions which failed wait for their next
+// attempt, the others for the schedule of the policy.
+func (api_ *API) backupDue(backup *images.VersionBackup, policy *images.BackupPolicy, version *images.Version,
+	now time.Time) bool {
+	if backup.Attempts != 0 {
+		return !now.Before(backup.NextAttemptAt)
+	}
+
+	if policy.Schedule == images.BackupNightly {
+		return version.UpdatedAt.Before(lastNightly(now, api_.config.BackupNightlyHour))
+	}
+
+	return true
+}
+
+// copyVersion copies the file of a version to the target. The file is checked against the checksum of the version
+// first, a corrupt file would replace a good copy.
+func (api_ *API) copyVersion(ctx context.Context, target backupTarget, image *images.ImageModel,
+	version *images.Version) (string, error) {
+	release, err := api_.claimFiles(image)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	path := api_.versionFile(image, version.Version)
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	if version.SHA256 != "" && !strings.EqualFold(sum, version.SHA256) {
+		return "", fmt.Errorf("the stored file does not match the checksum %s of the version", version.SHA256)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backupCopyTimeout)
+	defer cancel()
+
+	return sum, target.put(ctx, path, backupFileName(image.UUID, version.Version))
+}
+
+// backupVersion copies a version and records how it went. A failure is tried again later, until BackupMaxAttempts
+// failed, and the operators are told about every one of them.
+func (api_ *API) backupVersion(ctx context.Context, target backupTarget, policy *images.BackupPolicy,
+	image *images.ImageModel, version *images.Version, backup *images.VersionBackup, now time.Time) error {
+	sum, err := api_.copyVersion(ctx, target, image, version)
+	if errors.Is(err, errMigrating) || errors.Is(err, errResharding) {
+		// The files are moving, the next pass finds them at their new place
+		return nil
+	}
+
+	backup.Target = policy.Target
+	if err == nil {
+		log.Infof("Backed up version %d of image %s to %s", version.Version, image.UUID, policy.Target)
+		backup.State, backup.SHA256, backup.Attempts, backup.LastError = images.BackupDone, sum, 0, ""
+		backup.BackedUpAt = &now
+		return api_.store.SaveVersionBackup(backup)
+	}
+
+	backup.Attempts++
+	backup.LastError = err.Error()
+	backup.State = images.BackupPending
+	backup.NextAttemptAt = now.Add(api_.backupRetryDelay(backup.Attempts))
+	next := fmt.Sprintf("It is tried again at %s.", backup.NextAttemptAt.Format(time.RFC3339))
+	if backup.Attempts >= api_.config.BackupMaxAttempts {
+		backup.State = images.BackupFailed
+		next = "It is not tried again until the backup policy of the image is set again."
+	}
+
+	log.Warnf("Cannot back up version %d of image %s to %s (attempt %d): %v", version.Version, image.UUID,
+		policy.Target, backup.Attempts, err)
+	api_.alert(config.EventBackupFailure, string(image.UUID),
+		fmt.Sprintf("Version %d of image %s was not backed up", version.Version, image.Name),
+		fmt.Sprintf("Copying version %d of image %s (%s), owned by %s, to %s failed in attempt %d: %v. %s",
+			version.Version, image.Name, image.UUID, image.Username, policy.Target, backup.Attempts, err, next))
+
+	return api_.store.SaveVersionBackup(backup)
+}
+
+// backupImage copies the versions of an image which are due under its policy
+func (api_ *API) backupImage(ctx context.Context, policy *images.BackupPolicy, now time.Time) error {
+	target := api_.backupTarget(policy.Target)
+	if target == nil {
+		log.Warnf("Not backing up image %s, its target %s is not in BackupTargets", policy.ImageUUID, policy.Target)
+		return nil
+	}
+
+	image, err := api_.store.GetImageByUUID(policy.ImageUUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Images in the trash are not backed up
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	backups, err := api_.store.GetVersionBackups(image.UUID)
+	if err != nil {
+		return err
+	}
+
+	byVersion := map[uint64]*images.VersionBackup{}
+	for i := range backups {
+		byVersion[backups[i].Version] = &backups[i]
+	}
+
+	for i := range image.Versions {
+		version := &image.Versions[i]
+		if version.Corrupt {
+			continue
+		}
+
+		backup, ok := byVersion[version.Version]
+		if !ok || !backupCurrent(backup, policy, version) {
+			backup = &images.VersionBackup{ImageUUID: image.UUID, Version: version.Version,
+				State: images.BackupPending}
+		}
+
+		if backup.State != images.BackupPending || !api_.backupDue(backup, policy, version, now) {
+			continue
+		}
+
+		if err = api_.backupVersion(ctx, target, policy, image, version, backup, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupPass copies the versions of all images which are due at now
+func (api_ *API) backupPass(ctx context.Context, now time.Time) error {
+	api_.backups.pass.Lock()
+	defer api_.backups.pass.Unlock()
+
+	policies, err := api_.store.GetBackupPolicies()
+	if err != nil {
+		return err
+	}
+
+	for i := range policies {
+		if err = api_.backupImage(ctx, &policies[i], now); err != nil {
+			return fmt.Errorf("back up image %s: %w", policies[i].ImageUUID, err)
+		}
+	}
+
+	return nil
+}
+
+// startBackups copies the versions in the background, when a version is stored and every backupInterval
+func (api_ *API) startBackups() {
+	if len(api_.config.BackupTargets) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(backupInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := api_.backupPass(context.Background(), time.Now()); err != nil {
+				log.Errorf("Backing up the images: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-api_.backups.wake:
+			}
+		}
+	}()
+}
+
+// forgetBackup drops the record of the copy of a deleted version, and the copy itself when the policy of its image
+// says so
+func (api_ *API) forgetBackup(r *http.Request, image *images.ImageModel, version uint64) {
+	if err := api_.store.DeleteVersionBackup(image.UUID, version); err != nil {
+		requestLog(r).Warnf("Cannot forget the backup of version %d of %s: %v", version, image.UUID, err)
+	}
+
+	policy, err := api_.store.GetBackupPolicy(image.UUID)
+	if err != nil || !policy.DeleteRemote {
+		return
+	}
+
+	target := api_.backupTarget(policy.Target)
+	if target == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), backupCopyTimeout)
+		defer cancel()
+
+		if err := target.remove(ctx, backupFileName(image.UUID, version)); err != nil {
+			log.Warnf("Cannot remove the backup of version %d of %s from %s: %v", version, image.UUID,
+				policy.Target, err)
+		}
+	}()
+}
+
+// backupStatuses fills in whether the versions of an image were backed up, images without a policy leave it out
+func (api_ *API) backupStatuses(r *http.Request, uuid images.ImageUUID, versions []images.Version,
+	described []types.ImageVersion) error {
+	policy, err := api_.storeFor(r).GetBackupPolicy(uuid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	backups, err := api_.storeFor(r).GetVersionBackups(uuid)
+	if err != nil {
+		return err
+	}
+
+	byVersion := map[uint64]*images.VersionBackup{}
+	for i := range backups {
+		byVersion[backups[i].Version] = &backups[i]
+	}
+
+	for i := range versions {
+		described[i].BackedUp = backupStatus(byVersion[versions[i].Version], policy, &versions[i])
+	}
+
+	return nil
+}
+
+// imageBackups is the backup policy of an image, together with the copies of its versions
+type imageBackups struct {
+	Policy   *images.BackupPolicy
+	Versions []images.VersionBackup
+}
+
+// SetBackupPolicy has the versions of an image copied to one of the BackupTargets, as soon as they are stored or
+// every night. Setting the policy again has the versions which failed in all attempts tried again.
+// Example request: PUT /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/backup
+// Example body: {"Target": "offsite", "Schedule": "nightly", "DeleteRemote": false}
+// Example response: {"ImageUUID": "57bf0cd3-...", "Target": "offsite", "Schedule": "nightly",
+// "DeleteRemote": false, "CreatedAt": "2022-06-01T12:00:00Z", "UpdatedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) SetBackupPolicy(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	var policy images.BackupPolicy
+	if err = json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Cannot decode the backup policy", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := api_.config.BackupTargets[policy.Target]; !ok {
+		targets := make([]string, 0, len(api_.config.BackupTargets))
+		for name := range api_.config.BackupTargets {
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
+
+		http.Error(w, fmt.Sprintf("Unknown backup target %q, the targets are: %s", policy.Target,
+			strings.Join(targets, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	if !policy.Schedule.Valid() {
+		http.Error(w, fmt.Sprintf("The schedule has to be %s or %s", images.BackupOnNewVersion,
+			images.BackupNightly), http.StatusBadRequest)
+		return
+	}
+
+	policy.ImageUUID = image.UUID
+	if ErrorWrite(w, api_.storeFor(r).SetBackupPolicy(&policy), "Cannot store the backup policy") != nil {
+		return
+	}
+
+	backups, err := api_.storeFor(r).GetVersionBackups(image.UUID)
+	if ErrorWrite(w, err, "Cannot fetch the backups") != nil {
+		return
+	}
+
+	for i := range backups {
+		if backups[i].State != images.BackupFailed {
+			continue
+		}
+
+		backups[i].State, backups[i].Attempts = images.BackupPending, 0
+		if ErrorWrite(w, api_.storeFor(r).SaveVersionBackup(&backups[i]), "Cannot reset the backup") != nil {
+			return
+		}
+	}
+
+	requestLog(r).Infof("%s backs up image %s to %s %s", api_.requester(r), image.UUID, policy.Target,
+		policy.Schedule)
+	api_.wakeBackups()
+
+	stored, err := api_.storeFor(r).GetBackupPolicy(image.UUID)
+	if ErrorWrite(w, err, "Cannot fetch the backup policy") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stored)
+}
+
+// GetBackupPolicy returns the backup policy of an image and the copies of its versions
+// Example request: GET /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/backup
+// Example response: {"Policy": {"ImageUUID": "57bf0cd3-...", "Target": "offsite", "Schedule": "nightly", ...},
+// "Versions": [{"ImageUUID": "57bf0cd3-...", "Version": 3, "Target": "offsite", "State": "backed_up",
+// "SHA256": "5a1f...", "Attempts": 0, "BackedUpAt": "2022-06-02T02:00:12Z", ...}]}
+func (api_ *API) GetBackupPolicy(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	policy, err := api_.storeFor(r).GetBackupPolicy(image.UUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The image has no backup policy", http.StatusNotFound)
+		return
+	}
+	if ErrorWrite(w, err, "Cannot fetch the backup policy") != nil {
+		return
+	}
+
+	backups, err := api_.storeFor(r).GetVersionBackups(image.UUID)
+	if ErrorWrite(w, err, "Cannot fetch the backups") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, imageBackups{Policy: policy, Versions: backups})
+}
+
+// DeleteBackupPolicy stops backing up an image, the copies which were made stay on the target
+// Example request: DELETE /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/backup
+func (api_ *API) DeleteBackupPolicy(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteBackupPolicy(image.UUID), "Cannot delete the backup policy") != nil {
+		return
+	}
+
+	requestLog(r).Infof("%s stopped backing up image %s", api_.requester(r), image.UUID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetBackupFailures lists the versions whose last copy failed, the latest failures first. The ones in the state
+// pending are tried again at NextAttemptAt, the failed ones gave up.
+// Example request: GET /admin/backups/failures
+// Example response: [{"ImageUUID": "57bf0cd3-...", "Version": 3, "Target": "offsite", "State": "pending",
+// "Attempts": 2, "LastError": "rsync: exit status 255: ssh: connect to host offsite: Connection refused",
+// "NextAttemptAt": "2022-06-01T12:20:00Z", ...}]
+func (api_ *API) GetBackupFailures(w http.ResponseWriter, r *http.Request) {
+	failures, err := api_.storeFor(r).GetFailedVersionBackups()
+	if ErrorWrite(w, err, "Cannot fetch the failed backups") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, failures)
+}
+
+// RegisterBackupHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterBackupHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/backup",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.SetBackupPolicy,
+		Method:      http.MethodPut,
+		Schema:      "backup-policy",
+		Description: "Sets where and when the versions of the image are backed up",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/backup",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetBackupPolicy,
+		Method:      http.MethodGet,
+		Description: "Gets the backup policy of the image and the backups of its versions",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/backup",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.DeleteBackupPolicy,
+		Method:      http.MethodDelete,
+		Description: "Stops backing up the image",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/backups/failures",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetBackupFailures,
+		Method:      http.MethodGet,
+		Description: "Lists the versions which could not be backed up",
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastNightly(t *testing.T) {
+	night := time.Date(2022, 6, 2, 2, 0, 0, 0, time.UTC)
+	assert.Equal(t, night, lastNightly(night, 2))
+	assert.Equal(t, night, lastNightly(night.Add(23*time.Hour), 2))
+	assert.Equal(t, night.AddDate(0, 0, -1), lastNightly(night.Add(-time.Minute), 2))
+}
+
+func TestApi_Backups(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	owner := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, owner} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	diskpath, err := ioutil.TempDir("", "backups")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "course", Username: "alice", UUID: "course"}
+	assert.NoError(t, store.CreateImage(&image))
+	// Only the versions with a file are of interest, not the empty one the image starts with
+	created, err := store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	for i := range created.Versions {
+		assert.NoError(t, store.DeleteVersion(&created.Versions[i]))
+	}
+	for version, content := range map[uint64]string{1: "the first disk", 2: "the second disk"} {
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: version, ImageModelUUID: "course"}))
+		assert.NoError(t, ioutil.WriteFile(image.VersionFile(version), []byte(content), 0644))
+		sum := sha256.Sum256([]byte(content))
+		assert.NoError(t, store.SetVersionChecksum("course", version, hex.EncodeToString(sum[:])))
+	}
+
+	offsite := filepath.Join(diskpath, "offsite")
+	broken := filepath.Join(diskpath, "broken")
+	assert.NoError(t, ioutil.WriteFile(broken, nil, 0644))
+
+	conf := config.Default()
+	conf.BackupTargets = map[string]config.BackupTarget{
+		"offsite": {Kind: config.BackupDirectory, Path: offsite},
+		// A file where the directory should be, every copy to it fails
+		"broken": {Kind: config.BackupDirectory, Path: broken},
+	}
+	conf.BackupMaxAttempts = 2
+	s := newTestServer(t, store, diskpath, conf)
+
+	statuses := func() map[uint64]types.BackupStatus {
+		resp := s.requestAs(owner, http.MethodGet, "/image/course/versions", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		var page struct{ Items []types.ImageVersion }
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &page))
+		found := map[uint64]types.BackupStatus{}
+		for _, version := range page.Items {
+			found[version.Version] = version.BackedUp
+		}
+		return found
+	}
+	failures := func() []images.VersionBackup {
+		resp := s.requestAs(admin, http.MethodGet, "/admin/backups/failures", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		var found []images.VersionBackup
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &found))
+		return found
+	}
+
+	// Images without a policy leave the status out
+	assert.Equal(t, map[uint64]types.BackupStatus{1: "", 2: ""}, statuses())
+	assert.Equal(t, http.StatusNotFound, s.requestAs(owner, http.MethodGet, "/image/course/backup", "").Code)
+
+	for _, body := range []string{`{"Target": "elsewhere", "Schedule": "nightly"}`,
+		`{"Target": "offsite", "Schedule": "hourly"}`} {
+		assert.Equal(t, http.StatusBadRequest, s.requestAs(owner, http.MethodPut, "/image/course/backup", body).Code)
+	}
+
+	// Nightly versions wait for the night after they were stored
+	assert.Equal(t, http.StatusOK, s.requestAs(owner, http.MethodPut, "/image/course/backup",
+		`{"Target": "offsite", "Schedule": "nightly", "DeleteRemote": true}`).Code)
+	now := time.Now()
+	assert.NoError(t, s.api.backupPass(context.Background(), now))
+	assert.Equal(t, map[uint64]types.BackupStatus{1: types.BackupStatusPending, 2: types.BackupStatusPending},
+		statuses())
+
+	assert.NoError(t, s.api.backupPass(context.Background(), now.Add(24*time.Hour)))
+	assert.Equal(t, map[uint64]types.BackupStatus{1: types.BackupStatusDone, 2: types.BackupStatusDone}, statuses())
+	copied, err := ioutil.ReadFile(filepath.Join(offsite, backupFileName("course", 2)))
+	assert.NoError(t, err)
+	assert.Equal(t, "the second disk", string(copied))
+
+	var backups imageBackups
+	resp := s.requestAs(owner, http.MethodGet, "/image/course/backup", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &backups))
+	assert.Equal(t, images.BackupNightly, backups.Policy.Schedule)
+	assert.Len(t, backups.Versions, 2)
+	assert.NotNil(t, backups.Versions[0].BackedUpAt)
+
+	// Deleting a version removes its copy, as the policy asks
+	assert.Equal(t, http.StatusNoContent, s.requestAs(owner, http.MethodDelete, "/image/course/1", "").Code)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(offsite, backupFileName("course", 1)))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, filepath.Join(offsite, backupFileName("course", 2)))
+
+	// Failed copies are tried again later, and given up after BackupMaxAttempts
+	assert.Equal(t, http.StatusOK, s.requestAs(owner, http.MethodPut, "/image/course/backup",
+		`{"Target": "broken", "Schedule": "on_new_version"}`).Code)
+	assert.NoError(t, s.api.backupPass(context.Background(), now))
+	assert.Equal(t, map[uint64]types.BackupStatus{2: types.BackupStatusPending}, statuses())
+	found := failures()
+	assert.Len(t, found, 1)
+	assert.Equal(t, uint(1), found[0].Attempts)
+	assert.NotEmpty(t, found[0].LastError)
+	assert.Equal(t, now.Add(time.Duration(conf.BackupRetryMinutes)*time.Minute).Unix(), found[0].NextAttemptAt.Unix())
+
+	// Not before the next attempt is due
+	assert.NoError(t, s.api.backupPass(context.Background(), now.Add(time.Minute)))
+	assert.Equal(t, uint(1), failures()[0].Attempts)
+
+	assert.NoError(t, s.api.backupPass(context.Background(), now.Add(time.Hour)))
+	assert.Equal(t, map[uint64]types.BackupStatus{2: types.BackupStatusFailed}, statuses())
+	assert.Equal(t, images.BackupFailed, failures()[0].State)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(owner, http.MethodGet, "/admin/backups/failures", "").Code)
+
+	// Back at a working target the version is copied again, and its failures are gone
+	assert.Equal(t, http.StatusOK, s.requestAs(owner, http.MethodPut, "/image/course/backup",
+		`{"Target": "offsite", "Schedule": "on_new_version"}`).Code)
+	assert.NoError(t, s.api.backupPass(context.Background(), now.Add(2*time.Hour)))
+	assert.Equal(t, map[uint64]types.BackupStatus{2: types.BackupStatusDone}, statuses())
+	assert.Empty(t, failures())
+
+	// The copies stay on the target once the image is no longer backed up
+	assert.Equal(t, http.StatusNoContent, s.requestAs(owner, http.MethodDelete, "/image/course/backup", "").Code)
+	assert.Equal(t, map[uint64]types.BackupStatus{2: ""}, statuses())
+	assert.FileExists(t, filepath.Join(offsite, backupFileName("course", 2)))
+}
@@ -5,7 +5,7 @@
 package api
 
 import (
-	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
 	"strings"
@@ -17,6 +17,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 type bootConfigResponse struct {
@@ -70,13 +71,27 @@ func (api_ *API) ServeBootConfigurations(w http.ResponseWriter, r *http.Request)
 
 	log.Infof("Serving boot config for %v at ip: %v", mac, addr)
 
-	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
-	if err != nil {
+	m, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
+	if errors.Is(err, gorm.ErrRecordNotFound) && api_.mayRegister() {
+		// Machines BAAS does not know boot the management OS to register themselves, pixiecore only boots x86
+		log.Infof("Serving the registration boot config for %v", mac)
+		resp := getBootConfig(machine.X86_64)
+		resp.Cmdline = api_.joinCmdline(resp.Cmdline)
+		writeJSON(w, http.StatusOK, &resp)
+		return
+	} else if err != nil {
 		log.Errorf("Couldn't find machine in store: %v", err)
 		http.Error(w, "Cannot serve the boot configuration", http.StatusNotFound)
 		return
 	}
 
+	// Pixiecore leaves the machines it gets no boot configuration for to boot from their local disk
+	if !m.Approved() {
+		log.Infof("Not serving a boot config to the %s machine %v", m.RegistrationStatus(), mac)
+		http.Error(w, "The machine was not approved", http.StatusNotFound)
+		return
+	}
+
 	resp := getBootConfig(m.Architecture)
 	if resp == nil {
 		log.Error("Couldn't find appropriate bootconfig for this machine")
@@ -86,8 +101,5 @@ func (api_ *API) ServeBootConfigurations(w http.ResponseWriter, r *http.Request)
 
 	log.Debugf("Sending boot config %v", resp)
 
-	if err := json.NewEncoder(w).Encode(&resp); err != nil {
-		log.Errorf("Couldn't write bootconfig to network: %v", err)
-		http.Error(w, "Cannot serve the boot configuration", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, &resp)
 }
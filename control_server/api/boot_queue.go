@@ -0,0 +1,231 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// errCorruptVersion is returned when a boot setup would flash a version which no longer matches its checksum
+var errCorruptVersion = errors.New("the version is corrupt")
+
+// versionlessError is returned when a boot setup would flash an image without any version, since nothing was
+// uploaded to it yet or all its versions were deleted
+type versionlessError struct {
+	Image images.ImageUUID
+}
+
+func (e *versionlessError) Error() string {
+	return fmt.Sprintf("image %s has no versions", e.Image)
+}
+
+// missingVersion explains why the version of an image in a setup cannot be found, images without any version are
+// told apart from those which lack the version asked for
+func (api_ *API) missingVersion(uuid images.ImageUUID, err error) error {
+	image, ierr := api_.store.GetImageByUUID(uuid)
+	if ierr == nil && len(image.Versions) == 0 {
+		return &versionlessError{Image: uuid}
+	}
+
+	return err
+}
+
+// resolveVersions picks the version of every image in the setup according to the version selector of the boot
+// setup, or the selector of the member for image sets. The chosen versions are stored in the image setup and
+// returned so they can be recorded. Corrupt versions are never picked as the latest one, and refused when they are
+// asked for by number.
+func (api_ *API) resolveVersions(bootSetup *images.BootSetup, setup *images.ImageSetup) (images.ResolvedVersions, error) {
+	resolved := images.ResolvedVersions{}
+
+	for i := range setup.Images {
+		frozen := &setup.Images[i]
+
+		selector := bootSetup.Version
+		if selector == "" {
+			selector = frozen.Selector
+		}
+
+		var version *images.Version
+		if selector == "" {
+			v, err := api_.store.GetVersionByID(frozen.VersionID)
+			if err != nil {
+				return nil, api_.missingVersion(frozen.UUIDImage, err)
+			}
+			version = v
+		} else {
+			image, err := api_.store.GetImageByUUID(frozen.UUIDImage)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(image.Versions) == 0 {
+				return nil, &versionlessError{Image: image.UUID}
+			}
+
+			if n, ok := selector.Pinned(); ok {
+				version = image.FindVersion(n)
+			} else {
+				version = image.LatestVersion()
+			}
+		}
+
+		if version == nil {
+			return nil, fmt.Errorf("image %s has no version %s", frozen.UUIDImage, selector)
+		}
+
+		if version.Corrupt {
+			return nil, fmt.Errorf("version %d of image %s: %w", version.Version, frozen.UUIDImage, errCorruptVersion)
+		}
+
+		frozen.Version = *version
+		resolved = append(resolved, images.ResolvedVersion{ImageUUID: frozen.UUIDImage, Version: version.Version})
+	}
+
+	return resolved, nil
+}
+
+// bootQueueEntry is a queued boot setup together with the versions it will flash.
+// Resolved is empty for boot setups asking for the latest version, since those are resolved when claimed.
+type bootQueueEntry struct {
+	images.BootSetup
+	Resolved images.ResolvedVersions `json:",omitempty"`
+}
+
+// GetBootQueue lists the boot setups which are queued for a machine
+// Example request: GET /machine/52:54:00:d9:71:93/queue
+// Example response: [{"SetupUUID": "74368cec-7903-4233-87b7-564195619dce", "Update": false, "Version": 3,
+//
+//	"Resolved": [{"ImageUUID": "3a760707-c160-40fa-81be-430b75131ddc", "Version": 3}]}]
+func (api_ *API) GetBootQueue(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	bootSetups, err := api_.storeFor(r).GetBootSetups(mac)
+	if ErrorWrite(w, err, "Cannot fetch the boot queue") != nil {
+		return
+	}
+
+	queue := []bootQueueEntry{}
+	for i := range bootSetups {
+		entry := bootQueueEntry{BootSetup: bootSetups[i]}
+
+		if bootSetups[i].Version != images.VersionLatest {
+			setup, serr := api_.storeFor(r).GetImageSetup(string(bootSetups[i].SetupUUID))
+			if serr == nil {
+				entry.Resolved, _ = api_.resolveVersions(&bootSetups[i], &setup)
+			}
+		}
+
+		queue = append(queue, entry)
+	}
+
+	writeJSON(w, http.StatusOK, queue)
+}
+
+// bootFilter reads which boots of the history are asked for, by the state they are in with ?outcome= and by the
+// reason they failed for with ?reason=
+func bootFilter(r *http.Request) (database.BootFilter, error) {
+	query := r.URL.Query()
+	filter := database.BootFilter{
+		State:  images.BootState(query.Get("outcome")),
+		Reason: images.FailureReason(query.Get("reason")),
+	}
+
+	switch filter.State {
+	case "", images.BootInProgress, images.BootCompleted, images.BootFailed, images.BootCancelled, images.BootExpired:
+	default:
+		return filter, fmt.Errorf("outcome must be one of %s, %s, %s, %s or %s", images.BootInProgress,
+			images.BootCompleted, images.BootFailed, images.BootCancelled, images.BootExpired)
+	}
+
+	if filter.Reason != "" && !filter.Reason.Valid() {
+		return filter, fmt.Errorf("unknown failure reason %q", filter.Reason)
+	}
+
+	return filter, nil
+}
+
+// GetBootHistory lists the boot setups a machine has claimed together with the versions which were flashed.
+// The history only grows, so it is paginated with a cursor rather than an offset. It can be narrowed down to the
+// boots which failed, and to those which failed for a particular reason.
+// Example request: GET /machine/52:54:00:d9:71:93/history?limit=20&since=2022-01-01T00:00:00Z
+// Example request: GET /machine/52:54:00:d9:71:93/history?outcome=failed&reason=checksum_mismatch
+// Example response: {"Items": [{"MachineMAC": "52:54:00:d9:71:93", "SetupUUID": "74368cec-...",
+//
+//	"RequestedVersion": "latest", "ResolvedVersions": [{"ImageUUID": "3a760707-...", "Version": 5}],
+//	"CreatedAt": "2022-01-10T12:00:00Z"}], "Limit": 20,
+//	"Next": "/machine/52:54:00:d9:71:93/history?cursor=1204&limit=20"}
+func (api_ *API) GetBootHistory(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	opts, err := parseListOptions(w, r, true)
+	if err != nil {
+		return
+	}
+
+	filter, err := bootFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	history, err := api_.storeFor(r).GetBootHistory(mac, filter, opts)
+	if ErrorWrite(w, err, "Cannot fetch the boot history") != nil {
+		return
+	}
+
+	var last uint
+	if len(history) != 0 {
+		last = history[len(history)-1].ID
+	}
+
+	writePage(w, cursorPage(r, opts, history, len(history), last))
+}
+
+// versionBlockers finds the queued boot setups which would flash a particular version of an image
+func (api_ *API) versionBlockers(image *images.ImageModel, version *images.Version) ([]images.BootSetup, error) {
+	bootSetups, err := api_.store.GetBootSetupsByImage(image.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	blockers := []images.BootSetup{}
+	for _, bootSetup := range bootSetups {
+		if n, ok := bootSetup.Version.Pinned(); ok {
+			if n == version.Version {
+				blockers = append(blockers, bootSetup)
+			}
+			continue
+		}
+
+		if bootSetup.Version == images.VersionLatest {
+			continue
+		}
+
+		setup, serr := api_.store.GetImageSetup(string(bootSetup.SetupUUID))
+		if serr != nil {
+			return nil, serr
+		}
+
+		for _, frozen := range setup.Images {
+			if frozen.UUIDImage == image.UUID && frozen.VersionID == uint64(version.ID) {
+				blockers = append(blockers, bootSetup)
+				break
+			}
+		}
+	}
+
+	return blockers, nil
+}
@@ -0,0 +1,407 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_BootVersionSelection(t *testing.T) {
+	store := newTestStore(t)
+
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.Admin}))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "image"}
+	store.CreateImage(&image)
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID})
+
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}
+	assert.NoError(t, store.CreateImageSetup("test", &setup))
+	store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(0), false)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	fetched, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+
+	// Without a selector the version in the image setup is used, "latest" picks the newest one
+	resolved, err := s.api.resolveVersions(&images.BootSetup{}, &fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), resolved[0].Version)
+
+	resolved, err = s.api.resolveVersions(&images.BootSetup{Version: images.VersionLatest}, &fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), resolved[0].Version)
+
+	_, err = s.api.resolveVersions(&images.BootSetup{Version: "7"}, &fetched)
+	assert.Error(t, err)
+
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPost, "/machine/abc/boot",
+		`{"SetupUUID": "setup", "Version": 1}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/machine/abc/boot",
+		`{"SetupUUID": "setup", "Version": 7}`).Code)
+
+	resp := s.request(http.MethodGet, "/machine/abc/queue", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var queue []bootQueueEntry
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&queue))
+	assert.Len(t, queue, 1)
+	assert.Equal(t, images.VersionSelector("1"), queue[0].Version)
+	assert.Equal(t, uint64(1), queue[0].Resolved[0].Version)
+
+	// The pinned version cannot be removed while the boot is queued, other versions can
+	resp = s.request(http.MethodDelete, "/image/image/1", "")
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Blockers")
+
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/image/0", "").Code)
+}
+
+func TestApi_BootVersionlessImage(t *testing.T) {
+	store := newTestStore(t)
+
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.Admin}))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "versionless"}
+	assert.NoError(t, store.CreateImage(&image))
+
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}
+	assert.NoError(t, store.CreateImageSetup("test", &setup))
+	store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(0), false)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	fetched, err := store.GetImageSetup("setup")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/versionless/0", "").Code)
+
+	// Neither the version in the setup nor the latest one can be booted
+	for _, selector := range []images.VersionSelector{"", images.VersionLatest} {
+		_, err = s.api.resolveVersions(&images.BootSetup{Version: selector}, &fetched)
+		var versionless *versionlessError
+		if assert.True(t, errors.As(err, &versionless)) {
+			assert.Equal(t, image.UUID, versionless.Image)
+		}
+	}
+
+	// Listings tell such images apart, with an empty list of versions
+	for _, uri := range []string{"/user/test/images", "/user/test/images?include_versions=false", "/image/versionless"} {
+		resp := s.request(http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		body := strings.TrimPrefix(strings.TrimSuffix(strings.TrimSpace(resp.Body.String()), "]"), "[")
+
+		var listed map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(body), &listed))
+		assert.Equal(t, []interface{}{}, listed["Versions"], uri)
+		assert.Equal(t, float64(0), listed["VersionCount"], uri)
+		assert.Equal(t, false, listed["HasVersions"], uri)
+	}
+
+	// The image is passed over as a default image
+	_, err = s.api.bootableDefault(&machinemodel.MachineModel{}, machinemodel.DefaultImage{ImageUUID: "versionless"})
+	assert.EqualError(t, err, "the image has no versions")
+
+	// Uploading to the image gives it its first version again
+	version, err := manageVersion(s.api, "false", "versionless")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), version.Version)
+	_, err = s.api.resolveVersions(&images.BootSetup{Version: images.VersionLatest}, &fetched)
+	assert.NoError(t, err)
+}
+
+func TestApi_ImageLocks(t *testing.T) {
+	store := newTestStore(t)
+
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.Admin}))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "locked"}
+	store.CreateImage(&image)
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID})
+
+	boot := images.BootHistory{
+		MachineMAC:       "abc",
+		SetupUUID:        "setup",
+		ResolvedVersions: images.ResolvedVersions{{ImageUUID: image.UUID, Version: 1}},
+		State:            images.BootInProgress,
+		LastSeen:         time.Now(),
+	}
+	assert.NoError(t, store.AddBootHistory(&boot))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	// The version being flashed and the image cannot be removed, other versions can
+	resp := s.request(http.MethodDelete, "/image/locked/1", "")
+	assert.Equal(t, http.StatusLocked, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Locks")
+	assert.Equal(t, http.StatusLocked, s.request(http.MethodDelete, "/image/locked", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/locked/0", "").Code)
+
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPost, "/machine/abc/boot/heartbeat", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/machine/abc/boot/state",
+		`{"State": "expired"}`).Code)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/machine/abc/boot/state", `{"State": "completed"}`).Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodPost, "/machine/abc/boot/heartbeat", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/locked/1", "").Code)
+
+	// The janitor releases the locks of machines which stopped sending heartbeats
+	boot = images.BootHistory{MachineMAC: "abc", SetupUUID: "setup", State: images.BootInProgress,
+		LastSeen: time.Now().Add(-time.Hour)}
+	assert.NoError(t, store.AddBootHistory(&boot))
+	assert.NoError(t, s.api.failLostBoots(api_pkg.NewPlannedChanges(false), time.Now()))
+
+	_, err := store.GetActiveBoot("abc")
+	assert.Error(t, err)
+	history, err := store.GetBootHistory("abc", database.BootFilter{}, database.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, images.BootFailed, history[0].State)
+	assert.Equal(t, images.FailureAgentLost, history[0].FailureReason)
+	assert.Equal(t, lostAgentReason, history[0].FailureDetail)
+}
+
+func TestApi_PaginateHistory(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.Admin}))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "paged"}
+	store.CreateImage(&image)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup",
+			RequestedVersion: images.VersionSelector(fmt.Sprint(i))}))
+		store.CreateNewImageVersion(images.Version{Version: uint64(i + 1), ImageModelUUID: image.UUID})
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	get := func(uri string, body interface{}) int {
+		resp := s.request(http.MethodGet, uri, "")
+		if resp.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(body))
+		}
+		return resp.Code
+	}
+
+	// Walk through the history newest first, following the links to the next pages
+	var items []images.BootHistory
+	page := types.Page{Items: &items}
+	assert.Equal(t, http.StatusOK, get("/machine/abc/history?limit=2", &page))
+	assert.Len(t, items, 2)
+	assert.Equal(t, images.VersionSelector("4"), items[0].RequestedVersion)
+	assert.Nil(t, page.Total)
+	assert.Equal(t, 2, page.Limit)
+	assert.Empty(t, page.Prev)
+
+	seen := len(items)
+	for page.Next != "" {
+		next := page.Next
+		items = nil
+		page = types.Page{Items: &items}
+		assert.Equal(t, http.StatusOK, get(next, &page))
+		seen += len(items)
+	}
+	assert.Equal(t, 5, seen)
+
+	items = nil
+	page = types.Page{Items: &items}
+	assert.Equal(t, http.StatusOK, get("/machine/abc/history?order=asc&limit=1", &page))
+	assert.Equal(t, images.VersionSelector("0"), items[0].RequestedVersion)
+
+	items = nil
+	page = types.Page{Items: &items}
+	assert.Equal(t, http.StatusOK, get("/machine/abc/history?until=2000-01-01T00:00:00Z", &page))
+	assert.Empty(t, items)
+	assert.Equal(t, http.StatusBadRequest, get("/machine/abc/history?order=sideways", &page))
+
+	var versions []types.ImageVersion
+	page = types.Page{Items: &versions}
+	assert.Equal(t, http.StatusOK, get("/image/paged/versions?limit=2&offset=1", &page))
+	assert.Equal(t, int64(6), *page.Total)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, uint64(4), versions[0].Version)
+	assert.Equal(t, "/image/paged/versions?limit=2&offset=3", page.Next)
+	assert.Equal(t, "/image/paged/versions?limit=2&offset=0", page.Prev)
+
+	// The same pages are linked in the header
+	resp := s.request(http.MethodGet, "/image/paged/versions?limit=2&offset=4", "")
+	assert.Equal(t, `</image/paged/versions?limit=2&offset=2>; rel="prev"`, resp.Header().Get("Link"))
+
+	// Clients walk through all pages
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+	c := client.New(server.URL)
+
+	pages := 0
+	assert.NoError(t, c.EachPage("/image/paged/versions?limit=4", func(items json.RawMessage) error {
+		pages++
+		return nil
+	}))
+	assert.Equal(t, 2, pages)
+
+	all, err := c.GetVersions("paged")
+	assert.NoError(t, err)
+	assert.Len(t, all, 6)
+	boots, err := c.GetBootHistory("abc")
+	assert.NoError(t, err)
+	assert.Len(t, boots, 5)
+}
+
+func TestApi_CancelBoot(t *testing.T) {
+	store := newTestStore(t)
+
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "alice", Email: "alice@example.com",
+		Role: user.User}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "bob", Email: "bob@example.com", Role: user.User}))
+
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "alice"}
+	assert.NoError(t, store.CreateImageSetup("alice", &setup))
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}))
+
+	conf := config.Default()
+	conf.BootCancelWaitSeconds = 0
+	s := newTestServer(t, store, "/tmp", conf)
+
+	users := map[string]*user.UserModel{}
+	for _, name := range []string{"alice", "bob"} {
+		u, err := store.GetUserByUsername(name)
+		assert.NoError(t, err)
+		users[name] = u
+	}
+
+	// Queued boots are taken out of the queue by the owner of the image setup
+	assert.Equal(t, http.StatusForbidden, s.requestAs(users["bob"], http.MethodDelete, "/machine/abc/boot/setup", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestAs(users["alice"], http.MethodDelete,
+		"/machine/abc/boot/setup", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(users["alice"], http.MethodDelete,
+		"/machine/abc/boot/setup", "").Code)
+
+	boot := images.BootHistory{MachineMAC: "abc", SetupUUID: "setup", State: images.BootInProgress,
+		LastSeen: time.Now()}
+	assert.NoError(t, store.AddBootHistory(&boot))
+	uri := fmt.Sprintf("/machine/abc/boot/%d", boot.ID)
+
+	var control images.BootControl
+	resp := s.request(http.MethodPost, "/machine/abc/boot/heartbeat", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&control))
+	assert.Equal(t, images.BootControl{BootID: boot.ID, CancelRequested: false}, control)
+
+	// The management OS did not stop in time, the boot is still in progress
+	assert.Equal(t, http.StatusForbidden, s.requestAs(users["bob"], http.MethodDelete, uri, "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(users["alice"], http.MethodDelete, "/machine/abc/boot/100", "").Code)
+	assert.Equal(t, http.StatusAccepted, s.requestAs(users["alice"], http.MethodDelete, uri, "").Code)
+
+	resp = s.request(http.MethodPost, "/machine/abc/boot/heartbeat", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&control))
+	assert.True(t, control.CancelRequested)
+
+	// The request waits for the management OS to confirm it stopped
+	conf.BootCancelWaitSeconds = 10
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- s.requestAs(users["alice"], http.MethodDelete, uri, "")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/machine/abc/boot/state",
+		`{"State": "cancelled"}`).Code)
+
+	resp = <-done
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var cancelled images.BootHistory
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&cancelled))
+	assert.Equal(t, images.BootCancelled, cancelled.State)
+	assert.Equal(t, "alice", cancelled.CancelledBy)
+	assert.NotNil(t, cancelled.CancelRequestedAt)
+
+	// The flash stopped halfway
+	machine, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	assert.True(t, machine.Dirty)
+
+	resp = s.requestAs(users["alice"], http.MethodDelete, uri, "")
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "already cancelled")
+}
+
+func TestApi_FailureReasons(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	// Management OSes which only send the detail, or a reason which is not known, fail for an unknown reason
+	for _, report := range []string{
+		`{"State": "failed", "FailureReason": "checksum_mismatch", "FailureDetail": "the checksum does not match"}`,
+		`{"State": "failed", "FailureDetail": "cannot open /dev/sda"}`,
+		`{"State": "failed", "FailureReason": "cosmic_rays"}`,
+		`{"State": "cancelled"}`,
+		`{"State": "completed"}`,
+	} {
+		assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup",
+			State: images.BootInProgress, LastSeen: time.Now()}))
+		assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/machine/abc/boot/state", report).Code, report)
+	}
+
+	history := func(query string) []images.BootHistory {
+		resp := s.request(http.MethodGet, "/machine/abc/history?order=asc&"+query, "")
+		assert.Equal(t, http.StatusOK, resp.Code, query)
+
+		var items []images.BootHistory
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&types.Page{Items: &items}))
+		return items
+	}
+
+	all := history("")
+	assert.Len(t, all, 5)
+	assert.Equal(t, images.FailureChecksum, all[0].FailureReason)
+	assert.Equal(t, "the checksum does not match", all[0].FailureDetail)
+	assert.Equal(t, images.FailureUnknown, all[1].FailureReason)
+	assert.Equal(t, "cannot open /dev/sda", all[1].FailureDetail)
+	assert.Equal(t, images.FailureUnknown, all[2].FailureReason)
+	assert.Equal(t, images.FailureCancelled, all[3].FailureReason)
+	assert.Empty(t, all[4].FailureReason)
+
+	assert.Len(t, history("outcome=failed"), 3)
+	failed := history("outcome=failed&reason=checksum_mismatch")
+	assert.Len(t, failed, 1)
+	assert.Equal(t, all[0].ID, failed[0].ID)
+	assert.Empty(t, history("outcome=completed&reason=unknown"))
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/machine/abc/history?outcome=exploded", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/machine/abc/history?reason=cosmic_rays", "").Code)
+
+	stats, err := store.GetStatistics(time.Now().Add(-time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, map[images.FailureReason]int64{images.FailureChecksum: 1, images.FailureUnknown: 2,
+		images.FailureCancelled: 1}, stats.FailuresByReason)
+}
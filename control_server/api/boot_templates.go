@@ -0,0 +1,366 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// templateError is returned when a boot template cannot be used, since its images are gone or its owner may no
+// longer boot them
+type templateError struct {
+	Error    string
+	Template string
+	Images   []images.ImageUUID `json:",omitempty"`
+}
+
+// checkTemplateImages checks whether the owner of a boot template may still boot the images its options select
+func (api_ *API) checkTemplateImages(r *http.Request, owner string, name string,
+	options *images.BootOptions) *bootRefusal {
+	uuid := options.SetupUUID
+	if options.SetUUID != "" {
+		uuid = options.SetUUID
+	}
+
+	if uuid == "" {
+		return &bootRefusal{http.StatusBadRequest, templateError{
+			Error:    fmt.Sprintf("boot template %s selects no image setup or image set", name),
+			Template: name,
+		}}
+	}
+
+	setup, err := api_.storeFor(r).GetImageSetup(string(uuid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &bootRefusal{http.StatusUnprocessableEntity, templateError{
+			Error:    fmt.Sprintf("boot template %s uses image setup %s, which no longer exists", name, uuid),
+			Template: name,
+		}}
+	} else if err != nil {
+		requestLog(r).Errorf("Cannot fetch image setup %s of boot template %s: %v", uuid, name, err)
+		return &bootRefusal{http.StatusInternalServerError, "Cannot fetch the image setup"}
+	}
+
+	account, err := api_.storeFor(r).GetUserByUsername(owner)
+	if err != nil {
+		requestLog(r).Errorf("Cannot fetch the owner %s of boot template %s: %v", owner, name, err)
+		return &bootRefusal{http.StatusInternalServerError, "Cannot fetch the owner of the boot template"}
+	}
+
+	// Images which were deleted since are not loaded with the setup
+	subject := authz.Subject{Username: owner, Role: account.Role}
+	var lost []images.ImageUUID
+	for i := range setup.Images {
+		frozen := &setup.Images[i]
+		if frozen.Image.UUID == "" || !authz.Image(subject, &frozen.Image, authz.Boot).Allowed {
+			lost = append(lost, frozen.UUIDImage)
+		}
+	}
+
+	if len(lost) == 0 {
+		return nil
+	}
+
+	return &bootRefusal{http.StatusUnprocessableEntity, templateError{
+		Error:    fmt.Sprintf("boot template %s uses images which %s can no longer boot", name, owner),
+		Template: name,
+		Images:   lost,
+	}}
+}
+
+// bootTemplateOwner splits a reference to a boot template into its owner and its name. A plain name is a template
+// of the logged-in user, admins and the system reference those of others as owner/name.
+func (api_ *API) bootTemplateOwner(w http.ResponseWriter, r *http.Request, reference string) (string, string, bool) {
+	username := api_.sessionUsername(r)
+	owner, name := username, reference
+	if i := strings.Index(reference, "/"); i >= 0 {
+		owner, name = reference[:i], reference[i+1:]
+	}
+
+	if owner == "" {
+		http.Error(w, "Reference the boot template as owner/name", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	if owner != username && !api_.isAdmin(r) {
+		http.Error(w, "You cannot use the boot templates of other users", http.StatusForbidden)
+		return "", "", false
+	}
+
+	return owner, name, true
+}
+
+// applyBootTemplate fills in the boot setup from the boot template it references. The fields given in the body of
+// the request override those of the template, the metadata is merged on top of that of the template. The boot
+// records the revision of the template and the options it ended up with. It answers the request when the template
+// cannot be used.
+func (api_ *API) applyBootTemplate(w http.ResponseWriter, r *http.Request, body []byte,
+	bootSetup *images.BootSetup) bool {
+	bootSetup.TemplateRevision = 0
+	bootSetup.TemplateOptions = nil
+	if bootSetup.Template == "" {
+		return true
+	}
+
+	reference := bootSetup.Template
+	owner, name, ok := api_.bootTemplateOwner(w, r, reference)
+	if !ok {
+		return false
+	}
+
+	template, err := api_.storeFor(r).GetBootTemplate(owner, name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find boot template "+reference, http.StatusBadRequest)
+		return false
+	} else if ErrorWrite(w, err, "Cannot fetch the boot template") != nil {
+		return false
+	}
+
+	*bootSetup = template.BootSetup()
+	metadata := bootSetup.Metadata
+	bootSetup.Metadata = images.Metadata{}
+
+	// The request picks either an image setup or an image set, the one of the template is dropped
+	var given map[string]json.RawMessage
+	_ = json.Unmarshal(body, &given)
+	for field := range given {
+		if strings.EqualFold(field, "SetupUUID") || strings.EqualFold(field, "SetUUID") {
+			bootSetup.SetupUUID = ""
+			bootSetup.SetUUID = ""
+		}
+	}
+
+	if err = json.Unmarshal(body, bootSetup); err != nil {
+		http.Error(w, "Invalid machine given", http.StatusBadRequest)
+		return false
+	}
+	bootSetup.Metadata = metadata.Merge(bootSetup.Metadata)
+
+	options := images.NewBootOptions(bootSetup)
+	if refusal := api_.checkTemplateImages(r, owner, name, &options); refusal != nil {
+		requestLog(r).Warnf("Refusing a boot from boot template %s of %s: %v", name, owner, refusal.Body)
+		refusal.write(w)
+		return false
+	}
+
+	snapshot := images.TemplateOptions(options)
+	bootSetup.Template = reference
+	bootSetup.TemplateRevision = template.Revision
+	bootSetup.TemplateOptions = &snapshot
+	return true
+}
+
+// readBootTemplate reads the options of a boot template from the body of a request, and checks those which do not
+// depend on the machine. It answers the request when they cannot be used.
+func (api_ *API) readBootTemplate(w http.ResponseWriter, r *http.Request, username string,
+	template *images.BootTemplate) bool {
+	if err := json.NewDecoder(r.Body).Decode(template); err != nil || template.Name == "" ||
+		strings.Contains(template.Name, "/") {
+		http.Error(w, "Invalid boot template given", http.StatusBadRequest)
+		requestLog(r).Errorf("Invalid boot template given: %v", err)
+		return false
+	}
+
+	if template.BootMode != "" && !template.BootMode.Valid() {
+		http.Error(w, "BootMode must be one of persistent, discard, overlay or diskless", http.StatusBadRequest)
+		return false
+	}
+
+	if !template.Verify.Valid() {
+		http.Error(w, "verify must be one of none, quick or full", http.StatusBadRequest)
+		return false
+	}
+
+	if refusal := api_.checkTemplateImages(r, username, template.Name, &template.BootOptions); refusal != nil {
+		refusal.write(w)
+		return false
+	}
+
+	return true
+}
+
+// getBootTemplates lists the boot templates of a user
+// Example request: GET /user/[name]/boot-templates
+// Example response: [{"Name": "lab", "Revision": 2, "SetupUUID": "74368cec-7903-4233-87b7-564195619dce",
+//
+//	"Update": false, "BootMode": "discard", "Metadata": {"Hostname": "", "SSHAuthorizedKeys": [], "Values": {}},
+//	"MetadataTemplate": "lab", "verify": "quick"}]
+func (api_ *API) getBootTemplates(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	templates, err := api_.storeFor(r).GetBootTemplates(username)
+	if ErrorWrite(w, err, "Cannot fetch the boot templates") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, templates)
+}
+
+// createBootTemplate saves a new boot template for a user
+// Example request: POST /user/[name]/boot-templates
+// Example body: {"Name": "lab", "SetupUUID": "74368cec-7903-4233-87b7-564195619dce", "BootMode": "discard",
+//
+//	"MetadataTemplate": "lab", "verify": "quick"}
+func (api_ *API) createBootTemplate(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var template images.BootTemplate
+	if !api_.readBootTemplate(w, r, username, &template) {
+		return
+	}
+
+	template.Username = username
+	if err = api_.storeFor(r).CreateBootTemplate(&template); err != nil {
+		http.Error(w, "Cannot create the boot template", http.StatusConflict)
+		log.Errorf("Cannot create boot template: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, template)
+}
+
+func (api_ *API) getBootTemplateFromURI(w http.ResponseWriter, r *http.Request) (*images.BootTemplate, error) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	name, err := GetTag("template", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	template, err := api_.storeFor(r).GetBootTemplate(username, name)
+	if err != nil {
+		http.Error(w, "Boot template not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// getBootTemplate gets a single boot template of a user
+// Example request: GET /user/[name]/boot-templates/lab
+func (api_ *API) getBootTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := api_.getBootTemplateFromURI(w, r)
+	if err != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, template)
+}
+
+// updateBootTemplate replaces the options of a boot template, which raises its revision. The boots queued before
+// keep the options they were queued with.
+// Example request: PUT /user/[name]/boot-templates/lab
+// Example body: {"Name": "lab", "SetupUUID": "74368cec-7903-4233-87b7-564195619dce", "BootMode": "overlay"}
+func (api_ *API) updateBootTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := api_.getBootTemplateFromURI(w, r)
+	if err != nil {
+		return
+	}
+
+	var updated images.BootTemplate
+	if !api_.readBootTemplate(w, r, template.Username, &updated) {
+		return
+	}
+
+	if updated.Name != template.Name {
+		http.Error(w, "The name of a boot template cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	template.BootOptions = updated.BootOptions
+	if ErrorWrite(w, api_.storeFor(r).UpdateBootTemplate(template), "Cannot update the boot template") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, template)
+}
+
+// deleteBootTemplate removes a boot template of a user, the boots queued from it keep their options
+// Example request: DELETE /user/[name]/boot-templates/lab
+func (api_ *API) deleteBootTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := api_.getBootTemplateFromURI(w, r)
+	if err != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteBootTemplate(template), "Cannot delete the boot template") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterBootTemplateHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterBootTemplateHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/boot-templates",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.getBootTemplates,
+		Method:      http.MethodGet,
+		Description: "Lists the boot templates of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/boot-templates",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.createBootTemplate,
+		Method:      http.MethodPost,
+		Schema:      "boot-template",
+		Description: "Saves a boot template for a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/boot-templates/{template}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.getBootTemplate,
+		Method:      http.MethodGet,
+		Description: "Gets a boot template of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/boot-templates/{template}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.updateBootTemplate,
+		Method:      http.MethodPut,
+		Schema:      "boot-template",
+		Description: "Replaces the options of a boot template of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/boot-templates/{template}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.deleteBootTemplate,
+		Method:      http.MethodDelete,
+		Description: "Deletes a boot template of a user",
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_BootTemplates(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "boot-templates")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "other", Email: "other@example.com",
+		Role: user.User}))
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac, Group: "lab"}))
+	machineImage, err := images.CreateMachineImageModel(mac)
+	assert.NoError(t, err)
+	assert.NoError(t, store.(sqlite.Store).Session(&gorm.Session{SkipHooks: true}).Create(machineImage).Error)
+
+	// The user has a setup of their own image, and one of a public image of someone else
+	addSetup := func(uuid string, image images.ImageModel) {
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+
+		setup := images.ImageSetup{Name: uuid, UUID: images.ImageUUID(uuid), Username: "test"}
+		assert.NoError(t, store.CreateImageSetup("test", &setup))
+		stored, err := store.GetImageByUUID(image.UUID)
+		assert.NoError(t, err)
+		store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(1), false)
+	}
+	addSetup("setup", images.ImageModel{Name: "image", Username: "test", UUID: "image"})
+	addSetup("shared", images.ImageModel{Name: "public", Username: "other", UUID: "public", Public: true})
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	queue := func(body string, system bool) images.BootSetup {
+		as := test
+		if system {
+			as = nil
+		}
+		resp := s.requestAs(as, http.MethodPost, "/machine/abc/boot", body)
+		assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+		var queued images.BootSetup
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&queued))
+		return queued
+	}
+	claim := func() images.BootHistory {
+		assert.Equal(t, http.StatusOK, s.request(http.MethodGet, "/machine/abc/boot", "").Code)
+		boot, err := store.GetActiveBoot("abc")
+		assert.NoError(t, err)
+		return *boot
+	}
+
+	const lab = `{"Name": "lab", "SetupUUID": "setup", "BootMode": "discard", "verify": "quick",
+		"Metadata": {"Hostname": "lab", "Values": {"course": "os"}}}`
+	assert.Equal(t, http.StatusCreated, s.requestAs(test, http.MethodPost, "/user/test/boot-templates", lab).Code)
+	assert.Equal(t, http.StatusConflict, s.requestAs(test, http.MethodPost, "/user/test/boot-templates", lab).Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/user/test/boot-templates",
+		`{"Name": "lab-2", "SetupUUID": "setup", "BootMode": "twice"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, s.requestAs(test, http.MethodPost, "/user/test/boot-templates",
+		`{"Name": "gone", "SetupUUID": "gone"}`).Code)
+	assert.Equal(t, http.StatusCreated, s.requestAs(test, http.MethodPost, "/user/test/boot-templates",
+		`{"Name": "shared", "SetupUUID": "shared"}`).Code)
+
+	resp := s.requestAs(test, http.MethodGet, "/user/test/boot-templates", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var templates []images.BootTemplate
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&templates))
+	assert.Len(t, templates, 2)
+	assert.Equal(t, "lab", templates[0].Name)
+	assert.Equal(t, uint(1), templates[0].Revision)
+
+	// The boot takes what it leaves out from the template, the metadata is merged
+	queued := queue(`{"Template": "lab", "Metadata": {"Values": {"seat": "1"}}}`, false)
+	assert.Equal(t, images.ImageUUID("setup"), queued.SetupUUID)
+	assert.Equal(t, images.BootDiscard, queued.BootMode)
+	assert.Equal(t, images.VerifyQuick, queued.Verify)
+	assert.Equal(t, "lab", queued.Metadata.Hostname)
+	assert.Equal(t, images.MetadataValues{"course": "os", "seat": "1"}, queued.Metadata.Values)
+	assert.Equal(t, uint(1), queued.TemplateRevision)
+
+	boot := claim()
+	assert.Equal(t, "lab", boot.Template)
+	assert.Equal(t, uint(1), boot.TemplateRevision)
+	assert.Equal(t, images.BootDiscard, boot.TemplateOptions.BootMode)
+
+	// Changing the template raises its revision, the fields of the request still override it
+	resp = s.requestAs(test, http.MethodPut, "/user/test/boot-templates/lab",
+		`{"Name": "lab", "SetupUUID": "setup", "BootMode": "overlay"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var template images.BootTemplate
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&template))
+	assert.Equal(t, uint(2), template.Revision)
+
+	queued = queue(`{"Template": "lab", "BootMode": "persistent"}`, false)
+	assert.Equal(t, images.BootPersistent, queued.BootMode)
+	boot = claim()
+	assert.Equal(t, uint(2), boot.TemplateRevision)
+	assert.Equal(t, images.BootPersistent, boot.TemplateOptions.BootMode)
+	assert.Empty(t, boot.TemplateOptions.Verify)
+
+	// The system names the owner of the template
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/machine/abc/boot", `{"Template": "lab"}`).Code)
+	assert.Equal(t, images.BootOverlay, queue(`{"Template": "test/lab"}`, true).BootMode)
+	claim()
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/machine/abc/boot",
+		`{"Template": "none"}`).Code)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(test, http.MethodPost, "/machine/abc/boot",
+		`{"Template": "other/lab"}`).Code)
+
+	resp = s.requestAs(test, http.MethodPost, "/machine-group/lab/boot", `{"Template": "lab"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var result types.MultiStatus
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, []types.MultiStatusItem{{ID: "abc", Status: types.ItemSucceeded}}, result.Items)
+	claim()
+
+	// Templates of images which are no longer public say so before anything is queued
+	assert.NoError(t, store.(sqlite.Store).Model(&images.ImageModel{}).Where("uuid = ?", "public").
+		Update("public", false).Error)
+	resp = s.requestAs(test, http.MethodPost, "/machine/abc/boot", `{"Template": "shared"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	var refused templateError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refused))
+	assert.Equal(t, "shared", refused.Template)
+	assert.Equal(t, []images.ImageUUID{"public"}, refused.Images)
+	assert.Contains(t, refused.Error, "boot template shared")
+
+	assert.Equal(t, http.StatusNoContent, s.requestAs(test, http.MethodDelete, "/user/test/boot-templates/lab", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(test, http.MethodGet, "/user/test/boot-templates/lab", "").Code)
+}
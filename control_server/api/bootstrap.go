@@ -0,0 +1,248 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/bootstrap"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/validation"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// seedImage is the sidecar describing a disk image the bootstrap seeds
+type seedImage struct {
+	Name                    string
+	Description             string
+	SourceURL               string
+	BaseOS                  string
+	License                 images.LicenseKind
+	LicenseName             string
+	Architecture            machinemodel.SystemArchitecture
+	DiskCompressionStrategy images.DiskCompressionStrategy
+	Type                    string
+	DiskUUID                string
+}
+
+// bootstrap prepares a fresh deployment as the Bootstrap section of the configuration says: the admin exists and can
+// log in, and the images of its images directory are seeded as public images. Everything it creates is recorded and
+// returned, what has a record is left alone from then on. Running it again changes nothing, and changes made by hand
+// are kept.
+func (api_ *API) bootstrap() ([]bootstrap.Record, error) {
+	if api_.config.Bootstrap.Admin == "" {
+		return nil, nil
+	}
+
+	var created []bootstrap.Record
+	record, err := api_.bootstrapAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	if record != nil {
+		created = append(created, *record)
+	}
+
+	if api_.config.Bootstrap.ImagesDir == "" {
+		return created, nil
+	}
+
+	sidecars, err := filepath.Glob(filepath.Join(api_.config.Bootstrap.ImagesDir, "*.json"))
+	if err != nil {
+		return created, err
+	}
+
+	for _, sidecar := range sidecars {
+		record, err = api_.seedImage(strings.TrimSuffix(sidecar, ".json"))
+		if err != nil {
+			return created, fmt.Errorf("seed %s: %w", sidecar, err)
+		}
+
+		if record != nil {
+			created = append(created, *record)
+		}
+	}
+
+	return created, nil
+}
+
+// bootstrapped checks whether the bootstrap created what the key names before
+func (api_ *API) bootstrapped(key string) (bool, error) {
+	_, err := api_.store.GetBootstrapRecord(key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// bootstrapAdmin creates the admin together with the identity they log in with. An existing account is only adopted
+// when it is an admin already, the bootstrap never changes the role of an account.
+func (api_ *API) bootstrapAdmin() (*bootstrap.Record, error) {
+	conf := api_.config.Bootstrap
+	key := bootstrap.AdminKey(conf.Admin)
+	if done, err := api_.bootstrapped(key); done || err != nil {
+		return nil, err
+	}
+
+	provider := usermodel.OAuthProvider(conf.Provider)
+	identity, err := api_.store.GetIdentity(provider, conf.ProviderID)
+	if err == nil && identity.Username != conf.Admin {
+		return nil, fmt.Errorf("the %s account %s of the admin already belongs to user %s", provider,
+			conf.ProviderID, identity.Username)
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	admin, err := api_.store.GetUserByUsername(conf.Admin)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if reasons := validation.Username(conf.Admin); len(reasons) != 0 {
+			return nil, fmt.Errorf("the admin cannot be named %s: %s", conf.Admin, strings.Join(reasons, ", "))
+		}
+
+		email := usermodel.NormalizeEmail(conf.Email)
+		if err = api_.checkEmail(email, ""); err != nil {
+			return nil, err
+		}
+
+		admin = &usermodel.UserModel{Username: conf.Admin, Name: conf.Name, Email: email, Role: usermodel.Admin}
+		if err = api_.store.CreateUser(admin); err != nil {
+			return nil, err
+		}
+
+		log.Infof("Bootstrap created the admin %s", admin.Username)
+	} else if err != nil {
+		return nil, err
+	} else if admin.MergedInto != "" {
+		return nil, fmt.Errorf("user %s was merged into %s, name another admin", admin.Username, admin.MergedInto)
+	} else if admin.Role != usermodel.Admin {
+		return nil, fmt.Errorf("user %s already exists with the role %s, the bootstrap does not change the role of "+
+			"an existing account", admin.Username, admin.Role)
+	}
+
+	err = api_.linkIdentity(admin.Username, provider, &oauthUser{ID: conf.ProviderID, Login: conf.Login})
+	if err != nil {
+		return nil, err
+	}
+
+	record := &bootstrap.Record{Key: key, Ref: admin.Username}
+	return record, api_.store.AddBootstrapRecord(record)
+}
+
+// seedImage creates a public image of the admin from the disk image at path and its sidecar, the disk image becomes
+// its first version. An image of the admin with the same name is never replaced.
+func (api_ *API) seedImage(path string) (*bootstrap.Record, error) {
+	key := bootstrap.ImageKey(filepath.Base(path))
+	if done, err := api_.bootstrapped(key); done || err != nil {
+		return nil, err
+	}
+
+	sidecar, err := ioutil.ReadFile(path + ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	var seed seedImage
+	if err = json.Unmarshal(sidecar, &seed); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	image := images.ImageModel{
+		Name:                    seed.Name,
+		Username:                api_.config.Bootstrap.Admin,
+		Description:             seed.Description,
+		SourceURL:               seed.SourceURL,
+		BaseOS:                  seed.BaseOS,
+		License:                 seed.License,
+		LicenseName:             seed.LicenseName,
+		Architecture:            seed.Architecture,
+		DiskCompressionStrategy: seed.DiskCompressionStrategy,
+		Type:                    seed.Type,
+		DiskUUID:                seed.DiskUUID,
+		Public:                  true,
+	}
+
+	if image.Name == "" {
+		return nil, errors.New("the sidecar does not name the image")
+	}
+
+	for _, check := range []func(*images.ImageModel) error{validateImageInfo, checkArchitecture, checkDiskUUID} {
+		if err = check(&image); err != nil {
+			return nil, err
+		}
+	}
+
+	if problem := api_.unpublishable(&image); problem != nil {
+		return nil, fmt.Errorf("%s, set %s", problem.Error, strings.Join(problem.Missing, " and "))
+	}
+
+	existing, err := api_.store.GetImagesByNameAndUsername(image.Name, image.Username)
+	if err != nil {
+		return nil, err
+	} else if len(existing) != 0 {
+		return nil, fmt.Errorf("the admin already has an image named %s", existing[0].Name)
+	}
+
+	image.UUID = images.ImageUUID(uuid.New().String())
+	api_.placeImage(&image)
+	if image.Type == "" {
+		image.Type = "base"
+	}
+
+	if err = api_.store.CreateImage(&image); err != nil {
+		return nil, err
+	}
+
+	dest := api_.versionFile(&image, 0)
+	checksum, err := storeBuild(path, dest+".part", image.DiskCompressionStrategy)
+	if err == nil {
+		err = os.Rename(dest+".part", dest)
+	}
+
+	var format images.FileFormat
+	if err == nil {
+		format, err = detectFileFormat(dest, &image)
+	}
+
+	if err != nil {
+		_ = os.Remove(dest + ".part")
+		if deleteErr := api_.store.DeleteImage(&image); deleteErr != nil {
+			log.Errorf("Cannot remove image %s after seeding it failed: %v", image.UUID, deleteErr)
+		}
+		return nil, err
+	}
+
+	if err = api_.store.SetVersionSize(image.UUID, 0, uint64(info.Size())); err != nil {
+		log.Warnf("Cannot store the size of the seeded image %s: %v", image.UUID, err)
+	}
+
+	if err = api_.store.SetVersionChecksum(image.UUID, 0, checksum); err != nil {
+		log.Warnf("Cannot store the checksum of the seeded image %s: %v", image.UUID, err)
+	}
+
+	if err = api_.store.SetVersionFormat(image.UUID, 0, format); err != nil {
+		log.Warnf("Cannot store the format of the seeded image %s: %v", image.UUID, err)
+	}
+
+	log.Infof("Bootstrap seeded the public image %s (%s) from %s", image.Name, image.UUID, path)
+	record := &bootstrap.Record{Key: key, Ref: string(image.UUID)}
+	return record, api_.store.AddBootstrapRecord(record)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/bootstrap"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Bootstrap(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "bootstrap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	seeds := filepath.Join(diskpath, "seeds")
+	assert.NoError(t, os.Mkdir(seeds, 0755))
+	disk := []byte("a disk image which is not much of one")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(seeds, "debian.img"), disk, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(seeds, "debian.img.json"), []byte(`{"Name": "Debian",
+		"BaseOS": "Debian 12", "License": "open-source", "Description": "Plain Debian"}`), 0644))
+
+	conf := config.Default()
+	conf.Bootstrap = config.BootstrapConfig{Admin: "jan", Email: "jan@example.com", Provider: "github",
+		ProviderID: "42", Login: "octoroot", ImagesDir: seeds}
+
+	// An account which diverged from the configuration is neither promoted nor demoted
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}))
+	_, err = NewAPI(store, diskpath, conf).bootstrap()
+	assert.Error(t, err)
+	diverged, err := store.GetUserByUsername("jan")
+	assert.NoError(t, err)
+	assert.Equal(t, user.User, diverged.Role)
+	identities, err := store.GetIdentitiesByUsername("jan")
+	assert.NoError(t, err)
+	assert.Empty(t, identities)
+
+	conf.Bootstrap.Admin = "root"
+	conf.Bootstrap.Email = "root@example.com"
+	created, err := NewAPI(store, diskpath, conf).bootstrap()
+	assert.NoError(t, err)
+	assert.Len(t, created, 2)
+	assert.Equal(t, bootstrap.AdminKey("root"), created[0].Key)
+	assert.Equal(t, bootstrap.ImageKey("debian.img"), created[1].Key)
+
+	// The admin logs in with the identity of the configuration
+	api := NewAPI(store, diskpath, conf)
+	admin, err := api.returnUserByOAuth(user.ProviderGitHub, &oauthUser{ID: "42", Login: "octoroot"})
+	assert.NoError(t, err)
+	assert.Equal(t, "root", admin.Username)
+	assert.Equal(t, user.Admin, admin.Role)
+
+	image, err := store.GetImageByUUID(images.ImageUUID(created[1].Ref))
+	assert.NoError(t, err)
+	assert.True(t, image.Public)
+	assert.Equal(t, "Debian", image.Name)
+	assert.Equal(t, "root", image.Username)
+	sum := sha256.Sum256(disk)
+	assert.Equal(t, hex.EncodeToString(sum[:]), image.FindVersion(0).SHA256)
+	stored, err := ioutil.ReadFile(api.versionFile(image, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, disk, stored)
+
+	// Changes made by hand afterwards survive running it again, which changes nothing
+	image.Description = "Debian with our tweaks"
+	assert.NoError(t, store.UpdateImage(image))
+	created, err = NewAPI(store, diskpath, conf).bootstrap()
+	assert.NoError(t, err)
+	assert.Empty(t, created)
+
+	found, err := store.GetImagesByUsername("root")
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, "Debian with our tweaks", found[0].Description)
+
+	// An identity belonging to someone else is never handed to the admin
+	conf.Bootstrap.Admin = "other"
+	conf.Bootstrap.Email = "other@example.com"
+	conf.Bootstrap.ImagesDir = ""
+	_, err = NewAPI(store, diskpath, conf).bootstrap()
+	assert.Error(t, err)
+	_, err = store.GetUserByUsername("other")
+	assert.Error(t, err)
+}
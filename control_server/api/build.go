@@ -0,0 +1,281 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/control_server/builder"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/limits"
+	"github.com/baas-project/baas/pkg/model/images"
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// buildRequest names the container image a version is built from
+type buildRequest struct {
+	Reference string `description:"The container image the version is built from"`
+}
+
+// newBuildQueue creates the queue of the image builds, which registers the images it builds as versions
+func (api_ *API) newBuildQueue(conf *config.Config) *builder.Queue {
+	return builder.NewQueue(builder.Config{
+		Dir:       conf.BuildDir,
+		MaxBytes:  int64(conf.BuildMaxBytes),
+		Timeout:   time.Duration(conf.BuildTimeoutMinutes) * time.Minute,
+		MaxQueued: int(conf.BuildMaxQueued),
+	}, builder.NewScriptBuilder(conf.BuildScript, conf.BuildBootloader), builder.NewCranePuller(conf.BuildCrane),
+		api_.registerBuild)
+}
+
+// findBuildImage looks up the image named in the URI
+func (api_ *API) findBuildImage(w http.ResponseWriter, r *http.Request) (*images.ImageModel, error) {
+	owner, err := api_.findUser(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := GetTag("image_name", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	found, err := api_.storeFor(r).GetImagesByNameAndUsername(name, owner.Username)
+	if ErrorWrite(w, err, "Cannot look up the image") != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		http.Error(w, "The user has no image named "+name, http.StatusNotFound)
+		return nil, errors.New("image not found")
+	}
+
+	return &found[0], nil
+}
+
+// BuildImage queues the build of a new version of an image. A JSON body names the container image it is built from,
+// any other body is a tarball of the root file system, which may be compressed with gzip. The build runs in the
+// background, the job it answers with tells how it is going.
+// Example request: POST /user/Jan/images/Debian/build {"Reference": "docker.io/library/debian:bookworm"}
+// Example response: {"ID": 4, "Username": "Jan", "Image": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf",
+//
+//	"Reference": "docker.io/library/debian:bookworm", "State": "queued", "Unsupported": false, "Log": "",
+//	"CreatedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) BuildImage(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findBuildImage(w, r)
+	if err != nil {
+		return
+	}
+
+	if !api_.checkLimits(w, image.Username, limits.CreateVersion(image.UUID)) {
+		return
+	}
+
+	var reference string
+	var tarball io.Reader
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var request buildRequest
+		if err = json.NewDecoder(r.Body).Decode(&request); err != nil || request.Reference == "" {
+			http.Error(w, "The request does not name a container image", http.StatusBadRequest)
+			return
+		}
+		reference = request.Reference
+	} else {
+		done, ok := api_.admitUpload(w, r)
+		if !ok {
+			return
+		}
+		defer done()
+
+		tarball = r.Body
+	}
+
+	job, err := api_.builds.Submit(image.Username, image.UUID, reference, tarball)
+	switch {
+	case errors.Is(err, builder.ErrTooLarge):
+		http.Error(w, fmt.Sprintf("The tarball is larger than the %d bytes a build may take", api_.config.BuildMaxBytes),
+			http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, builder.ErrQueueFull):
+		http.Error(w, "Too many builds are waiting, try again later", http.StatusServiceUnavailable)
+		return
+	case ErrorWrite(w, err, "Cannot queue the build") != nil:
+		return
+	}
+
+	requestLog(r).Infof("Queued build %d of image %s", job.ID, image.UUID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GetBuild follows a build, the log is the output of the build so far. Builds are forgotten when the control server
+// restarts and once many builds finished after them.
+// Example request: GET /user/Jan/images/Debian/build/4
+// Example response: {"ID": 4, "Username": "Jan", "Image": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf",
+//
+//	"Reference": "docker.io/library/debian:bookworm", "State": "failed",
+//	"Error": "unsupported input: the root file system has no kernel in /boot, ...", "Unsupported": true,
+//	"Log": "Pulling docker.io/library/debian:bookworm\n...", "CreatedAt": "2022-06-01T12:00:00Z", ...}
+func (api_ *API) GetBuild(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findBuildImage(w, r)
+	if err != nil {
+		return
+	}
+
+	tag, err := GetTag("id", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	id, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+
+	// The builds of other images are not found either, their owners may not be the one asking
+	job, err := api_.builds.Get(id)
+	if errors.Is(err, builder.ErrNotFound) || (err == nil && job.Image != image.UUID) {
+		http.Error(w, "The image has no such build", http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the build") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// registerBuild stores the disk image of a build as a new version, compressed like the uploads of the image. The
+// limits are checked again, the build may have waited a long time for its turn.
+func (api_ *API) registerBuild(job builder.Job, path string) (uint64, error) {
+	image, err := api_.store.GetImageByUUID(job.Image)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	release, err := api_.claimFiles(image)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	size := uint64(info.Size())
+	for _, action := range []limits.Action{limits.CreateVersion(image.UUID), limits.StoreBytes(size, 0)} {
+		if err = limits.Check(api_.store, image.Username, action); err != nil {
+			return 0, err
+		}
+	}
+
+	version, err := CreateNewVersion(string(image.UUID), api_.store)
+	if err != nil {
+		return 0, err
+	}
+
+	dest := api_.versionFile(image, version.Version)
+	checksum, err := storeBuild(path, dest+".part", image.DiskCompressionStrategy)
+	if err == nil {
+		err = os.Rename(dest+".part", dest)
+	}
+
+	if err != nil {
+		_ = os.Remove(dest + ".part")
+		if deleteErr := api_.store.DeleteVersion(&version); deleteErr != nil {
+			log.Errorf("Cannot remove version %d of %s after its build failed: %v", version.Version, image.UUID,
+				deleteErr)
+		}
+		return 0, err
+	}
+
+	if err = api_.store.SetVersionSize(image.UUID, version.Version, size); err != nil {
+		log.Warnf("Cannot store the size of version %d: %v", version.Version, err)
+	}
+
+	if err = api_.store.SetVersionChecksum(image.UUID, version.Version, checksum); err != nil {
+		log.Warnf("Cannot store the checksum of version %d: %v", version.Version, err)
+	}
+
+	if err = api_.store.SetVersionFormat(image.UUID, version.Version, images.FormatRaw); err != nil {
+		log.Warnf("Cannot store the format of version %d: %v", version.Version, err)
+	}
+
+	api_.imageEvent(image, images.WebhookVersionCreated, &version.Version)
+	return version.Version, nil
+}
+
+// storeBuild compresses the disk image into dest and returns the checksum of what it stored
+func storeBuild(path string, dest string, strategy images.DiskCompressionStrategy) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	if strategy == "" {
+		strategy = images.DiskCompressionStrategyNone
+	}
+
+	compressed, err := compression.Compress(src, strategy)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = fs.Copy(io.MultiWriter(f, hash), compressed)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// RegisterBuildHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterBuildHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/images/{image_name}/build",
+		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Timeout:     NoTimeout,
+		Scope:       usermodel.ScopeImagesWrite,
+		Handler:     api_.BuildImage,
+		Idempotent:  true,
+		Method:      http.MethodPost,
+		Schema:      "build",
+		Description: "Builds a new version of an image from a container image or a root file system tarball",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/images/{image_name}/build/{id}",
+		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeImagesRead,
+		Handler:     api_.GetBuild,
+		Method:      http.MethodGet,
+		Description: "Follows the build of a new version of an image",
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/builder"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// testImageBuilder writes the files of the root file system one after another as the disk image
+type testImageBuilder struct{}
+
+func (testImageBuilder) Build(_ context.Context, rootfs string, image string, _ int64, log io.Writer) error {
+	var disk bytes.Buffer
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(path)
+		disk.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintln(log, "installed the bootloader")
+	return ioutil.WriteFile(image, disk.Bytes(), 0644)
+}
+
+// testPuller finds an index of several architectures behind every reference
+type testPuller struct{}
+
+func (testPuller) Pull(_ context.Context, reference string, _ io.Writer, _ io.Writer) error {
+	return &builder.UnsupportedError{Reason: reference + " is a multi-architecture index"}
+}
+
+func rootFSTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, content := range files {
+		assert.NoError(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)),
+			Typeflag: tar.TypeReg}))
+		_, err := w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestApi_BuildImage(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "build")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	alice := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(alice))
+	bob := &user.UserModel{Username: "bob", Email: "bob@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(bob))
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "debian", Username: "alice", UUID: "disk",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone}))
+	assert.NoError(t, os.Mkdir(filepath.Join(diskpath, "disk"), 0755))
+
+	conf := config.Default()
+	conf.BuildDir = filepath.Join(diskpath, "builds")
+	s := newTestServer(t, store, diskpath, conf)
+	s.api.builds = builder.NewQueue(builder.Config{Dir: conf.BuildDir, MaxBytes: 1 << 20, Timeout: time.Minute,
+		MaxQueued: 2}, testImageBuilder{}, testPuller{}, s.api.registerBuild)
+
+	// build sends a root file system or an image reference to build as alice
+	build := func(uri string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, uri, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		s.login(req, alice)
+		return s.serve(req)
+	}
+
+	// wait polls the build until it finished
+	wait := func(resp *httptest.ResponseRecorder) builder.Job {
+		assert.Equal(t, http.StatusAccepted, resp.Code, resp.Body.String())
+		var job builder.Job
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+
+		uri := fmt.Sprintf("/user/alice/images/debian/build/%d", job.ID)
+		for i := 0; i < 200 && job.State != builder.Succeeded && job.State != builder.Failed; i++ {
+			time.Sleep(10 * time.Millisecond)
+			resp = s.requestAs(alice, http.MethodGet, uri, "")
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+		}
+
+		return job
+	}
+
+	tarball := rootFSTarball(t, map[string]string{"etc/hostname": "machine\n", "boot/vmlinuz": "kernel"})
+	job := wait(build("/user/alice/images/debian/build", "application/x-tar", tarball))
+	assert.Equal(t, builder.Succeeded, job.State, job.Log)
+	assert.Equal(t, uint64(1), job.Version)
+	assert.Contains(t, job.Log, "installed the bootloader")
+
+	image, err := store.GetImageByUUID("disk")
+	assert.NoError(t, err)
+	version := image.FindVersion(1)
+	if assert.NotNil(t, version) {
+		stored, err := ioutil.ReadFile(filepath.Join(diskpath, "disk", "1.img"))
+		assert.NoError(t, err)
+		sum := sha256.Sum256(stored)
+		assert.Equal(t, hex.EncodeToString(sum[:]), version.SHA256)
+		assert.Equal(t, uint64(len(stored)), version.Size)
+	}
+
+	// Others cannot follow the builds of alice
+	uri := fmt.Sprintf("/user/alice/images/debian/build/%d", job.ID)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(bob, http.MethodGet, uri, "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(alice, http.MethodGet, "/user/alice/images/debian/build/100",
+		"").Code)
+
+	// A root file system without a kernel cannot boot
+	tarball = rootFSTarball(t, map[string]string{"etc/hostname": "machine\n"})
+	job = wait(build("/user/alice/images/debian/build", "application/x-tar", tarball))
+	assert.Equal(t, builder.Failed, job.State)
+	assert.True(t, job.Unsupported)
+	assert.Contains(t, job.Error, "no kernel")
+
+	job = wait(build("/user/alice/images/debian/build", "application/json",
+		[]byte(`{"Reference": "docker.io/library/debian"}`)))
+	assert.True(t, job.Unsupported)
+	assert.Contains(t, job.Log, "multi-architecture index")
+
+	assert.Equal(t, http.StatusBadRequest, build("/user/alice/images/debian/build", "application/json",
+		[]byte(`{}`)).Code)
+	assert.Equal(t, http.StatusNotFound, build("/user/alice/images/ubuntu/build",
+		"application/x-tar", tarball).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, build("/user/alice/images/debian/build",
+		"application/x-tar", make([]byte, 2<<20)).Code)
+
+	// Only the successful build left a version behind
+	image, err = store.GetImageByUUID("disk")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 2)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/baas-project/baas/pkg/model/machine"
+)
+
+// clockHeader carries the clock of the management OS on its heartbeats, in RFC 3339 with nanoseconds. It is only
+// compared with the clock of the control server, every time which is stored is taken from the latter.
+const clockHeader = "X-BAAS-Clock"
+
+// statusClockSkew lists the machines whose clock was off by more than ClockSkewMaxSeconds at their last heartbeat
+const statusClockSkew = "clock_skew"
+
+var clockSkew = metrics.NewGauge("baas_machine_clock_skew_seconds",
+	"How far the clock of the management OS was ahead of the control server at its last heartbeat.", "machine")
+
+// recordClock compares the clock the management OS sent along with a heartbeat with our own. Machines booted with
+// a clock which NTP did not set yet are logged, the times in their history are ours anyway.
+func (api_ *API) recordClock(r *http.Request, mac string) {
+	reported := r.Header.Get(clockHeader)
+	if reported == "" {
+		return
+	}
+
+	agentTime, err := time.Parse(time.RFC3339Nano, reported)
+	if err != nil {
+		requestLog(r).Debugf("Ignoring the clock %q of %s: %v", reported, mac, err)
+		return
+	}
+
+	now := time.Now()
+	skew := agentTime.Sub(now)
+	if err = api_.storeFor(r).SetMachineClockSkew(mac, skew, now); err != nil {
+		requestLog(r).Debugf("Cannot record the clock of %s: %v", mac, err)
+		return
+	}
+
+	clockSkew.Set(skew.Seconds(), mac)
+	if api_.clockSkewed(skew) {
+		requestLog(r).Warnf("The clock of %s is off by %s", mac, skew.Round(time.Second))
+	}
+}
+
+// clockSkewed tells whether a clock which is off by skew is off by too much
+func (api_ *API) clockSkewed(skew time.Duration) bool {
+	if skew < 0 {
+		skew = -skew
+	}
+
+	return skew > time.Duration(api_.config.ClockSkewMaxSeconds)*time.Second
+}
+
+// filterMachineStatus keeps the machines in the status asked for with ?status=. Without it, the machines which
+// registered themselves and were not approved are left out. Only admins list those.
+func (api_ *API) filterMachineStatus(w http.ResponseWriter, r *http.Request,
+	machines []machine.MachineModel) ([]machine.MachineModel, bool) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		approved := []machine.MachineModel{}
+		for _, m := range machines {
+			if m.Approved() {
+				approved = append(approved, m)
+			}
+		}
+
+		return approved, true
+	case statusClockSkew:
+		skewed := []machine.MachineModel{}
+		for _, m := range machines {
+			if m.ClockCheckedAt != nil && api_.clockSkewed(time.Duration(m.ClockSkewMillis)*time.Millisecond) {
+				skewed = append(skewed, m)
+			}
+		}
+
+		return skewed, true
+	case string(machine.MachinePending), string(machine.MachineRejected):
+		if !api_.isAdmin(r) {
+			http.Error(w, "Only administrators list the machines which were not approved", http.StatusForbidden)
+			return nil, false
+		}
+
+		found := []machine.MachineModel{}
+		for _, m := range machines {
+			if m.RegistrationStatus() == machine.RegistrationStatus(status) {
+				found = append(found, m)
+			}
+		}
+
+		return found, true
+	default:
+		http.Error(w, "status must be "+statusClockSkew+", pending or rejected", http.StatusBadRequest)
+		return nil, false
+	}
+}
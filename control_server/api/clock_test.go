@@ -0,0 +1,84 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ClockSkew(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, mac := range []string{"abc", "def", "ghi"} {
+		assert.NoError(t, store.CreateMachine(&machine.MachineModel{Name: mac, MacAddress: util.MacAddress{Address: mac}}))
+	}
+	assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup",
+		State: images.BootInProgress, LastSeen: time.Now()}))
+	before, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	heartbeat := func(mac string, clock string) int {
+		header := http.Header{}
+		if clock != "" {
+			header.Set(clockHeader, clock)
+		}
+		return s.requestWith(header, http.MethodPost, "/machine/"+mac+"/boot/heartbeat", "").Code
+	}
+	skewed := func() []string {
+		resp := s.request(http.MethodGet, "/machines?status=clock_skew", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var listing []types.Machine
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listing))
+		names := []string{}
+		for _, m := range listing {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	// A machine which booted with the clock at 1970, one which is a little off and one which never told
+	epoch := time.Unix(5, 0).Format(time.RFC3339Nano)
+	assert.Equal(t, http.StatusOK, heartbeat("abc", epoch))
+	assert.Equal(t, http.StatusNotFound, heartbeat("def", time.Now().Add(-10*time.Second).Format(time.RFC3339Nano)))
+	assert.Equal(t, http.StatusNotFound, heartbeat("ghi", ""))
+	assert.Equal(t, []string{"abc"}, skewed())
+
+	stored, err := store.GetMachineByMac(util.MacAddress{Address: "abc"})
+	assert.NoError(t, err)
+	assert.NotNil(t, stored.ClockCheckedAt)
+	assert.Less(t, stored.ClockSkewMillis, int64(-50*365*24*time.Hour/time.Millisecond))
+	assert.True(t, before.UpdatedAt.Equal(stored.UpdatedAt), "the clock is not a change of the machine")
+	assert.Less(t, clockSkew.Value("abc"), float64(-1e9))
+
+	stored, err = store.GetMachineByMac(util.MacAddress{Address: "def"})
+	assert.NoError(t, err)
+	assert.InDelta(t, -10000, stored.ClockSkewMillis, 1000)
+
+	// Once NTP set the clock the machine is no longer listed
+	assert.Equal(t, http.StatusOK, heartbeat("abc", time.Now().Format(time.RFC3339Nano)))
+	assert.Empty(t, skewed())
+
+	// Garbage is ignored rather than recorded
+	assert.Equal(t, http.StatusOK, heartbeat("abc", "yesterday"))
+	assert.Empty(t, skewed())
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/machines?status=broken", "").Code)
+	resp := s.request(http.MethodGet, "/machines", "")
+	var listing []types.Machine
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listing))
+	assert.Len(t, listing, 3)
+}
@@ -0,0 +1,370 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ruleCommand labels the commands the janitor expired
+const ruleCommand = "command"
+
+// speedTestBytes is how much the speedtest diagnostic downloads from the control server
+const speedTestBytes = 64 * 1024 * 1024
+
+// commandLog is the audit log of a command, it names the administrator who queued it
+func commandLog(r *http.Request, command *machine.MachineCommand) *log.Entry {
+	return requestLog(r).WithFields(log.Fields{
+		"machine":      command.MachineMAC,
+		"command":      command.ID,
+		"diagnostic":   command.Diagnostic,
+		"requested_by": command.RequestedBy,
+	})
+}
+
+// findCommand finds the command in the path of the request, it answers the request itself when there is none
+func (api_ *API) findCommand(w http.ResponseWriter, r *http.Request) (*machine.MachineCommand, error) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	tag, err := GetTag("id", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseUint(tag, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid command id", http.StatusBadRequest)
+		return nil, err
+	}
+
+	command, err := api_.storeFor(r).GetMachineCommand(mac, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find the command", http.StatusNotFound)
+		return nil, err
+	}
+
+	return command, ErrorWrite(w, err, "Cannot fetch the command")
+}
+
+// diagnosticNames lists the names of the diagnostics which can be run
+func diagnosticNames() string {
+	names := make([]string, 0, len(machine.Diagnostics))
+	for _, diagnostic := range machine.Diagnostics {
+		names = append(names, diagnostic.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// GetDiagnostics lists the diagnostics a machine in the management OS can be asked to run
+// Example request: GET /diagnostics
+// Example response: [{"Name": "lsblk", "Description": "Lists the block devices of the machine",
+//
+//	"TimeoutSeconds": 10}, ...]
+func (api_ *API) GetDiagnostics(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, machine.Diagnostics)
+}
+
+// commandRequest is the diagnostic a machine is asked to run
+type commandRequest struct {
+	Diagnostic string `description:"The name of the diagnostic on the allow-list"`
+}
+
+// QueueMachineCommand asks a machine to run a diagnostic the next time the management OS polls for commands. Only
+// the diagnostics of the allow-list can be run. Commands which the machine does not pick up within
+// CommandExpiryMinutes expire.
+// Example request: POST /machine/52:54:00:d9:71:93/commands
+// Example body: {"Diagnostic": "smartctl"}
+// Example response: {"ID": 4, "MachineMAC": "52:54:00:d9:71:93", "Diagnostic": "smartctl", "State": "queued", ...}
+func (api_ *API) QueueMachineCommand(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var body commandRequest
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid command", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := machine.FindDiagnostic(body.Diagnostic); !ok {
+		http.Error(w, fmt.Sprintf("Unknown diagnostic %q, the diagnostics are %s", body.Diagnostic,
+			diagnosticNames()), http.StatusBadRequest)
+		return
+	}
+
+	_, err = api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find the machine", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the machine") != nil {
+		return
+	}
+
+	command := machine.MachineCommand{
+		MachineMAC:  mac,
+		Diagnostic:  body.Diagnostic,
+		RequestedBy: api_.requester(r),
+		State:       machine.CommandQueued,
+		ExpiresAt:   time.Now().Add(time.Duration(api_.config.CommandExpiryMinutes) * time.Minute),
+	}
+	if ErrorWrite(w, api_.storeFor(r).AddMachineCommand(&command), "Cannot queue the command") != nil {
+		return
+	}
+
+	commandLog(r, &command).WithField("audit", "machine-command-queued").
+		Infof("Queued %s for %s", command.Diagnostic, mac)
+	writeJSON(w, http.StatusCreated, command)
+}
+
+// GetMachineCommands lists the commands of a machine with their results, the newest first
+// Example request: GET /machine/52:54:00:d9:71:93/commands
+// Example response: [{"ID": 4, "Diagnostic": "smartctl", "State": "completed", "ExitCode": 0,
+//
+//	"Output": "smartctl 7.2 ...", "Truncated": false, ...}]
+func (api_ *API) GetMachineCommands(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	commands, err := api_.storeFor(r).GetMachineCommands(mac)
+	if ErrorWrite(w, err, "Cannot fetch the commands") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, commands)
+}
+
+// GetMachineCommand fetches a single command of a machine with its result
+// Example request: GET /machine/52:54:00:d9:71:93/commands/4
+// Example response: {"ID": 4, "Diagnostic": "smartctl", "State": "completed", "ExitCode": 0, ...}
+func (api_ *API) GetMachineCommand(w http.ResponseWriter, r *http.Request) {
+	command, err := api_.findCommand(w, r)
+	if err != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, command)
+}
+
+// ClaimMachineCommands hands the queued commands of a machine to its management OS, which polls for them along with
+// its heartbeats. From then on it has until the timeout of the diagnostic to report the result.
+// Example request: POST /machine/52:54:00:d9:71:93/commands/claim
+// Example response: [{"ID": 4, "Diagnostic": "smartctl", "State": "sent", ...}]
+func (api_ *API) ClaimMachineCommands(w http.ResponseWriter, r *http.Request) {
+	if !api_.isMachine(r) {
+		http.Error(w, "only the management OS can run commands", http.StatusForbidden)
+		return
+	}
+
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	commands, err := api_.storeFor(r).ClaimMachineCommands(mac, time.Now())
+	if ErrorWrite(w, err, "Cannot fetch the commands") != nil {
+		return
+	}
+
+	for i := range commands {
+		commandLog(r, &commands[i]).WithField("audit", "machine-command-sent").
+			Infof("Sent %s to %s", commands[i].Diagnostic, mac)
+	}
+
+	writeJSON(w, http.StatusOK, commands)
+}
+
+// SetMachineCommandResult stores what a diagnostic reported. The output is cut off at CommandOutputMaxBytes, results
+// of commands which were not sent to the machine or already expired are refused.
+// Example request: PUT /machine/52:54:00:d9:71:93/commands/4/result
+// Example body: {"ExitCode": 0, "Output": "NAME SIZE TYPE ...", "Truncated": false}
+func (api_ *API) SetMachineCommandResult(w http.ResponseWriter, r *http.Request) {
+	if !api_.isMachine(r) {
+		http.Error(w, "only the management OS reports the results of commands", http.StatusForbidden)
+		return
+	}
+
+	command, err := api_.findCommand(w, r)
+	if err != nil {
+		return
+	}
+
+	// The output is cut off anyway, there is no reason to read much more of it
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 2*machine.CommandOutputMaxBytes+64*1024))
+	if err != nil {
+		http.Error(w, "Cannot read the result", http.StatusBadRequest)
+		return
+	}
+
+	var result machine.CommandResult
+	if err = json.Unmarshal(body, &result); err != nil {
+		http.Error(w, "Invalid result, at most "+strconv.Itoa(machine.CommandOutputMaxBytes)+
+			" bytes of output are kept", http.StatusBadRequest)
+		return
+	}
+
+	if command.State != machine.CommandSent {
+		http.Error(w, fmt.Sprintf("The command is %s, it is not waiting for a result", command.State),
+			http.StatusConflict)
+		return
+	}
+
+	command.Finish(&result, time.Now())
+	if ErrorWrite(w, api_.storeFor(r).UpdateMachineCommand(command), "Cannot store the result") != nil {
+		return
+	}
+
+	commandLog(r, command).WithFields(log.Fields{"audit": "machine-command-finished", "state": command.State,
+		"exit_code": command.ExitCode}).Infof("%s on %s finished", command.Diagnostic, command.MachineMAC)
+	writeJSON(w, http.StatusOK, command)
+}
+
+// SpeedTest sends the data the speedtest diagnostic downloads to measure the network of a machine
+// Example request: GET /machine/52:54:00:d9:71:93/speedtest
+func (api_ *API) SpeedTest(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(speedTestBytes))
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.CopyN(w, zeroReader{}, speedTestBytes)
+}
+
+// zeroReader reads zeroes forever
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// expireCommands expires the commands which the machine did not pick up or answer in time, most likely because it
+// was not in the management OS
+func (api_ *API) expireCommands(plan *api_pkg.PlannedChanges, now time.Time) error {
+	expired, err := api_.store.GetMachineCommandsExpiredBefore(now)
+	if err != nil {
+		return err
+	}
+
+	for i := range expired {
+		command := &expired[i]
+		plan.Row(api_pkg.PlanModify, "command", strconv.FormatUint(uint64(command.ID), 10))
+		if plan.DryRun {
+			continue
+		}
+
+		command.State = machine.CommandExpired
+		if err = api_.store.UpdateMachineCommand(command); err != nil {
+			return err
+		}
+
+		cleaned(plan, ruleCommand, "%s for %s requested by %s expired", command.Diagnostic, command.MachineMAC,
+			command.RequestedBy)
+	}
+
+	return nil
+}
+
+// RegisterCommandHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterCommandHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/diagnostics",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetDiagnostics,
+		Method:      http.MethodGet,
+		Description: "Lists the diagnostics a machine in the management OS can run",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/commands",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.QueueMachineCommand,
+		Method:      http.MethodPost,
+		Schema:      "machine-command",
+		Description: "Asks a machine in the management OS to run a diagnostic",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/commands",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetMachineCommands,
+		Method:      http.MethodGet,
+		Description: "Lists the diagnostics run on a machine with their results",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/commands/claim",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.ClaimMachineCommands,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Hands the queued diagnostics to the management OS",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/commands/{id}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetMachineCommand,
+		Method:      http.MethodGet,
+		Description: "Gets a diagnostic run on a machine with its result",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/commands/{id}/result",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetMachineCommandResult,
+		Method:      http.MethodPut,
+		Schema:      "command-result",
+		Description: "Reports the result of a diagnostic",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/speedtest",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SpeedTest,
+		Method:      http.MethodGet,
+		Description: "Sends the data the speedtest diagnostic downloads",
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_MachineCommands(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, test} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machine.MachineModel{MacAddress: mac}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	queue := func(diagnostic string) machine.MachineCommand {
+		resp := s.requestAs(admin, http.MethodPost, "/machine/abc/commands", `{"Diagnostic": "`+diagnostic+`"}`)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		var command machine.MachineCommand
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&command))
+		return command
+	}
+
+	claim := func() []machine.MachineCommand {
+		resp := s.requestAs(nil, http.MethodPost, "/machine/abc/commands/claim", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var commands []machine.MachineCommand
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&commands))
+		return commands
+	}
+
+	// Only the diagnostics of the allow-list can be queued, by administrators
+	resp := s.requestAs(admin, http.MethodPost, "/machine/abc/commands", `{"Diagnostic": "rm -rf /"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "smartctl")
+	assert.Equal(t, http.StatusNotFound,
+		s.requestAs(admin, http.MethodPost, "/machine/def/commands", `{"Diagnostic": "lsblk"}`).Code)
+	assert.Equal(t, http.StatusForbidden,
+		s.requestAs(test, http.MethodPost, "/machine/abc/commands", `{"Diagnostic": "lsblk"}`).Code)
+
+	queued := queue("lsblk")
+	assert.Equal(t, machine.CommandQueued, queued.State)
+	assert.Equal(t, "admin", queued.RequestedBy)
+
+	// Users cannot pose as the management OS
+	assert.Equal(t, http.StatusForbidden, s.requestAs(admin, http.MethodPost, "/machine/abc/commands/claim", "").Code)
+
+	sent := claim()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, machine.CommandSent, sent[0].State)
+	assert.NotNil(t, sent[0].SentAt)
+	assert.Empty(t, claim())
+
+	result := fmt.Sprintf("/machine/abc/commands/%d/result", queued.ID)
+	output, err := json.Marshal(machine.CommandResult{ExitCode: 1, Output: strings.Repeat("x",
+		machine.CommandOutputMaxBytes+10)})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(admin, http.MethodPut, result, string(output)).Code)
+	assert.Equal(t, http.StatusOK, s.requestAs(nil, http.MethodPut, result, string(output)).Code)
+	assert.Equal(t, http.StatusConflict, s.requestAs(nil, http.MethodPut, result, string(output)).Code)
+
+	resp = s.requestAs(admin, http.MethodGet, fmt.Sprintf("/machine/abc/commands/%d", queued.ID), "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var finished machine.MachineCommand
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&finished))
+	assert.Equal(t, machine.CommandCompleted, finished.State)
+	assert.Equal(t, 1, finished.ExitCode)
+	assert.Len(t, finished.Output, machine.CommandOutputMaxBytes)
+	assert.True(t, finished.Truncated)
+	assert.NotNil(t, finished.FinishedAt)
+
+	assert.Equal(t, http.StatusNotFound, s.requestAs(admin, http.MethodGet, "/machine/abc/commands/999", "").Code)
+
+	// Commands for machines which are not in the management OS expire, and are not sent when it does come by
+	stale := queue("smartctl")
+	command, err := store.GetMachineCommand("abc", stale.ID)
+	assert.NoError(t, err)
+	command.ExpiresAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, store.UpdateMachineCommand(command))
+	assert.Empty(t, claim())
+
+	_, err = s.api.collectGarbage(false)
+	assert.NoError(t, err)
+
+	resp = s.requestAs(admin, http.MethodGet, "/machine/abc/commands", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var commands []machine.MachineCommand
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&commands))
+	assert.Len(t, commands, 2)
+	assert.Equal(t, stale.ID, commands[0].ID)
+	assert.Equal(t, machine.CommandExpired, commands[0].State)
+
+	// The commands go with the machine
+	stored, err := store.GetMachineByMac(mac)
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteMachine(stored))
+	remaining, err := store.GetMachineCommands("abc")
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+}
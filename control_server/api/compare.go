@@ -0,0 +1,241 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// maxCachedComparisons is how many comparisons are kept, the oldest one is dropped to make room
+const maxCachedComparisons = 256
+
+// partitionChange is how much of a partition changed between two versions
+type partitionChange struct {
+	fs.Partition
+	Blocks         int
+	ChangedBlocks  int
+	ChangedPercent float64
+}
+
+// versionComparison is how two versions of an image differ, block by block
+type versionComparison struct {
+	Image     images.ImageUUID
+	A         uint64
+	B         uint64
+	BlockSize uint64
+	// Blocks is the number of blocks of the larger version, blocks which only it has count as changed
+	Blocks         int
+	ChangedBlocks  int
+	ChangedPercent float64
+	// UniqueBytesA and UniqueBytesB are the bytes in the blocks which only one of the versions holds, anywhere on
+	// the disk
+	UniqueBytesA uint64
+	UniqueBytesB uint64
+	// PartitionTable is the version whose partitions are summarized, B unless only A has a partition table
+	PartitionTable uint64            `json:",omitempty"`
+	Partitions     []partitionChange `json:",omitempty"`
+}
+
+// comparisonKey is a comparison of two versions as they are stored, replacing a version changes its checksum
+type comparisonKey struct {
+	image   images.ImageUUID
+	a       uint64
+	b       uint64
+	sha256A string
+	sha256B string
+}
+
+// comparisonCache keeps the last comparisons, comparing large versions reads their manifests and partition tables
+type comparisonCache struct {
+	mu          sync.Mutex
+	comparisons map[comparisonKey]*versionComparison
+	order       []comparisonKey
+}
+
+func newComparisonCache() *comparisonCache {
+	return &comparisonCache{comparisons: map[comparisonKey]*versionComparison{}}
+}
+
+func (c *comparisonCache) get(key comparisonKey) *versionComparison {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.comparisons[key]
+}
+
+func (c *comparisonCache) put(key comparisonKey, comparison *versionComparison) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.comparisons[key]; ok {
+		return
+	}
+
+	if len(c.order) == maxCachedComparisons {
+		delete(c.comparisons, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	c.comparisons[key] = comparison
+	c.order = append(c.order, key)
+}
+
+// percentage is part of whole in percent, nothing of nothing changed
+func percentage(part int, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+
+	return 100 * float64(part) / float64(whole)
+}
+
+// comparePartitions sums the changed blocks of every partition, the blocks a partition only partly covers count
+// towards it
+func comparePartitions(table *fs.PartitionTable, changed []bool, blockSize uint64) []partitionChange {
+	partitions := make([]partitionChange, 0, len(table.Partitions))
+	for _, partition := range table.Partitions {
+		summary := partitionChange{Partition: partition}
+		first := partition.Start / blockSize
+		end := (partition.Start + partition.Size + blockSize - 1) / blockSize
+		for block := first; block < end && block < uint64(len(changed)); block++ {
+			summary.Blocks++
+			if changed[block] {
+				summary.ChangedBlocks++
+			}
+		}
+
+		summary.ChangedPercent = percentage(summary.ChangedBlocks, summary.Blocks)
+		partitions = append(partitions, summary)
+	}
+
+	return partitions
+}
+
+// compareVersions compares the manifests of two versions, and the partitions of the layout of one of them
+func (api_ *API) compareVersions(r *http.Request, image *images.ImageModel, a, b *images.Version,
+	manifestA, manifestB *fs.Manifest) (*versionComparison, error) {
+	changed, err := fs.ChangedBlocks(manifestA, manifestB)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := &versionComparison{Image: image.UUID, A: a.Version, B: b.Version, BlockSize: manifestA.BlockSize,
+		Blocks: len(changed), UniqueBytesA: fs.UniqueBytes(manifestA, manifestB),
+		UniqueBytesB: fs.UniqueBytes(manifestB, manifestA)}
+	for _, differs := range changed {
+		if differs {
+			comparison.ChangedBlocks++
+		}
+	}
+	comparison.ChangedPercent = percentage(comparison.ChangedBlocks, comparison.Blocks)
+
+	for _, version := range []*images.Version{b, a} {
+		table, err := readPartitionTable(api_.versionFile(image, version.Version), image)
+		if errors.Is(err, fs.ErrNoPartitionTable) {
+			continue
+		}
+
+		if err != nil {
+			requestLog(r).Warnf("Cannot read the partition table of version %d of image %s: %v", version.Version,
+				image.UUID, err)
+			continue
+		}
+
+		comparison.PartitionTable = version.Version
+		comparison.Partitions = comparePartitions(table, changed, comparison.BlockSize)
+		break
+	}
+
+	return comparison, nil
+}
+
+// CompareVersions tells how much two versions of an image differ from the manifests of their blocks, in total and
+// per partition when one of them has a partition table. Versions without a manifest are answered with 409, the
+// manifest is made with POST /image/{uuid}/versions/{version}/manifest.
+// Example request: GET /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/versions/3/compare/7
+// Example response: {"Image": "57bf0cd3-...", "A": 3, "B": 7, "BlockSize": 1048576, "Blocks": 10240,
+// "ChangedBlocks": 512, "ChangedPercent": 5, "UniqueBytesA": 402653184, "UniqueBytesB": 536870912,
+// "PartitionTable": 7, "Partitions": [{"Number": 1, "Type": "83", "Start": 1048576, "Size": 10736369664,
+// "Blocks": 10239, "ChangedBlocks": 512, "ChangedPercent": 5.0005}]}
+func (api_ *API) CompareVersions(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	a := findVersion(w, r, image, "a")
+	if a == nil {
+		return
+	}
+
+	b := findVersion(w, r, image, "b")
+	if b == nil {
+		return
+	}
+
+	key := comparisonKey{image: image.UUID, a: a.Version, b: b.Version, sha256A: a.SHA256, sha256B: b.SHA256}
+	if comparison := api_.comparisons.get(key); comparison != nil {
+		writeJSON(w, http.StatusOK, comparison)
+		return
+	}
+
+	manifests := make([]*fs.Manifest, 2)
+	var missing []uint64
+	for i, version := range []*images.Version{a, b} {
+		if err = checkManifestable(version); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		manifests[i], err = api_.loadManifest(image, version)
+		if errors.Is(err, errNoManifest) {
+			missing = append(missing, version.Version)
+			continue
+		}
+
+		if ErrorWrite(w, err, "Cannot read the manifest") != nil {
+			return
+		}
+	}
+
+	if len(missing) != 0 {
+		writeJSON(w, http.StatusConflict, struct {
+			Error   string
+			Missing []uint64
+			Hint    string
+		}{"the blocks of the versions were not hashed", missing,
+			fmt.Sprintf("Hash each of them with POST /image/%s/versions/{version}/manifest", image.UUID)})
+		return
+	}
+
+	comparison, err := api_.compareVersions(r, image, a, b, manifests[0], manifests[1])
+	if ErrorWrite(w, err, "Cannot compare the versions") != nil {
+		return
+	}
+
+	api_.comparisons.put(key, comparison)
+	writeJSON(w, http.StatusOK, comparison)
+}
+
+// RegisterCompareHandlers sets the metadata for the route which compares versions of an image
+func (api_ *API) RegisterCompareHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions/{a}/compare/{b}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Timeout:     longTimeout,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.CompareVersions,
+		Method:      http.MethodGet,
+		Description: "Tells how much two versions of the image differ",
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_CompareVersions(t *testing.T) {
+	store := newTestStore(t)
+	u := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(u))
+
+	diskpath, err := ioutil.TempDir("", "compare")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "course", Username: "test", UUID: "course",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone}
+	assert.NoError(t, store.CreateImage(&image))
+	storeDisk := func(version uint64, disk []byte) {
+		assert.NoError(t, ioutil.WriteFile(image.VersionFile(version), disk, 0644))
+		sum := sha256.Sum256(disk)
+		assert.NoError(t, store.SetVersionChecksum("course", version, hex.EncodeToString(sum[:])))
+	}
+
+	// A disk of 4 MiB with a partition on its second MiB, which the second version changes
+	first := append(mbrDisk(0x30df844c), make([]byte, 4*fs.ManifestBlockSize-4096)...)
+	second := append([]byte(nil), first...)
+	second[fs.ManifestBlockSize+5] = 1
+	for version, disk := range map[uint64][]byte{1: first, 2: second, 3: first} {
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: version, ImageModelUUID: "course"}))
+		storeDisk(version, disk)
+	}
+	assert.NoError(t, store.SetVersionFormat("course", 3, images.FormatQCow2))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	hash := func(version string) {
+		assert.Equal(t, http.StatusAccepted, s.requestAs(u, http.MethodPost, "/image/course/versions/"+version+
+			"/manifest", "").Code)
+		assert.Eventually(t, func() bool {
+			var job manifestJob
+			resp := s.requestAs(u, http.MethodGet, "/image/course/versions/"+version+"/manifest", "")
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+			assert.NotEqual(t, manifestFailed, job.State, job.Error)
+			return job.State == manifestReady
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	missing := func() []uint64 {
+		resp := s.requestAs(u, http.MethodGet, "/image/course/versions/1/compare/2", "")
+		assert.Equal(t, http.StatusConflict, resp.Code)
+		var refused struct{ Missing []uint64 }
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refused))
+		return refused.Missing
+	}
+
+	// Versions stored before the manifests are hashed when they are asked for
+	assert.Equal(t, []uint64{1, 2}, missing())
+	assert.Equal(t, http.StatusNotFound, s.requestAs(u, http.MethodGet, "/image/course/versions/1/manifest", "").Code)
+	hash("1")
+	hash("2")
+
+	resp := s.requestAs(u, http.MethodGet, "/image/course/versions/1/compare/2", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var comparison versionComparison
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&comparison))
+	assert.Equal(t, 4, comparison.Blocks)
+	assert.Equal(t, 1, comparison.ChangedBlocks)
+	assert.Equal(t, 25.0, comparison.ChangedPercent)
+	// The changed block of the first version is zeroes, which the second version holds elsewhere
+	assert.Zero(t, comparison.UniqueBytesA)
+	assert.Equal(t, uint64(fs.ManifestBlockSize), comparison.UniqueBytesB)
+	assert.Equal(t, uint64(2), comparison.PartitionTable)
+	if assert.Len(t, comparison.Partitions, 1) {
+		assert.Equal(t, 1, comparison.Partitions[0].Blocks)
+		assert.Equal(t, 1, comparison.Partitions[0].ChangedBlocks)
+		assert.Equal(t, 100.0, comparison.Partitions[0].ChangedPercent)
+	}
+
+	// Replacing a version outdates its manifest
+	storeDisk(2, first)
+	assert.Equal(t, []uint64{2}, missing())
+	hash("2")
+	resp = s.requestAs(u, http.MethodGet, "/image/course/versions/1/compare/2", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&comparison))
+	assert.Zero(t, comparison.ChangedBlocks)
+
+	// The blocks of other formats are not where they are on the disk
+	assert.Equal(t, http.StatusUnprocessableEntity, s.requestAs(u, http.MethodPost,
+		"/image/course/versions/3/manifest", "").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, s.requestAs(u, http.MethodGet,
+		"/image/course/versions/1/compare/3", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(u, http.MethodGet, "/image/course/versions/1/compare/9", "").Code)
+}
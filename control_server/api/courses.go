@@ -0,0 +1,636 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/control_server/notify"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// courseCheckInterval is how often the courses are checked when the configuration does not say
+const courseCheckInterval = time.Hour
+
+// CheckCourses warns the owners of the courses which expire within warning and expires the courses whose time is
+// up. Their members lose access to the machines of the course by themselves, expiring a course trashes the images
+// labelled with it when the course asks for that and tells the owner.
+func CheckCourses(store database.Store, notifier notify.Notifier, warning time.Duration, now time.Time) error {
+	courses, err := store.GetCourses()
+	if err != nil {
+		return err
+	}
+
+	for i := range courses {
+		c := &courses[i]
+		switch {
+		case c.ExpiredAt == nil && c.Expired(now):
+			if err = expireCourse(store, notifier, c, now); err != nil {
+				return fmt.Errorf("expire course %s: %w", c.Name, err)
+			}
+		case c.WarnedAt == nil && c.ExpiredAt == nil && c.Expired(now.Add(warning)):
+			body := fmt.Sprintf("The course %s expires on %s. Its %d members lose access to its %d machines then, "+
+				"ask an administrator to extend it if they still need them.", c.Name,
+				c.ExpiresAt.Format(time.RFC1123), len(c.Members), len(c.Machines))
+			notifyOwner(store, notifier, c, "Course "+c.Name+" is about to expire", body)
+
+			if err = store.MarkCourseWarned(c.Name, now); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// expireCourse records that a course expired and cleans up after it
+func expireCourse(store database.Store, notifier notify.Notifier, c *course.CourseModel, now time.Time) error {
+	trashed := 0
+	if c.TrashImages {
+		labelled, err := store.GetImagesByCourse(c.Name)
+		if err != nil {
+			return err
+		}
+
+		for i := range labelled {
+			if err = store.TrashImage(&labelled[i]); err != nil {
+				return err
+			}
+		}
+		trashed = len(labelled)
+	}
+
+	if err := store.MarkCourseExpired(c.Name, now); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"course": c.Name, "trashed": trashed}).Info("Course expired")
+	body := fmt.Sprintf("The course %s expired, its members cannot boot its machines anymore.", c.Name)
+	if trashed != 0 {
+		body += fmt.Sprintf(" %d images labelled with the course were moved to the trash.", trashed)
+	}
+	notifyOwner(store, notifier, c, "Course "+c.Name+" expired", body)
+
+	return nil
+}
+
+// notifyOwner tells the owner of a course about it, failing to do so is only logged since the course changes anyway
+func notifyOwner(store database.Store, notifier notify.Notifier, c *course.CourseModel, subject string,
+	body string) {
+	owner, err := store.GetUserByUsername(c.Owner)
+	if err == nil {
+		err = notifier.Notify(owner, subject, body)
+	}
+
+	if err != nil {
+		log.Errorf("Cannot notify %s about course %s: %v", c.Owner, c.Name, err)
+	}
+}
+
+// StartCourseExpiry periodically checks the courses for expiry in the background
+func StartCourseExpiry(store database.Store, notifier notify.Notifier, warning time.Duration,
+	interval time.Duration) {
+	if interval == 0 {
+		interval = courseCheckInterval
+	}
+
+	go func() {
+		for {
+			if err := CheckCourses(store, notifier, warning, time.Now()); err != nil {
+				log.Errorf("check courses: %v", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// getCourse fetches the course named in the URI, answering 404 when there is none
+func (api_ *API) getCourse(w http.ResponseWriter, r *http.Request) (*course.CourseModel, error) {
+	name, err := GetTag("course", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	c, err := api_.storeFor(r).GetCourse(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "course not found", http.StatusNotFound)
+		return nil, err
+	} else if ErrorWrite(w, err, "Cannot fetch the course") != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// manageCourse fetches the course named in the URI if the user may change its members, which are administrators
+// and the owner of the course
+func (api_ *API) manageCourse(w http.ResponseWriter, r *http.Request) (*course.CourseModel, error) {
+	c, err := api_.getCourse(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !api_.isAdmin(r) && api_.sessionUsername(r) != c.Owner {
+		http.Error(w, "Only the owner of the course can change its members", http.StatusForbidden)
+		return nil, errors.New("not the owner of the course")
+	}
+
+	return c, nil
+}
+
+// checkUserExists answers 404 when there is no such user
+func (api_ *API) checkUserExists(w http.ResponseWriter, username string) bool {
+	_, err := api_.store.GetUserByUsername(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: username})
+		return false
+	}
+
+	return ErrorWrite(w, err, "Cannot fetch the user") == nil
+}
+
+// checkCourseLabel checks that the owner of an image takes part in the course it is labelled with
+func (api_ *API) checkCourseLabel(image *images.ImageModel, username string) error {
+	if image.Course == "" {
+		return nil
+	}
+
+	c, err := api_.store.GetCourse(image.Course)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("there is no course named %s", image.Course)
+	} else if err != nil {
+		return err
+	}
+
+	if c.Owner == username {
+		return nil
+	}
+
+	for _, member := range c.Members {
+		if member.Username == username {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s does not take part in course %s", username, c.Name)
+}
+
+// mayBootMachine reports whether the user behind a request may queue boots on a machine, the rules are those of
+// authz.BootMachine. The system may boot every machine.
+func (api_ *API) mayBootMachine(r *http.Request, machine *machinemodel.MachineModel) (bool, error) {
+	principal := api_.principal(r)
+	if !machine.Restricted || principal.Kind == PrincipalMachine {
+		return true, nil
+	}
+
+	if principal.Kind != PrincipalUser {
+		return false, nil
+	}
+
+	decision, err := authz.BootMachine(api_.storeFor(r), principal.subject(), machine, time.Now())
+	if scope := decision.Scope(); scope != "" {
+		requestLog(r).WithField("scope", scope).
+			Infof("Moderator %s is permitted to boot restricted machine %s", principal.Name, machine.MacAddress.Address)
+	}
+
+	return decision.Allowed, err
+}
+
+// GetCourses lists all courses, those which expire first come first. Moderators who are scoped to courses only get
+// those.
+// Example request: GET /courses
+// Example response: [{"Name": "os-2022", "Owner": "jan", "ExpiresAt": "2022-07-01T00:00:00Z", "TrashImages": true,
+// "Members": [{"CourseName": "os-2022", "Username": "piet"}], "Machines": [...]}]
+func (api_ *API) GetCourses(w http.ResponseWriter, r *http.Request) {
+	courses, err := api_.storeFor(r).GetCourses()
+	if ErrorWrite(w, err, "Cannot fetch the courses") != nil {
+		return
+	}
+
+	scopes, err := api_.moderatorScopes(r)
+	if ErrorWrite(w, err, "Cannot fetch the scopes of the moderator") != nil {
+		return
+	}
+
+	if len(scopes) != 0 {
+		scoped := []course.CourseModel{}
+		for _, c := range courses {
+			for _, scope := range scopes {
+				if scope.CourseName == c.Name {
+					scoped = append(scoped, c)
+				}
+			}
+		}
+		courses = scoped
+	}
+
+	writeJSON(w, http.StatusOK, courses)
+}
+
+// CreateCourse creates a course, the members and machines can be given straight away
+// Example request: POST /courses
+// Example body: {"Name": "os-2022", "Owner": "jan", "ExpiresAt": "2022-07-01T00:00:00Z", "TrashImages": true}
+// Example response: {"Name": "os-2022", "Owner": "jan", ...}
+func (api_ *API) CreateCourse(w http.ResponseWriter, r *http.Request) {
+	var c course.CourseModel
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid course given", http.StatusBadRequest)
+		return
+	}
+
+	if c.Name == "" || c.Owner == "" {
+		http.Error(w, "A course needs a name and an owner", http.StatusBadRequest)
+		return
+	}
+
+	if c.Expired(time.Now()) {
+		http.Error(w, "The course would have expired already", http.StatusBadRequest)
+		return
+	}
+
+	if !api_.checkUserExists(w, c.Owner) {
+		return
+	}
+
+	for i := range c.Members {
+		if !api_.checkUserExists(w, c.Members[i].Username) {
+			return
+		}
+	}
+
+	machines := c.Machines
+	c.Machines = nil
+	c.WarnedAt, c.ExpiredAt = nil, nil
+	if StoreErrorWrite(w, api_.storeFor(r).CreateCourse(&c), "Cannot create the course") != nil {
+		return
+	}
+
+	// Adding the machines one by one restricts them
+	for _, m := range machines {
+		err := api_.storeFor(r).AddCourseMachine(c.Name, m.MachineMAC)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "machine not found: "+m.MachineMAC, http.StatusNotFound)
+			return
+		} else if StoreErrorWrite(w, err, "Cannot add the machine to the course") != nil {
+			return
+		}
+	}
+
+	created, err := api_.storeFor(r).GetCourse(c.Name)
+	if ErrorWrite(w, err, "Cannot fetch the course") != nil {
+		return
+	}
+
+	log.Infof("Created course %s of %s", c.Name, c.Owner)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// GetCourse gets a course with its members and machines
+// Example request: GET /course/os-2022
+// Example response: {"Name": "os-2022", "Owner": "jan", ...}
+func (api_ *API) GetCourse(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.getCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	if !api_.isAdmin(r) && api_.sessionUsername(r) != c.Owner {
+		if api_.principal(r).Role != user.Moderator {
+			http.Error(w, "Only the owner of the course can see it", http.StatusForbidden)
+			return
+		}
+
+		if !api_.moderatorIsScoped(w, r, c.Name) {
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+// DeleteCourse removes a course, its members lose access to its machines right away. The machines stay restricted.
+// Example request: DELETE /course/os-2022
+// Example response: 204 No Content
+func (api_ *API) DeleteCourse(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.getCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteCourse(c), "Cannot delete the course") != nil {
+		return
+	}
+
+	log.Infof("Deleted course %s", c.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// courseExpiry is the body which extends a course
+type courseExpiry struct {
+	ExpiresAt time.Time `description:"When the course expires"`
+}
+
+// SetCourseExpiry moves the expiry of a course. A course which expired already is given back its access, the owner
+// is warned again before the new expiry.
+// Example request: PUT /course/os-2022/expiry
+// Example body: {"ExpiresAt": "2022-09-01T00:00:00Z"}
+// Example response: {"Name": "os-2022", "ExpiresAt": "2022-09-01T00:00:00Z", ...}
+func (api_ *API) SetCourseExpiry(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.getCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	var body courseExpiry
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil || body.ExpiresAt.IsZero() {
+		http.Error(w, "Invalid expiry given", http.StatusBadRequest)
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).SetCourseExpiry(c.Name, body.ExpiresAt), "Cannot extend the course") != nil {
+		return
+	}
+
+	c, err = api_.storeFor(r).GetCourse(c.Name)
+	if ErrorWrite(w, err, "Cannot fetch the course") != nil {
+		return
+	}
+
+	log.Infof("Course %s now expires at %s", c.Name, c.ExpiresAt)
+	writeJSON(w, http.StatusOK, c)
+}
+
+// AddCourseMember adds a user to a course, which gives them access to its machines
+// Example request: POST /course/os-2022/members/piet
+// Example response: 204 No Content
+func (api_ *API) AddCourseMember(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.manageCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if !api_.checkUserExists(w, username) {
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).AddCourseMember(c.Name, username), "Cannot add the member") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveCourseMember removes a user from a course
+// Example request: DELETE /course/os-2022/members/piet
+// Example response: 204 No Content
+func (api_ *API) RemoveCourseMember(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.manageCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	err = api_.storeFor(r).RemoveCourseMember(c.Name, mux.Vars(r)["username"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "the user is not a member of the course", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot remove the member") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddCourseMachine lets the members of a course boot a machine. The machine is restricted from then on, so users
+// outside the course cannot boot it anymore.
+// Example request: POST /course/os-2022/machines/52:54:00:d9:71:93
+// Example response: 204 No Content
+func (api_ *API) AddCourseMachine(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.getCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	err = api_.storeFor(r).AddCourseMachine(c.Name, mux.Vars(r)["mac"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "machine not found", http.StatusNotFound)
+		return
+	} else if StoreErrorWrite(w, err, "Cannot add the machine") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveCourseMachine takes a machine away from a course, the machine stays restricted
+// Example request: DELETE /course/os-2022/machines/52:54:00:d9:71:93
+// Example response: 204 No Content
+func (api_ *API) RemoveCourseMachine(w http.ResponseWriter, r *http.Request) {
+	c, err := api_.getCourse(w, r)
+	if err != nil {
+		return
+	}
+
+	err = api_.storeFor(r).RemoveCourseMachine(c.Name, mux.Vars(r)["mac"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "the machine is not part of the course", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot remove the machine") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetMachineGrants lists the users who were granted access to a machine directly, outside of courses
+// Example request: GET /machine/52:54:00:d9:71:93/grants
+// Example response: [{"MachineMAC": "52:54:00:d9:71:93", "Username": "piet", "CreatedAt": "..."}]
+func (api_ *API) GetMachineGrants(w http.ResponseWriter, r *http.Request) {
+	grants, err := api_.storeFor(r).GetMachineGrants(mux.Vars(r)["mac"])
+	if ErrorWrite(w, err, "Cannot fetch the grants") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, grants)
+}
+
+// CreateMachineGrant grants a user access to a machine and restricts the machine
+// Example request: POST /machine/52:54:00:d9:71:93/grants/piet
+// Example response: 204 No Content
+func (api_ *API) CreateMachineGrant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !api_.checkUserExists(w, vars["username"]) {
+		return
+	}
+
+	err := api_.storeFor(r).CreateMachineGrant(&machinemodel.MachineGrant{MachineMAC: vars["mac"],
+		Username: vars["username"]})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "machine not found", http.StatusNotFound)
+		return
+	} else if StoreErrorWrite(w, err, "Cannot grant access") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteMachineGrant takes the access a user was granted to a machine away
+// Example request: DELETE /machine/52:54:00:d9:71:93/grants/piet
+// Example response: 204 No Content
+func (api_ *API) DeleteMachineGrant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := api_.storeFor(r).DeleteMachineGrant(vars["mac"], vars["username"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "the user was not granted access to the machine", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot take the access away") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterCourseHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterCourseHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:             "/courses",
+		Permissions:     []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed:     false,
+		ModeratorScoped: true,
+		Scope:           user.ScopeUsersRead,
+		Handler:         api_.GetCourses,
+		Method:          http.MethodGet,
+		Description:     "Lists the courses",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/courses",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.CreateCourse,
+		Method:      http.MethodPost,
+		Schema:      "course",
+		Description: "Creates a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeUsersRead,
+		Handler:     api_.GetCourse,
+		Method:      http.MethodGet,
+		Description: "Gets a course with its members and machines",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.DeleteCourse,
+		Method:      http.MethodDelete,
+		Description: "Deletes a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}/expiry",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetCourseExpiry,
+		Method:      http.MethodPut,
+		Schema:      "course-expiry",
+		Description: "Extends a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}/members/{username}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeUsersWrite,
+		Handler:     api_.AddCourseMember,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Adds a member to a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}/members/{username}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeUsersWrite,
+		Handler:     api_.RemoveCourseMember,
+		Method:      http.MethodDelete,
+		Description: "Removes a member from a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}/machines/{mac}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.AddCourseMachine,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Lets the members of a course boot a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/course/{course}/machines/{mac}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.RemoveCourseMachine,
+		Method:      http.MethodDelete,
+		Description: "Takes a machine away from a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/grants",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetMachineGrants,
+		Method:      http.MethodGet,
+		Description: "Lists the users granted access to a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/grants/{username}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.CreateMachineGrant,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Grants a user access to a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/grants/{username}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.DeleteMachineGrant,
+		Method:      http.MethodDelete,
+		Description: "Takes the access of a user to a machine away",
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingNotifier struct {
+	subjects []string
+}
+
+func (n *recordingNotifier) Notify(to *user.UserModel, subject string, _ string) error {
+	n.subjects = append(n.subjects, to.Username+": "+subject)
+	return nil
+}
+
+func TestApi_Courses(t *testing.T) {
+	store := newTestStore(t)
+
+	users := map[string]*user.UserModel{}
+	for _, u := range []user.UserModel{
+		{Username: "admin", Role: user.Admin},
+		{Username: "teacher", Role: user.User},
+		{Username: "alice", Role: user.User},
+		{Username: "bob", Role: user.User},
+	} {
+		u := u
+		u.Email = u.Username + "@example.com"
+		assert.NoError(t, store.CreateUser(&u))
+		users[u.Username] = &u
+	}
+
+	mac := "52:54:00:d9:71:93"
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: "lab1",
+		MacAddress: util.MacAddress{Address: mac}, Architecture: machinemodel.X86_64}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	request := func(username string, method string, uri string, body string) int {
+		return s.requestAs(users[username], method, uri, body).Code
+	}
+
+	// The boot requests are empty, anything but 403 means the access check let them through
+	boot := func(username string) int {
+		return request(username, http.MethodPost, "/machine/"+mac+"/boot", "")
+	}
+
+	assert.NotEqual(t, http.StatusForbidden, boot("bob"))
+
+	expires := time.Now().Add(30 * 24 * time.Hour).UTC().Truncate(time.Second)
+	course := fmt.Sprintf(`{"Name": "os", "Owner": "teacher", "ExpiresAt": %q, "TrashImages": true,
+		"Members": [{"Username": "alice"}], "Machines": [{"MachineMAC": %q}]}`, expires.Format(time.RFC3339), mac)
+	assert.Equal(t, http.StatusForbidden, request("teacher", http.MethodPost, "/courses", course))
+	assert.Equal(t, http.StatusCreated, request("admin", http.MethodPost, "/courses", course))
+	assert.Equal(t, http.StatusConflict, request("admin", http.MethodPost, "/courses", course))
+
+	// Adding the machine to the course restricted it
+	assert.Equal(t, http.StatusForbidden, boot("bob"))
+	assert.NotEqual(t, http.StatusForbidden, boot("alice"))
+	assert.NotEqual(t, http.StatusForbidden, boot("admin"))
+
+	// The owner manages the members, the members do not
+	assert.Equal(t, http.StatusForbidden, request("alice", http.MethodPost, "/course/os/members/bob", ""))
+	assert.Equal(t, http.StatusNoContent, request("teacher", http.MethodPost, "/course/os/members/bob", ""))
+	assert.NotEqual(t, http.StatusForbidden, boot("bob"))
+	assert.Equal(t, http.StatusNoContent, request("teacher", http.MethodDelete, "/course/os/members/bob", ""))
+	assert.Equal(t, http.StatusNotFound, request("teacher", http.MethodDelete, "/course/os/members/bob", ""))
+	assert.Equal(t, http.StatusNotFound, request("teacher", http.MethodPost, "/course/os/members/nobody", ""))
+	assert.Equal(t, http.StatusForbidden, boot("bob"))
+
+	// A direct grant does not expire with the course
+	assert.Equal(t, http.StatusNoContent, request("admin", http.MethodPost, "/machine/"+mac+"/grants/bob", ""))
+	assert.NotEqual(t, http.StatusForbidden, boot("bob"))
+
+	// Images can only be labelled with courses their owner takes part in
+	labelled := images.ImageModel{Name: "lab", Username: "alice", UUID: "lab", Course: "os"}
+	assert.NoError(t, s.api.checkCourseLabel(&labelled, "alice"))
+	assert.Error(t, s.api.checkCourseLabel(&labelled, "bob"))
+	assert.Error(t, s.api.checkCourseLabel(&images.ImageModel{Course: "unknown"}, "alice"))
+	assert.NoError(t, store.CreateImage(&labelled))
+
+	// The owner is warned once, a week ahead
+	notifier := &recordingNotifier{}
+	week := 7 * 24 * time.Hour
+	assert.NoError(t, CheckCourses(store, notifier, week, expires.Add(-8*24*time.Hour)))
+	assert.Empty(t, notifier.subjects)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, CheckCourses(store, notifier, week, expires.Add(-6*24*time.Hour)))
+	}
+	assert.Equal(t, []string{"teacher: Course os is about to expire"}, notifier.subjects)
+
+	// Once expired the members lose access and the labelled images go to the trash
+	assert.NoError(t, store.SetCourseExpiry("os", time.Now().Add(-time.Minute)))
+	assert.NoError(t, CheckCourses(store, notifier, week, time.Now()))
+	assert.Equal(t, "teacher: Course os expired", notifier.subjects[len(notifier.subjects)-1])
+	assert.Equal(t, http.StatusForbidden, boot("alice"))
+	assert.NotEqual(t, http.StatusForbidden, boot("bob"))
+	trashed, err := store.GetTrashedImages("alice")
+	assert.NoError(t, err)
+	assert.Len(t, trashed, 1)
+
+	c, err := store.GetCourse("os")
+	assert.NoError(t, err)
+	assert.NotNil(t, c.ExpiredAt)
+
+	// Extending the course gives the access back
+	extended := fmt.Sprintf(`{"ExpiresAt": %q}`, expires.Format(time.RFC3339))
+	assert.Equal(t, http.StatusForbidden, request("teacher", http.MethodPut, "/course/os/expiry", extended))
+	assert.Equal(t, http.StatusOK, request("admin", http.MethodPut, "/course/os/expiry", extended))
+	assert.NotEqual(t, http.StatusForbidden, boot("alice"))
+
+	c, err = store.GetCourse("os")
+	assert.NoError(t, err)
+	assert.Nil(t, c.ExpiredAt)
+	assert.Nil(t, c.WarnedAt)
+
+	assert.Equal(t, http.StatusNoContent, request("admin", http.MethodDelete, "/course/os", ""))
+	assert.Equal(t, http.StatusForbidden, boot("alice"))
+	assert.Equal(t, http.StatusNotFound, request("admin", http.MethodGet, "/course/os", ""))
+}
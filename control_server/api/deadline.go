@@ -0,0 +1,220 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/metrics"
+)
+
+const (
+	// NoTimeout routes stream files or run for as long as their job takes, they are not bounded
+	NoTimeout time.Duration = -1
+	// longTimeout bounds the routes which run a job on all images or users, such as the janitor
+	longTimeout = 10 * time.Minute
+)
+
+var requestTimeouts = metrics.NewCounter("baas_request_timeouts_total",
+	"Requests which took longer than the timeout of their route, by route.", "route")
+
+// timeoutError is the answer to a request which took longer than its route allows
+type timeoutError struct {
+	Error   string
+	Timeout string
+}
+
+// routeTimeout is how long a route may take. Routes without a timeout of their own take RequestTimeoutSeconds,
+// zero means they are not bounded.
+func (api_ *API) routeTimeout(route Route) time.Duration {
+	switch {
+	case route.Timeout == NoTimeout:
+		return 0
+	case route.Timeout != 0:
+		return route.Timeout
+	case api_.config == nil:
+		return 0
+	}
+
+	return time.Duration(api_.config.RequestTimeoutSeconds) * time.Second
+}
+
+// deadlineContextKey marks the requests of routes which are bounded by a deadline
+type deadlineContextKey struct{}
+
+// storeFor is the store for the queries of a request. On routes with a deadline it is bound to the request, its
+// queries are interrupted once it runs out of time or the client goes away. Other requests, such as uploads, finish
+// their queries either way.
+func (api_ *API) storeFor(r *http.Request) database.Store {
+	if r.Context().Value(deadlineContextKey{}) == nil {
+		return api_.store
+	}
+
+	return api_.store.WithContext(r.Context())
+}
+
+// timeoutWriter passes the response of a handler on until its request runs out of time. Afterwards the handler
+// can no longer write anything, the request is answered with 504 unless the handler already started its response.
+type timeoutWriter struct {
+	w   http.ResponseWriter
+	ctx context.Context
+	// header is the header of the handler, it is only copied to w when the handler writes its status
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// writeHeader writes the status of the handler, a handler which noticed its deadline first still gets a 504
+func (tw *timeoutWriter) writeHeader(status int) bool {
+	if tw.timedOut || errors.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		for key, values := range tw.header {
+			tw.w.Header()[key] = values
+		}
+		tw.w.WriteHeader(status)
+	}
+
+	return true
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if !tw.writeHeader(http.StatusOK) {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	return tw.w.Write(b)
+}
+
+// Flush passes flushes on, unless the request ran out of time
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if f, ok := tw.w.(http.Flusher); ok && tw.wroteHeader && !tw.timedOut {
+		f.Flush()
+	}
+}
+
+// finish writes the status of a handler which returned without writing anything. It reports false when the
+// handler only returned after its deadline, the request is answered with 504 then.
+func (tw *timeoutWriter) finish(limit time.Duration) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.wroteHeader || tw.writeHeader(http.StatusOK) {
+		return true
+	}
+
+	return !tw.timeoutLocked(limit)
+}
+
+// timeout answers the request with 504 when the handler did not start its response, it reports whether it did
+func (tw *timeoutWriter) timeout(limit time.Duration) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	return tw.timeoutLocked(limit)
+}
+
+// abandon drops whatever the handler writes from now on, the response is finished without it
+func (tw *timeoutWriter) abandon() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.timedOut = true
+}
+
+func (tw *timeoutWriter) timeoutLocked(limit time.Duration) bool {
+	tw.timedOut = true
+	if tw.wroteHeader {
+		return false
+	}
+
+	writeJSON(tw.w, http.StatusGatewayTimeout, timeoutError{
+		Error:   "the request took longer than its route allows",
+		Timeout: limit.String(),
+	})
+	return true
+}
+
+// deadline bounds how long the handler of a route takes. The context of the request is cancelled once the timeout
+// passes, which interrupts the queries of the handler through storeFor. The request is answered right away, the
+// handler finishes in the background and whatever it writes afterwards is dropped.
+func (api_ *API) deadline(route Route, handler http.HandlerFunc) http.HandlerFunc {
+	limit := api_.routeTimeout(route)
+	if limit <= 0 {
+		return handler
+	}
+
+	name := fmt.Sprintf("%s %s", route.Method, route.URI)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), deadlineContextKey{}, limit), limit)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, ctx: ctx, header: http.Header{}}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+
+			handler(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			if !tw.finish(limit) {
+				requestTimeouts.Inc(name)
+				requestLog(r).Warnf("%s took longer than %s", name, limit)
+			}
+		case p := <-panicked:
+			panic(p)
+		case <-ctx.Done():
+			// The client went away, nobody waits for an answer
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				tw.abandon()
+				return
+			}
+
+			requestTimeouts.Inc(name)
+			if !tw.timeout(limit) {
+				requestLog(r).Warnf("%s ran out of time after it started its response", name)
+				return
+			}
+
+			requestLog(r).Warnf("%s took longer than %s", name, limit)
+		}
+	}
+}
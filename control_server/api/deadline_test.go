@@ -0,0 +1,79 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Deadline(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+
+	conf := config.Default()
+	conf.RequestTimeoutSeconds = 1
+	api := NewAPI(store, "/tmp", conf)
+	api.registerRoutes()
+
+	// The queries of a request which ran out of time fail, those of routes without a deadline do not
+	queries := make(chan error, 1)
+	route := func(uri string, timeout time.Duration, handler http.HandlerFunc) {
+		api.Routes = append(api.Routes, Route{URI: uri, Permissions: []user.UserRole{user.Admin}, Timeout: timeout,
+			Handler: handler, Method: http.MethodGet})
+	}
+	route("/test/stuck", 50*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := api.storeFor(r).GetUserByUsername("admin")
+		queries <- err
+		http.Error(w, "too late", http.StatusInternalServerError)
+	})
+	route("/test/started", 50*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		<-r.Context().Done()
+	})
+	route("/test/streaming", NoTimeout, func(w http.ResponseWriter, r *http.Request) {
+		_, err := api.storeFor(r).WithContext(context.Background()).GetUserByUsername("admin")
+		queries <- err
+		_, bounded := r.Context().Deadline()
+		writeJSON(w, http.StatusOK, bounded)
+	})
+	route("/test/default", 0, func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ := r.Context().Deadline()
+		writeJSON(w, http.StatusOK, time.Until(deadline) > 500*time.Millisecond)
+	})
+	s := &testServer{t: t, store: store, api: api, handler: api.router("", primaryListener(false))}
+
+	before := requestTimeouts.Value("GET /test/stuck")
+	resp := s.requestAs(admin, http.MethodGet, "/test/stuck", "")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.Code)
+	var answer timeoutError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&answer))
+	assert.Equal(t, "50ms", answer.Timeout)
+	assert.Equal(t, before+1, requestTimeouts.Value("GET /test/stuck"))
+	assert.True(t, errors.Is(<-queries, context.DeadlineExceeded))
+
+	// A response which started cannot be turned into a 504
+	assert.Equal(t, http.StatusAccepted, s.requestAs(admin, http.MethodGet, "/test/started", "").Code)
+
+	resp = s.requestAs(admin, http.MethodGet, "/test/streaming", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "false\n", resp.Body.String())
+	assert.NoError(t, <-queries)
+
+	// Routes without a timeout of their own take the one of the configuration
+	resp = s.requestAs(admin, http.MethodGet, "/test/default", "")
+	assert.Equal(t, "true\n", resp.Body.String())
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// decisionTimeout is how long a DHCP hook waits for its answer at most, the DHCP server cannot offer a lease
+// until the hook returns so anything undecided by then boots from the local disk.
+const decisionTimeout = 250 * time.Millisecond
+
+// maxBatchDecisions is the largest amount of machines which can be decided on in one request
+const maxBatchDecisions = 256
+
+// bootAction is what the DHCP server should tell a machine to do
+type bootAction string
+
+const (
+	// actionNetboot sends the machine to the boot loader on the control server
+	actionNetboot bootAction = "netboot"
+	// actionLocal lets the machine boot from its own disk
+	actionLocal bootAction = "local"
+)
+
+// bootFiles are the boot loaders for each architecture and firmware, they are served from the static directory.
+var bootFiles = map[machine.SystemArchitecture]map[string]string{
+	machine.X86_64: {
+		"bios": "undionly.kpxe",
+		"efi":  "ipxe.efi",
+	},
+}
+
+// bootDecision tells the DHCP server whether to netboot a machine and where it finds the boot loader
+type bootDecision struct {
+	MAC    string
+	Action bootAction
+	// Reason explains the decision, it is meant for the logs of the DHCP server. Rule names the rule which fired
+	// for managed machines: the boot queue, a default image or the local disk.
+	Reason string
+	Rule   bootRule `json:",omitempty"`
+	// BootFile and Server are the boot file name and next-server of the DHCP offer, they are only set for netboots
+	BootFile     string                     `json:",omitempty"`
+	Server       string                     `json:",omitempty"`
+	Architecture machine.SystemArchitecture `json:",omitempty"`
+	Firmware     string                     `json:",omitempty"`
+}
+
+func localBoot(mac string, reason string) bootDecision {
+	return bootDecision{MAC: mac, Action: actionLocal, Reason: reason}
+}
+
+// decide looks up whether the machine has boots queued or a default image, everything which is not certain boots
+// from the local disk
+func (api_ *API) decide(mac string, firmware string, server string) bootDecision {
+	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if errors.Is(err, gorm.ErrRecordNotFound) && api_.mayRegister() {
+		return api_.registrationBoot(mac, firmware, server)
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		return localBoot(mac, "unknown machine")
+	} else if err != nil {
+		log.Errorf("Cannot find machine %s for a boot decision: %v", mac, err)
+		return localBoot(mac, "cannot find the machine")
+	}
+
+	// Machines which registered themselves are not booted until an admin approves them
+	if !m.Approved() {
+		return localBoot(mac, fmt.Sprintf("the machine is %s", m.RegistrationStatus()))
+	}
+
+	// Machines are taken out of service by no longer letting BAAS manage them
+	if !m.Managed {
+		return localBoot(mac, "the machine is not managed by BAAS")
+	}
+
+	queue, err := api_.store.GetBootSetups(mac)
+	if err != nil {
+		log.Errorf("Cannot fetch the boot queue of %s for a boot decision: %v", mac, err)
+		return localBoot(mac, "cannot fetch the boot queue")
+	}
+
+	rule, reason := ruleQueue, "a boot is queued"
+	if len(queue) == 0 {
+		def := api_.resolveDefault(m)
+		if def.Rule == ruleLocalBoot {
+			decision := localBoot(mac, def.Reason)
+			decision.Rule = def.Rule
+			return decision
+		}
+
+		rule, reason = def.Rule, def.Reason
+	}
+
+	arch := machine.SystemArchitecture(strings.ToLower(string(m.Architecture)))
+	bootFile, ok := bootFiles[arch][firmware]
+	if !ok {
+		decision := localBoot(mac, fmt.Sprintf("there is no boot loader for %s with %s firmware", m.Architecture,
+			firmware))
+		decision.Rule = rule
+		return decision
+	}
+
+	return bootDecision{
+		MAC:          mac,
+		Action:       actionNetboot,
+		Reason:       reason,
+		Rule:         rule,
+		BootFile:     bootFile,
+		Server:       server,
+		Architecture: arch,
+		Firmware:     firmware,
+	}
+}
+
+// registrationBoot sends a machine BAAS does not know to the management OS, which registers it. Only x86 machines
+// have boot loaders, the others boot from their local disk.
+func (api_ *API) registrationBoot(mac string, firmware string, server string) bootDecision {
+	bootFile, ok := bootFiles[machine.X86_64][firmware]
+	if !ok {
+		return localBoot(mac, "unknown machine, there is no boot loader to register it with")
+	}
+
+	return bootDecision{
+		MAC:          mac,
+		Action:       actionNetboot,
+		Reason:       "unknown machine, it may register itself",
+		Rule:         ruleRegister,
+		BootFile:     bootFile,
+		Server:       server,
+		Architecture: machine.X86_64,
+		Firmware:     firmware,
+	}
+}
+
+// decideAll decides on every machine at the same time, the machines which are not decided on before the
+// context ends boot from the local disk.
+func (api_ *API) decideAll(ctx context.Context, macs []string, firmware string, server string) []bootDecision {
+	type result struct {
+		index    int
+		decision bootDecision
+	}
+
+	// The channel is buffered so the lookups which finish after the deadline do not block forever
+	results := make(chan result, len(macs))
+	for i, mac := range macs {
+		go func(i int, mac string) {
+			results <- result{i, api_.decide(mac, firmware, server)}
+		}(i, mac)
+	}
+
+	decisions := make([]bootDecision, len(macs))
+	decided := make([]bool, len(macs))
+	for remaining := len(macs); remaining > 0; remaining-- {
+		select {
+		case res := <-results:
+			decisions[res.index] = res.decision
+			decided[res.index] = true
+		case <-ctx.Done():
+			for i, mac := range macs {
+				if !decided[i] {
+					log.Warnf("Boot decision for %s timed out", mac)
+					decisions[i] = localBoot(mac, "timed out")
+				}
+			}
+			return decisions
+		}
+	}
+
+	return decisions
+}
+
+// nextServer is the address of the control server as seen by the DHCP server, the boot loader is fetched from it
+func nextServer(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+
+	return r.Host
+}
+
+// bootFirmware reads the firmware of the machine from the query, BIOS and EFI machines need different loaders
+func bootFirmware(w http.ResponseWriter, r *http.Request) (string, bool) {
+	firmware := strings.ToLower(r.URL.Query().Get("firmware"))
+	if firmware == "" {
+		return "efi", true
+	}
+
+	if firmware != "bios" && firmware != "efi" {
+		http.Error(w, "firmware must be bios or efi", http.StatusBadRequest)
+		return "", false
+	}
+
+	return firmware, true
+}
+
+// GetBootDecision tells an external DHCP server whether a machine should netboot
+// Example request: GET boot/52:54:00:d9:71:93/decision?firmware=bios
+// Example response: {"MAC": "52:54:00:d9:71:93", "Action": "netboot", "Reason": "a boot is queued", "Rule": "queue",
+//
+//	"BootFile": "undionly.kpxe", "Server": "10.0.0.1", "Architecture": "x86_64", "Firmware": "bios"}
+func (api_ *API) GetBootDecision(w http.ResponseWriter, r *http.Request) {
+	mac := mux.Vars(r)["mac"]
+	firmware, ok := bootFirmware(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), decisionTimeout)
+	defer cancel()
+
+	decision := api_.decideAll(ctx, []string{mac}, firmware, nextServer(r))[0]
+	writeJSON(w, http.StatusOK, decision)
+}
+
+// bootDecisionsRequest lists the machines a DHCP server wants a decision on
+type bootDecisionsRequest struct {
+	MACs []string `description:"The MAC addresses of the machines to decide for"`
+}
+
+// GetBootDecisions decides for several machines at once, the decisions are in the same order as the machines
+// Example request: POST boot/decisions?firmware=efi {"MACs": ["52:54:00:d9:71:93", "52:54:00:d9:71:94"]}
+// Example response: [{"MAC": "52:54:00:d9:71:93", "Action": "local", "Rule": "local-boot",
+//
+//	"Reason": "no boots are queued and there is no default image"}, {"MAC": "52:54:00:d9:71:94", "Action": "local", "Reason": "unknown machine"}]
+func (api_ *API) GetBootDecisions(w http.ResponseWriter, r *http.Request) {
+	firmware, ok := bootFirmware(w, r)
+	if !ok {
+		return
+	}
+
+	var req bootDecisionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid list of machines", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.MACs) > maxBatchDecisions {
+		http.Error(w, fmt.Sprintf("at most %d machines can be decided on at once", maxBatchDecisions),
+			http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), decisionTimeout)
+	defer cancel()
+
+	writeJSON(w, http.StatusOK, api_.decideAll(ctx, req.MACs, firmware, nextServer(r)))
+}
+
+// RegisterBootDecisionHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterBootDecisionHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/boot/{mac}/decision",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetBootDecision,
+		Method:      http.MethodGet,
+		Description: "Tells a DHCP server whether a machine should netboot",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/boot/decisions",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeMachinesWrite,
+		Handler:     api_.GetBootDecisions,
+		Method:      http.MethodPost,
+		Schema:      "boot-decisions",
+		Description: "Tells a DHCP server which of several machines should netboot",
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_BootDecision(t *testing.T) {
+	store := newTestStore(t)
+
+	machines := []machinemodel.MachineModel{
+		{Name: "queued", MacAddress: util.MacAddress{Address: "aa"}, Architecture: machinemodel.X86_64, Managed: true},
+		{Name: "idle", MacAddress: util.MacAddress{Address: "bb"}, Architecture: machinemodel.X86_64, Managed: true},
+		{Name: "unmanaged", MacAddress: util.MacAddress{Address: "cc"}, Architecture: machinemodel.X86_64},
+		{Name: "arm", MacAddress: util.MacAddress{Address: "dd"}, Architecture: machinemodel.Arm64, Managed: true},
+	}
+	for i := range machines {
+		assert.NoError(t, store.CreateMachine(&machines[i]))
+	}
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+	assert.NoError(t, store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}))
+	for _, mac := range []string{"aa", "cc", "dd"} {
+		assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: mac, SetupUUID: "setup"}))
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	resp := s.request(http.MethodGet, "/boot/aa/decision?firmware=bios", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var decision bootDecision
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decision))
+	assert.Equal(t, actionNetboot, decision.Action)
+	assert.Equal(t, "undionly.kpxe", decision.BootFile)
+	assert.Equal(t, "example.com", decision.Server)
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/boot/aa/decision?firmware=uboot", "").Code)
+
+	// Machines without a queued boot, out of service, without a boot loader or unknown boot from their disk
+	resp = s.request(http.MethodPost, "/boot/decisions", `{"MACs": ["aa", "bb", "cc", "dd", "ee"]}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var decisions []bootDecision
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decisions))
+	assert.Len(t, decisions, 5)
+	assert.Equal(t, actionNetboot, decisions[0].Action)
+	assert.Equal(t, "ipxe.efi", decisions[0].BootFile)
+	for i, mac := range []string{"bb", "cc", "dd", "ee"} {
+		assert.Equal(t, mac, decisions[i+1].MAC)
+		assert.Equal(t, actionLocal, decisions[i+1].Action)
+		assert.Empty(t, decisions[i+1].BootFile)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// bootRule names the rule which decided what a network-booting machine does
+type bootRule string
+
+const (
+	// ruleQueue boots the head of the boot queue of the machine
+	ruleQueue bootRule = "queue"
+	// ruleMachineDefault boots the default image of the machine itself, since nothing is queued
+	ruleMachineDefault bootRule = "machine-default"
+	// ruleGroupDefault boots the default image of the group of the machine, which has none of its own
+	ruleGroupDefault bootRule = "group-default"
+	// ruleLocalBoot boots from the local disk, since nothing is queued and there is no default image
+	ruleLocalBoot bootRule = "local-boot"
+	// ruleRegister boots the management OS on a machine BAAS does not know, so it registers itself
+	ruleRegister bootRule = "register"
+)
+
+// defaultBootMode is used for default images which do not name a boot mode, the changes made while running them
+// are never kept
+const defaultBootMode = images.BootDiscard
+
+// resolvedDefault is the default image a machine boots when nothing is queued for it
+type resolvedDefault struct {
+	Rule bootRule
+	// Reason explains which default image was picked, or why none was
+	Reason   string
+	Image    *images.ImageModel
+	BootMode images.BootMode
+}
+
+// bootableDefault checks whether a default image can be booted on a machine. Images are removed from under their
+// defaults when they are trashed with ?force, they may still rot or be built for another architecture.
+func (api_ *API) bootableDefault(m *machinemodel.MachineModel, def machinemodel.DefaultImage) (*images.ImageModel,
+	error) {
+	image, err := api_.store.GetImageByUUID(images.ImageUUID(def.ImageUUID))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(image.Versions) == 0 {
+		return nil, errors.New("the image has no versions")
+	}
+
+	if image.LatestVersion() == nil {
+		return nil, errors.New("the image has no intact version")
+	}
+
+	if image.Architecture.Conflicts(m.Architecture) {
+		return nil, fmt.Errorf("the image is built for %s", image.Architecture)
+	}
+
+	return image, nil
+}
+
+// defaultCandidate is a default image which may apply to a machine
+type defaultCandidate struct {
+	rule   bootRule
+	def    machinemodel.DefaultImage
+	reason string
+}
+
+// resolveDefault finds what a machine boots when nothing is queued for it: its own default image, else the default
+// image of its group, else the local disk. Default images which cannot be booted are passed over.
+func (api_ *API) resolveDefault(m *machinemodel.MachineModel) resolvedDefault {
+	candidates := []defaultCandidate{{ruleMachineDefault, m.DefaultImage, "the default image of the machine"}}
+
+	if m.Group != "" {
+		group, err := api_.store.GetMachineGroup(m.Group)
+		if err == nil {
+			candidates = append(candidates,
+				defaultCandidate{ruleGroupDefault, group.DefaultImage, "the default image of group " + m.Group})
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Errorf("Cannot find group %s of machine %s: %v", m.Group, m.MacAddress.Address, err)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !candidate.def.Set() {
+			continue
+		}
+
+		image, err := api_.bootableDefault(m, candidate.def)
+		if err != nil {
+			log.Warnf("Passing over %s %s for %s: %v", candidate.reason, candidate.def.ImageUUID,
+				m.MacAddress.Address, err)
+			continue
+		}
+
+		mode := images.BootMode(candidate.def.BootMode)
+		if mode == "" {
+			mode = defaultBootMode
+		}
+
+		return resolvedDefault{
+			Rule:     candidate.rule,
+			Reason:   fmt.Sprintf("no boots are queued, booting %s %s", candidate.reason, image.UUID),
+			Image:    image,
+			BootMode: mode,
+		}
+	}
+
+	return resolvedDefault{Rule: ruleLocalBoot, Reason: "no boots are queued and there is no default image"}
+}
+
+// defaultBootSetup builds the boot of the default image of a machine, as if it had been queued. The latest version
+// is resolved when the boot is claimed, like for any other boot.
+func defaultBootSetup(m *machinemodel.MachineModel, def resolvedDefault) (*images.BootSetup, images.ImageSetup) {
+	bootSetup := &images.BootSetup{
+		MachineMAC: m.MacAddress.Address,
+		BootMode:   def.BootMode,
+		Version:    images.VersionLatest,
+	}
+
+	setup := images.ImageSetup{
+		Name:     def.Image.Name,
+		Username: def.Image.Username,
+		Images:   []images.ImageFrozen{{Image: *def.Image, UUIDImage: def.Image.UUID}},
+	}
+
+	return bootSetup, setup
+}
+
+// checkDefaultImage validates the default image of a machine or group, the boot mode is left out when there is no
+// image and filled in when there is one without it
+func (api_ *API) checkDefaultImage(w http.ResponseWriter, def *machinemodel.DefaultImage) bool {
+	if !def.Set() {
+		def.BootMode = ""
+		return true
+	}
+
+	if def.BootMode == "" {
+		def.BootMode = string(defaultBootMode)
+	}
+
+	if !images.BootMode(def.BootMode).Valid() {
+		http.Error(w, fmt.Sprintf("unknown boot mode %q", def.BootMode), http.StatusBadRequest)
+		return false
+	}
+
+	if _, err := api_.store.GetImageByUUID(images.ImageUUID(def.ImageUUID)); err != nil {
+		http.Error(w, fmt.Sprintf("unknown default image %s", def.ImageUUID), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// imageDefaults lists who boots an image by default, by the MAC addresses of the machines and the names of the
+// groups
+type imageDefaults struct {
+	Machines []string
+	Groups   []string
+}
+
+func (d imageDefaults) empty() bool {
+	return len(d.Machines) == 0 && len(d.Groups) == 0
+}
+
+// plan adds the defaults to the plan of removing their image, they are cleared when it is forced and block it
+// otherwise
+func (d imageDefaults) plan(plan *api_pkg.PlannedChanges, uuid images.ImageUUID, force bool) {
+	for _, mac := range d.Machines {
+		if force {
+			plan.Row(api_pkg.PlanModify, "machine", mac)
+		} else {
+			plan.Block(fmt.Sprintf("image %s is the default image of machine %s", uuid, mac))
+		}
+	}
+
+	for _, group := range d.Groups {
+		if force {
+			plan.Row(api_pkg.PlanModify, "machine group", group)
+		} else {
+			plan.Block(fmt.Sprintf("image %s is the default image of group %s", uuid, group))
+		}
+	}
+}
+
+func (api_ *API) getImageDefaults(uuid images.ImageUUID) (imageDefaults, error) {
+	defaults := imageDefaults{Machines: []string{}, Groups: []string{}}
+
+	machines, groups, err := api_.store.GetImageDefaults(string(uuid))
+	for _, m := range machines {
+		defaults.Machines = append(defaults.Machines, m.MacAddress.Address)
+	}
+
+	for _, group := range groups {
+		defaults.Groups = append(defaults.Groups, group.Name)
+	}
+
+	return defaults, err
+}
+
+// GetMachineGroups lists the groups which have settings of their own
+// Example request: GET /machine-groups
+// Example response: [{"Name": "lab-1", "DefaultImage": {"ImageUUID": "57bf0cd3-...", "BootMode": "discard"}, ...}]
+func (api_ *API) GetMachineGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := api_.storeFor(r).GetMachineGroups()
+	if ErrorWrite(w, err, "Cannot fetch the groups") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewMachineGroups(groups))
+}
+
+// GetMachineGroup gets the settings of a group, groups which have none are not found
+// Example request: GET /machine-group/lab-1
+// Example response: {"Name": "lab-1", "DefaultImage": {"ImageUUID": "57bf0cd3-...", "BootMode": "discard"}, ...}
+func (api_ *API) GetMachineGroup(w http.ResponseWriter, r *http.Request) {
+	name, err := GetTag("group", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	group, err := api_.storeFor(r).GetMachineGroup(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The group has no settings", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the group") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewMachineGroup(group))
+}
+
+// machineGroupRequest is the body of PUT /machine-group/{group}
+type machineGroupRequest struct {
+	DefaultImage machinemodel.DefaultImage
+	Verify       images.VerifyMode
+}
+
+// SetMachineGroup replaces the settings of a group. The machines name their group, so a group can be set up before
+// any machine is in it.
+// Example request: PUT /machine-group/lab-1 {"DefaultImage": {"ImageUUID": "57bf0cd3-...", "BootMode": "discard"},
+//
+//	"Verify": "quick"}
+//
+// Example response: {"Name": "lab-1", "DefaultImage": {"ImageUUID": "57bf0cd3-...", "BootMode": "discard"}, ...}
+func (api_ *API) SetMachineGroup(w http.ResponseWriter, r *http.Request) {
+	name, err := GetTag("group", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var body machineGroupRequest
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid group settings given", http.StatusBadRequest)
+		return
+	}
+
+	if !api_.checkDefaultImage(w, &body.DefaultImage) {
+		return
+	}
+
+	if !body.Verify.Valid() {
+		http.Error(w, "Verify must be one of none, quick or full", http.StatusBadRequest)
+		return
+	}
+
+	group, err := api_.storeFor(r).GetMachineGroup(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		group = &machinemodel.MachineGroup{Name: name}
+	} else if ErrorWrite(w, err, "Cannot fetch the group") != nil {
+		return
+	}
+
+	group.DefaultImage = body.DefaultImage
+	group.Verify = string(body.Verify)
+	if ErrorWrite(w, api_.storeFor(r).SaveMachineGroup(group), "Cannot save the group") != nil {
+		return
+	}
+
+	requestLog(r).Infof("%s set the default image of group %s to %q, verified %q", api_.requester(r), name,
+		group.DefaultImage.ImageUUID, group.Verify)
+	writeJSON(w, http.StatusOK, types.NewMachineGroup(group))
+}
+
+// DeleteMachineGroup forgets the settings of a group, its machines are not touched
+// Example request: DELETE /machine-group/lab-1
+// Example response: 204 No Content
+func (api_ *API) DeleteMachineGroup(w http.ResponseWriter, r *http.Request) {
+	name, err := GetTag("group", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	err = api_.storeFor(r).DeleteMachineGroup(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The group has no settings", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot delete the group") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterMachineGroupHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterMachineGroupHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine-groups",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetMachineGroups,
+		Method:      http.MethodGet,
+		Description: "Lists the groups of machines which have settings of their own",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine-group/{group}",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetMachineGroup,
+		Method:      http.MethodGet,
+		Description: "Gets the settings of a group of machines",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine-group/{group}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetMachineGroup,
+		Method:      http.MethodPut,
+		Schema:      "machine-group",
+		Description: "Sets the default image of a group of machines",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine-group/{group}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.DeleteMachineGroup,
+		Method:      http.MethodDelete,
+		Description: "Forgets the settings of a group of machines",
+	})
+}
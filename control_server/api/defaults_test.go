@@ -0,0 +1,143 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_DefaultImages(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "defaults")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+	for _, uuid := range []images.ImageUUID{"course", "lab"} {
+		assert.NoError(t, store.CreateImage(&images.ImageModel{Name: string(uuid), Username: "test", UUID: uuid}))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: uuid}))
+	}
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	// own and grouped are in the lab, alone is not
+	for _, m := range []machinemodel.MachineModel{
+		{Name: "own", Group: "lab-1", MacAddress: util.MacAddress{Address: "52:54:00:00:00:01"}},
+		{Name: "grouped", Group: "lab-1", MacAddress: util.MacAddress{Address: "52:54:00:00:00:02"}},
+		{Name: "alone", MacAddress: util.MacAddress{Address: "52:54:00:00:00:03"}},
+	} {
+		m := m
+		m.Architecture = machinemodel.X86_64
+		m.Managed = true
+		assert.NoError(t, store.CreateMachine(&m))
+		machineImage, err := images.CreateMachineImageModel(m.MacAddress)
+		assert.NoError(t, err)
+		assert.NoError(t, store.(sqlite.Store).Session(&gorm.Session{SkipHooks: true}).Create(machineImage).Error)
+	}
+
+	assert.Equal(t, http.StatusBadRequest,
+		s.request(http.MethodPut, "/machine-group/lab-1", `{"DefaultImage": {"ImageUUID": "gone"}}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/machine-group/lab-1",
+		`{"DefaultImage": {"ImageUUID": "lab", "BootMode": "scratch"}}`).Code)
+
+	resp := s.request(http.MethodPut, "/machine-group/lab-1", `{"DefaultImage": {"ImageUUID": "lab"}}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var group types.MachineGroup
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &group))
+	assert.Equal(t, types.DefaultImage{ImageUUID: "lab", BootMode: "discard"}, group.DefaultImage)
+
+	// The machine overrides the default image of its group
+	resp = s.request(http.MethodPut, "/machine", `{"Name": "own", "Architecture": "x86_64", "Managed": true,
+		"Group": "lab-1", "MacAddress": {"Address": "52:54:00:00:00:01"},
+		"DefaultImage": {"ImageUUID": "course", "BootMode": "persistent"}}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var updated types.Machine
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &updated))
+	assert.Equal(t, types.DefaultImage{ImageUUID: "course", BootMode: "persistent"}, updated.DefaultImage)
+
+	decide := func() []bootDecision {
+		resp := s.request(http.MethodPost, "/boot/decisions",
+			`{"MACs": ["52:54:00:00:00:01", "52:54:00:00:00:02", "52:54:00:00:00:03"]}`)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var decisions []bootDecision
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &decisions))
+		return decisions
+	}
+
+	decisions := decide()
+	assert.Equal(t, actionNetboot, decisions[0].Action)
+	assert.Equal(t, ruleMachineDefault, decisions[0].Rule)
+	assert.Contains(t, decisions[0].Reason, "course")
+	assert.Equal(t, actionNetboot, decisions[1].Action)
+	assert.Equal(t, ruleGroupDefault, decisions[1].Rule)
+	assert.Equal(t, actionLocal, decisions[2].Action)
+	assert.Equal(t, ruleLocalBoot, decisions[2].Rule)
+
+	// The default image is claimed like a queued boot
+	resp = s.request(http.MethodGet, "/machine/52:54:00:00:00:02/boot", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var setup images.ImageSetup
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &setup))
+	assert.Equal(t, images.BootDiscard, setup.BootMode)
+	assert.Equal(t, images.ImageUUID("lab"), setup.Images[0].Image.UUID)
+	assert.Equal(t, uint64(1), setup.Images[0].Version.Version)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/machine/52:54:00:00:00:03/boot", "").Code)
+
+	resp = s.request(http.MethodGet, "/boot/pxelinux.cfg/01-52-54-00-00-00-01", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "MENU LABEL Default image: course")
+	assert.NotContains(t, s.request(http.MethodGet, "/boot/pxelinux.cfg/01-52-54-00-00-00-03", "").Body.String(),
+		"KERNEL")
+
+	// Images which are booted by default are only removed when forced, which clears the defaults
+	resp = s.request(http.MethodDelete, "/image/lab", "")
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	var plan api_pkg.PlannedChanges
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &plan))
+	assert.Equal(t, []string{"image lab is the default image of group lab-1"}, plan.Blockers)
+
+	resp = s.request(http.MethodDelete, "/image/course?force=true&dry_run=true", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &plan))
+	assert.Contains(t, plan.Rows, api_pkg.PlannedRow{Action: api_pkg.PlanModify, Kind: "machine",
+		Key: "52:54:00:00:00:01"})
+
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/course?force=true", "").Code)
+	decisions = decide()
+	assert.Equal(t, ruleGroupDefault, decisions[0].Rule)
+
+	resp = s.request(http.MethodGet, "/machine/52:54:00:00:00:01", "")
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &updated))
+	assert.Equal(t, types.DefaultImage{}, updated.DefaultImage)
+
+	resp = s.request(http.MethodGet, "/machine-groups", "")
+	var groups []types.MachineGroup
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &groups))
+	assert.Len(t, groups, 1)
+
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/machine-group/lab-1", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/machine-group/lab-1", "").Code)
+	assert.Equal(t, ruleLocalBoot, decide()[1].Rule)
+}
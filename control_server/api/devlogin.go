@@ -0,0 +1,223 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/validation"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// devClientID is the client the dev provider is used by, its secret is the same since there is nothing to protect
+const devClientID = "baas-dev"
+
+// devLogin is an OAuth provider served by the control server itself, which logs in as whoever is typed into its
+// form. It stands in for GitHub during local development and tests, so those need no OAuth app and no public
+// callback. The login goes through the same callback as any other provider.
+type devLogin struct {
+	base string
+
+	mu sync.Mutex
+	// codes are handed to the callback and exchanged for tokens, which fetch the account once. Both are single use.
+	codes  map[string]oauthUser
+	tokens map[string]oauthUser
+}
+
+func newDevLogin(base string) *devLogin {
+	return &devLogin{
+		base:   strings.TrimSuffix(base, "/"),
+		codes:  map[string]oauthUser{},
+		tokens: map[string]oauthUser{},
+	}
+}
+
+// provider is the OAuth configuration which logs in through the endpoints of the dev provider
+func (d *devLogin) provider() *oauthProvider {
+	return &oauthProvider{
+		conf: &oauth2.Config{
+			ClientID:     devClientID,
+			ClientSecret: devClientID,
+			RedirectURL:  d.base + "/user/login/dev/callback",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   d.base + "/dev/authorize",
+				TokenURL:  d.base + "/dev/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+		fetchUser: d.fetchUser,
+	}
+}
+
+// put stores an account under a new random key
+func (d *devLogin) put(into map[string]oauthUser, account oauthUser) string {
+	key := generateRandomState()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	into[key] = account
+	return key
+}
+
+// take removes the account stored under a key
+func (d *devLogin) take(from map[string]oauthUser, key string) (oauthUser, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	account, ok := from[key]
+	delete(from, key)
+	return account, ok
+}
+
+// fetchUser asks the dev provider who the token of the client logs in as
+func (d *devLogin) fetchUser(client *http.Client) (*oauthUser, error) {
+	resp, err := client.Get(d.base + "/dev/user")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the dev provider answered %s", resp.Status)
+	}
+
+	var account oauthUser
+	if err = json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return nil, err
+	}
+
+	if account.ID == "" {
+		return nil, errors.New("the dev provider did not return an account")
+	}
+
+	return &account, nil
+}
+
+// devLoginForm asks who to log in as, it posts back to /dev/authorize
+var devLoginForm = template.Must(template.New("dev-login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>BAAS dev login</title></head>
+<body>
+<h1>Log in to BAAS for development</h1>
+<p>Anyone can log in as anyone here, this is not meant for real deployments.</p>
+<form method="post" action="/dev/authorize">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<label>Username <input name="username" required autofocus></label>
+<label>Role <select name="role">
+<option value="user">user</option>
+<option value="moderator">moderator</option>
+<option value="admin">admin</option>
+</select></label>
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// ServeDevAuthorize shows the form of the dev provider, and sends the browser back to the callback with a code
+// for the user it was filled in with. Only the callback of the control server is accepted as redirect.
+// Example request: GET /dev/authorize?state=...&redirect_uri=http://localhost:4848/user/login/dev/callback
+// Example request: POST /dev/authorize with the form fields username, role, state and redirect_uri
+// Example response: 302 Found to /user/login/dev/callback?code=...&state=...
+func (api_ *API) ServeDevAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	callback := api_.devLogin.provider().conf.RedirectURL
+	if r.Form.Get("redirect_uri") != callback {
+		http.Error(w, "The dev provider only redirects to "+callback, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := devLoginForm.Execute(w, struct{ State, RedirectURI string }{r.Form.Get("state"), callback})
+		if err != nil {
+			requestLog(r).Errorf("Cannot show the dev login form: %v", err)
+		}
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	if reasons := validation.Username(username); len(reasons) != 0 {
+		http.Error(w, "Invalid username: "+strings.Join(reasons, ", "), http.StatusBadRequest)
+		return
+	}
+
+	role, err := usermodel.ParseRole(r.PostForm.Get("role"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code := api_.devLogin.put(api_.devLogin.codes, oauthUser{
+		ID:    username,
+		Login: username,
+		Name:  username,
+		Email: username + "@dev.localhost",
+		Role:  role,
+	})
+
+	requestLog(r).Warnf("Dev login as %s with role %s", username, role)
+	query := url.Values{"code": []string{code}, "state": []string{r.PostForm.Get("state")}}
+	http.Redirect(w, r, callback+"?"+query.Encode(), http.StatusFound)
+}
+
+// ServeDevToken exchanges a code of the dev provider for a token
+// Example request: POST /dev/token with the form fields grant_type=authorization_code and code
+// Example response: {"access_token": "...", "token_type": "bearer"}
+func (api_ *API) ServeDevToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	account, ok := api_.devLogin.take(api_.devLogin.codes, r.PostForm.Get("code"))
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := api_.devLogin.put(api_.devLogin.tokens, account)
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": token, "token_type": "bearer"})
+}
+
+// ServeDevUser tells which account the token of the dev provider logs in as
+// Example request: GET /dev/user with the header Authorization: Bearer ...
+// Example response: {"ID": "jan", "Login": "jan", "Name": "jan", "Email": "jan@dev.localhost", "Role": "admin"}
+func (api_ *API) ServeDevUser(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	account, ok := api_.devLogin.take(api_.devLogin.tokens, token)
+	if !ok {
+		http.Error(w, "Unknown token", http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account)
+}
+
+// registerDevLoginHandlers serves the endpoints of the dev provider when it is enabled. Like the login itself they
+// are reached without a session.
+func (api_ *API) registerDevLoginHandlers(r *mux.Router) {
+	if api_.devLogin == nil {
+		return
+	}
+
+	r.HandleFunc("/dev/authorize", api_.ServeDevAuthorize).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/dev/token", api_.ServeDevToken).Methods(http.MethodPost)
+	r.HandleFunc("/dev/user", api_.ServeDevUser).Methods(http.MethodGet)
+}
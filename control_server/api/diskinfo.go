@@ -0,0 +1,156 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// diskInfo is the partition table of a version, next to the disk its image is built for
+type diskInfo struct {
+	Version        uint64
+	DiskUUID       string
+	Warning        string `json:",omitempty"`
+	PartitionTable *fs.PartitionTable
+}
+
+// checkDiskUUID spells the DiskUUID of an image the way the management OS reports the disks of machines, so they
+// can be matched. An empty DiskUUID fits any disk.
+func checkDiskUUID(image *images.ImageModel) error {
+	if image.DiskUUID == "" {
+		return nil
+	}
+
+	diskUUID, err := fs.NormalizeDiskUUID(image.DiskUUID)
+	if err != nil {
+		return fmt.Errorf("invalid DiskUUID: %v", err)
+	}
+
+	image.DiskUUID = diskUUID
+	return nil
+}
+
+// hasContent checks whether anything was uploaded to an image, its empty version 0 does not count
+func hasContent(image *images.ImageModel) bool {
+	for _, version := range image.Versions {
+		if version.SHA256 != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readPartitionTable reads the partition table of a stored file, a file which was never uploaded has none
+func readPartitionTable(path string, image *images.ImageModel) (table *fs.PartitionTable, err error) {
+	err = readContent(path, image, func(r io.Reader) error {
+		table, err = fs.ReadPartitionTable(r)
+		return err
+	})
+
+	if os.IsNotExist(err) {
+		return nil, fs.ErrNoPartitionTable
+	}
+
+	return table, err
+}
+
+// recordDiskUUID derives the disk an upload is built for from its partition table, rather than trusting the
+// uploader. The first upload to an image sets its DiskUUID, later ones are recorded so listings warn when they
+// disagree with it.
+func (api_ *API) recordDiskUUID(r *http.Request, image *images.ImageModel, path string, format images.FileFormat,
+	first bool) {
+	diskUUID := ""
+	if format == images.FormatRaw {
+		table, err := readPartitionTable(path, image)
+		switch {
+		case err == nil:
+			diskUUID = table.DiskUUID
+		case !errors.Is(err, fs.ErrNoPartitionTable):
+			requestLog(r).Warnf("Cannot read the partition table of the upload to image %s: %v", image.UUID, err)
+			return
+		}
+	}
+
+	claim := first && diskUUID != ""
+	if err := api_.storeFor(r).SetUploadedDiskUUID(image.UUID, diskUUID, claim); err != nil {
+		requestLog(r).Warnf("Cannot store the partition table UUID of image %s: %v", image.UUID, err)
+		return
+	}
+
+	if claim && diskUUID != image.DiskUUID {
+		requestLog(r).Infof("Image %s is built for the disk %s, as its first upload shows", image.UUID, diskUUID)
+	}
+}
+
+// GetDiskInfo reads the partition table of the latest version of an image, or of the version given with ?version=.
+// Versions without a partition table, such as ISO images or encrypted versions, are answered with 422.
+// Example request: GET /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/diskinfo
+// Example response: {"Version": 3, "DiskUUID": "30df844c", "PartitionTable": {"Type": "dos", "DiskUUID": "30df844c",
+// "Partitions": [{"Number": 1, "Type": "83", "Start": 1048576, "Size": 10736369664, "Bootable": true}]}}
+func (api_ *API) GetDiskInfo(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	var version *images.Version
+	if number := r.URL.Query().Get("version"); number != "" {
+		parsed, perr := strconv.ParseUint(number, 10, 64)
+		if perr == nil {
+			version = image.FindVersion(parsed)
+		}
+	} else if n := len(image.Versions); n != 0 {
+		version = &image.Versions[n-1]
+	}
+
+	if version == nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	table, err := readPartitionTable(api_.versionFile(image, version.Version), image)
+	if errors.Is(err, fs.ErrNoPartitionTable) {
+		http.Error(w, fmt.Sprintf("Version %d has no partition table", version.Version),
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot read the partition table of the version") != nil {
+		return
+	}
+
+	info := diskInfo{Version: version.Version, DiskUUID: image.DiskUUID, PartitionTable: table}
+	if image.DiskUUID != "" && table.DiskUUID != "" &&
+		!strings.EqualFold(table.DiskUUID, image.DiskUUID) {
+		info.Warning = fmt.Sprintf("the version has the partition table %s, the image is built for the disk %s",
+			table.DiskUUID, image.DiskUUID)
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// RegisterDiskInfoHandlers sets the metadata for the route which describes the partition table of a version
+func (api_ *API) RegisterDiskInfoHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/diskinfo",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetDiskInfo,
+		Method:      http.MethodGet,
+		Description: "Describes the partition table of a version of the image",
+	})
+}
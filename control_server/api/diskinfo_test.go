@@ -0,0 +1,116 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// mbrDisk is a disk with an MBR which holds a single Linux partition
+func mbrDisk(signature uint32) []byte {
+	disk := make([]byte, 4096)
+	binary.LittleEndian.PutUint32(disk[440:], signature)
+	disk[446+4] = 0x83
+	binary.LittleEndian.PutUint32(disk[446+8:], 2048)
+	binary.LittleEndian.PutUint32(disk[446+12:], 2048)
+	copy(disk[510:], "\x55\xaa")
+	return disk
+}
+
+func TestApi_DiskInfo(t *testing.T) {
+	store := newTestStore(t)
+	u := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(u))
+
+	diskpath, err := ioutil.TempDir("", "diskinfo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	upload := func(uri string, content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "image.img")
+		_, _ = part.Write(content)
+		_ = form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, uri, &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-BAAS-NewVersion", "true")
+		s.login(req, u)
+		return s.serve(req)
+	}
+
+	// Only partition table UUIDs are accepted, in the spelling of blkid
+	for _, diskUUID := range []string{"/dev/sda", "WD-WCC4N1234567", "30DF-84"} {
+		resp := s.requestAs(u, http.MethodPost, "/image",
+			`{"Name": "Fedora", "Username": "test", "DiskUUID": "`+diskUUID+`"}`)
+		assert.Equal(t, http.StatusBadRequest, resp.Code, diskUUID)
+	}
+
+	resp := s.requestAs(u, http.MethodPost, "/image", `{"Name": "Fedora", "Username": "test", "DiskUUID": "30DF-844C"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var image types.Image
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&image))
+	assert.Equal(t, "30df844c", image.DiskUUID)
+	assert.NoError(t, os.MkdirAll(filepath.Join(diskpath, string(image.UUID)), os.ModePerm))
+
+	// Nothing was uploaded yet
+	assert.Equal(t, http.StatusUnprocessableEntity, s.requestAs(u, http.MethodGet,
+		"/image/"+string(image.UUID)+"/diskinfo", "").Code)
+
+	// The first upload decides the disk the image is built for, whatever it was created with
+	assert.Equal(t, http.StatusOK, upload("/image/"+string(image.UUID), mbrDisk(0xdeadbeef)).Code)
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "deadbeef", stored.DiskUUID)
+	assert.Empty(t, types.NewImage(stored).DiskUUIDWarning)
+
+	resp = s.requestAs(u, http.MethodGet, "/image/"+string(image.UUID)+"/diskinfo", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var info diskInfo
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, uint64(1), info.Version)
+	assert.Empty(t, info.Warning)
+	assert.Equal(t, &fs.PartitionTable{Type: fs.TableDOS, DiskUUID: "deadbeef", Partitions: []fs.Partition{
+		{Number: 1, Type: "83", Start: 1024 * 1024, Size: 1024 * 1024}}}, info.PartitionTable)
+
+	// Later uploads with another partition table are flagged in the listings
+	assert.Equal(t, http.StatusOK, upload("/image/"+string(image.UUID), mbrDisk(0x30df844c)).Code)
+	resp = s.requestAs(u, http.MethodGet, "/user/test/images", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var listed []types.Image
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "deadbeef", listed[0].DiskUUID)
+	assert.True(t, strings.Contains(listed[0].DiskUUIDWarning, "30df844c"), listed[0].DiskUUIDWarning)
+
+	resp = s.requestAs(u, http.MethodGet, "/image/"+string(image.UUID)+"/diskinfo?version=1", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Empty(t, info.Warning)
+	resp = s.requestAs(u, http.MethodGet, "/image/"+string(image.UUID)+"/diskinfo", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, uint64(2), info.Version)
+	assert.NotEmpty(t, info.Warning)
+
+	assert.Equal(t, http.StatusNotFound, s.requestAs(u, http.MethodGet,
+		"/image/"+string(image.UUID)+"/diskinfo?version=7", "").Code)
+}
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"strconv"
 
+	"github.com/baas-project/baas/pkg/limits"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/user"
 
@@ -59,14 +60,13 @@ func runDockerCommand(dir string) error {
 	return nil
 }
 
-func renameFiles(dir string, diskpath string, filepathfmt string, uniqueID string, version uint64) error {
-	if err := os.Rename(dir+"/"+"image.img",
-		fmt.Sprintf(diskpath+filepathfmt, uniqueID, version)); err != nil {
+func renameFiles(dir string, version uint64) error {
+	if err := os.Rename(dir+"/"+"image.img", dir+"/"+fmt.Sprintf(images.VersionFileFmt, version)); err != nil {
 		log.Errorf("Failed to move image file: %v", err)
 		return err
 	}
 
-	newPath := fmt.Sprintf(diskpath+"/%s/Dockerfile-%d", uniqueID, version)
+	newPath := fmt.Sprintf("%s/Dockerfile-%d", dir, version)
 	if err := os.Rename(dir+"/"+"Dockerfile", newPath); err != nil {
 		log.Errorf("Failed to move dockerfile: %v", err)
 		return err
@@ -78,12 +78,23 @@ func renameFiles(dir string, diskpath string, filepathfmt string, uniqueID strin
 // RunDocker takes a Dockerfile and generates a bootable OS image
 // Request request: /image/{uuid}/docker
 func (api_ *API) RunDocker(w http.ResponseWriter, r *http.Request) {
-	uniqueID, err := GetTag("uuid", w, r)
+	uniqueID, err := GetTag("uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uniqueID))
 	if err != nil {
+		http.Error(w, "cannot fetch the image from the database", http.StatusNotFound)
+		log.Errorf("cannot fetch image from database: %v", err)
 		return
 	}
 
-	version, err := CreateNewVersion(uniqueID, api_.store)
+	if !api_.checkLimits(w, image.Username, limits.CreateVersion(image.UUID)) {
+		return
+	}
+
+	version, err := CreateNewVersion(uniqueID, api_.storeFor(r))
 	if err != nil {
 		http.Error(w, "cannot fetch the image from the database", http.StatusNotFound)
 		log.Errorf("cannot fetch image from database: %v", err)
@@ -103,7 +114,13 @@ func (api_ *API) RunDocker(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	dir := api_.diskpath + "/" + uniqueID
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+	defer release()
+
+	dir := api_.imageDir(image)
 
 	// Delete the directory at the end of the program
 	// defer os.RemoveAll(dir)
@@ -118,7 +135,7 @@ func (api_ *API) RunDocker(w http.ResponseWriter, r *http.Request) {
 
 	defer f.Close()
 
-	err = fs.CopyStream(p, f)
+	_, err = fs.Copy(f, p)
 	if err != nil {
 		http.Error(w, "Cannot compile docker image", http.StatusInternalServerError)
 		log.Errorf("Cannot write to DockerImage file: %v", err)
@@ -132,11 +149,12 @@ func (api_ *API) RunDocker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if renameFiles(dir, api_.diskpath, images.FilePathFmt, uniqueID, version.Version) != nil {
+	if renameFiles(dir, version.Version) != nil {
 		http.Error(w, "cannot compile docker image", http.StatusInternalServerError)
 		return
 	}
 
+	api_.imageEvent(image, images.WebhookVersionCreated, &version.Version)
 	http.Error(w, "Successfully uploaded image: "+strconv.FormatUint(version.Version, 10), http.StatusOK)
 }
 
@@ -146,8 +164,11 @@ func (api_ *API) RegisterImageDockerHandlers() {
 		URI:         "/image/{uuid}/docker",
 		Permissions: []user.UserRole{user.Moderator, user.Admin},
 		UserAllowed: true,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.RunDocker,
 		Method:      http.MethodPost,
+		Schema:      schemaMultipart,
 		Description: "Uploads a new version of the image",
 	})
 }
@@ -0,0 +1,55 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/baas-project/baas/control_server/downloads"
+	log "github.com/sirupsen/logrus"
+)
+
+// downloadRetryAfter is how many seconds a refused download is told to wait, the agents add jitter to it
+const downloadRetryAfter = 10
+
+// throttledResponseWriter sends the body of a download through the bandwidth limit of the coordinator
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// downloadPriority puts the downloads of users ahead of the machines, which flash without anyone waiting on them
+func (api_ *API) downloadPriority(r *http.Request) downloads.Priority {
+	if api_.isMachine(r) {
+		return downloads.Bulk
+	}
+
+	return downloads.Interactive
+}
+
+// admitDownload waits for the turn of an image download and answers the request when it is refused. The returned
+// writer is limited to the shared bandwidth, and release has to be called when the download is done.
+func (api_ *API) admitDownload(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	release, err := api_.downloads.Acquire(r.Context(), api_.downloadPriority(r))
+	if errors.Is(err, downloads.ErrQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(downloadRetryAfter))
+		http.Error(w, "The server is busy with other downloads, try again later", http.StatusServiceUnavailable)
+		log.Infof("Refused download of %s: %v", r.URL.Path, err)
+		return nil, nil, false
+	} else if err != nil {
+		// The client went away while waiting
+		log.Debugf("Gave up download of %s: %v", r.URL.Path, err)
+		return nil, nil, false
+	}
+
+	return &throttledResponseWriter{w, api_.downloads.Writer(r.Context(), w)}, release, true
+}
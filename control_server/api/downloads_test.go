@@ -0,0 +1,181 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/downloads"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_DownloadQueue(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "downloads")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	// New images get their directory in BAAS_DISK_PATH
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "download-image"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(0), []byte("disk"), 0644))
+
+	conf := config.Default()
+	conf.DownloadMaxActive = 1
+	conf.DownloadMaxQueued = 1
+	api := NewAPI(store, diskpath, conf)
+
+	download := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/image/download-image/0", nil)
+		req.Header.Add("type", "system")
+		req = mux.SetURLVars(req, map[string]string{"uuid": "download-image", "version": "0"})
+		api.DownloadImage(resp, req)
+		return resp
+	}
+
+	resp := download()
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "disk", resp.Body.String())
+
+	// With one download streaming and another one waiting, the next one is told to come back later
+	release, err := api.downloads.Acquire(context.Background(), downloads.Bulk)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _, _ = api.downloads.Acquire(ctx, downloads.Bulk) }()
+	for i := 0; i < 100 && api.downloads.Stats().Queued == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp = download()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "10", resp.Header().Get("Retry-After"))
+
+	cancel()
+	release()
+}
+
+func TestApi_DownloadConditional(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "downloads")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "cached-image",
+		DiskCompressionStrategy: images.DiskCompressionStrategyNone}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(0), []byte("disk"), 0644))
+	sum := sha256.Sum256([]byte("disk"))
+	checksum := hex.EncodeToString(sum[:])
+	assert.NoError(t, store.SetVersionChecksum("cached-image", 0, checksum))
+
+	conf := config.Default()
+	conf.DownloadMaxActive = 1
+	conf.DownloadMaxQueued = 1
+	s := newTestServer(t, store, diskpath, conf)
+
+	// Descriptions and the versions the client holds do not wait for a turn, even when the queue is full
+	release, err := s.api.downloads.Acquire(context.Background(), downloads.Bulk)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _, _ = s.api.downloads.Acquire(ctx, downloads.Bulk) }()
+	for i := 0; i < 100 && s.api.downloads.Stats().Queued == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := s.request(http.MethodHead, "/image/cached-image/0", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Body.String())
+	assert.Equal(t, "4", resp.Header().Get("Content-Length"))
+	assert.Equal(t, `"`+checksum+`"`, resp.Header().Get("ETag"))
+	assert.NotEmpty(t, resp.Header().Get("Last-Modified"))
+	assert.Equal(t, "none", resp.Header().Get("X-BAAS-Compression"))
+	assert.Equal(t, "true", resp.Header().Get("X-BAAS-Sparse"))
+
+	resp = s.requestWith(http.Header{"If-None-Match": {`"` + checksum + `"`}}, http.MethodGet, "/image/cached-image/0", "")
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	assert.Empty(t, resp.Body.String())
+	assert.Equal(t, `"`+checksum+`"`, resp.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusServiceUnavailable, s.requestWith(http.Header{"If-None-Match": {`"stale"`}}, http.MethodGet,
+		"/image/cached-image/0", "").Code)
+	assert.Equal(t, 1, s.api.downloads.Stats().Active)
+
+	cancel()
+	release()
+
+	resp = s.requestWith(http.Header{"If-None-Match": {`"stale", W/"other"`}}, http.MethodGet, "/image/cached-image/0", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "disk", resp.Body.String())
+	assert.Equal(t, `"`+checksum+`"`, resp.Header().Get("ETag"))
+
+	// Versions the image does not have are not described either
+	resp = s.request(http.MethodHead, "/image/cached-image/7", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestApi_DownloadCache(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "downloads")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "lab-image"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(0), []byte("kernel"), 0644))
+
+	conf := config.Default()
+	conf.DownloadCacheDir = diskpath + "/cache"
+	s := newTestServer(t, store, diskpath, conf)
+
+	// The first download fills the cache, the next ones are served from it and do not see the storage change
+	resp := s.request(http.MethodGet, "/image/lab-image/0", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "kernel", resp.Body.String())
+
+	f, err := os.OpenFile(image.VersionFile(0), os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("K"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	resp = s.request(http.MethodGet, "/image/lab-image/0", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "kernel", resp.Body.String())
+	resp = s.requestWith(http.Header{"Range": {"bytes=3-"}}, http.MethodGet, "/image/lab-image/0", "")
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "nel", resp.Body.String())
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	log "github.com/sirupsen/logrus"
+)
+
+// isDryRun reports whether a request only asks what it would change
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// writePlan answers a dry run with the changes the request would have made
+func writePlan(w http.ResponseWriter, r *http.Request, plan *api_pkg.PlannedChanges) {
+	requestLog(r).WithFields(log.Fields{"rows": len(plan.Rows), "files": len(plan.Files), "bytes": plan.Bytes,
+		"blockers": len(plan.Blockers)}).Infof("Planned %s %s", r.Method, r.URL.Path)
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// writeBlocked refuses an operation which cannot be carried out, the plan tells what is in the way
+func writeBlocked(w http.ResponseWriter, plan *api_pkg.PlannedChanges) bool {
+	if !plan.Blocked() {
+		return false
+	}
+
+	writeJSON(w, http.StatusConflict, plan)
+	return true
+}
+
+// planLocks blocks a plan on the boots which are flashing an image (version)
+func (api_ *API) planLocks(plan *api_pkg.PlannedChanges, uuid images.ImageUUID, version *uint64) error {
+	locks, err := api_.imageLocks(uuid, version)
+	for _, lock := range locks {
+		plan.Block(fmt.Sprintf("image %s is being flashed onto machine %s", uuid, lock.MachineMAC))
+	}
+
+	return err
+}
+
+// planVersionRemoval plans removing a version of an image together with its file. Versions which queued boot
+// setups are going to flash cannot be removed.
+func (api_ *API) planVersionRemoval(plan *api_pkg.PlannedChanges, image *images.ImageModel,
+	version *images.Version) error {
+	if err := api_.planLocks(plan, image.UUID, &version.Version); err != nil {
+		return err
+	}
+
+	blockers, err := api_.versionBlockers(image, version)
+	if err != nil {
+		return err
+	}
+
+	for _, blocker := range blockers {
+		plan.Block(fmt.Sprintf("version %d of image %s is going to be flashed onto machine %s", version.Version,
+			image.UUID, blocker.MachineMAC))
+	}
+
+	plan.Row(api_pkg.PlanDelete, "version", string(image.UUID)+"/"+strconv.FormatUint(version.Version, 10))
+	plan.File(api_.versionFile(image, version.Version), version.Size)
+	return nil
+}
+
+// planImageRemoval plans removing an image, either to the trash or for good together with its versions and files
+func (api_ *API) planImageRemoval(plan *api_pkg.PlannedChanges, image *images.ImageModel, purge bool) error {
+	if err := api_.planLocks(plan, image.UUID, nil); err != nil {
+		return err
+	}
+
+	// The webhooks go as soon as the image is moved to the trash
+	webhooks, err := api_.store.GetImageWebhooks(image.UUID)
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		plan.Row(api_pkg.PlanDelete, "image_webhook", strconv.FormatUint(uint64(webhook.ID), 10))
+	}
+
+	if !purge {
+		plan.Row(api_pkg.PlanTrash, "image", string(image.UUID))
+		return nil
+	}
+
+	plan.Row(api_pkg.PlanDelete, "image", string(image.UUID))
+	for _, version := range image.Versions {
+		plan.Row(api_pkg.PlanDelete, "version", string(image.UUID)+"/"+strconv.FormatUint(version.Version, 10))
+		plan.File(api_.versionFile(image, version.Version), version.Size)
+	}
+
+	return nil
+}
+
+// planUserRemoval plans removing a user, which takes everything the user owns along with it: the images in and
+// outside the trash with their files, the image setups, the metadata templates, the linked identities, the SSH keys
+// and the overridden limits.
+func (api_ *API) planUserRemoval(plan *api_pkg.PlannedChanges, username string) error {
+	plan.Row(api_pkg.PlanDelete, "user", username)
+
+	owned, err := api_.store.GetImagesByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	trashed, err := api_.store.GetTrashedImages(username)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range append(owned, trashed...) {
+		image := image
+		if err = api_.planImageRemoval(plan, &image, true); err != nil {
+			return err
+		}
+	}
+
+	setups, err := api_.store.GetImageSetups(username)
+	if err != nil {
+		return err
+	}
+
+	for _, setup := range *setups {
+		plan.Row(api_pkg.PlanDelete, "image_setup", string(setup.UUID))
+	}
+
+	templates, err := api_.store.GetMetadataTemplates(username)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range templates {
+		plan.Row(api_pkg.PlanDelete, "metadata_template", template.Name)
+	}
+
+	bootTemplates, err := api_.store.GetBootTemplates(username)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range bootTemplates {
+		plan.Row(api_pkg.PlanDelete, "boot_template", template.Name)
+	}
+
+	identities, err := api_.store.GetIdentitiesByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	for _, identity := range identities {
+		plan.Row(api_pkg.PlanDelete, "identity", fmt.Sprintf("%s/%s", identity.Provider, identity.ProviderID))
+	}
+
+	keys, err := api_.store.GetSSHKeys(username)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		plan.Row(api_pkg.PlanDelete, "ssh_key", key.Fingerprint)
+	}
+
+	overrides, err := api_.store.GetLimitOverrides(username)
+	if err != nil {
+		return err
+	}
+
+	if overrides.StorageBytes != nil || overrides.MaxImages != nil || overrides.MaxVersions != nil ||
+		overrides.MaxQueuedBoots != nil || overrides.MaxActiveBoots != nil || overrides.MaxWebhooks != nil {
+		plan.Row(api_pkg.PlanDelete, "limit_overrides", username)
+	}
+
+	return nil
+}
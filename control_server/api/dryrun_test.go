@@ -0,0 +1,143 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_DryRun(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "dryrun")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "alice", Email: "alice@example.com",
+		Role: user.User}))
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+
+	for _, uuid := range []images.ImageUUID{"disk", "old"} {
+		assert.NoError(t, store.CreateImage(&images.ImageModel{Name: string(uuid), Username: "alice", UUID: uuid}))
+		assert.NoError(t, os.Mkdir(filepath.Join(diskpath, string(uuid)), 0755))
+	}
+
+	for version, size := range map[uint64]uint64{1: 100, 2: 200} {
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: version, ImageModelUUID: "disk"}))
+		assert.NoError(t, store.SetVersionSize("disk", version, size))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(diskpath, "disk", fmt.Sprintf("%d.img", version)),
+			make([]byte, size), 0644))
+	}
+
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "old"}))
+	assert.NoError(t, store.SetVersionSize("old", 1, 50))
+	old, err := store.GetImageByUUID("old")
+	assert.NoError(t, err)
+	assert.NoError(t, store.TrashImage(old))
+
+	// A boot queued on a machine is going to flash the first version
+	disk, err := store.GetImageByUUID("disk")
+	assert.NoError(t, err)
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "alice"}
+	assert.NoError(t, store.CreateImageSetup("alice", &setup))
+	store.AddImageToImageSetup(&setup, disk, *disk.FindVersion(1), false)
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"},
+		Architecture: machinemodel.X86_64}))
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "abc", SetupUUID: "setup"}))
+
+	assert.NoError(t, store.CreateMetadataTemplate(&images.MetadataTemplate{Name: "lab", Username: "alice"}))
+	maxImages := uint(3)
+	assert.NoError(t, store.SetLimitOverrides(&user.LimitOverrides{Username: "alice", MaxImages: &maxImages}))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	// Removing a user needs the session of an administrator, the images only let the system in
+	request := func(uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, uri, nil)
+		req.Header.Add("type", "system")
+		s.login(req, admin)
+		return s.serve(req)
+	}
+
+	plan := func(uri string) api_pkg.PlannedChanges {
+		resp := request(uri)
+		assert.Equal(t, http.StatusOK, resp.Code, uri)
+
+		var planned api_pkg.PlannedChanges
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&planned))
+		assert.True(t, planned.DryRun)
+		return planned
+	}
+
+	version := func(uuid string, n int) api_pkg.PlannedRow {
+		return api_pkg.PlannedRow{Action: api_pkg.PlanDelete, Kind: "version", Key: fmt.Sprintf("%s/%d", uuid, n)}
+	}
+
+	planned := plan("/image/disk/1?dry_run=true")
+	assert.Equal(t, []api_pkg.PlannedRow{version("disk", 1)}, planned.Rows)
+	assert.Equal(t, []string{filepath.Join(diskpath, "disk", "1.img")}, planned.Files)
+	assert.Equal(t, uint64(100), planned.Bytes)
+	assert.Equal(t, []string{"version 1 of image disk is going to be flashed onto machine abc"}, planned.Blockers)
+
+	planned = plan("/image/disk/2?dry_run=true")
+	assert.Empty(t, planned.Blockers)
+	assert.Equal(t, uint64(200), planned.Bytes)
+
+	// Every image starts with an empty version 0, removing the image removes it as well
+	// Moving an image to the trash frees nothing
+	planned = plan("/image/disk?dry_run=true")
+	assert.Equal(t, []api_pkg.PlannedRow{{Action: api_pkg.PlanTrash, Kind: "image", Key: "disk"}}, planned.Rows)
+	assert.Empty(t, planned.Files)
+
+	planned = plan("/image/disk?purge=true&dry_run=true")
+	assert.ElementsMatch(t, []api_pkg.PlannedRow{{Action: api_pkg.PlanDelete, Kind: "image", Key: "disk"},
+		version("disk", 0), version("disk", 1), version("disk", 2)}, planned.Rows)
+	assert.Equal(t, uint64(300), planned.Bytes)
+
+	// Removing a user takes everything they own along, the trash included
+	planned = plan("/user/alice?dry_run=true")
+	assert.ElementsMatch(t, []api_pkg.PlannedRow{
+		{Action: api_pkg.PlanDelete, Kind: "user", Key: "alice"},
+		{Action: api_pkg.PlanDelete, Kind: "image", Key: "disk"},
+		{Action: api_pkg.PlanDelete, Kind: "image", Key: "old"},
+		version("disk", 0), version("disk", 1), version("disk", 2), version("old", 0), version("old", 1),
+		{Action: api_pkg.PlanDelete, Kind: "image_setup", Key: "setup"},
+		{Action: api_pkg.PlanDelete, Kind: "metadata_template", Key: "lab"},
+		{Action: api_pkg.PlanDelete, Kind: "limit_overrides", Key: "alice"},
+	}, planned.Rows)
+	assert.Len(t, planned.Files, 5)
+	assert.Equal(t, uint64(350), planned.Bytes)
+
+	// Nothing was touched
+	_, err = store.GetUserByUsername("alice")
+	assert.NoError(t, err)
+	disk, err = store.GetImageByUUID("disk")
+	assert.NoError(t, err)
+	assert.Len(t, disk.Versions, 3)
+	assert.FileExists(t, filepath.Join(diskpath, "disk", "1.img"))
+
+	assert.Equal(t, http.StatusNoContent, request("/user/alice").Code)
+
+	_, err = store.GetUserByUsername("alice")
+	assert.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(diskpath, "disk"))
+	assert.NoDirExists(t, filepath.Join(diskpath, "old"))
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// bootPassphraseBytes is the number of random bytes in the passphrase of an encrypted boot
+const bootPassphraseBytes = 32
+
+// checkEncryption checks whether the images of a boot setup can be encrypted as it asks, it answers the request
+// when they cannot
+func checkEncryption(w http.ResponseWriter, bootSetup *images.BootSetup) bool {
+	if !bootSetup.Encrypt {
+		if bootSetup.KeepEncrypted {
+			http.Error(w, "keep_encrypted only applies to encrypted boots", http.StatusBadRequest)
+			return false
+		}
+
+		return true
+	}
+
+	// The passphrases are sealed in the database, they are not stored in the clear
+	if !secrets.Enabled() {
+		http.Error(w, "Encrypted boots need a SecretKey or SecretKeyFile, neither is configured", http.StatusBadRequest)
+		return false
+	}
+
+	if bootSetup.BootMode == images.BootOverlay || bootSetup.BootMode == images.BootDiskless {
+		http.Error(w, "Overlay and diskless boots cannot be encrypted", http.StatusBadRequest)
+		return false
+	}
+
+	if bootSetup.KeepEncrypted && !bootSetup.Update {
+		http.Error(w, "keep_encrypted only applies to boots which upload their changes", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// newBootPassphrase makes the random passphrase of an encrypted boot
+func newBootPassphrase() (string, error) {
+	b := make([]byte, bootPassphraseBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// encryptBoot makes the key of a boot which was just claimed and adds it to the boot setup handed out. Only the
+// images of the setup are encrypted, not the machine image which is added to it afterwards.
+func (api_ *API) encryptBoot(boot *images.BootHistory, bootSetup *images.BootSetup, setup *images.ImageSetup) error {
+	passphrase, err := newBootPassphrase()
+	if err != nil {
+		return err
+	}
+
+	err = api_.store.AddBootKey(&images.BootKey{
+		BootHistoryID: boot.ID,
+		Passphrase:    secrets.NewSecret(passphrase),
+		KeepEncrypted: bootSetup.KeepEncrypted,
+	})
+	if err != nil {
+		return err
+	}
+
+	encryption := &images.BootEncryption{
+		BootID:        boot.ID,
+		Passphrase:    passphrase,
+		KeepEncrypted: bootSetup.KeepEncrypted,
+	}
+	for _, frozen := range setup.Images {
+		encryption.Images = append(encryption.Images, frozen.Image.UUID)
+	}
+
+	setup.Encryption = encryption
+	return nil
+}
+
+// uploadBootKey finds the key of the boot whose encrypted disk is uploaded, as named by the X-BAAS-Encrypted-Boot
+// header. It answers the request when the key cannot be used, uploads without the header have no key.
+func (api_ *API) uploadBootKey(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	header := r.Header.Get("X-BAAS-Encrypted-Boot")
+	if header == "" {
+		return 0, true
+	}
+
+	if !api_.isMachine(r) {
+		http.Error(w, "only the management OS uploads encrypted disks", http.StatusForbidden)
+		return 0, false
+	}
+
+	bootID, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		http.Error(w, "X-BAAS-Encrypted-Boot must be the ID of a boot", http.StatusBadRequest)
+		return 0, false
+	}
+
+	key, err := api_.storeFor(r).GetBootKey(uint(bootID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, fmt.Sprintf("boot %d was not encrypted", bootID), http.StatusBadRequest)
+		return 0, false
+	} else if ErrorWrite(w, err, "Cannot fetch the key of the boot") != nil {
+		return 0, false
+	}
+
+	if !key.KeepEncrypted {
+		http.Error(w, fmt.Sprintf("boot %d decrypts its disks for the upload", bootID), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return key.ID, true
+}
+
+// bootKey is the passphrase of an encrypted boot, as it is handed out for the upload
+type bootKey struct {
+	BootID     uint
+	Passphrase string
+}
+
+// ReleaseBootKey hands out the passphrase of an encrypted boot to the management OS, which decrypts the disk to
+// upload the changes after the boot. It is handed out once, to the machine of the boot, and never for the boots
+// which upload their disks encrypted.
+// Example request: POST /machine/52:54:00:d9:71:93/boot/12/key
+// Example response: {"BootID": 12, "Passphrase": "kq3m1Xv..."}
+func (api_ *API) ReleaseBootKey(w http.ResponseWriter, r *http.Request) {
+	if !api_.isMachine(r) {
+		http.Error(w, "only the management OS can fetch the key of a boot", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid boot id", http.StatusBadRequest)
+		return
+	}
+
+	boot, err := api_.storeFor(r).GetBootHistoryEntry(vars["mac"], uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "boot not found", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the boot") != nil {
+		return
+	}
+
+	key, err := api_.storeFor(r).ReleaseBootKey(boot.ID)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		http.Error(w, "the boot was not encrypted", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrKeyReleased) && key.KeepEncrypted:
+		http.Error(w, "the boot uploads its disks encrypted, its key is not handed out", http.StatusConflict)
+		return
+	case errors.Is(err, database.ErrKeyReleased):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case ErrorWrite(w, err, "Cannot fetch the key of the boot") != nil:
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"audit":   "boot-key-released",
+		"machine": boot.MachineMAC,
+		"boot":    boot.ID,
+	}).Infof("Handed out the key of boot %d to decrypt its disks for the upload", boot.ID)
+
+	writeJSON(w, http.StatusOK, bootKey{BootID: boot.ID, Passphrase: key.Passphrase.Reveal()})
+}
+
+// RegisterEncryptionHandlers sets the metadata for the route which hands out the keys of encrypted boots
+func (api_ *API) RegisterEncryptionHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/{id}/key",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.ReleaseBootKey,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Hands out the key of an encrypted boot once, to decrypt its disks for the upload",
+	})
+}
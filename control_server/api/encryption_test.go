@@ -0,0 +1,159 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_EncryptedBoots(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "encrypted-boots")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac}))
+	machineImage, err := images.CreateMachineImageModel(mac)
+	assert.NoError(t, err)
+	assert.NoError(t, store.(sqlite.Store).Session(&gorm.Session{SkipHooks: true}).Create(machineImage).Error)
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "image"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+	assert.NoError(t, os.MkdirAll(filepath.Join(diskpath, "image"), os.ModePerm))
+
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}
+	assert.NoError(t, store.CreateImageSetup("test", &setup))
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(1), true)
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	claim := func() *images.ImageSetup {
+		resp := s.request(http.MethodGet, "/machine/abc/boot", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var claimed images.ImageSetup
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&claimed))
+		return &claimed
+	}
+
+	// The passphrases are sealed, without a key nothing is encrypted
+	encrypted := `{"SetupUUID": "setup", "Update": true, "encrypt": true}`
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/machine/abc/boot", encrypted).Code)
+
+	key, err := secrets.GenerateKey("boot")
+	assert.NoError(t, err)
+	ring, err := secrets.NewKeyring(key)
+	assert.NoError(t, err)
+	secrets.Use(ring)
+	defer secrets.Use(nil)
+
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/machine/abc/boot",
+		`{"SetupUUID": "setup", "BootMode": "overlay", "encrypt": true}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/machine/abc/boot",
+		`{"SetupUUID": "setup", "encrypt": true, "keep_encrypted": true}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/machine/abc/boot",
+		`{"SetupUUID": "setup", "Update": true, "keep_encrypted": true}`).Code)
+
+	// The passphrase is handed out with the boot setup and stored sealed
+	assert.Equal(t, http.StatusOK, s.requestAs(test, http.MethodPost, "/machine/abc/boot", encrypted).Code)
+	claimed := claim()
+	assert.NotNil(t, claimed.Encryption)
+	assert.NotEmpty(t, claimed.Encryption.Passphrase)
+	assert.Equal(t, []images.ImageUUID{"image"}, claimed.Encryption.Images)
+	assert.False(t, claimed.Encryption.KeepEncrypted)
+
+	bootKey, err := store.GetBootKey(claimed.Encryption.BootID)
+	assert.NoError(t, err)
+	assert.Equal(t, claimed.Encryption.Passphrase, bootKey.Passphrase.Reveal())
+
+	var column string
+	assert.NoError(t, store.(sqlite.Store).Raw("SELECT passphrase FROM boot_keys WHERE id = ?", bootKey.ID).
+		Scan(&column).Error)
+	assert.True(t, secrets.IsSealed(column))
+
+	// It is handed out once more, to the management OS, to decrypt the disks for the upload
+	keyURI := fmt.Sprintf("/machine/abc/boot/%d/key", claimed.Encryption.BootID)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(test, http.MethodPost, keyURI, "").Code)
+
+	resp := s.request(http.MethodPost, keyURI, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var released map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&released))
+	assert.Equal(t, claimed.Encryption.Passphrase, released["Passphrase"])
+
+	assert.Equal(t, http.StatusGone, s.request(http.MethodPost, keyURI, "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodPost, "/machine/abc/boot/999/key", "").Code)
+
+	// Boots which keep their disks encrypted never hand out the key, the version records it instead
+	assert.Equal(t, http.StatusOK, s.requestAs(test, http.MethodPost, "/machine/abc/boot",
+		`{"SetupUUID": "setup", "Update": true, "encrypt": true, "keep_encrypted": true}`).Code)
+	kept := claim()
+	assert.True(t, kept.Encryption.KeepEncrypted)
+
+	keptURI := fmt.Sprintf("/machine/abc/boot/%d/key", kept.Encryption.BootID)
+	assert.Equal(t, http.StatusConflict, s.request(http.MethodPost, keptURI, "").Code)
+
+	upload := func(bootID uint, system bool) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "image.img")
+		_, _ = part.Write([]byte("LUKS\xba\xbe"))
+		_ = form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/image/image", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-BAAS-NewVersion", "true")
+		req.Header.Set("X-BAAS-Encrypted-Boot", fmt.Sprint(bootID))
+		if system {
+			req.Header.Set("type", "system")
+		} else {
+			s.login(req, test)
+		}
+		return s.serve(req)
+	}
+
+	assert.Equal(t, http.StatusForbidden, upload(kept.Encryption.BootID, false).Code)
+	assert.Equal(t, http.StatusBadRequest, upload(claimed.Encryption.BootID, true).Code)
+	assert.Equal(t, http.StatusOK, upload(kept.Encryption.BootID, true).Code)
+
+	keptKey, err := store.GetBootKey(kept.Encryption.BootID)
+	assert.NoError(t, err)
+	stored, err = store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, keptKey.ID, stored.Versions[len(stored.Versions)-1].BootKeyID)
+
+	// The keys go with the history of the boots
+	machine, err := store.GetMachineByMac(mac)
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteMachine(machine))
+	_, err = store.GetBootKey(kept.Encryption.BootID)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
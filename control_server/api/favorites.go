@@ -0,0 +1,246 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"gorm.io/gorm"
+)
+
+// sortRelevance orders listings of images by what the user is most likely to boot
+const sortRelevance = "relevance"
+
+// imageOrder is how a listing of images is sorted, either like other listings or by relevance to the user
+type imageOrder struct {
+	listOrder
+	Relevance bool
+}
+
+// parseImageOrder reads how a listing of images is sorted, ?sort=relevance besides the orders of parseListOrder. On
+// invalid parameters a 400 is written and an error returned.
+func parseImageOrder(w http.ResponseWriter, r *http.Request) (imageOrder, error) {
+	if r.URL.Query().Get("sort") == sortRelevance {
+		return imageOrder{Relevance: true}, nil
+	}
+
+	order, err := parseListOrder(w, r)
+	return imageOrder{listOrder: order}, err
+}
+
+// writeImages answers with a listing of images, marking the favorites and the last boot of the user of the session,
+// and sorted as the request asked
+func (api_ *API) writeImages(w http.ResponseWriter, r *http.Request, order imageOrder, found []images.ImageModel) {
+	listing := types.NewImages(found)
+	if ErrorWrite(w, api_.markFavorites(api_.sessionUsername(r), listing), "Cannot find the favorite images") != nil {
+		return
+	}
+
+	if order.Relevance {
+		sortByRelevance(listing)
+	} else {
+		order.apply(listing, func(i int) (time.Time, time.Time) {
+			return listing[i].CreatedAt, listing[i].UpdatedAt
+		})
+	}
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// markFavorites marks the images in a listing which the user marked as a favorite, and when they last booted them.
+// Requests without a user have no favorites.
+func (api_ *API) markFavorites(username string, listing []types.Image) error {
+	if username == "" {
+		return nil
+	}
+
+	favorites, err := api_.store.GetFavoriteImages(username)
+	if err != nil {
+		return err
+	}
+
+	lastBooted, err := api_.store.GetImagesLastBooted(username)
+	if err != nil {
+		return err
+	}
+
+	favorite := map[images.ImageUUID]bool{}
+	for _, image := range favorites {
+		favorite[image.UUID] = true
+	}
+
+	for i := range listing {
+		listing[i].Favorite = favorite[listing[i].UUID]
+		if at, ok := lastBooted[listing[i].UUID]; ok {
+			listing[i].LastUsedByMe = &at
+		}
+	}
+
+	return nil
+}
+
+// sortByRelevance puts the favorites first and the other images the user booted after them, both starting with
+// the one booted most recently. The rest follows in alphabetical order.
+func sortByRelevance(listing []types.Image) {
+	sort.SliceStable(listing, func(i, j int) bool {
+		a, b := &listing[i], &listing[j]
+		if a.Favorite != b.Favorite {
+			return a.Favorite
+		}
+
+		if (a.LastUsedByMe == nil) != (b.LastUsedByMe == nil) {
+			return a.LastUsedByMe != nil
+		}
+
+		if a.LastUsedByMe != nil && !a.LastUsedByMe.Equal(*b.LastUsedByMe) {
+			return a.LastUsedByMe.After(*b.LastUsedByMe)
+		}
+
+		nameA, nameB := strings.ToLower(a.Name), strings.ToLower(b.Name)
+		if nameA != nameB {
+			return nameA < nameB
+		}
+
+		return a.UUID < b.UUID
+	})
+}
+
+// mayUseImage checks whether the user behind a request can boot an image, which are their own images and the public
+// ones. Administrators and the system can use every image.
+func (api_ *API) mayUseImage(r *http.Request, image *images.ImageModel) bool {
+	principal := api_.principal(r)
+	return principal.Kind == PrincipalMachine || authz.Image(principal.subject(), image, authz.Boot).Allowed
+}
+
+// GetFavoriteImages lists the favorite images of the logged-in user. Images they can no longer use, since they were
+// made private or moved to the trash, are left out. It is sorted like the other listings of images.
+// Example request: GET /user/me/favorites?sort=relevance
+// Example response: [{"Name": "Gentoo", "UUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Favorite": true,
+//
+//	"LastUsedByMe": "2022-03-04T10:11:12Z", ...}]
+func (api_ *API) GetFavoriteImages(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	order, err := parseImageOrder(w, r)
+	if err != nil {
+		return
+	}
+
+	favorites, err := api_.storeFor(r).GetFavoriteImages(username)
+	if ErrorWrite(w, err, "Cannot find the favorite images") != nil {
+		return
+	}
+
+	usable := []images.ImageModel{}
+	for i := range favorites {
+		if api_.mayUseImage(r, &favorites[i]) {
+			usable = append(usable, favorites[i])
+		}
+	}
+
+	api_.writeImages(w, r, order, usable)
+}
+
+// AddFavoriteImage marks an image as a favorite of the logged-in user, who has to be able to use it. Marking it again
+// changes nothing.
+// Example request: PUT /user/me/favorites/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf
+// Example response: 204 No Content
+func (api_ *API) AddFavoriteImage(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := GetTag("image_uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	// Images the user cannot use are not found, whether they exist is none of their business
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uuid))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !api_.mayUseImage(r, image)) {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the image") != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).AddFavoriteImage(username, image.UUID), "Cannot mark the favorite") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveFavoriteImage unmarks an image as a favorite of the logged-in user, images which are not a favorite are
+// left alone
+// Example request: DELETE /user/me/favorites/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf
+// Example response: 204 No Content
+func (api_ *API) RemoveFavoriteImage(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := GetTag("image_uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	err = api_.storeFor(r).RemoveFavoriteImage(username, images.ImageUUID(uuid))
+	if ErrorWrite(w, err, "Cannot unmark the favorite") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterFavoriteHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterFavoriteHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/favorites",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetFavoriteImages,
+		Method:      http.MethodGet,
+		Description: "Lists the favorite images of the user who is currently logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/favorites/{image_uuid}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.AddFavoriteImage,
+		Method:      http.MethodPut,
+		Schema:      schemaNone,
+		Description: "Marks an image as a favorite of the user who is currently logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/favorites/{image_uuid}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.RemoveFavoriteImage,
+		Method:      http.MethodDelete,
+		Description: "Unmarks an image as a favorite of the user who is currently logged in",
+	})
+}
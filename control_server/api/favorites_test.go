@@ -0,0 +1,110 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Favorites(t *testing.T) {
+	store := newTestStore(t)
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "other", Email: "other@example.com",
+		Role: user.User}))
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+
+	for _, image := range []images.ImageModel{
+		{Name: "Zeta", Username: "test", UUID: "zeta"},
+		{Name: "alpha", Username: "test", UUID: "alpha"},
+		{Name: "Beta", Username: "test", UUID: "beta"},
+		{Name: "delta", Username: "test", UUID: "delta"},
+		{Name: "Echo", Username: "test", UUID: "echo"},
+		{Name: "shared", Username: "other", UUID: "shared", Public: true},
+		{Name: "private", Username: "other", UUID: "private"},
+	} {
+		image := image
+		assert.NoError(t, store.CreateImage(&image))
+	}
+
+	// Beta was booted before alpha
+	assert.NoError(t, store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", UUID: "setup",
+		Username: "test"}))
+	for _, uuid := range []images.ImageUUID{"beta", "alpha"} {
+		assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup",
+			ResolvedVersions: images.ResolvedVersions{{ImageUUID: uuid}}}))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	list := func(uri string) []types.Image {
+		resp := s.requestAs(test, http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var listing []types.Image
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listing))
+		return listing
+	}
+	names := func(listing []types.Image) []string {
+		found := []string{}
+		for _, image := range listing {
+			found = append(found, image.Name)
+		}
+		return found
+	}
+
+	// Images of others can only be marked when they are public, marking twice is fine
+	assert.Equal(t, http.StatusNoContent, s.requestAs(test, http.MethodPut, "/user/me/favorites/zeta", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestAs(test, http.MethodPut, "/user/me/favorites/zeta", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestAs(test, http.MethodPut, "/user/me/favorites/shared", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(test, http.MethodPut, "/user/me/favorites/private", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(test, http.MethodPut, "/user/me/favorites/missing", "").Code)
+
+	// Favorites come first, then the images which were booted and then the rest in alphabetical order
+	listing := list("/user/test/images?sort=relevance")
+	assert.Equal(t, []string{"Zeta", "alpha", "Beta", "delta", "Echo"}, names(listing))
+	assert.True(t, listing[0].Favorite)
+	assert.Nil(t, listing[0].LastUsedByMe)
+	assert.False(t, listing[1].Favorite)
+	assert.NotNil(t, listing[1].LastUsedByMe)
+
+	listing = list("/images/public")
+	assert.Len(t, listing, 1)
+	assert.True(t, listing[0].Favorite)
+
+	// Favorites which the user can no longer use are left out
+	assert.Equal(t, []string{"Zeta", "shared"}, names(list("/user/me/favorites")))
+	shared, err := store.GetImageByUUID("shared")
+	assert.NoError(t, err)
+	shared.Public = false
+	assert.NoError(t, store.UpdateImage(shared))
+	assert.Equal(t, []string{"Zeta"}, names(list("/user/me/favorites")))
+
+	assert.Equal(t, http.StatusNoContent, s.requestAs(test, http.MethodDelete, "/user/me/favorites/zeta", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestAs(test, http.MethodDelete, "/user/me/favorites/zeta", "").Code)
+	assert.Empty(t, list("/user/me/favorites"))
+	assert.Equal(t, []string{"alpha", "Beta", "delta", "Echo", "Zeta"}, names(list("/user/test/images?sort=relevance")))
+
+	// Favorites go together with their image
+	alpha, err := store.GetImageByUUID("alpha")
+	assert.NoError(t, err)
+	assert.NoError(t, store.AddFavoriteImage("test", alpha.UUID))
+	assert.NoError(t, store.DeleteImage(alpha))
+	dangling, err := store.CheckReferences(false)
+	assert.NoError(t, err)
+	assert.Empty(t, dangling)
+	assert.Empty(t, list("/user/me/favorites"))
+}
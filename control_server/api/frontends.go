@@ -0,0 +1,180 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/gorilla/securecookie"
+	log "github.com/sirupsen/logrus"
+)
+
+// oauthStateName is what the OAuth states are signed as, so a session cookie cannot pass for one
+const oauthStateName = "oauth-state"
+
+// defaultFrontendName names the frontend of LoginRedirect, when no Frontends are configured
+const defaultFrontendName = "default"
+
+// frontend is a web frontend which uses the control server, see config.Frontends
+type frontend struct {
+	Name string
+	// Origin is the scheme and host of the frontend in lower case, as browsers send it in the Origin header
+	Origin       string
+	RedirectPath string
+}
+
+// landing is the page logins return to when they did not ask for one
+func (f frontend) landing() string {
+	return f.Origin + f.RedirectPath
+}
+
+// contains checks whether a page is served by the frontend, below its RedirectPath
+func (f frontend) contains(u *url.URL) bool {
+	return originOf(u) == f.Origin && withinPath(u, f.RedirectPath)
+}
+
+// frontends are the web frontends of the configuration, fallback is the one for every other origin
+type frontends struct {
+	byName   map[string]frontend
+	fallback frontend
+}
+
+// newFrontends reads the frontends of the configuration. Configurations without them have a single one, whose
+// landing is LoginRedirect.
+func newFrontends(conf *config.Config) frontends {
+	f := frontends{byName: map[string]frontend{}}
+	for name, configured := range conf.Frontends {
+		origin, err := url.Parse(configured.Origin)
+		if err != nil {
+			log.Errorf("Ignoring the frontend %s with the invalid origin %q", name, configured.Origin)
+			continue
+		}
+
+		f.byName[name] = frontend{Name: name, Origin: originOf(origin), RedirectPath: configured.RedirectPath}
+	}
+
+	if fallback, ok := f.byName[conf.DefaultFrontend]; ok {
+		f.fallback = fallback
+		return f
+	}
+
+	f.fallback = frontend{Name: defaultFrontendName}
+	if redirect, err := url.Parse(conf.LoginRedirect); err == nil {
+		f.fallback.Origin = originOf(redirect)
+		f.fallback.RedirectPath = redirect.Path
+	}
+	f.byName[defaultFrontendName] = f.fallback
+	return f
+}
+
+// forPage finds the frontend which serves a page, or else one on its origin
+func (f frontends) forPage(u *url.URL) (frontend, bool) {
+	names := make([]string, 0, len(f.byName))
+	for name := range f.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	origin := originOf(u)
+	found := false
+	var match frontend
+	for _, name := range names {
+		candidate := f.byName[name]
+		if candidate.contains(u) {
+			return candidate, true
+		}
+		if !found && origin != "" && candidate.Origin == origin {
+			match, found = candidate, true
+		}
+	}
+
+	return match, found
+}
+
+// allows checks whether a browser on an origin may call the API, which only the frontends may
+func (f frontends) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, candidate := range f.byName {
+		if candidate.Origin != "" && candidate.Origin == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originOf is the origin of a URL as browsers send it, the scheme and host in lower case
+func originOf(u *url.URL) string {
+	if u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// withinPath checks whether the path of a URL is prefix or below it. Cleaning the path first stops /app/../admin
+// from escaping /app.
+func withinPath(u *url.URL, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	clean := path.Clean("/" + u.Path)
+	return clean == prefix || strings.HasPrefix(clean, prefix+"/")
+}
+
+var errUnknownFrontend = errors.New("unknown frontend")
+
+// loginFrontend picks the frontend a login returns to: the one named by ?env=, otherwise the one serving the page
+// in ?redirect=. Logins from any other origin return to the default frontend.
+func (api_ *API) loginFrontend(r *http.Request) (frontend, error) {
+	if name := r.URL.Query().Get("env"); name != "" {
+		chosen, ok := api_.frontends.byName[name]
+		if !ok {
+			return frontend{}, errUnknownFrontend
+		}
+		return chosen, nil
+	}
+
+	if target, err := url.Parse(r.URL.Query().Get("redirect")); err == nil {
+		if chosen, ok := api_.frontends.forPage(target); ok {
+			return chosen, nil
+		}
+	}
+
+	return api_.frontends.fallback, nil
+}
+
+// oauthState is what the state of an OAuth flow carries to the callback
+type oauthState struct {
+	// Nonce makes every state unique, the session of the browser holds the one it started with
+	Nonce    string
+	Frontend string
+}
+
+// encodeOAuthState signs the frontend of a login into its state, so the callback does not take it from the
+// session alone
+func (api_ *API) encodeOAuthState(chosen frontend) (string, error) {
+	return securecookie.EncodeMulti(oauthStateName, oauthState{Nonce: generateRandomState(), Frontend: chosen.Name},
+		api_.session.Codecs...)
+}
+
+// decodeOAuthState checks the signature of a state and finds its frontend again. A frontend which was removed
+// from the configuration since is replaced by the default one.
+func (api_ *API) decodeOAuthState(state string) (frontend, error) {
+	var decoded oauthState
+	if err := securecookie.DecodeMulti(oauthStateName, state, &decoded, api_.session.Codecs...); err != nil {
+		return frontend{}, err
+	}
+
+	if chosen, ok := api_.frontends.byName[decoded.Frontend]; ok {
+		return chosen, nil
+	}
+
+	return api_.frontends.fallback, nil
+}
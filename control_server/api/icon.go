@@ -0,0 +1,194 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxIconDimension is the largest width and height of an icon in pixels
+const maxIconDimension = 256
+
+// iconPath is where the icon of an image is stored, next to its versions
+func (api_ *API) iconPath(image *images.ImageModel) string {
+	return api_.imageDir(image) + "/icon.png"
+}
+
+// readIcon reads and validates an uploaded icon, it answers the request itself when the icon is refused.
+func (api_ *API) readIcon(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Header.Get("Content-Type") != "image/png" {
+		http.Error(w, "icons must be uploaded as image/png", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	limit := int64(api_.config.IconMaxBytes)
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if ErrorWrite(w, err, "Cannot read the icon") != nil {
+		return nil, false
+	}
+
+	if int64(len(content)) > limit {
+		http.Error(w, fmt.Sprintf("icons can be at most %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	// Decode the whole image, the header alone says nothing about whether the rest is a valid PNG
+	icon, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		http.Error(w, "the icon is not a valid PNG image", http.StatusUnsupportedMediaType)
+		log.Warnf("Refused icon: %v", err)
+		return nil, false
+	}
+
+	if size := icon.Bounds().Size(); size.X > maxIconDimension || size.Y > maxIconDimension {
+		http.Error(w, fmt.Sprintf("icons can be at most %dx%d pixels", maxIconDimension, maxIconDimension),
+			http.StatusBadRequest)
+		return nil, false
+	}
+
+	return content, true
+}
+
+// SetImageIcon replaces the icon of an image with the PNG image in the body
+// Example request: PUT image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/icon -H "Content-Type: image/png"
+//
+//	--data-binary @icon.png
+//
+// Example response: {"Name": "Gentoo", "Icon": "/image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/icon", ...}
+func (api_ *API) SetImageIcon(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	content, ok := api_.readIcon(w, r)
+	if !ok {
+		return
+	}
+
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Write the icon next to the old one first, so the old icon stays intact when something goes wrong
+	path := api_.iconPath(image)
+	if ErrorWrite(w, ioutil.WriteFile(path+".part", content, 0644), "Cannot store the icon") != nil {
+		return
+	}
+
+	if ErrorWrite(w, os.Rename(path+".part", path), "Cannot store the icon") != nil {
+		return
+	}
+
+	image.Icon = fmt.Sprintf("/image/%s/icon", image.UUID)
+	if ErrorWrite(w, api_.storeFor(r).SetImageIcon(image.UUID, image.Icon), "Cannot store the icon") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImage(image))
+}
+
+// GetImageIcon serves the icon of an image, the icons of public images are visible to everyone
+// Example request: GET image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/icon
+func (api_ *API) GetImageIcon(w http.ResponseWriter, r *http.Request) {
+	uniqueID, err := GetTag("uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uniqueID))
+	if err != nil {
+		http.Error(w, "cannot find the image", http.StatusNotFound)
+		return
+	}
+
+	if !image.Public {
+		if image, err = api_.checkUserImage(w, r); err != nil {
+			return
+		}
+	}
+
+	if image.Icon == "" {
+		http.Error(w, "the image has no icon", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, api_.iconPath(image))
+}
+
+// DeleteImageIcon removes the icon of an image
+// Example request: DELETE image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/icon
+func (api_ *API) DeleteImageIcon(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err = os.Remove(api_.iconPath(image)); err != nil && !os.IsNotExist(err) {
+		_ = ErrorWrite(w, err, "Cannot remove the icon")
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).SetImageIcon(image.UUID, ""), "Cannot remove the icon") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterImageIconHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterImageIconHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/icon",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.SetImageIcon,
+		Method:      http.MethodPut,
+		Schema:      "icon",
+		Description: "Uploads the icon of an image",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:              "/image/{uuid}/icon",
+		Permissions:      []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:      true,
+		AnonymousAllowed: true,
+		Scope:            user.ScopeImagesRead,
+		Handler:          api_.GetImageIcon,
+		Method:           http.MethodGet,
+		Description:      "Gets the icon of an image",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/icon",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.DeleteImageIcon,
+		Method:      http.MethodDelete,
+		Description: "Removes the icon of an image",
+	})
+}
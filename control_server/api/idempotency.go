@@ -0,0 +1,205 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/idempotency"
+	log "github.com/sirupsen/logrus"
+)
+
+// idempotencyHeader carries the key under which a client retries a request
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is the longest key which is accepted
+const maxIdempotencyKey = 255
+
+// maxReplayedResponse is the largest response which is stored for replays, larger responses are not replayed
+const maxReplayedResponse = 1 << 20
+
+// idempotencyCleanupInterval is how often the keys which outlived their TTL are removed
+const idempotencyCleanupInterval = time.Hour
+
+// recordedResponse passes a response on while keeping a copy of it
+type recordedResponse struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recordedResponse) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recordedResponse) Write(b []byte) (int, error) {
+	if r.body.Len()+len(b) > maxReplayedResponse {
+		r.overflow = true
+	} else if !r.overflow {
+		r.body.Write(b)
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// hashingBody hashes the body of a request as the handler reads it
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (h *hashingBody) Read(b []byte) (int, error) {
+	n, err := h.ReadCloser.Read(b)
+	h.hash.Write(b[:n])
+	return n, err
+}
+
+// sum hashes what is left of the body and returns the hash of all of it
+func (h *hashingBody) sum() (string, error) {
+	_, err := io.Copy(ioutil.Discard, h)
+	return hex.EncodeToString(h.hash.Sum(nil)), err
+}
+
+// idempotencyTTL is how long the responses are replayed
+func (api_ *API) idempotencyTTL() time.Duration {
+	return time.Duration(api_.config.IdempotencyKeyHours) * time.Hour
+}
+
+// idempotent lets clients retry a request safely. The first request with an Idempotency-Key header is handled and
+// its response stored, repeats of it by the same user get that response again without being handled. Reusing a key
+// for another request is refused with 422. Server errors are not stored, the request may work when it is retried.
+func (api_ *API) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			http.Error(w, "The idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
+		record := &idempotency.Record{Principal: api_.requester(r), Key: key, Method: r.Method, Path: r.URL.Path}
+		reserved, err := api_.reserveIdempotencyKey(record)
+		if ErrorWrite(w, err, "Cannot look up the idempotency key") != nil {
+			return
+		}
+
+		if !reserved {
+			api_.replay(w, r, record.Principal, key)
+			return
+		}
+
+		body := &hashingBody{ReadCloser: r.Body, hash: sha256.New()}
+		r.Body = body
+		recorded := &recordedResponse{ResponseWriter: w, status: http.StatusOK}
+		next(recorded, r)
+
+		// Handlers need not read all of the body, the retries are compared against all of it
+		record.BodyHash, err = body.sum()
+		if err != nil || recorded.status >= http.StatusInternalServerError || recorded.overflow {
+			if err = api_.store.DeleteIdempotencyKey(record); err != nil {
+				requestLog(r).Errorf("Cannot release idempotency key %s: %v", key, err)
+			}
+			return
+		}
+
+		record.Status = recorded.status
+		record.ContentType = recorded.Header().Get("Content-Type")
+		record.Body = recorded.body.Bytes()
+		if err = api_.store.CompleteIdempotencyKey(record); err != nil {
+			requestLog(r).Errorf("Cannot store the response for idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+// reserveIdempotencyKey claims a key for a request, it is false when the key is in use. A key which outlived its TTL
+// but was not cleaned up yet is claimed again.
+func (api_ *API) reserveIdempotencyKey(record *idempotency.Record) (bool, error) {
+	var constraint *database.ConstraintError
+	err := api_.store.ReserveIdempotencyKey(record)
+	if !errors.As(err, &constraint) {
+		return err == nil, err
+	}
+
+	existing, err := api_.store.GetIdempotencyKey(record.Principal, record.Key)
+	if err != nil || time.Since(existing.CreatedAt) < api_.idempotencyTTL() {
+		return false, err
+	}
+
+	if err = api_.store.DeleteIdempotencyKey(existing); err != nil {
+		return false, err
+	}
+
+	err = api_.store.ReserveIdempotencyKey(record)
+	if errors.As(err, &constraint) {
+		// Another retry claimed it in the meantime
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// replay answers a retry with the stored response, provided it is the same request
+func (api_ *API) replay(w http.ResponseWriter, r *http.Request, principal string, key string) {
+	existing, err := api_.storeFor(r).GetIdempotencyKey(principal, key)
+	if ErrorWrite(w, err, "Cannot look up the idempotency key") != nil {
+		return
+	}
+
+	if !existing.Completed() {
+		http.Error(w, "A request with this idempotency key is still being handled", http.StatusConflict)
+		return
+	}
+
+	body := &hashingBody{ReadCloser: r.Body, hash: sha256.New()}
+	sum, err := body.sum()
+	if err != nil {
+		http.Error(w, "Cannot read the request", http.StatusBadRequest)
+		return
+	}
+
+	if existing.Method != r.Method || existing.Path != r.URL.Path || existing.BodyHash != sum {
+		http.Error(w, "The idempotency key was used for another request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	requestLog(r).Infof("Replaying the response to idempotency key %s", key)
+	if existing.ContentType != "" {
+		w.Header().Set("Content-Type", existing.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.Status)
+	_, _ = w.Write(existing.Body)
+}
+
+// StartIdempotencyCleanup periodically removes the idempotency keys which outlived their TTL in the background
+func StartIdempotencyCleanup(store database.Store, ttl time.Duration) {
+	go func() {
+		for {
+			removed, err := store.DeleteIdempotencyKeysBefore(time.Now().Add(-ttl))
+			if err != nil {
+				log.Errorf("clean up idempotency keys: %v", err)
+			} else if removed != 0 {
+				log.Infof("Removed %d expired idempotency keys", removed)
+			}
+
+			time.Sleep(idempotencyCleanupInterval)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/idempotency"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_IdempotencyKeys(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+	other := &user.UserModel{Username: "other", Email: "other@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(other))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	createUser := func(as *user.UserModel, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/user", bytes.NewBufferString(body))
+		req.Header.Set(idempotencyHeader, key)
+		s.login(req, as)
+		return s.serve(req)
+	}
+
+	alice := `{"Username": "alice", "Name": "Alice", "Email": "alice@example.com", "Role": "user"}`
+	first := createUser(admin, "create-alice", alice)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// The retry gets the same answer instead of a conflict with the user the first request created
+	retry := createUser(admin, "create-alice", alice)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	assert.Equal(t, http.StatusUnprocessableEntity, createUser(admin, "create-alice",
+		`{"Username": "bob", "Name": "Bob", "Email": "bob@example.com", "Role": "user"}`).Code)
+
+	// Keys belong to the user who made the request
+	resp := createUser(other, "create-alice", alice)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Empty(t, resp.Header().Get("Idempotent-Replayed"))
+
+	// Requests without a key are handled every time
+	assert.Equal(t, http.StatusConflict, createUser(admin, "", alice).Code)
+
+	// A retry while the first request is still being handled has to wait for it
+	assert.NoError(t, store.ReserveIdempotencyKey(&idempotency.Record{Principal: "admin", Key: "busy",
+		Method: http.MethodPost, Path: "/user"}))
+	assert.Equal(t, http.StatusConflict, createUser(admin, "busy", alice).Code)
+
+	// Keys which outlived their TTL are handled again, and cleaned up eventually
+	assert.NoError(t, store.(sqlite.Store).Model(&idempotency.Record{}).Where("key = ?", "create-alice").
+		Update("created_at", time.Now().Add(-25*time.Hour)).Error)
+	resp = createUser(admin, "create-alice", alice)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Empty(t, resp.Header().Get("Idempotent-Replayed"))
+
+	removed, err := store.DeleteIdempotencyKeysBefore(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), removed)
+}
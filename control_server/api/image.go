@@ -5,15 +5,25 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/baas-project/baas/control_server/authz"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/limits"
 	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
 	"github.com/baas-project/baas/pkg/model/user"
 
 	"github.com/baas-project/baas/pkg/fs"
@@ -21,47 +31,57 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// maxDescriptionLength is the size of the longest description of an image in bytes
+const maxDescriptionLength = 4096
+
 func (api_ *API) checkUserImage(w http.ResponseWriter, r *http.Request) (*images.ImageModel, error) {
-	uniqueID, err := GetTag("uuid", w, r)
-	if err != nil {
-		http.Error(w, "uri does not include UUID", http.StatusInternalServerError)
-		log.Errorf("image error: %v", err)
-		return nil, errors.New("failed to get image")
+	uniqueID, err := GetTag("uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
 	}
 
-	image, err := api_.store.GetImageByUUID(images.ImageUUID(uniqueID))
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uniqueID))
 	if err != nil {
 		http.Error(w, "cannot get image", http.StatusInternalServerError)
-		log.Errorf("could not get image: %v", err)
+		requestLog(r).Errorf("could not get image: %v", err)
 		return nil, errors.New("failed to get image")
 	}
 
-	session, _ := api_.session.Get(r, "session-name")
-	username, ok := session.Values["Username"].(string)
-
-	// TODO: Hardcoded nonesense
-	if r.Header.Get("type") == "system" {
+	principal := api_.principal(r)
+	if principal.Kind == PrincipalMachine {
 		return image, nil
 	}
 
-	if !ok || username != image.Username {
+	action := authz.Write
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		action = authz.Read
+	}
+
+	ok := principal.Kind == PrincipalUser
+	if !ok || !authz.Image(principal.subject(), image, action).Allowed {
 		http.Error(w, "user does not own this image", http.StatusForbidden)
-		log.Errorf("access denied: %v", ok)
+		requestLog(r).Errorf("access denied: %v", ok)
 		return nil, errors.New("failed to get image")
 	}
 
 	return image, nil
 }
 
+// imageConflictError is the answer to creating an image with the name of an existing image of the user
+type imageConflictError struct {
+	Error string
+	UUID  images.ImageUUID
+}
+
 // CreateImage creates an image based on a name
 // Example request: POST user/Jan/image
-// Example body: {"DiskUUID": "30DF-844C", "Name": "Fedora"}
+// Example body: {"DiskUUID": "30df844c", "Name": "Fedora"}
 // Example response: {"Name": "Fedora",
 //
 //	"Versions": [{"Version": "2021-11-01T00:11:22.38125222+01:00",
 //	              "ImageModelID": 0}],
 //	"UUID": "eed13670-5974-4c98-b044-347e1f630bc5",
-//	"DiskUUID": "30DF-844C",
+//	"DiskUUID": "30df844c",
 //	"UserModelID": 0}
 func (api_ *API) CreateImage(w http.ResponseWriter, r *http.Request) {
 	image := images.ImageModel{}
@@ -85,28 +105,67 @@ func (api_ *API) CreateImage(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		http.Error(w, "couldn't decode image model", http.StatusBadRequest)
-		log.Errorf("decode image model: %v", err)
+		requestLog(r).Errorf("decode image model: %v", err)
+		return
+	}
+
+	if err = validateImageInfo(&image); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = api_.checkCourseLabel(&image, image.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = checkArchitecture(&image); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = checkDiskUUID(&image); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if api_.checkPublishable(w, &image) != nil {
 		return
 	}
 
 	// Generate the UUID and create the entry in the database.
 	// We don't actually make an image file yet.
 	image.UUID = images.ImageUUID(uuid.New().String())
+	image.Icon = ""
+	api_.placeImage(&image)
 
 	if image.Type == "" {
 		image.Type = "base"
 	}
 
-	api_.store.CreateImage(&image)
+	if !api_.checkLimits(w, image.Username, limits.CreateImage()) {
+		return
+	}
 
-	if err != nil {
-		http.Error(w, "couldn't create image model", http.StatusInternalServerError)
-		log.Errorf("decode create model: %v", err)
+	// Names are unique per user regardless of case, the answer points to the image which is in the way
+	existing, err := api_.storeFor(r).GetImagesByNameAndUsername(image.Name, image.Username)
+	if ErrorWrite(w, err, "couldn't look up the images of the user") != nil {
+		return
+	}
+
+	if len(existing) != 0 {
+		writeJSON(w, http.StatusConflict, imageConflictError{
+			Error: fmt.Sprintf("the user already has an image named %s", existing[0].Name),
+			UUID:  existing[0].UUID,
+		})
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).CreateImage(&image), "couldn't create image model") != nil {
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(&image)
+	writeJSON(w, http.StatusCreated, types.NewImage(&image))
 }
 
 // GetImage gets any image based on its unique id.
@@ -114,10 +173,12 @@ func (api_ *API) CreateImage(w http.ResponseWriter, r *http.Request) {
 //
 //	Example response: {
 //	 "Name": "Gentoo",
-//	 "Versions": null,
+//	 "Versions": [{"Version": 0, "CreatedAt": "2022-01-02T15:04:05Z", ...}],
 //	 "UUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf",
-//	 "DiskUUID": "30DF-844C",
-//	 "UserModelID": 1
+//	 "DiskUUID": "30df844c",
+//	 "Username": "Jan",
+//	 "CreatedAt": "2022-01-02T15:04:05Z",
+//	 "UpdatedAt": "2022-03-04T10:11:12Z"
 //	}
 func (api_ *API) GetImage(w http.ResponseWriter, r *http.Request) {
 	image, err := api_.checkUserImage(w, r)
@@ -125,7 +186,93 @@ func (api_ *API) GetImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(image)
+	writeJSON(w, http.StatusOK, types.NewImage(image))
+}
+
+// GetPublicImages lists the images which are visible to everyone, with ?include_versions=false only the number of
+// versions of every image is given. With ?arch= only the images built for that architecture are listed, with
+// ?sort=created or ?sort=updated the newest come first unless ?order=asc.
+// Example request: GET images/public?sort=updated
+// Example response: [{"Name": "Gentoo", "UUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Public": true, ...}]
+func (api_ *API) GetPublicImages(w http.ResponseWriter, r *http.Request) {
+	order, err := parseImageOrder(w, r)
+	if err != nil {
+		return
+	}
+
+	var publicImages []images.ImageModel
+	if r.URL.Query().Get("include_versions") == "false" {
+		publicImages, err = api_.storeFor(r).GetPublicImageSummaries()
+	} else {
+		publicImages, err = api_.storeFor(r).GetPublicImages()
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the public images") != nil {
+		return
+	}
+
+	if publicImages, err = filterArchitecture(r, publicImages); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	api_.writeImages(w, r, order, publicImages)
+}
+
+// validateImageInfo checks the information shown about an image in listings
+func validateImageInfo(image *images.ImageModel) error {
+	if len(image.Description) > maxDescriptionLength {
+		return fmt.Errorf("the description can be at most %d bytes", maxDescriptionLength)
+	}
+
+	if err := validateProvenance(image); err != nil {
+		return err
+	}
+
+	if image.SourceURL == "" {
+		return nil
+	}
+
+	source, err := url.Parse(image.SourceURL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		return errors.New("the source URL must be an http or https URL")
+	}
+
+	return nil
+}
+
+// checkArchitecture spells the architecture of an image the way machines do, an image without one is unknown
+func checkArchitecture(image *images.ImageModel) error {
+	arch, ok := machinemodel.ParseArchitecture(string(image.Architecture))
+	if !ok {
+		return fmt.Errorf("the architecture must be one of %s, %s or %s", machinemodel.X86_64, machinemodel.Arm64,
+			machinemodel.Unknown)
+	}
+
+	image.Architecture = arch
+	return nil
+}
+
+// filterArchitecture keeps the images built for the architecture given with ?arch=, all of them when it is empty
+func filterArchitecture(r *http.Request, found []images.ImageModel) ([]images.ImageModel, error) {
+	name := r.URL.Query().Get("arch")
+	if name == "" {
+		return found, nil
+	}
+
+	arch, ok := machinemodel.ParseArchitecture(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown architecture %s", name)
+	}
+
+	filtered := []images.ImageModel{}
+	for _, image := range found {
+		if image.Architecture == arch {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered, nil
 }
 
 // UpdateImage changes some of the parameters of the image
@@ -141,47 +288,169 @@ func (api_ *API) UpdateImage(w http.ResponseWriter, r *http.Request) {
 	err = json.NewDecoder(r.Body).Decode(&newImage)
 	if err != nil || oldImage.UUID != newImage.UUID {
 		http.Error(w, "invalid machine given", http.StatusBadRequest)
-		log.Errorf("Invalid machine given: %v", err)
+		requestLog(r).Errorf("Invalid machine given: %v", err)
+		return
+	}
+
+	if err = validateImageInfo(&newImage); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Labels which were already there stay, even if the owner left the course since
+	if newImage.Course != oldImage.Course {
+		if err = api_.checkCourseLabel(&newImage, oldImage.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The architecture stays as it is when it is left out
+	if newImage.Architecture == "" {
+		newImage.Architecture = oldImage.Architecture
+	}
+
+	if err = checkArchitecture(&newImage); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	api_.store.UpdateImage(&newImage)
+	// DiskUUIDs from before they were checked stay as they are until they change
+	if newImage.DiskUUID != oldImage.DiskUUID {
+		if err = checkDiskUUID(&newImage); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Images which were public before their provenance was recorded stay public, until it changes
+	if !oldImage.Public || provenanceChanged(oldImage, &newImage) {
+		if api_.checkPublishable(w, &newImage) != nil {
+			return
+		}
+	}
+
+	// The icon can only be changed by uploading one, the tiers only by admins
+	newImage.Icon = oldImage.Icon
+	newImage.Tier = oldImage.Tier
+	newImage.Placement = oldImage.Placement
 
-	_ = json.NewEncoder(w).Encode(newImage)
+	if StoreErrorWrite(w, api_.storeFor(r).UpdateImage(&newImage), "couldn't update image") != nil {
+		return
+	}
+
+	// The stored image has the fields the request left out, and the time of the update
+	updated, err := api_.storeFor(r).GetImageByUUID(newImage.UUID)
+	if ErrorWrite(w, err, "Cannot fetch the updated image") != nil {
+		return
+	}
+
+	if updated.Public != oldImage.Public {
+		api_.imageEvent(updated, images.WebhookVisibilityChanged, nil)
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImage(updated))
 }
 
-// DeleteImage removes an image based on its UUID
-// Example request: DELETE image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf
-// Example response: Successfully deleted image
+// DeleteImage moves an image to the trash, from where it can be restored until it is purged. Administrators can
+// remove it for good straight away with ?purge=true. With ?dry_run=true the image is left alone, the response lists
+// what would be removed. Images which machines or groups boot by default are only removed with ?force=true, which
+// clears those defaults.
+// Example request: DELETE image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf?purge=true
+// Example response: 204 No Content
 func (api_ *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	image, err := api_.checkUserImage(w, r)
 	if err != nil {
 		return
 	}
 
-	// Delete the images and versions from the database
-	if api_.store.DeleteImage(image) != nil {
+	purge := r.URL.Query().Get("purge") == "true"
+	if purge && !api_.isAdmin(r) {
+		http.Error(w, "only administrators can purge images", http.StatusForbidden)
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	defaults, err := api_.getImageDefaults(image.UUID)
+	if ErrorWrite(w, err, "Cannot find who boots the image by default") != nil {
+		return
+	}
+
+	if isDryRun(r) {
+		plan := api_pkg.NewPlannedChanges(true)
+		if ErrorWrite(w, api_.planImageRemoval(plan, image, purge), "Cannot plan the removal of the image") != nil {
+			return
+		}
+
+		defaults.plan(plan, image.UUID, force)
+		writePlan(w, r, plan)
+		return
+	}
+
+	// The plan lists the machines and groups which would lose their default image
+	if !force {
+		plan := api_pkg.NewPlannedChanges(false)
+		defaults.plan(plan, image.UUID, false)
+		if writeBlocked(w, plan) {
+			return
+		}
+	}
+
+	if !api_.checkUnlocked(w, image.UUID, nil) {
+		return
+	}
+
+	if !defaults.empty() {
+		if ErrorWrite(w, api_.storeFor(r).ClearImageDefaults(string(image.UUID)), "Cannot clear the defaults") != nil {
+			return
+		}
+
+		requestLog(r).Infof("Cleared the default image %s of machines %v and groups %v", image.UUID,
+			defaults.Machines, defaults.Groups)
+	}
+
+	if purge {
+		if err = api_.purgeImage(image); err != nil {
+			http.Error(w, "couldn't delete image", http.StatusInternalServerError)
+			requestLog(r).Errorf("delete image: %v", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err = api_.storeFor(r).TrashImage(image); err != nil {
 		http.Error(w, "couldn't delete image", http.StatusInternalServerError)
-		log.Errorf("delete image: %v", err)
+		requestLog(r).Errorf("delete image: %v", err)
 		return
 	}
 
-	http.Error(w, "Successfully deleted image", http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// DownloadImageFile gets the specified version of the image off the disk and offers it to the client
-func DownloadImageFile(image *images.ImageModel, version string, w http.ResponseWriter) {
+// DownloadImageFile gets the specified version of the image off the storage tier holding it and offers it to the
+// client. HEAD requests, and clients which already hold the version named in If-None-Match, only get the headers.
+// They do not wait for a turn and are not counted as downloads.
+func (api_ *API) DownloadImageFile(image *images.ImageModel, version string, w http.ResponseWriter, r *http.Request) {
 	val, err := strconv.ParseUint(version, 10, 64)
 	if err != nil {
 		http.Error(w, "Cannot download the image", http.StatusNotFound)
-		log.Errorf("Download image: %v", err)
+		requestLog(r).Errorf("Download image: %v", err)
+		return
+	}
+
+	stored := image.FindVersion(val)
+	if stored == nil {
+		http.Error(w, "Cannot download the image", http.StatusNotFound)
+		requestLog(r).Errorf("Download image: %s has no version %d", image.UUID, val)
 		return
 	}
 
-	f, err := image.OpenImageFile(val)
+	f, err := api_.openVersion(image, val)
 	if err != nil {
 		http.Error(w, "Cannot download the image", http.StatusNotFound)
-		log.Errorf("Download image: %v", err)
+		requestLog(r).Errorf("Download image: %v", err)
 		return
 	}
 
@@ -190,29 +459,147 @@ func DownloadImageFile(image *images.ImageModel, version string, w http.Response
 		err = f.Close()
 		if err != nil {
 			http.Error(w, "Cannot close image file", http.StatusInternalServerError)
-			log.Errorf("Cannot close image file: %v", err)
+			requestLog(r).Errorf("Cannot close image file: %v", err)
 		}
 	}()
 
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Cannot download the image", http.StatusInternalServerError)
+		requestLog(r).Errorf("Download image: %v", err)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		describeVersion(w.Header(), image, stored, info.Size())
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), versionETag(stored)) {
+		describeVersion(w.Header(), image, stored, info.Size())
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w, release, ok := api_.admitDownload(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Machines flashing the same version at once read it from the storage only once, through the cache
+	var content io.ReadSeeker = f
+	if api_.cache != nil {
+		cached, err := api_.cache.Open(versionCacheKey(image, stored), info.Size(), func() (*os.File, error) {
+			return api_.openVersion(image, val)
+		})
+		if err != nil {
+			requestLog(r).Warnf("Download image: not using the cache: %v", err)
+		} else if cached != nil {
+			defer cached.Close()
+			content = cached
+		}
+	}
+
+	// A Range header resumes a download which broke off, only the rest of the file is sent then
+	describeVersion(w.Header(), image, stored, info.Size())
+	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=%s-%s.img", image.UUID, version))
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// versionCacheKey names the file of a version in the download cache, a replaced file gets another key
+func versionCacheKey(image *images.ImageModel, version *images.Version) string {
+	return fmt.Sprintf("%s/%d/%s/%d", image.UUID, version.Version, version.SHA256, version.UpdatedAt.UnixNano())
+}
+
+// describeVersion sets the headers which describe the stored file of a version. The file is sent as it is stored,
+// compressed with the strategy of the image. Uncompressed files are the raw disk, the zeroes in them may be skipped
+// instead of written, which is what the sparse header tells.
+func describeVersion(header http.Header, image *images.ImageModel, version *images.Version, size int64) {
 	// We set the Content-Type to disk/raw as a placeholder, but it does not actually exist. It might be nice to change
 	// this at some later date some more common value.
-	w.Header().Set("Content-Type", "disk/raw")
-	_, err = io.Copy(w, f)
+	header.Set("Content-Type", "disk/raw")
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
 
-	if err != nil {
-		http.Error(w, "Cannot serve image", http.StatusInternalServerError)
-		log.Errorf("Cannot serve image: %v", err)
-		return
+	if etag := versionETag(version); etag != "" {
+		header.Set("ETag", etag)
 	}
+
+	if !version.UpdatedAt.IsZero() {
+		header.Set("Last-Modified", version.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	if version.Size != 0 {
+		header.Set("X-BAAS-ImageSize", strconv.FormatUint(version.Size, 10))
+	}
+
+	strategy := image.DiskCompressionStrategy
+	if strategy == "" {
+		strategy = images.DiskCompressionStrategyNone
+	}
+
+	header.Set("X-BAAS-Compression", string(strategy))
+	header.Set("X-BAAS-Sparse", strconv.FormatBool(strategy == images.DiskCompressionStrategyNone))
+}
+
+// versionETag is the entity tag of a version, which is its checksum. Versions without a checksum have no tag.
+func versionETag(version *images.Version) string {
+	if version.SHA256 == "" {
+		return ""
+	}
+
+	return `"` + version.SHA256 + `"`
+}
+
+// etagMatches tells whether an If-None-Match header names the entity tag
+func etagMatches(header string, etag string) bool {
+	if header == "" || etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
 }
 
 // DownloadImage offers the requested image to the respective client
 // Example request: image/87f58936-9540-4dad-aba6-253f06142166/1635888918
+// Example request: HEAD image/87f58936-9540-4dad-aba6-253f06142166/1635888918
+// Example response: ETag: "9f86d081884c7d65...", Content-Length: 4294967296, X-BAAS-Compression: none, ...
 func (api_ *API) DownloadImage(w http.ResponseWriter, r *http.Request) {
-	version, err := GetTag("version", w, r)
+	version, err := GetTag("version", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	image, err := api_.checkUserImage(w, r)
 	if err != nil {
-		http.Error(w, "Invalid version in the URI", http.StatusInternalServerError)
-		log.Errorf("Download image: %v", err)
+		return
+	}
+
+	api_.DownloadImageFile(image, version, w, r)
+}
+
+// DeleteVersion removes a version of an image. Versions which queued boot setups are going to flash are
+// not deleted, instead the blocking boot setups are returned. A dry run only lists what would be removed.
+// Example request: DELETE image/87f58936-9540-4dad-aba6-253f06142166/3
+// Example response when blocked: {"Error": "...", "Blockers": [{"MachineMAC": "52:54:00:d9:71:93", ...}]}
+func (api_ *API) DeleteVersion(w http.ResponseWriter, r *http.Request) {
+	versionTxt, err := GetTag("version", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	number, err := strconv.ParseUint(versionTxt, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version in the URI", http.StatusBadRequest)
 		return
 	}
 
@@ -221,9 +608,92 @@ func (api_ *API) DownloadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=%s-%s.img", image.UUID, version))
+	version := image.FindVersion(number)
+	if version == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	if isDryRun(r) {
+		plan := api_pkg.NewPlannedChanges(true)
+		if ErrorWrite(w, api_.planVersionRemoval(plan, image, version), "Cannot plan the removal of the version") != nil {
+			return
+		}
+
+		writePlan(w, r, plan)
+		return
+	}
+
+	if !api_.checkUnlocked(w, image.UUID, &version.Version) {
+		return
+	}
+
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+	defer release()
+
+	blockers, err := api_.versionBlockers(image, version)
+	if ErrorWrite(w, err, "Cannot check the boot queue") != nil {
+		return
+	}
 
-	DownloadImageFile(image, version, w)
+	if len(blockers) != 0 {
+		writeJSON(w, http.StatusConflict, struct {
+			Error    string
+			Blockers []images.BootSetup
+		}{"this version is going to be flashed by queued boot setups", blockers})
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteVersion(version), "Cannot delete the version") != nil {
+		return
+	}
+
+	err = os.Remove(api_.versionFile(image, version.Version))
+	if err != nil && !os.IsNotExist(err) {
+		requestLog(r).Warnf("Cannot remove the file of version %d of %s: %v", version.Version, image.UUID, err)
+	}
+
+	err = os.Remove(api_.manifestFile(image, version.Version))
+	if err != nil && !os.IsNotExist(err) {
+		requestLog(r).Warnf("Cannot remove the manifest of version %d of %s: %v", version.Version, image.UUID, err)
+	}
+
+	api_.forgetBackup(r, image, version.Version)
+	api_.imageEvent(image, images.WebhookVersionDeleted, &version.Version)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetVersions lists the versions of an image, newest first. With ?sort=updated the versions which changed last come
+// first.
+// Example request: GET image/87f58936-9540-4dad-aba6-253f06142166/versions?limit=10&offset=10
+// Example response: {"Items": [{"Version": 12, "ImageModelUUID": "87f58936-...", "Size": 4294967296,
+// "CreatedAt": "2022-01-02T15:04:05Z", ...}], "Total": 13, "Limit": 10, "Offset": 10,
+// "Next": "/image/87f58936-.../versions?limit=10&offset=20", "Prev": "/image/87f58936-.../versions?limit=10&offset=0"}
+func (api_ *API) GetVersions(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	opts, err := parseListOptions(w, r, false)
+	if err != nil {
+		return
+	}
+
+	versions, total, err := api_.storeFor(r).GetVersions(image.UUID, opts)
+	if ErrorWrite(w, err, "Cannot fetch the versions") != nil {
+		return
+	}
+
+	described := types.NewImageVersions(versions)
+	if ErrorWrite(w, api_.backupStatuses(r, image.UUID, versions, described), "Cannot fetch the backups") != nil {
+		return
+	}
+
+	writePage(w, offsetPage(r, opts, described, len(versions), total))
 }
 
 // DownloadLatestImage offers the latest version
@@ -234,11 +704,14 @@ func (api_ *API) DownloadLatestImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	versionTxt := image.Versions[len(image.Versions)-1]
-	version := strconv.FormatUint(versionTxt.Version, 10)
+	latest := image.LatestVersion()
+	if latest == nil {
+		http.Error(w, "The image has no version which can be downloaded", http.StatusNotFound)
+		return
+	}
 
-	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=%s-%s.img", image.UUID, version))
-	DownloadImageFile(image, version, w)
+	version := strconv.FormatUint(latest.Version, 10)
+	api_.DownloadImageFile(image, version, w, r)
 }
 
 func createNewVersion(api *API, uniqueID string) (*images.Version, error) {
@@ -252,7 +725,11 @@ func updateVersion(api *API, uniqueID string) (*images.Version, error) {
 		return nil, err
 	}
 
-	// Update the latest version
+	// Update the latest version, images without versions get their first one
+	if len(image.Versions) == 0 {
+		return createNewVersion(api, uniqueID)
+	}
+
 	return &image.Versions[len(image.Versions)-1], nil
 }
 
@@ -272,77 +749,326 @@ func manageVersion(api *API, newVersion string, uniqueID string) (*images.Versio
 	return version, err
 }
 
-// UploadImage takes the uploaded file and stores as a new version of the image
+// uploadedSize determines the logical size of an uploaded image. Uncompressed images are measured on disk,
+// for compressed ones we rely on the size the uploader gave in the X-BAAS-ImageSize header.
+func uploadedSize(image *images.ImageModel, dest *os.File, announced string) uint64 {
+	if image.DiskCompressionStrategy == "" || image.DiskCompressionStrategy == images.DiskCompressionStrategyNone {
+		info, err := dest.Stat()
+		if err != nil {
+			log.Warnf("Cannot determine the size of the uploaded image: %v", err)
+			return 0
+		}
+
+		return uint64(info.Size())
+	}
+
+	size, err := strconv.ParseUint(announced, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
+
+// checksumError is the answer to an upload whose SHA-256 is not the one the uploader expected
+type checksumError struct {
+	Error    string
+	Expected string
+	Actual   string
+}
+
+// receivedUpload is an upload whose file was received, it is yet to be verified and stored as its version
+type receivedUpload struct {
+	image   *images.ImageModel
+	version *images.Version
+	// path is the file of the version, the received file is kept next to it until it is accepted
+	path       string
+	newVersion bool
+	created    bool
+	skip       bool
+	keyID      uint
+	file       uploadedFile
+}
+
+// UploadImage takes the uploaded file and stores as a new version of the image. Users can only upload disk images in
+// the formats of UploadFormats, see checkUploadFormat.
+// Every upload is a job, which the X-BAAS-Job header of the answer names. Once the file is received it is hashed and
+// stored, which takes a while for large images. Uploaders who send "Prefer: respond-async" are answered with 202 and
+// the job as soon as the file is received, and follow the rest through GET /jobs/{id} or GET /events.
 // Example request: image/87f58936-9540-4dad-aba6-253f06142166 -H "Content-Type: multipart/form-data"
 //
 //	-F "file=@/tmp/test3.img"
 //
 // Example return: Successfully uploaded image: 134251234
 func (api_ *API) UploadImage(w http.ResponseWriter, r *http.Request) {
-	log.Info("Started with upload")
+	requestLog(r).Info("Started with upload")
 	image, err := api_.checkUserImage(w, r)
 	if err != nil {
 		return
 	}
 
+	job := api_.jobs.begin(jobUpload, api_.requester(r), image.UUID, phaseReceiving)
+	w.Header().Set(jobHeader, job.ID)
+	answer := newJobResponse(w)
+
+	upload, release, ok := api_.receiveUpload(answer, r, image, job.ID)
+	if !ok {
+		api_.jobs.finish(job.ID, answer)
+		return
+	}
+
+	if !respondAsync(r) {
+		api_.storeUpload(answer, r, upload, job.ID)
+		release()
+		api_.jobs.finish(job.ID, answer)
+		return
+	}
+
+	job, _ = api_.jobs.get(job.ID)
+	answer.detach()
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+
+	go func() {
+		api_.storeUpload(answer, r, upload, job.ID)
+		release()
+		api_.jobs.finish(job.ID, answer)
+	}()
+}
+
+// receiveUpload reads the file of an upload next to the version it is uploaded for. The upload holds a slot of the
+// uploads and the files of the image until the returned function is called, the request is answered when it is not
+// ok.
+func (api_ *API) receiveUpload(w http.ResponseWriter, r *http.Request, image *images.ImageModel,
+	job string) (*receivedUpload, func(), bool) {
+	skip, ok := api_.skipsValidation(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	keyID, ok := api_.uploadBootKey(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	done, ok := api_.admitUpload(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	unclaim, ok := api_.beginWrite(w, image)
+	if !ok {
+		done()
+		return nil, nil, false
+	}
+
+	release := func() {
+		unclaim()
+		done()
+	}
+	received := false
+	defer func() {
+		if !received {
+			release()
+		}
+	}()
+
 	// Get the reader to the multireader
 	mr, err := r.MultipartReader()
 	if ErrorWrite(w, err, "Cannot parse POST form") != nil {
-		return
+		return nil, nil, false
 	}
 
 	// Get the parameters for this update
 	// TODO: Bad design. Write a new endpoint or use a header for this.
 
+	// Overwriting a version which is being flashed would tear the download of the management OS
+	if r.Header.Get("X-BAAS-NewVersion") == "false" && len(image.Versions) != 0 &&
+		!api_.checkUnlocked(w, image.UUID, &image.Versions[len(image.Versions)-1].Version) {
+		return nil, nil, false
+	}
+
+	newVersion := r.Header.Get("X-BAAS-NewVersion") == "true"
+	if newVersion && !api_.checkLimits(w, image.Username, limits.CreateVersion(image.UUID)) {
+		return nil, nil, false
+	}
+
+	// Overwriting the latest version keeps its number, the webhooks are only told about versions which are new
+	created := newVersion || len(image.Versions) == 0
 	version, err := manageVersion(api_, r.Header.Get("X-BAAS-NewVersion"), string(image.UUID))
 	if err != nil {
 		http.Error(w, "cannot fetch the image from the database", http.StatusNotFound)
-		log.Errorf("cannot fetch image from database: %v", err)
-		return
+		requestLog(r).Errorf("cannot fetch image from database: %v", err)
+		return nil, nil, false
 	}
+	api_.jobs.setVersion(job, version.Version)
 
 	// We only use the first part right now, but this might change
 	p, err := mr.NextPart()
 	if ErrorWrite(w, err, "File upload failed") != nil {
-		return
+		return nil, nil, false
 	}
 
 	// One liner which closes the file at the end of the call.
 	defer func() {
 		if err = p.Close(); err != nil {
-			log.Errorf("Cannot close upload file: %v", err)
+			requestLog(r).Errorf("Cannot close upload file: %v", err)
 		}
 	}()
 
-	// Write the file onto the disk
-	dest, err := os.OpenFile(fmt.Sprintf(api_.diskpath+images.FilePathFmt, image.UUID, version.Version),
-		os.O_WRONLY|os.O_CREATE, 0644)
+	// Write the file next to its destination, it only replaces the version once we know the user can store it.
+	path := api_.versionFile(image, version.Version)
+	dest, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if ErrorWrite(w, err, "Cannot open destination file") != nil {
-		return
+		return nil, nil, false
 	}
 
-	err = fs.CopyStream(p, dest)
+	_, err = fs.Copy(dest, api_.jobs.reader(job, phaseReceiving, p, r.ContentLength))
+	size := uploadedSize(image, dest, r.Header.Get("X-BAAS-ImageSize"))
+
+	if cerr := dest.Close(); cerr != nil {
+		requestLog(r).Errorf("Cannot close upload file: %v", cerr)
+	}
 
 	if ErrorWrite(w, err, "Cannot copy over the contents of the file") != nil {
+		api_.discardUpload(r, path+".part", image.UUID, newVersion)
+		return nil, nil, false
+	}
+
+	received = true
+	return &receivedUpload{image: image, version: version, path: path, newVersion: newVersion, created: created,
+		skip: skip, keyID: keyID, file: uploadedFile{Path: path + ".part", Size: size}}, release, true
+}
+
+// hashUpload hashes the received file of an upload, the job of the upload follows how far along it is
+func (api_ *API) hashUpload(job string, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err = fs.Copy(hash, api_.jobs.reader(job, phaseVerifying, file, info.Size())); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// storeUpload verifies the received file of an upload and stores it as the version it was uploaded for
+func (api_ *API) storeUpload(w http.ResponseWriter, r *http.Request, upload *receivedUpload, job string) {
+	image, version := upload.image, upload.version
+
+	// The checksum lets machines verify versions they downloaded from one another
+	checksum, err := api_.hashUpload(job, upload.file.Path)
+	if ErrorWrite(w, err, "Cannot hash the uploaded file") != nil {
+		api_.discardUpload(r, upload.file.Path, image.UUID, upload.newVersion)
+		return
+	}
+	upload.file.Checksum = checksum
+
+	// Uploaders which know the checksum of their file have it verified, a mismatch means the file got corrupted
+	if expected := r.Header.Get("X-BAAS-SHA256"); expected != "" && !strings.EqualFold(expected, checksum) {
+		api_.discardUpload(r, upload.file.Path, image.UUID, upload.newVersion)
+		writeJSON(w, http.StatusUnprocessableEntity, checksumError{
+			Error: fmt.Sprintf("the checksum of the upload is %s, but %s was expected", checksum,
+				strings.ToLower(expected)),
+			Expected: strings.ToLower(expected),
+			Actual:   checksum,
+		})
 		return
 	}
 
-	defer func() {
-		if err := dest.Close(); err != nil {
-			log.Errorf("Cannot close upload file: %v", err)
+	api_.jobs.progress(job, phaseStoring, 0)
+	if !api_.checkUploadFormat(w, r, image, &upload.file, upload.skip) {
+		api_.discardUpload(r, upload.file.Path, image.UUID, upload.newVersion)
+		return
+	}
+
+	if !api_.checkLimits(w, image.Username, limits.StoreBytes(upload.file.Size, version.Size)) {
+		api_.discardUpload(r, upload.file.Path, image.UUID, upload.newVersion)
+		return
+	}
+
+	if ErrorWrite(w, os.Rename(upload.file.Path, upload.path), "Cannot store the uploaded file") != nil {
+		return
+	}
+
+	if err = api_.storeFor(r).SetVersionSize(image.UUID, version.Version, upload.file.Size); err != nil {
+		requestLog(r).Warnf("Cannot store the size of version %d: %v", version.Version, err)
+	}
+
+	if err = api_.storeFor(r).SetVersionChecksum(image.UUID, version.Version, upload.file.Checksum); err != nil {
+		requestLog(r).Warnf("Cannot store the checksum of version %d: %v", version.Version, err)
+	}
+
+	if err = api_.storeFor(r).SetVersionFormat(image.UUID, version.Version, upload.file.Format); err != nil {
+		requestLog(r).Warnf("Cannot store the format of version %d: %v", version.Version, err)
+	}
+
+	if upload.keyID != 0 {
+		if err = api_.storeFor(r).SetVersionBootKey(image.UUID, version.Version, upload.keyID); err != nil {
+			requestLog(r).Warnf("Cannot store the key of version %d: %v", version.Version, err)
 		}
-	}()
+	}
+
+	api_.recordDiskUUID(r, image, upload.path, upload.file.Format, !hasContent(image))
+	api_.wakeBackups()
+	if upload.created {
+		api_.imageEvent(image, images.WebhookVersionCreated, &version.Version)
+	}
+
 	http.Error(w, "Successfully uploaded image: "+strconv.FormatUint(version.Version, 10), http.StatusOK)
 }
 
+// discardUpload removes a file which was not accepted, together with the version it was uploaded for if that was
+// created for the upload.
+func (api_ *API) discardUpload(r *http.Request, path string, uuid images.ImageUUID, newVersion bool) {
+	if err := os.Remove(path); err != nil {
+		requestLog(r).Warnf("Cannot remove the rejected upload %s: %v", path, err)
+	}
+
+	if !newVersion {
+		return
+	}
+
+	version, err := updateVersion(api_, string(uuid))
+	if err == nil {
+		err = api_.store.DeleteVersion(version)
+	}
+
+	if err != nil {
+		requestLog(r).Errorf("Cannot remove the version created for the rejected upload of %s: %v", uuid, err)
+	}
+}
+
 // RegisterImageHandlers sets the metadata for each of the routes and registers them to the global handler
 func (api_ *API) RegisterImageHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:              "/images/public",
+		Permissions:      []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:      true,
+		AnonymousAllowed: true,
+		Scope:            user.ScopeImagesRead,
+		Handler:          api_.GetPublicImages,
+		Method:           http.MethodGet,
+		Description:      "Lists the images which are visible to everyone",
+	})
+
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/image",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.CreateImage,
 		Method:      http.MethodPost,
+		Schema:      "image",
 		Description: "Creates a new image",
 	})
 
@@ -350,6 +1076,7 @@ func (api_ *API) RegisterImageHandlers() {
 		URI:         "/image/{uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
 		Handler:     api_.GetImage,
 		Method:      http.MethodGet,
 		Description: "Gets information about an image",
@@ -359,6 +1086,7 @@ func (api_ *API) RegisterImageHandlers() {
 		URI:         "/image/{uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.DeleteImage,
 		Method:      http.MethodDelete,
 		Description: "Removes an image",
@@ -368,8 +1096,10 @@ func (api_ *API) RegisterImageHandlers() {
 		URI:         "/image/{uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.UpdateImage,
 		Method:      http.MethodPut,
+		Schema:      "image-update",
 		Description: "Updates an image",
 	})
 
@@ -377,26 +1107,69 @@ func (api_ *API) RegisterImageHandlers() {
 		URI:         "/image/{uuid}/latest",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.DownloadLatestImage,
 		Method:      http.MethodPost,
+		Schema:      schemaNone,
 		Description: "Offers the latest version of the image",
 	})
 
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetVersions,
+		Method:      http.MethodGet,
+		Description: "Lists the versions of the image",
+	})
+
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/image/{uuid}/{version}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Audience:    AudienceEveryone,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesRead,
 		Handler:     api_.DownloadImage,
 		Method:      http.MethodGet,
 		Description: "Requests a particular version of the image",
 	})
 
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/{version}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Audience:    AudienceEveryone,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.DownloadImage,
+		Method:      http.MethodHead,
+		Description: "Describes a particular version of the image without downloading it",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/{version}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.DeleteVersion,
+		Method:      http.MethodDelete,
+		Description: "Deletes a particular version of the image",
+	})
+
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/image/{uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Audience:    AudienceEveryone,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.UploadImage,
+		Idempotent:  true,
 		Method:      http.MethodPost,
+		Schema:      schemaMultipart,
 		Description: "Uploads a new version of the image",
 	})
 }
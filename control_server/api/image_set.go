@@ -0,0 +1,302 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// expandImageSet checks the members of a set and builds the image setup the set is booted through. The version
+// stored for each member is the one it would flash now, its selector picks the version again when a machine claims
+// the boot.
+func (api_ *API) expandImageSet(set *images.ImageSet) (*images.ImageSetup, error) {
+	if set.Name == "" {
+		return nil, errors.New("the name of the set cannot be empty")
+	}
+
+	if len(set.Members) == 0 {
+		return nil, errors.New("a set needs at least one member")
+	}
+
+	setup := images.ImageSetup{UUID: set.UUID, Name: set.Name, Username: set.Username}
+	devices := map[string]bool{}
+	for i := range set.Members {
+		member := &set.Members[i]
+		if member.TargetDevice == "" {
+			return nil, errors.New("every member needs a target device")
+		}
+
+		if devices[member.TargetDevice] {
+			return nil, fmt.Errorf("several members are written to %s", member.TargetDevice)
+		}
+		devices[member.TargetDevice] = true
+
+		image, err := api_.store.GetImageByUUID(member.ImageUUID)
+		if err != nil || (image.Username != set.Username && !image.Public) {
+			return nil, fmt.Errorf("cannot find image %s", member.ImageUUID)
+		}
+
+		if member.Version == "" {
+			member.Version = images.VersionLatest
+		}
+
+		var version *images.Version
+		if n, ok := member.Version.Pinned(); ok {
+			version = image.FindVersion(n)
+		} else if member.Version == images.VersionLatest {
+			version = image.LatestVersion()
+		} else {
+			return nil, errors.New("the version of a member is either latest or a version number")
+		}
+
+		if version == nil {
+			return nil, fmt.Errorf("image %s has no version %s", image.UUID, member.Version)
+		}
+
+		setup.Images = append(setup.Images, images.ImageFrozen{
+			UUIDImage:    image.UUID,
+			VersionID:    uint64(version.ID),
+			Selector:     member.Version,
+			TargetDevice: member.TargetDevice,
+		})
+	}
+
+	return &setup, nil
+}
+
+// checkSetDisks checks that every image of a multi-disk setup goes to a disk of its own which it fits on
+func checkSetDisks(machine *machinemodel.MachineModel, setup *images.ImageSetup) *targetDiskError {
+	used := map[string]bool{}
+	for _, frozen := range setup.Images {
+		fail := &targetDiskError{Selector: frozen.TargetDevice, Disks: machine.Disks,
+			TargetDevice: machine.TargetDevice}
+
+		disks := machine.FindDisks(frozen.TargetDevice)
+		switch {
+		case len(machine.Disks) == 0:
+			fail.Error = "the disks of this machine are not known yet, boot it once with an image setup"
+		case len(disks) == 0:
+			fail.Error = "no disk of this machine matches"
+		case len(disks) > 1:
+			fail.Error = "several disks of this machine match"
+		case used[disks[0].Device]:
+			fail.Error = "several images are written to " + disks[0].Device
+		case frozen.Version.Size > disks[0].Size:
+			fail.Error = fmt.Sprintf("image %s does not fit on %s", frozen.UUIDImage, disks[0].Device)
+		default:
+			used[disks[0].Device] = true
+			continue
+		}
+
+		return fail
+	}
+
+	return nil
+}
+
+// getUserImageSet finds the image set in the URI, it writes the error when the set does not belong to the user
+func (api_ *API) getUserImageSet(w http.ResponseWriter, r *http.Request) (*images.ImageSet, error) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	setUUID, err := GetTag("set_uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	set, err := api_.storeFor(r).GetImageSet(images.ImageUUID(setUUID))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && set.Username != username) {
+		http.Error(w, "Image set not found", http.StatusNotFound)
+		return nil, errors.New("image set not found")
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the image set") != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// CreateImageSet creates a set of images which are written to different disks of a machine. The members are
+// flashed in the order they are given in, the Version of a member is "latest" when it is left out.
+// Example request: POST /user/jan/imagesets
+// Example body: {"Name": "Course", "Members": [
+//
+//	{"ImageUUID": "3a760707-c160-40fa-81be-430b75131ddc", "Version": "latest", "TargetDevice": "S4EWNX0N123456"},
+//	{"ImageUUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Version": 3, "TargetDevice": "WD-WCC4N1234567"}]}
+//
+// Example response: {"UUID": "a1f0...", "Name": "Course", "Username": "jan", "Members": [...]}
+func (api_ *API) CreateImageSet(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var set images.ImageSet
+	if err = json.NewDecoder(r.Body).Decode(&set); err != nil {
+		http.Error(w, "Invalid image set", http.StatusBadRequest)
+		return
+	}
+
+	set.UUID = images.ImageUUID(uuid.New().String())
+	set.Username = username
+
+	setup, err := api_.expandImageSet(&set)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).CreateImageSet(&set, setup), "Cannot create the image set") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, types.NewImageSet(&set))
+}
+
+// GetImageSets lists the image sets of a user
+// Example request: GET /user/jan/imagesets
+// Example response: [{"UUID": "a1f0...", "Name": "Course", "Username": "jan", "Members": [...]}]
+func (api_ *API) GetImageSets(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	sets, err := api_.storeFor(r).GetImageSets(username)
+	if ErrorWrite(w, err, "Cannot fetch the image sets") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImageSets(sets))
+}
+
+// GetImageSet gets an image set with its members
+// Example request: GET /user/jan/imagesets/a1f0...
+// Example response: {"UUID": "a1f0...", "Name": "Course", "Username": "jan", "Members": [...]}
+func (api_ *API) GetImageSet(w http.ResponseWriter, r *http.Request) {
+	set, err := api_.getUserImageSet(w, r)
+	if err != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImageSet(set))
+}
+
+// UpdateImageSet replaces the name and the members of an image set. Boots of the set which are queued flash the
+// new members.
+// Example request: PUT /user/jan/imagesets/a1f0...
+// Example body: {"Name": "Course", "Members": [{"ImageUUID": "3a76...", "TargetDevice": "S4EWNX0N123456"}]}
+// Example response: the updated image set
+func (api_ *API) UpdateImageSet(w http.ResponseWriter, r *http.Request) {
+	old, err := api_.getUserImageSet(w, r)
+	if err != nil {
+		return
+	}
+
+	var set images.ImageSet
+	if err = json.NewDecoder(r.Body).Decode(&set); err != nil {
+		http.Error(w, "Invalid image set", http.StatusBadRequest)
+		return
+	}
+
+	set.UUID = old.UUID
+	set.Username = old.Username
+
+	setup, err := api_.expandImageSet(&set)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).UpdateImageSet(&set, setup), "Cannot update the image set") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImageSet(&set))
+}
+
+// DeleteImageSet removes an image set, together with the boots of it which are queued
+// Example request: DELETE /user/jan/imagesets/a1f0...
+// Example response: 204 No Content
+func (api_ *API) DeleteImageSet(w http.ResponseWriter, r *http.Request) {
+	set, err := api_.getUserImageSet(w, r)
+	if err != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteImageSet(set), "Cannot delete the image set") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterImageSetHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterImageSetHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/imagesets",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetImageSets,
+		Method:      http.MethodGet,
+		Description: "Lists the image sets of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/imagesets",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.CreateImageSet,
+		Method:      http.MethodPost,
+		Schema:      "image-set",
+		Description: "Creates a set of images which are written to different disks",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/imagesets/{set_uuid}",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetImageSet,
+		Method:      http.MethodGet,
+		Description: "Gets an image set",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/imagesets/{set_uuid}",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.UpdateImageSet,
+		Method:      http.MethodPut,
+		Schema:      "image-set",
+		Description: "Replaces the members of an image set",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/imagesets/{set_uuid}",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.DeleteImageSet,
+		Method:      http.MethodDelete,
+		Description: "Deletes an image set",
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ImageSets(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "imagesets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	for _, uuid := range []images.ImageUUID{"system", "data"} {
+		image := images.ImageModel{Name: string(uuid), Username: "test", UUID: uuid}
+		assert.NoError(t, store.CreateImage(&image))
+		store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: uuid, Size: 100})
+	}
+
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac}))
+	assert.NoError(t, store.UpdateInventory(mac, &machinemodel.Inventory{TargetDevice: "/dev/sda", Disks: []machinemodel.DiskModel{
+		{Device: "/dev/sda", Size: 1000, Serial: "SYSTEM"},
+		{Device: "/dev/sdb", Size: 50, Serial: "DATA"},
+	}}))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	// Members need a disk of their own
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/user/test/imagesets",
+		`{"Name": "lab", "Members": [{"ImageUUID": "system", "TargetDevice": "SYSTEM"},
+		{"ImageUUID": "data", "TargetDevice": "SYSTEM"}]}`).Code)
+
+	resp := s.request(http.MethodPost, "/user/test/imagesets", `{"Name": "lab", "Members": [
+		{"ImageUUID": "system", "TargetDevice": "SYSTEM"}, {"ImageUUID": "data", "Version": 0, "TargetDevice": "DATA"}]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var set images.ImageSet
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&set))
+	assert.Equal(t, images.VersionLatest, set.Members[0].Version)
+
+	resp = s.request(http.MethodGet, "/user/test/imagesets", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), string(set.UUID))
+
+	// The latest version of the data image does not fit on its disk, the first one does
+	assert.Equal(t, http.StatusUnprocessableEntity,
+		s.request(http.MethodPost, "/machine/abc/boot", `{"SetUUID": "`+string(set.UUID)+`", "Version": "latest"}`).Code)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPost, "/machine/abc/boot",
+		`{"SetUUID": "`+string(set.UUID)+`"}`).Code)
+
+	resp = s.request(http.MethodGet, "/machine/abc/boot", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var setup images.ImageSetup
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&setup))
+	if assert.Len(t, setup.Images, 2) {
+		assert.Equal(t, "SYSTEM", setup.Images[0].TargetDevice)
+		assert.Equal(t, uint64(1), setup.Images[0].Version.Version)
+		assert.Equal(t, uint64(0), setup.Images[1].Version.Version)
+	}
+
+	// A set is only completed once every member is flashed
+	resp = s.request(http.MethodPut, "/machine/abc/boot/state",
+		`{"State": "completed", "Flashed": [{"ImageUUID": "system", "Version": 1}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Contains(t, resp.Body.String(), string(images.BootFailed))
+
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/user/test/imagesets/"+string(set.UUID), "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/user/test/imagesets/"+string(set.UUID), "").Code)
+}
@@ -8,39 +8,35 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/baas-project/baas/pkg/api/types"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/user"
 
 	"github.com/baas-project/baas/pkg/model"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
 )
 
 func _getImageSetup(w http.ResponseWriter, r *http.Request, api *API) (*images.ImageSetup, error) {
-	username, err := GetName(w, r)
-	if err != nil {
-		http.Error(w, "Failed to create image setup", http.StatusBadRequest)
-		log.Errorf("Username not found in URI: %v", err)
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
 		return nil, err
 	}
 
-	tagUUID, err := GetTag("setup_uuid", w, r)
-	if err != nil {
-		http.Error(w, "Failed to find image setups", http.StatusBadRequest)
-		log.Errorf("UUID not found in URI: %v", err)
+	tagUUID, err := GetTag("setup_uuid", r)
+	if TagErrorWrite(w, err) != nil {
 		return nil, err
 	}
 
 	setup, err := api.store.GetImageSetup(tagUUID)
 	if err != nil {
 		http.Error(w, "Failed to find image setup", http.StatusBadRequest)
-		log.Errorf("Cannot find image setup: %v", err)
+		requestLog(r).Errorf("Cannot find image setup: %v", err)
 		return nil, err
 	}
 
 	if setup.Username != username {
 		http.Error(w, "Image not owned by this user", http.StatusUnauthorized)
-		log.Errorf("Image not owned by requesting user: %v", err)
+		requestLog(r).Errorf("Image not owned by requesting user: %v", err)
 		return nil, err
 	}
 
@@ -49,12 +45,10 @@ func _getImageSetup(w http.ResponseWriter, r *http.Request, api *API) (*images.I
 
 // createImageSetup defines an endpoint which creates an ImageSetup in the database
 // Example request: POST /user/[name]/image_setup
-// Example response: Successfully created image setup.
+// Example response: 201 Created with the image setup
 func (api_ *API) createImageSetup(w http.ResponseWriter, r *http.Request) {
-	username, err := GetName(w, r)
-	if err != nil {
-		http.Error(w, "Failed to create image setup", http.StatusBadRequest)
-		log.Errorf("Username not found in URI: %v", err)
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
 		return
 	}
 
@@ -66,20 +60,18 @@ func (api_ *API) createImageSetup(w http.ResponseWriter, r *http.Request) {
 
 	if imageSetup.Name == "" {
 		http.Error(w, "Did not set image setup name", http.StatusBadRequest)
-		log.Errorf("Did not sent image setup name: %v", err)
+		requestLog(r).Errorf("Did not sent image setup name: %v", err)
 		return
 	}
 
-	err = api_.store.CreateImageSetup(username, &imageSetup)
-	if err != nil {
-		http.Error(w, "Failed to create image setup", http.StatusBadRequest)
-		log.Errorf("Error creating database entry: %v", err)
+	err = api_.storeFor(r).CreateImageSetup(username, &imageSetup)
+	if StoreErrorWrite(w, err, "Failed to create image setup") != nil {
 		return
 	}
 
 	imageSetup.Images = []images.ImageFrozen{}
 
-	_ = json.NewEncoder(w).Encode(imageSetup)
+	writeJSON(w, http.StatusCreated, types.NewImageSetup(&imageSetup))
 }
 
 // findImageSetupsByUsername returns all ImageSetups associated with a specific user
@@ -88,29 +80,27 @@ func (api_ *API) createImageSetup(w http.ResponseWriter, r *http.Request) {
 // [{"Name": "Linux Kernel",
 //
 //	 "Images": [],
-//	 "User": "ValentijnvdBeek",
+//	 "Username": "ValentijnvdBeek",
 //	  "UUID": "fcc0ed46-1f55-4366-a1fd-73b61473bbd5"},
 //	{"Name": "Linux Kernel 2",
 //	 "Images": [],
-//	 "User": "ValentijnvdBeek",
+//	 "Username": "ValentijnvdBeek",
 //	 "UUID": "2b59ff94-7fb6-4239-b2e6-82f1e30f4355"}]
 func (api_ *API) findImageSetupsByUsername(w http.ResponseWriter, r *http.Request) {
-	username, err := GetName(w, r)
-	if err != nil {
-		http.Error(w, "Failed to find image setups", http.StatusBadRequest)
-		log.Errorf("Username not found in URI: %v", err)
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
 		return
 	}
 
 	// TODO: Better unique error returns
-	imageSetup, err := api_.store.FindImageSetupsByUsername(username)
+	imageSetup, err := api_.storeFor(r).FindImageSetupsByUsername(username)
 	if err != nil {
 		http.Error(w, "Failed to find image setups", http.StatusBadRequest)
-		log.Errorf("Find image setups cannot be found: %v", err)
+		requestLog(r).Errorf("Find image setups cannot be found: %v", err)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(imageSetup)
+	writeJSON(w, http.StatusOK, types.NewImageSetups(*imageSetup))
 }
 
 // getImageSetup returns the ImageSetup associated with an UUID
@@ -118,9 +108,9 @@ func (api_ *API) findImageSetupsByUsername(w http.ResponseWriter, r *http.Reques
 // Example response:
 // { "Name": "Linux Kernel 2",
 //
-//	"Images": [{"UUIDImage": "3a760707-c160-40fa-81be-430b75131ddc",
-//	            "VersionNumber": 3 }],
-//	"User": "ValentijnvdBeek",
+//	"Images": [{"Image": {"UUID": "3a760707-c160-40fa-81be-430b75131ddc", ...},
+//	            "Version": {"Version": 3, ...}, "Update": false}],
+//	"Username": "ValentijnvdBeek",
 //	"UUID": "2b59ff94-7fb6-4239-b2e6-82f1e30f4355" }
 func (api_ *API) getImageSetup(w http.ResponseWriter, r *http.Request) {
 	setup, err := _getImageSetup(w, r, api_)
@@ -128,12 +118,12 @@ func (api_ *API) getImageSetup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(setup)
+	writeJSON(w, http.StatusOK, types.NewImageSetup(setup))
 }
 
 // addImageSetup deletes an image from a setup
 // Request: DELETE /user/{name}/image_setup/{setup_uuid}/image/{image_uuid}
-// Response: Successfully deleted image from setup
+// Response: 204 No Content
 func (api_ *API) removeImageFromImageSetup(w http.ResponseWriter, r *http.Request) {
 	setup, err := _getImageSetup(w, r, api_)
 	if err != nil {
@@ -144,15 +134,15 @@ func (api_ *API) removeImageFromImageSetup(w http.ResponseWriter, r *http.Reques
 	err = json.NewDecoder(r.Body).Decode(&imageMsg)
 	if err != nil {
 		http.Error(w, "Cannot find image UUID in JSON message.", http.StatusBadRequest)
-		log.Errorf("Cannot find image UUID: %v", err)
+		requestLog(r).Errorf("Cannot find image UUID: %v", err)
 		return
 	}
 
-	image, err := api_.store.GetImageByUUID(images.ImageUUID(imageMsg.UUID))
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(imageMsg.UUID))
 
 	if err != nil {
 		http.Error(w, "Failed to add image to image setups", http.StatusBadRequest)
-		log.Errorf("Cannot find images: %v", err)
+		requestLog(r).Errorf("Cannot find images: %v", err)
 		return
 	}
 
@@ -161,14 +151,14 @@ func (api_ *API) removeImageFromImageSetup(w http.ResponseWriter, r *http.Reques
 		ImageModelUUID: image.UUID,
 	}
 
-	err = api_.store.RemoveImageFromImageSetup(setup, image, version, imageMsg.Update)
+	err = api_.storeFor(r).RemoveImageFromImageSetup(setup, image, version, imageMsg.Update)
 	if err != nil {
 		http.Error(w, "Cannot remove image from setup", http.StatusBadRequest)
-		log.Errorf("Cannot delete image from setup: %s, %v", imageMsg.UUID, err)
+		requestLog(r).Errorf("Cannot delete image from setup: %s, %v", imageMsg.UUID, err)
 		return
 	}
 
-	http.Error(w, "Successfully deleted image from setup", http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // getImagesFromImageSetup gets all the images from an image setup
@@ -180,27 +170,25 @@ func (api_ *API) getImagesFromImageSetup(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(setup.Images)
+	writeJSON(w, http.StatusOK, types.NewFrozenImages(setup.Images))
 }
 
 // getImageSetups fetches all the image setups related to the user
 func (api_ *API) getImageSetups(w http.ResponseWriter, r *http.Request) {
-	username, err := GetName(w, r)
-	if err != nil {
-		http.Error(w, "Failed to find image setups", http.StatusBadRequest)
-		log.Errorf("Username not found in URI: %v", err)
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
 		return
 	}
 
-	imageSetups, err := api_.store.GetImageSetups(username)
+	imageSetups, err := api_.storeFor(r).GetImageSetups(username)
 
 	if err != nil {
 		http.Error(w, "Failed to find image setups", http.StatusBadRequest)
-		log.Errorf("Username not found in URI: %v", err)
+		requestLog(r).Errorf("Username not found in URI: %v", err)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(imageSetups)
+	writeJSON(w, http.StatusOK, types.NewImageSetups(*imageSetups))
 }
 
 // addImageToImageSetup add an ImageModel to the associated ImageSetup
@@ -209,9 +197,9 @@ func (api_ *API) getImageSetups(w http.ResponseWriter, r *http.Request) {
 // Example response:
 //
 //	{"Name": "Linux Kernel 2",
-//	 "Images": [{"UUIDImage":"3a760707-c160-40fa-81be-430b75131ddc","VersionNumber":3}],
-//	 "User":"ValentijnvdBeek",
-//	 "UUID":"2b59ff94-7fb6-4239-b2e6-82f1e30f4355"}
+//	 "Images": [{"Image": {"UUID": "3a760707-c160-40fa-81be-430b75131ddc", ...}, "Version": {"Version": 3, ...}}],
+//	 "Username": "ValentijnvdBeek",
+//	 "UUID": "2b59ff94-7fb6-4239-b2e6-82f1e30f4355"}
 func (api_ *API) addImageToImageSetup(w http.ResponseWriter, r *http.Request) {
 	imageSetup, err := _getImageSetup(w, r, api_)
 	if err != nil {
@@ -222,15 +210,15 @@ func (api_ *API) addImageToImageSetup(w http.ResponseWriter, r *http.Request) {
 	err = json.NewDecoder(r.Body).Decode(&imageMsg)
 	if err != nil {
 		http.Error(w, "Cannot find image UUID in JSON message.", http.StatusBadRequest)
-		log.Errorf("Cannot find image UUID: %v", err)
+		requestLog(r).Errorf("Cannot find image UUID: %v", err)
 		return
 	}
 
-	image, err := api_.store.GetImageByUUID(images.ImageUUID(imageMsg.UUID))
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(imageMsg.UUID))
 
 	if err != nil {
 		http.Error(w, "Failed to add image to image setups", http.StatusBadRequest)
-		log.Errorf("Cannot find images: %v", err)
+		requestLog(r).Errorf("Cannot find images: %v", err)
 		return
 	}
 
@@ -243,32 +231,32 @@ func (api_ *API) addImageToImageSetup(w http.ResponseWriter, r *http.Request) {
 
 	if targetVersion.ImageModelUUID == "" {
 		http.Error(w, "Failed to add image to image setups", http.StatusBadRequest)
-		log.Errorf("Cannot find images: version %d not found", imageMsg.Version)
+		requestLog(r).Errorf("Cannot find images: version %d not found", imageMsg.Version)
 		return
 	}
 
-	api_.store.AddImageToImageSetup(imageSetup, image, targetVersion, imageMsg.Update)
+	api_.storeFor(r).AddImageToImageSetup(imageSetup, image, targetVersion, imageMsg.Update)
 
-	_ = json.NewEncoder(w).Encode(imageSetup)
+	writeJSON(w, http.StatusOK, types.NewImageSetup(imageSetup))
 }
 
 // deleteImageSetup deletes the image setup from the database
 // Request: DELETE /user/{name}/image_setup/{setup_uuid}
-// Response: Successfully deleted image setup
+// Response: 204 No Content
 func (api_ *API) deleteImageSetup(w http.ResponseWriter, r *http.Request) {
 	setup, err := _getImageSetup(w, r, api_)
 	if err != nil {
 		return
 	}
 
-	err = api_.store.DeleteImageSetup(setup)
+	err = api_.storeFor(r).DeleteImageSetup(setup)
 	if err != nil {
 		http.Error(w, "Failed to delete the image setup.", http.StatusBadRequest)
-		log.Errorf("Delete image setup: %v", err)
+		requestLog(r).Errorf("Delete image setup: %v", err)
 		return
 	}
 
-	http.Error(w, "Successfully deleted image setup", http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // modifyImageSetup modifies the metadata of the image setup, but
@@ -285,20 +273,20 @@ func (api_ *API) modifyImageSetup(w http.ResponseWriter, r *http.Request) {
 	err = json.NewDecoder(r.Body).Decode(&newSetup)
 	if err != nil {
 		http.Error(w, "Cannot decode the request body.", http.StatusBadRequest)
-		log.Errorf("Modify image setup: %v", err)
+		requestLog(r).Errorf("Modify image setup: %v", err)
 		return
 	}
 
 	// Allows for easier objects to be sent over and ensures you
 	// cannot secretly modify a different setup.
 	newSetup.UUID = oldSetup.UUID
-	err = api_.store.ModifyImageSetup(&newSetup)
+	err = api_.storeFor(r).ModifyImageSetup(&newSetup)
 	if err != nil {
 		http.Error(w, "Failed to modify the image setup.", http.StatusBadRequest)
-		log.Errorf("Modify image setup: %v", err)
+		requestLog(r).Errorf("Modify image setup: %v", err)
 		return
 	}
-	_ = json.NewEncoder(w).Encode(newSetup)
+	writeJSON(w, http.StatusOK, types.NewImageSetup(&newSetup))
 }
 
 // RegisterImageSetupHandlers sets the metadata for each of the routes and registers them to the global handler
@@ -307,8 +295,10 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.createImageSetup,
 		Method:      http.MethodPost,
+		Schema:      "image-setup",
 		Description: "Creates an image setup",
 	})
 
@@ -316,6 +306,7 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setups",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
 		Handler:     api_.getImageSetups,
 		Method:      http.MethodGet,
 		Description: "Gets the image setups associated with a user",
@@ -325,6 +316,7 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
 		Handler:     api_.findImageSetupsByUsername,
 		Method:      http.MethodGet,
 		Description: "Find image setups by username",
@@ -334,6 +326,7 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup/{setup_uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
 		Handler:     api_.getImageSetup,
 		Method:      http.MethodGet,
 		Description: "Get a specific image setup",
@@ -343,6 +336,7 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup/{setup_uuid}/images",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
 		Handler:     api_.getImagesFromImageSetup,
 		Method:      http.MethodGet,
 		Description: "Gets the images associated with an image setup",
@@ -352,8 +346,10 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup/{setup_uuid}/images",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.addImageToImageSetup,
 		Method:      http.MethodPost,
+		Schema:      "image-setup-image",
 		Description: "Add image to the setup system",
 	})
 
@@ -361,6 +357,7 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup/{setup_uuid}/images",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.removeImageFromImageSetup,
 		Method:      http.MethodDelete,
 		Description: "Deletes an image from the setup",
@@ -370,6 +367,7 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup/{setup_uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.deleteImageSetup,
 		Method:      http.MethodDelete,
 		Description: "Deletes the image setup",
@@ -379,8 +377,10 @@ func (api_ *API) RegisterImageSetupHandlers() {
 		URI:         "/user/{name}/image_setup/{setup_uuid}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
 		Handler:     api_.modifyImageSetup,
 		Method:      http.MethodPut,
+		Schema:      "image-setup",
 		Description: "Modifies the image setup",
 	})
 }
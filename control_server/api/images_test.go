@@ -7,14 +7,23 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	goimage "image"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
 	"github.com/baas-project/baas/pkg/model/user"
 
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database"
 	"github.com/baas-project/baas/pkg/database/sqlite"
 	"github.com/stretchr/testify/assert"
 )
@@ -41,13 +50,14 @@ func TestApi_CreateImage(t *testing.T) {
 	assert.NoError(t, err)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "/tmp")
+	handler := getHandler(store, "", "/tmp", config.Default())
 	request := httptest.NewRequest(http.MethodPost, "/user/test/image", &mi)
 	request.Header.Add("type", "system")
 	request.Header.Add("origin", "http://localhost:9090")
 
 	handler.ServeHTTP(resp, request)
 	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
 
 	decoded := images.ImageModel{}
 	err = json.NewDecoder(resp.Body).Decode(&decoded)
@@ -62,6 +72,60 @@ func TestApi_CreateImage(t *testing.T) {
 	assert.Equal(t, decoded.UUID, res.UUID)
 	assert.Equal(t, image.Name, res.Name)
 	os.RemoveAll("/tmp/" + string(decoded.UUID))
+
+	// Names only differing in case are the same name, the conflict points to the existing image
+	resp = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodPost, "/user/test/image",
+		bytes.NewBufferString(`{"Name": "YEET", "Username": "test"}`))
+	request.Header.Add("type", "system")
+	handler.ServeHTTP(resp, request)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	var conflict imageConflictError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&conflict))
+	assert.Equal(t, decoded.UUID, conflict.UUID)
+}
+
+// fitsSHA256 is the SHA-256 of "fits"
+const fitsSHA256 = "658ace74701b4d47c76b8caba284b3c55c9c68eb3afe48a6abf97df4dfb15bec"
+
+func TestApi_UploadImageChecksum(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "image", Username: "test", UUID: "checked"}))
+
+	diskpath, err := ioutil.TempDir("", "checksum")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+	assert.NoError(t, os.MkdirAll(diskpath+"/checked", os.ModePerm))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	upload := func(content string, checksum string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "image.img")
+		_, _ = part.Write([]byte(content))
+		_ = form.Close()
+
+		return s.requestWith(http.Header{"Content-Type": {form.FormDataContentType()},
+			"X-BAAS-NewVersion": {"true"}, "X-BAAS-SHA256": {checksum}}, http.MethodPost, "/image/checked",
+			body.String())
+	}
+
+	// Corrupted uploads are thrown away together with their version, the answer tells which checksum arrived
+	resp := upload("fits", "0000")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	var mismatch checksumError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&mismatch))
+	assert.Equal(t, "0000", mismatch.Expected)
+	assert.Equal(t, fitsSHA256, mismatch.Actual)
+	assert.NoFileExists(t, diskpath+"/checked/1.img.part")
+	stored, err := store.GetImageByUUID("checked")
+	assert.NoError(t, err)
+	assert.Len(t, stored.Versions, 1)
+
+	assert.Equal(t, http.StatusOK, upload("fits", fitsSHA256).Code)
+	assert.FileExists(t, diskpath+"/checked/1.img")
 }
 
 func TestApi_GetImage(t *testing.T) {
@@ -86,7 +150,7 @@ func TestApi_GetImage(t *testing.T) {
 	store.CreateImage(&image)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "/tmp")
+	handler := getHandler(store, "", "/tmp", config.Default())
 	request := httptest.NewRequest(http.MethodGet, "/image/def", nil)
 	request.Header.Add("type", "system")
 	request.Header.Add("origin", "http://localhost:9090")
@@ -101,3 +165,312 @@ func TestApi_GetImage(t *testing.T) {
 	assert.Equal(t, image.UUID, decoded.UUID)
 	assert.Equal(t, image.Name, decoded.Name)
 }
+
+func TestApi_GetImagesByUser(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	// Users without images get an empty list rather than null
+	for _, uri := range []string{"/user/test/images", "/user/test/images/Gentoo"} {
+		resp := s.request(http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "[]\n", resp.Body.String())
+	}
+
+	for _, uri := range []string{"/user/tset/images", "/user/tset/images/Gentoo"} {
+		resp := s.request(http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		assert.JSONEq(t, `{"Error": "user not found", "Username": "tset"}`, resp.Body.String())
+	}
+
+	// Listings without the versions only count them
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "Gentoo", Username: "test", UUID: "gentoo"}))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "gentoo"}))
+
+	var listed []images.ImageModel
+	resp := s.request(http.MethodGet, "/user/test/images?include_versions=false", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	if assert.Len(t, listed, 1) {
+		assert.Empty(t, listed[0].Versions)
+		assert.Equal(t, int64(2), listed[0].VersionCount)
+	}
+
+	listed = nil
+	resp = s.request(http.MethodGet, "/user/test/images", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	if assert.Len(t, listed, 1) {
+		assert.Len(t, listed[0].Versions, 2)
+		assert.Equal(t, int64(2), listed[0].VersionCount)
+	}
+}
+
+func TestApi_TrashImage(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "trash-image", ImagePath: "/tmp"}
+	store.CreateImage(&image)
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID, Size: 512})
+	assert.NoError(t, os.MkdirAll("/tmp/trash-image", os.ModePerm))
+	defer os.RemoveAll("/tmp/trash-image")
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	// Deleting only moves the image to the trash, the files stay around and still count as used storage
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/trash-image", "").Code)
+	_, err := store.GetImageByUUID(image.UUID)
+	assert.Error(t, err)
+	assert.DirExists(t, "/tmp/trash-image")
+
+	resp := s.request(http.MethodGet, "/user/test/images/trash", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var trashed []images.ImageModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&trashed))
+	assert.Len(t, trashed, 1)
+
+	resp = s.request(http.MethodGet, "/user/test/storage", "")
+	var usage images.StorageUsage
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+	assert.Equal(t, images.StorageUsage{Used: 512, Trashed: 512}, usage)
+
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPost, "/image/trash-image/restore", "").Code)
+	_, err = store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+
+	// Images which stayed in the trash longer than the retention period are purged together with their files
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/trash-image", "").Code)
+	assert.NoError(t, PurgeTrash(store, "/tmp", time.Hour))
+	assert.DirExists(t, "/tmp/trash-image")
+	assert.NoError(t, PurgeTrash(store, "/tmp", 0))
+	assert.NoDirExists(t, "/tmp/trash-image")
+	_, err = store.GetTrashedImage(image.UUID)
+	assert.Error(t, err)
+}
+
+func TestApi_IntegrityCheck(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+
+	// Duplicate names are refused by the store and reported as conflicts
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "image", Username: "test", UUID: "checked"}))
+	err := store.CreateImage(&images.ImageModel{Name: "image", Username: "test", UUID: "duplicate"})
+	var constraint *database.ConstraintError
+	assert.True(t, errors.As(err, &constraint))
+	assert.Equal(t, database.UniqueConstraint, constraint.Kind)
+
+	err = store.CreateUser(&user.UserModel{Username: "other", Email: "test@example.com", Role: user.User})
+	assert.True(t, errors.As(err, &constraint))
+
+	diskpath, err := ioutil.TempDir("", "integrity")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "checked", Size: 512})
+	assert.NoError(t, os.MkdirAll(diskpath+"/checked", os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(diskpath+"/checked/7.img", nil, 0644))
+	assert.NoError(t, os.MkdirAll(diskpath+"/unknown", os.ModePerm))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	resp := s.request(http.MethodPost, "/admin/integrity-check", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var report database.IntegrityReport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.ElementsMatch(t, []string{diskpath + "/checked/7.img", diskpath + "/unknown"}, report.OrphanedFiles)
+	assert.Equal(t, []string{diskpath + "/checked/1.img"}, report.MissingFiles)
+	assert.Empty(t, report.DanglingReferences)
+
+	resp = s.request(http.MethodPost, "/user",
+		`{"Username": "other", "Name": "Other", "Email": "test@example.com", "Role": "user"}`)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestApi_ImageInfo(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "icon")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "described"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, os.MkdirAll(diskpath+"/described", os.ModePerm))
+
+	conf := config.Default()
+	conf.IconMaxBytes = 1024
+	s := newTestServer(t, store, diskpath, conf)
+	icon := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		return s.requestWith(http.Header{"Content-Type": {contentType}}, http.MethodPut, "/image/described/icon",
+			string(body))
+	}
+
+	image.Description = "# Lab 3\nStarting point for the third lab"
+	image.SourceURL = "ftp://example.com"
+	body, _ := json.Marshal(image)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/image/described", string(body)).Code)
+
+	image.SourceURL = "https://example.com/lab-3"
+	body, _ = json.Marshal(image)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/image/described", string(body)).Code)
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Description, stored.Description)
+	assert.Equal(t, image.SourceURL, stored.SourceURL)
+
+	encode := func(size int) []byte {
+		var buf bytes.Buffer
+		assert.NoError(t, png.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, size, size))))
+		return buf.Bytes()
+	}
+
+	// Only small PNG images are accepted as icons
+	assert.Equal(t, http.StatusUnsupportedMediaType, icon("image/png", []byte("not a png")).Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, icon("image/gif", encode(16)).Code)
+	assert.Equal(t, http.StatusBadRequest, icon("image/png", encode(maxIconDimension+1)).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, icon("image/png", make([]byte, 2048)).Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/image/described/icon", "").Code)
+
+	assert.Equal(t, http.StatusOK, icon("image/png", encode(16)).Code)
+	resp := s.request(http.MethodGet, "/image/described/icon", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, encode(16), resp.Body.Bytes())
+
+	stored, err = store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "/image/described/icon", stored.Icon)
+
+	// The icon goes together with the image when it is purged
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/image/described?purge=true", "").Code)
+	assert.NoFileExists(t, diskpath+"/described/icon.png")
+}
+
+func TestApi_ImageArchitecture(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "arch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	assert.Equal(t, http.StatusBadRequest,
+		s.request(http.MethodPost, "/user/test/image", `{"Name": "mips", "Username": "test", "Architecture": "mips"}`).Code)
+
+	// The architecture is spelled the way the machines spell it
+	resp := s.request(http.MethodPost, "/user/test/image", `{"Name": "arm", "Username": "test", "Architecture": "ARM64"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var arm images.ImageModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&arm))
+	assert.Equal(t, machinemodel.Arm64, arm.Architecture)
+
+	resp = s.request(http.MethodPost, "/user/test/image", `{"Name": "old", "Username": "test"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var old images.ImageModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&old))
+	assert.Equal(t, machinemodel.Unknown, old.Architecture)
+
+	// Leaving the architecture out of an update keeps it
+	arm.Architecture = ""
+	arm.Description = "For the Raspberry Pis"
+	body, _ := json.Marshal(arm)
+	resp = s.request(http.MethodPut, "/image/"+string(arm.UUID), string(body))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&arm))
+	assert.Equal(t, machinemodel.Arm64, arm.Architecture)
+
+	old.Architecture = machinemodel.X86_64
+	body, _ = json.Marshal(old)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/image/"+string(old.UUID), string(body)).Code)
+
+	resp = s.request(http.MethodGet, "/user/test/images?arch=x86_64", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var listed []images.ImageModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, old.UUID, listed[0].UUID)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/user/test/images?arch=mips", "").Code)
+}
+
+func TestApi_Timestamps(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Name: "Admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	var before struct{ CreatedAt, UpdatedAt time.Time }
+	resp := s.requestAs(admin, http.MethodGet, "/user/admin", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &before))
+	assert.False(t, before.CreatedAt.IsZero())
+	assert.NotContains(t, resp.Body.String(), "SessionsRevokedAt")
+
+	// Modifying a user changes UpdatedAt, the creation time cannot be changed by the request
+	time.Sleep(10 * time.Millisecond)
+	resp = s.requestAs(admin, http.MethodPut, "/user/admin", `{"Name": "Renamed", "CreatedAt": "2000-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var after struct {
+		Name                 string
+		CreatedAt, UpdatedAt time.Time
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &after))
+	assert.Equal(t, "Renamed", after.Name)
+	assert.True(t, after.CreatedAt.Equal(before.CreatedAt))
+	assert.True(t, after.UpdatedAt.After(before.UpdatedAt))
+
+	// Uploading a version changes the image, the listing sorted by updates shows it first
+	for _, uuid := range []images.ImageUUID{"old", "new"} {
+		assert.NoError(t, store.CreateImage(&images.ImageModel{Name: string(uuid), Username: "admin", UUID: uuid}))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	created, err := store.GetImageByUUID("old")
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "old"}))
+	assert.NoError(t, store.SetVersionSize("old", 1, 4096))
+	uploaded, err := store.GetImageByUUID("old")
+	assert.NoError(t, err)
+	assert.True(t, uploaded.UpdatedAt.After(created.UpdatedAt))
+	assert.True(t, uploaded.CreatedAt.Equal(created.CreatedAt))
+
+	names := func(uri string) []string {
+		resp := s.requestAs(admin, http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var listed []struct{ Name string }
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &listed))
+		found := []string{}
+		for _, image := range listed {
+			found = append(found, image.Name)
+		}
+		return found
+	}
+
+	assert.Equal(t, []string{"new", "old"}, names("/user/admin/images?sort=created"))
+	assert.Equal(t, []string{"old", "new"}, names("/user/admin/images?sort=created&order=asc"))
+	assert.Equal(t, []string{"old", "new"}, names("/user/admin/images?sort=updated&include_versions=false"))
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(admin, http.MethodGet, "/user/admin/images?sort=name", "").Code)
+
+	// The versions are sorted in the database, the version which was uploaded last comes first
+	resp = s.requestAs(admin, http.MethodGet, "/image/old/versions?sort=updated", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var page struct {
+		Items []struct {
+			Version   uint64
+			UpdatedAt time.Time
+		}
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &page))
+	if assert.Len(t, page.Items, 2) {
+		assert.Equal(t, uint64(1), page.Items[0].Version)
+		assert.False(t, page.Items[0].UpdatedAt.IsZero())
+	}
+}
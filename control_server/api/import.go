@@ -0,0 +1,334 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxImportSize is the largest file accepted by an import, a lab has far fewer machines than fit in it
+const maxImportSize = 4 << 20
+
+// importStatus is what the import did with a row
+type importStatus string
+
+const (
+	importCreated importStatus = "created"
+	importUpdated importStatus = "updated"
+	importSkipped importStatus = "skipped"
+	importError   importStatus = "error"
+)
+
+// importRow is a single machine of an imported file, Line is where it was found. Rows with an error have the HTTP
+// status importing the machine alone would have gotten.
+type importRow struct {
+	Line         int
+	MAC          string
+	Name         string
+	Architecture machinemodel.SystemArchitecture
+	Group        string
+	Status       importStatus
+	Code         int
+	Error        string
+}
+
+// fail marks the row as wrong
+func (row *importRow) fail(code int, err error) {
+	row.Status = importError
+	row.Code = code
+	row.Error = err.Error()
+}
+
+// id is how the caller knows the row, its MAC address or the line when it has none
+func (row *importRow) id() string {
+	if row.MAC == "" {
+		return fmt.Sprintf("line %d", row.Line)
+	}
+
+	return row.MAC
+}
+
+// parseCSVRow reads a line of mac,name,architecture,group. Only the MAC address is required.
+func parseCSVRow(line string) (importRow, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	fields, err := reader.Read()
+	if err != nil {
+		return importRow{}, err
+	}
+
+	if len(fields) > 4 {
+		return importRow{}, fmt.Errorf("expected at most 4 fields but found %d", len(fields))
+	}
+
+	fields = append(fields, make([]string, 4-len(fields))...)
+	return importRow{
+		MAC:          strings.TrimSpace(fields[0]),
+		Name:         strings.TrimSpace(fields[1]),
+		Architecture: machinemodel.SystemArchitecture(strings.TrimSpace(fields[2])),
+		Group:        strings.TrimSpace(fields[3]),
+	}, nil
+}
+
+// parseLeaseRow reads a line of a dnsmasq leases file: expiry, MAC address, IP address, hostname and client id. The
+// hostname is * when the machine did not send one.
+func parseLeaseRow(line string) (importRow, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return importRow{}, fmt.Errorf("expected a lease but found %d fields", len(fields))
+	}
+
+	row := importRow{MAC: fields[1]}
+	if fields[3] != "*" {
+		row.Name = fields[3]
+	}
+
+	return row, nil
+}
+
+// parseImport reads the rows of a CSV or dnsmasq leases file. Without a format the file is taken to be CSV when its
+// first row has a comma in it. Rows which cannot be read are reported as errors instead of failing the whole file.
+func parseImport(body io.Reader, format string) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(body)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if format == "" {
+			format = "leases"
+			if strings.Contains(text, ",") {
+				format = "csv"
+			}
+		}
+
+		var row importRow
+		var err error
+		switch format {
+		case "csv":
+			row, err = parseCSVRow(text)
+			// The header is optional
+			if err == nil && len(rows) == 0 && strings.EqualFold(row.MAC, "mac") {
+				continue
+			}
+		case "leases":
+			// dnsmasq writes the DUID of the server for DHCPv6 leases in the same file
+			if strings.HasPrefix(text, "duid ") {
+				continue
+			}
+			row, err = parseLeaseRow(text)
+		default:
+			return nil, fmt.Errorf("unknown import format %q, expected csv or leases", format)
+		}
+
+		row.Line = line
+		if err != nil {
+			row.fail(http.StatusBadRequest, err)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
+
+// checkImportRow validates a row and normalises its MAC address and architecture. Machines without a name are
+// named after their MAC address, as names must be unique.
+func checkImportRow(row *importRow) error {
+	hw, err := net.ParseMAC(row.MAC)
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("invalid MAC address %q", row.MAC)
+	}
+	row.MAC = hw.String()
+
+	arch, ok := machinemodel.ParseArchitecture(string(row.Architecture))
+	if !ok {
+		return fmt.Errorf("unknown architecture %q", row.Architecture)
+	}
+	row.Architecture = arch
+
+	if row.Name == "" {
+		row.Name = row.MAC
+	}
+
+	return nil
+}
+
+// planImport checks every row against the file and the machines which already exist, and decides what to do with
+// it. The machines to create and to update are only returned when no row has an error.
+func planImport(rows []importRow, existing []machinemodel.MachineModel,
+	updateExisting bool) (created []machinemodel.MachineModel, updated []machinemodel.MachineModel, failed bool) {
+	known := map[string]*machinemodel.MachineModel{}
+	names := map[string]string{}
+	for i := range existing {
+		mac := strings.ToLower(existing[i].MacAddress.Address)
+		known[mac] = &existing[i]
+		names[existing[i].Name] = mac
+	}
+
+	macLines := map[string]int{}
+	nameLines := map[string]int{}
+	for i := range rows {
+		row := &rows[i]
+		if row.Status == importError {
+			failed = true
+			continue
+		}
+
+		if err := checkImportRow(row); err != nil {
+			row.fail(http.StatusBadRequest, err)
+			failed = true
+			continue
+		}
+
+		if err := checkImportDuplicate(row, macLines, nameLines, known, names, updateExisting); err != nil {
+			row.fail(http.StatusConflict, err)
+			failed = true
+			continue
+		}
+
+		machine, ok := known[row.MAC]
+		switch {
+		case !ok:
+			row.Status = importCreated
+			created = append(created, machinemodel.MachineModel{
+				Name:         row.Name,
+				Architecture: row.Architecture,
+				Group:        row.Group,
+				MacAddress:   util.MacAddress{Address: row.MAC},
+			})
+		case machine.Name == row.Name && machine.Group == row.Group:
+			row.Status = importSkipped
+		default:
+			row.Status = importUpdated
+			updated = append(updated, machinemodel.MachineModel{Name: row.Name, Group: row.Group,
+				MacAddress: machine.MacAddress})
+		}
+	}
+
+	// Nothing is imported when any of the rows is wrong
+	if failed {
+		return nil, nil, true
+	}
+
+	return created, updated, false
+}
+
+// checkImportDuplicate refuses MAC addresses and names which appear twice in the file, and the ones of machines which
+// already exist unless those are updated.
+func checkImportDuplicate(row *importRow, macLines map[string]int, nameLines map[string]int,
+	known map[string]*machinemodel.MachineModel, names map[string]string, updateExisting bool) error {
+	if line, ok := macLines[row.MAC]; ok {
+		return fmt.Errorf("MAC address %s is also on line %d", row.MAC, line)
+	}
+	macLines[row.MAC] = row.Line
+
+	if line, ok := nameLines[row.Name]; ok {
+		return fmt.Errorf("name %s is also on line %d", row.Name, line)
+	}
+	nameLines[row.Name] = row.Line
+
+	if _, ok := known[row.MAC]; ok && !updateExisting {
+		return fmt.Errorf("machine %s already exists", row.MAC)
+	}
+
+	if mac, ok := names[row.Name]; ok && mac != row.MAC {
+		return fmt.Errorf("name %s is already used by machine %s", row.Name, mac)
+	}
+
+	return nil
+}
+
+// ImportMachines registers many machines at once from a CSV file of mac,name,architecture,group or from a dnsmasq
+// leases file. The format is given with ?format=csv or ?format=leases, or guessed from the first row. All rows are
+// checked before anything is imported: when any of them is wrong the response is 422 and none are. Machines which
+// already exist are refused, unless ?update_existing=true is given in which case their names and groups are updated.
+// The rows are listed in the order of the file, the message tells whether a machine was created or updated.
+// Example request: POST /machines/import?update_existing=true
+// 52:54:00:d9:71:93,lab-1,x86_64,room-1
+// 52:54:00:d9:71:94,lab-2,x86_64,room-1
+// Example response: {"succeeded": 2, "failed": 0, "skipped": 0, "items": [{"id": "52:54:00:d9:71:93",
+// "status": "succeeded", "message": "created"}, {"id": "52:54:00:d9:71:94", "status": "succeeded", "message": "updated"}]}
+func (api_ *API) ImportMachines(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	rows, err := parseImport(r.Body, strings.ToLower(r.URL.Query().Get("format")))
+	if err != nil {
+		http.Error(w, "Cannot read the import: "+err.Error(), http.StatusBadRequest)
+		requestLog(r).Warnf("Cannot read the import: %v", err)
+		return
+	}
+
+	if len(rows) == 0 {
+		http.Error(w, "There are no machines to import", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := api_.storeFor(r).GetMachines()
+	if ErrorWrite(w, err, "Cannot fetch the machines") != nil {
+		return
+	}
+
+	updateExisting := r.URL.Query().Get("update_existing") == "true"
+	created, updated, failed := planImport(rows, existing, updateExisting)
+
+	result := types.NewMultiStatus()
+	for i := range rows {
+		row := &rows[i]
+		switch {
+		case row.Status == importError:
+			result.Fail(row.id(), row.Code, fmt.Sprintf("line %d: %s", row.Line, row.Error))
+		case failed:
+			result.Skip(row.id(), "not imported, other rows are wrong")
+		case row.Status == importSkipped:
+			result.Skip(row.id(), "unchanged")
+		default:
+			result.Succeed(row.id(), string(row.Status))
+		}
+	}
+
+	if failed {
+		requestLog(r).Warnf("Refused to import machines, %d of the %d rows are wrong", result.Failed, len(rows))
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).ImportMachines(created, updated), "Cannot import the machines") != nil {
+		return
+	}
+
+	log.Infof("Imported machines: %d created or updated and %d unchanged", result.Succeeded, result.Skipped)
+	writeMultiStatus(w, result)
+}
+
+// RegisterImportHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterImportHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machines/import",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     longTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.ImportMachines,
+		Method:      http.MethodPost,
+		Schema:      "machine-import",
+		Description: "Imports machines from a CSV or dnsmasq leases file",
+	})
+}
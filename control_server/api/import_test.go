@@ -0,0 +1,133 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ImportMachines(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "import")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	// The machine images are created without their files when the disk path does not exist, the test does not need
+	// them
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", filepath.Join(diskpath, "missing")))
+
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: "old",
+		MacAddress: util.MacAddress{Address: "52:54:00:00:00:01"}, Architecture: machinemodel.X86_64}))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	post := func(uri string, body string) (*httptest.ResponseRecorder, types.MultiStatus) {
+		resp := s.request(http.MethodPost, uri, body)
+
+		var report types.MultiStatus
+		if resp.Code == http.StatusOK || resp.Code == http.StatusUnprocessableEntity {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		}
+		return resp, report
+	}
+
+	messages := func(report types.MultiStatus) []string {
+		found := []string{}
+		for _, item := range report.Items {
+			found = append(found, item.Message)
+		}
+		return found
+	}
+
+	// A single wrong row keeps the others out as well
+	resp, report := post("/machines/import", "mac,name,architecture,group\n"+
+		"52:54:00:00:00:02,lab-2,x86_64,room-1\n"+
+		"52:54:00:00:00:0g,lab-3\n"+
+		"52:54:00:00:00:02,lab-4\n"+
+		"52:54:00:00:00:05,lab-2\n"+
+		"52:54:00:00:00:06,lab-6,sparc\n"+
+		"52:54:00:00:00:01,lab-1\n"+
+		"52:54:00:00:00:07,old\n")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Len(t, report.Items, 7)
+	assert.Equal(t, types.MultiStatusItem{ID: "52:54:00:00:00:02", Status: types.ItemSkipped,
+		Message: "not imported, other rows are wrong"}, report.Items[0])
+	assert.Equal(t, types.MultiStatusItem{ID: "52:54:00:00:00:02", Status: types.ItemFailed, ErrorCode: "conflict",
+		Message: "line 4: MAC address 52:54:00:00:00:02 is also on line 2"}, report.Items[2])
+	assert.Equal(t, "bad_request", report.Items[1].ErrorCode)
+	assert.Equal(t, "line 7: machine 52:54:00:00:00:01 already exists", report.Items[5].Message)
+	assert.Equal(t, 6, report.Failed)
+	assert.Equal(t, 1, report.Skipped)
+
+	count, err := store.CountMachines()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	resp, report = post("/machines/import", "52:54:00:00:00:02,lab-2,X86_64,room-1\n"+
+		"52-54-00-00-00-03,,arm64\n")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []string{"created", "created"}, messages(report))
+	assert.Equal(t, "52:54:00:00:00:03", report.Items[1].ID)
+	assert.Equal(t, 2, report.Succeeded)
+
+	machine, err := store.GetMachineByMac(util.MacAddress{Address: "52:54:00:00:00:02"})
+	assert.NoError(t, err)
+	assert.Equal(t, "lab-2", machine.Name)
+	assert.Equal(t, "room-1", machine.Group)
+	assert.Equal(t, machinemodel.X86_64, machine.Architecture)
+
+	// MAC addresses are normalised and machines without a name are named after them
+	machine, err = store.GetMachineByMac(util.MacAddress{Address: "52:54:00:00:00:03"})
+	assert.NoError(t, err)
+	assert.Equal(t, "52:54:00:00:00:03", machine.Name)
+	assert.Equal(t, machinemodel.Arm64, machine.Architecture)
+
+	_, err = store.GetMachineImageByMac(util.MacAddress{Address: "52:54:00:00:00:03"})
+	assert.NoError(t, err)
+
+	// Leases of known machines only rename them with update_existing
+	leases := "1643712000 52:54:00:00:00:02 10.0.0.2 lab-2 01:52:54:00:00:00:02\n" +
+		"1643712000 52:54:00:00:00:01 10.0.0.1 lab-1 *\n" +
+		"1643712000 52:54:00:00:00:04 10.0.0.4 * *\n" +
+		"duid 00:01:00:01:29:7a:6d:f5:52:54:00:00:00:ff\n"
+	resp, _ = post("/machines/import?format=leases", leases)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	resp, report = post("/machines/import?format=leases&update_existing=true", leases)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []string{"updated", "updated", "created"}, messages(report))
+
+	machine, err = store.GetMachineByMac(util.MacAddress{Address: "52:54:00:00:00:02"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", machine.Group)
+	assert.Equal(t, machinemodel.X86_64, machine.Architecture)
+
+	machine, err = store.GetMachineByMac(util.MacAddress{Address: "52:54:00:00:00:01"})
+	assert.NoError(t, err)
+	assert.Equal(t, "lab-1", machine.Name)
+
+	resp, report = post("/machines/import?update_existing=true", "52:54:00:00:00:01,lab-1\n")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []types.MultiStatusItem{{ID: "52:54:00:00:00:01", Status: types.ItemSkipped,
+		Message: "unchanged"}}, report.Items)
+
+	resp, _ = post("/machines/import?format=yaml", "52:54:00:00:00:01,lab-1\n")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp, _ = post("/machines/import", "\n# nothing\n")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
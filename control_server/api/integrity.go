@@ -0,0 +1,216 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+)
+
+// checkImageFiles compares the version files on disk with the versions in the database. Machine images are
+// skipped, their files are not tracked as versions. Every storage tier is searched, the directory of an image on
+// another tier than the one it is stored on is orphaned.
+func (api_ *API) checkImageFiles(report *database.IntegrityReport) error {
+	_, machineImages, err := api_.store.GetImageUUIDs()
+	if err != nil {
+		return err
+	}
+
+	roots, err := api_.store.GetImagePaths()
+	if err != nil {
+		return err
+	}
+
+	versions, err := api_.store.GetAllVersions()
+	if err != nil {
+		return err
+	}
+
+	for uuid, root := range roots {
+		if root == "" {
+			roots[uuid] = api_.diskpath
+		}
+	}
+
+	skipped := map[images.ImageUUID]bool{}
+	for _, uuid := range machineImages {
+		skipped[uuid] = true
+	}
+
+	files := map[string]bool{}
+	for _, version := range versions {
+		if skipped[version.ImageModelUUID] {
+			continue
+		}
+
+		root, ok := roots[version.ImageModelUUID]
+		if !ok {
+			root = api_.diskpath
+		}
+
+		path := filepath.Clean(storage.Dir(root, string(version.ImageModelUUID)) + "/" +
+			fmt.Sprintf(images.VersionFileFmt, version.Version))
+		files[path] = true
+
+		// Every image starts out with an empty version 0 which only gets a file on the first upload
+		if version.Version == 0 && version.Size == 0 {
+			continue
+		}
+
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			report.MissingFiles = append(report.MissingFiles, path)
+		}
+	}
+
+	tiers := api_.storageTiers()
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Tiers may share a directory, it is only searched once
+	searched := map[string]bool{}
+	for _, name := range names {
+		if dir := filepath.Clean(tiers[name]); !searched[dir] {
+			searched[dir] = true
+			if err = checkTierFiles(report, tiers[name], roots, skipped, files); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkTierFiles looks for the files in the directory of a tier which no version refers to, the images in the
+// shards as well as those which are still stored in the root
+func checkTierFiles(report *database.IntegrityReport, tier string, roots map[images.ImageUUID]string,
+	skipped map[images.ImageUUID]bool, files map[string]bool) error {
+	dirs, err := ioutil.ReadDir(tier)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || !storage.IsShard(dir.Name()) {
+			continue
+		}
+
+		if err = checkImageDirs(report, tier, filepath.Join(tier, dir.Name()), roots, skipped, files); err != nil {
+			return err
+		}
+	}
+
+	return checkImageDirs(report, tier, tier, roots, skipped, files)
+}
+
+// checkImageDirs looks for the files in the directories of images below parent which no version refers to
+func checkImageDirs(report *database.IntegrityReport, tier string, parent string, roots map[images.ImageUUID]string,
+	skipped map[images.ImageUUID]bool, files map[string]bool) error {
+	dirs, err := ioutil.ReadDir(parent)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		uuid := images.ImageUUID(dir.Name())
+		if !dir.IsDir() || skipped[uuid] || storage.IsShard(dir.Name()) {
+			continue
+		}
+
+		path := filepath.Join(parent, dir.Name())
+		if root, ok := roots[uuid]; !ok || filepath.Clean(root) != filepath.Clean(tier) {
+			report.OrphanedFiles = append(report.OrphanedFiles, path)
+			continue
+		}
+
+		entries, rerr := ioutil.ReadDir(path)
+		if rerr != nil {
+			return rerr
+		}
+
+		for _, entry := range entries {
+			number := strings.TrimSuffix(entry.Name(), ".img")
+			if _, perr := strconv.ParseUint(number, 10, 64); perr != nil || number == entry.Name() {
+				continue
+			}
+
+			if file := filepath.Join(path, entry.Name()); !files[file] {
+				report.OrphanedFiles = append(report.OrphanedFiles, file)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckIntegrity looks for inconsistencies between the database and the files on disk. With ?repair=true the
+// rows referring to rows which no longer exist are removed when they are useless on their own. Files are never
+// touched, they are only reported.
+// Example request: POST /admin/integrity-check?repair=true
+// Example response: {"OrphanedFiles": ["/disks/1f5e.../3.img"], "MissingFiles": [],
+//
+//	"DanglingReferences": [{"Table": "versions", "Column": "image_model_uuid", "Value": "0a7c...",
+//	"Count": 2, "Repaired": true}],
+//	"NameCollisions": [{"Username": "jan", "Images": {"3a76...": "gentoo", "57bf...": "Gentoo"}}],
+//	"InvalidRoles": [{"Username": "piet", "Role": "adminn"}],
+//	"EmailCollisions": [{"Email": "w.narchi@tudelft.nl", "Usernames": ["wnarchi", "wnarchi-1"]}]}
+func (api_ *API) CheckIntegrity(w http.ResponseWriter, r *http.Request) {
+	report := database.IntegrityReport{OrphanedFiles: []string{}, MissingFiles: []string{}}
+
+	dangling, err := api_.storeFor(r).CheckReferences(r.URL.Query().Get("repair") == "true")
+	if ErrorWrite(w, err, "Cannot check the database references") != nil {
+		return
+	}
+	report.DanglingReferences = dangling
+
+	report.NameCollisions, err = api_.storeFor(r).FindNameCollisions()
+	if ErrorWrite(w, err, "Cannot check the image names") != nil {
+		return
+	}
+
+	report.InvalidRoles, err = api_.storeFor(r).FindInvalidRoles()
+	if ErrorWrite(w, err, "Cannot check the roles of the users") != nil {
+		return
+	}
+
+	report.EmailCollisions, err = api_.storeFor(r).FindEmailCollisions()
+	if ErrorWrite(w, err, "Cannot check the email addresses") != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.checkImageFiles(&report), "Cannot check the image files") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// RegisterIntegrityHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterIntegrityHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/integrity-check",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     longTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.CheckIntegrity,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Checks the database and image files for inconsistencies",
+	})
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// lostAgentReason is the detail of the boots whose machine stopped sending heartbeats while flashing
+const lostAgentReason = "the machine stopped sending heartbeats"
+
+// The rules of the janitor, they label what it cleaned up in the logs and the metrics
+const (
+	ruleTempFile = "temp_file"
+	ruleUpload   = "upload"
+	ruleSession  = "session"
+	ruleBoot     = "boot"
+)
+
+var janitorActions = metrics.NewCounter("baas_janitor_actions_total",
+	"Leftovers of crashes which the janitor cleaned up.", "rule")
+
+// janitorRule plans cleaning up one kind of leftover, and cleans it up unless the plan is a dry run
+type janitorRule func(plan *api_pkg.PlannedChanges, now time.Time) error
+
+// isTempFile checks whether a file is written next to its destination until it is complete: the uploads, builds,
+// icons and agent releases are stored as .part files and the disks of machines as .tmp files.
+func isTempFile(name string) bool {
+	return strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".tmp")
+}
+
+// cleaned logs and counts something the janitor cleaned up, a dry run has nothing to tell
+func cleaned(plan *api_pkg.PlannedChanges, rule string, format string, args ...interface{}) {
+	if plan.DryRun {
+		return
+	}
+
+	janitorActions.Inc(rule)
+	log.WithField("rule", rule).Infof("Janitor: "+format, args...)
+}
+
+// uploadTTL is how long an upload can go untouched before the janitor gives up on it
+func (api_ *API) uploadTTL() time.Duration {
+	return time.Duration(api_.config.UploadTTLMinutes) * time.Minute
+}
+
+// collectGarbage cleans up what crashes left behind: temporary files, versions which never received their file,
+// expired sessions, boots of machines which stopped responding and commands they never ran
+func (api_ *API) collectGarbage(dryRun bool) (*api_pkg.PlannedChanges, error) {
+	api_.janitor.Lock()
+	defer api_.janitor.Unlock()
+
+	plan := api_pkg.NewPlannedChanges(dryRun)
+	now := time.Now()
+	for _, rule := range []janitorRule{api_.removeTempFiles, api_.expireUploads, api_.expireSessions,
+		api_.failLostBoots, api_.expireCommands} {
+		if err := rule(plan, now); err != nil {
+			return plan, err
+		}
+	}
+
+	return plan, nil
+}
+
+// removeTempFiles removes the temporary files in the storage tiers which were not written to for longer than the
+// upload TTL. Files which are still being written to are younger than that.
+func (api_ *API) removeTempFiles(plan *api_pkg.PlannedChanges, now time.Time) error {
+	deadline := now.Add(-api_.uploadTTL())
+
+	dirs := []string{}
+	for _, dir := range api_.storageTiers() {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	// Tiers can be stored inside the disk path, their files are only looked at once
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Warnf("Janitor cannot look through %s: %v", path, err)
+				}
+				return nil
+			}
+
+			if seen[path] || !info.Mode().IsRegular() || !isTempFile(info.Name()) || info.ModTime().After(deadline) {
+				return nil
+			}
+			seen[path] = true
+
+			plan.File(path, uint64(info.Size()))
+			if plan.DryRun {
+				return nil
+			}
+
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			cleaned(plan, ruleTempFile, "removed %s, last written %s", path, info.ModTime().Format(time.RFC3339))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expireUploads removes the versions which were created for an upload or a build that never stored their file.
+// They have neither a file nor a checksum, and nothing wrote to their temporary file for longer than the upload
+// TTL. Versions which boots are flashing or going to flash are left alone.
+func (api_ *API) expireUploads(plan *api_pkg.PlannedChanges, now time.Time) error {
+	deadline := now.Add(-api_.uploadTTL())
+
+	versions, err := api_.store.GetAllVersions()
+	if err != nil {
+		return err
+	}
+
+	for i := range versions {
+		// Every image starts out with an empty version 0, it only gets a file on the first upload
+		version := &versions[i]
+		if version.Version == 0 || version.SHA256 != "" || version.CreatedAt.After(deadline) {
+			continue
+		}
+
+		// The versions of images in the trash go when the trash is purged
+		image, err := api_.store.GetImageByUUID(version.ImageModelUUID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		path := api_.versionFile(image, version.Version)
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+
+		if info, err := os.Stat(path + ".part"); err == nil && info.ModTime().After(deadline) {
+			continue
+		}
+
+		locks, err := api_.imageLocks(image.UUID, &version.Version)
+		if err != nil {
+			return err
+		}
+
+		blockers, err := api_.versionBlockers(image, version)
+		if err != nil {
+			return err
+		}
+
+		if len(locks) != 0 || len(blockers) != 0 {
+			continue
+		}
+
+		plan.Row(api_pkg.PlanDelete, "version", string(image.UUID)+"/"+strconv.FormatUint(version.Version, 10))
+		if plan.DryRun {
+			continue
+		}
+
+		if err = api_.store.DeleteVersion(version); err != nil {
+			return err
+		}
+
+		cleaned(plan, ruleUpload, "removed version %d of image %s, its upload never finished", version.Version,
+			image.UUID)
+	}
+
+	return nil
+}
+
+// expireSessions forgets the sessions which expired, the users which did not use them since can no longer either
+func (api_ *API) expireSessions(plan *api_pkg.PlannedChanges, now time.Time) error {
+	expired, err := api_.store.GetSessionsExpiredBefore(now)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range expired {
+		plan.Row(api_pkg.PlanDelete, "session", session.ID)
+		if plan.DryRun {
+			continue
+		}
+
+		if err = api_.store.DeleteSession(session.ID); err != nil {
+			return err
+		}
+
+		cleaned(plan, ruleSession, "forgot the session of %s which expired at %s", session.Username,
+			session.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// failLostBoots fails the boots of machines which sent no heartbeat for longer than the boot timeout, which
+// releases the locks on the images they were flashing
+func (api_ *API) failLostBoots(plan *api_pkg.PlannedChanges, now time.Time) error {
+	active, err := api_.store.GetActiveBoots()
+	if err != nil {
+		return err
+	}
+
+	deadline := now.Add(-time.Duration(api_.config.BootTimeoutMinutes) * time.Minute)
+	for i := range active {
+		boot := &active[i]
+		if boot.LastSeen.After(deadline) {
+			continue
+		}
+
+		plan.Row(api_pkg.PlanModify, "boot", strconv.FormatUint(uint64(boot.ID), 10))
+		if plan.DryRun {
+			continue
+		}
+
+		boot.Fail(images.FailureAgentLost, lostAgentReason)
+		if err = api_.store.UpdateBootHistory(boot); err != nil {
+			return err
+		}
+
+		cleaned(plan, ruleBoot, "machine %s stopped responding while flashing %s, releasing its locks",
+			boot.MachineMAC, boot.SetupUUID)
+		api_.alert(config.EventMachineOffline, boot.MachineMAC,
+			fmt.Sprintf("Machine %s stopped responding", boot.MachineMAC),
+			fmt.Sprintf("Machine %s sent no heartbeat for %d minutes while flashing image setup %s, its boot failed.",
+				boot.MachineMAC, api_.config.BootTimeoutMinutes, boot.SetupUUID))
+	}
+
+	return nil
+}
+
+// startJanitor runs the janitor at startup and then every JanitorIntervalMinutes in the background
+func (api_ *API) startJanitor() {
+	interval := time.Duration(api_.config.JanitorIntervalMinutes) * time.Minute
+
+	go func() {
+		for {
+			if _, err := api_.collectGarbage(false); err != nil {
+				log.Errorf("Janitor: %v", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// CollectGarbage runs the janitor now instead of waiting for its next run, it answers with what was cleaned up.
+// With ?dry_run=true it only lists what it would clean up.
+// Example request: POST /admin/gc?dry_run=true
+// Example response: {"DryRun": true, "Rows": [{"Action": "modify", "Kind": "boot", "Key": "12"}],
+//
+//	"Files": ["/disks/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/3.img.part"], "Bytes": 1048576, "Blockers": []}
+func (api_ *API) CollectGarbage(w http.ResponseWriter, r *http.Request) {
+	plan, err := api_.collectGarbage(isDryRun(r))
+	if ErrorWrite(w, err, "Cannot collect the garbage") != nil {
+		return
+	}
+
+	if plan.DryRun {
+		writePlan(w, r, plan)
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{"rows": len(plan.Rows), "files": len(plan.Files), "bytes": plan.Bytes}).
+		Info("Collected the garbage")
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// RegisterJanitorHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterJanitorHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/gc",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     longTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.CollectGarbage,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Cleans up temporary files, unfinished uploads, expired sessions, lost boots and commands",
+	})
+}
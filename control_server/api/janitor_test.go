@@ -0,0 +1,115 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_Janitor(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "other", Email: "other@example.com", Role: user.User}))
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+
+	diskpath, err := ioutil.TempDir("", "janitor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+	assert.NoError(t, os.MkdirAll(filepath.Join(diskpath, "image"), os.ModePerm))
+
+	long := time.Now().Add(-48 * time.Hour)
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "image"}
+	assert.NoError(t, store.CreateImage(&image))
+
+	// Version 1 was stored, the upload of version 2 crashed and version 3 is still being uploaded
+	for version := uint64(1); version <= 3; version++ {
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Model: gorm.Model{CreatedAt: long},
+			Version: version, ImageModelUUID: image.UUID}))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(diskpath, "image", "1.img"), []byte("stored"), 0644))
+	stale := filepath.Join(diskpath, "image", "2.img.part")
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("crashed"), 0644))
+	assert.NoError(t, os.Chtimes(stale, long, long))
+	uploading := filepath.Join(diskpath, "image", "3.img.part")
+	assert.NoError(t, ioutil.WriteFile(uploading, []byte("uploading"), 0644))
+
+	// Recording a session forgets the expired ones of the same user, the janitor forgets those of everyone
+	assert.NoError(t, store.CreateSession(&user.SessionModel{ID: "expired", Username: "other",
+		Kind: user.SessionBrowser, ExpiresAt: long}))
+	assert.NoError(t, store.CreateSession(&user.SessionModel{ID: "valid", Username: "test",
+		Kind: user.SessionBrowser, ExpiresAt: time.Now().Add(time.Hour)}))
+
+	boot := images.BootHistory{MachineMAC: "abc", SetupUUID: "setup", State: images.BootInProgress, LastSeen: long}
+	assert.NoError(t, store.AddBootHistory(&boot))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	collect := func(uri string) *api_pkg.PlannedChanges {
+		resp := s.request(http.MethodPost, uri, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var plan api_pkg.PlannedChanges
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&plan))
+		return &plan
+	}
+
+	// A dry run lists what would be cleaned up without touching it
+	before := janitorActions.Value(ruleBoot)
+	plan := collect("/admin/gc?dry_run=true")
+	assert.True(t, plan.DryRun)
+	assert.Equal(t, []string{stale}, plan.Files)
+	assert.Equal(t, []api_pkg.PlannedRow{
+		{Action: api_pkg.PlanDelete, Kind: "version", Key: "image/2"},
+		{Action: api_pkg.PlanDelete, Kind: "session", Key: "expired"},
+		{Action: api_pkg.PlanModify, Kind: "boot", Key: "1"},
+	}, plan.Rows)
+	assert.FileExists(t, stale)
+	assert.Equal(t, before, janitorActions.Value(ruleBoot))
+
+	plan = collect("/admin/gc")
+	assert.False(t, plan.DryRun)
+	assert.Len(t, plan.Rows, 3)
+	assert.Equal(t, before+1, janitorActions.Value(ruleBoot))
+
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	assert.FileExists(t, uploading)
+
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	assert.Nil(t, stored.FindVersion(2))
+	assert.NotNil(t, stored.FindVersion(3))
+
+	_, err = store.GetSession("expired")
+	assert.Error(t, err)
+	_, err = store.GetSession("valid")
+	assert.NoError(t, err)
+
+	history, err := store.GetBootHistory("abc", database.BootFilter{}, database.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, images.BootFailed, history[0].State)
+	assert.Equal(t, images.FailureAgentLost, history[0].FailureReason)
+	assert.Equal(t, lostAgentReason, history[0].FailureDetail)
+
+	// Nothing is left for the next run
+	plan = collect("/admin/gc")
+	assert.Empty(t, plan.Files)
+	assert.Empty(t, plan.Rows)
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// jobRunning jobs are still at work
+	jobRunning = "running"
+	// jobSucceeded jobs are done
+	jobSucceeded = "succeeded"
+	// jobFailed jobs gave up, their error tells why
+	jobFailed = "failed"
+)
+
+const (
+	// jobUpload stores an uploaded file as a version of an image
+	jobUpload = "upload"
+)
+
+const (
+	// phaseReceiving uploads are reading the file from the uploader
+	phaseReceiving = "receiving"
+	// phaseVerifying uploads are hashing the file they received, to compare it with the checksum of the uploader
+	phaseVerifying = "verifying"
+	// phaseStoring uploads are checking the format of the file, converting it, and storing it as the version
+	phaseStoring = "storing"
+)
+
+// jobHeader names the job of a request in its response
+const jobHeader = "X-BAAS-Job"
+
+// jobRetention is how long finished jobs can be looked up
+const jobRetention = time.Hour
+
+// jobKeepAlive is how often the event stream sends a comment, so proxies do not close it while nothing happens
+const jobKeepAlive = 15 * time.Second
+
+// progressJob is work which the control server does for a user and which takes long enough for them to follow it
+type progressJob struct {
+	ID      string
+	Kind    string
+	Owner   string
+	Image   images.ImageUUID `json:",omitempty"`
+	Version uint64           `json:",omitempty"`
+	State   string
+	// Phase is the step the job is at, Percent how far along that step it is
+	Phase   string
+	Percent int
+	Error   string `json:",omitempty"`
+	// Details is the answer the request would have gotten when the job failed, such as the expected and the actual
+	// checksum of an upload which got corrupted
+	Details    json.RawMessage `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// jobTracker keeps the jobs until a while after they finished, and tells their owners how they are doing
+type jobTracker struct {
+	mu       sync.Mutex
+	jobs     map[string]*progressJob
+	watchers map[string]map[chan progressJob]struct{}
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: map[string]*progressJob{}, watchers: map[string]map[chan progressJob]struct{}{}}
+}
+
+// begin starts a job of the owner at its first phase
+func (j *jobTracker) begin(kind string, owner string, image images.ImageUUID, phase string) progressJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Finished jobs are forgotten once nobody is expected to look for them anymore
+	for id, job := range j.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > jobRetention {
+			delete(j.jobs, id)
+		}
+	}
+
+	job := &progressJob{ID: uuid.New().String(), Kind: kind, Owner: owner, Image: image, State: jobRunning,
+		Phase: phase, StartedAt: time.Now()}
+	j.jobs[job.ID] = job
+	j.publish(job)
+	return *job
+}
+
+// update changes a running job, its owner is only told when something changed
+func (j *jobTracker) update(id string, change func(job *progressJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok || job.State != jobRunning {
+		return
+	}
+
+	before := *job
+	change(job)
+	if job.Phase != before.Phase || job.Percent != before.Percent || job.Version != before.Version ||
+		job.State != before.State {
+		j.publish(job)
+	}
+}
+
+// progress moves a job to a phase and tells how far along it is
+func (j *jobTracker) progress(id string, phase string, percent int) {
+	j.update(id, func(job *progressJob) {
+		job.Phase = phase
+		job.Percent = percent
+	})
+}
+
+// setVersion records the version a job is working on once it is known
+func (j *jobTracker) setVersion(id string, version uint64) {
+	j.update(id, func(job *progressJob) {
+		job.Version = version
+	})
+}
+
+// finish ends a job with the answer of its work. Answers which are not successful fail the job, their message
+// becomes the error of the job and JSON answers are kept as its details.
+func (j *jobTracker) finish(id string, answer *jobResponse) {
+	j.update(id, func(job *progressJob) {
+		now := time.Now()
+		job.FinishedAt = &now
+		job.State = jobSucceeded
+		job.Percent = 100
+		if answer.code() < http.StatusBadRequest {
+			return
+		}
+
+		job.State = jobFailed
+		job.Error = strings.TrimSpace(answer.body.String())
+		var message struct{ Error string }
+		if json.Unmarshal(answer.body.Bytes(), &message) == nil {
+			job.Details = append(json.RawMessage{}, answer.body.Bytes()...)
+			job.Error = message.Error
+		}
+		if job.Error == "" {
+			job.Error = http.StatusText(answer.code())
+		}
+	})
+}
+
+// get returns a copy of a job, it is false when there is no such job
+func (j *jobTracker) get(id string) (progressJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return progressJob{}, false
+	}
+
+	return *job, true
+}
+
+// watch follows the jobs of an owner until it is stopped. Updates which do not fit in the channel are dropped, the
+// job itself always has the latest state.
+func (j *jobTracker) watch(owner string) (chan progressJob, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	updates := make(chan progressJob, 64)
+	if j.watchers[owner] == nil {
+		j.watchers[owner] = map[chan progressJob]struct{}{}
+	}
+	j.watchers[owner][updates] = struct{}{}
+
+	return updates, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		delete(j.watchers[owner], updates)
+		if len(j.watchers[owner]) == 0 {
+			delete(j.watchers, owner)
+		}
+	}
+}
+
+// publish tells the watchers of the owner of a job about it, the lock has to be held
+func (j *jobTracker) publish(job *progressJob) {
+	for updates := range j.watchers[job.Owner] {
+		select {
+		case updates <- *job:
+		default:
+		}
+	}
+}
+
+// progressReader reports how much of a phase of a job is read
+type progressReader struct {
+	io.Reader
+	jobs  *jobTracker
+	id    string
+	phase string
+	total int64
+	read  int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.read += int64(n)
+	if p.total > 0 {
+		percent := int(p.read * 100 / p.total)
+		if percent > 99 {
+			percent = 99
+		}
+		p.jobs.progress(p.id, p.phase, percent)
+	}
+
+	return n, err
+}
+
+// reader reports the progress of a phase of a job while r is read, total is how much will be read or zero when that
+// is not known
+func (j *jobTracker) reader(id string, phase string, r io.Reader, total int64) io.Reader {
+	j.progress(id, phase, 0)
+	return &progressReader{Reader: r, jobs: j, id: id, phase: phase, total: total}
+}
+
+// jobResponse keeps the answer of the work of a job, and passes it on to the request while it still waits for the
+// job
+type jobResponse struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newJobResponse(w http.ResponseWriter) *jobResponse {
+	return &jobResponse{ResponseWriter: w, header: http.Header{}}
+}
+
+// detach stops passing the answer on, the request was answered before the job finished
+func (a *jobResponse) detach() {
+	a.ResponseWriter = nil
+}
+
+func (a *jobResponse) Header() http.Header {
+	if a.ResponseWriter != nil {
+		return a.ResponseWriter.Header()
+	}
+
+	return a.header
+}
+
+func (a *jobResponse) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	if a.ResponseWriter != nil {
+		a.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (a *jobResponse) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	a.body.Write(b)
+	if a.ResponseWriter != nil {
+		return a.ResponseWriter.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// code is the status of the answer
+func (a *jobResponse) code() int {
+	if a.status == 0 {
+		return http.StatusOK
+	}
+
+	return a.status
+}
+
+// respondAsync reports whether the client asked to be answered before the work of its request is done
+func respondAsync(r *http.Request) bool {
+	for _, preference := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetJob tells how a job is doing. Users see their own jobs, administrators and machines see every job.
+// Example request: GET /jobs/0b7e1c52-2f5c-4a43-9b6e-8f1f4a3d2c10
+// Example response: {"ID": "0b7e1c52-2f5c-4a43-9b6e-8f1f4a3d2c10", "Kind": "upload", "Owner": "jan",
+// "Image": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Version": 3, "State": "running", "Phase": "verifying",
+// "Percent": 42, "StartedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := api_.jobs.get(mux.Vars(r)["id"])
+	principal := api_.principal(r)
+	if !ok || (principal.Kind == PrincipalUser && principal.Role != user.Admin && job.Owner != principal.Name) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// StreamEvents follows the jobs of the user as server-sent events, every change to one of their jobs is sent as the
+// job as it is after the change
+// Example request: GET /events
+// Example response:
+//
+//	event: job
+//	data: {"ID": "0b7e1c52-2f5c-4a43-9b6e-8f1f4a3d2c10", "Kind": "upload", "State": "running", ...}
+func (api_ *API) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "The connection cannot stream the events", http.StatusInternalServerError)
+		return
+	}
+
+	updates, stop := api_.jobs.watch(api_.requester(r))
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(jobKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case job := <-updates:
+			body, err := json.Marshal(job)
+			if err != nil {
+				return
+			}
+
+			if _, err = fmt.Fprintf(w, "event: job\ndata: %s\n\n", body); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// RegisterJobHandlers sets the metadata for the routes which let users follow their jobs
+func (api_ *API) RegisterJobHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/jobs/{id}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetJob,
+		Method:      http.MethodGet,
+		Description: "Gets the phase and the progress of a job",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/events",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.StreamEvents,
+		Method:      http.MethodGet,
+		Description: "Follows the jobs of the user as server-sent events",
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_UploadJobs(t *testing.T) {
+	store := newTestStore(t)
+	jan := &user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}
+	piet := &user.UserModel{Username: "piet", Email: "piet@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{jan, piet} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "image", Username: "jan", UUID: "uploaded"}))
+
+	diskpath, err := ioutil.TempDir("", "jobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+	assert.NoError(t, os.MkdirAll(diskpath+"/uploaded", os.ModePerm))
+
+	// The uploads are not disks, they are only accepted as they are
+	conf := config.Default()
+	conf.UploadFormats = append(conf.UploadFormats, string(images.FormatUnknown))
+	s := newTestServer(t, store, diskpath, conf)
+	upload := func(checksum string, prefer string) *http.Request {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "image.img")
+		_, _ = part.Write([]byte("fits"))
+		_ = form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/image/uploaded", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-BAAS-NewVersion", "true")
+		req.Header.Set("X-BAAS-SHA256", checksum)
+		req.Header.Set("Prefer", prefer)
+		s.login(req, jan)
+		return req
+	}
+	finished := func(id string) progressJob {
+		var job progressJob
+		assert.Eventually(t, func() bool {
+			resp := s.requestAs(jan, http.MethodGet, "/jobs/"+id, "")
+			return resp.Code == http.StatusOK && json.NewDecoder(resp.Body).Decode(&job) == nil &&
+				job.State != jobRunning
+		}, 5*time.Second, 10*time.Millisecond)
+		return job
+	}
+
+	// Uploaders who do not wait are answered once the file arrived, the job tells what went wrong afterwards
+	resp := s.serve(upload("0000", "respond-async"))
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	var accepted progressJob
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+	assert.Equal(t, "/jobs/"+accepted.ID, resp.Header().Get("Location"))
+	assert.Equal(t, accepted.ID, resp.Header().Get(jobHeader))
+	assert.Equal(t, "jan", accepted.Owner)
+	assert.Equal(t, uint64(1), accepted.Version)
+
+	failed := finished(accepted.ID)
+	assert.Equal(t, jobFailed, failed.State)
+	assert.Equal(t, phaseVerifying, failed.Phase)
+	assert.Contains(t, failed.Error, fitsSHA256)
+	assert.Contains(t, failed.Error, "0000")
+	var mismatch checksumError
+	assert.NoError(t, json.Unmarshal(failed.Details, &mismatch))
+	assert.Equal(t, "0000", mismatch.Expected)
+	assert.Equal(t, fitsSHA256, mismatch.Actual)
+	assert.NoFileExists(t, diskpath+"/uploaded/1.img.part")
+
+	// Other users do not find the job, administrators and machines do
+	assert.Equal(t, http.StatusNotFound, s.requestAs(piet, http.MethodGet, "/jobs/"+accepted.ID, "").Code)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodGet, "/jobs/"+accepted.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/jobs/unknown", "").Code)
+
+	// The owner follows their jobs over the event stream
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	assert.NoError(t, err)
+	s.login(req, jan)
+	stream, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer stream.Body.Close()
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+
+	// Uploaders who wait get the answer as before, with the job which was followed meanwhile
+	resp = s.serve(upload(fitsSHA256, ""))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	done := finished(resp.Header().Get(jobHeader))
+	assert.Equal(t, jobSucceeded, done.State)
+	assert.Equal(t, 100, done.Percent)
+	assert.Empty(t, done.Error)
+	assert.FileExists(t, diskpath+"/uploaded/1.img")
+
+	var phases []string
+	events := bufio.NewScanner(stream.Body)
+	for events.Scan() {
+		data := strings.TrimPrefix(events.Text(), "data: ")
+		if data == events.Text() {
+			continue
+		}
+
+		var job progressJob
+		assert.NoError(t, json.Unmarshal([]byte(data), &job))
+		assert.Equal(t, done.ID, job.ID)
+		if len(phases) == 0 || phases[len(phases)-1] != job.Phase {
+			phases = append(phases, job.Phase)
+		}
+		if job.State != jobRunning {
+			assert.Equal(t, jobSucceeded, job.State)
+			break
+		}
+	}
+	assert.Equal(t, []string{phaseReceiving, phaseVerifying, phaseStoring}, phases)
+}
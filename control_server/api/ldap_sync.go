@@ -0,0 +1,335 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/directory"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/validation"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// memberDirectory lists the users who are in the groups which grant roles
+type memberDirectory interface {
+	Members() ([]directory.Member, error)
+}
+
+// syncAction is what the synchronization does to a user
+type syncAction string
+
+const (
+	syncCreate   syncAction = "create"
+	syncRole     syncAction = "role"
+	syncConflict syncAction = "conflict"
+	syncDisable  syncAction = "disable"
+	syncEnable   syncAction = "enable"
+	syncSkip     syncAction = "skip"
+)
+
+// syncChange is a single change to a user, Role is the role the user ends up with
+type syncChange struct {
+	Action       syncAction
+	Username     string
+	Role         user.UserRole `json:",omitempty"`
+	PreviousRole user.UserRole `json:",omitempty"`
+	// Reason explains conflicts and the members which were skipped
+	Reason string `json:",omitempty"`
+}
+
+// syncReport lists the changes of a synchronization, a dry run only plans them. The planned changes list the users
+// which are created or modified.
+type syncReport struct {
+	api_pkg.PlannedChanges
+	Members int
+	Changes []syncChange
+}
+
+// errNoMembers refuses to synchronize with an empty directory, which is far more likely a broken one than one
+// everyone left
+var errNoMembers = errors.New("the LDAP groups have no members")
+
+// syncer applies the members of the directory to the users in the store
+type syncer struct {
+	store     database.Store
+	conflicts string
+	report    *syncReport
+}
+
+// apply carries a change out, or only records it in a dry run
+func (s *syncer) apply(change syncChange, do func() error) error {
+	if !s.report.DryRun {
+		if err := do(); err != nil {
+			return fmt.Errorf("%s %s: %w", change.Action, change.Username, err)
+		}
+	}
+
+	action := api_pkg.PlanModify
+	if change.Action == syncCreate {
+		action = api_pkg.PlanCreate
+	}
+
+	s.report.Changes = append(s.report.Changes, change)
+	s.report.Row(action, "user", change.Username)
+	return nil
+}
+
+// skip records a member which cannot be created
+func (s *syncer) skip(username string, reason string) {
+	log.Warnf("LDAP synchronization skips %s: %s", username, reason)
+	s.report.Changes = append(s.report.Changes, syncChange{Action: syncSkip, Username: username, Reason: reason})
+}
+
+// create adds a member who has no account yet
+func (s *syncer) create(member *directory.Member) error {
+	if reasons := validation.Username(member.Username); len(reasons) != 0 {
+		s.skip(member.Username, "invalid username: "+strings.Join(reasons, ", "))
+		return nil
+	}
+
+	email, reasons := validation.Email(member.Email)
+	if len(reasons) != 0 {
+		s.skip(member.Username, "invalid email address: "+strings.Join(reasons, ", "))
+		return nil
+	}
+
+	owner, err := s.store.GetUserByEmail(email)
+	if err == nil {
+		s.skip(member.Username, "the email address is used by "+owner.Username)
+		return nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	name := member.Name
+	if name == "" {
+		name = member.Username
+	}
+
+	created := user.UserModel{Username: member.Username, Name: name, Email: email, Role: member.Role,
+		LDAPRole: member.Role}
+	return s.apply(syncChange{Action: syncCreate, Username: member.Username, Role: member.Role}, func() error {
+		return s.store.CreateUser(&created)
+	})
+}
+
+// update brings the role of an existing user in line with their groups. A role above the one of the groups, which
+// the synchronization did not give, was handed out by hand and is a conflict.
+func (s *syncer) update(existing *user.UserModel, member *directory.Member) error {
+	if existing.Disabled {
+		enable := func() error { return s.store.SetUserDisabled(existing.Username, false) }
+		if err := s.apply(syncChange{Action: syncEnable, Username: existing.Username}, enable); err != nil {
+			return err
+		}
+	}
+
+	role := member.Role
+	if existing.Role.Outranks(member.Role) && existing.Role != existing.LDAPRole {
+		reason := fmt.Sprintf("promoted to %s by hand, the LDAP groups grant %s", existing.Role, member.Role)
+		if s.conflicts == config.ManualWins {
+			role = existing.Role
+			reason += ", the manual role is kept"
+		} else {
+			reason += ", the LDAP role is restored"
+		}
+
+		log.Warnf("LDAP synchronization conflict for %s: %s", existing.Username, reason)
+		s.report.Changes = append(s.report.Changes, syncChange{Action: syncConflict, Username: existing.Username,
+			Role: role, PreviousRole: existing.Role, Reason: reason})
+	}
+
+	if role == existing.Role && member.Role == existing.LDAPRole {
+		return nil
+	}
+
+	modified := user.UserModel{Username: existing.Username, Role: role, LDAPRole: member.Role}
+	do := func() error { return s.store.ModifyUser(&modified) }
+	if role == existing.Role {
+		// Only the role the groups grant changed, which is nothing to report but still modifies the user
+		s.report.Row(api_pkg.PlanModify, "user", existing.Username)
+		if s.report.DryRun {
+			return nil
+		}
+
+		return do()
+	}
+
+	return s.apply(syncChange{Action: syncRole, Username: existing.Username, Role: role,
+		PreviousRole: existing.Role}, do)
+}
+
+// SyncDirectory creates the members of the directory who have no account, gives the users the roles of their groups
+// and, when disable is set, disables the users it manages who left all groups. Users the synchronization never
+// managed are left alone, as are users who were merged into another one.
+func SyncDirectory(store database.Store, members []directory.Member, conflicts string, disable bool,
+	dryRun bool) (*syncReport, error) {
+	if len(members) == 0 {
+		return nil, errNoMembers
+	}
+
+	users, err := store.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]*user.UserModel{}
+	for i := range users {
+		existing[users[i].Username] = &users[i]
+	}
+
+	s := syncer{store: store, conflicts: conflicts,
+		report: &syncReport{PlannedChanges: *api_pkg.NewPlannedChanges(dryRun), Members: len(members),
+			Changes: []syncChange{}}}
+	listed := map[string]bool{}
+	for i := range members {
+		member := &members[i]
+		listed[member.Username] = true
+
+		found, ok := existing[member.Username]
+		switch {
+		case !ok:
+			err = s.create(member)
+		case found.MergedInto != "":
+			s.skip(member.Username, "the account was merged into "+found.MergedInto)
+		default:
+			err = s.update(found, member)
+		}
+
+		if err != nil {
+			return s.report, err
+		}
+	}
+
+	for i := range users {
+		u := &users[i]
+		if !disable || listed[u.Username] || u.LDAPRole == "" || u.Disabled || u.MergedInto != "" {
+			continue
+		}
+
+		change := syncChange{Action: syncDisable, Username: u.Username, Reason: "left all LDAP groups"}
+		if err = s.apply(change, func() error { return store.SetUserDisabled(u.Username, true) }); err != nil {
+			return s.report, err
+		}
+	}
+
+	return s.report, nil
+}
+
+// logSyncReport logs the changes of a synchronization
+func logSyncReport(report *syncReport) {
+	verb := "Applied"
+	if report.DryRun {
+		verb = "Planned"
+	}
+
+	for _, change := range report.Changes {
+		if change.Action == syncConflict || change.Action == syncSkip {
+			continue
+		}
+
+		log.WithFields(log.Fields{"username": change.Username, "role": change.Role}).
+			Infof("%s LDAP change %s", verb, change.Action)
+	}
+}
+
+// StartLDAPSync periodically synchronizes the users with the LDAP groups in the background
+func StartLDAPSync(store database.Store, dir memberDirectory, conf *config.Config) {
+	interval := time.Duration(conf.LDAPSyncMinutes) * time.Minute
+	if interval == 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		for {
+			members, err := dir.Members()
+			var report *syncReport
+			if err == nil {
+				report, err = SyncDirectory(store, members, conf.LDAPConflicts, conf.LDAPDisableRemoved,
+					conf.LDAPDryRun)
+			}
+
+			if report != nil {
+				logSyncReport(report)
+			}
+
+			if err != nil {
+				log.Errorf("LDAP synchronization: %v", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// SyncLDAP synchronizes the users with the LDAP groups right away. With ?dry_run=true nothing is changed, the
+// response lists what would be.
+// Example request: POST /admin/sync/ldap?dry_run=true
+// Example response: {"DryRun": true, "Members": 2, "Changes": [{"Action": "create", "Username": "jan", "Role": "user"},
+// {"Action": "conflict", "Username": "piet", "Role": "admin", "PreviousRole": "admin", "Reason": "..."}]}
+func (api_ *API) SyncLDAP(w http.ResponseWriter, r *http.Request) {
+	if !api_.config.LDAPSync {
+		http.Error(w, "The LDAP synchronization is not enabled", http.StatusNotFound)
+		return
+	}
+
+	dir := api_.directory
+	if dir == nil {
+		ldap, err := directory.NewLDAP(api_.config)
+		if ErrorWrite(w, err, "The LDAP configuration is invalid") != nil {
+			return
+		}
+		dir = ldap
+	}
+
+	members, err := dir.Members()
+	if err != nil {
+		requestLog(r).Errorf("Cannot read the LDAP groups: %v", err)
+		http.Error(w, "Cannot read the LDAP groups: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	dryRun := isDryRun(r)
+	report, err := SyncDirectory(api_.storeFor(r), members, api_.config.LDAPConflicts, api_.config.LDAPDisableRemoved,
+		dryRun)
+	if report != nil {
+		logSyncReport(report)
+		for _, change := range report.Changes {
+			api_.users.forget(change.Username)
+		}
+	}
+
+	if errors.Is(err, errNoMembers) {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if ErrorWrite(w, err, "The LDAP synchronization failed") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// RegisterLDAPHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterLDAPHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/sync/ldap",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     longTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SyncLDAP,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Synchronizes the users and their roles with the LDAP groups",
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/directory"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDirectory []directory.Member
+
+func (d fakeDirectory) Members() ([]directory.Member, error) {
+	return d, nil
+}
+
+func TestApi_SyncLDAP(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, u := range []user.UserModel{
+		{Username: "alice", Email: "alice@example.com", Role: user.User},
+		// Promoted by hand, LDAP only makes bob a user
+		{Username: "bob", Email: "bob@example.com", Role: user.Admin},
+		{Username: "carol", Email: "carol@example.com", Role: user.User, LDAPRole: user.User},
+		{Username: "local", Email: "local@example.com", Role: user.Moderator},
+	} {
+		u := u
+		assert.NoError(t, store.CreateUser(&u))
+	}
+
+	members := fakeDirectory{
+		{Username: "alice", Email: "alice@example.com", Role: user.Admin},
+		{Username: "bob", Email: "bob@example.com", Role: user.User},
+		{Username: "dave", Name: "Dave", Email: "dave@Example.com", Role: user.Moderator},
+		{Username: "eve", Email: "local@example.com", Role: user.User},
+	}
+
+	conf := config.Default()
+	conf.LDAPSync = true
+	conf.LDAPDisableRemoved = true
+	api := NewAPI(store, "/tmp", conf)
+	api.directory = members
+
+	sync := func(query string) syncReport {
+		resp := httptest.NewRecorder()
+		api.SyncLDAP(resp, httptest.NewRequest(http.MethodPost, "/admin/sync/ldap"+query, nil))
+		assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+		var report syncReport
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		return report
+	}
+
+	actions := func(report syncReport) map[string]syncAction {
+		found := map[string]syncAction{}
+		for _, change := range report.Changes {
+			found[change.Username] = change.Action
+		}
+		return found
+	}
+
+	expected := map[string]syncAction{"alice": syncRole, "bob": syncConflict, "carol": syncDisable, "dave": syncCreate,
+		"eve": syncSkip}
+
+	// A dry run plans the changes without making them
+	report := sync("?dry_run=true")
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 4, report.Members)
+	assert.Equal(t, expected, actions(report))
+	assert.Contains(t, report.Rows, api_pkg.PlannedRow{Action: api_pkg.PlanCreate, Kind: "user", Key: "dave"})
+	assert.Contains(t, report.Rows, api_pkg.PlannedRow{Action: api_pkg.PlanModify, Kind: "user", Key: "carol"})
+
+	alice, err := store.GetUserByUsername("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, user.User, alice.Role)
+	_, err = store.GetUserByUsername("dave")
+	assert.Error(t, err)
+
+	report = sync("")
+	assert.False(t, report.DryRun)
+	assert.Equal(t, expected, actions(report))
+
+	for username, role := range map[string]user.UserRole{"alice": user.Admin, "bob": user.Admin,
+		"carol": user.User, "dave": user.Moderator, "local": user.Moderator} {
+		u, err := store.GetUserByUsername(username)
+		assert.NoError(t, err, username)
+		assert.Equal(t, role, u.Role, username)
+		assert.Equal(t, username == "carol", u.Disabled, username)
+	}
+
+	dave, err := store.GetUserByUsername("dave")
+	assert.NoError(t, err)
+	assert.Equal(t, "dave@example.com", dave.Email)
+	assert.Equal(t, user.Moderator, dave.LDAPRole)
+
+	// Disabled users cannot use their sessions anymore
+	_, err = api.lookupUser("carol")
+	assert.ErrorIs(t, err, errUserDisabled)
+
+	// The manual promotion stays a conflict, until LDAP wins it. Carol is back in a group and enabled again.
+	conf.LDAPConflicts = config.LDAPWins
+	api.directory = append(members, directory.Member{Username: "carol", Email: "carol@example.com",
+		Role: user.User})
+	report = sync("")
+	assert.Equal(t, map[string]syncAction{"bob": syncRole, "carol": syncEnable, "eve": syncSkip}, actions(report))
+
+	bob, err := store.GetUserByUsername("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, user.User, bob.Role)
+
+	carol, err := store.GetUserByUsername("carol")
+	assert.NoError(t, err)
+	assert.False(t, carol.Disabled)
+
+	// A directory without members is refused rather than disabling everyone
+	api.directory = fakeDirectory{}
+	resp := httptest.NewRecorder()
+	api.SyncLDAP(resp, httptest.NewRequest(http.MethodPost, "/admin/sync/ldap", nil))
+	assert.Equal(t, http.StatusBadGateway, resp.Code)
+}
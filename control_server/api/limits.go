@@ -0,0 +1,250 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/limits"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// limitError is the body of a response to a request which would exceed a limit
+type limitError struct {
+	Error     string
+	Limit     string
+	Max       uint64
+	Current   uint64
+	Requested uint64
+}
+
+func newLimitError(exceeded *limits.ExceededError) limitError {
+	return limitError{
+		Error:     exceeded.Error(),
+		Limit:     exceeded.Limit,
+		Max:       exceeded.Max,
+		Current:   exceeded.Current,
+		Requested: exceeded.Requested,
+	}
+}
+
+// userLimits are the limits of a user together with the overrides they are made of
+type userLimits struct {
+	Limits    user.Limits
+	Overrides *user.LimitOverrides
+}
+
+// checkLimits verifies that the action keeps the user within their limits and answers the request when it does not.
+func (api_ *API) checkLimits(w http.ResponseWriter, username string, action limits.Action) bool {
+	err := limits.Check(api_.store, username, action)
+	if err == nil {
+		return true
+	}
+
+	var exceeded *limits.ExceededError
+	if !errors.As(err, &exceeded) {
+		_ = ErrorWrite(w, err, "Cannot check the limits of the user")
+		return false
+	}
+
+	log.Infof("Refused request of %s: %v", username, err)
+	api_.alertExceeded(username, err.Error())
+	writeJSON(w, exceeded.StatusCode(), newLimitError(exceeded))
+	return false
+}
+
+// getRole fetches the role from the URI, only roles which can be granted to users have limits
+func getRole(w http.ResponseWriter, r *http.Request) (user.UserRole, error) {
+	role, err := GetTag("role", r)
+	if TagErrorWrite(w, err) != nil {
+		return "", err
+	}
+
+	parsed, err := user.ParseRole(role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+
+	return parsed, err
+}
+
+// GetRoleLimits gets the default limits of a role, a limit of 0 means there is no limit
+// Example request: GET /admin/limits/user
+// Example response: {"Role": "user", "StorageBytes": 53687091200, "MaxImages": 10, "MaxVersions": 0,
+//
+//	"MaxQueuedBoots": 2, "MaxActiveBoots": 0}
+func (api_ *API) GetRoleLimits(w http.ResponseWriter, r *http.Request) {
+	role, err := getRole(w, r)
+	if err != nil {
+		return
+	}
+
+	roleLimits, err := api_.storeFor(r).GetRoleLimits(role)
+	if ErrorWrite(w, err, "Cannot get the limits of the role") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, roleLimits)
+}
+
+// SetRoleLimits replaces the default limits of a role
+// Example request: PUT /admin/limits/user
+// Example body: {"StorageBytes": 53687091200, "MaxImages": 10, "MaxQueuedBoots": 2, "MaxActiveBoots": 0}
+// Example response: {"Role": "user", "StorageBytes": 53687091200, "MaxImages": 10, "MaxVersions": 0,
+//
+//	"MaxQueuedBoots": 2, "MaxActiveBoots": 0}
+func (api_ *API) SetRoleLimits(w http.ResponseWriter, r *http.Request) {
+	role, err := getRole(w, r)
+	if err != nil {
+		return
+	}
+
+	roleLimits := user.RoleLimits{}
+	if err = json.NewDecoder(r.Body).Decode(&roleLimits.Limits); err != nil {
+		http.Error(w, "invalid limits given", http.StatusBadRequest)
+		log.Errorf("decode limits: %v", err)
+		return
+	}
+	roleLimits.Role = role
+
+	if ErrorWrite(w, api_.storeFor(r).SetRoleLimits(&roleLimits), "Cannot store the limits of the role") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, roleLimits)
+}
+
+// GetUserLimits gets the limits which apply to a user and which of those are overridden for them
+// Example request: GET /user/Jan/limits
+// Example response: {"Limits": {"StorageBytes": 107374182400, "MaxImages": 10, "MaxVersions": 0,
+//
+//	"MaxQueuedBoots": 2, "MaxActiveBoots": 5}, "Overrides": {"Username": "Jan", "StorageBytes": 107374182400,
+//	"MaxImages": null, "MaxVersions": null, "MaxQueuedBoots": null, "MaxActiveBoots": null}}
+func (api_ *API) GetUserLimits(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	effective, err := limits.Effective(api_.storeFor(r), name)
+	if err != nil {
+		http.Error(w, "cannot find the user", http.StatusNotFound)
+		log.Errorf("get limits of %s: %v", name, err)
+		return
+	}
+
+	overrides, err := api_.storeFor(r).GetLimitOverrides(name)
+	if ErrorWrite(w, err, "Cannot get the limits of the user") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userLimits{Limits: effective, Overrides: overrides})
+}
+
+// SetUserLimits overrides limits of the role for a single user, limits which are null are taken from the role
+// Example request: PUT /user/Jan/limits
+// Example body: {"StorageBytes": 107374182400}
+// Example response: {"Username": "Jan", "StorageBytes": 107374182400, "MaxImages": null, "MaxVersions": null,
+//
+//	"MaxQueuedBoots": null, "MaxActiveBoots": null}
+func (api_ *API) SetUserLimits(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	if _, err = api_.storeFor(r).GetUserByUsername(name); err != nil {
+		http.Error(w, "cannot find the user", http.StatusNotFound)
+		log.Errorf("set limits of %s: %v", name, err)
+		return
+	}
+
+	overrides := user.LimitOverrides{}
+	if err = json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+		http.Error(w, "invalid limits given", http.StatusBadRequest)
+		log.Errorf("decode limits: %v", err)
+		return
+	}
+	overrides.Username = name
+
+	if StoreErrorWrite(w, api_.storeFor(r).SetLimitOverrides(&overrides), "Cannot store the limits of the user") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, overrides)
+}
+
+// DeleteUserLimits removes the overrides of a user, so the limits of their role apply again
+// Example request: DELETE /user/Jan/limits
+func (api_ *API) DeleteUserLimits(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteLimitOverrides(name), "Cannot remove the limits of the user") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterLimitHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterLimitHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/limits/{role}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetRoleLimits,
+		Method:      http.MethodGet,
+		Description: "Gets the default limits of a role",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/limits/{role}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetRoleLimits,
+		Method:      http.MethodPut,
+		Schema:      "role-limits",
+		Description: "Sets the default limits of a role",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/limits",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeUsersRead,
+		Handler:     api_.GetUserLimits,
+		Method:      http.MethodGet,
+		Description: "Gets the limits which apply to a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/limits",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetUserLimits,
+		Method:      http.MethodPut,
+		Schema:      "user-limits",
+		Description: "Overrides the limits of the role of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/limits",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.DeleteUserLimits,
+		Method:      http.MethodDelete,
+		Description: "Removes the overridden limits of a user",
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Limits(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	createImage := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(images.ImageModel{Name: "image", Username: "test"})
+		return s.request(http.MethodPost, "/image", string(body))
+	}
+
+	resp := s.request(http.MethodPut, "/admin/limits/user", `{"MaxImages": 1}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/admin/limits/wizard", "").Code)
+
+	resp = createImage()
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var image images.ImageModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&image))
+	assert.NoError(t, os.MkdirAll("/tmp/"+string(image.UUID), os.ModePerm))
+	defer os.RemoveAll("/tmp/" + string(image.UUID))
+
+	// The refusal names the limit which is in the way
+	resp = createImage()
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	var refused limitError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refused))
+	assert.Equal(t, limitError{Error: "limit MaxImages of 1 exceeded", Limit: "MaxImages", Max: 1, Current: 1,
+		Requested: 2}, refused)
+
+	// Overrides of the user take precedence over the limits of the role
+	resp = s.request(http.MethodPut, "/user/test/limits", `{"StorageBytes": 4}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	resp = s.request(http.MethodGet, "/user/test/limits", "")
+	var limits userLimits
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&limits))
+	assert.Equal(t, user.Limits{StorageBytes: 4, MaxImages: 1}, limits.Limits)
+
+	// Uploads which do not fit are thrown away together with the version created for them
+	upload := func(content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "image.img")
+		_, _ = part.Write([]byte(content))
+		_ = form.Close()
+
+		header := http.Header{
+			"Content-Type":      []string{form.FormDataContentType()},
+			"X-Baas-Newversion": []string{"true"},
+		}
+		return s.requestWith(header, http.MethodPost, "/image/"+string(image.UUID), body.String())
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload("too large").Code)
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, stored.Versions, 1)
+	assert.NoFileExists(t, "/tmp/"+string(image.UUID)+"/1.img.part")
+
+	assert.Equal(t, http.StatusOK, upload("fits").Code)
+	assert.FileExists(t, "/tmp/"+string(image.UUID)+"/1.img")
+
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/user/test/limits", "").Code)
+	assert.Equal(t, http.StatusOK, upload("no limit").Code)
+}
+
+func TestApi_ActiveBoots(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	moderator := &user.UserModel{Username: "mod", Email: "mod@example.com", Role: user.Moderator}
+	alice := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, moderator, alice} {
+		assert.NoError(t, store.CreateUser(u))
+
+		image := images.ImageModel{Name: "image", Username: u.Username, UUID: images.ImageUUID(u.Username)}
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+		stored, err := store.GetImageByUUID(image.UUID)
+		assert.NoError(t, err)
+
+		setup := images.ImageSetup{Name: "setup", UUID: images.ImageUUID(u.Username + "-setup"), Username: u.Username}
+		assert.NoError(t, store.CreateImageSetup(u.Username, &setup))
+		store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(1), false)
+	}
+
+	// Machines 0 to 3 are in the lab, 4 to 7 are not
+	mac := func(i int) string {
+		return fmt.Sprintf("52:54:00:00:00:%02d", i)
+	}
+	for i := 0; i < 8; i++ {
+		m := machinemodel.MachineModel{Name: fmt.Sprintf("machine %d", i), Architecture: machinemodel.X86_64,
+			MacAddress: util.MacAddress{Address: mac(i)}}
+		if i < 4 {
+			m.Group = "lab"
+		}
+		assert.NoError(t, store.CreateMachine(&m))
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	boot := func(as *user.UserModel, uri string) *httptest.ResponseRecorder {
+		return s.requestAs(as, http.MethodPost, uri, fmt.Sprintf(`{"SetupUUID": "%s-setup"}`, as.Username))
+	}
+
+	// Boots which are being flashed count towards the cap as well
+	assert.Equal(t, http.StatusOK, boot(alice, "/machine/"+mac(4)+"/boot").Code)
+	assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: mac(5), SetupUUID: "alice-setup",
+		State: images.BootInProgress}))
+
+	resp := s.requestAs(admin, http.MethodPut, "/user/alice/limits", `{"MaxActiveBoots": 4}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// The group is only booted up to the cap
+	resp = boot(alice, "/machine-group/lab/boot")
+	assert.Equal(t, http.StatusMultiStatus, resp.Code)
+	var result types.MultiStatus
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Equal(t, 2, result.Failed)
+	assert.Equal(t, mac(0), result.Items[0].ID)
+	assert.Equal(t, types.MultiStatusItem{ID: mac(2), Status: types.ItemFailed, ErrorCode: "forbidden",
+		Message: "limit MaxActiveBoots of 4 exceeded"}, result.Items[2])
+
+	// Users cannot pass the cap, and the refusal tells them where they stand
+	resp = boot(alice, "/machine/"+mac(6)+"/boot?override=true")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	var refused limitError
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &refused))
+	assert.Equal(t, uint64(4), refused.Current)
+	assert.Equal(t, uint64(4), refused.Max)
+
+	// Without an override of their own users have the cap of the configuration
+	assert.Equal(t, http.StatusNoContent, s.requestAs(admin, http.MethodDelete, "/user/alice/limits", "").Code)
+	assert.Equal(t, http.StatusOK, boot(alice, "/machine/"+mac(6)+"/boot").Code)
+	assert.Equal(t, http.StatusForbidden, boot(alice, "/machine/"+mac(7)+"/boot").Code)
+
+	// Moderators and admins may pass the cap when they ask to
+	resp = s.requestAs(admin, http.MethodPut, "/user/mod/limits", `{"MaxActiveBoots": 1}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusOK, boot(moderator, "/machine/"+mac(4)+"/boot").Code)
+	assert.Equal(t, http.StatusForbidden, boot(moderator, "/machine/"+mac(5)+"/boot").Code)
+	assert.Equal(t, http.StatusOK, boot(moderator, "/machine/"+mac(5)+"/boot?override=true").Code)
+}
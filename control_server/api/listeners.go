@@ -0,0 +1,202 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// The names of the listeners, which label their requests in the logs and the metrics
+const (
+	primaryListenerName = "primary"
+	agentListenerName   = "agent"
+)
+
+var (
+	requestsServed = metrics.NewCounter("baas_http_requests_total", "Requests answered by the API.", "listener",
+		"status")
+	openConnections = metrics.NewGauge("baas_http_connections", "Connections open to the API.", "listener")
+)
+
+// listener is an address the API is served on. Once the agents have a listener of their own, the primary listener
+// no longer serves their routes. A listener which is everyoneOnly serves neither the users nor the agents.
+type listener struct {
+	Name         string
+	split        bool
+	everyoneOnly bool
+}
+
+// primaryListener serves the users, and the agents as well unless they have a listener of their own
+func primaryListener(split bool) listener {
+	return listener{Name: primaryListenerName, split: split}
+}
+
+// agentListener serves the management OS and the boot services
+func agentListener() listener {
+	return listener{Name: agentListenerName, split: true}
+}
+
+// plainAgentListener serves the agents without TLS. Once they have to present a client certificate, it only serves
+// the routes for everyone, otherwise a machine without one could skip the TLS listener.
+func plainAgentListener(mutualTLS bool) listener {
+	return listener{Name: agentListenerName, split: true, everyoneOnly: mutualTLS}
+}
+
+// serves checks whether the listener serves the routes of an audience
+func (l listener) serves(audience Audience) bool {
+	switch {
+	case audience == AudienceEveryone:
+		return true
+	case l.everyoneOnly:
+		return false
+	case l.Name == agentListenerName:
+		return audience == AudienceAgents
+	default:
+		return !l.split || audience == AudienceUsers
+	}
+}
+
+// countingListener counts the connections which are open on a listener. When slots is not nil, connections past
+// its capacity are only accepted once another one closes.
+type countingListener struct {
+	net.Listener
+	name  string
+	slots chan struct{}
+}
+
+// newCountingListener counts the connections of a listener, and keeps at most max of them open unless max is zero
+func newCountingListener(inner net.Listener, name string, max uint) *countingListener {
+	l := &countingListener{Listener: inner, name: name}
+	if max != 0 {
+		l.slots = make(chan struct{}, max)
+	}
+
+	return l
+}
+
+// Accept waits for a free slot and then for the next connection
+func (l *countingListener) Accept() (net.Conn, error) {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	openConnections.Add(1, l.name)
+	return &countedConn{Conn: conn, listener: l}, nil
+}
+
+// release frees the slot of a connection
+func (l *countingListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// countedConn gives its slot back to its listener when it is closed
+type countedConn struct {
+	net.Conn
+	listener *countingListener
+	once     sync.Once
+}
+
+// Close closes the connection, the slot is freed only once however often it is closed
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		openConnections.Add(-1, c.listener.name)
+		c.listener.release()
+	})
+
+	return err
+}
+
+// agentTLSConfig serves the agents over TLS with the certificate of the control server. With a client CA they have
+// to present a certificate issued by it.
+func (api_ *API) agentTLSConfig(certs *certReloader) (*tls.Config, error) {
+	conf := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if api_.config.AgentClientCAFile == "" {
+		return conf, nil
+	}
+
+	pem, err := ioutil.ReadFile(api_.config.AgentClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("AgentClientCAFile holds no certificates")
+	}
+
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	return conf, nil
+}
+
+// agentServer serves the agents with the timeouts of their listeners
+func (api_ *API) agentServer(staticDir string, l listener) *http.Server {
+	return &http.Server{
+		Handler:           api_.router(staticDir, l),
+		ReadHeaderTimeout: time.Duration(api_.config.AgentReadHeaderTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(api_.config.AgentIdleTimeoutSeconds) * time.Second,
+	}
+}
+
+// serveAgents serves the routes of the agents on AgentAddress, and over TLS on AgentTLSAddress when it is set. With
+// AgentClientCAFile they are only served over TLS, AgentAddress keeps serving the routes for everyone.
+func (api_ *API) serveAgents(staticDir string, certs *certReloader) error {
+	mutualTLS := api_.config.AgentClientCAFile != ""
+
+	plain, err := net.Listen("tcp", api_.config.AgentAddress)
+	if err != nil {
+		return err
+	}
+
+	if api_.config.AgentTLSAddress != "" {
+		tlsConf, err := api_.agentTLSConfig(certs)
+		if err != nil {
+			return err
+		}
+
+		secure, err := net.Listen("tcp", api_.config.AgentTLSAddress)
+		if err != nil {
+			return err
+		}
+
+		srv := api_.agentServer(staticDir, agentListener())
+		limited := newCountingListener(secure, agentListenerName, api_.config.AgentMaxConnections)
+		go func() {
+			log.Fatalf("Agent TLS listener: %v", srv.Serve(tls.NewListener(limited, tlsConf)))
+		}()
+	}
+
+	srv := api_.agentServer(staticDir, plainAgentListener(mutualTLS))
+	go func() {
+		limited := newCountingListener(plain, agentListenerName, api_.config.AgentMaxConnections)
+		log.Fatalf("Agent listener: %v", srv.Serve(limited))
+	}()
+
+	log.Infof("Serving the agents on %s", api_.config.AgentAddress)
+	return nil
+}
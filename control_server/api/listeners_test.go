@@ -0,0 +1,178 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_AgentListener(t *testing.T) {
+	store := newTestStore(t)
+
+	api := NewAPI(store, "/tmp", config.Default())
+	api.registerRoutes()
+
+	listen := func(l listener) *testServer {
+		return &testServer{t: t, store: store, api: api, handler: api.router("", l)}
+	}
+	status := func(s *testServer, method string, uri string) int {
+		return s.request(method, uri, "").Code
+	}
+	// The heartbeat of a machine which is not flashing is not found either, but not for lack of a route
+	routed := func(s *testServer, method string, uri string) bool {
+		resp := s.request(method, uri, "")
+		return resp.Code != http.StatusMethodNotAllowed && !strings.Contains(resp.Body.String(), "no such route")
+	}
+
+	// A single listener serves everything
+	all := listen(primaryListener(false))
+	assert.True(t, routed(all, http.MethodPost, "/machine/abc/boot/heartbeat"))
+	assert.Equal(t, http.StatusOK, status(all, http.MethodGet, "/users"))
+
+	// Once the agents have a listener of their own, the primary listener only serves the users
+	primary := listen(primaryListener(true))
+	agents := listen(agentListener())
+	assert.False(t, routed(primary, http.MethodPost, "/machine/abc/boot/heartbeat"))
+	assert.False(t, routed(primary, http.MethodGet, "/v1/boot/abc"))
+	assert.True(t, routed(agents, http.MethodPost, "/machine/abc/boot/heartbeat"))
+	assert.Equal(t, http.StatusOK, status(primary, http.MethodGet, "/users"))
+	assert.Equal(t, http.StatusNotFound, status(agents, http.MethodGet, "/users"))
+	assert.Equal(t, http.StatusNotFound, status(agents, http.MethodGet, "/user/login/github"))
+
+	// Both serve the routes for everyone
+	assert.Equal(t, http.StatusOK, status(primary, http.MethodGet, "/version"))
+	assert.Equal(t, http.StatusOK, status(agents, http.MethodGet, "/version"))
+
+	// The requests are counted by listener
+	before := requestsServed.Value(agentListenerName, "200")
+	assert.Equal(t, http.StatusOK, status(agents, http.MethodGet, "/version"))
+	assert.Equal(t, before+1, requestsServed.Value(agentListenerName, "200"))
+}
+
+func TestApi_AgentMutualTLS(t *testing.T) {
+	store := newTestStore(t)
+
+	dir, err := ioutil.TempDir("", "agent-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := testCertificate(t, "control-server", false)
+	certs := &certReloader{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	assert.NoError(t, ioutil.WriteFile(certs.certFile, serverCert, 0600))
+	assert.NoError(t, ioutil.WriteFile(certs.keyFile, serverKey, 0600))
+
+	// The machine certificate is its own CA
+	machineCert, machineKey := testCertificate(t, "machine", true)
+	conf := config.Default()
+	conf.AgentClientCAFile = filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(conf.AgentClientCAFile, machineCert, 0600))
+
+	api := NewAPI(store, "/tmp", conf)
+	api.registerRoutes()
+	tlsConf, err := api.agentTLSConfig(certs)
+	assert.NoError(t, err)
+
+	secure := httptest.NewUnstartedServer(api.router("", agentListener()))
+	secure.TLS = tlsConf
+	secure.StartTLS()
+	defer secure.Close()
+	plain := httptest.NewServer(api.router("", plainAgentListener(true)))
+	defer plain.Close()
+
+	// routed tells whether the listener has the route, without a certificate the request does not get that far
+	routed := func(server *httptest.Server, certificates []tls.Certificate, uri string) (bool, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates:       certificates,
+			InsecureSkipVerify: true,
+		}}}
+		req, err := http.NewRequest(http.MethodGet, server.URL+uri, nil)
+		assert.NoError(t, err)
+		req.Header.Add("type", "system")
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "no such route"), nil
+	}
+
+	// Without a certificate issued by the CA the agent routes cannot be reached, not over plain HTTP either
+	_, err = routed(secure, nil, "/machine/abc/boot")
+	assert.Error(t, err)
+	ok, err := routed(plain, nil, "/machine/abc/boot")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The routes for everyone stay on the plain listener
+	ok, err = routed(plain, nil, "/version")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	machine, err := tls.X509KeyPair(machineCert, machineKey)
+	assert.NoError(t, err)
+	ok, err = routed(secure, []tls.Certificate{machine}, "/machine/abc/boot")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestCountingListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l := newCountingListener(inner, "test", 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", inner.Addr().String())
+	assert.NoError(t, err)
+	defer first.Close()
+	conn := <-accepted
+	assert.Equal(t, float64(1), openConnections.Value("test"))
+
+	// The second connection waits until the first one closes
+	second, err := net.Dial("tcp", inner.Addr().String())
+	assert.NoError(t, err)
+	defer second.Close()
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Closing a connection twice frees its slot once
+	assert.NoError(t, conn.Close())
+	_ = conn.Close()
+	select {
+	case conn = <-accepted:
+		assert.NoError(t, conn.Close())
+	case <-time.After(time.Second):
+		t.Fatal("the second connection was not accepted")
+	}
+	assert.Equal(t, float64(0), openConnections.Value("test"))
+}
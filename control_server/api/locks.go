@@ -0,0 +1,437 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// imageLocks finds the boots in progress which are flashing an image. When version is given only the boots
+// flashing that particular version are returned.
+func (api_ *API) imageLocks(uuid images.ImageUUID, version *uint64) ([]images.BootHistory, error) {
+	active, err := api_.store.GetActiveBoots()
+	if err != nil {
+		return nil, err
+	}
+
+	locks := []images.BootHistory{}
+	for _, boot := range active {
+		if boot.ResolvedVersions.Includes(uuid, version) {
+			locks = append(locks, boot)
+		}
+	}
+
+	return locks, nil
+}
+
+// checkUnlocked makes sure nobody is flashing the image (version) before it is modified. When it is locked a
+// 423 listing the boots holding the lock is written and false is returned.
+func (api_ *API) checkUnlocked(w http.ResponseWriter, uuid images.ImageUUID, version *uint64) bool {
+	locks, err := api_.imageLocks(uuid, version)
+	if ErrorWrite(w, err, "Cannot check the image locks") != nil {
+		return false
+	}
+
+	if len(locks) == 0 {
+		return true
+	}
+
+	writeJSON(w, http.StatusLocked, struct {
+		Error string
+		Locks []images.BootHistory
+	}{"the image is being flashed onto a machine", locks})
+
+	return false
+}
+
+// BootHeartbeat lets the management OS tell that it is still flashing the machine. Management OSes serving images
+// to other machines send the versions they hold along, those are recorded even when the machine is done flashing.
+// The response tells the management OS to stop flashing when someone cancelled the boot. The clock of the management
+// OS in the X-BAAS-Clock header is compared with ours.
+// Example request: POST /machine/52:54:00:d9:71:93/boot/heartbeat
+// Example body: {"Port": 4849, "Token": "5b0f...", "Versions": [{"ImageUUID": "74368cec-...", "Version": 2}]}
+// Example response: {"boot_id": 12, "cancel_requested": false}
+func (api_ *API) BootHeartbeat(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var body *images.PeerHeartbeat
+	var peerBody images.PeerHeartbeat
+	switch err = json.NewDecoder(r.Body).Decode(&peerBody); err {
+	case nil:
+		body = &peerBody
+	case io.EOF:
+		// Management OSes which do not serve images send an empty heartbeat
+	default:
+		http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+
+	if api_.peers != nil {
+		host, _, herr := net.SplitHostPort(r.RemoteAddr)
+		if herr != nil {
+			host = r.RemoteAddr
+		}
+
+		api_.peers.heartbeat(mac, host, body)
+	}
+
+	api_.recordClock(r, mac)
+
+	// Boots which are being flashed are not refused for their protocol, the agent finds out at its next claim
+	agent, _ := agentProtocol(r)
+	protocol := api_pkg.NegotiateProtocol(agent)
+	setVersionHeaders(w, protocol)
+	api_.stampVersions(r, mac, protocol)
+
+	n, err := api_.storeFor(r).TouchActiveBoot(mac)
+	if ErrorWrite(w, err, "Cannot update the boot") != nil {
+		return
+	}
+
+	if n == 0 {
+		http.Error(w, "The machine is not flashing anything", http.StatusNotFound)
+		return
+	}
+
+	boot, err := api_.storeFor(r).GetActiveBoot(mac)
+	if ErrorWrite(w, err, "Cannot fetch the boot") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, images.BootControl{BootID: boot.ID, CancelRequested: boot.CancelRequestedAt != nil})
+}
+
+// requester names who made a request for the history, the management OS and other services are the system
+func (api_ *API) requester(r *http.Request) string {
+	if username := api_.sessionUsername(r); username != "" {
+		return username
+	}
+
+	return "system"
+}
+
+// ownsSetup checks whether the user behind a request owns an image setup
+func (api_ *API) ownsSetup(r *http.Request, uuid images.ImageUUID) bool {
+	setup, err := api_.storeFor(r).GetImageSetup(string(uuid))
+	username := api_.sessionUsername(r)
+	return err == nil && username != "" && username == setup.Username
+}
+
+// SetBootState finishes the boot a machine is flashing, which releases the locks on its images. The management
+// OS reports completed or failed, users can cancel the boots of their own image setups.
+// Example request: PUT /machine/52:54:00:d9:71:93/boot/state
+// The management OS tells which disk it wrote the images to with TargetDevice, and which versions it wrote with
+// Flashed. Image sets are only completed once every member is flashed, otherwise the boot fails with 422.
+// Example body: {"State": "completed", "TargetDevice": "/dev/sda",
+//
+//	"Flashed": [{"ImageUUID": "3a760707-c160-40fa-81be-430b75131ddc", "Version": 3}]}
+//
+// Boots which read the images back report what they found with Verification, a mismatch does not fail the boot.
+// Example body: {"State": "completed", "Verification": [{"ImageUUID": "3a760707-...", "Version": 3, "Mode": "quick",
+//
+//	"Verified": false, "Checked": 18874368, "Written": 2147483648, "Mismatches": [1073741824]}]}
+//
+// Failed boots tell why with FailureReason, and the error itself with FailureDetail.
+// Example body: {"State": "failed", "FailureReason": "checksum_mismatch",
+//
+//	"FailureDetail": "the checksum 9f86d0... of the download does not match 2c26b4..."}
+//
+// Example response: {"MachineMAC": "52:54:00:d9:71:93", "State": "completed", ...}
+func (api_ *API) SetBootState(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var body images.BootReport
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid boot state", http.StatusBadRequest)
+		return
+	}
+
+	switch body.State {
+	case images.BootCompleted, images.BootFailed, images.BootCancelled:
+	default:
+		http.Error(w, "State must be one of completed, failed or cancelled", http.StatusBadRequest)
+		return
+	}
+
+	boot, err := api_.storeFor(r).GetActiveBoot(mac)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The machine is not flashing anything", http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the boot") != nil {
+		return
+	}
+
+	if !api_.isAdmin(r) && (body.State != images.BootCancelled || !api_.ownsSetup(r, boot.SetupUUID)) {
+		http.Error(w, "Only the owner of the image setup can cancel this boot", http.StatusForbidden)
+		return
+	}
+
+	// A boot cancelled through DELETE /machine/{mac}/boot/{id} keeps who asked for it, the management OS only
+	// confirms it stopped
+	if body.State == images.BootCancelled && boot.CancelledBy == "" {
+		boot.CancelledBy = api_.requester(r)
+	}
+
+	// Users cancelling a boot did not write anything
+	if body.TargetDevice != "" && api_.isAdmin(r) {
+		boot.TargetDevice = body.TargetDevice
+	}
+	if len(body.Verification) != 0 && api_.isAdmin(r) {
+		boot.Verification = body.Verification
+	}
+
+	missing := body.State == images.BootCompleted && !api_.flashedAll(boot, body.Flashed)
+	switch {
+	case missing:
+		body.State = images.BootFailed
+		boot.Fail(images.FailureWrite, "not every member of the image set was flashed")
+	case body.State == images.BootFailed:
+		boot.Fail(reportedFailure(mac, body.FailureReason), body.FailureDetail)
+	case body.State == images.BootCancelled:
+		boot.Finish(body.State)
+		boot.FailureReason, boot.FailureDetail = images.FailureCancelled, body.FailureDetail
+	default:
+		boot.Finish(body.State)
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).UpdateBootHistory(boot), "Cannot update the boot") != nil {
+		return
+	}
+
+	api_.alertMismatches(boot)
+	if body.State == images.BootFailed {
+		api_.alert(config.EventBootFailure, mac, fmt.Sprintf("Boot of %s failed", mac),
+			fmt.Sprintf("The boot of image setup %s on %s failed (%s): %s", boot.SetupUUID, mac, boot.FailureReason,
+				boot.FailureDetail))
+	}
+
+	// Flashing cleans the disk up, unless the changes of this boot are not going to be uploaded either
+	if body.State == images.BootCompleted {
+		dirty := boot.BootMode == images.BootDiscard
+		if err = api_.storeFor(r).SetMachineDirty(util.MacAddress{Address: mac}, dirty); err != nil {
+			log.Warnf("Cannot update whether %s is dirty: %v", mac, err)
+		}
+	}
+
+	// The management OS stopped flashing halfway, whatever it wrote has to be flashed clean
+	if body.State == images.BootCancelled && api_.isMachine(r) {
+		if err = api_.storeFor(r).SetMachineDirty(util.MacAddress{Address: mac}, true); err != nil {
+			log.Warnf("Cannot mark %s dirty: %v", mac, err)
+		}
+	}
+
+	// A diskless boot which did not get going does not need its exports anymore
+	if body.State != images.BootCompleted && boot.BootMode == images.BootDiskless {
+		api_.endDisklessBoot(mac)
+	}
+
+	status := http.StatusOK
+	if missing {
+		log.Warnf("Boot of %s did not flash every member of image set %s", mac, boot.SetupUUID)
+		status = http.StatusUnprocessableEntity
+	}
+
+	writeJSON(w, status, boot)
+}
+
+// reportedFailure is the reason a management OS reported a failed boot for. Older management OSes only send the
+// detail, and newer ones may know reasons this control server does not, those boots fail for an unknown reason.
+func reportedFailure(mac string, reason images.FailureReason) images.FailureReason {
+	if reason.Valid() {
+		return reason
+	}
+
+	if reason != "" {
+		log.Warnf("Boot of %s failed for reason %q, which is not known, recording it as unknown", mac, reason)
+	}
+
+	return images.FailureUnknown
+}
+
+// bootCancelPoll is how often cancelling a boot checks whether the management OS stopped flashing
+const bootCancelPoll = 250 * time.Millisecond
+
+// CancelBoot cancels a boot of a machine. A boot which is still queued is identified by the UUID of its image setup
+// and taken out of the queue. A boot which is being flashed is identified by the ID in its history, the management
+// OS is told to stop at its next heartbeat. The request waits for it to stop and answers with the boot, or answers
+// 202 Accepted when it takes longer than BootCancelWaitSeconds.
+// Example request: DELETE /machine/52:54:00:d9:71:93/boot/12
+// Example response: {"ID": 12, "MachineMAC": "52:54:00:d9:71:93", "State": "cancelled", "CancelledBy": "jan", ...}
+func (api_ *API) CancelBoot(w http.ResponseWriter, r *http.Request) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	id, err := GetTag("id", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		api_.cancelQueuedBoot(w, r, mac, images.ImageUUID(id))
+		return
+	}
+
+	boot, err := api_.storeFor(r).GetBootHistoryEntry(mac, uint(n))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find the boot", http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the boot") != nil {
+		return
+	}
+
+	if !api_.isAdmin(r) && !api_.ownsSetup(r, boot.SetupUUID) {
+		http.Error(w, "Only the owner of the image setup can cancel this boot", http.StatusForbidden)
+		return
+	}
+
+	if boot.State != images.BootInProgress {
+		http.Error(w, "The boot is already "+string(boot.State), http.StatusConflict)
+		return
+	}
+
+	if boot.CancelRequestedAt == nil {
+		now := time.Now()
+		boot.CancelRequestedAt = &now
+		boot.CancelledBy = api_.requester(r)
+		if ErrorWrite(w, api_.storeFor(r).UpdateBootHistory(boot), "Cannot cancel the boot") != nil {
+			return
+		}
+
+		requestLog(r).Infof("%s asked to cancel boot %d of %s", boot.CancelledBy, boot.ID, mac)
+	}
+
+	deadline := time.Now().Add(time.Duration(api_.config.BootCancelWaitSeconds) * time.Second)
+	for {
+		boot, err = api_.storeFor(r).GetBootHistoryEntry(mac, uint(n))
+		if ErrorWrite(w, err, "Cannot fetch the boot") != nil {
+			return
+		}
+
+		if boot.State != images.BootInProgress {
+			writeJSON(w, http.StatusOK, boot)
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			writeJSON(w, http.StatusAccepted, boot)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(bootCancelPoll):
+		}
+	}
+}
+
+// cancelQueuedBoot takes a boot which was not claimed yet out of the queue of a machine
+func (api_ *API) cancelQueuedBoot(w http.ResponseWriter, r *http.Request, mac string, uuid images.ImageUUID) {
+	if !api_.isAdmin(r) && !api_.ownsSetup(r, uuid) {
+		http.Error(w, "Only the owner of the image setup can cancel this boot", http.StatusForbidden)
+		return
+	}
+
+	err := api_.storeFor(r).RemoveBootSetup(mac, uuid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The boot is not queued on this machine", http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot cancel the boot") != nil {
+		return
+	}
+
+	requestLog(r).Infof("%s removed the boot of %s from the queue of %s", api_.requester(r), uuid, mac)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flashedAll reports whether the management OS flashed every version of a boot, which is only checked for image
+// sets since a single disk is either written as a whole or not
+func (api_ *API) flashedAll(boot *images.BootHistory, flashed images.ResolvedVersions) bool {
+	setup, err := api_.store.GetImageSetup(string(boot.SetupUUID))
+	if err != nil || !setup.MultiDisk() {
+		return true
+	}
+
+	done := map[images.ResolvedVersion]bool{}
+	for _, version := range flashed {
+		done[version] = true
+	}
+
+	for _, version := range boot.ResolvedVersions {
+		if !done[version] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RegisterLockHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterLockHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/heartbeat",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Quiet:       true,
+		Scope:       user.ScopeMachinesBoot,
+		Handler:     api_.BootHeartbeat,
+		Method:      http.MethodPost,
+		Schema:      "boot-heartbeat",
+		Description: "Tells the control server the machine is still flashing",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/state",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeMachinesBoot,
+		Handler:     api_.SetBootState,
+		Method:      http.MethodPut,
+		Schema:      "boot-state",
+		Description: "Completes, fails or cancels the boot a machine is flashing",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/boot/{id}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeMachinesBoot,
+		Handler:     api_.CancelBoot,
+		Method:      http.MethodDelete,
+		Description: "Cancels a boot which is queued or being flashed",
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type logContextKey struct{}
+
+// requestIDHeader carries the ID of a request, a proxy in front of us may have set it already
+const requestIDHeader = "X-Request-ID"
+
+// loggedVars are the route variables which are added to every message logged for a request
+var loggedVars = []string{"name", "image_name", "mac", "uuid"}
+
+// requestLog is the logger of a request, its messages carry the request ID, the user of the session and the
+// variables of the route which identify what the request is about
+func requestLog(r *http.Request) *log.Entry {
+	entry, ok := r.Context().Value(logContextKey{}).(*log.Entry)
+	if !ok {
+		entry = log.NewEntry(log.StandardLogger())
+	}
+
+	vars := mux.Vars(r)
+	fields := log.Fields{}
+	for _, name := range loggedVars {
+		if value, ok := vars[name]; ok {
+			fields[name] = value
+		}
+	}
+
+	return entry.WithFields(fields)
+}
+
+// onStatusRewrite is called when a handler writes the status of a response after it was written already. The
+// response keeps the first status, the message of the second error ends up garbling its body. The tests replace it
+// to fail on handlers which do this.
+var onStatusRewrite = func(r *http.Request, written int, status int) {
+	requestLog(r).Warnf("Superfluous status %d, the response already has status %d", status, written)
+}
+
+// statusWriter remembers the status and the size of a response for the summary of the request
+type statusWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		onStatusRewrite(w.r, w.status, status)
+		return
+	}
+
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes on, image downloads are streamed
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// requestLogging gives every request its logger and logs a summary line once it is done, and counts the request
+// for the listener it came in on. The summaries of the quiet routes, which machines call all the time, are only
+// logged at debug level.
+func (api_ *API) requestLogging(listener string, quiet map[string]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			id := r.Header.Get(requestIDHeader)
+			if id == "" {
+				id = uuid.New().String()
+			}
+			w.Header().Set(requestIDHeader, id)
+
+			entry := log.WithField("request_id", id)
+			if username := api_.claimedUsername(r); username != "" {
+				entry = entry.WithField("username", username)
+			}
+
+			// Dry runs change nothing, which whoever reads the log back has to be able to tell
+			if isDryRun(r) {
+				entry = entry.WithField("dry_run", true)
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), logContextKey{}, entry))
+			sw := &statusWriter{ResponseWriter: w, r: r}
+			next.ServeHTTP(sw, r)
+
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+
+			pattern := r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					pattern = template
+				}
+			}
+
+			requestsServed.Inc(listener, strconv.Itoa(sw.status))
+			summary := requestLog(r).WithFields(log.Fields{
+				"listener": listener,
+				"method":   r.Method,
+				"route":    pattern,
+				"status":   sw.status,
+				"duration": time.Since(start).String(),
+				"bytes":    sw.bytes,
+			})
+
+			if quiet[pattern] {
+				summary.Debug("request")
+			} else {
+				summary.Info("request")
+			}
+		})
+	}
+}
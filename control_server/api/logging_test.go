@@ -0,0 +1,136 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain fails the tests when a handler behind the request logging writes the status of a response twice
+func TestMain(m *testing.M) {
+	var mu sync.Mutex
+	var rewrites []string
+	onStatusRewrite = func(r *http.Request, written int, status int) {
+		mu.Lock()
+		defer mu.Unlock()
+		rewrites = append(rewrites, fmt.Sprintf("%s %s: status %d after %d", r.Method, r.URL.Path, status, written))
+	}
+
+	code := m.Run()
+	if len(rewrites) != 0 {
+		fmt.Fprintf(os.Stderr, "Handlers wrote the status of a response twice:\n  %s\n", strings.Join(rewrites, "\n  "))
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+func TestApi_StatusRewrite(t *testing.T) {
+	defer func(guard func(*http.Request, int, int)) { onStatusRewrite = guard }(onStatusRewrite)
+	var rewritten []int
+	onStatusRewrite = func(_ *http.Request, written int, status int) {
+		rewritten = append(rewritten, written, status)
+	}
+
+	resp := httptest.NewRecorder()
+	sw := &statusWriter{ResponseWriter: resp, r: httptest.NewRequest(http.MethodGet, "/image/abc", nil)}
+	http.Error(sw, "image not found", http.StatusNotFound)
+	http.Error(sw, "cannot get image", http.StatusInternalServerError)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, http.StatusNotFound, sw.status)
+	assert.Equal(t, []int{http.StatusNotFound, http.StatusInternalServerError}, rewritten)
+}
+
+func TestApi_RequestLogging(t *testing.T) {
+	store := newTestStore(t)
+
+	jan := &user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(jan))
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"},
+		Architecture: machinemodel.X86_64}))
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+
+	api := NewAPI(store, "/tmp", config.Default())
+	api.RegisterUserHandlers()
+	api.RegisterImagePackageHandlers()
+	api.RegisterLockHandlers()
+	router := mux.NewRouter()
+	for _, route := range api.Routes {
+		router.HandleFunc(route.URI, api.CheckRole(route, route.Handler)).Methods(route.Method)
+	}
+	router.Use(api.requestLogging(primaryListenerName, map[string]bool{"/machine/{mac}/boot/heartbeat": true}))
+	s := &testServer{t: t, store: store, api: api, handler: router}
+
+	summary := func() *log.Entry {
+		for i := len(hook.AllEntries()) - 1; i >= 0; i-- {
+			if entry := hook.AllEntries()[i]; entry.Message == "request" {
+				return entry
+			}
+		}
+		return nil
+	}
+
+	// The summary carries the route rather than the path, with the user and the variables of the route
+	resp := s.requestWith(http.Header{requestIDHeader: {"42"}}, http.MethodGet, "/user/jan/images/nothing", "")
+
+	entry := summary()
+	assert.NotNil(t, entry)
+	assert.Equal(t, log.InfoLevel, entry.Level)
+	assert.Equal(t, "42", resp.Header().Get(requestIDHeader))
+	assert.Equal(t, "42", entry.Data["request_id"])
+	assert.Equal(t, "/user/{name}/images/{image_name}", entry.Data["route"])
+	assert.Equal(t, "jan", entry.Data["name"])
+	assert.Equal(t, "nothing", entry.Data["image_name"])
+	assert.Equal(t, resp.Code, entry.Data["status"])
+	assert.Equal(t, int64(resp.Body.Len()), entry.Data["bytes"])
+
+	// Requests without an ID get one, and a session adds its user
+	token := s.token(jan)
+	hook.Reset()
+	resp = s.requestToken(token, http.MethodGet, "/user/me", "")
+	assert.NotEmpty(t, resp.Header().Get(requestIDHeader))
+
+	entry = summary()
+	assert.NotNil(t, entry)
+	assert.Equal(t, "jan", entry.Data["username"])
+	assert.Equal(t, http.StatusOK, entry.Data["status"])
+
+	// Dry runs are marked, they changed nothing
+	hook.Reset()
+	req := httptest.NewRequest(http.MethodDelete, "/user/jan?dry_run=true", nil)
+	req.Header.Set("type", "system")
+	req.AddCookie(&http.Cookie{Name: s.api.config.SessionCookieName, Value: token})
+	s.serve(req)
+
+	entry = summary()
+	assert.NotNil(t, entry)
+	assert.Equal(t, true, entry.Data["dry_run"])
+	assert.Equal(t, http.StatusOK, entry.Data["status"])
+
+	// Heartbeats are quiet, they do not show up at info level
+	hook.Reset()
+	s.request(http.MethodPost, "/machine/abc/boot/heartbeat", "")
+	assert.Nil(t, summary())
+}
@@ -9,22 +9,51 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/baas-project/baas/pkg/api/types"
 	"github.com/baas-project/baas/pkg/model"
 
 	"net/http"
 	"os"
 
 	usermodel "github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/validation"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 	"gorm.io/gorm"
 )
 
-var conf *oauth2.Config
+// oauthUser is the information about an account that BAAS needs from an OAuth provider.
+type oauthUser struct {
+	// ID is the stable identifier of the account at the provider
+	ID    string
+	Login string
+	Name  string
+	Email string
+	// Role is only set by the dev provider, which logs in with the role picked on its form
+	Role usermodel.UserRole `json:",omitempty"`
+}
+
+// oauthProvider bundles the OAuth configuration of a provider with the function
+// fetching the account information of the user who logged in.
+type oauthProvider struct {
+	conf      *oauth2.Config
+	fetchUser func(client *http.Client) (*oauthUser, error)
+}
+
+var providers = map[usermodel.OAuthProvider]*oauthProvider{}
 
 func init() {
 	secret := os.Getenv("GITHUB_SECRET")
@@ -32,13 +61,129 @@ func init() {
 		log.Fatal("GITHUB_SECRET is not set!")
 	}
 
-	conf = &oauth2.Config{
-		ClientID:     "Ov23libSvpfP4mzgI5LD",
-		ClientSecret: secret,
-		RedirectURL:  "http://localhost:4848/user/login/github/callback",
-		Scopes:       []string{"user"},
-		Endpoint:     github.Endpoint,
+	providers[usermodel.ProviderGitHub] = &oauthProvider{
+		conf: &oauth2.Config{
+			ClientID:     "Ov23libSvpfP4mzgI5LD",
+			ClientSecret: secret,
+			Scopes:       []string{"user"},
+			Endpoint:     github.Endpoint,
+		},
+		fetchUser: fetchGitHubUser,
+	}
+
+	// GitLab is optional since it is usually the self-hosted instance of the university.
+	if gitlabSecret := os.Getenv("GITLAB_SECRET"); gitlabSecret != "" {
+		base := os.Getenv("GITLAB_URL")
+		if base == "" {
+			base = "https://gitlab.com"
+		}
+
+		providers[usermodel.ProviderGitLab] = &oauthProvider{
+			conf: &oauth2.Config{
+				ClientID:     os.Getenv("GITLAB_CLIENT_ID"),
+				ClientSecret: gitlabSecret,
+				Scopes:       []string{"read_user"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  base + "/oauth/authorize",
+					TokenURL: base + "/oauth/token",
+				},
+			},
+			fetchUser: func(client *http.Client) (*oauthUser, error) {
+				return fetchGitLabUser(client, base)
+			},
+		}
+	}
+}
+
+// fetchGitHubUser requests the account information from the GitHub user API
+func fetchGitHubUser(client *http.Client) (*oauthUser, error) {
+	resp, err := client.Get("https://api.github.com/user")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var loginInfo model.GitHubLogin
+	if err = json.NewDecoder(resp.Body).Decode(&loginInfo); err != nil {
+		return nil, err
+	}
+
+	if loginInfo.ID == 0 || loginInfo.Login == "" {
+		return nil, errors.New("github did not return an account")
+	}
+
+	name := loginInfo.Name
+	if name == "" {
+		name = loginInfo.Login
+	}
+
+	return &oauthUser{
+		ID:    strconv.Itoa(loginInfo.ID),
+		Login: loginInfo.Login,
+		Name:  name,
+		Email: loginInfo.Email,
+	}, nil
+}
+
+// fetchGitLabUser requests the account information from the GitLab instance at base
+func fetchGitLabUser(client *http.Client, base string) (*oauthUser, error) {
+	resp, err := client.Get(base + "/api/v4/user")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var loginInfo model.GitLabLogin
+	if err = json.NewDecoder(resp.Body).Decode(&loginInfo); err != nil {
+		return nil, err
+	}
+
+	if loginInfo.ID == 0 || loginInfo.Username == "" {
+		return nil, errors.New("gitlab did not return an account")
 	}
+
+	name := loginInfo.Name
+	if name == "" {
+		name = loginInfo.Username
+	}
+
+	return &oauthUser{
+		ID:    strconv.Itoa(loginInfo.ID),
+		Login: loginInfo.Username,
+		Name:  name,
+		Email: loginInfo.Email,
+	}, nil
+}
+
+// loginProviders are the OAuth providers users can log in with, the dev provider is added when it is enabled. The
+// providers send the browser back to their callback at the public URL of the control server.
+func loginProviders(publicURL string, dev *devLogin) map[usermodel.OAuthProvider]*oauthProvider {
+	base := strings.TrimSuffix(publicURL, "/")
+	enabled := map[usermodel.OAuthProvider]*oauthProvider{}
+	for name, provider := range providers {
+		conf := *provider.conf
+		conf.RedirectURL = base + "/user/login/" + string(name) + "/callback"
+		enabled[name] = &oauthProvider{conf: &conf, fetchUser: provider.fetchUser}
+	}
+
+	if dev != nil {
+		enabled[usermodel.ProviderDev] = dev.provider()
+	}
+
+	return enabled
+}
+
+// getProvider finds the OAuth provider named in the URI
+func (api_ *API) getProvider(w http.ResponseWriter, r *http.Request) (usermodel.OAuthProvider, *oauthProvider,
+	error) {
+	name := usermodel.OAuthProvider(mux.Vars(r)["provider"])
+	provider, ok := api_.providers[name]
+	if !ok {
+		http.Error(w, "Unknown login provider: "+string(name), http.StatusNotFound)
+		return "", nil, errors.New("unknown provider")
+	}
+
+	return name, provider, nil
 }
 
 func generateRandomState() string {
@@ -50,111 +195,436 @@ func generateRandomState() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-// returnUserByOAuth gets or creates the associated user from the database.
-func (api_ *API) returnUserByOAuth(username string, email string, realName string) (*usermodel.UserModel, error) {
-	user, err := api_.store.GetUserByUsername(username)
-	// Create the user if we cannot find it in the database.
-	if err == gorm.ErrRecordNotFound {
+// freeUsername finds a username which is not yet in use for an account coming from a provider.
+// Logins are only unique per provider, so a login which is already taken gets the provider as suffix. Logins which
+// are no valid username, such as the reserved ones, get the suffix as well.
+func (api_ *API) freeUsername(provider usermodel.OAuthProvider, login string) (string, error) {
+	candidates := []string{login, fmt.Sprintf("%s-%s", login, provider)}
+	for _, candidate := range candidates {
+		if len(validation.Username(candidate)) != 0 {
+			continue
+		}
+
+		_, err := api_.store.GetUserByUsername(candidate)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("no free username for %s login %s", provider, login)
+}
+
+// unlinkedUserError is returned when a GitHub login is named after an account from before identities existed, which
+// an administrator has to link to the GitHub account first
+type unlinkedUserError struct {
+	Username string
+}
+
+func (e *unlinkedUserError) Error() string {
+	return "the account " + e.Username + " is not linked to its GitHub account yet"
+}
+
+// checkUnlinked refuses GitHub logins named after an account without identities, their owner would otherwise log in
+// to a new account next to theirs. Accounts of the LDAP synchronization are claimed by their email address instead.
+func (api_ *API) checkUnlinked(provider usermodel.OAuthProvider, login string) error {
+	if provider != usermodel.ProviderGitHub {
+		return nil
+	}
+
+	user, err := api_.store.GetUserByUsername(login)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if user.LDAPRole != "" {
+		return nil
+	}
+
+	identities, err := api_.store.GetIdentitiesByUsername(user.Username)
+	if err != nil {
+		return err
+	}
+
+	if len(identities) == 0 {
+		return &unlinkedUserError{Username: user.Username}
+	}
+
+	return nil
+}
+
+// returnUserByOAuth gets or creates the user associated with an account at a provider.
+// Users are found by the identity of the account and never by the login name, since
+// login names are only unique per provider. Accounts from before identities existed are
+// linked to their GitHub account by an administrator, see LinkUserIdentity and
+// baas-admin link-github, until then logging in with that GitHub login is refused.
+func (api_ *API) returnUserByOAuth(provider usermodel.OAuthProvider, account *oauthUser) (*usermodel.UserModel, error) {
+	identity, err := api_.store.GetIdentity(provider, account.ID)
+	if err == nil {
+		return api_.store.GetUserByUsername(identity.Username)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// Accounts created by the LDAP synchronization are claimed by the first login with their email address
+	var user *usermodel.UserModel
+	email := usermodel.NormalizeEmail(account.Email)
+	if email != "" {
+		if user, err = api_.unclaimedLDAPUser(email); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the user if there is no account we can attach the identity to.
+	if user == nil {
+		// Someone who already has an account with this address has to link the provider to it instead
+		if err = api_.checkEmail(email, ""); err != nil {
+			return nil, err
+		}
+
+		if err = api_.checkUnlinked(provider, account.Login); err != nil {
+			return nil, err
+		}
+
+		username, uerr := api_.freeUsername(provider, account.Login)
+		if uerr != nil {
+			return nil, uerr
+		}
+
 		user = &usermodel.UserModel{
 			Username: username,
-			Name:     realName,
+			Name:     account.Name,
 			Email:    email,
 			Role:     usermodel.User,
 		}
 
-		api_.store.CreateUser(user)
-	} else if err != nil {
+		if err = api_.store.CreateUser(user); err != nil {
+			return nil, err
+		}
+	}
+
+	err = api_.store.CreateIdentity(&usermodel.IdentityModel{
+		Provider:   provider,
+		ProviderID: account.ID,
+		Login:      account.Login,
+		Username:   user.Username,
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
 
-// LoginGithub defines the entrypoint to start the OAuth flow
-func (api_ *API) LoginGithub(w http.ResponseWriter, r *http.Request) {
+// unclaimedLDAPUser finds the account with an email address which the LDAP synchronization created and nobody logged
+// in to yet, it returns nil when there is none
+func (api_ *API) unclaimedLDAPUser(email string) (*usermodel.UserModel, error) {
+	owner, err := api_.store.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && owner.LDAPRole == "") {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	identities, err := api_.store.GetIdentitiesByUsername(owner.Username)
+	if err != nil || len(identities) != 0 {
+		return nil, err
+	}
+
+	return owner, nil
+}
+
+// linkIdentity attaches the account at a provider to an existing user
+func (api_ *API) linkIdentity(username string, provider usermodel.OAuthProvider, account *oauthUser) error {
+	identity, err := api_.store.GetIdentity(provider, account.ID)
+	if err == nil {
+		if identity.Username != username {
+			return errIdentityInUse
+		}
+
+		return nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	return api_.store.CreateIdentity(&usermodel.IdentityModel{
+		Provider:   provider,
+		ProviderID: account.ID,
+		Login:      account.Login,
+		Username:   username,
+	})
+}
+
+var errIdentityInUse = errors.New("identity is linked to another user")
+
+// loginToken is the response to a login started with ?mode=token. The token is sent as the session cookie.
+type loginToken struct {
+	Token     string
+	Username  string
+	ExpiresAt time.Time
+	// Scopes limit what the token may be used for, tokens without any may do everything their owner can
+	Scopes []usermodel.TokenScope `json:",omitempty"`
+
+	// session identifies the session of the token, it is not sent along
+	session string
+}
+
+// loginRedirect checks the page a login asked to return to against the pages of its frontend and the allowed pages.
+// Anything else, including other sites, ends up at the landing page of the frontend.
+func (api_ *API) loginRedirect(chosen frontend, target string) string {
+	if target == "" {
+		return chosen.landing()
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Printf("Ignoring invalid login redirect %q", target)
+		return chosen.landing()
+	}
+
+	if chosen.contains(u) {
+		return u.String()
+	}
+
+	for _, entry := range api_.config.LoginRedirectAllowed {
+		allowed, aerr := url.Parse(entry)
+		if aerr != nil || allowed.Scheme != u.Scheme || allowed.Host != u.Host {
+			continue
+		}
+
+		if withinPath(u, allowed.Path) {
+			return u.String()
+		}
+	}
+
+	log.Printf("Ignoring login redirect %q which is not allowed", target)
+	return chosen.landing()
+}
+
+// createLoginToken creates a session for the user which expires after LoginTokenMinutes, encoded like the session
+// cookie so it can be used in its place
+func (api_ *API) createLoginToken(user *usermodel.UserModel) (*loginToken, error) {
+	return api_.createScopedToken(user, nil)
+}
+
+// createScopedToken creates a login token which may only be used for the scopes, or for everything the user may do
+// when there are none
+func (api_ *API) createScopedToken(user *usermodel.UserModel, scopes []usermodel.TokenScope) (*loginToken, error) {
+	expires := time.Now().Add(time.Duration(api_.config.LoginTokenMinutes) * time.Minute)
+	session := uuid.New().String()
+	values := map[interface{}]interface{}{
+		"Session":  session,
+		"Username": user.Username,
+		"Role":     string(user.Role),
+		"Expires":  expires.Unix(),
+		"IssuedAt": time.Now().UnixNano(),
+	}
+
+	// The scopes are kept as a single string, which the encoding of the session takes without registering a type
+	if len(scopes) > 0 {
+		names := make([]string, len(scopes))
+		for i, scope := range scopes {
+			names[i] = string(scope)
+		}
+		values["Scopes"] = strings.Join(names, ",")
+	}
+
+	token, err := securecookie.EncodeMulti(api_.config.SessionCookieName, values, api_.session.Codecs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &loginToken{Token: token, Username: user.Username, ExpiresAt: expires, Scopes: scopes, session: session},
+		nil
+}
+
+// startOAuth redirects the user to the login page of the provider. When linkUser is set the
+// callback attaches the identity to that user instead of logging in. The page to return to afterwards and whether
+// a token is wanted instead are kept in the session until the callback, the frontend is signed into the state.
+func (api_ *API) startOAuth(w http.ResponseWriter, r *http.Request, provider *oauthProvider, linkUser string) {
+	chosen, err := api_.loginFrontend(r)
+	if err != nil {
+		http.Error(w, "Unknown frontend environment: "+r.URL.Query().Get("env"), http.StatusBadRequest)
+		return
+	}
+
+	state, err := api_.encodeOAuthState(chosen)
+	if ErrorWrite(w, err, "Failed to create the OAuth state") != nil {
+		return
+	}
 
-	// Beim Start der Authentifizierung:
-	state := generateRandomState()
-	log.Printf("Generated state: %s", state)
-	session, err := api_.session.Get(r, "session-name")
+	session, err := api_.session.Get(r, api_.config.SessionCookieName)
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
+
 	session.Values["oauth_state"] = state
-	session.Save(r, w)
+	if linkUser != "" {
+		session.Values["oauth_link"] = linkUser
+	} else {
+		delete(session.Values, "oauth_link")
+	}
+
+	session.Values["oauth_redirect"] = api_.loginRedirect(chosen, r.URL.Query().Get("redirect"))
+	if linkUser == "" && r.URL.Query().Get("mode") == "token" {
+		session.Values["oauth_mode"] = "token"
+	} else {
+		delete(session.Values, "oauth_mode")
+	}
+
+	if err = session.Save(r, w); err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
+
+	authURL := provider.conf.AuthCodeURL(state)
+	requestLog(r).Debugf("Auth URL: %s", authURL)
 
-	url := conf.AuthCodeURL(state)
-	log.Printf("Generated OAuth state: %s", state)
-	log.Printf("Auth URL: %s", url)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// LoginOAuth defines the entrypoint to start the OAuth flow. The user is sent back to the page in ?redirect= when
+// it is allowed, command line tools pass ?mode=token to receive a token rather than a cookie. The frontend the user
+// returns to is the one serving that page, or the one named with ?env=.
+// Example request: GET /user/login/github?redirect=http://localhost:9090/app/images
+// Example request: GET /user/login/github?env=staging
+func (api_ *API) LoginOAuth(w http.ResponseWriter, r *http.Request) {
+	_, provider, err := api_.getProvider(w, r)
+	if err != nil {
+		return
+	}
 
-	http.Redirect(w, r, url, http.StatusFound)
+	api_.startOAuth(w, r, provider, "")
 }
 
-// LoginGithubCallback gets the token and creates the user model for the GitHub User
-func (api_ *API) LoginGithubCallback(w http.ResponseWriter, r *http.Request) {
+// LinkOAuth starts the OAuth flow to attach another identity to the logged-in user
+// Example request: GET /user/me/link/gitlab
+func (api_ *API) LinkOAuth(w http.ResponseWriter, r *http.Request) {
+	_, provider, err := api_.getProvider(w, r)
+	if err != nil {
+		return
+	}
+
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	api_.startOAuth(w, r, provider, username)
+}
+
+// LoginOAuthCallback gets the token and logs in the user behind it, or links the
+// identity to the current user when the flow was started by LinkOAuth.
+func (api_ *API) LoginOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	name, provider, err := api_.getProvider(w, r)
+	if err != nil {
+		return
+	}
+
 	// Get the session
-	session, err := api_.session.Get(r, "session-name")
+	session, err := api_.session.Get(r, api_.config.SessionCookieName)
 	if err != nil {
 		http.Error(w, "Failed to get session", http.StatusInternalServerError)
 		return
 	}
 
-	if r.URL.Query().Get("state") != session.Values["oauth_state"] {
+	// The state has to be the one this browser started with, and signed by us
+	state := r.URL.Query().Get("state")
+	if state == "" || state != session.Values["oauth_state"] {
 		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
 		return
 	}
+	delete(session.Values, "oauth_state")
 
-	log.Printf("Callback received state: %s, stored state: %s", r.URL.Query().Get("state"), session.Values["oauth_state"])
+	chosen, err := api_.decodeOAuthState(state)
+	if err != nil {
+		requestLog(r).Warnf("Refusing an OAuth state which is not signed: %v", err)
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+
+	redirect, _ := session.Values["oauth_redirect"].(string)
+	redirect = api_.loginRedirect(chosen, redirect)
+	mode, _ := session.Values["oauth_mode"].(string)
+	delete(session.Values, "oauth_redirect")
+	delete(session.Values, "oauth_mode")
 
 	// Fetch the single-use code from the URI
 	ctx := context.Background()
-	code := r.URL.Query()["code"][0]
+	code := r.URL.Query().Get("code")
 	if code == "" {
 		http.Error(w, "Missing code in query", http.StatusBadRequest)
 		return
 	}
 
 	// Get the OAuth token
-	tok, err := conf.Exchange(ctx, code)
-
+	tok, err := provider.conf.Exchange(ctx, code)
 	if err != nil {
-		log.Printf("OAuth token excange failed for code: %s: %v", code, err)
+		requestLog(r).Warnf("OAuth token exchange failed: %v", err)
 		http.Error(w, "Invalid OAuth token: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Create a client which sends requests using the token.
-	client := conf.Client(ctx, tok)
-	resp, err := client.Get("https://api.github.com/user")
+	// Create a client which sends requests using the token and fetch the user information.
+	account, err := provider.fetchUser(provider.conf.Client(ctx, tok))
 	if err != nil {
-		http.Error(w, "Request to Github API failed", http.StatusBadRequest)
+		requestLog(r).Warnf("Fetching %s account failed: %v", name, err)
+		http.Error(w, "Request to the login provider failed", http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Fetch the user information/api.github.com/user")
-	if err != nil {
-		http.Error(w, "Request to GitHub API failed", http.StatusBadRequest)
+	if linkUser, ok := session.Values["oauth_link"].(string); ok && linkUser != "" {
+		delete(session.Values, "oauth_link")
+		api_.finishLink(w, r, session, linkUser, name, account, redirect)
 		return
 	}
 
-	var loginInfo model.GitHubLogin
-	if err = json.NewDecoder(resp.Body).Decode(&loginInfo); err != nil {
-		http.Error(w, "Cannot parse GitHub data", http.StatusBadRequest)
+	user, err := api_.returnUserByOAuth(name, account)
+	var taken *emailTakenError
+	var unlinked *unlinkedUserError
+	if errors.As(err, &taken) {
+		http.Error(w, "There is already an account with this email address, log in with it and link "+
+			string(name)+" to it. If you cannot log in to it, contact an administrator to link it for you",
+			http.StatusConflict)
+		return
+	} else if errors.As(err, &unlinked) {
+		http.Error(w, "The account "+unlinked.Username+" is from before accounts were linked to GitHub, contact "+
+			"an administrator to link your GitHub account to it", http.StatusConflict)
+		return
+	} else if err != nil {
+		requestLog(r).Errorf("Cannot log in %s account %s: %v", name, account.Login, err)
+		http.Error(w, "Cannot find the user in the database", http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
 
-	user, err := api_.returnUserByOAuth(loginInfo.Login, loginInfo.Email, loginInfo.Email)
+	if user.Disabled {
+		http.Error(w, "This account has been disabled", http.StatusForbidden)
+		return
+	}
 
-	if err != nil {
-		http.Error(w, "Cannot find the user in the database", http.StatusBadRequest)
+	if account.Role != "" && account.Role != user.Role {
+		user.Role = account.Role
+		if err = api_.storeFor(r).ModifyUser(user); err != nil {
+			requestLog(r).Errorf("Cannot give %s the role %s: %v", user.Username, account.Role, err)
+			http.Error(w, "Cannot change the role of the user", http.StatusInternalServerError)
+			return
+		}
+		api_.users.forget(user.Username)
+	}
+
+	// The browser of a command line login does not get logged in, only the command line tool does
+	if mode == "token" {
+		api_.finishTokenLogin(w, r, session, user)
 		return
 	}
 
 	uuID, err := uuid.NewUUID()
-
 	if err != nil {
 		http.Error(w, "Cannot generate UUID", http.StatusBadRequest)
 		return
@@ -164,6 +634,7 @@ func (api_ *API) LoginGithubCallback(w http.ResponseWriter, r *http.Request) {
 	session.Values["Session"] = uuID.String()
 	session.Values["Username"] = user.Username
 	session.Values["Role"] = string(user.Role)
+	session.Values["IssuedAt"] = time.Now().UnixNano()
 
 	err = session.Save(r, w)
 	if err != nil {
@@ -171,11 +642,177 @@ func (api_ *API) LoginGithubCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expires := time.Now().Add(time.Duration(api_.session.Options.MaxAge) * time.Second)
+	api_.recordSession(r, uuID.String(), user.Username, usermodel.SessionBrowser, expires)
+
 	// Return the session cookie
-	http.Redirect(w, r, "http://localhost:9090/app", http.StatusFound)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// finishTokenLogin answers a command line login with a token for the user
+func (api_ *API) finishTokenLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session,
+	user *usermodel.UserModel) {
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	token, err := api_.createLoginToken(user)
 	if err != nil {
+		requestLog(r).Errorf("Cannot create a login token for %s: %v", user.Username, err)
+		http.Error(w, "Cannot create the token", http.StatusInternalServerError)
+		return
+	}
+
+	api_.recordSession(r, token.session, user.Username, usermodel.SessionToken, token.ExpiresAt)
+	writeJSON(w, http.StatusOK, token)
+}
+
+// finishLink links the account to the user who started the flow and sends them back to the frontend
+func (api_ *API) finishLink(w http.ResponseWriter, r *http.Request, session *sessions.Session,
+	username string, provider usermodel.OAuthProvider, account *oauthUser, redirect string) {
+	err := api_.linkIdentity(username, provider, account)
+	if errors.Is(err, errIdentityInUse) {
+		http.Error(w, "This account is already linked to another user", http.StatusConflict)
+		return
+	} else if err != nil {
+		requestLog(r).Errorf("Cannot link %s account %s to %s: %v", provider, account.Login, username, err)
+		http.Error(w, "Cannot link the account", http.StatusInternalServerError)
+		return
+	}
+
+	if err = session.Save(r, w); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// GetIdentities lists the OAuth identities linked to the logged-in user
+// Example request: GET /user/me/identities
+// Example response: [{"ID": 1, "Provider": "github", "ProviderID": "1234", "Login": "jan",
+//
+//	"Username": "jan", "CreatedAt": "2022-01-01T12:00:00Z"}]
+func (api_ *API) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	identities, err := api_.storeFor(r).GetIdentitiesByUsername(username)
+	if err != nil {
+		http.Error(w, "Cannot get identities", http.StatusInternalServerError)
+		requestLog(r).Errorf("get identities: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewIdentities(identities))
+}
+
+// identityLink is the account at a provider which an administrator links to a user
+type identityLink struct {
+	Provider   usermodel.OAuthProvider `description:"The provider of the account, such as github"`
+	ProviderID string                  `description:"The stable numeric id of the account at the provider, not its login"`
+	Login      string                  `description:"The name of the account at the provider, it is only shown"`
+}
+
+// LinkUserIdentity links an account at a provider to a user. Accounts made before identities existed are named after
+// the GitHub login of their owner, which logs in to a new account until its GitHub account ID is linked here once.
+// Example request: POST /user/jan/identities
+// Example body: {"Provider": "github", "ProviderID": "1234", "Login": "jan"}
+// Example response: [{"ID": 1, "Provider": "github", "ProviderID": "1234", "Login": "jan",
+//
+//	"Username": "jan", "CreatedAt": "2022-01-01T12:00:00Z"}]
+func (api_ *API) LinkUserIdentity(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var link identityLink
+	if err = json.NewDecoder(r.Body).Decode(&link); err != nil {
+		http.Error(w, "Invalid identity", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := api_.providers[link.Provider]; !ok || link.ProviderID == "" {
+		http.Error(w, "An identity needs a known provider and the id of the account there", http.StatusBadRequest)
+		return
+	}
+
+	_, err = api_.storeFor(r).GetUserByUsername(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: name})
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the user") != nil {
+		return
+	}
+
+	err = api_.linkIdentity(name, link.Provider, &oauthUser{ID: link.ProviderID, Login: link.Login})
+	if errors.Is(err, errIdentityInUse) {
+		http.Error(w, "The account is linked to another user", http.StatusConflict)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot link the identity") != nil {
+		return
+	}
+
+	requestLog(r).WithField("audit", "identity-linked").Infof("%s linked %s account %s to %s", api_.requester(r),
+		link.Provider, link.ProviderID, name)
+
+	identities, err := api_.storeFor(r).GetIdentitiesByUsername(name)
+	if ErrorWrite(w, err, "Cannot get identities") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewIdentities(identities))
+}
+
+// DeleteIdentity unlinks an identity from the logged-in user. The last identity cannot be
+// removed, since the user would not be able to log in anymore.
+// Example request: DELETE /user/me/identities/2
+// Response: 204 No Content
+func (api_ *API) DeleteIdentity(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid identity id", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := api_.storeFor(r).GetIdentityByID(uint(id))
+	if err != nil || identity.Username != username {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+
+	identities, err := api_.storeFor(r).GetIdentitiesByUsername(username)
+	if err != nil {
+		http.Error(w, "Cannot get identities", http.StatusInternalServerError)
+		requestLog(r).Errorf("get identities: %v", err)
+		return
+	}
+
+	if len(identities) <= 1 {
+		http.Error(w, "Cannot remove the last identity of a user", http.StatusConflict)
+		return
+	}
+
+	if err = api_.storeFor(r).DeleteIdentity(identity); err != nil {
+		http.Error(w, "Cannot remove identity", http.StatusInternalServerError)
+		requestLog(r).Errorf("delete identity: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,373 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ReturnUserByOAuthNoHijack(t *testing.T) {
+	store := newTestStore(t)
+	api := NewAPI(store, "/tmp", config.Default())
+
+	github := &oauthUser{ID: "1", Login: "jan", Name: "Jan", Email: "jan@github.com"}
+	first, err := api.returnUserByOAuth(user.ProviderGitHub, github)
+	assert.NoError(t, err)
+	assert.Equal(t, "jan", first.Username)
+
+	// A different person using the same name at another provider gets their own account
+	gitlab := &oauthUser{ID: "1", Login: "jan", Name: "Other Jan", Email: "jan@gitlab.com"}
+	second, err := api.returnUserByOAuth(user.ProviderGitLab, gitlab)
+	assert.NoError(t, err)
+	assert.Equal(t, "jan-gitlab", second.Username)
+
+	// Logging in again finds the account through the identity
+	again, err := api.returnUserByOAuth(user.ProviderGitHub, github)
+	assert.NoError(t, err)
+	assert.Equal(t, "jan", again.Username)
+
+	// Linking the GitLab account to the first user is refused since it belongs to someone else
+	assert.ErrorIs(t, api.linkIdentity("jan", user.ProviderGitLab, gitlab), errIdentityInUse)
+	assert.NoError(t, api.linkIdentity("jan", user.ProviderGitLab, &oauthUser{ID: "2", Login: "jdb"}))
+
+	identities, err := store.GetIdentitiesByUsername("jan")
+	assert.NoError(t, err)
+	assert.Len(t, identities, 2)
+}
+
+func TestApi_LinkUserIdentity(t *testing.T) {
+	store := newTestStore(t)
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	// An account from before identities existed is named after the GitHub login, but that does not make it theirs.
+	// Its owner does not get a second account either, an administrator has to link it.
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.Admin}))
+	_, err := s.api.returnUserByOAuth(user.ProviderGitHub, &oauthUser{ID: "7", Login: "jan"})
+	var unlinked *unlinkedUserError
+	assert.ErrorAs(t, err, &unlinked)
+	_, err = store.GetUserByUsername("jan-github")
+	assert.Error(t, err)
+
+	link := func(name string, body string) *httptest.ResponseRecorder {
+		return s.request(http.MethodPost, "/user/"+name+"/identities", body)
+	}
+
+	// An administrator links the GitHub account ID of its owner once
+	resp := link("jan", `{"Provider": "github", "ProviderID": "42", "Login": "jan"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var identities []types.Identity
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&identities))
+	assert.Len(t, identities, 1)
+
+	owner, err := s.api.returnUserByOAuth(user.ProviderGitHub, &oauthUser{ID: "42", Login: "jan"})
+	assert.NoError(t, err)
+	assert.Equal(t, "jan", owner.Username)
+
+	// Once linked, someone who took over the login at GitHub gets an account of their own
+	impostor, err := s.api.returnUserByOAuth(user.ProviderGitHub, &oauthUser{ID: "7", Login: "jan"})
+	assert.NoError(t, err)
+	assert.Equal(t, "jan-github", impostor.Username)
+
+	assert.Equal(t, http.StatusConflict, link("jan", `{"Provider": "github", "ProviderID": "7"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, link("jan", `{"Provider": "myspace", "ProviderID": "1"}`).Code)
+	assert.Equal(t, http.StatusNotFound, link("nobody", `{"Provider": "github", "ProviderID": "1"}`).Code)
+}
+
+func TestApi_LoginRedirect(t *testing.T) {
+	conf := config.Default()
+	conf.LoginRedirectAllowed = []string{"https://baas.example.org/app", "http://localhost:9090/"}
+	api := NewAPI(nil, "/tmp", conf)
+
+	for target, expected := range map[string]string{
+		"":                             conf.LoginRedirect,
+		"https://baas.example.org/app": "https://baas.example.org/app",
+		"https://baas.example.org/app/images?page=2": "https://baas.example.org/app/images?page=2",
+		"http://localhost:9090/admin":                "http://localhost:9090/admin",
+		"https://baas.example.org/application":       conf.LoginRedirect,
+		"https://baas.example.org/app/../admin":      conf.LoginRedirect,
+		"http://baas.example.org/app":                conf.LoginRedirect,
+		"https://baas.example.org.evil.com/app":      conf.LoginRedirect,
+		"https://user@baas.example.org/app":          conf.LoginRedirect,
+		"//evil.com/app":                             conf.LoginRedirect,
+		"javascript:alert(1)":                        conf.LoginRedirect,
+	} {
+		assert.Equal(t, expected, api.loginRedirect(api.frontends.fallback, target), target)
+	}
+}
+
+func TestApi_LoginFrontends(t *testing.T) {
+	store := newTestStore(t)
+
+	server := httptest.NewUnstartedServer(nil)
+	defer server.Close()
+	conf := config.Default()
+	conf.DevLogin = true
+	conf.DevLoginURL = "http://" + server.Listener.Addr().String()
+	conf.Frontends = map[string]config.Frontend{
+		"staging":    {Origin: "https://staging.baas.example.org", RedirectPath: "/app"},
+		"production": {Origin: "https://baas.example.org", RedirectPath: "/"},
+	}
+	conf.DefaultFrontend = "production"
+	assert.NoError(t, conf.Validate())
+	s := newTestServer(t, store, "/tmp", conf)
+	server.Config.Handler = s.handler
+	server.Start()
+
+	// The browser follows the redirects up to the frontend, which is not running
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	browser := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+		if req.URL.Host != server.Listener.Addr().String() {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+
+	login := func(query string, tamper func(string) string) *http.Response {
+		resp, err := browser.Get(server.URL + "/user/login/dev" + query)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp
+		}
+
+		form := url.Values{
+			"username":     []string{"jan"},
+			"role":         []string{"user"},
+			"state":        []string{tamper(resp.Request.URL.Query().Get("state"))},
+			"redirect_uri": []string{resp.Request.URL.Query().Get("redirect_uri")},
+		}
+		resp, err = browser.PostForm(server.URL+"/dev/authorize", form)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	same := func(state string) string { return state }
+
+	for query, expected := range map[string]string{
+		"":             "https://baas.example.org/",
+		"?env=staging": "https://staging.baas.example.org/app",
+		"?redirect=https://staging.baas.example.org/app/images":         "https://staging.baas.example.org/app/images",
+		"?redirect=https://staging.baas.example.org/admin":              "https://staging.baas.example.org/app",
+		"?env=production&redirect=https://staging.baas.example.org/app": "https://baas.example.org/",
+		"?redirect=https://evil.example.org/app":                        "https://baas.example.org/",
+	} {
+		resp := login(query, same)
+		assert.Equal(t, http.StatusFound, resp.StatusCode, query)
+		assert.Equal(t, expected, resp.Header.Get("Location"), query)
+	}
+
+	// Unknown environments are refused, the state cannot be swapped for an unsigned one
+	assert.Equal(t, http.StatusBadRequest, login("?env=evil", same).StatusCode)
+	state, err := s.api.encodeOAuthState(s.api.frontends.byName["staging"])
+	assert.NoError(t, err)
+	chosen, err := s.api.decodeOAuthState(state)
+	assert.NoError(t, err)
+	assert.Equal(t, "staging", chosen.Name)
+	_, err = s.api.decodeOAuthState(generateRandomState())
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, login("?env=staging", func(string) string {
+		return generateRandomState()
+	}).StatusCode)
+
+	// Only the frontends may call the API from the browser
+	for origin, allowed := range map[string]bool{
+		"https://staging.baas.example.org": true,
+		"https://BAAS.example.org":         true,
+		"http://baas.example.org":          false,
+		"https://evil.example.org":         false,
+		"http://localhost:9090":            false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		req.Header.Set("Origin", origin)
+		resp := s.serve(req)
+		if allowed {
+			assert.Equal(t, origin, resp.Header().Get("Access-Control-Allow-Origin"), origin)
+		} else {
+			assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"), origin)
+		}
+	}
+
+	// The frontends may send the headers of uploads and retries, and read the job of an upload
+	preflight := httptest.NewRequest(http.MethodOptions, "/image/uploaded", nil)
+	preflight.Header.Set("Origin", "https://baas.example.org")
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	preflight.Header.Set("Access-Control-Request-Headers", "Idempotency-Key, X-BAAS-SHA256, If-None-Match, Prefer")
+	resp := s.serve(preflight)
+	assert.Equal(t, "https://baas.example.org", resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Idempotency-Key, X-Baas-Sha256, If-None-Match, Prefer",
+		resp.Header().Get("Access-Control-Allow-Headers"))
+
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set("Origin", "https://baas.example.org")
+	assert.Contains(t, s.serve(req).Header().Get("Access-Control-Expose-Headers"), "X-Baas-Job")
+}
+
+func TestApi_LoginCallbackURL(t *testing.T) {
+	conf := config.Default()
+	conf.PublicURL = "https://api.baas.example.org/"
+	assert.NoError(t, conf.Validate())
+	api := NewAPI(newTestStore(t), "/tmp", conf)
+
+	// The providers send the browser back to the control server where it is reached, not where it listens
+	github := api.providers[user.ProviderGitHub].conf
+	assert.Equal(t, "https://api.baas.example.org/user/login/github/callback", github.RedirectURL)
+	assert.Empty(t, providers[user.ProviderGitHub].conf.RedirectURL)
+
+	for _, public := range []string{"", "baas.example.org", "ftp://baas.example.org", "https://baas.example.org/?a=b"} {
+		conf.PublicURL = public
+		assert.Error(t, conf.Validate(), public)
+	}
+}
+
+func TestApi_LoginToken(t *testing.T) {
+	store := newTestStore(t)
+	test := &user.UserModel{Username: "test", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+
+	api := NewAPI(store, "/tmp", config.Default())
+	handler := api.CheckRole(Route{Permissions: []user.UserRole{user.User}}, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	request := func(token string) int {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/user/test/images", nil)
+		req.AddCookie(&http.Cookie{Name: "session-name", Value: token})
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	token, err := api.createLoginToken(test)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", token.Username)
+	assert.Equal(t, http.StatusNoContent, request(token.Token))
+
+	// Tokens are refused once they expire, even though the cookie itself would still be valid
+	expired, err := securecookie.EncodeMulti("session-name", map[interface{}]interface{}{
+		"Username": "test",
+		"Role":     string(user.User),
+		"Expires":  time.Now().Add(-time.Minute).Unix(),
+	}, api.session.Codecs...)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, request(expired))
+}
+
+func TestApi_DevLogin(t *testing.T) {
+	store := newTestStore(t)
+
+	// The provider sends the browser and itself to the address of the server, which is only known once it listens
+	server := httptest.NewUnstartedServer(nil)
+	defer server.Close()
+	conf := config.Default()
+	conf.DevLogin = true
+	conf.DevLoginURL = "http://" + server.Listener.Addr().String()
+	s := newTestServer(t, store, "/tmp", conf)
+	server.Config.Handler = s.handler
+	server.Start()
+
+	// The browser follows the redirects up to the frontend, which is not running
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	browser := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, _ []*http.Request) error {
+		if req.URL.Host != server.Listener.Addr().String() {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+
+	login := func(query string, username string, role string) *http.Response {
+		resp, err := browser.Get(server.URL + "/user/login/dev" + query)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/dev/authorize", resp.Request.URL.Path)
+
+		form := url.Values{
+			"username":     []string{username},
+			"role":         []string{role},
+			"state":        []string{resp.Request.URL.Query().Get("state")},
+			"redirect_uri": []string{resp.Request.URL.Query().Get("redirect_uri")},
+		}
+		resp, err = browser.PostForm(server.URL+"/dev/authorize", form)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// Command line logins get a token which is used like any other
+	resp := login("?mode=token", "jan", "admin")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var token loginToken
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+	resp.Body.Close()
+	assert.Equal(t, "jan", token.Username)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/users", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: conf.SessionCookieName, Value: token.Token})
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	identities, err := store.GetIdentitiesByUsername("jan")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ProviderDev, identities[0].Provider)
+
+	// Logging in again as a user finds the same account, with the role picked this time
+	resp = login("", "jan", "user")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, conf.LoginRedirect, resp.Header.Get("Location"))
+
+	resp, err = browser.Get(server.URL + "/user/me")
+	assert.NoError(t, err)
+	var me types.User
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&me))
+	resp.Body.Close()
+	assert.Equal(t, "jan", me.Username)
+	assert.Equal(t, user.User, me.Role)
+
+	resp, err = browser.Get(server.URL + "/users")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Codes are only exchanged once, and only the callback of the server is redirected to
+	resp = login("", "piet", "wizard")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = browser.Get(server.URL + "/dev/authorize?redirect_uri=https://evil.example.org")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.PostForm(server.URL+"/dev/token", url.Values{"grant_type": []string{"authorization_code"},
+		"code": []string{"guessed"}})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Production deployments refuse the provider
+	conf = config.Default()
+	conf.DevLogin = true
+	conf.Production = true
+	assert.Error(t, conf.Validate())
+	production := newTestServer(t, store, "/tmp", conf)
+	for _, uri := range []string{"/user/login/dev", "/dev/authorize"} {
+		assert.Equal(t, http.StatusNotFound, production.serve(httptest.NewRequest(http.MethodGet, uri, nil)).Code, uri)
+	}
+}
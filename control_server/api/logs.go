@@ -0,0 +1,238 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baas-project/baas/control_server/logtail"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultLogLimit is how many entries GetLogs gives when the request does not say
+	defaultLogLimit = 100
+	// logKeepAlive is how often a stream of the logs is sent a comment while nothing is logged, so proxies do not
+	// close it
+	logKeepAlive = 15 * time.Second
+)
+
+// logQuery is what a request for the logs asks for
+type logQuery struct {
+	level log.Level
+	since time.Time
+	limit int
+}
+
+// parseLogQuery reads the filters of a request for the logs. Since is a time in RFC 3339 or how long ago, such as
+// 15m.
+func (api_ *API) parseLogQuery(r *http.Request) (logQuery, error) {
+	query := r.URL.Query()
+	q := logQuery{level: log.TraceLevel, limit: defaultLogLimit}
+
+	if value := query.Get("level"); value != "" {
+		level, err := log.ParseLevel(value)
+		if err != nil {
+			return q, errors.New("level must be one of panic, fatal, error, warning, info, debug or trace")
+		}
+		q.level = level
+	}
+
+	if value := query.Get("since"); value != "" {
+		if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+			q.since = time.Now().Add(-ago)
+		} else if q.since, err = time.Parse(time.RFC3339, value); err != nil {
+			return q, errors.New("since must be a RFC 3339 time or a duration such as 15m")
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return q, errors.New("limit must be a positive number")
+		}
+		q.limit = limit
+	}
+
+	if q.limit > int(api_.config.LogBufferEntries) {
+		q.limit = int(api_.config.LogBufferEntries)
+	}
+
+	return q, nil
+}
+
+// checkLogAccess lets only admins who logged in read the logs, not the machines which act as the system. Every
+// access is audited.
+func (api_ *API) checkLogAccess(w http.ResponseWriter, r *http.Request, audit string) (logQuery, bool) {
+	if api_.isMachine(r) {
+		http.Error(w, "Only administrators can read the logs", http.StatusForbidden)
+		return logQuery{}, false
+	}
+
+	if api_.logs == nil {
+		http.Error(w, "The control server keeps no logs, LogBufferEntries is zero", http.StatusNotFound)
+		return logQuery{}, false
+	}
+
+	q, err := api_.parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return logQuery{}, false
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"audit": audit,
+		"level": q.level.String(),
+		"since": q.since.Format(time.RFC3339),
+	}).Infof("%s is reading the logs of the control server", api_.requester(r))
+	return q, true
+}
+
+// GetLogs gives the last entries logged by the control server, the oldest first. With ?level= only the entries at
+// that level or more severe, with ?since= only those logged since a time or in the last while. ?limit= gives at
+// most that many, 100 by default. Credentials were scrubbed from the entries before they were kept.
+// Example request: GET /admin/logs?level=warning&since=15m&limit=2
+// Example response:
+//
+//	[{"ID": 4180, "Time": "2022-03-04T10:11:12Z", "Level": "warning",
+//	  "Message": "Machine 52:54:00:d9:71:93 stopped sending heartbeats", "Fields": {"mac": "52:54:00:d9:71:93"}}]
+func (api_ *API) GetLogs(w http.ResponseWriter, r *http.Request) {
+	q, ok := api_.checkLogAccess(w, r, "logs-read")
+	if !ok {
+		return
+	}
+
+	entries := api_.logs.Entries(q.level, q.since, 0, q.limit)
+	if entries == nil {
+		entries = []logtail.Entry{}
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// StreamLogs follows the entries logged by the control server as server-sent events, filtered by ?level= as
+// GetLogs. Every entry is a log event with the entry as its data and its ID as the event ID. A client which
+// reconnects with Last-Event-ID first gets the entries it missed which are still kept. When the client falls too
+// far behind, a missed event tells how many entries it did not get.
+// Example request: GET /admin/logs/stream?level=info
+// Example response:
+//
+//	id: 4181
+//	event: log
+//	data: {"ID": 4181, "Time": "2022-03-04T10:11:13Z", "Level": "info", "Message": "request", ...}
+func (api_ *API) StreamLogs(w http.ResponseWriter, r *http.Request) {
+	q, ok := api_.checkLogAccess(w, r, "logs-streamed")
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "The connection cannot stream the logs", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribing first leaves no gap between the entries which were kept and the ones which follow
+	subscription := api_.logs.Subscribe(q.level)
+	defer api_.logs.Unsubscribe(subscription)
+
+	var last uint64
+	if resume := r.Header.Get("Last-Event-ID"); resume != "" {
+		id, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID must be the ID of an entry", http.StatusBadRequest)
+			return
+		}
+		last = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, id uint64, data interface{}) bool {
+		body, err := json.Marshal(data)
+		if err != nil {
+			return false
+		}
+
+		if id != 0 {
+			_, err = fmt.Fprintf(w, "id: %d\n", id)
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+		}
+		flusher.Flush()
+		return err == nil
+	}
+
+	if last != 0 {
+		for _, entry := range api_.logs.Entries(q.level, time.Time{}, last, int(api_.config.LogBufferEntries)) {
+			if !send("log", entry.ID, entry) {
+				return
+			}
+			last = entry.ID
+		}
+	}
+
+	keepAlive := time.NewTicker(logKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case entry := <-subscription.C:
+			if entry.ID <= last {
+				continue
+			}
+
+			if missed := subscription.Missed(); missed != 0 && !send("missed", 0, struct{ Missed uint64 }{missed}) {
+				return
+			}
+
+			if !send("log", entry.ID, entry) {
+				return
+			}
+			last = entry.ID
+		}
+	}
+}
+
+// RegisterLogHandlers sets the metadata for the routes which let admins read the logs of the control server
+func (api_ *API) RegisterLogHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/logs",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetLogs,
+		Method:      http.MethodGet,
+		Description: "Gets the last entries logged by the control server",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/logs/stream",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.StreamLogs,
+		Method:      http.MethodGet,
+		Description: "Follows the entries logged by the control server as server-sent events",
+	})
+}
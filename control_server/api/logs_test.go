@@ -0,0 +1,115 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/logtail"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Logs(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+	moderator := &user.UserModel{Username: "mod", Email: "mod@example.com", Role: user.Moderator}
+	assert.NoError(t, store.CreateUser(moderator))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(s.api.logs)
+	logger.Info("Control server started")
+	logger.WithField("session_id", "abc").Warn("Session of admin looks odd")
+
+	audits := test.NewGlobal()
+	defer audits.Reset()
+
+	request := func(ctx context.Context, as *user.UserModel, uri string, header http.Header) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+uri, nil)
+		assert.NoError(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		if as != nil {
+			s.login(req, as)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	get := func(as *user.UserModel, uri string, header http.Header) int {
+		resp := request(context.Background(), as, uri, header)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Only administrators who logged in read the logs, not moderators nor the machines
+	assert.Equal(t, http.StatusForbidden, get(moderator, "/admin/logs", nil))
+	assert.Equal(t, http.StatusForbidden, get(nil, "/admin/logs", http.Header{"Type": {"system"}}))
+	assert.Equal(t, http.StatusForbidden, get(nil, "/admin/logs/stream", http.Header{"Type": {"system"}}))
+	assert.Equal(t, http.StatusBadRequest, get(admin, "/admin/logs?level=loud", nil))
+	assert.Equal(t, http.StatusBadRequest, get(admin, "/admin/logs?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, get(admin, "/admin/logs?limit=0", nil))
+
+	resp := request(context.Background(), admin, "/admin/logs?level=warning&since=1h", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var entries []logtail.Entry
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	_ = resp.Body.Close()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "Session of admin looks odd", entries[0].Message)
+	assert.Equal(t, map[string]string{"session_id": logtail.Redacted}, entries[0].Fields)
+
+	// Every access is audited
+	var audited []string
+	for _, entry := range audits.AllEntries() {
+		if audit, ok := entry.Data["audit"].(string); ok {
+			audited = append(audited, audit+" by "+entry.Data["username"].(string))
+		}
+	}
+	assert.Contains(t, audited, "logs-read by admin")
+
+	// The stream starts with the entries after the one the client saw last, and follows the new ones of its level
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp = request(ctx, admin, "/admin/logs/stream?level=warning", http.Header{"Last-Event-ID": {"1"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	defer resp.Body.Close()
+
+	logger.Info("Not loud enough")
+	logger.Error("Machine 52:54:00:d9:71:93 stopped sending heartbeats")
+
+	events := bufio.NewScanner(resp.Body)
+	var streamed []string
+	for len(streamed) < 2 && events.Scan() {
+		if data := strings.TrimPrefix(events.Text(), "data: "); data != events.Text() {
+			var entry logtail.Entry
+			assert.NoError(t, json.Unmarshal([]byte(data), &entry))
+			streamed = append(streamed, entry.Message)
+		}
+	}
+	assert.Equal(t, []string{"Session of admin looks odd", "Machine 52:54:00:d9:71:93 stopped sending heartbeats"},
+		streamed)
+}
@@ -6,10 +6,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/limits"
 	"github.com/baas-project/baas/pkg/model/images"
 	machinemodel "github.com/baas-project/baas/pkg/model/machine"
 	"github.com/baas-project/baas/pkg/model/user"
@@ -20,95 +27,115 @@ import (
 	"github.com/baas-project/baas/pkg/fs"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
 )
 
 // GetMachine GETs any machine in the database based on its MAC address
 // Example message: machine/00:11:22:33:44:55:66
-// Example response: {"name": "Machine 1",
+// Example response: {"Name": "Machine 1",
 //
 //	"Architecture": "x86_64",
-//	"MacAddresses": [{"Mac": "00:11:22:33:44:55:66}]}
+//	"MacAddress": {"Address": "00:11:22:33:44:55:66"},
+//	"CreatedAt": "2022-01-02T15:04:05Z", "UpdatedAt": "2022-01-02T15:04:05Z", ...}
 func (api_ *API) GetMachine(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	mac, ok := vars["mac"]
 	if !ok || mac == "" {
 		http.Error(w, "invalid mac address", http.StatusBadRequest)
-		log.Error("Invalid mac address given")
+		requestLog(r).Error("Invalid mac address given")
 		return
 	}
 
-	machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	machine, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
 	if err != nil {
 		http.Error(w, "couldn't get machine", http.StatusInternalServerError)
-		log.Errorf("get machine by mac: %v", err)
+		requestLog(r).Errorf("get machine by mac: %v", err)
 		return
 	}
 
-	e := json.NewEncoder(w)
-	_ = e.Encode(machine)
+	writeJSON(w, http.StatusOK, types.NewMachine(machine))
 }
 
-// GetMachines fetches all the machines from the database using a GET request
+// GetMachines fetches all the machines from the database using a GET request. With ?sort=created or ?sort=updated
+// the newest come first unless ?order=asc, with ?status=clock_skew only the machines whose clock is off are listed.
 // Example request: machines
-// Example response: {"name": "Machine 1",
+// Example response: [{"Name": "Machine 1",
 //
 //	"Architecture": "x86_64",
-//	"MacAddresses": [{"Mac": "00:11:22:33:44:55:66}]}
-func (api_ *API) GetMachines(w http.ResponseWriter, _ *http.Request) {
-	machines, err := api_.store.GetMachines()
+//	"MacAddress": {"Address": "00:11:22:33:44:55:66"},
+//	"CreatedAt": "2022-01-02T15:04:05Z", "UpdatedAt": "2022-01-02T15:04:05Z", ...}]
+func (api_ *API) GetMachines(w http.ResponseWriter, r *http.Request) {
+	order, err := parseListOrder(w, r)
+	if err != nil {
+		return
+	}
+
+	machines, err := api_.storeFor(r).GetMachines()
 	if err != nil {
 		http.Error(w, "couldn't get machines", http.StatusInternalServerError)
-		log.Errorf("get machines: %v", err)
+		requestLog(r).Errorf("get machines: %v", err)
 		return
 	}
 
-	e := json.NewEncoder(w)
-	_ = e.Encode(machines)
+	machines, ok := api_.filterMachineStatus(w, r, machines)
+	if !ok {
+		return
+	}
+
+	listing := types.NewMachines(machines)
+	order.apply(listing, func(i int) (time.Time, time.Time) {
+		return listing[i].CreatedAt, listing[i].UpdatedAt
+	})
+
+	writeJSON(w, http.StatusOK, listing)
 }
 
 // DeleteMachine Deletes a machine from the database
 // Example request: DELETE machine/[mac]
-// Example response: Successfully deleted
+// Example response: 204 No Content
 func (api_ *API) DeleteMachine(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	mac, ok := vars["mac"]
 	if !ok || mac == "" {
 		http.Error(w, "Invalid mac", http.StatusBadRequest)
-		log.Error("Invalid mac given")
+		requestLog(r).Error("Invalid mac given")
 		return
 	}
 
-	machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	machine, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
 	if err != nil {
 		http.Error(w, "Failed to delete machine", http.StatusInternalServerError)
-		log.Errorf("Cannot find machine with mac address: %s (%v)", mac, err)
+		requestLog(r).Errorf("Cannot find machine with mac address: %s (%v)", mac, err)
 		return
 	}
 
-	image, err := api_.store.GetMachineImageByMac(util.MacAddress{Address: mac})
+	image, err := api_.storeFor(r).GetMachineImageByMac(util.MacAddress{Address: mac})
 
 	if err != nil {
 		http.Error(w, "Failed to get the next boot setup", http.StatusBadRequest)
-		log.Errorf("Failed to get the machine image: %v", err)
+		requestLog(r).Errorf("Failed to get the machine image: %v", err)
 		return
 	}
 
-	err = api_.store.DeleteMachine(machine)
+	err = api_.storeFor(r).DeleteMachine(machine)
 	if err != nil {
 		http.Error(w, "Failed to delete machine", http.StatusInternalServerError)
-		log.Errorf("Machine %s deletion failed with error code: %v", mac, err)
+		requestLog(r).Errorf("Machine %s deletion failed with error code: %v", mac, err)
 		return
 	}
 
 	err = os.RemoveAll(fmt.Sprintf(api_.diskpath+"/%s", image.UUID))
 	if err != nil {
 		http.Error(w, "Failed to delete machine", http.StatusInternalServerError)
-		log.Errorf("Machine %s deletion failed with error code: %v", mac, err)
+		requestLog(r).Errorf("Machine %s deletion failed with error code: %v", mac, err)
 		return
 	}
 
-	http.Error(w, "Successfully deleted the machine", http.StatusOK)
+	// The artifacts of its boots went with the history of the machine
+	if err = os.RemoveAll(artifactDir(api_.diskpath, mac)); err != nil {
+		requestLog(r).Warnf("Cannot remove the boot artifacts of %s: %v", mac, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // UpdateMachine updates (or adds) the machine to the database.
@@ -116,15 +143,14 @@ func (api_ *API) DeleteMachine(w http.ResponseWriter, r *http.Request) {
 // Example of a JSON message:
 //
 //	{
-//	   "name": "Hello World",
+//	   "Name": "Hello World",
 //	   "Architecture": "x86_64",
 //	   "Managed": true,
-//	   "DiskUUIDs": null,
-//	   "MacAddresses": [{
-//	       "Mac": "52:54:00:d9:71:15",
-//	       "MachineModelID": 12
-//	   }]
+//	   "MacAddress": {"Address": "52:54:00:d9:71:15"},
+//	   "DefaultImage": {"ImageUUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "BootMode": "discard"}
 //	}
+//
+// Example response: the stored machine
 func (api_ *API) UpdateMachine(w http.ResponseWriter, r *http.Request) {
 	var machine machinemodel.MachineModel
 	err := json.NewDecoder(r.Body).Decode(&machine)
@@ -132,18 +158,25 @@ func (api_ *API) UpdateMachine(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		http.Error(w, "invalid machine given", http.StatusBadRequest)
-		log.Errorf("Invalid machine given: %v", err)
+		requestLog(r).Errorf("Invalid machine given: %v", err)
 		return
 	}
 
-	err = api_.store.UpdateMachine(&machine)
-	if err != nil {
-		http.Error(w, "couldn't update machine", http.StatusInternalServerError)
-		log.Errorf("get update machine: %v", err)
+	if !api_.checkDefaultImage(w, &machine.DefaultImage) {
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).UpdateMachine(&machine), "couldn't update machine") != nil {
+		return
+	}
+
+	// Only some of the fields are updated, the stored machine tells what it looks like now
+	updated, err := api_.storeFor(r).GetMachineByMac(machine.MacAddress)
+	if ErrorWrite(w, err, "Cannot fetch the updated machine") != nil {
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(&machine)
+	writeJSON(w, http.StatusOK, types.NewMachine(updated))
 }
 
 // CreateMachine creates the machine in the database and returns a JSON object representing it
@@ -152,12 +185,16 @@ func (api_ *API) CreateMachine(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&machine)
 	if err != nil {
 		http.Error(w, "invalid machine given", http.StatusBadRequest)
-		log.Errorf("Invalid machine given: %v", err)
+		requestLog(r).Errorf("Invalid machine given: %v", err)
 		return
 	}
 
-	err = api_.store.CreateMachine(&machine)
-	if ErrorWrite(w, err, "Cannot create machine") != nil {
+	if !api_.checkDefaultImage(w, &machine.DefaultImage) {
+		return
+	}
+
+	err = api_.storeFor(r).CreateMachine(&machine)
+	if StoreErrorWrite(w, err, "Cannot create machine") != nil {
 		return
 	}
 
@@ -172,16 +209,15 @@ func (api_ *API) CreateMachine(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// api_.store.CreateImage(&machineImage.ImageModel)
-	api_.store.CreateMachineImage(machineImage)
+	api_.storeFor(r).CreateMachineImage(machineImage)
 
 	if err != nil {
 		http.Error(w, "couldn't create image model", http.StatusInternalServerError)
-		log.Errorf("decode create model: %v", err)
+		requestLog(r).Errorf("decode create model: %v", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(&machine)
+	writeJSON(w, http.StatusCreated, types.NewMachine(&machine))
 }
 
 // UploadDiskImage allows the management os to upload disk images
@@ -190,38 +226,48 @@ func (api_ *API) UploadDiskImage(w http.ResponseWriter, r *http.Request) {
 	id, ok := vars["uuid"]
 	if !ok || id == "" {
 		http.Error(w, "Invalid uuid", http.StatusBadRequest)
-		log.Error("Invalid uuid given")
+		requestLog(r).Error("Invalid uuid given")
 		return
 	}
 
 	mac, ok := vars["mac"]
 	if !ok || mac == "" {
 		http.Error(w, "Invalid mac address", http.StatusBadRequest)
-		log.Error("Invalid mac address given")
+		requestLog(r).Error("Invalid mac address given")
 		return
 	}
 
 	path := fmt.Sprintf("%s/%s", api_.diskpath, id)
 	temppath := fmt.Sprintf("%s.%s.tmp", path, uuid.New().String())
 
+	done, ok := api_.admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
 	f, err := os.OpenFile(temppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
 	if err != nil {
 		http.NotFound(w, r)
-		log.Errorf("failed to open/create disk image (%v)", err)
+		requestLog(r).Errorf("failed to open/create disk image (%v)", err)
 		return
 	}
 
-	err = fs.CopyStream(r.Body, f)
+	_, err = fs.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
+		_ = os.Remove(temppath)
 		http.Error(w, "failed to write file", http.StatusInternalServerError)
-		log.Errorf("failed to write file (%v)", err)
+		requestLog(r).Errorf("failed to write file (%v)", err)
 		return
 	}
 
 	err = os.Rename(temppath, path)
 	if err != nil {
 		http.Error(w, "failed to move file", http.StatusInternalServerError)
-		log.Errorf("failed to move file (%v)", err)
+		requestLog(r).Errorf("failed to move file (%v)", err)
 		return
 	}
 }
@@ -233,22 +279,22 @@ func (api_ *API) DownloadDiskImage(w http.ResponseWriter, r *http.Request) {
 	mac, ok := vars["mac"]
 	if !ok || mac == "" {
 		http.Error(w, "Invalid mac address", http.StatusBadRequest)
-		log.Error("Invalid mac address given")
+		requestLog(r).Error("Invalid mac address given")
 		return
 	}
 
-	image, err := api_.store.GetMachineImageByMac(util.MacAddress{Address: mac})
+	image, err := api_.storeFor(r).GetMachineImageByMac(util.MacAddress{Address: mac})
 
 	if err != nil {
 		http.NotFound(w, r)
-		log.Errorf("failed to read disk image (%v)", err)
+		requestLog(r).Errorf("failed to read disk image (%v)", err)
 		return
 	}
 
 	f, err := image.OpenImageFile(0)
 	if err != nil {
 		http.NotFound(w, r)
-		log.Errorf("failed to read disk image (%v)", err)
+		requestLog(r).Errorf("failed to read disk image (%v)", err)
 		return
 	}
 
@@ -257,12 +303,13 @@ func (api_ *API) DownloadDiskImage(w http.ResponseWriter, r *http.Request) {
 	err = fs.CopyStream(f, w)
 	if err != nil {
 		http.Error(w, "failed to write file", http.StatusInternalServerError)
-		log.Errorf("failed to write file (%v)", err)
+		requestLog(r).Errorf("failed to write file (%v)", err)
 		return
 	}
 }
 
-// BootInform handles all incoming boot inform requests
+// BootInform handles all incoming boot inform requests. The machine claims the boot at the head of its queue, or
+// with ?image=<uuid> the first queued boot which flashes the image picked from the pxelinux menu.
 func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 	// First we fetch the id associated of the
 	vars := mux.Vars(r)
@@ -270,91 +317,322 @@ func (api_ *API) BootInform(w http.ResponseWriter, r *http.Request) {
 
 	if !ok || mac == "" {
 		http.Error(w, "mac address is not found", http.StatusBadRequest)
-		log.Errorf("mac not provided")
+		requestLog(r).Errorf("mac not provided")
 		return
 	}
 
-	machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	machine, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
 
 	if err != nil {
 		http.Error(w, "Cannot find the machine in the database", http.StatusBadRequest)
-		log.Errorf("Machine not found")
+		requestLog(r).Errorf("Machine not found")
 		return
 	}
 
-	log.Debug("Received BootInform request, serving Reprovisioning information")
-
-	// Get the next boot configuration based on a FIFO queue.
-	bootInfo, err := api_.store.GetNextBootSetup(machine.MacAddress.Address)
+	if !machine.Approved() {
+		http.Error(w, "The machine was not approved", http.StatusConflict)
+		return
+	}
 
-	if err == gorm.ErrRecordNotFound {
-		http.Error(w, "No boot setup found", http.StatusNotFound)
+	protocol, ok := api_.negotiateProtocol(w, r)
+	if !ok {
 		return
 	}
+	stamp := api_.stampVersions(r, mac, protocol)
+
+	requestLog(r).Debug("Received BootInform request, serving Reprovisioning information")
+
+	// Get the next boot configuration based on a FIFO queue, unless an image was picked from the boot menu. With
+	// nothing queued the machine boots its default image, when it has one.
+	var bootInfo *images.BootSetup
+	var resp images.ImageSetup
+	if chosen := r.URL.Query().Get("image"); chosen != "" {
+		bootInfo, err = api_.storeFor(r).GetNextBootSetupWithImage(machine.MacAddress.Address, images.ImageUUID(chosen))
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "No boot setup with the chosen image found", http.StatusNotFound)
+			return
+		}
+	} else {
+		bootInfo, err = api_.storeFor(r).GetNextBootSetup(machine.MacAddress.Address)
+		if err == gorm.ErrRecordNotFound {
+			def := api_.resolveDefault(machine)
+			if def.Rule == ruleLocalBoot {
+				http.Error(w, "No boot setup found", http.StatusNotFound)
+				return
+			}
+
+			requestLog(r).Infof("Boot of %s: %s", mac, def.Reason)
+			bootInfo, resp = defaultBootSetup(machine, def)
+			err = nil
+		}
+	}
 
 	if err != nil {
 		http.Error(w, "Error with finding boot setup", http.StatusBadRequest)
-		log.Errorf("Database error: %v", err)
+		requestLog(r).Errorf("Database error: %v", err)
 		return
 	}
 
+	if err = api_.rotateMetadata(r, bootInfo); err != nil {
+		requestLog(r).Warnf("Cannot update the metadata of %s: %v", mac, err)
+	}
+
 	// TODO: Fix foreign key to version
-	resp, err := api_.store.GetImageSetup(string(bootInfo.SetupUUID))
+	if bootInfo.SetupUUID != "" {
+		resp, err = api_.storeFor(r).GetImageSetup(string(bootInfo.SetupUUID))
+		if err != nil {
+			http.Error(w, "Failed to get the next boot setup", http.StatusInternalServerError)
+			requestLog(r).Errorf("Failed to get the image setup: %v", err)
+			return
+		}
+	}
 
+	// "latest" is resolved here rather than when the boot was scheduled, so the newest upload is flashed.
+	resolved, err := api_.resolveVersions(bootInfo, &resp)
 	if err != nil {
-		http.Error(w, "Failed to get the next boot setup", http.StatusInternalServerError)
-		log.Errorf("Failed to get the image setup: %v", err)
+		http.Error(w, "Failed to get the next boot setup", http.StatusBadRequest)
+		requestLog(r).Errorf("Failed to resolve the image versions: %v", err)
 		return
 	}
 
-	// Circumvents a problem in the foreign key where the version is
-	// not properly loaded into struct. This should be fixed.
-	for i := range resp.Images {
-		version, verr := api_.store.GetVersionByID(resp.Images[i].VersionID)
+	// A machine claiming a new boot has given up on the one it was flashing before, and left its diskless boot
+	api_.endDisklessBoot(mac)
+	if previous, perr := api_.storeFor(r).GetActiveBoot(mac); perr == nil {
+		previous.Fail(images.FailureAgentLost, "the machine claimed another boot")
+		if perr = api_.storeFor(r).UpdateBootHistory(previous); perr != nil {
+			requestLog(r).Warnf("Cannot release the previous boot of %s: %v", mac, perr)
+		}
+	}
+
+	// Boots of the default image, and those queued before they were verified, read back as the machine does now
+	verify := bootInfo.Verify
+	if verify == "" {
+		verify = api_.verifyMode(machine, bootInfo)
+	}
+
+	// The history entry locks the versions against modification until the boot is finished
+	boot := images.BootHistory{
+		MachineMAC:       bootInfo.MachineMAC,
+		SetupUUID:        bootInfo.SetupUUID,
+		RequestedVersion: bootInfo.Version,
+		ResolvedVersions: resolved,
+		TargetDevice:     bootInfo.TargetDevice,
+		BootMode:         bootInfo.BootMode,
+		VerifyMode:       verify,
+		Template:         bootInfo.Template,
+		TemplateRevision: bootInfo.TemplateRevision,
+		TemplateOptions:  bootInfo.TemplateOptions,
+		State:            images.BootInProgress,
+		LastSeen:         time.Now(),
+		CAFingerprint:    r.Header.Get("X-BAAS-CA-Fingerprint"),
+		VersionStamp:     stamp,
+	}
+	err = api_.storeFor(r).AddBootHistory(&boot)
+	if err != nil {
+		requestLog(r).Warnf("Cannot record the boot history of %s: %v", mac, err)
+	}
+
+	// The key goes with the boot, an encrypted boot which was not recorded cannot be handed out
+	if bootInfo.Encrypt {
+		if err == nil {
+			err = api_.encryptBoot(&boot, bootInfo, &resp)
+		}
+
+		if err != nil {
+			http.Error(w, "Failed to make the key of the encrypted boot", http.StatusInternalServerError)
+			requestLog(r).Errorf("Cannot make the key of the boot of %s: %v", mac, err)
+			if boot.ID != 0 {
+				boot.Fail(images.FailureUnknown, "the control server could not make the key of the boot")
+				if err = api_.storeFor(r).UpdateBootHistory(&boot); err != nil {
+					requestLog(r).Warnf("Cannot fail the boot of %s: %v", mac, err)
+				}
+			}
+			return
+		}
+	}
+
+	if bootInfo.BootMode == images.BootDiskless {
+		if err = api_.exportDisklessImages(r, mac, &resp); err != nil {
+			http.Error(w, "Failed to export the images", http.StatusInternalServerError)
+			requestLog(r).Errorf("Cannot export the images of the diskless boot of %s: %v", mac, err)
+			return
+		}
+	}
+
+	// The machine image shares the disk with the images, image sets write whole disks so they go without it
+	if !resp.MultiDisk() {
+		image, err := api_.storeFor(r).GetMachineImageByMac(util.MacAddress{Address: mac})
 
-		if verr != nil {
+		if err != nil {
 			http.Error(w, "Failed to get the next boot setup", http.StatusBadRequest)
-			log.Errorf("Failed to get the machine image: %v", verr)
+			requestLog(r).Errorf("Failed to get the machine image: %v", err)
 			return
 		}
 
-		resp.Images[i].Version = *version
+		// Add the machine image to the list
+		resp.Images = append(resp.Images, images.ImageFrozen{
+			Image: image.ImageModel,
+			Version: images.Version{
+				Version: 0,
+				Size:    uint64(image.Size * images.SizeMegabyte),
+			},
+		})
 	}
 
-	image, err := api_.store.GetMachineImageByMac(util.MacAddress{Address: mac})
+	resp.TargetDevice = bootInfo.TargetDevice
+	resp.BootMode = bootInfo.BootMode
+	resp.Verify = verify
+	if bootInfo.InjectSSHKeys {
+		resp.SSHAuthorizedKeys = bootInfo.Metadata.SSHAuthorizedKeys
+	}
 
-	if err != nil {
-		http.Error(w, "Failed to get the next boot setup", http.StatusBadRequest)
-		log.Errorf("Failed to get the machine image: %v", err)
-		return
+	if api_.peers != nil {
+		for i := range resp.Images {
+			frozen := &resp.Images[i]
+			// Only versions with a checksum can be verified after they are downloaded from another machine
+			if frozen.Version.SHA256 != "" {
+				frozen.Peer = api_.peers.plan(mac, images.PeerVersion{
+					ImageUUID: frozen.Image.UUID,
+					Version:   frozen.Version.Version,
+				})
+			}
+		}
 	}
 
-	// Add the machine image to the list
-	resp.Images = append(resp.Images, images.ImageFrozen{
-		Image: image.ImageModel,
-		Version: images.Version{
-			Version: 0,
-		},
-	})
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// preflightError is returned when a boot setup is refused because it does not fit on the machine
+type preflightError struct {
+	Error string
+
+	// Required and Available are the sizes of the images and the target disk in bytes
+	Required  uint64
+	Available uint64
+}
+
+// architectureError is returned when a boot setup is refused because its images are built for another architecture
+type architectureError struct {
+	Error        string
+	Architecture machinemodel.SystemArchitecture
+	Images       []images.ImageUUID
+}
+
+// checkArchitectures finds the images of a setup which cannot run on the machine. The architecture of older images
+// is unknown, they are booted anyway and only logged.
+func checkArchitectures(r *http.Request, machine *machinemodel.MachineModel,
+	setup *images.ImageSetup) *architectureError {
+	var conflicting []images.ImageUUID
+	for _, frozen := range setup.Images {
+		image := frozen.Image
+		if image.Architecture.Conflicts(machine.Architecture) {
+			conflicting = append(conflicting, image.UUID)
+		} else if image.Architecture == "" || image.Architecture == machinemodel.Unknown {
+			requestLog(r).Warnf("The architecture of image %s is unknown, it may not boot on %s", image.UUID,
+				machine.MacAddress.Address)
+		}
+	}
+
+	if len(conflicting) == 0 {
+		return nil
+	}
+
+	return &architectureError{
+		Error:        fmt.Sprintf("the images are not built for %s", machine.Architecture),
+		Architecture: machine.Architecture,
+		Images:       conflicting,
+	}
+}
+
+// targetDiskError is returned when a boot setup is refused because the disk it is meant for cannot be told apart
+type targetDiskError struct {
+	Error    string
+	Selector string `json:",omitempty"`
+
+	// Disks are the disks the machine reported, TargetDevice is the one the management OS writes to
+	Disks        []machinemodel.DiskModel
+	TargetDevice string
+}
+
+// selectTargetDisk finds the device file of the disk a boot setup is written to. The disk is selected by the
+// TargetDevice of the boot setup, otherwise by the DiskUUID of its images, and has to be the disk the management OS
+// writes to. Without a selector the images go to the disk the management OS writes to.
+func selectTargetDisk(machine *machinemodel.MachineModel, setup *images.ImageSetup,
+	bootSetup *images.BootSetup) (string, *targetDiskError) {
+	selectors := map[string]bool{}
+	if bootSetup.TargetDevice != "" {
+		selectors[bootSetup.TargetDevice] = true
+	} else {
+		for _, frozen := range setup.Images {
+			if frozen.Image.DiskUUID != "" {
+				selectors[frozen.Image.DiskUUID] = true
+			}
+		}
+	}
+
+	if len(selectors) == 0 {
+		return machine.TargetDevice, nil
+	}
+
+	fail := &targetDiskError{Disks: machine.Disks, TargetDevice: machine.TargetDevice}
+	if len(selectors) > 1 {
+		fail.Error = "the images are built for different disks"
+		return "", fail
+	}
+
+	for selector := range selectors {
+		fail.Selector = selector
+	}
+
+	disks := machine.FindDisks(fail.Selector)
+	switch {
+	case len(machine.Disks) == 0:
+		fail.Error = "the disks of this machine are not known yet, boot it once without selecting a disk"
+	case len(disks) == 0:
+		fail.Error = "no disk of this machine matches"
+	case len(disks) > 1:
+		fail.Error = "several disks of this machine match"
+	case disks[0].Device != machine.TargetDevice:
+		fail.Error = "the management OS writes the images to " + machine.TargetDevice
+	default:
+		return disks[0].Device, nil
+	}
+
+	return "", fail
+}
 
+// requiredDiskSize sums the logical sizes of the images a boot setup would flash if it were claimed now
+func (api_ *API) requiredDiskSize(bootSetup *images.BootSetup) (uint64, error) {
+	setup, err := api_.store.GetImageSetup(string(bootSetup.SetupUUID))
 	if err != nil {
-		http.Error(w, "Failed to get the next boot setup", http.StatusBadRequest)
-		log.Errorf("Failed to fetch image setup: %v", err)
-		return
+		return 0, err
 	}
 
-	if err := json.NewEncoder(w).Encode(&resp); err != nil {
-		log.Errorf("Error while serialising json: %v", err)
-		http.Error(w, "Error while serialising response json", http.StatusInternalServerError)
-		return
+	if _, err = api_.resolveVersions(bootSetup, &setup); err != nil {
+		return 0, err
+	}
+
+	var required uint64
+	for _, frozen := range setup.Images {
+		required += frozen.Version.Size
 	}
 
-	r.Header.Set("content-type", "application/json")
+	return required, nil
 }
 
-// SetBootSetup adds an image to the schedule to be flashed onto the machine
+// SetBootSetup adds an image to the schedule to be flashed onto the machine.
+// Setups that are larger than the machine's disk, or which are meant for a disk that cannot be found in the
+// machine, are refused with 422, unless an admin passes ?force=true. An image set is booted by passing SetUUID
+// instead of SetupUUID, every member then has to match a disk of its own.
 // Example request: POST machine/52:54:00:d9:71:93/boot
-// Example body: {"Version": 1636116090, "ImageUUID": "74368cec-7903-4233-87b7-564195619dce", "update": true}
+// The Version is either left out to use the versions in the image setup, "latest" or a version number to pin.
+// The BootMode is persistent, discard or overlay, only persistent boots can be uploaded with update.
+// The SSH keys of the user are added to the metadata, inject_ssh_keys also writes them into the images.
+// verify has the images read back after they are written, the response warns when full reading back slows it down.
+// Example body: {"Version": "latest", "SetupUUID": "74368cec-7903-4233-87b7-564195619dce", "update": true,
+//
+//	"BootMode": "persistent", "Metadata": {"Hostname": "lab-01"}, "MetadataTemplate": "lab",
+//	"TargetDevice": "S4EWNX0N123456", "inject_ssh_keys": true, "verify": "quick"}
 //
 //	Example response: {
 //	  "MachineModelID": 1,
@@ -368,39 +646,468 @@ func (api_ *API) SetBootSetup(w http.ResponseWriter, r *http.Request) {
 
 	if !ok || mac == "" {
 		http.Error(w, "mac address is not found", http.StatusBadRequest)
-		log.Errorf("mac not provided")
+		requestLog(r).Errorf("mac not provided")
 		return
 	}
 
-	machine, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	machine, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
 
 	if err != nil {
 		http.Error(w, "Cannot find the machine in the database", http.StatusBadRequest)
-		log.Errorf("Machine not found")
+		requestLog(r).Errorf("Machine not found")
 		return
 	}
 
-	// Fetch the data from the body
-	var bootSetup images.BootSetup
-	err = json.NewDecoder(r.Body).Decode(&bootSetup)
+	// Restricted machines are reserved for the users granted access, directly or through a course
+	allowed, err := api_.mayBootMachine(r, machine)
+	if ErrorWrite(w, err, "Cannot check the access to the machine") != nil {
+		return
+	} else if !allowed {
+		http.Error(w, "You have no access to this machine", http.StatusForbidden)
+		return
+	}
 
-	if err != nil {
-		http.Error(w, "Invalid machine given", http.StatusBadRequest)
-		log.Errorf("Invalid machine given: %v", err)
+	request, ok := api_.readBootRequest(w, r)
+	if !ok {
 		return
 	}
 
-	bootSetup.MachineMAC = machine.MacAddress.Address
-	err = api_.store.AddBootSetupToMachine(&bootSetup)
+	bootSetup := request.BootSetup
+	if refusal := api_.checkBootMachine(r, machine, &request, &bootSetup); refusal != nil {
+		refusal.write(w)
+		return
+	}
 
+	bootSetup.MachineMAC = machine.MacAddress.Address
+	queued, refusal, err := api_.enqueueBoots(r, request.Setup.Username, []*images.BootSetup{&bootSetup})
 	if err != nil {
 		http.Error(w, "cannot add the bootsetup to the machine", http.StatusBadRequest)
-		log.Errorf("Cannot add boot info: %v", err)
+		requestLog(r).Errorf("Cannot add boot info: %v", err)
+		return
+	} else if queued == 0 {
+		refusal.write(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, bootSetup)
+}
+
+// bootRequest is a boot setup which was read from a request and passed the checks which do not depend on the
+// machine it is queued on
+type bootRequest struct {
+	BootSetup images.BootSetup
+	Setup     images.ImageSetup
+	// Required is the size of the images in bytes
+	Required uint64
+	// Force skips the checks of the machine, only admins can force a boot
+	Force bool
+}
+
+// bootRefusal is why a boot setup cannot be queued on a machine. The body is written as plain text when it is a
+// string, and as JSON otherwise.
+type bootRefusal struct {
+	Status int
+	Body   interface{}
+}
+
+func (b *bootRefusal) write(w http.ResponseWriter) {
+	if text, ok := b.Body.(string); ok {
+		http.Error(w, text, b.Status)
 		return
 	}
 
-	e := json.NewEncoder(w)
-	_ = e.Encode(bootSetup)
+	writeJSON(w, b.Status, b.Body)
+}
+
+// message is the refusal as a single line, the error of the bodies which are JSON
+func (b *bootRefusal) message() string {
+	if text, ok := b.Body.(string); ok {
+		return text
+	}
+
+	encoded, err := json.Marshal(b.Body)
+	if err != nil {
+		return http.StatusText(b.Status)
+	}
+
+	var described struct{ Error string }
+	if json.Unmarshal(encoded, &described) == nil && described.Error != "" {
+		return described.Error
+	}
+
+	return string(encoded)
+}
+
+// readBootRequest reads the boot setup from the body of the request and checks it, it answers the request when the
+// boot setup cannot be queued on any machine
+func (api_ *API) readBootRequest(w http.ResponseWriter, r *http.Request) (bootRequest, bool) {
+	var request bootRequest
+	bootSetup := &request.BootSetup
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, bootSetup)
+	}
+	if err != nil {
+		http.Error(w, "Invalid machine given", http.StatusBadRequest)
+		requestLog(r).Errorf("Invalid machine given: %v", err)
+		return request, false
+	}
+
+	if !api_.applyBootTemplate(w, r, body, bootSetup) {
+		return request, false
+	}
+
+	if err := api_.resolveMetadata(r, bootSetup); err != nil {
+		http.Error(w, "cannot find the metadata template", http.StatusBadRequest)
+		requestLog(r).Errorf("Cannot resolve metadata template %s: %v", bootSetup.MetadataTemplate, err)
+		return request, false
+	}
+
+	if bootSetup.BootMode == "" {
+		bootSetup.BootMode = images.BootPersistent
+	}
+
+	if !bootSetup.BootMode.Valid() {
+		http.Error(w, "BootMode must be one of persistent, discard, overlay or diskless", http.StatusBadRequest)
+		return request, false
+	}
+
+	// The changes of the other modes are thrown away, uploading them would make them persistent after all
+	if bootSetup.Update && bootSetup.BootMode != images.BootPersistent {
+		http.Error(w, "Only persistent boots can upload their changes", http.StatusBadRequest)
+		return request, false
+	}
+
+	if !checkEncryption(w, bootSetup) {
+		return request, false
+	}
+
+	if err := checkVerify(bootSetup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return request, false
+	}
+
+	// An image set is booted through the image setup the control server keeps in sync with it
+	if bootSetup.SetUUID != "" {
+		bootSetup.SetupUUID = bootSetup.SetUUID
+	}
+
+	// Images without versions would only fail in the management OS, when it cannot download them
+	required, err := api_.requiredDiskSize(bootSetup)
+	var versionless *versionlessError
+	if errors.As(err, &versionless) {
+		writeJSON(w, http.StatusUnprocessableEntity, struct {
+			Error string
+			Image images.ImageUUID
+		}{"image has no versions", versionless.Image})
+		requestLog(r).Warnf("Refusing boot setup %s: %v", bootSetup.SetupUUID, err)
+		return request, false
+	} else if errors.Is(err, errCorruptVersion) {
+		http.Error(w, "The image setup asks for a version which no longer matches its checksum",
+			http.StatusUnprocessableEntity)
+		requestLog(r).Warnf("Refusing boot setup %s: %v", bootSetup.SetupUUID, err)
+		return request, false
+	} else if err != nil {
+		http.Error(w, "cannot find the image setup or the requested versions", http.StatusBadRequest)
+		requestLog(r).Errorf("Cannot determine the size of image setup %s: %v", bootSetup.SetupUUID, err)
+		return request, false
+	}
+	request.Required = required
+
+	request.Setup, err = api_.storeFor(r).GetImageSetup(string(bootSetup.SetupUUID))
+	if ErrorWrite(w, err, "cannot find the image setup") != nil {
+		return request, false
+	}
+	setup := &request.Setup
+
+	if bootSetup.BootMode == images.BootDiskless {
+		if api_.exports == nil {
+			http.Error(w, "Diskless boots need NBD exports, which are not enabled", http.StatusBadRequest)
+			return request, false
+		}
+
+		for i := range setup.Images {
+			if err = exportable(&setup.Images[i].Image); err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return request, false
+			}
+		}
+	}
+
+	if ErrorWrite(w, api_.addSSHKeys(r, bootSetup, setup.Username), "Cannot fetch the SSH keys") != nil {
+		return request, false
+	}
+
+	// The members of an image set each go to a disk of their own
+	if setup.MultiDisk() {
+		// The overlays are kept next to the machine image, which image sets overwrite
+		if bootSetup.BootMode == images.BootOverlay || bootSetup.BootMode == images.BootDiskless {
+			http.Error(w, "Image sets cannot be booted with an overlay or diskless", http.StatusBadRequest)
+			return request, false
+		}
+
+		if _, err = api_.resolveVersions(bootSetup, setup); err != nil {
+			http.Error(w, "cannot find the requested versions", http.StatusBadRequest)
+			return request, false
+		}
+	}
+
+	request.Force = r.URL.Query().Get("force") == "true" && api_.isAdmin(r)
+	return request, true
+}
+
+// checkBootMachine checks whether the boot setup can be flashed onto the machine and picks the disk it is written
+// to, it returns why not when it cannot
+func (api_ *API) checkBootMachine(r *http.Request, machine *machinemodel.MachineModel, request *bootRequest,
+	bootSetup *images.BootSetup) *bootRefusal {
+	mac := machine.MacAddress.Address
+	setup := &request.Setup
+
+	// Not even admins force a boot onto a machine which registered itself and was not approved
+	if !machine.Approved() {
+		return &bootRefusal{http.StatusConflict, "The machine was not approved"}
+	}
+
+	bootSetup.Verify = api_.verifyMode(machine, bootSetup)
+	if bootSetup.Verify == images.VerifyFull {
+		bootSetup.Warnings = append(bootSetup.Warnings, fullVerifyWarning)
+	}
+
+	// An image for another architecture would only show up as a machine which does not boot
+	if aerr := checkArchitectures(r, machine, setup); aerr != nil && !request.Force {
+		requestLog(r).Warnf("Refusing boot setup for %s: %s", mac, aerr.Error)
+		return &bootRefusal{http.StatusUnprocessableEntity, aerr}
+	}
+
+	// The members of an image set each go to a disk of their own, so they are checked one by one
+	if setup.MultiDisk() {
+		if derr := checkSetDisks(machine, setup); derr != nil && !request.Force {
+			requestLog(r).Warnf("Refusing image set %s for %s: %s", setup.UUID, mac, derr.Error)
+			return &bootRefusal{http.StatusUnprocessableEntity, derr}
+		}
+
+		return nil
+	}
+
+	// Images built for another disk layout would be written over whatever disk the management OS uses
+	device, derr := selectTargetDisk(machine, setup, bootSetup)
+	if derr != nil && !request.Force {
+		requestLog(r).Warnf("Refusing boot setup for %s: %s", mac, derr.Error)
+		return &bootRefusal{http.StatusUnprocessableEntity, derr}
+	} else if derr != nil {
+		device = machine.TargetDevice
+	}
+	bootSetup.TargetDevice = device
+
+	// Refuse setups which cannot fit on the disk now, rather than finding out in the management OS after a reboot.
+	// Diskless boots only keep their copy-on-write stores on the disk.
+	available := machine.TargetDiskSize()
+	required := request.Required
+	if available != 0 && required > available && !request.Force && bootSetup.BootMode != images.BootDiskless {
+		requestLog(r).Warnf("Refusing boot setup for %s: requires %d bytes, disk has %d bytes", mac, required, available)
+		return &bootRefusal{http.StatusUnprocessableEntity, preflightError{
+			Error:     "the images do not fit on the disk of this machine",
+			Required:  required,
+			Available: available,
+		}}
+	}
+
+	return nil
+}
+
+// overridesBootCap reports whether an admin or a moderator passes the cap on the active boots with ?override=true
+func (api_ *API) overridesBootCap(r *http.Request) bool {
+	if r.URL.Query().Get("override") != "true" {
+		return false
+	}
+
+	if api_.isAdmin(r) {
+		return true
+	}
+
+	principal := api_.principal(r)
+	return principal.Kind == PrincipalUser && principal.Role == user.Moderator
+}
+
+// enqueueBoots queues the boot setups of a user, in order and as many as the limits of the user allow. It returns
+// how many were queued, and why the others were not. The limits are checked and the setups queued under a single
+// lock, so requests at the same time cannot both take the last place.
+func (api_ *API) enqueueBoots(r *http.Request, username string, bootSetups []*images.BootSetup) (int, *bootRefusal,
+	error) {
+	api_.enqueue.Lock()
+	defer api_.enqueue.Unlock()
+
+	count := uint64(len(bootSetups))
+	actions := []limits.Action{limits.QueueBoots(count)}
+	if api_.overridesBootCap(r) {
+		requestLog(r).Infof("%s passes the cap on the active boots of %s", api_.requester(r), username)
+	} else {
+		actions = append(actions, limits.ActiveBoots(count, api_.config.MaxActiveBoots))
+	}
+
+	allowed := count
+	var refusal *bootRefusal
+	for _, action := range actions {
+		var exceeded *limits.ExceededError
+		err := limits.Check(api_.storeFor(r), username, action)
+		if errors.As(err, &exceeded) {
+			if exceeded.Remaining() < allowed {
+				allowed = exceeded.Remaining()
+				refusal = &bootRefusal{exceeded.StatusCode(), newLimitError(exceeded)}
+			}
+		} else if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if refusal != nil {
+		requestLog(r).Infof("Queueing %d of %d boots of %s: %v", allowed, count, username,
+			refusal.Body.(limitError).Error)
+		api_.alertExceeded(username, refusal.Body.(limitError).Error)
+	}
+
+	for i := uint64(0); i < allowed; i++ {
+		if err := api_.storeFor(r).AddBootSetupToMachine(bootSetups[i]); err != nil {
+			return int(i), nil, err
+		}
+	}
+
+	return int(allowed), refusal, nil
+}
+
+// BootMachineGroup queues a boot setup on every machine of a group, the machines it cannot be queued on fail one by
+// one. When the limits of the owner of the setup only leave room for some of the machines, it is queued on the first
+// of them by name. The machines are listed by name, the message of those it was queued on holds its warnings.
+// Example request: POST /machine-group/lab-1/boot[?override=true]
+// Example body: the same as for POST /machine/{mac}/boot
+// Example response: 207 Multi-Status {"succeeded": 1, "failed": 1, "skipped": 0, "items": [
+//
+//	{"id": "52:54:00:d9:71:93", "status": "succeeded"}, {"id": "52:54:00:d9:71:94", "status": "failed",
+//	"error_code": "forbidden", "message": "limit MaxActiveBoots of 5 exceeded"}]}
+func (api_ *API) BootMachineGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := GetTag("group", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	all, err := api_.storeFor(r).GetMachines()
+	if ErrorWrite(w, err, "Cannot fetch the machines") != nil {
+		return
+	}
+
+	var members []machinemodel.MachineModel
+	for _, m := range all {
+		if m.Group == group {
+			members = append(members, m)
+		}
+	}
+
+	if len(members) == 0 {
+		http.Error(w, "The group has no machines", http.StatusNotFound)
+		return
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Name != members[j].Name {
+			return members[i].Name < members[j].Name
+		}
+		return members[i].MacAddress.Address < members[j].MacAddress.Address
+	})
+
+	request, ok := api_.readBootRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The outcome of each machine is kept in the order of the group, the boots are only queued at the end
+	refusals := make([]*bootRefusal, len(members))
+	var bootSetups []*images.BootSetup
+	var queuedOn []int
+	for i := range members {
+		machine := &members[i]
+		mac := machine.MacAddress.Address
+
+		allowed, err := api_.mayBootMachine(r, machine)
+		if ErrorWrite(w, err, "Cannot check the access to the machine") != nil {
+			return
+		} else if !allowed {
+			refusals[i] = &bootRefusal{http.StatusForbidden, "You have no access to this machine"}
+			continue
+		}
+
+		bootSetup := request.BootSetup
+		if refusal := api_.checkBootMachine(r, machine, &request, &bootSetup); refusal != nil {
+			refusals[i] = refusal
+			continue
+		}
+
+		bootSetup.MachineMAC = mac
+		bootSetups = append(bootSetups, &bootSetup)
+		queuedOn = append(queuedOn, i)
+	}
+
+	queued, refusal, err := api_.enqueueBoots(r, request.Setup.Username, bootSetups)
+	if ErrorWrite(w, err, "Cannot queue the boots") != nil {
+		return
+	}
+
+	warnings := make([]string, len(members))
+	for i, member := range queuedOn {
+		if i < queued {
+			warnings[member] = strings.Join(bootSetups[i].Warnings, "; ")
+		} else {
+			refusals[member] = refusal
+		}
+	}
+
+	result := types.NewMultiStatus()
+	for i := range members {
+		mac := members[i].MacAddress.Address
+		if refusals[i] != nil {
+			result.Fail(mac, refusals[i].Status, refusals[i].message())
+		} else {
+			result.Succeed(mac, warnings[i])
+		}
+	}
+
+	requestLog(r).Infof("Queued boot setup %s on %d machines of group %s, rejected %d", request.Setup.UUID,
+		result.Succeeded, group, result.Failed)
+	writeMultiStatus(w, result)
+}
+
+// UpdateInventory stores the hardware which the management OS found in the machine
+// Example request: PUT machine/52:54:00:d9:71:93/inventory
+// Example body: {"TargetDevice": "/dev/sda", "Disks": [{"Device": "/dev/sda", "Size": 256060514304,
+//
+//	"UUID": "1f5e2a4c-8a1d-4c3e-9f21-6b0d3c2e7a10", "Serial": "S4EWNX0N123456"}]}
+func (api_ *API) UpdateInventory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	mac, ok := vars["mac"]
+	if !ok || mac == "" {
+		http.Error(w, "Invalid mac address", http.StatusBadRequest)
+		requestLog(r).Error("Invalid mac address given")
+		return
+	}
+
+	var inventory machinemodel.Inventory
+	if err := json.NewDecoder(r.Body).Decode(&inventory); err != nil {
+		http.Error(w, "Invalid inventory given", http.StatusBadRequest)
+		requestLog(r).Errorf("Invalid inventory given: %v", err)
+		return
+	}
+
+	err := api_.storeFor(r).UpdateInventory(util.MacAddress{Address: mac}, &inventory)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find the machine in the database", http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot update the inventory") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &inventory)
 }
 
 // RegisterMachineHandlers sets the metadata for each of the routes and registers them to the global handler
@@ -409,26 +1116,31 @@ func (api_ *API) RegisterMachineHandlers() {
 		URI:         "/machine/{mac}",
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeMachinesRead,
 		Handler:     api_.GetMachine,
 		Method:      http.MethodGet,
 		Description: "Gets a machine from the database",
 	})
 
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/machines",
-		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
-		UserAllowed: true,
-		Handler:     api_.GetMachines,
-		Method:      http.MethodGet,
-		Description: "Gets all the machines from the database",
+		URI:              "/machines",
+		Permissions:      []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:      true,
+		AnonymousAllowed: true,
+		Scope:            user.ScopeMachinesRead,
+		Handler:          api_.GetMachines,
+		Method:           http.MethodGet,
+		Description:      "Gets all the machines from the database",
 	})
 
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/machine",
 		Permissions: []user.UserRole{user.Admin},
 		UserAllowed: true,
+		Scope:       user.ScopeAdmin,
 		Handler:     api_.UpdateMachine,
 		Method:      http.MethodPut,
+		Schema:      "machine",
 		Description: "Updates a machine",
 	})
 
@@ -436,8 +1148,11 @@ func (api_ *API) RegisterMachineHandlers() {
 		URI:         "/machine",
 		Permissions: []user.UserRole{user.Admin},
 		UserAllowed: true,
+		Audience:    AudienceEveryone,
+		Scope:       user.ScopeAdmin,
 		Handler:     api_.CreateMachine,
 		Method:      http.MethodPost,
+		Schema:      "machine",
 		Description: "Creates a new machine",
 	})
 
@@ -445,6 +1160,7 @@ func (api_ *API) RegisterMachineHandlers() {
 		URI:         "/machine/{mac}",
 		Permissions: []user.UserRole{user.Admin},
 		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
 		Handler:     api_.DeleteMachine,
 		Method:      http.MethodDelete,
 		Description: "Deletes a machine from the database",
@@ -454,8 +1170,12 @@ func (api_ *API) RegisterMachineHandlers() {
 		URI:         "/machine/{mac}/disk/{uuid}",
 		Permissions: []user.UserRole{user.Moderator, user.Admin},
 		UserAllowed: true,
+		Audience:    AudienceEveryone,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeMachinesWrite,
 		Handler:     api_.UploadDiskImage,
 		Method:      http.MethodPost,
+		Schema:      schemaFile,
 		Description: "Uploads the image",
 	})
 
@@ -463,15 +1183,52 @@ func (api_ *API) RegisterMachineHandlers() {
 		URI:         "/machine/{mac}/image",
 		Permissions: []user.UserRole{user.Moderator, user.Admin},
 		UserAllowed: true,
+		Audience:    AudienceEveryone,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeMachinesRead,
 		Handler:     api_.DownloadDiskImage,
 		Method:      http.MethodGet,
 		Description: "Downloads the disk image",
 	})
 
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/queue",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetBootQueue,
+		Method:      http.MethodGet,
+		Description: "Lists the boot setups queued for a machine",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/history",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeMachinesRead,
+		Handler:     api_.GetBootHistory,
+		Method:      http.MethodGet,
+		Description: "Lists the boot setups a machine booted into",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/inventory",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeMachinesWrite,
+		Handler:     api_.UpdateInventory,
+		Method:      http.MethodPut,
+		Schema:      "machine-inventory",
+		Description: "Stores the hardware the management OS found in the machine",
+	})
+
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/machine/{mac}/boot",
 		Permissions: []user.UserRole{user.Moderator, user.Admin},
 		UserAllowed: false,
+		Audience:    AudienceAgents,
+		Scope:       user.ScopeMachinesRead,
 		Handler:     api_.BootInform,
 		Method:      http.MethodGet,
 		Description: "Gets the next configuration a machine is going to boot into",
@@ -482,7 +1239,22 @@ func (api_ *API) RegisterMachineHandlers() {
 		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
 		UserAllowed: true,
 		Handler:     api_.SetBootSetup,
+		Idempotent:  true,
+		Scope:       user.ScopeMachinesBoot,
 		Method:      http.MethodPost,
+		Schema:      "boot",
 		Description: "Adds a boot configuration to the queue",
 	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine-group/{group}/boot",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Handler:     api_.BootMachineGroup,
+		Idempotent:  true,
+		Scope:       user.ScopeMachinesBoot,
+		Method:      http.MethodPost,
+		Schema:      "boot",
+		Description: "Adds a boot configuration to the queues of the machines of a group",
+	})
 }
@@ -12,8 +12,11 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/baas-project/baas/pkg/model/images"
 	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
 
+	"github.com/baas-project/baas/control_server/config"
 	"github.com/baas-project/baas/pkg/database/sqlite"
 	"github.com/baas-project/baas/pkg/util"
 	"github.com/stretchr/testify/assert"
@@ -35,7 +38,7 @@ func TestApi_UpdateMachine(t *testing.T) {
 	assert.NoError(t, err)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "")
+	handler := getHandler(store, "", "", config.Default())
 	req := httptest.NewRequest(http.MethodPut, "/machine", &mj)
 	req.Header.Add("type", "system")
 	req.Header.Add("origin", "http://localhost:9090")
@@ -68,7 +71,7 @@ func TestApi_UpdateMachineExists(t *testing.T) {
 	assert.NoError(t, err)
 
 	resp := httptest.NewRecorder()
-	handler := getHandler(store, "", "")
+	handler := getHandler(store, "", "", config.Default())
 	req := httptest.NewRequest(http.MethodPut, "/machine", &mj)
 	req.Header.Add("type", "system")
 	req.Header.Add("origin", "http://localhost:9090")
@@ -124,7 +127,7 @@ func TestApi_GetMachine(t *testing.T) {
 	req.Header.Add("type", "system")
 	req.Header.Add("origin", "http://localhost:9090")
 
-	handler := getHandler(store, "", "")
+	handler := getHandler(store, "", "", config.Default())
 	handler.ServeHTTP(resp, req)
 
 	assert.NoError(t, err)
@@ -169,7 +172,7 @@ func TestApi_GetMachines(t *testing.T) {
 	req.Header.Add("type", "system")
 	req.Header.Add("origin", "http://localhost:9090")
 
-	handler := getHandler(store, "", "")
+	handler := getHandler(store, "", "", config.Default())
 	handler.ServeHTTP(resp, req)
 
 	assert.NoError(t, err)
@@ -199,3 +202,172 @@ func TestApi_GetMachines(t *testing.T) {
 	assert.Equal(t, dm2.Architecture, machine2.Architecture)
 	assert.Equal(t, dm2.MacAddress, machine2.MacAddress)
 }
+
+func TestApi_SetBootSetupDiskTooSmall(t *testing.T) {
+	store := newTestStore(t)
+
+	machine := machinemodel.MachineModel{
+		MacAddress:   util.MacAddress{Address: "abc"},
+		Name:         "bca",
+		Architecture: machinemodel.X86_64,
+	}
+	assert.NoError(t, store.CreateMachine(&machine))
+	assert.NoError(t, store.UpdateInventory(machine.MacAddress, &machinemodel.Inventory{
+		TargetDevice: "/dev/sda",
+		Disks:        []machinemodel.DiskModel{{Device: "/dev/sda", Size: 256}},
+	}))
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.Admin}))
+	image := images.ImageModel{Name: "big", Username: "test", UUID: "big-image"}
+	store.CreateImage(&image)
+	assert.NoError(t, store.SetVersionSize(image.UUID, 0, 480))
+
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+
+	setup := images.ImageSetup{Name: "setup", UUID: "big-setup", Username: "test"}
+	assert.NoError(t, store.CreateImageSetup("test", &setup))
+	store.AddImageToImageSetup(&setup, stored, stored.Versions[0], false)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	resp := s.request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "big-setup"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	var preflight preflightError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&preflight))
+	assert.Equal(t, uint64(480), preflight.Required)
+	assert.Equal(t, uint64(256), preflight.Available)
+
+	resp = s.request(http.MethodPost, "/machine/abc/boot?force=true", `{"SetupUUID": "big-setup"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestApi_SetBootSetupArchitecture(t *testing.T) {
+	store := newTestStore(t)
+
+	machine := machinemodel.MachineModel{
+		MacAddress:   util.MacAddress{Address: "abc"},
+		Architecture: machinemodel.X86_64,
+	}
+	assert.NoError(t, store.CreateMachine(&machine))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	for _, arch := range []machinemodel.SystemArchitecture{machinemodel.Arm64, machinemodel.Unknown} {
+		image := images.ImageModel{Name: string(arch), Username: "test", UUID: images.ImageUUID(arch),
+			Architecture: arch}
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+
+		stored, err := store.GetImageByUUID(image.UUID)
+		assert.NoError(t, err)
+		setup := images.ImageSetup{Name: string(arch), UUID: images.ImageUUID(arch), Username: "test"}
+		assert.NoError(t, store.CreateImageSetup("test", &setup))
+		store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(1), false)
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	boot := func(uri string, setup machinemodel.SystemArchitecture) *httptest.ResponseRecorder {
+		return s.request(http.MethodPost, uri, `{"SetupUUID": "`+string(setup)+`"}`)
+	}
+
+	resp := boot("/machine/abc/boot", machinemodel.Arm64)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	var mismatch architectureError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&mismatch))
+	assert.Equal(t, machinemodel.X86_64, mismatch.Architecture)
+	assert.Equal(t, []images.ImageUUID{"Arm64"}, mismatch.Images)
+
+	// Images of which the architecture is unknown cannot be checked, they are only warned about
+	assert.Equal(t, http.StatusOK, boot("/machine/abc/boot", machinemodel.Unknown).Code)
+	assert.Equal(t, http.StatusOK, boot("/machine/abc/boot?force=true", machinemodel.Arm64).Code)
+}
+
+func TestSelectTargetDisk(t *testing.T) {
+	machine := machinemodel.MachineModel{
+		TargetDevice: "/dev/sda",
+		Disks: []machinemodel.DiskModel{
+			{Device: "/dev/sda", UUID: "1f5e2a4c-8a1d-4c3e-9f21-6b0d3c2e7a10", Serial: "WD-123"},
+			{Device: "/dev/nvme0n1", UUID: "30df844c", Serial: "S4EW"},
+			{Device: "/dev/sdb", Serial: "WD-123"},
+		},
+	}
+
+	setup := func(diskUUIDs ...string) *images.ImageSetup {
+		var setup images.ImageSetup
+		for _, diskUUID := range diskUUIDs {
+			setup.Images = append(setup.Images, images.ImageFrozen{Image: images.ImageModel{DiskUUID: diskUUID}})
+		}
+		return &setup
+	}
+
+	// Without a selector the images go to the disk of the management OS
+	device, err := selectTargetDisk(&machine, setup(""), &images.BootSetup{})
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/sda", device)
+
+	device, err = selectTargetDisk(&machine, setup("1F5E2A4C-8A1D-4C3E-9F21-6B0D3C2E7A10"), &images.BootSetup{})
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/sda", device)
+
+	// The selector of the boot request goes before the disks of the images
+	device, err = selectTargetDisk(&machine, setup("30df844c"), &images.BootSetup{TargetDevice: "/dev/sda"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/sda", device)
+
+	_, err = selectTargetDisk(&machine, setup("30df844c"), &images.BootSetup{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "the management OS writes the images to /dev/sda", err.Error)
+		assert.Len(t, err.Disks, 3)
+	}
+
+	_, err = selectTargetDisk(&machine, setup(), &images.BootSetup{TargetDevice: "WD-123"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "several disks of this machine match", err.Error)
+	}
+
+	_, err = selectTargetDisk(&machine, setup("30df844c", "missing"), &images.BootSetup{})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "the images are built for different disks", err.Error)
+	}
+
+	_, err = selectTargetDisk(&machinemodel.MachineModel{}, setup("30df844c"), &images.BootSetup{})
+	assert.NotNil(t, err)
+}
+
+func TestApi_BootModes(t *testing.T) {
+	store := newTestStore(t)
+
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac, Architecture: machinemodel.X86_64}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+	assert.NoError(t, store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	assert.Equal(t, http.StatusBadRequest,
+		s.request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup", "BootMode": "scratch"}`).Code)
+	assert.Equal(t, http.StatusBadRequest,
+		s.request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup", "BootMode": "discard", "Update": true}`).Code)
+
+	resp := s.request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var queued images.BootSetup
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&queued))
+	assert.Equal(t, images.BootPersistent, queued.BootMode)
+
+	// A completed discard boot leaves the machine dirty until the next boot is flashed
+	dirty := func() bool {
+		machine, err := store.GetMachineByMac(mac)
+		assert.NoError(t, err)
+		return machine.Dirty
+	}
+
+	for _, mode := range []images.BootMode{images.BootDiscard, images.BootOverlay} {
+		assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: mac.Address, SetupUUID: "setup",
+			BootMode: mode, State: images.BootInProgress}))
+		assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/machine/abc/boot/state", `{"State": "completed"}`).Code)
+		assert.Equal(t, mode == images.BootDiscard, dirty())
+	}
+}
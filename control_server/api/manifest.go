@@ -0,0 +1,321 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// manifestRunning jobs are hashing the blocks of the version
+	manifestRunning = "running"
+	// manifestReady versions have a manifest which matches their file
+	manifestReady = "ready"
+	// manifestFailed jobs could not hash the version, the version keeps the manifest it had
+	manifestFailed = "failed"
+)
+
+// manifestFileFmt is the name of the manifest of a version in the directory of its image
+const manifestFileFmt = "%d.manifest"
+
+// errNoManifest is returned for versions without a manifest, or whose manifest no longer matches their file
+var errNoManifest = errors.New("the version has no manifest")
+
+// versionManifest is the manifest of a version as it is stored next to the file of the version
+type versionManifest struct {
+	Version uint64
+	// SHA256 is the checksum of the version when its blocks were hashed, the manifest is outdated once it changes
+	SHA256 string
+	fs.Manifest
+}
+
+// manifestJob hashes the blocks of a version in the background
+type manifestJob struct {
+	Image      images.ImageUUID
+	Version    uint64
+	State      string
+	Error      string `json:",omitempty"`
+	Blocks     int
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// manifestKey is a version of an image
+type manifestKey struct {
+	image   images.ImageUUID
+	version uint64
+}
+
+// manifestJobs remembers the last manifest job of every version until the control server restarts
+type manifestJobs struct {
+	mu   sync.Mutex
+	last map[manifestKey]*manifestJob
+}
+
+func newManifestJobs() *manifestJobs {
+	return &manifestJobs{last: map[manifestKey]*manifestJob{}}
+}
+
+// begin registers a job for a version, unless one is running for it already
+func (m *manifestJobs) begin(uuid images.ImageUUID, version uint64) (*manifestJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := manifestKey{uuid, version}
+	if job, ok := m.last[key]; ok && job.State == manifestRunning {
+		copied := *job
+		return &copied, false
+	}
+
+	job := &manifestJob{Image: uuid, Version: version, State: manifestRunning, StartedAt: time.Now()}
+	m.last[key] = job
+	copied := *job
+	return &copied, true
+}
+
+// finish records the outcome of a job
+func (m *manifestJobs) finish(job *manifestJob, blocks int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	stored := m.last[manifestKey{job.Image, job.Version}]
+	stored.FinishedAt = &now
+	stored.Blocks = blocks
+	stored.State = manifestReady
+	if err != nil {
+		stored.State = manifestFailed
+		stored.Error = err.Error()
+	}
+}
+
+// get returns a copy of the last job of a version, it is nil when there was none
+func (m *manifestJobs) get(uuid images.ImageUUID, version uint64) *manifestJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.last[manifestKey{uuid, version}]
+	if !ok {
+		return nil
+	}
+
+	copied := *job
+	return &copied
+}
+
+// manifestFile is where the manifest of a version is stored, next to the file of the version
+func (api_ *API) manifestFile(image *images.ImageModel, version uint64) string {
+	return api_.imageDir(image) + "/" + fmt.Sprintf(manifestFileFmt, version)
+}
+
+// checkManifestable refuses versions whose blocks say nothing about the disk, the blocks of encrypted versions and
+// of disk formats other than raw are not where they are on the disk
+func checkManifestable(version *images.Version) error {
+	if version.BootKeyID != 0 {
+		return fmt.Errorf("version %d is encrypted", version.Version)
+	}
+
+	if version.Format != "" && version.Format != images.FormatRaw {
+		return fmt.Errorf("version %d is stored as %s rather than as a raw disk", version.Version, version.Format)
+	}
+
+	return nil
+}
+
+// loadManifest reads the manifest of a version, a manifest which no longer matches the version counts as missing
+func (api_ *API) loadManifest(image *images.ImageModel, version *images.Version) (*fs.Manifest, error) {
+	content, err := ioutil.ReadFile(api_.manifestFile(image, version.Version))
+	if os.IsNotExist(err) {
+		return nil, errNoManifest
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored versionManifest
+	if err = json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("the manifest of version %d is damaged: %v", version.Version, err)
+	}
+
+	if stored.Version != version.Version || (version.SHA256 != "" && !strings.EqualFold(stored.SHA256, version.SHA256)) {
+		return nil, errNoManifest
+	}
+
+	return &stored.Manifest, nil
+}
+
+// buildManifest hashes the blocks of a version and stores its manifest. The manifest only replaces the one the
+// version had once it is complete.
+func (api_ *API) buildManifest(image *images.ImageModel, version *images.Version) (*fs.Manifest, error) {
+	var manifest *fs.Manifest
+	err := readContent(api_.versionFile(image, version.Version), image, func(r io.Reader) (err error) {
+		manifest, err = fs.ReadManifest(r, fs.ManifestBlockSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(versionManifest{Version: version.Version, SHA256: version.SHA256,
+		Manifest: *manifest})
+	if err != nil {
+		return nil, err
+	}
+
+	path := api_.manifestFile(image, version.Version)
+	if err = ioutil.WriteFile(path+".part", content, 0644); err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(path+".part", path); err != nil {
+		_ = os.Remove(path + ".part")
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// findVersion looks up the version named by the variable of the URI, it answers 404 when there is none
+func findVersion(w http.ResponseWriter, r *http.Request, image *images.ImageModel, name string) *images.Version {
+	number, err := strconv.ParseUint(mux.Vars(r)[name], 10, 64)
+	version := image.FindVersion(number)
+	if err != nil || version == nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return nil
+	}
+
+	return version
+}
+
+// CreateManifest hashes the blocks of a version in the background, so it can be compared with the other versions.
+// Versions which were stored before the manifests existed get theirs this way.
+// Example request: POST /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/versions/3/manifest
+// Example response: {"Image": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Version": 3, "State": "running",
+// "Blocks": 0, "StartedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) CreateManifest(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	version := findVersion(w, r, image, "version")
+	if version == nil {
+		return
+	}
+
+	if err = checkManifestable(version); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+
+	job, ok := api_.manifests.begin(image.UUID, version.Version)
+	if !ok {
+		release()
+		writeJSON(w, http.StatusConflict, job)
+		return
+	}
+
+	requestLog(r).Infof("%s started to hash the blocks of version %d of image %s", api_.requester(r),
+		version.Version, image.UUID)
+
+	go func() {
+		defer release()
+
+		manifest, err := api_.buildManifest(image, version)
+		blocks := 0
+		if err == nil {
+			blocks = manifest.Blocks()
+		} else {
+			log.Warnf("Cannot hash the blocks of version %d of image %s: %v", version.Version, image.UUID, err)
+		}
+		api_.manifests.finish(job, blocks, err)
+	}()
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GetManifest follows the job hashing the blocks of a version, versions whose manifest was made before the control
+// server started are ready without a job
+// Example request: GET /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/versions/3/manifest
+// Example response: {"Image": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Version": 3, "State": "ready",
+// "Blocks": 10240, "StartedAt": "2022-06-01T12:00:00Z", "FinishedAt": "2022-06-01T12:01:30Z"}
+func (api_ *API) GetManifest(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	version := findVersion(w, r, image, "version")
+	if version == nil {
+		return
+	}
+
+	job := api_.manifests.get(image.UUID, version.Version)
+	if job != nil && job.State != manifestReady {
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+
+	manifest, err := api_.loadManifest(image, version)
+	if errors.Is(err, errNoManifest) {
+		http.Error(w, fmt.Sprintf("Version %d has no manifest", version.Version), http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot read the manifest") != nil {
+		return
+	}
+
+	if job == nil {
+		job = &manifestJob{Image: image.UUID, Version: version.Version, State: manifestReady}
+	}
+	job.Blocks = manifest.Blocks()
+	writeJSON(w, http.StatusOK, job)
+}
+
+// RegisterManifestHandlers sets the metadata for the routes which hash the blocks of versions
+func (api_ *API) RegisterManifestHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions/{version}/manifest",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.CreateManifest,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Hashes the blocks of a version so it can be compared with the other versions",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions/{version}/manifest",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetManifest,
+		Method:      http.MethodGet,
+		Description: "Follows the hashing of the blocks of a version",
+	})
+}
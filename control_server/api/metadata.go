@@ -0,0 +1,318 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// resolveMetadata merges the metadata template referenced by a boot setup with the metadata given in the request.
+// Templates are looked up for the logged-in user, or the owner of the image setup for system requests.
+func (api_ *API) resolveMetadata(r *http.Request, bootSetup *images.BootSetup) error {
+	if bootSetup.MetadataTemplate == "" {
+		return nil
+	}
+
+	username := api_.sessionUsername(r)
+	if username == "" {
+		setup, err := api_.storeFor(r).GetImageSetup(string(bootSetup.SetupUUID))
+		if err != nil {
+			return err
+		}
+		username = setup.Username
+	}
+
+	template, err := api_.storeFor(r).GetMetadataTemplate(username, bootSetup.MetadataTemplate)
+	if err != nil {
+		return err
+	}
+
+	bootSetup.Metadata = template.Metadata.Merge(bootSetup.Metadata)
+	return nil
+}
+
+// rotateMetadata replaces the metadata served to a machine with the one of the boot setup it just claimed
+func (api_ *API) rotateMetadata(r *http.Request, bootSetup *images.BootSetup) error {
+	if bootSetup.Metadata.Empty() {
+		return api_.storeFor(r).DeleteMachineMetadata(bootSetup.MachineMAC)
+	}
+
+	return api_.storeFor(r).SetMachineMetadata(&images.MachineMetadata{
+		MachineMAC: bootSetup.MachineMAC,
+		MachineIP:  api_.clientIP(r),
+		InstanceID: uuid.New().String(),
+		Metadata:   bootSetup.Metadata,
+	})
+}
+
+// machineMetadata finds the metadata for the machine in the URI, which only that machine or an admin may read
+func (api_ *API) machineMetadata(w http.ResponseWriter, r *http.Request) (*images.MachineMetadata, error) {
+	mac, err := GetTag("mac", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	metadata, err := api_.storeFor(r).GetMachineMetadata(mac)
+	if err != nil {
+		http.Error(w, "No metadata found for this machine", http.StatusNotFound)
+		return nil, err
+	}
+
+	if from := api_.clientIP(r); metadata.MachineIP != from && !api_.isAdmin(r) {
+		http.Error(w, "Metadata can only be requested by the machine itself", http.StatusForbidden)
+		log.Warnf("%s requested the metadata of %s", from, mac)
+		return nil, errors.New("metadata requested by another host")
+	}
+
+	return metadata, nil
+}
+
+// GetMachineMetadata serves the metadata for the current boot of a machine
+// Example request: GET /machine/52:54:00:d9:71:93/metadata
+// Example response: {"MachineMAC": "52:54:00:d9:71:93", "MachineIP": "192.168.1.10",
+//
+//	"InstanceID": "fcc0ed46-1f55-4366-a1fd-73b61473bbd5", "Hostname": "lab-01",
+//	"SSHAuthorizedKeys": ["ssh-ed25519 AAAA..."], "Values": {"course": "os"}}
+func (api_ *API) GetMachineMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := api_.machineMetadata(w, r)
+	if err != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+// CompleteMachineMetadata stops serving the metadata once the machine has finished booting.
+// This is called by the phone_home module of cloud-init.
+// Example request: POST /machine/52:54:00:d9:71:93/metadata/complete
+func (api_ *API) CompleteMachineMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := api_.machineMetadata(w, r)
+	if err != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteMachineMetadata(metadata.MachineMAC), "Cannot remove the metadata") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cloudInitMetadata finds the metadata belonging to the machine making a cloud-init request
+func (api_ *API) cloudInitMetadata(w http.ResponseWriter, r *http.Request) (*images.MachineMetadata, error) {
+	metadata, err := api_.storeFor(r).GetMachineMetadataByIP(api_.clientIP(r))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.NotFound(w, r)
+		return nil, err
+	}
+
+	if ErrorWrite(w, err, "Cannot fetch the metadata") != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// ServeCloudInitMetadata serves the meta-data file of the cloud-init NoCloud data source.
+// JSON is valid YAML, so we do not need a YAML encoder for this.
+// Example request: GET /2009-04-04/meta-data
+// Example response: {"instance-id": "fcc0ed46-1f55-4366-a1fd-73b61473bbd5", "local-hostname": "lab-01",
+//
+//	"public-keys": ["ssh-ed25519 AAAA..."], "course": "os"}
+func (api_ *API) ServeCloudInitMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := api_.cloudInitMetadata(w, r)
+	if err != nil {
+		return
+	}
+
+	resp := map[string]interface{}{}
+	for k, v := range metadata.Values {
+		resp[k] = v
+	}
+	resp["instance-id"] = metadata.InstanceID
+	resp["local-hostname"] = metadata.Hostname
+	resp["public-keys"] = metadata.SSHAuthorizedKeys
+
+	w.Header().Set("Content-Type", "text/yaml")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ServeCloudInitUserData serves the user-data file of the cloud-init NoCloud data source as cloud-config.
+// It asks cloud-init to phone home once the boot is done, after which the metadata is no longer served.
+// Example request: GET /2009-04-04/user-data
+func (api_ *API) ServeCloudInitUserData(w http.ResponseWriter, r *http.Request) {
+	metadata, err := api_.cloudInitMetadata(w, r)
+	if err != nil {
+		return
+	}
+
+	config := map[string]interface{}{
+		"ssh_authorized_keys": metadata.SSHAuthorizedKeys,
+		"phone_home": map[string]interface{}{
+			"url":  fmt.Sprintf("http://%s/machine/%s/metadata/complete", r.Host, metadata.MachineMAC),
+			"post": []string{"instance_id"},
+		},
+	}
+
+	if metadata.Hostname != "" {
+		config["hostname"] = metadata.Hostname
+	}
+
+	w.Header().Set("Content-Type", "text/cloud-config")
+	_, _ = fmt.Fprintln(w, "#cloud-config")
+	_ = json.NewEncoder(w).Encode(config)
+}
+
+// getMetadataTemplates lists the metadata templates of a user
+// Example request: GET /user/[name]/metadata-templates
+// Example response: [{"Name": "lab", "Hostname": "", "SSHAuthorizedKeys": ["ssh-ed25519 AAAA..."], "Values": {}}]
+func (api_ *API) getMetadataTemplates(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	templates, err := api_.storeFor(r).GetMetadataTemplates(username)
+	if ErrorWrite(w, err, "Cannot fetch the metadata templates") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, templates)
+}
+
+// createMetadataTemplate saves a new metadata template for a user
+// Example request: POST /user/[name]/metadata-templates
+// Example body: {"Name": "lab", "SSHAuthorizedKeys": ["ssh-ed25519 AAAA..."], "Values": {"course": "os"}}
+func (api_ *API) createMetadataTemplate(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var template images.MetadataTemplate
+	if err = json.NewDecoder(r.Body).Decode(&template); err != nil || template.Name == "" {
+		http.Error(w, "Invalid metadata template given", http.StatusBadRequest)
+		log.Errorf("Invalid metadata template given: %v", err)
+		return
+	}
+
+	template.Username = username
+	if err = api_.storeFor(r).CreateMetadataTemplate(&template); err != nil {
+		http.Error(w, "Cannot create the metadata template", http.StatusConflict)
+		log.Errorf("Cannot create metadata template: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, template)
+}
+
+func (api_ *API) getMetadataTemplateFromURI(w http.ResponseWriter, r *http.Request) (*images.MetadataTemplate, error) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	name, err := GetTag("template", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	template, err := api_.storeFor(r).GetMetadataTemplate(username, name)
+	if err != nil {
+		http.Error(w, "Metadata template not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// getMetadataTemplate gets a single metadata template of a user
+// Example request: GET /user/[name]/metadata-templates/lab
+func (api_ *API) getMetadataTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := api_.getMetadataTemplateFromURI(w, r)
+	if err != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, template)
+}
+
+// deleteMetadataTemplate removes a metadata template of a user
+// Example request: DELETE /user/[name]/metadata-templates/lab
+func (api_ *API) deleteMetadataTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := api_.getMetadataTemplateFromURI(w, r)
+	if err != nil {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteMetadataTemplate(template), "Cannot delete the metadata template") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterMetadataHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterMetadataHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/metadata-templates",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.getMetadataTemplates,
+		Method:      http.MethodGet,
+		Description: "Lists the metadata templates of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/metadata-templates",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.createMetadataTemplate,
+		Method:      http.MethodPost,
+		Schema:      "metadata-template",
+		Description: "Saves a metadata template for a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/metadata-templates/{template}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.getMetadataTemplate,
+		Method:      http.MethodGet,
+		Description: "Gets a metadata template of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/metadata-templates/{template}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.deleteMetadataTemplate,
+		Method:      http.MethodDelete,
+		Description: "Deletes a metadata template of a user",
+	})
+}
+
+// registerCloudInitHandlers adds the routes the machines use to fetch their metadata. These do not use the
+// route table since the machines have no session, they are checked against the address the machine booted from.
+func (api_ *API) registerCloudInitHandlers(r *mux.Router) {
+	r.HandleFunc("/machine/{mac}/metadata", api_.GetMachineMetadata).Methods(http.MethodGet)
+	r.HandleFunc("/machine/{mac}/metadata/complete", api_.CompleteMachineMetadata).Methods(http.MethodPost)
+	r.HandleFunc("/2009-04-04/meta-data", api_.ServeCloudInitMetadata).Methods(http.MethodGet)
+	r.HandleFunc("/2009-04-04/user-data", api_.ServeCloudInitUserData).Methods(http.MethodGet)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_CloudInitMetadata(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+
+	err := store.SetMachineMetadata(&images.MachineMetadata{
+		MachineMAC: "abc",
+		MachineIP:  "192.0.2.1",
+		InstanceID: "instance",
+		Metadata: images.Metadata{
+			Hostname:          "lab-01",
+			SSHAuthorizedKeys: images.StringList{"ssh-ed25519 AAAA"},
+			Values:            images.MetadataValues{"course": "os"},
+		},
+	})
+	assert.NoError(t, err)
+
+	conf := config.Default()
+	conf.TrustedProxies = []string{"10.0.0.0/8"}
+	s := newTestServer(t, store, "/tmp", conf)
+	forwarded := func(method string, uri string, from string, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, nil)
+		req.RemoteAddr = from + ":1234"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return s.serve(req)
+	}
+	request := func(method string, uri string, from string) *httptest.ResponseRecorder {
+		return forwarded(method, uri, from, "")
+	}
+
+	resp := request(http.MethodGet, "/2009-04-04/meta-data", "192.0.2.1")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var metadata map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+	assert.Equal(t, "lab-01", metadata["local-hostname"])
+	assert.Equal(t, "instance", metadata["instance-id"])
+	assert.Equal(t, "os", metadata["course"])
+
+	// Other machines do not get to see the metadata
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/2009-04-04/meta-data", "192.0.2.2").Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/machine/abc/metadata", "192.0.2.2").Code)
+
+	// Behind a trusted proxy the machine is the client it forwards for, anyone else cannot claim to be the machine
+	assert.Equal(t, http.StatusOK, forwarded(http.MethodGet, "/2009-04-04/meta-data", "10.0.0.5", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusOK, forwarded(http.MethodGet, "/machine/abc/metadata", "10.0.0.5", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusNotFound, forwarded(http.MethodGet, "/2009-04-04/meta-data", "10.0.0.5", "").Code)
+	assert.Equal(t, http.StatusNotFound,
+		forwarded(http.MethodGet, "/2009-04-04/meta-data", "192.0.2.2", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusForbidden,
+		forwarded(http.MethodGet, "/machine/abc/metadata", "192.0.2.2", "192.0.2.1").Code)
+
+	resp = request(http.MethodGet, "/2009-04-04/user-data", "192.0.2.1")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "#cloud-config")
+
+	// After phoning home the metadata is gone
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPost, "/machine/abc/metadata/complete", "192.0.2.1").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/machine/abc/metadata", "192.0.2.1").Code)
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetMetrics writes the metrics of the control server in the Prometheus text format
+// Example request: GET metrics
+// Example response: # HELP baas_downloads_active Image downloads which are streaming.
+//
+//	# TYPE baas_downloads_active gauge
+//	baas_downloads_active 3
+func (api_ *API) GetMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.Default.Write(w); err != nil {
+		log.Warnf("Cannot write the metrics: %v", err)
+	}
+}
+
+// RegisterMetricsHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterMetricsHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/metrics",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Quiet:       true,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetMetrics,
+		Method:      http.MethodGet,
+		Description: "Gets the metrics of the control server",
+	})
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// globalScope is the scope of moderators who are not limited to any course
+const globalScope = authz.GlobalScope
+
+// moderatorScopes gets the courses the moderator behind a request is scoped to. It is empty for anyone else,
+// including moderators who moderate everyone.
+func (api_ *API) moderatorScopes(r *http.Request) ([]course.ModeratorScope, error) {
+	principal := api_.principal(r)
+	if principal.Kind != PrincipalUser || principal.Role != user.Moderator {
+		return nil, nil
+	}
+
+	return api_.storeFor(r).GetModeratorScopes(principal.Name)
+}
+
+// requestSubject finds the user a request is about: the user in the URI, or the owner of the image in the URI. It is
+// empty when the request is not about a single user.
+func (api_ *API) requestSubject(r *http.Request) (string, error) {
+	vars := mux.Vars(r)
+	if name, ok := vars["name"]; ok {
+		return name, nil
+	}
+
+	uuid, ok := vars["uuid"]
+	if !ok || !strings.HasPrefix(r.URL.Path, "/image/") {
+		return "", nil
+	}
+
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uuid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return image.Username, nil
+}
+
+// scopeModerator finds the scope under which a moderator may use their powers on a request. Moderators without any
+// scope moderate everyone, the others only the members of their courses. The scope is empty when the request is
+// outside it, the moderator is then treated as a user.
+func (api_ *API) scopeModerator(route Route, r *http.Request) (string, error) {
+	moderator := api_.sessionUsername(r)
+	scopes, err := api_.storeFor(r).GetModeratorScopes(moderator)
+	if err != nil || len(scopes) == 0 {
+		return globalScope, err
+	}
+
+	// The handler itself limits what the moderator gets to their courses
+	if route.ModeratorScoped {
+		names := make([]string, len(scopes))
+		for i, scope := range scopes {
+			names[i] = scope.CourseName
+		}
+
+		return strings.Join(names, ","), nil
+	}
+
+	subject, err := api_.requestSubject(r)
+	if err != nil || subject == "" {
+		return "", err
+	}
+
+	return api_.storeFor(r).GetModeratorScopeOfUser(moderator, subject)
+}
+
+// auditModerator records the scope a moderator action was permitted under, on the request and in the logs of its
+// handler
+func auditModerator(r *http.Request, moderator string, scope string) *http.Request {
+	entry := requestLog(r).WithField("scope", scope)
+	entry.Infof("Moderator %s is permitted to %s %s", moderator, r.Method, r.URL.Path)
+	return r.WithContext(context.WithValue(r.Context(), logContextKey{}, entry))
+}
+
+// moderatorIsScoped answers 403 when a scoped moderator asks about a course outside their scopes
+func (api_ *API) moderatorIsScoped(w http.ResponseWriter, r *http.Request, name string) bool {
+	scopes, err := api_.moderatorScopes(r)
+	if ErrorWrite(w, err, "Cannot fetch the scopes of the moderator") != nil {
+		return false
+	}
+
+	if len(scopes) == 0 {
+		return true
+	}
+
+	for _, scope := range scopes {
+		if scope.CourseName == name {
+			return true
+		}
+	}
+
+	http.Error(w, "The course is outside the scope of the moderator", http.StatusForbidden)
+	return false
+}
+
+// GetModeratorScopes lists the courses a moderator is scoped to, a moderator without any moderates everyone
+// Example request: GET /user/piet/scopes
+// Example response: [{"Moderator": "piet", "CourseName": "os-2022"}]
+func (api_ *API) GetModeratorScopes(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !api_.checkUserExists(w, name) {
+		return
+	}
+
+	scopes, err := api_.storeFor(r).GetModeratorScopes(name)
+	if ErrorWrite(w, err, "Cannot fetch the scopes of the moderator") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, scopes)
+}
+
+// AddModeratorScope scopes a moderator to a course, from then on they only moderate the members of their courses
+// Example request: PUT /user/piet/scopes/os-2022
+// Example response: 201 Created
+func (api_ *API) AddModeratorScope(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	moderator, err := api_.storeFor(r).GetUserByUsername(vars["name"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: vars["name"]})
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the user") != nil {
+		return
+	}
+
+	if moderator.Role != user.Moderator {
+		http.Error(w, "Only moderators can be scoped to courses", http.StatusBadRequest)
+		return
+	}
+
+	if _, err = api_.getCourse(w, r); err != nil {
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).AddModeratorScope(moderator.Username, vars["course"]),
+		"Cannot scope the moderator") != nil {
+		return
+	}
+
+	log.Infof("Scoped moderator %s to course %s", moderator.Username, vars["course"])
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RemoveModeratorScope takes a course out of the scope of a moderator, without any left they moderate everyone again
+// Example request: DELETE /user/piet/scopes/os-2022
+// Example response: 204 No Content
+func (api_ *API) RemoveModeratorScope(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := api_.storeFor(r).RemoveModeratorScope(vars["name"], vars["course"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "the moderator is not scoped to the course", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot remove the scope of the moderator") != nil {
+		return
+	}
+
+	log.Infof("Removed course %s from the scope of moderator %s", vars["course"], vars["name"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterModerationHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterModerationHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/scopes",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetModeratorScopes,
+		Method:      http.MethodGet,
+		Description: "Lists the courses a moderator is scoped to",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/scopes/{course}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.AddModeratorScope,
+		Method:      http.MethodPut,
+		Schema:      schemaNone,
+		Description: "Scopes a moderator to a course",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/scopes/{course}",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.RemoveModeratorScope,
+		Method:      http.MethodDelete,
+		Description: "Takes a course out of the scope of a moderator",
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/course"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ModeratorScopes(t *testing.T) {
+	store := newTestStore(t)
+
+	users := map[string]*user.UserModel{}
+	for _, u := range []user.UserModel{
+		{Username: "admin", Role: user.Admin},
+		{Username: "ta", Role: user.Moderator},
+		{Username: "global", Role: user.Moderator},
+		{Username: "alice", Role: user.User},
+		{Username: "bob", Role: user.User},
+	} {
+		u := u
+		u.Email = u.Username + "@example.com"
+		assert.NoError(t, store.CreateUser(&u))
+		users[u.Username] = &u
+	}
+	admin, ta, global := users["admin"], users["ta"], users["global"]
+
+	lab, other := "52:54:00:d9:71:93", "52:54:00:d9:71:94"
+	for _, mac := range []string{lab, other} {
+		assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: mac,
+			MacAddress: util.MacAddress{Address: mac}, Architecture: machinemodel.X86_64}))
+	}
+
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	assert.NoError(t, store.CreateCourse(&course.CourseModel{Name: "os", Owner: "admin", ExpiresAt: expires,
+		Members: []course.CourseMember{{Username: "alice"}}}))
+	assert.NoError(t, store.CreateCourse(&course.CourseModel{Name: "db", Owner: "admin", ExpiresAt: expires,
+		Members: []course.CourseMember{{Username: "bob"}}}))
+	assert.NoError(t, store.AddCourseMachine("os", lab))
+	assert.NoError(t, store.AddCourseMachine("db", other))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	listed := func(username string, uri string) []string {
+		resp := s.requestAs(users[username], http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var found []struct{ Username, Name string }
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+		names := []string{}
+		for _, f := range found {
+			names = append(names, f.Username+f.Name)
+		}
+		return names
+	}
+
+	// Without a scope a moderator moderates everyone
+	assert.Equal(t, http.StatusOK, s.requestAs(ta, http.MethodGet, "/user/bob/images", "").Code)
+
+	assert.Equal(t, http.StatusForbidden, s.requestAs(ta, http.MethodPut, "/user/ta/scopes/os", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(admin, http.MethodPut, "/user/alice/scopes/os", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(admin, http.MethodPut, "/user/ta/scopes/nothing", "").Code)
+	assert.Equal(t, http.StatusCreated, s.requestAs(admin, http.MethodPut, "/user/ta/scopes/os", "").Code)
+	assert.Equal(t, http.StatusConflict, s.requestAs(admin, http.MethodPut, "/user/ta/scopes/os", "").Code)
+
+	scopes, err := store.GetModeratorScopes("ta")
+	assert.NoError(t, err)
+	assert.Equal(t, []course.ModeratorScope{{Moderator: "ta", CourseName: "os"}}, scopes)
+
+	// A scoped moderator only moderates the members of their courses
+	assert.Equal(t, http.StatusForbidden, s.requestAs(ta, http.MethodDelete, "/user/bob", "").Code)
+	assert.Equal(t, http.StatusOK, s.requestAs(ta, http.MethodGet, "/user/alice/images", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(ta, http.MethodGet, "/user/bob/images", "").Code)
+	assert.Equal(t, []string{"alice"}, listed("ta", "/users"))
+	assert.Len(t, listed("global", "/users"), len(users))
+	assert.Equal(t, []string{"os"}, listed("ta", "/courses"))
+	assert.Equal(t, http.StatusOK, s.requestAs(ta, http.MethodGet, "/course/os", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(ta, http.MethodGet, "/course/db", "").Code)
+
+	// The boot requests are empty, anything but 403 means the access check let them through
+	assert.NotEqual(t, http.StatusForbidden, s.requestAs(ta, http.MethodPost, "/machine/"+lab+"/boot", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.requestAs(ta, http.MethodPost, "/machine/"+other+"/boot", "").Code)
+	assert.NotEqual(t, http.StatusForbidden, s.requestAs(global, http.MethodPost, "/machine/"+other+"/boot", "").Code)
+
+	// Without any scope left the moderator moderates everyone again
+	assert.Equal(t, http.StatusNoContent, s.requestAs(admin, http.MethodDelete, "/user/ta/scopes/os", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.requestAs(admin, http.MethodDelete, "/user/ta/scopes/os", "").Code)
+	assert.Equal(t, http.StatusOK, s.requestAs(ta, http.MethodGet, "/user/bob/images", "").Code)
+
+	// Deleting a course takes it out of the scopes
+	assert.Equal(t, http.StatusCreated, s.requestAs(admin, http.MethodPut, "/user/ta/scopes/db", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestAs(admin, http.MethodDelete, "/course/db", "").Code)
+	assert.Equal(t, []string{}, listed("admin", "/user/ta/scopes"))
+}
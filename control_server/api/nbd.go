@@ -0,0 +1,149 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportable checks that a version can be exported, NBD needs to read anywhere in the file so it cannot be
+// compressed
+func exportable(image *images.ImageModel) error {
+	if image.DiskCompressionStrategy != "" &&
+		!strings.EqualFold(string(image.DiskCompressionStrategy), string(images.DiskCompressionStrategyNone)) {
+		return fmt.Errorf("image %s is compressed with %s, only uncompressed images can be exported", image.UUID,
+			image.DiskCompressionStrategy)
+	}
+
+	return nil
+}
+
+// exportVersion exports a version of an image over NBD, for the machine with the MAC address when it is not empty
+func (api_ *API) exportVersion(r *http.Request, image *images.ImageModel, version uint64,
+	mac string) (*images.NBDExport, error) {
+	if err := exportable(image); err != nil {
+		return nil, err
+	}
+
+	export, err := api_.exports.Export(api_.versionFile(image, version), mac)
+	if err != nil {
+		return nil, err
+	}
+
+	// Machines connect to the host they reached the control server on, unless another one is configured
+	host := api_.config.NBDHost
+	if host == "" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+
+	_, port, err := net.SplitHostPort(api_.config.NBDAddress)
+	if err != nil {
+		api_.exports.Remove(export.Name)
+		return nil, err
+	}
+
+	return &images.NBDExport{
+		URL:       fmt.Sprintf("nbd://%s/%s", net.JoinHostPort(host, port), export.Name),
+		Token:     export.Name,
+		Size:      export.Size,
+		ExpiresAt: export.CreatedAt.Add(time.Duration(api_.config.NBDIdleMinutes) * time.Minute),
+	}, nil
+}
+
+// ExportVersion exports a version of an image read-only over NBD. The token in the response is the name of the
+// export, it is accepted for a single connection. The export is removed when that connection ends, when nobody
+// connected to it within NBDIdleMinutes, or when the machine given with ?machine= claims its next boot.
+// Example request: POST /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/versions/3/export?machine=52:54:00:d9:71:93
+// Example response: {"URL": "nbd://baas.example.org:10809/9f2c...", "Token": "9f2c...", "Size": 2147483648,
+// "ExpiresAt": "2022-02-01T10:10:00Z"}
+func (api_ *API) ExportVersion(w http.ResponseWriter, r *http.Request) {
+	if api_.exports == nil {
+		http.Error(w, "NBD exports are not enabled", http.StatusNotFound)
+		return
+	}
+
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	version, err := strconv.ParseUint(mux.Vars(r)["version"], 10, 64)
+	if err != nil || image.FindVersion(version) == nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	if err = exportable(image); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	export, err := api_.exportVersion(r, image, version, r.URL.Query().Get("machine"))
+	if ErrorWrite(w, err, "Cannot export the version") != nil {
+		return
+	}
+
+	log.Infof("Exported version %d of image %s over NBD", version, image.UUID)
+	writeJSON(w, http.StatusCreated, export)
+}
+
+// exportDisklessImages exports the images of a diskless boot to the machine which claimed it. The machine image is
+// not part of the setup yet, it is flashed as usual and holds the copy-on-write stores.
+func (api_ *API) exportDisklessImages(r *http.Request, mac string, setup *images.ImageSetup) error {
+	if api_.exports == nil {
+		return fmt.Errorf("diskless boots need NBD exports, which are not enabled")
+	}
+
+	for i := range setup.Images {
+		frozen := &setup.Images[i]
+		export, err := api_.exportVersion(r, &frozen.Image, frozen.Version.Version, mac)
+		if err != nil {
+			api_.exports.RemoveMachine(mac)
+			return err
+		}
+
+		frozen.Export = export
+	}
+
+	return nil
+}
+
+// endDisklessBoot disconnects the exports of a machine, its diskless boot is over
+func (api_ *API) endDisklessBoot(mac string) {
+	if api_.exports == nil {
+		return
+	}
+
+	if removed := api_.exports.RemoveMachine(mac); removed != 0 {
+		log.Infof("Removed the %d NBD exports of %s", removed, mac)
+	}
+}
+
+// RegisterNBDHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterNBDHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions/{version}/export",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.ExportVersion,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Exports a version of an image read-only over NBD",
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_DisklessBoot(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "nbd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	mac := util.MacAddress{Address: "52:54:00:d9:71:93"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac,
+		Architecture: machinemodel.X86_64}))
+	machineImage, err := images.CreateMachineImageModel(mac)
+	assert.NoError(t, err)
+	// Creating the machine image normally formats its file, which the test does not need
+	assert.NoError(t, store.(sqlite.Store).Session(&gorm.Session{SkipHooks: true}).Create(machineImage).Error)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com",
+		Role: user.User}))
+
+	for _, image := range []images.ImageModel{
+		{Name: "raw", Username: "test", UUID: "raw", DiskCompressionStrategy: images.DiskCompressionStrategyNone},
+		{Name: "packed", Username: "test", UUID: "packed", DiskCompressionStrategy: images.DiskCompressionStrategyZSTD},
+	} {
+		image := image
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+		assert.NoError(t, ioutil.WriteFile(image.VersionFile(1),
+			[]byte("disk of "+image.Name), 0644))
+	}
+
+	raw, err := store.GetImageByUUID("raw")
+	assert.NoError(t, err)
+	for _, uuid := range []images.ImageUUID{"diskless", "compressed"} {
+		setup := images.ImageSetup{Name: string(uuid), UUID: uuid, Username: "test"}
+		assert.NoError(t, store.CreateImageSetup("test", &setup))
+		image := raw
+		if uuid == "compressed" {
+			image, err = store.GetImageByUUID("packed")
+			assert.NoError(t, err)
+		}
+		store.AddImageToImageSetup(&setup, image, *image.FindVersion(1), false)
+	}
+
+	// Without NBD there is nothing to export to, or to boot diskless from
+	disabled := newTestServer(t, store, diskpath, config.Default())
+	assert.Equal(t, http.StatusNotFound, disabled.request(http.MethodPost, "/image/raw/versions/1/export", "").Code)
+	assert.Equal(t, http.StatusBadRequest, disabled.request(http.MethodPost, "/machine/"+mac.Address+"/boot",
+		`{"SetupUUID": "diskless", "BootMode": "diskless"}`).Code)
+
+	conf := config.Default()
+	conf.NBDEnabled = true
+	conf.NBDHost = "baas.example.org"
+	s := newTestServer(t, store, diskpath, conf)
+
+	resp := s.request(http.MethodPost, "/image/raw/versions/1/export?machine="+mac.Address, "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var export images.NBDExport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&export))
+	assert.Equal(t, "nbd://baas.example.org:10809/"+export.Token, export.URL)
+	assert.Equal(t, int64(len("disk of raw")), export.Size)
+	assert.Len(t, s.api.exports.Exports(), 1)
+
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodPost, "/image/raw/versions/7/export", "").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity,
+		s.request(http.MethodPost, "/image/packed/versions/1/export", "").Code)
+
+	// Compressed images cannot be read over NBD
+	assert.Equal(t, http.StatusUnprocessableEntity, s.request(http.MethodPost, "/machine/"+mac.Address+"/boot",
+		`{"SetupUUID": "compressed", "BootMode": "diskless"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/machine/"+mac.Address+"/boot",
+		`{"SetupUUID": "diskless", "BootMode": "diskless", "Update": true}`).Code)
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPost, "/machine/"+mac.Address+"/boot",
+		`{"SetupUUID": "diskless", "BootMode": "diskless"}`).Code)
+
+	// Claiming the boot ends the session the earlier export was made for, the images of the new one are exported.
+	// The machine image is flashed as usual.
+	resp = s.request(http.MethodGet, "/machine/"+mac.Address+"/boot", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var setup images.ImageSetup
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&setup))
+	assert.Equal(t, images.BootDiskless, setup.BootMode)
+	assert.Len(t, setup.Images, 2)
+	assert.NotNil(t, setup.Images[0].Export)
+	assert.True(t, strings.HasPrefix(setup.Images[0].Export.URL, "nbd://baas.example.org:10809/"))
+	assert.NotEqual(t, export.Token, setup.Images[0].Export.Token)
+	assert.Nil(t, setup.Images[1].Export)
+
+	exports := s.api.exports.Exports()
+	assert.Len(t, exports, 1)
+	assert.Equal(t, setup.Images[0].Export.Token, exports[0].Name)
+
+	// A diskless boot which failed does not keep its exports
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPut, "/machine/"+mac.Address+"/boot/state",
+		`{"State": "failed"}`).Code)
+	assert.Empty(t, s.api.exports.Exports())
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+)
+
+const (
+	// defaultPageSize is the number of entries in a page when the request does not set a limit
+	defaultPageSize = 50
+	// maxPageSize caps the limit requested by clients
+	maxPageSize = 500
+)
+
+// parseListOptions reads the pagination and filter parameters of a listing from the query string:
+// limit, order (asc or desc, newest first by default), sort (created or updated), since and until (RFC 3339) and
+// either offset or, for keyset paginated listings, cursor. On invalid parameters a 400 is written and an error
+// returned.
+func parseListOptions(w http.ResponseWriter, r *http.Request, keyset bool) (database.ListOptions, error) {
+	opts, err := listOptions(r, keyset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+
+	return opts, err
+}
+
+func listOptions(r *http.Request, keyset bool) (database.ListOptions, error) {
+	query := r.URL.Query()
+	opts := database.ListOptions{Limit: defaultPageSize}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return opts, fmt.Errorf("limit must be a number between 1 and %d", maxPageSize)
+		}
+		opts.Limit = n
+	}
+
+	order, err := sortOrder(query)
+	if err != nil {
+		return opts, err
+	}
+	opts.Sort, opts.Ascending = order.Sort, order.Ascending
+
+	// Cursors are IDs, which follow the order of creation but not that of the changes
+	if keyset && opts.Sort == database.SortUpdated {
+		return opts, errors.New("this listing cannot be sorted by the time of the last change")
+	}
+
+	for param, dest := range map[string]*time.Time{"since": &opts.Since, "until": &opts.Until} {
+		if value := query.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be a RFC 3339 time", param)
+			}
+			*dest = t
+		}
+	}
+
+	if keyset {
+		if cursor := query.Get("cursor"); cursor != "" {
+			after, err := strconv.ParseUint(cursor, 10, 64)
+			if err != nil {
+				return opts, errors.New("invalid cursor")
+			}
+			opts.After = uint(after)
+		}
+	} else if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return opts, errors.New("offset must be a positive number")
+		}
+		opts.Offset = n
+	}
+
+	return opts, nil
+}
+
+// listOrder is how a listing which is not paginated is sorted. Without a sort field it is left in the order of the
+// database.
+type listOrder struct {
+	Sort      database.SortField
+	Ascending bool
+}
+
+// sortOrder reads the sort parameter, created or updated, and the order parameter, asc or desc, from the query
+func sortOrder(query url.Values) (listOrder, error) {
+	var order listOrder
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		order.Ascending = true
+	default:
+		return order, errors.New("order must be asc or desc")
+	}
+
+	switch field := database.SortField(query.Get("sort")); field {
+	case "", database.SortCreated, database.SortUpdated:
+		order.Sort = field
+	default:
+		return order, errors.New("sort must be created or updated")
+	}
+
+	return order, nil
+}
+
+// parseListOrder reads how a listing which is not paginated is sorted, see sortOrder. On invalid parameters a 400 is
+// written and an error returned.
+func parseListOrder(w http.ResponseWriter, r *http.Request) (listOrder, error) {
+	order, err := sortOrder(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+
+	return order, err
+}
+
+// apply sorts the entries of listing, newest first unless the order is ascending. times returns when the entry
+// at an index was created and last updated.
+func (order listOrder) apply(listing interface{}, times func(i int) (created time.Time, updated time.Time)) {
+	if order.Sort == "" {
+		return
+	}
+
+	at := func(i int) time.Time {
+		created, updated := times(i)
+		if order.Sort == database.SortUpdated {
+			return updated
+		}
+		return created
+	}
+
+	sort.SliceStable(listing, func(i, j int) bool {
+		if order.Ascending {
+			return at(i).Before(at(j))
+		}
+		return at(i).After(at(j))
+	})
+}
+
+// nextCursor returns the cursor to the page after one which ended with the row with ID last. Cursors are the
+// ID of the last row in the page, there is no next page when the page is not full.
+func nextCursor(opts database.ListOptions, size int, last uint) string {
+	if size < opts.Limit {
+		return ""
+	}
+
+	return strconv.FormatUint(uint64(last), 10)
+}
+
+// pageURI is the URI of the request with other query parameters, the parameters which are empty are removed
+func pageURI(r *http.Request, params map[string]string) string {
+	query := r.URL.Query()
+	for param, value := range params {
+		if value == "" {
+			query.Del(param)
+		} else {
+			query.Set(param, value)
+		}
+	}
+
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// offsetPage is a page of a listing paginated by offset which holds n of the total entries
+func offsetPage(r *http.Request, opts database.ListOptions, items interface{}, n int, total int64) types.Page {
+	page := types.Page{Items: items, Total: &total, Limit: opts.Limit, Offset: opts.Offset}
+
+	if int64(opts.Offset+n) < total {
+		page.Next = pageURI(r, map[string]string{"offset": strconv.Itoa(opts.Offset + n)})
+	}
+
+	if opts.Offset > 0 {
+		prev := opts.Offset - opts.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Prev = pageURI(r, map[string]string{"offset": strconv.Itoa(prev)})
+	}
+
+	return page
+}
+
+// cursorPage is a page of a listing paginated with a cursor which holds n entries, the last of which has ID last.
+// Cursors only lead forward, there is no previous page.
+func cursorPage(r *http.Request, opts database.ListOptions, items interface{}, n int, last uint) types.Page {
+	page := types.Page{Items: items, Limit: opts.Limit}
+
+	if cursor := nextCursor(opts, n, last); cursor != "" {
+		page.Next = pageURI(r, map[string]string{"cursor": cursor})
+	}
+
+	return page
+}
+
+// writePage answers a listing with a page, the pages around it are in the Link header as well (RFC 5988)
+func writePage(w http.ResponseWriter, page types.Page) {
+	var links []string
+	for _, link := range []struct{ rel, uri string }{{"next", page.Next}, {"prev", page.Prev}} {
+		if link.uri != "" {
+			links = append(links, fmt.Sprintf("<%s>; rel=%q", link.uri, link.rel))
+		}
+	}
+
+	if len(links) != 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// peerExpiry is how long a machine is trusted to serve its images, or to be downloading one, after its last
+// heartbeat. The management OS sends one every minute.
+const peerExpiry = 3 * time.Minute
+
+// peer is a management OS which serves the versions it downloaded to other machines
+type peer struct {
+	address  string
+	token    string
+	versions map[string]bool
+	lastSeen time.Time
+}
+
+// fetch is a machine which was told where to download a version from, source is the MAC address of the peer or
+// empty for the control server
+type fetch struct {
+	source string
+	since  time.Time
+}
+
+// peerTracker keeps track of which machines hold which versions and plans where machines download them from.
+// It only lives in memory, the machines tell it again what they hold with their next heartbeat.
+type peerTracker struct {
+	seeds      int
+	maxUploads int
+
+	mu    sync.Mutex
+	peers map[string]*peer
+	// fetches holds the machines which are downloading a version by its key, until they report they hold it
+	fetches map[string]map[string]fetch
+}
+
+func newPeerTracker(seeds int, maxUploads int) *peerTracker {
+	return &peerTracker{
+		seeds:      seeds,
+		maxUploads: maxUploads,
+		peers:      map[string]*peer{},
+		fetches:    map[string]map[string]fetch{},
+	}
+}
+
+// expire forgets the machines which went silent
+func (t *peerTracker) expire(now time.Time) {
+	for mac, p := range t.peers {
+		if now.Sub(p.lastSeen) > peerExpiry {
+			delete(t.peers, mac)
+		}
+	}
+
+	for key, machines := range t.fetches {
+		for mac, f := range machines {
+			if now.Sub(f.since) > peerExpiry {
+				delete(machines, mac)
+			}
+		}
+
+		if len(machines) == 0 {
+			delete(t.fetches, key)
+		}
+	}
+}
+
+// heartbeat records the versions a machine serves, host is the address it contacted the control server from.
+// Heartbeats without a body only tell that the machine is still downloading.
+func (t *peerTracker) heartbeat(mac string, host string, body *images.PeerHeartbeat) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, machines := range t.fetches {
+		if f, ok := machines[mac]; ok {
+			f.since = now
+			machines[mac] = f
+		}
+	}
+
+	if body == nil {
+		return
+	}
+
+	if body.Port == 0 {
+		delete(t.peers, mac)
+		return
+	}
+
+	p := &peer{
+		address:  net.JoinHostPort(host, fmt.Sprint(body.Port)),
+		token:    body.Token,
+		versions: map[string]bool{},
+		lastSeen: now,
+	}
+
+	for _, version := range body.Versions {
+		p.versions[version.String()] = true
+		delete(t.fetches[version.String()], mac)
+	}
+
+	t.peers[mac] = p
+}
+
+// plan decides where a machine downloads a version from, it is nil when it should use the control server. The
+// first machines go to the control server, the later ones to the least busy machine which already holds it.
+func (t *peerTracker) plan(mac string, version images.PeerVersion) *images.PeerSource {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+
+	key := version.String()
+	machines, ok := t.fetches[key]
+	if !ok {
+		machines = map[string]fetch{}
+		t.fetches[key] = machines
+	}
+	delete(machines, mac)
+
+	uploads := map[string]int{}
+	for _, f := range machines {
+		uploads[f.source]++
+	}
+
+	var holders []string
+	for holder, p := range t.peers {
+		if holder != mac && p.versions[key] {
+			holders = append(holders, holder)
+		}
+	}
+
+	source := ""
+	if len(holders)+uploads[""] >= t.seeds {
+		for _, holder := range holders {
+			if t.maxUploads != 0 && uploads[holder] >= t.maxUploads {
+				continue
+			}
+
+			// Ties go to the lowest MAC address, so the plan does not depend on the order of the map
+			if source == "" || uploads[holder] < uploads[source] ||
+				(uploads[holder] == uploads[source] && holder < source) {
+				source = holder
+			}
+		}
+	}
+
+	machines[mac] = fetch{source: source, since: now}
+	if source == "" {
+		return nil
+	}
+
+	p := t.peers[source]
+	return &images.PeerSource{
+		MachineMAC: source,
+		URL:        "http://" + p.address + fmt.Sprintf(images.PeerPathFmt, version.ImageUUID, version.Version),
+		Token:      p.token,
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerTracker(t *testing.T) {
+	tracker := newPeerTracker(1, 1)
+	version := images.PeerVersion{ImageUUID: "image", Version: 2}
+
+	// The first machine is the seed, the second one has nobody to go to either while the seed is downloading
+	assert.Nil(t, tracker.plan("aa", version))
+	tracker.heartbeat("aa", "10.0.0.1", &images.PeerHeartbeat{Port: 4849, Token: "secret",
+		Versions: []images.PeerVersion{version}})
+
+	source := tracker.plan("bb", version)
+	if assert.NotNil(t, source) {
+		assert.Equal(t, "aa", source.MachineMAC)
+		assert.Equal(t, "http://10.0.0.1:4849/image/image/2", source.URL)
+		assert.Equal(t, "secret", source.Token)
+	}
+
+	// The seed serves one machine at a time, the next one goes to the control server
+	assert.Nil(t, tracker.plan("cc", version))
+
+	// Once the second machine holds the version both serve the machines after it
+	tracker.heartbeat("bb", "10.0.0.2", &images.PeerHeartbeat{Port: 4849, Token: "other",
+		Versions: []images.PeerVersion{version}})
+	for _, mac := range []string{"dd", "ee"} {
+		assert.NotNil(t, tracker.plan(mac, version))
+	}
+	assert.Nil(t, tracker.plan("ff", version))
+
+	// Other versions are not served by anyone yet
+	assert.Nil(t, tracker.plan("gg", images.PeerVersion{ImageUUID: "image", Version: 3}))
+
+	// Machines which went silent are forgotten
+	tracker.expire(time.Now().Add(2 * peerExpiry))
+	assert.Empty(t, tracker.peers)
+	assert.Empty(t, tracker.fetches)
+}
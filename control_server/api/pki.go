@@ -0,0 +1,229 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/pki"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxCASize is the largest CA chain which can be uploaded
+const maxCASize = 1 << 20
+
+// certificateAuthority is a CA chain as shown to administrators, Trusted tells whether the machines are still
+// given it
+type certificateAuthority struct {
+	pki.CertificateAuthority
+	Trusted bool
+}
+
+// caGrace is how long a CA is still handed out after it was rotated out
+func (api_ *API) caGrace() time.Duration {
+	return time.Duration(api_.config.CAGraceDays) * 24 * time.Hour
+}
+
+// trustedCAs are the CA chains the machines are given, the current one first
+func (api_ *API) trustedCAs() ([]pki.CertificateAuthority, error) {
+	authorities, err := api_.store.GetCertificateAuthorities()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var trusted []pki.CertificateAuthority
+	for _, ca := range authorities {
+		if ca.Trusted(api_.caGrace(), now) {
+			trusted = append(trusted, ca)
+		}
+	}
+
+	return trusted, nil
+}
+
+// ServeCA serves the CA chains which sign the certificate of the control server, so the management OS can verify
+// it. It is served without a login over plain HTTP, a machine booting for the first time has no other way to get
+// it. During the grace window after a rotation both the new and the old chain are served.
+// Example request: GET /pki/ca.pem
+// Example response: -----BEGIN CERTIFICATE-----
+func (api_ *API) ServeCA(w http.ResponseWriter, _ *http.Request) {
+	trusted, err := api_.trustedCAs()
+	if ErrorWrite(w, err, "Cannot fetch the certificate authorities") != nil {
+		return
+	}
+
+	if len(trusted) == 0 {
+		http.Error(w, "No certificate authority has been configured", http.StatusNotFound)
+		return
+	}
+
+	var bundle strings.Builder
+	for _, ca := range trusted {
+		bundle.WriteString(strings.TrimSpace(ca.PEM) + "\n")
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	_, _ = w.Write([]byte(bundle.String()))
+}
+
+// GetCAs lists every CA chain which was uploaded, the current one first
+// Example request: GET /admin/pki/ca
+// Example response: [{"Fingerprint": "5d41402a...", "Subject": "CN=BAAS CA 2022", "NotAfter": "2032-01-01T00:00:00Z",
+//
+//	"CreatedAt": "2022-06-01T12:00:00Z", "Trusted": true}]
+func (api_ *API) GetCAs(w http.ResponseWriter, _ *http.Request) {
+	authorities, err := api_.store.GetCertificateAuthorities()
+	if ErrorWrite(w, err, "Cannot fetch the certificate authorities") != nil {
+		return
+	}
+
+	now := time.Now()
+	shown := []certificateAuthority{}
+	for _, ca := range authorities {
+		shown = append(shown, certificateAuthority{CertificateAuthority: ca, Trusted: ca.Trusted(api_.caGrace(), now)})
+	}
+
+	writeJSON(w, http.StatusOK, shown)
+}
+
+// RotateCA uploads the PEM encoded CA chain which signs the certificate of the control server. The first
+// certificate is the CA itself. The current chain is retired but still handed to the machines for CAGraceDays, the
+// certificate of the control server should only be replaced by one of the new CA after that.
+// Example request: PUT /admin/pki/ca --data-binary @ca.pem
+// Example response: {"Fingerprint": "5d41402a...", "Subject": "CN=BAAS CA 2022", "NotAfter": "2032-01-01T00:00:00Z",
+//
+//	"CreatedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) RotateCA(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCASize))
+	if err != nil {
+		http.Error(w, "Cannot read the certificate authority", http.StatusBadRequest)
+		return
+	}
+
+	certs, err := pki.ParseBundle(body)
+	if err != nil {
+		http.Error(w, "Invalid certificate authority: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !certs[0].IsCA {
+		http.Error(w, "The first certificate is not a certificate authority", http.StatusBadRequest)
+		return
+	}
+
+	ca := pki.CertificateAuthority{
+		Fingerprint: pki.Fingerprint(certs[0]),
+		Subject:     certs[0].Subject.String(),
+		PEM:         string(body),
+		NotAfter:    certs[0].NotAfter,
+	}
+
+	for _, cert := range certs {
+		if time.Now().After(cert.NotAfter) {
+			http.Error(w, "The certificate of "+cert.Subject.String()+" has expired", http.StatusBadRequest)
+			return
+		}
+
+		if cert.NotAfter.Before(ca.NotAfter) {
+			ca.NotAfter = cert.NotAfter
+		}
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).RotateCertificateAuthority(&ca), "Cannot store the certificate authority") != nil {
+		return
+	}
+
+	requestLog(r).Infof("Rotated the certificate authority to %s (%s)", ca.Subject, ca.Fingerprint)
+	writeJSON(w, http.StatusCreated, ca)
+}
+
+// certReloader hands out the certificate of the control server, the files are read again once they change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// changed finds when the certificate or the key was last written
+func (c *certReloader) changed() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+
+	return modified, nil
+}
+
+// GetCertificate loads the certificate when it changed, a broken replacement keeps the previous one in use
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modified, err := c.changed()
+	if err == nil && c.cert != nil && modified.Equal(c.modified) {
+		return c.cert, nil
+	}
+
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	}
+
+	if err != nil {
+		if c.cert == nil {
+			return nil, err
+		}
+
+		log.Warnf("Cannot load the new certificate of the control server, keeping the old one: %v", err)
+		return c.cert, nil
+	}
+
+	log.Infof("Loaded the certificate of the control server from %s", c.certFile)
+	c.cert = &cert
+	c.modified = modified
+	return c.cert, nil
+}
+
+// RegisterPKIHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterPKIHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/pki/ca",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetCAs,
+		Method:      http.MethodGet,
+		Description: "Lists the certificate authorities of the control server",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/pki/ca",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.RotateCA,
+		Method:      http.MethodPut,
+		Schema:      "ca",
+		Description: "Rotates the certificate authority of the control server",
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate creates a self-signed certificate and its key, both PEM encoded
+func testCertificate(t *testing.T, name string, isCA bool) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestApi_CertificateAuthority(t *testing.T) {
+	store := newTestStore(t)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	// Everyone may fetch the CA to trust it
+	published := func() *httptest.ResponseRecorder {
+		return s.serve(httptest.NewRequest(http.MethodGet, "/pki/ca.pem", nil))
+	}
+
+	assert.Equal(t, http.StatusNotFound, published().Code)
+
+	oldCA, _ := testCertificate(t, "old", true)
+	newCA, _ := testCertificate(t, "new", true)
+	leaf, key := testCertificate(t, "control_server", false)
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/admin/pki/ca", "not a CA").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/admin/pki/ca", string(key)).Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPut, "/admin/pki/ca", string(leaf)).Code)
+
+	resp := s.request(http.MethodPut, "/admin/pki/ca", string(oldCA))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var ca pki.CertificateAuthority
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&ca))
+	assert.Equal(t, "CN=old", ca.Subject)
+
+	certs, err := pki.ParseBundle(oldCA)
+	assert.NoError(t, err)
+	assert.Equal(t, pki.Fingerprint(certs[0]), ca.Fingerprint)
+
+	assert.Equal(t, http.StatusConflict, s.request(http.MethodPut, "/admin/pki/ca", string(oldCA)).Code)
+
+	// The machines get the old CA next to the new one until the grace window is over
+	assert.Equal(t, http.StatusCreated, s.request(http.MethodPut, "/admin/pki/ca", string(newCA)).Code)
+	resp = published()
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, string(newCA)+string(oldCA), resp.Body.String())
+
+	var listed []certificateAuthority
+	assert.NoError(t, json.NewDecoder(s.request(http.MethodGet, "/admin/pki/ca", "").Body).Decode(&listed))
+	assert.Len(t, listed, 2)
+	assert.Equal(t, "CN=new", listed[0].Subject)
+	assert.Nil(t, listed[0].RetiredAt)
+	assert.NotNil(t, listed[1].RetiredAt)
+	assert.True(t, listed[1].Trusted)
+
+	retired := time.Now().Add(-15 * 24 * time.Hour)
+	assert.NoError(t, store.(sqlite.Store).Model(&pki.CertificateAuthority{}).Where("subject = ?", "CN=old").
+		Update("retired_at", retired).Error)
+	assert.Equal(t, string(newCA), published().Body.String())
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certs := &certReloader{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	_, err = certs.GetCertificate(nil)
+	assert.Error(t, err)
+
+	write := func(name string) {
+		cert, key := testCertificate(t, name, false)
+		assert.NoError(t, ioutil.WriteFile(certs.certFile, cert, 0600))
+		assert.NoError(t, ioutil.WriteFile(certs.keyFile, key, 0600))
+
+		// Make sure the modification time changes on file systems with a coarse clock
+		modified := time.Now().Add(time.Duration(len(name)) * time.Second)
+		assert.NoError(t, os.Chtimes(certs.certFile, modified, modified))
+	}
+
+	subject := func() string {
+		cert, err := certs.GetCertificate(nil)
+		assert.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+
+	write("first")
+	assert.Equal(t, "first", subject())
+
+	write("replaced")
+	assert.Equal(t, "replaced", subject())
+
+	// A broken certificate keeps the previous one in use
+	assert.NoError(t, ioutil.WriteFile(certs.certFile, []byte("broken"), 0600))
+	assert.Equal(t, "replaced", subject())
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrincipalKind tells what made a request
+type PrincipalKind string
+
+const (
+	// PrincipalUser is a user logged in through the browser or with the token of a command line login
+	PrincipalUser PrincipalKind = "user"
+	// PrincipalMachine is the management OS or a service which calls the API as the system
+	PrincipalMachine PrincipalKind = "machine"
+	// PrincipalAnonymous is a visitor without a session
+	PrincipalAnonymous PrincipalKind = "anonymous"
+)
+
+// systemPrincipal is the name of the machine principal, which the management OS and the services of the control
+// server act as
+const systemPrincipal = "system"
+
+var errTokenExpired = errors.New("the token has expired, log in again")
+
+// Principal is who made a request, whatever the credential it was made with
+type Principal struct {
+	Kind PrincipalKind `json:"Kind"`
+	Name string        `json:"Name"`
+	Role user.UserRole `json:"Role"`
+	// Scopes are the courses a moderator moderates, a moderator without them moderates everyone
+	Scopes []string `json:"Scopes,omitempty"`
+	// TokenScopes limit what the token of the request may be used for. Tokens without any, and the sessions of the
+	// browser, may do everything the role allows.
+	TokenScopes []user.TokenScope `json:"TokenScopes,omitempty"`
+}
+
+// scoped reports whether the token of the principal may be used for a route which needs the scope
+func (p Principal) scoped(needed user.TokenScope) bool {
+	if len(p.TokenScopes) == 0 {
+		return true
+	}
+
+	for _, scope := range p.TokenScopes {
+		if scope.Grants(needed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subject is the user behind the principal, as the authorization decisions know them
+func (p Principal) subject() authz.Subject {
+	return authz.Subject{Username: p.Name, Role: p.Role}
+}
+
+// principalContextKey keeps the principal resolved by CheckRole in the context of the request
+type principalContextKey struct{}
+
+// withPrincipal attaches the principal to the request for the handlers after the auth middleware
+func withPrincipal(r *http.Request, principal Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal))
+}
+
+// claimedUsername is the user a request claims to be made by. It is not checked whether the session is still
+// valid, only what the logs note down and what resolvePrincipal starts from.
+func (api_ *API) claimedUsername(r *http.Request) string {
+	session, _ := api_.session.Get(r, api_.config.SessionCookieName)
+	username, _ := session.Values["Username"].(string)
+	return username
+}
+
+// resolvePrincipal works out who made a request from its credentials. Requests without any are anonymous, the
+// error tells why a credential is refused.
+func (api_ *API) resolvePrincipal(r *http.Request) (Principal, error) {
+	// TODO: the system is trusted by a header, machine credentials should replace it
+	if r.Header.Get("type") == "system" {
+		return Principal{Kind: PrincipalMachine, Name: systemPrincipal, Role: user.Admin}, nil
+	}
+
+	if api_.replicaToken(r) {
+		return Principal{Kind: PrincipalMachine, Name: replicaPrincipal, Role: user.Admin}, nil
+	}
+
+	role, ok, err := api_.sessionRole(r)
+	if !ok {
+		return Principal{Kind: PrincipalAnonymous, Role: user.Anonymous}, nil
+	} else if err != nil {
+		return Principal{}, err
+	}
+
+	// Tokens of command line logins carry their own expiry, unlike the cookies of the browser
+	session, _ := api_.session.Get(r, api_.config.SessionCookieName)
+	if expires, ok := session.Values["Expires"].(int64); ok && time.Now().Unix() > expires {
+		return Principal{}, errTokenExpired
+	}
+
+	principal := Principal{Kind: PrincipalUser, Name: api_.claimedUsername(r), Role: role}
+	if scopes, ok := session.Values["Scopes"].(string); ok && scopes != "" {
+		for _, scope := range strings.Split(scopes, ",") {
+			principal.TokenScopes = append(principal.TokenScopes, user.TokenScope(scope))
+		}
+	}
+	if role == user.Moderator {
+		scopes, err := api_.storeFor(r).GetModeratorScopes(principal.Name)
+		if err != nil {
+			return Principal{}, err
+		}
+
+		for _, scope := range scopes {
+			principal.Scopes = append(principal.Scopes, scope.CourseName)
+		}
+	}
+
+	return principal, nil
+}
+
+// principal is who made a request. Behind CheckRole it is the principal the middleware resolved, elsewhere it is
+// resolved on the spot and requests with a refused credential are anonymous.
+func (api_ *API) principal(r *http.Request) Principal {
+	if principal, ok := r.Context().Value(principalContextKey{}).(Principal); ok {
+		return principal
+	}
+
+	principal, err := api_.resolvePrincipal(r)
+	if err != nil {
+		return Principal{Kind: PrincipalAnonymous, Role: user.Anonymous}
+	}
+
+	return principal
+}
+
+// isMachine reports whether the request was made by a machine rather than by a user
+func (api_ *API) isMachine(r *http.Request) bool {
+	return api_.principal(r).Kind == PrincipalMachine
+}
+
+// permits reports whether the role of a principal grants a route. Machines may use every route, replicas only the
+// ones which read, visitors only the routes which opted in while anonymous access is on. Routes users reach through owning the resource are not
+// counted, nor are the moderators who are scoped out of them, nor the routes the token of the principal is not
+// scoped for.
+func (api_ *API) permits(principal Principal, route Route) bool {
+	switch principal.Kind {
+	case PrincipalMachine:
+		return principal.Name != replicaPrincipal || readOnlyMethod(route.Method)
+	case PrincipalAnonymous:
+		return api_.config.AnonymousAccess && route.AnonymousAllowed
+	}
+
+	if !principal.scoped(route.requiredScope()) {
+		return false
+	}
+
+	for _, role := range route.Permissions {
+		if role == principal.Role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// whoAmI describes the principal of a request and what it may do
+type whoAmI struct {
+	Principal
+	Permissions []string `json:"Permissions"`
+}
+
+// refusePrincipal answers the requests whose credential was refused, it reports whether it did
+func refusePrincipal(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, errSessionRevoked) || errors.Is(err, errUserGone) || errors.Is(err, errInvalidRole) ||
+		errors.Is(err, errUserDisabled) || errors.Is(err, errTokenExpired) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return true
+	} else if err != nil {
+		log.Errorf("Cannot look up the role of the session: %v", err)
+		http.Error(w, "Cannot look up the role of the session", http.StatusInternalServerError)
+		return true
+	}
+
+	return false
+}
+
+// GetWhoAmI tells who made the request, whether a user, a machine or an anonymous visitor, and the routes their
+// role grants them. Like the login it is served without one, so visitors can find out they are not logged in.
+// Example request: GET /whoami
+// Example response: {"Kind": "user", "Name": "jan", "Role": "user",
+//
+//	"Permissions": ["GET /user/me", "GET /image/{uuid}", ...]}
+func (api_ *API) GetWhoAmI(w http.ResponseWriter, r *http.Request) {
+	principal, err := api_.resolvePrincipal(r)
+	if refusePrincipal(w, err) {
+		return
+	}
+
+	response := whoAmI{Principal: principal, Permissions: []string{}}
+	for _, route := range api_.Routes {
+		if api_.permits(principal, route) {
+			response.Permissions = append(response.Permissions, route.Method+" "+route.URI)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Principals(t *testing.T) {
+	store := newTestStore(t)
+
+	jan := &user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}
+	piet := &user.UserModel{Username: "piet", Email: "piet@example.com", Role: user.Moderator}
+	for _, u := range []*user.UserModel{jan, piet} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+	assert.NoError(t, store.CreateCourse(&course.CourseModel{Name: "os-2022", Owner: "piet",
+		ExpiresAt: time.Now().Add(time.Hour)}))
+	assert.NoError(t, store.AddModeratorScope("piet", "os-2022"))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	request := func(uri string, token string, system bool) *httptest.ResponseRecorder {
+		switch {
+		case token != "":
+			return s.requestToken(token, http.MethodGet, uri, "")
+		case system:
+			return s.request(http.MethodGet, uri, "")
+		}
+		return s.serve(httptest.NewRequest(http.MethodGet, uri, nil))
+	}
+
+	// The roles of users refuse to decode the anonymous role, so the role is read back as it was sent
+	type principal struct {
+		Kind        PrincipalKind
+		Name        string
+		Role        string
+		Scopes      []string
+		Permissions []string
+	}
+
+	whoami := func(token string, system bool) principal {
+		resp := request("/whoami", token, system)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var found principal
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+		return found
+	}
+
+	// Visitors are told they are anonymous, even though anonymous access is off
+	found := whoami("", false)
+	assert.Equal(t, PrincipalAnonymous, found.Kind)
+	assert.Equal(t, "anonymous", found.Role)
+	assert.Empty(t, found.Permissions)
+
+	found = whoami(s.token(jan), false)
+	assert.Equal(t, PrincipalUser, found.Kind)
+	assert.Equal(t, "jan", found.Name)
+	assert.Equal(t, "user", found.Role)
+	assert.Contains(t, found.Permissions, "GET /user/me")
+	assert.NotContains(t, found.Permissions, "GET /users")
+
+	found = whoami(s.token(piet), false)
+	assert.Equal(t, "moderator", found.Role)
+	assert.Equal(t, []string{"os-2022"}, found.Scopes)
+
+	found = whoami("", true)
+	assert.Equal(t, PrincipalMachine, found.Kind)
+	assert.Equal(t, "system", found.Name)
+	assert.Contains(t, found.Permissions, "GET /users")
+
+	// Users get their profile, machines have none
+	resp := request("/user/me", s.token(jan), false)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = request("/user/me", "", true)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "machine principals have no user profile")
+
+	// The session of a disabled account is refused, it is not taken for a visitor
+	token := s.token(jan)
+	assert.NoError(t, store.SetUserDisabled("jan", true))
+	s.api.users.forget("jan")
+	assert.Equal(t, http.StatusUnauthorized, request("/whoami", token, false).Code)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/baas-project/baas/pkg/model/machine"
+)
+
+// agentActiveWindow is how long a machine counts as running the agent it last checked in with
+const agentActiveWindow = time.Hour
+
+// agentOnlineWindow is how long a machine counts as online after its agent checked in, a few of its heartbeats
+const agentOnlineWindow = time.Minute
+
+// unknownAgentVersion stands in for the release of the agents which do not say theirs
+const unknownAgentVersion = "unknown"
+
+var (
+	activeAgents = metrics.NewGauge("baas_agents_active",
+		"Machines whose management OS agent checked in during the last hour, by its release.", "version")
+	refusedAgents = metrics.NewCounter("baas_agents_refused_total",
+		"Boot claims refused because the agent speaks a protocol older than MinAgentProtocol.", "protocol")
+)
+
+// agentTracker remembers which release of the agent the machines checked in with and when, for activeAgents and
+// the machines which are online
+type agentTracker struct {
+	mu    sync.Mutex
+	seen  map[string]agentSighting
+	known map[string]bool
+}
+
+// agentSighting is the last time a machine checked in and the release of the agent it ran
+type agentSighting struct {
+	version string
+	at      time.Time
+}
+
+func newAgentTracker() *agentTracker {
+	return &agentTracker{seen: map[string]agentSighting{}, known: map[string]bool{}}
+}
+
+// record counts the machine under the release it checked in with and forgets the machines which went quiet
+func (t *agentTracker) record(mac string, version string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seen[mac] = agentSighting{version: version, at: now}
+	counts := map[string]float64{}
+	for seenMAC, sighting := range t.seen {
+		if now.Sub(sighting.at) > agentActiveWindow {
+			delete(t.seen, seenMAC)
+			continue
+		}
+		counts[sighting.version]++
+	}
+
+	// Releases nobody runs anymore stay at zero rather than keeping their last count
+	for version := range t.known {
+		activeAgents.Set(counts[version], version)
+	}
+	for version, n := range counts {
+		t.known[version] = true
+		activeAgents.Set(n, version)
+	}
+}
+
+// online reports whether the agent of a machine checked in during the last agentOnlineWindow
+func (t *agentTracker) online(mac string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sighting, ok := t.seen[mac]
+	return ok && now.Sub(sighting.at) <= agentOnlineWindow
+}
+
+// agentProtocol is the protocol the agent behind a request says it speaks, zero when it does not say
+func agentProtocol(r *http.Request) (uint, error) {
+	header := r.Header.Get(api_pkg.ProtocolHeader)
+	if header == "" {
+		return 0, nil
+	}
+
+	parsed, err := strconv.ParseUint(header, 10, 32)
+	if err != nil || parsed == 0 {
+		return 0, fmt.Errorf("invalid %s header %q", api_pkg.ProtocolHeader, header)
+	}
+
+	return uint(parsed), nil
+}
+
+// setVersionHeaders tells the agent which protocol both sides speak and which version of the control server it
+// talks to
+func setVersionHeaders(w http.ResponseWriter, protocol uint) {
+	w.Header().Set(api_pkg.ServerVersionHeader, api_pkg.Version)
+	w.Header().Set(api_pkg.ProtocolHeader, strconv.FormatUint(uint64(protocol), 10))
+}
+
+// negotiateProtocol picks the protocol both the agent behind a request and this build speak, and tells the agent.
+// Agents which only speak protocols older than MinAgentProtocol are answered with 426 Upgrade Required, which
+// points them to the release they should update to.
+func (api_ *API) negotiateProtocol(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	agent, err := agentProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+
+	protocol := api_pkg.NegotiateProtocol(agent)
+	setVersionHeaders(w, protocol)
+	if protocol >= api_.config.MinAgentProtocol {
+		return protocol, true
+	}
+
+	refusedAgents.Inc(strconv.FormatUint(uint64(protocol), 10))
+	requestLog(r).Warnf("Refusing agent %s, it speaks protocol %d and at least %d is needed", agentVersion(r),
+		protocol, api_.config.MinAgentProtocol)
+	writeJSON(w, http.StatusUpgradeRequired, api_pkg.ProtocolError{
+		Error: fmt.Sprintf("the agent speaks protocol %d, the control server needs at least %d", protocol,
+			api_.config.MinAgentProtocol),
+		ErrorCode:       api_pkg.ErrorProtocolUnsupported,
+		Protocol:        protocol,
+		MinimumProtocol: api_.config.MinAgentProtocol,
+		ServerProtocol:  api_pkg.ProtocolVersion,
+		UpdateURL:       "/agent/latest",
+	})
+	return 0, false
+}
+
+// agentVersion is the release the agent behind a request says it runs
+func agentVersion(r *http.Request) string {
+	if version := r.Header.Get(api_pkg.AgentVersionHeader); version != "" {
+		return version
+	}
+
+	return unknownAgentVersion
+}
+
+// stampVersions records what the agent of a machine and this build run, on the machine and in activeAgents. The
+// stamp is returned for the boot the request claims, if any.
+func (api_ *API) stampVersions(r *http.Request, mac string, protocol uint) machine.VersionStamp {
+	stamp := machine.VersionStamp{
+		AgentVersion:  r.Header.Get(api_pkg.AgentVersionHeader),
+		AgentProtocol: protocol,
+		ServerVersion: api_pkg.Version,
+		ServerCommit:  api_pkg.Commit,
+	}
+
+	now := time.Now()
+	if err := api_.storeFor(r).SetMachineVersions(mac, stamp, now); err != nil {
+		requestLog(r).Debugf("Cannot record the versions of %s: %v", mac, err)
+	}
+
+	api_.agents.record(mac, agentVersion(r), now)
+	return stamp
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_AgentProtocol(t *testing.T) {
+	store := newTestStore(t)
+
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac}))
+	machineImage, err := images.CreateMachineImageModel(mac)
+	assert.NoError(t, err)
+	assert.NoError(t, store.(sqlite.Store).Session(&gorm.Session{SkipHooks: true}).Create(machineImage).Error)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+	assert.NoError(t, store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", UUID: "setup",
+		Username: "test"}))
+
+	conf := config.Default()
+	conf.MinAgentProtocol = api_pkg.ProtocolVersion
+	assert.NoError(t, conf.Validate())
+	s := newTestServer(t, store, "/tmp", conf)
+
+	// Agents which do not say their protocol speak the legacy one, which is too old here
+	refused := refusedAgents.Value("1")
+	resp := s.request(http.MethodGet, "/machine/abc/boot", "")
+	assert.Equal(t, http.StatusUpgradeRequired, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get(api_pkg.ProtocolHeader))
+	var refusal api_pkg.ProtocolError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refusal))
+	assert.Equal(t, api_pkg.ErrorProtocolUnsupported, refusal.ErrorCode)
+	assert.Equal(t, api_pkg.ProtocolVersion, refusal.MinimumProtocol)
+	assert.Equal(t, "/agent/latest", refusal.UpdateURL)
+	assert.Equal(t, refused+1, refusedAgents.Value("1"))
+
+	assert.Equal(t, http.StatusBadRequest, s.requestWith(http.Header{api_pkg.ProtocolHeader: {"two"}},
+		http.MethodGet, "/machine/abc/boot", "").Code)
+
+	// Newer agents speak the newest protocol of the control server, and the boot records who took part
+	assert.Equal(t, http.StatusOK, s.request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup"}`).Code)
+	resp = s.requestWith(http.Header{
+		api_pkg.ProtocolHeader:     {"7"},
+		api_pkg.AgentVersionHeader: {"1.4.0-protocol-test"},
+	}, http.MethodGet, "/machine/abc/boot", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "2", resp.Header().Get(api_pkg.ProtocolHeader))
+	assert.Equal(t, api_pkg.Version, resp.Header().Get(api_pkg.ServerVersionHeader))
+
+	boot, err := store.GetActiveBoot("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, machinemodel.VersionStamp{AgentVersion: "1.4.0-protocol-test", AgentProtocol: 2,
+		ServerVersion: api_pkg.Version, ServerCommit: api_pkg.Commit}, boot.VersionStamp)
+	assert.Equal(t, float64(1), activeAgents.Value("1.4.0-protocol-test"))
+
+	// Heartbeats are never refused, they update what the machine runs
+	resp = s.requestWith(http.Header{
+		api_pkg.ProtocolHeader:     {"2"},
+		api_pkg.AgentVersionHeader: {"1.4.1-protocol-test"},
+	}, http.MethodPost, "/machine/abc/boot/heartbeat", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, api_pkg.Version, resp.Header().Get(api_pkg.ServerVersionHeader))
+
+	resp = s.request(http.MethodGet, "/machine/abc", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var described types.Machine
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&described))
+	assert.Equal(t, "1.4.1-protocol-test", described.AgentVersion)
+	assert.Equal(t, uint(2), described.AgentProtocol)
+	assert.Equal(t, api_pkg.Version, described.ServerVersion)
+	assert.Equal(t, api_pkg.Commit, described.ServerCommit)
+	assert.NotNil(t, described.AgentSeenAt)
+
+	assert.Equal(t, float64(0), activeAgents.Value("1.4.0-protocol-test"))
+	assert.Equal(t, float64(1), activeAgents.Value("1.4.1-protocol-test"))
+}
+
+func TestAgentTracker(t *testing.T) {
+	tracker := newAgentTracker()
+	start := time.Now()
+	tracker.record("m1", "0.9-tracker-test", start)
+	tracker.record("m2", "0.9-tracker-test", start.Add(time.Minute))
+	assert.Equal(t, float64(2), activeAgents.Value("0.9-tracker-test"))
+
+	// Machines which went quiet no longer count
+	tracker.record("m3", "1.0-tracker-test", start.Add(agentActiveWindow+30*time.Second))
+	assert.Equal(t, float64(1), activeAgents.Value("0.9-tracker-test"))
+	assert.Equal(t, float64(1), activeAgents.Value("1.0-tracker-test"))
+
+	tracker.record("m2", "1.0-tracker-test", start.Add(agentActiveWindow+time.Minute))
+	assert.Equal(t, float64(0), activeAgents.Value("0.9-tracker-test"))
+	assert.Equal(t, float64(2), activeAgents.Value("1.0-tracker-test"))
+}
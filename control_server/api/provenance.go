@@ -0,0 +1,209 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// maxProvenanceLength is the size of the longest base OS and license name of an image in bytes, the source notes
+// can be as long as the description
+const maxProvenanceLength = 256
+
+// errNotPublishable is returned when an image is made public without the provenance which allows that
+var errNotPublishable = errors.New("the image cannot be made public")
+
+// unpublishableImage is the body of the response to making an image public without the provenance it needs.
+// Missing are the fields which have to be filled in or changed, AllowedLicenses the kinds of licenses public images
+// can have.
+type unpublishableImage struct {
+	Error           string
+	Missing         []string
+	AllowedLicenses []string
+}
+
+// validateProvenance checks the fields which tell what is in an image and where it came from
+func validateProvenance(image *images.ImageModel) error {
+	if !image.License.Valid() {
+		return fmt.Errorf("the license must be one of %s, %s, %s or %s", images.LicenseOpenSource,
+			images.LicenseFreeware, images.LicenseProprietary, images.LicenseOther)
+	}
+
+	if len(image.BaseOS) > maxProvenanceLength || len(image.LicenseName) > maxProvenanceLength {
+		return fmt.Errorf("the base OS and the license name can be at most %d bytes", maxProvenanceLength)
+	}
+
+	if len(image.SourceNotes) > maxDescriptionLength {
+		return fmt.Errorf("the source notes can be at most %d bytes", maxDescriptionLength)
+	}
+
+	return nil
+}
+
+// provenanceChanged checks whether an update changes what is known about the contents of an image
+func provenanceChanged(old *images.ImageModel, updated *images.ImageModel) bool {
+	return old.BaseOS != updated.BaseOS || old.License != updated.License || old.LicenseName != updated.LicenseName
+}
+
+// publicLicense checks whether images with a kind of license can be made public
+func (api_ *API) publicLicense(license images.LicenseKind) bool {
+	for _, allowed := range api_.config.PublicLicenses {
+		if images.LicenseKind(allowed) == license {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPublishable answers 422 Unprocessable Entity when a public image lacks the base OS, or has no license which
+// the configuration allows for public images
+func (api_ *API) checkPublishable(w http.ResponseWriter, image *images.ImageModel) error {
+	if problem := api_.unpublishable(image); problem != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, problem)
+		return errNotPublishable
+	}
+
+	return nil
+}
+
+// unpublishable tells what keeps a public image from being public, it returns nil for images which can be
+func (api_ *API) unpublishable(image *images.ImageModel) *unpublishableImage {
+	if !image.Public {
+		return nil
+	}
+
+	missing := []string{}
+	if image.BaseOS == "" {
+		missing = append(missing, "BaseOS")
+	}
+
+	message := "the base OS and the license of an image are needed to make it public"
+	if !api_.publicLicense(image.License) {
+		missing = append(missing, "License")
+		if image.License != "" {
+			message = fmt.Sprintf("images with a %s license cannot be made public", image.License)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	allowed := append([]string{}, api_.config.PublicLicenses...)
+	return &unpublishableImage{message, missing, allowed}
+}
+
+// imageFilter reads the filters of a search through the images from the query
+func imageFilter(r *http.Request) (database.ImageFilter, error) {
+	query := r.URL.Query()
+	filter := database.ImageFilter{Username: query.Get("user")}
+
+	switch license := images.LicenseKind(query.Get("license")); {
+	case license == "none":
+		filter.Unlicensed = true
+	case !license.Valid():
+		return filter, fmt.Errorf("unknown license %s", license)
+	default:
+		filter.License = license
+	}
+
+	if public := query.Get("public"); public != "" {
+		value, err := strconv.ParseBool(public)
+		if err != nil {
+			return filter, fmt.Errorf("public must be true or false")
+		}
+		filter.Public = &value
+	}
+
+	return filter, nil
+}
+
+// imageCSVHeader are the columns of the CSV export of a search through the images
+var imageCSVHeader = []string{"UUID", "Name", "Username", "Public", "BaseOS", "License", "LicenseName",
+	"SourceURL", "SourceNotes", "Architecture", "Versions", "CreatedAt", "UpdatedAt"}
+
+// writeImagesCSV writes the images as a CSV file, with their provenance
+func writeImagesCSV(w http.ResponseWriter, found []images.ImageModel) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(imageCSVHeader); err != nil {
+		return err
+	}
+
+	for _, image := range found {
+		err := writer.Write([]string{string(image.UUID), image.Name, image.Username, strconv.FormatBool(image.Public),
+			image.BaseOS, string(image.License), image.LicenseName, image.SourceURL, image.SourceNotes,
+			string(image.Architecture), strconv.FormatInt(image.VersionCount, 10),
+			image.CreatedAt.UTC().Format(time.RFC3339), image.UpdatedAt.UTC().Format(time.RFC3339)})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// SearchImages finds the images of all users, to audit which images are public and under what license. The images
+// are filtered with ?license=, where none finds the images without a license, ?public=true or false and ?user=.
+// With ?format=csv they are exported as a CSV file instead.
+// Example request: GET /admin/images?public=true&license=proprietary
+// Example response: [{"Name": "Windows 10", "UUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Public": true,
+//
+//	"BaseOS": "Windows 10", "License": "proprietary", ...}]
+func (api_ *API) SearchImages(w http.ResponseWriter, r *http.Request) {
+	filter, err := imageFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "the format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	found, err := api_.storeFor(r).SearchImages(filter)
+	if ErrorWrite(w, err, "Cannot search the images") != nil {
+		return
+	}
+
+	if format == "csv" {
+		if err = writeImagesCSV(w, found); err != nil {
+			requestLog(r).Errorf("write the images as CSV: %v", err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImages(found))
+}
+
+// RegisterProvenanceHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterProvenanceHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/images",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SearchImages,
+		Method:      http.MethodGet,
+		Description: "Searches the images of all users by license and visibility",
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ImageProvenance(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	windows := images.ImageModel{Name: "windows", Username: "test", UUID: "windows"}
+	assert.NoError(t, store.CreateImage(&windows))
+	legacy := images.ImageModel{Name: "legacy", Username: "test", UUID: "legacy", Public: true}
+	assert.NoError(t, store.CreateImage(&legacy))
+
+	diskpath, err := ioutil.TempDir("", "provenance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	send := func(method string, uri string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		return s.request(method, uri, string(encoded))
+	}
+
+	// Images without a base OS and an allowed license stay private
+	windows.Public = true
+	resp := send(http.MethodPut, "/image/windows", windows)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	var refused unpublishableImage
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refused))
+	assert.Equal(t, []string{"BaseOS", "License"}, refused.Missing)
+	assert.Equal(t, []string{"open-source", "freeware"}, refused.AllowedLicenses)
+
+	windows.BaseOS = "Windows 10"
+	windows.License = images.LicenseProprietary
+	windows.LicenseName = "Windows 10 Education"
+	resp = send(http.MethodPut, "/image/windows", windows)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refused))
+	assert.Equal(t, []string{"License"}, refused.Missing)
+
+	windows.License = "shareware"
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, "/image/windows", windows).Code)
+
+	// The owner can record the provenance of a private image
+	windows.Public = false
+	windows.License = images.LicenseProprietary
+	windows.SourceNotes = "Installed from the campus license ISO"
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/image/windows", windows).Code)
+	stored, err := store.GetImageByUUID("windows")
+	assert.NoError(t, err)
+	assert.Equal(t, "Windows 10", stored.BaseOS)
+	assert.Equal(t, images.LicenseProprietary, stored.License)
+	assert.Equal(t, "Installed from the campus license ISO", stored.SourceNotes)
+
+	// Images which were public before stay so, until their provenance is filled in
+	legacy.Description = "Still public"
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/image/legacy", legacy).Code)
+	legacy.BaseOS = "Debian 11"
+	assert.Equal(t, http.StatusUnprocessableEntity, send(http.MethodPut, "/image/legacy", legacy).Code)
+	legacy.License = images.LicenseOpenSource
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/image/legacy", legacy).Code)
+
+	created := images.ImageModel{Name: "gentoo", Username: "test", Public: true}
+	assert.Equal(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/image", created).Code)
+
+	// Admins search the images by license and visibility
+	var found []types.Image
+	resp = s.request(http.MethodGet, "/admin/images?public=true&license=open-source", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+	assert.Len(t, found, 1)
+	assert.Equal(t, images.ImageUUID("legacy"), found[0].UUID)
+
+	resp = s.request(http.MethodGet, "/admin/images?license=proprietary&user=test", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+	assert.Len(t, found, 1)
+	assert.Equal(t, images.ImageUUID("windows"), found[0].UUID)
+
+	resp = s.request(http.MethodGet, "/admin/images?license=none", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+	assert.Len(t, found, 0)
+
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/admin/images?license=shareware", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodGet, "/admin/images?public=maybe", "").Code)
+
+	resp = s.request(http.MethodGet, "/admin/images?format=csv", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Get("Content-Type"), "text/csv")
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, imageCSVHeader, rows[0])
+	assert.Equal(t, []string{"windows", "windows", "test", "false", "Windows 10", "proprietary",
+		"Windows 10 Education", "", "Installed from the campus license ISO"}, rows[2][:9])
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// pxelinuxTemplate is the syslinux menu served to machines which chain-load pxelinux. Entries without an image
+// claim the boot at the head of the queue, the others the first queued boot which flashes their image.
+var pxelinuxTemplate = template.Must(template.New("pxelinux").Parse(`DEFAULT menu.c32
+PROMPT 0
+TIMEOUT 100
+MENU TITLE BAAS {{.Title}}
+{{- range .Entries}}
+
+LABEL {{.Label}}
+	MENU LABEL {{.Name}}
+{{- if .Default}}
+	MENU DEFAULT
+{{- end}}
+{{- if .Kernel}}
+	KERNEL {{.Kernel}}
+	INITRD {{.Initrd}}
+	APPEND {{.Append}}
+{{- else}}
+	LOCALBOOT 0
+{{- end}}
+{{- end}}
+`))
+
+// pxelinuxEntry is a single entry of the boot menu, entries without a kernel boot from the local disk
+type pxelinuxEntry struct {
+	Label   string
+	Name    string
+	Default bool
+	Kernel  string
+	Initrd  string
+	Append  string
+}
+
+type pxelinuxMenu struct {
+	Title   string
+	Entries []pxelinuxEntry
+}
+
+// pxelinuxMac turns the name pxelinux asks for, 01-aa-bb-cc-dd-ee-ff for ethernet, into a MAC address
+func pxelinuxMac(name string) (string, bool) {
+	parts := strings.Split(strings.ToLower(name), "-")
+	if len(parts) != 7 || parts[0] != "01" {
+		return "", false
+	}
+
+	for _, part := range parts[1:] {
+		if len(part) != 2 || strings.Trim(part, "0123456789abcdef") != "" {
+			return "", false
+		}
+	}
+
+	return strings.Join(parts[1:], ":"), true
+}
+
+// menuText keeps user supplied names from breaking out of their line of the menu
+func menuText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// bootableImages collects the images which may be picked for a machine: those of the image setups queued for it,
+// which belong to the owner of the setup or are public, are not built for another architecture and have a version
+func (api_ *API) bootableImages(mac string, arch machine.SystemArchitecture) ([]images.ImageModel, error) {
+	bootSetups, err := api_.store.GetBootSetups(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[images.ImageUUID]bool{}
+	var bootable []images.ImageModel
+	for _, bootSetup := range bootSetups {
+		setup, err := api_.store.GetImageSetup(string(bootSetup.SetupUUID))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, frozen := range setup.Images {
+			image := frozen.Image
+			if seen[image.UUID] || (image.Username != setup.Username && !image.Public) ||
+				image.Architecture.Conflicts(arch) {
+				continue
+			}
+
+			seen[image.UUID] = true
+			stored, err := api_.store.GetImageByUUID(image.UUID)
+			if err != nil {
+				return nil, err
+			}
+
+			// Picking an image without versions would only fail in the management OS
+			if len(stored.Versions) == 0 {
+				continue
+			}
+
+			bootable = append(bootable, image)
+		}
+	}
+
+	return bootable, nil
+}
+
+// pxelinuxMenuFor builds the menu of a machine. Machines without any queued boot get their default image, unknown
+// machines and the machines without a default image get the default menu which boots from the local disk.
+func (api_ *API) pxelinuxMenuFor(name string) (*pxelinuxMenu, error) {
+	local := pxelinuxEntry{Label: "local", Name: "Boot from the local disk"}
+	menu := &pxelinuxMenu{Title: "boot menu"}
+
+	mac, ok := pxelinuxMac(name)
+	if !ok {
+		local.Default = true
+		menu.Entries = []pxelinuxEntry{local}
+		return menu, nil
+	}
+
+	m, err := api_.store.GetMachineByMac(util.MacAddress{Address: mac})
+	if err != nil || !m.Approved() {
+		log.Debugf("Serving the default pxelinux menu to unknown or unapproved machine %s", mac)
+		local.Default = true
+		menu.Entries = []pxelinuxEntry{local}
+		return menu, nil
+	}
+
+	bootable, err := api_.bootableImages(mac, m.Architecture)
+	if err != nil {
+		return nil, err
+	}
+
+	menu.Title = menuText(m.Name)
+	if menu.Title == "" {
+		menu.Title = mac
+	}
+
+	// Machines with nothing queued are offered their default image instead
+	def := resolvedDefault{Rule: ruleQueue}
+	if len(bootable) == 0 {
+		queue, err := api_.store.GetBootSetups(mac)
+		if err != nil {
+			return nil, err
+		}
+
+		def.Rule = ruleLocalBoot
+		if len(queue) == 0 {
+			def = api_.resolveDefault(m)
+		}
+	}
+
+	boot := getBootConfig(m.Architecture)
+	if boot.Kernel == "" || def.Rule == ruleLocalBoot {
+		local.Default = true
+		menu.Entries = []pxelinuxEntry{local}
+		return menu, nil
+	}
+
+	entry := func(label string, name string, extra string) pxelinuxEntry {
+		return pxelinuxEntry{
+			Label:  label,
+			Name:   name,
+			Kernel: boot.Kernel,
+			Initrd: strings.Join(boot.Initramfs, ","),
+			Append: strings.TrimSpace(boot.Cmdline + " " + extra),
+		}
+	}
+
+	if def.Image != nil {
+		// The default image is claimed like the head of the queue
+		image := entry("default", menuText("Default image: "+def.Image.Name), "")
+		image.Default = true
+		menu.Entries = append(menu.Entries, image, local)
+		return menu, nil
+	}
+
+	next := entry("next", "Next queued boot", "")
+	next.Default = true
+	menu.Entries = append(menu.Entries, next)
+
+	for i, image := range bootable {
+		menu.Entries = append(menu.Entries, entry("image"+strconv.Itoa(i),
+			menuText(image.Name+" ("+image.Username+")"), "baas.image="+string(image.UUID)))
+	}
+
+	menu.Entries = append(menu.Entries, local)
+	return menu, nil
+}
+
+// ServePxelinuxConfig serves the pxelinux.cfg file of a machine, listing the images which are queued for it. It is
+// requested by pxelinux itself, so it needs no login.
+// Example request: GET /boot/pxelinux.cfg/01-52-54-00-d9-71-93
+// Example response: a syslinux menu
+func (api_ *API) ServePxelinuxConfig(w http.ResponseWriter, r *http.Request) {
+	menu, err := api_.pxelinuxMenuFor(mux.Vars(r)["name"])
+	if ErrorWrite(w, err, "Cannot build the boot menu") != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if ErrorWrite(w, pxelinuxTemplate.Execute(&buf, menu), "Cannot render the boot menu") != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
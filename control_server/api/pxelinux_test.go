@@ -0,0 +1,103 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPxelinuxMac(t *testing.T) {
+	mac, ok := pxelinuxMac("01-52-54-00-D9-71-93")
+	assert.True(t, ok)
+	assert.Equal(t, "52:54:00:d9:71:93", mac)
+
+	for _, name := range []string{"default", "C0A8010A", "01-52-54-00-d9-71", "06-52-54-00-d9-71-93",
+		"01-52-54-00-d9-71-zz"} {
+		_, ok = pxelinuxMac(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestApi_PxelinuxConfig(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "pxelinux")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "other", Email: "other@example.com", Role: user.User}))
+
+	created := map[images.ImageUUID]*images.ImageModel{}
+	for _, image := range []images.ImageModel{
+		{Name: "own", Username: "test", UUID: "own"},
+		{Name: "private", Username: "other", UUID: "private"},
+		{Name: "shared", Username: "other", UUID: "shared", Public: true},
+		{Name: "arm", Username: "test", UUID: "arm", Architecture: machinemodel.Arm64},
+	} {
+		image := image
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+		created[image.UUID], err = store.GetImageByUUID(image.UUID)
+		assert.NoError(t, err)
+	}
+
+	// The second setup of the user lists an image which is not theirs and one which cannot boot on the machine, they
+	// are left out of the menu
+	setups := map[images.ImageUUID][]images.ImageUUID{"first": {"own"}, "second": {"private", "shared", "arm"}}
+	for _, uuid := range []images.ImageUUID{"first", "second"} {
+		setup := images.ImageSetup{Name: string(uuid), UUID: uuid, Username: "test"}
+		assert.NoError(t, store.CreateImageSetup("test", &setup))
+		for _, image := range setups[uuid] {
+			store.AddImageToImageSetup(&setup, created[image], *created[image].LatestVersion(), false)
+		}
+	}
+
+	mac := util.MacAddress{Address: "52:54:00:d9:71:93"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: "lab1", MacAddress: mac,
+		Architecture: machinemodel.X86_64, Managed: true}))
+	for _, uuid := range []images.ImageUUID{"first", "second"} {
+		assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: mac.Address, SetupUUID: uuid}))
+	}
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	request := func(uri string) *httptest.ResponseRecorder {
+		return s.serve(httptest.NewRequest(http.MethodGet, uri, nil))
+	}
+
+	// pxelinux does not log in
+	resp := request("/boot/pxelinux.cfg/01-52-54-00-d9-71-93")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	menu := resp.Body.String()
+	assert.Contains(t, menu, "MENU TITLE BAAS lab1")
+	assert.Contains(t, menu, "KERNEL http://localhost:4848/static/vmlinuz")
+	assert.Contains(t, menu, "APPEND root=sr0 baas.image=own")
+	assert.Contains(t, menu, "APPEND root=sr0 baas.image=shared")
+	assert.NotContains(t, menu, "baas.image=private")
+	assert.NotContains(t, menu, "baas.image=arm")
+	assert.Contains(t, menu, "LOCALBOOT 0")
+
+	// Unknown machines and the fallback names of pxelinux get the default menu
+	for _, name := range []string{"01-52-54-00-00-00-00", "default"} {
+		resp = request("/boot/pxelinux.cfg/" + name)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), "LOCALBOOT 0")
+		assert.NotContains(t, resp.Body.String(), "KERNEL")
+	}
+}
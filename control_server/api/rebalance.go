@@ -0,0 +1,435 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rebalanceRunning rebalances are moving images into their shards
+	rebalanceRunning = "running"
+	// rebalanceStopped rebalances were interrupted, starting another one moves the images which are left
+	rebalanceStopped = "stopped"
+	// rebalanceFinished rebalances went over all images which were stored in the flat layout
+	rebalanceFinished = "finished"
+)
+
+// maxRebalanceErrors is how many of the errors of a rebalance are kept, the others are only logged
+const maxRebalanceErrors = 20
+
+// shardCount is how many shards the directory of a tier is split into
+const shardCount = 256
+
+// rebalanceStatus is how moving the images of the flat layout into their shards is going
+type rebalanceStatus struct {
+	State string
+	// Images is how many images were stored in the flat layout when the rebalance started
+	Images int
+	Moved  int
+	// Skipped images were being written or migrated, the next rebalance moves them
+	Skipped int
+	Failed  int
+	// Bytes is the size of the files of the images which were moved
+	Bytes      uint64
+	Errors     []string `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// rebalancer runs one rebalance at a time, the last one is remembered until the control server restarts
+type rebalancer struct {
+	mu     sync.Mutex
+	status *rebalanceStatus
+	cancel context.CancelFunc
+}
+
+// begin registers a rebalance of the images, unless one is running already
+func (b *rebalancer) begin(pending int) (context.Context, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.status != nil && b.status.State == rebalanceRunning {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.status = &rebalanceStatus{State: rebalanceRunning, Images: pending, StartedAt: time.Now()}
+	return ctx, true
+}
+
+// moved counts an image of the rebalance, err tells why it was not moved
+func (b *rebalancer) moved(uuid images.ImageUUID, bytes uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err == nil:
+		b.status.Moved++
+		b.status.Bytes += bytes
+	case errors.Is(err, errWriting) || errors.Is(err, errMigrating):
+		b.status.Skipped++
+	default:
+		b.status.Failed++
+		if len(b.status.Errors) < maxRebalanceErrors {
+			b.status.Errors = append(b.status.Errors, fmt.Sprintf("%s: %v", uuid, err))
+		}
+	}
+}
+
+// finish records how a rebalance ended, stopped ones were interrupted
+func (b *rebalancer) finish(stopped bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.status.FinishedAt = &now
+	b.status.State = rebalanceFinished
+	if stopped {
+		b.status.State = rebalanceStopped
+	}
+	b.cancel()
+}
+
+// stop interrupts the running rebalance, it reports whether there was one
+func (b *rebalancer) stop() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.status == nil || b.status.State != rebalanceRunning {
+		return false
+	}
+
+	b.cancel()
+	return true
+}
+
+// get returns a copy of the status of the last rebalance, it is nil when there was none
+func (b *rebalancer) get() *rebalanceStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.status == nil {
+		return nil
+	}
+
+	status := *b.status
+	status.Errors = append([]string(nil), b.status.Errors...)
+	return &status
+}
+
+// flatImages finds the images which are still stored in the root of their tier, by the root. Machine images are
+// left there, there is only one for every machine.
+func (api_ *API) flatImages() (map[images.ImageUUID]string, error) {
+	_, machineImages, err := api_.store.GetImageUUIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := api_.store.GetImagePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uuid := range machineImages {
+		delete(roots, uuid)
+	}
+
+	flat := map[images.ImageUUID]string{}
+	for uuid, root := range roots {
+		if root == "" {
+			root = api_.diskpath
+		}
+
+		if info, serr := os.Stat(storage.FlatDir(root, string(uuid))); serr == nil && info.IsDir() {
+			flat[uuid] = root
+		}
+	}
+
+	return flat, nil
+}
+
+// reshardImage moves the directory of an image into its shard and returns the size of its files. Nothing writes the
+// files meanwhile, downloads which opened them already keep reading them.
+func (api_ *API) reshardImage(uuid images.ImageUUID, root string) (uint64, error) {
+	release, err := api_.moves.reshard(uuid)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	src, dest := storage.FlatDir(root, string(uuid)), storage.ShardDir(root, string(uuid))
+	if _, err = os.Stat(dest); err == nil {
+		return 0, errors.New("the image is stored in its shard as well, one of the two has to be removed")
+	}
+
+	size := diskUsage(src)
+	if err = os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	// The shard is in the same directory, so the rename is atomic: an interrupted rebalance leaves every image in
+	// either layout and the lookups find it in both
+	if err = os.Rename(src, dest); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// rebalance moves the images of the flat layout into their shards, until it is stopped
+func (api_ *API) rebalance(ctx context.Context, pending map[images.ImageUUID]string) {
+	uuids := make([]string, 0, len(pending))
+	for uuid := range pending {
+		uuids = append(uuids, string(uuid))
+	}
+	sort.Strings(uuids)
+
+	for _, uuid := range uuids {
+		if ctx.Err() != nil {
+			log.Infof("Stopped the rebalance of the image store, starting it again moves the images which are left")
+			api_.rebalancing.finish(true)
+			return
+		}
+
+		size, err := api_.reshardImage(images.ImageUUID(uuid), pending[images.ImageUUID(uuid)])
+		if err != nil {
+			log.Warnf("Cannot move image %s into its shard: %v", uuid, err)
+		}
+		api_.rebalancing.moved(images.ImageUUID(uuid), size, err)
+	}
+
+	log.Infof("Rebalanced the image store")
+	api_.rebalancing.finish(false)
+}
+
+// StartRebalance moves the images which are stored in the root of their tier into their shards in the background.
+// The images stay readable all along. Rebalances can be stopped and started again, they pick up the images which
+// are left.
+// Example request: POST /admin/storage/rebalance
+// Example response: {"State": "running", "Images": 24311, "Moved": 0, "Skipped": 0, "Failed": 0, "Bytes": 0,
+// "StartedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) StartRebalance(w http.ResponseWriter, r *http.Request) {
+	pending, err := api_.flatImages()
+	if ErrorWrite(w, err, "Cannot find the images to move") != nil {
+		return
+	}
+
+	ctx, ok := api_.rebalancing.begin(len(pending))
+	if !ok {
+		writeJSON(w, http.StatusConflict, api_.rebalancing.get())
+		return
+	}
+
+	requestLog(r).Infof("%s started to move %d images into their shards", api_.requester(r), len(pending))
+	go api_.rebalance(ctx, pending)
+	writeJSON(w, http.StatusAccepted, api_.rebalancing.get())
+}
+
+// GetRebalance follows the last rebalance, rebalances are forgotten when the control server restarts
+// Example request: GET /admin/storage/rebalance
+// Example response: {"State": "running", "Images": 24311, "Moved": 12000, "Skipped": 2, "Failed": 0,
+// "Bytes": 8796093022208, "StartedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) GetRebalance(w http.ResponseWriter, _ *http.Request) {
+	status := api_.rebalancing.get()
+	if status == nil {
+		http.Error(w, "The image store was not rebalanced", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// StopRebalance interrupts the running rebalance after the image it is moving
+// Example request: DELETE /admin/storage/rebalance
+// Example response: 202 Accepted
+func (api_ *API) StopRebalance(w http.ResponseWriter, r *http.Request) {
+	if !api_.rebalancing.stop() {
+		http.Error(w, "The image store is not being rebalanced", http.StatusConflict)
+		return
+	}
+
+	requestLog(r).Infof("%s stopped the rebalance of the image store", api_.requester(r))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// shardUsage is what a shard of a tier holds
+type shardUsage struct {
+	Shard  string
+	Images int
+	Bytes  uint64
+}
+
+// tierLayout is how the images of a directory of the storage tiers are spread over its shards
+type tierLayout struct {
+	// Tiers are the storage tiers stored in the directory
+	Tiers     []string
+	Directory string
+	// FlatImages are the images stored in the root of the directory, the rebalance moves them into their shards
+	FlatImages int
+	FlatBytes  uint64
+	// Shards are the shards which hold any images
+	Shards []shardUsage
+	// Skew is how many images the fullest shard holds compared to the average shard, 1 is perfectly even
+	Skew float64
+}
+
+// layoutOf counts the images and bytes in the shards of a directory
+func layoutOf(dir string) (tierLayout, error) {
+	layout := tierLayout{Directory: dir, Shards: []shardUsage{}}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return layout, err
+	}
+
+	total, fullest := 0, 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !storage.IsShard(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		members, rerr := ioutil.ReadDir(path)
+		if rerr != nil {
+			return layout, rerr
+		}
+
+		usage := shardUsage{Shard: entry.Name(), Bytes: diskUsage(path)}
+		for _, member := range members {
+			if member.IsDir() {
+				usage.Images++
+			}
+		}
+
+		if usage.Images == 0 {
+			continue
+		}
+
+		total += usage.Images
+		if usage.Images > fullest {
+			fullest = usage.Images
+		}
+		layout.Shards = append(layout.Shards, usage)
+	}
+
+	if total != 0 {
+		layout.Skew = float64(fullest) / (float64(total) / shardCount)
+	}
+
+	return layout, nil
+}
+
+// GetStorageLayout reports how the images are spread over the shards of every directory of the storage tiers,
+// and how many are still stored in the flat layout
+// Example request: GET /admin/storage/layout
+// Example response: {"Tiers": [{"Tiers": ["default"], "Directory": "/disks", "FlatImages": 12,
+// "FlatBytes": 5368709120, "Shards": [{"Shard": "00", "Images": 95, "Bytes": 40802189312}], "Skew": 1.21}],
+// "Rebalance": {"State": "finished", "Images": 24311, "Moved": 24299, "Skipped": 12, "Failed": 0}}
+func (api_ *API) GetStorageLayout(w http.ResponseWriter, _ *http.Request) {
+	flat, err := api_.flatImages()
+	if ErrorWrite(w, err, "Cannot find the images in the flat layout") != nil {
+		return
+	}
+
+	tiers := api_.storageTiers()
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Tiers may share a directory, it is only counted once
+	layouts := []tierLayout{}
+	counted := map[string]int{}
+	for _, name := range names {
+		dir := filepath.Clean(tiers[name])
+		if i, ok := counted[dir]; ok {
+			layouts[i].Tiers = append(layouts[i].Tiers, name)
+			continue
+		}
+
+		layout, lerr := layoutOf(dir)
+		if ErrorWrite(w, lerr, "Cannot count the images in the shards of tier "+name) != nil {
+			return
+		}
+
+		layout.Tiers = []string{name}
+		for uuid, root := range flat {
+			if filepath.Clean(root) == dir {
+				layout.FlatImages++
+				layout.FlatBytes += diskUsage(storage.FlatDir(root, string(uuid)))
+			}
+		}
+
+		counted[dir] = len(layouts)
+		layouts = append(layouts, layout)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Tiers     []tierLayout
+		Rebalance *rebalanceStatus `json:",omitempty"`
+	}{layouts, api_.rebalancing.get()})
+}
+
+// RegisterRebalanceHandlers sets the metadata for the routes which report on and rebalance the layout of the image
+// store
+func (api_ *API) RegisterRebalanceHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/storage/rebalance",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.StartRebalance,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Moves the images of the flat layout into their shards",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/storage/rebalance",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetRebalance,
+		Method:      http.MethodGet,
+		Description: "Follows the rebalance of the image store",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/storage/rebalance",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.StopRebalance,
+		Method:      http.MethodDelete,
+		Description: "Stops the rebalance of the image store",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/storage/layout",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Timeout:     longTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetStorageLayout,
+		Method:      http.MethodGet,
+		Description: "Reports how the images are spread over the shards of the storage tiers",
+	})
+}
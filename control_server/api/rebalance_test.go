@@ -0,0 +1,109 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Rebalance(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "rebalance")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	// Images from before the shards are stored straight in the disk path
+	for _, uuid := range []images.ImageUUID{"old", "older", "sharded"} {
+		image := images.ImageModel{Name: string(uuid), Username: "test", UUID: uuid,
+			DiskCompressionStrategy: images.DiskCompressionStrategyNone}
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: uuid}))
+		assert.NoError(t, ioutil.WriteFile(image.VersionFile(1), []byte("disk of "+uuid), 0644))
+		if uuid != "sharded" {
+			assert.NoError(t, os.Rename(storage.ShardDir(diskpath, string(uuid)), storage.FlatDir(diskpath,
+				string(uuid))))
+		}
+	}
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	layout := func() tierLayout {
+		resp := s.request(http.MethodGet, "/admin/storage/layout", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		var report struct{ Tiers []tierLayout }
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		assert.Len(t, report.Tiers, 1)
+		return report.Tiers[0]
+	}
+	rebalance := func() rebalanceStatus {
+		assert.Equal(t, http.StatusAccepted, s.request(http.MethodPost, "/admin/storage/rebalance", "").Code)
+		var status rebalanceStatus
+		assert.Eventually(t, func() bool {
+			resp := s.request(http.MethodGet, "/admin/storage/rebalance", "")
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+			return status.State != rebalanceRunning
+		}, 5*time.Second, 10*time.Millisecond)
+		return status
+	}
+
+	before := layout()
+	assert.Equal(t, []string{images.DiskPathTier}, before.Tiers)
+	assert.Equal(t, 2, before.FlatImages)
+	assert.Equal(t, []shardUsage{{Shard: storage.Shard("sharded"), Images: 1, Bytes: diskUsage(
+		storage.ShardDir(diskpath, "sharded"))}}, before.Shards)
+
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/admin/storage/rebalance", "").Code)
+	assert.Equal(t, http.StatusConflict, s.request(http.MethodDelete, "/admin/storage/rebalance", "").Code)
+
+	// Images which are being written are left for the next rebalance
+	release, err := s.api.moves.write("older")
+	assert.NoError(t, err)
+	status := rebalance()
+	release()
+	assert.Equal(t, rebalanceFinished, status.State)
+	assert.Equal(t, 2, status.Images)
+	assert.Equal(t, 1, status.Moved)
+	assert.Equal(t, 1, status.Skipped)
+	assert.NoDirExists(t, storage.FlatDir(diskpath, "old"))
+	assert.DirExists(t, storage.FlatDir(diskpath, "older"))
+
+	status = rebalance()
+	assert.Equal(t, 1, status.Images)
+	assert.Equal(t, 1, status.Moved)
+	assert.Zero(t, status.Failed)
+
+	// The images are found in their shards
+	for _, uuid := range []string{"old", "older", "sharded"} {
+		assert.FileExists(t, storage.ShardDir(diskpath, uuid)+"/1.img")
+		resp := s.request(http.MethodGet, "/image/"+uuid+"/1", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "disk of "+uuid, resp.Body.String())
+	}
+
+	after := layout()
+	assert.Zero(t, after.FlatImages)
+	stored := 0
+	for _, shard := range after.Shards {
+		stored += shard.Images
+	}
+	assert.Equal(t, 3, stored)
+	assert.NotZero(t, after.Skew)
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// joinParameter passes the join token to the management OS on the kernel command line
+const joinParameter = "baas.join="
+
+// registrationKeyBytes is the size of the key a registered machine gets, before it is hex encoded
+const registrationKeyBytes = 32
+
+// registrationRequest is what a machine tells about itself when it registers
+type registrationRequest struct {
+	Architecture string `schema:"architecture" description:"The architecture of the machine, in any case"`
+}
+
+// bearerToken is the token of the Authorization header, empty when there is none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// hashRegistrationKey is what is stored of the key of a registered machine
+func hashRegistrationKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRegistrationKey makes the key of a machine which registered itself, and the hash which is stored of it
+func newRegistrationKey() (string, string, error) {
+	b := make([]byte, registrationKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	key := hex.EncodeToString(b)
+	return key, hashRegistrationKey(key), nil
+}
+
+// joinCmdline adds the join token to the kernel command line of the management OS for a machine which may
+// register itself
+func (api_ *API) joinCmdline(cmdline string) string {
+	return strings.TrimSpace(cmdline + " " + joinParameter + api_.config.JoinToken)
+}
+
+// mayRegister reports whether a machine network-booting with a MAC address BAAS does not know may register itself
+func (api_ *API) mayRegister() bool {
+	return api_.config.AutoRegister && api_.config.JoinToken != ""
+}
+
+// RegisterMachine adds a machine which BAAS does not know as pending, when it has the join token. The machine
+// gets a key to report its inventory and to ask for its status with, which it gets anew every time it registers
+// while it is pending. Approved and rejected machines are only told their status.
+// Example request: POST /register/52:54:00:d9:71:93
+// Example header: Authorization: Bearer <join token>
+// Example body: {"Architecture": "x86_64"}
+// Example response: {"Status": "pending", "Key": "9f86d081884c7d659a2feaa0c55ad015..."}
+func (api_ *API) RegisterMachine(w http.ResponseWriter, r *http.Request) {
+	if !api_.mayRegister() {
+		http.Error(w, "Machines cannot register themselves, AutoRegister is off", http.StatusNotFound)
+		return
+	}
+
+	token := bearerToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(api_.config.JoinToken)) != 1 {
+		http.Error(w, "Invalid join token", http.StatusUnauthorized)
+		requestLog(r).Warn("Refused a registration with an invalid join token")
+		return
+	}
+
+	mac := mux.Vars(r)["mac"]
+	if _, err := net.ParseMAC(mac); err != nil {
+		http.Error(w, "Invalid mac address", http.StatusBadRequest)
+		return
+	}
+
+	var request registrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid registration given", http.StatusBadRequest)
+		return
+	}
+
+	arch, ok := machinemodel.ParseArchitecture(request.Architecture)
+	if !ok {
+		http.Error(w, "Unknown architecture", http.StatusBadRequest)
+		return
+	}
+
+	store := api_.storeFor(r)
+	machine, err := store.GetMachineByMac(util.MacAddress{Address: mac})
+	known := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		ErrorWrite(w, err, "Cannot find the machine")
+		return
+	}
+
+	// Machines which were decided on learn the decision, nothing more
+	if known && machine.RegistrationStatus() != machinemodel.MachinePending {
+		writeJSON(w, http.StatusOK, machinemodel.Registration{Status: machine.RegistrationStatus()})
+		return
+	}
+
+	key, hash, err := newRegistrationKey()
+	if ErrorWrite(w, err, "Cannot make a key for the machine") != nil {
+		return
+	}
+
+	if known {
+		if ErrorWrite(w, store.SetRegistrationKey(machine.MacAddress, hash), "Cannot register the machine") != nil {
+			return
+		}
+
+		requestLog(r).Infof("Pending machine %s registered again", mac)
+		writeJSON(w, http.StatusOK, machinemodel.Registration{Status: machinemodel.MachinePending, Key: key})
+		return
+	}
+
+	// Pending machines are named after their MAC address until an admin names them, names are unique
+	machine = &machinemodel.MachineModel{
+		Name:                mac,
+		Architecture:        arch,
+		MacAddress:          util.MacAddress{Address: mac},
+		Status:              machinemodel.MachinePending,
+		RegistrationKeyHash: hash,
+	}
+	if StoreErrorWrite(w, store.CreateMachine(machine), "Cannot register the machine") != nil {
+		return
+	}
+
+	machineImage, err := images.CreateMachineImageModel(machine.MacAddress)
+	if ErrorWrite(w, err, "Cannot register the machine") != nil {
+		return
+	}
+	store.CreateMachineImage(machineImage)
+
+	requestLog(r).WithFields(log.Fields{
+		"audit": "machine-registered",
+		"mac":   mac,
+	}).Infof("Machine %s registered itself and waits for approval", mac)
+	writeJSON(w, http.StatusCreated, machinemodel.Registration{Status: machinemodel.MachinePending, Key: key})
+}
+
+// registeredMachine finds the machine which registered itself from its key. Only the machine which holds the key
+// of its last registration gets it.
+func (api_ *API) registeredMachine(w http.ResponseWriter, r *http.Request) (*machinemodel.MachineModel, bool) {
+	mac := mux.Vars(r)["mac"]
+	key := bearerToken(r)
+
+	machine, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
+	if err != nil || key == "" || machine.RegistrationKeyHash == "" || subtle.ConstantTimeCompare(
+		[]byte(hashRegistrationKey(key)), []byte(machine.RegistrationKeyHash)) != 1 {
+		http.Error(w, "Invalid registration key", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return machine, true
+}
+
+// GetRegistration tells a machine which registered itself whether it was approved
+// Example request: GET /register/52:54:00:d9:71:93
+// Example header: Authorization: Bearer <key>
+// Example response: {"Status": "approved"}
+func (api_ *API) GetRegistration(w http.ResponseWriter, r *http.Request) {
+	machine, ok := api_.registeredMachine(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, machinemodel.Registration{Status: machine.RegistrationStatus()})
+}
+
+// UpdateRegisteredInventory stores the hardware a pending machine found in itself, as UpdateInventory does for
+// the machines BAAS boots
+// Example request: PUT /register/52:54:00:d9:71:93/inventory
+// Example header: Authorization: Bearer <key>
+// Example body: {"TargetDevice": "/dev/sda", "Disks": [{"Device": "/dev/sda", "Size": 256060514304}]}
+func (api_ *API) UpdateRegisteredInventory(w http.ResponseWriter, r *http.Request) {
+	machine, ok := api_.registeredMachine(w, r)
+	if !ok {
+		return
+	}
+
+	if machine.Status != machinemodel.MachinePending {
+		http.Error(w, "Only pending machines report their inventory with their key", http.StatusConflict)
+		return
+	}
+
+	var inventory machinemodel.Inventory
+	if err := json.NewDecoder(r.Body).Decode(&inventory); err != nil {
+		http.Error(w, "Invalid inventory given", http.StatusBadRequest)
+		return
+	}
+
+	err := api_.storeFor(r).UpdateInventory(machine.MacAddress, &inventory)
+	if ErrorWrite(w, err, "Cannot update the inventory") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &inventory)
+}
+
+// decideRegistration approves or rejects a machine which registered itself
+func (api_ *API) decideRegistration(w http.ResponseWriter, r *http.Request, status machinemodel.RegistrationStatus) {
+	mac := mux.Vars(r)["mac"]
+	machine, err := api_.storeFor(r).GetMachineByMac(util.MacAddress{Address: mac})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Cannot find the machine", http.StatusNotFound)
+		return
+	} else if ErrorWrite(w, err, "Cannot find the machine") != nil {
+		return
+	}
+
+	// A rejected machine can still be approved, an approved one is taken out of service by no longer managing it
+	if machine.Approved() || machine.Status == status {
+		http.Error(w, "The machine is already "+string(machine.RegistrationStatus()), http.StatusConflict)
+		return
+	}
+
+	machine.Status = status
+	machine.Managed = status == machinemodel.MachineApproved
+	err = api_.storeFor(r).SetMachineRegistration(machine.MacAddress, machine.Status, machine.Managed)
+	if ErrorWrite(w, err, "Cannot update the machine") != nil {
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"audit": "machine-" + string(status),
+		"mac":   mac,
+	}).Infof("%s %s machine %s", api_.requester(r), status, mac)
+	writeJSON(w, http.StatusOK, types.NewMachine(machine))
+}
+
+// ApproveMachine lets BAAS boot a machine which registered itself, it is managed from then on
+// Example request: POST /machine/52:54:00:d9:71:93/approve
+func (api_ *API) ApproveMachine(w http.ResponseWriter, r *http.Request) {
+	api_.decideRegistration(w, r, machinemodel.MachineApproved)
+}
+
+// RejectMachine keeps a machine which registered itself booting from its local disk
+// Example request: POST /machine/52:54:00:d9:71:93/reject
+func (api_ *API) RejectMachine(w http.ResponseWriter, r *http.Request) {
+	api_.decideRegistration(w, r, machinemodel.MachineRejected)
+}
+
+// registerRegistrationHandlers serves the routes the machines register themselves with, they are authenticated by
+// the join token and the key of the machine rather than a session
+func (api_ *API) registerRegistrationHandlers(r *mux.Router) {
+	r.HandleFunc("/register/{mac}", validateBody(requestSchemas["machine-registration"], api_.RegisterMachine)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/register/{mac}", api_.GetRegistration).Methods(http.MethodGet)
+	r.HandleFunc("/register/{mac}/inventory", validateBody(requestSchemas["machine-inventory"],
+		api_.UpdateRegisteredInventory)).Methods(http.MethodPut)
+}
+
+// RegisterRegistrationHandlers sets the metadata for the routes admins decide on the registered machines with
+func (api_ *API) RegisterRegistrationHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/approve",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.ApproveMachine,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Lets BAAS boot a machine which registered itself",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/machine/{mac}/reject",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.RejectMachine,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Keeps a machine which registered itself booting from its local disk",
+	})
+}
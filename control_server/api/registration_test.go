@@ -0,0 +1,138 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Registration(t *testing.T) {
+	store := newTestStore(t)
+
+	student := &user.UserModel{Username: "student", Email: "student@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(student))
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: "known", Managed: true,
+		MacAddress: util.MacAddress{Address: "52:54:00:00:00:01"}, Architecture: machinemodel.X86_64}))
+
+	const token = "a join token long enough"
+	conf := config.Default()
+	s := newTestServer(t, store, "/tmp", conf)
+
+	request := func(method string, uri string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		return s.serve(req)
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	system := http.Header{"Type": {"system"}}
+
+	const mac = "52:54:00:00:00:02"
+	register := func(token string) *httptest.ResponseRecorder {
+		return request(http.MethodPost, "/register/"+mac, bearer(token), `{"Architecture": "x86_64"}`)
+	}
+
+	// Unknown machines boot from their disk until auto-registration is turned on
+	assert.Equal(t, http.StatusNotFound, register(token).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/boot/"+mac, nil, "").Code)
+
+	conf.AutoRegister = true
+	conf.JoinToken = token
+	assert.Equal(t, http.StatusUnauthorized, register("a guessed join token").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/register/"+mac, nil, "{}").Code)
+
+	// Pixiecore hands the token to the management OS of the machines BAAS does not know
+	resp := request(http.MethodGet, "/v1/boot/"+mac, nil, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var boot bootConfigResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&boot))
+	assert.True(t, strings.HasSuffix(boot.Cmdline, " baas.join="+token))
+	assert.Equal(t, actionNetboot, s.api.decide(mac, "efi", "10.0.0.1").Action)
+
+	resp = register(token)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var registration machinemodel.Registration
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&registration))
+	assert.Equal(t, machinemodel.MachinePending, registration.Status)
+	assert.NotEmpty(t, registration.Key)
+
+	// The key only reports the inventory of its own machine
+	inventory := `{"TargetDevice": "/dev/sda", "Disks": [{"Device": "/dev/sda", "Size": 256060514304}]}`
+	assert.Equal(t, http.StatusUnauthorized,
+		request(http.MethodPut, "/register/"+mac+"/inventory", bearer(token), inventory).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		request(http.MethodPut, "/register/52:54:00:00:00:01/inventory", bearer(registration.Key), inventory).Code)
+	assert.Equal(t, http.StatusOK,
+		request(http.MethodPut, "/register/"+mac+"/inventory", bearer(registration.Key), inventory).Code)
+
+	// Pending machines are not booted, nor listed but for the admins who asked for them
+	assert.Equal(t, actionLocal, s.api.decide(mac, "efi", "10.0.0.1").Action)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/boot/"+mac, nil, "").Code)
+	assert.Equal(t, http.StatusConflict, request(http.MethodGet, "/machine/"+mac+"/boot", system, "").Code)
+
+	listed := func(header http.Header, uri string) []string {
+		resp := request(http.MethodGet, uri, header, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		var machines []types.Machine
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&machines))
+
+		var macs []string
+		for _, m := range machines {
+			macs = append(macs, m.MacAddress.Address+" "+m.Status)
+		}
+		return macs
+	}
+	cookie := http.Header{"Cookie": {conf.SessionCookieName + "=" + s.token(student)}}
+	assert.Equal(t, []string{"52:54:00:00:00:01 approved"}, listed(cookie, "/machines"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/machines?status=pending", cookie, "").Code)
+	assert.Equal(t, []string{mac + " pending"}, listed(system, "/machines?status=pending"))
+
+	pending, err := store.GetMachineByMac(util.MacAddress{Address: mac})
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/sda", pending.TargetDevice)
+	assert.False(t, pending.Managed)
+
+	// Once approved the machine is booted as any other
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/machine/"+mac+"/approve", cookie, "").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/machine/"+mac+"/approve", system, "").Code)
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/machine/"+mac+"/approve", system, "").Code)
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/machine/"+mac+"/reject", system, "").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/v1/boot/"+mac, nil, "").Code)
+
+	resp = request(http.MethodGet, "/register/"+mac, bearer(registration.Key), "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&registration))
+	assert.Equal(t, machinemodel.MachineApproved, registration.Status)
+
+	resp = register(token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	registration = machinemodel.Registration{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&registration))
+	assert.Equal(t, machinemodel.MachineApproved, registration.Status)
+	assert.Empty(t, registration.Key)
+
+	// Rejected machines boot from their disk for good
+	const rejected = "52:54:00:00:00:03"
+	assert.Equal(t, http.StatusCreated,
+		request(http.MethodPost, "/register/"+rejected, bearer(token), `{"Architecture": "x86_64"}`).Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/machine/"+rejected+"/reject", system, "").Code)
+	assert.Equal(t, actionLocal, s.api.decide(rejected, "efi", "10.0.0.1").Action)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/v1/boot/"+rejected, nil, "").Code)
+	assert.Equal(t, []string{rejected + " rejected"}, listed(system, "/machines?status=rejected"))
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplaceVersionContent replaces the file of a version with the body of the request, keeping its number, so the
+// boot setups which pin a corrupt version flash the repaired one. The SHA-256 of the body has to be given in the
+// X-BAAS-SHA256 header. The file is written next to the old one and renamed over it, downloads which already opened
+// the old file finish reading it.
+// Example request: PUT /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/versions/3/content
+//
+//	-H "X-BAAS-SHA256: 9f86d0..." --data-binary @repaired.img
+//
+// Example response: {"Version": 3, "ImageModelUUID": "57bf0cd3-...", "Size": 10737418240, "SHA256": "9f86d0...", ...}
+func (api_ *API) ReplaceVersionContent(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findImage(w, r)
+	if err != nil {
+		return
+	}
+
+	number, err := strconv.ParseUint(mux.Vars(r)["version"], 10, 64)
+	if err != nil || image.FindVersion(number) == nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	expected := strings.ToLower(r.Header.Get("X-BAAS-SHA256"))
+	if expected == "" {
+		http.Error(w, "The X-BAAS-SHA256 header with the checksum of the replacement is required",
+			http.StatusBadRequest)
+		return
+	}
+
+	done, ok := api_.admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+	defer release()
+
+	path := api_.versionFile(image, number)
+	dest, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if ErrorWrite(w, err, "Cannot open the replacement file") != nil {
+		return
+	}
+
+	hash := sha256.New()
+	_, err = fs.Copy(io.MultiWriter(dest, hash), r.Body)
+	size := uploadedSize(image, dest, r.Header.Get("X-BAAS-ImageSize"))
+
+	if cerr := dest.Close(); cerr != nil {
+		requestLog(r).Errorf("Cannot close the replacement file: %v", cerr)
+	}
+
+	// The old file stays until the replacement is known to be good
+	discard := func() {
+		if rerr := os.Remove(dest.Name()); rerr != nil {
+			requestLog(r).Warnf("Cannot remove the rejected replacement %s: %v", dest.Name(), rerr)
+		}
+	}
+
+	if ErrorWrite(w, err, "Cannot copy over the contents of the file") != nil {
+		discard()
+		return
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != expected {
+		discard()
+		writeJSON(w, http.StatusUnprocessableEntity, checksumError{
+			Error:    "the checksum of the replacement does not match",
+			Expected: expected,
+			Actual:   checksum,
+		})
+		return
+	}
+
+	format, err := detectFileFormat(dest.Name(), image)
+	if ErrorWrite(w, err, "Cannot detect the format of the replacement") != nil {
+		discard()
+		return
+	}
+
+	old := image.FindVersion(number).SHA256
+	if ErrorWrite(w, os.Rename(dest.Name(), path), "Cannot store the replacement file") != nil {
+		discard()
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"audit":      "version-replaced",
+		"image":      image.UUID,
+		"version":    number,
+		"old_sha256": old,
+		"new_sha256": checksum,
+	}).Warnf("%s replaced the file of version %d of image %s", api_.requester(r), number, image.UUID)
+
+	if err = api_.storeFor(r).SetVersionSize(image.UUID, number, size); err != nil {
+		requestLog(r).Warnf("Cannot store the size of version %d: %v", number, err)
+	}
+
+	if err = api_.storeFor(r).SetVersionChecksum(image.UUID, number, checksum); err != nil {
+		requestLog(r).Warnf("Cannot store the checksum of version %d: %v", number, err)
+	}
+
+	if err = api_.storeFor(r).SetVersionFormat(image.UUID, number, format); err != nil {
+		requestLog(r).Warnf("Cannot store the format of version %d: %v", number, err)
+	}
+
+	// The replacement matches the checksum it was given, whatever the scrubber found wrong with the old file
+	if err = api_.storeFor(r).SetVersionCorrupt(image.UUID, number, false); err != nil {
+		requestLog(r).Warnf("Cannot mark version %d intact: %v", number, err)
+	}
+
+	if latest := image.Versions[len(image.Versions)-1]; latest.Version == number {
+		api_.recordDiskUUID(r, image, path, format, false)
+	}
+
+	image, err = api_.storeFor(r).GetImageByUUID(image.UUID)
+	if ErrorWrite(w, err, "Cannot fetch the replaced version") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewImageVersion(image.FindVersion(number)))
+}
+
+// RegisterVersionContentHandlers sets the metadata for the route which replaces the file of a version
+func (api_ *API) RegisterVersionContentHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions/{version}/content",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.ReplaceVersionContent,
+		Method:      http.MethodPut,
+		Schema:      schemaFile,
+		Description: "Replaces the file of a version, keeping its number",
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ReplaceVersionContent(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	owner := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, owner} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	diskpath, err := ioutil.TempDir("", "replace")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "course", Username: "alice", UUID: "course"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "course"}))
+	assert.NoError(t, store.SetVersionCorrupt("course", 1, true))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	path := s.api.versionFile(&image, 1)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("the rotten disk"), 0644))
+
+	replace := func(as *user.UserModel, version string, body string, checksum string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/image/course/versions/"+version+"/content",
+			strings.NewReader(body))
+		s.login(req, as)
+		if checksum != "" {
+			req.Header.Set("X-BAAS-SHA256", checksum)
+		}
+		return s.serve(req)
+	}
+
+	sum := sha256.Sum256([]byte("the repaired disk"))
+	checksum := hex.EncodeToString(sum[:])
+
+	// Only administrators replace files, and only with the checksum of the replacement
+	assert.Equal(t, http.StatusForbidden, replace(owner, "1", "the repaired disk", checksum).Code)
+	assert.Equal(t, http.StatusBadRequest, replace(admin, "1", "the repaired disk", "").Code)
+
+	resp := replace(admin, "1", "the repaired disk?", checksum)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "the rotten disk", string(content))
+
+	// A download which opened the old file keeps reading it
+	download, err := os.Open(path)
+	assert.NoError(t, err)
+	defer download.Close()
+
+	resp = replace(admin, "1", "the repaired disk", checksum)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var version types.ImageVersion
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&version))
+	assert.Equal(t, checksum, version.SHA256)
+	assert.Equal(t, uint64(len("the repaired disk")), version.Size)
+
+	content, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "the repaired disk", string(content))
+	content, err = ioutil.ReadAll(download)
+	assert.NoError(t, err)
+	assert.Equal(t, "the rotten disk", string(content))
+
+	stored, err := store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	assert.False(t, stored.FindVersion(1).Corrupt)
+	assert.Equal(t, checksum, stored.FindVersion(1).SHA256)
+
+	// Nothing of the rejected replacement is left behind
+	parts, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.part"))
+	assert.NoError(t, err)
+	assert.Empty(t, parts)
+
+	assert.Equal(t, http.StatusNotFound, replace(admin, "7", "the repaired disk", checksum).Code)
+}
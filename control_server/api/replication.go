@@ -0,0 +1,468 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/replication"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// replicaPrincipal is the name of the machine principal a replica fetches the changes and the image files as. It
+// may only read.
+const replicaPrincipal = "replica"
+
+const (
+	// replicationBatch is how many changes a replica fetches at once, and the most the primary hands out
+	replicationBatch = 500
+	// replicationRequestTimeout bounds the requests for changes, the downloads of image files may take longer
+	replicationRequestTimeout = time.Minute
+)
+
+var (
+	replicationLag = metrics.NewGauge("baas_replication_lag_seconds",
+		"How long ago the replica last caught up with all changes and image files of its primary.")
+	replicationMissingFiles = metrics.NewGauge("baas_replication_missing_files",
+		"Image files the replica could not download from its primary in its last pull.")
+)
+
+// errVersionGone is returned for a version whose file the primary no longer serves
+var errVersionGone = errors.New("the primary does not serve the version")
+
+// replicaState is what the API knows of the replication of a standby control server
+type replicaState struct {
+	// readOnly is set while the database is a replica of another control server
+	readOnly int32
+
+	lock    sync.Mutex
+	missing int
+}
+
+// active reports whether the database is a replica, which only serves reads
+func (r *replicaState) active() bool {
+	return atomic.LoadInt32(&r.readOnly) == 1
+}
+
+// replicationChanges is the response to a request for the changes since a cursor
+type replicationChanges struct {
+	Changes []replication.Change
+	// Cursor is what the replica asks for the next changes with, More tells whether there are more already
+	Cursor uint64
+	More   bool
+}
+
+// readiness is the response of /readyz
+type readiness struct {
+	Ready   bool
+	Replica bool
+	// LagSeconds is how long ago the replica last caught up, MissingFiles the image files it could not download
+	LagSeconds   float64 `json:",omitempty"`
+	MissingFiles int     `json:",omitempty"`
+}
+
+// replicaToken reports whether the request carries the ReplicationToken of this control server
+func (api_ *API) replicaToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return api_.config.ReplicationToken != "" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(api_.config.ReplicationToken)) == 1
+}
+
+// readOnlyMethod reports whether requests with the method leave the data as it is
+func readOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// readOnlyReplica refuses the requests which would change something while the database is a replica, the changes
+// would be lost with the next ones of the primary
+func (api_ *API) readOnlyReplica(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api_.replica.active() && !readOnlyMethod(r.Method) {
+			http.Error(w, "read-only replica", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetReplicationChanges hands a replica the rows which changed after the sequence number since, at most limit and
+// oldest first. Every row is only sent once in its latest state, deleted rows come without their columns. The
+// replica asks again with the Cursor of the response until More is false.
+// Example request: GET /admin/replication/changes?since=1042&limit=500
+// Example response: {"Changes": [{"Seq": 1043, "Table": "user_models", "Key": {"username": "jan"},
+//
+//	"Row": {"username": "jan", "name": "Jan", ...}}], "Cursor": 1043, "More": false}
+func (api_ *API) GetReplicationChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+	if query.Get("since") != "" && err != nil {
+		http.Error(w, "The cursor in ?since= has to be a number", http.StatusBadRequest)
+		return
+	}
+
+	limit := replicationBatch
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > replicationBatch {
+			http.Error(w, fmt.Sprintf("The limit has to be between 1 and %d", replicationBatch), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := api_.storeFor(r).GetReplicationChanges(since, limit)
+	if ErrorWrite(w, err, "Cannot fetch the changes") != nil {
+		return
+	}
+
+	response := replicationChanges{Changes: changes, Cursor: since, More: len(changes) == limit}
+	if len(changes) != 0 {
+		response.Cursor = changes[len(changes)-1].Seq
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// GetReadiness tells a load balancer whether to send requests to this control server. A primary always is, a
+// replica once it caught up with its primary within ReplicationMaxLagSeconds. It is answered without a login.
+// Example request: GET /readyz
+// Example response: {"Ready": false, "Replica": true, "LagSeconds": 912.4, "MissingFiles": 2}
+func (api_ *API) GetReadiness(w http.ResponseWriter, _ *http.Request) {
+	if !api_.replica.active() {
+		writeJSON(w, http.StatusOK, readiness{Ready: true})
+		return
+	}
+
+	state, err := api_.store.GetReplicationState()
+	if err != nil {
+		log.Errorf("Cannot fetch the state of the replica: %v", err)
+		writeJSON(w, http.StatusServiceUnavailable, readiness{Replica: true})
+		return
+	}
+
+	api_.replica.lock.Lock()
+	missing := api_.replica.missing
+	api_.replica.lock.Unlock()
+
+	// A replica which never caught up has no lag to tell
+	response := readiness{Replica: true, MissingFiles: missing}
+	if state.SyncedAt.IsZero() {
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	lag := time.Since(state.SyncedAt)
+	replicationLag.Set(lag.Seconds())
+	response.LagSeconds = lag.Seconds()
+	response.Ready = lag <= time.Duration(api_.config.ReplicationMaxLagSeconds)*time.Second
+
+	status := http.StatusOK
+	if !response.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, response)
+}
+
+// fromPrimary sends a request to the primary with the ReplicationToken
+func (api_ *API) fromPrimary(ctx context.Context, primary string, path string,
+	header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(primary, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+api_.config.ReplicationToken)
+
+	return http.DefaultClient.Do(req)
+}
+
+// pullBatch applies the next batch of changes of the primary after cursor. It returns the cursor after them and
+// whether the primary has more.
+func (api_ *API) pullBatch(ctx context.Context, primary string, cursor uint64) (uint64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, replicationRequestTimeout)
+	defer cancel()
+
+	resp, err := api_.fromPrimary(ctx, primary,
+		fmt.Sprintf("/admin/replication/changes?since=%d&limit=%d", cursor, replicationBatch), nil)
+	if err != nil {
+		return cursor, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return cursor, false, fmt.Errorf("the primary answered %s: %s", resp.Status,
+			strings.TrimSpace(string(message)))
+	}
+
+	// Keep the numbers as they were sent, JSON would round the large ones to floats
+	var changes replicationChanges
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err = decoder.Decode(&changes); err != nil {
+		return cursor, false, err
+	}
+
+	if len(changes.Changes) == 0 {
+		return cursor, false, nil
+	}
+
+	if err = api_.store.ApplyReplicationChanges(changes.Changes, changes.Cursor); err != nil {
+		return cursor, false, err
+	}
+
+	log.Debugf("Applied %d changes of the primary, up to %d", len(changes.Changes), changes.Cursor)
+	return changes.Cursor, changes.More, nil
+}
+
+// pullChanges applies the changes of the primary after the cursor of the replica, until there are no more
+func (api_ *API) pullChanges(ctx context.Context, state *replication.State) error {
+	cursor, more := state.Cursor, true
+	for more {
+		var err error
+		if cursor, more, err = api_.pullBatch(ctx, state.PrimaryURL, cursor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchVersion downloads the file of a version from the primary. The download goes to a partial file first, which
+// a later pull resumes with a range request rather than starting over. The file is only put in its place once it
+// matches its checksum.
+func (api_ *API) fetchVersion(ctx context.Context, primary string, image *images.ImageModel,
+	version images.Version) error {
+	path := api_.versionFile(image, version.Version)
+	partial := path + ".partial"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if offset != 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := api_.fromPrimary(ctx, primary, fmt.Sprintf("/image/%s/%d", image.UUID, version.Version), header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The primary sends the whole file, the partial one is of no use
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is whole already, only the checksum was not checked yet
+	case http.StatusNotFound:
+		return errVersionGone
+	default:
+		return fmt.Errorf("the primary answered %s", resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err = io.Copy(f, resp.Body); err != nil {
+			return err
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if version.SHA256 != "" {
+		sum, err := fileSHA256(partial)
+		if err != nil {
+			return err
+		}
+
+		if !strings.EqualFold(sum, version.SHA256) {
+			_ = os.Remove(partial)
+			return fmt.Errorf("the file has the checksum %s instead of %s", sum, version.SHA256)
+		}
+	}
+
+	return os.Rename(partial, path)
+}
+
+// fileSHA256 is the hex encoded checksum of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fetchVersions downloads the files of the versions the replica does not have yet and returns how many it could
+// not. The versions of images in the trash are not downloaded, nor the ones the primary no longer has.
+func (api_ *API) fetchVersions(ctx context.Context, primary string) (int, error) {
+	versions, err := api_.store.GetAllVersions()
+	if err != nil {
+		return 0, err
+	}
+
+	missing := 0
+	imagesByUUID := map[images.ImageUUID]*images.ImageModel{}
+	for _, version := range versions {
+		image, ok := imagesByUUID[version.ImageModelUUID]
+		if !ok {
+			image, err = api_.store.GetImageByUUID(version.ImageModelUUID)
+			if err != nil {
+				image = nil
+			}
+			imagesByUUID[version.ImageModelUUID] = image
+		}
+
+		if image == nil {
+			continue
+		}
+
+		if _, err = os.Stat(api_.versionFile(image, version.Version)); err == nil {
+			continue
+		}
+
+		err = api_.fetchVersion(ctx, primary, image, version)
+		if errors.Is(err, errVersionGone) {
+			log.Debugf("The primary has no file for version %d of %s", version.Version, image.UUID)
+		} else if err != nil {
+			log.Warnf("Cannot download version %d of %s from the primary: %v", version.Version, image.UUID, err)
+			missing++
+		}
+	}
+
+	return missing, nil
+}
+
+// replicationRound pulls the changes and the image files from the primary once. It reports whether the database
+// still is a replica, promoting it ends the replication.
+func (api_ *API) replicationRound(ctx context.Context) (bool, error) {
+	state, err := api_.store.GetReplicationState()
+	if err != nil {
+		return true, err
+	}
+
+	if !state.Replica() {
+		atomic.StoreInt32(&api_.replica.readOnly, 0)
+		return false, nil
+	}
+
+	if err = api_.pullChanges(ctx, state); err != nil {
+		return true, fmt.Errorf("pull the changes: %w", err)
+	}
+
+	missing, err := api_.fetchVersions(ctx, state.PrimaryURL)
+	if err != nil {
+		return true, fmt.Errorf("download the image files: %w", err)
+	}
+
+	api_.replica.lock.Lock()
+	api_.replica.missing = missing
+	api_.replica.lock.Unlock()
+	replicationMissingFiles.Set(float64(missing))
+
+	if missing == 0 {
+		state.SyncedAt = time.Now()
+		if err = api_.store.SetReplicationSynced(state.SyncedAt); err != nil {
+			return true, err
+		}
+	}
+
+	if !state.SyncedAt.IsZero() {
+		replicationLag.Set(time.Since(state.SyncedAt).Seconds())
+	}
+
+	return true, nil
+}
+
+// startReplication keeps the replica in step with its primary until it is promoted, then it runs promoted
+func (api_ *API) startReplication(promoted func()) {
+	interval := time.Duration(api_.config.ReplicationIntervalSeconds) * time.Second
+
+	go func() {
+		for {
+			replica, err := api_.replicationRound(context.Background())
+			if err != nil {
+				log.Errorf("Replication: %v", err)
+			} else if !replica {
+				log.Info("The replica was promoted, it accepts changes from now on")
+				promoted()
+				return
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// RegisterReplicationHandlers sets the metadata for each of the routes and registers them to the global handler.
+// A database which is a replica only serves reads from the start.
+func (api_ *API) RegisterReplicationHandlers() {
+	if state, err := api_.store.GetReplicationState(); err != nil {
+		log.Errorf("Cannot tell whether the database is a replica: %v", err)
+	} else if state.Replica() {
+		atomic.StoreInt32(&api_.replica.readOnly, 1)
+	}
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/replication/changes",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetReplicationChanges,
+		Method:      http.MethodGet,
+		Description: "Gets the rows which changed since a cursor, for a replica",
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Replication(t *testing.T) {
+	primaryDisks, err := ioutil.TempDir("", "primary")
+	assert.NoError(t, err)
+	defer os.RemoveAll(primaryDisks)
+	replicaDisks, err := ioutil.TempDir("", "replica")
+	assert.NoError(t, err)
+	defer os.RemoveAll(replicaDisks)
+
+	conf := config.Default()
+	conf.ReplicationToken = "secret"
+
+	// The primary has an image with a version on disk
+	primaryStore := newTestStore(t)
+	jan := &user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}
+	assert.NoError(t, primaryStore.CreateUser(jan))
+	content := bytes.Repeat([]byte("ubuntu"), 1000)
+	sum := sha256.Sum256(content)
+	assert.NoError(t, primaryStore.CreateImage(&images.ImageModel{Name: "ubuntu", Username: "jan", UUID: "ubuntu",
+		Versions: []images.Version{{Version: 1, ImageModelUUID: "ubuntu", SHA256: hex.EncodeToString(sum[:])}}}))
+	assert.NoError(t, os.MkdirAll(filepath.Join(primaryDisks, "ubuntu"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(primaryDisks, "ubuntu", "1.img"), content, 0644))
+
+	primary := newTestServer(t, primaryStore, primaryDisks, conf)
+	server := httptest.NewServer(primary.handler)
+	defer server.Close()
+
+	replicaStore := newTestStore(t)
+	assert.NoError(t, replicaStore.SetReplicaOf(server.URL))
+	replica := newTestServer(t, replicaStore, replicaDisks, conf)
+
+	// The primary is asked with the token of the replica, the replica is asked without logging in
+	pull := func(token string, method string, uri string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return primary.serve(req)
+	}
+	request := func(method string, uri string, body string) *httptest.ResponseRecorder {
+		return replica.serve(httptest.NewRequest(method, uri, strings.NewReader(body)))
+	}
+
+	// Only the token of the replica reads the changes, and it cannot change anything
+	assert.Equal(t, http.StatusOK,
+		pull("secret", http.MethodGet, "/admin/replication/changes?since=0", nil, "").Code)
+	assert.NotEqual(t, http.StatusOK,
+		pull("wrong", http.MethodGet, "/admin/replication/changes?since=0", nil, "").Code)
+	assert.Equal(t, http.StatusBadRequest,
+		pull("secret", http.MethodGet, "/admin/replication/changes?limit=0", nil, "").Code)
+	assert.Equal(t, http.StatusForbidden,
+		pull("secret", http.MethodPut, "/user/jan", nil, `{"Name": "Jan"}`).Code)
+
+	// Downloads resume where they stopped
+	resp := pull("secret", http.MethodGet, "/image/ubuntu/1", http.Header{"Range": {"bytes=6-11"}}, "")
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "ubuntu", resp.Body.String())
+
+	// The replica does not take changes and is not ready before it caught up
+	resp = request(http.MethodPost, "/user/jan/image", "{}")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Equal(t, "read-only replica\n", resp.Body.String())
+	resp = request(http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.JSONEq(t, `{"Ready": false, "Replica": true}`, resp.Body.String())
+
+	// A download which broke off earlier is resumed
+	assert.NoError(t, os.MkdirAll(filepath.Join(replicaDisks, "ubuntu"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(replicaDisks, "ubuntu", "1.img.partial"), content[:100], 0644))
+
+	stillReplica, err := replica.api.replicationRound(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, stillReplica)
+
+	image, err := replicaStore.GetImageByUUID("ubuntu")
+	assert.NoError(t, err)
+	assert.Equal(t, "jan", image.Username)
+	copied, err := ioutil.ReadFile(filepath.Join(replicaDisks, "ubuntu", "1.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, copied)
+	assert.Equal(t, float64(0), replicationMissingFiles.Value())
+
+	resp = request(http.MethodGet, "/readyz", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var ready readiness
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&ready))
+	assert.True(t, ready.Ready)
+
+	// Changes on the primary arrive with the next pull
+	jan.Name = "Jan"
+	assert.NoError(t, primaryStore.ModifyUser(jan))
+	_, err = replica.api.replicationRound(context.Background())
+	assert.NoError(t, err)
+	copiedUser, err := replicaStore.GetUserByUsername("jan")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jan", copiedUser.Name)
+
+	// Once promoted the replica stops pulling and takes changes
+	assert.NoError(t, replicaStore.PromoteReplica())
+	stillReplica, err = replica.api.replicationRound(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, stillReplica)
+	assert.False(t, replica.api.replica.active())
+	resp = request(http.MethodGet, "/readyz", "")
+	assert.JSONEq(t, `{"Ready": true, "Replica": false}`, resp.Body.String())
+
+	resp = replica.requestAs(copiedUser, http.MethodPut, "/user/jan", `{"Name": "Jan de Vries"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// usageCacheSize is the number of usage reports kept, the oldest report makes way for a new one
+const usageCacheSize = 32
+
+// usageReport is what the courses or users used over a period, for charging them for it
+type usageReport struct {
+	From    time.Time
+	To      time.Time
+	GroupBy database.UsageGrouping
+	Groups  []database.Usage
+
+	GeneratedAt     time.Time
+	CacheAgeSeconds float64
+}
+
+// usageKey is the period and grouping a usage report is cached under
+type usageKey struct {
+	from    int64
+	to      int64
+	groupBy database.UsageGrouping
+}
+
+// usageCache keeps the usage reports per period. Periods which ended before their report was made do not change
+// any more and are kept until they make way, reports of a period which is not over yet age like the statistics.
+type usageCache struct {
+	mu      sync.Mutex
+	reports map[usageKey]*usageReport
+}
+
+// parseReportTime reads a bound of the period, either a day or a moment in RFC 3339
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// usagePeriod reads the period and the grouping of a usage report from the query
+func usagePeriod(r *http.Request) (usageKey, error) {
+	query := r.URL.Query()
+	from, err := parseReportTime(query.Get("from"))
+	if err != nil {
+		return usageKey{}, errors.New("from must be a day such as 2022-01-01 or a time in RFC 3339")
+	}
+
+	to, err := parseReportTime(query.Get("to"))
+	if err != nil {
+		return usageKey{}, errors.New("to must be a day such as 2022-04-01 or a time in RFC 3339")
+	}
+
+	if !from.Before(to) {
+		return usageKey{}, errors.New("from must come before to")
+	}
+
+	groupBy := database.UsageGrouping(query.Get("group_by"))
+	switch groupBy {
+	case "":
+		groupBy = database.UsageByCourse
+	case database.UsageByCourse, database.UsageByUser:
+	default:
+		return usageKey{}, fmt.Errorf("cannot group by %q, group by course or user", groupBy)
+	}
+
+	return usageKey{from: from.Unix(), to: to.Unix(), groupBy: groupBy}, nil
+}
+
+// usage returns the cached report of a period, or adds up the usage again when there is none or it is outdated
+func (api_ *API) usage(key usageKey) (*usageReport, error) {
+	api_.reports.mu.Lock()
+	defer api_.reports.mu.Unlock()
+
+	maxAge := time.Duration(api_.config.StatsCacheSeconds) * time.Second
+	report := api_.reports.reports[key]
+	if report == nil || (report.GeneratedAt.Unix() < key.to && time.Since(report.GeneratedAt) >= maxAge) {
+		from, to := time.Unix(key.from, 0).UTC(), time.Unix(key.to, 0).UTC()
+		groups, err := api_.store.GetUsage(from, to, key.groupBy)
+		if err != nil {
+			return nil, err
+		}
+
+		report = &usageReport{From: from, To: to, GroupBy: key.groupBy, Groups: groups, GeneratedAt: time.Now()}
+		api_.reports.store(key, report)
+	}
+
+	cached := *report
+	cached.CacheAgeSeconds = time.Since(cached.GeneratedAt).Seconds()
+	return &cached, nil
+}
+
+// store keeps a report, when the cache is full the report made the longest ago goes
+func (c *usageCache) store(key usageKey, report *usageReport) {
+	if c.reports == nil {
+		c.reports = map[usageKey]*usageReport{}
+	}
+
+	if _, ok := c.reports[key]; !ok && len(c.reports) >= usageCacheSize {
+		var oldest *usageKey
+		for found, cached := range c.reports {
+			if oldest == nil || cached.GeneratedAt.Before(c.reports[*oldest].GeneratedAt) {
+				found := found
+				oldest = &found
+			}
+		}
+		delete(c.reports, *oldest)
+	}
+
+	c.reports[key] = report
+}
+
+// usageCSVHeader names the columns of the CSV export of a usage report
+var usageCSVHeader = []string{"group", "machine_hours", "flashes", "storage_bytes"}
+
+// writeUsageCSV writes the usage of every group as a CSV file
+func writeUsageCSV(w http.ResponseWriter, report *usageReport) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`,
+		report.From.Format("2006-01-02"), report.To.Format("2006-01-02")))
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(usageCSVHeader); err != nil {
+		return err
+	}
+
+	for _, group := range report.Groups {
+		err := writer.Write([]string{group.Group, strconv.FormatFloat(group.MachineHours, 'f', 2, 64),
+			strconv.FormatInt(group.Flashes, 10), strconv.FormatUint(group.StorageBytes, 10)})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// GetUsageReport adds up the machine hours, flashes and storage of every course or user between ?from= and ?to=,
+// which are days or times in RFC 3339. Boots count towards the courses their user is a member of, storage towards
+// the course the images are labelled with. With ?group_by=user they count towards the owners instead, with
+// ?format=csv the report is exported as a CSV file.
+// Example request: GET /admin/reports/usage?from=2022-01-01&to=2022-04-01&group_by=course
+// Example response: {"From": "2022-01-01T00:00:00Z", "To": "2022-04-01T00:00:00Z", "GroupBy": "course",
+//
+//	"Groups": [{"Group": "os-2022", "MachineHours": 412.5, "Flashes": 830, "StorageBytes": 107374182400}, ...],
+//	"GeneratedAt": "2022-04-02T09:00:00Z", "CacheAgeSeconds": 3.2}
+func (api_ *API) GetUsageReport(w http.ResponseWriter, r *http.Request) {
+	key, err := usagePeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "the format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	report, err := api_.usage(key)
+	if ErrorWrite(w, err, "Cannot add up the usage") != nil {
+		return
+	}
+
+	if format == "csv" {
+		if err = writeUsageCSV(w, report); err != nil {
+			requestLog(r).Warnf("Cannot write the usage report: %v", err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// RegisterReportHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterReportHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/reports/usage",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetUsageReport,
+		Method:      http.MethodGet,
+		Description: "Gets the machine hours, flashes and storage of the courses or users over a period",
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_UsageReport(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	jan := &user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}
+	piet := &user.UserModel{Username: "piet", Email: "piet@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, jan, piet} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	for _, name := range []string{"os-2022", "net-2022"} {
+		assert.NoError(t, store.CreateCourse(&course.CourseModel{Name: name, Owner: "admin",
+			ExpiresAt: time.Now().Add(time.Hour)}))
+	}
+	assert.NoError(t, store.AddCourseMember("os-2022", "jan"))
+	assert.NoError(t, store.AddCourseMember("os-2022", "piet"))
+	assert.NoError(t, store.AddCourseMember("net-2022", "piet"))
+
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, store.CreateImageSetup("jan", &images.ImageSetup{Name: "jan", UUID: "jan", Username: "jan"}))
+	assert.NoError(t, store.CreateImageSetup("piet", &images.ImageSetup{Name: "piet", UUID: "piet",
+		Username: "piet"}))
+
+	// The timestamps are written in the local time of the server, like those of the boots themselves
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		assert.NoError(t, err)
+		return parsed.Local()
+	}
+
+	boot := func(setup images.ImageUUID, claimed string, finished string) {
+		history := images.BootHistory{MachineMAC: "abc", SetupUUID: setup, CreatedAt: at(claimed)}
+		if finished != "" {
+			end := at(finished)
+			history.FinishedAt = &end
+		}
+		assert.NoError(t, store.AddBootHistory(&history))
+	}
+
+	boot("jan", "2022-02-01T10:00:00Z", "2022-02-01T12:00:00Z")
+	// Boots reaching over the ends of the period count for the time within it
+	boot("jan", "2021-12-31T23:00:00Z", "2022-01-01T01:00:00Z")
+	boot("jan", "2022-03-31T23:30:00Z", "2022-04-01T00:30:00Z")
+	boot("jan", "2022-05-01T10:00:00Z", "2022-05-01T12:00:00Z")
+	// Boots recorded before their end was kept are flashes without any time
+	boot("jan", "2022-02-02T10:00:00Z", "")
+	boot("piet", "2022-02-10T08:00:00Z", "2022-02-10T09:00:00Z")
+
+	version := func(image images.ImageUUID, number uint64, size uint64, created string) {
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: number, ImageModelUUID: image,
+			Size: size, Model: gorm.Model{CreatedAt: at(created)}}))
+	}
+
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "disk", Username: "jan", UUID: "disk",
+		Course: "os-2022"}))
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "own", Username: "piet", UUID: "own"}))
+	version("disk", 1, 100, "2021-06-01T00:00:00Z")
+	version("disk", 2, 50, "2022-05-01T00:00:00Z")
+	version("own", 1, 10, "2022-01-10T00:00:00Z")
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	request := func(as *user.UserModel, query string) *httptest.ResponseRecorder {
+		return s.requestAs(as, http.MethodGet, "/admin/reports/usage?"+query, "")
+	}
+
+	report := func(query string) map[string]database.Usage {
+		resp := request(admin, query)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var found usageReport
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+		groups := map[string]database.Usage{}
+		for _, group := range found.Groups {
+			groups[group.Group] = group
+		}
+		return groups
+	}
+
+	courses := report("from=2022-01-01&to=2022-04-01&group_by=course")
+	assert.Len(t, courses, 2)
+	assert.InDelta(t, 4.5, courses["os-2022"].MachineHours, 0.001)
+	assert.Equal(t, int64(4), courses["os-2022"].Flashes)
+	assert.Equal(t, uint64(100), courses["os-2022"].StorageBytes)
+	assert.InDelta(t, 1, courses["net-2022"].MachineHours, 0.001)
+	assert.Equal(t, int64(1), courses["net-2022"].Flashes)
+	assert.Zero(t, courses["net-2022"].StorageBytes)
+
+	users := report("from=2022-01-01&to=2022-04-01&group_by=user")
+	assert.InDelta(t, 3.5, users["jan"].MachineHours, 0.001)
+	assert.Equal(t, int64(3), users["jan"].Flashes)
+	assert.Equal(t, uint64(100), users["jan"].StorageBytes)
+	assert.Equal(t, uint64(10), users["piet"].StorageBytes)
+
+	// The period is over, boots recorded afterwards do not change its cached report
+	boot("piet", "2022-02-11T08:00:00Z", "2022-02-11T09:00:00Z")
+	assert.Equal(t, int64(1), report("from=2022-01-01&to=2022-04-01&group_by=user")["piet"].Flashes)
+	assert.Equal(t, int64(2), report("from=2022-01-01T00:00:00Z&to=2022-04-02T00:00:00Z&group_by=user")["piet"].Flashes)
+
+	resp := request(admin, "from=2022-01-01&to=2022-04-01&format=csv")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "group,machine_hours,flashes,storage_bytes\nnet-2022,1.00,1,0\nos-2022,4.50,4,100\n",
+		resp.Body.String())
+
+	assert.Equal(t, http.StatusForbidden, request(jan, "from=2022-01-01&to=2022-04-01").Code)
+	assert.Equal(t, http.StatusBadRequest, request(admin, "to=2022-04-01").Code)
+	assert.Equal(t, http.StatusBadRequest, request(admin, "from=2022-04-01&to=2022-01-01").Code)
+	assert.Equal(t, http.StatusBadRequest, request(admin, "from=2022-01-01&to=2022-04-01&group_by=machine").Code)
+	assert.Equal(t, http.StatusBadRequest, request(admin, "from=2022-01-01&to=2022-04-01&format=xml").Code)
+}
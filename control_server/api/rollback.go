@@ -0,0 +1,109 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/limits"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// rolledBack is the version a rollback created, and how its file was copied
+type rolledBack struct {
+	types.ImageVersion
+	Mechanism storage.Mechanism
+}
+
+// RollbackVersion makes a copy of an older version the latest version of the image, the versions in between are
+// kept. On filesystems with reflinks the copy shares the blocks of the old version and takes no time, on others the
+// file is copied.
+// Example request: POST /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/versions/3/rollback
+// Example response: {"Version": 8, "ImageModelUUID": "57bf0cd3-...", "Size": 42949672960, "SHA256": "9f86d0...",
+// ..., "Mechanism": "reflink"}
+func (api_ *API) RollbackVersion(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.checkUserImage(w, r)
+	if err != nil {
+		return
+	}
+
+	number, err := strconv.ParseUint(mux.Vars(r)["version"], 10, 64)
+	source := image.FindVersion(number)
+	if err != nil || source == nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	if source.Corrupt {
+		http.Error(w, "The version is corrupt, it cannot be rolled back to", http.StatusUnprocessableEntity)
+		return
+	}
+
+	release, ok := api_.beginWrite(w, image)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !api_.checkLimits(w, image.Username, limits.CreateVersion(image.UUID)) ||
+		!api_.checkLimits(w, image.Username, limits.StoreBytes(source.Size, 0)) {
+		return
+	}
+
+	version := images.Version{ImageModelUUID: image.UUID, Size: source.Size, SHA256: source.SHA256,
+		Format: source.Format, BootKeyID: source.BootKeyID}
+	if n := len(image.Versions); n != 0 {
+		version.Version = image.Versions[n-1].Version + 1
+	}
+
+	// The copy only gets the name of the new version once it is complete
+	path := api_.versionFile(image, version.Version)
+	mechanism, err := storage.CloneFile(api_.versionFile(image, number), path+".part")
+	if ErrorWrite(w, err, "Cannot copy the file of the version") != nil {
+		return
+	}
+
+	if ErrorWrite(w, os.Rename(path+".part", path), "Cannot store the copy of the version") != nil {
+		api_.discardUpload(r, path+".part", image.UUID, false)
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).CreateNewImageVersion(version), "Cannot create the version") != nil {
+		api_.discardUpload(r, path, image.UUID, false)
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"image":     image.UUID,
+		"from":      number,
+		"version":   version.Version,
+		"mechanism": mechanism,
+	}).Infof("%s rolled image %s back to version %d", api_.requester(r), image.UUID, number)
+	api_.imageEvent(image, images.WebhookVersionCreated, &version.Version)
+
+	writeJSON(w, http.StatusCreated, rolledBack{ImageVersion: types.NewImageVersion(&version), Mechanism: mechanism})
+}
+
+// RegisterRollbackHandlers sets the metadata for the route which rolls an image back to an older version
+func (api_ *API) RegisterRollbackHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/versions/{version}/rollback",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.RollbackVersion,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Makes a copy of an older version the latest version of the image",
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_RollbackVersion(t *testing.T) {
+	store := newTestStore(t)
+
+	owner := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	other := &user.UserModel{Username: "bob", Email: "bob@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{owner, other} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	diskpath, err := ioutil.TempDir("", "rollback")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	image := images.ImageModel{Name: "course", Username: "alice", UUID: "course"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "course", Size: 13,
+		SHA256: "9f86d0", Format: images.FormatRaw}))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 2, ImageModelUUID: "course"}))
+	assert.NoError(t, store.SetVersionCorrupt("course", 2, true))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	assert.NoError(t, os.MkdirAll(diskpath+"/course", os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(s.api.versionFile(&image, 1), []byte("the good disk"), 0644))
+	assert.NoError(t, ioutil.WriteFile(s.api.versionFile(&image, 2), []byte("the bad disk"), 0644))
+
+	rollback := func(as *user.UserModel, version string) *httptest.ResponseRecorder {
+		return s.requestAs(as, http.MethodPost, "/image/course/versions/"+version+"/rollback", "")
+	}
+
+	assert.Equal(t, http.StatusForbidden, rollback(other, "1").Code)
+	assert.Equal(t, http.StatusNotFound, rollback(owner, "7").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, rollback(owner, "2").Code)
+
+	resp := rollback(owner, "1")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var created rolledBack
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, uint64(3), created.Version)
+	assert.Equal(t, "9f86d0", created.SHA256)
+	assert.Equal(t, storage.Detect(diskpath+"/course").Reflink, created.Mechanism == storage.Reflink)
+
+	// The copy is the latest version, the versions in between are kept
+	content, err := ioutil.ReadFile(s.api.versionFile(&image, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, "the good disk", string(content))
+
+	found, err := store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	assert.Len(t, found.Versions, 4)
+	assert.Equal(t, uint64(3), found.LatestVersion().Version)
+	assert.Equal(t, uint64(13), found.LatestVersion().Size)
+	assert.Equal(t, images.FormatRaw, found.LatestVersion().Format)
+
+	_, err = os.Stat(s.api.versionFile(&image, 3) + ".part")
+	assert.True(t, os.IsNotExist(err))
+}
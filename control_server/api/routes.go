@@ -5,9 +5,14 @@
 package api
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/directory"
 	"github.com/baas-project/baas/pkg/model/user"
 
 	"github.com/baas-project/baas/pkg/database"
@@ -17,78 +22,326 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Audience tells who calls a route. When the agents have a listener of their own, it only serves the routes of the
+// agents and the primary listener the others. The routes for everyone are served on both.
+type Audience string
+
+const (
+	// AudienceUsers routes are called by users, their scripts and the web interface, which routes are unless they
+	// say otherwise
+	AudienceUsers Audience = ""
+	// AudienceAgents routes are only called by the management OS and by the machines and services they boot with
+	AudienceAgents Audience = "agents"
+	// AudienceEveryone routes are called by both, such as the image downloads
+	AudienceEveryone Audience = "everyone"
+)
+
 // Route stores the data about each of the routes and any related metadata.
 type Route struct {
 	URI         string
 	Permissions []user.UserRole
 	UserAllowed bool
-	Handler     func(w http.ResponseWriter, r *http.Request)
-	Method      string
+	// Audience decides which listener serves the route when the agents have a listener of their own
+	Audience Audience
+	// AnonymousAllowed lets visitors without a session use this route when anonymous access is enabled in the
+	// configuration. Only GET routes may set this, since anonymous visitors should never change anything.
+	AnonymousAllowed bool
+	// Quiet routes are called by machines all the time, their requests are only logged at debug level
+	Quiet bool
+	// ModeratorScoped routes let moderators who are scoped to courses through, the handler limits what they get to
+	// their courses. On other routes the moderator powers of scoped moderators only apply to the members.
+	ModeratorScoped bool
+	// Idempotent routes replay their first response to retries which carry the same Idempotency-Key header
+	Idempotent bool
+	// Scope is what a scoped token needs to use the route. Every route names one, routes which fit no other scope
+	// and those only administrators may use need the admin scope.
+	Scope user.TokenScope
+	// Timeout bounds how long the handler may take before the request is answered with 504, routes which leave it
+	// zero take RequestTimeoutSeconds. Routes which stream files set NoTimeout.
+	Timeout time.Duration
+
+	Handler func(w http.ResponseWriter, r *http.Request)
+	Method  string
+
+	// Schema names the entry of requestSchemas which describes the body, every POST and PUT route has one. JSON
+	// bodies are validated against it before the handler reads them.
+	Schema string
 
 	// Cute little feature
 	Description string
 }
 
-func getHandler(machineStore database.Store, staticDir string, diskpath string) http.Handler {
+// checkAnonymous guards against routes which are accessible anonymously by accident
+func (route *Route) checkAnonymous() error {
+	for _, role := range route.Permissions {
+		if role == user.Anonymous {
+			return fmt.Errorf("route %s %s lists the anonymous role, use AnonymousAllowed instead", route.Method, route.URI)
+		}
+	}
+
+	if route.AnonymousAllowed && route.Method != http.MethodGet {
+		return fmt.Errorf("route %s %s modifies data and cannot allow anonymous access", route.Method, route.URI)
+	}
+
+	return nil
+}
+
+func getHandler(machineStore database.Store, staticDir string, diskpath string, conf *config.Config) http.Handler {
 	// API for communicating with the management os
-	api := NewAPI(machineStore, diskpath)
+	return newRouter(NewAPI(machineStore, diskpath, conf), staticDir)
+}
+
+// NewHandler serves the API like StartServer does, without listening or starting the background jobs. It lets the
+// tests of other packages talk to a control server.
+func NewHandler(machineStore database.Store, staticDir string, diskpath string, conf *config.Config) http.Handler {
+	return getHandler(machineStore, staticDir, diskpath, conf)
+}
+
+// newRouter registers the routes of the API and serves all of them
+func newRouter(api *API, staticDir string) http.Handler {
+	api.registerRoutes()
+	return api.router(staticDir, primaryListener(false))
+}
 
+// registerRoutes registers the routes of the API, the listeners each pick the ones they serve
+func (api_ *API) registerRoutes() {
+	api_.RegisterMachineHandlers()
+	api_.RegisterRegistrationHandlers()
+	api_.RegisterBootDecisionHandlers()
+	api_.RegisterMachineGroupHandlers()
+	api_.RegisterLockHandlers()
+	api_.RegisterArtifactHandlers()
+	api_.RegisterEncryptionHandlers()
+	api_.RegisterCommandHandlers()
+	// The trash has to be registered before /user/{name}/images/{image_name} shadows it
+	api_.RegisterTrashHandlers()
+	api_.RegisterLimitHandlers()
+	api_.RegisterUserHandlers()
+	api_.RegisterSSHKeyHandlers()
+	api_.RegisterFavoriteHandlers()
+	api_.RegisterImagePackageHandlers()
+	api_.RegisterJobHandlers()
+	api_.RegisterMetadataHandlers()
+	api_.RegisterBootTemplateHandlers()
+	api_.RegisterProvenanceHandlers()
+	api_.RegisterJanitorHandlers()
+	api_.RegisterVersionHandlers()
+	api_.RegisterIntegrityHandlers()
+	api_.RegisterAgentHandlers()
+	api_.RegisterMetricsHandlers()
+	api_.RegisterStatsHandlers()
+	api_.RegisterReportHandlers()
+	api_.RegisterLDAPHandlers()
+	api_.RegisterCourseHandlers()
+	api_.RegisterNBDHandlers()
+	api_.RegisterModerationHandlers()
+	api_.RegisterAccessHandlers()
+	api_.RegisterImportHandlers()
+	api_.RegisterPKIHandlers()
+	api_.RegisterBuildHandlers()
+	api_.RegisterNotifyHandlers()
+	api_.RegisterReplicationHandlers()
+	api_.RegisterLogHandlers()
+	api_.RegisterSchemaHandlers()
+	api_.RegisterTelemetryHandlers()
+
+	for _, route := range api_.Routes {
+		if err := route.checkAnonymous(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// router serves the routes of the API which the listener is for
+func (api_ *API) router(staticDir string, l listener) http.Handler {
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = methodNotAllowed(r)
+
+	routes := []Route{}
+	for _, route := range api_.Routes {
+		if l.serves(route.Audience) {
+			routes = append(routes, route)
+		}
+	}
+
+	if l.serves(AudienceAgents) {
+		// Applications (in particular, the management OS) can send logs here to be logged on the control server.
+		r.HandleFunc("/log", httplog.CreateLogHandler(log.StandardLogger()))
+
+		// TODO: we may want to split this up, especially the disk images part
+		// TODO: isn't this already the case?
+		// Serve static files (kernel, initramfs, disk images)
+		r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
+	}
+
+	for _, route := range routes {
+		handler := route.Handler
+		if route.Idempotent {
+			handler = api_.idempotent(handler)
+		}
+
+		if schema, ok := requestSchemas[route.Schema]; ok && schema.JSON() {
+			handler = validateBody(schema, handler)
+		}
+
+		r.HandleFunc(route.URI, api_.deadline(route, api_.CheckRole(route, handler))).Methods(route.Method)
+	}
+	registerOptionsHandlers(r, routes)
 
-	r.StrictSlash(true)
-	r.Use(logging)
+	// We don't want to log the fact that we are logging
+	quiet := map[string]bool{"/log": true}
+	for _, route := range routes {
+		if route.Quiet {
+			quiet[route.URI] = true
+		}
+	}
+	r.Use(api_.requestLogging(l.Name, quiet))
+	r.Use(api_.readOnlyReplica)
 
-	// Applications (in particular, the management OS) can send logs here to be logged on the control server.
-	r.HandleFunc("/log", httplog.CreateLogHandler(log.StandardLogger()))
+	if l.serves(AudienceUsers) {
+		// OAuth login handlers, we deal with these separately since they should always be available.
+		r.HandleFunc("/user/login/{provider}", api_.LoginOAuth).Methods(http.MethodGet)
+		r.HandleFunc("/user/login/{provider}/callback", api_.LoginOAuthCallback).Methods(http.MethodGet)
+		api_.registerDevLoginHandlers(r)
+	}
 
-	// TODO: we may want to split this up, especially the disk images part
-	// TODO: isn't this already the case?
-	// Serve static files (kernel, initramfs, disk images)
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
+	if l.serves(AudienceAgents) {
+		api_.registerCloudInitHandlers(r)
+		api_.registerRegistrationHandlers(r)
 
-	api.RegisterMachineHandlers()
-	api.RegisterUserHandlers()
-	api.RegisterImagePackageHandlers()
+		// Serve boot configurations to pixiecore (this url is hardcoded in pixiecore)
+		r.HandleFunc("/v1/boot/{mac}", api_.ServeBootConfigurations)
 
-	for _, route := range api.Routes {
-		r.HandleFunc(route.URI, api.CheckRole(route, route.Handler)).Methods(route.Method)
+		// Serve the boot menus of machines which chain-load pxelinux
+		r.HandleFunc("/boot/pxelinux.cfg/{name}", api_.ServePxelinuxConfig).Methods(http.MethodGet)
 	}
 
-	// OAuth login handlers, we deal with these separately since they should always be available.
-	r.HandleFunc("/user/login/github", api.LoginGithub).Methods(http.MethodGet)
-	r.HandleFunc("/user/login/github/callback", api.LoginGithubCallback).Methods(http.MethodGet)
+	// Everyone may ask who they are, the visitors without a session as well
+	r.HandleFunc("/whoami", api_.GetWhoAmI).Methods(http.MethodGet)
 
-	// Serve boot configurations to pixiecore (this url is hardcoded in pixiecore)
-	r.HandleFunc("/v1/boot/{mac}", api.ServeBootConfigurations)
+	// Machines fetch the CA before they can verify anything, so it is served without a login
+	r.HandleFunc("/pki/ca.pem", api_.ServeCA).Methods(http.MethodGet)
 
+	// Load balancers ask whether to send requests here without logging in
+	r.HandleFunc("/readyz", api_.GetReadiness).Methods(http.MethodGet)
+
+	// The origin of every request is checked against the frontends, any other origin is never echoed back. The
+	// frontends send the headers of the uploads, the retries and the event stream, and read those of the answers.
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:9090"},
-		AllowedHeaders:   []string{"Authorization", "Set-Cookie"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowOriginFunc: api_.frontends.allows,
+		AllowedHeaders: []string{"Authorization", "Set-Cookie", "Content-Type", idempotencyHeader, "If-None-Match",
+			"Prefer", "Last-Event-ID", "X-BAAS-SHA256", "X-BAAS-NewVersion", "X-BAAS-ImageSize"},
+		ExposedHeaders: []string{"Location", "ETag", "Link", "Retry-After", "Content-Disposition",
+			"Idempotent-Replayed", requestIDHeader, jobHeader, "X-BAAS-ImageSize", "X-BAAS-Compression",
+			"X-BAAS-Sparse"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "DELETE"},
 		AllowCredentials: true,
-		Debug:            true,
 	})
+	if api_.config.CORSDebug {
+		c.Log = log.WithField("component", "cors")
+	}
 
-	return c.Handler(r)
+	return c.Handler(trimTrailingSlash(r))
+}
+
+// startJobs starts the jobs which keep the database and the image files tidy in the background
+func (api_ *API) startJobs() {
+	conf := api_.config
+	StartTrashPurger(api_.store, api_.diskpath, time.Duration(conf.TrashRetentionDays)*24*time.Hour)
+	StartArtifactExpiry(api_.store, api_.diskpath, time.Duration(conf.ArtifactRetentionDays)*24*time.Hour)
+	api_.startJanitor()
+	StartIdempotencyCleanup(api_.store, time.Duration(conf.IdempotencyKeyHours)*time.Hour)
+	api_.startScrubber()
+	api_.startBackups()
+	api_.startTelemetry()
+
+	if conf.LDAPSync {
+		ldap, err := directory.NewLDAP(conf)
+		if err != nil {
+			log.Fatalf("LDAP synchronization: %v", err)
+		}
+
+		StartLDAPSync(api_.store, ldap, conf)
+	}
+
+	StartCourseExpiry(api_.store, api_.notifier, time.Duration(conf.CourseWarningDays)*24*time.Hour,
+		time.Duration(conf.CourseCheckMinutes)*time.Minute)
 }
 
 // StartServer defines all routes and then starts listening for HTTP requests.
-func StartServer(machineStore database.Store, staticDir string, diskPath string, address string, port int) {
+func StartServer(machineStore database.Store, staticDir string, diskPath string, address string, port int,
+	conf *config.Config) {
+	api := NewAPI(machineStore, diskPath, conf)
+	if api.logs != nil {
+		log.AddHook(api.logs)
+	}
+	if err := api.checkStorageTiers(); err != nil {
+		log.Fatalf("Storage tiers: %v", err)
+	}
+
+	// A replica copies what the bootstrap of its primary created
+	if !api.replica.active() {
+		if _, err := api.bootstrap(); err != nil {
+			log.Fatalf("Bootstrap: %v", err)
+		}
+	}
+
+	// The agents only leave the primary listener once they have a listener of their own
+	api.registerRoutes()
+	handler := api.router(staticDir, primaryListener(conf.AgentAddress != ""))
 	srv := http.Server{
-		Handler: getHandler(machineStore, staticDir, diskPath),
+		Handler: handler,
 		Addr:    fmt.Sprintf("%s:%d", address, port),
 	}
-	log.Fatal(srv.ListenAndServe())
-}
 
-func logging(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// We don't want to log the fact that we are logging.
-		if r.URL.Path != "/log" {
-			log.Debugf("%s request on %s", r.Method, r.URL)
+	var certs *certReloader
+	if conf.TLSCertFile != "" {
+		certs = &certReloader{certFile: conf.TLSCertFile, keyFile: conf.TLSKeyFile}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			log.Fatalf("Cannot load the certificate of the control server: %v", err)
 		}
+	}
 
-		// Call the next handler, which can be another middleware in the chain, or the final handler.
-		next.ServeHTTP(w, r)
-	})
+	// Plain HTTP stays available for the machines which have not pinned the CA yet
+	if certs != nil {
+		tlsSrv := http.Server{
+			Handler: handler,
+			Addr:    conf.TLSAddress,
+			TLSConfig: &tls.Config{
+				GetCertificate: certs.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
+			},
+		}
+
+		go func() {
+			log.Fatalf("TLS server: %v", tlsSrv.ListenAndServeTLS("", ""))
+		}()
+	}
+
+	if conf.AgentAddress != "" {
+		if err := api.serveAgents(staticDir, certs); err != nil {
+			log.Fatalf("Agent listener: %v", err)
+		}
+	}
+
+	if api.exports != nil {
+		go func() {
+			log.Fatalf("NBD exports: %v", api.exports.ListenAndServe(conf.NBDAddress))
+		}()
+	}
+
+	// A replica leaves the jobs which change the database to its primary until it is promoted
+	if api.replica.active() {
+		api.startReplication(api.startJobs)
+	} else {
+		api.startJobs()
+	}
+
+	primary, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(srv.Serve(newCountingListener(primary, primaryListenerName, 0)))
 }
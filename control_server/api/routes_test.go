@@ -0,0 +1,94 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer serves the API on an in-memory store, the way getHandler does, for the tests to send requests to
+type testServer struct {
+	t       *testing.T
+	store   database.Store
+	api     *API
+	handler http.Handler
+}
+
+// newTestStore opens a new in-memory store
+func newTestStore(t *testing.T) database.Store {
+	store, err := sqlite.NewSqliteStore(sqlite.InMemoryPath)
+	assert.NoError(t, err)
+	return store
+}
+
+// newTestServer serves the API on a store with a configuration, the images are kept in diskpath
+func newTestServer(t *testing.T, store database.Store, diskpath string, conf *config.Config) *testServer {
+	api := NewAPI(store, diskpath, conf)
+	return &testServer{t: t, store: store, api: api, handler: newRouter(api, "")}
+}
+
+// serve sends a request to the API as it is
+func (s *testServer) serve(req *http.Request) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	s.handler.ServeHTTP(resp, req)
+	return resp
+}
+
+// request sends a request as the system, which may do everything
+func (s *testServer) request(method string, uri string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	req.Header.Add("type", "system")
+	return s.serve(req)
+}
+
+// requestWith sends a request as the system with more headers
+func (s *testServer) requestWith(header http.Header, method string, uri string,
+	body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Add("type", "system")
+	return s.serve(req)
+}
+
+// requestAs sends a request logged in as a user, or as the system without one
+func (s *testServer) requestAs(as *user.UserModel, method string, uri string, body string) *httptest.ResponseRecorder {
+	if as == nil {
+		return s.request(method, uri, body)
+	}
+
+	return s.requestToken(s.token(as), method, uri, body)
+}
+
+// requestToken sends a request with the session of a login token
+func (s *testServer) requestToken(token string, method string, uri string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: s.api.config.SessionCookieName, Value: token})
+	return s.serve(req)
+}
+
+// token hands out a new login token of a user
+func (s *testServer) token(as *user.UserModel) string {
+	token, err := s.api.createLoginToken(as)
+	assert.NoError(s.t, err)
+	return token.Token
+}
+
+// login gives a request the session of a new login token of a user
+func (s *testServer) login(req *http.Request, as *user.UserModel) {
+	req.AddCookie(&http.Cookie{Name: s.api.config.SessionCookieName, Value: s.token(as)})
+}
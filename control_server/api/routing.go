@@ -0,0 +1,118 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// routeError is the body of the responses to requests which match no route, Allowed lists the methods the path
+// does accept
+type routeError struct {
+	Error   string
+	Method  string
+	Path    string
+	Allowed []string `json:",omitempty"`
+}
+
+// trimTrailingSlash treats /users/ as /users, rather than redirecting to it, since clients do not repeat the body
+// of a request when they follow a redirect. The static files keep their slashes, the file server uses them to tell
+// directories apart.
+func trimTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(path) > 1 && strings.HasSuffix(path, "/") && !strings.HasPrefix(path, "/static/") {
+			r.URL.Path = strings.TrimRight(path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedMethods finds the methods the routes of the router accept for the path of the request
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	allowed := map[string]bool{}
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes without methods accept them all, they never answer 405
+			return nil
+		}
+
+		for _, method := range methods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if route.Match(probe, &mux.RouteMatch{}) {
+				allowed[method] = true
+			}
+		}
+
+		return nil
+	})
+
+	methods := []string{}
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return methods
+}
+
+// notFound answers requests for paths which have no route
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotFound, routeError{
+		Error:  "there is no such route",
+		Method: r.Method,
+		Path:   r.URL.Path,
+	})
+}
+
+// methodNotAllowed answers requests for a path which has routes, but not for the method of the request
+func methodNotAllowed(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(router, r)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, routeError{
+			Error:   fmt.Sprintf("%s is not allowed here", r.Method),
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Allowed: allowed,
+		})
+	}
+}
+
+// registerOptionsHandlers answers OPTIONS for every path of the routes with the methods it accepts. Preflight
+// requests of browsers are answered before they get here, by the CORS handler.
+func registerOptionsHandlers(r *mux.Router, routes []Route) {
+	methods := map[string][]string{}
+	var uris []string
+	for _, route := range routes {
+		if _, ok := methods[route.URI]; !ok {
+			uris = append(uris, route.URI)
+		}
+		methods[route.URI] = append(methods[route.URI], route.Method)
+	}
+
+	for _, uri := range uris {
+		allowed := append([]string{http.MethodOptions}, methods[uri]...)
+		sort.Strings(allowed)
+		header := strings.Join(allowed, ", ")
+
+		r.HandleFunc(uri, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", header)
+			w.WriteHeader(http.StatusNoContent)
+		}).Methods(http.MethodOptions)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model"
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/validation"
+)
+
+// Schemas of the bodies which are not JSON, or which have none at all
+const (
+	schemaNone      = "none"
+	schemaFile      = "file"
+	schemaMultipart = "multipart"
+)
+
+// maxValidatedBody is the most of a body which is read to validate it, larger bodies are left to the handler
+const maxValidatedBody = 1 << 20
+
+// requestSchemas are the schemas of the bodies of the routes, by the resource the routes name in their Schema.
+// The same schemas are served to the frontends at /schema/{resource} and validate the bodies the routes are sent.
+var requestSchemas = map[string]*validation.Schema{
+	schemaNone:       validation.NoBody(),
+	schemaFile:       validation.Binary("application/octet-stream"),
+	schemaMultipart:  validation.Binary("multipart/form-data"),
+	"icon":           validation.Binary("image/png"),
+	"machine-import": validation.Binary("text/csv"),
+	"ca":             validation.Binary("application/x-pem-file"),
+
+	"user": validation.Generate(user.UserModel{}).Require("Username", "Name", "Email", "Role").
+		Describe("user", "A new user"),
+	"user-update": validation.Generate(user.UserModel{}).
+		Describe("user-update", "The changes to a user, the fields which are left out stay as they are"),
+	"user-merge": validation.Generate(mergeRequest{}).Require("Primary", "Duplicate").
+		Describe("user-merge", "The duplicate account which is merged into the primary one"),
+	"user-identity-link": validation.Generate(identityLink{}).Require("Provider", "ProviderID").
+		Describe("user-identity-link", "The account at an OAuth provider which is linked to the user"),
+	"user-bulk-update": validation.Generate([]userChange{}).
+		Describe("user-bulk-update", "The changes to many users, a CSV file of username,role,quota,disabled works too"),
+	"user-limits": validation.Generate(user.LimitOverrides{}).
+		Describe("user-limits", "The limits of a user which replace those of their role"),
+	"role-limits": validation.Generate(user.Limits{}).
+		Describe("role-limits", "The limits of the users of a role"),
+	"token": validation.Generate(tokenRequest{}).
+		Describe("token", "The scopes of a new API token"),
+	"ssh-key": validation.Generate(sshKeyRequest{}).Require("Key").
+		Describe("ssh-key", "A public key of a user"),
+
+	"image": validation.Generate(images.ImageModel{}).Require("Name", "Username").
+		Describe("image", "A new image, its versions are uploaded afterwards"),
+	"image-update": validation.Generate(images.ImageModel{}).Require("UUID").
+		Describe("image-update", "The new description of an image"),
+	"image-set": validation.Generate(images.ImageSet{}).
+		Describe("image-set", "A set of image setups which are written to disks of their own"),
+	"image-setup": validation.Generate(images.ImageSetup{}).
+		Describe("image-setup", "A combination of images which are booted together"),
+	"image-setup-image": validation.Generate(model.ImageSetupMessage{}).
+		Describe("image-setup-image", "An image which is added to an image setup"),
+	"image-tier": validation.Generate(tierRequest{}).
+		Describe("image-tier", "The storage tier of an image"),
+	"backup-policy": validation.Generate(images.BackupPolicy{}).
+		Describe("backup-policy", "How an image is backed up"),
+	"image-webhook": validation.Generate(webhookRequest{}).Require("URL").
+		Describe("image-webhook", "A URL the events of an image are posted to"),
+	"build": validation.Generate(buildRequest{}).Require("Reference").
+		Describe("build", "The container image a version is built from, a tarball of the root file system can be "+
+			"uploaded instead"),
+	"metadata-template": validation.Generate(images.MetadataTemplate{}).Require("Name").
+		Describe("metadata-template", "Metadata which boots can be merged on top of"),
+	"boot-template": validation.Generate(images.BootTemplate{}).Require("Name").
+		Describe("boot-template", "Boot options saved under a name"),
+
+	"machine": validation.Generate(machinemodel.MachineModel{}).
+		Describe("machine", "A machine BAAS can boot"),
+	"machine-registration": validation.Generate(registrationRequest{}).
+		Describe("machine-registration", "What an unknown machine tells about itself when it registers"),
+	"machine-inventory": validation.Generate(machinemodel.Inventory{}).
+		Describe("machine-inventory", "The hardware the management OS found on a machine"),
+	"machine-group": validation.Generate(machineGroupRequest{}).
+		Describe("machine-group", "The settings of a group of machines"),
+	"machine-command": validation.Generate(commandRequest{}).Require("Diagnostic").
+		Describe("machine-command", "A diagnostic a machine is asked to run"),
+	"command-result": validation.Generate(machinemodel.CommandResult{}).
+		Describe("command-result", "What running a diagnostic on a machine found"),
+	"boot": validation.Generate(images.BootSetup{}).
+		Describe("boot", "A boot which is queued on a machine or a group of machines"),
+	"boot-decisions": validation.Generate(bootDecisionsRequest{}).
+		Describe("boot-decisions", "The machines to decide the next boot of"),
+	"boot-heartbeat": validation.Generate(images.PeerHeartbeat{}).
+		Describe("boot-heartbeat", "The state of a boot which is in progress"),
+	"boot-state": validation.Generate(images.BootReport{}).
+		Describe("boot-state", "The state a boot reached"),
+	"agent-channel": validation.Generate(agent.Channel{}).
+		Describe("agent-channel", "The version of the management OS agent a channel points at"),
+
+	"course": validation.Generate(course.CourseModel{}).Require("Name", "Owner").
+		Describe("course", "A course which grants its members access to machines"),
+	"course-expiry": validation.Generate(courseExpiry{}).Require("ExpiresAt").
+		Describe("course-expiry", "When a course expires"),
+}
+
+// validateBody refuses bodies which do not match the schema of the route, before the handler reads them. Bodies
+// which are not JSON, or too large to hold on to, are left to the handler, which refuses them as it did before.
+func validateBody(schema *validation.Schema, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if r.Body == nil || (contentType != "" && !strings.Contains(contentType, "json")) {
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValidatedBody+1))
+		if err != nil {
+			http.Error(w, "Cannot read the body", http.StatusBadRequest)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		if len(body) > maxValidatedBody || len(bytes.TrimSpace(body)) == 0 {
+			next(w, r)
+			return
+		}
+
+		value, err := validation.Decode(body)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		if reasons := schema.Validate(value); len(reasons) != 0 {
+			http.Error(w, "Invalid request body: "+strings.Join(reasons, "; "), http.StatusBadRequest)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// GetSchemas lists the resources which have a schema
+// Example request: GET /schema
+// Example response: ["boot", "boot-template", "file", "image", "machine", "none", "user", ...]
+func (api_ *API) GetSchemas(w http.ResponseWriter, _ *http.Request) {
+	names := make([]string, 0, len(requestSchemas))
+	for name := range requestSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+// GetSchema serves the JSON schema of the body of a resource, for the frontends to generate their forms from. The
+// control server validates the bodies it is sent with the same schema.
+// Example request: GET /schema/user
+// Example response: {"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "user", "type": "object",
+//
+//	"properties": {"Role": {"title": "role", "type": "string", "enum": ["", "user", "moderator", "admin"],
+//	"description": "What the user may do, ..."}, ...}, "required": ["Username", "Name", "Email", "Role"]}
+func (api_ *API) GetSchema(w http.ResponseWriter, r *http.Request) {
+	name, err := GetTag("resource", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	schema, ok := requestSchemas[name]
+	if !ok {
+		http.Error(w, "There is no schema of "+name, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schema)
+}
+
+// RegisterSchemaHandlers sets the metadata for the routes which serve the schemas of the request bodies
+func (api_ *API) RegisterSchemaHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:              "/schema",
+		Permissions:      []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:      true,
+		AnonymousAllowed: true,
+		Scope:            user.ScopeAdmin,
+		Handler:          api_.GetSchemas,
+		Method:           http.MethodGet,
+		Description:      "Lists the resources which have a schema",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:              "/schema/{resource}",
+		Permissions:      []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:      true,
+		AnonymousAllowed: true,
+		Scope:            user.ScopeAdmin,
+		Handler:          api_.GetSchema,
+		Method:           http.MethodGet,
+		Description:      "Gets the JSON schema of the body of a resource",
+	})
+}
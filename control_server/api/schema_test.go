@@ -0,0 +1,77 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/validation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_RouteSchemas(t *testing.T) {
+	store := newTestStore(t)
+
+	api := NewAPI(store, "", config.Default())
+	api.registerRoutes()
+
+	for _, route := range api.Routes {
+		if route.Method != http.MethodPost && route.Method != http.MethodPut {
+			continue
+		}
+
+		_, ok := requestSchemas[route.Schema]
+		assert.True(t, ok, "%s %s has no schema", route.Method, route.URI)
+	}
+}
+
+func TestApi_Schema(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "schema")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	resp := s.request(http.MethodGet, "/schema/user", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var schema validation.Schema
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&schema))
+	assert.Equal(t, validation.Dialect, schema.Dialect)
+	assert.Equal(t, []string{"", "user", "moderator", "admin"}, schema.Properties["Role"].Enum)
+	assert.NotEmpty(t, schema.Properties["Email"].Description)
+	assert.Contains(t, schema.Required, "Email")
+
+	resp = s.request(http.MethodGet, "/schema/machine", "")
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&schema))
+	assert.Equal(t, []string{"", "x86_64", "Arm64", "unknown"}, schema.Properties["Architecture"].Enum)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodGet, "/schema/nothing", "").Code)
+
+	resp = s.request(http.MethodGet, "/schema", "")
+	var names []string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&names))
+	assert.Contains(t, names, "boot")
+
+	// The bodies are refused with the reasons the schema gives, before the handler sees them
+	resp = s.request(http.MethodPost, "/user", `{"Username": "new user", "Name": "New", "Email": "new@example.com"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Role is missing")
+	assert.Contains(t, resp.Body.String(), "Username: the username can only contain")
+
+	resp = s.request(http.MethodPut, "/machine", `{"Architecture": "sparc", "MacAddress": {"Address": "abc"}}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `Architecture: unknown architecture "sparc"`)
+
+	assert.Equal(t, http.StatusCreated, s.request(http.MethodPost, "/user",
+		`{"Username": "new", "Name": "New", "Email": "new@example.com", "Role": "user"}`).Code)
+	assert.Equal(t, http.StatusCreated, s.request(http.MethodPost, "/machine",
+		`{"Architecture": "X86_64", "MacAddress": {"Address": "abc"}}`).Code)
+}
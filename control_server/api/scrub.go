@@ -0,0 +1,311 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/control_server/downloads"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// scrubChunk is the most the scrubber reads at once, it waits for the bandwidth of every chunk before reading it
+const scrubChunk = 1 << 20
+
+// scrubMinInterval is the least the scrubber rests between two passes, so an empty store is not scrubbed in a loop
+const scrubMinInterval = time.Minute
+
+// scrubStatus is how the scrubbing of the stored versions is going
+type scrubStatus struct {
+	Running bool
+	// LastFullPass is when the scrubber last finished going over all images
+	LastFullPass *time.Time `json:",omitempty"`
+	// FilesChecked and CorruptionsFound count the versions since the control server started
+	FilesChecked     uint64
+	CorruptionsFound uint64
+}
+
+// scrubber reads the files of the versions back at a limited pace, to find the ones which rotted on disk
+type scrubber struct {
+	// bucket limits the bandwidth of the scrubber, it is nil when the scrubber is not limited
+	bucket *downloads.TokenBucket
+
+	mu      sync.Mutex
+	running int
+	status  scrubStatus
+}
+
+func newScrubber(bytesPerSecond uint64) *scrubber {
+	var bucket *downloads.TokenBucket
+	if bytesPerSecond != 0 {
+		bucket = downloads.NewTokenBucket(float64(bytesPerSecond), scrubChunk)
+	}
+
+	return &scrubber{bucket: bucket}
+}
+
+// begin registers a pass or the scrub of a single image, end has to be called when it is done
+func (s *scrubber) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running++
+}
+
+// end records the end of a scrub, full tells whether it went over all images
+func (s *scrubber) end(full bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running--
+	if full {
+		now := time.Now()
+		s.status.LastFullPass = &now
+	}
+}
+
+// checked counts a version which was read back
+func (s *scrubber) checked(corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.FilesChecked++
+	if corrupt {
+		s.status.CorruptionsFound++
+	}
+}
+
+// Status returns a copy of the status of the scrubber
+func (s *scrubber) Status() scrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status
+	status.Running = s.running != 0
+	return status
+}
+
+// scrubReader reads a file at the pace of the scrubber
+type scrubReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *downloads.TokenBucket
+}
+
+func (s *scrubReader) Read(p []byte) (int, error) {
+	if len(p) > scrubChunk {
+		p = p[:scrubChunk]
+	}
+
+	if s.bucket != nil {
+		if err := s.bucket.Wait(s.ctx, uint64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.r.Read(p)
+}
+
+// scrubResult is what scrubbing an image found
+type scrubResult struct {
+	Image images.ImageUUID
+	// Checked is the number of versions which were read back, versions without a checksum or a file are skipped
+	Checked int
+	// Corrupt are the versions which do not match their checksum
+	Corrupt []uint64
+}
+
+// scrubVersion reads the file of a version back and tells whether it still matches its checksum. An upload may
+// replace the file while it is read, it is only corrupt when the checksum did not change in the meantime.
+func (api_ *API) scrubVersion(ctx context.Context, image *images.ImageModel, version *images.Version) (bool, error) {
+	f, err := api_.openVersion(image, version.Version)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, &scrubReader{ctx: ctx, r: f, bucket: api_.scrub.bucket}); err != nil {
+		return false, err
+	}
+
+	if strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), version.SHA256) {
+		return true, nil
+	}
+
+	current, err := api_.store.GetImageByUUID(image.UUID)
+	if err != nil {
+		return false, err
+	}
+
+	now := current.FindVersion(version.Version)
+	return now == nil || now.SHA256 != version.SHA256, nil
+}
+
+// scrubImage reads back the versions of an image which have a checksum. The versions which no longer match it are
+// marked as corrupt, and their owner is told about it. Versions which match it again, because the file was
+// restored, are no longer corrupt.
+func (api_ *API) scrubImage(ctx context.Context, image *images.ImageModel) (scrubResult, error) {
+	result := scrubResult{Image: image.UUID, Corrupt: []uint64{}}
+
+	for i := range image.Versions {
+		version := &image.Versions[i]
+		if version.SHA256 == "" {
+			continue
+		}
+
+		intact, err := api_.scrubVersion(ctx, image, version)
+		if os.IsNotExist(err) {
+			// The integrity check reports the missing files
+			log.Warnf("Cannot scrub version %d of image %s: %v", version.Version, image.UUID, err)
+			continue
+		} else if err != nil {
+			return result, err
+		}
+
+		result.Checked++
+		api_.scrub.checked(!intact)
+		if !intact {
+			result.Corrupt = append(result.Corrupt, version.Version)
+		}
+
+		if intact != version.Corrupt {
+			continue
+		}
+
+		if err = api_.store.SetVersionCorrupt(image.UUID, version.Version, !intact); err != nil {
+			return result, err
+		}
+		version.Corrupt = !intact
+
+		if intact {
+			log.Infof("Version %d of image %s matches its checksum again", version.Version, image.UUID)
+		} else {
+			api_.reportCorruption(image, version)
+		}
+	}
+
+	return result, nil
+}
+
+// reportCorruption tells the owner of an image that one of its versions is corrupt
+func (api_ *API) reportCorruption(image *images.ImageModel, version *images.Version) {
+	log.Errorf("Version %d of image %s does not match its checksum %s", version.Version, image.UUID, version.SHA256)
+
+	subject := fmt.Sprintf("Version %d of image %s is corrupt", version.Version, image.Name)
+	body := fmt.Sprintf("The stored file of version %d of your image %s (%s) no longer matches its checksum. "+
+		"The version is not booted anymore, and the latest version of the image is the newest one which is "+
+		"intact. Uploading the version again repairs it.", version.Version, image.Name, image.UUID)
+
+	api_.alert(config.EventScrubCorruption, string(image.UUID), subject,
+		fmt.Sprintf("The stored file of version %d of image %s (%s), owned by %s, no longer matches its checksum %s.",
+			version.Version, image.Name, image.UUID, image.Username, version.SHA256))
+
+	owner, err := api_.store.GetUserByUsername(image.Username)
+	if err == nil {
+		err = api_.notifier.Notify(owner, subject, body)
+	}
+
+	if err != nil {
+		log.Errorf("Cannot notify %s about the corrupt image %s: %v", image.Username, image.UUID, err)
+	}
+}
+
+// scrubAll scrubs every image which is not in the trash, the images in the trash are not booted anymore
+func (api_ *API) scrubAll(ctx context.Context) error {
+	api_.scrub.begin()
+	full := false
+	defer func() { api_.scrub.end(full) }()
+
+	uuids, _, err := api_.store.GetImageUUIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, uuid := range uuids {
+		image, err := api_.store.GetImageByUUID(uuid)
+		if err != nil {
+			continue
+		}
+
+		if _, err = api_.scrubImage(ctx, image); err != nil {
+			return fmt.Errorf("scrub image %s: %w", uuid, err)
+		}
+	}
+
+	full = true
+	return nil
+}
+
+// startScrubber scrubs all images in the background, resting for the configured interval after every pass
+func (api_ *API) startScrubber() {
+	if api_.config.ScrubBytesPerSecond == 0 {
+		return
+	}
+
+	interval := time.Duration(api_.config.ScrubIntervalHours) * time.Hour
+	if interval < scrubMinInterval {
+		interval = scrubMinInterval
+	}
+
+	go func() {
+		for {
+			if err := api_.scrubAll(context.Background()); err != nil {
+				log.Errorf("Scrubbing the images: %v", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// ScrubImage reads back the versions of an image now instead of waiting for the next pass of the scrubber, at the
+// same pace
+// Example request: POST /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/scrub
+// Example response: {"Image": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", "Checked": 3, "Corrupt": [2]}
+func (api_ *API) ScrubImage(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findImage(w, r)
+	if err != nil {
+		return
+	}
+
+	api_.scrub.begin()
+	result, err := api_.scrubImage(r.Context(), image)
+	api_.scrub.end(false)
+
+	if ErrorWrite(w, err, "Cannot scrub the image") != nil {
+		return
+	}
+
+	requestLog(r).Infof("Scrubbed image %s: %d versions checked, %d corrupt", image.UUID, result.Checked,
+		len(result.Corrupt))
+	writeJSON(w, http.StatusOK, result)
+}
+
+// RegisterScrubHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterScrubHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/scrub",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Timeout:     NoTimeout,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.ScrubImage,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Verifies the stored versions of an image against their checksums",
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Scrub(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+	owner := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(owner))
+
+	diskpath, err := ioutil.TempDir("", "scrub")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "course", Username: "alice", UUID: "course"}
+	assert.NoError(t, store.CreateImage(&image))
+	for version, content := range map[uint64]string{1: "the first disk", 2: "the second disk"} {
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: version, ImageModelUUID: "course"}))
+		assert.NoError(t, ioutil.WriteFile(image.VersionFile(version), []byte(content), 0644))
+		sum := sha256.Sum256([]byte(content))
+		assert.NoError(t, store.SetVersionChecksum("course", version, hex.EncodeToString(sum[:])))
+	}
+
+	conf := config.Default()
+	conf.ScrubBytesPerSecond = 1 << 20
+	s := newTestServer(t, store, diskpath, conf)
+	notifier := &recordingNotifier{}
+	s.api.notifier = notifier
+
+	scrub := func() scrubResult {
+		resp := s.requestAs(admin, http.MethodPost, "/image/course/scrub", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var result scrubResult
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+		return result
+	}
+
+	assert.Equal(t, http.StatusForbidden, s.requestAs(owner, http.MethodPost, "/image/course/scrub", "").Code)
+	assert.Equal(t, scrubResult{Image: "course", Checked: 2, Corrupt: []uint64{}}, scrub())
+
+	// The second version rots on disk
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(2), []byte("the second dusk"), 0644))
+	assert.Equal(t, scrubResult{Image: "course", Checked: 2, Corrupt: []uint64{2}}, scrub())
+	assert.Equal(t, []string{"alice: Version 2 of image course is corrupt"}, notifier.subjects)
+
+	stored, err := store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	assert.True(t, stored.FindVersion(2).Corrupt)
+	assert.Equal(t, uint64(1), stored.LatestVersion().Version)
+
+	// The owner is only told once
+	scrub()
+	assert.Len(t, notifier.subjects, 1)
+
+	// Corrupt versions are not booted
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "alice"}
+	assert.NoError(t, store.CreateImageSetup("alice", &setup))
+	store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(1), false)
+	resp := s.requestAs(owner, http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup", "Version": 2}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Equal(t, http.StatusOK, s.requestAs(owner, http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup"}`).Code)
+
+	resp = s.requestAs(admin, http.MethodGet, "/admin/storage/stats", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var stats struct{ Scrub scrubStatus }
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(6), stats.Scrub.FilesChecked)
+	assert.Equal(t, uint64(2), stats.Scrub.CorruptionsFound)
+	assert.Nil(t, stats.Scrub.LastFullPass)
+
+	// Restoring the file repairs the version
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(2), []byte("the second disk"), 0644))
+	assert.NoError(t, s.api.scrubAll(context.Background()))
+	stored, err = store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	assert.False(t, stored.FindVersion(2).Corrupt)
+	assert.Equal(t, uint64(2), stored.LatestVersion().Version)
+	assert.NotNil(t, s.api.scrub.Status().LastFullPass)
+}
@@ -0,0 +1,440 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// sessionTouchInterval is how often the use of a session is written to the store, unless it is used from another
+// address in the meantime
+const sessionTouchInterval = time.Minute
+
+// maxUserAgent is the longest User-Agent header which is kept of a session, the rest is cut off
+const maxUserAgent = 512
+
+// userCacheTTL is how long the role of a user is trusted before it is looked up again. Changes made through the
+// API take effect right away, since those drop the user from the cache.
+const userCacheTTL = 10 * time.Second
+
+var (
+	errSessionRevoked = errors.New("the session has been revoked, log in again")
+	errUserGone       = errors.New("the user of this session does not exist anymore")
+	errInvalidRole    = errors.New("the user of this session has no valid role")
+	errUserDisabled   = errors.New("the account of this session has been disabled")
+)
+
+// cachedUser is what authorization needs to know about a user
+type cachedUser struct {
+	role      user.UserRole
+	revokedAt *time.Time
+	fetched   time.Time
+}
+
+// userCache keeps the roles of the users who recently made a request, so not every request hits the store
+type userCache struct {
+	mu    sync.Mutex
+	users map[string]cachedUser
+}
+
+func newUserCache() *userCache {
+	return &userCache{users: map[string]cachedUser{}}
+}
+
+// forget drops a user from the cache, the next request of the user looks them up again
+func (c *userCache) forget(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, username)
+}
+
+// lookupUser finds the current role of a user, from the cache when it is recent enough
+func (api_ *API) lookupUser(username string) (cachedUser, error) {
+	api_.users.mu.Lock()
+	cached, ok := api_.users.users[username]
+	api_.users.mu.Unlock()
+
+	if ok && time.Since(cached.fetched) < userCacheTTL {
+		return cached, nil
+	}
+
+	found, err := api_.store.GetUserByUsername(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && found.MergedInto != "") {
+		return cachedUser{}, errUserGone
+	} else if err != nil {
+		return cachedUser{}, err
+	} else if found.Disabled {
+		return cachedUser{}, errUserDisabled
+	}
+
+	cached = cachedUser{role: found.Role, revokedAt: found.SessionsRevokedAt, fetched: time.Now()}
+	api_.users.mu.Lock()
+	api_.users.users[username] = cached
+	api_.users.mu.Unlock()
+
+	return cached, nil
+}
+
+// sessionUsername is the user who made a request, it is empty for requests made by machines or without a session
+func (api_ *API) sessionUsername(r *http.Request) string {
+	if principal := api_.principal(r); principal.Kind == PrincipalUser {
+		return principal.Name
+	}
+
+	return ""
+}
+
+// sessionRole resolves the current role of the user behind the session of a request. The role stored in the
+// session is not trusted, the user may have been demoted since logging in. Requests without a session are not ok.
+func (api_ *API) sessionRole(r *http.Request) (user.UserRole, bool, error) {
+	username := api_.claimedUsername(r)
+	if username == "" {
+		return "", false, nil
+	}
+
+	current, err := api_.lookupUser(username)
+	if err != nil {
+		return "", true, err
+	}
+
+	// Sessions from before the revocation, or from before sessions recorded when they were issued, are refused
+	session, _ := api_.session.Get(r, api_.config.SessionCookieName)
+	issued, _ := session.Values["IssuedAt"].(int64)
+	if current.revokedAt != nil && issued <= current.revokedAt.UnixNano() {
+		return "", true, errSessionRevoked
+	}
+
+	// A role which was mistyped into the database does not grant anything, the session is treated as logged out
+	if !current.role.Valid() {
+		return "", true, errInvalidRole
+	}
+
+	return current.role, true, nil
+}
+
+// RevokeSessions logs a user out everywhere, including the tokens of command line logins
+// Example request: POST /user/jan/revoke-sessions
+// Example response: 204 No Content
+func (api_ *API) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	err = api_.storeFor(r).RevokeSessions(name, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: name})
+		return
+	}
+
+	if ErrorWrite(w, err, "Cannot revoke the sessions") != nil {
+		return
+	}
+
+	api_.users.forget(name)
+	log.Infof("Revoked the sessions of %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseProxies reads the trusted proxies of the configuration, single addresses are ranges of their own
+func parseProxies(entries []string) []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Errorf("Ignoring trusted proxy %q: %v", entry, err)
+			continue
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies
+}
+
+// trustedProxy reports whether an address is one of the proxies in front of the control server
+func (api_ *API) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, proxy := range api_.proxies {
+		if ip != nil && proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteIP gets the address a request was made from without the port, which is the proxy when there is one
+func remoteIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return addr
+}
+
+// clientIP is the address of the client behind a request. X-Forwarded-For is followed back from the proxy which
+// made the request for as long as the addresses are trusted proxies, anyone else could have written the header.
+func (api_ *API) clientIP(r *http.Request) string {
+	addr := remoteIP(r)
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && api_.trustedProxy(addr); i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+	}
+
+	return addr
+}
+
+// sameNetwork reports whether two addresses are in the same /16, or /48 for IPv6. Addresses which cannot be
+// compared are taken to be the same.
+func sameNetwork(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return true
+	}
+
+	mask := net.CIDRMask(48, 128)
+	if ipA.To4() != nil && ipB.To4() != nil {
+		ipA, ipB, mask = ipA.To4(), ipB.To4(), net.CIDRMask(16, 32)
+	}
+
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+// sessionTouch is when the use of a session was last written to the store, and from where
+type sessionTouch struct {
+	at   time.Time
+	from string
+}
+
+// sessionTouches keeps the store from being written to on every request of a session
+type sessionTouches struct {
+	mu      sync.Mutex
+	touches map[string]sessionTouch
+}
+
+func newSessionTouches() *sessionTouches {
+	return &sessionTouches{touches: map[string]sessionTouch{}}
+}
+
+// due reports whether the use of a session should be written to the store, and assumes it will be
+func (t *sessionTouches) due(id string, from string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, ok := t.touches[id]
+	if ok && last.from == from && now.Sub(last.at) < sessionTouchInterval {
+		return false
+	}
+
+	// Sessions which were not used for a while are written the next time anyway, so they need not be remembered
+	for other, touch := range t.touches {
+		if now.Sub(touch.at) >= sessionTouchInterval {
+			delete(t.touches, other)
+		}
+	}
+
+	t.touches[id] = sessionTouch{at: now, from: from}
+	return true
+}
+
+// recordSession stores where a session was handed out. The login goes through when it cannot be recorded, the
+// user only misses it on their list of sessions.
+func (api_ *API) recordSession(r *http.Request, id string, username string, kind user.SessionKind,
+	expires time.Time) {
+	api_.recordScopedSession(r, id, username, kind, expires, nil)
+}
+
+// recordScopedSession stores where a session was handed out like recordSession, together with the scopes of a
+// token
+func (api_ *API) recordScopedSession(r *http.Request, id string, username string, kind user.SessionKind,
+	expires time.Time, scopes []user.TokenScope) {
+	var shown images.StringList
+	for _, scope := range scopes {
+		shown = append(shown, string(scope))
+	}
+
+	agent := r.UserAgent()
+	if len(agent) > maxUserAgent {
+		agent = agent[:maxUserAgent]
+	}
+
+	from := api_.clientIP(r)
+	err := api_.storeFor(r).CreateSession(&user.SessionModel{
+		ID:           id,
+		Username:     username,
+		Kind:         kind,
+		CreatedFrom:  from,
+		UserAgent:    agent,
+		LastUsedFrom: from,
+		LastUsedAt:   time.Now(),
+		Scopes:       shown,
+		ExpiresAt:    expires,
+	})
+
+	if err != nil {
+		requestLog(r).Errorf("Cannot record the session of %s: %v", username, err)
+	}
+}
+
+// touchSession records that a session made a request, at most every sessionTouchInterval unless the address
+// changes. Sessions which are used from another network than they were created on are reported once.
+func (api_ *API) touchSession(r *http.Request, session *sessions.Session) {
+	id, _ := session.Values["Session"].(string)
+	from := api_.clientIP(r)
+	now := time.Now()
+	if id == "" || !api_.touches.due(id, from, now) {
+		return
+	}
+
+	// Sessions handed out before they were recorded have nothing to update
+	record, err := api_.storeFor(r).GetSession(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	} else if err != nil {
+		requestLog(r).Errorf("Cannot find session %s: %v", id, err)
+		return
+	}
+
+	if err = api_.storeFor(r).TouchSession(id, from, now); err != nil {
+		requestLog(r).Errorf("Cannot record the use of session %s: %v", id, err)
+	}
+
+	if !sameNetwork(record.CreatedFrom, from) {
+		api_.sessionAnomaly(r, record, from, now)
+	}
+}
+
+// sessionAnomaly reports a session which is used from another network than it was created on, which may mean it
+// was stolen. The user is mailed when NotifySessionAnomalies is set.
+func (api_ *API) sessionAnomaly(r *http.Request, record *user.SessionModel, from string, at time.Time) {
+	flagged, err := api_.storeFor(r).FlagSessionAnomaly(record.ID, at)
+	if err != nil {
+		requestLog(r).Errorf("Cannot flag session %s: %v", record.ID, err)
+		return
+	} else if !flagged {
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"audit":        "session-anomaly",
+		"username":     record.Username,
+		"session":      record.ID,
+		"created_from": record.CreatedFrom,
+		"used_from":    from,
+	}).Warnf("Session of %s created from %s is used from %s", record.Username, record.CreatedFrom, from)
+
+	if !api_.config.NotifySessionAnomalies {
+		return
+	}
+
+	owner, err := api_.storeFor(r).GetUserByUsername(record.Username)
+	if err == nil {
+		err = api_.notifier.Notify(owner, "Your account was used from a new network",
+			fmt.Sprintf("A session of your account which was created from %s on %s was used from %s. If this "+
+				"was not you, revoke your sessions.", record.CreatedFrom, record.CreatedAt.Format(time.RFC1123), from))
+	}
+
+	if err != nil {
+		requestLog(r).Errorf("Cannot tell %s about session %s: %v", record.Username, record.ID, err)
+	}
+}
+
+// writeSessions answers with the sessions of a user which have not expired or been revoked, of a single kind
+// unless it is empty
+func (api_ *API) writeSessions(w http.ResponseWriter, r *http.Request, username string, kind user.SessionKind) {
+	owner, err := api_.storeFor(r).GetUserByUsername(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: username})
+		return
+	} else if ErrorWrite(w, err, "Cannot fetch the user") != nil {
+		return
+	}
+
+	found, err := api_.storeFor(r).GetSessionsByUsername(username)
+	if ErrorWrite(w, err, "Cannot fetch the sessions") != nil {
+		return
+	}
+
+	valid := []user.SessionModel{}
+	for _, s := range found {
+		revoked := owner.SessionsRevokedAt != nil && !s.CreatedAt.After(*owner.SessionsRevokedAt)
+		if !revoked && (kind == "" || s.Kind == kind) {
+			valid = append(valid, s)
+		}
+	}
+
+	session, _ := api_.session.Get(r, api_.config.SessionCookieName)
+	current, _ := session.Values["Session"].(string)
+	writeJSON(w, http.StatusOK, types.NewSessions(valid, current))
+}
+
+// GetOwnSessions lists where the sessions of the logged-in user were created and last used from, including the
+// tokens of command line logins
+// Example request: GET /user/me/sessions
+// Example response: [{"ID": "7b4c...", "Username": "jan", "Kind": "browser", "Current": true,
+//
+//	"CreatedFrom": "131.180.1.10", "UserAgent": "Mozilla/5.0 ...", "LastUsedFrom": "131.180.1.10",
+//	"LastUsedAt": "2022-02-01T10:03:12Z", "ExpiresAt": "2022-02-01T17:58:40Z", "CreatedAt": "2022-02-01T09:58:40Z"}]
+func (api_ *API) GetOwnSessions(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	api_.writeSessions(w, r, username, "")
+}
+
+// GetOwnTokens lists the tokens of the command line logins of the logged-in user, like GetOwnSessions
+// Example request: GET /user/me/tokens
+// Example response: [{"ID": "0d1e...", "Username": "jan", "Kind": "token", "Current": false, ...}]
+func (api_ *API) GetOwnTokens(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	api_.writeSessions(w, r, username, user.SessionToken)
+}
+
+// GetUserSessions lists the sessions of any user, like GetOwnSessions
+// Example request: GET /user/jan/sessions
+// Example response: [{"ID": "7b4c...", "Username": "jan", "Kind": "browser", "Current": false, ...}]
+func (api_ *API) GetUserSessions(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	api_.writeSessions(w, r, name, "")
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_SessionRevalidation(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	root := &user.UserModel{Username: "root", Email: "root@example.com", Role: user.Admin}
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, root, test} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	adminToken := s.token(admin)
+	rootToken := s.token(root)
+	assert.Equal(t, http.StatusOK, s.requestToken(adminToken, http.MethodGet, "/users", "").Code)
+
+	// Demoting the admin takes effect on their next request, even though their session still says admin
+	assert.Equal(t, http.StatusOK, s.requestToken(rootToken, http.MethodPut, "/user/admin", `{"Role": "user"}`).Code)
+	assert.Equal(t, http.StatusForbidden, s.requestToken(adminToken, http.MethodGet, "/users", "").Code)
+
+	// Revoking the sessions of a user refuses every token handed out before, new logins work again
+	testToken := s.token(test)
+	assert.Equal(t, http.StatusOK, s.requestToken(testToken, http.MethodGet, "/user/me", "").Code)
+	assert.Equal(t, http.StatusForbidden, s.requestToken(testToken, http.MethodPost,
+		"/user/root/revoke-sessions", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestToken(rootToken, http.MethodPost,
+		"/user/test/revoke-sessions", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, s.requestToken(testToken, http.MethodGet, "/user/me", "").Code)
+	assert.Equal(t, http.StatusOK, s.requestToken(s.token(test), http.MethodGet, "/user/me", "").Code)
+
+	assert.Equal(t, http.StatusNotFound, s.requestToken(rootToken, http.MethodPost,
+		"/user/nobody/revoke-sessions", "").Code)
+}
+
+func TestApi_InvalidRoles(t *testing.T) {
+	store := newTestStore(t)
+
+	// A role mistyped into the database grants nothing, the session is treated as logged out
+	typo := &user.UserModel{Username: "typo", Email: "typo", Role: "adminn"}
+	assert.NoError(t, store.CreateUser(typo))
+	root := &user.UserModel{Username: "root", Email: "root", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(root))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	token := s.token(typo)
+	resp := s.requestToken(token, http.MethodGet, "/user/me", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	resp = s.request(http.MethodPost, "/admin/integrity-check", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var report database.IntegrityReport
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, []database.InvalidRole{{Username: "typo", Role: "adminn"}}, report.InvalidRoles)
+
+	// Roles coming in through the API are checked when they are decoded
+	resp = s.request(http.MethodPost, "/user", `{"Username": "new", "Name": "New", "Email": "new", "Role": "adminn"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `unknown role "adminn"`)
+
+	// Users cannot promote themselves
+	self := &user.UserModel{Username: "self", Email: "self", Role: user.User}
+	assert.NoError(t, store.CreateUser(self))
+	resp = s.requestAs(self, http.MethodPut, "/user/self", `{"Role": "admin"}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = s.requestAs(root, http.MethodPut, "/user/typo", `{"Role": "moderatr"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	assert.Equal(t, http.StatusOK, s.requestAs(root, http.MethodPut, "/user/typo", `{"Role": "admin"}`).Code)
+	resp = s.requestToken(token, http.MethodGet, "/user/me", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestClientIP(t *testing.T) {
+	conf := config.Default()
+	conf.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.7", "bogus"}
+	api := NewAPI(nil, "/tmp", conf)
+
+	for remote, tc := range map[string]struct {
+		forwarded string
+		expected  string
+	}{
+		// Only the proxies are believed, and only about the hop before them
+		"198.51.100.1:4242": {"131.180.1.10", "198.51.100.1"},
+		"10.1.2.3:4242":     {"131.180.1.10", "131.180.1.10"},
+		"192.0.2.7:4242":    {"131.180.1.10, 10.0.0.1", "131.180.1.10"},
+		"10.0.0.1:4242":     {"6.6.6.6, 131.180.1.10", "131.180.1.10"},
+		"10.0.0.2:4242":     {"", "10.0.0.2"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/user/me", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", tc.forwarded)
+		assert.Equal(t, tc.expected, api.clientIP(req), remote)
+	}
+
+	assert.True(t, sameNetwork("131.180.1.10", "131.180.200.1"))
+	assert.False(t, sameNetwork("131.180.1.10", "131.181.1.10"))
+	assert.True(t, sameNetwork("2001:db8:1::1", "2001:db8:1:ff::1"))
+	assert.False(t, sameNetwork("2001:db8:1::1", "2001:db8:2::1"))
+	assert.True(t, sameNetwork("", "131.180.1.10"))
+
+	// The use of a session is written once a minute, unless it comes from elsewhere
+	touches := newSessionTouches()
+	now := time.Now()
+	assert.True(t, touches.due("a", "131.180.1.10", now))
+	assert.False(t, touches.due("a", "131.180.1.10", now.Add(time.Second)))
+	assert.True(t, touches.due("a", "131.180.1.11", now.Add(2*time.Second)))
+	assert.True(t, touches.due("a", "131.180.1.11", now.Add(2*time.Second+sessionTouchInterval)))
+}
+
+func TestApi_SessionActivity(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, test} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	conf := config.Default()
+	conf.TrustedProxies = []string{"10.0.0.0/8"}
+	conf.NotifySessionAnomalies = true
+	s := newTestServer(t, store, "/tmp", conf)
+	notifier := &recordingNotifier{}
+	s.api.notifier = notifier
+
+	// The tokens are handed out behind the proxy
+	login := func(u *user.UserModel, kind user.SessionKind) *loginToken {
+		token, err := s.api.createLoginToken(u)
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/user/login/github/callback", nil)
+		req.RemoteAddr = "10.0.0.1:4242"
+		req.Header.Set("X-Forwarded-For", "131.180.1.10")
+		req.Header.Set("User-Agent", "baas-cli/1.0")
+		s.api.recordSession(req, token.session, u.Username, kind, token.ExpiresAt)
+		return token
+	}
+
+	request := func(token *loginToken, from string, uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.RemoteAddr = "10.0.0.1:4242"
+		req.Header.Set("X-Forwarded-For", from)
+		req.AddCookie(&http.Cookie{Name: s.api.config.SessionCookieName, Value: token.Token})
+		return s.serve(req)
+	}
+
+	sessions := func(token *loginToken, from string, uri string) []types.Session {
+		resp := request(token, from, uri)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var found []types.Session
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &found))
+		return found
+	}
+
+	adminToken := login(admin, user.SessionToken)
+	browser := login(test, user.SessionBrowser)
+	token := login(test, user.SessionToken)
+
+	// Moving around within the network is nothing out of the ordinary
+	assert.Equal(t, http.StatusOK, request(token, "131.180.7.7", "/user/me").Code)
+	found := sessions(token, "131.180.7.7", "/user/me/tokens")
+	assert.Len(t, found, 1)
+	assert.Equal(t, token.session, found[0].ID)
+	assert.True(t, found[0].Current)
+	assert.Equal(t, "131.180.1.10", found[0].CreatedFrom)
+	assert.Equal(t, "131.180.7.7", found[0].LastUsedFrom)
+	assert.Equal(t, "baas-cli/1.0", found[0].UserAgent)
+	assert.Nil(t, found[0].AnomalyAt)
+	assert.Empty(t, notifier.subjects)
+
+	// Another network is reported, once
+	assert.Equal(t, http.StatusOK, request(browser, "203.0.113.9", "/user/me").Code)
+	assert.Equal(t, http.StatusOK, request(browser, "198.51.100.3", "/user/me").Code)
+	assert.Equal(t, []string{"test: Your account was used from a new network"}, notifier.subjects)
+
+	// The most recently used session comes first
+	found = sessions(token, "131.180.7.7", "/user/me/sessions")
+	assert.Len(t, found, 2)
+	assert.Equal(t, browser.session, found[0].ID)
+	assert.Equal(t, "198.51.100.3", found[0].LastUsedFrom)
+	assert.False(t, found[0].Current)
+	assert.NotNil(t, found[0].AnomalyAt)
+
+	// Only admins see the sessions of others, revoked sessions are not listed
+	assert.Equal(t, http.StatusForbidden, request(token, "131.180.1.10", "/user/admin/sessions").Code)
+	assert.Len(t, sessions(adminToken, "131.180.1.10", "/user/test/sessions"), 2)
+	assert.NoError(t, store.RevokeSessions("test", time.Now()))
+	assert.Empty(t, sessions(adminToken, "131.180.1.10", "/user/test/sessions"))
+	assert.Equal(t, http.StatusNotFound, request(adminToken, "131.180.1.10", "/user/nobody/sessions").Code)
+}
+
+func TestApi_SessionKeys(t *testing.T) {
+	store := newTestStore(t)
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+
+	old, err := config.GenerateSessionKey()
+	assert.NoError(t, err)
+	newer, err := config.GenerateSessionKey()
+	assert.NoError(t, err)
+
+	start := func(keys ...string) *testServer {
+		conf := config.Default()
+		conf.SessionCookieName = "baas"
+		conf.SessionKeys = keys
+		assert.NoError(t, conf.Validate())
+		return newTestServer(t, store, "/tmp", conf)
+	}
+	me := func(s *testServer, token string) int {
+		return s.requestToken(token, http.MethodGet, "/user/me", "").Code
+	}
+
+	// Sessions outlive a restart with the same keys
+	oldToken := start(old).token(test)
+	assert.Equal(t, http.StatusOK, me(start(old), oldToken))
+
+	// After a rotation the older key still opens the sessions it sealed, new ones are sealed with the newer key
+	s := start(old, newer)
+	assert.Equal(t, http.StatusOK, me(s, oldToken))
+	newToken := s.token(test)
+
+	s = start(newer)
+	assert.Equal(t, http.StatusOK, me(s, newToken))
+	assert.NotEqual(t, http.StatusOK, me(s, oldToken))
+
+	// The cookie of another control server is refused
+	assert.NotEqual(t, http.StatusOK, me(start(), newToken))
+}
+
+func TestNewSessionStore(t *testing.T) {
+	conf := config.Default()
+	options := newSessionStore(conf).Options
+	assert.Equal(t, "/", options.Path)
+	assert.Equal(t, 8*3600, options.MaxAge)
+	assert.True(t, options.HttpOnly)
+	assert.False(t, options.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, options.SameSite)
+
+	// Production deployments only send the cookie over TLS
+	key, err := config.GenerateSessionKey()
+	assert.NoError(t, err)
+	conf.Production = true
+	assert.Error(t, conf.Validate())
+	conf.SessionKeys = []string{key}
+	conf.SessionCookieSameSite = config.SameSiteNone
+	assert.NoError(t, conf.Validate())
+	options = newSessionStore(conf).Options
+	assert.True(t, options.Secure)
+	assert.Equal(t, http.SameSiteNoneMode, options.SameSite)
+
+	conf.Production = false
+	assert.Error(t, conf.Validate())
+	conf.SessionCookieSameSite = config.SameSiteStrict
+	conf.SessionKeys = []string{"c2hvcnQ="}
+	assert.Error(t, conf.Validate())
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxSSHKeySize is the largest public key accepted, RSA keys of 16384 bits still fit well within it
+const maxSSHKeySize = 8 << 10
+
+// parseSSHKey checks that the text is a single public key and returns the key in the format of authorized_keys
+func parseSSHKey(text string) (*usermodel.SSHKeyModel, error) {
+	if len(text) > maxSSHKeySize {
+		return nil, fmt.Errorf("the key is larger than %d bytes", maxSSHKeySize)
+	}
+
+	// Someone who pastes the wrong file should not get their private key stored
+	_, err := ssh.ParseRawPrivateKey([]byte(text))
+	var passphrase *ssh.PassphraseMissingError
+	if err == nil || errors.As(err, &passphrase) || strings.Contains(text, "PRIVATE KEY") {
+		return nil, errors.New("this is a private key, add the public key (the .pub file) instead")
+	}
+
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(text))
+	if err != nil {
+		return nil, errors.New("this is not an SSH public key")
+	}
+
+	if len(options) != 0 {
+		return nil, errors.New("keys cannot have options")
+	}
+
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, errors.New("add one key at a time")
+	}
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		line += " " + comment
+	}
+
+	return &usermodel.SSHKeyModel{Key: line, Fingerprint: ssh.FingerprintSHA256(key)}, nil
+}
+
+// addSSHKeys adds the keys of the user who queues a boot to its metadata, system requests add the keys of the
+// owner of the image setup
+func (api_ *API) addSSHKeys(r *http.Request, bootSetup *images.BootSetup, owner string) error {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		username = owner
+	}
+
+	keys, err := api_.storeFor(r).GetSSHKeys(username)
+	if err != nil {
+		return err
+	}
+
+	present := map[string]bool{}
+	for _, key := range bootSetup.Metadata.SSHAuthorizedKeys {
+		present[key] = true
+	}
+
+	for _, key := range keys {
+		if !present[key.Key] {
+			bootSetup.Metadata.SSHAuthorizedKeys = append(bootSetup.Metadata.SSHAuthorizedKeys, key.Key)
+		}
+	}
+
+	return nil
+}
+
+// GetSSHKeys lists the public keys of a user with their fingerprints
+// Example request: GET /user/jan/ssh-keys
+// Example response: [{"ID": 1, "Username": "jan", "Key": "ssh-ed25519 AAAA... jan@laptop",
+//
+//	"Fingerprint": "SHA256:6aHxSjzJ0gq4hM2kG8Uq3lC1rQ2eWzYV1p1n4xN0dU8", "CreatedAt": "2022-05-02T10:12:00Z"}]
+func (api_ *API) GetSSHKeys(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	keys, err := api_.storeFor(r).GetSSHKeys(username)
+	if ErrorWrite(w, err, "Cannot fetch the SSH keys") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewSSHKeys(keys))
+}
+
+// sshKeyRequest is the public key a user adds
+type sshKeyRequest struct {
+	Key string `description:"A single public key in the format of authorized_keys"`
+}
+
+// CreateSSHKey adds a public key to a user. Private keys, keys with options and keys the user already has are
+// refused.
+// Example request: POST /user/jan/ssh-keys
+// Example body: {"Key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHx... jan@laptop"}
+// Example response: 201 Created with the key and its fingerprint
+func (api_ *API) CreateSSHKey(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	var body sshKeyRequest
+
+	// The body holds little more than the key, anything much larger is not worth reading
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxSSHKeySize)
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid SSH key given", http.StatusBadRequest)
+		return
+	}
+
+	key, err := parseSSHKey(body.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key.Username = username
+	err = api_.storeFor(r).CreateSSHKey(key)
+	var constraint *database.ConstraintError
+	if errors.As(err, &constraint) && constraint.Kind == database.UniqueConstraint {
+		http.Error(w, "This key was already added", http.StatusConflict)
+		return
+	}
+
+	if StoreErrorWrite(w, err, "Cannot add the SSH key") != nil {
+		return
+	}
+
+	log.Infof("Added SSH key %s to %s", key.Fingerprint, username)
+	writeJSON(w, http.StatusCreated, types.NewSSHKey(key))
+}
+
+// DeleteSSHKey removes a public key of a user, boots which were queued with the key still add it
+// Example request: DELETE /user/jan/ssh-keys/1
+// Example response: 204 No Content
+func (api_ *API) DeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	username, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	tag, err := GetTag("id", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	id, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid SSH key id", http.StatusBadRequest)
+		return
+	}
+
+	key, err := api_.storeFor(r).GetSSHKey(uint(id))
+	if err != nil || key.Username != username {
+		http.Error(w, "SSH key not found", http.StatusNotFound)
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteSSHKey(key), "Cannot remove the SSH key") != nil {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterSSHKeyHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterSSHKeyHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/ssh-keys",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.GetSSHKeys,
+		Method:      http.MethodGet,
+		Description: "Lists the SSH keys of a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/ssh-keys",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersWrite,
+		Handler:     api_.CreateSSHKey,
+		Method:      http.MethodPost,
+		Schema:      "ssh-key",
+		Description: "Adds an SSH key to a user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/ssh-keys/{id}",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersWrite,
+		Handler:     api_.DeleteSSHKey,
+		Method:      http.MethodDelete,
+		Description: "Removes an SSH key of a user",
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// generateSSHKey makes a key pair, returning the public key as authorized_keys line and the private key as PEM
+func generateSSHKey(t *testing.T, comment string) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	key, err := ssh.NewPublicKey(public)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + comment
+	return line, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestParseSSHKey(t *testing.T) {
+	public, private := generateSSHKey(t, "jan@laptop")
+
+	key, err := parseSSHKey("  " + public + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, public, key.Key)
+	assert.True(t, strings.HasPrefix(key.Fingerprint, "SHA256:"))
+
+	other, _ := generateSSHKey(t, "")
+	for name, text := range map[string]string{
+		"private":  private,
+		"options":  `command="ls" ` + public,
+		"two keys": public + "\n" + other,
+		"garbage":  "ssh-ed25519 not-base64",
+		"too big":  public + strings.Repeat(" ", maxSSHKeySize),
+	} {
+		_, err = parseSSHKey(text)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestApi_SSHKeys(t *testing.T) {
+	store := newTestStore(t)
+
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac, Architecture: machinemodel.X86_64}))
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+	assert.NoError(t, store.CreateImageSetup("test", &images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	public, private := generateSSHKey(t, "test@laptop")
+	body, err := json.Marshal(map[string]string{"Key": public})
+	assert.NoError(t, err)
+
+	resp := s.request(http.MethodPost, "/user/test/ssh-keys", string(body))
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var created user.SSHKeyModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+	// The same key is refused, even with another comment, and private keys are never stored
+	body, err = json.Marshal(map[string]string{"Key": strings.TrimSuffix(public, "test@laptop") + "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, s.request(http.MethodPost, "/user/test/ssh-keys", string(body)).Code)
+	body, err = json.Marshal(map[string]string{"Key": private})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/user/test/ssh-keys", string(body)).Code)
+
+	resp = s.request(http.MethodGet, "/user/test/ssh-keys", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var keys []user.SSHKeyModel
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&keys))
+	assert.Len(t, keys, 1)
+	assert.Equal(t, created.Fingerprint, keys[0].Fingerprint)
+
+	// Boots of the user carry the keys in their metadata
+	resp = s.request(http.MethodPost, "/machine/abc/boot", `{"SetupUUID": "setup", "inject_ssh_keys": true,
+		"Metadata": {"SSHAuthorizedKeys": ["ssh-ed25519 AAAA template"]}}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var queued images.BootSetup
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&queued))
+	assert.True(t, queued.InjectSSHKeys)
+	assert.Equal(t, images.StringList{"ssh-ed25519 AAAA template", public}, queued.Metadata.SSHAuthorizedKeys)
+
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodDelete, "/user/other/ssh-keys/1", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.request(http.MethodDelete, "/user/test/ssh-keys/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodDelete, "/user/test/ssh-keys/1", "").Code)
+}
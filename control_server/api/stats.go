@@ -0,0 +1,143 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// statsDays is the number of days the boot setups are counted for, today included
+	statsDays = 30
+	// statsTopUsers is the number of users listed by the storage they use
+	statsTopUsers = 10
+)
+
+// adminStats is the overview of the admin dashboard
+type adminStats struct {
+	*database.Statistics
+	// OnDiskBytes is the size of the files on all storage tiers, compressed versions take up less than they count for
+	OnDiskBytes uint64
+
+	GeneratedAt     time.Time
+	CacheAgeSeconds float64
+}
+
+// statsCache keeps the last statistics, only one request counts them again when they are outdated
+type statsCache struct {
+	mu    sync.Mutex
+	stats *adminStats
+}
+
+// diskUsage sums the sizes of the files under the disk path, files which cannot be read are skipped
+func diskUsage(root string) uint64 {
+	var total uint64
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += uint64(info.Size())
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Warnf("Cannot determine the disk usage of %s: %v", root, err)
+	}
+
+	return total
+}
+
+// onDiskBytes sums the disk usage of the storage tiers, tiers which share a directory count once
+func (api_ *API) onDiskBytes() uint64 {
+	var total uint64
+	counted := map[string]bool{}
+	for _, dir := range api_.storageTiers() {
+		if dir = filepath.Clean(dir); !counted[dir] {
+			counted[dir] = true
+			total += diskUsage(dir)
+		}
+	}
+
+	return total
+}
+
+// fillDays adds the days without any boot setups, so every one of the last days is in the list
+func fillDays(counts []database.DayCount, now time.Time) []database.DayCount {
+	found := map[string]int64{}
+	for _, count := range counts {
+		found[count.Day] = count.Count
+	}
+
+	days := make([]database.DayCount, 0, statsDays)
+	for i := statsDays - 1; i >= 0; i-- {
+		day := now.UTC().AddDate(0, 0, -i).Format("2006-01-02")
+		days = append(days, database.DayCount{Day: day, Count: found[day]})
+	}
+
+	return days
+}
+
+// statistics returns the cached statistics, or counts them again once they are older than the configuration allows
+func (api_ *API) statistics() (*adminStats, error) {
+	api_.stats.mu.Lock()
+	defer api_.stats.mu.Unlock()
+
+	maxAge := time.Duration(api_.config.StatsCacheSeconds) * time.Second
+	if api_.stats.stats == nil || time.Since(api_.stats.stats.GeneratedAt) >= maxAge {
+		now := time.Now()
+		since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-statsDays)
+
+		stats, err := api_.store.GetStatistics(since, statsTopUsers)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.BootSetupsPerDay = fillDays(stats.BootSetupsPerDay, now)
+		api_.stats.stats = &adminStats{Statistics: stats, OnDiskBytes: api_.onDiskBytes(), GeneratedAt: now}
+	}
+
+	stats := *api_.stats.stats
+	stats.CacheAgeSeconds = time.Since(stats.GeneratedAt).Seconds()
+	return &stats, nil
+}
+
+// GetStats gives the overview of the users, images and machines for the admin dashboard
+// Example request: GET /admin/stats
+// Example response: {"UsersByRole": {"admin": 1, "user": 40}, "Images": 120, "TrashedImages": 3,
+//
+//	"Versions": 410, "LogicalBytes": 1099511627776, "OnDiskBytes": 549755813888,
+//	"MachinesByStatus": {"online": 10, "flashing": 2, "offline": 3, "maintenance": 1},
+//	"BootSetupsPerDay": [{"Day": "2022-01-01", "Count": 12}, ...],
+//	"TopUsersByStorage": [{"Username": "jan", "StorageBytes": 107374182400}, ...],
+//	"FailuresByReason": {"checksum_mismatch": 2, "download_failed": 5, "unknown": 1},
+//	"GeneratedAt": "2022-01-30T12:00:00Z", "CacheAgeSeconds": 12.5}
+func (api_ *API) GetStats(w http.ResponseWriter, _ *http.Request) {
+	stats, err := api_.statistics()
+	if ErrorWrite(w, err, "Cannot collect the statistics") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// RegisterStatsHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterStatsHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/stats",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetStats,
+		Method:      http.MethodGet,
+		Description: "Gets the statistics of the users, images and machines",
+	})
+}
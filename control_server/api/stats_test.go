@@ -0,0 +1,92 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Stats(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "stats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	for name, role := range map[string]user.UserRole{"admin": user.Admin, "jan": user.User, "piet": user.User} {
+		assert.NoError(t, store.CreateUser(&user.UserModel{Username: name, Email: name, Role: role}))
+	}
+
+	for name, size := range map[string]uint64{"jan": 300, "piet": 100} {
+		image := images.ImageModel{Name: "image", Username: name, UUID: images.ImageUUID(name)}
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.SetVersionSize(image.UUID, 0, size))
+	}
+	assert.NoError(t, store.TrashImage(&images.ImageModel{UUID: "piet"}))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(storage.ShardDir(diskpath, "jan"), "0.img"), make([]byte, 42), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(storage.ShardDir(diskpath, "piet"), "0.img"), make([]byte, 8), 0644))
+
+	assert.NoError(t, store.CreateImageSetup("jan", &images.ImageSetup{Name: "setup", UUID: "setup", Username: "jan"}))
+	for mac, managed := range map[string]bool{"aa": true, "bb": true, "cc": true, "dd": false} {
+		assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: mac, Managed: managed,
+			MacAddress: util.MacAddress{Address: mac}}))
+	}
+	assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "aa", SetupUUID: "setup",
+		State: images.BootCompleted}))
+	assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "bb", SetupUUID: "setup",
+		State: images.BootInProgress}))
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "aa", SetupUUID: "setup"}))
+
+	s := newTestServer(t, store, diskpath, config.Default())
+	request := func() *adminStats {
+		resp := s.request(http.MethodGet, "/admin/stats", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		stats := adminStats{Statistics: &database.Statistics{}}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+		return &stats
+	}
+
+	stats := request()
+	assert.Equal(t, map[user.UserRole]int64{user.Admin: 1, user.User: 2}, stats.UsersByRole)
+	assert.Equal(t, int64(1), stats.Images)
+	assert.Equal(t, int64(1), stats.TrashedImages)
+	assert.Equal(t, int64(1), stats.Versions)
+	assert.Equal(t, uint64(400), stats.LogicalBytes)
+	assert.Equal(t, uint64(50), stats.OnDiskBytes)
+	assert.Equal(t, map[database.MachineStatus]int64{database.MachineOnline: 1, database.MachineFlashing: 1,
+		database.MachineOffline: 1, database.MachineMaintenance: 1}, stats.MachinesByStatus)
+	assert.Equal(t, []database.UserStorage{{Username: "jan", StorageBytes: 300}, {Username: "piet", StorageBytes: 100}},
+		stats.TopUsersByStorage)
+
+	if assert.Len(t, stats.BootSetupsPerDay, statsDays) {
+		assert.Equal(t, int64(1), stats.BootSetupsPerDay[statsDays-1].Count)
+		assert.Equal(t, int64(0), stats.BootSetupsPerDay[0].Count)
+	}
+
+	// The statistics are served from the cache until they are outdated
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "kees", Email: "kees", Role: user.User}))
+	cached := request()
+	assert.Equal(t, stats.GeneratedAt.UnixNano(), cached.GeneratedAt.UnixNano())
+	assert.Equal(t, int64(2), cached.UsersByRole[user.User])
+	assert.GreaterOrEqual(t, cached.CacheAgeSeconds, 0.0)
+}
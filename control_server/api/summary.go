@@ -0,0 +1,183 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/limits"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// recentBoots is the number of boots shown in the summary of a user
+const recentBoots = 5
+
+// imageSummary is the amount of images and storage a user has, next to what they are allowed to have
+type imageSummary struct {
+	Count        int64
+	MaxImages    uint
+	StorageBytes uint64
+	TrashedBytes uint64
+	StorageLimit uint64
+}
+
+// machineSummary counts the machines the user may boot, a machine is online while its agent is checking in
+type machineSummary struct {
+	Total  int64
+	Online int
+}
+
+// userSummary is everything the dashboard shows on its landing page
+type userSummary struct {
+	User        types.User
+	Images      imageSummary
+	Machines    machineSummary
+	RecentBoots []images.BootHistory
+	// ActiveBoots are the jobs running for the user, the boots of their setups which are being flashed
+	ActiveBoots []images.BootHistory
+}
+
+// summarize collects the summary of a user. The queries are independent so they run concurrently, the first one which
+// fails interrupts the others and ctx does so when the request is gone.
+func (api_ *API) summarize(ctx context.Context, subject authz.Subject) (*userSummary, error) {
+	summary := userSummary{RecentBoots: []images.BootHistory{}, ActiveBoots: []images.BootHistory{}}
+	username := subject.Username
+
+	group, ctx := errgroup.WithContext(ctx)
+	store := api_.store.WithContext(ctx)
+	group.Go(func() error {
+		found, err := store.GetUserByUsername(username)
+		if err != nil {
+			return err
+		}
+
+		summary.User = types.NewUser(found)
+		return nil
+	})
+	group.Go(func() error {
+		count, err := store.CountImages(username)
+		if err != nil {
+			return err
+		}
+
+		usage, err := store.GetStorageUsage(username)
+		if err != nil {
+			return err
+		}
+
+		effective, err := limits.Effective(store, username)
+		if err != nil {
+			return err
+		}
+
+		summary.Images = imageSummary{
+			Count:        count,
+			MaxImages:    effective.MaxImages,
+			StorageBytes: usage.Used,
+			TrashedBytes: usage.Trashed,
+			StorageLimit: effective.StorageBytes,
+		}
+		return nil
+	})
+	group.Go(func() error {
+		machines, err := api_.accessibleMachines(store, subject)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		summary.Machines = machineSummary{Total: int64(len(machines))}
+		for _, m := range machines {
+			if api_.agents.online(m.MacAddress.Address, now) {
+				summary.Machines.Online++
+			}
+		}
+		return nil
+	})
+	group.Go(func() error {
+		recent, err := store.GetBootHistoryByUsername(username, database.ListOptions{Limit: recentBoots})
+		if err != nil {
+			return err
+		}
+
+		summary.RecentBoots = recent
+		return nil
+	})
+	group.Go(func() error {
+		active, err := store.GetActiveBootsByUsername(username)
+		if err != nil {
+			return err
+		}
+
+		summary.ActiveBoots = active
+		return nil
+	})
+
+	return &summary, group.Wait()
+}
+
+// accessibleMachines are the approved machines a user may boot, restricted machines count only when a grant, a
+// course or their moderator scope gives them access, as in authz.BootMachine
+func (api_ *API) accessibleMachines(store database.Store, subject authz.Subject) ([]machinemodel.MachineModel,
+	error) {
+	machines, err := store.GetMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	accessible := []machinemodel.MachineModel{}
+	for i := range machines {
+		if !machines[i].Approved() {
+			continue
+		}
+
+		decision, err := authz.BootMachine(store, subject, &machines[i], now)
+		if err != nil {
+			return nil, err
+		}
+
+		if decision.Allowed {
+			accessible = append(accessible, machines[i])
+		}
+	}
+
+	return accessible, nil
+}
+
+// GetSummary returns everything the dashboard shows about the logged-in user in a single response
+// Example request: GET user/me/summary
+// Example response: {"User": {"Username": "Jan", "Name": "Jan", "Email": "jan@example.com", "Role": "user"},
+//
+//	"Images": {"Count": 3, "MaxImages": 10, "StorageBytes": 4294967296, "TrashedBytes": 0,
+//	           "StorageLimit": 53687091200},
+//	"Machines": {"Total": 12, "Online": 2},
+//	"RecentBoots": [{"MachineMAC": "52:54:00:d9:71:93", "SetupUUID": "...", "State": "completed", ...}],
+//	"ActiveBoots": []}
+func (api_ *API) GetSummary(w http.ResponseWriter, r *http.Request) {
+	username := api_.sessionUsername(r)
+	if username == "" {
+		http.Error(w, "Cannot find username", http.StatusBadRequest)
+		return
+	}
+
+	subject := authz.Subject{Username: username, Role: api_.principal(r).Role}
+	summary, err := api_.summarize(r.Context(), subject)
+	if err != nil {
+		http.Error(w, "Cannot summarize the user", http.StatusInternalServerError)
+		log.Errorf("summarize %s: %v", username, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+}
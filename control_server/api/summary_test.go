@@ -0,0 +1,101 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Summary(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, name := range []string{"test", "other"} {
+		assert.NoError(t, store.CreateUser(&user.UserModel{Username: name, Email: name, Role: user.User}))
+		assert.NoError(t, store.CreateImageSetup(name, &images.ImageSetup{Name: "setup", UUID: images.ImageUUID(name),
+			Username: name}))
+	}
+	assert.NoError(t, store.SetRoleLimits(&user.RoleLimits{Role: user.User, Limits: user.Limits{MaxImages: 3}}))
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "image"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.SetVersionSize(image.UUID, 0, 512))
+
+	for _, mac := range []string{"abc", "def", "ghi"} {
+		assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: mac,
+			MacAddress: util.MacAddress{Address: mac}, Restricted: mac == "ghi"}))
+	}
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "test"}))
+	}
+	assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "def", SetupUUID: "test",
+		State: images.BootInProgress}))
+	assert.NoError(t, store.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "other"}))
+
+	api := NewAPI(store, "/tmp", config.Default())
+
+	// Machines are online while their agent checks in, whether or not it is flashing a boot
+	now := time.Now()
+	api.agents.record("abc", "v1", now)
+	api.agents.record("def", "v1", now.Add(-2*agentOnlineWindow))
+	api.agents.record("ghi", "v1", now)
+
+	// The restricted machine is not counted for users who have no access to it
+	test := authz.Subject{Username: "test", Role: user.User}
+	summary, err := api.summarize(context.Background(), test)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", summary.User.Username)
+	assert.Equal(t, imageSummary{Count: 1, MaxImages: 3, StorageBytes: 512}, summary.Images)
+	assert.Equal(t, machineSummary{Total: 2, Online: 1}, summary.Machines)
+
+	admin, err := api.summarize(context.Background(), authz.Subject{Username: "test", Role: user.Admin})
+	assert.NoError(t, err)
+	assert.Equal(t, machineSummary{Total: 3, Online: 2}, admin.Machines)
+
+	assert.NoError(t, store.CreateMachineGrant(&machinemodel.MachineGrant{MachineMAC: "ghi", Username: "test"}))
+	summary, err = api.summarize(context.Background(), test)
+	assert.NoError(t, err)
+	assert.Equal(t, machineSummary{Total: 3, Online: 2}, summary.Machines)
+	assert.Len(t, summary.ActiveBoots, 1)
+	assert.Len(t, summary.RecentBoots, recentBoots)
+	for _, boot := range summary.RecentBoots {
+		assert.Equal(t, images.ImageUUID("test"), boot.SetupUUID)
+	}
+
+	// Users without any boots get empty lists rather than null
+	summary, err = api.summarize(context.Background(), authz.Subject{Username: "other", Role: user.User})
+	assert.NoError(t, err)
+	assert.NotNil(t, summary.ActiveBoots)
+	assert.Len(t, summary.RecentBoots, 1)
+
+	// The summary is of the user of the session
+	login := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/user/me/summary", nil)
+	session, _ := api.session.New(req, "session-name")
+	session.Values["Username"] = "test"
+	assert.NoError(t, session.Save(req, login))
+
+	resp := httptest.NewRecorder()
+	req.Header.Set("Cookie", login.Header().Get("Set-Cookie"))
+	api.GetSummary(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var decoded userSummary
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+	assert.Equal(t, "test", decoded.User.Username)
+	assert.Equal(t, int64(1), decoded.Images.Count)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/telemetry"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// telemetryInterval is how often a report is sent, telemetryRetry how long to wait after one could not be
+	telemetryInterval = 7 * 24 * time.Hour
+	telemetryRetry    = 6 * time.Hour
+	// telemetryCheck is how often the control server looks whether a report is due, so a restart does not delay
+	// it by a week
+	telemetryCheck = time.Hour
+	// telemetryTimeout bounds sending a report, the endpoint being slow must not hold anything up
+	telemetryTimeout = 30 * time.Second
+)
+
+// telemetryReport is everything a report holds. Only counts go in it: no usernames, MAC addresses, image names or
+// anything else which tells who runs the deployment or what is on it.
+type telemetryReport struct {
+	InstallID     string
+	ServerVersion string
+	Machines      int64
+	Images        int64
+	// BootsLastWeek are the boot setups queued in the 7 days before the report
+	BootsLastWeek int64
+}
+
+// telemetryStatus is whether the telemetry is on and how sending the reports went
+type telemetryStatus struct {
+	Enabled  bool
+	Endpoint string
+	telemetry.State
+}
+
+// installID gives the install ID of the deployment, the first report generates it
+func installID(store database.Store) (string, error) {
+	state, err := store.GetTelemetryState()
+	if err != nil {
+		return "", err
+	}
+
+	if state.InstallID != "" {
+		return state.InstallID, nil
+	}
+
+	id := uuid.New().String()
+	return id, store.SetTelemetryInstallID(id)
+}
+
+// makeTelemetryReport counts what goes in a report at the given time, the preview and the reports which are sent
+// come from here both
+func makeTelemetryReport(store database.Store, now time.Time) ([]byte, error) {
+	id, err := installID(store)
+	if err != nil {
+		return nil, fmt.Errorf("install ID: %w", err)
+	}
+
+	machines, err := store.CountMachines()
+	if err != nil {
+		return nil, fmt.Errorf("count machines: %w", err)
+	}
+
+	stats, err := store.GetStatistics(now.Add(-7*24*time.Hour), 0)
+	if err != nil {
+		return nil, fmt.Errorf("count images and boots: %w", err)
+	}
+
+	report := telemetryReport{InstallID: id, ServerVersion: api_pkg.Version, Machines: machines,
+		Images: stats.Images}
+	for _, day := range stats.BootSetupsPerDay {
+		report.BootsLastWeek += day.Count
+	}
+
+	return json.MarshalIndent(report, "", "  ")
+}
+
+// telemetryDue reports whether a report should be sent, the last one was sent a week ago and the last attempt
+// did not fail recently
+func telemetryDue(state *telemetry.State, now time.Time) bool {
+	if state.SentAt != nil && now.Sub(*state.SentAt) < telemetryInterval {
+		return false
+	}
+
+	return state.AttemptedAt == nil || state.LastError == "" || now.Sub(*state.AttemptedAt) >= telemetryRetry
+}
+
+// sendTelemetry posts a report to the endpoint and records how it went. Whatever goes wrong is only logged, the
+// telemetry never gets in the way of the control server.
+func (api_ *API) sendTelemetry(ctx context.Context, now time.Time) {
+	err := api_.postTelemetry(ctx, now)
+	failure := ""
+	if err != nil {
+		failure = err.Error()
+		log.Warnf("Cannot send the telemetry report: %v", err)
+	} else {
+		log.Infof("Sent the telemetry report to %s", api_.config.TelemetryEndpoint)
+	}
+
+	if err = api_.store.RecordTelemetryAttempt(now, failure); err != nil {
+		log.Warnf("Cannot record sending the telemetry report: %v", err)
+	}
+}
+
+// postTelemetry makes a report and posts it to the endpoint
+func (api_ *API) postTelemetry(ctx context.Context, now time.Time) error {
+	body, err := makeTelemetryReport(api_.store, now)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, telemetryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api_.config.TelemetryEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the endpoint answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// startTelemetry sends a report every telemetryInterval in the background, when the operator turned it on
+func (api_ *API) startTelemetry() {
+	if !api_.config.Telemetry {
+		return
+	}
+
+	log.Infof("Sending anonymous telemetry reports to %s, see GET /admin/telemetry/preview",
+		api_.config.TelemetryEndpoint)
+	go func() {
+		for {
+			now := time.Now()
+			state, err := api_.store.GetTelemetryState()
+			if err != nil {
+				log.Warnf("Cannot fetch the state of the telemetry: %v", err)
+			} else if telemetryDue(state, now) {
+				api_.sendTelemetry(context.Background(), now)
+			}
+
+			time.Sleep(telemetryCheck)
+		}
+	}()
+}
+
+// PreviewTelemetry gives the report exactly as it would be sent now, whether the telemetry is on or not
+// Example request: GET /admin/telemetry/preview
+// Example response: {"InstallID": "5b0e5a8e-4f4d-4f4e-9a3e-2c1b8f0d7e61", "ServerVersion": "v1.4.0",
+// "Machines": 48, "Images": 310, "BootsLastWeek": 1290}
+func (api_ *API) PreviewTelemetry(w http.ResponseWriter, r *http.Request) {
+	body, err := makeTelemetryReport(api_.storeFor(r), time.Now())
+	if ErrorWrite(w, err, "Cannot make the telemetry report") != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// GetTelemetry tells whether the telemetry is on, where it sends to and how sending the last report went
+// Example request: GET /admin/telemetry
+// Example response: {"Enabled": true, "Endpoint": "https://telemetry.example.org/baas", "ID": 1,
+// "InstallID": "5b0e5a8e-4f4d-4f4e-9a3e-2c1b8f0d7e61", "SentAt": "2022-05-02T10:12:00Z", ...}
+func (api_ *API) GetTelemetry(w http.ResponseWriter, r *http.Request) {
+	state, err := api_.storeFor(r).GetTelemetryState()
+	if ErrorWrite(w, err, "Cannot fetch the state of the telemetry") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, telemetryStatus{Enabled: api_.config.Telemetry,
+		Endpoint: api_.config.TelemetryEndpoint, State: *state})
+}
+
+// RegenerateInstallID replaces the install ID with a new random one, the reports sent from now on cannot be tied
+// to the earlier ones
+// Example request: POST /admin/telemetry/install-id
+// Example response: {"Enabled": true, "InstallID": "0d7b4c8e-3a0e-4b8e-8f8c-6f2a1d9e5b47", ...}
+func (api_ *API) RegenerateInstallID(w http.ResponseWriter, r *http.Request) {
+	if ErrorWrite(w, api_.storeFor(r).SetTelemetryInstallID(uuid.New().String()),
+		"Cannot replace the install ID") != nil {
+		return
+	}
+
+	requestLog(r).WithField("audit", "telemetry-install-id-regenerated").
+		Infof("%s replaced the telemetry install ID", api_.requester(r))
+	api_.GetTelemetry(w, r)
+}
+
+// RegisterTelemetryHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterTelemetryHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/telemetry",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetTelemetry,
+		Method:      http.MethodGet,
+		Description: "Tells whether the anonymous telemetry is on and how sending the last report went",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/telemetry/preview",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.PreviewTelemetry,
+		Method:      http.MethodGet,
+		Description: "Shows the anonymous telemetry report exactly as it would be sent",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/telemetry/install-id",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.RegenerateInstallID,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Replaces the install ID of the telemetry with a new random one",
+	})
+}
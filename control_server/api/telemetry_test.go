@@ -0,0 +1,108 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/telemetry"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_Telemetry(t *testing.T) {
+	store := newTestStore(t)
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}))
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "secret-project", Username: "jan", UUID: "image"}))
+	assert.NoError(t, store.CreateImageSetup("jan", &images.ImageSetup{Name: "setup", UUID: "setup", Username: "jan"}))
+	for _, mac := range []string{"52:54:00:d9:71:93", "52:54:00:d9:71:94"} {
+		assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{Name: mac,
+			MacAddress: util.MacAddress{Address: mac}}))
+	}
+	assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "52:54:00:d9:71:93",
+		SetupUUID: "setup"}))
+
+	var received []byte
+	status := http.StatusNoContent
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer endpoint.Close()
+
+	// The telemetry is off by default, the preview shows what would be sent anyway
+	conf := config.Default()
+	assert.False(t, conf.Telemetry)
+	conf.Telemetry = true
+	assert.Error(t, conf.Validate())
+	conf.TelemetryEndpoint = endpoint.URL
+	assert.NoError(t, conf.Validate())
+
+	s := newTestServer(t, store, "/tmp", conf)
+
+	resp := s.request(http.MethodGet, "/admin/telemetry/preview", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	preview := resp.Body.String()
+	for _, private := range []string{"jan", "secret-project", "52:54:00", "setup"} {
+		assert.NotContains(t, preview, private)
+	}
+
+	var report telemetryReport
+	assert.NoError(t, json.Unmarshal([]byte(preview), &report))
+	assert.NotEmpty(t, report.InstallID)
+	assert.Equal(t, telemetryReport{InstallID: report.InstallID, ServerVersion: api_pkg.Version, Machines: 2,
+		Images: 1, BootsLastWeek: 1}, report)
+
+	// What is sent is exactly the preview
+	s.api.sendTelemetry(context.Background(), time.Now())
+	assert.Equal(t, preview, string(received))
+	state, err := store.GetTelemetryState()
+	assert.NoError(t, err)
+	assert.NotNil(t, state.SentAt)
+	assert.Empty(t, state.LastError)
+	assert.False(t, telemetryDue(state, time.Now()))
+
+	// Failures are only recorded
+	status = http.StatusInternalServerError
+	later := time.Now().Add(telemetryInterval)
+	s.api.sendTelemetry(context.Background(), later)
+	state, err = store.GetTelemetryState()
+	assert.NoError(t, err)
+	assert.Contains(t, state.LastError, "500")
+	assert.False(t, telemetryDue(state, later.Add(time.Hour)))
+	assert.True(t, telemetryDue(state, later.Add(telemetryRetry)))
+
+	resp = s.request(http.MethodPost, "/admin/telemetry/install-id", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var described telemetryStatus
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&described))
+	assert.True(t, described.Enabled)
+	assert.NotEmpty(t, described.InstallID)
+	assert.NotEqual(t, report.InstallID, described.InstallID)
+	assert.Contains(t, s.request(http.MethodGet, "/admin/telemetry/preview", "").Body.String(), described.InstallID)
+}
+
+func TestTelemetryDue(t *testing.T) {
+	now := time.Now()
+	assert.True(t, telemetryDue(&telemetry.State{}, now))
+
+	sent := now.Add(-telemetryInterval + time.Hour)
+	assert.False(t, telemetryDue(&telemetry.State{SentAt: &sent, AttemptedAt: &sent}, now))
+
+	sent = now.Add(-telemetryInterval)
+	assert.True(t, telemetryDue(&telemetry.State{SentAt: &sent, AttemptedAt: &sent}, now))
+}
@@ -0,0 +1,689 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// migrationRunning migrations are copying the files of the image
+	migrationRunning = "running"
+	// migrationSucceeded migrations moved the image, its files are only on the new tier
+	migrationSucceeded = "succeeded"
+	// migrationFailed migrations left the image where it was
+	migrationFailed = "failed"
+)
+
+var (
+	// errMigrating is returned when the files of an image are written while a migration copies them
+	errMigrating = errors.New("the image is being moved to another storage tier")
+	// errWriting is returned when an image is migrated while its files are written
+	errWriting = errors.New("the files of the image are being written")
+	// errResharding is returned when the files of an image are written while they are moved into their shard
+	errResharding = errors.New("the files of the image are being moved into their shard")
+)
+
+// migration moves the files of an image from one storage tier to another
+type migration struct {
+	Image images.ImageUUID
+	From  string
+	To    string
+	State string
+	Error string `json:",omitempty"`
+	// Bytes is how much of the files was copied so far
+	Bytes uint64
+	// Mechanism is reflink when every file was cloned, and copy once a file had to be copied byte by byte
+	Mechanism  storage.Mechanism `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// tierMoves keeps track of the migrations and of the requests writing the files of images. A migration only starts
+// when nothing writes the files of its image, which are not written again until it finished.
+type tierMoves struct {
+	mu      sync.Mutex
+	writers map[images.ImageUUID]int
+	// last is the last migration of every image since the control server started
+	last map[images.ImageUUID]*migration
+	// resharding are the images the rebalance is moving into their shard
+	resharding map[images.ImageUUID]bool
+}
+
+func newTierMoves() *tierMoves {
+	return &tierMoves{writers: map[images.ImageUUID]int{}, last: map[images.ImageUUID]*migration{},
+		resharding: map[images.ImageUUID]bool{}}
+}
+
+// write claims the files of an image for writing, the returned function releases them again
+func (m *tierMoves) write(uuid images.ImageUUID) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job, ok := m.last[uuid]; ok && job.State == migrationRunning {
+		return nil, errMigrating
+	}
+
+	if m.resharding[uuid] {
+		return nil, errResharding
+	}
+
+	m.writers[uuid]++
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.writers[uuid]--; m.writers[uuid] == 0 {
+			delete(m.writers, uuid)
+		}
+	}, nil
+}
+
+// begin registers a migration, unless the image is migrated or written already
+func (m *tierMoves) begin(job *migration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if last, ok := m.last[job.Image]; ok && last.State == migrationRunning {
+		return errMigrating
+	}
+
+	if m.writers[job.Image] != 0 {
+		return errWriting
+	}
+
+	if m.resharding[job.Image] {
+		return errResharding
+	}
+
+	m.last[job.Image] = job
+	return nil
+}
+
+// reshard claims the files of an image for moving them into their shard, the returned function releases them again
+func (m *tierMoves) reshard(uuid images.ImageUUID) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job, ok := m.last[uuid]; ok && job.State == migrationRunning {
+		return nil, errMigrating
+	}
+
+	if m.writers[uuid] != 0 {
+		return nil, errWriting
+	}
+
+	m.resharding[uuid] = true
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.resharding, uuid)
+	}, nil
+}
+
+// copied counts the bytes a migration copied
+func (m *tierMoves) copied(uuid images.ImageUUID, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.last[uuid].Bytes += uint64(n)
+}
+
+// cloned records how a file of a migration was copied
+func (m *tierMoves) cloned(uuid images.ImageUUID, mechanism storage.Mechanism) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job := m.last[uuid]; job.Mechanism != storage.Copy {
+		job.Mechanism = mechanism
+	}
+}
+
+// finish records how a migration ended
+func (m *tierMoves) finish(uuid images.ImageUUID, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := m.last[uuid]
+	now := time.Now()
+	job.FinishedAt = &now
+	job.State = migrationSucceeded
+	if err != nil {
+		job.State = migrationFailed
+		job.Error = err.Error()
+	}
+}
+
+// get returns a copy of the last migration of an image
+func (m *tierMoves) get(uuid images.ImageUUID) (migration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.last[uuid]
+	if !ok {
+		return migration{}, false
+	}
+
+	return *job, true
+}
+
+// progressWriter reports the bytes which are copied to the migration
+type progressWriter struct {
+	moves *tierMoves
+	uuid  images.ImageUUID
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	p.moves.copied(p.uuid, int64(len(b)))
+	return len(b), nil
+}
+
+// storageTiers are the directories of the storage tiers by their names, the disk path is the default tier
+func (api_ *API) storageTiers() map[string]string {
+	tiers := map[string]string{images.DiskPathTier: api_.diskpath}
+	for name, dir := range api_.config.StorageTiers {
+		if name != images.DiskPathTier {
+			tiers[name] = dir
+		}
+	}
+
+	return tiers
+}
+
+// defaultTier is the tier new images are stored on
+func (api_ *API) defaultTier() string {
+	if api_.config.StorageDefaultTier == "" {
+		return images.DiskPathTier
+	}
+
+	return api_.config.StorageDefaultTier
+}
+
+// placement is the tier an image belongs on
+func (api_ *API) placement(image *images.ImageModel) string {
+	if image.Placement != "" {
+		return image.Placement
+	}
+
+	return api_.defaultTier()
+}
+
+// checkStorageTiers makes sure the default tier exists and creates the directories of the tiers
+func (api_ *API) checkStorageTiers() error {
+	tiers := api_.storageTiers()
+	if _, ok := tiers[api_.defaultTier()]; !ok {
+		return fmt.Errorf("the default storage tier %s is not configured", api_.defaultTier())
+	}
+
+	for name, dir := range tiers {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("create the directory of storage tier %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// placeImage stores a new image on the default tier
+func (api_ *API) placeImage(image *images.ImageModel) {
+	image.Tier = api_.defaultTier()
+	image.ImagePath = api_.storageTiers()[image.Tier]
+	image.Placement = ""
+}
+
+// imageRoot is the directory of the tier holding the files of an image. Images whose path was never recorded are
+// stored in the disk path.
+func imageRoot(diskpath string, image *images.ImageModel) string {
+	if image.ImagePath == "" {
+		return diskpath
+	}
+
+	return image.ImagePath
+}
+
+// imageDir is the directory holding the files of an image, see storage.Dir
+func (api_ *API) imageDir(image *images.ImageModel) string {
+	return storage.Dir(imageRoot(api_.diskpath, image), string(image.UUID))
+}
+
+// versionFile is where the file of a version is stored
+func (api_ *API) versionFile(image *images.ImageModel, version uint64) string {
+	return api_.imageDir(image) + "/" + fmt.Sprintf(images.VersionFileFmt, version)
+}
+
+// openVersion opens the file of a version. A migration may have moved the image to another tier or into its shard
+// since the image was fetched, the image is then fetched again to find where its files went.
+func (api_ *API) openVersion(image *images.ImageModel, version uint64) (*os.File, error) {
+	path := api_.versionFile(image, version)
+	f, err := os.Open(path)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+
+	current, lookupErr := api_.store.GetImageByUUID(image.UUID)
+	if lookupErr != nil || api_.versionFile(current, version) == path {
+		return nil, err
+	}
+
+	return os.Open(api_.versionFile(current, version))
+}
+
+// removeImageFiles removes the directory of an image from every tier in either layout, which includes what failed
+// migrations left
+func (api_ *API) removeImageFiles(uuid images.ImageUUID) error {
+	for _, dir := range api_.storageTiers() {
+		for _, path := range []string{storage.FlatDir(dir, string(uuid)), storage.ShardDir(dir, string(uuid))} {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// claimFiles claims the files of an image for writing them and makes sure the image points to where they are now, a
+// migration may have moved them since the image was fetched
+func (api_ *API) claimFiles(image *images.ImageModel) (func(), error) {
+	release, err := api_.moves.write(image.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := api_.store.GetImageByUUID(image.UUID)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	image.Tier, image.ImagePath = current.Tier, current.ImagePath
+	return release, nil
+}
+
+// beginWrite claims the files of an image for a request which writes them. When a migration is moving them a 409 is
+// written and false is returned.
+func (api_ *API) beginWrite(w http.ResponseWriter, image *images.ImageModel) (func(), bool) {
+	release, err := api_.claimFiles(image)
+	if errors.Is(err, errMigrating) || errors.Is(err, errResharding) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, false
+	}
+
+	if ErrorWrite(w, err, "Cannot look up the image") != nil {
+		return nil, false
+	}
+
+	return release, true
+}
+
+// findImage looks up the image in the URI, regardless of who owns it
+func (api_ *API) findImage(w http.ResponseWriter, r *http.Request) (*images.ImageModel, error) {
+	uuid, err := GetTag("uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uuid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The image does not exist", http.StatusNotFound)
+		return nil, err
+	}
+
+	return image, ErrorWrite(w, err, "Cannot fetch the image")
+}
+
+// copyTierFile copies a file of an image to another tier and returns its checksum. Tiers on the same filesystem get
+// a reflink when the filesystem supports them, the checksum is empty then since the blocks are shared rather than
+// read.
+func (api_ *API) copyTierFile(uuid images.ImageUUID, src string, dest string) (string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var sum string
+	var n int64
+	err = storage.Share(out, in)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = out.Stat(); err == nil {
+			n = info.Size()
+			api_.moves.copied(uuid, n)
+			api_.moves.cloned(uuid, storage.Reflink)
+		}
+	} else if errors.Is(err, storage.ErrNotSupported) {
+		hash := sha256.New()
+		n, err = storage.CopySparse(out, io.TeeReader(in, io.MultiWriter(hash, progressWriter{api_.moves, uuid})))
+		sum = hex.EncodeToString(hash.Sum(nil))
+		api_.moves.cloned(uuid, storage.Copy)
+	}
+
+	if err == nil {
+		// The copy has to be on disk before the image points to it
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return sum, n, err
+}
+
+// copyImage copies the files of an image to dest, the versions are checked against their checksums
+func (api_ *API) copyImage(image *images.ImageModel, src string, dest string) error {
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+
+	checksums := map[string]string{}
+	for _, version := range image.Versions {
+		checksums[fmt.Sprintf(images.VersionFileFmt, version.Version)] = version.SHA256
+	}
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Uploads which never finished are left behind
+		if !entry.Mode().IsRegular() || strings.HasSuffix(entry.Name(), ".part") {
+			continue
+		}
+
+		sum, n, err := api_.copyTierFile(image.UUID, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		if n != entry.Size() {
+			return fmt.Errorf("copied %d of the %d bytes of %s", n, entry.Size(), entry.Name())
+		}
+
+		if expected := checksums[entry.Name()]; expected != "" && sum != "" && !strings.EqualFold(expected, sum) {
+			return fmt.Errorf("the copy of %s does not match its checksum", entry.Name())
+		}
+	}
+
+	dir, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// migrate moves the files of an image to another tier. The image only points to the new tier once all files were
+// copied, until then it is read from the original tier. When anything fails the copy is removed again.
+func (api_ *API) migrate(image *images.ImageModel, tier string, root string) {
+	src := api_.imageDir(image)
+	dest := storage.ShardDir(root, string(image.UUID))
+
+	// Tiers may share a directory, then only the pointer moves and the files stay in the layout they are in
+	same := filepath.Clean(imageRoot(api_.diskpath, image)) == filepath.Clean(root)
+
+	var err error
+	if !same {
+		err = api_.copyImage(image, src, dest)
+	}
+
+	if err == nil {
+		var moved bool
+		moved, err = api_.store.MoveImage(image.UUID, image.ImagePath, tier, root)
+		if err == nil && !moved {
+			err = errors.New("the image was moved or removed while it was copied")
+		}
+	}
+
+	if err != nil {
+		if !same {
+			if removeErr := os.RemoveAll(dest); removeErr != nil {
+				log.Warnf("Cannot remove the copy of image %s on tier %s: %v", image.UUID, tier, removeErr)
+			}
+		}
+
+		log.Errorf("Cannot move image %s from tier %s to tier %s: %v", image.UUID, image.Tier, tier, err)
+		api_.moves.finish(image.UUID, err)
+		return
+	}
+
+	// Downloads which already opened the old files keep reading them
+	if !same {
+		if err = os.RemoveAll(src); err != nil {
+			log.Warnf("Cannot remove image %s from tier %s: %v", image.UUID, image.Tier, err)
+		}
+	}
+
+	log.Infof("Moved image %s from tier %s to tier %s", image.UUID, image.Tier, tier)
+	api_.moves.finish(image.UUID, nil)
+}
+
+// tierRequest names the storage tier an image is put on
+type tierRequest struct {
+	Tier string `description:"The storage tier to put the image on, empty to follow the default tier"`
+}
+
+// SetImageTier puts an image on a storage tier, an empty tier makes the image follow the default tier again. The
+// files stay where they are until the image is migrated.
+// Example request: PUT /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/tier {"Tier": "fast"}
+// Example response: {"Name": "Gentoo", "UUID": "57bf0cd3-...", "Tier": "default", "Placement": "fast", ...}
+func (api_ *API) SetImageTier(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findImage(w, r)
+	if err != nil {
+		return
+	}
+
+	var request tierRequest
+	if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid tier given", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := api_.storageTiers()[request.Tier]; !ok && request.Tier != "" {
+		http.Error(w, "Unknown storage tier "+request.Tier, http.StatusBadRequest)
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).SetImagePlacement(image.UUID, request.Tier), "Cannot store the tier") != nil {
+		return
+	}
+
+	requestLog(r).Infof("Placed image %s on tier %q", image.UUID, request.Tier)
+	image.Placement = request.Tier
+	writeJSON(w, http.StatusOK, types.NewImage(image))
+}
+
+// MigrateImage moves the files of an image to another storage tier in the background, to the tier the image was put
+// on when no tier is given. The image is readable all along, the migration it answers with tells how it is going.
+// Example request: POST /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/migrate?tier=fast
+// Example response: {"Image": "57bf0cd3-...", "From": "default", "To": "fast", "State": "running", "Bytes": 0,
+//
+//	"StartedAt": "2022-06-01T12:00:00Z"}
+func (api_ *API) MigrateImage(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findImage(w, r)
+	if err != nil {
+		return
+	}
+
+	tier := r.URL.Query().Get("tier")
+	if tier == "" {
+		tier = api_.placement(image)
+	}
+
+	root, ok := api_.storageTiers()[tier]
+	if !ok {
+		http.Error(w, "Unknown storage tier "+tier, http.StatusBadRequest)
+		return
+	}
+
+	if tier == image.Tier {
+		http.Error(w, "The image is stored on tier "+tier+" already", http.StatusConflict)
+		return
+	}
+
+	// Machines flashing the image would lose the files they are about to download
+	if !api_.checkUnlocked(w, image.UUID, nil) {
+		return
+	}
+
+	job := &migration{Image: image.UUID, From: image.Tier, To: tier, State: migrationRunning, StartedAt: time.Now()}
+	if err = api_.moves.begin(job); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	requestLog(r).Infof("Moving image %s from tier %s to tier %s", image.UUID, image.Tier, tier)
+	started, _ := api_.moves.get(image.UUID)
+	go api_.migrate(image, tier, root)
+
+	writeJSON(w, http.StatusAccepted, started)
+}
+
+// GetMigration follows the last migration of an image, migrations are forgotten when the control server restarts
+// Example request: GET /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/migrate
+// Example response: {"Image": "57bf0cd3-...", "From": "default", "To": "fast", "State": "succeeded",
+//
+//	"Bytes": 4294967296, "StartedAt": "2022-06-01T12:00:00Z", "FinishedAt": "2022-06-01T12:03:00Z"}
+func (api_ *API) GetMigration(w http.ResponseWriter, r *http.Request) {
+	image, err := api_.findImage(w, r)
+	if err != nil {
+		return
+	}
+
+	job, ok := api_.moves.get(image.UUID)
+	if !ok {
+		http.Error(w, "The image was not migrated", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// tierStats is the usage of a storage tier
+type tierStats struct {
+	database.TierUsage
+	Directory string
+	Default   bool
+	// OnDiskBytes is the size of the files in the directory of the tier
+	OnDiskBytes uint64
+}
+
+// GetStorageStats reports what the images on every storage tier take up, and how the scrubber is doing
+// Example request: GET /admin/storage/stats
+// Example response: {"Tiers": [{"Tier": "default", "Images": 110, "Versions": 380, "LogicalBytes": 1099511627776,
+//
+//	"Directory": "/disks", "Default": true, "OnDiskBytes": 549755813888},
+//	{"Tier": "fast", "Images": 10, "Versions": 30, ...}],
+//	"Scrub": {"Running": true, "LastFullPass": "2022-06-01T03:12:00Z", "FilesChecked": 760, "CorruptionsFound": 1}}
+func (api_ *API) GetStorageStats(w http.ResponseWriter, _ *http.Request) {
+	usage, err := api_.store.GetTierUsage()
+	if ErrorWrite(w, err, "Cannot count the usage of the storage tiers") != nil {
+		return
+	}
+
+	counted := map[string]database.TierUsage{}
+	for _, tier := range usage {
+		counted[tier.Tier] = tier
+	}
+
+	tiers := api_.storageTiers()
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats := []tierStats{}
+	for _, name := range names {
+		tier := counted[name]
+		tier.Tier = name
+		stats = append(stats, tierStats{TierUsage: tier, Directory: tiers[name], Default: name == api_.defaultTier(),
+			OnDiskBytes: diskUsage(tiers[name])})
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Tiers []tierStats
+		Scrub scrubStatus
+	}{stats, api_.scrub.Status()})
+}
+
+// RegisterTierHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterTierHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/tier",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.SetImageTier,
+		Method:      http.MethodPut,
+		Schema:      "image-tier",
+		Description: "Puts an image on a storage tier",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/migrate",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.MigrateImage,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Moves the files of an image to another storage tier",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/migrate",
+		Permissions: []user.UserRole{user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetMigration,
+		Method:      http.MethodGet,
+		Description: "Follows the migration of an image to another storage tier",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/storage/stats",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: false,
+		Scope:       user.ScopeAdmin,
+		Handler:     api_.GetStorageStats,
+		Method:      http.MethodGet,
+		Description: "Gets the usage of the storage tiers",
+	})
+}
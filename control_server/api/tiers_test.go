@@ -0,0 +1,138 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_StorageTiers(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+	owner := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(owner))
+
+	diskpath, err := ioutil.TempDir("", "tier-default")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	fast, err := ioutil.TempDir("", "tier-fast")
+	assert.NoError(t, err)
+	defer os.RemoveAll(fast)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	image := images.ImageModel{Name: "course", Username: "alice", UUID: "course"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "course"}))
+	content := []byte("the disk of the course")
+	assert.NoError(t, ioutil.WriteFile(image.VersionFile(1), content, 0644))
+	sum := sha256.Sum256(content)
+	assert.NoError(t, store.SetVersionChecksum("course", 1, hex.EncodeToString(sum[:])))
+
+	conf := config.Default()
+	conf.StorageTiers = map[string]string{"fast": fast}
+	s := newTestServer(t, store, diskpath, conf)
+	assert.NoError(t, s.api.checkStorageTiers())
+
+	// migrate moves the image and waits for the migration to finish
+	migrate := func(uri string) migration {
+		resp := s.requestAs(admin, http.MethodPost, uri, "")
+		assert.Equal(t, http.StatusAccepted, resp.Code)
+
+		var job migration
+		assert.Eventually(t, func() bool {
+			resp = s.requestAs(admin, http.MethodGet, "/image/course/migrate", "")
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &job))
+			return job.State != migrationRunning
+		}, 5*time.Second, 10*time.Millisecond)
+
+		return job
+	}
+
+	download := func() string {
+		resp := s.requestAs(owner, http.MethodGet, "/image/course/1", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		return resp.Body.String()
+	}
+
+	// Only admins put images on tiers, and only on tiers which exist
+	assert.Equal(t, http.StatusForbidden, s.requestAs(owner, http.MethodPut, "/image/course/tier",
+		`{"Tier": "fast"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(admin, http.MethodPut, "/image/course/tier",
+		`{"Tier": "tape"}`).Code)
+
+	resp := s.requestAs(admin, http.MethodPut, "/image/course/tier", `{"Tier": "fast"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var placed images.ImageModel
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &placed))
+	assert.Equal(t, images.DiskPathTier, placed.Tier)
+	assert.Equal(t, "fast", placed.Placement)
+
+	// Without a tier the image goes where it was put
+	job := migrate("/image/course/migrate")
+	assert.Equal(t, migrationSucceeded, job.State, job.Error)
+	assert.Equal(t, "fast", job.To)
+	assert.Equal(t, uint64(len(content)+512<<20), job.Bytes)
+
+	moved, err := store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", moved.Tier)
+	assert.Equal(t, fast, moved.ImagePath)
+	assert.NoDirExists(t, storage.ShardDir(diskpath, "course"))
+	assert.FileExists(t, moved.VersionFile(0))
+	assert.Equal(t, string(content), download())
+
+	assert.Equal(t, http.StatusConflict, s.requestAs(admin, http.MethodPost, "/image/course/migrate", "").Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(admin, http.MethodPost, "/image/course/migrate?tier=tape", "").Code)
+
+	// A copy which does not match the checksum leaves the image where it was
+	assert.NoError(t, store.SetVersionChecksum("course", 1, hex.EncodeToString(make([]byte, sha256.Size))))
+	job = migrate("/image/course/migrate?tier=default")
+	assert.Equal(t, migrationFailed, job.State)
+	assert.Contains(t, job.Error, "checksum")
+
+	moved, err = store.GetImageByUUID("course")
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", moved.Tier)
+	assert.NoDirExists(t, storage.ShardDir(diskpath, "course"))
+	assert.Equal(t, string(content), download())
+
+	// Files which are being written are not moved from under the writer
+	release, err := s.api.moves.write("course")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, s.requestAs(admin, http.MethodPost,
+		"/image/course/migrate?tier=default", "").Code)
+	release()
+
+	resp = s.requestAs(admin, http.MethodGet, "/admin/storage/stats", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var stats struct{ Tiers []tierStats }
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.Len(t, stats.Tiers, 2)
+	assert.Equal(t, images.DiskPathTier, stats.Tiers[0].Tier)
+	assert.True(t, stats.Tiers[0].Default)
+	assert.Equal(t, int64(0), stats.Tiers[0].Images)
+	assert.Equal(t, "fast", stats.Tiers[1].Tier)
+	assert.Equal(t, int64(1), stats.Tiers[1].Images)
+	assert.Equal(t, int64(2), stats.Tiers[1].Versions)
+	assert.NotZero(t, stats.Tiers[1].OnDiskBytes)
+}
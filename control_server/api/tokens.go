@@ -0,0 +1,120 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// requiredScope is the scope a token needs for a route. A route which does not name its scope needs the admin scope,
+// so forgetting it never lets a scoped token through.
+func (route *Route) requiredScope() user.TokenScope {
+	if route.Scope == "" {
+		return user.ScopeAdmin
+	}
+
+	return route.Scope
+}
+
+// grantsScope reports whether a role may use any route which needs the scope, either through the role or by
+// owning the resource. Only administrators can hand out the admin scope.
+func (api_ *API) grantsScope(role user.UserRole, scope user.TokenScope) bool {
+	if role == user.Admin {
+		return true
+	} else if scope == user.ScopeAdmin {
+		return false
+	}
+
+	for i := range api_.Routes {
+		route := &api_.Routes[i]
+		if route.requiredScope() != scope {
+			continue
+		}
+
+		if route.UserAllowed {
+			return true
+		}
+
+		for _, permitted := range route.Permissions {
+			if permitted == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// tokenRequest is the body of a request for a scoped token
+type tokenRequest struct {
+	Scopes []user.TokenScope
+}
+
+// scopeError is the response to a request for a scope which cannot be handed out
+type scopeError struct {
+	Error string
+	Scope user.TokenScope
+}
+
+// CreateOwnToken hands the logged-in user a token for a script, such as a CI job uploading new versions, which may
+// only be used for the scopes it asks for. The token expires after LoginTokenMinutes, like the ones of command line
+// logins. The scopes cannot go beyond what the user may do, nor beyond the scopes of the token the request is made
+// with.
+// Example request: POST /user/me/tokens
+// Example body: {"Scopes": ["images:read", "images:write"]}
+// Example response: {"Token": "MTY0...", "Username": "jan", "ExpiresAt": "2022-02-01T10:58:40Z",
+//
+//	"Scopes": ["images:read", "images:write"]}
+func (api_ *API) CreateOwnToken(w http.ResponseWriter, r *http.Request) {
+	principal := api_.principal(r)
+	if principal.Kind != PrincipalUser {
+		http.Error(w, "Only users can create tokens", http.StatusBadRequest)
+		return
+	}
+
+	var body tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid token request", http.StatusBadRequest)
+		return
+	}
+
+	if len(body.Scopes) == 0 {
+		http.Error(w, "Give the scopes of the token", http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range body.Scopes {
+		if !scope.Valid() {
+			writeJSON(w, http.StatusBadRequest, scopeError{Error: fmt.Sprintf("unknown scope, it can be one of %v",
+				user.TokenScopes), Scope: scope})
+			return
+		}
+
+		if !api_.grantsScope(principal.Role, scope) || !principal.scoped(scope) {
+			writeJSON(w, http.StatusForbidden, scopeError{Error: "you cannot hand out this scope", Scope: scope})
+			return
+		}
+	}
+
+	owner, err := api_.storeFor(r).GetUserByUsername(principal.Name)
+	if ErrorWrite(w, err, "Cannot fetch the user") != nil {
+		return
+	}
+
+	token, err := api_.createScopedToken(owner, body.Scopes)
+	if err != nil {
+		requestLog(r).Errorf("Cannot create a token for %s: %v", owner.Username, err)
+		http.Error(w, "Cannot create the token", http.StatusInternalServerError)
+		return
+	}
+
+	api_.recordScopedSession(r, token.session, owner.Username, user.SessionToken, token.ExpiresAt, body.Scopes)
+	requestLog(r).Infof("Created a token for %s with the scopes %v", owner.Username, body.Scopes)
+	writeJSON(w, http.StatusCreated, token)
+}
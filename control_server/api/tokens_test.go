@@ -0,0 +1,155 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoute_RequiredScope(t *testing.T) {
+	s := newTestServer(t, newTestStore(t), "/tmp", config.Default())
+
+	// Every route names the scope a token needs for it, none is left to be guessed
+	scopes := map[string]user.TokenScope{}
+	for _, route := range s.api.Routes {
+		assert.NotEmpty(t, route.Scope, "%s %s", route.Method, route.URI)
+		assert.True(t, route.Scope.Valid(), "%s %s", route.Method, route.URI)
+		scopes[route.Method+" "+route.URI] = route.requiredScope()
+	}
+
+	for route, expected := range map[string]user.TokenScope{
+		"GET /image/{uuid}/{version}":              user.ScopeImagesRead,
+		"POST /image/{uuid}":                       user.ScopeImagesWrite,
+		"GET /jobs/{id}":                           user.ScopeImagesRead,
+		"POST /user/{name}/boot-templates":         user.ScopeImagesWrite,
+		"GET /machines":                            user.ScopeMachinesRead,
+		"POST /machine/{mac}/boot":                 user.ScopeMachinesBoot,
+		"POST /machine-group/{group}/boot":         user.ScopeMachinesBoot,
+		"POST /machine/{mac}/boot/heartbeat":       user.ScopeMachinesBoot,
+		"PUT /machine/{mac}/inventory":             user.ScopeMachinesWrite,
+		"GET /user/{name}/ssh-keys":                user.ScopeUsersRead,
+		"POST /course/{course}/members/{username}": user.ScopeUsersWrite,
+		"GET /user/{name}/sessions":                user.ScopeAdmin,
+		"GET /version":                             user.ScopeAdmin,
+	} {
+		assert.Equal(t, expected, scopes[route], route)
+	}
+
+	// A route which does not name its scope is only for tokens with the admin scope
+	assert.Equal(t, user.ScopeAdmin, (&Route{URI: "/machines", Method: http.MethodGet}).requiredScope())
+}
+
+func TestApi_ScopedTokens(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	jan := &user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{admin, jan} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "ci", Username: "jan", UUID: "ci"}))
+	assert.NoError(t, store.CreateMachine(&machine.MachineModel{Name: "abc",
+		MacAddress: util.MacAddress{Address: "abc"}}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	create := func(token string, body string) (*httptest.ResponseRecorder, loginToken) {
+		resp := s.requestToken(token, http.MethodPost, "/user/me/tokens", body)
+		var created loginToken
+		if resp.Code == http.StatusCreated {
+			assert.NoError(t, json.NewDecoder(bytes.NewReader(resp.Body.Bytes())).Decode(&created))
+		}
+		return resp, created
+	}
+
+	login := s.token(jan)
+
+	// The CI gets a token which can only work on images
+	resp, ci := create(login, `{"Scopes": ["images:read", "images:write"]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, []user.TokenScope{user.ScopeImagesRead, user.ScopeImagesWrite}, ci.Scopes)
+	assert.Equal(t, "jan", ci.Username)
+
+	assert.Equal(t, http.StatusOK, s.requestToken(ci.Token, http.MethodGet, "/image/ci", "").Code)
+	assert.Equal(t, http.StatusOK, s.requestToken(ci.Token, http.MethodPut, "/image/ci",
+		`{"UUID": "ci", "Name": "ci-runner"}`).Code)
+	resp = s.requestToken(ci.Token, http.MethodPut, "/user/jan", `{"Name": "Jan"}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "users:write")
+	assert.Equal(t, http.StatusForbidden, s.requestToken(ci.Token, http.MethodPost, "/machine/abc/boot", "{}").Code)
+	assert.Equal(t, http.StatusForbidden, s.requestToken(ci.Token, http.MethodGet, "/machines", "").Code)
+
+	// A CI job which boots its image gets a token which can boot the machines, but not change them
+	resp, booter := create(login, `{"Scopes": ["machines:boot"]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.NotEqual(t, http.StatusForbidden, s.requestToken(booter.Token, http.MethodPost, "/machine/abc/boot",
+		"{}").Code)
+	assert.Equal(t, http.StatusOK, s.requestToken(booter.Token, http.MethodGet, "/machines", "").Code)
+	resp = s.requestToken(booter.Token, http.MethodPut, "/machine-group/lab", `{"Machines": ["abc"]}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Equal(t, http.StatusForbidden, s.requestToken(booter.Token, http.MethodGet, "/image/ci", "").Code)
+
+	// The unscoped token of the login may still do everything jan can
+	assert.Equal(t, http.StatusOK, s.requestToken(login, http.MethodGet, "/machines", "").Code)
+
+	// The scopes cannot go beyond what jan may do
+	resp, _ = create(login, `{"Scopes": ["admin"]}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.JSONEq(t, `{"Error": "you cannot hand out this scope", "Scope": "admin"}`, resp.Body.String())
+	resp, _ = create(login, `{"Scopes": ["images:delete"]}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp, _ = create(login, `{"Scopes": []}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Nor beyond the token the request is made with, which needs users:write to make tokens at all
+	resp, _ = create(ci.Token, `{"Scopes": ["images:read"]}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp, manager := create(login, `{"Scopes": ["users:write", "images:read"]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	resp, _ = create(manager.Token, `{"Scopes": ["images:write"]}`)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp, _ = create(manager.Token, `{"Scopes": ["images:read"]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	// The listing of the tokens shows their scopes
+	resp = s.requestToken(login, http.MethodGet, "/user/me/tokens", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var tokens []types.Session
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&tokens))
+	scopes := [][]string{}
+	for _, token := range tokens {
+		scopes = append(scopes, token.Scopes)
+	}
+	assert.Contains(t, scopes, []string{"images:read", "images:write"})
+
+	// What a scoped token can do is what whoami lists
+	resp = s.requestToken(ci.Token, http.MethodGet, "/whoami", "")
+	var whoami whoAmI
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&whoami))
+	assert.Equal(t, []user.TokenScope{user.ScopeImagesRead, user.ScopeImagesWrite}, whoami.TokenScopes)
+	assert.Contains(t, whoami.Permissions, "GET /image/{uuid}")
+	assert.NotContains(t, whoami.Permissions, "GET /machines")
+
+	// Administrators can hand out every scope, an admin token reaches the admin routes
+	adminLogin := s.token(admin)
+	resp, readOnly := create(adminLogin, `{"Scopes": ["images:read"]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, http.StatusForbidden, s.requestToken(readOnly.Token, http.MethodGet, "/users", "").Code)
+	resp, full := create(adminLogin, `{"Scopes": ["admin"]}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, http.StatusOK, s.requestToken(full.Token, http.MethodGet, "/users", "").Code)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPurgeInterval is how often the purger looks for images which stayed in the trash for too long
+const trashPurgeInterval = time.Hour
+
+// purgeImage removes an image, its versions and its files for good
+func (api_ *API) purgeImage(image *images.ImageModel) error {
+	return purgeImage(api_.store, api_.diskpath, image)
+}
+
+func purgeImage(store database.Store, diskpath string, image *images.ImageModel) error {
+	if err := store.DeleteImage(image); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(storage.Dir(imageRoot(diskpath, image), string(image.UUID)))
+}
+
+// PurgeTrash removes all images which were moved to the trash before the retention period started
+func PurgeTrash(store database.Store, diskpath string, retention time.Duration) error {
+	trashed, err := store.GetImagesTrashedBefore(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+
+	for i := range trashed {
+		if err = purgeImage(store, diskpath, &trashed[i]); err != nil {
+			return err
+		}
+
+		log.Infof("Purged image %s of user %s from the trash", trashed[i].UUID, trashed[i].Username)
+	}
+
+	return nil
+}
+
+// StartTrashPurger periodically purges the trash in the background
+func StartTrashPurger(store database.Store, diskpath string, retention time.Duration) {
+	go func() {
+		for {
+			if err := PurgeTrash(store, diskpath, retention); err != nil {
+				log.Errorf("purge trash: %v", err)
+			}
+
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+// GetTrashedImages lists the images of a user which are in the trash
+// Example request: GET /user/Jan/images/trash
+// Example response: [{"Name": "Gentoo", "UUID": "...", "DeletedAt": "2022-01-02T15:04:05Z", ...}]
+func (api_ *API) GetTrashedImages(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	order, err := parseImageOrder(w, r)
+	if err != nil {
+		return
+	}
+
+	trashed, err := api_.storeFor(r).GetTrashedImages(name)
+	if err != nil {
+		http.Error(w, "couldn't get the trash", http.StatusInternalServerError)
+		log.Errorf("get trashed images: %v", err)
+		return
+	}
+
+	api_.writeImages(w, r, order, trashed)
+}
+
+// RestoreImage takes an image out of the trash
+// Example request: POST /image/57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf/restore
+// Example response: {"Name": "Gentoo", "UUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf", ...}
+func (api_ *API) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	uniqueID, err := GetTag("uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	image, err := api_.storeFor(r).GetTrashedImage(images.ImageUUID(uniqueID))
+	if err != nil {
+		http.Error(w, "image is not in the trash", http.StatusNotFound)
+		log.Errorf("restore image: %v", err)
+		return
+	}
+
+	if !api_.isAdmin(r) && api_.sessionUsername(r) != image.Username {
+		http.Error(w, "user does not own this image", http.StatusForbidden)
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).RestoreImage(image), "couldn't restore image") != nil {
+		return
+	}
+
+	image.DeletedAt.Valid = false
+	writeJSON(w, http.StatusOK, types.NewImage(image))
+}
+
+// GetStorageUsage returns how much storage the images of a user take up, images in the trash still count
+// Example request: GET /user/Jan/storage
+// Example response: {"Used": 4294967296, "Trashed": 1073741824}
+func (api_ *API) GetStorageUsage(w http.ResponseWriter, r *http.Request) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return
+	}
+
+	usage, err := api_.storeFor(r).GetStorageUsage(name)
+	if err != nil {
+		http.Error(w, "couldn't get storage usage", http.StatusInternalServerError)
+		log.Errorf("get storage usage: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// RegisterTrashHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterTrashHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/images/trash",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetTrashedImages,
+		Method:      http.MethodGet,
+		Description: "Lists the images of a user which are in the trash",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/storage",
+		Permissions: []user.UserRole{user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetStorageUsage,
+		Method:      http.MethodGet,
+		Description: "Gets how much storage the images of a user take up",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/restore",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.RestoreImage,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Restores an image from the trash",
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/compression"
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/images"
+	gzip "github.com/klauspost/pgzip"
+)
+
+// convertibleFormats are the formats UploadConverter turns into raw disks
+var convertibleFormats = map[images.FileFormat]bool{images.FormatQCow2: true, images.FormatVMDK: true}
+
+// uploadedFile is the temporary file of an upload, its size and checksum change when it is converted
+type uploadedFile struct {
+	Path     string
+	Size     uint64
+	Checksum string
+	Format   images.FileFormat
+}
+
+// formatError is the answer to an upload in a format the control server does not accept
+type formatError struct {
+	Error    string
+	Format   images.FileFormat
+	Accepted []string
+}
+
+// isUncompressed checks whether the files of an image are stored as they are
+func isUncompressed(image *images.ImageModel) bool {
+	return image.DiskCompressionStrategy == "" || image.DiskCompressionStrategy == images.DiskCompressionStrategyNone
+}
+
+// readContent passes the content of a stored file to read, compressed files are decompressed for it. A file which
+// cannot be decompressed has no content.
+func readContent(path string, image *images.ImageModel, read func(io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch {
+	case isUncompressed(image):
+	case strings.EqualFold(string(image.DiskCompressionStrategy), images.DiskCompressionStrategyGZip):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return read(bytes.NewReader(nil))
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		if reader, err = compression.Decompress(file, image.DiskCompressionStrategy); err != nil {
+			return err
+		}
+
+		if release, ok := reader.(interface{ Release() }); ok {
+			defer release.Release()
+		}
+	}
+
+	return read(reader)
+}
+
+// detectFileFormat detects the format of a stored file
+func detectFileFormat(path string, image *images.ImageModel) (format images.FileFormat, err error) {
+	err = readContent(path, image, func(r io.Reader) error {
+		format, err = fs.DetectFormat(r)
+		return err
+	})
+	return format, err
+}
+
+// acceptsFormat checks whether users can upload files of a format
+func (api_ *API) acceptsFormat(format images.FileFormat) bool {
+	for _, accepted := range api_.config.UploadFormats {
+		if images.FileFormat(accepted) == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipsValidation checks whether an upload asked to skip the check of its format with ?skip_validation=true, which
+// only administrators can. Others are answered with 403 before their file is received.
+func (api_ *API) skipsValidation(w http.ResponseWriter, r *http.Request) (skip bool, ok bool) {
+	if r.URL.Query().Get("skip_validation") != "true" {
+		return false, true
+	}
+
+	if !api_.isAdmin(r) {
+		http.Error(w, "only administrators can skip the validation of uploads", http.StatusForbidden)
+		return true, false
+	}
+
+	return true, true
+}
+
+// checkUploadFormat detects the format of an upload. Uploads of users in a format which is not accepted are
+// converted to a raw disk when they can be, and refused with 422 otherwise. The management OS saves whatever the
+// disk of a machine holds, so the uploads of the system are not checked, like the ones which skip the check. Their
+// format is recorded all the same.
+func (api_ *API) checkUploadFormat(w http.ResponseWriter, r *http.Request, image *images.ImageModel,
+	upload *uploadedFile, skip bool) bool {
+	format, err := detectFileFormat(upload.Path, image)
+	if ErrorWrite(w, err, "Cannot detect the format of the upload") != nil {
+		return false
+	}
+	upload.Format = format
+
+	if skip || api_.isMachine(r) || api_.acceptsFormat(format) {
+		return true
+	}
+
+	if api_.config.UploadConverter != "" && convertibleFormats[format] && isUncompressed(image) &&
+		api_.acceptsFormat(images.FormatRaw) {
+		if err = api_.convertUpload(upload); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot convert the %s image to a raw disk", format),
+				http.StatusUnprocessableEntity)
+			requestLog(r).Errorf("Cannot convert the upload to image %s: %v", image.UUID, err)
+			return false
+		}
+
+		requestLog(r).Infof("Converted the %s upload to image %s to a raw disk", format, image.UUID)
+		return true
+	}
+
+	writeJSON(w, http.StatusUnprocessableEntity, formatError{
+		Error:    fmt.Sprintf("uploads in the %s format are not accepted", format),
+		Format:   format,
+		Accepted: api_.config.UploadFormats,
+	})
+	return false
+}
+
+// convertUpload converts an upload to a raw disk with UploadConverter, in place
+func (api_ *API) convertUpload(upload *uploadedFile) error {
+	converted := upload.Path + ".raw"
+	defer os.Remove(converted)
+
+	out, err := exec.Command(api_.config.UploadConverter, "convert", "-f", string(upload.Format), "-O", "raw",
+		upload.Path, converted).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	file, err := os.Open(converted)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(converted, upload.Path); err != nil {
+		return err
+	}
+
+	upload.Size = uint64(size)
+	upload.Checksum = hex.EncodeToString(hash.Sum(nil))
+	upload.Format = images.FormatRaw
+	return nil
+}
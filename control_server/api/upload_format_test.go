@@ -0,0 +1,110 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_UploadFormat(t *testing.T) {
+	store := newTestStore(t)
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+
+	diskpath, err := ioutil.TempDir("", "upload-format")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "image"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, os.MkdirAll(filepath.Join(diskpath, "image"), os.ModePerm))
+
+	// The converter writes an empty MBR disk, whatever it is given
+	raw := make([]byte, 512)
+	copy(raw[510:], "\x55\xaa")
+	rawSHA256 := sha256.Sum256(raw)
+	converter := filepath.Join(diskpath, "qemu-img")
+	assert.NoError(t, ioutil.WriteFile(converter, []byte("#!/bin/sh\nhead -c 510 /dev/zero > \"$7\"\n"+
+		"printf '\\125\\252' >> \"$7\"\n"), 0755))
+
+	conf := config.Default()
+	s := newTestServer(t, store, diskpath, conf)
+
+	upload := func(uri string, content []byte, system bool) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "image.img")
+		_, _ = part.Write(content)
+		_ = form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, uri, &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-BAAS-NewVersion", "true")
+		if system {
+			req.Header.Set("type", "system")
+		} else {
+			s.login(req, test)
+		}
+		return s.serve(req)
+	}
+	latest := func() images.Version {
+		stored, err := store.GetImageByUUID(image.UUID)
+		assert.NoError(t, err)
+		return stored.Versions[len(stored.Versions)-1]
+	}
+	qcow2 := append([]byte("QFI\xfb"), make([]byte, 508)...)
+
+	// Raw disks are accepted, the format is stored with the version
+	assert.Equal(t, http.StatusOK, upload("/image/image", raw, false).Code)
+	assert.Equal(t, uint64(1), latest().Version)
+	assert.Equal(t, images.FormatRaw, latest().Format)
+
+	// Other files are refused with the format they have, and thrown away together with their version
+	resp := upload("/image/image", qcow2, false)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	var refused formatError
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&refused))
+	assert.Equal(t, images.FormatQCow2, refused.Format)
+	assert.Equal(t, []string{"raw"}, refused.Accepted)
+	assert.Equal(t, uint64(1), latest().Version)
+	assert.NoFileExists(t, filepath.Join(diskpath, "image", "2.img.part"))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, upload("/image/image", []byte("homework.zip"), false).Code)
+
+	// Only administrators can skip the validation, the management OS is not validated
+	assert.Equal(t, http.StatusForbidden, upload("/image/image?skip_validation=true", qcow2, false).Code)
+	assert.Equal(t, http.StatusOK, upload("/image/image?skip_validation=true", qcow2, true).Code)
+	assert.Equal(t, images.FormatQCow2, latest().Format)
+	assert.Equal(t, http.StatusOK, upload("/image/image", []byte("wiped"), true).Code)
+	assert.Equal(t, images.FormatUnknown, latest().Format)
+
+	// With a converter the images it can convert are stored as raw disks
+	conf.UploadConverter = converter
+	assert.Equal(t, http.StatusOK, upload("/image/image", qcow2, false).Code)
+	version := latest()
+	assert.Equal(t, images.FormatRaw, version.Format)
+	assert.Equal(t, uint64(len(raw)), version.Size)
+	assert.Equal(t, hex.EncodeToString(rawSHA256[:]), version.SHA256)
+	stored, err := ioutil.ReadFile(s.api.versionFile(&image, version.Version))
+	assert.NoError(t, err)
+	assert.Equal(t, raw, stored)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, upload("/image/image", []byte("homework.zip"), false).Code)
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/baas-project/baas/pkg/metrics"
+)
+
+// uploadRetryAfter is how many seconds a refused upload is told to wait
+const uploadRetryAfter = 30
+
+var (
+	activeUploads  = metrics.NewGauge("baas_uploads_active", "Uploads which are streaming to the disk.")
+	refusedUploads = metrics.NewCounter("baas_uploads_refused_total",
+		"Uploads which were refused because UploadMaxActive uploads were streaming.")
+)
+
+// newUploadSlots makes room for max uploads streaming at once, there is no limit when max is zero
+func newUploadSlots(max uint) chan struct{} {
+	if max == 0 {
+		return nil
+	}
+
+	return make(chan struct{}, max)
+}
+
+// admitUpload takes the turn of an upload before its body is read. When UploadMaxActive uploads are streaming it
+// is refused right away with 503, clients which asked for 100 Continue did not send the body yet and can try again.
+// release has to be called when the upload is done.
+func (api_ *API) admitUpload(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if api_.uploads == nil {
+		activeUploads.Add(1)
+		return func() { activeUploads.Add(-1) }, true
+	}
+
+	select {
+	case api_.uploads <- struct{}{}:
+		activeUploads.Add(1)
+		return func() {
+			activeUploads.Add(-1)
+			<-api_.uploads
+		}, true
+	default:
+		refusedUploads.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfter))
+		http.Error(w, "The server is busy with other uploads, try again later", http.StatusServiceUnavailable)
+		requestLog(r).Infof("Refused upload to %s, %d uploads are streaming", r.URL.Path, cap(api_.uploads))
+		return nil, false
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+// zeroes reads as a stream of zero bytes
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// uploadBody frames size bytes as the file of a multipart form, the way the management OS streams its disks
+func uploadBody(size int64) (io.Reader, string) {
+	boundary := "uploads"
+	start := fmt.Sprintf("--%s\r\nContent-Disposition: form-data; name=\"file\"; filename=\"image.img\"\r\n"+
+		"Content-Type: application/octet-stream\r\n\r\n", boundary)
+	end := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+
+	return io.MultiReader(strings.NewReader(start), io.LimitReader(zeroes{}, size), strings.NewReader(end)),
+		"multipart/form-data; boundary=" + boundary
+}
+
+func setupUploads(t *testing.T, conf *config.Config) *testServer {
+	store := newTestStore(t)
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}))
+
+	diskpath, err := ioutil.TempDir("", "uploads")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(diskpath) })
+
+	assert.NoError(t, store.CreateImage(&images.ImageModel{Name: "image", Username: "test", UUID: "image"}))
+	assert.NoError(t, os.MkdirAll(filepath.Join(diskpath, "image"), os.ModePerm))
+
+	return newTestServer(t, store, diskpath, conf)
+}
+
+func TestApi_UploadStreams(t *testing.T) {
+	size := int64(3) << 30
+	if testing.Short() {
+		size = 256 << 20
+	}
+
+	s := setupUploads(t, config.Default())
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	// Sample the heap while the upload streams, it should not grow with the size of the upload
+	var peak uint64
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	body, contentType := uploadBody(size)
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/image/image", body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("type", "system")
+	req.Header.Set("X-BAAS-NewVersion", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	close(stop)
+	wg.Wait()
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	image, err := s.store.GetImageByUUID("image")
+	assert.NoError(t, err)
+	assert.Len(t, image.Versions, 2)
+	info, err := os.Stat(s.api.versionFile(image, image.Versions[1].Version))
+	if assert.NoError(t, err) {
+		assert.Equal(t, size, info.Size())
+	}
+
+	growth := int64(peak) - int64(before.HeapAlloc)
+	assert.Less(t, growth, int64(64<<20), "the heap grew by %d bytes for an upload of %d bytes", growth, size)
+}
+
+func TestApi_UploadMaxActive(t *testing.T) {
+	conf := config.Default()
+	conf.UploadMaxActive = 1
+	s := setupUploads(t, conf)
+
+	upload := func() *httptest.ResponseRecorder {
+		body, contentType := uploadBody(1024)
+		req := httptest.NewRequest(http.MethodPost, "/image/image", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("type", "system")
+		req.Header.Set("X-BAAS-NewVersion", "true")
+		return s.serve(req)
+	}
+
+	// Another upload is streaming
+	done, ok := s.api.admitUpload(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/image/image", nil))
+	assert.True(t, ok)
+
+	resp := upload()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "30", resp.Header().Get("Retry-After"))
+
+	stored, err := s.store.GetImageByUUID("image")
+	assert.NoError(t, err)
+	assert.Len(t, stored.Versions, 1, "a refused upload does not create a version")
+
+	done()
+	assert.Equal(t, http.StatusOK, upload().Code)
+	assert.Equal(t, http.StatusOK, upload().Code, "the slot is given back after an upload")
+}
@@ -7,18 +7,39 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/baas-project/baas/control_server/authz"
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
 	usermodel "github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/validation"
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 func _getUserInternal(w http.ResponseWriter, r *http.Request, api *API) (*usermodel.UserModel, error) {
-	session, _ := api.session.Get(r, "session-name")
-	username, ok := session.Values["Username"].(string)
-	if !ok {
+	user, err := _findUserInternal(w, r, api)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the user is allowed to access the profile, the role is the one of whoever is asking
+	if !api.isAdmin(r) && user.Username != api.sessionUsername(r) {
+		http.Error(w, "Cannot access this user", http.StatusUnauthorized)
+		return nil, errors.New("cannot access this user")
+	}
+	return user, nil
+}
+
+// _findUserInternal looks up the user named in the URI, it leaves it to the caller whether the requester may see them
+func _findUserInternal(w http.ResponseWriter, r *http.Request, api *API) (*usermodel.UserModel, error) {
+	// Machines act as administrators, they have no username of their own
+	username := api.sessionUsername(r)
+	if username == "" && !api.isMachine(r) {
 		http.Error(w, "Username not found", http.StatusBadRequest)
 		return nil, errors.New("username not found")
 	}
@@ -27,7 +48,7 @@ func _getUserInternal(w http.ResponseWriter, r *http.Request, api *API) (*usermo
 	name, ok := vars["name"]
 	if !ok || name == "" {
 		http.Error(w, "name not found", http.StatusBadRequest)
-		log.Errorf("name not provided in get user")
+		requestLog(r).Errorf("name not provided in get user")
 		return nil, errors.New("name not found")
 	}
 
@@ -36,54 +57,156 @@ func _getUserInternal(w http.ResponseWriter, r *http.Request, api *API) (*usermo
 	// Annoyingly enough we can't be more specific due to error wrapping... I swear, this language.
 	if err != nil {
 		http.Error(w, "couldn't get users", http.StatusInternalServerError)
-		log.Errorf("get users: %v", err)
+		requestLog(r).Errorf("get users: %v", err)
 		return nil, err
 	}
 
-	// Check if the user is allowed to access the profile.
-	if user.Role != usermodel.Admin && user.Username != username {
-		http.Error(w, "Cannot access this user", http.StatusUnauthorized)
+	return user, nil
+}
+
+// unknownUserError is the body of a response about a user which does not exist
+type unknownUserError struct {
+	Error    string
+	Username string
+}
+
+// emailConflictError is the body of a response refusing an email address which another user has
+type emailConflictError struct {
+	Error    string
+	Username string
+}
+
+// emailTakenError is returned when an account would get the email address of another user
+type emailTakenError struct {
+	Username string
+}
+
+func (e *emailTakenError) Error() string {
+	return "the email address is used by " + e.Username
+}
+
+// checkEmail makes sure no other user than the given one has the email address, regardless of its case
+func (api_ *API) checkEmail(email string, username string) error {
+	if email == "" {
+		return nil
+	}
+
+	owner, err := api_.store.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if owner.Username != username {
+		return &emailTakenError{Username: owner.Username}
+	}
+
+	return nil
+}
+
+// writeEmailError answers a failed checkEmail, with 409 and the user who has the address when it is taken
+func writeEmailError(w http.ResponseWriter, err error) error {
+	var taken *emailTakenError
+	if errors.As(err, &taken) {
+		writeJSON(w, http.StatusConflict, emailConflictError{Error: "the email address is used by another user",
+			Username: taken.Username})
+		return err
+	}
+
+	return ErrorWrite(w, err, "Cannot check the email address")
+}
+
+// findUser fetches the user in the URI and answers with 404 when there is no such user. Who may see the user is
+// decided by the route, like for GetUser.
+func (api_ *API) findUser(w http.ResponseWriter, r *http.Request) (*usermodel.UserModel, error) {
+	name, err := GetName(r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, err
+	}
+
+	user, err := api_.storeFor(r).GetUserByUsername(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: name})
 		return nil, err
 	}
+
+	if ErrorWrite(w, err, "couldn't get the user") != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
-// GetUsers fetches all the users from the database
+// GetUsers fetches all the users from the database, moderators who are scoped to courses only get their members.
+// With ?sort=created or ?sort=updated the newest come first unless ?order=asc.
 // Example request: users
-// Response: [{"Name": "Valentijn", "Email": "v.d.vandebeek@student.tudelft.nl",
+// Response: [{"Username": "valentijn", "Name": "Valentijn", "Email": "v.d.vandebeek@student.tudelft.nl",
 //
-//	"Role": "admin", "Image": null}
-func (api_ *API) GetUsers(w http.ResponseWriter, _ *http.Request) {
-	users, err := api_.store.GetUsers()
+//	"Role": "admin", "CreatedAt": "2022-01-02T15:04:05Z", "UpdatedAt": "2022-01-02T15:04:05Z"}]
+func (api_ *API) GetUsers(w http.ResponseWriter, r *http.Request) {
+	order, err := parseListOrder(w, r)
+	if err != nil {
+		return
+	}
+
+	scopes, err := api_.moderatorScopes(r)
+	if ErrorWrite(w, err, "Cannot fetch the scopes of the moderator") != nil {
+		return
+	}
+
+	var users []usermodel.UserModel
+	if len(scopes) != 0 {
+		users, err = api_.storeFor(r).GetUsersInModeratorScope(api_.sessionUsername(r))
+	} else {
+		users, err = api_.storeFor(r).GetUsers()
+	}
 
 	if err != nil {
 		http.Error(w, "couldn't get users", http.StatusInternalServerError)
-		log.Errorf("get users: %v", err)
+		requestLog(r).Errorf("get users: %v", err)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(users)
+	listing := types.NewUsers(users)
+	order.apply(listing, func(i int) (time.Time, time.Time) {
+		return listing[i].CreatedAt, listing[i].UpdatedAt
+	})
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// checkRoleCeiling answers 403 unless the requester may manage a user with the role current and give them the role
+// granted, current is empty for new users. Administrators manage everyone, the others only the users below them.
+func (api_ *API) checkRoleCeiling(w http.ResponseWriter, r *http.Request, current usermodel.UserRole,
+	granted usermodel.UserRole) bool {
+	if authz.ManageUser(api_.principal(r).subject(), current, granted).Allowed {
+		return true
+	}
+
+	http.Error(w, "Only users and roles below your own role can be managed", http.StatusForbidden)
+	return false
 }
 
-// CreateUser creates a new user in the database
+// CreateUser creates a new user in the database. Moderators may create users whose role is below their own.
 // Example request: user, {"name": "William Narchi",
 //
 //	"email", "w.narchi1@student.tudelft.nl",
 //	"role": "user"}
 //
-// Response: Either an error message or success.
+// Response: 201 Created with the created user
 func (api_ *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 	var user usermodel.UserModel
 	err := json.NewDecoder(r.Body).Decode(&user)
 
 	if err != nil {
-		http.Error(w, "invalid user given", http.StatusBadRequest)
-		log.Errorf("Invalid user given: %v", err)
+		http.Error(w, "invalid user given"+roleErrorMessage(err), http.StatusBadRequest)
+		requestLog(r).Errorf("Invalid user given: %v", err)
 		return
 	}
 
-	if user.Username == "" {
-		http.Error(w, "No username given", http.StatusBadRequest)
+	if reasons := validation.Username(user.Username); len(reasons) != 0 {
+		http.Error(w, "Invalid username: "+strings.Join(reasons, ", "), http.StatusBadRequest)
 		return
 	}
 
@@ -92,8 +215,9 @@ func (api_ *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.Email == "" {
-		http.Error(w, "No email given", http.StatusBadRequest)
+	var reasons []string
+	if user.Email, reasons = validation.Email(user.Email); len(reasons) != 0 {
+		http.Error(w, "Invalid email address: "+strings.Join(reasons, ", "), http.StatusBadRequest)
 		return
 	}
 
@@ -102,153 +226,224 @@ func (api_ *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = api_.store.CreateUser(&user)
-	if err != nil {
-		http.Error(w, "couldn't create user", http.StatusInternalServerError)
-		log.Errorf("create user: %v", err)
+	if !api_.checkRoleCeiling(w, r, "", user.Role) {
 		return
 	}
-	_, err = fmt.Fprintf(w, "Successfully created user\n")
-	if err != nil {
-		log.Error("Error writing over http")
+
+	if writeEmailError(w, api_.checkEmail(user.Email, "")) != nil {
 		return
 	}
+
+	user.MergedInto = ""
+	user.Disabled = false
+	user.LDAPRole = ""
+	if StoreErrorWrite(w, api_.storeFor(r).CreateUser(&user), "couldn't create user") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, types.NewUser(&user))
 }
 
 // GetLoggedInUser gets the currently logged-in user and returns it.
 // Example request: user/me
 func (api_ *API) GetLoggedInUser(w http.ResponseWriter, r *http.Request) {
-	session, _ := api_.session.Get(r, "session-name")
-	username, ok := session.Values["Username"].(string)
-
-	if !ok {
+	principal := api_.principal(r)
+	if principal.Kind == PrincipalMachine {
+		http.Error(w, "machine principals have no user profile", http.StatusForbidden)
+		return
+	} else if principal.Kind != PrincipalUser {
 		http.Error(w, "Cannot find username", http.StatusBadRequest)
 		return
 	}
 
-	user, err := api_.store.GetUserByUsername(username)
+	username := principal.Name
+
+	user, err := api_.storeFor(r).GetUserByUsername(username)
 
 	if err != nil {
 		http.Error(w, "Cannot find user: "+username, http.StatusNotFound)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(user)
+	writeJSON(w, http.StatusOK, types.NewUser(user))
 }
 
 // GetImagesByName gets any image based on the user who created it and human-readable name assigned to it.
+// Unknown users are answered with 404, users without such images with an empty list.
 // Example Request: user/Jan/images/Gentoo
 // Example Response: [
 //
 //	{
 //	  "Name": "Gentoo",
-//	  "Versions": null,
+//	  "Versions": [{"Version": 0, "CreatedAt": "2022-01-02T15:04:05Z", ...}],
 //	  "UUID": "57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf",
-//	  "DiskUUID": "30DF-844C",
-//	  "UserModelID": 1
+//	  "DiskUUID": "30df844c",
+//	  "Username": "Jan",
+//	  "CreatedAt": "2022-01-02T15:04:05Z",
+//	  "UpdatedAt": "2022-01-02T15:04:05Z"
 //	}
 //
 // ]
 func (api_ *API) GetImagesByName(w http.ResponseWriter, r *http.Request) {
-	username, err := GetName(w, r)
+	user, err := api_.findUser(w, r)
 	if err != nil {
-		http.Error(w, "Couldn't find images by name.", http.StatusInternalServerError)
-		log.Errorf("could not find name in request: %v", err)
 		return
 	}
 
-	imageName, err := GetTag("image_name", w, r)
-	if err != nil {
-		http.Error(w, "Couldn't find images by name.", http.StatusInternalServerError)
-		log.Errorf("could not find image name in request: %v", err)
+	imageName, err := GetTag("image_name", r)
+	if TagErrorWrite(w, err) != nil {
 		return
 	}
 
-	userImages, err := api_.store.GetImagesByNameAndUsername(imageName, username)
+	userImages, err := api_.storeFor(r).GetImagesByNameAndUsername(imageName, user.Username)
 
 	if err != nil {
 		http.Error(w, "couldn't get image", http.StatusInternalServerError)
-		log.Errorf("get image by name: %v", err)
+		requestLog(r).Errorf("get image by name: %v", err)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(userImages)
+	// Strict clients expect a list, even when it is empty
+	writeJSON(w, http.StatusOK, types.NewImages(userImages))
 }
 
-// GetImagesByUser fetches all the images of the given user
-// Example request: user/Jan/images
+// GetImagesByUser fetches all the images of the given user, or 404 when there is no such user. With
+// ?include_versions=false the versions are left out and only counted in VersionCount, with ?arch= only the images
+// built for that architecture are listed. With ?sort=created or ?sort=updated the newest come first unless
+// ?order=asc.
+// Example request: user/Jan/images?include_versions=false&sort=updated
 // Example result: [
 //
 //	{
 //	  "Name": "Windows",
-//	  "Versions "a9c11954-6161-410b-b238-c03df5c529e9",
-//	  "DiskUUID": "30DF-844C",
-//	  "UserModelID": 2
+//	  "VersionCount": 3,
+//	  "UUID": "a9c11954-6161-410b-b238-c03df5c529e9",
+//	  "DiskUUID": "30df844c",
+//	  "Username": "Jan",
+//	  "CreatedAt": "2022-01-02T15:04:05Z",
+//	  "UpdatedAt": "2022-03-04T10:11:12Z"
 //	},
 //	{
 //	  "Name": "Arch Linux",
-//	  "Versions": null,
+//	  "VersionCount": 1,
 //	  "UUID": "341b2c69-8776-4e54-9330-7c9692f7ed28",
-//	  "DiskUUID": "30DF-844C",
-//	  "UserModelID": 2
+//	  "DiskUUID": "30df844c",
+//	  "Username": "Jan",
+//	  "CreatedAt": "2022-02-03T09:00:00Z",
+//	  "UpdatedAt": "2022-02-03T09:00:00Z"
 //	}
 //
 // ]
 func (api_ *API) GetImagesByUser(w http.ResponseWriter, r *http.Request) {
-	name, err := GetName(w, r)
+	user, err := api_.findUser(w, r)
 	if err != nil {
 		return
 	}
 
-	userImages, err := api_.store.GetImagesByUsername(name)
+	order, err := parseImageOrder(w, r)
+	if err != nil {
+		return
+	}
+
+	var userImages []images.ImageModel
+	if r.URL.Query().Get("include_versions") == "false" {
+		userImages, err = api_.storeFor(r).GetImageSummariesByUsername(user.Username)
+	} else {
+		userImages, err = api_.storeFor(r).GetImagesByUsername(user.Username)
+	}
 
 	if err != nil {
 		http.Error(w, "couldn't get userImages", http.StatusInternalServerError)
-		log.Errorf("get userImages by users: %v", err)
+		requestLog(r).Errorf("get userImages by users: %v", err)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(userImages)
+	if userImages, err = filterArchitecture(r, userImages); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	api_.writeImages(w, r, order, userImages)
 }
 
 // GetUser fetches a user based on their name and returns it
 // Example request: GET /user/[name]
-// Response: {"Name": "Jan",
+// Response: {"Username": "jan", "Name": "Jan",
 //
 //	"Email": "v.d.vandebeek@student.tudelft.nl",
-//	"role": "admin"}
+//	"Role": "admin", "CreatedAt": "2022-01-02T15:04:05Z", "UpdatedAt": "2022-01-02T15:04:05Z"}
 func (api_ *API) GetUser(w http.ResponseWriter, r *http.Request) {
 	user, err := _getUserInternal(w, r, api_)
 	if err != nil {
 		return
 	}
-	_ = json.NewEncoder(w).Encode(user)
+	writeJSON(w, http.StatusOK, types.NewUser(user))
 }
 
-// DeleteUser removes a user from the database
+// roleErrorMessage explains why a user could not be decoded when the reason is an unknown role, other decoding
+// errors are not shown to the client
+func roleErrorMessage(err error) string {
+	var invalid *usermodel.InvalidRoleError
+	if errors.As(err, &invalid) {
+		return " " + invalid.Error()
+	}
+
+	return ""
+}
+
+// DeleteUser removes a user from the database together with everything they own, including the files of their
+// images. Users whose images are being flashed cannot be removed. With ?dry_run=true nothing is removed, the
+// response lists what would be.
 // Request: DELETE /user/[name]
-// Response: Successfully deleted user
+// Response: 204 No Content
 func (api_ *API) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	user, err := _getUserInternal(w, r, api_)
 	if err != nil {
 		return
 	}
 
-	err = api_.store.RemoveUser(user)
+	plan := api_pkg.NewPlannedChanges(isDryRun(r))
+	if ErrorWrite(w, api_.planUserRemoval(plan, user.Username), "Cannot plan the removal of the user") != nil {
+		return
+	}
+
+	if plan.DryRun {
+		writePlan(w, r, plan)
+		return
+	}
+
+	if writeBlocked(w, plan) {
+		return
+	}
+
+	err = api_.storeFor(r).RemoveUser(user)
 	if err != nil {
 		http.Error(w, "Cannot remove the user.", http.StatusBadRequest)
-		log.Errorf("Remove user: %v", err)
+		requestLog(r).Errorf("Remove user: %v", err)
 		return
 	}
 
-	http.Error(w, "Successfully deleted user", http.StatusOK)
+	// The rows of the images are removed together with the user, their files are not
+	for _, row := range plan.Rows {
+		if row.Kind != "image" {
+			continue
+		}
+
+		if err = api_.removeImageFiles(images.ImageUUID(row.Key)); err != nil {
+			requestLog(r).Warnf("Cannot remove the files of image %s: %v", row.Key, err)
+		}
+	}
+
+	api_.users.forget(user.Username)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// ModifyUser modifies the metadata related to the user
+// ModifyUser modifies the metadata related to the user. Users edit their own profile, moderators and administrators
+// also the profiles and roles of the users below them.
 // Request: PUT /user/[name]
 // Response: the modified user
 func (api_ *API) ModifyUser(w http.ResponseWriter, r *http.Request) {
-	oldUser, err := _getUserInternal(w, r, api_)
+	oldUser, err := _findUserInternal(w, r, api_)
 	if err != nil {
 		return
 	}
@@ -257,38 +452,208 @@ func (api_ *API) ModifyUser(w http.ResponseWriter, r *http.Request) {
 	err = json.NewDecoder(r.Body).Decode(&newUser)
 	newUser.Username = oldUser.Username
 	if err != nil {
-		http.Error(w, "Cannot decode the request body.", http.StatusBadRequest)
-		log.Errorf("Modify user: %v", err)
+		http.Error(w, "Cannot decode the request body."+roleErrorMessage(err), http.StatusBadRequest)
+		requestLog(r).Errorf("Modify user: %v", err)
 		return
 	}
 
-	err = api_.store.ModifyUser(&newUser)
+	// Users may edit their own profile, the profiles of others and all roles are under the role ceiling
+	granted := oldUser.Role
+	if newUser.Role != "" {
+		granted = newUser.Role
+	}
+	if (oldUser.Username != api_.principal(r).Name || granted != oldUser.Role) &&
+		!api_.checkRoleCeiling(w, r, oldUser.Role, granted) {
+		return
+	}
+
+	// An empty address leaves the current one as it is
+	if newUser.Email != "" {
+		var reasons []string
+		if newUser.Email, reasons = validation.Email(newUser.Email); len(reasons) != 0 {
+			http.Error(w, "Invalid email address: "+strings.Join(reasons, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if writeEmailError(w, api_.checkEmail(newUser.Email, newUser.Username)) != nil {
+		return
+	}
+
+	// Accounts are only merged through MergeUsers, and only disabled and enabled by the LDAP synchronization
+	newUser.MergedInto = ""
+	newUser.Disabled = false
+	newUser.LDAPRole = ""
+	err = api_.storeFor(r).ModifyUser(&newUser)
 	if err != nil {
 		http.Error(w, "Cannot decode the request body.", http.StatusBadRequest)
-		log.Errorf("Modify user: %v", err)
+		requestLog(r).Errorf("Modify user: %v", err)
 		return
 	}
 
-	_ = json.NewEncoder(w).Encode(newUser)
+	// The role may have changed, the next request of the user has to see the new one
+	api_.users.forget(newUser.Username)
+
+	// The request may leave fields out, the stored user has all of them and the time of the change
+	modified, err := api_.storeFor(r).GetUserByUsername(newUser.Username)
+	if ErrorWrite(w, err, "Cannot fetch the modified user") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.NewUser(modified))
+}
+
+// mergeRequest names the account which is kept and the one which is folded into it
+type mergeRequest struct {
+	Primary   string `description:"The user who keeps everything"`
+	Duplicate string `description:"The user who is merged into the primary one and disabled"`
+}
+
+// MergeUsers moves everything of a duplicate account to the primary one and disables the duplicate. Boot history
+// follows the image setups, machines are not owned by anyone and the sessions and tokens of the duplicate are
+// revoked, its owner logs in as the primary user from now on.
+// Example request: POST /admin/users/merge
+// Example body: {"Primary": "wnarchi", "Duplicate": "wnarchi-1"}
+// Example response: {"Primary": "wnarchi", "Duplicate": "wnarchi-1", "Images": 3, "ImageSetups": 1, "ImageSets": 0,
+// "MetadataTemplates": 0, "BootTemplates": 1, "Identities": 1, "SSHKeys": 2, "Renamed": 1}
+func (api_ *API) MergeUsers(w http.ResponseWriter, r *http.Request) {
+	var req mergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid merge request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Primary == "" || req.Duplicate == "" {
+		http.Error(w, "Both the primary and the duplicate user are needed", http.StatusBadRequest)
+		return
+	}
+
+	if req.Primary == req.Duplicate {
+		http.Error(w, "A user cannot be merged into themselves", http.StatusBadRequest)
+		return
+	}
+
+	for _, name := range []string{req.Primary, req.Duplicate} {
+		found, err := api_.storeFor(r).GetUserByUsername(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeJSON(w, http.StatusNotFound, unknownUserError{Error: "user not found", Username: name})
+			return
+		}
+
+		if ErrorWrite(w, err, "Cannot fetch the user") != nil {
+			return
+		}
+
+		if found.MergedInto != "" {
+			http.Error(w, name+" was already merged into "+found.MergedInto, http.StatusConflict)
+			return
+		}
+	}
+
+	result, err := api_.storeFor(r).MergeUsers(req.Primary, req.Duplicate)
+	if StoreErrorWrite(w, err, "Cannot merge the users") != nil {
+		return
+	}
+
+	api_.users.forget(req.Primary)
+	api_.users.forget(req.Duplicate)
+	requestLog(r).Infof("Merged user %s into %s", req.Duplicate, req.Primary)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// availability is the answer of CheckUser, a field is false when its value was not checked
+type availability struct {
+	UsernameAvailable bool     `json:"username_available"`
+	UsernameValid     bool     `json:"username_valid"`
+	EmailAvailable    bool     `json:"email_available"`
+	Reasons           []string `json:"reasons"`
+
+	// EmailOwner is only told to administrators
+	EmailOwner string `json:"email_owner,omitempty"`
+}
+
+// CheckUser tells whether a username and an email address can be used for a new user, with the same rules as
+// CreateUser. Either can be left out.
+// Example request: GET /users/check?username=wnarchi&email=W.Narchi@tudelft.nl
+// Example response: {"username_available": false, "username_valid": true, "email_available": true,
+// "reasons": ["the username is taken"]}
+func (api_ *API) CheckUser(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	resp := availability{Reasons: []string{}}
+
+	if _, ok := query["username"]; ok {
+		username := query.Get("username")
+		reasons := validation.Username(username)
+		resp.UsernameValid = len(reasons) == 0
+		resp.Reasons = append(resp.Reasons, reasons...)
+
+		if resp.UsernameValid {
+			_, err := api_.storeFor(r).GetUserByUsername(username)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				resp.UsernameAvailable = true
+			} else if ErrorWrite(w, err, "Cannot check the username") != nil {
+				return
+			} else {
+				resp.Reasons = append(resp.Reasons, "the username is taken")
+			}
+		}
+	}
+
+	if _, ok := query["email"]; ok {
+		email, reasons := validation.Email(query.Get("email"))
+		resp.Reasons = append(resp.Reasons, reasons...)
+
+		if len(reasons) == 0 {
+			err := api_.checkEmail(email, "")
+			var taken *emailTakenError
+			if errors.As(err, &taken) {
+				resp.Reasons = append(resp.Reasons, "the email address is used by another user")
+				if api_.isAdmin(r) {
+					resp.EmailOwner = taken.Username
+				}
+			} else if ErrorWrite(w, err, "Cannot check the email address") != nil {
+				return
+			} else {
+				resp.EmailAvailable = true
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // RegisterUserHandlers sets the metadata for each of the routes and registers them to the global handler
 func (api_ *API) RegisterUserHandlers() {
 	api_.Routes = append(api_.Routes, Route{
-		URI:         "/users",
-		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
+		URI:             "/users",
+		Permissions:     []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
+		UserAllowed:     false,
+		ModeratorScoped: true,
+		Scope:           usermodel.ScopeUsersRead,
+		Handler:         api_.GetUsers,
+		Method:          http.MethodGet,
+		Description:     "Gets all the users from the database",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/users/check",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
 		UserAllowed: false,
-		Handler:     api_.GetUsers,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.CheckUser,
 		Method:      http.MethodGet,
-		Description: "Gets all the users from the database",
+		Description: "Checks whether a username and an email address can be used for a new user",
 	})
 
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/user",
-		Permissions: []usermodel.UserRole{usermodel.Admin},
+		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: false,
+		Scope:       usermodel.ScopeUsersWrite,
 		Handler:     api_.CreateUser,
+		Idempotent:  true,
 		Method:      http.MethodPost,
+		Schema:      "user",
 		Description: "Adds a new user to the database",
 	})
 
@@ -296,15 +661,88 @@ func (api_ *API) RegisterUserHandlers() {
 		URI:         "/user/me",
 		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
 		Handler:     api_.GetLoggedInUser,
 		Method:      http.MethodGet,
 		Description: "Gets the user who is currently logged in",
 	})
 
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/summary",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.GetSummary,
+		Method:      http.MethodGet,
+		Description: "Summarizes the images, machines and boots of the user who is logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/link/{provider}",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.LinkOAuth,
+		Method:      http.MethodGet,
+		Description: "Links another OAuth account to the user who is currently logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/identities",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.GetIdentities,
+		Method:      http.MethodGet,
+		Description: "Gets the OAuth accounts linked to the user who is currently logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/identities/{id}",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersWrite,
+		Handler:     api_.DeleteIdentity,
+		Method:      http.MethodDelete,
+		Description: "Unlinks an OAuth account from the user who is currently logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/sessions",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.GetOwnSessions,
+		Method:      http.MethodGet,
+		Description: "Lists where the sessions of the user who is currently logged in were used from",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/tokens",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
+		Handler:     api_.GetOwnTokens,
+		Method:      http.MethodGet,
+		Description: "Lists the command line tokens of the user who is currently logged in",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/me/tokens",
+		Permissions: []usermodel.UserRole{usermodel.User, usermodel.Moderator, usermodel.Admin},
+		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersWrite,
+		Handler:     api_.CreateOwnToken,
+		Method:      http.MethodPost,
+		Schema:      "token",
+		Description: "Creates a token for the user who is currently logged in, limited to some scopes",
+	})
+
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/user/{name}",
 		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersRead,
 		Handler:     api_.GetUser,
 		Method:      http.MethodGet,
 		Description: "Gets information about a particular user",
@@ -314,6 +752,7 @@ func (api_ *API) RegisterUserHandlers() {
 		URI:         "/user/{name}",
 		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersWrite,
 		Handler:     api_.DeleteUser,
 		Method:      http.MethodDelete,
 		Description: "Deletes a user from the database",
@@ -323,17 +762,86 @@ func (api_ *API) RegisterUserHandlers() {
 		URI:         "/user/{name}",
 		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeUsersWrite,
 		Handler:     api_.ModifyUser,
 		Method:      http.MethodPut,
+		Schema:      "user-update",
 		Description: "Gets information about a particular user",
 	})
 
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/users/merge",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: false,
+		Scope:       usermodel.ScopeAdmin,
+		Handler:     api_.MergeUsers,
+		Method:      http.MethodPost,
+		Schema:      "user-merge",
+		Description: "Merges a duplicate account into another user",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/admin/users/bulk-update",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: false,
+		Timeout:     longTimeout,
+		Scope:       usermodel.ScopeAdmin,
+		Handler:     api_.BulkUpdateUsers,
+		Method:      http.MethodPost,
+		Schema:      "user-bulk-update",
+		Description: "Changes the roles, storage quotas and accounts of many users at once, from JSON or CSV",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/users/export",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: false,
+		Scope:       usermodel.ScopeAdmin,
+		Handler:     api_.ExportUsers,
+		Method:      http.MethodGet,
+		Description: "Exports the roles, storage quotas and accounts of the users as CSV for the bulk update",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/identities",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: false,
+		Scope:       usermodel.ScopeAdmin,
+		Handler:     api_.LinkUserIdentity,
+		Method:      http.MethodPost,
+		Schema:      "user-identity-link",
+		Description: "Links an OAuth account to a user, such as the GitHub account of a user from before identities",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/revoke-sessions",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: false,
+		Scope:       usermodel.ScopeAdmin,
+		Handler:     api_.RevokeSessions,
+		Method:      http.MethodPost,
+		Schema:      schemaNone,
+		Description: "Logs a user out of all their sessions and tokens",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/user/{name}/sessions",
+		Permissions: []usermodel.UserRole{usermodel.Admin},
+		UserAllowed: false,
+		Scope:       usermodel.ScopeAdmin,
+		Handler:     api_.GetUserSessions,
+		Method:      http.MethodGet,
+		Description: "Lists where the sessions of a user were used from",
+	})
+
 	api_.Routes = append(api_.Routes, Route{
 		URI:         "/user/{name}/image",
 		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeImagesWrite,
 		Handler:     api_.CreateImage,
 		Method:      http.MethodPost,
+		Schema:      "image",
 		Description: "Creates a new image",
 	})
 
@@ -341,6 +849,7 @@ func (api_ *API) RegisterUserHandlers() {
 		URI:         "/user/{name}/images",
 		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeImagesRead,
 		Handler:     api_.GetImagesByUser,
 		Method:      http.MethodGet,
 		Description: "Gets all the images owned by a particular user",
@@ -350,6 +859,7 @@ func (api_ *API) RegisterUserHandlers() {
 		URI:         "/user/{name}/images/{image_name}",
 		Permissions: []usermodel.UserRole{usermodel.Moderator, usermodel.Admin},
 		UserAllowed: true,
+		Scope:       usermodel.ScopeImagesRead,
 		Handler:     api_.GetImagesByName,
 		Method:      http.MethodGet,
 		Description: "Finds all the images by this user with a particular name",
@@ -0,0 +1,500 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database"
+	usermodel "github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// roleQuota is written in the quota column for users who have the storage limit of their role
+const roleQuota = "role"
+
+// userCSVHeader names the columns of the export of the users, the bulk update reads the same file back. The name
+// and email address are only there to recognise the users by, they are not changed.
+var userCSVHeader = []string{"username", "role", "quota", "disabled", "name", "email"}
+
+// userChange is the change to a single user of a bulk update, the fields which are left out stay as they are
+type userChange struct {
+	Username string             `schema:"username,required" description:"The user to change"`
+	Role     usermodel.UserRole `json:",omitempty" description:"The new role of the user"`
+	// Quota replaces the storage limit of the role of the user, ResetQuota makes the one of their role apply again
+	Quota      *uint64 `json:",omitempty" description:"The storage limit of the user in bytes, 0 is unlimited"`
+	ResetQuota bool    `json:",omitempty" description:"Whether the user gets the storage limit of their role again"`
+	Disabled   *bool   `json:",omitempty" description:"Whether the account of the user is disabled"`
+}
+
+// userState is what a bulk update can change of a user. A nil Quota is the storage limit of their role.
+type userState struct {
+	Role     usermodel.UserRole
+	Quota    *uint64
+	Disabled bool
+}
+
+// equals compares the states by the quota they have, not the pointer to it
+func (s userState) equals(other userState) bool {
+	sameQuota := (s.Quota == nil) == (other.Quota == nil) && (s.Quota == nil || *s.Quota == *other.Quota)
+	return s.Role == other.Role && s.Disabled == other.Disabled && sameQuota
+}
+
+// apply is the state of the user after the change
+func (s userState) apply(change userChange) userState {
+	if change.Role != "" {
+		s.Role = change.Role
+	}
+
+	if change.ResetQuota {
+		s.Quota = nil
+	} else if change.Quota != nil {
+		s.Quota = change.Quota
+	}
+
+	if change.Disabled != nil {
+		s.Disabled = *change.Disabled
+	}
+
+	return s
+}
+
+// activeAdmin reports whether the user can still act as an administrator in this state
+func (s userState) activeAdmin() bool {
+	return s.Role == usermodel.Admin && !s.Disabled
+}
+
+// userChangeRow is a change of a bulk update, Line is where it was found in a CSV file. Rows with an error have the
+// HTTP status changing the user alone would have gotten.
+type userChangeRow struct {
+	Line   int
+	Change userChange
+	Before userState
+	After  userState
+	Code   int
+	Error  string
+}
+
+// fail marks the row as wrong
+func (row *userChangeRow) fail(code int, err error) {
+	row.Code = code
+	row.Error = err.Error()
+}
+
+// id is how the caller knows the row, the username or the place in the file when it has none
+func (row *userChangeRow) id(index int) string {
+	switch {
+	case row.Change.Username != "":
+		return row.Change.Username
+	case row.Line != 0:
+		return fmt.Sprintf("line %d", row.Line)
+	}
+
+	return fmt.Sprintf("item %d", index+1)
+}
+
+// where tells the caller which row an error is about in the messages
+func (row *userChangeRow) where() string {
+	if row.Line == 0 {
+		return row.Error
+	}
+
+	return fmt.Sprintf("line %d: %s", row.Line, row.Error)
+}
+
+// parseUserChanges reads the changes of a bulk update from a JSON list or a CSV file. Without ?format= the body is
+// taken to be JSON when it starts with [.
+func parseUserChanges(body io.Reader, format string) ([]userChangeRow, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "" {
+		format = "csv"
+		if bytes.HasPrefix(bytes.TrimSpace(content), []byte("[")) {
+			format = "json"
+		}
+	}
+
+	switch format {
+	case "csv":
+		return parseUserCSV(bytes.NewReader(content))
+	case "json":
+		var changes []userChange
+		if err := json.Unmarshal(content, &changes); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+
+		rows := make([]userChangeRow, len(changes))
+		for i, change := range changes {
+			rows[i].Change = change
+		}
+		return rows, nil
+	}
+
+	return nil, fmt.Errorf("unknown format %q, expected csv or json", format)
+}
+
+// parseUserCSV reads a CSV file of username,role,quota,disabled. When the first row is a header the columns are
+// found by their names and the other columns, such as those of the export, are ignored. Empty cells leave the user
+// as they are, a quota of "role" resets it to the one of their role.
+func parseUserCSV(body io.Reader) ([]userChangeRow, error) {
+	columns := map[string]int{"username": 0, "role": 1, "quota": 2, "disabled": 3}
+	var rows []userChangeRow
+	scanner := bufio.NewScanner(body)
+	header := true
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		reader := csv.NewReader(strings.NewReader(text))
+		reader.TrimLeadingSpace = true
+		fields, err := reader.Read()
+		if err != nil {
+			rows = append(rows, userChangeRow{Line: line, Code: http.StatusBadRequest, Error: err.Error()})
+			continue
+		}
+
+		if header {
+			header = false
+			if named, ok := userCSVColumns(fields); ok {
+				columns = named
+				continue
+			}
+		}
+
+		row := userChangeRow{Line: line}
+		if row.Change, err = parseUserCSVRow(fields, columns); err != nil {
+			row.fail(http.StatusBadRequest, err)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
+
+// userCSVColumns finds the columns in a header, which is only one when it names the username column
+func userCSVColumns(fields []string) (map[string]int, bool) {
+	columns := map[string]int{}
+	for i, field := range fields {
+		columns[strings.ToLower(strings.TrimSpace(field))] = i
+	}
+
+	_, ok := columns["username"]
+	return columns, ok
+}
+
+// parseUserCSVRow reads the change in a row of a CSV file
+func parseUserCSVRow(fields []string, columns map[string]int) (userChange, error) {
+	cell := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	change := userChange{Username: cell("username")}
+	if role := cell("role"); role != "" {
+		parsed, err := usermodel.ParseRole(strings.ToLower(role))
+		if err != nil {
+			return change, err
+		}
+		change.Role = parsed
+	}
+
+	switch quota := cell("quota"); {
+	case quota == "":
+	case strings.EqualFold(quota, roleQuota):
+		change.ResetQuota = true
+	default:
+		limit, err := strconv.ParseUint(quota, 10, 64)
+		if err != nil {
+			return change, fmt.Errorf("invalid quota %q, expected bytes or %q", quota, roleQuota)
+		}
+		change.Quota = &limit
+	}
+
+	if disabled := cell("disabled"); disabled != "" {
+		parsed, err := strconv.ParseBool(disabled)
+		if err != nil {
+			return change, fmt.Errorf("invalid disabled %q, expected true or false", disabled)
+		}
+		change.Disabled = &parsed
+	}
+
+	return change, nil
+}
+
+// userStates gives what a bulk update can change of every user who was not merged into another, the users are
+// sorted by their username
+func userStates(store database.Store) (map[string]userState, []usermodel.UserModel, error) {
+	users, err := store.GetUsers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	overrides, err := store.GetAllLimitOverrides()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	quotas := map[string]*uint64{}
+	for i := range overrides {
+		quotas[overrides[i].Username] = overrides[i].StorageBytes
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	states := map[string]userState{}
+	listed := users[:0]
+	for _, u := range users {
+		if u.MergedInto != "" {
+			continue
+		}
+
+		states[u.Username] = userState{Role: u.Role, Quota: quotas[u.Username], Disabled: u.Disabled}
+		listed = append(listed, u)
+	}
+
+	return states, listed, nil
+}
+
+// planUserChanges checks every row against the others, the users and the role of the requester, and works out what
+// each user becomes. It reports whether any row is wrong, in which case nothing may be changed.
+func planUserChanges(rows []userChangeRow, states map[string]userState, subject authz.Subject) (failed bool) {
+	lines := map[string]int{}
+	for i := range rows {
+		row := &rows[i]
+		if row.Error != "" {
+			failed = true
+			continue
+		}
+
+		if code, err := checkUserChange(row, i, lines, states, subject); err != nil {
+			row.fail(code, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return true
+	}
+
+	// Whoever is left has to be able to manage the server, the rows which take away the last administrators fail
+	after := map[string]userState{}
+	for name, state := range states {
+		after[name] = state
+	}
+	for _, row := range rows {
+		after[row.Change.Username] = row.After
+	}
+
+	for _, state := range after {
+		if state.activeAdmin() {
+			return false
+		}
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		if row.Before.activeAdmin() && !row.After.activeAdmin() {
+			row.fail(http.StatusConflict, errors.New("no enabled administrator would be left"))
+			failed = true
+		}
+	}
+
+	return failed
+}
+
+// checkUserChange validates a single row and sets what the user was and becomes, lines tracks where every user
+// was seen first. A wrong row comes with the status changing the user alone would have gotten.
+func checkUserChange(row *userChangeRow, index int, lines map[string]int, states map[string]userState,
+	subject authz.Subject) (int, error) {
+	change := row.Change
+	if change.Username == "" {
+		return http.StatusBadRequest, errors.New("no username given")
+	}
+
+	if seen, ok := lines[change.Username]; ok {
+		return http.StatusConflict, fmt.Errorf("user %s is also changed by row %d", change.Username, seen)
+	}
+	lines[change.Username] = index + 1
+
+	if change.Role != "" && !change.Role.Valid() {
+		return http.StatusBadRequest, &usermodel.InvalidRoleError{Role: string(change.Role)}
+	}
+
+	if change.ResetQuota && change.Quota != nil {
+		return http.StatusBadRequest, errors.New("either a quota or to reset it can be given, not both")
+	}
+
+	before, ok := states[change.Username]
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("user %s does not exist", change.Username)
+	}
+
+	row.Before = before
+	row.After = before.apply(change)
+	if !authz.ManageUser(subject, before.Role, row.After.Role).Allowed {
+		return http.StatusForbidden, errors.New("only users and roles below your own role can be managed")
+	}
+
+	return 0, nil
+}
+
+// BulkUpdateUsers changes the role, storage quota and whether the account is disabled of many users at once, from
+// a JSON list of changes or from a CSV file such as the one of ExportUsers. The format is given with ?format=json or
+// ?format=csv, or guessed from the body. All rows are checked before anything is changed, against the role of the
+// requester and so that an enabled administrator is left: when any of them is wrong the response is 422 and no
+// user is changed. Otherwise all changes are made in one transaction. Every user is listed with what they were and
+// became, the users who stay the same are skipped.
+// Example request: POST /admin/users/bulk-update
+// [{"Username": "wnarchi", "Role": "moderator", "ResetQuota": true}, {"Username": "valentijn", "Disabled": true}]
+// Example response: {"succeeded": 1, "failed": 0, "skipped": 1, "items": [{"id": "wnarchi", "status": "succeeded",
+// "before": {"Role": "user", "Quota": 1073741824, "Disabled": false}, "after": {"Role": "moderator", "Quota": null,
+// "Disabled": false}}, {"id": "valentijn", "status": "skipped", "message": "unchanged", ...}]}
+func (api_ *API) BulkUpdateUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	rows, err := parseUserChanges(r.Body, strings.ToLower(r.URL.Query().Get("format")))
+	if err != nil {
+		http.Error(w, "Cannot read the changes: "+err.Error(), http.StatusBadRequest)
+		requestLog(r).Warnf("Cannot read the user changes: %v", err)
+		return
+	}
+
+	if len(rows) == 0 {
+		http.Error(w, "There are no users to change", http.StatusBadRequest)
+		return
+	}
+
+	states, _, err := userStates(api_.storeFor(r))
+	if ErrorWrite(w, err, "Cannot fetch the users") != nil {
+		return
+	}
+
+	failed := planUserChanges(rows, states, api_.principal(r).subject())
+	result := types.NewMultiStatus()
+	var updates []database.UserUpdate
+	for i := range rows {
+		row := &rows[i]
+		switch {
+		case row.Error != "":
+			result.Fail(row.id(i), row.Code, row.where())
+		case failed:
+			result.Skip(row.id(i), "not changed, other rows are wrong")
+		case row.Before.equals(row.After):
+			result.Add(types.MultiStatusItem{ID: row.id(i), Status: types.ItemSkipped, Message: "unchanged",
+				Before: row.Before, After: row.After})
+		default:
+			result.Add(types.MultiStatusItem{ID: row.id(i), Status: types.ItemSucceeded, Before: row.Before,
+				After: row.After})
+			updates = append(updates, database.UserUpdate{Username: row.Change.Username, Role: row.Change.Role,
+				Disabled: row.Change.Disabled, StorageBytes: row.Change.Quota, ResetStorage: row.Change.ResetQuota})
+		}
+	}
+
+	if failed {
+		requestLog(r).Warnf("Refused to update users in bulk, %d of the %d rows are wrong", result.Failed, len(rows))
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	if StoreErrorWrite(w, api_.storeFor(r).UpdateUsers(updates), "Cannot update the users") != nil {
+		return
+	}
+
+	requester := api_.requester(r)
+	requestLog(r).WithFields(log.Fields{
+		"audit":     "users-bulk-updated",
+		"updated":   result.Succeeded,
+		"unchanged": result.Skipped,
+	}).Infof("%s updated %d users in bulk", requester, result.Succeeded)
+	for _, row := range rows {
+		if row.Before.equals(row.After) {
+			continue
+		}
+
+		// The roles are cached, the next request of the user has to see the new one
+		api_.users.forget(row.Change.Username)
+		requestLog(r).WithFields(log.Fields{
+			"audit":    "user-bulk-updated",
+			"username": row.Change.Username,
+			"before":   describeUserState(row.Before),
+			"after":    describeUserState(row.After),
+		}).Infof("%s changed user %s in a bulk update", requester, row.Change.Username)
+	}
+
+	writeMultiStatus(w, result)
+}
+
+// describeUserState writes a state the way it is exported, for the audit log
+func describeUserState(s userState) string {
+	return fmt.Sprintf("role=%s quota=%s disabled=%t", s.Role, formatQuota(s.Quota), s.Disabled)
+}
+
+// formatQuota writes a storage limit as the quota column of the export
+func formatQuota(quota *uint64) string {
+	if quota == nil {
+		return roleQuota
+	}
+
+	return strconv.FormatUint(*quota, 10)
+}
+
+// ExportUsers writes every user as a CSV file of username,role,quota,disabled,name,email, which BulkUpdateUsers
+// reads back after it is edited. The quota is "role" for the users who have the storage limit of their role.
+// Merged accounts are left out, they cannot be changed anymore.
+// Example request: GET /users/export
+// Example response:
+// username,role,quota,disabled,name,email
+// wnarchi,user,role,false,William Narchi,w.narchi1@student.tudelft.nl
+func (api_ *API) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	states, users, err := userStates(api_.storeFor(r))
+	if ErrorWrite(w, err, "Cannot fetch the users") != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	err = writer.Write(userCSVHeader)
+	for i := 0; err == nil && i < len(users); i++ {
+		u := users[i]
+		state := states[u.Username]
+		err = writer.Write([]string{u.Username, string(state.Role), formatQuota(state.Quota),
+			strconv.FormatBool(state.Disabled), u.Name, u.Email})
+	}
+
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		requestLog(r).Errorf("Cannot write the export of the users: %v", err)
+		return
+	}
+
+	requestLog(r).WithField("audit", "users-exported").Infof("%s exported %d users", api_.requester(r), len(users))
+}
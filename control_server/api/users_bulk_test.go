@@ -0,0 +1,144 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/authz"
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_BulkUpdateUsers(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, u := range []user.UserModel{
+		{Username: "root", Name: "Root", Email: "root@example.com", Role: user.Admin},
+		{Username: "ta1", Name: "TA 1", Email: "ta1@example.com", Role: user.User},
+		{Username: "ta2", Name: "TA 2", Email: "ta2@example.com", Role: user.User},
+		{Username: "student", Name: "Student", Email: "student@example.com", Role: user.User},
+	} {
+		u := u
+		assert.NoError(t, store.CreateUser(&u))
+	}
+	storage, images := uint64(5), uint(3)
+	assert.NoError(t, store.SetLimitOverrides(&user.LimitOverrides{Username: "student", StorageBytes: &storage,
+		MaxImages: &images}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+	update := func(uri string, body string) (*httptest.ResponseRecorder, types.MultiStatus) {
+		resp := s.request(http.MethodPost, uri, body)
+
+		var report types.MultiStatus
+		if resp.Code != http.StatusBadRequest {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		}
+		return resp, report
+	}
+
+	role := func(username string) user.UserRole {
+		u, err := store.GetUserByUsername(username)
+		assert.NoError(t, err)
+		return u.Role
+	}
+
+	// The export is read back unchanged
+	resp := s.request(http.MethodGet, "/users/export", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header().Get("Content-Type"))
+	exported := resp.Body.String()
+	assert.Equal(t, "username,role,quota,disabled,name,email\n"+
+		"root,admin,role,false,Root,root@example.com\n"+
+		"student,user,5,false,Student,student@example.com\n"+
+		"ta1,user,role,false,TA 1,ta1@example.com\n"+
+		"ta2,user,role,false,TA 2,ta2@example.com\n", exported)
+
+	resp, report := update("/admin/users/bulk-update", exported)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 4, report.Skipped)
+
+	// Nothing is changed when any row is wrong
+	resp, report = update("/admin/users/bulk-update?format=csv",
+		"ta1,moderator\nnobody,user\nta1,moderator\nta2,,lots\n")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 3, report.Failed)
+	if assert.Len(t, report.Items, 4) {
+		assert.Equal(t, "not_found", report.Items[1].ErrorCode)
+		assert.Equal(t, "conflict", report.Items[2].ErrorCode)
+		assert.Equal(t, "bad_request", report.Items[3].ErrorCode)
+		assert.Equal(t, `line 4: invalid quota "lots", expected bytes or "role"`, report.Items[3].Message)
+	}
+	assert.Equal(t, user.User, role("ta1"))
+
+	// Somebody has to be left to manage the server
+	resp, report = update("/admin/users/bulk-update",
+		`[{"Username": "root", "Disabled": true}, {"Username": "ta1", "Role": "moderator"}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Equal(t, "conflict", report.Items[0].ErrorCode)
+	assert.Equal(t, types.ItemSkipped, report.Items[1].Status)
+
+	resp, report = update("/admin/users/bulk-update", `[
+		{"Username": "ta1", "Role": "moderator"},
+		{"Username": "ta2", "Role": "moderator", "Quota": 1000},
+		{"Username": "student", "ResetQuota": true, "Disabled": true},
+		{"Username": "root", "Role": "admin"}]`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 3, report.Succeeded)
+	assert.Equal(t, 1, report.Skipped)
+	if assert.Len(t, report.Items, 4) {
+		assert.Equal(t, map[string]interface{}{"Role": "user", "Quota": nil, "Disabled": false}, report.Items[1].Before)
+		assert.Equal(t, map[string]interface{}{"Role": "moderator", "Quota": float64(1000), "Disabled": false},
+			report.Items[1].After)
+		assert.Equal(t, "unchanged", report.Items[3].Message)
+	}
+
+	assert.Equal(t, user.Moderator, role("ta1"))
+	assert.Equal(t, user.Moderator, role("ta2"))
+	student, err := store.GetUserByUsername("student")
+	assert.NoError(t, err)
+	assert.True(t, student.Disabled)
+	assert.NotNil(t, student.SessionsRevokedAt)
+
+	// Resetting the quota keeps the other limits of the user
+	overrides, err := store.GetLimitOverrides("student")
+	assert.NoError(t, err)
+	assert.Nil(t, overrides.StorageBytes)
+	assert.Equal(t, &images, overrides.MaxImages)
+	overrides, err = store.GetLimitOverrides("ta2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), *overrides.StorageBytes)
+
+	resp = s.request(http.MethodGet, "/users/export", "")
+	assert.Contains(t, resp.Body.String(), "student,user,role,true,Student,student@example.com\n")
+	assert.Contains(t, resp.Body.String(), "ta2,moderator,1000,false,TA 2,ta2@example.com\n")
+}
+
+func TestPlanUserChanges_RoleCeiling(t *testing.T) {
+	states := map[string]userState{
+		"root": {Role: user.Admin},
+		"ta":   {Role: user.User},
+	}
+	moderator := authz.Subject{Username: "mod", Role: user.Moderator}
+
+	rows := []userChangeRow{{Change: userChange{Username: "ta", Role: user.Moderator}}}
+	assert.True(t, planUserChanges(rows, states, moderator))
+	assert.Equal(t, http.StatusForbidden, rows[0].Code)
+
+	disabled := true
+	rows = []userChangeRow{{Change: userChange{Username: "root", Disabled: &disabled}}}
+	assert.True(t, planUserChanges(rows, states, moderator))
+	assert.Equal(t, http.StatusForbidden, rows[0].Code)
+
+	rows = []userChangeRow{{Change: userChange{Username: "ta", Disabled: &disabled}}}
+	assert.False(t, planUserChanges(rows, states, moderator))
+	assert.True(t, rows[0].After.Disabled)
+}
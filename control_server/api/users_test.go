@@ -0,0 +1,230 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_EmailUniqueness(t *testing.T) {
+	store := newTestStore(t)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	assert.NoError(t, store.CreateUser(admin))
+
+	resp := s.requestAs(admin, http.MethodPost, "/user",
+		`{"Username": "wnarchi", "Name": "W. Narchi", "Email": " W.Narchi@TUDelft.NL ", "Role": "user"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	created, err := store.GetUserByUsername("wnarchi")
+	assert.NoError(t, err)
+	assert.Equal(t, "W.Narchi@tudelft.nl", created.Email)
+
+	// The same address in another case, or with spaces around it, belongs to the first user
+	for _, email := range []string{"w.narchi@tudelft.nl ", "W.NARCHI@tudelft.nl"} {
+		resp = s.requestAs(admin, http.MethodPost, "/user",
+			`{"Username": "narchi", "Name": "Narchi", "Email": "`+email+`", "Role": "user"}`)
+		assert.Equal(t, http.StatusConflict, resp.Code)
+		var conflict emailConflictError
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&conflict))
+		assert.Equal(t, "wnarchi", conflict.Username)
+	}
+
+	resp = s.requestAs(admin, http.MethodPost, "/user",
+		`{"Username": "narchi", "Name": "Narchi", "Email": "narchi@tudelft.nl", "Role": "user"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, http.StatusConflict, s.requestAs(admin, http.MethodPut, "/user/narchi",
+		`{"Email": "w.narchi@tudelft.nl"}`).Code)
+
+	// Users may keep their own address, in a different case
+	assert.Equal(t, http.StatusOK, s.requestAs(admin, http.MethodPut, "/user/wnarchi",
+		`{"Email": "w.narchi@tudelft.nl"}`).Code)
+}
+
+func TestApi_MergeUsers(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "merge")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", diskpath))
+
+	primary := &user.UserModel{Username: "wnarchi", Email: "w.narchi@tudelft.nl", Role: user.User}
+	duplicate := &user.UserModel{Username: "wnarchi-1", Email: "wnarchi@student.tudelft.nl", Role: user.User}
+	for _, u := range []*user.UserModel{primary, duplicate} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	for uuid, image := range map[images.ImageUUID]images.ImageModel{
+		"kept":      {Name: "gentoo", Username: "wnarchi"},
+		"colliding": {Name: "Gentoo", Username: "wnarchi-1"},
+		"moved":     {Name: "arch", Username: "wnarchi-1"},
+	} {
+		image.UUID = uuid
+		assert.NoError(t, store.CreateImage(&image))
+	}
+
+	assert.NoError(t, store.CreateIdentity(&user.IdentityModel{Provider: user.ProviderGitHub, ProviderID: "42",
+		Login: "wnarchi", Username: "wnarchi-1"}))
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	duplicateToken := s.token(duplicate)
+
+	assert.Equal(t, http.StatusForbidden, s.requestToken(duplicateToken, http.MethodPost, "/admin/users/merge",
+		`{"Primary": "wnarchi-1", "Duplicate": "wnarchi"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, s.request(http.MethodPost, "/admin/users/merge",
+		`{"Primary": "wnarchi", "Duplicate": "wnarchi"}`).Code)
+	assert.Equal(t, http.StatusNotFound, s.request(http.MethodPost, "/admin/users/merge",
+		`{"Primary": "wnarchi", "Duplicate": "nobody"}`).Code)
+
+	resp := s.request(http.MethodPost, "/admin/users/merge", `{"Primary": "wnarchi", "Duplicate": "wnarchi-1"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var result database.MergeResult
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, database.MergeResult{Primary: "wnarchi", Duplicate: "wnarchi-1", Images: 2, Identities: 1,
+		Renamed: 1}, result)
+
+	owned, err := store.GetImagesByUsername("wnarchi")
+	assert.NoError(t, err)
+	names := map[images.ImageUUID]string{}
+	for _, image := range owned {
+		names[image.UUID] = image.Name
+	}
+	assert.Equal(t, map[images.ImageUUID]string{"kept": "gentoo", "colliding": "Gentoo (colliding)", "moved": "arch"},
+		names)
+
+	identity, err := store.GetIdentity(user.ProviderGitHub, "42")
+	assert.NoError(t, err)
+	assert.Equal(t, "wnarchi", identity.Username)
+
+	// The duplicate is disabled, it cannot be merged again and its sessions no longer work
+	assert.Equal(t, http.StatusConflict, s.request(http.MethodPost, "/admin/users/merge",
+		`{"Primary": "wnarchi", "Duplicate": "wnarchi-1"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, s.requestToken(duplicateToken, http.MethodPost,
+		"/admin/users/merge", `{}`).Code)
+}
+
+func TestApi_CheckUser(t *testing.T) {
+	store := newTestStore(t)
+
+	admin := &user.UserModel{Username: "admin", Email: "admin@example.com", Role: user.Admin}
+	test := &user.UserModel{Username: "test", Email: "w.narchi@tudelft.nl", Role: user.User}
+	for _, u := range []*user.UserModel{admin, test} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	check := func(u *user.UserModel, query string) availability {
+		resp := s.requestAs(u, http.MethodGet, "/users/check?"+query, "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var result availability
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	assert.Equal(t, availability{UsernameAvailable: true, UsernameValid: true, EmailAvailable: true, Reasons: []string{}},
+		check(admin, "username=wnarchi&email=narchi@tudelft.nl"))
+
+	// The address is compared the way CreateUser stores it, only administrators learn who has it
+	result := check(test, "username=test&email=%20W.Narchi@TUDelft.NL")
+	assert.False(t, result.UsernameAvailable)
+	assert.True(t, result.UsernameValid)
+	assert.False(t, result.EmailAvailable)
+	assert.Empty(t, result.EmailOwner)
+	assert.Len(t, result.Reasons, 2)
+	assert.Equal(t, "test", check(admin, "email=w.narchi@tudelft.nl").EmailOwner)
+
+	result = check(admin, "username=me")
+	assert.False(t, result.UsernameValid)
+	assert.False(t, result.UsernameAvailable)
+	assert.False(t, result.EmailAvailable)
+	assert.Equal(t, []string{`the username "me" is reserved`}, result.Reasons)
+
+	// CreateUser refuses what the check refuses
+	resp := s.request(http.MethodPost, "/user",
+		`{"Username": "me", "Name": "Me", "Email": "me@example.com", "Role": "user"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "reserved")
+}
+
+func TestApi_RoleCeiling(t *testing.T) {
+	store := newTestStore(t)
+
+	s := newTestServer(t, store, "/tmp", config.Default())
+
+	roles := []user.UserRole{user.User, user.Moderator, user.Admin}
+	callers := map[user.UserRole]*user.UserModel{}
+	for _, role := range roles {
+		caller := &user.UserModel{Username: "caller-" + string(role), Email: string(role) + "@example.com", Role: role}
+		assert.NoError(t, store.CreateUser(caller))
+		callers[role] = caller
+	}
+
+	request := func(caller user.UserRole, method string, uri string, body string) int {
+		return s.requestAs(callers[caller], method, uri, body).Code
+	}
+
+	n := 0
+	for _, caller := range roles {
+		for _, granted := range roles {
+			n++
+			name := "created-" + strconv.Itoa(n)
+			code := request(caller, http.MethodPost, "/user",
+				`{"Username": "`+name+`", "Name": "New", "Email": "`+name+`@example.com", "Role": "`+string(granted)+`"}`)
+			switch {
+			case caller == user.Admin || (caller == user.Moderator && granted == user.User):
+				assert.Equal(t, http.StatusCreated, code, "%s creates a %s", caller, granted)
+			case caller == user.Moderator:
+				assert.Equal(t, http.StatusForbidden, code, "%s creates a %s", caller, granted)
+			default:
+				// Users do not get past the route
+				assert.NotEqual(t, http.StatusCreated, code, "%s creates a %s", caller, granted)
+			}
+
+			for _, current := range roles {
+				n++
+				name = "changed-" + strconv.Itoa(n)
+				assert.NoError(t, store.CreateUser(&user.UserModel{Username: name, Email: name + "@example.com",
+					Role: current}))
+				code = request(caller, http.MethodPut, "/user/"+name, `{"Role": "`+string(granted)+`"}`)
+				stored, err := store.GetUserByUsername(name)
+				assert.NoError(t, err)
+				if caller == user.Admin || (caller.Outranks(current) && caller.Outranks(granted)) {
+					assert.Equal(t, http.StatusOK, code, "%s turns a %s into a %s", caller, current, granted)
+					assert.Equal(t, granted, stored.Role)
+				} else {
+					assert.Equal(t, http.StatusForbidden, code, "%s turns a %s into a %s", caller, current, granted)
+					assert.Equal(t, current, stored.Role)
+				}
+			}
+		}
+	}
+
+	// Everyone edits their own profile, but nobody below an administrator raises their own role
+	for _, caller := range roles {
+		uri := "/user/caller-" + string(caller)
+		assert.Equal(t, http.StatusOK, request(caller, http.MethodPut, uri, `{"Name": "Renamed"}`))
+		if caller != user.Admin {
+			assert.Equal(t, http.StatusForbidden, request(caller, http.MethodPut, uri, `{"Role": "admin"}`))
+		}
+	}
+}
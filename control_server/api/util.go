@@ -5,9 +5,11 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 
+	"github.com/baas-project/baas/pkg/api/types"
 	"github.com/baas-project/baas/pkg/model/images"
 
 	"github.com/baas-project/baas/pkg/database"
@@ -15,24 +17,29 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// GetTag helper function which gets the name out of the request
-// Returns the name in the URI
-func GetTag(tag string, w http.ResponseWriter, r *http.Request) (string, error) {
-	vars := mux.Vars(r)
-	res, ok := vars[tag]
+// MissingTagError is returned when the URI of a request lacks a variable of its route
+type MissingTagError struct {
+	Tag string
+}
+
+func (e *MissingTagError) Error() string {
+	return e.Tag + " not found"
+}
 
+// GetTag gets a variable of the route out of the URI of the request. It leaves answering the request to the handler,
+// which can use TagErrorWrite.
+func GetTag(tag string, r *http.Request) (string, error) {
+	res, ok := mux.Vars(r)[tag]
 	if !ok || res == "" {
-		http.Error(w, tag+" not found", http.StatusBadRequest)
-		log.Errorf("%s", tag+" not provided")
-		return "", errors.New(tag + " not found")
+		return "", &MissingTagError{Tag: tag}
 	}
 
 	return res, nil
 }
 
-// GetName is a shorthand for GetTag(name, r, w)
-func GetName(w http.ResponseWriter, r *http.Request) (string, error) {
-	return GetTag("name", w, r)
+// GetName is a shorthand for GetTag("name", r)
+func GetName(r *http.Request) (string, error) {
+	return GetTag("name", r)
 }
 
 // CreateNewVersion creates a new version for a specified image
@@ -45,11 +52,29 @@ func CreateNewVersion(uuid string, store database.Store) (images.Version, error)
 		return images.Version{}, errors.New("cannot fetch image from database")
 	}
 
-	version := images.Version{Version: image.Versions[len(image.Versions)-1].Version + 1,
-		ImageModelUUID: image.UUID}
+	// Images whose versions were all deleted start over at the first version
+	version := images.Version{ImageModelUUID: image.UUID}
+	if len(image.Versions) != 0 {
+		version.Version = image.Versions[len(image.Versions)-1].Version + 1
+	}
+
+	return version, store.CreateNewImageVersion(version)
+}
+
+// writeMultiStatus answers a bulk request, with 207 Multi-Status when some of its items failed
+func writeMultiStatus(w http.ResponseWriter, result *types.MultiStatus) {
+	writeJSON(w, result.StatusCode(), result)
+}
+
+// writeJSON answers a request with v encoded as JSON, failures to encode it can only be logged since the status is
+// already written by then
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 
-	store.CreateNewImageVersion(version)
-	return version, nil
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Cannot encode the response: %v", err)
+	}
 }
 
 // ErrorWrite writes the same error message on the HTTP stream and log
@@ -62,9 +87,47 @@ func ErrorWrite(w http.ResponseWriter, err error, msg string) error {
 	return err
 }
 
+// TagErrorWrite is ErrorWrite for the errors of GetTag, a variable missing from the URI is the fault of the request
+func TagErrorWrite(w http.ResponseWriter, err error) error {
+	var missing *MissingTagError
+	if errors.As(err, &missing) {
+		http.Error(w, missing.Error(), http.StatusBadRequest)
+		log.Warnf("%s not provided", missing.Tag)
+		return err
+	}
+
+	return ErrorWrite(w, err, "Cannot read the URI")
+}
+
+// StoreErrorWrite is ErrorWrite for errors of the store. A write conflicting with the stored data, such as a
+// duplicate name, is the fault of the request and answered with 409 rather than 500.
+func StoreErrorWrite(w http.ResponseWriter, err error, msg string) error {
+	var constraint *database.ConstraintError
+	if errors.As(err, &constraint) {
+		http.Error(w, msg+": "+constraint.Error(), http.StatusConflict)
+		log.Warnf("%s: %v", msg, err)
+		return err
+	}
+
+	return ErrorWrite(w, err, msg)
+}
+
 // RegisterImagePackageHandlers runs the handlers which install the routes for the modules
 func (api_ *API) RegisterImagePackageHandlers() {
 	api_.RegisterImageDockerHandlers()
+	api_.RegisterImageIconHandlers()
+	// The tiers and the scrubber have to be registered before /image/{uuid}/{version} shadows them
+	api_.RegisterTierHandlers()
+	api_.RegisterRebalanceHandlers()
+	api_.RegisterScrubHandlers()
+	api_.RegisterVersionContentHandlers()
+	api_.RegisterRollbackHandlers()
+	api_.RegisterDiskInfoHandlers()
+	api_.RegisterManifestHandlers()
+	api_.RegisterCompareHandlers()
+	api_.RegisterBackupHandlers()
+	api_.RegisterImageWebhookHandlers()
 	api_.RegisterImageHandlers()
 	api_.RegisterImageSetupHandlers()
+	api_.RegisterImageSetHandlers()
 }
@@ -0,0 +1,92 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// fullVerifyWarning is handed back when a boot is queued which reads back everything it writes
+const fullVerifyWarning = "full verification reads back every image after writing it, which roughly doubles the " +
+	"time it takes to provision the machine"
+
+// verifyMode resolves how a boot reads back its images on a machine: as the boot asks, otherwise as the group of the
+// machine says, otherwise FlashVerify. Diskless boots only flash the machine image, which is never read back.
+func (api_ *API) verifyMode(m *machinemodel.MachineModel, bootSetup *images.BootSetup) images.VerifyMode {
+	if bootSetup.BootMode == images.BootDiskless {
+		return images.VerifyNone
+	}
+
+	if bootSetup.Verify != "" {
+		return bootSetup.Verify
+	}
+
+	if m.Group != "" {
+		group, err := api_.store.GetMachineGroup(m.Group)
+		if err == nil && group.Verify != "" {
+			return images.VerifyMode(group.Verify)
+		} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Errorf("Cannot find group %s of machine %s: %v", m.Group, m.MacAddress.Address, err)
+		}
+	}
+
+	return images.VerifyMode(api_.config.FlashVerify)
+}
+
+// checkVerify refuses read backs the boot cannot do, there is nothing to read back when nothing is flashed
+func checkVerify(bootSetup *images.BootSetup) error {
+	if !bootSetup.Verify.Valid() {
+		return errors.New("verify must be one of none, quick or full")
+	}
+
+	if bootSetup.BootMode == images.BootDiskless && bootSetup.Verify != "" && bootSetup.Verify != images.VerifyNone {
+		return errors.New("diskless boots do not flash their images, so they cannot be verified")
+	}
+
+	return nil
+}
+
+// alertMismatches tells the operators about the images of a boot which did not read back as they were written
+func (api_ *API) alertMismatches(boot *images.BootHistory) {
+	var failed []string
+	for _, verification := range boot.Verification {
+		if verification.Verified {
+			continue
+		}
+
+		var problems []string
+		if len(verification.Mismatches) != 0 {
+			problems = append(problems, fmt.Sprintf("%d blocks differ, the first at offset %d",
+				len(verification.Mismatches), verification.Mismatches[0]))
+		}
+		if verification.PartitionTable != "" {
+			problems = append(problems, verification.PartitionTable)
+		}
+		if verification.Error != "" {
+			problems = append(problems, verification.Error)
+		}
+
+		failed = append(failed, fmt.Sprintf("image %s version %d (%s): %s", verification.ImageUUID,
+			verification.Version, verification.Mode, strings.Join(problems, "; ")))
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	log.Warnf("The images flashed onto %s do not read back as written: %s", boot.MachineMAC,
+		strings.Join(failed, ", "))
+	api_.alert(config.EventFlashMismatch, boot.MachineMAC, fmt.Sprintf("Flash of %s does not match", boot.MachineMAC),
+		fmt.Sprintf("The management OS of %s read back images of boot %d which do not match what it wrote, the "+
+			"disk may be dropping writes:\n%s", boot.MachineMAC, boot.ID, strings.Join(failed, "\n")))
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	machinemodel "github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestApi_FlashVerify(t *testing.T) {
+	store := newTestStore(t)
+
+	diskpath, err := ioutil.TempDir("", "flash-verify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	test := &user.UserModel{Username: "test", Email: "test@example.com", Role: user.User}
+	assert.NoError(t, store.CreateUser(test))
+	mac := util.MacAddress{Address: "abc"}
+	assert.NoError(t, store.CreateMachine(&machinemodel.MachineModel{MacAddress: mac, Group: "lab"}))
+	machineImage, err := images.CreateMachineImageModel(mac)
+	assert.NoError(t, err)
+	assert.NoError(t, store.(sqlite.Store).Session(&gorm.Session{SkipHooks: true}).Create(machineImage).Error)
+
+	image := images.ImageModel{Name: "image", Username: "test", UUID: "image"}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: image.UUID}))
+
+	setup := images.ImageSetup{Name: "setup", UUID: "setup", Username: "test"}
+	assert.NoError(t, store.CreateImageSetup("test", &setup))
+	stored, err := store.GetImageByUUID(image.UUID)
+	assert.NoError(t, err)
+	store.AddImageToImageSetup(&setup, stored, *stored.FindVersion(1), false)
+
+	s := newTestServer(t, store, diskpath, config.Default())
+
+	queue := func(body string) images.BootSetup {
+		resp := s.requestAs(test, http.MethodPost, "/machine/abc/boot", body)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var queued images.BootSetup
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&queued))
+		return queued
+	}
+	claim := func() images.VerifyMode {
+		resp := s.request(http.MethodGet, "/machine/abc/boot", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var claimed images.ImageSetup
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&claimed))
+		return claimed.Verify
+	}
+
+	for _, body := range []string{`{"SetupUUID": "setup", "verify": "twice"}`,
+		`{"SetupUUID": "setup", "BootMode": "diskless", "verify": "quick"}`} {
+		assert.Equal(t, http.StatusBadRequest, s.requestAs(test, http.MethodPost, "/machine/abc/boot", body).Code)
+	}
+
+	// Nothing is read back unless someone asks for it
+	queued := queue(`{"SetupUUID": "setup"}`)
+	assert.Equal(t, images.VerifyNone, queued.Verify)
+	assert.Empty(t, queued.Warnings)
+	assert.Equal(t, images.VerifyNone, claim())
+
+	// The group of the machine decides for the boots which do not say
+	assert.NoError(t, store.SaveMachineGroup(&machinemodel.MachineGroup{Name: "lab", Verify: "quick"}))
+	assert.Equal(t, images.VerifyQuick, queue(`{"SetupUUID": "setup"}`).Verify)
+	assert.Equal(t, images.VerifyQuick, claim())
+
+	// Reading back everything is allowed, but takes its time
+	queued = queue(`{"SetupUUID": "setup", "verify": "full"}`)
+	assert.Equal(t, images.VerifyFull, queued.Verify)
+	assert.Equal(t, []string{fullVerifyWarning}, queued.Warnings)
+	assert.Equal(t, images.VerifyFull, claim())
+
+	// The management OS reports what it read back into the history, a mismatch does not fail the boot
+	resp := s.request(http.MethodPut, "/machine/abc/boot/state", `{"State": "completed", "Verification": [
+		{"ImageUUID": "image", "Version": 1, "Mode": "full", "Checked": 4194304, "Written": 4194304,
+		 "Mismatches": [1048576]}]}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var boot images.BootHistory
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&boot))
+
+	entry, err := store.GetBootHistoryEntry("abc", boot.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, images.BootCompleted, entry.State)
+	assert.Equal(t, images.VerifyFull, entry.VerifyMode)
+	assert.Equal(t, images.FlashVerifications{{ImageUUID: "image", Version: 1, Mode: images.VerifyFull,
+		Checked: 4194304, Written: 4194304, Mismatches: []uint64{1048576}}}, entry.Verification)
+
+	// Boots of a whole group warn on each machine
+	resp = s.requestAs(test, http.MethodPost, "/machine-group/lab/boot", `{"SetupUUID": "setup", "verify": "full"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var result types.MultiStatus
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, []types.MultiStatusItem{{ID: "abc", Status: types.ItemSucceeded, Message: fullVerifyWarning}},
+		result.Items)
+}
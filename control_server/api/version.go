@@ -0,0 +1,34 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+
+	api_pkg "github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// GetVersion returns the version of the control server
+// Example request: GET version
+// Example response: {"Version": "v1.0.0"}
+func (api_ *API) GetVersion(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, struct{ Version string }{api_pkg.Version})
+}
+
+// RegisterVersionHandlers sets the metadata for each of the routes and registers them to the global handler
+func (api_ *API) RegisterVersionHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:              "/version",
+		Permissions:      []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed:      true,
+		Audience:         AudienceEveryone,
+		AnonymousAllowed: true,
+		Scope:            user.ScopeAdmin,
+		Handler:          api_.GetVersion,
+		Method:           http.MethodGet,
+		Description:      "Gets the version of the control server",
+	})
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/limits"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// webhookSecretBytes is the size of the random keys the deliveries of the webhooks are signed with
+const webhookSecretBytes = 32
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the body of a delivery, keyed with the secret of the webhook
+const webhookSignatureHeader = "X-BAAS-Signature"
+
+// webhookRequest is the body of a request which creates a webhook
+type webhookRequest struct {
+	URL string `description:"Where the events are posted to, over http or https"`
+}
+
+// createdWebhook is a webhook which was just created, the only time its secret is handed out
+type createdWebhook struct {
+	images.ImageWebhook
+	Secret string
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	Event     images.WebhookEvent
+	ImageUUID images.ImageUUID
+	ImageName string
+	// Version is the version which was created or deleted, it is left out of the other events
+	Version *uint64 `json:",omitempty"`
+	Public  bool
+	Time    time.Time
+}
+
+// webhookSender posts the events of the images to their webhooks in the background
+type webhookSender struct {
+	client *http.Client
+	// keep is how many deliveries of each webhook are kept
+	keep int
+	// pending are the deliveries which are being posted
+	pending sync.WaitGroup
+}
+
+// newWebhookSender gives the URLs timeout to answer a delivery, zero does not bound them
+func newWebhookSender(timeout time.Duration, keep int) *webhookSender {
+	return &webhookSender{client: &http.Client{Timeout: timeout}, keep: keep}
+}
+
+// wait blocks until the deliveries which were started are done
+func (s *webhookSender) wait() {
+	s.pending.Wait()
+}
+
+// signWebhook signs the body of a delivery as it is sent in the signature header
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts an event to a webhook and records how it went
+func (s *webhookSender) deliver(store database.Store, webhook images.ImageWebhook, event images.WebhookEvent,
+	body []byte) {
+	defer s.pending.Done()
+
+	delivery := images.WebhookDelivery{WebhookID: webhook.ID, Event: event}
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-BAAS-Event", string(event))
+		req.Header.Set(webhookSignatureHeader, signWebhook(webhook.Secret.Reveal(), body))
+
+		var resp *http.Response
+		if resp, err = s.client.Do(req); err == nil {
+			delivery.StatusCode = resp.StatusCode
+			_ = resp.Body.Close()
+		}
+	}
+	delivery.Duration = time.Since(start).Milliseconds()
+
+	fields := log.Fields{"webhook": webhook.ID, "image": webhook.ImageUUID, "event": event}
+	if err != nil {
+		delivery.Error = err.Error()
+		log.WithFields(fields).Warnf("Cannot deliver the event to the webhook: %v", err)
+	} else if !delivery.Succeeded() {
+		delivery.Error = fmt.Sprintf("the webhook answered %d %s", delivery.StatusCode,
+			http.StatusText(delivery.StatusCode))
+		log.WithFields(fields).Warn(delivery.Error)
+	}
+
+	if s.keep == 0 {
+		return
+	}
+
+	if err = store.AddWebhookDelivery(&delivery, s.keep); err != nil {
+		log.WithFields(fields).Errorf("Cannot record the delivery: %v", err)
+	}
+}
+
+// imageEvent tells the webhooks of an image about an event. It does not wait for them, so a slow URL holds up
+// neither the request nor the background job the event happened in. version is nil for events about the whole image.
+func (api_ *API) imageEvent(image *images.ImageModel, event images.WebhookEvent, version *uint64) {
+	webhooks, err := api_.store.GetImageWebhooks(image.UUID)
+	if err != nil {
+		log.Errorf("Cannot fetch the webhooks of image %s: %v", image.UUID, err)
+		return
+	}
+
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{Event: event, ImageUUID: image.UUID, ImageName: image.Name,
+		Version: version, Public: image.Public, Time: time.Now().UTC()})
+	if err != nil {
+		log.Errorf("Cannot encode the %s event of image %s: %v", event, image.UUID, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		api_.webhooks.pending.Add(1)
+		go api_.webhooks.deliver(api_.store, webhook, event, body)
+	}
+}
+
+// checkWebhookURL refuses URLs the deliveries cannot be posted to
+func checkWebhookURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("the URL of a webhook has to be an http or https URL, not %q", raw)
+	}
+
+	return nil
+}
+
+// newWebhookSecret makes the random key a webhook signs its deliveries with
+func newWebhookSecret() (string, error) {
+	b := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getWebhookImage fetches the image of the URI for the webhook routes. Its owner manages its webhooks, and
+// administrators manage those of every image. It answers the request when the image cannot be used.
+func (api_ *API) getWebhookImage(w http.ResponseWriter, r *http.Request) (*images.ImageModel, bool) {
+	if !api_.isAdmin(r) {
+		image, err := api_.checkUserImage(w, r)
+		return image, err == nil
+	}
+
+	uuid, err := GetTag("uuid", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, false
+	}
+
+	image, err := api_.storeFor(r).GetImageByUUID(images.ImageUUID(uuid))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The image does not exist", http.StatusNotFound)
+		return nil, false
+	}
+
+	return image, ErrorWrite(w, err, "Cannot fetch the image") == nil
+}
+
+// getImageWebhook fetches the webhook of the URI, it answers the request when the webhook cannot be used
+func (api_ *API) getImageWebhook(w http.ResponseWriter, r *http.Request) (*images.ImageWebhook, bool) {
+	image, ok := api_.getWebhookImage(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	tag, err := GetTag("id", r)
+	if TagErrorWrite(w, err) != nil {
+		return nil, false
+	}
+
+	id, err := strconv.ParseUint(tag, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid webhook in the URI", http.StatusBadRequest)
+		return nil, false
+	}
+
+	webhook, err := api_.storeFor(r).GetImageWebhook(image.UUID, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "The image has no such webhook", http.StatusNotFound)
+		return nil, false
+	}
+
+	return webhook, ErrorWrite(w, err, "Cannot fetch the webhook") == nil
+}
+
+// CreateImageWebhook posts the events of an image to a URL from now on: new versions, deleted versions and the image
+// being made public or private. The response has the secret the deliveries are signed with, which is not handed
+// out again. Webhooks count against the MaxWebhooks of who created them, except for administrators.
+// Example request: POST /image/87f58936-9540-4dad-aba6-253f06142166/webhooks
+// Example body: {"URL": "https://ci.example.org/hooks/baas"}
+// Example response: {"ID": 3, "ImageUUID": "87f58936-...", "Username": "jan",
+// "URL": "https://ci.example.org/hooks/baas", "CreatedAt": "2022-06-01T12:00:00Z", "Secret": "mS2r..."}
+func (api_ *API) CreateImageWebhook(w http.ResponseWriter, r *http.Request) {
+	image, ok := api_.getWebhookImage(w, r)
+	if !ok {
+		return
+	}
+
+	// The secrets are sealed in the database, they are not stored in the clear
+	if !secrets.Enabled() {
+		http.Error(w, "Image webhooks need a SecretKey or SecretKeyFile, neither is configured",
+			http.StatusBadRequest)
+		return
+	}
+
+	var request webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid webhook given", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkWebhookURL(request.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username := api_.requester(r)
+	if !api_.isAdmin(r) && !api_.checkLimits(w, username, limits.CreateWebhook(api_.config.MaxWebhooks)) {
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if ErrorWrite(w, err, "Cannot make the secret of the webhook") != nil {
+		return
+	}
+
+	webhook := images.ImageWebhook{ImageUUID: image.UUID, Username: username, URL: request.URL,
+		Secret: secrets.NewSecret(secret)}
+	if StoreErrorWrite(w, api_.storeFor(r).CreateImageWebhook(&webhook), "Cannot create the webhook") != nil {
+		return
+	}
+
+	requestLog(r).Infof("%s added webhook %d to image %s", username, webhook.ID, image.UUID)
+	writeJSON(w, http.StatusCreated, createdWebhook{ImageWebhook: webhook, Secret: secret})
+}
+
+// GetImageWebhooks lists the webhooks of an image, without their secrets
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/webhooks
+// Example response: [{"ID": 3, "ImageUUID": "87f58936-...", "Username": "jan",
+// "URL": "https://ci.example.org/hooks/baas", "CreatedAt": "2022-06-01T12:00:00Z"}]
+func (api_ *API) GetImageWebhooks(w http.ResponseWriter, r *http.Request) {
+	image, ok := api_.getWebhookImage(w, r)
+	if !ok {
+		return
+	}
+
+	webhooks, err := api_.storeFor(r).GetImageWebhooks(image.UUID)
+	if ErrorWrite(w, err, "Cannot fetch the webhooks") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+// DeleteImageWebhook stops posting the events of an image to a webhook, its deliveries are forgotten
+// Example request: DELETE /image/87f58936-9540-4dad-aba6-253f06142166/webhooks/3
+func (api_ *API) DeleteImageWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := api_.getImageWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if ErrorWrite(w, api_.storeFor(r).DeleteImageWebhook(webhook), "Cannot delete the webhook") != nil {
+		return
+	}
+
+	requestLog(r).Infof("%s removed webhook %d of image %s", api_.requester(r), webhook.ID, webhook.ImageUUID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries lists the last deliveries of a webhook, the latest first. StatusCode is what the URL answered,
+// it is zero when the URL could not be reached.
+// Example request: GET /image/87f58936-9540-4dad-aba6-253f06142166/webhooks/3/deliveries
+// Example response: [{"ID": 12, "WebhookID": 3, "Event": "version-created", "StatusCode": 502,
+// "Error": "the webhook answered 502 Bad Gateway", "Duration": 31, "CreatedAt": "2022-06-01T12:05:00Z"}]
+func (api_ *API) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := api_.getImageWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := api_.storeFor(r).GetWebhookDeliveries(webhook.ID)
+	if ErrorWrite(w, err, "Cannot fetch the deliveries") != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// RegisterImageWebhookHandlers sets the metadata for the routes of the webhooks of the images
+func (api_ *API) RegisterImageWebhookHandlers() {
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/webhooks",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.CreateImageWebhook,
+		Method:      http.MethodPost,
+		Schema:      "image-webhook",
+		Description: "Posts the events of the image to a URL",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/webhooks",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetImageWebhooks,
+		Method:      http.MethodGet,
+		Description: "Lists the webhooks of the image",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/webhooks/{id}",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesWrite,
+		Handler:     api_.DeleteImageWebhook,
+		Method:      http.MethodDelete,
+		Description: "Stops posting the events of the image to a webhook",
+	})
+
+	api_.Routes = append(api_.Routes, Route{
+		URI:         "/image/{uuid}/webhooks/{id}/deliveries",
+		Permissions: []user.UserRole{user.User, user.Moderator, user.Admin},
+		UserAllowed: true,
+		Scope:       user.ScopeImagesRead,
+		Handler:     api_.GetWebhookDeliveries,
+		Method:      http.MethodGet,
+		Description: "Lists the last deliveries of a webhook of the image",
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi_ImageWebhooks(t *testing.T) {
+	store := newTestStore(t)
+
+	owner := &user.UserModel{Username: "alice", Email: "alice@example.com", Role: user.User}
+	other := &user.UserModel{Username: "bob", Email: "bob@example.com", Role: user.User}
+	for _, u := range []*user.UserModel{owner, other} {
+		assert.NoError(t, store.CreateUser(u))
+	}
+
+	diskpath, err := ioutil.TempDir("", "webhooks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(diskpath)
+
+	image := images.ImageModel{Name: "course", Username: "alice", UUID: "course", Public: true}
+	assert.NoError(t, store.CreateImage(&image))
+	assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "course", Size: 9,
+		Format: images.FormatRaw}))
+
+	conf := config.Default()
+	conf.MaxWebhooks = 1
+	conf.WebhookDeliveriesKept = 2
+	s := newTestServer(t, store, diskpath, conf)
+	assert.NoError(t, os.MkdirAll(diskpath+"/course", os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(s.api.versionFile(&image, 1), []byte("the disk"), 0644))
+
+	var mu sync.Mutex
+	var received []webhookPayload
+	var secret string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+
+		var payload webhookPayload
+		if r.Header.Get(webhookSignatureHeader) != signWebhook(secret, body) ||
+			json.Unmarshal(body, &payload) != nil || r.Header.Get("X-BAAS-Event") != string(payload.Event) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received = append(received, payload)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+
+	// The secrets are sealed, without a key there are no webhooks
+	create := `{"URL": "` + hook.URL + `"}`
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(owner, http.MethodPost, "/image/course/webhooks", create).Code)
+
+	key, err := secrets.GenerateKey("webhooks")
+	assert.NoError(t, err)
+	ring, err := secrets.NewKeyring(key)
+	assert.NoError(t, err)
+	secrets.Use(ring)
+	defer secrets.Use(nil)
+
+	assert.Equal(t, http.StatusForbidden, s.requestAs(other, http.MethodPost, "/image/course/webhooks", create).Code)
+	assert.Equal(t, http.StatusBadRequest, s.requestAs(owner, http.MethodPost, "/image/course/webhooks",
+		`{"URL": "ftp://ci.example.org"}`).Code)
+
+	resp := s.requestAs(owner, http.MethodPost, "/image/course/webhooks", create)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var created createdWebhook
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, "alice", created.Username)
+	assert.NotEmpty(t, created.Secret)
+	mu.Lock()
+	secret = created.Secret
+	mu.Unlock()
+
+	// Owners are held to their limit, administrators are not
+	assert.Equal(t, http.StatusForbidden, s.requestAs(owner, http.MethodPost, "/image/course/webhooks", create).Code)
+	resp = s.requestAs(nil, http.MethodPost, "/image/course/webhooks", `{"URL": "http://localhost:1/unreachable"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var unreachable createdWebhook
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&unreachable))
+
+	resp = s.requestAs(owner, http.MethodGet, "/image/course/webhooks", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Body.String(), created.Secret)
+	var listed []images.ImageWebhook
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	assert.Len(t, listed, 2)
+
+	// A rollback creates a version, deleting it and making the image private are told as well
+	assert.Equal(t, http.StatusCreated, s.requestAs(owner, http.MethodPost, "/image/course/versions/1/rollback", "").Code)
+	s.api.webhooks.wait()
+	assert.Equal(t, http.StatusNoContent, s.requestAs(owner, http.MethodDelete, "/image/course/2", "").Code)
+	s.api.webhooks.wait()
+	assert.Equal(t, http.StatusOK, s.requestAs(owner, http.MethodPut, "/image/course",
+		`{"UUID": "course", "Name": "course", "Public": false}`).Code)
+	s.api.webhooks.wait()
+
+	mu.Lock()
+	assert.Len(t, received, 3)
+	if len(received) == 3 {
+		assert.Equal(t, images.WebhookVersionCreated, received[0].Event)
+		assert.Equal(t, uint64(2), *received[0].Version)
+		assert.Equal(t, images.WebhookVersionDeleted, received[1].Event)
+		assert.Equal(t, uint64(2), *received[1].Version)
+		assert.Equal(t, images.WebhookVisibilityChanged, received[2].Event)
+		assert.Nil(t, received[2].Version)
+		assert.False(t, received[2].Public)
+	}
+	mu.Unlock()
+
+	// Only the last deliveries are kept, the failed ones say why
+	uri := "/image/course/webhooks/" + strconv.FormatUint(uint64(created.ID), 10)
+	resp = s.requestAs(owner, http.MethodGet, uri+"/deliveries", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var deliveries []images.WebhookDelivery
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&deliveries))
+	assert.Len(t, deliveries, 2)
+	for _, delivery := range deliveries {
+		assert.Equal(t, http.StatusNoContent, delivery.StatusCode)
+	}
+	assert.Equal(t, images.WebhookVisibilityChanged, deliveries[0].Event)
+
+	failed, err := store.GetWebhookDeliveries(unreachable.ID)
+	assert.NoError(t, err)
+	assert.Len(t, failed, 2)
+	assert.False(t, failed[0].Succeeded())
+	assert.NotEmpty(t, failed[0].Error)
+
+	assert.Equal(t, http.StatusNotFound, s.requestAs(owner, http.MethodDelete, "/image/course/webhooks/99", "").Code)
+	assert.Equal(t, http.StatusNoContent, s.requestAs(owner, http.MethodDelete,
+		"/image/course/webhooks/"+strconv.FormatUint(uint64(unreachable.ID), 10), "").Code)
+
+	// Trashing the image removes its webhooks
+	assert.Equal(t, http.StatusNoContent, s.requestAs(owner, http.MethodDelete, "/image/course", "").Code)
+	left, err := store.GetImageWebhooks("course")
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+	count, err := store.CountWebhooks("alice")
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package authz decides what users may do with the images and the machines. The API asks it on every request, and
+// the access check of the administrators asks it the same questions, so the check cannot tell another story than
+// the requests themselves. Every decision lists the rules it evaluated, in order, up to the one which decided.
+package authz
+
+import (
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// Action is what a user wants to do with a resource
+type Action string
+
+const (
+	// Read fetches the resource
+	Read Action = "read"
+	// Write changes the resource
+	Write Action = "write"
+	// Boot boots an image, or queues a boot on a machine
+	Boot Action = "boot"
+)
+
+// Valid reports whether the action is one of the known ones
+func (a Action) Valid() bool {
+	return a == Read || a == Write || a == Boot
+}
+
+// The rules a decision can consist of
+const (
+	// RuleRole is the role of the user, admitted by a route or granting the action by itself
+	RuleRole = "role"
+	// RuleOwnership is the user owning the image
+	RuleOwnership = "ownership"
+	// RulePublic is the image being visible to everyone
+	RulePublic = "public"
+	// RuleUnrestricted is the machine being bootable by everyone
+	RuleUnrestricted = "unrestricted"
+	// RuleModeratorScope is the moderator moderating everyone, or a course of the machine. Its detail is the scope,
+	// global or the name of the course.
+	RuleModeratorScope = "moderator_scope"
+	// RuleGrant is the user having been granted the machine directly
+	RuleGrant = "grant"
+	// RuleCourse is the user taking part in a course which has the machine
+	RuleCourse = "course"
+	// RuleRoleCeiling is the role of the user being above the role of the user they manage, and above the role they
+	// hand out
+	RuleRoleCeiling = "role_ceiling"
+)
+
+// GlobalScope is the scope of moderators who are not limited to any course
+const GlobalScope = "global"
+
+// Subject is the user a decision is about
+type Subject struct {
+	Username string
+	Role     user.UserRole
+}
+
+// Rule is a single rule a decision evaluated
+type Rule struct {
+	Rule    string
+	Matched bool
+	Detail  string `json:",omitempty"`
+}
+
+// Decision is whether a user may do something, and why
+type Decision struct {
+	Allowed bool
+	Rules   []Rule
+}
+
+// check records a rule, a matching rule allows the action
+func (d *Decision) check(rule string, matched bool, detail string) bool {
+	d.Rules = append(d.Rules, Rule{Rule: rule, Matched: matched, Detail: detail})
+	d.Allowed = matched
+	return matched
+}
+
+// Then continues a decision which allowed the action with the next one, both have to allow it
+func (d Decision) Then(next Decision) Decision {
+	if !d.Allowed {
+		return d
+	}
+
+	return Decision{Allowed: next.Allowed, Rules: append(d.Rules, next.Rules...)}
+}
+
+// Admits reports whether a route which admits the permissions admits the role
+func Admits(permissions []user.UserRole, role user.UserRole) bool {
+	for _, permitted := range permissions {
+		if permitted == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Route decides whether a route which admits the permissions admits the subject
+func Route(subject Subject, permissions []user.UserRole) Decision {
+	roles := make([]string, len(permissions))
+	for i, permitted := range permissions {
+		roles[i] = string(permitted)
+	}
+
+	var d Decision
+	d.check(RuleRole, Admits(permissions, subject.Role), "the route admits "+strings.Join(roles, ", "))
+	return d
+}
+
+// Image decides whether a subject may use an image. Reading and changing it is up to its owner. Booting it is up to
+// its owner as well, everyone for public images and administrators for all of them.
+func Image(subject Subject, image *images.ImageModel, action Action) Decision {
+	var d Decision
+	owned := image.Username != "" && image.Username == subject.Username
+	if d.check(RuleOwnership, owned, "the image belongs to "+image.Username) || action != Boot {
+		return d
+	}
+
+	if d.check(RulePublic, image.Public, "") {
+		return d
+	}
+
+	d.check(RuleRole, subject.Role == user.Admin, "administrators boot every image")
+	return d
+}
+
+// ManageUser decides whether a subject may create or change a user who has the role current and gets the role
+// granted. Administrators manage every user. Others only manage the users below them, and only hand out the roles
+// below their own, so nobody raises anyone to their own rank. current is empty for users who do not exist yet.
+func ManageUser(subject Subject, current user.UserRole, granted user.UserRole) Decision {
+	var d Decision
+	if d.check(RuleRole, subject.Role == user.Admin, "administrators manage every user") {
+		return d
+	}
+
+	if current != "" && !d.check(RuleRoleCeiling, subject.Role.Outranks(current), "the user is "+string(current)) {
+		return d
+	}
+
+	d.check(RuleRoleCeiling, subject.Role.Outranks(granted), "the role to hand out is "+string(granted))
+	return d
+}
+
+// Grants looks up what gives users access to restricted machines
+type Grants interface {
+	GetModeratorScopes(moderator string) ([]course.ModeratorScope, error)
+	GetModeratorScopeOfMachine(moderator string, mac string) (string, error)
+	GetMachineAccess(mac string, username string, at time.Time) (*machine.MachineAccess, error)
+}
+
+// BootMachine decides whether a subject may queue boots on a machine. Anyone may boot machines which are not
+// restricted, administrators and moderators without a scope may boot all of them. Moderators who are scoped to
+// courses may boot the machines of those courses. Other users need a grant of the machine, or take part in a
+// course which has not expired and has the machine.
+func BootMachine(grants Grants, subject Subject, m *machine.MachineModel, at time.Time) (Decision, error) {
+	var d Decision
+	if d.check(RuleUnrestricted, !m.Restricted, "") {
+		return d, nil
+	}
+
+	if d.check(RuleRole, subject.Role == user.Admin, "administrators boot every machine") {
+		return d, nil
+	}
+
+	mac := m.MacAddress.Address
+	if subject.Role == user.Moderator {
+		scopes, err := grants.GetModeratorScopes(subject.Username)
+		if err != nil {
+			return d, err
+		}
+
+		scope := GlobalScope
+		if len(scopes) != 0 {
+			if scope, err = grants.GetModeratorScopeOfMachine(subject.Username, mac); err != nil {
+				return d, err
+			}
+		}
+
+		if d.check(RuleModeratorScope, scope != "", scope) {
+			return d, nil
+		}
+	}
+
+	access, err := grants.GetMachineAccess(mac, subject.Username, at)
+	if err != nil {
+		return d, err
+	}
+
+	if d.check(RuleGrant, access.Granted, "") {
+		return d, nil
+	}
+
+	detail := ""
+	if access.Course != "" {
+		detail = "the machine belongs to course " + access.Course
+	}
+
+	d.check(RuleCourse, access.Course != "", detail)
+	return d, nil
+}
+
+// Scope returns the course or global scope a decision to boot a machine was made under, it is empty when no
+// moderator scope decided it
+func (d Decision) Scope() string {
+	if n := len(d.Rules); d.Allowed && n != 0 && d.Rules[n-1].Rule == RuleModeratorScope {
+		return d.Rules[n-1].Detail
+	}
+
+	return ""
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// grants are the grants of a single machine
+type grants struct {
+	scopes  map[string][]course.ModeratorScope
+	courses map[string]string
+	access  map[string]*machine.MachineAccess
+}
+
+func (g grants) GetModeratorScopes(moderator string) ([]course.ModeratorScope, error) {
+	return g.scopes[moderator], nil
+}
+
+func (g grants) GetModeratorScopeOfMachine(moderator string, _ string) (string, error) {
+	return g.courses[moderator], nil
+}
+
+func (g grants) GetMachineAccess(_ string, username string, _ time.Time) (*machine.MachineAccess, error) {
+	if access, ok := g.access[username]; ok {
+		return access, nil
+	}
+
+	return &machine.MachineAccess{}, nil
+}
+
+// rules lists the names of the rules a decision evaluated
+func rules(d Decision) []string {
+	names := []string{}
+	for _, rule := range d.Rules {
+		names = append(names, rule.Rule)
+	}
+	return names
+}
+
+func TestImage(t *testing.T) {
+	private := &images.ImageModel{Username: "jan"}
+	public := &images.ImageModel{Username: "jan", Public: true}
+	jan := Subject{Username: "jan", Role: user.User}
+	piet := Subject{Username: "piet", Role: user.User}
+	admin := Subject{Username: "root", Role: user.Admin}
+
+	for _, tc := range []struct {
+		subject Subject
+		image   *images.ImageModel
+		action  Action
+		allowed bool
+		rules   []string
+	}{
+		{jan, private, Write, true, []string{RuleOwnership}},
+		{piet, public, Read, false, []string{RuleOwnership}},
+		{admin, private, Write, false, []string{RuleOwnership}},
+		{piet, public, Boot, true, []string{RuleOwnership, RulePublic}},
+		{piet, private, Boot, false, []string{RuleOwnership, RulePublic, RuleRole}},
+		{admin, private, Boot, true, []string{RuleOwnership, RulePublic, RuleRole}},
+	} {
+		d := Image(tc.subject, tc.image, tc.action)
+		assert.Equal(t, tc.allowed, d.Allowed, "%s %s", tc.subject.Username, tc.action)
+		assert.Equal(t, tc.rules, rules(d), "%s %s", tc.subject.Username, tc.action)
+	}
+}
+
+func TestBootMachine(t *testing.T) {
+	restricted := &machine.MachineModel{MacAddress: util.MacAddress{Address: "52:54:00:d9:71:93"}, Restricted: true}
+	g := grants{
+		scopes:  map[string][]course.ModeratorScope{"ta": {{Moderator: "ta", CourseName: "os"}}},
+		courses: map[string]string{"ta": "os"},
+		access: map[string]*machine.MachineAccess{
+			"alice": {Course: "os"},
+			"bob":   {Granted: true, Course: "os"},
+		},
+	}
+
+	for _, tc := range []struct {
+		subject Subject
+		allowed bool
+		rules   []string
+		detail  string
+	}{
+		{Subject{"root", user.Admin}, true, []string{RuleUnrestricted, RuleRole}, "administrators boot every machine"},
+		{Subject{"global", user.Moderator}, true, []string{RuleUnrestricted, RuleRole, RuleModeratorScope},
+			GlobalScope},
+		{Subject{"ta", user.Moderator}, true, []string{RuleUnrestricted, RuleRole, RuleModeratorScope}, "os"},
+		{Subject{"bob", user.User}, true, []string{RuleUnrestricted, RuleRole, RuleGrant}, ""},
+		{Subject{"alice", user.User}, true, []string{RuleUnrestricted, RuleRole, RuleGrant, RuleCourse},
+			"the machine belongs to course os"},
+		{Subject{"carol", user.User}, false, []string{RuleUnrestricted, RuleRole, RuleGrant, RuleCourse}, ""},
+	} {
+		d, err := BootMachine(g, tc.subject, restricted, time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, tc.allowed, d.Allowed, tc.subject.Username)
+		assert.Equal(t, tc.rules, rules(d), tc.subject.Username)
+		assert.Equal(t, tc.detail, d.Rules[len(d.Rules)-1].Detail, tc.subject.Username)
+	}
+
+	// A moderator outside the courses of the machine is treated like any other user
+	g.courses["ta"] = ""
+	d, err := BootMachine(g, Subject{"ta", user.Moderator}, restricted, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "", d.Scope())
+	assert.Equal(t, []string{RuleUnrestricted, RuleRole, RuleModeratorScope, RuleGrant, RuleCourse}, rules(d))
+
+	// Machines which are not restricted are open to everyone
+	d, err = BootMachine(g, Subject{"carol", user.User}, &machine.MachineModel{}, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, []string{RuleUnrestricted}, rules(d))
+}
+
+func TestRoute(t *testing.T) {
+	admins := []user.UserRole{user.Admin}
+	d := Route(Subject{"jan", user.User}, admins)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, []Rule{{Rule: RuleRole, Detail: "the route admits admin"}}, d.Rules)
+
+	// Only a route which allowed the action continues with the resource
+	assert.Equal(t, d, d.Then(Decision{Allowed: true}))
+	allowed := Route(Subject{"root", user.Admin}, admins).Then(Decision{Rules: []Rule{{Rule: RuleOwnership}}})
+	assert.False(t, allowed.Allowed)
+	assert.Equal(t, []string{RuleRole, RuleOwnership}, rules(allowed))
+}
+
+func TestManageUser(t *testing.T) {
+	jan := Subject{"jan", user.User}
+	ta := Subject{"ta", user.Moderator}
+	root := Subject{"root", user.Admin}
+
+	for _, tc := range []struct {
+		subject Subject
+		current user.UserRole
+		granted user.UserRole
+		allowed bool
+	}{
+		// Creating users
+		{jan, "", user.User, false},
+		{ta, "", user.User, true},
+		{ta, "", user.Moderator, false},
+		{ta, "", user.Admin, false},
+		{root, "", user.Admin, true},
+		// Changing the roles of users
+		{jan, user.User, user.User, false},
+		{ta, user.User, user.User, true},
+		{ta, user.User, user.Moderator, false},
+		{ta, user.Moderator, user.User, false},
+		{ta, user.Admin, user.User, false},
+		{root, user.User, user.Admin, true},
+		{root, user.Admin, user.User, true},
+	} {
+		d := ManageUser(tc.subject, tc.current, tc.granted)
+		assert.Equal(t, tc.allowed, d.Allowed, "%s turns %q into %s", tc.subject.Role, tc.current, tc.granted)
+	}
+
+	d := ManageUser(ta, user.Moderator, user.User)
+	assert.Equal(t, []string{RuleRole, RuleRoleCeiling}, rules(d))
+	assert.Equal(t, "the user is moderator", d.Rules[1].Detail)
+
+	d = ManageUser(ta, user.User, user.Moderator)
+	assert.Equal(t, []string{RuleRole, RuleRoleCeiling, RuleRoleCeiling}, rules(d))
+	assert.Equal(t, "the role to hand out is moderator", d.Rules[2].Detail)
+}
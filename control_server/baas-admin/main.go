@@ -0,0 +1,349 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// baas-admin performs maintenance on the database of the control server while it is stopped, and runs the bulk
+// operations of a control server which is running
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+)
+
+var (
+	confpath = flag.String("config", "", "Configuration file of the control server.")
+	dbpath   = flag.String("db", "store.db", "Database of the control server.")
+
+	server         = flag.String("server", "http://localhost:4848", "URL of the control server, for bulk operations.")
+	allowPartial   = flag.Bool("allow-partial", false, "Succeed when only some items of a bulk operation failed.")
+	override       = flag.Bool("override", false, "Pass the cap on the active boots, for boot-group.")
+	importFormat   = flag.String("format", "", "Format of the file to import, csv or leases. Guessed when empty.")
+	updateExisting = flag.Bool("update-existing", false, "Update the machines which exist, for import-machines.")
+	githubAPI      = flag.String("github-api", "https://api.github.com", "GitHub API, for link-github.")
+	dryRun         = flag.Bool("dry-run", false, "Print the accounts link-github would link without linking them.")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: baas-admin [flags] <command>
+
+Commands:
+  generate-key <id>     Prints a new key for SecretKey or SecretKeyFile
+  generate-session-key  Prints a new key for SessionKeys
+  rotate-keys           Seals all secrets in the database with the last key of SecretKeyFile
+  promote               Makes a replica a control server of its own, which accepts changes
+  link-github           Links the accounts from before identities existed to the GitHub account they are
+                        named after, run once while upgrading
+  boot-group <group> <file>
+                        Queues the boot setup of a JSON file on every machine of a group
+  import-machines <file>
+                        Registers the machines of a CSV or dnsmasq leases file
+
+The bulk operations print what happened to every item and fail when any item did, unless --allow-partial is given.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// generateKey prints a new key, which is added to the end of the key file to start sealing with it
+func generateKey(id string) error {
+	key, err := secrets.GenerateKey(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(key)
+	return nil
+}
+
+// generateSessionKey prints a new key, which is added to the end of SessionKeys to start sealing the sessions with it
+func generateSessionKey() error {
+	key, err := config.GenerateSessionKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(key)
+	return nil
+}
+
+// rotateKeys seals every secret with the primary key, after which the older keys can be removed from the key file
+func rotateKeys() error {
+	conf := config.Default()
+	if *confpath != "" {
+		var err error
+		if conf, err = config.Load(*confpath); err != nil {
+			return err
+		}
+	}
+
+	keyring, err := conf.Keyring()
+	if err != nil {
+		return err
+	}
+
+	if keyring == nil {
+		return fmt.Errorf("neither SecretKey nor SecretKeyFile is configured")
+	}
+
+	store, err := sqlite.NewSqliteStore(*dbpath)
+	if err != nil {
+		return err
+	}
+
+	ids, err := store.SecretKeyIDs()
+	if err != nil {
+		return err
+	}
+
+	if missing := secrets.Missing(keyring, ids); len(missing) != 0 {
+		return fmt.Errorf("secrets are sealed with the keys %v, which are not configured", missing)
+	}
+
+	rotated, err := store.RotateSecrets(keyring)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Sealed %d secrets with key %s, keys other than %s can be removed now\n", rotated,
+		keyring.Primary(), keyring.Primary())
+	return nil
+}
+
+// promote stops the database from being a replica, the control server started on it accepts changes again
+func promote() error {
+	store, err := sqlite.NewSqliteStore(*dbpath)
+	if err != nil {
+		return err
+	}
+
+	state, err := store.GetReplicationState()
+	if err != nil {
+		return err
+	}
+
+	if err = store.PromoteReplica(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Promoted the replica of %s, it has the changes up to %d. Start the control server without "+
+		"--replica-of\n", state.PrimaryURL, state.Cursor)
+	return nil
+}
+
+// githubAccount is the part of a GitHub user which link-github needs
+type githubAccount struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+}
+
+// lookupGitHub finds the GitHub account with a login. GITHUB_TOKEN is sent when it is set, since GitHub allows few
+// requests without it.
+func lookupGitHub(login string) (*githubAccount, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*githubAPI, "/")+"/users/"+url.PathEscape(login),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("there is no GitHub account named %s", login)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub answered %s", resp.Status)
+	}
+
+	var account githubAccount
+	if err = json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return nil, fmt.Errorf("cannot read the GitHub account: %w", err)
+	}
+
+	return &account, nil
+}
+
+// linkGitHub links the users from before identities existed to the GitHub account with their name, which is how they
+// logged in until then. Users of the LDAP synchronization and users with an identity are left alone.
+func linkGitHub() error {
+	store, err := sqlite.NewSqliteStore(*dbpath)
+	if err != nil {
+		return err
+	}
+
+	users, err := store.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	linked, failed := 0, 0
+	for _, u := range users {
+		if u.LDAPRole != "" {
+			continue
+		}
+
+		identities, err := store.GetIdentitiesByUsername(u.Username)
+		if err != nil {
+			return err
+		}
+		if len(identities) != 0 {
+			continue
+		}
+
+		account, err := lookupGitHub(u.Username)
+		if err == nil && !*dryRun {
+			err = store.CreateIdentity(&user.IdentityModel{
+				Provider:   user.ProviderGitHub,
+				ProviderID: strconv.FormatInt(account.ID, 10),
+				Login:      account.Login,
+				Username:   u.Username,
+			})
+		}
+
+		if err != nil {
+			fmt.Printf("%s: %v\n", u.Username, err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s: GitHub account %d (%s)\n", u.Username, account.ID, account.Login)
+		linked++
+	}
+
+	if *dryRun {
+		fmt.Printf("Would link %d users, %d cannot be linked\n", linked, failed)
+	} else {
+		fmt.Printf("Linked %d users, %d could not be linked\n", linked, failed)
+	}
+
+	if failed != 0 && !*allowPartial {
+		return fmt.Errorf("%d users could not be linked, link them with POST /user/[name]/identities", failed)
+	}
+
+	return nil
+}
+
+// printResult prints the outcome of a bulk operation, the statuses are colored when printed to a terminal
+func printResult(result *types.MultiStatus) error {
+	color := false
+	if info, err := os.Stdout.Stat(); err == nil {
+		color = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	return client.WriteMultiStatus(os.Stdout, result, color)
+}
+
+// bootGroup queues a boot setup on every machine of a group
+func bootGroup(group string, path string) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var bootSetup images.BootSetup
+	if err = json.Unmarshal(file, &bootSetup); err != nil {
+		return fmt.Errorf("cannot read the boot setup: %w", err)
+	}
+
+	result, err := client.New(*server).BootMachineGroup(group, &bootSetup, *override)
+	if err != nil {
+		return err
+	}
+
+	if err = printResult(result); err != nil {
+		return err
+	}
+
+	return client.CheckPartial(result, *allowPartial)
+}
+
+// importMachines registers the machines of a file, none are when any row is wrong
+func importMachines(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Refused imports are never partial, --allow-partial does not apply as nothing was imported
+	result, err := client.New(*server).ImportMachines(file, *importFormat, *updateExisting)
+	var partial *client.PartialError
+	if errors.As(err, &partial) {
+		if err = printResult(result); err != nil {
+			return err
+		}
+		return fmt.Errorf("nothing was imported, %w", partial)
+	} else if err != nil {
+		return err
+	}
+
+	return printResult(result)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "generate-key":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = generateKey(flag.Arg(1))
+	case "generate-session-key":
+		err = generateSessionKey()
+	case "rotate-keys":
+		err = rotateKeys()
+	case "promote":
+		err = promote()
+	case "link-github":
+		err = linkGitHub()
+	case "boot-group":
+		if flag.NArg() != 3 {
+			usage()
+			os.Exit(2)
+		}
+		err = bootGroup(flag.Arg(1), flag.Arg(2))
+	case "import-machines":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = importMachines(flag.Arg(1))
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "baas-admin: %v\n", err)
+		os.Exit(1)
+	}
+}
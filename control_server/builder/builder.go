@@ -0,0 +1,140 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package builder turns container images and root file system tarballs into bootable raw disk images. A build
+// unpacks the root file system in a working directory of its own, which it may only fill up to a limit, and hands
+// it to a Builder which partitions the disk image, copies the files onto it and installs the bootloader.
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// UnsupportedError is returned for inputs which cannot be turned into a bootable image, rather than building an
+// image which does not boot
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "unsupported input: " + e.Reason
+}
+
+// Builder writes a bootable raw disk image of a root file system
+type Builder interface {
+	// Build writes the disk image of the root file system in rootfs to image, which may take at most limit bytes.
+	// Its output goes to log.
+	Build(ctx context.Context, rootfs string, image string, limit int64, log io.Writer) error
+}
+
+// Puller fetches the root file system of a container image
+type Puller interface {
+	// Pull writes the root file system of the image, with its layers flattened, as a tarball to w. Its output
+	// goes to log.
+	Pull(ctx context.Context, reference string, w io.Writer, log io.Writer) error
+}
+
+// sandboxEnv is the environment the commands of a build run with, nothing of the control server leaks in
+func sandboxEnv() []string {
+	return []string{"PATH=" + os.Getenv("PATH"), "LC_ALL=C"}
+}
+
+// ScriptBuilder runs a script which creates the partitions, copies the root file system onto them and installs the
+// bootloader. The script is called with the root file system, the disk image, the most bytes the disk image may take
+// and the name of the bootloader.
+type ScriptBuilder struct {
+	script     string
+	bootloader string
+}
+
+// NewScriptBuilder creates a builder which runs script to install bootloader
+func NewScriptBuilder(script string, bootloader string) *ScriptBuilder {
+	// The script runs in the working directory of the build
+	if abs, err := filepath.Abs(script); err == nil {
+		script = abs
+	}
+
+	return &ScriptBuilder{script: script, bootloader: bootloader}
+}
+
+// Build runs the script in the working directory of the build
+func (b *ScriptBuilder) Build(ctx context.Context, rootfs string, image string, limit int64, log io.Writer) error {
+	cmd := exec.CommandContext(ctx, b.script, rootfs, image, strconv.FormatInt(limit, 10), b.bootloader)
+	cmd.Dir = filepath.Dir(image)
+	cmd.Env = sandboxEnv()
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return cmd.Run()
+}
+
+// CranePuller pulls container images with crane, from go-containerregistry
+type CranePuller struct {
+	crane string
+}
+
+// NewCranePuller creates a puller which runs the crane binary
+func NewCranePuller(crane string) *CranePuller {
+	return &CranePuller{crane: crane}
+}
+
+// manifest holds the fields of an image manifest or index which tell them apart
+type manifest struct {
+	SchemaVersion int
+	MediaType     string
+	Manifests     []json.RawMessage
+}
+
+// checkManifest refuses references which do not point at the image of a single platform
+func checkManifest(reference string, raw []byte) error {
+	var m manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return fmt.Errorf("cannot read the manifest of %s: %w", reference, err)
+	}
+
+	switch {
+	case m.Manifests != nil || m.MediaType == "application/vnd.oci.image.index.v1+json" ||
+		m.MediaType == "application/vnd.docker.distribution.manifest.list.v2+json":
+		return &UnsupportedError{Reason: fmt.Sprintf("%s is a multi-architecture index of %d images, "+
+			"refer to the image of a single platform by its digest", reference, len(m.Manifests))}
+	case m.SchemaVersion != 2:
+		return &UnsupportedError{Reason: fmt.Sprintf("%s has a manifest of schema version %d, only version 2 is "+
+			"supported", reference, m.SchemaVersion)}
+	}
+
+	return nil
+}
+
+// Pull checks the manifest of the image before exporting its file system
+func (p *CranePuller) Pull(ctx context.Context, reference string, w io.Writer, log io.Writer) error {
+	var raw bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.crane, "manifest", reference)
+	cmd.Env = sandboxEnv()
+	cmd.Stdout = &raw
+	cmd.Stderr = log
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot fetch the manifest of %s: %w", reference, err)
+	}
+
+	if err := checkManifest(reference, raw.Bytes()); err != nil {
+		return err
+	}
+
+	cmd = exec.CommandContext(ctx, p.crane, "export", reference, "-")
+	cmd.Env = sandboxEnv()
+	cmd.Stdout = w
+	cmd.Stderr = log
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot export the file system of %s: %w", reference, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/stretchr/testify/assert"
+)
+
+// entry is a file in a test tarball, a Linkname makes it a symbolic link
+type entry struct {
+	name     string
+	body     string
+	linkname string
+	dir      bool
+}
+
+func tarball(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.dir {
+			header = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		} else if e.linkname != "" {
+			header = &tar.Header{Name: e.name, Linkname: e.linkname, Typeflag: tar.TypeSymlink}
+		}
+
+		assert.NoError(t, w.WriteHeader(header))
+		_, err := w.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "builder")
+	assert.NoError(t, err)
+	return dir
+}
+
+var bootable = []entry{{name: "etc", dir: true}, {name: "etc/hostname", body: "machine\n"},
+	{name: "boot/vmlinuz-5.15", body: "kernel"}}
+
+func TestExtract(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write(tarball(t, append(bootable, entry{name: "bin/sh", linkname: "busybox"})...))
+	assert.NoError(t, gz.Close())
+
+	written, err := Extract(&compressed, dir, 100, ioutil.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("machine\nkernel")), written)
+	assert.NoError(t, CheckRootFS(dir))
+
+	link, err := os.Readlink(filepath.Join(dir, "bin", "sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, "busybox", link)
+}
+
+func TestExtract_Refused(t *testing.T) {
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+
+	var unsupported *UnsupportedError
+	for name, test := range map[string]struct {
+		input       []byte
+		unsupported bool
+	}{
+		"empty":         {input: nil, unsupported: true},
+		"not a tarball": {input: []byte(strings.Repeat("not a tarball", 100)), unsupported: true},
+		"image archive": {input: tarball(t, entry{name: "manifest.json", body: "[]"}), unsupported: true},
+		"too large":     {input: tarball(t, entry{name: "large", body: strings.Repeat("a", 200)})},
+		"symbolic link": {input: tarball(t, entry{name: "escape", linkname: outside}, entry{name: "escape/x"})},
+		"absolute link": {input: tarball(t, entry{name: "a", linkname: "/"}, entry{name: "a/etc/passwd"})},
+	} {
+		dir := tempDir(t)
+		_, err := Extract(bytes.NewReader(test.input), dir, 100, ioutil.Discard)
+		assert.Error(t, err, name)
+		assert.Equal(t, test.unsupported, errors.As(err, &unsupported), name)
+		os.RemoveAll(dir)
+	}
+
+	// Nothing was written outside of the root file system
+	files, err := ioutil.ReadDir(outside)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestExtract_TraversalStaysInside(t *testing.T) {
+	parent := tempDir(t)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "rootfs")
+	assert.NoError(t, os.Mkdir(dir, 0755))
+
+	_, err := Extract(bytes.NewReader(tarball(t, entry{name: "../../escaped", body: "x"})), dir, 100, ioutil.Discard)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "escaped"))
+	assert.NoFileExists(t, filepath.Join(parent, "escaped"))
+}
+
+func TestCheckRootFS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := Extract(bytes.NewReader(tarball(t, bootable[:2]...)), dir, 100, ioutil.Discard)
+	assert.NoError(t, err)
+
+	var unsupported *UnsupportedError
+	assert.True(t, errors.As(CheckRootFS(dir), &unsupported))
+}
+
+func TestCheckManifest(t *testing.T) {
+	var unsupported *UnsupportedError
+	assert.NoError(t, checkManifest("debian", []byte(`{"schemaVersion": 2, "layers": []}`)))
+
+	err := checkManifest("debian", []byte(`{"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [{}, {}]}`))
+	assert.True(t, errors.As(err, &unsupported))
+	assert.Contains(t, err.Error(), "multi-architecture index of 2 images")
+
+	assert.True(t, errors.As(checkManifest("old", []byte(`{"schemaVersion": 1}`)), &unsupported))
+}
+
+// fakeBuilder writes an empty disk image of its size
+type fakeBuilder struct {
+	size int64
+}
+
+func (b fakeBuilder) Build(_ context.Context, rootfs string, image string, limit int64, log io.Writer) error {
+	_, _ = fmt.Fprintf(log, "building %d bytes at most\n", limit)
+	return ioutil.WriteFile(image, make([]byte, b.size), 0644)
+}
+
+// fakePuller serves the tarball of every reference
+type fakePuller struct {
+	tarball []byte
+}
+
+func (p fakePuller) Pull(_ context.Context, reference string, w io.Writer, _ io.Writer) error {
+	if reference == "multiarch" {
+		return &UnsupportedError{Reason: "multiarch is a multi-architecture index"}
+	}
+
+	_, err := w.Write(p.tarball)
+	return err
+}
+
+// waitFinished polls a job until it stops
+func waitFinished(t *testing.T, q *Queue, id uint64) Job {
+	for i := 0; i < 200; i++ {
+		job, err := q.Get(id)
+		assert.NoError(t, err)
+		if job.State == Succeeded || job.State == Failed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("build %d did not finish", id)
+	return Job{}
+}
+
+func TestQueue(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var registered []string
+	register := func(job Job, image string) (uint64, error) {
+		info, err := os.Stat(image)
+		if err != nil {
+			return 0, err
+		}
+		registered = append(registered, fmt.Sprintf("%s:%d", job.Image, info.Size()))
+		return uint64(len(registered)), nil
+	}
+
+	q := NewQueue(Config{Dir: dir, MaxBytes: 1 << 20, Timeout: time.Minute, MaxQueued: 4}, fakeBuilder{size: 64},
+		fakePuller{tarball: tarball(t, bootable...)}, register)
+
+	job, err := q.Submit("alice", images.ImageUUID("disk"), "debian", nil)
+	assert.NoError(t, err)
+	job = waitFinished(t, q, job.ID)
+	assert.Equal(t, Succeeded, job.State, job.Log)
+	assert.Equal(t, uint64(1), job.Version)
+	assert.Contains(t, job.Log, "building 1048562 bytes at most")
+	assert.Equal(t, []string{"disk:64"}, registered)
+
+	job, err = q.Submit("alice", "disk", "", bytes.NewReader(tarball(t, bootable...)))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), waitFinished(t, q, job.ID).Version)
+
+	job, err = q.Submit("alice", "disk", "multiarch", nil)
+	assert.NoError(t, err)
+	job = waitFinished(t, q, job.ID)
+	assert.Equal(t, Failed, job.State)
+	assert.True(t, job.Unsupported)
+	assert.Contains(t, job.Log, "multi-architecture index")
+
+	// The root file system has no kernel
+	job, err = q.Submit("alice", "disk", "", bytes.NewReader(tarball(t, bootable[:2]...)))
+	assert.NoError(t, err)
+	assert.True(t, waitFinished(t, q, job.ID).Unsupported)
+
+	_, err = q.Submit("alice", "disk", "", bytes.NewReader(make([]byte, 2<<20)))
+	assert.Equal(t, ErrTooLarge, err)
+
+	_, err = q.Get(100)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Len(t, registered, 2)
+
+	// The working directories of the builds were cleaned up
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestQueue_TooLargeImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := NewQueue(Config{Dir: dir, MaxBytes: 8192, Timeout: time.Minute, MaxQueued: 1}, fakeBuilder{size: 10000},
+		fakePuller{tarball: tarball(t, bootable...)}, nil)
+	job, err := q.Submit("alice", "disk", "debian", nil)
+	assert.NoError(t, err)
+
+	job = waitFinished(t, q, job.ID)
+	assert.Equal(t, Failed, job.State)
+	assert.False(t, job.Unsupported)
+	assert.Equal(t, ErrTooLarge.Error(), job.Error)
+	assert.Contains(t, job.Log, "building 8178 bytes at most")
+}
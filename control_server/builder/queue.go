@@ -0,0 +1,365 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/baas-project/baas/pkg/model/images"
+	log "github.com/sirupsen/logrus"
+)
+
+// State is where a build job is in its life
+type State string
+
+const (
+	// Queued jobs wait for the builds ahead of them
+	Queued State = "queued"
+	// Running jobs are being built
+	Running State = "running"
+	// Succeeded jobs registered a new version of their image
+	Succeeded State = "succeeded"
+	// Failed jobs stopped with an error
+	Failed State = "failed"
+)
+
+// ErrQueueFull is returned when too many builds are waiting already
+var ErrQueueFull = errors.New("too many builds are waiting")
+
+// ErrNotFound is returned for jobs which do not exist, or which finished too long ago to be remembered
+var ErrNotFound = errors.New("the build does not exist")
+
+// maxLog is the most output of a build which is kept, the start and the end are the interesting parts
+const maxLog = 1 << 20
+
+// keepFinished is how many finished jobs are remembered
+const keepFinished = 100
+
+var (
+	builds      = metrics.NewCounter("baas_builds_total", "Image builds which finished.", "state")
+	queueLength = metrics.NewGauge("baas_builds_queued", "Image builds waiting for their turn.")
+)
+
+// Job is a build of a new version of an image
+type Job struct {
+	ID        uint64
+	Username  string
+	Image     images.ImageUUID
+	Reference string `json:",omitempty"`
+	State     State
+	// Version is the version which was registered once the job succeeded
+	Version uint64 `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	// Unsupported tells that the input can never be built, trying again does not help
+	Unsupported bool
+	Log         string
+	CreatedAt   time.Time
+	StartedAt   *time.Time `json:",omitempty"`
+	FinishedAt  *time.Time `json:",omitempty"`
+}
+
+// Register turns the disk image a job built into a new version of its image and returns that version
+type Register func(job Job, image string) (uint64, error)
+
+// Config tells how builds are run
+type Config struct {
+	// Dir holds the working directories of the builds
+	Dir string
+	// MaxBytes is the most disk space a build can take, its input included
+	MaxBytes int64
+	Timeout  time.Duration
+	// MaxQueued is how many builds can wait for their turn
+	MaxQueued int
+}
+
+// logBuffer collects the output of a build, it stops keeping it once it grows too large
+type logBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (l *logBuffer) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if room := maxLog - l.buf.Len(); len(b) > room {
+		l.buf.Write(b[:room])
+		l.truncated = true
+	} else {
+		l.buf.Write(b)
+	}
+
+	return len(b), nil
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.truncated {
+		return l.buf.String() + "\n[the rest of the output was left out]\n"
+	}
+
+	return l.buf.String()
+}
+
+// job is a build job as it is kept by the queue, its fields are guarded by the lock of the queue
+type job struct {
+	Job
+	dir string
+	log logBuffer
+}
+
+// Queue runs the build jobs one at a time, in the order they were submitted
+type Queue struct {
+	conf     Config
+	builder  Builder
+	puller   Puller
+	register Register
+
+	pending chan *job
+
+	mu       sync.Mutex
+	last     uint64
+	jobs     map[uint64]*job
+	finished []uint64
+}
+
+// NewQueue creates a queue and starts the worker which builds its jobs
+func NewQueue(conf Config, builder Builder, puller Puller, register Register) *Queue {
+	q := &Queue{
+		conf:     conf,
+		builder:  builder,
+		puller:   puller,
+		register: register,
+		pending:  make(chan *job, conf.MaxQueued),
+		jobs:     make(map[uint64]*job),
+	}
+
+	go q.work()
+	return q
+}
+
+// Submit queues the build of a new version of image from either a container image reference or a root file system
+// tarball. The tarball is copied before Submit returns.
+func (q *Queue) Submit(username string, image images.ImageUUID, reference string, tarball io.Reader) (Job, error) {
+	// Refuse early, rather than after a tarball of gigabytes has been uploaded
+	if len(q.pending) >= cap(q.pending) {
+		return Job{}, ErrQueueFull
+	}
+
+	if err := os.MkdirAll(q.conf.Dir, 0700); err != nil {
+		return Job{}, err
+	}
+
+	dir, err := ioutil.TempDir(q.conf.Dir, "build")
+	if err != nil {
+		return Job{}, err
+	}
+
+	if tarball != nil {
+		if err = q.receive(tarball, filepath.Join(dir, "input.tar")); err != nil {
+			_ = os.RemoveAll(dir)
+			return Job{}, err
+		}
+	}
+
+	q.mu.Lock()
+	q.last++
+	j := &job{Job: Job{ID: q.last, Username: username, Image: image, Reference: reference, State: Queued,
+		CreatedAt: time.Now()}, dir: dir}
+
+	select {
+	case q.pending <- j:
+		q.jobs[j.ID] = j
+		queueLength.Add(1)
+		q.mu.Unlock()
+	default:
+		q.mu.Unlock()
+		_ = os.RemoveAll(dir)
+		return Job{}, ErrQueueFull
+	}
+
+	log.Infof("Queued build %d of image %s for %s", j.ID, image, username)
+	return q.Get(j.ID)
+}
+
+// receive copies the uploaded tarball into the working directory of the build
+func (q *Queue) receive(tarball io.Reader, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	limited := &limitWriter{w: f, limit: q.conf.MaxBytes}
+	_, err = fs.Copy(limited, tarball)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Get finds a job, the log is the output of the build so far
+func (q *Queue) Get(id uint64) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	snapshot := j.Job
+	snapshot.Log = j.log.String()
+	return snapshot, nil
+}
+
+func (q *Queue) work() {
+	for j := range q.pending {
+		queueLength.Add(-1)
+		q.run(j)
+	}
+}
+
+// run builds a job and records how it went
+func (q *Queue) run(j *job) {
+	q.mu.Lock()
+	started := time.Now()
+	j.State = Running
+	j.StartedAt = &started
+	snapshot := j.Job
+	q.mu.Unlock()
+
+	log.Infof("Building image %s for %s in build %d", j.Image, j.Username, j.ID)
+	version, err := q.build(snapshot, j.dir, &j.log)
+	_ = os.RemoveAll(j.dir)
+
+	var unsupported *UnsupportedError
+	q.mu.Lock()
+	finished := time.Now()
+	j.FinishedAt = &finished
+	if err != nil {
+		j.State = Failed
+		j.Error = err.Error()
+		j.Unsupported = errors.As(err, &unsupported)
+		_, _ = fmt.Fprintf(&j.log, "The build failed: %v\n", err)
+	} else {
+		j.State = Succeeded
+		j.Version = version
+	}
+
+	q.finished = append(q.finished, j.ID)
+	if len(q.finished) > keepFinished {
+		delete(q.jobs, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+	q.mu.Unlock()
+
+	builds.Inc(string(j.State))
+	if err != nil {
+		log.Warnf("Build %d of image %s failed: %v", j.ID, j.Image, err)
+		return
+	}
+
+	log.Infof("Build %d registered version %d of image %s", j.ID, version, j.Image)
+}
+
+// build goes from the input of a job to a registered version. Each step may only use what is left of the disk space
+// of the build, and the whole build has to finish before the timeout.
+func (q *Queue) build(j Job, dir string, output io.Writer) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.conf.Timeout)
+	defer cancel()
+
+	input := filepath.Join(dir, "input.tar")
+	if j.Reference != "" {
+		if err := q.pull(ctx, j.Reference, input, output); err != nil {
+			return 0, timedOut(ctx, err)
+		}
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		return 0, err
+	}
+
+	_, _ = fmt.Fprintln(output, "Unpacking the root file system")
+	used, err := Extract(f, rootfs, q.conf.MaxBytes, output)
+	_ = f.Close()
+	_ = os.Remove(input)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = CheckRootFS(rootfs); err != nil {
+		return 0, err
+	}
+
+	image := filepath.Join(dir, "disk.img")
+	_, _ = fmt.Fprintln(output, "Building the disk image")
+	if err = q.builder.Build(ctx, rootfs, image, q.conf.MaxBytes-used, output); err != nil {
+		return 0, timedOut(ctx, err)
+	}
+
+	// The builder is trusted to stay below its limit only as far as it can be checked
+	info, err := os.Stat(image)
+	if err != nil {
+		return 0, fmt.Errorf("the builder did not write a disk image: %w", err)
+	} else if info.Size() > q.conf.MaxBytes-used {
+		return 0, ErrTooLarge
+	}
+
+	_ = os.RemoveAll(rootfs)
+	_, _ = fmt.Fprintln(output, "Registering the new version")
+	return q.register(j, image)
+}
+
+// pull writes the flattened file system of a container image to path
+func (q *Queue) pull(ctx context.Context, reference string, path string, output io.Writer) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(output, "Pulling %s\n", reference)
+	limited := &limitWriter{w: f, limit: q.conf.MaxBytes}
+	err = q.puller.Pull(ctx, reference, limited, output)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	// The puller only sees that its output was cut off
+	if limited.exceeded {
+		return ErrTooLarge
+	}
+
+	return err
+}
+
+// timedOut explains the errors of commands which were killed because the build took too long
+func timedOut(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("the build did not finish in time")
+	}
+
+	return err
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrTooLarge is returned when a build takes more disk space than it is allowed to
+var ErrTooLarge = errors.New("the build exceeds its disk usage limit")
+
+// limitWriter refuses writes once more than limit bytes have been written through it
+type limitWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.written+int64(len(b)) > l.limit {
+		l.exceeded = true
+		return 0, ErrTooLarge
+	}
+
+	n, err := l.w.Write(b)
+	l.written += int64(n)
+	return n, err
+}
+
+// imageArchiveFiles are found at the root of the archives made by docker save and of OCI layouts, which hold the
+// layers of an image rather than its file system
+var imageArchiveFiles = map[string]bool{"manifest.json": true, "index.json": true, "oci-layout": true}
+
+// safePath resolves the name of a tar entry inside dir. The parents of the entry may not be symbolic links, the
+// archive could otherwise write outside of dir through a link it created itself.
+func safePath(dir string, name string) (string, error) {
+	cleaned := filepath.Clean(string(filepath.Separator) + name)
+	if cleaned == string(filepath.Separator) {
+		return dir, nil
+	}
+
+	path := filepath.Join(dir, cleaned)
+	for parent := filepath.Dir(path); parent != dir; parent = filepath.Dir(parent) {
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is written through the symbolic link %s", name, parent)
+		}
+	}
+
+	return path, nil
+}
+
+// Extract unpacks the root file system tarball, which may be compressed with gzip, into dir. It writes at most limit
+// bytes and returns how many bytes it wrote. Device nodes are skipped, the kernel creates them when it boots.
+func Extract(r io.Reader, dir string, limit int64, log io.Writer) (int64, error) {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return 0, err
+		}
+		defer decompressed.Close()
+		r = decompressed
+	} else {
+		r = buffered
+	}
+
+	files := tar.NewReader(r)
+	written := &limitWriter{w: ioutil.Discard, limit: limit}
+	first := true
+	for {
+		header, err := files.Next()
+		if err == io.EOF {
+			if first {
+				return 0, &UnsupportedError{Reason: "the tarball is empty"}
+			}
+			return written.written, nil
+		} else if err != nil {
+			if first {
+				return 0, &UnsupportedError{Reason: "the input is not a tarball of a root file system"}
+			}
+			return written.written, err
+		}
+		first = false
+
+		if imageArchiveFiles[filepath.Clean(header.Name)] {
+			return written.written, &UnsupportedError{Reason: "the tarball holds the layers of a container image " +
+				"rather than its file system, export it with docker export or crane export instead"}
+		}
+
+		path, err := safePath(dir, header.Name)
+		if err != nil {
+			return written.written, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(path)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(files, path, written)
+		case tar.TypeSymlink:
+			if err = replace(path); err == nil {
+				err = os.Symlink(header.Linkname, path)
+			}
+		case tar.TypeLink:
+			var target string
+			if target, err = safePath(dir, header.Linkname); err == nil {
+				if err = replace(path); err == nil {
+					err = os.Link(target, path)
+				}
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			_, _ = fmt.Fprintf(log, "Skipping the device node %s\n", header.Name)
+			continue
+		default:
+			_, _ = fmt.Fprintf(log, "Skipping %s of unknown type %c\n", header.Name, header.Typeflag)
+			continue
+		}
+
+		if err != nil {
+			return written.written, err
+		}
+
+		// Only root can hand the files to their owners, the image keeps the ownership of the build otherwise
+		if os.Geteuid() == 0 {
+			if err = os.Lchown(path, header.Uid, header.Gid); err != nil {
+				return written.written, err
+			}
+		}
+
+		// The mode is set after the owner, changing the owner clears the setuid bit
+		if header.Typeflag != tar.TypeSymlink && header.Typeflag != tar.TypeLink {
+			mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			if header.Typeflag == tar.TypeDir && os.Geteuid() != 0 {
+				// Read-only directories such as /proc would keep the rest of the tarball out
+				mode |= 0700
+			}
+
+			if err = os.Chmod(path, mode); err != nil {
+				return written.written, err
+			}
+		}
+	}
+}
+
+// replace makes room for a file, removing whatever an earlier layer left at its path
+func replace(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// extractDir creates a directory, a symbolic link an earlier layer left at its path is replaced rather than followed
+func extractDir(path string) error {
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return os.MkdirAll(path, 0755)
+}
+
+// extractFile writes a regular file of the tarball, the limit is checked before anything reaches the disk
+func extractFile(r io.Reader, path string, written *limitWriter) error {
+	if err := replace(path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.MultiWriter(written, f), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// CheckRootFS makes sure the root file system can boot, it needs its configuration and a kernel
+func CheckRootFS(dir string) error {
+	if info, err := os.Stat(filepath.Join(dir, "etc")); err != nil || !info.IsDir() {
+		return &UnsupportedError{Reason: "the root file system has no /etc"}
+	}
+
+	kernels, err := filepath.Glob(filepath.Join(dir, "boot", "vmlinuz*"))
+	if err != nil {
+		return err
+	}
+
+	if len(kernels) == 0 {
+		return &UnsupportedError{Reason: "the root file system has no kernel in /boot, install one in the " +
+			"container image, most container images leave it out"}
+	}
+
+	return nil
+}
@@ -0,0 +1,938 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package config defines the configuration file of the control server
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+)
+
+// Config is the structure of the TOML configuration file of the control server
+type Config struct {
+	// AnonymousAccess lets visitors without a session use the routes which explicitly allow anonymous access.
+	// This is meant for read-only demo deployments.
+	AnonymousAccess bool
+
+	// Production marks a deployment real users depend on, the development conveniences refuse to start in it
+	Production bool
+	// DevLogin adds the dev login provider, which logs in as any user with any role without asking anyone. It is
+	// meant for local development and tests. DevLoginURL is where the control server is reached, the provider
+	// sends the browser and itself there.
+	DevLogin    bool
+	DevLoginURL string
+
+	// TrashRetentionDays is how long deleted images stay in the trash before they are purged for good
+	TrashRetentionDays uint
+
+	// BootTimeoutMinutes is how long a machine flashing images can stay silent before the janitor marks the boot
+	// failed, the agent was lost, and releases the locks on its images
+	BootTimeoutMinutes uint
+	// UploadTTLMinutes is how long an upload can stay untouched before the janitor removes its temporary file, and
+	// the version which was created for it when no file ever arrived. The janitor runs every JanitorIntervalMinutes.
+	UploadTTLMinutes       uint
+	JanitorIntervalMinutes uint
+	// BootCancelWaitSeconds is how long cancelling a boot which is being flashed waits for the management OS to
+	// stop, it keeps going in the background when it takes longer
+	BootCancelWaitSeconds uint
+	// FlashVerify is how the management OS reads the images back after writing them, for the boots which do not
+	// say and whose machine group has no default: none, quick or full. Full reads back everything which was written.
+	FlashVerify string
+
+	// IconMaxBytes is the largest icon which can be uploaded for an image
+	IconMaxBytes uint
+	// PublicLicenses are the kinds of licenses images need before they can be made public
+	PublicLicenses []string
+	// UploadFormats are the formats of the disk images users can upload, out of raw, qcow2, iso, vmdk and unknown.
+	// Uploads in other formats are converted to raw disks with UploadConverter, the path of qemu-img, when it is set
+	// and can convert them, and refused otherwise.
+	UploadFormats   []string
+	UploadConverter string
+
+	// ArtifactMaxBytes is the largest artifact the management OS can attach to a boot, ArtifactMaxCount how many a
+	// boot can have. They are removed ArtifactRetentionDays after they were attached.
+	ArtifactMaxBytes      uint
+	ArtifactMaxCount      uint
+	ArtifactRetentionDays uint
+
+	// CommandExpiryMinutes is how long a diagnostic queued for a machine waits for the management OS to pick it
+	// up, commands for machines which are not in the management OS expire after it
+	CommandExpiryMinutes uint
+
+	// ClockSkewMaxSeconds is how far the clock of the management OS can be off from that of the control server
+	// before the machine is listed as having a skewed clock
+	ClockSkewMaxSeconds uint
+
+	// TFTPEnabled serves the static files over TFTP as well, for firmware which cannot fetch its loader over HTTP
+	TFTPEnabled bool
+	// TFTPAddress is the UDP address the TFTP server listens on
+	TFTPAddress string
+
+	// AgentPublicKey is the base64 encoded Ed25519 key which signs the releases of the management OS agent. When it
+	// is set, releases which are not signed by it are refused.
+	AgentPublicKey string
+	// MinAgentProtocol is the oldest protocol of the management OS agent which may claim a boot. Agents speaking an
+	// older one are told to update themselves instead, 1 accepts the agents which do not say theirs.
+	MinAgentProtocol uint
+
+	// DownloadMaxActive is how many image downloads stream at the same time, DownloadMaxQueued how many more wait
+	// for their turn before downloads are refused. Zero does not limit them.
+	DownloadMaxActive uint
+	DownloadMaxQueued uint
+	// DownloadBytesPerSecond is the bandwidth all image downloads share, zero does not limit it
+	DownloadBytesPerSecond uint64
+	// DownloadCacheDir is a directory on a fast disk which keeps copies of the downloaded versions, so the machines
+	// flashing the same version read it from the storage once. It holds at most DownloadCacheBytes, empty disables
+	// the cache.
+	DownloadCacheDir   string
+	DownloadCacheBytes uint64
+	// UploadMaxActive is how many uploads stream to the disk at the same time, further uploads are refused until
+	// one of them is done. Zero does not limit them.
+	UploadMaxActive uint
+
+	// PeerDistribution lets machines download the images from other machines which already flashed them, rather
+	// than all of them downloading from the control server. PeerServerSeeds machines download each version from the
+	// control server, PeerMaxUploads is how many machines one machine serves at the same time.
+	PeerDistribution bool
+	PeerServerSeeds  uint
+	PeerMaxUploads   uint
+
+	// PublicURL is where browsers reach the control server, such as https://api.baas.example.org. The OAuth
+	// providers send the browser back to its login callbacks, which have to be registered with them.
+	PublicURL string
+	// CORSDebug logs why the requests from browsers were allowed or refused by the CORS checks
+	CORSDebug bool
+
+	// LoginRedirect is where users end up after logging in, unless they asked for a page within
+	// LoginRedirectAllowed. Those are URLs whose origin has to match exactly and whose path is a prefix.
+	LoginRedirect        string
+	LoginRedirectAllowed []string
+	// Frontends name the web frontends which share this control server, such as staging and production. Their
+	// origins may call the API from the browser, and a login started from one returns to it. DefaultFrontend gets
+	// the logins from any other origin. Without frontends the origin of LoginRedirect is the only one.
+	Frontends       map[string]Frontend
+	DefaultFrontend string
+	// LoginTokenMinutes is how long the tokens handed to command line logins stay valid
+	LoginTokenMinutes uint
+	// TrustedProxies are the addresses and CIDR ranges of the reverse proxies in front of the control server. The
+	// address of a client is taken from the X-Forwarded-For header they add, that of anyone else is ignored.
+	TrustedProxies []string
+	// NotifySessionAnomalies mails users when one of their sessions is used from another network than it was
+	// created on. Those are logged either way.
+	NotifySessionAnomalies bool
+	// SessionCookieName is the cookie the sessions of the users are kept in, on SessionCookiePath for
+	// SessionCookieMaxAgeHours. SessionCookieSecure only sends it over TLS, production deployments always do.
+	// SessionCookieHTTPOnly hides it from scripts and SessionCookieSameSite is lax, strict, none or empty.
+	SessionCookieName        string
+	SessionCookiePath        string
+	SessionCookieMaxAgeHours uint
+	SessionCookieSecure      bool
+	SessionCookieHTTPOnly    bool
+	SessionCookieSameSite    string
+	// SessionKeys sign and encrypt the session cookies, each written as the base64 of an authentication key and,
+	// after a colon, that of an encryption key. The last one seals new cookies, the older ones only open the cookies
+	// which were sealed before it was added. Without keys a key is made up at every start, so restarts end the
+	// sessions, which production deployments refuse.
+	SessionKeys []string
+
+	// SecretKey seals the secrets stored in the database, written as id:base64. SecretKeyFile holds a key per line
+	// instead, the last one seals new secrets and the others only open the secrets which were not rotated yet.
+	SecretKey     string
+	SecretKeyFile string
+
+	// StatsCacheSeconds is how long the statistics of the admin dashboard are served before they are counted again,
+	// and the usage reports of periods which are not over yet
+	StatsCacheSeconds uint
+
+	// LDAPSync creates the users of the LDAP groups in LDAPGroupRoles and gives them the role of their group,
+	// every LDAPSyncMinutes. Users in several groups get the highest of the roles. LDAPBindDN and
+	// LDAPBindPassword are used to log in to LDAPURL, an empty LDAPBindDN searches anonymously.
+	LDAPSync         bool
+	LDAPURL          string
+	LDAPBindDN       string
+	LDAPBindPassword string
+	LDAPSyncMinutes  uint
+	// LDAPGroupRoles maps the DNs of groups to the roles of their members. The members of a group are the DNs in
+	// its LDAPMemberAttribute, their usernames, names and email addresses are read from the attributes named by
+	// LDAPUsernameAttribute, LDAPNameAttribute and LDAPEmailAttribute.
+	LDAPGroupRoles        map[string]string
+	LDAPMemberAttribute   string
+	LDAPUsernameAttribute string
+	LDAPNameAttribute     string
+	LDAPEmailAttribute    string
+	// LDAPDisableRemoved disables the accounts of users the synchronization manages once they left all groups
+	LDAPDisableRemoved bool
+	// LDAPConflicts decides who wins when a user was promoted by hand above the role LDAP grants them, either
+	// LDAPWins or ManualWins. The conflict is logged either way.
+	LDAPConflicts string
+	// LDAPDryRun only logs the changes the periodic synchronization would make
+	LDAPDryRun bool
+
+	// CourseWarningDays is how long before a course expires its owner is told about it
+	CourseWarningDays uint
+	// CourseCheckMinutes is how often the courses are checked for expiry
+	CourseCheckMinutes uint
+
+	// SMTPAddress is the host:port of the mail server notifications are sent through, as SMTPFrom. Without it the
+	// notifications are only logged. SMTPUsername and SMTPPassword log in to the server when they are set.
+	SMTPAddress  string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// NotifyChannels names the places the operators are told about events of the control server, such as the
+	// channel of a team in Mattermost. NotifyRoutes decide which events are sent to which channels.
+	NotifyChannels map[string]NotifyChannel
+	NotifyRoutes   []NotifyRoute
+
+	// NBDEnabled exports image versions read-only over NBD on NBDAddress, for diskless boots. NBDHost is the host
+	// put in the URLs of the exports, the host the request was made to when it is empty. Exports nobody connects to
+	// are removed after NBDIdleMinutes.
+	NBDEnabled     bool
+	NBDAddress     string
+	NBDHost        string
+	NBDIdleMinutes uint
+
+	// TLSCertFile and TLSKeyFile are the certificate and key the API is served with over TLS on TLSAddress, next to
+	// plain HTTP. The files are read again when they change, so the certificate is replaced without a restart.
+	TLSAddress  string
+	TLSCertFile string
+	TLSKeyFile  string
+	// CAGraceDays is how long a CA which was rotated out is still handed to the machines next to the new one
+	CAGraceDays uint
+
+	// AgentAddress gives the management OS and the boot services a listener of their own, which only serves their
+	// routes while the one on the address of the control server serves the others. AgentTLSAddress serves them
+	// over TLS with TLSCertFile, and with AgentClientCAFile it only accepts machines with a certificate issued by
+	// that CA. Everything is served on the address of the control server when AgentAddress is empty.
+	AgentAddress      string
+	AgentTLSAddress   string
+	AgentClientCAFile string
+	// AgentMaxConnections is how many connections each agent listener keeps open at once, more wait until one
+	// closes. Zero does not limit them. Connections have to send their headers within
+	// AgentReadHeaderTimeoutSeconds and are closed after AgentIdleTimeoutSeconds without a request.
+	AgentMaxConnections           uint
+	AgentReadHeaderTimeoutSeconds uint
+	AgentIdleTimeoutSeconds       uint
+
+	// AutoRegister lets machines which BAAS does not know register themselves with JoinToken, which is handed to
+	// them on the kernel command line of the management OS. They wait as pending machines until an admin approves
+	// them, so anyone on the boot network can add a machine to the list but not have it booted.
+	AutoRegister bool
+	JoinToken    string
+
+	// BuildDir holds the working directories of the image builds, which may take BuildMaxBytes each and have to
+	// finish within BuildTimeoutMinutes. At most BuildMaxQueued builds wait for their turn.
+	BuildDir            string
+	BuildMaxBytes       uint64
+	BuildTimeoutMinutes uint
+	BuildMaxQueued      uint
+	// BuildScript partitions the disk image of a build, copies the root file system onto it and installs
+	// BuildBootloader. BuildCrane is the crane binary container images are pulled with.
+	BuildScript     string
+	BuildBootloader string
+	BuildCrane      string
+
+	// IdempotencyKeyHours is how long the responses to requests with an Idempotency-Key header are replayed
+	IdempotencyKeyHours uint
+
+	// RequestTimeoutSeconds bounds how long the API takes to answer a request, the queries of requests which take
+	// longer are interrupted and they are answered with 504. Routes which stream files, such as uploads and
+	// downloads, and the routes of jobs like the janitor have limits of their own. Zero does not bound them.
+	RequestTimeoutSeconds uint
+
+	// LogBufferEntries is how many of the last log entries are kept in memory for the admins to read back, as long
+	// as they take no more than LogBufferBytes. Zero keeps none.
+	LogBufferEntries uint
+	LogBufferBytes   uint64
+
+	// StorageTiers names the directories images can be stored in, next to the disk path which is the tier named
+	// default. New images are stored on StorageDefaultTier, admins move them between the tiers.
+	StorageTiers       map[string]string
+	StorageDefaultTier string
+
+	// ScrubBytesPerSecond is how fast the scrubber reads the stored versions back to verify their checksums, zero
+	// turns it off. After a full pass it rests for ScrubIntervalHours.
+	ScrubBytesPerSecond uint64
+	ScrubIntervalHours  uint
+
+	// MaxActiveBoots caps the boot setups of a user which are queued or being flashed at the same time, for users
+	// whose role and overrides set no MaxActiveBoots of their own. Zero leaves them uncapped.
+	MaxActiveBoots uint
+	// MaxWebhooks caps the image webhooks a user can create, for users whose role and overrides set no MaxWebhooks
+	// of their own. Zero leaves them uncapped. Webhooks administrators create are not counted.
+	MaxWebhooks uint
+	// WebhookTimeoutSeconds is how long the URL of an image webhook has to answer a delivery, and
+	// WebhookDeliveriesKept how many of the last deliveries of each webhook are kept to read back.
+	WebhookTimeoutSeconds uint
+	WebhookDeliveriesKept uint
+
+	// ReplicationToken lets a replica started with --replica-of fetch the changes and the image files of this
+	// control server, and is what a replica sends to its primary. Empty turns the replication off on a primary.
+	// A replica pulls every ReplicationIntervalSeconds and is not ready while it is more than
+	// ReplicationMaxLagSeconds behind.
+	ReplicationToken           string
+	ReplicationIntervalSeconds uint
+	ReplicationMaxLagSeconds   uint
+
+	// ReadReplicaDSN is a copy of the database, such as one restored continuously by a backup tool, which the
+	// usage reports, statistics and other heavy queries which only read are run on, so they do not hold up the
+	// machines which are provisioned. They run on the database itself when it is empty or cannot be read.
+	ReadReplicaDSN string
+
+	// BackupTargets name the places off the control server the versions of images with a backup policy are copied
+	// to. The backups copy the versions of the nightly policies at BackupNightlyHour. A copy which fails is tried
+	// again after BackupRetryMinutes, twice as long after every failure, until BackupMaxAttempts failed. BackupRsync
+	// is the rsync binary of the rsync targets.
+	BackupTargets      map[string]BackupTarget
+	BackupNightlyHour  uint
+	BackupRetryMinutes uint
+	BackupMaxAttempts  uint
+	BackupRsync        string
+
+	// Telemetry sends the BAAS project a few anonymous counts once a week: the machines, images and boots of the
+	// last week and the version of the control server, under a random install ID. It is off unless the operator
+	// turns it on, GET /admin/telemetry/preview shows exactly what would be sent to TelemetryEndpoint.
+	Telemetry         bool
+	TelemetryEndpoint string
+
+	// Bootstrap prepares a fresh deployment when the control server starts, see BootstrapConfig
+	Bootstrap BootstrapConfig
+}
+
+// BootstrapConfig names the admin account a fresh deployment starts with, and the public images it is seeded with.
+// What the bootstrap created is recorded in the database and never touched again, so it can stay configured.
+type BootstrapConfig struct {
+	// Admin is the username of the admin, with their Email and Name. Empty turns the bootstrap off.
+	Admin string
+	Email string
+	Name  string
+	// Provider is github, gitlab or dev, and ProviderID the stable numeric id of the account of the admin there
+	// which they log in with. Login is only shown.
+	Provider   string
+	ProviderID string
+	Login      string
+	// ImagesDir holds the disk images which are seeded as public images of the admin. Every file X next to a
+	// sidecar X.json is one, the sidecar gives its Name and the rest of its metadata.
+	ImagesDir string
+}
+
+// Frontend is a web frontend which uses the control server, see Frontends
+type Frontend struct {
+	// Origin is the scheme and host the frontend is served from, such as https://staging.baas.example.org
+	Origin string
+	// RedirectPath is where logins end up on the origin, unless they asked for a page below it
+	RedirectPath string
+}
+
+// BackupTarget is a place the versions of images are copied to, see BackupTargets
+type BackupTarget struct {
+	// Kind is BackupDirectory or BackupRsync
+	Kind string
+	// Path is the directory the copies are stored in, or the destination rsync copies them to such as
+	// backup@offsite.example.com:/srv/baas
+	Path string
+}
+
+const (
+	// BackupDirectory copies the versions into a directory, such as the mount of another storage backend
+	BackupDirectory = "directory"
+	// BackupRsync copies the versions with rsync, over SSH for a destination on another host
+	BackupRsync = "rsync"
+)
+
+// NotifyChannel is a place the operators are told about events, see NotifyChannels
+type NotifyChannel struct {
+	// Kind is NotifySMTP, NotifyWebhook or NotifyMatrix
+	Kind string
+	// To are the addresses mails are sent to through SMTPAddress
+	To []string
+	// URL is the incoming webhook of Slack or Mattermost, or the homeserver of Matrix
+	URL string
+	// Room is the Matrix room the messages are sent to, by the account of the access token Token
+	Room  string
+	Token string
+	// Template formats the messages with text/template from the Event, Key, Subject and Body of the notification.
+	// Every kind has a default.
+	Template string
+}
+
+// NotifyRoute sends the Events to the Channels. At most RateLimit notifications about the same thing, such as the
+// same machine, are sent in RateLimitMinutes, the rest are dropped. Zero does not limit them.
+type NotifyRoute struct {
+	Events           []string
+	Channels         []string
+	RateLimit        uint
+	RateLimitMinutes uint
+}
+
+const (
+	// NotifySMTP mails the notifications
+	NotifySMTP = "smtp"
+	// NotifyWebhook posts the notifications to an incoming webhook which speaks the protocol of Slack, which
+	// Mattermost does as well
+	NotifyWebhook = "webhook"
+	// NotifyMatrix sends the notifications to a Matrix room
+	NotifyMatrix = "matrix"
+)
+
+const (
+	// EventBootFailure is sent when the management OS reports a failed boot
+	EventBootFailure = "boot_failure"
+	// EventMachineOffline is sent when a machine stops sending heartbeats while it is flashing
+	EventMachineOffline = "machine_offline"
+	// EventScrubCorruption is sent when the scrubber finds a version which does not match its checksum
+	EventScrubCorruption = "scrub_corruption"
+	// EventQuotaExceeded is sent when a request of a user is refused because it would exceed their limits
+	EventQuotaExceeded = "quota_exceeded"
+	// EventBackupFailure is sent when a version cannot be copied to the backup target of its image
+	EventBackupFailure = "backup_failure"
+	// EventFlashMismatch is sent when the management OS reads back an image which does not match what it wrote
+	EventFlashMismatch = "flash_mismatch"
+)
+
+// NotifyEvents are the events NotifyRoutes can send
+var NotifyEvents = []string{EventBootFailure, EventMachineOffline, EventScrubCorruption, EventQuotaExceeded,
+	EventBackupFailure, EventFlashMismatch}
+
+const (
+	// LDAPWins gives users who were promoted by hand the role of their LDAP groups again
+	LDAPWins = "ldap-wins"
+	// ManualWins keeps the roles users were promoted to by hand
+	ManualWins = "manual-wins"
+)
+
+const (
+	// SameSiteLax sends the session cookie along with requests from other sites when the user follows a link
+	SameSiteLax = "lax"
+	// SameSiteStrict only sends the session cookie along with requests from the control server itself
+	SameSiteStrict = "strict"
+	// SameSiteNone sends the session cookie along with all requests, browsers only accept that for Secure cookies
+	SameSiteNone = "none"
+)
+
+// minJoinTokenLength keeps the join token from being guessed by the machines on the boot network
+const minJoinTokenLength = 16
+
+// minLogBufferBytes fits the longest entries the log buffer keeps
+const minLogBufferBytes = 64 << 10
+
+// The keys GenerateSessionKey makes are an HMAC-SHA256 key for authentication and an AES-256 key for encryption
+const (
+	sessionAuthenticationKeyLength = 64
+	sessionEncryptionKeyLength     = 32
+)
+
+// Default returns the configuration used when no configuration file is given
+func Default() *Config {
+	return &Config{
+		AnonymousAccess:       false,
+		Production:            false,
+		DevLogin:              false,
+		DevLoginURL:           "http://localhost:4848",
+		PublicURL:             "http://localhost:4848",
+		TrashRetentionDays:    14,
+		BootTimeoutMinutes:    30,
+		BootCancelWaitSeconds: 30,
+		FlashVerify:           string(images.VerifyNone),
+		IconMaxBytes:          64 * 1024,
+		PublicLicenses:        []string{string(images.LicenseOpenSource), string(images.LicenseFreeware)},
+		UploadFormats:         []string{string(images.FormatRaw)},
+		UploadConverter:       "",
+		ArtifactMaxBytes:      1 << 20,
+		ArtifactMaxCount:      4,
+		ArtifactRetentionDays: 30,
+		CommandExpiryMinutes:  10,
+		ClockSkewMaxSeconds:   60,
+		TFTPEnabled:           false,
+		TFTPAddress:           ":69",
+		AgentPublicKey:        "",
+		MinAgentProtocol:      api.ProtocolLegacy,
+
+		UploadTTLMinutes:       24 * 60,
+		JanitorIntervalMinutes: 5,
+
+		DownloadMaxActive:      8,
+		DownloadMaxQueued:      64,
+		DownloadBytesPerSecond: 0,
+		DownloadCacheDir:       "",
+		DownloadCacheBytes:     32 << 30,
+		UploadMaxActive:        8,
+
+		PeerDistribution: false,
+		PeerServerSeeds:  2,
+		PeerMaxUploads:   2,
+
+		LoginRedirect:        "http://localhost:9090/app",
+		LoginRedirectAllowed: []string{"http://localhost:9090/app"},
+		Frontends:            map[string]Frontend{},
+		LoginTokenMinutes:    15,
+
+		TrustedProxies:         []string{},
+		NotifySessionAnomalies: false,
+
+		SessionCookieName:        "session-name",
+		SessionCookiePath:        "/",
+		SessionCookieMaxAgeHours: 8,
+		SessionCookieSecure:      false,
+		SessionCookieHTTPOnly:    true,
+		SessionCookieSameSite:    SameSiteLax,
+		SessionKeys:              []string{},
+
+		SecretKey:     "",
+		SecretKeyFile: "",
+
+		StatsCacheSeconds: 60,
+
+		LDAPSync:              false,
+		LDAPSyncMinutes:       60,
+		LDAPMemberAttribute:   "member",
+		LDAPUsernameAttribute: "uid",
+		LDAPNameAttribute:     "cn",
+		LDAPEmailAttribute:    "mail",
+		LDAPDisableRemoved:    false,
+		LDAPConflicts:         ManualWins,
+		LDAPDryRun:            false,
+
+		CourseWarningDays:  7,
+		CourseCheckMinutes: 60,
+
+		SMTPAddress: "",
+		SMTPFrom:    "baas@localhost",
+
+		NotifyChannels: map[string]NotifyChannel{},
+		NotifyRoutes:   []NotifyRoute{},
+
+		NBDEnabled:     false,
+		NBDAddress:     ":10809",
+		NBDHost:        "",
+		NBDIdleMinutes: 10,
+
+		TLSAddress:  ":4443",
+		TLSCertFile: "",
+		TLSKeyFile:  "",
+		CAGraceDays: 14,
+
+		AgentAddress:                  "",
+		AgentTLSAddress:               "",
+		AgentClientCAFile:             "",
+		AgentMaxConnections:           1024,
+		AgentReadHeaderTimeoutSeconds: 10,
+		AgentIdleTimeoutSeconds:       120,
+
+		AutoRegister: false,
+		JoinToken:    "",
+
+		BuildDir:            "control_server/builds",
+		BuildMaxBytes:       32 << 30,
+		BuildTimeoutMinutes: 60,
+		BuildMaxQueued:      8,
+		BuildScript:         "utils/rootfs2image.sh",
+		BuildBootloader:     "systemd-boot",
+		BuildCrane:          "crane",
+
+		IdempotencyKeyHours:   24,
+		RequestTimeoutSeconds: 15,
+
+		LogBufferEntries: 2000,
+		LogBufferBytes:   4 << 20,
+
+		StorageTiers:       map[string]string{},
+		StorageDefaultTier: "default",
+
+		ScrubBytesPerSecond: 16 << 20,
+		ScrubIntervalHours:  24,
+
+		MaxActiveBoots: 5,
+
+		MaxWebhooks:           10,
+		WebhookTimeoutSeconds: 10,
+		WebhookDeliveriesKept: 50,
+
+		ReplicationToken:           "",
+		ReplicationIntervalSeconds: 30,
+		ReplicationMaxLagSeconds:   300,
+		ReadReplicaDSN:             "",
+
+		BackupTargets:      map[string]BackupTarget{},
+		BackupNightlyHour:  2,
+		BackupRetryMinutes: 5,
+		BackupMaxAttempts:  8,
+		BackupRsync:        "rsync",
+
+		Telemetry:         false,
+		TelemetryEndpoint: "",
+	}
+}
+
+// Load reads the configuration file at path, any option missing from the file keeps its default value
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read configuration file")
+	}
+
+	conf := Default()
+	if err = toml.Unmarshal(content, conf); err != nil {
+		return nil, errors.Wrap(err, "parse configuration file")
+	}
+
+	if err = conf.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
+	}
+
+	return conf, nil
+}
+
+// Validate checks for options which cannot be combined
+func (c *Config) Validate() error {
+	if c.Production && c.DevLogin {
+		return errors.New("DevLogin lets anyone log in as anyone and cannot be enabled in production")
+	}
+
+	for _, license := range c.PublicLicenses {
+		if kind := images.LicenseKind(license); kind == "" || !kind.Valid() {
+			return errors.Errorf("PublicLicenses has the unknown license %q", license)
+		}
+	}
+
+	if mode := images.VerifyMode(c.FlashVerify); mode == "" || !mode.Valid() {
+		return errors.Errorf("FlashVerify has the unknown mode %q, it can be none, quick or full", c.FlashVerify)
+	}
+
+	for _, format := range c.UploadFormats {
+		if !images.FileFormat(format).Valid() {
+			return errors.Errorf("UploadFormats has the unknown format %q", format)
+		}
+	}
+
+	if c.SecretKey != "" && c.SecretKeyFile != "" {
+		return errors.New("give either SecretKey or SecretKeyFile, not both")
+	}
+
+	if err := c.validateSessions(); err != nil {
+		return err
+	}
+
+	if c.AgentTLSAddress != "" && c.TLSCertFile == "" {
+		return errors.New("AgentTLSAddress needs TLSCertFile and TLSKeyFile")
+	}
+
+	if (c.AgentTLSAddress != "" || c.AgentClientCAFile != "") && c.AgentAddress == "" {
+		return errors.New("AgentTLSAddress and AgentClientCAFile need AgentAddress")
+	}
+
+	if c.AgentClientCAFile != "" && c.AgentTLSAddress == "" {
+		return errors.New("AgentClientCAFile needs AgentTLSAddress")
+	}
+
+	if c.AutoRegister && len(c.JoinToken) < minJoinTokenLength {
+		return errors.Errorf("AutoRegister needs a JoinToken of at least %d characters", minJoinTokenLength)
+	}
+
+	if c.CommandExpiryMinutes == 0 {
+		return errors.New("CommandExpiryMinutes has to be at least 1")
+	}
+
+	if c.MinAgentProtocol < api.ProtocolLegacy || c.MinAgentProtocol > api.ProtocolVersion {
+		return errors.Errorf("MinAgentProtocol has to be from %d to %d, the protocols this build speaks",
+			api.ProtocolLegacy, api.ProtocolVersion)
+	}
+
+	if c.ClockSkewMaxSeconds == 0 {
+		return errors.New("ClockSkewMaxSeconds has to be at least 1")
+	}
+
+	if c.JanitorIntervalMinutes == 0 {
+		return errors.New("JanitorIntervalMinutes has to be at least 1")
+	}
+
+	if c.ReplicationIntervalSeconds == 0 {
+		return errors.New("ReplicationIntervalSeconds has to be at least 1")
+	}
+
+	if c.LogBufferEntries != 0 && c.LogBufferBytes < minLogBufferBytes {
+		return errors.Errorf("LogBufferBytes has to be at least %d to keep any entries", minLogBufferBytes)
+	}
+
+	if c.DownloadCacheDir != "" && c.DownloadCacheBytes == 0 {
+		return errors.New("DownloadCacheDir needs DownloadCacheBytes")
+	}
+
+	if c.Telemetry {
+		u, err := url.Parse(c.TelemetryEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Telemetry needs a TelemetryEndpoint to send the reports to, over http or https")
+		}
+	}
+
+	if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.User != nil || u.RawQuery != "" {
+		return errors.Errorf("PublicURL has to be the http or https URL the control server is reached at, not %q",
+			c.PublicURL)
+	}
+
+	if err := c.validateFrontends(); err != nil {
+		return err
+	}
+
+	if err := c.validateBackups(); err != nil {
+		return err
+	}
+
+	if err := c.validateBootstrap(); err != nil {
+		return err
+	}
+
+	return c.validateNotify()
+}
+
+// validateFrontends checks that the frontends are bare origins, and that the default one exists
+func (c *Config) validateFrontends() error {
+	for name, frontend := range c.Frontends {
+		u, err := url.Parse(frontend.Origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+			strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" {
+			return errors.Errorf("Frontends %s has the Origin %q, it has to be a scheme and host such as "+
+				"https://baas.example.org", name, frontend.Origin)
+		}
+
+		if !strings.HasPrefix(frontend.RedirectPath, "/") {
+			return errors.Errorf("Frontends %s needs a RedirectPath starting with /", name)
+		}
+	}
+
+	if len(c.Frontends) == 0 {
+		if c.DefaultFrontend != "" {
+			return errors.New("DefaultFrontend needs Frontends")
+		}
+		return nil
+	}
+
+	if _, ok := c.Frontends[c.DefaultFrontend]; !ok {
+		return errors.Errorf("DefaultFrontend has to name one of the Frontends, not %q", c.DefaultFrontend)
+	}
+
+	return nil
+}
+
+// validateBackups checks that the backup targets say where the copies go, and that failed copies are tried
+func (c *Config) validateBackups() error {
+	for name, target := range c.BackupTargets {
+		if target.Kind != BackupDirectory && target.Kind != BackupRsync {
+			return errors.Errorf("BackupTargets %s has the unknown kind %q, it can be %s or %s", name, target.Kind,
+				BackupDirectory, BackupRsync)
+		}
+
+		if target.Path == "" {
+			return errors.Errorf("BackupTargets %s needs a Path", name)
+		}
+	}
+
+	if c.BackupNightlyHour > 23 {
+		return errors.New("BackupNightlyHour has to be an hour of the day, from 0 to 23")
+	}
+
+	if c.BackupMaxAttempts == 0 || c.BackupRetryMinutes == 0 {
+		return errors.New("BackupMaxAttempts and BackupRetryMinutes have to be at least 1")
+	}
+
+	return nil
+}
+
+// validateBootstrap checks that the admin of the bootstrap can log in
+func (c *Config) validateBootstrap() error {
+	b := c.Bootstrap
+	if b.Admin == "" {
+		if b.ImagesDir != "" || b.ProviderID != "" {
+			return errors.New("Bootstrap needs an Admin, who logs in and owns the seeded images")
+		}
+		return nil
+	}
+
+	if b.Email == "" {
+		return errors.New("Bootstrap needs the Email of the Admin")
+	}
+
+	switch user.OAuthProvider(b.Provider) {
+	case user.ProviderGitHub, user.ProviderGitLab:
+	case user.ProviderDev:
+		if c.Production {
+			return errors.New("the Admin of Bootstrap cannot log in with the dev provider in production")
+		}
+	default:
+		return errors.Errorf("Bootstrap has the unknown Provider %q, it can be github, gitlab or dev", b.Provider)
+	}
+
+	if b.ProviderID == "" {
+		return errors.New("Bootstrap needs the ProviderID the Admin logs in with")
+	}
+
+	return nil
+}
+
+// validateSessions checks the options of the session cookie and that its keys can be read
+func (c *Config) validateSessions() error {
+	if c.SessionCookieName == "" {
+		return errors.New("SessionCookieName cannot be empty")
+	}
+
+	if c.SessionCookieMaxAgeHours == 0 {
+		return errors.New("SessionCookieMaxAgeHours has to be at least 1")
+	}
+
+	switch c.SessionCookieSameSite {
+	case "", SameSiteLax, SameSiteStrict:
+	case SameSiteNone:
+		if !c.SecureSessionCookie() {
+			return errors.New("SessionCookieSameSite none needs SessionCookieSecure")
+		}
+	default:
+		return errors.Errorf("SessionCookieSameSite has the unknown mode %q", c.SessionCookieSameSite)
+	}
+
+	if c.Production && len(c.SessionKeys) == 0 {
+		return errors.New("production deployments need SessionKeys, or every restart ends the sessions")
+	}
+
+	_, err := c.SessionKeyPairs()
+	return err
+}
+
+// validateNotify checks that the channels can be reached and the routes only name events and channels which exist
+func (c *Config) validateNotify() error {
+	for name, channel := range c.NotifyChannels {
+		switch channel.Kind {
+		case NotifySMTP:
+			if c.SMTPAddress == "" || len(channel.To) == 0 {
+				return errors.Errorf("NotifyChannels %s needs SMTPAddress and To", name)
+			}
+		case NotifyWebhook:
+			if channel.URL == "" {
+				return errors.Errorf("NotifyChannels %s needs the URL of the webhook", name)
+			}
+		case NotifyMatrix:
+			if channel.URL == "" || channel.Room == "" || channel.Token == "" {
+				return errors.Errorf("NotifyChannels %s needs the URL of the homeserver, the Room and a Token", name)
+			}
+		default:
+			return errors.Errorf("NotifyChannels %s has the unknown kind %q, it can be %s, %s or %s", name,
+				channel.Kind, NotifySMTP, NotifyWebhook, NotifyMatrix)
+		}
+
+		if _, err := template.New(name).Parse(channel.Template); err != nil {
+			return errors.Wrapf(err, "NotifyChannels %s has an invalid Template", name)
+		}
+	}
+
+	for i, route := range c.NotifyRoutes {
+		for _, event := range route.Events {
+			if !knownEvent(event) {
+				return errors.Errorf("NotifyRoutes %d has the unknown event %q", i+1, event)
+			}
+		}
+
+		for _, channel := range route.Channels {
+			if _, ok := c.NotifyChannels[channel]; !ok {
+				return errors.Errorf("NotifyRoutes %d sends to the channel %q, which is not in NotifyChannels",
+					i+1, channel)
+			}
+		}
+
+		if route.RateLimit > 0 && route.RateLimitMinutes == 0 {
+			return errors.Errorf("NotifyRoutes %d needs RateLimitMinutes with its RateLimit", i+1)
+		}
+	}
+
+	return nil
+}
+
+func knownEvent(event string) bool {
+	for _, known := range NotifyEvents {
+		if event == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keyring reads the keys the secrets in the database are sealed with, it is nil when none are configured
+func (c *Config) Keyring() (*secrets.Keyring, error) {
+	switch {
+	case c.SecretKeyFile != "":
+		keyring, err := secrets.LoadKeyring(c.SecretKeyFile)
+		return keyring, errors.Wrap(err, "read SecretKeyFile")
+	case c.SecretKey != "":
+		key, err := secrets.ParseKey(c.SecretKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "read SecretKey")
+		}
+		return secrets.NewKeyring(key)
+	default:
+		return nil, nil
+	}
+}
+
+// SecureSessionCookie tells whether the session cookie is only sent over TLS
+func (c *Config) SecureSessionCookie() bool {
+	return c.SessionCookieSecure || c.Production
+}
+
+// SessionKeyPairs reads SessionKeys as the pairs of authentication and encryption keys of the session cookies,
+// newest first. It is empty when no keys are configured.
+func (c *Config) SessionKeyPairs() ([][]byte, error) {
+	pairs := make([][]byte, 0, 2*len(c.SessionKeys))
+	for i := len(c.SessionKeys) - 1; i >= 0; i-- {
+		parts := strings.Split(c.SessionKeys[i], ":")
+		if len(parts) > 2 {
+			return nil, errors.Errorf("SessionKeys %d is not written as authentication:encryption", i)
+		}
+
+		authentication, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, errors.Errorf("the authentication key of SessionKeys %d is not valid base64: %v", i, err)
+		}
+		if len(authentication) < 32 {
+			return nil, errors.Errorf("the authentication key of SessionKeys %d has to be at least 32 bytes", i)
+		}
+
+		var encryption []byte
+		if len(parts) == 2 {
+			if encryption, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+				return nil, errors.Errorf("the encryption key of SessionKeys %d is not valid base64: %v", i, err)
+			}
+			if n := len(encryption); n != 16 && n != 24 && n != 32 {
+				return nil, errors.Errorf("the encryption key of SessionKeys %d has to be 16, 24 or 32 bytes", i)
+			}
+		}
+
+		pairs = append(pairs, authentication, encryption)
+	}
+
+	return pairs, nil
+}
+
+// GenerateSessionKey makes up a key for SessionKeys
+func GenerateSessionKey() (string, error) {
+	key := make([]byte, sessionAuthenticationKeyLength+sessionEncryptionKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "generate session key")
+	}
+
+	return base64.StdEncoding.EncodeToString(key[:sessionAuthenticationKeyLength]) + ":" +
+		base64.StdEncoding.EncodeToString(key[sessionAuthenticationKeyLength:]), nil
+}
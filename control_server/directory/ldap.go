@@ -0,0 +1,151 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package directory reads the users of the control server and their roles from the groups of an LDAP directory
+package directory
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Member is a user who is in at least one of the groups which grant a role
+type Member struct {
+	Username string
+	Name     string
+	Email    string
+	// Role is the highest role of the groups the member is in
+	Role user.UserRole
+}
+
+// LDAP finds the members of the groups configured in LDAPGroupRoles
+type LDAP struct {
+	url          string
+	bindDN       string
+	bindPassword string
+	groups       map[string]user.UserRole
+
+	memberAttribute   string
+	usernameAttribute string
+	nameAttribute     string
+	emailAttribute    string
+}
+
+// NewLDAP checks the LDAP options of the configuration, it does not connect to the directory yet
+func NewLDAP(conf *config.Config) (*LDAP, error) {
+	if conf.LDAPURL == "" {
+		return nil, errors.New("LDAPURL is not set")
+	}
+
+	if len(conf.LDAPGroupRoles) == 0 {
+		return nil, errors.New("LDAPGroupRoles does not map any group to a role")
+	}
+
+	if conf.LDAPConflicts != config.LDAPWins && conf.LDAPConflicts != config.ManualWins {
+		return nil, fmt.Errorf("LDAPConflicts is %q, it is either %s or %s", conf.LDAPConflicts, config.LDAPWins,
+			config.ManualWins)
+	}
+
+	groups := map[string]user.UserRole{}
+	for group, name := range conf.LDAPGroupRoles {
+		role, err := user.ParseRole(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "role of group %s", group)
+		}
+
+		groups[group] = role
+	}
+
+	return &LDAP{
+		url:               conf.LDAPURL,
+		bindDN:            conf.LDAPBindDN,
+		bindPassword:      conf.LDAPBindPassword,
+		groups:            groups,
+		memberAttribute:   conf.LDAPMemberAttribute,
+		usernameAttribute: conf.LDAPUsernameAttribute,
+		nameAttribute:     conf.LDAPNameAttribute,
+		emailAttribute:    conf.LDAPEmailAttribute,
+	}, nil
+}
+
+// readEntry reads the attributes of a single entry
+func readEntry(conn *ldap.Conn, dn string, attributes ...string) (*ldap.Entry, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", attributes, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("%s does not exist", dn)
+	}
+
+	return res.Entries[0], nil
+}
+
+// Members lists the members of all groups, sorted by their username. Members without a username are left out,
+// a group which cannot be read fails the whole listing so nobody loses their role because of it.
+func (l *LDAP) Members() ([]Member, error) {
+	conn, err := ldap.DialURL(l.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect to the directory")
+	}
+	defer conn.Close()
+
+	if l.bindDN != "" {
+		if err = conn.Bind(l.bindDN, l.bindPassword); err != nil {
+			return nil, errors.Wrap(err, "bind to the directory")
+		}
+	}
+
+	members := map[string]*Member{}
+	entries := map[string]*Member{}
+	for group, role := range l.groups {
+		entry, err := readEntry(conn, group, l.memberAttribute)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read group %s", group)
+		}
+
+		for _, dn := range entry.GetAttributeValues(l.memberAttribute) {
+			member, ok := entries[dn]
+			if !ok {
+				entry, err := readEntry(conn, dn, l.usernameAttribute, l.nameAttribute, l.emailAttribute)
+				if err != nil {
+					return nil, errors.Wrapf(err, "read member %s of group %s", dn, group)
+				}
+
+				member = &Member{
+					Username: entry.GetAttributeValue(l.usernameAttribute),
+					Name:     entry.GetAttributeValue(l.nameAttribute),
+					Email:    entry.GetAttributeValue(l.emailAttribute),
+				}
+				entries[dn] = member
+
+				if member.Username == "" {
+					log.Warnf("LDAP member %s has no %s, it is left out", dn, l.usernameAttribute)
+				} else {
+					members[member.Username] = member
+				}
+			}
+
+			if role.Outranks(member.Role) {
+				member.Role = role
+			}
+		}
+	}
+
+	list := make([]Member, 0, len(members))
+	for _, member := range members {
+		list = append(list, *member)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
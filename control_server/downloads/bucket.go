@@ -0,0 +1,65 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloads
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate bytes per second on average, with bursts of at most burst bytes
+type TokenBucket struct {
+	rate  float64
+	burst uint64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full token bucket
+func NewTokenBucket(rate float64, burst uint64) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Burst is the largest amount of bytes which can be taken at once
+func (b *TokenBucket) Burst() uint64 {
+	return b.burst
+}
+
+// Wait takes n tokens from the bucket, waiting until they are available. Tokens are reserved before waiting, so
+// the waiting callers are served in the order they arrived.
+func (b *TokenBucket) Wait(ctx context.Context, n uint64) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The reserved tokens were not used
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
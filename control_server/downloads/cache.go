@@ -0,0 +1,353 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloads
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/baas-project/baas/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheSuffix marks the files of the cache, only those are removed when the cache starts
+const cacheSuffix = ".cache"
+
+var (
+	cacheRequests = metrics.NewCounter("baas_download_cache_requests_total",
+		"Image downloads by how the cache served them: hit, coalesced, miss or bypass.", "result")
+	cacheHitRatio = metrics.NewGauge("baas_download_cache_hit_ratio",
+		"Share of the cached image downloads which did not read the storage themselves.")
+	cacheBytes    = metrics.NewGauge("baas_download_cache_bytes", "Bytes held by the download cache.")
+	cacheFailures = metrics.NewCounter("baas_download_cache_failures_total",
+		"Cache fills which failed, their readers fell back to the storage.")
+)
+
+// Cache keeps copies of the files machines download on a fast disk, bounded by a number of bytes. The first
+// download of a file fills the cache while the concurrent downloads of the same file read along, so a lab which
+// flashes the same version at once reads it from the storage only once.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	used    int64
+	entries map[string]*entry
+	// lru orders the entries from the most to the least recently used
+	lru *list.List
+	// served counts the downloads which did not read the storage themselves, of the total downloads
+	served, total uint64
+}
+
+// entry is a file in the cache, which may still be filling
+type entry struct {
+	key     string
+	path    string
+	size    int64
+	element *list.Element
+	// readers is how many downloads read the entry, it is not evicted while they do
+	readers int
+
+	mu     sync.Mutex
+	filled *sync.Cond
+	// written is how many bytes of the file are in the cache
+	written int64
+	done    bool
+	err     error
+}
+
+// NewCache creates a cache in dir of at most maxBytes, the files an earlier cache left there are removed
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), cacheSuffix) {
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &Cache{dir: dir, maxBytes: maxBytes, entries: map[string]*entry{}, lru: list.New()}, nil
+}
+
+// Open returns a reader of the file stored under key, which is size bytes long. The key has to change when the
+// file does. The file is read from the cache when it is there, or is being filled by a concurrent download.
+// Otherwise open is called to read the file from the storage into the cache. When the file does not fit in the
+// cache Open returns nil, and the caller reads the file itself.
+func (c *Cache) Open(key string, size int64, open func() (*os.File, error)) (*Reader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	result := "hit"
+	if !ok {
+		if !c.reserve(size) {
+			cacheRequests.Inc("bypass")
+			return nil, nil
+		}
+
+		var err error
+		e, err = c.add(key, size, open)
+		if err != nil {
+			c.used -= size
+			cacheBytes.Set(float64(c.used))
+			return nil, err
+		}
+		result = "miss"
+	} else if !e.finished() {
+		result = "coalesced"
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+
+	e.readers++
+	c.lru.MoveToFront(e.element)
+	c.count(result)
+	return &Reader{cache: c, entry: e, file: f, open: open}, nil
+}
+
+// count updates the metrics of a download which was served as result
+func (c *Cache) count(result string) {
+	cacheRequests.Inc(result)
+	c.total++
+	if result != "miss" {
+		c.served++
+	}
+	cacheHitRatio.Set(float64(c.served) / float64(c.total))
+}
+
+// reserve makes room for size bytes by evicting the least recently used files which are not being read
+func (c *Cache) reserve(size int64) bool {
+	if size > c.maxBytes {
+		return false
+	}
+
+	for element := c.lru.Back(); element != nil && c.used+size > c.maxBytes; {
+		e := element.Value.(*entry)
+		element = element.Prev()
+		if e.readers == 0 && e.finished() {
+			c.remove(e)
+		}
+	}
+
+	if c.used+size > c.maxBytes {
+		return false
+	}
+
+	c.used += size
+	cacheBytes.Set(float64(c.used))
+	return true
+}
+
+// add creates the entry of a file and starts filling it
+func (c *Cache) add(key string, size int64, open func() (*os.File, error)) (*entry, error) {
+	sum := sha256.Sum256([]byte(key))
+	path := filepath.Join(c.dir, hex.EncodeToString(sum[:])+cacheSuffix)
+	dst, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &entry{key: key, path: path, size: size}
+	e.filled = sync.NewCond(&e.mu)
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+
+	// The fill does not belong to the download which started it, the others keep reading when it goes away
+	go c.fill(e, dst, open)
+	return e, nil
+}
+
+// remove takes an entry out of the cache, readers which still have its file open keep reading it
+func (c *Cache) remove(e *entry) {
+	if c.entries[e.key] != e {
+		return
+	}
+
+	delete(c.entries, e.key)
+	c.lru.Remove(e.element)
+	c.used -= e.size
+	cacheBytes.Set(float64(c.used))
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Cannot remove %s from the download cache: %v", e.key, err)
+	}
+}
+
+// fill copies the file from the storage into the cache. When it fails the entry is removed, so the next download
+// tries again, and the readers of the entry read the rest from the storage.
+func (c *Cache) fill(e *entry, dst *os.File, open func() (*os.File, error)) {
+	err := e.copy(dst, open)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.Errorf("Cannot cache %s, its downloads read from the storage: %v", e.key, err)
+		cacheFailures.Inc()
+		c.mu.Lock()
+		c.remove(e)
+		c.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	e.done, e.err = true, err
+	e.mu.Unlock()
+	e.filled.Broadcast()
+}
+
+func (e *entry) copy(dst *os.File, open func() (*os.File, error)) error {
+	src, err := open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	buf := make([]byte, 1<<20)
+	for e.written < e.size {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+
+			e.mu.Lock()
+			e.written += int64(n)
+			e.mu.Unlock()
+			e.filled.Broadcast()
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if e.written != e.size {
+		return fmt.Errorf("read %d of the %d bytes, the file changed", e.written, e.size)
+	}
+
+	return nil
+}
+
+func (e *entry) finished() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.done
+}
+
+// wait waits until the cache holds the byte at offset, and returns up to where the file was written. It returns the
+// error of the fill when that failed before it got there.
+func (e *entry) wait(offset int64) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for e.written <= offset && !e.done {
+		e.filled.Wait()
+	}
+
+	if e.written <= offset && e.err != nil {
+		return 0, e.err
+	}
+
+	return e.written, nil
+}
+
+// Reader reads a file from the cache as it is filled, or from the storage when the filling failed
+type Reader struct {
+	cache  *Cache
+	entry  *entry
+	file   *os.File
+	open   func() (*os.File, error)
+	direct *os.File
+	offset int64
+}
+
+// Read reads from the current offset, waiting for the cache to be filled up to it
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.entry.size {
+		return 0, io.EOF
+	}
+
+	var n int
+	var err error
+	if r.direct == nil {
+		var written int64
+		written, err = r.entry.wait(r.offset)
+		if err == nil {
+			if available := written - r.offset; int64(len(p)) > available {
+				p = p[:available]
+			}
+
+			n, err = r.file.ReadAt(p, r.offset)
+			r.offset += int64(n)
+			return n, err
+		}
+
+		// The fill failed, what it wrote is still valid but the rest has to come from the storage
+		if r.direct, err = r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = r.direct.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset of the next Read
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.entry.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+// Close releases the entry, it may be evicted once nobody reads it
+func (r *Reader) Close() error {
+	r.cache.mu.Lock()
+	r.entry.readers--
+	r.cache.mu.Unlock()
+
+	err := r.file.Close()
+	if r.direct != nil {
+		if directErr := r.direct.Close(); err == nil {
+			err = directErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloads
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_Coalescing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("initramfs"), 300000)
+	source := filepath.Join(dir, "source.img")
+	assert.NoError(t, ioutil.WriteFile(source, content, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stale"+cacheSuffix), []byte("old"), 0644))
+
+	cache, err := NewCache(dir, int64(len(content))*2)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "stale"+cacheSuffix))
+	assert.True(t, os.IsNotExist(err))
+
+	// The storage is held up until all downloads asked for the file
+	var opens int32
+	start := make(chan struct{})
+	open := func() (*os.File, error) {
+		atomic.AddInt32(&opens, 1)
+		<-start
+		return os.Open(source)
+	}
+
+	misses, coalesced := cacheRequests.Value("miss"), cacheRequests.Value("coalesced")
+	readers := make([]*Reader, 10)
+	for i := range readers {
+		readers[i], err = cache.Open("kernel/1", int64(len(content)), open)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, float64(1), cacheRequests.Value("miss")-misses)
+	assert.Equal(t, float64(9), cacheRequests.Value("coalesced")-coalesced)
+	close(start)
+
+	var wg sync.WaitGroup
+	for _, reader := range readers {
+		wg.Add(1)
+		go func(reader *Reader) {
+			defer wg.Done()
+			read, err := ioutil.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, content, read)
+			assert.NoError(t, reader.Close())
+		}(reader)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opens))
+
+	// Later downloads are hits, and can start anywhere in the file
+	hits := cacheRequests.Value("hit")
+	reader, err := cache.Open("kernel/1", int64(len(content)), open)
+	assert.NoError(t, err)
+	_, err = reader.Seek(9, io.SeekStart)
+	assert.NoError(t, err)
+	buf := make([]byte, 9)
+	_, err = io.ReadFull(reader, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "initramfs", string(buf))
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, float64(1), cacheRequests.Value("hit")-hits)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opens))
+}
+
+func TestCache_FailedFill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("disk"), 1000000)
+	source := filepath.Join(dir, "source.img")
+	assert.NoError(t, ioutil.WriteFile(source, content, 0644))
+	truncated := filepath.Join(dir, "truncated.img")
+	assert.NoError(t, ioutil.WriteFile(truncated, content[:len(content)/2], 0644))
+
+	cache, err := NewCache(dir, int64(len(content)))
+	assert.NoError(t, err)
+
+	// The fill reads a file which breaks off halfway, the readers get the rest from the storage
+	var opens int32
+	start := make(chan struct{})
+	open := func() (*os.File, error) {
+		if atomic.AddInt32(&opens, 1) == 1 {
+			<-start
+			return os.Open(truncated)
+		}
+		return os.Open(source)
+	}
+
+	failures := cacheFailures.Value()
+	readers := make([]*Reader, 3)
+	for i := range readers {
+		readers[i], err = cache.Open("disk/1", int64(len(content)), open)
+		assert.NoError(t, err)
+	}
+	close(start)
+
+	for _, reader := range readers {
+		read, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, content, read)
+		assert.NoError(t, reader.Close())
+	}
+	assert.Equal(t, float64(1), cacheFailures.Value()-failures)
+
+	// The failed entry is gone, the next download fills the cache again
+	assert.Equal(t, float64(0), cacheBytes.Value())
+	misses := cacheRequests.Value("miss")
+	reader, err := cache.Open("disk/1", int64(len(content)), open)
+	assert.NoError(t, err)
+	read, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, float64(1), cacheRequests.Value("miss")-misses)
+}
+
+func TestCache_Eviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.img")
+	assert.NoError(t, ioutil.WriteFile(source, []byte("0123456789"), 0644))
+	open := func() (*os.File, error) {
+		return os.Open(source)
+	}
+
+	cache, err := NewCache(dir, 25)
+	assert.NoError(t, err)
+
+	read := func(key string) *Reader {
+		reader, err := cache.Open(key, 10, open)
+		assert.NoError(t, err)
+		if reader != nil {
+			content, err := ioutil.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, "0123456789", string(content))
+		}
+		return reader
+	}
+
+	assert.NoError(t, read("a").Close())
+	assert.NoError(t, read("b").Close())
+	assert.NoError(t, read("a").Close())
+
+	// b was used least recently, it makes room for c
+	assert.NoError(t, read("c").Close())
+	misses := cacheRequests.Value("miss")
+	assert.NoError(t, read("a").Close())
+	assert.Equal(t, misses, cacheRequests.Value("miss"))
+	assert.NoError(t, read("b").Close())
+	assert.Equal(t, misses+1, cacheRequests.Value("miss"))
+
+	// Files which are being read are not evicted, nor are files larger than the cache cached
+	a, b := read("a"), read("b")
+	assert.Nil(t, read("c"))
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Close())
+	reader, err := cache.Open("large", 26, open)
+	assert.NoError(t, err)
+	assert.Nil(t, reader)
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package downloads coordinates the image downloads of the control server, so a lab full of machines flashing at
+// the same time does not saturate its uplink. It caps the number of downloads which stream at once and their
+// combined bandwidth, queues the others with interactive downloads ahead of bulk ones, and refuses downloads
+// when the queue is full. A cache on a fast disk lets the downloads of the same file read it from the storage once.
+package downloads
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/baas-project/baas/pkg/metrics"
+)
+
+// Priority decides the order in which queued downloads start
+type Priority int
+
+const (
+	// Bulk downloads are those of machines flashing their images
+	Bulk Priority = iota
+	// Interactive downloads are made by users, who are waiting for them
+	Interactive
+)
+
+func (p Priority) String() string {
+	if p == Interactive {
+		return "interactive"
+	}
+
+	return "bulk"
+}
+
+// ErrQueueFull is returned when a download can neither start nor wait for its turn
+var ErrQueueFull = errors.New("too many downloads are waiting")
+
+var (
+	activeDownloads = metrics.NewGauge("baas_downloads_active", "Image downloads which are streaming.")
+	queuedDownloads = metrics.NewGauge("baas_downloads_queued", "Image downloads waiting for their turn.",
+		"priority")
+	refusedDownloads = metrics.NewCounter("baas_downloads_refused_total",
+		"Image downloads refused because the queue was full.", "priority")
+	downloadedBytes = metrics.NewCounter("baas_downloads_bytes_total", "Bytes sent by image downloads.")
+)
+
+// Coordinator hands out the turns of the downloads
+type Coordinator struct {
+	// maxActive and maxQueued of zero do not limit anything
+	maxActive int
+	maxQueued int
+	bucket    *TokenBucket
+
+	mu     sync.Mutex
+	active int
+	// queues holds the waiting downloads for every priority, each element is a chan struct{} which is closed
+	// when the download gets its turn
+	queues [Interactive + 1]*list.List
+}
+
+// NewCoordinator creates a coordinator, bytesPerSecond is the bandwidth the downloads share together
+func NewCoordinator(maxActive int, maxQueued int, bytesPerSecond uint64) *Coordinator {
+	c := &Coordinator{maxActive: maxActive, maxQueued: maxQueued}
+	for i := range c.queues {
+		c.queues[i] = list.New()
+	}
+
+	if bytesPerSecond != 0 {
+		c.bucket = NewTokenBucket(float64(bytesPerSecond), bytesPerSecond)
+	}
+
+	return c
+}
+
+func (c *Coordinator) queued() int {
+	total := 0
+	for _, queue := range c.queues {
+		total += queue.Len()
+	}
+
+	return total
+}
+
+// Acquire waits for the turn of a download. The download has to call the release function once it is done, it is
+// not waited for when the queue is full or the context ends.
+func (c *Coordinator) Acquire(ctx context.Context, priority Priority) (func(), error) {
+	c.mu.Lock()
+	if c.maxActive == 0 || (c.active < c.maxActive && c.queued() == 0) {
+		c.active++
+		c.mu.Unlock()
+		activeDownloads.Add(1)
+		return c.release, nil
+	}
+
+	if c.maxQueued != 0 && c.queued() >= c.maxQueued {
+		c.mu.Unlock()
+		refusedDownloads.Inc(priority.String())
+		return nil, ErrQueueFull
+	}
+
+	turn := make(chan struct{})
+	element := c.queues[priority].PushBack(turn)
+	c.mu.Unlock()
+	queuedDownloads.Add(1, priority.String())
+
+	select {
+	case <-turn:
+		return c.release, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// The turn may have been handed out while we were giving up, it is passed on in that case
+		select {
+		case <-turn:
+			c.releaseLocked()
+		default:
+			c.queues[priority].Remove(element)
+			queuedDownloads.Add(-1, priority.String())
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Coordinator) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.releaseLocked()
+}
+
+// releaseLocked ends a download and hands its turn to the next one, interactive downloads go first
+func (c *Coordinator) releaseLocked() {
+	for priority := Interactive; priority >= Bulk; priority-- {
+		if front := c.queues[priority].Front(); front != nil {
+			c.queues[priority].Remove(front)
+			queuedDownloads.Add(-1, priority.String())
+			close(front.Value.(chan struct{}))
+			return
+		}
+	}
+
+	c.active--
+	activeDownloads.Add(-1)
+}
+
+// Stats is the state of the coordinator at one moment
+type Stats struct {
+	Active int
+	Queued int
+}
+
+// Stats returns the number of active and queued downloads
+func (c *Coordinator) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Active: c.active, Queued: c.queued()}
+}
+
+// Writer limits a download to the bandwidth of the coordinator, which it shares with the other downloads
+func (c *Coordinator) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return &writer{ctx: ctx, w: w, bucket: c.bucket}
+}
+
+type writer struct {
+	ctx    context.Context
+	w      io.Writer
+	bucket *TokenBucket
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if w.bucket != nil {
+			// Writes are split into pieces of at most the burst, so the downloads take turns instead of one of them
+			// reserving seconds of bandwidth at once
+			if burst := w.bucket.Burst(); uint64(len(chunk)) > burst {
+				chunk = chunk[:burst]
+			}
+
+			if err := w.bucket.Wait(w.ctx, uint64(len(chunk))); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.w.Write(chunk)
+		written += n
+		downloadedBytes.Add(float64(n))
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package downloads
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitQueued waits until the coordinator has queued the amount of downloads
+func waitQueued(t *testing.T, c *Coordinator, queued int) {
+	for i := 0; i < 100 && c.Stats().Queued != queued; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, queued, c.Stats().Queued)
+}
+
+func TestCoordinator(t *testing.T) {
+	c := NewCoordinator(1, 2, 0)
+	ctx := context.Background()
+
+	release, err := c.Acquire(ctx, Bulk)
+	assert.NoError(t, err)
+
+	// The queue takes two downloads, interactive ones start before the bulk ones queued earlier
+	order := make(chan Priority, 2)
+	for _, priority := range []Priority{Bulk, Interactive} {
+		go func(priority Priority) {
+			release, err := c.Acquire(ctx, priority)
+			if assert.NoError(t, err) {
+				order <- priority
+				release()
+			}
+		}(priority)
+		waitQueued(t, c, int(priority)+1)
+	}
+
+	_, err = c.Acquire(ctx, Interactive)
+	assert.Equal(t, ErrQueueFull, err)
+
+	release()
+	assert.Equal(t, Interactive, <-order)
+	assert.Equal(t, Bulk, <-order)
+	assert.Equal(t, Stats{}, c.Stats())
+
+	// Downloads which give up waiting leave the queue
+	release, err = c.Acquire(ctx, Bulk)
+	assert.NoError(t, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := c.Acquire(cancelled, Bulk)
+		done <- err
+	}()
+	waitQueued(t, c, 1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, Stats{Active: 1}, c.Stats())
+	release()
+	assert.Equal(t, Stats{}, c.Stats())
+}
+
+func TestWriter(t *testing.T) {
+	// 1000 bytes per second with a burst of 1000 bytes, writing 1500 bytes has to wait half a second
+	c := NewCoordinator(0, 0, 1000)
+	var buf bytes.Buffer
+
+	start := time.Now()
+	n, err := c.Writer(context.Background(), &buf).Write(make([]byte, 1500))
+	assert.NoError(t, err)
+	assert.Equal(t, 1500, n)
+	assert.Equal(t, 1500, buf.Len())
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "the write took %s", time.Since(start))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Writer(ctx, &buf).Write(make([]byte, 1500))
+	assert.Equal(t, context.Canceled, err)
+}
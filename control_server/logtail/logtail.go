@@ -0,0 +1,193 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logtail keeps the latest log entries of the control server in memory, so admins can read them back and
+// follow them without access to the host
+package logtail
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxMessageBytes and maxFieldBytes cut off long messages and field values, so one entry cannot take the
+	// whole buffer
+	maxMessageBytes = 4096
+	maxFieldBytes   = 1024
+	// entryOverhead is roughly what an entry takes next to its message and fields
+	entryOverhead = 64
+	// subscriptionBacklog is how many entries a subscriber may fall behind before it misses entries
+	subscriptionBacklog = 256
+)
+
+// Entry is a log entry as the buffer keeps it, with the sensitive fields scrubbed. IDs count up from 1 in the
+// order the entries were logged.
+type Entry struct {
+	ID      uint64
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  map[string]string `json:",omitempty"`
+
+	level log.Level
+	size  int
+}
+
+// Buffer is a logrus hook which keeps the last entries, at most maxEntries of them taking at most maxBytes
+type Buffer struct {
+	mu         sync.Mutex
+	ring       []Entry
+	start      int
+	count      int
+	bytes      int
+	maxBytes   int
+	lastID     uint64
+	subscribed map[*Subscription]bool
+}
+
+// New makes a buffer keeping the last maxEntries entries, as long as they take no more than maxBytes
+func New(maxEntries int, maxBytes int) *Buffer {
+	return &Buffer{
+		ring:       make([]Entry, maxEntries),
+		maxBytes:   maxBytes,
+		subscribed: map[*Subscription]bool{},
+	}
+}
+
+// Levels are the levels the buffer keeps, which is all of them the logger logs
+func (b *Buffer) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire scrubs the entry and adds it to the buffer, dropping the oldest entries to make room
+func (b *Buffer) Fire(entry *log.Entry) error {
+	e := Entry{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: truncate(Scrub(entry.Message), maxMessageBytes),
+		level:   entry.Level,
+	}
+
+	if len(entry.Data) != 0 {
+		e.Fields = make(map[string]string, len(entry.Data))
+		for key, value := range entry.Data {
+			e.Fields[key] = truncate(ScrubField(key, fmt.Sprint(value)), maxFieldBytes)
+		}
+	}
+
+	e.size = entryOverhead + len(e.Message)
+	for key, value := range e.Fields {
+		e.size += len(key) + len(value)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.ring) == 0 || e.size > b.maxBytes {
+		return nil
+	}
+
+	for b.count == len(b.ring) || b.bytes+e.size > b.maxBytes {
+		b.bytes -= b.ring[b.start].size
+		b.ring[b.start] = Entry{}
+		b.start = (b.start + 1) % len(b.ring)
+		b.count--
+	}
+
+	b.lastID++
+	e.ID = b.lastID
+	b.ring[(b.start+b.count)%len(b.ring)] = e
+	b.count++
+	b.bytes += e.size
+
+	for s := range b.subscribed {
+		s.offer(e)
+	}
+
+	return nil
+}
+
+// Entries gives the last limit entries at level or more severe which came after the entry with the ID after and
+// were logged at since or later, the oldest first
+func (b *Buffer) Entries(level log.Level, since time.Time, after uint64, limit int) []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var found []Entry
+	for i := b.count - 1; i >= 0 && len(found) < limit; i-- {
+		e := b.ring[(b.start+i)%len(b.ring)]
+		if e.ID <= after {
+			break
+		}
+
+		if e.level <= level && !e.Time.Before(since) {
+			found = append(found, e)
+		}
+	}
+
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+
+	return found
+}
+
+// Subscription receives the entries logged at its level or more severe after it subscribed
+type Subscription struct {
+	// C receives the entries, entries logged while it is full are missed
+	C      <-chan Entry
+	c      chan Entry
+	level  log.Level
+	missed uint64
+}
+
+// offer passes the entry on without waiting for a subscriber which fell behind
+func (s *Subscription) offer(e Entry) {
+	if e.level > s.level {
+		return
+	}
+
+	select {
+	case s.c <- e:
+	default:
+		atomic.AddUint64(&s.missed, 1)
+	}
+}
+
+// Missed is how many entries the subscription missed since it was last asked
+func (s *Subscription) Missed() uint64 {
+	return atomic.SwapUint64(&s.missed, 0)
+}
+
+// Subscribe follows the entries at level or more severe, until the subscription is unsubscribed
+func (b *Buffer) Subscribe(level log.Level) *Subscription {
+	c := make(chan Entry, subscriptionBacklog)
+	s := &Subscription{C: c, c: c, level: level}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribed[s] = true
+	return s
+}
+
+// Unsubscribe stops passing entries to the subscription
+func (b *Buffer) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribed, s)
+}
+
+// truncate cuts s off after max bytes, and says so
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	return s[:max] + "…"
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logtail
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLogger logs into a buffer only
+func newLogger(b *Buffer) *log.Logger {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	logger.Level = log.TraceLevel
+	logger.AddHook(b)
+	return logger
+}
+
+// messages are the messages of the entries
+func messages(entries []Entry) []string {
+	found := []string{}
+	for _, e := range entries {
+		found = append(found, e.Message)
+	}
+	return found
+}
+
+func TestBuffer_Entries(t *testing.T) {
+	b := New(3, 1<<20)
+	logger := newLogger(b)
+	logger.Info("one")
+	logger.Warn("two")
+	logger.Debug("three")
+	logger.Error("four")
+
+	// The oldest entry made way
+	assert.Equal(t, []string{"two", "three", "four"}, messages(b.Entries(log.TraceLevel, time.Time{}, 0, 10)))
+	assert.Equal(t, []string{"two", "four"}, messages(b.Entries(log.WarnLevel, time.Time{}, 0, 10)))
+	assert.Equal(t, []string{"four"}, messages(b.Entries(log.TraceLevel, time.Time{}, 0, 1)))
+	assert.Equal(t, []string{"four"}, messages(b.Entries(log.TraceLevel, time.Time{}, 3, 10)))
+	assert.Empty(t, b.Entries(log.TraceLevel, time.Now().Add(time.Minute), 0, 10))
+
+	entries := b.Entries(log.TraceLevel, time.Time{}, 0, 10)
+	assert.Equal(t, []uint64{2, 3, 4}, []uint64{entries[0].ID, entries[1].ID, entries[2].ID})
+	assert.Equal(t, "warning", entries[0].Level)
+}
+
+func TestBuffer_Bytes(t *testing.T) {
+	b := New(100, 3*(entryOverhead+maxMessageBytes))
+	logger := newLogger(b)
+	for i := 0; i < 10; i++ {
+		logger.Info(strings.Repeat("x", 2*maxMessageBytes))
+	}
+
+	// Long messages are cut off, and only as many are kept as fit
+	entries := b.Entries(log.TraceLevel, time.Time{}, 0, 100)
+	assert.Len(t, entries, 2)
+	assert.True(t, strings.HasPrefix(entries[0].Message, strings.Repeat("x", maxMessageBytes)))
+	assert.LessOrEqual(t, b.bytes, b.maxBytes)
+}
+
+func TestBuffer_Scrub(t *testing.T) {
+	b := New(10, 1<<20)
+	logger := newLogger(b)
+	logger.WithFields(log.Fields{"session_id": "abc", "code": "4/0Ab", "exit_code": 1, "mac": "52:54:00:d9:71:93",
+		"url": "/user/login/github/callback?code=4/0Ab&state=xyz"}).
+		Infof("Logged in with Authorization: Bearer eyJhbGc and token=s3cret")
+
+	entry := b.Entries(log.TraceLevel, time.Time{}, 0, 1)[0]
+	assert.Equal(t, "Logged in with Authorization: Bearer [redacted] and token=[redacted]", entry.Message)
+	assert.Equal(t, map[string]string{
+		"session_id": Redacted,
+		"code":       Redacted,
+		"exit_code":  "1",
+		"mac":        "52:54:00:d9:71:93",
+		"url":        "/user/login/github/callback?code=[redacted]&state=xyz",
+	}, entry.Fields)
+}
+
+func TestBuffer_Subscribe(t *testing.T) {
+	b := New(10, 1<<20)
+	logger := newLogger(b)
+	logger.Info("before")
+
+	s := b.Subscribe(log.WarnLevel)
+	logger.Info("quiet")
+	logger.Warn("loud")
+	assert.Equal(t, "loud", (<-s.C).Message)
+
+	// A subscriber which falls behind misses entries rather than holding up the logging
+	for i := 0; i < subscriptionBacklog+5; i++ {
+		logger.Error("flood")
+	}
+	assert.Equal(t, uint64(5), s.Missed())
+	assert.Equal(t, uint64(0), s.Missed())
+
+	b.Unsubscribe(s)
+	for len(s.C) != 0 {
+		<-s.C
+	}
+	logger.Error("after")
+	assert.Empty(t, s.C)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logtail
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces what is scrubbed
+const Redacted = "[redacted]"
+
+// sensitiveWords mark the fields which hold credentials anywhere in their names, such as session_id or
+// access_token
+var sensitiveWords = []string{"token", "secret", "password", "passphrase", "session", "cookie", "authorization"}
+
+// sensitiveFields are the fields which hold credentials, but whose names are too common to look for within others
+var sensitiveFields = map[string]bool{"code": true, "oauth_code": true}
+
+var (
+	// sensitiveParameters are credentials given as name=value in query strings, forms and messages
+	sensitiveParameters = regexp.MustCompile(`(?i)\b((?:[a-z_-]*token|code|[a-z_-]*secret|password|passphrase|` +
+		`session[a-z_-]*)=)([^\s&"',;]+)`)
+	// bearerTokens are the tokens of authorization headers
+	bearerTokens = regexp.MustCompile(`(?i)\b(bearer\s+)([^\s"',;]+)`)
+)
+
+// Scrub removes the credentials from a message
+func Scrub(message string) string {
+	message = sensitiveParameters.ReplaceAllString(message, "${1}"+Redacted)
+	return bearerTokens.ReplaceAllString(message, "${1}"+Redacted)
+}
+
+// ScrubField removes the value of a field which holds credentials, and the credentials in the value of the others
+func ScrubField(key string, value string) string {
+	name := strings.ToLower(key)
+	if sensitiveFields[name] {
+		return Redacted
+	}
+
+	for _, word := range sensitiveWords {
+		if strings.Contains(name, word) {
+			return Redacted
+		}
+	}
+
+	return Scrub(value)
+}
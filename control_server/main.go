@@ -11,17 +11,22 @@ import (
 	"strconv"
 
 	"github.com/baas-project/baas/pkg/database/sqlite"
+	"github.com/baas-project/baas/pkg/secrets"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/baas-project/baas/control_server/api"
+	"github.com/baas-project/baas/control_server/config"
 	"github.com/baas-project/baas/control_server/pixieserver"
+	"github.com/baas-project/baas/control_server/tftpserver"
 	api_pkg "github.com/baas-project/baas/pkg/api"
 )
 
 var (
-	static   = flag.String("static", "control_server/static", "Static file dir to server under /static/.")
-	diskpath = flag.String("disks", "control_server/disks", "Location to store disk images.")
+	static    = flag.String("static", "control_server/static", "Static file dir to server under /static/.")
+	diskpath  = flag.String("disks", "control_server/disks", "Location to store disk images.")
+	confpath  = flag.String("config", "", "Configuration file, the defaults are used when none is given.")
+	replicaOf = flag.String("replica-of", "", "URL of the primary control server to run as a read-only replica of.")
 )
 
 func init() {
@@ -48,16 +53,89 @@ func main() {
 
 	log.Info("Starting BAAS control server")
 
-	store, err := sqlite.NewSqliteStore("store.db")
+	conf := config.Default()
+	if *confpath != "" {
+		var err error
+		if conf, err = config.Load(*confpath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store, err := sqlite.NewSqliteStoreWithReadReplica("store.db", conf.ReadReplicaDSN)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The database stays a replica across restarts, until it is promoted with baas-admin
+	if *replicaOf != "" {
+		if conf.ReplicationToken == "" {
+			log.Fatal("A replica needs the ReplicationToken of its primary")
+		}
+
+		if err = store.SetReplicaOf(*replicaOf); err != nil {
+			log.Fatalf("Cannot make the database a replica of %s: %v", *replicaOf, err)
+		}
+
+		log.Infof("Running as a read-only replica of %s", *replicaOf)
+	}
+
+	// Image names only become unique regardless of case once the admin resolved the names which collide
+	collisions, err := store.FindNameCollisions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, collision := range collisions {
+		log.Warnf("Images of %s differ only in the case of their names, rename or remove all but one: %v",
+			collision.Username, collision.Images)
+	}
+
+	// Users with a role which is not known cannot do anything until an admin gives them a valid one
+	invalid, err := store.FindInvalidRoles()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// mac
+	for _, u := range invalid {
+		log.Warnf("User %s has the unknown role %q, give them a valid role", u.Username, u.Role)
+	}
+
+	// Accounts sharing an email address keep the address from being unique until an admin merges them
+	emails, err := store.FindEmailCollisions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, collision := range emails {
+		log.Warnf("Users %v share the email address %s, merge them through /admin/users/merge",
+			collision.Usernames, collision.Email)
+	}
+
+	// Secrets sealed with a key we do not have cannot be read, better to stop now than fail on every use
+	keyring, err := conf.Keyring()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	ids, err := store.SecretKeyIDs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if missing := secrets.Missing(keyring, ids); len(missing) != 0 {
+		log.Fatalf("The database holds secrets sealed with the keys %v, which are not configured in SecretKey or "+
+			"SecretKeyFile", missing)
+	}
+	secrets.Use(keyring)
+
+	if conf.TFTPEnabled {
+		go func() {
+			if err := tftpserver.ListenAndServe(conf.TFTPAddress, *static); err != nil {
+				log.Errorf("TFTP server stopped: %v", err)
+			}
+		}()
+	}
+
 	go pixieserver.StartPixiecore(fmt.Sprintf("http://localhost:%s", strconv.Itoa(api_pkg.Port)))
-	api.StartServer(store, *static, *diskpath, "0.0.0.0", api_pkg.Port)
+	api.StartServer(store, *static, *diskpath, "0.0.0.0", api_pkg.Port, conf)
 }
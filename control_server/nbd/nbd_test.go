@@ -0,0 +1,181 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client speaks just enough of the protocol to read from an export
+type client struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dial(t *testing.T, address string) *client {
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+
+	c := &client{t: t, conn: conn}
+	var magic, option uint64
+	var flags uint16
+	c.read(&magic, &option, &flags)
+	assert.Equal(t, nbdMagic, magic)
+	assert.Equal(t, optionMagic, option)
+	c.write(uint32(flagFixedNewstyle | flagNoZeroes))
+	return c
+}
+
+func (c *client) write(values ...interface{}) {
+	for _, v := range values {
+		assert.NoError(c.t, binary.Write(c.conn, binary.BigEndian, v))
+	}
+}
+
+func (c *client) read(values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Read(c.conn, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// option sends INFO or GO for an export and returns the type of the last reply and the size of the export
+func (c *client) option(option uint32, name string) (uint32, uint64) {
+	c.write(optionMagic, option, uint32(4+len(name)+2), uint32(len(name)), []byte(name), uint16(0))
+
+	var size uint64
+	for {
+		var magic uint64
+		var replied, kind, length uint32
+		assert.NoError(c.t, c.read(&magic, &replied, &kind, &length))
+		assert.Equal(c.t, replyMagic, magic)
+		assert.Equal(c.t, option, replied)
+
+		data := make([]byte, length)
+		_, err := io.ReadFull(c.conn, data)
+		assert.NoError(c.t, err)
+
+		if kind == repInfo {
+			size = binary.BigEndian.Uint64(data[2:])
+			assert.Equal(c.t, transmissionFlags, binary.BigEndian.Uint16(data[10:]))
+			continue
+		}
+
+		return kind, size
+	}
+}
+
+// request sends a command and returns the error code and the data of a read
+func (c *client) request(kind uint16, offset uint64, length uint32, payload []byte) (uint32, []byte) {
+	c.write(requestMagic, uint16(0), kind, uint64(42), offset, length)
+	if payload != nil {
+		c.write(payload)
+	}
+
+	var magic, code uint32
+	var handle uint64
+	assert.NoError(c.t, c.read(&magic, &code, &handle))
+	assert.Equal(c.t, simpleReply, magic)
+	assert.Equal(c.t, uint64(42), handle)
+
+	if code != 0 || kind != cmdRead {
+		return code, nil
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(c.conn, data)
+	assert.NoError(c.t, err)
+	return code, data
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "1.img")
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	s := NewServer(time.Minute)
+	go s.Serve(listener)
+
+	// Exports of the same file share its handle
+	first, err := s.Export(path, "52:54:00:d9:71:93")
+	assert.NoError(t, err)
+	second, err := s.Export(path, "52:54:00:d9:71:94")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Name, second.Name)
+	assert.Equal(t, int64(len(content)), first.Size)
+	assert.Len(t, s.files, 1)
+	assert.Equal(t, 2, s.files[path].refs)
+
+	c := dial(t, listener.Addr().String())
+	kind, _ := c.option(optGo, "guessed")
+	assert.Equal(t, repErrUnknown, kind)
+
+	// INFO does not use up the name
+	kind, size := c.option(optInfo, first.Name)
+	assert.Equal(t, repAck, kind)
+	assert.Equal(t, uint64(len(content)), size)
+
+	kind, _ = c.option(optGo, first.Name)
+	assert.Equal(t, repAck, kind)
+
+	code, data := c.request(cmdRead, 4, 5, nil)
+	assert.Equal(t, uint32(0), code)
+	assert.Equal(t, []byte("quick"), data)
+
+	code, _ = c.request(cmdRead, 40, 10, nil)
+	assert.Equal(t, errInval, code)
+
+	code, _ = c.request(cmdWrite, 0, 3, []byte("THE"))
+	assert.Equal(t, errPerm, code)
+	code, data = c.request(cmdRead, 0, 3, nil)
+	assert.Equal(t, uint32(0), code)
+	assert.Equal(t, []byte("the"), data)
+
+	// The name was good for a single connection
+	other := dial(t, listener.Addr().String())
+	kind, _ = other.option(optGo, first.Name)
+	assert.Equal(t, repErrUnknown, kind)
+
+	// Disconnecting removes the export, the file stays open for the other one
+	c.write(requestMagic, uint16(0), cmdDisc, uint64(0), uint64(0), uint32(0))
+	assert.Eventually(t, func() bool { return len(s.Exports()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, s.files, 1)
+
+	// Ending the boot of the machine disconnects its client and closes the file
+	kind, _ = other.option(optGo, second.Name)
+	assert.Equal(t, repAck, kind)
+	assert.Equal(t, 1, s.RemoveMachine("52:54:00:d9:71:94"))
+	var magic uint32
+	assert.Error(t, other.read(&magic))
+	assert.Empty(t, s.files)
+
+	// Exports nobody connects to expire
+	_, err = s.Export(path, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.Expire(time.Now()))
+	assert.Equal(t, 1, s.Expire(time.Now().Add(time.Minute)))
+	assert.Empty(t, s.Exports())
+	assert.Empty(t, s.files)
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The constants of the fixed newstyle negotiation and the transmission phase, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic       uint64 = 0x4e42444d41474943 // NBDMAGIC
+	optionMagic    uint64 = 0x49484156454f5054 // IHAVEOPT
+	replyMagic     uint64 = 0x3e889045565a9
+	requestMagic   uint32 = 0x25609513
+	simpleReply    uint32 = 0x67446698
+	maxOptionBytes uint32 = 64 * 1024
+	// maxReadBytes is the largest read a client may ask for, the Linux client reads far less at once
+	maxReadBytes uint32 = 32 * 1024 * 1024
+
+	flagFixedNewstyle uint16 = 1 << 0
+	flagNoZeroes      uint16 = 1 << 1
+
+	flagHasFlags uint16 = 1 << 0
+	flagReadOnly uint16 = 1 << 1
+	flagFlush    uint16 = 1 << 2
+
+	optExportName uint32 = 1
+	optAbort      uint32 = 2
+	optList       uint32 = 3
+	optInfo       uint32 = 6
+	optGo         uint32 = 7
+
+	repAck        uint32 = 1
+	repInfo       uint32 = 3
+	repErrUnsup   uint32 = 1<<31 + 1
+	repErrPolicy  uint32 = 1<<31 + 2
+	repErrInvalid uint32 = 1<<31 + 3
+	repErrUnknown uint32 = 1<<31 + 6
+
+	infoExport uint16 = 0
+
+	cmdRead  uint16 = 0
+	cmdWrite uint16 = 1
+	cmdDisc  uint16 = 2
+	cmdFlush uint16 = 3
+	cmdTrim  uint16 = 4
+
+	errPerm  uint32 = 1
+	errInval uint32 = 22
+)
+
+// transmissionFlags tell the client the export is read-only
+const transmissionFlags = flagHasFlags | flagReadOnly | flagFlush
+
+// errAbort ends a negotiation the client gave up on
+var errAbort = errors.New("the client aborted the negotiation")
+
+// connection is a client in either phase of the protocol
+type connection struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+}
+
+func (c *connection) write(values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Write(c.w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *connection) read(values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Read(c.r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reply answers an option during the negotiation
+func (c *connection) reply(option uint32, kind uint32, data []byte) error {
+	if err := c.write(replyMagic, option, kind, uint32(len(data)), data); err != nil {
+		return err
+	}
+
+	return c.w.Flush()
+}
+
+// serveConn negotiates an export with a client and serves it until the client disconnects. The export is removed
+// once the connection ends, its name was only good for this one connection.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	c := &connection{server: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	export, err := c.negotiate()
+	if export != nil {
+		defer s.Remove(export.Name)
+	}
+
+	if err != nil {
+		if !errors.Is(err, errAbort) && !errors.Is(err, io.EOF) {
+			log.Warnf("NBD negotiation with %s failed: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{"path": export.Path, "machine": export.MachineMAC}).
+		Infof("NBD client %s connected", conn.RemoteAddr())
+
+	// Removing the export closes the connection from under the client
+	if err = c.transmit(export); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Warnf("NBD connection with %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// negotiate runs the fixed newstyle handshake until the client picked an export. An export which was claimed is
+// returned even when the negotiation failed afterwards, so it can be removed.
+func (c *connection) negotiate() (*Export, error) {
+	if err := c.write(nbdMagic, optionMagic, flagFixedNewstyle|flagNoZeroes); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := c.read(&clientFlags); err != nil {
+		return nil, err
+	}
+
+	if clientFlags&uint32(flagFixedNewstyle) == 0 {
+		return nil, errors.New("the client does not speak the fixed newstyle negotiation")
+	}
+
+	for {
+		var magic uint64
+		var option, length uint32
+		if err := c.read(&magic, &option, &length); err != nil {
+			return nil, err
+		}
+
+		if magic != optionMagic {
+			return nil, fmt.Errorf("unexpected option magic %x", magic)
+		}
+
+		if length > maxOptionBytes {
+			return nil, fmt.Errorf("option of %d bytes is too long", length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+
+		export, err := c.option(option, data, clientFlags&uint32(flagNoZeroes) != 0)
+		if export != nil || err != nil {
+			return export, err
+		}
+	}
+}
+
+// option handles a single option, it returns the export once the client picked one
+func (c *connection) option(option uint32, data []byte, noZeroes bool) (*Export, error) {
+	switch option {
+	case optExportName:
+		// There is no way to refuse this option but hanging up
+		export, err := c.server.claim(string(data), c.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = c.write(uint64(export.Size), transmissionFlags); err != nil {
+			return nil, err
+		}
+		if !noZeroes {
+			if err = c.write(make([]byte, 124)); err != nil {
+				return nil, err
+			}
+		}
+
+		return export, c.w.Flush()
+	case optInfo, optGo:
+		if len(data) < 6 {
+			return nil, c.reply(option, repErrInvalid, nil)
+		}
+
+		nameLength := binary.BigEndian.Uint32(data)
+		if uint64(len(data)) < 4+uint64(nameLength)+2 {
+			return nil, c.reply(option, repErrInvalid, nil)
+		}
+		name := string(data[4 : 4+nameLength])
+
+		// Asking about an export does not use up its name, connecting to it does
+		var export *Export
+		var err error
+		if option == optGo {
+			export, err = c.server.claim(name, c.conn)
+		} else {
+			export, err = c.server.lookup(name)
+		}
+
+		if err != nil {
+			return nil, c.reply(option, repErrUnknown, []byte("unknown export"))
+		}
+
+		info := make([]byte, 12)
+		binary.BigEndian.PutUint16(info, infoExport)
+		binary.BigEndian.PutUint64(info[2:], uint64(export.Size))
+		binary.BigEndian.PutUint16(info[10:], transmissionFlags)
+		// Only GO moves on to the transmission, after INFO the client picks another option
+		if option == optInfo {
+			export = nil
+		}
+
+		if err = c.reply(option, repInfo, info); err != nil {
+			return export, err
+		}
+
+		return export, c.reply(option, repAck, nil)
+	case optAbort:
+		// The client may already be gone, the answer is a courtesy
+		_ = c.reply(option, repAck, nil)
+		return nil, errAbort
+	case optList:
+		// The names of the exports are their secrets
+		return nil, c.reply(option, repErrPolicy, []byte("exports are not listed"))
+	default:
+		return nil, c.reply(option, repErrUnsup, nil)
+	}
+}
+
+// answer sends a simple reply to a request
+func (c *connection) answer(code uint32, handle uint64, data []byte) error {
+	if err := c.write(simpleReply, code, handle); err != nil {
+		return err
+	}
+
+	if data != nil {
+		if _, err := c.w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return c.w.Flush()
+}
+
+// transmit serves the requests of the client until it disconnects. Writes are refused, the export is read-only.
+func (c *connection) transmit(export *Export) error {
+	for {
+		var magic uint32
+		var flags, kind uint16
+		var handle, offset uint64
+		var length uint32
+		if err := c.read(&magic, &flags, &kind, &handle, &offset, &length); err != nil {
+			return err
+		}
+
+		if magic != requestMagic {
+			return fmt.Errorf("unexpected request magic %x", magic)
+		}
+
+		var err error
+		switch kind {
+		case cmdRead:
+			if length > maxReadBytes || offset+uint64(length) > uint64(export.Size) {
+				err = c.answer(errInval, handle, nil)
+				break
+			}
+
+			data := make([]byte, length)
+			if _, rerr := export.backing.file.ReadAt(data, int64(offset)); rerr != nil && rerr != io.EOF {
+				log.Warnf("Cannot read %s: %v", export.Path, rerr)
+				err = c.answer(errInval, handle, nil)
+				break
+			}
+
+			err = c.answer(0, handle, data)
+		case cmdWrite:
+			// The data of the write still has to be read before the next request
+			if _, err = io.CopyN(ioutil.Discard, c.r, int64(length)); err == nil {
+				err = c.answer(errPerm, handle, nil)
+			}
+		case cmdTrim:
+			err = c.answer(errPerm, handle, nil)
+		case cmdFlush:
+			err = c.answer(0, handle, nil)
+		case cmdDisc:
+			return nil
+		default:
+			err = c.answer(errInval, handle, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
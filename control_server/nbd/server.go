@@ -0,0 +1,254 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nbd exports image versions read-only over the network block device protocol, so machines can boot them
+// without flashing them first. Every export has a name nobody can guess, which is accepted for a single connection
+// only. Exports of the same file share one file handle, however many machines boot it.
+package nbd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// expiryInterval is how often exports which were never connected are looked for
+const expiryInterval = time.Minute
+
+var (
+	// ErrUnknownExport is returned for names which are not exported, or whose connection was made already
+	ErrUnknownExport = errors.New("unknown export")
+
+	activeExports = metrics.NewGauge("baas_nbd_exports", "Image versions exported over NBD.")
+	openFiles     = metrics.NewGauge("baas_nbd_open_files", "Files held open for the NBD exports.")
+)
+
+// Export is an image version which can be connected to once
+type Export struct {
+	// Name is the secret the client asks for during the negotiation
+	Name string
+	Path string
+	Size int64
+	// MachineMAC is the machine the export was made for, it may be empty
+	MachineMAC string
+	CreatedAt  time.Time
+
+	// conn is the connection which claimed the export, the export is removed when it ends
+	conn    net.Conn
+	claimed bool
+	backing *backing
+}
+
+// backing is a file shared by all exports of it
+type backing struct {
+	path string
+	file *os.File
+	size int64
+	refs int
+}
+
+// Server keeps the exports and serves them to clients
+type Server struct {
+	// idle is how long an export waits for its connection before it is removed
+	idle time.Duration
+
+	mu      sync.Mutex
+	exports map[string]*Export
+	files   map[string]*backing
+}
+
+// NewServer creates a server without any exports, idle is how long an export waits for its connection
+func NewServer(idle time.Duration) *Server {
+	return &Server{idle: idle, exports: map[string]*Export{}, files: map[string]*backing{}}
+}
+
+// newName generates the secret name of an export
+func newName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Export exports a file until its connection ends or nobody connected to it for the idle time. The file is
+// opened once, for all of its exports together.
+func (s *Server) Export(path string, machineMAC string) (Export, error) {
+	name, err := newName()
+	if err != nil {
+		return Export{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.files[path]
+	if !ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return Export{}, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return Export{}, err
+		}
+
+		b = &backing{path: path, file: f, size: info.Size()}
+		s.files[path] = b
+		openFiles.Add(1)
+	}
+
+	b.refs++
+	e := &Export{Name: name, Path: path, Size: b.size, MachineMAC: machineMAC, CreatedAt: time.Now(), backing: b}
+	s.exports[name] = e
+	activeExports.Add(1)
+
+	return *e, nil
+}
+
+// claim hands the export to the connection asking for it, an export is only ever claimed once
+func (s *Server) claim(name string, conn net.Conn) (*Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.exports[name]
+	if !ok || e.claimed {
+		return nil, ErrUnknownExport
+	}
+
+	e.claimed = true
+	e.conn = conn
+	return e, nil
+}
+
+// lookup finds an export which has not been claimed yet, without claiming it
+func (s *Server) lookup(name string) (*Export, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.exports[name]
+	if !ok || e.claimed {
+		return nil, ErrUnknownExport
+	}
+
+	return e, nil
+}
+
+// remove drops an export, closing its connection and its file when no other export uses it. The lock is held.
+func (s *Server) remove(e *Export) {
+	if _, ok := s.exports[e.Name]; !ok {
+		return
+	}
+
+	delete(s.exports, e.Name)
+	activeExports.Add(-1)
+	if e.conn != nil {
+		e.conn.Close()
+	}
+
+	e.backing.refs--
+	if e.backing.refs == 0 {
+		if err := e.backing.file.Close(); err != nil {
+			log.Warnf("Cannot close %s: %v", e.backing.path, err)
+		}
+		delete(s.files, e.backing.path)
+		openFiles.Add(-1)
+	}
+}
+
+// Remove drops an export and disconnects its client
+func (s *Server) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.exports[name]; ok {
+		s.remove(e)
+	}
+}
+
+// RemoveMachine drops the exports of a machine, which ended the boot they were made for
+func (s *Server) RemoveMachine(mac string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, e := range s.exports {
+		if e.MachineMAC == mac {
+			s.remove(e)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Expire drops the exports which nobody connected to within the idle time
+func (s *Server) Expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, e := range s.exports {
+		if !e.claimed && now.Sub(e.CreatedAt) >= s.idle {
+			s.remove(e)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Exports lists the current exports
+func (s *Server) Exports() []Export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Export, 0, len(s.exports))
+	for _, e := range s.exports {
+		list = append(list, *e)
+	}
+
+	return list
+}
+
+// Serve accepts the connections of clients until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// ListenAndServe serves the exports on a TCP address and drops the exports nobody connects to in the background
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(expiryInterval)
+			if removed := s.Expire(time.Now()); removed != 0 {
+				log.Infof("Removed %d NBD exports nobody connected to", removed)
+			}
+		}
+	}()
+
+	return s.Serve(l)
+}
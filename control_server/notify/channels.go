@@ -0,0 +1,328 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventTest is the event of the messages sent to check that a channel is configured correctly
+const EventTest = "test"
+
+// channelTimeout is how long a channel may take to accept a message
+const channelTimeout = 10 * time.Second
+
+// defaultTemplates format the messages of the channels which have no Template of their own
+var defaultTemplates = map[string]string{
+	config.NotifySMTP:    "{{.Body}}",
+	config.NotifyWebhook: "{{.Subject}}\n{{.Body}}",
+	config.NotifyMatrix:  "{{.Subject}}\n{{.Body}}",
+}
+
+var (
+	notificationsSent = metrics.NewCounter("baas_notifications_total",
+		"Notifications sent to the channels of the operators, by channel and whether they arrived.", "channel",
+		"result")
+	notificationsLimited = metrics.NewCounter("baas_notifications_limited_total",
+		"Notifications which were dropped by the rate limit of their route, by event.", "event")
+)
+
+// ErrUnknownChannel is returned for channels which are not in NotifyChannels
+var ErrUnknownChannel = errors.New("unknown notification channel")
+
+// Message is a notification for the operators
+type Message struct {
+	// Event is one of config.NotifyEvents, or EventTest
+	Event string
+	// Key is what the message is about, such as the mac address of a machine. Rate limits count the messages of
+	// each key apart.
+	Key     string
+	Subject string
+	Body    string
+}
+
+// Channel sends messages to the operators
+type Channel interface {
+	Send(m Message) error
+}
+
+// newChannel creates the channel the configuration describes
+func newChannel(conf *config.Config, name string, channel config.NotifyChannel) (Channel, error) {
+	text := channel.Template
+	if text == "" {
+		text = defaultTemplates[channel.Kind]
+	}
+
+	format, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "template of %s", name)
+	}
+
+	client := &http.Client{Timeout: channelTimeout}
+	switch channel.Kind {
+	case config.NotifySMTP:
+		return &mailChannel{smtp: &SMTP{address: conf.SMTPAddress, from: conf.SMTPFrom, username: conf.SMTPUsername,
+			password: conf.SMTPPassword}, to: channel.To, format: format}, nil
+	case config.NotifyWebhook:
+		return &webhookChannel{url: channel.URL, client: client, format: format}, nil
+	case config.NotifyMatrix:
+		return &matrixChannel{homeserver: strings.TrimSuffix(channel.URL, "/"), room: channel.Room,
+			token: channel.Token, client: client, format: format}, nil
+	default:
+		return nil, errors.Errorf("%s has the unknown kind %q", name, channel.Kind)
+	}
+}
+
+// render formats a message with the template of a channel
+func render(format *template.Template, m Message) (string, error) {
+	var text strings.Builder
+	if err := format.Execute(&text, m); err != nil {
+		return "", errors.Wrap(err, "format the message")
+	}
+
+	return text.String(), nil
+}
+
+// mailChannel mails the messages to a fixed list of addresses
+type mailChannel struct {
+	smtp   *SMTP
+	to     []string
+	format *template.Template
+}
+
+// Send mails the message
+func (c *mailChannel) Send(m Message) error {
+	body, err := render(c.format, m)
+	if err != nil {
+		return err
+	}
+
+	return c.smtp.send(c.to, m.Subject, body)
+}
+
+// webhookChannel posts the messages to an incoming webhook of Slack, or of anything which speaks its protocol
+type webhookChannel struct {
+	url    string
+	client *http.Client
+	format *template.Template
+}
+
+// Send posts the message
+func (c *webhookChannel) Send(m Message) error {
+	text, err := render(c.format, m)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "create the request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return deliver(c.client, req)
+}
+
+// matrixTransaction numbers the messages sent to Matrix, the homeserver drops a message with a transaction ID it
+// has seen before
+var matrixTransaction uint64
+
+// matrixChannel sends the messages to a Matrix room through the client-server API
+type matrixChannel struct {
+	homeserver string
+	room       string
+	token      string
+	client     *http.Client
+	format     *template.Template
+}
+
+// Send sends the message to the room
+func (c *matrixChannel) Send(m Message) error {
+	text, err := render(c.format, m)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": text})
+	if err != nil {
+		return err
+	}
+
+	transaction := fmt.Sprintf("baas-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&matrixTransaction, 1))
+	uri := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", c.homeserver,
+		url.PathEscape(c.room), transaction)
+	req, err := http.NewRequest(http.MethodPut, uri, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "create the request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	return deliver(c.client, req)
+}
+
+// deliver sends a request to a chat service, which has to accept it with a 2xx status
+func deliver(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "send the message")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("the message was refused with %s: %s", resp.Status, strings.TrimSpace(string(reason)))
+	}
+
+	return nil
+}
+
+// route sends some events to some channels, within its rate limit
+type route struct {
+	events   map[string]bool
+	channels []string
+	limit    int
+	window   time.Duration
+	// sent holds the times the messages of every key were sent within the window
+	sent map[string][]time.Time
+}
+
+// allow tells whether another message about key fits in the rate limit, and counts it when it does
+func (r *route) allow(key string, now time.Time) bool {
+	if r.limit == 0 {
+		return true
+	}
+
+	// Forget the messages which left the window, of every key so machines which went quiet do not pile up
+	since := now.Add(-r.window)
+	for k, times := range r.sent {
+		kept := times[:0]
+		for _, t := range times {
+			if t.After(since) {
+				kept = append(kept, t)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(r.sent, k)
+		} else {
+			r.sent[k] = kept
+		}
+	}
+
+	if len(r.sent[key]) >= r.limit {
+		return false
+	}
+
+	r.sent[key] = append(r.sent[key], now)
+	return true
+}
+
+// Router sends the events of the control server to the channels NotifyRoutes send them to
+type Router struct {
+	channels map[string]Channel
+	routes   []*route
+	// lock keeps the rate limits of messages published at the same time apart
+	lock sync.Mutex
+}
+
+// NewRouter creates the channels and routes of the configuration, without any it drops every message
+func NewRouter(conf *config.Config) (*Router, error) {
+	router := &Router{channels: map[string]Channel{}}
+	for name, channel := range conf.NotifyChannels {
+		created, err := newChannel(conf, name, channel)
+		if err != nil {
+			return nil, err
+		}
+		router.channels[name] = created
+	}
+
+	for _, r := range conf.NotifyRoutes {
+		events := map[string]bool{}
+		for _, event := range r.Events {
+			events[event] = true
+		}
+
+		router.routes = append(router.routes, &route{events: events, channels: r.Channels, limit: int(r.RateLimit),
+			window: time.Duration(r.RateLimitMinutes) * time.Minute, sent: map[string][]time.Time{}})
+	}
+
+	return router, nil
+}
+
+// Publish sends the message to the channels of every route of its event which has room for it. A channel which
+// several routes send the event to gets it once. Channels which fail are logged.
+func (r *Router) Publish(m Message) {
+	now := time.Now()
+	targets := map[string]Channel{}
+
+	r.lock.Lock()
+	for _, route := range r.routes {
+		if !route.events[m.Event] {
+			continue
+		}
+
+		if !route.allow(m.Key, now) {
+			notificationsLimited.Inc(m.Event)
+			log.Debugf("Not sending %s about %s, the rate limit of its route was reached", m.Event, m.Key)
+			continue
+		}
+
+		for _, name := range route.channels {
+			targets[name] = r.channels[name]
+		}
+	}
+	r.lock.Unlock()
+
+	for name, channel := range targets {
+		if err := send(name, channel, m); err != nil {
+			log.Errorf("Cannot send %s about %s to %s: %v", m.Event, m.Key, name, err)
+		}
+	}
+}
+
+// Test sends a message to a channel to check its configuration, regardless of the routes
+func (r *Router) Test(name string) error {
+	channel, ok := r.channels[name]
+	if !ok {
+		return ErrUnknownChannel
+	}
+
+	return send(name, channel, Message{Event: EventTest, Key: name, Subject: "Test notification from BAAS",
+		Body: fmt.Sprintf("The channel %s of the BAAS control server works.", name)})
+}
+
+// send sends a message to one channel and counts how that went
+func send(name string, channel Channel, m Message) error {
+	err := channel.Send(m)
+	result := "sent"
+	if err != nil {
+		result = "failed"
+	}
+
+	notificationsSent.Inc(name, result)
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package notify tells users about things which happen to them while they are not looking, such as a course expiring,
+// and the operators about the events of the control server they want to hear about
+package notify
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/baas-project/baas/control_server/config"
+	"github.com/baas-project/baas/pkg/model/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// Notifier sends a message to a user
+type Notifier interface {
+	Notify(to *user.UserModel, subject string, body string) error
+}
+
+// New sends notifications by mail when SMTPAddress is configured and only logs them otherwise
+func New(conf *config.Config) Notifier {
+	if conf.SMTPAddress == "" {
+		return Log{}
+	}
+
+	return &SMTP{address: conf.SMTPAddress, from: conf.SMTPFrom, username: conf.SMTPUsername,
+		password: conf.SMTPPassword}
+}
+
+// Log writes the notifications to the log, for servers which cannot send mail
+type Log struct{}
+
+// Notify logs the message
+func (Log) Notify(to *user.UserModel, subject string, body string) error {
+	log.WithFields(log.Fields{"username": to.Username, "subject": subject}).Info(body)
+	return nil
+}
+
+// SMTP mails the notifications to the email address of the user
+type SMTP struct {
+	address  string
+	from     string
+	username string
+	password string
+}
+
+// Notify mails the message
+func (s *SMTP) Notify(to *user.UserModel, subject string, body string) error {
+	if to.Email == "" {
+		return fmt.Errorf("%s has no email address", to.Username)
+	}
+
+	return s.send([]string{to.Email}, subject, body)
+}
+
+// send mails the message to every address
+func (s *SMTP) send(to []string, subject string, body string) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.address)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+
+	// Line breaks in the subject would add headers of their own
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", s.from, strings.Join(to, ", "),
+		subject, body)
+	return smtp.SendMail(s.address, auth, s.from, to, []byte(message))
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftpserver
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// arpTable is where Linux lists the hardware addresses of its neighbours
+const arpTable = "/proc/net/arp"
+
+// lookupMAC finds the mac address belonging to an IP address in the ARP table, the client has just sent us a
+// packet so it is usually there. It returns an empty string when it is not.
+func lookupMAC(ip string) string {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// IP address  HW type  Flags  HW address  Mask  Device
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[0] == ip && fields[3] != "00:00:00:00:00:00" {
+			return fields[3]
+		}
+	}
+
+	return ""
+}
+
+// describeClient names the client in the logs by its address and, when it is known, its mac address
+func describeClient(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	if mac := lookupMAC(host); mac != "" {
+		return addr.String() + " (" + mac + ")"
+	}
+
+	return addr.String()
+}
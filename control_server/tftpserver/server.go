@@ -0,0 +1,385 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tftpserver is a read-only TFTP server (RFC 1350) for machines whose firmware can only fetch their
+// first-stage loader over TFTP. It serves the same directory as the /static/ route of the control server and
+// supports the blksize, tsize and timeout options (RFC 2347, 2348 and 2349), so large files such as the initramfs
+// do not need hundreds of thousands of round trips.
+package tftpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	opRRQ   uint16 = 1
+	opWRQ   uint16 = 2
+	opDATA  uint16 = 3
+	opACK   uint16 = 4
+	opERROR uint16 = 5
+	opOACK  uint16 = 6
+)
+
+// Error codes of RFC 1350 and RFC 2347
+const (
+	errNotDefined       uint16 = 0
+	errFileNotFound     uint16 = 1
+	errAccessViolation  uint16 = 2
+	errIllegalOperation uint16 = 4
+	errUnknownTransfer  uint16 = 5
+	errOptionRefused    uint16 = 8
+)
+
+const (
+	defaultBlockSize = 512
+	// maxBlockSize is the largest block which fits in a UDP datagram, as given by RFC 2348
+	maxBlockSize = 65464
+	minBlockSize = 8
+	// maxPacketSize fits the largest data packet including its header
+	maxPacketSize = maxBlockSize + 4
+)
+
+// Server serves the files in Root to TFTP clients
+type Server struct {
+	Root string
+	// Timeout is how long to wait for an acknowledgement before sending a packet again, clients can ask for
+	// another timeout with the timeout option.
+	Timeout time.Duration
+	// Retries is how often a packet is sent again before the transfer is abandoned
+	Retries int
+}
+
+// ListenAndServe serves the files in root on the UDP address
+func ListenAndServe(address string, root string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Serving %s over TFTP on %s", root, conn.LocalAddr())
+	server := Server{Root: root, Timeout: 2 * time.Second, Retries: 5}
+	return server.Serve(conn)
+}
+
+// Serve answers the requests arriving on conn, every transfer gets a connection of its own as the protocol requires.
+func (s *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go s.handle(packet, addr, conn.LocalAddr())
+	}
+}
+
+// request is a parsed read or write request
+type request struct {
+	opcode   uint16
+	filename string
+	mode     string
+	options  map[string]string
+	// order is the order in which the client gave the options, the acknowledgement follows it
+	order []string
+}
+
+func parseRequest(packet []byte) (*request, error) {
+	if len(packet) < 2 {
+		return nil, errors.New("packet too short")
+	}
+
+	req := request{opcode: binary.BigEndian.Uint16(packet), options: map[string]string{}}
+	if req.opcode != opRRQ && req.opcode != opWRQ {
+		return &req, fmt.Errorf("unexpected opcode %d", req.opcode)
+	}
+
+	fields := bytes.Split(packet[2:], []byte{0})
+	// The request ends with a zero byte, which leaves an empty field after splitting
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return &req, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+
+	req.filename, req.mode = string(fields[0]), strings.ToLower(string(fields[1]))
+	for i := 2; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		req.options[name] = string(fields[i+1])
+		req.order = append(req.order, name)
+	}
+
+	return &req, nil
+}
+
+// resolve turns the requested filename into a path inside the root, it refuses anything outside of it
+func (s *Server) resolve(filename string) (string, error) {
+	// Some firmware uses backslashes as separators
+	name := strings.ReplaceAll(filename, "\\", "/")
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("path traversal")
+		}
+	}
+
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+name)))
+	if err != nil {
+		return "", err
+	}
+
+	// Symbolic links could still lead out of the root
+	if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", errors.New("path traversal")
+	}
+
+	return path, nil
+}
+
+// transfer is a single file being sent to a client
+type transfer struct {
+	conn      net.PacketConn
+	addr      net.Addr
+	blockSize int
+	timeout   time.Duration
+	retries   int
+}
+
+func (s *Server) handle(packet []byte, addr net.Addr, local net.Addr) {
+	// The transfer has a port of its own on the same address, the port identifies the transfer
+	host, _, err := net.SplitHostPort(local.String())
+	if err != nil {
+		log.Errorf("TFTP: invalid local address %s: %v", local, err)
+		return
+	}
+
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Errorf("TFTP: cannot open a connection for %s: %v", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	t := transfer{conn: conn, addr: addr, blockSize: defaultBlockSize, timeout: s.Timeout, retries: s.Retries}
+	client := describeClient(addr)
+
+	req, err := parseRequest(packet)
+	if err != nil {
+		log.Warnf("TFTP: invalid request from %s: %v", client, err)
+		t.sendError(errIllegalOperation, err.Error())
+		return
+	}
+
+	if req.opcode == opWRQ {
+		log.Warnf("TFTP: refused write of %s by %s", req.filename, client)
+		t.sendError(errAccessViolation, "this server is read-only")
+		return
+	}
+
+	if req.mode != "octet" && req.mode != "netascii" {
+		t.sendError(errIllegalOperation, "unsupported mode "+req.mode)
+		return
+	}
+
+	path, err := s.resolve(req.filename)
+	if err != nil {
+		log.Warnf("TFTP: %s requested %s: %v", client, req.filename, err)
+		t.sendError(errFileNotFound, "file not found")
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Warnf("TFTP: %s requested %s: %v", client, req.filename, err)
+		t.sendError(errFileNotFound, "file not found")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		t.sendError(errFileNotFound, "file not found")
+		return
+	}
+
+	log.Infof("TFTP: sending %s to %s", req.filename, client)
+	start := time.Now()
+
+	accepted, err := t.negotiate(req, info.Size())
+	if err != nil {
+		log.Warnf("TFTP: invalid options from %s for %s: %v", client, req.filename, err)
+		return
+	}
+
+	// Without any options the transfer starts right away, otherwise the client acknowledges the options first
+	if len(accepted) != 0 {
+		if err = t.exchange(optionAck(accepted, req.order), 0); err != nil {
+			log.Warnf("TFTP: transfer of %s to %s failed: %v", req.filename, client, err)
+			return
+		}
+	}
+
+	if err = t.send(file); err != nil {
+		log.Warnf("TFTP: transfer of %s to %s failed: %v", req.filename, client, err)
+		return
+	}
+
+	log.Infof("TFTP: sent %s (%d bytes, block size %d) to %s in %s", req.filename, info.Size(), t.blockSize, client,
+		time.Since(start).Round(time.Millisecond))
+}
+
+// negotiate applies the options the server supports and returns the values it accepted
+func (t *transfer) negotiate(req *request, size int64) (map[string]string, error) {
+	accepted := map[string]string{}
+
+	if value, ok := req.options["blksize"]; ok {
+		blockSize, err := strconv.Atoi(value)
+		if err != nil || blockSize < minBlockSize {
+			t.sendError(errOptionRefused, "invalid blksize")
+			return nil, fmt.Errorf("invalid blksize %q", value)
+		}
+
+		if blockSize > maxBlockSize {
+			blockSize = maxBlockSize
+		}
+
+		t.blockSize = blockSize
+		accepted["blksize"] = strconv.Itoa(blockSize)
+	}
+
+	if value, ok := req.options["timeout"]; ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 1 && seconds <= 255 {
+			t.timeout = time.Duration(seconds) * time.Second
+			accepted["timeout"] = value
+		}
+	}
+
+	// Clients ask for the size of the file by sending a tsize of 0
+	if _, ok := req.options["tsize"]; ok {
+		accepted["tsize"] = strconv.FormatInt(size, 10)
+	}
+
+	return accepted, nil
+}
+
+func optionAck(accepted map[string]string, order []string) []byte {
+	packet := []byte{0, byte(opOACK)}
+	for _, name := range order {
+		if value, ok := accepted[name]; ok {
+			packet = append(packet, name...)
+			packet = append(packet, 0)
+			packet = append(packet, value...)
+			packet = append(packet, 0)
+		}
+	}
+
+	return packet
+}
+
+// send sends the file block by block, the block numbers wrap around for files of more than 65535 blocks
+func (t *transfer) send(file io.Reader) error {
+	data := make([]byte, t.blockSize)
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(file, data)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.sendError(errNotDefined, "cannot read the file")
+			return err
+		}
+
+		packet := make([]byte, 4+n)
+		binary.BigEndian.PutUint16(packet, opDATA)
+		binary.BigEndian.PutUint16(packet[2:], block)
+		copy(packet[4:], data[:n])
+
+		if err = t.exchange(packet, block); err != nil {
+			return err
+		}
+
+		// A block shorter than the block size ends the transfer
+		if n < t.blockSize {
+			return nil
+		}
+	}
+}
+
+// exchange sends the packet until the client acknowledges the block
+func (t *transfer) exchange(packet []byte, block uint16) error {
+	buf := make([]byte, maxPacketSize)
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if _, err := t.conn.WriteTo(packet, t.addr); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(t.timeout)
+		for {
+			if err := t.conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+
+			n, addr, err := t.conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+
+				return err
+			}
+
+			// Packets from anyone else than the client are answered without disturbing the transfer
+			if addr.String() != t.addr.String() {
+				_, _ = t.conn.WriteTo(errorPacket(errUnknownTransfer, "unknown transfer ID"), addr)
+				continue
+			}
+
+			if n < 4 {
+				continue
+			}
+
+			switch binary.BigEndian.Uint16(buf) {
+			case opACK:
+				// Duplicate acknowledgements of earlier blocks are ignored
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+			case opERROR:
+				return fmt.Errorf("client error %d: %s", binary.BigEndian.Uint16(buf[2:]),
+					strings.TrimRight(string(buf[4:n]), "\x00"))
+			}
+		}
+	}
+
+	return errors.New("timed out waiting for an acknowledgement")
+}
+
+func errorPacket(code uint16, message string) []byte {
+	packet := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(packet, opERROR)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, message...)
+	return append(packet, 0)
+}
+
+func (t *transfer) sendError(code uint16, message string) {
+	if _, err := t.conn.WriteTo(errorPacket(code, message), t.addr); err != nil {
+		log.Debugf("TFTP: cannot send error to %s: %v", t.addr, err)
+	}
+}
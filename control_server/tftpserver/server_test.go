@@ -0,0 +1,122 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tftpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client is a minimal TFTP client which reads a file
+type client struct {
+	t      *testing.T
+	conn   net.PacketConn
+	server net.Addr
+}
+
+func (c *client) request(opcode uint16, fields ...string) {
+	packet := []byte{0, byte(opcode)}
+	for _, field := range fields {
+		packet = append(append(packet, field...), 0)
+	}
+
+	_, err := c.conn.WriteTo(packet, c.server)
+	assert.NoError(c.t, err)
+}
+
+func (c *client) receive() ([]byte, net.Addr) {
+	buf := make([]byte, maxPacketSize)
+	assert.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, addr, err := c.conn.ReadFrom(buf)
+	if !assert.NoError(c.t, err) {
+		c.t.FailNow()
+	}
+
+	return buf[:n], addr
+}
+
+func (c *client) ack(block uint16, to net.Addr) {
+	packet := make([]byte, 4)
+	binary.BigEndian.PutUint16(packet, opACK)
+	binary.BigEndian.PutUint16(packet[2:], block)
+	_, err := c.conn.WriteTo(packet, to)
+	assert.NoError(c.t, err)
+}
+
+func TestServer(t *testing.T) {
+	base, err := ioutil.TempDir("", "tftp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(base)
+
+	root := filepath.Join(base, "static")
+	assert.NoError(t, os.Mkdir(root, os.ModePerm))
+	content := bytes.Repeat([]byte("initramfs"), 500)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "initramfs"), content, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(base, "secret"), []byte("secret"), 0644))
+	assert.NoError(t, os.Symlink(filepath.Join(base, "secret"), filepath.Join(root, "link")))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	server := Server{Root: root, Timeout: 200 * time.Millisecond, Retries: 2}
+	go func() { _ = server.Serve(conn) }()
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer clientConn.Close()
+	c := &client{t: t, conn: clientConn, server: conn.LocalAddr()}
+
+	// Files are sent in blocks of the negotiated size, the options are acknowledged first
+	c.request(opRRQ, "/initramfs", "octet", "tsize", "0", "blksize", "1024")
+
+	packet, transfer := c.receive()
+	assert.Equal(t, opOACK, binary.BigEndian.Uint16(packet))
+	assert.Equal(t, "tsize\x004500\x00blksize\x001024\x00", string(packet[2:]))
+	c.ack(0, transfer)
+
+	var received []byte
+	for block := uint16(1); ; block++ {
+		packet, _ = c.receive()
+		assert.Equal(t, opDATA, binary.BigEndian.Uint16(packet))
+		assert.Equal(t, block, binary.BigEndian.Uint16(packet[2:]))
+		received = append(received, packet[4:]...)
+		c.ack(block, transfer)
+
+		if len(packet)-4 < 1024 {
+			break
+		}
+	}
+	assert.Equal(t, content, received)
+
+	// Nothing outside of the root is served, neither through .. nor through symbolic links
+	for _, name := range []string{"../secret", "..\\secret", "link", "missing"} {
+		c.request(opRRQ, name, "octet")
+		packet, _ = c.receive()
+		assert.Equal(t, opERROR, binary.BigEndian.Uint16(packet))
+		assert.Equal(t, errFileNotFound, binary.BigEndian.Uint16(packet[2:]))
+	}
+
+	c.request(opWRQ, "initramfs", "octet")
+	packet, _ = c.receive()
+	assert.Equal(t, opERROR, binary.BigEndian.Uint16(packet))
+	assert.Equal(t, errAccessViolation, binary.BigEndian.Uint16(packet[2:]))
+
+	// Unacknowledged blocks are sent again
+	c.request(opRRQ, "initramfs", "octet")
+	first, _ := c.receive()
+	again, _ := c.receive()
+	assert.Equal(t, first, again)
+	assert.True(t, strings.HasPrefix(string(first[4:]), "initramfs"))
+}
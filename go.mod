@@ -6,8 +6,10 @@ require (
 	github.com/codingsince1985/checksum v1.2.4
 	github.com/diskfs/go-diskfs v1.2.0
 	github.com/frankban/quicktest v1.14.1 // indirect
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.7.4
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/klauspost/pgzip v1.2.5
@@ -18,7 +20,9 @@ require (
 	github.com/stretchr/testify v1.7.1-0.20210427113832-6241f9ab9942
 	github.com/valyala/gozstd v1.8.3
 	go.universe.tf/netboot v0.0.0-20200920222120-66e5fba6f663
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
 	gorm.io/driver/sqlite v1.1.6
 	gorm.io/gorm v1.21.16
@@ -0,0 +1,159 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// framebufferDevice is the console the screenshot of a failed boot is taken of
+	framebufferDevice = "/dev/fb0"
+	// framebufferSysfs describes the layout of the framebuffer
+	framebufferSysfs = "/sys/class/graphics/fb0"
+	// serialLogFile receives everything the agent writes to the serial console
+	serialLogFile = "/var/log/baas.log"
+	// serialTailBytes is how much of the end of the serial log is sent along with a failed boot
+	serialTailBytes = 64 * 1024
+)
+
+// readSysfsInt reads a number from the sysfs directory of the framebuffer
+func readSysfsInt(name string) (int, error) {
+	content, err := ioutil.ReadFile(framebufferSysfs + "/" + name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// captureScreen takes a screenshot of the framebuffer console as a PNG image. Only the 32 and 16 bits per pixel
+// layouts the kernel consoles use are understood.
+func captureScreen() ([]byte, error) {
+	size, err := ioutil.ReadFile(framebufferSysfs + "/virtual_size")
+	if err != nil {
+		return nil, err
+	}
+
+	var width, height int
+	if _, err = fmt.Sscanf(strings.TrimSpace(string(size)), "%d,%d", &width, &height); err != nil {
+		return nil, errors.Wrap(err, "cannot read the size of the framebuffer")
+	}
+
+	bpp, err := readSysfsInt("bits_per_pixel")
+	if err != nil {
+		return nil, err
+	}
+
+	stride, err := readSysfsInt("stride")
+	if err != nil {
+		return nil, err
+	}
+
+	pixels, err := ioutil.ReadFile(framebufferDevice)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pixels) < stride*height {
+		return nil, errors.Errorf("the framebuffer holds %d bytes, expected %d", len(pixels), stride*height)
+	}
+
+	screen := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := pixels[y*stride:]
+		for x := 0; x < width; x++ {
+			switch bpp {
+			case 32:
+				// Stored as BGRX
+				screen.Set(x, y, color.RGBA{R: row[4*x+2], G: row[4*x+1], B: row[4*x], A: 0xff})
+			case 16:
+				// Stored as RGB565
+				p := uint16(row[2*x]) | uint16(row[2*x+1])<<8
+				screen.Set(x, y, color.RGBA{R: uint8(p>>11) << 3, G: uint8(p>>5) << 2, B: uint8(p) << 3, A: 0xff})
+			default:
+				return nil, errors.Errorf("cannot read a framebuffer with %d bits per pixel", bpp)
+			}
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err = png.Encode(&encoded, screen); err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
+
+// serialTail reads the end of the serial log, starting at a line
+func serialTail() ([]byte, error) {
+	f, err := os.Open(serialLogFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := info.Size() - serialTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+
+	tail := make([]byte, info.Size()-offset)
+	if _, err = f.ReadAt(tail, offset); err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+
+	return tail, nil
+}
+
+// attachFailureArtifacts sends what was on the screen and the serial console along with a failed boot, so whoever
+// looks at its history sees what went wrong. Either is left out when it cannot be captured.
+func attachFailureArtifacts(c *client.Client, mac string, bootID uint) {
+	var artifacts []client.Artifact
+
+	if screen, err := captureScreen(); err != nil {
+		log.Warnf("Cannot take a screenshot of the console: %v", err)
+	} else {
+		artifacts = append(artifacts, client.Artifact{Name: "screen.png", ContentType: "image/png", Content: screen})
+	}
+
+	if tail, err := serialTail(); err != nil {
+		log.Warnf("Cannot read the serial log: %v", err)
+	} else {
+		artifacts = append(artifacts, client.Artifact{Name: "serial.log", ContentType: "text/plain; charset=utf-8",
+			Content: tail})
+	}
+
+	if len(artifacts) == 0 {
+		return
+	}
+
+	if err := c.UploadBootArtifacts(mac, bootID, artifacts); err != nil {
+		log.Warnf("Cannot attach the artifacts to the failed boot: %v", err)
+	}
+}
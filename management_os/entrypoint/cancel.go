@@ -0,0 +1,45 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// errCancelled stops writing the images when the boot was cancelled on the control server
+var errCancelled = errors.New("the boot was cancelled")
+
+// cancellation is set by the heartbeats once the control server asks us to stop flashing
+type cancellation struct {
+	requested int32
+}
+
+// Request asks the images being written to stop
+func (c *cancellation) Request() {
+	atomic.StoreInt32(&c.requested, 1)
+}
+
+// Requested reports whether the boot was cancelled
+func (c *cancellation) Requested() bool {
+	return c != nil && atomic.LoadInt32(&c.requested) == 1
+}
+
+// cancelReader stops the copy to the disk between chunks once the boot is cancelled, the disk keeps whatever was
+// written until then
+type cancelReader struct {
+	r      io.Reader
+	cancel *cancellation
+}
+
+func (c *cancelReader) Read(b []byte) (int, error) {
+	if c.cancel.Requested() {
+		return 0, errCancelled
+	}
+
+	return c.r.Read(b)
+}
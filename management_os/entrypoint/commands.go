@@ -0,0 +1,121 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/model/machine"
+	log "github.com/sirupsen/logrus"
+)
+
+// diagnostic runs one of the diagnostics the control server can ask for, it writes what it found to out
+type diagnostic func(ctx context.Context, c *client.Client, mac string, out *cappedBuffer) (int, error)
+
+// diagnostics are what the names of the diagnostics run, nothing but these is run whatever the control server asks
+var diagnostics = map[string]diagnostic{
+	"lsblk": runDiagnostic("lsblk", "-o", "NAME,SIZE,TYPE,MODEL,SERIAL,MOUNTPOINT"),
+	"smartctl": func(ctx context.Context, c *client.Client, mac string, out *cappedBuffer) (int, error) {
+		return runDiagnostic("smartctl", "-a", targetDevice)(ctx, c, mac, out)
+	},
+	"dmesg":     runDiagnostic("dmesg", "--level=err,warn"),
+	"speedtest": speedTest,
+}
+
+// cappedBuffer keeps the first CommandOutputMaxBytes written to it and throws away the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := machine.CommandOutputMaxBytes - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// runDiagnostic runs a program with fixed arguments, a non-zero exit code is part of the result and no error
+func runDiagnostic(name string, args ...string) diagnostic {
+	return func(ctx context.Context, _ *client.Client, _ string, out *cappedBuffer) (int, error) {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		err := cmd.Run()
+		if exit, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+			return exit.ExitCode(), nil
+		}
+
+		return 0, err
+	}
+}
+
+// speedTest measures how fast this machine downloads from the control server
+func speedTest(ctx context.Context, c *client.Client, mac string, out *cappedBuffer) (int, error) {
+	n, took, err := c.SpeedTest(ctx, mac)
+	if err != nil {
+		return 0, err
+	}
+
+	_, _ = fmt.Fprintf(out, "Downloaded %d bytes in %s, %.1f Mbit/s\n", n, took.Round(time.Millisecond),
+		float64(n)*8/took.Seconds()/1e6)
+	return 0, nil
+}
+
+// runCommand runs a command of the control server within the timeout of its diagnostic
+func runCommand(c *client.Client, mac string, command *machine.MachineCommand) *machine.CommandResult {
+	known, ok := machine.FindDiagnostic(command.Diagnostic)
+	run, runnable := diagnostics[command.Diagnostic]
+	if !ok || !runnable {
+		return &machine.CommandResult{Error: fmt.Sprintf("this management OS cannot run %q", command.Diagnostic)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), known.Timeout())
+	defer cancel()
+
+	var out cappedBuffer
+	exitCode, err := run(ctx, c, mac, &out)
+	result := &machine.CommandResult{ExitCode: exitCode, Output: out.String(), Truncated: out.truncated}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.Error = fmt.Sprintf("the diagnostic did not finish within %s", known.Timeout())
+	case err != nil:
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// startCommands polls for the diagnostics the control server wants us to run at every heartbeat, for as long as
+// the management OS runs. They are run one at a time.
+func startCommands(c *client.Client, mac string) {
+	go func() {
+		for range time.Tick(heartbeatInterval) {
+			commands, err := c.ClaimCommands(mac)
+			if err != nil {
+				log.Warnf("Cannot fetch the commands: %v", err)
+				continue
+			}
+
+			for i := range commands {
+				command := &commands[i]
+				log.Infof("Running diagnostic %s requested by %s", command.Diagnostic, command.RequestedBy)
+				if err = c.SetCommandResult(mac, command.ID, runCommand(c, mac, command)); err != nil {
+					log.Warnf("Cannot report the result of %s: %v", command.Diagnostic, err)
+				}
+			}
+		}
+	}()
+}
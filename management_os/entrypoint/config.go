@@ -18,6 +18,16 @@ type Config struct {
 	UploadDisk        bool
 	RebootAfterFinish bool
 	SetNextBoot       bool
+	// AgentPublicKey is the base64 encoded Ed25519 key the releases of the agent are signed with, the agent does
+	// not update itself without it.
+	AgentPublicKey string
+	// PeerCacheDir keeps a copy of the downloaded images, which are served to other machines on PeerPort when the
+	// control server distributes the images between the machines. The images are not served when it is empty.
+	PeerCacheDir string
+	PeerPort     uint16
+	// TLSURL is where the control server serves its API over TLS, such as https://control_server:4443. The CA is
+	// pinned on the machine image the first time, without it everything goes over plain HTTP.
+	TLSURL string
 }
 
 var conf *Config
@@ -0,0 +1,104 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// connectExport connects an NBD export of the control server to a device, read-only
+func connectExport(export *images.NBDExport, device string) error {
+	u, err := url.Parse(export.URL)
+	if err != nil || u.Scheme != "nbd" {
+		return errors.Errorf("invalid NBD URL %q", export.URL)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return errors.Wrapf(err, "invalid NBD URL %q", export.URL)
+	}
+
+	_, err = run("nbd-client", "-N", export.Token, "--readonly", host, port, device)
+	return err
+}
+
+// activateOverlay puts the snapshot of an overlay on top of its origin. A zeroed store is set up by the kernel the
+// first time it is activated, so it does not need to be initialised.
+func activateOverlay(machine *MachineImage, o *overlay) error {
+	loop, err := run("losetup", "--find", "--show", machine.target+"/"+o.Store)
+	if err != nil {
+		return err
+	}
+
+	_, err = run("dmsetup", "create", o.Name, "--table", o.Table(loop))
+	return err
+}
+
+// prepareDiskless connects the images of a diskless boot from the control server rather than flashing them, and
+// puts a snapshot on top of each so the booted images can write to them. The snapshots are /dev/mapper/baas-<uuid>
+// and are listed in overlays.json as those of an overlay boot are.
+func prepareDiskless(machine *MachineImage, setup *images.ImageSetup) error {
+	if err := machine.MkdirAll(overlayDir, 0700); err != nil {
+		return errors.Wrap(err, "couldn't create the overlay directory")
+	}
+
+	// The module may be built in, in which case there is nothing to load
+	if _, err := run("modprobe", "nbd"); err != nil {
+		log.Debugf("Cannot load the nbd module: %v", err)
+	}
+
+	var overlays []overlay
+	for i, frozen := range setup.Images {
+		if frozen.Export == nil {
+			continue
+		}
+
+		uuid := string(frozen.Image.UUID)
+		o := overlay{
+			Name:    "baas-" + uuid,
+			Origin:  fmt.Sprintf("/dev/nbd%d", i),
+			Store:   overlayDir + "/" + uuid + ".cow",
+			Sectors: uint64(frozen.Export.Size) / 512,
+		}
+
+		if err := connectExport(frozen.Export, o.Origin); err != nil {
+			return errors.Wrapf(err, "couldn't connect image %s", uuid)
+		}
+
+		if err := createStore(machine, &o); err != nil {
+			return errors.Wrapf(err, "couldn't create the overlay of %s", uuid)
+		}
+
+		if err := activateOverlay(machine, &o); err != nil {
+			return errors.Wrapf(err, "couldn't activate the overlay of %s", uuid)
+		}
+
+		log.Infof("Image %s is read from the control server through %s", uuid, o.Origin)
+		overlays = append(overlays, o)
+	}
+
+	return writeOverlayList(machine, overlays)
+}
+
+// setupDiskless connects the images of a diskless boot, the machine partition holds their overlays
+func setupDiskless(setup *images.ImageSetup) error {
+	var machine MachineImage
+	machine.Initialise("/dev/sda1", "/mnt/machine")
+	machine.Mount()
+
+	// The stores stay in use by the snapshots, so the machine partition cannot be unmounted
+	err := prepareDiskless(&machine, setup)
+	if err != nil {
+		machine.Unmount()
+	}
+
+	return err
+}
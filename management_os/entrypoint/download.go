@@ -5,34 +5,103 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 
+	"github.com/baas-project/baas/pkg/client"
 	"github.com/baas-project/baas/pkg/compression"
 	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
 	"github.com/baas-project/baas/pkg/util"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func setupDisk(api *APIClient, mac string, image *images.ImageModel, version uint64) error {
-	log.Debugf("writing disk: %v", mac)
+// setupDisk flashes an image, downloading it from the machine the control server sent us to if there is one. When
+// that machine cannot be reached or its image does not match the checksum, it is downloaded from the control server.
+// The disk is where images of a set go, it is nil for images written to their partition. Encrypted images are written
+// with the passphrase of the boot, it is empty for the others. The image is read back into verification when it is
+// given.
+func setupDisk(api *client.Client, frozen *images.ImageFrozen, peers *peerServer, disk *machine.DiskModel,
+	passphrase string, verification *images.FlashVerification, cancel *cancellation) error {
+	if frozen.Peer != nil {
+		err := writeImage(api, frozen, frozen.Peer, peers, disk, passphrase, verification, cancel)
+		if err == nil || errors.Cause(err) == errCancelled {
+			return err
+		}
+
+		log.Warnf("Cannot flash image %s from %s, downloading it from the control server: %v",
+			frozen.Image.UUID, frozen.Peer.MachineMAC, err)
+	}
+
+	return writeImage(api, frozen, nil, peers, disk, passphrase, verification, cancel)
+}
+
+// writeImage downloads an image from source, or from the control server if it is nil, and writes it to disk. It
+// stops halfway when the boot is cancelled.
+func writeImage(api *client.Client, frozen *images.ImageFrozen, source *images.PeerSource, peers *peerServer,
+	disk *machine.DiskModel, passphrase string, verification *images.FlashVerification, cancel *cancellation) error {
+	image := &frozen.Image
+	version := frozen.Version
+	log.Debugf("writing disk: %v", image.UUID)
+
+	held := images.PeerVersion{ImageUUID: image.UUID, Version: version.Version}
+	cached := ""
+	if peers != nil && version.SHA256 != "" {
+		cached = peers.path(held)
+	}
+
+	var reader io.ReadCloser
+	var reused bool
+	var err error
+	if source != nil {
+		reader, err = DownloadDiskPeer(source)
+	} else {
+		reader, reused, err = DownloadDisk(api, image, version.Version, cached)
+	}
 
-	reader, err := DownloadDisk(api, image, version)
 	if err != nil {
-		return errors.Wrap(err, "error downloading disk")
+		return failWith(images.FailureDownload, errors.Wrap(err, "error downloading disk"))
+	}
+
+	// The download is hashed to verify it, and kept when it can be served to other machines
+	hash := sha256.New()
+	writers := []io.Writer{hash}
+
+	var cache *cacheWriter
+	if cached != "" && !reused {
+		f, cerr := os.Create(peers.path(held))
+		if cerr != nil {
+			log.Warnf("Cannot keep image %s to serve it to other machines: %v", held, cerr)
+		} else {
+			defer func() {
+				if cerr := f.Close(); cerr != nil {
+					log.Warnf("Cannot close the cached image: %v", cerr)
+				}
+			}()
+
+			cache = &cacheWriter{f: f}
+			writers = append(writers, cache)
+		}
 	}
 
+	download := io.TeeReader(reader, io.MultiWriter(writers...))
+
 	// Kind of a dirty hack which I am not super proud of. However, GZip's reader has an extra close method that
 	// we need to deal with. This can only be done after writing everything, which means we need to keep the type
 	// somehow. Casting it upwards is not allowed, hence this is the only solution I could find. Maybe there
 	// is a neater way out there. Feel free to change this.
 	var dec io.Reader
 	if image.DiskCompressionStrategy == images.DiskCompressionStrategyGZip {
-		r, err2 := gzip.NewReader(reader)
+		r, err2 := gzip.NewReader(download)
 
 		if err2 != nil {
-			return errors.Wrap(err, "Opening GZip stream")
+			return failWith(images.FailureDownload, errors.Wrap(err2, "Opening GZip stream"))
 		}
 
 		defer func() {
@@ -45,15 +114,20 @@ func setupDisk(api *APIClient, mac string, image *images.ImageModel, version uin
 		// Cast down to common Reader
 		dec = r // nolint: ineffassign
 	} else {
-		dec, err = compression.Decompress(reader, image.DiskCompressionStrategy)
+		dec, err = compression.Decompress(download, image.DiskCompressionStrategy)
 		if err != nil {
-			return errors.Wrap(err, "error decompressing disk")
+			return failWith(images.FailureDownload, errors.Wrap(err, "error decompressing disk"))
 		}
 	}
 
-	err = WriteDisk(dec, image)
+	err = WriteDisk(&cancelReader{r: dec, cancel: cancel}, image, version.Size, disk, passphrase, verification)
 	if err != nil {
-		return errors.Wrap(err, "error writing disk")
+		return failWith(images.FailureWrite, errors.Wrap(err, "error writing disk"))
+	}
+
+	// The disk may be written before the end of the download, the rest is still part of the checksum
+	if _, err = io.Copy(ioutil.Discard, download); err != nil {
+		return failWith(images.FailureDownload, errors.Wrap(err, "error finishing the download"))
 	}
 
 	err = reader.Close()
@@ -62,31 +136,161 @@ func setupDisk(api *APIClient, mac string, image *images.ImageModel, version uin
 		return errors.Wrap(err, "couldn't close download body")
 	}
 
+	if version.SHA256 == "" {
+		return nil
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != version.SHA256 {
+		return failWith(images.FailureChecksum,
+			errors.Errorf("the checksum %s of the download does not match %s", sum, version.SHA256))
+	}
+
+	if cache != nil && cache.err != nil {
+		log.Warnf("Cannot keep image %s to serve it to other machines: %v", held, cache.err)
+	} else if cache != nil || reused {
+		peers.Add(held)
+	}
+
 	return nil
 }
 
-// WriteOutDisks Downloads, Decompresses and finally Writes a disk image to disk
-func WriteOutDisks(api *APIClient, mac string, setup *images.ImageSetup) error {
+// WriteOutDisks Downloads, Decompresses and finally Writes a disk image to disk. When peers is given the images are
+// served to other machines after they are written, which the control server is told about right away. The versions
+// which were written, and the disks of an image set, are added to the report. Once cancel is requested the images
+// which are left are not written.
+func WriteOutDisks(api *client.Client, mac string, setup *images.ImageSetup, peers *peerServer,
+	report *images.BootReport, cancel *cancellation) error {
 	log.Info("Downloading and writing disks")
 
-	for _, image := range setup.Images {
+	// The disks of a set are found before anything is written, writing a disk changes its partition table UUID
+	disks := make([]*machine.DiskModel, len(setup.Images))
+	if setup.MultiDisk() {
+		inventory := getInventory()
+		var devices []string
+		for i, frozen := range setup.Images {
+			disk, err := findDisk(inventory, frozen.TargetDevice)
+			if err != nil {
+				return errors.Wrapf(err, "cannot find the disk of image %s", frozen.UUIDImage)
+			}
+
+			disks[i] = disk
+			devices = append(devices, disk.Device)
+		}
+
+		report.TargetDevice = strings.Join(devices, ",")
+	}
+
+	for i := range setup.Images {
+		image := &setup.Images[i]
+		// Diskless boots read the image from the control server instead
+		if image.Export != nil {
+			continue
+		}
+
 		log.Warnf("Image UUID: %s", image.Image.UUID)
 		// Yes, you could inline this function but this screws with the defers mechanism that Go has.
 		// By using a separate method call we ensure that the file are closed whenever they are no longer
 		// needed rather than waiting for the entire cycle.
 		util.PrettyPrintStruct(image)
-		err := setupDisk(api, mac, &image.Image, image.Version.Version)
+		if cancel.Requested() {
+			return errCancelled
+		}
+
+		passphrase := ""
+		if setup.Encryption.Covers(image.Image.UUID) {
+			passphrase = setup.Encryption.Passphrase
+		}
+
+		// The machine image holds what the management OS keeps between boots, it is not read back
+		var verification *images.FlashVerification
+		if (setup.Verify == images.VerifyQuick || setup.Verify == images.VerifyFull) && image.Image.Type != "machine" {
+			verification = &images.FlashVerification{ImageUUID: image.Image.UUID, Version: image.Version.Version,
+				Mode: setup.Verify}
+		}
+
+		err := setupDisk(api, image, peers, disks[i], passphrase, verification, cancel)
 
 		if err != nil {
 			return errors.Wrap(err, "couldn't close download body")
 		}
+
+		report.Flashed = append(report.Flashed, images.ResolvedVersion{
+			ImageUUID: image.Image.UUID,
+			Version:   image.Version.Version,
+		})
+
+		// An image which was already on its partition was not written, so there is nothing to read back
+		if verification != nil && verification.Written != 0 {
+			report.Verification = append(report.Verification, *verification)
+			if !verification.Verified {
+				log.Warnf("Image %s does not read back as it was written: %d blocks differ, %s %s",
+					image.Image.UUID, len(verification.Mismatches), verification.PartitionTable, verification.Error)
+			}
+		}
+
+		if peers != nil {
+			control, err := api.BootHeartbeat(mac, peers.Heartbeat())
+			if err != nil {
+				log.Warnf("Cannot send heartbeat: %v", err)
+			} else if control != nil && control.CancelRequested {
+				cancel.Request()
+			}
+		}
 	}
 
 	return nil
 }
 
-// DownloadDisk downloads a disk from the network using the image's DiskTransferStrategy
-func DownloadDisk(api *APIClient, image *images.ImageModel, version uint64) (reader io.ReadCloser, _ error) {
+// DownloadDisk downloads a disk from the network using the image's DiskTransferStrategy. When the peer cache kept
+// the version from an earlier boot and the control server still stores the same file, the cached copy is read
+// instead, which reused tells.
+func DownloadDisk(api *client.Client, image *images.ImageModel, version uint64, cached string) (reader io.ReadCloser,
+	reused bool, _ error) {
 	log.Debugf("Downloading image: %s", image.UUID)
-	return api.DownloadDiskHTTP(image.UUID, version)
+	reader, err := api.DownloadDiskHTTP(image.UUID, version, cachedChecksum(api, image.UUID, version, cached))
+	if err != client.ErrNotModified {
+		return reader, false, err
+	}
+
+	log.Infof("The cached copy of image %s version %d is up to date, not downloading it", image.UUID, version)
+	f, err := os.Open(cached)
+	return f, true, err
+}
+
+// cachedChecksum is the checksum of the cached copy of a version, or empty when there is none. The size of the copy
+// is compared with what the control server stores first, so a stale copy is not read just to hash it.
+func cachedChecksum(api *client.Client, uuid images.ImageUUID, version uint64, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	stored, err := api.DescribeDiskHTTP(uuid, version)
+	if err != nil {
+		log.Warnf("Cannot check the cached copy of image %s: %v", uuid, err)
+		return ""
+	}
+
+	if stored.SHA256 == "" || stored.Size != info.Size() {
+		return ""
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Warnf("Cannot read the cached copy of image %s: %v", uuid, err)
+		return ""
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		log.Warnf("Cannot read the cached copy of image %s: %v", uuid, err)
+		return ""
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
 }
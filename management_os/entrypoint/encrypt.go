@@ -0,0 +1,102 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// luksHeaderSize is the space the LUKS2 header takes at the start of an encrypted device, the image gets the rest
+const luksHeaderSize = 16 * 1024 * 1024
+
+// runWithInput runs a command which reads input from its standard input, so passphrases stay out of the list of
+// processes
+func runWithInput(input string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// mapperName is the name the decrypted device of an image is opened under
+func mapperName(image images.ImageUUID) string {
+	return "baas-" + string(image)
+}
+
+// openEncrypted opens the LUKS container on a device and returns the decrypted device, together with the function
+// which closes it again. With format a new container is made first, which throws away what was on the device.
+func openEncrypted(device string, image images.ImageUUID, passphrase string, format bool) (string, func(), error) {
+	if format {
+		_, err := runWithInput(passphrase, "cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode",
+			"--key-file=-", device)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	name := mapperName(image)
+	if _, err := runWithInput(passphrase, "cryptsetup", "open", "--key-file=-", device, name); err != nil {
+		return "", nil, err
+	}
+
+	closer := func() {
+		if _, err := run("cryptsetup", "close", name); err != nil {
+			log.Warnf("Cannot close the encrypted device of image %s: %v", image, err)
+		}
+	}
+
+	return "/dev/mapper/" + name, closer, nil
+}
+
+// encryptedSize is what is left of a device for the image once the LUKS header is written to it
+func encryptedSize(available uint64) uint64 {
+	if available < luksHeaderSize {
+		return 0
+	}
+
+	return available - luksHeaderSize
+}
+
+// decryptedDisk is a decrypted device which is read from, closing it closes the device as well
+type decryptedDisk struct {
+	*os.File
+	closeDevice func()
+}
+
+func (d *decryptedDisk) Close() error {
+	err := d.File.Close()
+	d.closeDevice()
+	return err
+}
+
+// readEncryptedDisk opens the LUKS container on the partition of an image and returns the decrypted device, with
+// the size of the image inside it
+func readEncryptedDisk(image *images.ImageModel, passphrase string) (io.ReadCloser, uint64, error) {
+	partition := getPartition(image.UUID)
+	device, closeDevice, err := openEncrypted(partition.DeviceFile, image.UUID, passphrase, false)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "cannot decrypt %s", partition.DeviceFile)
+	}
+
+	file, err := os.Open(device)
+	if err != nil {
+		closeDevice()
+		return nil, 0, errors.Wrapf(err, "error opening path %s", device)
+	}
+
+	return &decryptedDisk{File: file, closeDevice: closeDevice}, encryptedSize(uint64(partition.Partition.GetSize())),
+		nil
+}
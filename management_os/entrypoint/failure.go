@@ -0,0 +1,57 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+)
+
+// bootFailure marks an error with the reason the control server counts the failed boot under
+type bootFailure struct {
+	reason images.FailureReason
+	err    error
+}
+
+func (f *bootFailure) Error() string {
+	return f.err.Error()
+}
+
+// Cause lets errors.Cause look through the failure, for instance to find errCancelled
+func (f *bootFailure) Cause() error {
+	return f.err
+}
+
+// failWith marks err with the reason of the failure, a nil error stays nil
+func failWith(reason images.FailureReason, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &bootFailure{reason: reason, err: err}
+}
+
+// failureReason finds why a boot failed. When the error was marked more than once the mark closest to the cause
+// wins, a disk which is too small is also an error writing the disk.
+func failureReason(err error) images.FailureReason {
+	if errors.Cause(err) == errCancelled {
+		return images.FailureCancelled
+	}
+
+	reason := images.FailureUnknown
+	for err != nil {
+		if failure, ok := err.(*bootFailure); ok {
+			reason = failure.reason
+		}
+
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+
+	return reason
+}
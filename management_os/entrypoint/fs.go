@@ -5,11 +5,13 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"syscall"
 
 	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
 
 	"github.com/codingsince1985/checksum"
 
@@ -19,43 +21,129 @@ import (
 	"github.com/baas-project/baas/pkg/fs"
 )
 
-// ReadDisk reads a disk from a file and returns a stream
-func ReadDisk(image *images.ImageModel) (io.ReadCloser, error) {
+// ReadDisk reads a disk from a file and returns a stream together with the size of the partition
+func ReadDisk(image *images.ImageModel) (io.ReadCloser, uint64, error) {
 	partition := getPartition(image.UUID)
 	file, err := os.OpenFile(partition.DeviceFile, syscall.O_RDWR, os.ModePerm)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error opening path %s", partition.DeviceFile)
+		return nil, 0, errors.Wrapf(err, "error opening path %s", partition.DeviceFile)
 	}
 
-	return file, nil
+	return file, uint64(partition.Partition.GetSize()), nil
 }
 
-// WriteDisk Writes an image to disk using an io reader and disk image definition
-func WriteDisk(reader io.Reader, image *images.ImageModel) error {
+// WriteDisk Writes an image to disk using an io reader and disk image definition.
+// The expected size given by the control server is checked against the partition before anything is written.
+// Images of a set are written over the whole disk they are meant for instead. With a passphrase the image is written
+// into a new LUKS container on the partition or disk. When verification is given the image is read back after it is
+// written, as its Mode says, and the partition table of the disk is checked.
+func WriteDisk(reader io.Reader, image *images.ImageModel, expected uint64, disk *machine.DiskModel,
+	passphrase string, verification *images.FlashVerification) error {
+	if disk != nil {
+		return writeWholeDisk(reader, image, expected, disk, passphrase, verification)
+	}
+
 	partition := getPartition(image.UUID)
 	logrus.Debug("Writing to disk")
 	if partition != nil {
 		printPartition(*partition)
 	}
-	chk, err := checksum.CRC32(partition.DeviceFile)
-	if err != nil {
-		logrus.Errorf("Cannot get checksum: %v", err)
+
+	available := uint64(partition.Partition.GetSize())
+	if passphrase != "" {
+		available = encryptedSize(available)
 	}
 
-	if image.Checksum != "" && image.Checksum == chk {
-		return nil
+	if expected > available {
+		return failWith(images.FailureDiskTooSmall, errors.Errorf("image %s needs %d bytes but %s only has %d bytes",
+			image.UUID, expected, partition.DeviceFile, available))
 	}
 
-	file, err := os.OpenFile(partition.DeviceFile, syscall.O_RDWR, os.ModePerm)
+	// An encrypted image never matches what is on the partition, the container is made anew
+	if passphrase == "" {
+		chk, err := checksum.CRC32(partition.DeviceFile)
+		if err != nil {
+			logrus.Errorf("Cannot get checksum: %v", err)
+		}
+
+		if image.Checksum != "" && image.Checksum == chk {
+			return nil
+		}
+	}
+
+	if err := writeDevice(reader, image, partition.DeviceFile, passphrase, verification); err != nil {
+		return err
+	}
+
+	if verification != nil {
+		checkPartitionTable(targetDevice, partition, verification)
+	}
+	return nil
+}
+
+func writeWholeDisk(reader io.Reader, image *images.ImageModel, expected uint64, disk *machine.DiskModel,
+	passphrase string, verification *images.FlashVerification) error {
+	available := disk.Size
+	if passphrase != "" {
+		available = encryptedSize(available)
+	}
+
+	if expected > available {
+		return failWith(images.FailureDiskTooSmall, errors.Errorf("image %s needs %d bytes but %s only has %d bytes",
+			image.UUID, expected, disk.Device, available))
+	}
+
+	logrus.Infof("Writing image %s to %s", image.UUID, disk.Device)
+	if err := writeDevice(reader, image, disk.Device, passphrase, verification); err != nil {
+		return err
+	}
+
+	// The partition table is in the first block of the image, which is always read back. Inside a LUKS container
+	// it is not the partition table of the disk.
+	if verification != nil && passphrase == "" && len(verification.Mismatches) != 0 &&
+		verification.Mismatches[0] == 0 {
+		verification.PartitionTable = fmt.Sprintf("the partition table of %s does not read back as written",
+			disk.Device)
+	}
+	return nil
+}
+
+// writeDevice writes an image to a device, or into a LUKS container on it when a passphrase is given. When
+// verification is given the image is read back from the device afterwards.
+func writeDevice(reader io.Reader, image *images.ImageModel, device string, passphrase string,
+	verification *images.FlashVerification) error {
+	if passphrase != "" {
+		decrypted, closeDevice, err := openEncrypted(device, image.UUID, passphrase, true)
+		if err != nil {
+			return errors.Wrapf(err, "cannot encrypt %s", device)
+		}
+		defer closeDevice()
+
+		device = decrypted
+	}
+
+	file, err := os.OpenFile(device, syscall.O_RDWR, os.ModePerm)
 	if err != nil {
-		return errors.Wrapf(err, "error opening path %s", partition.DeviceFile)
+		return errors.Wrapf(err, "error opening path %s", device)
 	}
 	defer func() {
-		err = file.Close()
-		if err != nil {
-			logrus.Errorf("error closing: %s %s", partition.DeviceFile, err.Error())
+		if err := file.Close(); err != nil {
+			logrus.Errorf("error closing: %s %s", device, err.Error())
 		}
 	}()
 
-	return errors.Wrap(fs.CopyStream(reader, file), "Error compressing")
+	var written *fs.ManifestWriter
+	if verification != nil {
+		written = fs.NewManifestWriter(fs.ManifestBlockSize)
+		reader = io.TeeReader(reader, written)
+	}
+
+	if err = fs.CopyStream(reader, file); err != nil {
+		return errors.Wrap(err, "Error compressing")
+	}
+
+	if verification != nil {
+		readBack(file, device, written.Manifest(), verification)
+	}
+	return nil
 }
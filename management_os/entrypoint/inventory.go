@@ -0,0 +1,121 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/machine"
+	log "github.com/sirupsen/logrus"
+)
+
+// sysBlock lists the block devices known to the kernel
+const sysBlock = "/sys/block"
+
+// sectorSize is the unit the kernel reports block device sizes in, regardless of the physical sector size
+const sectorSize = 512
+
+// getInventory collects the disks in this machine so the control server can check whether images fit
+func getInventory() *machine.Inventory {
+	inventory := machine.Inventory{TargetDevice: targetDevice}
+
+	devices, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		log.Warnf("Cannot list the block devices: %v", err)
+		return &inventory
+	}
+
+	for _, device := range devices {
+		name := device.Name()
+		// Skip virtual devices which images are never written to
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "sr") {
+			continue
+		}
+
+		raw, rerr := ioutil.ReadFile(sysBlock + "/" + name + "/size")
+		if rerr != nil {
+			log.Warnf("Cannot read the size of %s: %v", name, rerr)
+			continue
+		}
+
+		sectors, perr := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+		if perr != nil || sectors == 0 {
+			continue
+		}
+
+		inventory.Disks = append(inventory.Disks, machine.DiskModel{
+			Device: "/dev/" + name,
+			Size:   sectors * sectorSize,
+			UUID:   partitionTableUUID("/dev/" + name),
+			Serial: diskSerial(name),
+		})
+	}
+
+	return &inventory
+}
+
+// findDisk finds the disk an image of a set is written to by its device file, partition table UUID or serial
+func findDisk(inventory *machine.Inventory, selector string) (*machine.DiskModel, error) {
+	var found *machine.DiskModel
+	for i := range inventory.Disks {
+		if !inventory.Disks[i].Matches(selector) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("several disks match %s", selector)
+		}
+		found = &inventory.Disks[i]
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no disk matches %s", selector)
+	}
+
+	return found, nil
+}
+
+// diskSerial reads the serial number of a disk, NVMe disks report it themselves and the others through their WWID
+func diskSerial(name string) string {
+	for _, file := range []string{"/device/serial", "/device/wwid", "/wwid"} {
+		raw, err := ioutil.ReadFile(sysBlock + "/" + name + file)
+		if err == nil && len(bytes.TrimSpace(raw)) != 0 {
+			return string(bytes.TrimSpace(raw))
+		}
+	}
+
+	return ""
+}
+
+// partitionTableUUID reads the GUID of a GPT disk or the disk signature of an MBR disk, in the format of blkid's
+// PTUUID. It is empty when the disk has no partition table.
+func partitionTableUUID(device string) string {
+	f, err := os.Open(device)
+	if err != nil {
+		log.Warnf("Cannot open %s: %v", device, err)
+		return ""
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Cannot close %s: %v", device, err)
+		}
+	}()
+
+	table, err := fs.ReadPartitionTable(f)
+	if err != nil {
+		if err != fs.ErrNoPartitionTable {
+			log.Warnf("Cannot read the partition table of %s: %v", device, err)
+		}
+		return ""
+	}
+
+	return table.DiskUUID
+}
@@ -7,11 +7,16 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	syslog "log/syslog"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
+	"github.com/baas-project/baas/pkg/client"
 	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
 
 	"net"
 
@@ -49,6 +54,26 @@ func getMacAddr() (string, error) {
 
 var baseurl = fmt.Sprintf("http://control_server:%d", api.Port)
 
+// heartbeatInterval is how often the control server is told we are still flashing, well within its boot timeout. It
+// is also how long it takes at most to notice the boot was cancelled.
+const heartbeatInterval = 15 * time.Second
+
+// bootMenuImage finds the image picked from the pxelinux boot menu, it is passed as baas.image on the command line
+func bootMenuImage() images.ImageUUID {
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return ""
+	}
+
+	for _, param := range strings.Fields(string(cmdline)) {
+		if strings.HasPrefix(param, "baas.image=") {
+			return images.ImageUUID(strings.TrimPrefix(param, "baas.image="))
+		}
+	}
+
+	return ""
+}
+
 func init() {
 	file, err := os.OpenFile("/var/log/baas.log",
 		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
@@ -132,6 +157,7 @@ func initializeMachine() *images.ImageSetup {
 	printPartitions()
 
 	lastSetup := getLastSetup(&machine)
+	discardOverlays(&machine)
 	// Unmount the machine partition so it can be overwritten if needed, the partition should remain the same.
 	return &lastSetup
 }
@@ -155,7 +181,14 @@ func teardownMachine(imageSetup *images.ImageSetup) {
 	if err != nil {
 		log.Errorf("Cannot write setup to disk: %v", err)
 	}
-	err = json.NewEncoder(f).Encode(imageSetup)
+	// The passphrase of an encrypted boot is not kept next to the disks it opens, the upload fetches it again
+	saved := *imageSetup
+	if saved.Encryption != nil {
+		encryption := *saved.Encryption
+		encryption.Passphrase = ""
+		saved.Encryption = &encryption
+	}
+	err = json.NewEncoder(f).Encode(&saved)
 
 	if err != nil {
 		log.Errorf("Cannot encode the image setup: %v", err)
@@ -177,49 +210,158 @@ func teardownMachine(imageSetup *images.ImageSetup) {
 
 func main() {
 	conf := getConfig()
-	c := NewAPIClient(baseurl)
+	c := client.New(baseurl)
+	c.IdentifyAgent(agentVersion)
 	mac, err := getMacAddr()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if conf.TLSURL != "" {
+		if err = trustControlServer(c, conf.TLSURL); err != nil {
+			log.Fatalf("Cannot trust the control server: %v", err)
+		}
+	}
+
+	// The control server only hands a join token to the machines it does not know yet
+	if token := joinToken(); token != "" && !join(c, mac, token) {
+		bootLocally(conf)
+		return
+	}
+
+	selfUpdate(c, mac, conf.AgentPublicKey)
+
+	if err = c.ReportInventory(mac, getInventory()); err != nil {
+		log.Warnf("Cannot report the inventory: %v", err)
+	}
+
+	// Administrators can have us run diagnostics for as long as we are in the management OS
+	startCommands(c, mac)
+
 	lastSetup := initializeMachine()
 	if conf.UploadDisk && lastSetup.UUID != "" {
-		if err = ReadInDisks(c, lastSetup); err != nil {
+		if err = ReadInDisks(c, mac, lastSetup); err != nil {
 			log.Fatalf("Failed to read the disks: %v", err)
 		}
 	} else {
 		log.Info("Uploading disks disabled in configuration file.")
 	}
 
-	imageSetup, err := c.BootInform(mac)
+	imageSetup, err := c.BootInform(mac, bootMenuImage())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err = WriteOutDisks(c, mac, imageSetup); err != nil {
-		log.Fatal(err)
+	var peers *peerServer
+	if conf.PeerCacheDir != "" {
+		if peers, err = newPeerServer(conf.PeerCacheDir, conf.PeerPort); err != nil {
+			log.Warnf("Cannot serve the images to other machines: %v", err)
+		} else {
+			peers.Start()
+		}
+	}
+
+	// Keep the images locked on the server while we are writing them, and stop writing when the boot is cancelled
+	cancel := &cancellation{}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	go func() {
+		for range heartbeat.C {
+			var body *images.PeerHeartbeat
+			if peers != nil {
+				body = peers.Heartbeat()
+			}
+
+			control, err := c.BootHeartbeat(mac, body)
+			if err != nil {
+				log.Warnf("Cannot send heartbeat: %v", err)
+			} else if control != nil && control.CancelRequested && !cancel.Requested() {
+				log.Infof("Boot %d was cancelled, stopping", control.BootID)
+				cancel.Request()
+			}
+		}
+	}()
+
+	// The control server checked the images are meant for our disk, they are not written when it picked another one
+	report := images.BootReport{State: images.BootCompleted, TargetDevice: targetDevice}
+	if imageSetup.TargetDevice != "" && imageSetup.TargetDevice != targetDevice {
+		err = errors.Errorf("the images are meant for %s, but they are written to %s",
+			imageSetup.TargetDevice, targetDevice)
+	} else {
+		err = WriteOutDisks(c, mac, imageSetup, peers, &report, cancel)
+	}
+
+	// The keys go into the images themselves, so an overlay boot gets them as well
+	if err == nil && len(imageSetup.SSHAuthorizedKeys) != 0 {
+		injectSSHKeys(imageSetup)
+	}
+
+	// Without its overlays the images would be changed in place, which is what an overlay boot should prevent
+	if err == nil && imageSetup.BootMode == images.BootOverlay {
+		err = setupOverlays(imageSetup)
+	}
+
+	if err == nil && imageSetup.BootMode == images.BootDiskless {
+		err = setupDiskless(imageSetup)
+	}
+
+	if err != nil {
+		heartbeat.Stop()
+		report.State = images.BootFailed
+		if errors.Cause(err) == errCancelled {
+			report.State = images.BootCancelled
+		}
+		report.TargetDevice = ""
+		report.FailureReason = failureReason(err)
+		report.FailureDetail = err.Error()
+
+		// Log the error first, so it ends up in the serial log which is attached to the boot
+		log.Error(err)
+		boot, serr := c.SetBootState(mac, &report)
+		if serr != nil {
+			log.Warnf("Cannot report the failed boot: %v", serr)
+		} else if report.State == images.BootFailed {
+			attachFailureArtifacts(c, mac, boot.ID)
+		}
+		os.Exit(1)
+	}
+
+	if _, err = c.SetBootState(mac, &report); err != nil {
+		log.Warnf("Cannot report the finished boot: %v", err)
 	}
 	log.Info("reprovisioning done")
 
-	teardownMachine(imageSetup)
+	// The machines which were sent to us are still downloading, the heartbeats keep the control server sending
+	// machines here until we are done
+	if peers != nil {
+		log.Info("Serving the images to other machines")
+		peers.Linger(peerLinger)
+	}
+	heartbeat.Stop()
 
+	// Image sets overwrite whole disks, including the one the machine image lives on
+	if !imageSetup.MultiDisk() {
+		teardownMachine(imageSetup)
+	}
+
+	bootLocally(conf)
+}
+
+// bootLocally boots the machine from its disk next, as far as the configuration lets the management OS reboot it
+func bootLocally(conf *Config) {
 	// This presumes that the second option is the hard disk
 	if conf.SetNextBoot {
 		log.Info("Setting the BootNext parameter")
 		cmd := exec.Command("efibootmgr", "-n", "1")
 		log.Info(cmd.String())
-		err = cmd.Run()
-		if err != nil {
+		if err := cmd.Run(); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 	if conf.RebootAfterFinish {
 		cmd := exec.Command("systemctl", "reboot")
-		err = cmd.Run()
-		if err != nil {
+		if err := cmd.Run(); err != nil {
 			log.Fatal(err)
 		}
 	}
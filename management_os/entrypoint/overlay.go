@@ -0,0 +1,157 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// overlayDir holds the copy-on-write stores of overlay boots on the machine partition
+const overlayDir = "overlay"
+
+// overlayChunkSectors is the chunk size of the snapshots in sectors of 512 bytes
+const overlayChunkSectors = 8
+
+// overlay is a dm-snapshot over an image partition, the booted images activate it with the table of Table
+type overlay struct {
+	Name    string
+	Origin  string
+	Store   string
+	Sectors uint64
+}
+
+// Table is the device mapper table of the snapshot, with the device the store is attached to
+func (o *overlay) Table(store string) string {
+	return fmt.Sprintf("0 %d snapshot %s %s P %d", o.Sectors, o.Origin, store, overlayChunkSectors)
+}
+
+// run runs a command and returns its output, the output is part of the error when it fails
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// initialiseOverlay writes the header of the persistent exception store by activating the snapshot once
+func initialiseOverlay(o *overlay, path string) error {
+	loop, err := run("losetup", "--find", "--show", path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if _, err := run("losetup", "--detach", loop); err != nil {
+			log.Warnf("Cannot detach %s: %v", loop, err)
+		}
+	}()
+
+	if _, err = run("dmsetup", "create", o.Name, "--table", o.Table(loop)); err != nil {
+		return err
+	}
+
+	_, err = run("dmsetup", "remove", o.Name)
+	return err
+}
+
+// createStore creates the sparse copy-on-write store of an overlay on the machine partition, it only takes up the
+// space of the chunks which are written
+func createStore(machine *MachineImage, o *overlay) error {
+	f, err := machine.Create(o.Store)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(int64(o.Sectors * 512))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// writeOverlayList records the overlays of a boot, for the booted images and for throwing them away afterwards
+func writeOverlayList(machine *MachineImage, overlays []overlay) error {
+	f, err := machine.Create(overlayDir + "/overlays.json")
+	if err != nil {
+		return errors.Wrap(err, "couldn't write the overlay list")
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Errorf("Cannot close the overlay list: %v", err)
+		}
+	}()
+
+	return errors.Wrap(json.NewEncoder(f).Encode(overlays), "couldn't write the overlay list")
+}
+
+// prepareOverlays creates an empty copy-on-write store for every image of an overlay boot. The origin partitions
+// are never written while the overlays are active, so throwing the stores away restores the images.
+func prepareOverlays(machine *MachineImage, setup *images.ImageSetup) error {
+	if err := machine.MkdirAll(overlayDir, 0700); err != nil {
+		return errors.Wrap(err, "couldn't create the overlay directory")
+	}
+
+	var overlays []overlay
+	for _, frozen := range setup.Images {
+		// The stores live on the machine partition, it cannot be covered by an overlay itself
+		if frozen.Image.Type == "machine" {
+			continue
+		}
+
+		partition := getPartition(frozen.Image.UUID)
+		size := uint64(partition.Partition.GetSize())
+		o := overlay{
+			Name:    "baas-" + string(frozen.Image.UUID),
+			Origin:  partition.DeviceFile,
+			Store:   overlayDir + "/" + string(frozen.Image.UUID) + ".cow",
+			Sectors: size / 512,
+		}
+
+		if err := createStore(machine, &o); err != nil {
+			return errors.Wrapf(err, "couldn't create the overlay of %s", frozen.Image.UUID)
+		}
+
+		if err := initialiseOverlay(&o, machine.target+"/"+o.Store); err != nil {
+			return errors.Wrapf(err, "couldn't initialise the overlay of %s", frozen.Image.UUID)
+		}
+
+		overlays = append(overlays, o)
+	}
+
+	return writeOverlayList(machine, overlays)
+}
+
+// setupOverlays prepares the overlays of a boot on the machine partition
+func setupOverlays(setup *images.ImageSetup) error {
+	var machine MachineImage
+	machine.Initialise("/dev/sda1", "/mnt/machine")
+	machine.Mount()
+	defer machine.Unmount()
+
+	return prepareOverlays(&machine, setup)
+}
+
+// discardOverlays throws the changes of the last overlay boot away
+func discardOverlays(machine *MachineImage) {
+	if exists, _ := machine.Exists(overlayDir); !exists {
+		return
+	}
+
+	log.Info("Discarding the overlays of the last boot")
+	if err := machine.RemoveAll(overlayDir); err != nil {
+		log.Warnf("Cannot remove the overlays: %v", err)
+	}
+}
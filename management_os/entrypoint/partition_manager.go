@@ -19,6 +19,9 @@ import (
 
 const path = "partitions_cache.json"
 
+// targetDevice is the disk the images are written to
+const targetDevice = "/dev/sda"
+
 var partitionList []Partition
 
 // Partition defines a structure which keeps track of what images are currently on the disk
@@ -68,7 +71,7 @@ func getPartitions(machine *MachineImage) {
 
 // generatePartitionList generates a new instance of the cache
 func generatePartitionList() []Partition {
-	disk, err := diskfs.OpenWithMode("/dev/sda", diskfs.ReadOnly)
+	disk, err := diskfs.OpenWithMode(targetDevice, diskfs.ReadOnly)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 	}
@@ -86,7 +89,7 @@ func generatePartitionList() []Partition {
 				Number:          uint32(i + 1),
 				AssociatedImage: "",
 				LastUsedTime:    time.Now().Unix(),
-				DeviceFile:      fmt.Sprintf("/dev/sda%d", uint32(i+1)),
+				DeviceFile:      fmt.Sprintf("%s%d", targetDevice, uint32(i+1)),
 			})
 		}
 	}
@@ -0,0 +1,208 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// peerLinger is how long the machine keeps serving its images after flashing, once nobody downloads them anymore
+const peerLinger = 2 * time.Minute
+
+// peerServer serves the images this machine downloaded to the other machines the control server sends to it
+type peerServer struct {
+	dir   string
+	port  uint16
+	token string
+
+	mu       sync.Mutex
+	versions []images.PeerVersion
+	active   int
+	lastUsed time.Time
+}
+
+// newPeerServer creates the server, it only serves images once they are added to it
+func newPeerServer(dir string, port uint16) (*peerServer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "couldn't create the peer cache")
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, errors.Wrap(err, "couldn't generate the peer token")
+	}
+
+	return &peerServer{dir: dir, port: port, token: hex.EncodeToString(token), lastUsed: time.Now()}, nil
+}
+
+// Start serves the images in the background
+func (p *peerServer) Start() {
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf(":%d", p.port), p)
+		log.Errorf("Stopped serving images to other machines: %v", err)
+	}()
+}
+
+func (p *peerServer) path(version images.PeerVersion) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%s-%d.img", version.ImageUUID, version.Version))
+}
+
+// Add makes a version in the cache available to the other machines
+func (p *peerServer) Add(version images.PeerVersion) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.versions = append(p.versions, version)
+}
+
+func (p *peerServer) holds(version images.PeerVersion) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, held := range p.versions {
+		if held == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Heartbeat is what the control server is told about this server
+func (p *peerServer) Heartbeat() *images.PeerHeartbeat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	versions := make([]images.PeerVersion, len(p.versions))
+	copy(versions, p.versions)
+	return &images.PeerHeartbeat{Port: p.port, Token: p.token, Versions: versions}
+}
+
+// Linger waits until no machine has downloaded anything for the given time, counting from now at the earliest
+func (p *peerServer) Linger(idle time.Duration) {
+	p.mu.Lock()
+	p.lastUsed = time.Now()
+	p.mu.Unlock()
+
+	for {
+		p.mu.Lock()
+		wait := idle - time.Since(p.lastUsed)
+		if p.active != 0 {
+			wait = idle
+		}
+		p.mu.Unlock()
+
+		if wait <= 0 {
+			return
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+// ServeHTTP serves GET /image/{uuid}/{version} to the machines which know the token
+func (p *peerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) != 3 || parts[0] != "image" {
+		http.NotFound(w, r)
+		return
+	}
+
+	number, err := strconv.ParseUint(parts[2], 10, 64)
+	version := images.PeerVersion{ImageUUID: images.ImageUUID(parts[1]), Version: number}
+	if err != nil || !p.holds(version) {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(p.path(version))
+	if err != nil {
+		http.Error(w, "Cannot open the image", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Errorf("Failed to close the cached image (%v)", err)
+		}
+	}()
+
+	p.mu.Lock()
+	p.active++
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.active--
+		p.lastUsed = time.Now()
+		p.mu.Unlock()
+	}()
+
+	log.Infof("Serving image %s to %s", version, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err = io.Copy(w, f); err != nil {
+		log.Warnf("Cannot serve image %s to %s: %v", version, r.RemoteAddr, err)
+	}
+}
+
+// cacheWriter copies a download into the peer cache, it stops copying at the first error so a full cache does not
+// interrupt the download itself
+type cacheWriter struct {
+	f   *os.File
+	err error
+}
+
+func (c *cacheWriter) Write(b []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.f.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// DownloadDiskPeer downloads a disk image from another machine
+func DownloadDiskPeer(source *images.PeerSource) (io.ReadCloser, error) {
+	log.Infof("downloading disk over http from %s", source.URL)
+
+	req, err := http.NewRequest("GET", source.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create peer download request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+source.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed downloading from peer")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("peer download failed (%s) from %s", strings.TrimSpace(string(msg)), source.URL)
+	}
+
+	return resp.Body, nil
+}
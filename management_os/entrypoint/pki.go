@@ -0,0 +1,108 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/model/pki"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// caFile is where the CA bundle of the control server is pinned on the machine image
+const caFile = "ca.pem"
+
+// readPinnedCA reads the pinned CA bundle, which is nil when none was pinned yet
+func readPinnedCA(machine *MachineImage) ([]byte, error) {
+	if ok, err := machine.Exists(caFile); !ok {
+		return nil, err
+	}
+
+	f, err := machine.Open(caFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Cannot close the pinned CA: %v", err)
+		}
+	}()
+
+	return ioutil.ReadAll(f)
+}
+
+// pinCA stores the CA bundle on the machine image for the next boots
+func pinCA(machine *MachineImage, bundle []byte) error {
+	f, err := machine.Create(caFile)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(bundle); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// trustControlServer switches the client over to TLS at tlsURL. The first boot trusts the CA bundle it is given
+// over plain HTTP and pins it on the machine image, later boots only trust the pinned bundle. A rotated CA is
+// fetched over a connection the pinned bundle verified, and pinned in its place. The bundle is loaded once, the
+// control server keeps serving the old CA next to the new one long enough for a boot to finish.
+func trustControlServer(c *client.Client, tlsURL string) error {
+	var machine MachineImage
+	machine.Initialise("/dev/sda1", "/mnt/machine")
+	machine.Mount()
+	defer machine.Unmount()
+
+	pinned, err := readPinnedCA(&machine)
+	if err != nil {
+		log.Warnf("Cannot read the pinned CA: %v", err)
+	}
+
+	bundle := pinned
+	if bundle == nil {
+		if bundle, err = c.FetchCA(); err != nil {
+			return err
+		}
+
+		certs, err := pki.ParseBundle(bundle)
+		if err != nil {
+			return errors.Wrap(err, "invalid CA bundle")
+		}
+
+		log.Warnf("Trusting the CA %s of the control server on first use", pki.Fingerprints(certs))
+	}
+
+	if err = c.UseTLS(tlsURL, bundle); err != nil {
+		return err
+	}
+
+	current, err := c.FetchCA()
+	if err != nil {
+		return errors.Wrap(err, "cannot verify the control server")
+	}
+
+	if !bytes.Equal(current, bundle) {
+		if err = c.UseTLS(tlsURL, current); err != nil {
+			return err
+		}
+
+		log.Infof("The CA of the control server was rotated, trusting %s", c.CAFingerprint())
+		bundle = current
+	}
+
+	if !bytes.Equal(bundle, pinned) {
+		if err = pinCA(&machine, bundle); err != nil {
+			log.Warnf("Cannot pin the CA of the control server: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/model/machine"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// approvalPollInterval is how often a pending machine asks whether it was approved, for at most approvalWait.
+	// Machines which are still pending after that boot from their local disk and register again next time.
+	approvalPollInterval = 10 * time.Second
+	approvalWait         = 10 * time.Minute
+)
+
+// joinToken is the token the control server hands to machines it does not know on the kernel command line, it is
+// empty for the machines it knows
+func joinToken() string {
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return ""
+	}
+
+	for _, param := range strings.Fields(string(cmdline)) {
+		if strings.HasPrefix(param, "baas.join=") {
+			return strings.TrimPrefix(param, "baas.join=")
+		}
+	}
+
+	return ""
+}
+
+// architecture is the architecture of this machine as the control server names it
+func architecture() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return string(machine.X86_64)
+	case "arm64":
+		return string(machine.Arm64)
+	default:
+		return string(machine.Unknown)
+	}
+}
+
+// join registers this machine with the control server and reports its inventory, then waits for an admin to
+// approve it. It reports whether the machine may be provisioned.
+func join(c *client.Client, mac string, token string) bool {
+	registration, err := c.Join(mac, architecture(), token)
+	if err != nil {
+		log.Errorf("Cannot register this machine: %v", err)
+		return false
+	}
+
+	switch registration.Status {
+	case machine.MachineApproved:
+		return true
+	case machine.MachineRejected:
+		log.Warn("This machine was rejected by the administrators of BAAS")
+		return false
+	}
+
+	key := registration.Key
+	if err = c.PendingInventory(mac, key, getInventory()); err != nil {
+		log.Warnf("Cannot report the inventory: %v", err)
+	}
+
+	log.Infof("Registered this machine as %s, waiting for an administrator to approve it", mac)
+	deadline := time.Now().Add(approvalWait)
+	for time.Now().Before(deadline) {
+		time.Sleep(approvalPollInterval)
+
+		registration, err = c.Registration(mac, key)
+		if err != nil {
+			log.Warnf("Cannot ask whether this machine was approved: %v", err)
+			continue
+		}
+
+		switch registration.Status {
+		case machine.MachineApproved:
+			log.Info("This machine was approved")
+			return true
+		case machine.MachineRejected:
+			log.Warn("This machine was rejected by the administrators of BAAS")
+			return false
+		}
+	}
+
+	log.Info("This machine was not approved in time")
+	return false
+}
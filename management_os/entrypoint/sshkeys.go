@@ -0,0 +1,102 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// injectMount is where the images are mounted to write the SSH keys into them
+const injectMount = "/mnt/inject"
+
+// appendAuthorizedKeys adds the keys which are not in the authorized_keys of root in the file system at root yet
+func appendAuthorizedKeys(root string, keys []string) error {
+	// Images without a home directory for root are not a Linux root file system, there is nothing to add keys to
+	if _, err := os.Stat(filepath.Join(root, "root")); err != nil {
+		return errors.Wrap(err, "no home directory for root")
+	}
+
+	dir := filepath.Join(root, "root", ".ssh")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, "authorized_keys")
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	present := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+
+	var added strings.Builder
+	if len(existing) != 0 && !strings.HasSuffix(string(existing), "\n") {
+		added.WriteString("\n")
+	}
+	for _, key := range keys {
+		if !present[key] {
+			added.WriteString(key + "\n")
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(added.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// injectSSHKeys writes the SSH keys of the boot into the images which were flashed to a partition. Images which
+// cannot be mounted or are no Linux root file system are skipped, the keys only matter for those which are.
+func injectSSHKeys(setup *images.ImageSetup) {
+	if err := os.MkdirAll(injectMount, 0755); err != nil {
+		log.Warnf("Cannot create %s, the SSH keys are not injected: %v", injectMount, err)
+		return
+	}
+
+	for _, frozen := range setup.Images {
+		// Whole disks have a partition table of their own, which we do not look into
+		if frozen.Image.Type == "machine" || frozen.TargetDevice != "" {
+			continue
+		}
+
+		// The images of diskless boots are exported read-only, they get the keys from the metadata only
+		if frozen.Export != nil {
+			continue
+		}
+
+		device := getPartition(frozen.Image.UUID).DeviceFile
+		if _, err := run("mount", device, injectMount); err != nil {
+			log.Warnf("Cannot mount image %s to inject the SSH keys: %v", frozen.Image.UUID, err)
+			continue
+		}
+
+		if err := appendAuthorizedKeys(injectMount, setup.SSHAuthorizedKeys); err != nil {
+			log.Infof("Not injecting the SSH keys into image %s: %v", frozen.Image.UUID, err)
+		} else {
+			log.Infof("Injected %d SSH keys into image %s", len(setup.SSHAuthorizedKeys), frozen.Image.UUID)
+		}
+
+		if _, err := run("umount", injectMount); err != nil {
+			log.Warnf("Cannot unmount image %s: %v", frozen.Image.UUID, err)
+		}
+	}
+}
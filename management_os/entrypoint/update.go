@@ -0,0 +1,117 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/baas-project/baas/pkg/client"
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// agentVersion is the version of this build, it is set with -ldflags "-X main.agentVersion=1.4.0"
+var agentVersion = "dev"
+
+// agentPath is where a downloaded release of the agent is stored before it replaces this process
+const agentPath = "/tmp/baas-agent"
+
+// updatedEnv is set for the release this process was replaced with, so it does not update itself again
+const updatedEnv = "BAAS_AGENT_UPDATED"
+
+// selfUpdate replaces this process with the release of the agent the control server wants this machine to run.
+// Anything going wrong is logged and leaves the current agent running, an agent which cannot update can still
+// flash the machine.
+func selfUpdate(c *client.Client, mac string, publicKey string) {
+	if version := os.Getenv(updatedEnv); version != "" {
+		log.Infof("Running version %s of the agent", version)
+		return
+	}
+
+	if publicKey == "" {
+		log.Info("No agent public key configured, not checking for updates")
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		log.Warn("The agent public key is not a base64 encoded Ed25519 key, not checking for updates")
+		return
+	}
+
+	update, err := c.GetAgentUpdate(mac, runtime.GOARCH)
+	if err != nil {
+		log.Warnf("Cannot check for a new agent: %v", err)
+		return
+	}
+
+	if update == nil || update.Version == agentVersion {
+		log.Infof("Version %s of the agent is up to date", agentVersion)
+		return
+	}
+
+	log.Infof("Replacing version %s of the agent with %s", agentVersion, update.Version)
+	if err = downloadAgent(c, update, key); err != nil {
+		log.Warnf("Cannot update the agent: %v", err)
+		_ = os.Remove(agentPath)
+		return
+	}
+
+	// Exec only returns when it fails
+	err = syscall.Exec(agentPath, os.Args, append(os.Environ(), updatedEnv+"="+update.Version))
+	log.Warnf("Cannot run version %s of the agent: %v", update.Version, err)
+}
+
+// downloadAgent downloads the release and verifies its digest and signature before making it executable
+func downloadAgent(c *client.Client, update *agent.Update, key ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(update.Signature)
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+
+	body, err := c.DownloadAgent(update.URL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	// The file is only made executable once it is verified
+	f, err := os.OpenFile(agentPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "create agent file")
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "download agent")
+	}
+
+	digest := hash.Sum(nil)
+	if hex.EncodeToString(digest) != update.SHA256 {
+		return errors.New("the downloaded agent does not match its SHA-256 digest")
+	}
+
+	if !ed25519.Verify(key, digest, signature) {
+		return errors.New("the signature of the agent is not valid")
+	}
+
+	return os.Chmod(agentPath, 0755)
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"io"
 
+	"github.com/baas-project/baas/pkg/client"
 	"github.com/baas-project/baas/pkg/compression"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/util"
@@ -15,7 +16,13 @@ import (
 )
 
 // ReadInDisks reads in all disks in the machine setup and uploads them to the control server.
-func ReadInDisks(api *APIClient, setup *images.ImageSetup) error {
+func ReadInDisks(api *client.Client, mac string, setup *images.ImageSetup) error {
+	// The changes of discard and overlay boots are thrown away, setups from before boot modes have none
+	if setup.BootMode != "" && setup.BootMode != images.BootPersistent {
+		log.Infof("Not uploading the disks of a %s boot", setup.BootMode)
+		return nil
+	}
+
 	log.Info("Reading and uploading disks")
 
 	for _, image := range setup.Images {
@@ -26,27 +33,61 @@ func ReadInDisks(api *APIClient, setup *images.ImageSetup) error {
 			continue
 		}
 
-		r, err := ReadDisk(&image.Image)
-		if err != nil {
-			return errors.Wrapf(err, "read disk")
+		if err := readInDisk(api, mac, setup, &image.Image); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// readInDisk uploads the disk of an image. Encrypted disks are decrypted with the key of their boot, which the
+// control server hands out once for it, unless the boot keeps them encrypted. Those are uploaded as they are.
+func readInDisk(api *client.Client, mac string, setup *images.ImageSetup, image *images.ImageModel) error {
+	var r io.ReadCloser
+	var size uint64
+	var encryptedBoot uint
+	var err error
 
-		log.Debug("Compressing disk")
-		com, err := compression.Compress(r, image.Image.DiskCompressionStrategy)
-		if err != nil {
-			return errors.Wrapf(err, "compressing disk")
+	switch encryption := setup.Encryption; {
+	case !encryption.Covers(image.UUID):
+		r, size, err = ReadDisk(image)
+	case encryption.KeepEncrypted:
+		encryptedBoot = encryption.BootID
+		r, size, err = ReadDisk(image)
+	default:
+		passphrase, kerr := api.ReleaseBootKey(mac, encryption.BootID)
+		if kerr != nil {
+			return errors.Wrapf(kerr, "fetch the key of boot %d", encryption.BootID)
 		}
+		r, size, err = readEncryptedDisk(image, passphrase)
+	}
 
-		log.Debug("Uploading image")
-		err = UploadDisk(api, com, &image.Image)
-		if err != nil {
-			return errors.Wrapf(err, "uploading disk")
+	if err != nil {
+		return errors.Wrapf(err, "read disk")
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Cannot close the disk of image %s: %v", image.UUID, err)
 		}
+	}()
+
+	log.Debug("Compressing disk")
+	com, err := compression.Compress(r, image.DiskCompressionStrategy)
+	if err != nil {
+		return errors.Wrapf(err, "compressing disk")
 	}
+
+	log.Debug("Uploading image")
+	err = UploadDisk(api, com, image, size, encryptedBoot)
+	if err != nil {
+		return errors.Wrapf(err, "uploading disk")
+	}
+
 	return nil
 }
 
-// UploadDisk uploads a disk to the control server given a transfer strategy.
-func UploadDisk(api *APIClient, reader io.Reader, uuid *images.ImageModel) error {
-	return api.UploadDiskHTTP(reader, string(uuid.UUID))
+// UploadDisk uploads a disk to the control server given a transfer strategy. encryptedBoot is the boot whose key an
+// encrypted disk needs, zero for disks which are not.
+func UploadDisk(api *client.Client, reader io.Reader, uuid *images.ImageModel, size uint64, encryptedBoot uint) error {
+	return api.UploadDiskHTTP(reader, string(uuid.UUID), size, encryptedBoot)
 }
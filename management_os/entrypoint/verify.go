@@ -0,0 +1,90 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/baas-project/baas/pkg/fs"
+	"github.com/baas-project/baas/pkg/model/images"
+	log "github.com/sirupsen/logrus"
+)
+
+// quickSamples is how many blocks of an image a quick verification reads back
+const quickSamples = 16
+
+// readBack reads an image back from the device it was just written to and compares it with the manifest of what was
+// written. The buffers of the device are flushed first, so the blocks come from the disk rather than from memory.
+func readBack(file *os.File, device string, written *fs.Manifest, verification *images.FlashVerification) {
+	verification.Verified = false
+	verification.Written = written.Size
+	verification.Checked = 0
+	verification.Mismatches = nil
+	verification.Error = ""
+
+	if err := file.Sync(); err != nil {
+		verification.Error = fmt.Sprintf("cannot sync %s: %v", device, err)
+		return
+	}
+
+	if _, err := run("blockdev", "--flushbufs", device); err != nil {
+		log.Warnf("Cannot flush the buffers of %s, the image may be read back from memory: %v", device, err)
+	}
+
+	blocks := fs.SampleBlocks(written.Blocks(), quickSamples)
+	if verification.Mode == images.VerifyFull {
+		blocks = fs.SampleBlocks(written.Blocks(), written.Blocks())
+	}
+
+	mismatches, checked, err := fs.VerifyBlocks(file, written, blocks)
+	verification.Checked = checked
+	if len(mismatches) > images.MaxMismatches {
+		mismatches = mismatches[:images.MaxMismatches]
+	}
+	verification.Mismatches = mismatches
+	if err != nil {
+		verification.Error = err.Error()
+	}
+
+	verification.Verified = err == nil && len(mismatches) == 0
+	log.Infof("Read back %d of %d bytes of image %s from %s, %d blocks differ", checked, written.Size,
+		verification.ImageUUID, device, len(mismatches))
+}
+
+// checkPartitionTable checks that the partition table of the disk still lists the partition an image was written to
+// where it was before
+func checkPartitionTable(disk string, partition *Partition, verification *images.FlashVerification) {
+	f, err := os.Open(disk)
+	if err != nil {
+		verification.PartitionTable = fmt.Sprintf("cannot open %s: %v", disk, err)
+		verification.Verified = false
+		return
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Cannot close %s: %v", disk, err)
+		}
+	}()
+
+	table, err := fs.ReadPartitionTable(f)
+	if err != nil {
+		verification.PartitionTable = fmt.Sprintf("cannot read the partition table of %s: %v", disk, err)
+		verification.Verified = false
+		return
+	}
+
+	start, size := uint64(partition.Partition.GetStart()), uint64(partition.Partition.GetSize())
+	for _, found := range table.Partitions {
+		if found.Start == start && found.Size == size {
+			verification.PartitionTable = ""
+			return
+		}
+	}
+
+	verification.PartitionTable = fmt.Sprintf("the partition table of %s no longer has partition %d", disk,
+		partition.Number)
+	verification.Verified = false
+}
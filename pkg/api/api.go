@@ -8,6 +8,60 @@ package api
 // Port is the port on which the control server listens
 const Port int = 4848
 
+// Version of BAAS, this is set when building a release using
+// -ldflags "-X github.com/baas-project/baas/pkg/api.Version=v1.0.0"
+var Version = "development"
+
+// Commit is the git commit BAAS was built from, it is set like Version with
+// -ldflags "-X github.com/baas-project/baas/pkg/api.Commit=$(git rev-parse --short HEAD)"
+var Commit = "unknown"
+
+const (
+	// ProtocolLegacy is the protocol of the management OS agents which do not say which one they speak
+	ProtocolLegacy uint = 1
+	// ProtocolVersion is the newest protocol between the management OS agent and the control server this build
+	// speaks. It goes up whenever one side sends something the other has to understand.
+	ProtocolVersion uint = 2
+)
+
+const (
+	// ProtocolHeader carries the protocol of the agent on its requests, and the one both sides speak on the answers
+	ProtocolHeader = "X-BAAS-Protocol"
+	// AgentVersionHeader carries the release of the agent on its requests
+	AgentVersionHeader = "X-BAAS-Agent-Version"
+	// ServerVersionHeader carries the version of the control server on its answers to the agent
+	ServerVersionHeader = "X-BAAS-Server-Version"
+)
+
+// NegotiateProtocol picks the newest protocol spoken by both an agent and this build
+func NegotiateProtocol(agent uint) uint {
+	if agent == 0 {
+		agent = ProtocolLegacy
+	}
+
+	if agent < ProtocolVersion {
+		return agent
+	}
+
+	return ProtocolVersion
+}
+
+// ErrorProtocolUnsupported is the error code of the agents the control server refuses to serve for being too old
+const ErrorProtocolUnsupported = "agent_protocol_unsupported"
+
+// ProtocolError is the body of the 426 Upgrade Required the control server answers agents which are too old with
+type ProtocolError struct {
+	Error     string
+	ErrorCode string
+	// Protocol is the one both sides speak, MinimumProtocol the oldest the control server accepts and
+	// ServerProtocol the newest it speaks
+	Protocol        uint
+	MinimumProtocol uint
+	ServerProtocol  uint
+	// UpdateURL is where the agent asks which release it should run
+	UpdateURL string
+}
+
 // BootInformRequest is the data which the machine (client) sends to the control server on initial boot
 type BootInformRequest struct {
 }
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+// PlannedAction is what an operation does to a row
+type PlannedAction string
+
+// The actions an operation can take on a row. Trashed rows stay in the database until the trash is purged.
+const (
+	PlanCreate PlannedAction = "create"
+	PlanModify PlannedAction = "modify"
+	PlanTrash  PlannedAction = "trash"
+	PlanDelete PlannedAction = "delete"
+)
+
+// PlannedRow is a row an operation changes, Kind names what the row is (user, image, version, ...) and Key which
+// one of them it is
+type PlannedRow struct {
+	Action PlannedAction
+	Kind   string
+	Key    string
+}
+
+// PlannedChanges lists everything a destructive operation changes: the rows, the files it removes and the bytes
+// those take up. A dry run only plans the changes. Blockers are the reasons the operation cannot be carried out,
+// an operation with blockers changes nothing.
+type PlannedChanges struct {
+	DryRun   bool
+	Rows     []PlannedRow
+	Files    []string
+	Bytes    uint64
+	Blockers []string
+}
+
+// NewPlannedChanges starts an empty plan
+func NewPlannedChanges(dryRun bool) *PlannedChanges {
+	return &PlannedChanges{DryRun: dryRun, Rows: []PlannedRow{}, Files: []string{}, Blockers: []string{}}
+}
+
+// Row adds a row to the plan
+func (p *PlannedChanges) Row(action PlannedAction, kind string, key string) {
+	p.Rows = append(p.Rows, PlannedRow{Action: action, Kind: kind, Key: key})
+}
+
+// File adds a file which is removed, together with its size
+func (p *PlannedChanges) File(path string, size uint64) {
+	p.Files = append(p.Files, path)
+	p.Bytes += size
+}
+
+// Block adds a reason the operation cannot be carried out
+func (p *PlannedChanges) Block(reason string) {
+	p.Blockers = append(p.Blockers, reason)
+}
+
+// Blocked reports whether the operation cannot be carried out
+func (p *PlannedChanges) Blocked() bool {
+	return len(p.Blockers) != 0
+}
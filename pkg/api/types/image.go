@@ -0,0 +1,296 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+)
+
+// ImageVersion describes a version of an image
+type ImageVersion struct {
+	Version        uint64           `json:"Version"`
+	ImageModelUUID images.ImageUUID `json:"ImageModelUUID"`
+	Size           uint64           `json:"Size"`
+	SHA256         string           `json:"SHA256"`
+	Corrupt        bool             `json:"Corrupt"`
+	// Format is left out for the versions which were stored before the formats of uploads were detected
+	Format images.FileFormat `json:"Format,omitempty"`
+	// BootKeyID is the key the version is encrypted with, it is left out for versions which are not
+	BootKeyID uint `json:"BootKeyID,omitempty"`
+	// BackedUp tells whether the version was copied to the backup target of its image, it is only filled in by the
+	// listing of the versions and left out for images without a backup policy
+	BackedUp BackupStatus `json:"BackedUp,omitempty"`
+
+	CreatedAt time.Time `json:"CreatedAt"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+}
+
+// BackupStatus is whether a version was backed up, it is sent as true, false or "pending"
+type BackupStatus string
+
+const (
+	// BackupStatusDone versions were copied to the backup target
+	BackupStatusDone BackupStatus = "true"
+	// BackupStatusFailed versions could not be copied, or are corrupt
+	BackupStatusFailed BackupStatus = "false"
+	// BackupStatusPending versions are waiting for their schedule or their next attempt
+	BackupStatusPending BackupStatus = "pending"
+)
+
+// MarshalJSON sends the status as a boolean once it is known
+func (s BackupStatus) MarshalJSON() ([]byte, error) {
+	if s == BackupStatusDone || s == BackupStatusFailed {
+		return []byte(s), nil
+	}
+
+	return json.Marshal(string(s))
+}
+
+// UnmarshalJSON reads the status from a boolean or a string
+func (s *BackupStatus) UnmarshalJSON(data []byte) error {
+	var known bool
+	if err := json.Unmarshal(data, &known); err == nil {
+		*s = BackupStatus(strconv.FormatBool(known))
+		return nil
+	}
+
+	return json.Unmarshal(data, (*string)(s))
+}
+
+// NewImageVersion describes a version of an image
+func NewImageVersion(v *images.Version) ImageVersion {
+	return ImageVersion{
+		Version:        v.Version,
+		ImageModelUUID: v.ImageModelUUID,
+		Size:           v.Size,
+		SHA256:         v.SHA256,
+		Corrupt:        v.Corrupt,
+		Format:         v.Format,
+		BootKeyID:      v.BootKeyID,
+		CreatedAt:      v.CreatedAt,
+		UpdatedAt:      v.UpdatedAt,
+	}
+}
+
+// NewImageVersions describes the versions of an image, an image without versions has an empty list rather than
+// null. Listings of image summaries leave the versions out and only count them.
+func NewImageVersions(versions []images.Version) []ImageVersion {
+	described := make([]ImageVersion, len(versions))
+	for i := range versions {
+		described[i] = NewImageVersion(&versions[i])
+	}
+
+	return described
+}
+
+// Image describes an image, where its files are stored is left out
+type Image struct {
+	Name     string         `json:"Name"`
+	Versions []ImageVersion `json:"Versions"`
+	// VersionCount is also filled in by the summaries which leave the versions out, HasVersions tells whether
+	// there is any version to boot
+	VersionCount int64            `json:"VersionCount"`
+	HasVersions  bool             `json:"HasVersions"`
+	UUID         images.ImageUUID `json:"UUID"`
+	Username     string           `json:"Username"`
+
+	DiskCompressionStrategy images.DiskCompressionStrategy `json:"DiskCompressionStrategy"`
+	ImageFileType           images.DiskType                `json:"ImageFileType"`
+	Type                    string                         `json:"Type"`
+	Checksum                string                         `json:"Checksum"`
+	DiskUUID                string                         `json:"DiskUUID"`
+	// DiskUUIDWarning is set when the latest upload has another partition table than the disk the image is built for
+	DiskUUIDWarning string `json:"DiskUUIDWarning,omitempty"`
+
+	Tier      string `json:"Tier"`
+	Placement string `json:"Placement,omitempty"`
+
+	Filesystem   images.FilesystemType      `json:"Filesystem"`
+	Architecture machine.SystemArchitecture `json:"Architecture"`
+	Description  string                     `json:"Description"`
+	SourceURL    string                     `json:"SourceURL"`
+	BaseOS       string                     `json:"BaseOS"`
+	License      images.LicenseKind         `json:"License"`
+	LicenseName  string                     `json:"LicenseName"`
+	SourceNotes  string                     `json:"SourceNotes"`
+	Icon         string                     `json:"Icon"`
+	Public       bool                       `json:"Public"`
+	Course       string                     `json:"Course,omitempty"`
+
+	CreatedAt time.Time `json:"CreatedAt"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+	// DeletedAt is when the image was moved to the trash, it is left out for the images which are not in it
+	DeletedAt *time.Time `json:"DeletedAt,omitempty"`
+
+	// Favorite and LastUsedByMe are about the user who lists the images, LastUsedByMe is when they last booted it
+	Favorite     bool       `json:"Favorite,omitempty"`
+	LastUsedByMe *time.Time `json:"LastUsedByMe,omitempty"`
+}
+
+// NewImage describes an image
+func NewImage(image *images.ImageModel) Image {
+	described := Image{
+		Name:                    image.Name,
+		Versions:                NewImageVersions(image.Versions),
+		UUID:                    image.UUID,
+		Username:                image.Username,
+		DiskCompressionStrategy: image.DiskCompressionStrategy,
+		ImageFileType:           image.ImageFileType,
+		Type:                    image.Type,
+		Checksum:                image.Checksum,
+		DiskUUID:                image.DiskUUID,
+		Tier:                    image.Tier,
+		Placement:               image.Placement,
+		Filesystem:              image.Filesystem,
+		Architecture:            image.Architecture,
+		Description:             image.Description,
+		SourceURL:               image.SourceURL,
+		BaseOS:                  image.BaseOS,
+		License:                 image.License,
+		LicenseName:             image.LicenseName,
+		SourceNotes:             image.SourceNotes,
+		Icon:                    image.Icon,
+		Public:                  image.Public,
+		Course:                  image.Course,
+		CreatedAt:               image.CreatedAt,
+		UpdatedAt:               image.UpdatedAt,
+	}
+
+	// Summaries count the versions they leave out
+	described.VersionCount = image.VersionCount
+	if len(image.Versions) != 0 {
+		described.VersionCount = int64(len(image.Versions))
+	}
+	described.HasVersions = described.VersionCount != 0
+
+	if image.DiskUUID != "" && image.UploadedDiskUUID != "" &&
+		!strings.EqualFold(image.UploadedDiskUUID, image.DiskUUID) {
+		described.DiskUUIDWarning = fmt.Sprintf("the latest upload has the partition table %s, the image is built "+
+			"for the disk %s", image.UploadedDiskUUID, image.DiskUUID)
+	}
+
+	if image.DeletedAt.Valid {
+		deleted := image.DeletedAt.Time
+		described.DeletedAt = &deleted
+	}
+
+	return described
+}
+
+// NewImages describes a list of images, an empty list is an empty array rather than null
+func NewImages(found []images.ImageModel) []Image {
+	described := make([]Image, len(found))
+	for i := range found {
+		described[i] = NewImage(&found[i])
+	}
+
+	return described
+}
+
+// FrozenImage describes an image of an image setup, pegged to a version
+type FrozenImage struct {
+	Image   Image        `json:"Image"`
+	Version ImageVersion `json:"Version"`
+	Update  bool         `json:"Update"`
+
+	Selector     images.VersionSelector `json:"Selector,omitempty"`
+	TargetDevice string                 `json:"TargetDevice,omitempty"`
+}
+
+// NewFrozenImages describes the images of an image setup
+func NewFrozenImages(frozen []images.ImageFrozen) []FrozenImage {
+	described := make([]FrozenImage, len(frozen))
+	for i := range frozen {
+		described[i] = FrozenImage{
+			Image:        NewImage(&frozen[i].Image),
+			Version:      NewImageVersion(&frozen[i].Version),
+			Update:       frozen[i].Update,
+			Selector:     frozen[i].Selector,
+			TargetDevice: frozen[i].TargetDevice,
+		}
+	}
+
+	return described
+}
+
+// ImageSetup describes a collection of images which are booted together
+type ImageSetup struct {
+	Name     string           `json:"Name"`
+	Images   []FrozenImage    `json:"Images"`
+	Username string           `json:"Username"`
+	UUID     images.ImageUUID `json:"UUID"`
+}
+
+// NewImageSetup describes an image setup
+func NewImageSetup(setup *images.ImageSetup) ImageSetup {
+	return ImageSetup{
+		Name:     setup.Name,
+		Images:   NewFrozenImages(setup.Images),
+		Username: setup.Username,
+		UUID:     setup.UUID,
+	}
+}
+
+// NewImageSetups describes a list of image setups
+func NewImageSetups(setups []images.ImageSetup) []ImageSetup {
+	described := make([]ImageSetup, len(setups))
+	for i := range setups {
+		described[i] = NewImageSetup(&setups[i])
+	}
+
+	return described
+}
+
+// ImageSetMember describes an image in an image set together with the disk it is written to
+type ImageSetMember struct {
+	ImageUUID    images.ImageUUID       `json:"ImageUUID"`
+	Version      images.VersionSelector `json:"Version"`
+	TargetDevice string                 `json:"TargetDevice"`
+}
+
+// ImageSet describes images which are written to different disks of a machine and booted together
+type ImageSet struct {
+	UUID     images.ImageUUID `json:"UUID"`
+	Name     string           `json:"Name"`
+	Username string           `json:"Username"`
+	Members  []ImageSetMember `json:"Members"`
+}
+
+// NewImageSet describes an image set
+func NewImageSet(set *images.ImageSet) ImageSet {
+	described := ImageSet{
+		UUID:     set.UUID,
+		Name:     set.Name,
+		Username: set.Username,
+		Members:  make([]ImageSetMember, len(set.Members)),
+	}
+
+	for i, member := range set.Members {
+		described.Members[i] = ImageSetMember{
+			ImageUUID:    member.ImageUUID,
+			Version:      member.Version,
+			TargetDevice: member.TargetDevice,
+		}
+	}
+
+	return described
+}
+
+// NewImageSets describes a list of image sets
+func NewImageSets(sets []images.ImageSet) []ImageSet {
+	described := make([]ImageSet, len(sets))
+	for i := range sets {
+		described[i] = NewImageSet(&sets[i])
+	}
+
+	return described
+}
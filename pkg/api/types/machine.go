@@ -0,0 +1,142 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+)
+
+// MacAddress describes the MAC address of a machine, as an object for the clients which read it like that
+type MacAddress struct {
+	Address string `json:"Address"`
+}
+
+// Disk describes a block device the management OS reported for a machine
+type Disk struct {
+	Device string `json:"Device"`
+	Size   uint64 `json:"Size"`
+	UUID   string `json:"UUID"`
+	Serial string `json:"Serial"`
+}
+
+// DefaultImage describes the image a machine boots when nothing is queued for it, the image is empty when there is
+// none
+type DefaultImage struct {
+	ImageUUID string `json:"ImageUUID"`
+	BootMode  string `json:"BootMode"`
+}
+
+// Machine describes a machine
+type Machine struct {
+	Name         string                     `json:"Name"`
+	Architecture machine.SystemArchitecture `json:"Architecture"`
+	Group        string                     `json:"Group"`
+	Managed      bool                       `json:"Managed"`
+	MacAddress   MacAddress                 `json:"MacAddress"`
+	ImageUUID    string                     `json:"ImageUUID"`
+
+	Disks        []Disk `json:"Disks"`
+	TargetDevice string `json:"TargetDevice"`
+	Dirty        bool   `json:"Dirty"`
+	Restricted   bool   `json:"Restricted"`
+	Status       string `json:"Status"`
+
+	DefaultImage DefaultImage `json:"DefaultImage"`
+
+	// ClockCheckedAt is left out for machines which never reported their clock
+	ClockSkewMillis int64      `json:"ClockSkewMillis"`
+	ClockCheckedAt  *time.Time `json:"ClockCheckedAt,omitempty"`
+
+	// AgentVersion and ServerVersion are those of the last boot claim or heartbeat, they are left out for
+	// machines which never checked in since
+	AgentVersion  string     `json:"AgentVersion,omitempty"`
+	AgentProtocol uint       `json:"AgentProtocol,omitempty"`
+	ServerVersion string     `json:"ServerVersion,omitempty"`
+	ServerCommit  string     `json:"ServerCommit,omitempty"`
+	AgentSeenAt   *time.Time `json:"AgentSeenAt,omitempty"`
+
+	CreatedAt time.Time `json:"CreatedAt"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+}
+
+// NewMachine describes a machine
+func NewMachine(m *machine.MachineModel) Machine {
+	described := Machine{
+		Name:         m.Name,
+		Architecture: m.Architecture,
+		Group:        m.Group,
+		Managed:      m.Managed,
+		MacAddress:   MacAddress{Address: m.MacAddress.Address},
+		ImageUUID:    m.ImageUUID,
+		TargetDevice: m.TargetDevice,
+		Dirty:        m.Dirty,
+		Restricted:   m.Restricted,
+		Status:       string(m.RegistrationStatus()),
+		DefaultImage: DefaultImage(m.DefaultImage),
+
+		ClockSkewMillis: m.ClockSkewMillis,
+		ClockCheckedAt:  m.ClockCheckedAt,
+
+		AgentVersion:  m.AgentVersion,
+		AgentProtocol: m.AgentProtocol,
+		ServerVersion: m.ServerVersion,
+		ServerCommit:  m.ServerCommit,
+		AgentSeenAt:   m.AgentSeenAt,
+
+		CreatedAt: m.CreatedAt,
+		UpdatedAt: m.UpdatedAt,
+	}
+
+	// Machines which never reported their disks have none, rather than null
+	described.Disks = make([]Disk, len(m.Disks))
+	for i, disk := range m.Disks {
+		described.Disks[i] = Disk{Device: disk.Device, Size: disk.Size, UUID: disk.UUID, Serial: disk.Serial}
+	}
+
+	return described
+}
+
+// NewMachines describes a list of machines, an empty list is an empty array rather than null
+func NewMachines(machines []machine.MachineModel) []Machine {
+	described := make([]Machine, len(machines))
+	for i := range machines {
+		described[i] = NewMachine(&machines[i])
+	}
+
+	return described
+}
+
+// MachineGroup describes the settings of a group of machines
+type MachineGroup struct {
+	Name         string       `json:"Name"`
+	DefaultImage DefaultImage `json:"DefaultImage"`
+	Verify       string       `json:"Verify"`
+
+	CreatedAt time.Time `json:"CreatedAt"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+}
+
+// NewMachineGroup describes the settings of a group of machines
+func NewMachineGroup(g *machine.MachineGroup) MachineGroup {
+	return MachineGroup{
+		Name:         g.Name,
+		DefaultImage: DefaultImage(g.DefaultImage),
+		Verify:       g.Verify,
+		CreatedAt:    g.CreatedAt,
+		UpdatedAt:    g.UpdatedAt,
+	}
+}
+
+// NewMachineGroups describes a list of groups, an empty list is an empty array rather than null
+func NewMachineGroups(groups []machine.MachineGroup) []MachineGroup {
+	described := make([]MachineGroup, len(groups))
+	for i := range groups {
+		described[i] = NewMachineGroup(&groups[i])
+	}
+
+	return described
+}
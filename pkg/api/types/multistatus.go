@@ -0,0 +1,98 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ItemStatus is what happened to a single item of a bulk request
+type ItemStatus string
+
+const (
+	// ItemSucceeded items were done
+	ItemSucceeded ItemStatus = "succeeded"
+	// ItemFailed items were not done, the error code and message tell why
+	ItemFailed ItemStatus = "failed"
+	// ItemSkipped items needed nothing done, or were left alone because of the items which failed
+	ItemSkipped ItemStatus = "skipped"
+)
+
+// MultiStatusItem is the outcome of a single item of a bulk request
+type MultiStatusItem struct {
+	// ID is the item as the caller knows it, such as the MAC address of a machine
+	ID     string     `json:"id"`
+	Status ItemStatus `json:"status"`
+	// ErrorCode is the status the item would have gotten on its own, in snake case, such as "forbidden". It is only
+	// set for the items which failed.
+	ErrorCode string `json:"error_code,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// Before and After are what the item was and became, for the bulk requests which change existing items
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// MultiStatus is the response of every bulk request, which can partly succeed. The items are in the order of the
+// request, so they can be matched up by their index as well.
+type MultiStatus struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Skipped   int               `json:"skipped"`
+	Items     []MultiStatusItem `json:"items"`
+}
+
+// NewMultiStatus creates the response of a bulk request which has no items yet
+func NewMultiStatus() *MultiStatus {
+	return &MultiStatus{Items: []MultiStatusItem{}}
+}
+
+// Add appends the outcome of the next item and counts it
+func (m *MultiStatus) Add(item MultiStatusItem) {
+	switch item.Status {
+	case ItemSucceeded:
+		m.Succeeded++
+	case ItemFailed:
+		m.Failed++
+	case ItemSkipped:
+		m.Skipped++
+	}
+
+	m.Items = append(m.Items, item)
+}
+
+// Succeed appends an item which was done, the message may tell how
+func (m *MultiStatus) Succeed(id string, message string) {
+	m.Add(MultiStatusItem{ID: id, Status: ItemSucceeded, Message: message})
+}
+
+// Fail appends an item which was not done, status is what the item would have gotten on its own
+func (m *MultiStatus) Fail(id string, status int, message string) {
+	m.Add(MultiStatusItem{ID: id, Status: ItemFailed, ErrorCode: ErrorCode(status), Message: message})
+}
+
+// Skip appends an item which was left alone
+func (m *MultiStatus) Skip(id string, message string) {
+	m.Add(MultiStatusItem{ID: id, Status: ItemSkipped, Message: message})
+}
+
+// StatusCode is 200 OK when none of the items failed and 207 Multi-Status when some did
+func (m *MultiStatus) StatusCode() int {
+	if m.Failed > 0 {
+		return http.StatusMultiStatus
+	}
+
+	return http.StatusOK
+}
+
+// ErrorCode is the error code of an HTTP status, 409 Conflict is "conflict"
+func ErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package types
+
+// Page is a page of a paginated listing, every listing answers with the same envelope. The control server fills
+// Items with a slice of the entries, clients point it at what the entries are decoded into.
+type Page struct {
+	Items interface{}
+
+	// Total is the number of entries matching the filters across all pages, listings paginated with a cursor do not
+	// count them and leave it out
+	Total *int64 `json:",omitempty"`
+	// Limit is the most entries a page holds
+	Limit int
+	// Offset is the number of entries before this page, it is left out by listings paginated with a cursor
+	Offset int `json:",omitempty"`
+
+	// Next and Prev are the URIs of the pages after and before this one, they are left out at the ends of the
+	// listing. The same URIs are in the Link header of the response.
+	Next string `json:",omitempty"`
+	Prev string `json:",omitempty"`
+}
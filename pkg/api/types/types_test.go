@@ -0,0 +1,175 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// keys returns the keys of the JSON object v is encoded as
+func keys(t *testing.T, v interface{}) []string {
+	encoded, err := json.Marshal(v)
+	assert.NoError(t, err)
+
+	var object map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(encoded, &object))
+
+	found := []string{}
+	for key := range object {
+		found = append(found, key)
+	}
+	sort.Strings(found)
+	return found
+}
+
+// TestKeys pins what is sent to the clients. A key showing up here means a field was added to a response, make sure
+// it is meant to be seen by whoever can fetch the resource before adding it to the list.
+func TestKeys(t *testing.T) {
+	now := time.Now()
+	version := images.Version{Model: gorm.Model{ID: 7, CreatedAt: now}, Version: 1, ImageModelUUID: "gentoo",
+		Size: 4096, SHA256: "5a1f"}
+	image := images.ImageModel{Name: "Gentoo", UUID: "gentoo", Username: "jan", ImagePath: "/srv/baas",
+		Versions: []images.Version{version}, Placement: "fast", Course: "os", VersionCount: 1,
+		DeletedAt: gorm.DeletedAt{Time: now, Valid: true}}
+	imageKeys := []string{"Architecture", "BaseOS", "Checksum", "Course", "CreatedAt", "DeletedAt", "Description",
+		"DiskCompressionStrategy", "DiskUUID", "Filesystem", "HasVersions", "Icon", "ImageFileType", "License",
+		"LicenseName", "Name", "Placement", "Public", "SourceNotes", "SourceURL", "Tier", "Type", "UUID", "UpdatedAt",
+		"Username", "VersionCount", "Versions"}
+	versionKeys := []string{"Corrupt", "CreatedAt", "ImageModelUUID", "SHA256", "Size", "UpdatedAt", "Version"}
+
+	revoked := now
+	u := user.UserModel{Username: "jan", Name: "Jan", Email: "jan@example.com", Role: user.Admin,
+		SessionsRevokedAt: &revoked, MergedInto: "janneke", Disabled: true, LDAPRole: user.User,
+		Identities: []user.IdentityModel{{ProviderID: "12"}}, SSHKeys: []user.SSHKeyModel{{Key: "ssh-ed25519"}}}
+
+	m := machine.MachineModel{Name: "Machine 1", MacAddress: util.MacAddress{Address: "00:11:22:33:44:55"},
+		Disks: []machine.DiskModel{{ID: 3, MachineMAC: "00:11:22:33:44:55", Device: "/dev/sda"}}}
+
+	setup := images.ImageSetup{Name: "Course", Username: "jan", UUID: "setup", TargetDevice: "/dev/sda",
+		SSHAuthorizedKeys: images.StringList{"ssh-ed25519"},
+		Images: []images.ImageFrozen{{Image: image, Version: version, UUIDImage: "gentoo", VersionID: 7,
+			Selector: images.VersionLatest, TargetDevice: "/dev/sdb", Peer: &images.PeerSource{}}}}
+
+	set := images.ImageSet{UUID: "set", Name: "Course", Username: "jan",
+		Members: []images.ImageSetMember{{ID: 2, ImageSetUUID: "set", Position: 1, Image: image, ImageUUID: "gentoo",
+			Version: images.VersionLatest, TargetDevice: "/dev/sdb"}}}
+
+	for name, tc := range map[string]struct {
+		value    interface{}
+		expected []string
+	}{
+		"user": {NewUser(&u), []string{"CreatedAt", "Disabled", "Email", "LDAPRole", "MergedInto", "Name", "Role",
+			"UpdatedAt", "Username"}},
+		"image":   {NewImage(&image), imageKeys},
+		"version": {NewImageVersion(&version), versionKeys},
+		"machine": {NewMachine(&m), []string{"Architecture", "ClockSkewMillis", "CreatedAt", "DefaultImage", "Dirty",
+			"Disks", "Group",
+			"ImageUUID", "MacAddress", "Managed", "Name", "Restricted", "Status", "TargetDevice", "UpdatedAt"}},
+		"default image": {NewMachine(&m).DefaultImage, []string{"BootMode", "ImageUUID"}},
+		"machine group": {NewMachineGroup(&machine.MachineGroup{Name: "lab"}), []string{"CreatedAt", "DefaultImage",
+			"Name", "UpdatedAt", "Verify"}},
+		"mac address": {NewMachine(&m).MacAddress, []string{"Address"}},
+		"disk":        {NewMachine(&m).Disks[0], []string{"Device", "Serial", "Size", "UUID"}},
+		"image setup": {NewImageSetup(&setup), []string{"Images", "Name", "UUID", "Username"}},
+		"frozen image": {NewImageSetup(&setup).Images[0], []string{"Image", "Selector", "TargetDevice", "Update",
+			"Version"}},
+		"image set":        {NewImageSet(&set), []string{"Members", "Name", "UUID", "Username"}},
+		"image set member": {NewImageSet(&set).Members[0], []string{"ImageUUID", "TargetDevice", "Version"}},
+		"ssh key": {NewSSHKey(&user.SSHKeyModel{ID: 1, Username: "jan", Key: "ssh-ed25519"}),
+			[]string{"CreatedAt", "Fingerprint", "ID", "Key", "Username"}},
+		"identity": {NewIdentities([]user.IdentityModel{{ID: 1, Provider: user.ProviderGitHub}})[0],
+			[]string{"CreatedAt", "ID", "Login", "Provider", "ProviderID", "Username"}},
+		"session": {NewSessions([]user.SessionModel{{ID: "a", AnomalyAt: &now,
+			Scopes: images.StringList{string(user.ScopeImagesRead)}}}, "a")[0],
+			[]string{"AnomalyAt", "CreatedAt", "CreatedFrom", "Current", "ExpiresAt", "ID", "Kind", "LastUsedAt",
+				"LastUsedFrom", "Scopes", "UserAgent", "Username"}},
+	} {
+		assert.Equal(t, tc.expected, keys(t, tc.value), name)
+	}
+
+	// The versions nested in images and image setups are described the same way
+	assert.Equal(t, versionKeys, keys(t, NewImage(&image).Versions[0]))
+	assert.Equal(t, imageKeys, keys(t, NewImageSetup(&setup).Images[0].Image))
+}
+
+func TestEmptyLists(t *testing.T) {
+	for name, v := range map[string]interface{}{
+		"users":      NewUsers(nil),
+		"images":     NewImages(nil),
+		"machines":   NewMachines(nil),
+		"groups":     NewMachineGroups(nil),
+		"setups":     NewImageSetups(nil),
+		"sets":       NewImageSets(nil),
+		"ssh keys":   NewSSHKeys(nil),
+		"identities": NewIdentities(nil),
+		"sessions":   NewSessions(nil, ""),
+		"disks":      NewMachine(&machine.MachineModel{}).Disks,
+	} {
+		encoded, err := json.Marshal(v)
+		assert.NoError(t, err)
+		assert.Equal(t, "[]", string(encoded), name)
+	}
+
+	// Images without versions have an empty list of them, like the summaries which only count them
+	for _, image := range []images.ImageModel{{}, {VersionCount: 2}} {
+		described := NewImage(&image)
+		encoded, err := json.Marshal(described.Versions)
+		assert.NoError(t, err)
+		assert.Equal(t, "[]", string(encoded))
+		assert.Equal(t, image.VersionCount, described.VersionCount)
+		assert.Equal(t, image.VersionCount != 0, described.HasVersions)
+	}
+}
+
+func TestBackupStatus(t *testing.T) {
+	for status, encoded := range map[BackupStatus]string{BackupStatusDone: `{"BackedUp":true}`,
+		BackupStatusFailed: `{"BackedUp":false}`, BackupStatusPending: `{"BackedUp":"pending"}`, "": `{}`} {
+		value := struct {
+			BackedUp BackupStatus `json:",omitempty"`
+		}{status}
+		b, err := json.Marshal(value)
+		assert.NoError(t, err)
+		assert.Equal(t, encoded, string(b))
+
+		value.BackedUp = ""
+		assert.NoError(t, json.Unmarshal(b, &value))
+		assert.Equal(t, status, value.BackedUp)
+	}
+}
+
+func TestMultiStatus(t *testing.T) {
+	result := NewMultiStatus()
+	b, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"succeeded": 0, "failed": 0, "skipped": 0, "items": []}`, string(b))
+	assert.Equal(t, http.StatusOK, result.StatusCode())
+
+	result.Succeed("a", "")
+	result.Skip("b", "unchanged")
+	assert.Equal(t, http.StatusOK, result.StatusCode())
+
+	result.Fail("c", http.StatusUnprocessableEntity, "no room")
+	assert.Equal(t, http.StatusMultiStatus, result.StatusCode())
+	assert.Equal(t, []string{"error_code", "id", "message", "status"}, keys(t, result.Items[2]))
+	assert.Equal(t, "unprocessable_entity", result.Items[2].ErrorCode)
+	assert.Equal(t, []string{"a", "b", "c"}, []string{result.Items[0].ID, result.Items[1].ID, result.Items[2].ID})
+	assert.Equal(t, 1, result.Succeeded)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 1, result.Failed)
+
+	assert.Equal(t, "im_a_teapot", ErrorCode(http.StatusTeapot))
+	assert.Equal(t, "error", ErrorCode(599))
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package types defines how the control server describes its resources to clients. The database models are
+// converted into these, so columns added to the models are not sent along until they are added here as well.
+package types
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// User describes a user, the relations and the bookkeeping of the sessions are left out
+type User struct {
+	Username string        `json:"Username"`
+	Name     string        `json:"Name"`
+	Email    string        `json:"Email"`
+	Role     user.UserRole `json:"Role"`
+
+	MergedInto string        `json:"MergedInto,omitempty"`
+	Disabled   bool          `json:"Disabled,omitempty"`
+	LDAPRole   user.UserRole `json:"LDAPRole,omitempty"`
+
+	CreatedAt time.Time `json:"CreatedAt"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+}
+
+// NewUser describes a user
+func NewUser(u *user.UserModel) User {
+	return User{
+		Username:   u.Username,
+		Name:       u.Name,
+		Email:      u.Email,
+		Role:       u.Role,
+		MergedInto: u.MergedInto,
+		Disabled:   u.Disabled,
+		LDAPRole:   u.LDAPRole,
+		CreatedAt:  u.CreatedAt,
+		UpdatedAt:  u.UpdatedAt,
+	}
+}
+
+// NewUsers describes a list of users, an empty list is an empty array rather than null
+func NewUsers(users []user.UserModel) []User {
+	described := make([]User, len(users))
+	for i := range users {
+		described[i] = NewUser(&users[i])
+	}
+
+	return described
+}
+
+// SSHKey describes a public key of a user, the ID is what removes it
+type SSHKey struct {
+	ID          uint      `json:"ID"`
+	Username    string    `json:"Username"`
+	Key         string    `json:"Key"`
+	Fingerprint string    `json:"Fingerprint"`
+	CreatedAt   time.Time `json:"CreatedAt"`
+}
+
+// NewSSHKey describes a public key
+func NewSSHKey(key *user.SSHKeyModel) SSHKey {
+	return SSHKey{
+		ID:          key.ID,
+		Username:    key.Username,
+		Key:         key.Key,
+		Fingerprint: key.Fingerprint,
+		CreatedAt:   key.CreatedAt,
+	}
+}
+
+// NewSSHKeys describes the public keys of a user
+func NewSSHKeys(keys []user.SSHKeyModel) []SSHKey {
+	described := make([]SSHKey, len(keys))
+	for i := range keys {
+		described[i] = NewSSHKey(&keys[i])
+	}
+
+	return described
+}
+
+// Identity describes an account at an OAuth provider which logs in as a user
+type Identity struct {
+	ID         uint               `json:"ID"`
+	Provider   user.OAuthProvider `json:"Provider"`
+	ProviderID string             `json:"ProviderID"`
+	Login      string             `json:"Login"`
+	Username   string             `json:"Username"`
+	CreatedAt  time.Time          `json:"CreatedAt"`
+}
+
+// NewIdentities describes the identities of a user
+func NewIdentities(identities []user.IdentityModel) []Identity {
+	described := make([]Identity, len(identities))
+	for i, identity := range identities {
+		described[i] = Identity{
+			ID:         identity.ID,
+			Provider:   identity.Provider,
+			ProviderID: identity.ProviderID,
+			Login:      identity.Login,
+			Username:   identity.Username,
+			CreatedAt:  identity.CreatedAt,
+		}
+	}
+
+	return described
+}
+
+// Session describes where a session of a user was created and last used from. Current marks the session the
+// request was made with.
+type Session struct {
+	ID           string           `json:"ID"`
+	Username     string           `json:"Username"`
+	Kind         user.SessionKind `json:"Kind"`
+	Current      bool             `json:"Current"`
+	CreatedFrom  string           `json:"CreatedFrom"`
+	UserAgent    string           `json:"UserAgent"`
+	LastUsedFrom string           `json:"LastUsedFrom"`
+	LastUsedAt   time.Time        `json:"LastUsedAt"`
+	AnomalyAt    *time.Time       `json:"AnomalyAt,omitempty"`
+	Scopes       []string         `json:"Scopes,omitempty"`
+	ExpiresAt    time.Time        `json:"ExpiresAt"`
+	CreatedAt    time.Time        `json:"CreatedAt"`
+}
+
+// NewSessions describes the sessions of a user, current is the ID of the session of the request
+func NewSessions(sessions []user.SessionModel, current string) []Session {
+	described := make([]Session, len(sessions))
+	for i, session := range sessions {
+		described[i] = Session{
+			ID:           session.ID,
+			Username:     session.Username,
+			Kind:         session.Kind,
+			Current:      session.ID == current,
+			CreatedFrom:  session.CreatedFrom,
+			UserAgent:    session.UserAgent,
+			LastUsedFrom: session.LastUsedFrom,
+			LastUsedAt:   session.LastUsedAt,
+			AnomalyAt:    session.AnomalyAt,
+			Scopes:       session.Scopes,
+			ExpiresAt:    session.ExpiresAt,
+			CreatedAt:    session.CreatedAt,
+		}
+	}
+
+	return described
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PartialError is returned for a bulk request of which some items failed, Result tells which
+type PartialError struct {
+	Result *types.MultiStatus
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of the %d items failed", e.Result.Failed, len(e.Result.Items))
+}
+
+// CheckPartial is a PartialError when any item of a bulk request failed, unless that is allowed
+func CheckPartial(result *types.MultiStatus, allowPartial bool) error {
+	if result.Failed == 0 || allowPartial {
+		return nil
+	}
+
+	return &PartialError{Result: result}
+}
+
+// BootMachineGroup queues a boot setup on every machine of a group, the result lists the machines by name
+func (a *Client) BootMachineGroup(group string, bootSetup *images.BootSetup, override bool) (*types.MultiStatus,
+	error) {
+	body, err := json.Marshal(bootSetup)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't serialize boot setup")
+	}
+
+	uri := fmt.Sprintf("/machine-group/%s/boot", neturl.PathEscape(group))
+	if override {
+		uri += "?override=true"
+	}
+
+	return a.bulk(http.MethodPost, uri, "application/json", bytes.NewReader(body))
+}
+
+// ImportMachines registers the machines of a CSV or dnsmasq leases file, the format is guessed when it is empty.
+// When any row is wrong nothing is imported and the error is a PartialError, whose result tells which rows.
+func (a *Client) ImportMachines(file io.Reader, format string, updateExisting bool) (*types.MultiStatus, error) {
+	query := neturl.Values{}
+	if format != "" {
+		query.Set("format", format)
+	}
+	if updateExisting {
+		query.Set("update_existing", strconv.FormatBool(updateExisting))
+	}
+
+	uri := "/machines/import"
+	if len(query) != 0 {
+		uri += "?" + query.Encode()
+	}
+
+	result, err := a.bulk(http.MethodPost, uri, "text/csv", file)
+	if err == nil && result.Failed > 0 {
+		return result, &PartialError{Result: result}
+	}
+
+	return result, err
+}
+
+// bulk sends a bulk request and reads its multi-status response. Requests which are refused as a whole, with 422
+// Unprocessable Entity, still say why for each item.
+func (a *Client) bulk(method string, uri string, contentType string, body io.Reader) (*types.MultiStatus, error) {
+	url := a.baseURL + uri
+	log.Debugf("Sending bulk request to %s", url)
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create bulk request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", contentType)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed sending bulk request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusMultiStatus, http.StatusUnprocessableEntity:
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("bulk request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	result := types.NewMultiStatus()
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, errors.Wrap(err, "couldn't read the bulk response")
+	}
+
+	return result, nil
+}
+
+// defaultColor is the ANSI color of the terminal itself
+const defaultColor = 39
+
+// itemColors are the ANSI colors of the statuses of the items
+var itemColors = map[types.ItemStatus]int{
+	types.ItemSucceeded: 32,
+	types.ItemFailed:    31,
+	types.ItemSkipped:   33,
+}
+
+// WriteMultiStatus prints the items of a bulk request as a table, followed by the counts. The statuses are colored
+// for terminals.
+func WriteMultiStatus(w io.Writer, result *types.MultiStatus, color bool) error {
+	// The table counts the escape codes as text, so the whole column gets codes of the same length
+	colorize := func(text string, code int) string {
+		if !color {
+			return text
+		}
+		if code == 0 {
+			code = defaultColor
+		}
+		return fmt.Sprintf("\x1b[%dm%s\x1b[0m", code, text)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "ID\t%s\tCODE\tMESSAGE\n", colorize("STATUS", defaultColor))
+	for _, item := range result.Items {
+		status := colorize(string(item.Status), itemColors[item.Status])
+
+		code := item.ErrorCode
+		if code == "" {
+			code = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", item.ID, status, code, item.Message)
+	}
+
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%d succeeded, %d failed, %d skipped\n", result.Succeeded, result.Failed,
+		result.Skipped)
+	return err
+}
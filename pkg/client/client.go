@@ -0,0 +1,874 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client talks to the control server the way the machines do, it is used by the management OS and by the
+// machine simulator
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/baas-project/baas/pkg/api"
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/pki"
+
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+// maxDownloadAttempts is how often a download is tried while the server is busy, before flashing is given up on.
+// Uploads are offered as often.
+const maxDownloadAttempts = 30
+
+// Client is the client for all communication with the server
+type Client struct {
+	baseURL string
+	client  *http.Client
+	// caFingerprint lists the CA certificates the control server is verified with, it is empty over plain HTTP
+	caFingerprint string
+	// agentVersion is the release of the management OS agent using the client, it is empty for other tools
+	agentVersion string
+}
+
+// New creates a client for the control server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		client:  &http.Client{},
+	}
+}
+
+// UseTLS talks to the control server at baseURL from now on, verifying its certificate with the CA bundle
+func (a *Client) UseTLS(baseURL string, bundle []byte) error {
+	certs, err := pki.ParseBundle(bundle)
+	if err != nil {
+		return errors.Wrap(err, "invalid CA bundle")
+	}
+
+	roots := x509.NewCertPool()
+	for _, cert := range certs {
+		roots.AddCert(cert)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+	a.baseURL = baseURL
+	a.client = &http.Client{Transport: transport}
+	a.caFingerprint = pki.Fingerprints(certs)
+	return nil
+}
+
+// CAFingerprint lists the CA certificates the control server is verified with, it is empty over plain HTTP
+func (a *Client) CAFingerprint() string {
+	return a.caFingerprint
+}
+
+// FetchCA downloads the CA bundle of the control server. Over plain HTTP nothing vouches for it, over TLS the CA
+// which is already trusted does.
+func (a *Client) FetchCA() ([]byte, error) {
+	url := a.baseURL + "/pki/ca.pem"
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed fetching the CA")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading the CA")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetching the CA failed (%s) from %s", strings.TrimSpace(string(body)), url)
+	}
+
+	return body, nil
+}
+
+// IdentifyAgent makes the client tell the control server which release of the agent it is, and which protocol it
+// speaks, when it claims a boot and sends heartbeats
+func (a *Client) IdentifyAgent(version string) {
+	a.agentVersion = version
+}
+
+// setAgentHeaders adds the release and the protocol of the agent to a request, if the client identified one
+func (a *Client) setAgentHeaders(req *http.Request) {
+	if a.agentVersion == "" {
+		return
+	}
+
+	req.Header.Set(api.AgentVersionHeader, a.agentVersion)
+	req.Header.Set(api.ProtocolHeader, strconv.FormatUint(uint64(api.ProtocolVersion), 10))
+}
+
+// ErrProtocolUnsupported is returned by BootInform when the control server needs a newer agent
+var ErrProtocolUnsupported = errors.New("the control server does not support the protocol of this agent")
+
+// ErrNoBootSetup is returned by BootInform when nothing is queued for the machine and it has no default image
+var ErrNoBootSetup = errors.New("no boot setup found")
+
+// BootInform informs the server that we have booted, image is the image picked from the boot menu if any
+func (a *Client) BootInform(mac string, image images.ImageUUID) (*images.ImageSetup, error) {
+	url := fmt.Sprintf("%s/machine/%s/boot", a.baseURL, mac)
+	if image != "" {
+		url += "?image=" + neturl.QueryEscape(string(image))
+	}
+	log.Debugf("Sending boot inform request to %s", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Errorf("Cannot create request: %v", err)
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	// The boot history keeps which CA the control server was verified with
+	if a.caFingerprint != "" {
+		req.Header.Set("X-BAAS-CA-Fingerprint", a.caFingerprint)
+	}
+	a.setAgentHeaders(req)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed sending inform request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound && image == "" {
+		return nil, ErrNoBootSetup
+	}
+
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		var refusal api.ProtocolError
+		if err = json.NewDecoder(resp.Body).Decode(&refusal); err != nil {
+			return nil, ErrProtocolUnsupported
+		}
+		return nil, errors.Wrapf(ErrProtocolUnsupported, "protocol %d, at least %d is needed, update the agent from %s",
+			refusal.Protocol, refusal.MinimumProtocol, refusal.UpdateURL)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("inform request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	var info images.ImageSetup
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, errors.Wrap(err, "couldn't deserialize inform request response")
+	}
+
+	return &info, nil
+}
+
+// ErrMachineExists is returned by RegisterMachine when a machine with the MAC address is registered already
+var ErrMachineExists = errors.New("the machine is registered already")
+
+// RegisterMachine adds a machine to the control server
+func (a *Client) RegisterMachine(m *machine.MachineModel) error {
+	url := a.baseURL + "/machine"
+	log.Debugf("Registering machine %s at %s", m.MacAddress.Address, url)
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "couldn't serialize machine")
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create machine request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed registering machine")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return ErrMachineExists
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("machine request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+}
+
+// ReportInventory sends the hardware found in this machine to the control server
+func (a *Client) ReportInventory(mac string, inventory *machine.Inventory) error {
+	url := fmt.Sprintf("%s/machine/%s/inventory", a.baseURL, mac)
+	log.Debugf("Sending inventory to %s", url)
+
+	body, err := json.Marshal(inventory)
+	if err != nil {
+		return errors.Wrap(err, "couldn't serialize inventory")
+	}
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create inventory request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed sending inventory")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("inventory request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	return nil
+}
+
+// Join registers this machine with the join token, when the control server does not know it yet. Machines which
+// are still pending get a key to use with PendingInventory and Registration.
+func (a *Client) Join(mac string, architecture string, token string) (*machine.Registration, error) {
+	body, err := json.Marshal(struct{ Architecture string }{architecture})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't serialize registration")
+	}
+
+	var registration machine.Registration
+	if err = a.registration(http.MethodPost, "/register/"+mac, token, body, &registration); err != nil {
+		return nil, err
+	}
+
+	return &registration, nil
+}
+
+// Registration asks the control server whether this machine was approved since it registered
+func (a *Client) Registration(mac string, key string) (*machine.Registration, error) {
+	var registration machine.Registration
+	if err := a.registration(http.MethodGet, "/register/"+mac, key, nil, &registration); err != nil {
+		return nil, err
+	}
+
+	return &registration, nil
+}
+
+// PendingInventory sends the hardware found in this machine to the control server while it waits for approval
+func (a *Client) PendingInventory(mac string, key string, inventory *machine.Inventory) error {
+	body, err := json.Marshal(inventory)
+	if err != nil {
+		return errors.Wrap(err, "couldn't serialize inventory")
+	}
+
+	return a.registration(http.MethodPut, "/register/"+mac+"/inventory", key, body, nil)
+}
+
+// registration sends a request to the routes a machine registers itself with, which take the join token or the
+// key of the machine rather than the system header
+func (a *Client) registration(method string, path string, token string, body []byte, result interface{}) error {
+	url := a.baseURL + path
+	log.Debugf("Sending registration request to %s", url)
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create registration request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed sending registration request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("registration request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(result), "couldn't deserialize registration")
+}
+
+// ClaimCommands fetches the diagnostics the control server wants this machine to run
+func (a *Client) ClaimCommands(mac string) ([]machine.MachineCommand, error) {
+	url := fmt.Sprintf("%s/machine/%s/commands/claim", a.baseURL, mac)
+
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create commands request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed sending commands request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("commands request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	var commands []machine.MachineCommand
+	if err = json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, errors.Wrap(err, "couldn't read the commands")
+	}
+
+	return commands, nil
+}
+
+// SetCommandResult reports what a diagnostic the control server asked for found
+func (a *Client) SetCommandResult(mac string, id uint, result *machine.CommandResult) error {
+	url := fmt.Sprintf("%s/machine/%s/commands/%d/result", a.baseURL, mac, id)
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "couldn't serialize command result")
+	}
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create command result request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed sending command result")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("command result request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	return nil
+}
+
+// SpeedTest downloads the test data of the control server and returns how many bytes it read in how long, it
+// stops when ctx is done
+func (a *Client) SpeedTest(ctx context.Context, mac string) (int64, time.Duration, error) {
+	url := fmt.Sprintf("%s/machine/%s/speedtest", a.baseURL, mac)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "couldn't create speedtest request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	start := time.Now()
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed sending speedtest request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return 0, 0, errors.Errorf("speedtest request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	return n, time.Since(start), errors.Wrap(err, "speedtest download failed")
+}
+
+// ErrNotModified is returned by DownloadDiskHTTP when the copy the machine holds is the version the server stores
+var ErrNotModified = errors.New("the version is not modified")
+
+// StoredVersion describes the file the control server stores for a version of an image
+type StoredVersion struct {
+	// Size is the number of bytes which are downloaded
+	Size int64
+	// SHA256 is the checksum of the download, empty when the server does not know it
+	SHA256 string
+}
+
+// DescribeDiskHTTP asks the control server for the size and checksum of a version without downloading it
+func (a *Client) DescribeDiskHTTP(uuid images.ImageUUID, version uint64) (*StoredVersion, error) {
+	url := fmt.Sprintf("%s/image/%s/%d", a.baseURL, uuid, version)
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create the request")
+	}
+
+	req.Header.Set("type", "system")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed describing the disk")
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("describing the disk failed (%s) for %s", resp.Status, url)
+	}
+
+	return &StoredVersion{
+		Size:   resp.ContentLength,
+		SHA256: strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
+}
+
+// DownloadDiskHTTP Downloads a disk image from the control_server over HTTP. When the server is busy with other
+// downloads it is asked again after the time it gives, with some jitter so the machines do not return all at once.
+// A checksum of the copy the machine already holds is sent along, when the server stores the same file
+// ErrNotModified is returned instead of downloading it.
+func (a *Client) DownloadDiskHTTP(uuid images.ImageUUID, version uint64, held string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s/image/%s/%d", a.baseURL, uuid, version)
+	log.Infof("downloading disk %v over http from %s", uuid, url)
+
+	for attempt := 1; ; attempt++ {
+		//nolint we are returning a readcloser so the body will be closed later
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			log.Errorf("Cannot create request: %v", err)
+		}
+
+		req.Header.Set("type", "system")
+		req.Header.Set("Origin", "http://localhost:9090")
+		if held != "" {
+			req.Header.Set("If-None-Match", `"`+held+`"`)
+		}
+		log.Warn(req.Header)
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "error dl disk")
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			_ = resp.Body.Close()
+			return nil, ErrNotModified
+		}
+
+		if resp.StatusCode == http.StatusServiceUnavailable && attempt < maxDownloadAttempts {
+			_ = resp.Body.Close()
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			log.Infof("The server is busy, downloading disk %v again in %s", uuid, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			return nil, errors.Errorf("http error while downloading disk (%s)", strings.TrimSpace(string(b)))
+		}
+
+		log.Debugf("done downloading disk %v over http", uuid)
+
+		return resp.Body, nil
+	}
+}
+
+// retryAfter is how long to wait before trying a busy server again, the Retry-After header plus up to half of it
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds <= 0 {
+		seconds = 10
+	}
+
+	wait := time.Duration(seconds) * time.Second
+	return wait + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// startedReader tells whether anything was read from a stream yet, an upload whose body was not sent can be offered
+// again
+type startedReader struct {
+	io.Reader
+	started bool
+}
+
+func (s *startedReader) Read(p []byte) (int, error) {
+	s.started = true
+	return s.Reader.Read(p)
+}
+
+// UploadDiskHTTP uploads a disk image given the http strategy, size is the uncompressed size of the image.
+// encryptedBoot is the boot whose key the disk is encrypted with, zero when the disk is not encrypted. The body is
+// only sent once the server accepts the upload, while it is busy the upload is offered again.
+func (a *Client) UploadDiskHTTP(r io.Reader, uuid string, size uint64, encryptedBoot uint) error {
+	url := fmt.Sprintf("%s/image/%s", a.baseURL, uuid)
+	log.Debugf("uploading disk %v over http to %s", uuid, url)
+
+	// Create a pipe, so we only pass around the streams, if we try to
+	// write the actual file or program will be reaped.
+	// Dammit Calli, leave my processes alone.
+	boundary := "ProfessorDrIngJanRellermeyer"
+	fileName := "image.img"
+	fileHeader := "Content-Type: application/octet-stream"
+	fileFormat := "--%s\r\nContent-Disposition: form-data; name=\"file\"; filename=\"%s\"\r\n%s\r\n\r\n"
+	filePart := fmt.Sprintf(fileFormat, boundary, fileName, fileHeader)
+
+	end := fmt.Sprintf("\r\n--%s\r\n", boundary)
+
+	for attempt := 1; ; attempt++ {
+		body := &startedReader{Reader: io.MultiReader(strings.NewReader(filePart), r, strings.NewReader(end))}
+
+		req, err := http.NewRequest("POST", url, body)
+		if err != nil {
+			return errors.Wrap(err, "error dl disk")
+		}
+
+		req.Header.Set("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", boundary))
+		req.Header.Set("Origin", "http://localhost:9090")
+		req.Header.Set("type", "system")
+		req.Header.Set("X-BAAS-NewVersion", "true")
+		req.Header.Set("X-BAAS-ImageSize", strconv.FormatUint(size, 10))
+		// The disk is read while it is sent, it can only be offered again when the server refused it before
+		req.Header.Set("Expect", "100-continue")
+		if encryptedBoot != 0 {
+			req.Header.Set("X-BAAS-Encrypted-Boot", strconv.FormatUint(uint64(encryptedBoot), 10))
+		}
+		resp, err := a.client.Do(req)
+
+		if err != nil {
+			return errors.Wrap(err, "upload disk")
+		}
+
+		if resp.StatusCode == http.StatusServiceUnavailable && !body.started && attempt < maxDownloadAttempts {
+			_ = resp.Body.Close()
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			log.Infof("The server is busy, uploading disk %v again in %s", uuid, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			return errors.Errorf("upload disk http (%s) to %s", strings.TrimSpace(string(b)), url)
+		}
+
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close reader (%v)", err)
+		}
+
+		log.Debugf("done uploading disk %v over http", uuid)
+
+		return nil
+	}
+}
+
+// BootHeartbeat tells the server that this machine is still flashing, which keeps the images locked. The images
+// this machine serves to other machines are sent along when peer is given. The control server answers whether the
+// boot was cancelled, older ones do not answer anything.
+func (a *Client) BootHeartbeat(mac string, peer *images.PeerHeartbeat) (*images.BootControl, error) {
+	url := fmt.Sprintf("%s/machine/%s/boot/heartbeat", a.baseURL, mac)
+
+	var body []byte
+	if peer != nil {
+		var err error
+		if body, err = json.Marshal(peer); err != nil {
+			return nil, errors.Wrap(err, "couldn't serialize heartbeat")
+		}
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create heartbeat request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", "application/json")
+	// The control server only checks our clock, it may not be set yet this early in the boot
+	req.Header.Set("X-BAAS-Clock", time.Now().Format(time.RFC3339Nano))
+	a.setAgentHeaders(req)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed sending heartbeat")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var control images.BootControl
+		if err = json.NewDecoder(resp.Body).Decode(&control); err != nil {
+			return nil, errors.Wrap(err, "couldn't read the heartbeat response")
+		}
+		return &control, nil
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("heartbeat failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+}
+
+// SetBootState reports whether flashing the images succeeded, which releases the locks on them. The report tells
+// which disks the images were written to and which versions, the control server fails image sets with missing ones.
+// It answers with the boot as it was recorded.
+func (a *Client) SetBootState(mac string, report *images.BootReport) (*images.BootHistory, error) {
+	url := fmt.Sprintf("%s/machine/%s/boot/state", a.baseURL, mac)
+	log.Debugf("Reporting boot state %s to %s", report.State, url)
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't serialize boot state")
+	}
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create boot state request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed sending boot state")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("boot state request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	var boot images.BootHistory
+	if err = json.NewDecoder(resp.Body).Decode(&boot); err != nil {
+		return nil, errors.Wrap(err, "couldn't read the boot state response")
+	}
+
+	return &boot, nil
+}
+
+// ReleaseBootKey fetches the passphrase of an encrypted boot of this machine, to decrypt its disks for the upload.
+// The control server only hands it out once.
+func (a *Client) ReleaseBootKey(mac string, bootID uint) (string, error) {
+	url := fmt.Sprintf("%s/machine/%s/boot/%d/key", a.baseURL, mac, bootID)
+	log.Debugf("Fetching the key of boot %d from %s", bootID, url)
+
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create boot key request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed sending boot key request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "", errors.Errorf("boot key request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	var key struct {
+		Passphrase string
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return "", errors.Wrap(err, "couldn't read the boot key")
+	}
+
+	return key.Passphrase, nil
+}
+
+// Artifact is a file attached to a boot, see UploadBootArtifacts
+type Artifact struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// UploadBootArtifacts attaches files to a boot of this machine, such as what was on the screen when it failed
+func (a *Client) UploadBootArtifacts(mac string, bootID uint, artifacts []Artifact) error {
+	url := fmt.Sprintf("%s/machine/%s/boot/%d/artifacts", a.baseURL, mac, bootID)
+	log.Debugf("Uploading %d boot artifacts to %s", len(artifacts), url)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, artifact := range artifacts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition",
+			fmt.Sprintf(`form-data; name="artifact"; filename=%q`, artifact.Name))
+		header.Set("Content-Type", artifact.ContentType)
+
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return errors.Wrap(err, "couldn't add boot artifact")
+		}
+
+		if _, err = part.Write(artifact.Content); err != nil {
+			return errors.Wrap(err, "couldn't add boot artifact")
+		}
+	}
+
+	if err := form.Close(); err != nil {
+		return errors.Wrap(err, "couldn't add boot artifact")
+	}
+
+	req, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create boot artifact request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed sending boot artifacts")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("boot artifact upload failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	return nil
+}
+
+// GetAgentUpdate asks which release of the agent this machine should run, it is nil when nothing is released
+func (a *Client) GetAgentUpdate(mac string, architecture string) (*agent.Update, error) {
+	url := fmt.Sprintf("%s/agent/latest?arch=%s&mac=%s", a.baseURL, architecture, mac)
+	log.Debugf("Checking for a new agent at %s", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create agent update request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed sending agent update request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("agent update request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	var update agent.Update
+	if err := json.NewDecoder(resp.Body).Decode(&update); err != nil {
+		return nil, errors.Wrap(err, "couldn't deserialize agent update")
+	}
+
+	return &update, nil
+}
+
+// DownloadAgent downloads a release of the agent, the path is the URL of the update
+func (a *Client) DownloadAgent(path string) (io.ReadCloser, error) {
+	url := a.baseURL + path
+	log.Infof("Downloading the agent from %s", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create agent download request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed downloading the agent")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("agent download failed (%s) from %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/api/types"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseLinks reads the URIs of a Link header (RFC 5988) by their relation, such as next and prev
+func ParseLinks(header string) map[string]string {
+	links := map[string]string{}
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		uri := strings.TrimSpace(parts[0])
+		if len(uri) < 2 || uri[0] != '<' || uri[len(uri)-1] != '>' {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			name, value := param, ""
+			if i := strings.Index(param, "="); i >= 0 {
+				name, value = param[:i], param[i+1:]
+			}
+
+			if strings.EqualFold(strings.TrimSpace(name), "rel") {
+				// A link can have several relations, separated by spaces
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+					links[strings.ToLower(rel)] = uri[1 : len(uri)-1]
+				}
+			}
+		}
+	}
+
+	return links
+}
+
+// fetchPage fetches a page of a listing and returns the URI of the next one, which is empty on the last page
+func (a *Client) fetchPage(uri string, items *json.RawMessage) (string, error) {
+	url := a.baseURL + uri
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create list request")
+	}
+
+	req.Header.Set("type", "system")
+	req.Header.Set("Origin", "http://localhost:9090")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed sending list request")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Failed to close body (%v)", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "", errors.Errorf("list request failed (%s) to %s", strings.TrimSpace(string(msg)), url)
+	}
+
+	page := types.Page{Items: items}
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return "", errors.Wrap(err, "couldn't read the page")
+	}
+
+	// The header and the body link the same pages, servers which only send one of them are followed as well
+	if next, ok := ParseLinks(resp.Header.Get("Link"))["next"]; ok {
+		return next, nil
+	}
+
+	return page.Next, nil
+}
+
+// EachPage walks through a paginated listing from the page at uri on, such as /image/{uuid}/versions?limit=100.
+// The entries of every page are handed to fn as JSON, the walk stops at the last page or when fn fails.
+func (a *Client) EachPage(uri string, fn func(items json.RawMessage) error) error {
+	for uri != "" {
+		var items json.RawMessage
+		next, err := a.fetchPage(uri, &items)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(items); err != nil {
+			return err
+		}
+
+		uri = next
+	}
+
+	return nil
+}
+
+// GetVersions lists all versions of an image, newest first
+func (a *Client) GetVersions(uuid images.ImageUUID) ([]types.ImageVersion, error) {
+	all := []types.ImageVersion{}
+	err := a.EachPage(fmt.Sprintf("/image/%s/versions", uuid), func(items json.RawMessage) error {
+		var versions []types.ImageVersion
+		if err := json.Unmarshal(items, &versions); err != nil {
+			return errors.Wrap(err, "couldn't read the versions")
+		}
+
+		all = append(all, versions...)
+		return nil
+	})
+
+	return all, err
+}
+
+// GetBootHistory lists all boots a machine claimed, newest first
+func (a *Client) GetBootHistory(mac string) ([]images.BootHistory, error) {
+	all := []images.BootHistory{}
+	err := a.EachPage(fmt.Sprintf("/machine/%s/history", mac), func(items json.RawMessage) error {
+		var boots []images.BootHistory
+		if err := json.Unmarshal(items, &boots); err != nil {
+			return errors.Wrap(err, "couldn't read the boot history")
+		}
+
+		all = append(all, boots...)
+		return nil
+	})
+
+	return all, err
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeyReleased is returned when the key of a boot is asked for once more after it was handed out
+var ErrKeyReleased = errors.New("the key of the boot was already handed out")
+
+// ErrNotReplica is returned when a database which does not copy a primary is promoted
+var ErrNotReplica = errors.New("the database is not a replica")
+
+// ErrPromoted is returned when a database which was promoted is made a replica again, it has changes of its own
+// which the primary would overwrite
+var ErrPromoted = errors.New("the database was promoted from a replica")
+
+// ConstraintKind is the kind of schema constraint a write violated
+type ConstraintKind string
+
+const (
+	// UniqueConstraint is violated by a write which duplicates a row that should be unique
+	UniqueConstraint ConstraintKind = "unique"
+	// ForeignKeyConstraint is violated by referencing a row which does not exist
+	ForeignKeyConstraint ConstraintKind = "foreign key"
+)
+
+// ConstraintError is returned by the store when a write conflicts with the data which is already stored
+type ConstraintError struct {
+	Kind ConstraintKind
+	// Columns are the columns of the constraint, if the database reports them
+	Columns string
+	Err     error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Columns == "" {
+		return fmt.Sprintf("%s constraint violated", e.Kind)
+	}
+
+	return fmt.Sprintf("%s constraint violated on %s", e.Kind, e.Columns)
+}
+
+// Unwrap returns the error reported by the database
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
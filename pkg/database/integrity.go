@@ -0,0 +1,55 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+import "github.com/baas-project/baas/pkg/model/images"
+
+// IntegrityReport lists the inconsistencies between the database and the image files on disk
+type IntegrityReport struct {
+	// OrphanedFiles are image files on disk which do not belong to any version
+	OrphanedFiles []string
+	// MissingFiles are versions whose file does not exist
+	MissingFiles []string
+	// DanglingReferences are rows pointing to rows which do not exist
+	DanglingReferences []DanglingReference
+	// NameCollisions are images of a user whose names only differ in case, they keep image names from being
+	// unique regardless of case until an admin renames or removes them
+	NameCollisions []NameCollision
+	// InvalidRoles are users whose role is not one a user can have, they cannot use the API until it is fixed
+	InvalidRoles []InvalidRole
+	// EmailCollisions are users sharing an email address when case is ignored, they are merged by an admin
+	EmailCollisions []EmailCollision
+}
+
+// EmailCollision is a group of users whose email addresses are equal when case is ignored
+type EmailCollision struct {
+	Email     string
+	Usernames []string
+}
+
+// InvalidRole is a user with a role which is not known
+type InvalidRole struct {
+	Username string
+	Role     string
+}
+
+// NameCollision is a group of images of the same user whose names are equal when case is ignored
+type NameCollision struct {
+	Username string
+	// Images are the names of the colliding images by their UUID
+	Images map[images.ImageUUID]string
+}
+
+// DanglingReference is a row in Table whose Column refers to a value which is missing from the referenced table
+type DanglingReference struct {
+	Table  string
+	Column string
+	Value  string
+	// Count is the number of rows with this dangling value
+	Count int64
+
+	// Repaired is set when the rows were removed, which is only done for rows which are useless on their own
+	Repaired bool
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// SortField is a time by which the rows of a listing are ordered
+type SortField string
+
+const (
+	// SortCreated orders the rows by when they were created
+	SortCreated SortField = "created"
+	// SortUpdated orders the rows by when they were last changed
+	SortUpdated SortField = "updated"
+)
+
+// ListOptions narrows down and orders listings which can grow large. The zero value lists everything, newest first.
+type ListOptions struct {
+	// Limit is the maximum number of rows returned, zero means no limit
+	Limit int
+	// Offset skips rows, it is used by listings paginated by offset
+	Offset int
+	// After continues a keyset paginated listing after the row with this ID, in the direction of the ordering
+	After uint
+
+	// Ascending lists the oldest rows first
+	Ascending bool
+	// Sort is the time the rows are ordered by, the order in which they were added when it is empty
+	Sort SortField
+
+	// Since and Until only include the rows created in this interval, a zero time leaves that side open
+	Since time.Time
+	Until time.Time
+}
+
+// BootFilter narrows down the boot history of a machine. The zero value finds every boot.
+type BootFilter struct {
+	// State only finds the boots in this state, such as the failed ones
+	State images.BootState
+	// Reason only finds the boots which did not complete for this reason
+	Reason images.FailureReason
+}
+
+// ImageFilter narrows down a search through the images of all users. The zero value finds every image outside the
+// trash.
+type ImageFilter struct {
+	// License only finds the images with this kind of license, Unlicensed those whose owner did not give one yet
+	License    images.LicenseKind
+	Unlicensed bool
+	// Public only finds the public images when it points to true, and the private ones when it points to false
+	Public *bool
+	// Username only finds the images of this user
+	Username string
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+// MergeResult counts what was moved from a duplicate user to the primary one
+type MergeResult struct {
+	Primary   string
+	Duplicate string
+
+	Images            int64
+	ImageSetups       int64
+	ImageSets         int64
+	MetadataTemplates int64
+	BootTemplates     int64
+	Identities        int64
+	SSHKeys           int64
+	// Renamed are the images and templates which got a suffix, since the primary user had one with the
+	// same name
+	Renamed int64
+}
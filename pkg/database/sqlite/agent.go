@@ -0,0 +1,54 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"errors"
+
+	"github.com/baas-project/baas/pkg/model/agent"
+	"gorm.io/gorm"
+)
+
+// CreateAgentRelease stores a new release of the agent
+func (s Store) CreateAgentRelease(release *agent.Release) error {
+	return s.Create(release).Error
+}
+
+// GetAgentRelease gets a release of the agent for an architecture
+func (s Store) GetAgentRelease(architecture string, version string) (*agent.Release, error) {
+	var release agent.Release
+	res := s.Where("architecture = ? AND version = ?", architecture, version).First(&release)
+	return &release, res.Error
+}
+
+// GetAgentReleases lists the releases of the agent for all architectures, newest first
+func (s Store) GetAgentReleases() ([]agent.Release, error) {
+	releases := []agent.Release{}
+	res := s.Order("architecture").Order("id DESC").Find(&releases)
+	return releases, res.Error
+}
+
+// GetAgentChannel gets the rollout of an architecture, without a stored channel nothing is released
+func (s Store) GetAgentChannel(architecture string) (*agent.Channel, error) {
+	channel := agent.Channel{Architecture: architecture}
+	err := s.Where("architecture = ?", architecture).First(&channel).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &channel, nil
+	}
+
+	return &channel, err
+}
+
+// GetAgentChannels lists the rollouts of all architectures
+func (s Store) GetAgentChannels() ([]agent.Channel, error) {
+	channels := []agent.Channel{}
+	res := s.Order("architecture").Find(&channels)
+	return channels, res.Error
+}
+
+// SetAgentChannel replaces the rollout of an architecture
+func (s Store) SetAgentChannel(channel *agent.Channel) error {
+	return s.Save(channel).Error
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm/clause"
+)
+
+// SetBackupPolicy replaces the backup policy of an image
+func (s Store) SetBackupPolicy(policy *images.BackupPolicy) error {
+	return s.Omit("Image").Clauses(clause.OnConflict{UpdateAll: true}).Create(policy).Error
+}
+
+// GetBackupPolicy gets the backup policy of an image
+func (s Store) GetBackupPolicy(uuid images.ImageUUID) (*images.BackupPolicy, error) {
+	var policy images.BackupPolicy
+	res := s.Where("image_uuid = ?", uuid).First(&policy)
+	return &policy, res.Error
+}
+
+// GetBackupPolicies gets the backup policies of all images
+func (s Store) GetBackupPolicies() ([]images.BackupPolicy, error) {
+	policies := []images.BackupPolicy{}
+	res := s.Order("image_uuid").Find(&policies)
+	return policies, res.Error
+}
+
+// DeleteBackupPolicy stops backing up an image
+func (s Store) DeleteBackupPolicy(uuid images.ImageUUID) error {
+	return s.Where("image_uuid = ?", uuid).Delete(&images.BackupPolicy{}).Error
+}
+
+// SaveVersionBackup records how the copy of a version went
+func (s Store) SaveVersionBackup(backup *images.VersionBackup) error {
+	return s.Omit("Image").Clauses(clause.OnConflict{UpdateAll: true}).Create(backup).Error
+}
+
+// GetVersionBackups gets the copies of the versions of an image
+func (s Store) GetVersionBackups(uuid images.ImageUUID) ([]images.VersionBackup, error) {
+	backups := []images.VersionBackup{}
+	res := s.Where("image_uuid = ?", uuid).Order("version").Find(&backups)
+	return backups, res.Error
+}
+
+// GetFailedVersionBackups gets the copies which failed at least once since they last succeeded, the ones which
+// failed last come first. The failures are listed from the read replica when there is one.
+func (s Store) GetFailedVersionBackups() ([]images.VersionBackup, error) {
+	backups := []images.VersionBackup{}
+	err := s.readOnly("failed_backups", func(db Store) error {
+		return db.Where("attempts > 0").Order("updated_at DESC").Find(&backups).Error
+	})
+	return backups, err
+}
+
+// DeleteVersionBackup forgets the copy of a version
+func (s Store) DeleteVersionBackup(uuid images.ImageUUID, version uint64) error {
+	return s.Where("image_uuid = ? AND version = ?", uuid, version).Delete(&images.VersionBackup{}).Error
+}
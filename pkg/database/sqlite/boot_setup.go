@@ -5,7 +5,11 @@
 package sqlite
 
 import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
 	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm"
 )
 
 // AddBootSetupToMachine adds a configuration for booting to the specified machine
@@ -13,20 +17,231 @@ func (s Store) AddBootSetupToMachine(bootSetup *images.BootSetup) error {
 	return s.Save(bootSetup).Error
 }
 
-// GetNextBootSetup fetches the first machine from the database.
-func (s Store) GetNextBootSetup(machineMAC string) (*images.BootSetup, error) {
-	var bootSetup images.BootSetup
-
-	res := s.Table("boot_setups").
-		Where("machine_mac = ?", machineMAC).
-		First(&bootSetup)
+// claimBootSetup removes the first boot setup the query finds from the queue and returns it. The queue is kept in
+// the order of the rowid, the id of boot setups is not filled in as it is part of a composite primary key.
+func (s Store) claimBootSetup(query *gorm.DB) (*images.BootSetup, error) {
+	var rowids []int64
+	res := query.Where("boot_setups.deleted_at IS NULL").
+		Order("boot_setups.rowid").
+		Limit(1).
+		Pluck("boot_setups.rowid", &rowids)
 
 	if res.Error != nil {
 		return nil, res.Error
 	}
 
+	if len(rowids) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var bootSetup images.BootSetup
+	if err := s.Where("rowid = ?", rowids[0]).First(&bootSetup).Error; err != nil {
+		return nil, err
+	}
+
 	// ORMs are so dumb
-	s.Exec("DELETE FROM `boot_setups` WHERE `id` = ?", bootSetup.ID)
+	s.Exec("DELETE FROM `boot_setups` WHERE `rowid` = ?", rowids[0])
+
+	return &bootSetup, nil
+}
+
+// GetNextBootSetup fetches the first machine from the database.
+func (s Store) GetNextBootSetup(machineMAC string) (*images.BootSetup, error) {
+	return s.claimBootSetup(s.Table("boot_setups").Where("machine_mac = ?", machineMAC))
+}
+
+// GetNextBootSetupWithImage fetches the first boot setup of the machine which flashes the image, skipping the ones
+// queued before it
+func (s Store) GetNextBootSetupWithImage(machineMAC string, uuid images.ImageUUID) (*images.BootSetup, error) {
+	return s.claimBootSetup(s.Table("boot_setups").
+		Joins("JOIN image_frozens ON image_frozens.image_setup_uuid = boot_setups.setup_uuid").
+		Where("boot_setups.machine_mac = ? AND image_frozens.uuid_image = ? AND image_frozens.deleted_at IS NULL",
+			machineMAC, uuid))
+}
+
+// GetBootSetups fetches the boot setups queued for a machine in the order they will be claimed
+func (s Store) GetBootSetups(machineMAC string) ([]images.BootSetup, error) {
+	bootSetups := []images.BootSetup{}
+	res := s.Where("machine_mac = ?", machineMAC).
+		Order("id").
+		Find(&bootSetups)
+
+	return bootSetups, res.Error
+}
+
+// RemoveBootSetup takes the boot of an image setup out of the queue of a machine
+func (s Store) RemoveBootSetup(machineMAC string, setupUUID images.ImageUUID) error {
+	return deleted(s.Unscoped().Where("machine_mac = ? AND setup_uuid = ?", machineMAC, setupUUID).
+		Delete(&images.BootSetup{}))
+}
+
+// GetBootSetupsByImage fetches the queued boot setups of all machines which contain a particular image
+func (s Store) GetBootSetupsByImage(uuid images.ImageUUID) ([]images.BootSetup, error) {
+	bootSetups := []images.BootSetup{}
+	res := s.Distinct("boot_setups.*").
+		Joins("JOIN image_frozens ON image_frozens.image_setup_uuid = boot_setups.setup_uuid").
+		Where("image_frozens.uuid_image = ? AND image_frozens.deleted_at IS NULL", uuid).
+		Find(&bootSetups)
+
+	return bootSetups, res.Error
+}
+
+// AddBootHistory records that a machine claimed a boot setup
+func (s Store) AddBootHistory(history *images.BootHistory) error {
+	return s.Create(history).Error
+}
+
+// GetBootHistory fetches the boot history of a machine, newest first unless the options ask otherwise
+func (s Store) GetBootHistory(machineMAC string, filter database.BootFilter,
+	opts database.ListOptions) ([]images.BootHistory, error) {
+	history := []images.BootHistory{}
+	db := s.Where("machine_mac = ?", machineMAC)
+	if filter.State != "" {
+		db = db.Where("state = ?", filter.State)
+	}
+	if filter.Reason != "" {
+		db = db.Where("failure_reason = ?", filter.Reason)
+	}
+
+	db = filterCreated(db, "boot_histories", opts)
+	res := paginate(db, "boot_histories", opts).Find(&history)
+
+	return history, res.Error
+}
+
+// GetBootHistoryByUsername fetches the boots of the image setups of a user on any machine
+func (s Store) GetBootHistoryByUsername(username string, opts database.ListOptions) ([]images.BootHistory, error) {
+	history := []images.BootHistory{}
+	db := s.Select("boot_histories.*").
+		Joins("JOIN image_setups ON image_setups.uuid = boot_histories.setup_uuid").
+		Where("image_setups.username = ?", username)
+	res := paginate(filterCreated(db, "boot_histories", opts), "boot_histories", opts).Find(&history)
+
+	return history, res.Error
+}
+
+// GetActiveBootsByUsername fetches the boots of the image setups of a user which are in progress
+func (s Store) GetActiveBootsByUsername(username string) ([]images.BootHistory, error) {
+	history := []images.BootHistory{}
+	res := s.Select("boot_histories.*").
+		Joins("JOIN image_setups ON image_setups.uuid = boot_histories.setup_uuid").
+		Where("image_setups.username = ? AND boot_histories.state = ?", username, images.BootInProgress).
+		Order("boot_histories.id").
+		Find(&history)
+
+	return history, res.Error
+}
+
+// GetActiveBoot fetches the boot a machine is currently flashing
+func (s Store) GetActiveBoot(machineMAC string) (*images.BootHistory, error) {
+	var history images.BootHistory
+	res := s.Where("machine_mac = ? AND state = ?", machineMAC, images.BootInProgress).
+		Order("id DESC").
+		First(&history)
+
+	return &history, res.Error
+}
+
+// GetActiveBoots fetches the boots of all machines which are being flashed
+func (s Store) GetActiveBoots() ([]images.BootHistory, error) {
+	history := []images.BootHistory{}
+	res := s.Where("state = ?", images.BootInProgress).
+		Order("id").
+		Find(&history)
+
+	return history, res.Error
+}
+
+// GetBootHistoryEntry fetches a single boot of a machine
+func (s Store) GetBootHistoryEntry(machineMAC string, id uint) (*images.BootHistory, error) {
+	var history images.BootHistory
+	res := s.Where("machine_mac = ? AND id = ?", machineMAC, id).First(&history)
+	return &history, res.Error
+}
+
+// UpdateBootHistory stores changes to the state of a boot
+func (s Store) UpdateBootHistory(history *images.BootHistory) error {
+	return s.Save(history).Error
+}
+
+// TouchActiveBoot marks that the machine flashing a boot is still alive
+func (s Store) TouchActiveBoot(machineMAC string) (int64, error) {
+	res := s.Model(&images.BootHistory{}).
+		Where("machine_mac = ? AND state = ?", machineMAC, images.BootInProgress).
+		Update("last_seen", time.Now())
+
+	return res.RowsAffected, res.Error
+}
+
+// AddBootArtifact attaches an artifact to a boot
+func (s Store) AddBootArtifact(artifact *images.BootArtifact) error {
+	return s.Create(artifact).Error
+}
+
+// GetBootArtifacts fetches the artifacts attached to a boot, in the order they were attached
+func (s Store) GetBootArtifacts(bootID uint) ([]images.BootArtifact, error) {
+	artifacts := []images.BootArtifact{}
+	res := s.Where("boot_history_id = ?", bootID).Order("id").Find(&artifacts)
+	return artifacts, res.Error
+}
+
+// GetBootArtifact fetches a single artifact of a boot
+func (s Store) GetBootArtifact(bootID uint, id uint) (*images.BootArtifact, error) {
+	var artifact images.BootArtifact
+	res := s.Where("boot_history_id = ? AND id = ?", bootID, id).First(&artifact)
+	return &artifact, res.Error
+}
+
+// AddBootKey stores the passphrase of an encrypted boot
+func (s Store) AddBootKey(key *images.BootKey) error {
+	return s.Create(key).Error
+}
+
+// GetBootKey fetches the key of a boot
+func (s Store) GetBootKey(bootID uint) (*images.BootKey, error) {
+	var key images.BootKey
+	res := s.Where("boot_history_id = ?", bootID).First(&key)
+	return &key, res.Error
+}
+
+// ReleaseBootKey marks the key of a boot as handed out. The update only matches a key which was not handed out
+// yet, so of two machines asking at once only one gets it.
+func (s Store) ReleaseBootKey(bootID uint) (*images.BootKey, error) {
+	var key images.BootKey
+	err := s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("boot_history_id = ?", bootID).First(&key).Error; err != nil {
+			return err
+		}
+
+		res := tx.Model(&images.BootKey{}).
+			Where("id = ? AND released_at IS NULL AND NOT keep_encrypted", key.ID).
+			Update("released_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return database.ErrKeyReleased
+		}
+
+		return nil
+	})
+
+	return &key, err
+}
+
+// DeleteBootArtifactsBefore removes the artifacts which were attached before the given time and returns them
+func (s Store) DeleteBootArtifactsBefore(before time.Time) ([]images.BootArtifact, error) {
+	artifacts := []images.BootArtifact{}
+	err := s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("created_at < ?", before).Find(&artifacts).Error; err != nil {
+			return err
+		}
+
+		if len(artifacts) == 0 {
+			return nil
+		}
+
+		return tx.Delete(&artifacts).Error
+	})
 
-	return &bootSetup, res.Error
+	return artifacts, err
 }
@@ -0,0 +1,40 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// CreateBootTemplate stores a new boot template for a user, at its first revision
+func (s Store) CreateBootTemplate(template *images.BootTemplate) error {
+	template.Revision = 1
+	return s.Create(template).Error
+}
+
+// GetBootTemplates gets all the boot templates of a user
+func (s Store) GetBootTemplates(username string) ([]images.BootTemplate, error) {
+	templates := []images.BootTemplate{}
+	res := s.Where("username = ?", username).Order("name").Find(&templates)
+	return templates, res.Error
+}
+
+// GetBootTemplate finds a boot template of a user by its name
+func (s Store) GetBootTemplate(username string, name string) (*images.BootTemplate, error) {
+	var template images.BootTemplate
+	res := s.Where("username = ? AND name = ?", username, name).First(&template)
+	return &template, res.Error
+}
+
+// UpdateBootTemplate saves the options of a boot template as its next revision
+func (s Store) UpdateBootTemplate(template *images.BootTemplate) error {
+	template.Revision++
+	return s.Save(template).Error
+}
+
+// DeleteBootTemplate removes a boot template from the database
+func (s Store) DeleteBootTemplate(template *images.BootTemplate) error {
+	return s.Unscoped().Delete(template).Error
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import "github.com/baas-project/baas/pkg/model/bootstrap"
+
+// GetBootstrapRecord finds the record of something the bootstrap created
+func (s Store) GetBootstrapRecord(key string) (*bootstrap.Record, error) {
+	var record bootstrap.Record
+	res := s.Where("key = ?", key).First(&record)
+	return &record, res.Error
+}
+
+// GetBootstrapRecords lists everything the bootstrap created, in the order it did
+func (s Store) GetBootstrapRecords() ([]bootstrap.Record, error) {
+	records := []bootstrap.Record{}
+	res := s.Order("created_at, key").Find(&records)
+	return records, res.Error
+}
+
+// AddBootstrapRecord records that the bootstrap created something
+func (s Store) AddBootstrapRecord(record *bootstrap.Record) error {
+	return s.Create(record).Error
+}
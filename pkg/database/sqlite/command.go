@@ -0,0 +1,69 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"gorm.io/gorm"
+)
+
+// AddMachineCommand queues a diagnostic for a machine
+func (s Store) AddMachineCommand(command *machine.MachineCommand) error {
+	return s.Create(command).Error
+}
+
+// GetMachineCommands fetches the commands of a machine, the newest first
+func (s Store) GetMachineCommands(mac string) ([]machine.MachineCommand, error) {
+	commands := []machine.MachineCommand{}
+	res := s.Where("machine_mac = ?", mac).Order("id DESC").Find(&commands)
+	return commands, res.Error
+}
+
+// GetMachineCommand fetches a single command of a machine
+func (s Store) GetMachineCommand(mac string, id uint) (*machine.MachineCommand, error) {
+	var command machine.MachineCommand
+	res := s.Where("machine_mac = ? AND id = ?", mac, id).First(&command)
+	return &command, res.Error
+}
+
+// ClaimMachineCommands hands the queued commands which did not expire yet to the machine, in the order they were
+// queued
+func (s Store) ClaimMachineCommands(mac string, now time.Time) ([]machine.MachineCommand, error) {
+	commands := []machine.MachineCommand{}
+	err := s.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("machine_mac = ? AND state = ? AND expires_at > ?", mac, machine.CommandQueued, now).
+			Order("id").Find(&commands)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		for i := range commands {
+			commands[i].Send(now)
+			if err := tx.Save(&commands[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return commands, err
+}
+
+// UpdateMachineCommand stores the state and the result of a command
+func (s Store) UpdateMachineCommand(command *machine.MachineCommand) error {
+	return s.Save(command).Error
+}
+
+// GetMachineCommandsExpiredBefore gets the commands of all machines which are still waiting on the machine but
+// expired before the given time
+func (s Store) GetMachineCommandsExpiredBefore(at time.Time) ([]machine.MachineCommand, error) {
+	commands := []machine.MachineCommand{}
+	res := s.Where("state IN ? AND expires_at < ?", []machine.CommandState{machine.CommandQueued,
+		machine.CommandSent}, at).Order("id").Find(&commands)
+	return commands, res.Error
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+	"gorm.io/gorm"
+)
+
+// deleted turns a delete which matched nothing into gorm.ErrRecordNotFound
+func deleted(res *gorm.DB) error {
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// GetMachineGrants gets the users who were granted access to a machine directly
+func (s Store) GetMachineGrants(mac string) ([]machine.MachineGrant, error) {
+	grants := []machine.MachineGrant{}
+	res := s.Where("machine_mac = ?", mac).Order("username").Find(&grants)
+	return grants, res.Error
+}
+
+// restrictMachine restricts a machine to the users with access, it fails when there is no such machine
+func restrictMachine(tx *gorm.DB, mac string) error {
+	res := tx.Model(&machine.MachineModel{}).Where("address = ?", mac).Update("restricted", true)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// CreateMachineGrant grants a user access to a machine and restricts the machine
+func (s Store) CreateMachineGrant(grant *machine.MachineGrant) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := restrictMachine(tx, grant.MachineMAC); err != nil {
+			return err
+		}
+
+		return tx.Create(grant).Error
+	})
+}
+
+// DeleteMachineGrant takes the access a user was granted to a machine away, the machine stays restricted
+func (s Store) DeleteMachineGrant(mac string, username string) error {
+	return deleted(s.Where("machine_mac = ? AND username = ?", mac, username).Delete(&machine.MachineGrant{}))
+}
+
+// GetMachineAccess looks for a direct grant, and a course which has not expired and has both the user and the machine
+func (s Store) GetMachineAccess(mac string, username string, at time.Time) (*machine.MachineAccess, error) {
+	access := machine.MachineAccess{}
+	var grants int64
+	res := s.Model(&machine.MachineGrant{}).Where("machine_mac = ? AND username = ?", mac, username).Count(&grants)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	access.Granted = grants > 0
+
+	var names []string
+	res = s.Model(&course.CourseModel{}).
+		Joins("JOIN course_members ON course_members.course_name = course_models.name").
+		Joins("JOIN course_machines ON course_machines.course_name = course_models.name").
+		Where("course_members.username = ? AND course_machines.machine_mac = ? AND course_models.expires_at > ?",
+			username, mac, at).
+		Order("course_models.name").Limit(1).
+		Pluck("course_models.name", &names)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if len(names) != 0 {
+		access.Course = names[0]
+	}
+
+	return &access, nil
+}
+
+// CreateCourse creates a course together with its members and machines
+func (s Store) CreateCourse(c *course.CourseModel) error {
+	return s.Create(c).Error
+}
+
+// GetCourse gets a course with its members and machines
+func (s Store) GetCourse(name string) (*course.CourseModel, error) {
+	c := course.CourseModel{}
+	res := s.Preload("Members").Preload("Machines").Where("name = ?", name).First(&c)
+	return &c, res.Error
+}
+
+// GetCourses gets all courses with their members and machines, those which expire first come first
+func (s Store) GetCourses() ([]course.CourseModel, error) {
+	courses := []course.CourseModel{}
+	res := s.Preload("Members").Preload("Machines").Order("expires_at, name").Find(&courses)
+	return courses, res.Error
+}
+
+// DeleteCourse removes a course, its members lose the access it gave them
+func (s Store) DeleteCourse(c *course.CourseModel) error {
+	return s.Delete(c).Error
+}
+
+// SetCourseExpiry moves the expiry of a course and forgets that its owner was warned or that it expired
+func (s Store) SetCourseExpiry(name string, expiresAt time.Time) error {
+	res := s.Model(&course.CourseModel{}).Where("name = ?", name).
+		Updates(map[string]interface{}{"expires_at": expiresAt, "warned_at": nil, "expired_at": nil})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// MarkCourseWarned records that the owner of a course was told about its expiry
+func (s Store) MarkCourseWarned(name string, at time.Time) error {
+	return s.Model(&course.CourseModel{}).Where("name = ?", name).Update("warned_at", at).Error
+}
+
+// MarkCourseExpired records that a course expired
+func (s Store) MarkCourseExpired(name string, at time.Time) error {
+	return s.Model(&course.CourseModel{}).Where("name = ?", name).Update("expired_at", at).Error
+}
+
+// AddCourseMember adds a user to a course, adding a member twice is a constraint error
+func (s Store) AddCourseMember(name string, username string) error {
+	return s.Create(&course.CourseMember{CourseName: name, Username: username}).Error
+}
+
+// RemoveCourseMember removes a user from a course
+func (s Store) RemoveCourseMember(name string, username string) error {
+	return deleted(s.Where("course_name = ? AND username = ?", name, username).Delete(&course.CourseMember{}))
+}
+
+// AddCourseMachine assigns a machine to a course and restricts the machine
+func (s Store) AddCourseMachine(name string, mac string) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := restrictMachine(tx, mac); err != nil {
+			return err
+		}
+
+		return tx.Create(&course.CourseMachine{CourseName: name, MachineMAC: mac}).Error
+	})
+}
+
+// RemoveCourseMachine takes a machine away from a course, the machine stays restricted
+func (s Store) RemoveCourseMachine(name string, mac string) error {
+	return deleted(s.Where("course_name = ? AND machine_mac = ?", name, mac).Delete(&course.CourseMachine{}))
+}
+
+// GetImagesByCourse gets the images outside the trash which are labelled with a course
+func (s Store) GetImagesByCourse(name string) ([]images.ImageModel, error) {
+	labelled := []images.ImageModel{}
+	res := s.Where("course = ?", name).Find(&labelled)
+	return labelled, res.Error
+}
+
+// GetModeratorScopes gets the courses a moderator is scoped to
+func (s Store) GetModeratorScopes(moderator string) ([]course.ModeratorScope, error) {
+	scopes := []course.ModeratorScope{}
+	res := s.Where("moderator = ?", moderator).Order("course_name").Find(&scopes)
+	return scopes, res.Error
+}
+
+// AddModeratorScope scopes a moderator to a course, adding a scope twice is a constraint error
+func (s Store) AddModeratorScope(moderator string, name string) error {
+	return s.Create(&course.ModeratorScope{Moderator: moderator, CourseName: name}).Error
+}
+
+// RemoveModeratorScope takes a course out of the scope of a moderator
+func (s Store) RemoveModeratorScope(moderator string, name string) error {
+	return deleted(s.Where("moderator = ? AND course_name = ?", moderator, name).Delete(&course.ModeratorScope{}))
+}
+
+// GetModeratorScopeOfUser finds a course in the scope of a moderator which the user is a member of, it is empty when
+// there is none
+func (s Store) GetModeratorScopeOfUser(moderator string, username string) (string, error) {
+	var names []string
+	res := s.Model(&course.ModeratorScope{}).
+		Joins("JOIN course_members ON course_members.course_name = moderator_scopes.course_name").
+		Where("moderator_scopes.moderator = ? AND course_members.username = ?", moderator, username).
+		Order("moderator_scopes.course_name").Limit(1).
+		Pluck("moderator_scopes.course_name", &names)
+	if res.Error != nil || len(names) == 0 {
+		return "", res.Error
+	}
+
+	return names[0], nil
+}
+
+// GetModeratorScopeOfMachine finds a course in the scope of a moderator which the machine is assigned to, it is empty
+// when there is none
+func (s Store) GetModeratorScopeOfMachine(moderator string, mac string) (string, error) {
+	var names []string
+	res := s.Model(&course.ModeratorScope{}).
+		Joins("JOIN course_machines ON course_machines.course_name = moderator_scopes.course_name").
+		Where("moderator_scopes.moderator = ? AND course_machines.machine_mac = ?", moderator, mac).
+		Order("moderator_scopes.course_name").Limit(1).
+		Pluck("moderator_scopes.course_name", &names)
+	if res.Error != nil || len(names) == 0 {
+		return "", res.Error
+	}
+
+	return names[0], nil
+}
+
+// GetUsersInModeratorScope gets the members of the courses a moderator is scoped to
+func (s Store) GetUsersInModeratorScope(moderator string) ([]user.UserModel, error) {
+	users := []user.UserModel{}
+	res := s.Where("username IN (?)", s.Model(&course.CourseMember{}).Select("course_members.username").
+		Joins("JOIN moderator_scopes ON moderator_scopes.course_name = course_members.course_name").
+		Where("moderator_scopes.moderator = ?", moderator)).
+		Order("username").Find(&users)
+	return users, res.Error
+}
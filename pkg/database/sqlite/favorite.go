@@ -0,0 +1,59 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"gorm.io/gorm/clause"
+)
+
+// AddFavoriteImage marks an image as a favorite of a user, marking it twice changes nothing
+func (s Store) AddFavoriteImage(username string, uuid images.ImageUUID) error {
+	return s.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&user.FavoriteImage{Username: username, ImageUUID: uuid}).Error
+}
+
+// RemoveFavoriteImage unmarks an image as a favorite of a user
+func (s Store) RemoveFavoriteImage(username string, uuid images.ImageUUID) error {
+	return s.Where("username = ? AND image_uuid = ?", username, uuid).Delete(&user.FavoriteImage{}).Error
+}
+
+// GetFavoriteImages fetches the favorite images of a user which are not in the trash, in the order they were marked
+func (s Store) GetFavoriteImages(username string) ([]images.ImageModel, error) {
+	favorites := []images.ImageModel{}
+	res := s.Preload("Versions").
+		Joins("JOIN favorite_images ON favorite_images.image_uuid = image_models.uuid").
+		Where("favorite_images.username = ?", username).
+		Order("favorite_images.created_at").
+		Find(&favorites)
+
+	return favorites, res.Error
+}
+
+// GetImagesLastBooted finds when each image was last booted through an image setup of a user
+func (s Store) GetImagesLastBooted(username string) (map[images.ImageUUID]time.Time, error) {
+	boots := []images.BootHistory{}
+	res := s.Select("boot_histories.resolved_versions, boot_histories.created_at").
+		Joins("JOIN image_setups ON image_setups.uuid = boot_histories.setup_uuid").
+		Where("image_setups.username = ?", username).
+		Find(&boots)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	lastBooted := map[images.ImageUUID]time.Time{}
+	for _, boot := range boots {
+		for _, resolved := range boot.ResolvedVersions {
+			if boot.CreatedAt.After(lastBooted[resolved.ImageUUID]) {
+				lastBooted[resolved.ImageUUID] = boot.CreatedAt
+			}
+		}
+	}
+
+	return lastBooted, nil
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/idempotency"
+)
+
+// ReserveIdempotencyKey stores the key of a request before it is handled, a key which was already reserved fails
+// with a constraint error
+func (s Store) ReserveIdempotencyKey(record *idempotency.Record) error {
+	return s.Create(record).Error
+}
+
+// GetIdempotencyKey finds the record of a key of a principal
+func (s Store) GetIdempotencyKey(principal string, key string) (*idempotency.Record, error) {
+	record := idempotency.Record{}
+	res := s.Where("principal = ? AND key = ?", principal, key).First(&record)
+	return &record, res.Error
+}
+
+// CompleteIdempotencyKey stores the response to the request which reserved the key
+func (s Store) CompleteIdempotencyKey(record *idempotency.Record) error {
+	return s.Save(record).Error
+}
+
+// DeleteIdempotencyKey releases a key, so the request can be made again
+func (s Store) DeleteIdempotencyKey(record *idempotency.Record) error {
+	return s.Delete(record).Error
+}
+
+// DeleteIdempotencyKeysBefore removes the keys which were reserved before the given time and returns how many
+func (s Store) DeleteIdempotencyKeysBefore(before time.Time) (int64, error) {
+	res := s.Where("created_at < ?", before).Delete(&idempotency.Record{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// GetIdentity finds the identity associated with the account of an OAuth provider.
+func (s Store) GetIdentity(provider user.OAuthProvider, providerID string) (*user.IdentityModel, error) {
+	identity := user.IdentityModel{}
+	res := s.Where("provider = ? AND provider_id = ?", provider, providerID).First(&identity)
+	return &identity, res.Error
+}
+
+// GetIdentityByID gets the identity with the specified id from the database.
+func (s Store) GetIdentityByID(id uint) (*user.IdentityModel, error) {
+	identity := user.IdentityModel{}
+	res := s.Where("id = ?", id).First(&identity)
+	return &identity, res.Error
+}
+
+// GetIdentitiesByUsername gets all the identities which can be used to log in as a user.
+func (s Store) GetIdentitiesByUsername(username string) ([]user.IdentityModel, error) {
+	identities := []user.IdentityModel{}
+	res := s.Where("username = ?", username).Order("id").Find(&identities)
+	return identities, res.Error
+}
+
+// CreateIdentity links a new identity to a user
+func (s Store) CreateIdentity(identity *user.IdentityModel) error {
+	return s.Create(identity).Error
+}
+
+// DeleteIdentity unlinks an identity from its user
+func (s Store) DeleteIdentity(identity *user.IdentityModel) error {
+	return s.Delete(identity).Error
+}
@@ -5,14 +5,18 @@
 package sqlite
 
 import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
 	"github.com/baas-project/baas/pkg/model/images"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // CreateImage creates the image entity in the database and adds the first version to it.
-func (s Store) CreateImage(image *images.ImageModel) {
+func (s Store) CreateImage(image *images.ImageModel) error {
 	image.Versions = append(image.Versions, images.Version{Version: 0, ImageModelUUID: image.UUID})
-	s.DB.Create(image)
+	return s.DB.Create(image).Error
 }
 
 // GetImageByUUID fetches the image with the versions using their UUID as a key
@@ -44,9 +48,67 @@ func (s Store) GetImagesByUsername(username string) ([]images.ImageModel, error)
 	return userImages, res.Error
 }
 
+// countVersions fills in the number of versions of the images, with one query for all of them
+func (s Store) countVersions(found []images.ImageModel) error {
+	if len(found) == 0 {
+		return nil
+	}
+
+	uuids := make([]images.ImageUUID, len(found))
+	for i := range found {
+		uuids[i] = found[i].UUID
+	}
+
+	var counts []struct {
+		ImageModelUUID images.ImageUUID
+		Count          int64
+	}
+
+	res := s.Model(&images.Version{}).
+		Select("image_model_uuid, COUNT(*) AS count").
+		Where("image_model_uuid IN ?", uuids).
+		Group("image_model_uuid").
+		Scan(&counts)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	perImage := make(map[images.ImageUUID]int64, len(counts))
+	for _, count := range counts {
+		perImage[count.ImageModelUUID] = count.Count
+	}
+
+	for i := range found {
+		found[i].VersionCount = perImage[found[i].UUID]
+	}
+
+	return nil
+}
+
+// GetImageSummariesByUsername fetches the images of a user without their versions, only counting those
+func (s Store) GetImageSummariesByUsername(username string) ([]images.ImageModel, error) {
+	userImages := []images.ImageModel{}
+	if err := s.Where("username = ?", username).Find(&userImages).Error; err != nil {
+		return nil, err
+	}
+
+	return userImages, s.countVersions(userImages)
+}
+
+// touchImage marks an image as updated, the versions of an image are part of it
+func touchImage(db *gorm.DB, uuid images.ImageUUID) error {
+	return db.Model(&images.ImageModel{}).Where("uuid = ?", uuid).Update("updated_at", time.Now()).Error
+}
+
 // CreateNewImageVersion creates a new version in the database
-func (s Store) CreateNewImageVersion(version images.Version) {
-	s.Create(&version)
+func (s Store) CreateNewImageVersion(version images.Version) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&version).Error; err != nil {
+			return err
+		}
+
+		return touchImage(tx, version.ImageModelUUID)
+	})
 }
 
 // GetVersionByID gets the version associated with a specific ID
@@ -56,24 +118,245 @@ func (s Store) GetVersionByID(versionID uint64) (*images.Version, error) {
 	return &version, err
 }
 
-// GetImagesByNameAndUsername gets all the images associated with a user which have the same human-readable name.
-// This theoretically possible, but it is unsure whether this actually holds in any real-world scenario.
+// DeleteVersion removes a version of an image from the database
+func (s Store) DeleteVersion(version *images.Version) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(version).Error; err != nil {
+			return err
+		}
+
+		return touchImage(tx, version.ImageModelUUID)
+	})
+}
+
+// SetVersionSize stores the logical size of a particular version of an image. The size is stored once its file is
+// complete, so the image counts as updated again.
+func (s Store) SetVersionSize(uuid images.ImageUUID, version uint64, size uint64) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&images.Version{}).
+			Where("image_model_uuid = ? AND version = ?", uuid, version).
+			Update("size", size).Error
+		if err != nil {
+			return err
+		}
+
+		return touchImage(tx, uuid)
+	})
+}
+
+// SetVersionChecksum stores the checksum of the file of a particular version of an image. The file was just
+// written, so the version is no longer corrupt.
+func (s Store) SetVersionChecksum(uuid images.ImageUUID, version uint64, sha256 string) error {
+	return s.Model(&images.Version{}).
+		Where("image_model_uuid = ? AND version = ?", uuid, version).
+		Updates(map[string]interface{}{"sha256": sha256, "corrupt": false}).Error
+}
+
+// SetVersionCorrupt marks whether the file of a particular version of an image still matches its checksum
+func (s Store) SetVersionCorrupt(uuid images.ImageUUID, version uint64, corrupt bool) error {
+	return s.Model(&images.Version{}).
+		Where("image_model_uuid = ? AND version = ?", uuid, version).
+		Update("corrupt", corrupt).Error
+}
+
+// SetVersionFormat stores the format of the file of a particular version of an image
+func (s Store) SetVersionFormat(uuid images.ImageUUID, version uint64, format images.FileFormat) error {
+	return s.Model(&images.Version{}).
+		Where("image_model_uuid = ? AND version = ?", uuid, version).
+		Update("format", format).Error
+}
+
+// SetVersionBootKey records the key of the boot which uploaded a version encrypted
+func (s Store) SetVersionBootKey(uuid images.ImageUUID, version uint64, keyID uint) error {
+	return s.Model(&images.Version{}).
+		Where("image_model_uuid = ? AND version = ?", uuid, version).
+		Update("boot_key_id", keyID).Error
+}
+
+// GetImagesByNameAndUsername gets the images of a user with a human-readable name, ignoring case. Only databases
+// with names which collided before the names became unique regardless of case return more than one.
 func (s Store) GetImagesByNameAndUsername(name string, username string) ([]images.ImageModel, error) {
 	var userImages []images.ImageModel
 	res := s.Table("image_models").
 		Preload("Versions").
 		Joins("join user_models on user_models.username = image_models.username").
-		Where("image_models.name = ?", name).
+		Where("image_models.name = ? COLLATE NOCASE AND user_models.username = ?", name, username).
 		Find(&userImages)
 	return userImages, res.Error
 }
 
-// DeleteImage removes an image from the database
+// DeleteImage removes an image from the database together with its files
 func (s Store) DeleteImage(image *images.ImageModel) error {
 	return s.Unscoped().Delete(image).Error
 }
 
+// TrashImage moves an image to the trash, it keeps its files until it is purged. Its webhooks are deleted, as
+// they would not hear of it anymore.
+func (s Store) TrashImage(image *images.ImageModel) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("image_uuid = ?", image.UUID).Delete(&images.ImageWebhook{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(image).Error
+	})
+}
+
+// RestoreImage takes an image out of the trash
+func (s Store) RestoreImage(image *images.ImageModel) error {
+	return s.Unscoped().Model(image).Update("deleted_at", nil).Error
+}
+
+// GetTrashedImage fetches an image in the trash using its UUID
+func (s Store) GetTrashedImage(uuid images.ImageUUID) (*images.ImageModel, error) {
+	var image images.ImageModel
+	err := s.Unscoped().
+		Preload("Versions").
+		Where("uuid = ? AND deleted_at IS NOT NULL", uuid).
+		First(&image).Error
+
+	return &image, err
+}
+
+// GetTrashedImages fetches all the images of a user which are in the trash
+func (s Store) GetTrashedImages(username string) ([]images.ImageModel, error) {
+	trashed := []images.ImageModel{}
+	res := s.Unscoped().
+		Preload("Versions").
+		Where("username = ? AND deleted_at IS NOT NULL", username).
+		Find(&trashed)
+
+	return trashed, res.Error
+}
+
+// GetImagesTrashedBefore fetches the images of all users which were moved to the trash before a moment in time
+func (s Store) GetImagesTrashedBefore(before time.Time) ([]images.ImageModel, error) {
+	trashed := []images.ImageModel{}
+	res := s.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", before).
+		Find(&trashed)
+
+	return trashed, res.Error
+}
+
+// GetStorageUsage sums the sizes of all versions of the images of a user, including those in the trash
+func (s Store) GetStorageUsage(username string) (*images.StorageUsage, error) {
+	var usage images.StorageUsage
+	res := s.Table("versions").
+		Select("COALESCE(SUM(versions.size), 0) AS used, "+
+			"COALESCE(SUM(CASE WHEN image_models.deleted_at IS NOT NULL THEN versions.size ELSE 0 END), 0) AS trashed").
+		Joins("JOIN image_models ON image_models.uuid = versions.image_model_uuid").
+		Where("image_models.username = ? AND versions.deleted_at IS NULL", username).
+		Scan(&usage)
+
+	return &usage, res.Error
+}
+
 // UpdateImage updates an image in the database
 func (s Store) UpdateImage(image *images.ImageModel) error {
-	return s.Updates(image).Error
+	// The versions are managed on their own, saving them here would add the versions of the request as new rows
+	if err := s.Omit(clause.Associations).Updates(image).Error; err != nil {
+		return err
+	}
+
+	// Updates skips zero values, so an image could otherwise never be made private or lose its description again
+	return s.Model(image).Omit(clause.Associations).Updates(map[string]interface{}{
+		"public":       image.Public,
+		"description":  image.Description,
+		"source_url":   image.SourceURL,
+		"course":       image.Course,
+		"base_os":      image.BaseOS,
+		"license":      image.License,
+		"license_name": image.LicenseName,
+		"source_notes": image.SourceNotes,
+	}).Error
+}
+
+// SetImageIcon stores the URI of the icon of an image, an empty URI removes the icon
+func (s Store) SetImageIcon(uuid images.ImageUUID, icon string) error {
+	return s.Model(&images.ImageModel{}).Where("uuid = ?", uuid).Update("icon", icon).Error
+}
+
+// SetImagePlacement sets the storage tier an admin put the image on
+func (s Store) SetImagePlacement(uuid images.ImageUUID, tier string) error {
+	return s.Model(&images.ImageModel{}).Where("uuid = ?", uuid).Update("placement", tier).Error
+}
+
+// SetUploadedDiskUUID records the partition table UUID of the latest upload, and claims it for the image with claim
+func (s Store) SetUploadedDiskUUID(uuid images.ImageUUID, diskUUID string, claim bool) error {
+	columns := map[string]interface{}{"uploaded_disk_uuid": diskUUID}
+	if claim {
+		columns["disk_uuid"] = diskUUID
+	}
+
+	return s.Model(&images.ImageModel{}).Where("uuid = ?", uuid).Updates(columns).Error
+}
+
+// MoveImage points the image to its files on another tier in a single update, provided nothing moved it since
+func (s Store) MoveImage(uuid images.ImageUUID, from string, tier string, path string) (bool, error) {
+	res := s.Unscoped().Model(&images.ImageModel{}).Where("uuid = ? AND image_path = ?", uuid, from).
+		Updates(map[string]interface{}{"tier": tier, "image_path": path})
+	return res.RowsAffected == 1, res.Error
+}
+
+// GetPublicImages fetches all the images which are visible to everyone
+func (s Store) GetPublicImages() ([]images.ImageModel, error) {
+	publicImages := []images.ImageModel{}
+	res := s.Preload("Versions").
+		Where("public = ?", true).
+		Find(&publicImages)
+
+	return publicImages, res.Error
+}
+
+// GetPublicImageSummaries fetches the images which are visible to everyone without their versions, only counting
+// those
+func (s Store) GetPublicImageSummaries() ([]images.ImageModel, error) {
+	publicImages := []images.ImageModel{}
+	if err := s.Where("public = ?", true).Find(&publicImages).Error; err != nil {
+		return nil, err
+	}
+
+	return publicImages, s.countVersions(publicImages)
+}
+
+// SearchImages finds the images of all users which match the filter, without their versions, ordered by owner and
+// name
+func (s Store) SearchImages(filter database.ImageFilter) ([]images.ImageModel, error) {
+	db := s.Model(&images.ImageModel{})
+	switch {
+	case filter.Unlicensed:
+		db = db.Where("license = ?", "")
+	case filter.License != "":
+		db = db.Where("license = ?", filter.License)
+	}
+
+	if filter.Public != nil {
+		db = db.Where("public = ?", *filter.Public)
+	}
+
+	if filter.Username != "" {
+		db = db.Where("username = ?", filter.Username)
+	}
+
+	found := []images.ImageModel{}
+	if err := db.Order("username, name, uuid").Find(&found).Error; err != nil {
+		return nil, err
+	}
+
+	return found, s.countVersions(found)
+}
+
+// GetVersions fetches a page of the versions of an image together with the total number of versions
+func (s Store) GetVersions(uuid images.ImageUUID, opts database.ListOptions) ([]images.Version, int64, error) {
+	versions := []images.Version{}
+	db := filterCreated(s.Model(&images.Version{}).Where("image_model_uuid = ?", uuid), "versions", opts)
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	res := paginate(db, "versions", opts).Find(&versions)
+	return versions, total, res.Error
 }
@@ -0,0 +1,116 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm"
+)
+
+// createMembers stores the members of a set in their order, the images they refer to are left alone
+func createMembers(tx *gorm.DB, set *images.ImageSet) error {
+	for i := range set.Members {
+		set.Members[i].ID = 0
+		set.Members[i].ImageSetUUID = set.UUID
+		set.Members[i].Position = i
+	}
+
+	if len(set.Members) == 0 {
+		return nil
+	}
+
+	return tx.Omit("Image").Create(&set.Members).Error
+}
+
+// createFrozen stores the images of the setup of a set in their order
+func createFrozen(tx *gorm.DB, setup *images.ImageSetup) error {
+	for i := range setup.Images {
+		setup.Images[i].ID = 0
+		setup.Images[i].ImageSetupUUID = setup.UUID
+	}
+
+	if len(setup.Images) == 0 {
+		return nil
+	}
+
+	return tx.Omit("Image", "Version").Create(&setup.Images).Error
+}
+
+// CreateImageSet stores a new image set and the image setup it is booted through
+func (s Store) CreateImageSet(set *images.ImageSet, setup *images.ImageSetup) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Members").Create(set).Error; err != nil {
+			return err
+		}
+
+		if err := createMembers(tx, set); err != nil {
+			return err
+		}
+
+		if err := tx.Omit("Images").Create(setup).Error; err != nil {
+			return err
+		}
+
+		return createFrozen(tx, setup)
+	})
+}
+
+// UpdateImageSet replaces the name and the members of an image set, and the images of its image setup
+func (s Store) UpdateImageSet(set *images.ImageSet, setup *images.ImageSetup) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&images.ImageSet{}).Where("uuid = ?", set.UUID).Update("name", set.Name).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&images.ImageSetup{}).Where("uuid = ?", setup.UUID).Update("name", setup.Name).Error
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Where("image_set_uuid = ?", set.UUID).Delete(&images.ImageSetMember{}).Error; err != nil {
+			return err
+		}
+
+		if err = tx.Where("image_setup_uuid = ?", setup.UUID).Unscoped().Delete(&images.ImageFrozen{}).Error; err != nil {
+			return err
+		}
+
+		if err = createMembers(tx, set); err != nil {
+			return err
+		}
+
+		return createFrozen(tx, setup)
+	})
+}
+
+// GetImageSet gets an image set with its members in order
+func (s Store) GetImageSet(uuid images.ImageUUID) (*images.ImageSet, error) {
+	var set images.ImageSet
+	res := s.Preload("Members", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Where("uuid = ?", uuid).First(&set)
+	return &set, res.Error
+}
+
+// GetImageSets lists the image sets of a user
+func (s Store) GetImageSets(username string) ([]images.ImageSet, error) {
+	sets := []images.ImageSet{}
+	res := s.Preload("Members", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Where("username = ?", username).Order("id").Find(&sets)
+	return sets, res.Error
+}
+
+// DeleteImageSet removes an image set together with its image setup, which removes the boots queued for it
+func (s Store) DeleteImageSet(set *images.ImageSet) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("uuid = ?", set.UUID).Delete(&images.ImageSetup{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Where("uuid = ?", set.UUID).Delete(&images.ImageSet{}).Error
+	})
+}
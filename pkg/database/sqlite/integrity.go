@@ -0,0 +1,189 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"fmt"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"gorm.io/gorm"
+)
+
+// references are the columns which refer to rows in other tables. Repairable rows are useless without the row
+// they refer to and can be removed, the others belong to users and are only reported.
+var references = []struct {
+	table, column       string
+	refTable, refColumn string
+	repairable          bool
+}{
+	{"versions", "image_model_uuid", "image_models", "uuid", true},
+	{"image_frozens", "uuid_image", "image_models", "uuid", true},
+	{"image_frozens", "version_id", "versions", "id", true},
+	{"image_frozens", "image_setup_uuid", "image_setups", "uuid", true},
+	{"boot_setups", "setup_uuid", "image_setups", "uuid", true},
+	{"boot_setups", "machine_mac", "machine_models", "address", true},
+	{"disk_models", "machine_mac", "machine_models", "address", true},
+	{"machine_metadata", "machine_mac", "machine_models", "address", true},
+	{"favorite_images", "image_uuid", "image_models", "uuid", true},
+	{"backup_policies", "image_uuid", "image_models", "uuid", true},
+	{"version_backups", "image_uuid", "image_models", "uuid", true},
+	{"image_models", "username", "user_models", "username", false},
+	{"image_setups", "username", "user_models", "username", false},
+	{"metadata_templates", "username", "user_models", "username", false},
+}
+
+// CheckReferences finds the rows which refer to rows that do not exist, and removes the repairable ones if asked
+func (s Store) CheckReferences(repair bool) ([]database.DanglingReference, error) {
+	dangling := []database.DanglingReference{}
+
+	for _, ref := range references {
+		condition := fmt.Sprintf("%s IS NOT NULL AND %s NOT IN (SELECT %s FROM %s)",
+			ref.column, ref.column, ref.refColumn, ref.refTable)
+
+		var found []struct {
+			Value string
+			Count int64
+		}
+		err := s.Raw(fmt.Sprintf("SELECT %s AS value, COUNT(*) AS count FROM %s WHERE %s GROUP BY %s",
+			ref.column, ref.table, condition, ref.column)).Scan(&found).Error
+		if err != nil {
+			return nil, err
+		}
+
+		if len(found) == 0 {
+			continue
+		}
+
+		repaired := repair && ref.repairable
+		if repaired {
+			if err = s.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", ref.table, condition)).Error; err != nil {
+				return nil, err
+			}
+		}
+
+		for _, f := range found {
+			dangling = append(dangling, database.DanglingReference{
+				Table:    ref.table,
+				Column:   ref.column,
+				Value:    f.Value,
+				Count:    f.Count,
+				Repaired: repaired,
+			})
+		}
+	}
+
+	return dangling, nil
+}
+
+// GetAllVersions fetches the versions of all images, including the ones in the trash
+func (s Store) GetAllVersions() ([]images.Version, error) {
+	versions := []images.Version{}
+	return versions, s.Find(&versions).Error
+}
+
+// GetImageUUIDs fetches the UUIDs of all images, including the ones in the trash, and of all machine images
+func (s Store) GetImageUUIDs() (userImages []images.ImageUUID, machineImages []images.ImageUUID, err error) {
+	if err = s.Unscoped().Model(&images.ImageModel{}).Pluck("uuid", &userImages).Error; err != nil {
+		return nil, nil, err
+	}
+
+	err = s.Unscoped().Model(&images.MachineImageModel{}).Pluck("uuid", &machineImages).Error
+	return userImages, machineImages, err
+}
+
+// GetImagePaths fetches the directories holding the files of all images, including the ones in the trash
+func (s Store) GetImagePaths() (map[images.ImageUUID]string, error) {
+	var found []struct {
+		UUID      images.ImageUUID
+		ImagePath string
+	}
+	if err := s.Unscoped().Model(&images.ImageModel{}).Select("uuid, image_path").Scan(&found).Error; err != nil {
+		return nil, err
+	}
+
+	paths := map[images.ImageUUID]string{}
+	for _, image := range found {
+		paths[image.UUID] = image.ImagePath
+	}
+
+	return paths, nil
+}
+
+// FindNameCollisions finds the images whose names only differ in case from another image of the same user
+func (s Store) FindNameCollisions() ([]database.NameCollision, error) {
+	return findNameCollisions(s.DB)
+}
+
+func findNameCollisions(db *gorm.DB) ([]database.NameCollision, error) {
+	var found []struct {
+		Username string
+		UUID     images.ImageUUID
+		Name     string
+		Folded   string
+	}
+	err := db.Raw(`SELECT username, uuid, name, LOWER(name) AS folded FROM image_models
+		WHERE deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM image_models AS other WHERE other.deleted_at IS NULL AND other.username = image_models.username
+			AND other.name = image_models.name COLLATE NOCASE AND other.uuid != image_models.uuid)
+		ORDER BY username, folded, name`).Scan(&found).Error
+	if err != nil {
+		return nil, err
+	}
+
+	collisions := []database.NameCollision{}
+	for i, f := range found {
+		if i == 0 || f.Username != found[i-1].Username || f.Folded != found[i-1].Folded {
+			collisions = append(collisions, database.NameCollision{Username: f.Username,
+				Images: map[images.ImageUUID]string{}})
+		}
+
+		collisions[len(collisions)-1].Images[f.UUID] = f.Name
+	}
+
+	return collisions, nil
+}
+
+// FindInvalidRoles finds the users whose role was stored without being checked
+func (s Store) FindInvalidRoles() ([]database.InvalidRole, error) {
+	invalid := []database.InvalidRole{}
+	err := s.Model(&user.UserModel{}).Select("username, role").
+		Where("role NOT IN ?", []user.UserRole{user.User, user.Moderator, user.Admin}).
+		Order("username").Scan(&invalid).Error
+	return invalid, err
+}
+
+// FindEmailCollisions finds the users who share an email address when case is ignored
+func (s Store) FindEmailCollisions() ([]database.EmailCollision, error) {
+	return findEmailCollisions(s.DB)
+}
+
+func findEmailCollisions(db *gorm.DB) ([]database.EmailCollision, error) {
+	var found []struct {
+		Username string
+		Email    string
+		Folded   string
+	}
+	err := db.Raw(`SELECT username, email, LOWER(email) AS folded FROM user_models
+		WHERE merged_into = '' AND EXISTS (
+			SELECT 1 FROM user_models AS other WHERE other.merged_into = ''
+			AND other.email = user_models.email COLLATE NOCASE AND other.username != user_models.username)
+		ORDER BY folded, username`).Scan(&found).Error
+	if err != nil {
+		return nil, err
+	}
+
+	collisions := []database.EmailCollision{}
+	for i, f := range found {
+		if i == 0 || f.Folded != found[i-1].Folded {
+			collisions = append(collisions, database.EmailCollision{Email: f.Email})
+		}
+
+		collisions[len(collisions)-1].Usernames = append(collisions[len(collisions)-1].Usernames, f.Username)
+	}
+
+	return collisions, nil
+}
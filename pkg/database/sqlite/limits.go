@@ -0,0 +1,94 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"errors"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"gorm.io/gorm"
+)
+
+// GetRoleLimits gets the default limits of a role, roles without stored limits are unlimited
+func (s Store) GetRoleLimits(role user.UserRole) (*user.RoleLimits, error) {
+	limits := user.RoleLimits{Role: role}
+	err := s.Where("role = ?", role).First(&limits).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &limits, nil
+	}
+
+	return &limits, err
+}
+
+// SetRoleLimits replaces the default limits of a role
+func (s Store) SetRoleLimits(limits *user.RoleLimits) error {
+	return s.Save(limits).Error
+}
+
+// GetLimitOverrides gets the limits which are overridden for a user, without any overrides none are set
+func (s Store) GetLimitOverrides(username string) (*user.LimitOverrides, error) {
+	overrides := user.LimitOverrides{Username: username}
+	err := s.Where("username = ?", username).First(&overrides).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &overrides, nil
+	}
+
+	return &overrides, err
+}
+
+// SetLimitOverrides replaces the overridden limits of a user
+func (s Store) SetLimitOverrides(overrides *user.LimitOverrides) error {
+	return s.Save(overrides).Error
+}
+
+// DeleteLimitOverrides makes the user fall back to the limits of their role
+func (s Store) DeleteLimitOverrides(username string) error {
+	return s.Where("username = ?", username).Delete(&user.LimitOverrides{}).Error
+}
+
+// GetAllLimitOverrides gets the overridden limits of every user who has them
+func (s Store) GetAllLimitOverrides() (overrides []user.LimitOverrides, _ error) {
+	res := s.Order("username").Find(&overrides)
+	return overrides, res.Error
+}
+
+// CountImages counts the images of a user which are not in the trash
+func (s Store) CountImages(username string) (count int64, _ error) {
+	res := s.Model(&images.ImageModel{}).Where("username = ?", username).Count(&count)
+	return count, res.Error
+}
+
+// CountVersions counts the versions of an image
+func (s Store) CountVersions(uuid images.ImageUUID) (count int64, _ error) {
+	res := s.Model(&images.Version{}).Where("image_model_uuid = ?", uuid).Count(&count)
+	return count, res.Error
+}
+
+// CountQueuedBoots counts the boot setups of a user which are queued on any machine
+func (s Store) CountQueuedBoots(username string) (count int64, _ error) {
+	res := s.Model(&images.BootSetup{}).
+		Joins("JOIN image_setups ON image_setups.uuid = boot_setups.setup_uuid").
+		Where("image_setups.username = ? AND image_setups.deleted_at IS NULL", username).
+		Count(&count)
+
+	return count, res.Error
+}
+
+// CountActiveBoots counts the boot setups of a user which are queued on any machine or being flashed onto one
+func (s Store) CountActiveBoots(username string) (int64, error) {
+	queued, err := s.CountQueuedBoots(username)
+	if err != nil {
+		return 0, err
+	}
+
+	var flashing int64
+	res := s.Model(&images.BootHistory{}).
+		Joins("JOIN image_setups ON image_setups.uuid = boot_histories.setup_uuid").
+		Where("image_setups.username = ? AND boot_histories.state = ?", username, images.BootInProgress).
+		Count(&flashing)
+
+	return queued + flashing, res.Error
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"strings"
+
+	"github.com/baas-project/baas/pkg/database"
+	"gorm.io/gorm"
+)
+
+// filterCreated only keeps the rows of table created in the interval of the list options
+func filterCreated(db *gorm.DB, table string, opts database.ListOptions) *gorm.DB {
+	if !opts.Since.IsZero() {
+		db = db.Where(table+".created_at >= ?", opts.Since)
+	}
+
+	if !opts.Until.IsZero() {
+		db = db.Where(table+".created_at < ?", opts.Until)
+	}
+
+	return db
+}
+
+// paginate orders the rows of table by their ID, or the time they are sorted by, and applies the limit, offset and
+// keyset cursor. Cursors only work in the order of the IDs.
+func paginate(db *gorm.DB, table string, opts database.ListOptions) *gorm.DB {
+	columns := []string{table + ".id"}
+	switch opts.Sort {
+	case database.SortCreated:
+		columns = []string{table + ".created_at", table + ".id"}
+	case database.SortUpdated:
+		columns = []string{table + ".updated_at", table + ".id"}
+	}
+
+	direction, after := " DESC", table+".id < ?"
+	if opts.Ascending {
+		direction, after = "", table+".id > ?"
+	}
+
+	order := strings.Join(columns, direction+", ") + direction
+
+	if opts.After != 0 {
+		db = db.Where(after, opts.After)
+	}
+
+	if opts.Limit > 0 {
+		db = db.Limit(opts.Limit)
+	}
+
+	if opts.Offset > 0 {
+		db = db.Offset(opts.Offset)
+	}
+
+	return db.Order(order)
+}
@@ -6,7 +6,9 @@ package sqlite
 
 import (
 	errors2 "errors"
+	"time"
 
+	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/machine"
 
 	"github.com/baas-project/baas/pkg/util"
@@ -18,6 +20,7 @@ import (
 func (s Store) GetMachineByMac(mac util.MacAddress) (*machine.MachineModel, error) {
 	machineModel := machine.MachineModel{}
 	res := s.Table("machine_models").
+		Preload("Disks").
 		Where("address = ?", mac.Address).
 		First(&machineModel)
 
@@ -27,10 +30,16 @@ func (s Store) GetMachineByMac(mac util.MacAddress) (*machine.MachineModel, erro
 // GetMachines returns the values in the machine_models database.
 // TODO: Fetch foreign relations.
 func (s Store) GetMachines() (machines []machine.MachineModel, _ error) {
-	res := s.Find(&machines)
+	res := s.Preload("Disks").Find(&machines)
 	return machines, res.Error
 }
 
+// CountMachines counts all the machines in the database
+func (s Store) CountMachines() (count int64, _ error) {
+	res := s.Model(&machine.MachineModel{}).Count(&count)
+	return count, res.Error
+}
+
 // UpdateMachine updates the information about the machine or creates a machine where one does not yet exist.
 func (s Store) UpdateMachine(machine *machine.MachineModel) error {
 	m, err := s.GetMachineByMac(machine.MacAddress)
@@ -44,9 +53,74 @@ func (s Store) UpdateMachine(machine *machine.MachineModel) error {
 	m.Architecture = machine.Architecture
 	m.Managed = machine.Managed
 	m.Name = machine.Name
+	m.Group = machine.Group
+	m.Restricted = machine.Restricted
+	m.DefaultImage = machine.DefaultImage
 
-	s.Save(&m)
-	return nil
+	return s.Save(m).Error
+}
+
+// SetMachineDirty marks whether the disk of a machine needs to be flashed clean
+func (s Store) SetMachineDirty(mac util.MacAddress, dirty bool) error {
+	res := s.Model(&machine.MachineModel{}).Where("address = ?", mac.Address).Update("dirty", dirty)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// SetMachineRegistration records the decision of an admin on a machine which registered itself
+func (s Store) SetMachineRegistration(mac util.MacAddress, status machine.RegistrationStatus, managed bool) error {
+	res := s.Model(&machine.MachineModel{}).Where("address = ?", mac.Address).Updates(map[string]interface{}{
+		"status":  status,
+		"managed": managed,
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// SetRegistrationKey replaces the key of a pending machine, without counting as a change of the machine
+func (s Store) SetRegistrationKey(mac util.MacAddress, hash string) error {
+	res := s.Model(&machine.MachineModel{}).Where("address = ?", mac.Address).
+		UpdateColumn("registration_key_hash", hash)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// SetMachineClockSkew records how far the clock of a machine is off, without counting as a change of the machine
+func (s Store) SetMachineClockSkew(mac string, skew time.Duration, checkedAt time.Time) error {
+	res := s.Model(&machine.MachineModel{}).Where("address = ?", mac).UpdateColumns(map[string]interface{}{
+		"clock_skew_millis": skew.Milliseconds(),
+		"clock_checked_at":  checkedAt,
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// SetMachineVersions records what the management OS and the control server of a machine ran at seenAt
+func (s Store) SetMachineVersions(mac string, stamp machine.VersionStamp, seenAt time.Time) error {
+	res := s.Model(&machine.MachineModel{}).Where("address = ?", mac).UpdateColumns(map[string]interface{}{
+		"agent_version":  stamp.AgentVersion,
+		"agent_protocol": stamp.AgentProtocol,
+		"server_version": stamp.ServerVersion,
+		"server_commit":  stamp.ServerCommit,
+		"agent_seen_at":  seenAt,
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
 }
 
 // CreateMachine creates the machine in the database
@@ -54,8 +128,78 @@ func (s Store) CreateMachine(machine *machine.MachineModel) error {
 	return s.Create(machine).Error
 }
 
+// importBatchSize is the number of rows inserted per statement when importing machines
+const importBatchSize = 100
+
+// ImportMachines creates the new machines together with their machine images and renames or regroups the known
+// ones. Either all of them are written or none are.
+func (s Store) ImportMachines(created []machine.MachineModel, updated []machine.MachineModel) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if len(created) != 0 {
+			if err := tx.CreateInBatches(&created, importBatchSize).Error; err != nil {
+				return errors.Wrap(err, "create machines")
+			}
+
+			machineImages := make([]images.MachineImageModel, len(created))
+			for i, m := range created {
+				machineImage, err := images.CreateMachineImageModel(m.MacAddress)
+				if err != nil {
+					return err
+				}
+				machineImages[i] = *machineImage
+			}
+
+			if err := tx.CreateInBatches(&machineImages, importBatchSize).Error; err != nil {
+				return errors.Wrap(err, "create machine images")
+			}
+		}
+
+		for _, m := range updated {
+			res := tx.Model(&machine.MachineModel{}).
+				Where("address = ?", m.MacAddress.Address).
+				Updates(map[string]interface{}{"name": m.Name, "group": m.Group})
+			if res.Error != nil {
+				return errors.Wrapf(res.Error, "update machine %s", m.MacAddress.Address)
+			}
+		}
+
+		return nil
+	})
+}
+
 // DeleteMachine removes a machine from the database
 func (s Store) DeleteMachine(machine *machine.MachineModel) error {
 	res := s.Unscoped().Delete(machine)
 	return res.Error
 }
+
+// UpdateInventory replaces the disks known for a machine with the ones reported by the management OS.
+func (s Store) UpdateInventory(mac util.MacAddress, inventory *machine.Inventory) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&machine.MachineModel{}).
+			Where("address = ?", mac.Address).
+			Update("target_device", inventory.TargetDevice)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Where("machine_mac = ?", mac.Address).Delete(&machine.DiskModel{}).Error; err != nil {
+			return err
+		}
+
+		for i := range inventory.Disks {
+			inventory.Disks[i].ID = 0
+			inventory.Disks[i].MachineMAC = mac.Address
+		}
+
+		if len(inventory.Disks) == 0 {
+			return nil
+		}
+
+		return tx.Create(&inventory.Disks).Error
+	})
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/machine"
+	"gorm.io/gorm"
+)
+
+// GetMachineGroups gets the groups which have settings of their own, ordered by name
+func (s Store) GetMachineGroups() ([]machine.MachineGroup, error) {
+	groups := []machine.MachineGroup{}
+	res := s.Order("name").Find(&groups)
+	return groups, res.Error
+}
+
+// GetMachineGroup gets the settings of a group
+func (s Store) GetMachineGroup(name string) (*machine.MachineGroup, error) {
+	var group machine.MachineGroup
+	res := s.Where("name = ?", name).First(&group)
+	return &group, res.Error
+}
+
+// SaveMachineGroup stores the settings of a group, replacing the ones it had
+func (s Store) SaveMachineGroup(group *machine.MachineGroup) error {
+	return s.Save(group).Error
+}
+
+// DeleteMachineGroup forgets the settings of a group, its machines keep their label
+func (s Store) DeleteMachineGroup(name string) error {
+	return deleted(s.Where("name = ?", name).Delete(&machine.MachineGroup{}))
+}
+
+// GetImageDefaults finds the machines and the groups which have the image as their default image
+func (s Store) GetImageDefaults(uuid string) ([]machine.MachineModel, []machine.MachineGroup, error) {
+	machines := []machine.MachineModel{}
+	if err := s.Where("default_image_uuid = ?", uuid).Order("address").Find(&machines).Error; err != nil {
+		return nil, nil, err
+	}
+
+	groups := []machine.MachineGroup{}
+	if err := s.Where("default_image_uuid = ?", uuid).Order("name").Find(&groups).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return machines, groups, nil
+}
+
+// ClearImageDefaults resets the default image of the machines and the groups which boot the image by default
+func (s Store) ClearImageDefaults(uuid string) error {
+	cleared := map[string]interface{}{"default_image_uuid": "", "default_boot_mode": ""}
+
+	return s.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&machine.MachineModel{}).Where("default_image_uuid = ?", uuid).Updates(cleared).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&machine.MachineGroup{}).Where("default_image_uuid = ?", uuid).Updates(cleared).Error
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm/clause"
+)
+
+// CreateMetadataTemplate stores a new metadata template for a user
+func (s Store) CreateMetadataTemplate(template *images.MetadataTemplate) error {
+	return s.Create(template).Error
+}
+
+// GetMetadataTemplates gets all the metadata templates of a user
+func (s Store) GetMetadataTemplates(username string) ([]images.MetadataTemplate, error) {
+	templates := []images.MetadataTemplate{}
+	res := s.Where("username = ?", username).Find(&templates)
+	return templates, res.Error
+}
+
+// GetMetadataTemplate finds a metadata template of a user by its name
+func (s Store) GetMetadataTemplate(username string, name string) (*images.MetadataTemplate, error) {
+	var template images.MetadataTemplate
+	res := s.Where("username = ? AND name = ?", username, name).First(&template)
+	return &template, res.Error
+}
+
+// DeleteMetadataTemplate removes a metadata template from the database
+func (s Store) DeleteMetadataTemplate(template *images.MetadataTemplate) error {
+	return s.Unscoped().Delete(template).Error
+}
+
+// SetMachineMetadata replaces the metadata served to a machine
+func (s Store) SetMachineMetadata(metadata *images.MachineMetadata) error {
+	return s.Clauses(clause.OnConflict{UpdateAll: true}).Create(metadata).Error
+}
+
+// GetMachineMetadata gets the metadata currently served to a machine
+func (s Store) GetMachineMetadata(mac string) (*images.MachineMetadata, error) {
+	var metadata images.MachineMetadata
+	res := s.Where("machine_mac = ?", mac).First(&metadata)
+	return &metadata, res.Error
+}
+
+// GetMachineMetadataByIP finds the metadata of the machine which informed from the given address
+func (s Store) GetMachineMetadataByIP(ip string) (*images.MachineMetadata, error) {
+	var metadata images.MachineMetadata
+	res := s.Where("machine_ip = ?", ip).First(&metadata)
+	return &metadata, res.Error
+}
+
+// DeleteMachineMetadata stops serving metadata to a machine
+func (s Store) DeleteMachineMetadata(mac string) error {
+	return s.Where("machine_mac = ?", mac).Delete(&images.MachineMetadata{}).Error
+}
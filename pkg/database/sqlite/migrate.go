@@ -0,0 +1,367 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"context"
+	errors2 "errors"
+	"fmt"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// foreignKeyMigrations are the foreign keys which were added after the first release. SQLite cannot add
+// constraints to an existing table, so tables created before lack them and are rebuilt.
+var foreignKeyMigrations = []struct {
+	model      interface{}
+	constraint string
+}{
+	{&images.Version{}, "fk_image_models_versions"},
+	{&images.MachineMetadata{}, "fk_machine_metadata_machine"},
+	{&images.BootHistory{}, "fk_boot_histories_machine"},
+	{&images.MetadataTemplate{}, "fk_user_models_metadata_templates"},
+}
+
+// uniqueIndexes are the unique constraints which span multiple columns. Partial indexes cannot be declared
+// through gorm tags, and trashed or deleted rows should not stand in the way of new ones.
+var uniqueIndexes = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_image_models_user_name ON image_models(username, name) " +
+		"WHERE deleted_at IS NULL",
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_versions_image_version ON versions(image_model_uuid, version) " +
+		"WHERE deleted_at IS NULL",
+}
+
+// caseInsensitiveNameIndex keeps users from having several images whose names only differ in case. NOCASE only
+// folds ASCII letters, like the lookups by name.
+const caseInsensitiveNameIndex = "CREATE UNIQUE INDEX IF NOT EXISTS idx_image_models_user_name_nocase " +
+	"ON image_models(username, name COLLATE NOCASE) WHERE deleted_at IS NULL"
+
+// caseInsensitiveEmailIndex keeps several accounts from being made for the same email address. Merged accounts
+// keep their address, they are left out.
+const caseInsensitiveEmailIndex = "CREATE UNIQUE INDEX IF NOT EXISTS idx_user_models_email_nocase " +
+	"ON user_models(email COLLATE NOCASE) WHERE merged_into = ''"
+
+// migrateConstraints rebuilds the tables which miss foreign keys. It runs before the automatic migration, which
+// creates missing tables with all their constraints but cannot add constraints to the existing ones.
+func migrateConstraints(db *gorm.DB, models []interface{}) error {
+	// Constraints declared on the other side of a relation are only known once that side has been parsed
+	for _, model := range models {
+		if err := (&gorm.Statement{DB: db}).Parse(model); err != nil {
+			return err
+		}
+	}
+
+	for _, migration := range foreignKeyMigrations {
+		migrator := db.Migrator()
+		if !migrator.HasTable(migration.model) || migrator.HasConstraint(migration.model, migration.constraint) {
+			continue
+		}
+
+		if err := rebuildTable(db, migration.model); err != nil {
+			return errors.Wrapf(err, "add constraint %s", migration.constraint)
+		}
+	}
+
+	return nil
+}
+
+// rebuildTable recreates the table of model from its current definition and copies the rows over. Rows which
+// violate the new constraints are kept, the integrity check reports them.
+func rebuildTable(db *gorm.DB, model interface{}) error {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	rebuilt := stmt.Schema.Table + "__rebuild"
+
+	// Dropping the old table would cascade into the tables referring to it
+	return withoutForeignKeys(db, func(tx *gorm.DB) error {
+		return copyTable(tx, model, stmt, rebuilt)
+	})
+}
+
+// withoutForeignKeys runs fn in a transaction in which the foreign keys are not enforced. The pragma only applies
+// to one connection and is ignored inside transactions, hence the dedicated connection.
+func withoutForeignKeys(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Passing a context gives the session its own statement, so the connection does not leak into db
+	session := db.Session(&gorm.Session{NewDB: true, Context: ctx})
+	session.Statement.ConnPool = conn
+
+	if err = session.Exec("PRAGMA foreign_keys=OFF").Error; err != nil {
+		return err
+	}
+	defer session.Exec("PRAGMA foreign_keys=ON")
+
+	return session.Transaction(fn)
+}
+
+// copyTable creates the rebuilt table, copies the rows of the old table into it and puts it in its place
+func copyTable(tx *gorm.DB, model interface{}, stmt *gorm.Statement, rebuilt string) error {
+	table := stmt.Schema.Table
+
+	// The new table creates indexes with the same names, so the ones of the old table have to go first
+	var indexes []string
+	err := tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL",
+		table).Scan(&indexes).Error
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if err = tx.Exec(fmt.Sprintf("DROP INDEX `%s`", index)).Error; err != nil {
+			return err
+		}
+	}
+
+	oldColumns, err := tx.Migrator().ColumnTypes(model)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Table(rebuilt).Migrator().CreateTable(model); err != nil {
+		return err
+	}
+
+	// Only copy the columns which exist in both, the automatic migration adds the others later on
+	var columns []string
+	for _, column := range oldColumns {
+		if _, ok := stmt.Schema.FieldsByDBName[column.Name()]; ok {
+			columns = append(columns, "`"+column.Name()+"`")
+		}
+	}
+
+	list := strings.Join(columns, ",")
+	statements := []string{
+		fmt.Sprintf("INSERT INTO `%s` (%s) SELECT %s FROM `%s`", rebuilt, list, list, table),
+		fmt.Sprintf("DROP TABLE `%s`", table),
+		fmt.Sprintf("ALTER TABLE `%s` RENAME TO `%s`", rebuilt, table),
+	}
+
+	for _, statement := range statements {
+		if err = tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// timestampMigrations fill in the creation and modification times of the rows from before they were recorded. The
+// versions of an image remember when they were made, the other tables have nothing better than the migration.
+var timestampMigrations = []string{
+	`UPDATE image_models SET
+		created_at = COALESCE((SELECT MIN(created_at) FROM versions WHERE image_model_uuid = image_models.uuid),
+			CURRENT_TIMESTAMP),
+		updated_at = COALESCE((SELECT MAX(updated_at) FROM versions WHERE image_model_uuid = image_models.uuid),
+			CURRENT_TIMESTAMP)
+		WHERE created_at IS NULL`,
+	"UPDATE machine_image_models SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP " +
+		"WHERE created_at IS NULL",
+	"UPDATE user_models SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE created_at IS NULL",
+	"UPDATE machine_models SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP " +
+		"WHERE created_at IS NULL",
+}
+
+// migrateTimestamps fills in the timestamps of the rows which were created before the columns were added
+func migrateTimestamps(db *gorm.DB) error {
+	for _, migration := range timestampMigrations {
+		if err := db.Exec(migration).Error; err != nil {
+			return errors.Wrap(err, "fill in timestamps")
+		}
+	}
+
+	return nil
+}
+
+// migrateFailureReasons gives the boots which did not complete before their reasons were recorded one. The free text
+// which the control server kept as the reason becomes their detail.
+func migrateFailureReasons(db *gorm.DB) error {
+	err := db.Exec(`UPDATE boot_histories SET failure_detail = failure_reason, failure_reason = ''
+		WHERE failure_reason != '' AND failure_reason NOT IN ?`, images.FailureReasons).Error
+	if err != nil {
+		return errors.Wrap(err, "keep the failure details")
+	}
+
+	err = db.Exec("UPDATE boot_histories SET failure_reason = ? WHERE failure_reason = '' AND state IN ?",
+		images.FailureUnknown, []images.BootState{images.BootFailed, images.BootExpired}).Error
+	if err != nil {
+		return errors.Wrap(err, "fill in the failure reasons")
+	}
+
+	err = db.Exec("UPDATE boot_histories SET failure_reason = ? WHERE failure_reason = '' AND state = ?",
+		images.FailureCancelled, images.BootCancelled).Error
+	return errors.Wrap(err, "fill in the failure reasons")
+}
+
+// migrateBootDurations moves the times of the boots which end before they start to their start, so no boot lasts
+// a negative amount of time. They were recorded while the clock of the control server was set back.
+func migrateBootDurations(db *gorm.DB) error {
+	err := db.Exec(`UPDATE boot_histories SET finished_at = created_at
+		WHERE finished_at IS NOT NULL AND julianday(finished_at) < julianday(created_at)`).Error
+	if err != nil {
+		return errors.Wrap(err, "fix the finishing times of boots")
+	}
+
+	err = db.Exec(`UPDATE boot_histories SET last_seen = created_at
+		WHERE julianday(last_seen) < julianday(created_at)`).Error
+	return errors.Wrap(err, "fix the heartbeats of boots")
+}
+
+// usageIndexes let the usage reports pick the boots of a period and the members of a course without going through
+// the whole tables. The boot index covers the columns the report reads, the rows themselves are not looked up.
+var usageIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS idx_boot_histories_usage ON boot_histories(created_at, finished_at, setup_uuid, state)",
+	"CREATE INDEX IF NOT EXISTS idx_course_members_username ON course_members(username)",
+	"CREATE INDEX IF NOT EXISTS idx_versions_created_at ON versions(created_at)",
+}
+
+// migrateUsageIndexes creates the indexes of the usage reports
+func migrateUsageIndexes(db *gorm.DB) error {
+	for _, index := range usageIndexes {
+		if err := db.Exec(index).Error; err != nil {
+			return errors.Wrap(err, "create usage index")
+		}
+	}
+
+	return nil
+}
+
+// migrateUniqueIndexes renames the duplicates which were allowed before and then creates the unique indexes
+func migrateUniqueIndexes(db *gorm.DB) error {
+	// Images with the same name as an older image of the same user get their UUID appended to their name
+	err := db.Exec(`UPDATE image_models SET name = name || ' (' || uuid || ')'
+		WHERE deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM image_models AS other WHERE other.deleted_at IS NULL AND other.username = image_models.username
+			AND other.name = image_models.name AND other.rowid < image_models.rowid)`).Error
+	if err != nil {
+		return errors.Wrap(err, "rename duplicate images")
+	}
+
+	// Duplicated versions cannot be told apart, only the oldest row is kept
+	err = db.Exec(`UPDATE versions SET deleted_at = CURRENT_TIMESTAMP
+		WHERE deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM versions AS other WHERE other.deleted_at IS NULL AND other.version = versions.version
+			AND other.image_model_uuid = versions.image_model_uuid AND other.id < versions.id)`).Error
+	if err != nil {
+		return errors.Wrap(err, "remove duplicate versions")
+	}
+
+	for _, index := range uniqueIndexes {
+		if err = db.Exec(index).Error; err != nil {
+			return errors.Wrap(err, "create unique index")
+		}
+	}
+
+	// Names differing only in case are not renamed, which of them is meant is up to the admin. Until they are
+	// resolved the index waits, the integrity check lists them and creating images still refuses new ones.
+	collisions, err := findNameCollisions(db)
+	if err != nil {
+		return errors.Wrap(err, "find image names differing in case")
+	}
+
+	if len(collisions) == 0 {
+		if err = db.Exec(caseInsensitiveNameIndex).Error; err != nil {
+			return errors.Wrap(err, "create unique index")
+		}
+	}
+
+	if err = normalizeEmails(db); err != nil {
+		return errors.Wrap(err, "normalize email addresses")
+	}
+
+	return errors.Wrap(createEmailIndex(db), "create unique index")
+}
+
+// normalizeEmails brings the email addresses which were stored as they were given into their normal form. An
+// address whose normal form is taken by another user is left alone, the users are reported as a collision.
+func normalizeEmails(db *gorm.DB) error {
+	var users []user.UserModel
+	if err := db.Select("username, email").Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		normalized := user.NormalizeEmail(u.Email)
+		if normalized == u.Email {
+			continue
+		}
+
+		err := db.Model(&user.UserModel{}).Where("username = ?", u.Username).Update("email", normalized).Error
+		var constraint *database.ConstraintError
+		if err != nil && !errors2.As(err, &constraint) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createEmailIndex creates the index on the email addresses once no users share one. Until the duplicates are
+// merged the integrity check lists them and the handlers still refuse new ones.
+func createEmailIndex(db *gorm.DB) error {
+	collisions, err := findEmailCollisions(db)
+	if err != nil || len(collisions) != 0 {
+		return err
+	}
+
+	return db.Exec(caseInsensitiveEmailIndex).Error
+}
+
+// translateConstraintError turns the constraint errors of SQLite into a database.ConstraintError, so handlers can
+// tell a conflict apart from a broken database. The driver only exposes these as messages.
+func translateConstraintError(db *gorm.DB) {
+	if db.Error == nil {
+		return
+	}
+
+	message := db.Error.Error()
+	for prefix, kind := range map[string]database.ConstraintKind{
+		"UNIQUE constraint failed":      database.UniqueConstraint,
+		"FOREIGN KEY constraint failed": database.ForeignKeyConstraint,
+	} {
+		if strings.HasPrefix(message, prefix) {
+			db.Error = &database.ConstraintError{
+				Kind:    kind,
+				Columns: strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(message, prefix), ":")),
+				Err:     db.Error,
+			}
+			return
+		}
+	}
+}
+
+// registerConstraintErrors translates the errors of every statement which writes to the database
+func registerConstraintErrors(db *gorm.DB) error {
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Register("baas:constraint_errors", translateConstraintError),
+		callbacks.Update().Register("baas:constraint_errors", translateConstraintError),
+		callbacks.Delete().Register("baas:constraint_errors", translateConstraintError),
+		callbacks.Raw().Register("baas:constraint_errors", translateConstraintError),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/pki"
+	"gorm.io/gorm"
+)
+
+// RotateCertificateAuthority stores a new CA chain and retires the current one
+func (s Store) RotateCertificateAuthority(ca *pki.CertificateAuthority) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&pki.CertificateAuthority{}).Where("retired_at IS NULL").Update("retired_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+
+		return tx.Create(ca).Error
+	})
+}
+
+// GetCertificateAuthorities lists every CA chain which was uploaded, the current one first
+func (s Store) GetCertificateAuthorities() ([]pki.CertificateAuthority, error) {
+	authorities := []pki.CertificateAuthority{}
+	res := s.Order("id DESC").Find(&authorities)
+	return authorities, res.Error
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// replicaRetryInterval is how long the reads stay on the primary after the read replica failed
+const replicaRetryInterval = 30 * time.Second
+
+const (
+	// poolPrimary and poolReplica label the queries in baas_store_queries_total by the pool which served them
+	poolPrimary = "primary"
+	poolReplica = "replica"
+)
+
+var storeQueries = metrics.NewCounter("baas_store_queries_total",
+	"Queries of the reports and statistics, by the database pool which served them.", "query", "pool")
+
+// readReplica is a copy of the database the heavy read-only queries run on, so they do not hold up the
+// connections of the provisioning. It is opened again once replicaRetryInterval passed after it failed.
+type readReplica struct {
+	dsn string
+
+	mu        sync.Mutex
+	db        *gorm.DB
+	downUntil time.Time
+}
+
+// openReplica opens a copy of the database read-only. It is not migrated, whatever keeps it in sync copies the
+// schema of the primary as well.
+func openReplica(dsn string) (*gorm.DB, error) {
+	// SQLite only takes the mode from URIs, a plain path would be created when it is missing
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+
+	options := "mode=ro&_query_only=1"
+	if strings.Contains(dsn, "?") {
+		dsn += "&" + options
+	} else {
+		dsn += "?" + options
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Warn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Opening does not touch the file, the first query would
+	if err = db.Exec("SELECT 1 FROM sqlite_master LIMIT 1").Error; err != nil {
+		if sqlDB, derr := db.DB(); derr == nil {
+			_ = sqlDB.Close()
+		}
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// available is the replica to read from, nil while it is down
+func (r *readReplica) available() *gorm.DB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.db != nil || time.Now().Before(r.downUntil) {
+		return r.db
+	}
+
+	db, err := openReplica(r.dsn)
+	if err != nil {
+		log.Warnf("Reading from the primary database, the read replica cannot be opened: %v", err)
+		r.downUntil = time.Now().Add(replicaRetryInterval)
+		return nil
+	}
+
+	r.db = db
+	return db
+}
+
+// failed takes the replica out of use for replicaRetryInterval
+func (r *readReplica) failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another query may have noticed first
+	if r.db == nil {
+		return
+	}
+
+	log.Warnf("Reading from the primary database for %s, the read replica failed: %v", replicaRetryInterval, err)
+	if sqlDB, derr := r.db.DB(); derr == nil {
+		_ = sqlDB.Close()
+	}
+	r.db = nil
+	r.downUntil = time.Now().Add(replicaRetryInterval)
+}
+
+// NewSqliteStoreWithReadReplica creates the database storage as NewSqliteStore, and runs the reports and
+// statistics on the copy of the database at replicaDSN while it can be read. Everything runs on the primary when
+// replicaDSN is empty.
+func NewSqliteStoreWithReadReplica(dbpath string, replicaDSN string) (database.Store, error) {
+	store, err := NewSqliteStore(dbpath)
+	if err != nil || replicaDSN == "" {
+		return store, err
+	}
+
+	primary := store.(Store)
+	primary.replica = &readReplica{dsn: replicaDSN}
+	if primary.replica.available() != nil {
+		log.Infof("Running the reports on the read replica %s", replicaDSN)
+	}
+
+	return primary, nil
+}
+
+// readOnly runs a query which only reads and can do with a copy which lags behind on the read replica, and on
+// the primary when there is none or it fails. The writes and the reads which have to see them never come here.
+func (s Store) readOnly(name string, query func(Store) error) error {
+	if s.replica != nil {
+		if db := s.replica.available(); db != nil {
+			ctx := s.Statement.Context
+			if ctx != nil {
+				db = db.WithContext(ctx)
+			}
+
+			err := query(Store{DB: db})
+			if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+				storeQueries.Inc(name, poolReplica)
+				return err
+			}
+
+			// A request which went away says nothing about the replica
+			if (ctx != nil && ctx.Err() != nil) || errors.Is(err, context.Canceled) {
+				return err
+			}
+
+			s.replica.failed(err)
+		}
+	}
+
+	storeQueries.Inc(name, poolPrimary)
+	return query(s)
+}
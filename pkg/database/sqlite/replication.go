@@ -0,0 +1,426 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/replication"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// replicationStateID is the ID of the single row holding the state of a replica
+const replicationStateID = 1
+
+// replicatedTable is a table a replica copies, together with the columns of its primary key
+type replicatedTable struct {
+	name string
+	keys []string
+}
+
+// replicatedTables are the tables of all models except the local ones
+func replicatedTables(db *gorm.DB) ([]replicatedTable, error) {
+	local := map[reflect.Type]bool{}
+	for _, model := range localModels {
+		local[reflect.TypeOf(model)] = true
+	}
+
+	var tables []replicatedTable
+	for _, model := range models {
+		if local[reflect.TypeOf(model)] {
+			continue
+		}
+
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, err
+		}
+
+		if len(stmt.Schema.PrimaryFieldDBNames) == 0 {
+			return nil, fmt.Errorf("table %s has no primary key to replicate it by", stmt.Schema.Table)
+		}
+
+		tables = append(tables, replicatedTable{stmt.Schema.Table, stmt.Schema.PrimaryFieldDBNames})
+	}
+
+	return tables, nil
+}
+
+// keyObject is the SQL building the JSON object with the primary key of the row, row is NEW or OLD in a trigger
+func (t replicatedTable) keyObject(row string) string {
+	var pairs []string
+	for _, key := range t.keys {
+		pairs = append(pairs, fmt.Sprintf("'%s', %s.`%s`", key, row, key))
+	}
+
+	return "json_object(" + strings.Join(pairs, ", ") + ")"
+}
+
+// triggers are the statements creating the triggers which log the changes of the table. Each of them drops the
+// earlier entry of the row first. An update of the primary key deletes the row under its old key.
+func (t replicatedTable) triggers() []string {
+	forget := "DELETE FROM replication_log WHERE table_name = '%s' AND row_key IN (%s);"
+	record := "INSERT INTO replication_log (table_name, row_key, deleted) VALUES ('%s', %s, %d);"
+	oldKey, newKey := t.keyObject("OLD"), t.keyObject("NEW")
+
+	return []string{
+		fmt.Sprintf("CREATE TRIGGER `replicate_%s_insert` AFTER INSERT ON `%s` BEGIN %s %s END", t.name, t.name,
+			fmt.Sprintf(forget, t.name, newKey), fmt.Sprintf(record, t.name, newKey, 0)),
+		fmt.Sprintf("CREATE TRIGGER `replicate_%s_update` AFTER UPDATE ON `%s` BEGIN %s %s %s END", t.name, t.name,
+			fmt.Sprintf(forget, t.name, oldKey+", "+newKey),
+			fmt.Sprintf("INSERT INTO replication_log (table_name, row_key, deleted) SELECT '%s', %s, 1 WHERE %s != %s;",
+				t.name, oldKey, oldKey, newKey),
+			fmt.Sprintf(record, t.name, newKey, 0)),
+		fmt.Sprintf("CREATE TRIGGER `replicate_%s_delete` AFTER DELETE ON `%s` BEGIN %s %s END", t.name, t.name,
+			fmt.Sprintf(forget, t.name, oldKey), fmt.Sprintf(record, t.name, oldKey, 1)),
+	}
+}
+
+// replicationLog creates the log of the changes. It is not left to the automatic migration, which rebuilds tables
+// and cannot rebuild this one while the triggers of the other tables refer to it. AUTOINCREMENT keeps the sequence
+// numbers of removed entries from being handed out again.
+var replicationLog = []string{
+	"CREATE TABLE IF NOT EXISTS replication_log (seq integer PRIMARY KEY AUTOINCREMENT, table_name text NOT NULL, " +
+		"row_key text NOT NULL, deleted numeric NOT NULL DEFAULT false)",
+	"CREATE INDEX IF NOT EXISTS idx_replication_log_row ON replication_log(table_name, row_key)",
+}
+
+// migrateReplicationLog creates the triggers which log the changes of the replicated tables. A table without them
+// is new, or was rebuilt and lost them, so its rows which are not in the log are logged as changed to let the
+// replicas fetch them.
+func migrateReplicationLog(db *gorm.DB) error {
+	for _, statement := range replicationLog {
+		if err := db.Exec(statement).Error; err != nil {
+			return errors.Wrap(err, "create the replication log")
+		}
+	}
+
+	tables, err := replicatedTables(db)
+	if err != nil {
+		return errors.Wrap(err, "find the replicated tables")
+	}
+
+	for _, table := range tables {
+		var triggers int64
+		err = db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ? AND name LIKE ?",
+			table.name, "replicate_%").Scan(&triggers).Error
+		if err != nil {
+			return errors.Wrap(err, "find the replication triggers")
+		}
+
+		if triggers == 3 {
+			continue
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, kind := range []string{"insert", "update", "delete"} {
+				err := tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS `replicate_%s_%s`", table.name, kind)).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, trigger := range table.triggers() {
+				if err := tx.Exec(trigger).Error; err != nil {
+					return err
+				}
+			}
+
+			key := table.keyObject("`" + table.name + "`")
+			return tx.Exec(fmt.Sprintf("INSERT INTO replication_log (table_name, row_key, deleted) "+
+				"SELECT '%s', %s, 0 FROM `%s` WHERE NOT EXISTS (SELECT 1 FROM replication_log "+
+				"WHERE table_name = '%s' AND row_key = %s)", table.name, key, table.name, table.name, key)).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "log the changes of %s", table.name)
+		}
+	}
+
+	return nil
+}
+
+// decodeObject decodes a JSON object, keeping the numbers as they were written
+func decodeObject(data string) (map[string]interface{}, error) {
+	var object map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	return object, decoder.Decode(&object)
+}
+
+// keyCondition is the WHERE clause which finds a row by its primary key. The columns are sorted, so the same key
+// always gives the same clause.
+func keyCondition(key map[string]interface{}) (string, []interface{}) {
+	columns := make([]string, 0, len(key))
+	for column := range key {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var clauses []string
+	var args []interface{}
+	for _, column := range columns {
+		clauses = append(clauses, fmt.Sprintf("`%s` = ?", column))
+		args = append(args, jsonValue(key[column]))
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+// readRow reads all columns of the row with the primary key
+func readRow(tx *gorm.DB, table string, key map[string]interface{}) (map[string]interface{}, error) {
+	condition, args := keyCondition(key)
+	rows, err := tx.Raw(fmt.Sprintf("SELECT * FROM `%s` WHERE %s", table, condition), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	if err = rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+
+	row := map[string]interface{}{}
+	for i, column := range columns {
+		row[column] = values[i]
+	}
+
+	return row, nil
+}
+
+// GetReplicationChanges fetches the rows which changed after since, oldest first. The log and the rows are read in
+// one transaction, so the rows are the state of the log. A row which is gone by now is sent as deleted.
+func (s Store) GetReplicationChanges(since uint64, limit int) ([]replication.Change, error) {
+	changes := []replication.Change{}
+	err := s.Transaction(func(tx *gorm.DB) error {
+		var entries []replication.LogEntry
+		if err := tx.Where("seq > ?", since).Order("seq").Limit(limit).Find(&entries).Error; err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			key, err := decodeObject(entry.Key)
+			if err != nil {
+				return errors.Wrapf(err, "read the key of change %d", entry.Seq)
+			}
+
+			change := replication.Change{Seq: entry.Seq, Table: entry.Table, Key: key, Deleted: entry.Deleted}
+			if !entry.Deleted {
+				change.Row, err = readRow(tx, entry.Table, key)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					change.Deleted = true
+				} else if err != nil {
+					return errors.Wrapf(err, "read the row of change %d", entry.Seq)
+				}
+			}
+
+			changes = append(changes, change)
+		}
+
+		return nil
+	})
+
+	return changes, err
+}
+
+// tableColumns maps the columns of a table to their declared types, in lower case
+func tableColumns(tx *gorm.DB, table string) (map[string]string, error) {
+	var info []struct {
+		Name string
+		Type string
+	}
+	if err := tx.Raw(fmt.Sprintf("PRAGMA table_info(`%s`)", table)).Scan(&info).Error; err != nil {
+		return nil, err
+	}
+
+	columns := map[string]string{}
+	for _, column := range info {
+		columns[column.Name] = strings.ToLower(column.Type)
+	}
+
+	return columns, nil
+}
+
+// jsonValue turns a value decoded from JSON into one the driver stores like the primary did
+func jsonValue(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+
+	f, _ := number.Float64()
+	return f
+}
+
+// columnValue turns a value of a row decoded from JSON into one of the type the column is declared with. JSON has
+// no times or bytes, those were sent as text.
+func columnValue(value interface{}, declared string) (interface{}, error) {
+	text, ok := value.(string)
+	switch {
+	case ok && (strings.Contains(declared, "date") || strings.Contains(declared, "time")):
+		return time.Parse(time.RFC3339Nano, text)
+	case ok && declared == "blob":
+		return base64.StdEncoding.DecodeString(text)
+	default:
+		return jsonValue(value), nil
+	}
+}
+
+// applyChange writes a change of the primary, replacing whatever the replica has under its key
+func applyChange(tx *gorm.DB, change replication.Change, columns map[string]string) error {
+	for column := range change.Key {
+		if _, ok := columns[column]; !ok {
+			return fmt.Errorf("table %s has no column %s", change.Table, column)
+		}
+	}
+
+	if change.Deleted {
+		condition, args := keyCondition(change.Key)
+		return tx.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE %s", change.Table, condition), args...).Error
+	}
+
+	names := make([]string, 0, len(change.Row))
+	for column := range change.Row {
+		names = append(names, column)
+	}
+	sort.Strings(names)
+
+	var quoted, placeholders []string
+	var args []interface{}
+	for _, column := range names {
+		declared, ok := columns[column]
+		if !ok {
+			return fmt.Errorf("table %s has no column %s", change.Table, column)
+		}
+
+		value, err := columnValue(change.Row[column], declared)
+		if err != nil {
+			return errors.Wrapf(err, "read column %s of %s", column, change.Table)
+		}
+
+		quoted = append(quoted, "`"+column+"`")
+		placeholders = append(placeholders, "?")
+		args = append(args, value)
+	}
+
+	return tx.Exec(fmt.Sprintf("INSERT OR REPLACE INTO `%s` (%s) VALUES (%s)", change.Table,
+		strings.Join(quoted, ", "), strings.Join(placeholders, ", ")), args...).Error
+}
+
+// ApplyReplicationChanges writes the changes and moves the cursor in one transaction. The changes arrive in the order
+// of the log of the primary rather than that of the foreign keys, which are only whole again once all changes
+// are in, so they are not enforced while the changes are written.
+func (s Store) ApplyReplicationChanges(changes []replication.Change, cursor uint64) error {
+	tables, err := replicatedTables(s.DB)
+	if err != nil {
+		return err
+	}
+
+	replicated := map[string]bool{}
+	for _, table := range tables {
+		replicated[table.name] = true
+	}
+
+	return withoutForeignKeys(s.DB, func(tx *gorm.DB) error {
+		columns := map[string]map[string]string{}
+		for _, change := range changes {
+			if !replicated[change.Table] {
+				return fmt.Errorf("change %d is of %s, which is not replicated", change.Seq, change.Table)
+			}
+
+			if columns[change.Table] == nil {
+				if columns[change.Table], err = tableColumns(tx, change.Table); err != nil {
+					return err
+				}
+			}
+
+			if err := applyChange(tx, change, columns[change.Table]); err != nil {
+				return errors.Wrapf(err, "apply change %d", change.Seq)
+			}
+		}
+
+		return tx.Model(&replication.State{}).Where("id = ?", replicationStateID).Update("cursor", cursor).Error
+	})
+}
+
+// GetReplicationState fetches the state of the replica, a database which never was one gets an empty state
+func (s Store) GetReplicationState() (*replication.State, error) {
+	state := replication.State{}
+	res := s.Where(replication.State{ID: replicationStateID}).FirstOrInit(&state)
+	return &state, res.Error
+}
+
+// SetReplicaOf makes the database a replica of primary. The cursor starts over when the primary is another one.
+func (s Store) SetReplicaOf(primary string) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		state := replication.State{}
+		if err := tx.Where(replication.State{ID: replicationStateID}).FirstOrInit(&state).Error; err != nil {
+			return err
+		}
+
+		if state.PromotedAt != nil {
+			return database.ErrPromoted
+		}
+
+		if state.PrimaryURL != primary {
+			state.PrimaryURL = primary
+			state.Cursor = 0
+			state.SyncedAt = time.Time{}
+		}
+
+		return tx.Save(&state).Error
+	})
+}
+
+// SetReplicationSynced records that the replica caught up with its primary at the given time
+func (s Store) SetReplicationSynced(at time.Time) error {
+	return s.Model(&replication.State{}).Where("id = ?", replicationStateID).Update("synced_at", at).Error
+}
+
+// PromoteReplica clears the primary of a replica, which makes it a control server of its own
+func (s Store) PromoteReplica() error {
+	now := time.Now()
+	res := s.Model(&replication.State{}).Where("id = ? AND primary_url != ''", replicationStateID).
+		Updates(map[string]interface{}{"primary_url": "", "promoted_at": &now})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return database.ErrNotReplica
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/baas-project/baas/pkg/secrets"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// secretColumn is a column of a model which holds sealed secrets
+type secretColumn struct {
+	table  string
+	key    string
+	column string
+}
+
+var secretType = reflect.TypeOf(secrets.Secret{})
+
+// findSecretColumns finds the columns of the models which are declared as secrets.Secret
+func findSecretColumns(db *gorm.DB, models []interface{}) ([]secretColumn, error) {
+	var columns []secretColumn
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, err
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			if field.FieldType != secretType || field.DBName == "" {
+				continue
+			}
+
+			if stmt.Schema.PrioritizedPrimaryField == nil {
+				return nil, fmt.Errorf("table %s has secrets but no primary key", stmt.Schema.Table)
+			}
+
+			columns = append(columns, secretColumn{stmt.Schema.Table,
+				stmt.Schema.PrioritizedPrimaryField.DBName, field.DBName})
+		}
+	}
+
+	return columns, nil
+}
+
+// sealedValue is a secret as it is stored, together with the primary key of its row
+type sealedValue struct {
+	Key    interface{}
+	Sealed string
+}
+
+// readSealed reads the secrets of a column without opening them
+func readSealed(db *gorm.DB, column secretColumn) ([]sealedValue, error) {
+	rows, err := db.Raw(fmt.Sprintf("SELECT `%s`, `%s` FROM `%s` WHERE `%s` != ''",
+		column.key, column.column, column.table, column.column)).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []sealedValue
+	for rows.Next() {
+		var value sealedValue
+		if err = rows.Scan(&value.Key, &value.Sealed); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+// secretKeyIDs lists the keys the secrets in the columns of the models are sealed with
+func secretKeyIDs(db *gorm.DB, models []interface{}) ([]string, error) {
+	columns, err := findSecretColumns(db, models)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, column := range columns {
+		values, err := readSealed(db, column)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s.%s", column.table, column.column)
+		}
+
+		for _, value := range values {
+			id, err := secrets.KeyID(value.Sealed)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read %s.%s", column.table, column.column)
+			}
+			seen[id] = true
+		}
+	}
+
+	ids := []string{}
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// rotateSecrets seals the data keys of all secrets in the columns of the models with the primary key of the
+// keyring. Either all of them are rotated or none are.
+func rotateSecrets(db *gorm.DB, models []interface{}, keyring *secrets.Keyring) (int, error) {
+	columns, err := findSecretColumns(db, models)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, column := range columns {
+			values, err := readSealed(tx, column)
+			if err != nil {
+				return errors.Wrapf(err, "read %s.%s", column.table, column.column)
+			}
+
+			for _, value := range values {
+				sealed, changed, err := keyring.Rotate(value.Sealed)
+				if err != nil {
+					return errors.Wrapf(err, "rotate %s.%s", column.table, column.column)
+				}
+
+				if !changed {
+					continue
+				}
+
+				err = tx.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = ? WHERE `%s` = ?",
+					column.table, column.column, column.key), sealed, value.Key).Error
+				if err != nil {
+					return errors.Wrapf(err, "rotate %s.%s", column.table, column.column)
+				}
+				rotated++
+			}
+		}
+
+		return nil
+	})
+
+	return rotated, err
+}
+
+// SecretKeyIDs lists the keys the secrets in the database are sealed with
+func (s Store) SecretKeyIDs() ([]string, error) {
+	return secretKeyIDs(s.DB, models)
+}
+
+// RotateSecrets seals all secrets in the database with the primary key of the keyring, it returns how many were
+// sealed with another key
+func (s Store) RotateSecrets(keyring *secrets.Keyring) (int, error) {
+	return rotateSecrets(s.DB, models, keyring)
+}
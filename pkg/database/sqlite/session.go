@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// CreateSession records a new session, the expired sessions of its user are forgotten along the way
+func (s Store) CreateSession(session *user.SessionModel) error {
+	res := s.Where("username = ? AND expires_at < ?", session.Username, time.Now()).Delete(&user.SessionModel{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	return s.Create(session).Error
+}
+
+// GetSession gets the session with the specified id from the database
+func (s Store) GetSession(id string) (*user.SessionModel, error) {
+	session := user.SessionModel{}
+	res := s.Where("id = ?", id).First(&session)
+	return &session, res.Error
+}
+
+// GetSessionsByUsername gets the sessions of a user which have not expired, the most recently used first
+func (s Store) GetSessionsByUsername(username string) ([]user.SessionModel, error) {
+	sessions := []user.SessionModel{}
+	res := s.Where("username = ? AND expires_at >= ?", username, time.Now()).
+		Order("last_used_at DESC").Find(&sessions)
+	return sessions, res.Error
+}
+
+// TouchSession records that a session was used from an address
+func (s Store) TouchSession(id string, from string, at time.Time) error {
+	return s.Model(&user.SessionModel{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"last_used_from": from, "last_used_at": at}).Error
+}
+
+// FlagSessionAnomaly marks a session as used from an unexpected network, it reports whether the session had not
+// been marked before
+func (s Store) FlagSessionAnomaly(id string, at time.Time) (bool, error) {
+	res := s.Model(&user.SessionModel{}).Where("id = ? AND anomaly_at IS NULL", id).Update("anomaly_at", at)
+	return res.RowsAffected != 0, res.Error
+}
+
+// GetSessionsExpiredBefore gets the sessions of all users which expired before the given time
+func (s Store) GetSessionsExpiredBefore(at time.Time) ([]user.SessionModel, error) {
+	sessions := []user.SessionModel{}
+	res := s.Where("expires_at < ?", at).Order("expires_at").Find(&sessions)
+	return sessions, res.Error
+}
+
+// DeleteSession forgets a session
+func (s Store) DeleteSession(id string) error {
+	return s.Where("id = ?", id).Delete(&user.SessionModel{}).Error
+}
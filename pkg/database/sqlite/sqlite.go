@@ -6,9 +6,19 @@
 package sqlite
 
 import (
+	"context"
+	"strings"
+
 	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/baas-project/baas/pkg/model/bootstrap"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/idempotency"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/pki"
+	"github.com/baas-project/baas/pkg/model/replication"
+	"github.com/baas-project/baas/pkg/model/telemetry"
 	"github.com/baas-project/baas/pkg/model/user"
 	"github.com/pkg/errors"
 	"gorm.io/driver/sqlite"
@@ -19,41 +29,137 @@ import (
 // InMemoryPath is the path inside the memory pointing to the database
 const InMemoryPath = "file::memory:"
 
+// models are all the entities stored in the database
+var models = []interface{}{
+	&images.BootSetup{},
+	&images.ImageSetup{},
+	&images.ImageModel{},
+	&images.MachineImageModel{},
+	&machine.MachineModel{},
+	&machine.DiskModel{},
+	&user.UserModel{},
+	&user.IdentityModel{},
+	&user.SSHKeyModel{},
+	&user.SessionModel{},
+	&user.RoleLimits{},
+	&user.LimitOverrides{},
+	&user.FavoriteImage{},
+	&images.Version{},
+	&images.ImageFrozen{},
+	&images.MetadataTemplate{},
+	&images.BootTemplate{},
+	&images.MachineMetadata{},
+	&images.BootHistory{},
+	&images.BootArtifact{},
+	&images.BootKey{},
+	&images.ImageSet{},
+	&images.ImageSetMember{},
+	&images.BackupPolicy{},
+	&images.VersionBackup{},
+	&images.ImageWebhook{},
+	&images.WebhookDelivery{},
+	&agent.Release{},
+	&agent.Channel{},
+	&machine.MachineGrant{},
+	&machine.MachineCommand{},
+	&machine.MachineGroup{},
+	&course.CourseModel{},
+	&course.CourseMember{},
+	&course.CourseMachine{},
+	&course.ModeratorScope{},
+	&pki.CertificateAuthority{},
+	&idempotency.Record{},
+	&replication.State{},
+	&bootstrap.Record{},
+	&telemetry.State{},
+}
+
+// localModels belong to the control server they are stored on, a replica does not copy them from its primary
+var localModels = []interface{}{
+	&idempotency.Record{},
+	&replication.State{},
+	&telemetry.State{},
+}
+
 // Store is the database structure
 type Store struct {
 	*gorm.DB
+	// replica serves the queries marked read-only, it is nil when there is no read replica
+	replica *readReplica
+}
+
+// WithContext returns the store with its queries bound to ctx. SQLite interrupts the statement which is running
+// once ctx is done, a transaction is rolled back.
+func (s Store) WithContext(ctx context.Context) database.Store {
+	return Store{DB: s.DB.WithContext(ctx), replica: s.replica}
 }
 
 // NewSqliteStore creates the database storage using the given string as the database file.
 func NewSqliteStore(dbpath string) (database.Store, error) {
-	db, err := gorm.Open(sqlite.Open(dbpath), &gorm.Config{
+	// The foreign keys pragma only holds for a single connection, so it is set for every one through the DSN
+	dsn := dbpath + "?_foreign_keys=1"
+	if strings.Contains(dbpath, "?") {
+		dsn = dbpath + "&_foreign_keys=1"
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
 
-	if res := db.Exec("PRAGMA foreign_keys=ON", nil); res.Error != nil {
-		return nil, res.Error
-	}
-
 	if err != nil {
 		return nil, errors.Wrap(err, "open db")
 	}
 
-	err = db.AutoMigrate(
-		&images.BootSetup{},
-		&images.ImageSetup{},
-		&images.ImageModel{},
-		&images.MachineImageModel{},
-		&machine.MachineModel{},
-		&user.UserModel{},
-		&images.Version{},
-		&images.ImageFrozen{},
-	)
+	// Every connection to an in-memory database gets a database of its own
+	if dbpath == InMemoryPath {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, errors.Wrap(err, "open db")
+		}
+
+		sqlDB.SetMaxOpenConns(1)
+	}
+
+	if err = registerConstraintErrors(db); err != nil {
+		return nil, errors.Wrap(err, "register callbacks")
+	}
+
+	if err = migrateConstraints(db, models); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
+	err = db.AutoMigrate(models...)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "migrate")
 	}
 
+	if err = migrateUniqueIndexes(db); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
+	if err = migrateTimestamps(db); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
+	if err = migrateFailureReasons(db); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
+	if err = migrateBootDurations(db); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
+	if err = migrateUsageIndexes(db); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
+	// The triggers go last, the migrations before may have rebuilt the tables they were on
+	if err = migrateReplicationLog(db); err != nil {
+		return nil, errors.Wrap(err, "migrate")
+	}
+
 	return Store{
-		db,
+		DB: db,
 	}, nil
 }
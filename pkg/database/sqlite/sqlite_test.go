@@ -5,14 +5,29 @@
 package sqlite
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/baas-project/baas/pkg/database"
 	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/replication"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
+	"github.com/baas-project/baas/pkg/util"
 
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
 )
 
 type User struct {
@@ -49,3 +64,637 @@ func TestNewSqliteStore(t *testing.T) {
 	assert.Equal(t, string(imr.UUID), "yeet")
 	assert.Equal(t, len(imr.Versions), 0)
 }
+
+func TestMigrateConstraints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baas.db")
+
+	// A database from before the versions referred to their image, with a version of an image which is gone
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Exec("CREATE TABLE `versions` (`id` integer, `created_at` datetime, `updated_at` datetime, "+
+		"`deleted_at` datetime, `version` integer NOT NULL DEFAULT 0, `image_model_uuid` text NOT NULL, PRIMARY KEY (`id`))").Error)
+	assert.NoError(t, db.Exec("CREATE INDEX `idx_versions_deleted_at` ON `versions`(`deleted_at`)").Error)
+	assert.NoError(t, db.Exec("INSERT INTO versions (id, version, image_model_uuid) VALUES (1, 3, 'gone')").Error)
+	sqlDB, _ := db.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	store, err := NewSqliteStore(path)
+	assert.NoError(t, err)
+	assert.True(t, store.(Store).Migrator().HasConstraint(&images.Version{}, "fk_image_models_versions"))
+
+	dangling, err := store.CheckReferences(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []database.DanglingReference{
+		{Table: "versions", Column: "image_model_uuid", Value: "gone", Count: 1},
+	}, dangling)
+
+	dangling, err = store.CheckReferences(true)
+	assert.NoError(t, err)
+	assert.True(t, dangling[0].Repaired)
+
+	versions, err := store.GetAllVersions()
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+
+	// New rows have to refer to an existing image now
+	err = store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "gone"})
+	var constraint *database.ConstraintError
+	assert.True(t, errors.As(err, &constraint))
+	assert.Equal(t, database.ForeignKeyConstraint, constraint.Kind)
+}
+
+func TestMigrateCaseInsensitiveNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baas.db")
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", dir))
+
+	open := func() Store {
+		store, err := NewSqliteStore(path)
+		assert.NoError(t, err)
+		return store.(Store)
+	}
+	closeStore := func(store Store) {
+		sqlDB, _ := store.DB.DB()
+		assert.NoError(t, sqlDB.Close())
+	}
+	hasIndex := func(store Store) bool {
+		var count int64
+		assert.NoError(t, store.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?",
+			"idx_image_models_user_name_nocase").Scan(&count).Error)
+		return count == 1
+	}
+
+	// A database from before names were unique regardless of case, where the user created the same image twice
+	store := open()
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "jan", Email: "jan", Role: user.User}))
+	assert.NoError(t, store.Exec("DROP INDEX idx_image_models_user_name_nocase").Error)
+	for uuid, name := range map[images.ImageUUID]string{"lower": "gentoo", "upper": "Gentoo", "other": "arch"} {
+		assert.NoError(t, store.CreateImage(&images.ImageModel{Name: name, Username: "jan", UUID: uuid}))
+	}
+	closeStore(store)
+
+	// The collision is reported rather than renamed, and the index waits for it to be resolved
+	store = open()
+	assert.False(t, hasIndex(store))
+	collisions, err := store.FindNameCollisions()
+	assert.NoError(t, err)
+	assert.Equal(t, []database.NameCollision{
+		{Username: "jan", Images: map[images.ImageUUID]string{"lower": "gentoo", "upper": "Gentoo"}},
+	}, collisions)
+
+	found, err := store.GetImagesByNameAndUsername("GENTOO", "jan")
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+
+	assert.NoError(t, store.Model(&images.ImageModel{UUID: "upper"}).Update("name", "Gentoo old").Error)
+	closeStore(store)
+
+	store = open()
+	defer closeStore(store)
+	assert.True(t, hasIndex(store))
+
+	err = store.CreateImage(&images.ImageModel{Name: "ARCH", Username: "jan", UUID: "shouting"})
+	var constraint *database.ConstraintError
+	assert.True(t, errors.As(err, &constraint))
+	assert.Equal(t, database.UniqueConstraint, constraint.Kind)
+}
+
+func TestMigrateEmails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baas.db")
+
+	open := func() Store {
+		store, err := NewSqliteStore(path)
+		assert.NoError(t, err)
+		return store.(Store)
+	}
+	closeStore := func(store Store) {
+		sqlDB, _ := store.DB.DB()
+		assert.NoError(t, sqlDB.Close())
+	}
+	hasIndex := func(store Store) bool {
+		var count int64
+		assert.NoError(t, store.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?",
+			"idx_user_models_email_nocase").Scan(&count).Error)
+		return count == 1
+	}
+
+	// A database from before emails were normalized, where the same person signed up twice
+	store := open()
+	assert.NoError(t, store.Exec("DROP INDEX idx_user_models_email_nocase").Error)
+	for name, email := range map[string]string{"wnarchi": "W.Narchi@TUDelft.nl ", "narchi": "w.narchi@tudelft.nl",
+		"jan": "jan@example.com"} {
+		assert.NoError(t, store.CreateUser(&user.UserModel{Username: name, Email: email, Role: user.User}))
+	}
+	closeStore(store)
+
+	store = open()
+	assert.False(t, hasIndex(store))
+	found, err := store.GetUserByUsername("wnarchi")
+	assert.NoError(t, err)
+	assert.Equal(t, "W.Narchi@tudelft.nl", found.Email)
+
+	collisions, err := store.FindEmailCollisions()
+	assert.NoError(t, err)
+	assert.Equal(t, []database.EmailCollision{
+		{Email: "w.narchi@tudelft.nl", Usernames: []string{"narchi", "wnarchi"}},
+	}, collisions)
+
+	// Merging the duplicate resolves the collision, the index is there right away
+	_, err = store.MergeUsers("wnarchi", "narchi")
+	assert.NoError(t, err)
+	assert.True(t, hasIndex(store))
+
+	found, err = store.GetUserByEmail("W.NARCHI@tudelft.nl")
+	assert.NoError(t, err)
+	assert.Equal(t, "wnarchi", found.Username)
+	closeStore(store)
+
+	store = open()
+	defer closeStore(store)
+	collisions, err = store.FindEmailCollisions()
+	assert.NoError(t, err)
+	assert.Empty(t, collisions)
+
+	err = store.CreateUser(&user.UserModel{Username: "shouting", Email: "JAN@example.com", Role: user.User})
+	var constraint *database.ConstraintError
+	assert.True(t, errors.As(err, &constraint))
+	assert.Equal(t, database.UniqueConstraint, constraint.Kind)
+}
+
+func TestMigrateTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baas.db")
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", dir))
+
+	// A database from before the users and images recorded when they were created
+	store, err := NewSqliteStore(path)
+	assert.NoError(t, err)
+	db := store.(Store)
+	assert.NoError(t, db.CreateUser(&user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}))
+	assert.NoError(t, db.CreateImage(&images.ImageModel{Name: "gentoo", Username: "jan", UUID: "gentoo"}))
+	assert.NoError(t, db.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: "gentoo"}))
+
+	first := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	last := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, statement := range []string{
+		"UPDATE user_models SET created_at = NULL, updated_at = NULL",
+		"UPDATE image_models SET created_at = NULL, updated_at = NULL",
+	} {
+		assert.NoError(t, db.Exec(statement).Error)
+	}
+	assert.NoError(t, db.Exec("UPDATE versions SET created_at = ?, updated_at = ? WHERE version = 0", first, first).Error)
+	assert.NoError(t, db.Exec("UPDATE versions SET created_at = ?, updated_at = ? WHERE version = 1", last, last).Error)
+	sqlDB, _ := db.DB.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	// Images were created with their first version and last changed with their latest one
+	store, err = NewSqliteStore(path)
+	assert.NoError(t, err)
+	image, err := store.GetImageByUUID("gentoo")
+	assert.NoError(t, err)
+	assert.True(t, image.CreatedAt.Equal(first), image.CreatedAt)
+	assert.True(t, image.UpdatedAt.Equal(last), image.UpdatedAt)
+
+	found, err := store.GetUserByUsername("jan")
+	assert.NoError(t, err)
+	assert.False(t, found.CreatedAt.IsZero())
+	assert.False(t, found.UpdatedAt.IsZero())
+}
+
+func TestMigrateFailureReasons(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baas.db")
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", dir))
+
+	// A database from before the reasons, when the control server kept free text and the others kept nothing
+	store, err := NewSqliteStore(path)
+	assert.NoError(t, err)
+	db := store.(Store)
+	assert.NoError(t, db.CreateMachine(&machine.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+	for _, state := range []images.BootState{images.BootFailed, images.BootFailed, images.BootExpired,
+		images.BootCancelled, images.BootCompleted} {
+		assert.NoError(t, db.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup", State: state}))
+	}
+	assert.NoError(t, db.Exec("UPDATE boot_histories SET failure_reason = 'agent lost' WHERE id = 1").Error)
+	sqlDB, _ := db.DB.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	store, err = NewSqliteStore(path)
+	assert.NoError(t, err)
+	history, err := store.GetBootHistory("abc", database.BootFilter{}, database.ListOptions{Ascending: true})
+	assert.NoError(t, err)
+	assert.Len(t, history, 5)
+	assert.Equal(t, images.FailureUnknown, history[0].FailureReason)
+	assert.Equal(t, "agent lost", history[0].FailureDetail)
+	assert.Equal(t, images.FailureUnknown, history[1].FailureReason)
+	assert.Equal(t, images.FailureUnknown, history[2].FailureReason)
+	assert.Equal(t, images.FailureCancelled, history[3].FailureReason)
+	assert.Empty(t, history[4].FailureReason)
+}
+
+func TestMigrateBootDurations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baas.db")
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", dir))
+
+	// Boots recorded while the clock was set back end before they start
+	store, err := NewSqliteStore(path)
+	assert.NoError(t, err)
+	db := store.(Store)
+	assert.NoError(t, db.CreateMachine(&machine.MachineModel{MacAddress: util.MacAddress{Address: "abc"}}))
+
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	early := time.Date(1970, 1, 1, 0, 0, 5, 0, time.UTC)
+	later := start.Add(time.Hour)
+	for _, finished := range []*time.Time{&early, &later, nil} {
+		assert.NoError(t, db.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup",
+			CreatedAt: start, LastSeen: early, FinishedAt: finished}))
+	}
+	sqlDB, _ := db.DB.DB()
+	assert.NoError(t, sqlDB.Close())
+
+	store, err = NewSqliteStore(path)
+	assert.NoError(t, err)
+	history, err := store.GetBootHistory("abc", database.BootFilter{}, database.ListOptions{Ascending: true})
+	assert.NoError(t, err)
+	if assert.Len(t, history, 3) {
+		assert.True(t, history[0].FinishedAt.Equal(start))
+		assert.True(t, history[1].FinishedAt.Equal(later))
+		assert.Nil(t, history[2].FinishedAt)
+		for _, boot := range history {
+			assert.True(t, boot.LastSeen.Equal(start))
+		}
+	}
+}
+
+func TestUsageQueriesUseIndexes(t *testing.T) {
+	store, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(t, err)
+	db := store.(Store)
+
+	// The boots of a period are read from the index alone, the members of a course are found by their username
+	var plan []struct {
+		Detail string
+	}
+	now := time.Now()
+	query := fmt.Sprintf(usageBootsQuery, "course_members.course_name",
+		"JOIN course_members ON course_members.username = image_setups.username")
+	assert.NoError(t, db.Raw("EXPLAIN QUERY PLAN "+query, now, images.BootInProgress, now, now, now, now, now).
+		Scan(&plan).Error)
+
+	var details []string
+	for _, step := range plan {
+		details = append(details, step.Detail)
+	}
+	assert.Contains(t, details, "SEARCH boot_histories USING COVERING INDEX idx_boot_histories_usage (created_at<?)")
+	assert.Contains(t, details, "SEARCH course_members USING INDEX idx_course_members_username (username=?)")
+}
+
+func TestGetNextBootSetupWithImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootsetup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("BAAS_DISK_PATH", os.Getenv("BAAS_DISK_PATH"))
+	assert.NoError(t, os.Setenv("BAAS_DISK_PATH", dir))
+
+	s, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(t, err)
+	store := s.(Store)
+
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "jan", Email: "jan", Role: user.User}))
+	assert.NoError(t, store.CreateMachine(&machine.MachineModel{MacAddress: util.MacAddress{Address: "aa"}}))
+	for _, uuid := range []images.ImageUUID{"first", "second"} {
+		image := images.ImageModel{Name: string(uuid), Username: "jan", UUID: uuid}
+		assert.NoError(t, store.CreateImage(&image))
+		assert.NoError(t, store.CreateNewImageVersion(images.Version{Version: 1, ImageModelUUID: uuid}))
+		stored, err := store.GetImageByUUID(uuid)
+		assert.NoError(t, err)
+
+		setup := images.ImageSetup{Name: string(uuid), UUID: uuid, Username: "jan"}
+		assert.NoError(t, store.CreateImageSetup("jan", &setup))
+		store.AddImageToImageSetup(&setup, &image, *stored.LatestVersion(), false)
+		assert.NoError(t, store.AddBootSetupToMachine(&images.BootSetup{MachineMAC: "aa", SetupUUID: uuid}))
+	}
+
+	// The boot of the second image is claimed out of order, the first stays at the head of the queue
+	claimed, err := store.GetNextBootSetupWithImage("aa", "second")
+	assert.NoError(t, err)
+	assert.Equal(t, images.ImageUUID("second"), claimed.SetupUUID)
+
+	_, err = store.GetNextBootSetupWithImage("aa", "second")
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+
+	queued, err := store.GetBootSetups("aa")
+	assert.NoError(t, err)
+	if assert.Len(t, queued, 1) {
+		assert.Equal(t, images.ImageUUID("first"), queued[0].SetupUUID)
+	}
+}
+
+// countQueries counts the queries the store runs, the returned counter can be reset between the calls it measures
+func countQueries(tb testing.TB, store Store) *int {
+	queries := 0
+	count := func(*gorm.DB) { queries++ }
+	assert.NoError(tb, store.Callback().Query().After("gorm:query").Register("test:count_queries", count))
+	assert.NoError(tb, store.Callback().Row().After("gorm:row").Register("test:count_rows", count))
+	return &queries
+}
+
+// createImages gives a user images with a few versions each
+func createImages(tb testing.TB, store Store, username string, n int) {
+	for i := 0; i < n; i++ {
+		uuid := images.ImageUUID(fmt.Sprintf("%s-%d", username, i))
+		assert.NoError(tb, store.CreateImage(&images.ImageModel{Name: string(uuid), Username: username, UUID: uuid,
+			Public: true}))
+		for version := uint64(1); version <= 2; version++ {
+			assert.NoError(tb, store.CreateNewImageVersion(images.Version{Version: version, ImageModelUUID: uuid}))
+		}
+	}
+}
+
+func TestImageListingQueries(t *testing.T) {
+	s, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(t, err)
+	store := Store{DB: s.(Store).Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})}
+
+	for _, username := range []string{"few", "many"} {
+		assert.NoError(t, store.CreateUser(&user.UserModel{Username: username, Email: username, Role: user.User}))
+	}
+	createImages(t, store, "few", 1)
+	createImages(t, store, "many", 50)
+
+	queries := countQueries(t, store)
+	listings := map[string]func(username string) ([]images.ImageModel, error){
+		"versions":  store.GetImagesByUsername,
+		"summaries": store.GetImageSummariesByUsername,
+	}
+
+	for name, list := range listings {
+		used := map[string]int{}
+		for _, username := range []string{"few", "many"} {
+			*queries = 0
+			found, err := list(username)
+			assert.NoError(t, err)
+			used[username] = *queries
+
+			for _, image := range found {
+				if name == "versions" {
+					assert.Len(t, image.Versions, 3)
+				} else {
+					assert.Empty(t, image.Versions)
+					assert.Equal(t, int64(3), image.VersionCount)
+				}
+			}
+		}
+
+		// The versions of all images are loaded together, however many images there are
+		assert.Equal(t, used["few"], used["many"], name)
+		assert.LessOrEqual(t, used["many"], 2, name)
+	}
+
+	public, err := store.GetPublicImageSummaries()
+	assert.NoError(t, err)
+	assert.Len(t, public, 51)
+}
+
+func BenchmarkGetImagesByUsername(b *testing.B) {
+	s, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(b, err)
+	store := Store{DB: s.(Store).Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})}
+
+	assert.NoError(b, store.CreateUser(&user.UserModel{Username: "jan", Email: "jan", Role: user.User}))
+	createImages(b, store, "jan", 200)
+	queries := countQueries(b, store)
+
+	for _, bench := range []struct {
+		name string
+		list func(username string) ([]images.ImageModel, error)
+	}{
+		{"versions", store.GetImagesByUsername},
+		{"summaries", store.GetImageSummariesByUsername},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			*queries = 0
+			for i := 0; i < b.N; i++ {
+				if _, err := bench.list("jan"); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(*queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+type credential struct {
+	ID       uint
+	Name     string
+	Password secrets.Secret
+}
+
+func TestRotateSecrets(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(InMemoryPath), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.AutoMigrate(&credential{}))
+	models := []interface{}{&credential{}}
+
+	old, err := secrets.GenerateKey("old")
+	assert.NoError(t, err)
+	current, err := secrets.GenerateKey("current")
+	assert.NoError(t, err)
+	oldRing, err := secrets.NewKeyring(old)
+	assert.NoError(t, err)
+	ring, err := secrets.NewKeyring(old, current)
+	assert.NoError(t, err)
+	defer secrets.Use(nil)
+
+	// Nothing is sealed without a key, and empty secrets need none
+	assert.Error(t, db.Create(&credential{Name: "bmc", Password: secrets.NewSecret("hunter2")}).Error)
+	assert.NoError(t, db.Create(&credential{Name: "none"}).Error)
+
+	secrets.Use(oldRing)
+	assert.NoError(t, db.Create(&credential{Name: "bmc", Password: secrets.NewSecret("hunter2")}).Error)
+
+	var stored string
+	assert.NoError(t, db.Raw("SELECT password FROM credentials WHERE name = 'bmc'").Scan(&stored).Error)
+	assert.True(t, secrets.IsSealed(stored))
+	assert.NotContains(t, stored, "hunter2")
+
+	ids, err := secretKeyIDs(db, models)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old"}, ids)
+
+	rotated, err := rotateSecrets(db, models, ring)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rotated)
+	rotated, err = rotateSecrets(db, models, ring)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rotated)
+
+	ids, err = secretKeyIDs(db, models)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"current"}, ids)
+
+	// The old key is not needed anymore
+	currentRing, err := secrets.NewKeyring(current)
+	assert.NoError(t, err)
+	secrets.Use(currentRing)
+	var read credential
+	assert.NoError(t, db.Where("name = ?", "bmc").First(&read).Error)
+	assert.Equal(t, "hunter2", read.Password.Reveal())
+
+	// The store itself has no secrets yet, but looks for them all the same
+	store, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(t, err)
+	ids, err = store.SecretKeyIDs()
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestReplication(t *testing.T) {
+	primary, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(t, err)
+	replica, err := NewSqliteStore(InMemoryPath)
+	assert.NoError(t, err)
+	assert.NoError(t, replica.SetReplicaOf("https://baas.example.org"))
+
+	// The changes travel as JSON, which has no times or bytes
+	sync := func(since uint64) uint64 {
+		changes, err := primary.GetReplicationChanges(since, 100)
+		assert.NoError(t, err)
+		data, err := json.Marshal(changes)
+		assert.NoError(t, err)
+
+		var received []replication.Change
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		assert.NoError(t, decoder.Decode(&received))
+
+		cursor := since
+		if len(received) != 0 {
+			cursor = received[len(received)-1].Seq
+		}
+		assert.NoError(t, replica.ApplyReplicationChanges(received, cursor))
+		return cursor
+	}
+
+	created := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, primary.CreateUser(&user.UserModel{Username: "jan", Email: "jan@example.com", Role: user.User}))
+	image := &images.ImageModel{Name: "ubuntu", Username: "jan", UUID: "ubuntu",
+		Versions: []images.Version{{Version: 1, ImageModelUUID: "ubuntu", SHA256: "abc"}}}
+	assert.NoError(t, primary.CreateImage(image))
+	assert.NoError(t, primary.CreateMachine(&machine.MachineModel{Name: "abc", MacAddress: util.MacAddress{Address: "abc"}}))
+	assert.NoError(t, primary.AddBootHistory(&images.BootHistory{MachineMAC: "abc", SetupUUID: "setup",
+		CreatedAt: created, LastSeen: created}))
+
+	cursor := sync(0)
+	copied, err := replica.GetImageByUUID("ubuntu")
+	assert.NoError(t, err)
+	assert.Equal(t, "jan", copied.Username)
+	if version := copied.FindVersion(1); assert.NotNil(t, version) {
+		assert.Equal(t, "abc", version.SHA256)
+	}
+	history, err := replica.GetBootHistory("abc", database.BootFilter{}, database.ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.True(t, history[0].CreatedAt.Equal(created))
+	}
+
+	// Only what changed since is fetched again, deleted rows included
+	u, err := primary.GetUserByUsername("jan")
+	assert.NoError(t, err)
+	u.Name = "Jan"
+	assert.NoError(t, primary.ModifyUser(u))
+	assert.NoError(t, primary.DeleteImage(image))
+
+	changes, err := primary.GetReplicationChanges(cursor, 100)
+	assert.NoError(t, err)
+	tables := map[string]bool{}
+	for _, change := range changes {
+		tables[change.Table] = true
+	}
+	assert.Equal(t, map[string]bool{"user_models": true, "image_models": true, "versions": true}, tables)
+
+	sync(cursor)
+	copiedUser, err := replica.GetUserByUsername("jan")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jan", copiedUser.Name)
+	_, err = replica.GetImageByUUID("ubuntu")
+	assert.Error(t, err)
+
+	// The replica cannot be made one again once it was promoted
+	state, err := replica.GetReplicationState()
+	assert.NoError(t, err)
+	assert.True(t, state.Replica())
+	assert.Equal(t, changes[len(changes)-1].Seq, state.Cursor)
+	assert.NoError(t, replica.PromoteReplica())
+	assert.ErrorIs(t, replica.PromoteReplica(), database.ErrNotReplica)
+	assert.ErrorIs(t, replica.SetReplicaOf("https://baas.example.org"), database.ErrPromoted)
+	state, err = replica.GetReplicationState()
+	assert.NoError(t, err)
+	assert.False(t, state.Replica())
+	assert.NotNil(t, state.PromotedAt)
+}
+
+func TestReadReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replica")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The replica lags behind, it knows a user the primary does not
+	replica, err := NewSqliteStore(filepath.Join(dir, "replica.db"))
+	assert.NoError(t, err)
+	assert.NoError(t, replica.CreateUser(&user.UserModel{Username: "lagging", Email: "lagging@example.com",
+		Role: user.User}))
+
+	store, err := NewSqliteStoreWithReadReplica(filepath.Join(dir, "store.db"), filepath.Join(dir, "replica.db"))
+	assert.NoError(t, err)
+
+	served := storeQueries.Value("statistics", poolReplica)
+	stats, err := store.GetStatistics(time.Now(), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), stats.UsersByRole[user.User])
+	assert.Equal(t, served+1, storeQueries.Value("statistics", poolReplica))
+
+	// Writes and the reads which are not marked stay on the primary
+	assert.NoError(t, store.CreateUser(&user.UserModel{Username: "fresh", Email: "fresh@example.com",
+		Role: user.Admin}))
+	_, err = store.GetUserByUsername("fresh")
+	assert.NoError(t, err)
+	_, err = store.GetUserByUsername("lagging")
+	assert.Error(t, err)
+
+	// Without a replica to read from, the reads fall back to the primary
+	store, err = NewSqliteStoreWithReadReplica(filepath.Join(dir, "other.db"), filepath.Join(dir, "missing.db"))
+	assert.NoError(t, err)
+
+	served = storeQueries.Value("usage", poolPrimary)
+	_, err = store.GetUsage(time.Now().Add(-time.Hour), time.Now(), database.UsageByUser)
+	assert.NoError(t, err)
+	assert.Equal(t, served+1, storeQueries.Value("usage", poolPrimary))
+	_, err = os.Stat(filepath.Join(dir, "missing.db"))
+	assert.True(t, os.IsNotExist(err))
+}
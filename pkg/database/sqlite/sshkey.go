@@ -0,0 +1,33 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// GetSSHKeys gets the public keys of a user in the order they were added
+func (s Store) GetSSHKeys(username string) ([]user.SSHKeyModel, error) {
+	keys := []user.SSHKeyModel{}
+	res := s.Where("username = ?", username).Order("id").Find(&keys)
+	return keys, res.Error
+}
+
+// GetSSHKey gets the public key with the specified id from the database
+func (s Store) GetSSHKey(id uint) (*user.SSHKeyModel, error) {
+	key := user.SSHKeyModel{}
+	res := s.Where("id = ?", id).First(&key)
+	return &key, res.Error
+}
+
+// CreateSSHKey adds a public key to a user, adding a key the user already has is a constraint error
+func (s Store) CreateSSHKey(key *user.SSHKeyModel) error {
+	return s.Create(key).Error
+}
+
+// DeleteSSHKey removes a public key of a user
+func (s Store) DeleteSSHKey(key *user.SSHKeyModel) error {
+	return s.Delete(key).Error
+}
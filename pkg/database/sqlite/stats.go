@@ -0,0 +1,246 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+)
+
+// machineStatusQuery decides the status of every machine, a boot in progress comes before the state of the last boot
+const machineStatusQuery = `SELECT CASE
+		WHEN NOT machine_models.managed THEN ?
+		WHEN EXISTS (SELECT 1 FROM boot_histories WHERE boot_histories.machine_mac = machine_models.address
+			AND boot_histories.state = ?) THEN ?
+		WHEN (SELECT boot_histories.state FROM boot_histories WHERE boot_histories.machine_mac = machine_models.address
+			ORDER BY boot_histories.id DESC LIMIT 1) = ? THEN ?
+		ELSE ? END AS machine_status, COUNT(*) AS count
+	FROM machine_models GROUP BY machine_status`
+
+// GetStatistics counts everything on the read replica when there is one
+func (s Store) GetStatistics(since time.Time, top int) (*database.Statistics, error) {
+	var stats *database.Statistics
+	err := s.readOnly("statistics", func(db Store) (err error) {
+		stats, err = db.getStatistics(since, top)
+		return err
+	})
+	return stats, err
+}
+
+// getStatistics counts everything with aggregate queries, no table is loaded as a whole
+func (s Store) getStatistics(since time.Time, top int) (*database.Statistics, error) {
+	stats := database.Statistics{
+		UsersByRole:       map[user.UserRole]int64{},
+		MachinesByStatus:  map[database.MachineStatus]int64{},
+		BootSetupsPerDay:  []database.DayCount{},
+		TopUsersByStorage: []database.UserStorage{},
+		FailuresByReason:  map[images.FailureReason]int64{},
+	}
+
+	var roles []struct {
+		Role  user.UserRole
+		Count int64
+	}
+	if err := s.Model(&user.UserModel{}).Select("role, COUNT(*) AS count").Group("role").Scan(&roles).Error; err != nil {
+		return nil, errors.Wrap(err, "count users")
+	}
+	for _, role := range roles {
+		stats.UsersByRole[role.Role] = role.Count
+	}
+
+	var imageCounts struct {
+		Images  int64
+		Trashed int64
+	}
+	if err := s.Unscoped().Model(&images.ImageModel{}).
+		Select("COALESCE(SUM(CASE WHEN deleted_at IS NULL THEN 1 ELSE 0 END), 0) AS images, " +
+			"COALESCE(SUM(CASE WHEN deleted_at IS NOT NULL THEN 1 ELSE 0 END), 0) AS trashed").
+		Scan(&imageCounts).Error; err != nil {
+		return nil, errors.Wrap(err, "count images")
+	}
+	stats.Images, stats.TrashedImages = imageCounts.Images, imageCounts.Trashed
+
+	var versions struct {
+		Versions int64
+		Bytes    uint64
+	}
+	if err := s.Table("versions").
+		Select("COALESCE(SUM(CASE WHEN image_models.deleted_at IS NULL THEN 1 ELSE 0 END), 0) AS versions, " +
+			"COALESCE(SUM(versions.size), 0) AS bytes").
+		Joins("JOIN image_models ON image_models.uuid = versions.image_model_uuid").
+		Where("versions.deleted_at IS NULL").
+		Scan(&versions).Error; err != nil {
+		return nil, errors.Wrap(err, "count versions")
+	}
+	stats.Versions, stats.LogicalBytes = versions.Versions, versions.Bytes
+
+	var statuses []struct {
+		MachineStatus database.MachineStatus
+		Count         int64
+	}
+	if err := s.Raw(machineStatusQuery, database.MachineMaintenance, images.BootInProgress, database.MachineFlashing,
+		images.BootCompleted, database.MachineOnline, database.MachineOffline).Scan(&statuses).Error; err != nil {
+		return nil, errors.Wrap(err, "count machines")
+	}
+	for _, status := range statuses {
+		stats.MachinesByStatus[status.MachineStatus] = status.Count
+	}
+
+	// Boot setups are soft deleted once a machine boots them, those still count as queued on their day
+	if err := s.Unscoped().Model(&images.BootSetup{}).
+		Select("DATE(created_at) AS day, COUNT(*) AS count").
+		Where("created_at >= ?", since).
+		Group("day").Order("day").
+		Scan(&stats.BootSetupsPerDay).Error; err != nil {
+		return nil, errors.Wrap(err, "count boot setups")
+	}
+
+	if err := s.Table("versions").
+		Select("image_models.username AS username, COALESCE(SUM(versions.size), 0) AS storage_bytes").
+		Joins("JOIN image_models ON image_models.uuid = versions.image_model_uuid").
+		Where("versions.deleted_at IS NULL").
+		Group("image_models.username").Order("storage_bytes DESC, username").Limit(top).
+		Scan(&stats.TopUsersByStorage).Error; err != nil {
+		return nil, errors.Wrap(err, "rank users by storage")
+	}
+
+	var failures []struct {
+		Reason images.FailureReason
+		Count  int64
+	}
+	if err := s.Model(&images.BootHistory{}).
+		Select("failure_reason AS reason, COUNT(*) AS count").
+		Where("failure_reason != '' AND created_at >= ?", since).
+		Group("failure_reason").
+		Scan(&failures).Error; err != nil {
+		return nil, errors.Wrap(err, "count failed boots")
+	}
+	for _, failure := range failures {
+		stats.FailuresByReason[failure.Reason] = failure.Count
+	}
+
+	return &stats, nil
+}
+
+// usageBootsQuery adds up the boots which overlap with the period. The boots are cut off at the ends of the period,
+// a boot in progress runs until now and the boots which were recorded without their end did not take any time.
+const usageBootsQuery = `SELECT %s AS grp,
+		COALESCE(SUM(MAX(0, MIN(julianday(?), julianday(COALESCE(boot_histories.finished_at,
+			CASE WHEN boot_histories.state = ? THEN ? ELSE boot_histories.created_at END)))
+			- MAX(julianday(?), julianday(boot_histories.created_at)))), 0) * 24 AS machine_hours,
+		COALESCE(SUM(CASE WHEN boot_histories.created_at >= ? THEN 1 ELSE 0 END), 0) AS flashes
+	FROM boot_histories
+	JOIN image_setups ON image_setups.uuid = boot_histories.setup_uuid %s
+	WHERE boot_histories.created_at < ? AND (boot_histories.finished_at IS NULL OR boot_histories.finished_at > ?)
+	GROUP BY grp`
+
+// usageStorageQuery adds up the versions as they were at the end of the period, the images in the trash included
+const usageStorageQuery = `SELECT %s AS grp, COALESCE(SUM(versions.size), 0) AS storage_bytes
+	FROM versions
+	JOIN image_models ON image_models.uuid = versions.image_model_uuid
+	WHERE versions.created_at < ? AND (versions.deleted_at IS NULL OR versions.deleted_at >= ?) %s
+	GROUP BY grp`
+
+// GetUsage adds up the usage on the read replica when there is one
+func (s Store) GetUsage(from time.Time, to time.Time, groupBy database.UsageGrouping) ([]database.Usage, error) {
+	var usage []database.Usage
+	err := s.readOnly("usage", func(db Store) (err error) {
+		usage, err = db.getUsage(from, to, groupBy)
+		return err
+	})
+	return usage, err
+}
+
+// getUsage adds up the usage with aggregate queries over the indexes of migrateUsageIndexes
+func (s Store) getUsage(from time.Time, to time.Time, groupBy database.UsageGrouping) ([]database.Usage, error) {
+	var bootsGroup, bootsJoin, storageGroup, storageFilter string
+	switch groupBy {
+	case database.UsageByCourse:
+		bootsGroup, bootsJoin = "course_members.course_name",
+			"JOIN course_members ON course_members.username = image_setups.username"
+		storageGroup, storageFilter = "image_models.course", "AND image_models.course != ''"
+	case database.UsageByUser:
+		bootsGroup, storageGroup = "image_setups.username", "image_models.username"
+	default:
+		return nil, errors.Errorf("cannot group the usage by %q", groupBy)
+	}
+
+	// The timestamps are stored in the local time of the server, they only compare as text in the same zone
+	now := time.Now()
+	from, to = from.Local(), to.Local()
+	end := to
+	if now.Before(end) {
+		end = now
+	}
+
+	var boots []struct {
+		Grp          string
+		MachineHours float64
+		Flashes      int64
+	}
+	err := s.Raw(fmt.Sprintf(usageBootsQuery, bootsGroup, bootsJoin),
+		end, images.BootInProgress, now, from, from, to, from).Scan(&boots).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "add up the boots")
+	}
+
+	var storage []struct {
+		Grp          string
+		StorageBytes uint64
+	}
+	err = s.Raw(fmt.Sprintf(usageStorageQuery, storageGroup, storageFilter), to, to).Scan(&storage).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "add up the storage")
+	}
+
+	groups := map[string]*database.Usage{}
+	group := func(name string) *database.Usage {
+		if groups[name] == nil {
+			groups[name] = &database.Usage{Group: name}
+		}
+		return groups[name]
+	}
+
+	for _, row := range boots {
+		group(row.Grp).MachineHours, group(row.Grp).Flashes = row.MachineHours, row.Flashes
+	}
+	for _, row := range storage {
+		group(row.Grp).StorageBytes = row.StorageBytes
+	}
+
+	usage := make([]database.Usage, 0, len(groups))
+	for _, found := range groups {
+		usage = append(usage, *found)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Group < usage[j].Group })
+
+	return usage, nil
+}
+
+// GetTierUsage counts the images and versions per storage tier, the images in the trash still take up their space
+func (s Store) GetTierUsage() ([]database.TierUsage, error) {
+	usage := []database.TierUsage{}
+	err := s.readOnly("tier_usage", func(db Store) error {
+		usage = usage[:0]
+		return db.tierUsage(&usage)
+	})
+	return usage, errors.Wrap(err, "count the usage of the storage tiers")
+}
+
+// tierUsage adds up the storage tiers with an aggregate query
+func (s Store) tierUsage(usage *[]database.TierUsage) error {
+	return s.Unscoped().Model(&images.ImageModel{}).
+		Select("image_models.tier AS tier, COUNT(DISTINCT image_models.uuid) AS images, " +
+			"COUNT(versions.id) AS versions, COALESCE(SUM(versions.size), 0) AS logical_bytes").
+		Joins("LEFT JOIN versions ON versions.image_model_uuid = image_models.uuid AND versions.deleted_at IS NULL").
+		Group("image_models.tier").Order("image_models.tier").
+		Scan(usage).Error
+}
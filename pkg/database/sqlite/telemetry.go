@@ -0,0 +1,54 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/telemetry"
+	"gorm.io/gorm"
+)
+
+// telemetryStateID is the ID of the single row holding the state of the telemetry
+const telemetryStateID = 1
+
+// GetTelemetryState fetches the state of the telemetry, a database which never made a report gets an empty state
+func (s Store) GetTelemetryState() (*telemetry.State, error) {
+	state := telemetry.State{}
+	res := s.Where(telemetry.State{ID: telemetryStateID}).FirstOrInit(&state)
+	return &state, res.Error
+}
+
+// SetTelemetryInstallID replaces the install ID the reports are sent under
+func (s Store) SetTelemetryInstallID(id string) error {
+	return s.updateTelemetryState(func(state *telemetry.State) {
+		state.InstallID = id
+	})
+}
+
+// RecordTelemetryAttempt records that sending a report was tried at the given time, failure is empty when it was
+// sent
+func (s Store) RecordTelemetryAttempt(at time.Time, failure string) error {
+	return s.updateTelemetryState(func(state *telemetry.State) {
+		state.AttemptedAt = &at
+		state.LastError = failure
+		if failure == "" {
+			state.SentAt = &at
+		}
+	})
+}
+
+// updateTelemetryState changes the state of the telemetry, creating its row when there is none yet
+func (s Store) updateTelemetryState(change func(state *telemetry.State)) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		state := telemetry.State{}
+		if err := tx.Where(telemetry.State{ID: telemetryStateID}).FirstOrInit(&state).Error; err != nil {
+			return err
+		}
+
+		change(&state)
+		return tx.Save(&state).Error
+	})
+}
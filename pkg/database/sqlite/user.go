@@ -5,8 +5,12 @@
 package sqlite
 
 import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/database"
 	"github.com/baas-project/baas/pkg/model/user"
 	"github.com/pkg/errors"
+	"gorm.io/gorm"
 )
 
 // GetUserByUsername gets the first user with the associated username from the database.
@@ -31,7 +35,7 @@ func (s Store) GetUsers() (users []user.UserModel, _ error) {
 
 // CreateUser creates a new user
 func (s Store) CreateUser(user *user.UserModel) error {
-	return s.Save(user).Error
+	return s.Create(user).Error
 }
 
 // RemoveUser deletes a user from the database
@@ -43,3 +47,182 @@ func (s Store) RemoveUser(user *user.UserModel) error {
 func (s Store) ModifyUser(user *user.UserModel) error {
 	return s.Updates(user).Error
 }
+
+// RevokeSessions invalidates the sessions of a user which were handed out before the given time
+func (s Store) RevokeSessions(username string, at time.Time) error {
+	res := s.Model(&user.UserModel{}).Where("username = ?", username).Update("sessions_revoked_at", at)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// SetUserDisabled disables or enables a user, the sessions of a disabled user are revoked
+func (s Store) SetUserDisabled(username string, disabled bool) error {
+	values := map[string]interface{}{"disabled": disabled}
+	if disabled {
+		values["sessions_revoked_at"] = time.Now()
+	}
+
+	res := s.Model(&user.UserModel{}).Where("username = ?", username).Updates(values)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return res.Error
+}
+
+// UpdateUsers changes the roles, storage limits and accounts of many users in one transaction. Disabling a user
+// revokes their sessions, as SetUserDisabled does.
+func (s Store) UpdateUsers(updates []database.UserUpdate) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		for _, update := range updates {
+			if err := updateUser(tx, update); err != nil {
+				return errors.Wrapf(err, "update user %s", update.Username)
+			}
+		}
+
+		return nil
+	})
+}
+
+// updateUser applies a single change of UpdateUsers, the other limits of the user are kept
+func updateUser(tx *gorm.DB, update database.UserUpdate) error {
+	values := map[string]interface{}{}
+	if update.Role != "" {
+		values["role"] = update.Role
+	}
+
+	if update.Disabled != nil {
+		values["disabled"] = *update.Disabled
+		if *update.Disabled {
+			values["sessions_revoked_at"] = time.Now()
+		}
+	}
+
+	if len(values) != 0 {
+		res := tx.Model(&user.UserModel{}).Where("username = ?", update.Username).Updates(values)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+	}
+
+	if update.ResetStorage {
+		return tx.Model(&user.LimitOverrides{}).Where("username = ?", update.Username).
+			Update("storage_bytes", nil).Error
+	}
+
+	if update.StorageBytes == nil {
+		return nil
+	}
+
+	overrides := user.LimitOverrides{Username: update.Username}
+	err := tx.Where("username = ?", update.Username).First(&overrides).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	overrides.StorageBytes = update.StorageBytes
+	return tx.Save(&overrides).Error
+}
+
+// GetUserByEmail finds the user with an email address, ignoring the case of the address
+func (s Store) GetUserByEmail(email string) (*user.UserModel, error) {
+	userModel := user.UserModel{}
+	res := s.Where("email = ? COLLATE NOCASE AND merged_into = ''", email).First(&userModel)
+	return &userModel, res.Error
+}
+
+// MergeUsers hands the images, image setups, image sets, metadata templates, identities, SSH keys and favorites of
+// the duplicate user to the primary one. The boots of the setups follow them. The duplicate is marked merged and its
+// sessions are revoked, all in one transaction.
+func (s Store) MergeUsers(primary string, duplicate string) (*database.MergeResult, error) {
+	result := &database.MergeResult{Primary: primary, Duplicate: duplicate}
+
+	err := s.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&user.UserModel{}).
+			Where("username = ? AND merged_into = ''", duplicate).
+			Updates(map[string]interface{}{"merged_into": primary, "sessions_revoked_at": time.Now()})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// Names the primary user already uses get a suffix, images their UUID like the migration of duplicates
+		res = tx.Exec(`UPDATE image_models SET name = name || ' (' || uuid || ')'
+			WHERE username = ? AND deleted_at IS NULL AND EXISTS (
+				SELECT 1 FROM image_models AS other WHERE other.deleted_at IS NULL AND other.username = ?
+				AND other.name = image_models.name COLLATE NOCASE)`, duplicate, primary)
+		if res.Error != nil {
+			return res.Error
+		}
+		result.Renamed += res.RowsAffected
+
+		// The unique indexes of templates include deleted ones
+		for _, table := range []string{"metadata_templates", "boot_templates"} {
+			res = tx.Exec(`UPDATE `+table+` SET name = name || ' (' || username || ')'
+				WHERE username = ? AND EXISTS (
+					SELECT 1 FROM `+table+` AS other WHERE other.username = ? AND other.name = `+table+`.name)`,
+				duplicate, primary)
+			if res.Error != nil {
+				return res.Error
+			}
+			result.Renamed += res.RowsAffected
+		}
+
+		// Keys both users have are kept once
+		res = tx.Exec(`DELETE FROM ssh_key_models WHERE username = ? AND fingerprint IN (
+			SELECT fingerprint FROM ssh_key_models WHERE username = ?)`, duplicate, primary)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		// Favorites both users have are kept once
+		res = tx.Exec(`DELETE FROM favorite_images WHERE username = ? AND image_uuid IN (
+			SELECT image_uuid FROM favorite_images WHERE username = ?)`, duplicate, primary)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		res = tx.Exec("UPDATE favorite_images SET username = ? WHERE username = ?", primary, duplicate)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		for table, count := range map[string]*int64{
+			"image_models":       &result.Images,
+			"image_setups":       &result.ImageSetups,
+			"image_sets":         &result.ImageSets,
+			"metadata_templates": &result.MetadataTemplates,
+			"boot_templates":     &result.BootTemplates,
+			"identity_models":    &result.Identities,
+			"ssh_key_models":     &result.SSHKeys,
+		} {
+			res = tx.Exec("UPDATE `"+table+"` SET username = ? WHERE username = ?", primary, duplicate)
+			if res.Error != nil {
+				return res.Error
+			}
+			*count = res.RowsAffected
+		}
+
+		// The limits of the primary user are the ones which apply from now on
+		return tx.Where("username = ?", duplicate).Delete(&user.LimitOverrides{}).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The duplicate may have been the last thing keeping the index from being created. The merge is done either
+	// way, when this fails the next start creates it.
+	_ = createEmailIndex(s.DB)
+
+	return result, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlite
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"gorm.io/gorm"
+)
+
+// CreateImageWebhook adds a webhook to an image
+func (s Store) CreateImageWebhook(webhook *images.ImageWebhook) error {
+	return s.Omit("Image").Create(webhook).Error
+}
+
+// GetImageWebhooks lists the webhooks of an image, the oldest first
+func (s Store) GetImageWebhooks(uuid images.ImageUUID) ([]images.ImageWebhook, error) {
+	webhooks := []images.ImageWebhook{}
+	res := s.Where("image_uuid = ?", uuid).Order("id").Find(&webhooks)
+	return webhooks, res.Error
+}
+
+// GetImageWebhook gets a webhook of an image
+func (s Store) GetImageWebhook(uuid images.ImageUUID, id uint) (*images.ImageWebhook, error) {
+	var webhook images.ImageWebhook
+	res := s.Where("image_uuid = ? AND id = ?", uuid, id).First(&webhook)
+	return &webhook, res.Error
+}
+
+// DeleteImageWebhook removes a webhook together with its deliveries
+func (s Store) DeleteImageWebhook(webhook *images.ImageWebhook) error {
+	return s.Delete(webhook).Error
+}
+
+// AddWebhookDelivery records a delivery of a webhook and forgets its older deliveries
+func (s Store) AddWebhookDelivery(delivery *images.WebhookDelivery, keep int) error {
+	return s.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Webhook").Create(delivery).Error; err != nil {
+			return err
+		}
+
+		kept := tx.Model(&images.WebhookDelivery{}).Select("id").Where("webhook_id = ?", delivery.WebhookID).
+			Order("id DESC").Limit(keep)
+		return tx.Where("webhook_id = ? AND id NOT IN (?)", delivery.WebhookID, kept).
+			Delete(&images.WebhookDelivery{}).Error
+	})
+}
+
+// GetWebhookDeliveries lists the deliveries of a webhook which are kept, the latest first
+func (s Store) GetWebhookDeliveries(id uint) ([]images.WebhookDelivery, error) {
+	deliveries := []images.WebhookDelivery{}
+	res := s.Where("webhook_id = ?", id).Order("id DESC").Find(&deliveries)
+	return deliveries, res.Error
+}
+
+// CountWebhooks counts the image webhooks a user created
+func (s Store) CountWebhooks(username string) (count int64, _ error) {
+	res := s.Model(&images.ImageWebhook{}).Where("username = ?", username).Count(&count)
+	return count, res.Error
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// MachineStatus is what a machine is doing according to its boots
+type MachineStatus string
+
+const (
+	// MachineMaintenance machines are not managed, BAAS leaves them alone
+	MachineMaintenance MachineStatus = "maintenance"
+	// MachineFlashing machines have a boot in progress
+	MachineFlashing MachineStatus = "flashing"
+	// MachineOnline machines completed their last boot and run its images
+	MachineOnline MachineStatus = "online"
+	// MachineOffline machines never booted or their last boot failed
+	MachineOffline MachineStatus = "offline"
+)
+
+// Statistics is the overview of the whole system, every number is counted by the database
+type Statistics struct {
+	UsersByRole map[user.UserRole]int64
+	// Images and Versions leave out the images in the trash, LogicalBytes is the size of all versions the
+	// machines see, those in the trash included
+	Images        int64
+	TrashedImages int64
+	Versions      int64
+	LogicalBytes  uint64
+
+	MachinesByStatus map[MachineStatus]int64
+	// BootSetupsPerDay counts the boot setups queued on every day, days without any are left out
+	BootSetupsPerDay  []DayCount
+	TopUsersByStorage []UserStorage
+	// FailuresByReason counts the boots which failed or were cancelled over the same days, by their reason
+	FailuresByReason map[images.FailureReason]int64
+}
+
+// DayCount is the number of things which happened on a day, formatted as 2006-01-02 in UTC
+type DayCount struct {
+	Day   string
+	Count int64
+}
+
+// UserStorage is the storage used by the versions of the images of a user
+type UserStorage struct {
+	Username     string
+	StorageBytes uint64
+}
+
+// TierUsage is what the images on a storage tier take up according to the database
+type TierUsage struct {
+	Tier         string
+	Images       int64
+	Versions     int64
+	LogicalBytes uint64
+}
+
+// UsageGrouping is what a usage report adds the usage up by
+type UsageGrouping string
+
+const (
+	// UsageByCourse counts the boots of the members of a course and the images labelled with it
+	UsageByCourse UsageGrouping = "course"
+	// UsageByUser counts the boots of the boot setups of a user and the images they own
+	UsageByUser UsageGrouping = "user"
+)
+
+// Usage is what a course or a user used over a period of time
+type Usage struct {
+	// Group is the name of the course or the user
+	Group string
+	// MachineHours is the time machines spent on the boots from their claim until they finished, cut off at the
+	// ends of the period. Flashes are the boots claimed in the period.
+	MachineHours float64
+	Flashes      int64
+	// StorageBytes is the size of the versions which existed at the end of the period
+	StorageBytes uint64
+}
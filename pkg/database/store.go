@@ -6,14 +6,27 @@
 package database
 
 import (
+	"context"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/agent"
+	"github.com/baas-project/baas/pkg/model/bootstrap"
+	"github.com/baas-project/baas/pkg/model/course"
+	"github.com/baas-project/baas/pkg/model/idempotency"
 	"github.com/baas-project/baas/pkg/model/images"
 	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/pki"
+	"github.com/baas-project/baas/pkg/model/replication"
+	"github.com/baas-project/baas/pkg/model/telemetry"
 	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/baas-project/baas/pkg/secrets"
 	"github.com/baas-project/baas/pkg/util"
 )
 
 // Store defines the functions which should be exported by any concrete database implementation
 type Store interface {
+	// WithContext returns the store with its queries bound to ctx, they are interrupted once it is done
+	WithContext(ctx context.Context) Store
 
 	// GetMachineByMac retrieves a machine based on its mac address.
 	GetMachineByMac(mac util.MacAddress) (*machine.MachineModel, error)
@@ -21,14 +34,108 @@ type Store interface {
 
 	// GetMachines returns a list of all machines in the database
 	GetMachines() ([]machine.MachineModel, error)
+	CountMachines() (int64, error)
 	CreateMachine(machine *machine.MachineModel) error
+	// ImportMachines creates and updates many machines at once, in a single transaction. The new machines get their
+	// machine images, of the known ones only the name and the group are updated.
+	ImportMachines(created []machine.MachineModel, updated []machine.MachineModel) error
 
 	// UpdateMachine changes the value of a machine based.
 	// The mac address is used as key.
 	UpdateMachine(machine *machine.MachineModel) error
+	// UpdateInventory replaces the hardware information of a machine with the one reported by the management OS.
+	UpdateInventory(mac util.MacAddress, inventory *machine.Inventory) error
+	// SetMachineDirty records whether the disk of a machine holds changes of a discard boot.
+	SetMachineDirty(mac util.MacAddress, dirty bool) error
+	// SetMachineRegistration approves or rejects a machine which registered itself, and manages it when it was approved.
+	SetMachineRegistration(mac util.MacAddress, status machine.RegistrationStatus, managed bool) error
+	// SetRegistrationKey replaces the hash of the key a pending machine authenticates with.
+	SetRegistrationKey(mac util.MacAddress, hash string) error
+	// SetMachineClockSkew records how far the clock of the management OS on a machine was off at checkedAt.
+	SetMachineClockSkew(mac string, skew time.Duration, checkedAt time.Time) error
+	// SetMachineVersions records what the management OS and the control server of a machine ran at seenAt.
+	SetMachineVersions(mac string, stamp machine.VersionStamp, seenAt time.Time) error
 	AddBootSetupToMachine(bootSetup *images.BootSetup) error
 	GetNextBootSetup(machineMAC string) (*images.BootSetup, error)
+	// GetNextBootSetupWithImage claims the first boot setup queued for the machine whose image setup contains the image.
+	GetNextBootSetupWithImage(machineMAC string, uuid images.ImageUUID) (*images.BootSetup, error)
+	GetBootSetups(machineMAC string) ([]images.BootSetup, error)
+	// RemoveBootSetup takes the boot of an image setup out of the queue of a machine.
+	RemoveBootSetup(machineMAC string, setupUUID images.ImageUUID) error
+	// GetBootSetupsByImage finds the queued boot setups, for any machine, whose image setup contains the image.
+	GetBootSetupsByImage(uuid images.ImageUUID) ([]images.BootSetup, error)
+	AddBootHistory(history *images.BootHistory) error
+	GetBootHistory(machineMAC string, filter BootFilter, opts ListOptions) ([]images.BootHistory, error)
+	// GetActiveBoot and GetActiveBoots fetch the boots which are in progress, their versions are locked.
+	GetActiveBoot(machineMAC string) (*images.BootHistory, error)
+	GetActiveBoots() ([]images.BootHistory, error)
+	GetBootHistoryEntry(machineMAC string, id uint) (*images.BootHistory, error)
+	// GetBootHistoryByUsername and GetActiveBootsByUsername only include the boots of image setups of the user.
+	GetBootHistoryByUsername(username string, opts ListOptions) ([]images.BootHistory, error)
+	GetActiveBootsByUsername(username string) ([]images.BootHistory, error)
+	UpdateBootHistory(history *images.BootHistory) error
+	TouchActiveBoot(machineMAC string) (int64, error)
+	AddBootArtifact(artifact *images.BootArtifact) error
+	GetBootArtifacts(bootID uint) ([]images.BootArtifact, error)
+	GetBootArtifact(bootID uint, id uint) (*images.BootArtifact, error)
+	// AddBootKey stores the passphrase of an encrypted boot, sealed with the secret key of the control server.
+	AddBootKey(key *images.BootKey) error
+	GetBootKey(bootID uint) (*images.BootKey, error)
+	// ReleaseBootKey fetches the key of a boot to hand it out for the upload. Only the first call gets it, later
+	// ones and those for boots which keep their disks encrypted return ErrKeyReleased.
+	ReleaseBootKey(bootID uint) (*images.BootKey, error)
+	// DeleteBootArtifactsBefore removes the artifacts attached before a time and returns them, so their files can go.
+	DeleteBootArtifactsBefore(before time.Time) ([]images.BootArtifact, error)
 	DeleteMachine(machine *machine.MachineModel) error
+	GetMachineGrants(mac string) ([]machine.MachineGrant, error)
+	// CreateMachineGrant grants a user access to a machine and restricts the machine to the users with access.
+	CreateMachineGrant(grant *machine.MachineGrant) error
+	DeleteMachineGrant(mac string, username string) error
+	// AddMachineCommand queues a diagnostic for a machine, GetMachineCommands lists them with the newest first.
+	AddMachineCommand(command *machine.MachineCommand) error
+	GetMachineCommands(mac string) ([]machine.MachineCommand, error)
+	GetMachineCommand(mac string, id uint) (*machine.MachineCommand, error)
+	// ClaimMachineCommands marks the queued commands of a machine which did not expire as sent and returns them.
+	ClaimMachineCommands(mac string, now time.Time) ([]machine.MachineCommand, error)
+	UpdateMachineCommand(command *machine.MachineCommand) error
+	// GetMachineCommandsExpiredBefore finds the queued and sent commands which expired before a time.
+	GetMachineCommandsExpiredBefore(at time.Time) ([]machine.MachineCommand, error)
+	// GetMachineAccess finds whether a user was granted access to a machine, directly or through a course which
+	// has not expired at the given time.
+	GetMachineAccess(mac string, username string, at time.Time) (*machine.MachineAccess, error)
+	GetMachineGroups() ([]machine.MachineGroup, error)
+	GetMachineGroup(name string) (*machine.MachineGroup, error)
+	// SaveMachineGroup creates the group or replaces its settings.
+	SaveMachineGroup(group *machine.MachineGroup) error
+	DeleteMachineGroup(name string) error
+	// GetImageDefaults finds the machines and the groups which boot an image by default.
+	GetImageDefaults(uuid string) ([]machine.MachineModel, []machine.MachineGroup, error)
+	// ClearImageDefaults takes an image away as the default image of every machine and group.
+	ClearImageDefaults(uuid string) error
+
+	CreateCourse(course *course.CourseModel) error
+	GetCourse(name string) (*course.CourseModel, error)
+	GetCourses() ([]course.CourseModel, error)
+	DeleteCourse(course *course.CourseModel) error
+	// SetCourseExpiry moves the expiry of a course, which then warns its owner and expires once more.
+	SetCourseExpiry(name string, expiresAt time.Time) error
+	MarkCourseWarned(name string, at time.Time) error
+	MarkCourseExpired(name string, at time.Time) error
+	AddCourseMember(name string, username string) error
+	RemoveCourseMember(name string, username string) error
+	// AddCourseMachine assigns a machine to a course and restricts the machine to the users with access.
+	AddCourseMachine(name string, mac string) error
+	RemoveCourseMachine(name string, mac string) error
+	// GetImagesByCourse finds the images outside the trash which are labelled with a course.
+	GetImagesByCourse(name string) ([]images.ImageModel, error)
+	GetModeratorScopes(moderator string) ([]course.ModeratorScope, error)
+	AddModeratorScope(moderator string, name string) error
+	RemoveModeratorScope(moderator string, name string) error
+	// GetModeratorScopeOfUser and GetModeratorScopeOfMachine find a course in the scope of the moderator which has
+	// the user as a member or the machine assigned, the name is empty when there is none.
+	GetModeratorScopeOfUser(moderator string, username string) (string, error)
+	GetModeratorScopeOfMachine(moderator string, mac string) (string, error)
+	GetUsersInModeratorScope(moderator string) ([]user.UserModel, error)
 
 	GetUserByUsername(name string) (*user.UserModel, error)
 	GetUserByID(id uint) (*user.UserModel, error)
@@ -36,15 +143,150 @@ type Store interface {
 	CreateUser(user *user.UserModel) error
 	RemoveUser(user *user.UserModel) error
 	ModifyUser(user *user.UserModel) error
+	// RevokeSessions invalidates the sessions of a user which were handed out before the given time.
+	RevokeSessions(username string, at time.Time) error
+	// SetUserDisabled disables or enables the account of a user, disabling it revokes its sessions as well.
+	SetUserDisabled(username string, disabled bool) error
+	// GetUserByEmail finds the user, who is not merged, with the email address regardless of its case.
+	GetUserByEmail(email string) (*user.UserModel, error)
+	// MergeUsers moves everything of the duplicate user over to the primary one and marks the duplicate merged.
+	MergeUsers(primary string, duplicate string) (*MergeResult, error)
+	// UpdateUsers changes the roles, storage limits and accounts of many users, either all of them or none.
+	UpdateUsers(updates []UserUpdate) error
+	// GetIdentity finds the identity belonging to an account at an OAuth provider.
+	GetIdentity(provider user.OAuthProvider, providerID string) (*user.IdentityModel, error)
+	GetIdentityByID(id uint) (*user.IdentityModel, error)
+	GetIdentitiesByUsername(username string) ([]user.IdentityModel, error)
+	CreateIdentity(identity *user.IdentityModel) error
+	DeleteIdentity(identity *user.IdentityModel) error
+	GetSSHKeys(username string) ([]user.SSHKeyModel, error)
+	GetSSHKey(id uint) (*user.SSHKeyModel, error)
+	CreateSSHKey(key *user.SSHKeyModel) error
+	DeleteSSHKey(key *user.SSHKeyModel) error
+	// CreateSession records where a session was handed out, GetSessionsByUsername leaves out the expired ones.
+	CreateSession(session *user.SessionModel) error
+	GetSession(id string) (*user.SessionModel, error)
+	GetSessionsByUsername(username string) ([]user.SessionModel, error)
+	TouchSession(id string, from string, at time.Time) error
+	FlagSessionAnomaly(id string, at time.Time) (bool, error)
+	// GetSessionsExpiredBefore and DeleteSession let the janitor forget the sessions which can no longer be used.
+	GetSessionsExpiredBefore(at time.Time) ([]user.SessionModel, error)
+	DeleteSession(id string) error
+	// GetRoleLimits and GetLimitOverrides never fail for missing rows, nothing stored means nothing is limited.
+	GetRoleLimits(role user.UserRole) (*user.RoleLimits, error)
+	SetRoleLimits(limits *user.RoleLimits) error
+	GetLimitOverrides(username string) (*user.LimitOverrides, error)
+	SetLimitOverrides(overrides *user.LimitOverrides) error
+	DeleteLimitOverrides(username string) error
+	// GetAllLimitOverrides gives the overridden limits of every user who has them.
+	GetAllLimitOverrides() ([]user.LimitOverrides, error)
+	// AddFavoriteImage and RemoveFavoriteImage change the favorites of a user, GetFavoriteImages leaves out the
+	// images in the trash.
+	AddFavoriteImage(username string, uuid images.ImageUUID) error
+	RemoveFavoriteImage(username string, uuid images.ImageUUID) error
+	GetFavoriteImages(username string) ([]images.ImageModel, error)
+	// GetImagesLastBooted finds when each image was last booted through an image setup of the user.
+	GetImagesLastBooted(username string) (map[images.ImageUUID]time.Time, error)
+	CountImages(username string) (int64, error)
+	CountVersions(uuid images.ImageUUID) (int64, error)
+	CountQueuedBoots(username string) (int64, error)
+	// CountActiveBoots counts the boot setups of a user which are queued or being flashed.
+	CountActiveBoots(username string) (int64, error)
+	// CountWebhooks counts the image webhooks a user created
+	CountWebhooks(username string) (int64, error)
+
+	CreateAgentRelease(release *agent.Release) error
+	GetAgentRelease(architecture string, version string) (*agent.Release, error)
+	GetAgentReleases() ([]agent.Release, error)
+	// GetAgentChannel never fails for a missing row, an architecture without a channel has nothing released.
+	GetAgentChannel(architecture string) (*agent.Channel, error)
+	GetAgentChannels() ([]agent.Channel, error)
+	SetAgentChannel(channel *agent.Channel) error
+
+	// RotateCertificateAuthority retires the current CA chain in favour of a new one.
+	RotateCertificateAuthority(ca *pki.CertificateAuthority) error
+	GetCertificateAuthorities() ([]pki.CertificateAuthority, error)
+
+	// ReserveIdempotencyKey stores the key of a request before it is handled, it fails with a ConstraintError when
+	// the principal used the key before.
+	ReserveIdempotencyKey(record *idempotency.Record) error
+	GetIdempotencyKey(principal string, key string) (*idempotency.Record, error)
+	CompleteIdempotencyKey(record *idempotency.Record) error
+	DeleteIdempotencyKey(record *idempotency.Record) error
+	// DeleteIdempotencyKeysBefore removes the keys reserved before the given time, returning how many were removed.
+	DeleteIdempotencyKeysBefore(before time.Time) (int64, error)
+
+	// GetBootstrapRecord fails with gorm.ErrRecordNotFound for what the bootstrap did not create.
+	GetBootstrapRecord(key string) (*bootstrap.Record, error)
+	GetBootstrapRecords() ([]bootstrap.Record, error)
+	AddBootstrapRecord(record *bootstrap.Record) error
 
 	GetImageByUUID(uuid images.ImageUUID) (*images.ImageModel, error)
 	GetImagesByUsername(username string) ([]images.ImageModel, error)
 	GetImagesByNameAndUsername(name string, username string) ([]images.ImageModel, error)
-	CreateImage(image *images.ImageModel)
+	GetPublicImages() ([]images.ImageModel, error)
+	// GetImageSummariesByUsername and GetPublicImageSummaries leave the versions out and count them instead.
+	GetImageSummariesByUsername(username string) ([]images.ImageModel, error)
+	GetPublicImageSummaries() ([]images.ImageModel, error)
+	// SearchImages finds the images of all users which match the filter, without their versions
+	SearchImages(filter ImageFilter) ([]images.ImageModel, error)
+	CreateImage(image *images.ImageModel) error
+	// DeleteImage removes an image and its files for good, TrashImage only moves it to the trash.
 	DeleteImage(image *images.ImageModel) error
+	TrashImage(image *images.ImageModel) error
+	RestoreImage(image *images.ImageModel) error
+	GetTrashedImage(uuid images.ImageUUID) (*images.ImageModel, error)
+	GetTrashedImages(username string) ([]images.ImageModel, error)
+	GetImagesTrashedBefore(before time.Time) ([]images.ImageModel, error)
+	GetStorageUsage(username string) (*images.StorageUsage, error)
 	UpdateImage(image *images.ImageModel) error
-	CreateNewImageVersion(version images.Version)
+	SetImageIcon(uuid images.ImageUUID, icon string) error
+	// SetUploadedDiskUUID records the partition table UUID of the latest upload to an image, with claim it becomes
+	// the DiskUUID of the image as well
+	SetUploadedDiskUUID(uuid images.ImageUUID, diskUUID string, claim bool) error
+	// SetImagePlacement sets the storage tier an admin put the image on, MoveImage switches the image to the files
+	// on another tier. It only moves the image when it is still stored at from, reporting whether it did.
+	SetImagePlacement(uuid images.ImageUUID, tier string) error
+	MoveImage(uuid images.ImageUUID, from string, tier string, path string) (bool, error)
+	// GetImagePaths fetches where the files of all images are stored, including the ones in the trash
+	GetImagePaths() (map[images.ImageUUID]string, error)
+	// GetTierUsage counts the images and versions on every storage tier which holds any, those in the trash included
+	GetTierUsage() ([]TierUsage, error)
+	CreateNewImageVersion(version images.Version) error
 	GetVersionByID(versionID uint64) (*images.Version, error)
+	SetVersionSize(uuid images.ImageUUID, version uint64, size uint64) error
+	SetVersionChecksum(uuid images.ImageUUID, version uint64, sha256 string) error
+	// SetVersionCorrupt marks whether the file of a version still matches its checksum
+	SetVersionCorrupt(uuid images.ImageUUID, version uint64, corrupt bool) error
+	// SetVersionFormat records the format of the file of a version, as it was detected when it was stored
+	SetVersionFormat(uuid images.ImageUUID, version uint64, format images.FileFormat) error
+	// SetVersionBootKey records the key of the boot a version was uploaded encrypted by
+	SetVersionBootKey(uuid images.ImageUUID, version uint64, keyID uint) error
+	DeleteVersion(version *images.Version) error
+	GetVersions(uuid images.ImageUUID, opts ListOptions) ([]images.Version, int64, error)
+
+	// SetBackupPolicy replaces the backup policy of an image, GetBackupPolicy fails with gorm.ErrRecordNotFound for
+	// images without one.
+	SetBackupPolicy(policy *images.BackupPolicy) error
+	GetBackupPolicy(uuid images.ImageUUID) (*images.BackupPolicy, error)
+	GetBackupPolicies() ([]images.BackupPolicy, error)
+	DeleteBackupPolicy(uuid images.ImageUUID) error
+	// SaveVersionBackup records how the copy of a version to the backup target of its image went.
+	SaveVersionBackup(backup *images.VersionBackup) error
+	GetVersionBackups(uuid images.ImageUUID) ([]images.VersionBackup, error)
+	// GetFailedVersionBackups fetches the copies which failed since they last succeeded, the latest failures first.
+	GetFailedVersionBackups() ([]images.VersionBackup, error)
+	DeleteVersionBackup(uuid images.ImageUUID, version uint64) error
+
+	CreateImageWebhook(webhook *images.ImageWebhook) error
+	GetImageWebhooks(uuid images.ImageUUID) ([]images.ImageWebhook, error)
+	// GetImageWebhook fails with gorm.ErrRecordNotFound when the webhook does not belong to the image
+	GetImageWebhook(uuid images.ImageUUID, id uint) (*images.ImageWebhook, error)
+	DeleteImageWebhook(webhook *images.ImageWebhook) error
+	// AddWebhookDelivery records a delivery and forgets all but the last keep deliveries of its webhook
+	AddWebhookDelivery(delivery *images.WebhookDelivery, keep int) error
+	// GetWebhookDeliveries lists the deliveries of a webhook, the latest first
+	GetWebhookDeliveries(id uint) ([]images.WebhookDelivery, error)
 
 	// You could use weird Go polymorphisms here, but I guess I will just copy and paste code
 	CreateMachineImage(image *images.MachineImageModel)
@@ -58,4 +300,68 @@ type Store interface {
 	ModifyImageSetup(imageSetup *images.ImageSetup) error
 	DeleteImageSetup(imageSetup *images.ImageSetup) error
 	RemoveImageFromImageSetup(setup *images.ImageSetup, image *images.ImageModel, version images.Version, update bool) error
+
+	// CreateImageSet and UpdateImageSet store the set together with the image setup it is booted through
+	CreateImageSet(set *images.ImageSet, setup *images.ImageSetup) error
+	UpdateImageSet(set *images.ImageSet, setup *images.ImageSetup) error
+	GetImageSet(uuid images.ImageUUID) (*images.ImageSet, error)
+	GetImageSets(username string) ([]images.ImageSet, error)
+	DeleteImageSet(set *images.ImageSet) error
+
+	CreateMetadataTemplate(template *images.MetadataTemplate) error
+	GetMetadataTemplates(username string) ([]images.MetadataTemplate, error)
+	GetMetadataTemplate(username string, name string) (*images.MetadataTemplate, error)
+	DeleteMetadataTemplate(template *images.MetadataTemplate) error
+
+	CreateBootTemplate(template *images.BootTemplate) error
+	GetBootTemplates(username string) ([]images.BootTemplate, error)
+	GetBootTemplate(username string, name string) (*images.BootTemplate, error)
+	// UpdateBootTemplate saves the options of a template and raises its revision.
+	UpdateBootTemplate(template *images.BootTemplate) error
+	DeleteBootTemplate(template *images.BootTemplate) error
+	// SetMachineMetadata replaces the metadata which is served to a machine during its current boot.
+	SetMachineMetadata(metadata *images.MachineMetadata) error
+	GetMachineMetadata(mac string) (*images.MachineMetadata, error)
+	GetMachineMetadataByIP(ip string) (*images.MachineMetadata, error)
+	DeleteMachineMetadata(mac string) error
+
+	// CheckReferences finds (and when repair is set removes) rows which refer to rows that do not exist.
+	CheckReferences(repair bool) ([]DanglingReference, error)
+	GetAllVersions() ([]images.Version, error)
+	GetImageUUIDs() (userImages []images.ImageUUID, machineImages []images.ImageUUID, err error)
+	// FindNameCollisions finds the images outside the trash whose names only differ in case from another image of
+	// the same user.
+	FindNameCollisions() ([]NameCollision, error)
+	// FindInvalidRoles finds the users whose role is not one a user can have.
+	FindInvalidRoles() ([]InvalidRole, error)
+	// FindEmailCollisions finds the users who are not merged and share an email address regardless of case.
+	FindEmailCollisions() ([]EmailCollision, error)
+	// SecretKeyIDs lists the keys the secrets in the database are sealed with, so a missing key is noticed on start.
+	SecretKeyIDs() ([]string, error)
+	// RotateSecrets seals every secret with the primary key of the keyring and returns how many it changed.
+	RotateSecrets(keyring *secrets.Keyring) (int, error)
+
+	// GetReplicationChanges fetches the rows which changed after the sequence number since, at most limit of them.
+	GetReplicationChanges(since uint64, limit int) ([]replication.Change, error)
+	// ApplyReplicationChanges writes the changes of the primary and moves the cursor of the replica to cursor.
+	ApplyReplicationChanges(changes []replication.Change, cursor uint64) error
+	// GetReplicationState never fails for a missing row, a database without one is not a replica.
+	GetReplicationState() (*replication.State, error)
+	// GetTelemetryState never fails for a missing row, a database which never made a report has no install ID.
+	GetTelemetryState() (*telemetry.State, error)
+	SetTelemetryInstallID(id string) error
+	// RecordTelemetryAttempt records trying to send a report, failure is empty when it was sent.
+	RecordTelemetryAttempt(at time.Time, failure string) error
+	// SetReplicaOf makes the database a replica of the primary, it fails with ErrPromoted for promoted ones.
+	SetReplicaOf(primary string) error
+	SetReplicationSynced(at time.Time) error
+	// PromoteReplica stops the database from being a replica, it fails with ErrNotReplica when it is not one.
+	PromoteReplica() error
+
+	// GetStatistics counts the users, images and machines. The boot setups are counted from since onwards, the
+	// users using the most storage are limited to top.
+	GetStatistics(since time.Time, top int) (*Statistics, error)
+	// GetUsage adds up the machine hours, flashes and storage of every course or user between from and to. A user
+	// in several courses counts towards each of them.
+	GetUsage(from time.Time, to time.Time, groupBy UsageGrouping) ([]Usage, error)
 }
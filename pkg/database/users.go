@@ -0,0 +1,19 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package database
+
+import "github.com/baas-project/baas/pkg/model/user"
+
+// UserUpdate is the change to a single user of a bulk update, what is not set stays as it is
+type UserUpdate struct {
+	Username string
+	Role     user.UserRole
+	Disabled *bool
+
+	// StorageBytes replaces the storage limit of the user, ResetStorage removes it so the one of their role applies
+	// again
+	StorageBytes *uint64
+	ResetStorage bool
+}
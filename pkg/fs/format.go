@@ -0,0 +1,46 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// formatHeadSize is how much of a file is read to detect its format, the signature of ISO 9660 lies furthest in
+const formatHeadSize = 0x8001 + 5
+
+// DetectFormat classifies a disk image by the signatures in its first bytes. Hybrid ISO images also carry an MBR,
+// they are detected as ISO images.
+func DetectFormat(r io.Reader) (images.FileFormat, error) {
+	head := make([]byte, formatHeadSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+
+	at := func(offset int, signature string) bool {
+		return len(head) >= offset+len(signature) && string(head[offset:offset+len(signature)]) == signature
+	}
+
+	switch {
+	case at(0, "QFI\xfb"):
+		return images.FormatQCow2, nil
+	case at(0, "KDMV"), at(0, "# Disk DescriptorFile"):
+		return images.FormatVMDK, nil
+	case at(0x8001, "CD001"):
+		return images.FormatISO, nil
+	// A GPT, or the boot signature of an MBR or a FAT file system
+	case at(512, "EFI PART"), at(510, "\x55\xaa"):
+		return images.FormatRaw, nil
+	// The magic number of the superblock of an ext2, ext3 or ext4 file system
+	case at(0x438, "\x53\xef"):
+		return images.FormatRaw, nil
+	}
+
+	return images.FormatUnknown, nil
+}
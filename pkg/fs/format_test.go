@@ -0,0 +1,45 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectFormat(t *testing.T) {
+	disk := func(offset int, signature string) []byte {
+		b := make([]byte, 64*1024)
+		copy(b[offset:], signature)
+		return b
+	}
+	hybrid := disk(0x8001, "CD001")
+	copy(hybrid[510:], "\x55\xaa")
+
+	for name, tc := range map[string]struct {
+		content []byte
+		format  images.FileFormat
+	}{
+		"mbr":     {disk(510, "\x55\xaa"), images.FormatRaw},
+		"gpt":     {disk(512, "EFI PART"), images.FormatRaw},
+		"ext4":    {disk(0x438, "\x53\xef"), images.FormatRaw},
+		"qcow2":   {disk(0, "QFI\xfb"), images.FormatQCow2},
+		"vmdk":    {disk(0, "KDMV"), images.FormatVMDK},
+		"iso":     {disk(0x8001, "CD001"), images.FormatISO},
+		"hybrid":  {hybrid, images.FormatISO},
+		"zip":     {disk(0, "PK\x03\x04"), images.FormatUnknown},
+		"zeroes":  {disk(0, ""), images.FormatUnknown},
+		"short":   {[]byte("QF"), images.FormatUnknown},
+		"empty":   {nil, images.FormatUnknown},
+		"oneword": {[]byte("fits"), images.FormatUnknown},
+	} {
+		format, err := DetectFormat(bytes.NewReader(tc.content))
+		assert.NoError(t, err, name)
+		assert.Equal(t, tc.format, format, name)
+	}
+}
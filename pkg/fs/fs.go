@@ -8,6 +8,7 @@ package fs
 import (
 	"io"
 	"os"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -15,6 +16,25 @@ import (
 // Size with which to copy
 const blocksize int64 = 1500
 
+// copyBufferSize is the size of the buffers Copy uses, large enough to keep the number of system calls down and
+// small enough for many copies to run at once
+const copyBufferSize = 64 * 1024
+
+// copyBuffers are reused between copies, so streaming an upload does not allocate anything per request
+var copyBuffers = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, copyBufferSize)
+	return &buffer
+}}
+
+// Copy streams src into dest through a pooled buffer and returns the number of bytes copied. Unlike io.Copy it never
+// leaves the copy to the ReadFrom or WriteTo methods of the streams, which allocate buffers of their own.
+func Copy(dest io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+
+	return io.CopyBuffer(struct{ io.Writer }{dest}, struct{ io.Reader }{src}, *buffer)
+}
+
 // CopyFile is a function which copies a file, it is similar to dd in usage
 func CopyFile(from, to string) error {
 	src, err := os.OpenFile(from, os.O_RDONLY, os.ModePerm)
@@ -116,3 +116,19 @@ func TestCopyFile512(t *testing.T) {
 	err = os.Remove(fromFileName)
 	assert.NoError(t, err)
 }
+
+func TestCopy(t *testing.T) {
+	content := strings.Repeat("ABCDEFGH", copyBufferSize)
+
+	var dest strings.Builder
+	n, err := Copy(&dest, strings.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, content, dest.String())
+
+	// The buffers are reused, copying does not allocate one each time
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = Copy(ioutil.Discard, strings.NewReader(content))
+	})
+	assert.LessOrEqual(t, allocs, float64(4))
+}
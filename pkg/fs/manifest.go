@@ -0,0 +1,124 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestBlockSize is the size of the blocks manifests hash, partitioning tools align partitions to it
+const ManifestBlockSize = 1024 * 1024
+
+// Manifest holds the SHA-256 of every block of a disk, so versions of it can be compared without reading them
+type Manifest struct {
+	BlockSize uint64
+	// Size is the size of the disk in bytes, its last block is shorter when it is not a multiple of BlockSize
+	Size uint64
+	// Hashes are the hashes of the blocks back to back
+	Hashes []byte
+}
+
+// ReadManifest hashes the disk read from r in blocks of blockSize
+func ReadManifest(r io.Reader, blockSize uint64) (*Manifest, error) {
+	if blockSize == 0 {
+		return nil, errors.New("the block size cannot be zero")
+	}
+
+	manifest := &Manifest{BlockSize: blockSize}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			sum := sha256.Sum256(block[:n])
+			manifest.Hashes = append(manifest.Hashes, sum[:]...)
+			manifest.Size += uint64(n)
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return manifest, nil
+		default:
+			return nil, errors.Wrap(err, "read disk")
+		}
+	}
+}
+
+// Blocks is the number of blocks of the disk
+func (m *Manifest) Blocks() int {
+	return len(m.Hashes) / sha256.Size
+}
+
+// block is the hash of block i
+func (m *Manifest) block(i int) string {
+	return string(m.Hashes[i*sha256.Size : (i+1)*sha256.Size])
+}
+
+// blockLength is the number of bytes in block i, only the last block can be short
+func (m *Manifest) blockLength(i int) uint64 {
+	if end := uint64(i+1) * m.BlockSize; end > m.Size {
+		return m.Size - uint64(i)*m.BlockSize
+	}
+
+	return m.BlockSize
+}
+
+// check refuses manifests whose hashes do not add up to their size
+func (m *Manifest) check() error {
+	if m.BlockSize == 0 || len(m.Hashes)%sha256.Size != 0 ||
+		uint64(m.Blocks()) != (m.Size+m.BlockSize-1)/m.BlockSize {
+		return errors.New("the manifest is damaged")
+	}
+
+	return nil
+}
+
+// ChangedBlocks tells for every block whether it differs between the disks. Blocks which only the larger of the two
+// has count as changed.
+func ChangedBlocks(a, b *Manifest) ([]bool, error) {
+	if err := a.check(); err != nil {
+		return nil, err
+	}
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	if a.BlockSize != b.BlockSize {
+		return nil, errors.Errorf("the manifests have blocks of %d and %d bytes", a.BlockSize, b.BlockSize)
+	}
+
+	blocks := a.Blocks()
+	if b.Blocks() > blocks {
+		blocks = b.Blocks()
+	}
+
+	changed := make([]bool, blocks)
+	for i := range changed {
+		changed[i] = i >= a.Blocks() || i >= b.Blocks() || a.block(i) != b.block(i) ||
+			a.blockLength(i) != b.blockLength(i)
+	}
+
+	return changed, nil
+}
+
+// UniqueBytes counts the bytes of the blocks of m whose content appears nowhere in other, wherever they are. Those
+// are the bytes only m holds.
+func UniqueBytes(m, other *Manifest) uint64 {
+	held := make(map[string]bool, other.Blocks())
+	for i := 0; i < other.Blocks(); i++ {
+		held[other.block(i)] = true
+	}
+
+	var unique uint64
+	for i := 0; i < m.Blocks(); i++ {
+		if !held[m.block(i)] {
+			unique += m.blockLength(i)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifests(t *testing.T) {
+	a, err := ReadManifest(bytes.NewReader([]byte("aaaabbbbccccdd")), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(14), a.Size)
+	assert.Equal(t, 4, a.Blocks())
+
+	// The second block changed and the disk grew past the end of the last one
+	b, err := ReadManifest(bytes.NewReader([]byte("aaaaxxxxccccddbbbb")), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, b.Blocks())
+
+	changed, err := ChangedBlocks(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, false, true, true}, changed)
+	assert.Equal(t, uint64(6), UniqueBytes(a, b))
+	assert.Equal(t, uint64(10), UniqueBytes(b, a))
+
+	empty, err := ReadManifest(bytes.NewReader(nil), 4)
+	assert.NoError(t, err)
+	assert.Zero(t, empty.Blocks())
+	assert.Equal(t, a.Size, UniqueBytes(a, empty))
+
+	other, err := ReadManifest(bytes.NewReader([]byte("aaaabbbb")), 8)
+	assert.NoError(t, err)
+	_, err = ChangedBlocks(a, other)
+	assert.Error(t, err)
+
+	other.Hashes = other.Hashes[1:]
+	_, err = ChangedBlocks(other, other)
+	assert.Error(t, err)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// SectorSize is the size of the logical sectors partition tables are read with
+const SectorSize = 512
+
+// Partition table types, as blkid calls them
+const (
+	TableGPT = "gpt"
+	TableDOS = "dos"
+)
+
+const (
+	// maxPartitionEntries bounds the entries of a GPT which are read, the specification reserves room for 128
+	maxPartitionEntries = 1024
+	// maxEntriesOffset bounds how far into the disk the entries of a GPT may start
+	maxEntriesOffset = 1024 * 1024
+)
+
+// ErrNoPartitionTable is returned for disks without a GPT or MBR partition table
+var ErrNoPartitionTable = errors.New("the disk has no partition table")
+
+// guidPattern is a GUID as blkid prints it, lowercase with dashes
+var guidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// signaturePattern is the disk signature of an MBR, eight hexadecimal digits
+var signaturePattern = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// Partition is an entry of a partition table. Start and Size are in bytes.
+type Partition struct {
+	Number int
+	// Type is the partition type GUID on GPT disks, and the system ID in hexadecimal on MBR disks
+	Type     string
+	UUID     string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	Start    uint64
+	Size     uint64
+	Bootable bool `json:",omitempty"`
+}
+
+// PartitionTable summarizes the partition table at the start of a disk
+type PartitionTable struct {
+	// Type is gpt or dos
+	Type string
+	// DiskUUID identifies the partition table, in the format of the PTUUID of blkid. It is empty for MBR disks
+	// without a disk signature.
+	DiskUUID   string
+	Partitions []Partition
+}
+
+// NormalizeDiskUUID spells the UUID of a partition table the way blkid does. It accepts the GUID of a GPT disk and
+// the disk signature of an MBR disk, which may be written like the serial of a FAT volume: 30DF-844C.
+func NormalizeDiskUUID(id string) (string, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if guidPattern.MatchString(id) {
+		return id, nil
+	}
+
+	signature := strings.TrimPrefix(id, "0x")
+	if len(signature) == 9 && signature[4] == '-' {
+		signature = signature[:4] + signature[5:]
+	}
+
+	if signaturePattern.MatchString(signature) {
+		return signature, nil
+	}
+
+	return "", fmt.Errorf("%q is neither the GUID of a GPT disk nor the signature of an MBR disk", id)
+}
+
+// formatGUID prints a GUID as it is stored on disk, of which the first three fields are little endian
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]), binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+// ReadPartitionTable reads the partition table at the start of a disk. A protective MBR is followed by the GPT
+// behind it. The logical partitions of an extended MBR partition are not listed.
+func ReadPartitionTable(r io.Reader) (*PartitionTable, error) {
+	// The protective or regular MBR is in the first sector, the GPT header in the second one
+	head := make([]byte, 2*SectorSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNoPartitionTable
+		}
+		return nil, err
+	}
+
+	if string(head[SectorSize:SectorSize+8]) == "EFI PART" {
+		return readGPT(r, head[SectorSize:])
+	}
+
+	if head[510] != 0x55 || head[511] != 0xaa {
+		return nil, ErrNoPartitionTable
+	}
+
+	return readMBR(head)
+}
+
+// readMBR reads the four primary partitions of an MBR. The boot sector of a FAT file system has the same boot
+// signature, it is told apart by entries which are not partitions.
+func readMBR(head []byte) (*PartitionTable, error) {
+	table := PartitionTable{Type: TableDOS, Partitions: []Partition{}}
+	for i := 0; i < 4; i++ {
+		entry := head[446+16*i : 446+16*(i+1)]
+		if entry[0] != 0 && entry[0] != 0x80 {
+			return nil, ErrNoPartitionTable
+		}
+
+		sectors := binary.LittleEndian.Uint32(entry[12:16])
+		if entry[4] == 0 || sectors == 0 {
+			continue
+		}
+
+		// A protective MBR without the GPT it protects
+		if entry[4] == 0xee {
+			return nil, ErrNoPartitionTable
+		}
+
+		table.Partitions = append(table.Partitions, Partition{
+			Number:   i + 1,
+			Type:     fmt.Sprintf("%02x", entry[4]),
+			Start:    uint64(binary.LittleEndian.Uint32(entry[8:12])) * SectorSize,
+			Size:     uint64(sectors) * SectorSize,
+			Bootable: entry[0] == 0x80,
+		})
+	}
+
+	if len(table.Partitions) == 0 {
+		return nil, ErrNoPartitionTable
+	}
+
+	if signature := binary.LittleEndian.Uint32(head[440:444]); signature != 0 {
+		table.DiskUUID = fmt.Sprintf("%08x", signature)
+	}
+
+	return &table, nil
+}
+
+// readGPT reads the partition entries of a GPT, r is right behind its header
+func readGPT(r io.Reader, header []byte) (*PartitionTable, error) {
+	table := PartitionTable{Type: TableGPT, DiskUUID: formatGUID(header[56:72]), Partitions: []Partition{}}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	count := binary.LittleEndian.Uint32(header[80:84])
+	size := binary.LittleEndian.Uint32(header[84:88])
+	if entriesLBA < 2 || entriesLBA*SectorSize > maxEntriesOffset || count > maxPartitionEntries || size < 128 ||
+		size > SectorSize {
+		return nil, errors.Errorf("the GPT header is invalid: %d entries of %d bytes at sector %d", count, size,
+			entriesLBA)
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, int64(entriesLBA-2)*SectorSize); err != nil {
+		return nil, errors.Wrap(err, "cannot skip to the partition entries")
+	}
+
+	entries := make([]byte, int(count)*int(size))
+	if _, err := io.ReadFull(r, entries); err != nil {
+		return nil, errors.Wrap(err, "cannot read the partition entries")
+	}
+
+	var unused [16]byte
+	for i := 0; i < int(count); i++ {
+		entry := entries[i*int(size) : (i+1)*int(size)]
+		if string(entry[0:16]) == string(unused[:]) {
+			continue
+		}
+
+		first := binary.LittleEndian.Uint64(entry[32:40])
+		last := binary.LittleEndian.Uint64(entry[40:48])
+		if last < first {
+			return nil, errors.Errorf("partition %d ends before it starts", i+1)
+		}
+
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = binary.LittleEndian.Uint16(entry[56+2*j:])
+		}
+
+		table.Partitions = append(table.Partitions, Partition{
+			Number: i + 1,
+			Type:   formatGUID(entry[0:16]),
+			UUID:   formatGUID(entry[16:32]),
+			Name:   strings.TrimRight(string(utf16.Decode(name)), "\x00"),
+			Start:  first * SectorSize,
+			Size:   (last - first + 1) * SectorSize,
+		})
+	}
+
+	return &table, nil
+}
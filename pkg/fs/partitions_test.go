@@ -0,0 +1,103 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gptDisk is the start of a disk with a GPT which holds one EFI system partition, as sgdisk writes it
+func gptDisk() []byte {
+	disk := make([]byte, 34*SectorSize)
+	copy(disk[510:], "\x55\xaa")
+	disk[446+4] = 0xee
+	binary.LittleEndian.PutUint32(disk[446+12:], 0xffffffff)
+
+	header := disk[SectorSize:]
+	copy(header, "EFI PART")
+	// 5c3b1e2a-07d4-4f4e-9a52-6b8f0c1d2e3f
+	copy(header[56:], "\x2a\x1e\x3b\x5c\xd4\x07\x4e\x4f\x9a\x52\x6b\x8f\x0c\x1d\x2e\x3f")
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+
+	entry := disk[2*SectorSize:]
+	// The type GUID of EFI system partitions, c12a7328-f81f-11d2-ba4b-00a0c93ec93b
+	copy(entry, "\x28\x73\x2a\xc1\x1f\xf8\xd2\x11\xba\x4b\x00\xa0\xc9\x3e\xc9\x3b")
+	copy(entry[16:], "\x01\x00\x00\x00\x02\x00\x03\x00\x04\x05\x06\x07\x08\x09\x0a\x0b")
+	binary.LittleEndian.PutUint64(entry[32:], 2048)
+	binary.LittleEndian.PutUint64(entry[40:], 206847)
+	for i, c := range "EFI" {
+		binary.LittleEndian.PutUint16(entry[56+2*i:], uint16(c))
+	}
+
+	return disk
+}
+
+// mbrDisk is the first sector of a disk with an MBR which holds one bootable Linux partition
+func mbrDisk() []byte {
+	disk := make([]byte, 2*SectorSize)
+	binary.LittleEndian.PutUint32(disk[440:], 0x30df844c)
+	disk[446] = 0x80
+	disk[446+4] = 0x83
+	binary.LittleEndian.PutUint32(disk[446+8:], 2048)
+	binary.LittleEndian.PutUint32(disk[446+12:], 4096)
+	copy(disk[510:], "\x55\xaa")
+	return disk
+}
+
+func TestReadPartitionTable(t *testing.T) {
+	table, err := ReadPartitionTable(bytes.NewReader(gptDisk()))
+	assert.NoError(t, err)
+	assert.Equal(t, &PartitionTable{Type: TableGPT, DiskUUID: "5c3b1e2a-07d4-4f4e-9a52-6b8f0c1d2e3f",
+		Partitions: []Partition{{Number: 1, Type: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+			UUID: "00000001-0002-0003-0405-060708090a0b", Name: "EFI", Start: 1024 * 1024,
+			Size: 100 * 1024 * 1024}}}, table)
+
+	table, err = ReadPartitionTable(bytes.NewReader(mbrDisk()))
+	assert.NoError(t, err)
+	assert.Equal(t, &PartitionTable{Type: TableDOS, DiskUUID: "30df844c", Partitions: []Partition{{Number: 1,
+		Type: "83", Start: 1024 * 1024, Size: 2 * 1024 * 1024, Bootable: true}}}, table)
+
+	// A FAT boot sector has the boot signature of an MBR, but its entries are code
+	fat := make([]byte, 2*SectorSize)
+	copy(fat[446:], "\xeb\x3c\x90mkfs.fat")
+	copy(fat[510:], "\x55\xaa")
+	protective := gptDisk()[:SectorSize]
+	for name, disk := range map[string][]byte{"fat": fat, "protective": append(protective, make([]byte, 512)...),
+		"zeroes": make([]byte, 4096), "short": []byte("EFI PART")} {
+		_, err = ReadPartitionTable(bytes.NewReader(disk))
+		assert.Equal(t, ErrNoPartitionTable, err, name)
+	}
+
+	broken := gptDisk()
+	binary.LittleEndian.PutUint32(broken[SectorSize+80:], 1<<20)
+	_, err = ReadPartitionTable(bytes.NewReader(broken))
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrNoPartitionTable, err)
+}
+
+func TestNormalizeDiskUUID(t *testing.T) {
+	for id, normalized := range map[string]string{
+		"5C3B1E2A-07D4-4F4E-9A52-6B8F0C1D2E3F": "5c3b1e2a-07d4-4f4e-9a52-6b8f0c1d2e3f",
+		"30DF-844C":                            "30df844c",
+		" 30df844c ":                           "30df844c",
+		"0x30DF844C":                           "30df844c",
+	} {
+		found, err := NormalizeDiskUUID(id)
+		assert.NoError(t, err, id)
+		assert.Equal(t, normalized, found, id)
+	}
+
+	for _, id := range []string{"", "/dev/sda", "WD-WCC4N1234567", "30df-844", "5c3b1e2a07d44f4e9a526b8f0c1d2e3f",
+		"30df844g"} {
+		_, err := NormalizeDiskUUID(id)
+		assert.Error(t, err, id)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestWriter builds the manifest of what is written through it, so a disk can be compared with what was written
+// to it without keeping a copy
+type ManifestWriter struct {
+	manifest Manifest
+	block    []byte
+}
+
+// NewManifestWriter hashes what is written in blocks of blockSize
+func NewManifestWriter(blockSize uint64) *ManifestWriter {
+	return &ManifestWriter{
+		manifest: Manifest{BlockSize: blockSize},
+		block:    make([]byte, 0, blockSize),
+	}
+}
+
+// Write adds p to the manifest, it never fails
+func (w *ManifestWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := cap(w.block) - len(w.block)
+		if take > len(p) {
+			take = len(p)
+		}
+
+		w.block = append(w.block, p[:take]...)
+		p = p[take:]
+		if len(w.block) == cap(w.block) {
+			w.flush()
+		}
+	}
+
+	return n, nil
+}
+
+// flush hashes the block which was collected so far
+func (w *ManifestWriter) flush() {
+	sum := sha256.Sum256(w.block)
+	w.manifest.Hashes = append(w.manifest.Hashes, sum[:]...)
+	w.manifest.Size += uint64(len(w.block))
+	w.block = w.block[:0]
+}
+
+// Manifest is the manifest of everything written so far, a block which is not full yet is its last block
+func (w *ManifestWriter) Manifest() *Manifest {
+	if len(w.block) > 0 {
+		w.flush()
+	}
+
+	return &w.manifest
+}
+
+// SampleBlocks picks up to n of the blocks of a disk, spread evenly over it. The first and the last block are
+// always among them, the first holds the partition table and the last is where a disk which is too small fails.
+func SampleBlocks(blocks int, n int) []int {
+	if blocks <= n {
+		sample := make([]int, blocks)
+		for i := range sample {
+			sample[i] = i
+		}
+		return sample
+	}
+
+	if n < 2 {
+		n = 2
+	}
+
+	sample := make([]int, n)
+	for i := range sample {
+		sample[i] = i * (blocks - 1) / (n - 1)
+	}
+
+	return sample
+}
+
+// VerifyBlocks reads blocks of a disk back and compares them with its manifest. It returns the offsets of the blocks
+// which do not match and the number of bytes it read.
+func VerifyBlocks(r io.ReaderAt, m *Manifest, blocks []int) (mismatches []uint64, checked uint64, _ error) {
+	if err := m.check(); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, m.BlockSize)
+	for _, i := range blocks {
+		if i < 0 || i >= m.Blocks() {
+			return mismatches, checked, errors.Errorf("block %d is not on the disk", i)
+		}
+
+		offset := uint64(i) * m.BlockSize
+		block := buf[:m.blockLength(i)]
+		n, err := r.ReadAt(block, int64(offset))
+		checked += uint64(n)
+		if err != nil && !(err == io.EOF && n == len(block)) {
+			return mismatches, checked, errors.Wrapf(err, "read back block at offset %d", offset)
+		}
+
+		sum := sha256.Sum256(block)
+		if !bytes.Equal(sum[:], []byte(m.block(i))) {
+			mismatches = append(mismatches, offset)
+		}
+	}
+
+	return mismatches, checked, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestWriter(t *testing.T) {
+	disk := []byte("aaaabbbbccccdd")
+	w := NewManifestWriter(4)
+	for _, part := range [][]byte{disk[:3], disk[3:9], disk[9:]} {
+		n, err := w.Write(part)
+		assert.NoError(t, err)
+		assert.Equal(t, len(part), n)
+	}
+
+	read, err := ReadManifest(bytes.NewReader(disk), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, read, w.Manifest())
+}
+
+func TestSampleBlocks(t *testing.T) {
+	assert.Equal(t, []int{0, 1, 2}, SampleBlocks(3, 4))
+	assert.Equal(t, []int{0, 33, 66, 99}, SampleBlocks(100, 4))
+	assert.Equal(t, []int{0, 9}, SampleBlocks(10, 1))
+	assert.Empty(t, SampleBlocks(0, 4))
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	w := NewManifestWriter(4)
+	_, _ = w.Write([]byte("aaaabbbbccccdd"))
+	written := w.Manifest()
+
+	// The disk dropped the write of the second block, and is larger than what was written
+	disk := bytes.NewReader([]byte("aaaa\x00\x00\x00\x00ccccddeeeeee"))
+	mismatches, checked, err := VerifyBlocks(disk, written, []int{0, 1, 2, 3})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4}, mismatches)
+	assert.Equal(t, uint64(14), checked)
+
+	mismatches, checked, err = VerifyBlocks(disk, written, SampleBlocks(written.Blocks(), 2))
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+	assert.Equal(t, uint64(6), checked)
+
+	// A disk which ends before what was written cannot be read back
+	_, _, err = VerifyBlocks(bytes.NewReader([]byte("aaaabbbbcc")), written, []int{2})
+	assert.Error(t, err)
+	_, _, err = VerifyBlocks(disk, written, []int{4})
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package limits decides whether a user stays within the resources they are granted. The defaults are set per
+// role and can be overridden per user. Every place which claims resources goes through Check, so the rules are the
+// same everywhere.
+package limits
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/baas-project/baas/pkg/database"
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/pkg/errors"
+)
+
+// Names of the limits as reported in ExceededError, they match the fields of user.Limits
+const (
+	StorageBytes   = "StorageBytes"
+	MaxImages      = "MaxImages"
+	MaxVersions    = "MaxVersions"
+	MaxQueuedBoots = "MaxQueuedBoots"
+	MaxActiveBoots = "MaxActiveBoots"
+	MaxWebhooks    = "MaxWebhooks"
+)
+
+type kind int
+
+const (
+	createImage kind = iota
+	createVersion
+	storeBytes
+	queueBoot
+	activeBoots
+	createWebhook
+)
+
+// Action is something a user wants to do which claims resources
+type Action struct {
+	kind     kind
+	image    images.ImageUUID
+	bytes    uint64
+	replaces uint64
+	// count is the amount of boots which are queued at once, fallback the cap of users who have none of their role
+	// or their own
+	count    uint64
+	fallback uint
+}
+
+// CreateImage adds an image to those of the user
+func CreateImage() Action {
+	return Action{kind: createImage}
+}
+
+// CreateVersion adds a version to an image
+func CreateVersion(image images.ImageUUID) Action {
+	return Action{kind: createVersion, image: image}
+}
+
+// StoreBytes stores an uploaded file of size bytes, replacing a file of replaces bytes
+func StoreBytes(bytes uint64, replaces uint64) Action {
+	return Action{kind: storeBytes, bytes: bytes, replaces: replaces}
+}
+
+// QueueBoots queues count boot setups of the user, each on a machine
+func QueueBoots(count uint64) Action {
+	return Action{kind: queueBoot, count: count}
+}
+
+// ActiveBoots queues count boot setups of the user, which are counted together with the boots of the user that are
+// being flashed. fallback is the cap for users whose role and overrides leave MaxActiveBoots at zero.
+func ActiveBoots(count uint64, fallback uint) Action {
+	return Action{kind: activeBoots, count: count, fallback: fallback}
+}
+
+// CreateWebhook adds a webhook to an image. fallback is the cap for users whose role and overrides leave
+// MaxWebhooks at zero.
+func CreateWebhook(fallback uint) Action {
+	return Action{kind: createWebhook, fallback: fallback}
+}
+
+// ExceededError is returned by Check when the action would take the user over one of their limits
+type ExceededError struct {
+	Limit string
+	Max   uint64
+	// Current is the amount the user has, Requested the amount the user would have after the action
+	Current   uint64
+	Requested uint64
+}
+
+// Remaining is how much of the action fits within the limit, the limit may have been lowered below what the user
+// already has
+func (e *ExceededError) Remaining() uint64 {
+	if e.Current >= e.Max {
+		return 0
+	}
+
+	return e.Max - e.Current
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("limit %s of %d exceeded", e.Limit, e.Max)
+}
+
+// StatusCode is the HTTP status to answer the action with, storage has its own status.
+func (e *ExceededError) StatusCode() int {
+	if e.Limit == StorageBytes {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusForbidden
+}
+
+// Effective gets the limits which apply to a user: those of the role with the overrides of the user on top.
+func Effective(store database.Store, username string) (user.Limits, error) {
+	userModel, err := store.GetUserByUsername(username)
+	if err != nil {
+		return user.Limits{}, errors.Wrap(err, "find user")
+	}
+
+	role, err := store.GetRoleLimits(userModel.Role)
+	if err != nil {
+		return user.Limits{}, errors.Wrap(err, "get role limits")
+	}
+
+	overrides, err := store.GetLimitOverrides(username)
+	if err != nil {
+		return user.Limits{}, errors.Wrap(err, "get limit overrides")
+	}
+
+	return overrides.Apply(role.Limits), nil
+}
+
+// Check verifies that the user can perform the action. It returns an *ExceededError when a limit is in the way.
+func Check(store database.Store, username string, action Action) error {
+	limits, err := Effective(store, username)
+	if err != nil {
+		return err
+	}
+
+	var current int64
+	var usage *images.StorageUsage
+	switch action.kind {
+	case createImage:
+		if limits.MaxImages == 0 {
+			return nil
+		}
+
+		if current, err = store.CountImages(username); err != nil {
+			return err
+		}
+
+		return exceeds(MaxImages, uint64(limits.MaxImages), uint64(current), uint64(current)+1)
+	case createVersion:
+		if limits.MaxVersions == 0 {
+			return nil
+		}
+
+		if current, err = store.CountVersions(action.image); err != nil {
+			return err
+		}
+
+		return exceeds(MaxVersions, uint64(limits.MaxVersions), uint64(current), uint64(current)+1)
+	case storeBytes:
+		if limits.StorageBytes == 0 {
+			return nil
+		}
+
+		if usage, err = store.GetStorageUsage(username); err != nil {
+			return err
+		}
+
+		used := usage.Used + action.bytes
+		if action.replaces > used {
+			used = 0
+		} else {
+			used -= action.replaces
+		}
+
+		return exceeds(StorageBytes, limits.StorageBytes, usage.Used, used)
+	case queueBoot:
+		if limits.MaxQueuedBoots == 0 {
+			return nil
+		}
+
+		if current, err = store.CountQueuedBoots(username); err != nil {
+			return err
+		}
+
+		return exceeds(MaxQueuedBoots, uint64(limits.MaxQueuedBoots), uint64(current), uint64(current)+action.count)
+	case activeBoots:
+		limit := limits.MaxActiveBoots
+		if limit == 0 {
+			limit = action.fallback
+		}
+
+		if limit == 0 {
+			return nil
+		}
+
+		if current, err = store.CountActiveBoots(username); err != nil {
+			return err
+		}
+
+		return exceeds(MaxActiveBoots, uint64(limit), uint64(current), uint64(current)+action.count)
+	case createWebhook:
+		limit := limits.MaxWebhooks
+		if limit == 0 {
+			limit = action.fallback
+		}
+
+		if limit == 0 {
+			return nil
+		}
+
+		if current, err = store.CountWebhooks(username); err != nil {
+			return err
+		}
+
+		return exceeds(MaxWebhooks, uint64(limit), uint64(current), uint64(current)+1)
+	}
+
+	return nil
+}
+
+// exceeds checks the amount the user would have after the action against the limit
+func exceeds(limit string, max uint64, current uint64, after uint64) error {
+	if after <= max {
+		return nil
+	}
+
+	return &ExceededError{Limit: limit, Max: max, Current: current, Requested: after}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics keeps counters and gauges of the control server and writes them in the Prometheus text format,
+// so the server can be scraped without pulling in a metrics library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics which are written together
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Default is the registry the metrics of the control server are registered in
+var Default = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic("metric " + m.name() + " is registered twice")
+		}
+	}
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics of the registry in the Prometheus text format, ordered by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// vector holds the values of a metric for every combination of label values
+type vector struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVector(name string, help string, kind string, labels []string) *vector {
+	return &vector{metricName: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+func (v *vector) name() string {
+	return v.metricName
+}
+
+// key joins the label values, the separator cannot appear in a valid label value of the text format
+func (v *vector) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.metricName, len(v.labels), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\x00")
+}
+
+func (v *vector) add(delta float64, labelValues []string) {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *vector) set(value float64, labelValues []string) {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+func (v *vector) get(labelValues []string) float64 {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[key]
+}
+
+func (v *vector) write(w io.Writer) error {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, v.metricName+v.labelString(key)+" "+formatValue(v.values[key]))
+	}
+	v.mu.Unlock()
+
+	// Metrics without labels are always written, so they show up before anything happened
+	if len(v.labels) == 0 && len(lines) == 0 {
+		lines = append(lines, v.metricName+" 0")
+	}
+
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, v.kind)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *vector) labelString(key string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\x00")
+	pairs := make([]string, len(v.labels))
+	for i, label := range v.labels {
+		pairs[i] = label + "=" + strconv.Quote(values[i])
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a metric which only goes up, such as the number of requests
+type Counter struct {
+	*vector
+}
+
+// NewCounter registers a counter in the default registry, the label values are given in the order of labels
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newVector(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add adds a positive amount to the counter
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counter " + c.metricName + " cannot go down")
+	}
+
+	c.add(delta, labelValues)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.get(labelValues)
+}
+
+// Gauge is a metric which goes up and down, such as the number of running downloads
+type Gauge struct {
+	*vector
+}
+
+// NewGauge registers a gauge in the default registry, the label values are given in the order of labels
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newVector(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+// Set replaces the value of the gauge
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.set(value, labelValues)
+}
+
+// Add changes the gauge by delta, which may be negative
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.get(labelValues)
+}
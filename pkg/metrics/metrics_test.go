@@ -0,0 +1,34 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	requests := NewCounter("test_requests_total", "Requests.", "method", "status")
+	active := NewGauge("test_active", "Active.")
+
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(0.5, "POST", "500")
+	active.Add(2)
+	active.Add(-1)
+
+	assert.Equal(t, float64(2), requests.Value("GET", "200"))
+	assert.Panics(t, func() { requests.Inc("GET") })
+	assert.Panics(t, func() { requests.Add(-1, "GET", "200") })
+	assert.Panics(t, func() { NewGauge("test_active", "Again.") })
+
+	var buf bytes.Buffer
+	assert.NoError(t, Default.Write(&buf))
+	assert.Contains(t, buf.String(), "# TYPE test_active gauge\ntest_active 1\n")
+	assert.Contains(t, buf.String(), `test_requests_total{method="GET",status="200"} 2`+"\n")
+	assert.Contains(t, buf.String(), `test_requests_total{method="POST",status="500"} 0.5`+"\n")
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package agent declares the releases of the management OS agent and how new releases are rolled out to machines
+package agent
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// Release is a signed build of the agent for a single architecture. The signature is the Ed25519 signature of
+// the SHA-256 digest of the binary, the agent verifies it with the public key baked into the initramfs.
+type Release struct {
+	ID uint `gorm:"primaryKey" json:"-"`
+	// Architecture uses the names of GOARCH, such as amd64 and arm64
+	Architecture string `gorm:"not null;uniqueIndex:idx_agent_release"`
+	Version      string `gorm:"not null;uniqueIndex:idx_agent_release"`
+	Size         uint64 `gorm:"not null"`
+	// SHA256 and Signature are hex and base64 encoded respectively
+	SHA256    string `gorm:"not null"`
+	Signature string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// Channel decides which release the machines of an architecture run. A new release is first tried on the canary
+// machines, those listed explicitly and a percentage of the others, before it becomes the default.
+type Channel struct {
+	Architecture string `gorm:"primaryKey"`
+	// Default is the version every machine which is not a canary runs, older versions can be set for a downgrade
+	Default string `gorm:"not null;default:''"`
+	// Canary is the version being rolled out, it is not used when empty
+	Canary         string            `gorm:"not null;default:''"`
+	CanaryPercent  uint              `gorm:"not null;default:0"`
+	CanaryMachines images.StringList `gorm:"type:text"`
+}
+
+// IsCanary checks whether the machine gets the canary release. Machines keep their place in or out of the
+// percentage between boots, as it is derived from their MAC address.
+func (c *Channel) IsCanary(mac string) bool {
+	if c.Canary == "" {
+		return false
+	}
+
+	mac = strings.ToLower(mac)
+	for _, machine := range c.CanaryMachines {
+		if strings.ToLower(machine) == mac {
+			return true
+		}
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(mac))
+	return h.Sum32()%100 < uint32(c.CanaryPercent)
+}
+
+// VersionFor returns the version the machine should run, which is empty when nothing has been released
+func (c *Channel) VersionFor(mac string) string {
+	if c.IsCanary(mac) {
+		return c.Canary
+	}
+
+	return c.Default
+}
+
+// Update tells the agent which release it should run and where it downloads it
+type Update struct {
+	Version      string
+	Architecture string
+	// URL is relative to the control server
+	URL       string
+	Size      uint64
+	SHA256    string
+	Signature string
+	Canary    bool
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bootstrap declares what the bootstrap of a fresh deployment remembers having done
+package bootstrap
+
+import (
+	"fmt"
+	"time"
+)
+
+// Record remembers that the bootstrap created something. What has a record is never touched by the bootstrap
+// again, so changes made to it by hand afterwards stay.
+type Record struct {
+	// Key is AdminKey or ImageKey of what was created
+	Key string `gorm:"primaryKey"`
+	// Ref is the username of the admin or the UUID of the image
+	Ref       string
+	CreatedAt time.Time
+}
+
+// AdminKey is the key of the record of the admin account with the username
+func AdminKey(username string) string {
+	return fmt.Sprintf("admin:%s", username)
+}
+
+// ImageKey is the key of the record of the image seeded from the file with the name
+func ImageKey(file string) string {
+	return fmt.Sprintf("image:%s", file)
+}
+
+// TableName keeps the records apart from those of the idempotency keys
+func (Record) TableName() string {
+	return "bootstrap_records"
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package course defines the courses which grant their members access to machines until they expire
+package course
+
+import "time"
+
+// CourseModel is a course or project, its members may boot its machines until it expires
+// nolint: golint
+type CourseModel struct {
+	Name string `gorm:"primaryKey"`
+
+	// Owner is the user who is told when the course is about to expire, usually the teacher
+	Owner string `gorm:"not null;index"`
+
+	ExpiresAt time.Time `gorm:"not null"`
+
+	// TrashImages moves the images labelled with the course to the trash when it expires
+	TrashImages bool `gorm:"not null;default:false"`
+
+	// WarnedAt is when the owner was told about the expiry, ExpiredAt when the course expired. Both are cleared when
+	// the expiry is extended.
+	WarnedAt  *time.Time `json:",omitempty"`
+	ExpiredAt *time.Time `json:",omitempty"`
+
+	Members  []CourseMember  `gorm:"foreignKey:CourseName;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	Machines []CourseMachine `gorm:"foreignKey:CourseName;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+
+	// Moderators are the moderators scoped to the course, they are managed through the moderators themselves
+	Moderators []ModeratorScope `gorm:"foreignKey:CourseName;constraint:OnDelete:CASCADE,OnUpdate:CASCADE" json:"-"`
+
+	CreatedAt time.Time
+}
+
+// Expired reports whether the course has expired at a moment in time
+func (c *CourseModel) Expired(at time.Time) bool {
+	return !at.Before(c.ExpiresAt)
+}
+
+// CourseMember is a user who takes part in a course
+type CourseMember struct {
+	CourseName string `gorm:"primaryKey"`
+	Username   string `gorm:"primaryKey"`
+}
+
+// CourseMachine is a machine the members of a course may boot
+type CourseMachine struct {
+	CourseName string `gorm:"primaryKey"`
+	MachineMAC string `gorm:"primaryKey"`
+}
+
+// ModeratorScope limits the powers of a moderator to the members of a course. A moderator can be scoped to several
+// courses, moderators without any scope moderate everyone.
+type ModeratorScope struct {
+	Moderator  string `gorm:"primaryKey"`
+	CourseName string `gorm:"primaryKey"`
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package idempotency declares the responses which are replayed to clients retrying a request
+package idempotency
+
+import "time"
+
+// Record remembers the first response to a request made with an idempotency key. A retry with the same key gets
+// the same response rather than repeating what the request did. Keys belong to the user who made the request, two
+// users can use the same key without seeing each other's responses.
+type Record struct {
+	ID        uint   `gorm:"primaryKey"`
+	Principal string `gorm:"not null;uniqueIndex:idx_idempotency_key"`
+	Key       string `gorm:"not null;uniqueIndex:idx_idempotency_key"`
+	// Method and Path are those of the first request, a key is not reused for another endpoint
+	Method string `gorm:"not null"`
+	Path   string `gorm:"not null"`
+	// BodyHash is the hex encoded SHA-256 of the body of the first request
+	BodyHash string
+	// Status is zero while the first request is still being handled
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+// Completed tells whether the response to the first request was stored
+func (r *Record) Completed() bool {
+	return r.Status != 0
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import "time"
+
+// BackupSchedule is when the new versions of an image are copied to its backup target
+type BackupSchedule string
+
+const (
+	// BackupOnNewVersion copies every version as soon as it is stored
+	BackupOnNewVersion BackupSchedule = "on_new_version"
+	// BackupNightly copies the versions of the day at the configured hour of the night
+	BackupNightly BackupSchedule = "nightly"
+)
+
+// Valid reports whether the schedule is one the backups know
+func (s BackupSchedule) Valid() bool {
+	return s == BackupOnNewVersion || s == BackupNightly
+}
+
+// BackupPolicy has the versions of an image copied to one of the configured backup targets
+type BackupPolicy struct {
+	ImageUUID ImageUUID  `gorm:"primaryKey"`
+	Image     ImageModel `gorm:"foreignKey:ImageUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	// Target is the name of the target in BackupTargets
+	Target   string         `gorm:"not null"`
+	Schedule BackupSchedule `gorm:"not null"`
+	// DeleteRemote removes the copy of a version from the target when the version is deleted, otherwise the copy
+	// outlives it
+	DeleteRemote bool `gorm:"not null;default:false"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// BackupState is how far the copy of a version to the backup target got
+type BackupState string
+
+const (
+	// BackupPending versions are waiting for their schedule, or for their next attempt after a failure
+	BackupPending BackupState = "pending"
+	// BackupDone versions were copied, and the copy matched the stored file
+	BackupDone BackupState = "backed_up"
+	// BackupFailed versions could not be copied in all attempts, they are not tried again until the policy changes
+	BackupFailed BackupState = "failed"
+)
+
+// VersionBackup is the copy of a version on the backup target of its image
+type VersionBackup struct {
+	ImageUUID ImageUUID  `gorm:"primaryKey"`
+	Image     ImageModel `gorm:"foreignKey:ImageUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	Version   uint64     `gorm:"primaryKey;autoIncrement:false"`
+	// Target is where the version was copied to, a version is copied again when its image gets another target
+	Target string      `gorm:"not null"`
+	State  BackupState `gorm:"not null"`
+	// SHA256 is the checksum of the copy, the version is copied again once its file changes
+	SHA256 string `gorm:"not null;default:''"`
+	// Attempts counts the failed copies since the last one which succeeded, NextAttemptAt is when the copy is tried
+	// again after the last of them
+	Attempts      uint `gorm:"not null;default:0"`
+	LastError     string
+	NextAttemptAt time.Time
+	BackedUpAt    *time.Time
+	UpdatedAt     time.Time
+}
@@ -12,14 +12,17 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"time"
 
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/storage"
 	"github.com/codingsince1985/checksum"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-// FilePathFmt is the format string to create the path the image should be written to
-const FilePathFmt = "/%s/%d.img"
+// VersionFileFmt is the name of the file of a version in the directory of its image
+const VersionFileFmt = "%d.img"
 
 // imageFileSize is the size of the standard image that is created in MiB.
 const imageFileSize = 512 // size in MiB
@@ -99,38 +102,121 @@ type Version struct {
 	gorm.Model     `json:"-"`
 	Version        uint64    `gorm:"not null;default:0"`
 	ImageModelUUID ImageUUID `gorm:"not null;"`
+
+	// Size is the logical (uncompressed) size of this version in bytes, zero if it is not known.
+	Size uint64 `gorm:"not null;default:0"`
+
+	// SHA256 is the hex encoded checksum of the stored file of this version, empty if it is not known.
+	SHA256 string `gorm:"not null;default:''"`
+
+	// Corrupt versions no longer match their checksum when the scrubber read them back. They are not booted, and
+	// not picked as the latest version.
+	Corrupt bool `gorm:"not null;default:false"`
+
+	// Format is the format of the file as it was uploaded, empty for the versions which were stored before the
+	// formats were detected
+	Format FileFormat `gorm:"not null;default:''"`
+
+	// BootKeyID is the key of the boot whose encrypted disk was uploaded as this version, zero for versions which
+	// are not encrypted. The key goes with its boot, once that is gone the version cannot be decrypted.
+	BootKeyID uint `gorm:"not null;default:0" json:",omitempty"`
 }
 
 /* Disk Layout on control_server
 /disks
-	/abc  <-- First image UUID
-		/1.img
-		/2.img
-		/3.img
-		/4.img
-	/cdf  <-- Second image UUID
+	/3f  <-- Shard, the first byte of the SHA-256 of the image UUID
+		/abc  <-- First image UUID
+			/1.img
+			/2.img
+			/3.img
+			/4.img
+	/a9
+		/cdf  <-- Second image UUID
+			/1.img
+			/2.img
+	/def  <-- Image stored before the shards, until the rebalance moves it
 		/1.img
-		/2.img
+
+Every storage tier has this layout, an image is stored on one of them.
 */
 
+// DiskPathTier is the storage tier of the disk path the control server is started with
+const DiskPathTier = "default"
+
+// LicenseKind is the kind of license of the contents of an image, it is empty until the owner fills it in
+type LicenseKind string
+
+const (
+	// LicenseOpenSource images only contain software under open source licenses
+	LicenseOpenSource LicenseKind = "open-source"
+	// LicenseFreeware images may be shared freely, but contain software which is not open source
+	LicenseFreeware LicenseKind = "freeware"
+	// LicenseProprietary images contain software which may not be shared, such as Windows
+	LicenseProprietary LicenseKind = "proprietary"
+	// LicenseOther images have a license which does not fit the other kinds, LicenseName tells which
+	LicenseOther LicenseKind = "other"
+)
+
+// LicenseKinds are the known kinds of licenses
+var LicenseKinds = []LicenseKind{LicenseOpenSource, LicenseFreeware, LicenseProprietary, LicenseOther}
+
+// Valid checks whether the kind is one of the known kinds of licenses, or left empty
+func (k LicenseKind) Valid() bool {
+	switch k {
+	case "", LicenseOpenSource, LicenseFreeware, LicenseProprietary, LicenseOther:
+		return true
+	}
+
+	return false
+}
+
+// FileFormat is the format of the file of a version, as detected from its first bytes when it was uploaded
+type FileFormat string
+
+const (
+	// FormatRaw files are disks with an MBR or a GPT, or a bare FAT or ext file system
+	FormatRaw FileFormat = "raw"
+	// FormatQCow2 files are disk images of qemu
+	FormatQCow2 FileFormat = "qcow2"
+	// FormatISO files are ISO 9660 images of CDs and DVDs, including hybrid ones which can be written to disks
+	FormatISO FileFormat = "iso"
+	// FormatVMDK files are disk images of VMware
+	FormatVMDK FileFormat = "vmdk"
+	// FormatUnknown files are none of the above, such as archives or disks which were wiped
+	FormatUnknown FileFormat = "unknown"
+)
+
+// Valid checks whether the format is one of the formats which are detected
+func (f FileFormat) Valid() bool {
+	switch f {
+	case FormatRaw, FormatQCow2, FormatISO, FormatVMDK, FormatUnknown:
+		return true
+	}
+
+	return false
+}
+
 // ImageModel defines the database structure for storing the metadata about images
 type ImageModel struct {
 	// You will see quite a few of these around. They suppress the default values that the ORM creates when it gets
 	// cast into JSON.
 
 	// Human identifiable name of this image
-	Name string `gorm:"not null"`
+	Name string `gorm:"not null" description:"The name of the image"`
 
 	// Versions are all possible versions of this image, represented as unix
 	// timestamps of their creation. A new version is created whenever a reprovisioning
 	// takes place, and this image is replaced.
-	Versions []Version `gorm:"foreignKey:ImageModelUUID;not null;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	Versions []Version `gorm:"foreignKey:ImageModelUUID;not null;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" schema:"readonly"`
+
+	// VersionCount is the number of versions, it is only filled in by listings which leave the versions out
+	VersionCount int64 `gorm:"-" json:",omitempty" schema:"readonly"`
 
 	// ImageUUID is a universally unique identifier for images
-	UUID ImageUUID `gorm:"uniqueIndex;primaryKey;unique"`
+	UUID ImageUUID `gorm:"uniqueIndex;primaryKey;unique" description:"The identifier the control server gives the image, updates name the image with it"`
 
 	// Foreign key for gorm
-	Username string `gorm:"foreignKey:Username;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
+	Username string `gorm:"foreignKey:Username;constraint:OnDelete:CASCADE,OnUpdate:CASCADE" description:"The owner of the image"`
 
 	// Compression algorithm used for this image
 	DiskCompressionStrategy DiskCompressionStrategy `gorm:"not null;"`
@@ -139,15 +225,94 @@ type ImageModel struct {
 	ImageFileType DiskType `gorm:"not null;"`
 
 	// The image type
-	Type string `gorm:"not null;"`
+	Type string `gorm:"not null;" description:"The kind of the image, such as system or machine"`
 
 	// Checksum for this image as alternative for versioning
 	Checksum string
 
-	// ImagePath is where the system has stored this image
+	// DiskUUID is the disk the image is built for, the UUID of its partition table as blkid prints it. Boots of
+	// the image are refused on machines without a matching disk, any disk is fine when it is empty. The first
+	// upload of a raw disk sets it to the partition table of the upload.
+	DiskUUID string `gorm:"not null;default:''" description:"The UUID of the partition table of the disk the image is built for, any disk fits when it is empty"`
+	// UploadedDiskUUID is the UUID of the partition table of the latest upload, listings warn when it is not the
+	// DiskUUID. It is empty when the upload has no partition table.
+	UploadedDiskUUID string `gorm:"not null;default:''" json:"-"`
+
+	// ImagePath is where the system has stored this image, the directory of its Tier
 	ImagePath string `json:"-" gorm:"not null"`
+	// Tier is the storage tier holding the files of the image. Placement is the tier an admin put the image on,
+	// it follows the default tier of the configuration when it is empty.
+	Tier      string `gorm:"not null;default:'default'" schema:"readonly" description:"The storage tier the files of the image are on"`
+	Placement string `gorm:"not null;default:''" json:",omitempty"`
 
 	Filesystem FilesystemType
+
+	// Architecture is what the image is built for. Images from before it was recorded are unknown, which boots
+	// anywhere with a warning.
+	Architecture machine.SystemArchitecture `gorm:"not null;default:'unknown'" description:"The architecture the image is built for, in any case"`
+
+	// Description tells what the image is for in markdown, SourceURL is where the image or its sources come from
+	Description string `gorm:"not null;default:''" description:"What the image is for, in markdown"`
+	SourceURL   string `gorm:"not null;default:''" description:"The http or https URL the image or its sources come from"`
+
+	// BaseOS, License and SourceNotes tell what is in the image and where it came from. LicenseName is the exact
+	// license, License the kind of it which decides whether the image may be made public.
+	BaseOS      string      `gorm:"not null;default:''" description:"The operating system the image is based on"`
+	License     LicenseKind `gorm:"not null;default:'';index" description:"The kind of license of the contents, only open source and freeware images may be public"`
+	LicenseName string      `gorm:"not null;default:''" description:"The exact license of the contents"`
+	SourceNotes string      `gorm:"not null;default:''"`
+
+	// Icon is the URI of the icon of the image, empty when the image has none. It is set by uploading an icon.
+	Icon string `gorm:"not null;default:''" schema:"readonly" description:"The URI of the icon of the image, it is set by uploading one"`
+
+	// Public images are listed for everyone, including anonymous visitors when the server allows those
+	Public bool `gorm:"not null;default:false" description:"Public images are listed for everyone"`
+
+	// Course labels the image as made for a course, it is moved to the trash when the course expires if the course
+	// asks for that
+	Course string `gorm:"not null;default:''" json:",omitempty" description:"The course the image is made for"`
+
+	// CreatedAt and UpdatedAt are kept by gorm, uploading a version updates the image as well. Responses carry them
+	// through types.Image, requests cannot set them.
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+
+	// DeletedAt is set when the image is moved to the trash, it is purged for good after the retention period
+	DeletedAt gorm.DeletedAt `gorm:"index" json:",omitempty" schema:"readonly"`
+}
+
+// StorageUsage is the number of bytes the versions of a user's images take up
+type StorageUsage struct {
+	Used uint64
+	// Trashed is the part of Used taken up by images in the trash
+	Trashed uint64
+}
+
+// LatestVersion returns the newest version of the image which is not corrupt, or nil when it has none
+func (image *ImageModel) LatestVersion() *Version {
+	var latest *Version
+	for i := range image.Versions {
+		if image.Versions[i].Corrupt {
+			continue
+		}
+
+		if latest == nil || image.Versions[i].Version > latest.Version {
+			latest = &image.Versions[i]
+		}
+	}
+
+	return latest
+}
+
+// FindVersion returns the version of the image with the given number, or nil when it does not exist
+func (image *ImageModel) FindVersion(number uint64) *Version {
+	for i := range image.Versions {
+		if image.Versions[i].Version == number {
+			return &image.Versions[i]
+		}
+	}
+
+	return nil
 }
 
 const (
@@ -157,9 +322,20 @@ const (
 	SizeGigabyte = 1024 * 1024 * 1024
 )
 
+// Dir is the directory holding the files of the image, in the shard of the image unless it is still stored in the
+// flat layout from before the shards
+func (image *ImageModel) Dir() string {
+	return storage.Dir(image.ImagePath, string(image.UUID))
+}
+
+// VersionFile is where the file of a version of the image is stored
+func (image *ImageModel) VersionFile(version uint64) string {
+	return image.Dir() + "/" + fmt.Sprintf(VersionFileFmt, version)
+}
+
 // CreateImageFile creates the actual image on disk with a given size.
 func (image *ImageModel) CreateImageFile(imageSize uint, baseSize uint) error {
-	f, err := os.OpenFile(fmt.Sprintf(image.ImagePath+FilePathFmt, image.UUID, 0),
+	f, err := os.OpenFile(image.VersionFile(0),
 		os.O_WRONLY|os.O_CREATE, 0644)
 
 	if err != nil {
@@ -189,9 +365,9 @@ func (image *ImageModel) CreateImageFile(imageSize uint, baseSize uint) error {
 
 // OpenImageFile opens an image file so it can be read by the system
 func (image *ImageModel) OpenImageFile(version uint64) (*os.File, error) {
-	fmt.Println(fmt.Sprintf(image.ImagePath+FilePathFmt, image.UUID, version))
+	fmt.Println(image.VersionFile(version))
 	fmt.Println(os.Getenv("PWD"))
-	f, err := os.Open(fmt.Sprintf(image.ImagePath+FilePathFmt, image.UUID, version))
+	f, err := os.Open(image.VersionFile(version))
 	if err != nil {
 		return nil, err
 	}
@@ -232,7 +408,7 @@ func (image *ImageModel) FormatImage() {
 		version = 0
 	}
 
-	path := fmt.Sprintf("%s/%s/%d.img", image.ImagePath, image.UUID, version)
+	path := image.VersionFile(version)
 	var cmd *exec.Cmd
 	switch image.Filesystem {
 	case FileSystemTypeEXT4:
@@ -255,10 +431,14 @@ func (image *ImageModel) UpdateImage(r *io.Reader) {
 
 }
 
-// AfterDelete removes the image directory
+// AfterDelete removes the image directory, unless the image was only moved to the trash
 func (image *ImageModel) AfterDelete(tx *gorm.DB) (ret error) {
+	if !tx.Statement.Unscoped || image.UUID == "" {
+		return
+	}
+
 	// Remove the directory which includes all the image files
-	err := os.RemoveAll(image.ImagePath)
+	err := os.RemoveAll(image.Dir())
 	if err != nil {
 		log.Errorf("failed to delete image: %v", err)
 		return
@@ -267,12 +447,15 @@ func (image *ImageModel) AfterDelete(tx *gorm.DB) (ret error) {
 	return
 }
 
-// BeforeCreate adds the image path and creates the first version of the image.
+// BeforeCreate adds the image path, unless the image was placed on a storage tier, and creates the first version of
+// the image.
 func (image *ImageModel) BeforeCreate(tx *gorm.DB) (ret error) {
-	path := os.Getenv("BAAS_DISK_PATH")
-	image.ImagePath = path
+	if image.ImagePath == "" {
+		image.ImagePath = os.Getenv("BAAS_DISK_PATH")
+		image.Tier = DiskPathTier
+	}
 	// Create the actual image together with the first empty version which a user may or may not use.
-	err := os.Mkdir(image.ImagePath+"/"+string(image.UUID), os.ModePerm)
+	err := os.MkdirAll(storage.ShardDir(image.ImagePath, string(image.UUID)), os.ModePerm)
 
 	if err != nil {
 		log.Errorf("cannot create image directory: %s", err)
@@ -0,0 +1,275 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/secrets"
+)
+
+// VersionSelector chooses which version of the images in a boot setup is flashed. It is either empty, which
+// uses the versions stored in the image setup, "latest", which is resolved to the newest version when the
+// management OS claims the boot, or a version number which pins that version for every image.
+type VersionSelector string
+
+// VersionLatest resolves to the newest version of each image when the boot is claimed
+const VersionLatest VersionSelector = "latest"
+
+// Pinned returns the version number this selector pins, if it pins one
+func (v VersionSelector) Pinned() (uint64, bool) {
+	if v == "" || v == VersionLatest {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(string(v), 10, 64)
+	return n, err == nil
+}
+
+// MarshalJSON writes pinned versions as numbers and the others as strings
+func (v VersionSelector) MarshalJSON() ([]byte, error) {
+	if n, ok := v.Pinned(); ok {
+		return json.Marshal(n)
+	}
+
+	return json.Marshal(string(v))
+}
+
+// UnmarshalJSON accepts either a version number or the literal "latest"
+func (v *VersionSelector) UnmarshalJSON(b []byte) error {
+	if isNull(b) {
+		*v = ""
+		return nil
+	}
+
+	var n uint64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*v = VersionSelector(strconv.FormatUint(n, 10))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	if s != "" && s != string(VersionLatest) {
+		if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+			return errors.New(`version must be a number or "latest"`)
+		}
+	}
+
+	*v = VersionSelector(s)
+	return nil
+}
+
+// ResolvedVersion is the version of an image which was chosen for a boot
+type ResolvedVersion struct {
+	ImageUUID ImageUUID
+	Version   uint64
+}
+
+// ResolvedVersions is a list of resolved versions which is stored as JSON in a single column
+type ResolvedVersions []ResolvedVersion
+
+// Value serialises the list for the database
+func (r ResolvedVersions) Value() (driver.Value, error) {
+	if r == nil {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(r)
+	return string(b), err
+}
+
+// Scan deserialises the list from the database
+func (r *ResolvedVersions) Scan(value interface{}) error {
+	return scanJSON(value, r)
+}
+
+// Includes checks whether a version of an image is in the list, any version matches when version is nil
+func (r ResolvedVersions) Includes(uuid ImageUUID, version *uint64) bool {
+	for _, resolved := range r {
+		if resolved.ImageUUID == uuid && (version == nil || resolved.Version == *version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BootState tracks a claimed boot setup from the moment the management OS claims it until it is finished.
+type BootState string
+
+const (
+	// BootInProgress boots are being flashed, the versions they flash are locked against modification
+	BootInProgress BootState = "in_progress"
+	// BootCompleted boots were flashed successfully
+	BootCompleted BootState = "completed"
+	// BootFailed boots were aborted by the management OS, or superseded by a new boot of the same machine
+	BootFailed BootState = "failed"
+	// BootCancelled boots were cancelled by a user
+	BootCancelled BootState = "cancelled"
+	// BootExpired boots were given up on by the watchdog after the machine stopped responding. The janitor marks
+	// such boots failed instead, the state remains for the boots which expired before.
+	BootExpired BootState = "expired"
+)
+
+// FailureReason tells why a boot did not complete, so the failures can be counted by their cause. The details are
+// left to the free text which comes with it.
+type FailureReason string
+
+const (
+	// FailureDownload boots could not download an image, from the control server or from a peer
+	FailureDownload FailureReason = "download_failed"
+	// FailureChecksum boots downloaded an image whose checksum does not match the one of its version
+	FailureChecksum FailureReason = "checksum_mismatch"
+	// FailureDiskTooSmall boots had a disk or partition which is smaller than the image
+	FailureDiskTooSmall FailureReason = "disk_too_small"
+	// FailureWrite boots could not write an image to the disk, or did not write every member of an image set
+	FailureWrite FailureReason = "write_error"
+	// FailureCancelled boots were stopped because someone cancelled them
+	FailureCancelled FailureReason = "cancelled"
+	// FailureAgentLost boots were given up on after the management OS stopped responding or started another boot
+	FailureAgentLost FailureReason = "agent_lost"
+	// FailureUnknown boots failed without a reason, such as those reported by management OSes which do not send
+	// one and those which failed before the reasons were recorded
+	FailureUnknown FailureReason = "unknown"
+)
+
+// FailureReasons are all the reasons a boot can fail for
+var FailureReasons = []FailureReason{FailureDownload, FailureChecksum, FailureDiskTooSmall, FailureWrite,
+	FailureCancelled, FailureAgentLost, FailureUnknown}
+
+// Valid reports whether the reason is one of FailureReasons
+func (r FailureReason) Valid() bool {
+	for _, reason := range FailureReasons {
+		if r == reason {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BootHistory records which versions of the images were flashed onto a machine whenever it claims a boot setup
+type BootHistory struct {
+	ID         uint                 `gorm:"primaryKey"`
+	MachineMAC string               `gorm:"not null;index"`
+	Machine    machine.MachineModel `gorm:"foreignKey:MachineMAC;references:Address;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	SetupUUID  ImageUUID            `gorm:"not null"`
+
+	RequestedVersion VersionSelector  `gorm:"not null;default:''"`
+	ResolvedVersions ResolvedVersions `gorm:"type:text"`
+	// TargetDevice is the disk the images are written to, as reported by the management OS when it is done
+	TargetDevice string `gorm:"not null;default:''"`
+	// BootMode is copied from the boot setup, a completed discard boot leaves the machine dirty
+	BootMode BootMode `gorm:"not null;default:'persistent'"`
+	// CAFingerprint lists the fingerprints of the CA certificates the management OS pinned to verify the control
+	// server, it is empty when the management OS did not use TLS
+	CAFingerprint string `gorm:"not null;default:''" json:",omitempty"`
+	// VersionStamp is what the management OS and the control server ran when the boot was claimed
+	machine.VersionStamp
+	// VerifyMode is copied from the boot setup, Verification is what reading back the images found once the
+	// management OS reported it
+	VerifyMode   VerifyMode         `gorm:"not null;default:''" json:",omitempty"`
+	Verification FlashVerifications `gorm:"type:text" json:",omitempty"`
+	// Template, TemplateRevision and TemplateOptions are copied from the boot setup, they tell how to queue the
+	// same boot again after the template changed
+	Template         string           `gorm:"not null;default:''" json:",omitempty"`
+	TemplateRevision uint             `gorm:"not null;default:0" json:",omitempty"`
+	TemplateOptions  *TemplateOptions `gorm:"type:text" json:",omitempty"`
+
+	// State is in_progress while the management OS is flashing, LastSeen is the last time it checked in.
+	State      BootState `gorm:"not null;default:'completed';index"`
+	LastSeen   time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+
+	// CancelRequestedAt is set when someone asks to cancel the boot while it is flashing, the management OS stops
+	// at its next heartbeat. CancelledBy is who asked, the boot only becomes cancelled once it stopped.
+	CancelRequestedAt *time.Time `json:",omitempty"`
+	CancelledBy       string     `gorm:"not null;default:''" json:",omitempty"`
+	// FailureReason tells why a boot which did not complete failed, FailureDetail is the error as it was reported
+	FailureReason FailureReason `gorm:"not null;default:'';index" json:",omitempty"`
+	FailureDetail string        `gorm:"not null;default:''" json:",omitempty"`
+
+	CreatedAt time.Time
+}
+
+// BootArtifact is a small file the management OS attached to a boot, such as a screenshot of the console or the
+// tail of the serial log of a boot which failed. The content is stored on disk, the row goes with its boot.
+type BootArtifact struct {
+	ID            uint        `gorm:"primaryKey"`
+	BootHistoryID uint        `gorm:"not null;index"`
+	BootHistory   BootHistory `gorm:"constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	// MachineMAC is copied from the boot, the files of the artifacts are stored per machine
+	MachineMAC  string `gorm:"not null;index"`
+	Name        string `gorm:"not null"`
+	ContentType string `gorm:"not null;default:'application/octet-stream'"`
+	Size        int64  `gorm:"not null"`
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// BootKey is the passphrase of the LUKS containers an encrypted boot writes its images into. It is sealed in the
+// database and goes with its boot.
+type BootKey struct {
+	ID            uint        `gorm:"primaryKey"`
+	BootHistoryID uint        `gorm:"not null;uniqueIndex"`
+	BootHistory   BootHistory `gorm:"constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	Passphrase    secrets.Secret
+
+	// KeepEncrypted boots upload their containers as they are, the passphrase is never handed out again for them.
+	// The others fetch it once more to decrypt the disk for the upload, ReleasedAt is when they did.
+	KeepEncrypted bool `gorm:"not null;default:false"`
+	ReleasedAt    *time.Time
+
+	CreatedAt time.Time
+}
+
+// BootControl answers the heartbeats of the management OS, it tells whether the boot it is flashing was cancelled
+type BootControl struct {
+	BootID          uint `json:"boot_id"`
+	CancelRequested bool `json:"cancel_requested"`
+}
+
+// BootReport is what the management OS reports when it is done with a boot
+type BootReport struct {
+	State BootState
+	// TargetDevice is the disk the images were written to, image sets list their disks separated by commas
+	TargetDevice string `json:",omitempty"`
+	// Flashed are the versions which were written and verified, image sets only complete when all their members are
+	Flashed ResolvedVersions `json:",omitempty"`
+	// Verification has an entry for every image which was read back after it was written
+	Verification FlashVerifications `json:",omitempty"`
+	// FailureReason is why a boot failed, reports which only give the FailureDetail fail for an unknown reason
+	FailureReason FailureReason `json:",omitempty"`
+	FailureDetail string        `json:",omitempty"`
+}
+
+// Finish moves the boot out of the in progress state, which releases its locks
+func (h *BootHistory) Finish(state BootState) {
+	now := time.Now()
+	h.State = state
+	h.FinishedAt = &now
+}
+
+// Fail finishes the boot as failed, with the reason it is counted under and the detail which explains it
+func (h *BootHistory) Fail(reason FailureReason, detail string) {
+	h.Finish(BootFailed)
+	h.FailureReason = reason
+	h.FailureDetail = detail
+}
+
+// isNull checks whether a JSON value is null
+func isNull(b []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(b), []byte("null"))
+}
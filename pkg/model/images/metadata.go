@@ -0,0 +1,118 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+
+	model "github.com/baas-project/baas/pkg/model/machine"
+	"gorm.io/gorm"
+)
+
+// StringList is a list of strings which is stored as JSON in a single column
+type StringList []string
+
+// Value serialises the list for the database
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+// Scan deserialises the list from the database
+func (l *StringList) Scan(value interface{}) error {
+	return scanJSON(value, l)
+}
+
+// MetadataValues are arbitrary key/value pairs which are stored as JSON in a single column
+type MetadataValues map[string]string
+
+// Value serialises the values for the database
+func (m MetadataValues) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+// Scan deserialises the values from the database
+func (m *MetadataValues) Scan(value interface{}) error {
+	return scanJSON(value, m)
+}
+
+func scanJSON(value interface{}, target interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), target)
+	case []byte:
+		return json.Unmarshal(v, target)
+	default:
+		return errors.New("unsupported type for a JSON column")
+	}
+}
+
+// Metadata is handed to an image on its first boot after being flashed, in the same way cloud-init expects it.
+type Metadata struct {
+	Hostname          string
+	SSHAuthorizedKeys StringList     `gorm:"type:text"`
+	Values            MetadataValues `gorm:"type:text"`
+}
+
+// Empty checks whether any metadata has been set
+func (m *Metadata) Empty() bool {
+	return m.Hostname == "" && len(m.SSHAuthorizedKeys) == 0 && len(m.Values) == 0
+}
+
+// Merge returns the metadata with the fields set in other taking precedence.
+// The SSH keys of both are kept.
+func (m Metadata) Merge(other Metadata) Metadata {
+	if other.Hostname != "" {
+		m.Hostname = other.Hostname
+	}
+
+	m.SSHAuthorizedKeys = append(append(StringList{}, m.SSHAuthorizedKeys...), other.SSHAuthorizedKeys...)
+
+	values := MetadataValues{}
+	for k, v := range m.Values {
+		values[k] = v
+	}
+	for k, v := range other.Values {
+		values[k] = v
+	}
+	m.Values = values
+
+	return m
+}
+
+// MetadataTemplate is metadata that a user saved under a name, so it can be referenced in boot setups.
+type MetadataTemplate struct {
+	gorm.Model `json:"-"`
+	Name       string `gorm:"not null;uniqueIndex:idx_metadata_template"`
+	Username   string `gorm:"not null;uniqueIndex:idx_metadata_template" json:"-"`
+	Metadata   `gorm:"embedded"`
+}
+
+// MachineMetadata is the metadata served to a machine for the boot it is currently in.
+// It is replaced whenever the machine claims a new boot setup.
+type MachineMetadata struct {
+	MachineMAC string             `gorm:"primaryKey"`
+	Machine    model.MachineModel `gorm:"foreignKey:MachineMAC;references:Address;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+
+	// MachineIP is the address the machine informed from, only requests from this address get the metadata
+	MachineIP string `gorm:"index"`
+
+	// InstanceID changes on every boot, which tells cloud-init to run its first boot modules again
+	InstanceID string
+	Metadata   `gorm:"embedded"`
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import "time"
+
+// NBDExport is a version of an image the control server exports read-only over NBD
+type NBDExport struct {
+	// URL is nbd://host:port/name, Token is the name of the export. It is accepted for a single connection.
+	URL   string
+	Token string
+	// Size is the size of the version in bytes
+	Size int64
+	// ExpiresAt is when the export is removed if nobody connected to it
+	ExpiresAt time.Time
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import "fmt"
+
+// PeerPathFmt is the path a management OS serves a version it holds on, relative to its address
+const PeerPathFmt = "/image/%s/%d"
+
+// PeerSource points a management OS to another machine which holds the image it should flash
+type PeerSource struct {
+	// MachineMAC is the machine serving the image
+	MachineMAC string
+	// URL is where the version is downloaded from, Token is sent along as a bearer token
+	URL   string
+	Token string
+}
+
+// PeerVersion is a version of an image which a management OS holds and serves to other machines
+type PeerVersion struct {
+	ImageUUID ImageUUID
+	Version   uint64
+}
+
+// String returns the key of the version, which is unique between the images
+func (v PeerVersion) String() string {
+	return fmt.Sprintf("%s/%d", v.ImageUUID, v.Version)
+}
+
+// PeerHeartbeat is the body a management OS sends with its heartbeats when it serves images to other machines
+type PeerHeartbeat struct {
+	// Port is where the management OS serves the images, on the address it contacts the control server from
+	Port uint16
+	// Token has to be sent along with every download from this machine
+	Token string
+	// Versions are the versions it can serve, those which it downloaded and verified completely
+	Versions []PeerVersion
+}
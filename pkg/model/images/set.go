@@ -0,0 +1,33 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import "gorm.io/gorm"
+
+// ImageSet groups images which are written to different disks of a machine and booted together, such as an OS disk
+// and a data disk. The control server keeps an image setup with the same UUID in sync with the set, booting the set
+// flashes the members in order through that setup.
+type ImageSet struct {
+	gorm.Model `json:"-"`
+	UUID       ImageUUID        `gorm:"uniqueIndex;not null"`
+	Name       string           `gorm:"not null"`
+	Username   string           `gorm:"not null;index"`
+	Members    []ImageSetMember `gorm:"foreignKey:ImageSetUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+}
+
+// ImageSetMember is an image in a set together with the disk it is written to
+type ImageSetMember struct {
+	ID           uint      `gorm:"primaryKey" json:"-"`
+	ImageSetUUID ImageUUID `gorm:"not null;index" json:"-"`
+	// Position orders the members, they are flashed in the order they are given in
+	Position int `gorm:"not null" json:"-"`
+
+	Image     ImageModel `gorm:"foreignKey:ImageUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	ImageUUID ImageUUID  `gorm:"not null"`
+	// Version is flashed, either "latest" which is resolved when the machine claims the boot or a version number
+	Version VersionSelector `gorm:"not null;default:'latest'"`
+	// TargetDevice selects the disk the image is written to by its device file, partition table UUID or serial
+	TargetDevice string `gorm:"not null"`
+}
@@ -20,6 +20,19 @@ type ImageFrozen struct {
 	// ImageSetup     ImageSetup `json:"-" gorm:"foreignKey:UUID;referencesImageSetupUUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE"`
 	ImageSetupUUID ImageUUID `json:"-"`
 	Update         bool      `gorm:"not null;default:false"`
+
+	// Selector overrides the stored version when the boot does not select one, it is set for the members of
+	// image sets. TargetDevice is the disk the image is written to as a whole, rather than to its partition.
+	Selector     VersionSelector `gorm:"not null;default:''" json:",omitempty"`
+	TargetDevice string          `gorm:"not null;default:''" json:",omitempty"`
+
+	// Peer is where the management OS fetches this image from instead of the control server, it is only set in
+	// the boot setup handed out to a machine.
+	Peer *PeerSource `gorm:"-" json:",omitempty"`
+
+	// Export is where a diskless boot reads this image from, it is only set in the boot setup handed out to a
+	// machine
+	Export *NBDExport `gorm:"-" json:",omitempty"`
 }
 
 // ImageSetup defines a collection of Images
@@ -29,6 +42,76 @@ type ImageSetup struct {
 	Images     []ImageFrozen `gorm:"foreignKey:ImageSetupUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
 	Username   string        `gorm:"foreignKey:Username;not null;"`
 	UUID       ImageUUID     `gorm:"uniqueIndex;primaryKey;unique;not null;"`
+
+	// TargetDevice is the disk the images are written to and BootMode what happens to the changes made to them,
+	// these are only set in the boot setup handed out to a machine
+	TargetDevice string   `gorm:"-" json:",omitempty"`
+	BootMode     BootMode `gorm:"-" json:",omitempty"`
+
+	// SSHAuthorizedKeys are written to the authorized_keys of root in the images after flashing them, they are
+	// only set when the boot asked for the keys to be injected
+	SSHAuthorizedKeys StringList `gorm:"-" json:",omitempty"`
+
+	// Encryption is set when the boot asked for its images to be encrypted
+	Encryption *BootEncryption `gorm:"-" json:",omitempty"`
+
+	// Verify is how the images are read back after they are written, nothing is read back when it is left out
+	Verify VerifyMode `gorm:"-" json:",omitempty" description:"How the images are read back after writing them"`
+}
+
+// BootEncryption tells the management OS to write the images into LUKS containers. The passphrase is made for the
+// boot and only handed out with its boot setup, the management OS does not keep it.
+type BootEncryption struct {
+	BootID     uint
+	Passphrase string `json:",omitempty"`
+	// Images are the images which are encrypted, the machine image is not
+	Images []ImageUUID
+	// KeepEncrypted uploads the changes as the encrypted containers, otherwise they are decrypted for the upload
+	KeepEncrypted bool `json:",omitempty" description:"Upload the changes encrypted as they are stored on the disk"`
+}
+
+// Covers checks whether an image is encrypted, there is nothing encrypted without encryption
+func (e *BootEncryption) Covers(uuid ImageUUID) bool {
+	if e == nil {
+		return false
+	}
+
+	for _, image := range e.Images {
+		if image == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BootMode decides what happens to the changes made to the disk while the images are booted
+type BootMode string
+
+const (
+	// BootPersistent boots keep the changes on the disk, images marked for update are uploaded afterwards
+	BootPersistent BootMode = "persistent"
+	// BootDiscard boots are never uploaded, the disk is left dirty until the machine is flashed again
+	BootDiscard BootMode = "discard"
+	// BootOverlay boots write the changes to a copy-on-write overlay, which the management OS throws away
+	BootOverlay BootMode = "overlay"
+	// BootDiskless boots read the images over NBD instead of flashing them, the changes go to a copy-on-write
+	// overlay on the machine partition
+	BootDiskless BootMode = "diskless"
+)
+
+// BootModes are the known boot modes
+var BootModes = []BootMode{BootPersistent, BootDiscard, BootOverlay, BootDiskless}
+
+// Valid checks whether the mode is one of the known boot modes
+func (m BootMode) Valid() bool {
+	for _, mode := range BootModes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
 }
 
 // BootSetup stores what the next boot for the machine should look like.
@@ -37,15 +120,65 @@ type BootSetup struct {
 	gorm.Model `json:"-"`
 
 	// Store the machine id
-	Machine    machine.MachineModel `gorm:"foreignKey:MachineMAC;references:Address;not null;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
-	MachineMAC string               `gorm:"not null;primaryKey"`
+	Machine    machine.MachineModel `gorm:"foreignKey:MachineMAC;references:Address;not null;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" schema:"readonly"`
+	MachineMAC string               `gorm:"not null;primaryKey" schema:"readonly"`
 
 	// Store the setup that should be loaded onto the machine
-	Setup     ImageSetup `gorm:"foreignKey:SetupUUID;references:UUID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	SetupUUID ImageUUID  `gorm:"not null;primaryKey"`
+	Setup     ImageSetup `gorm:"foreignKey:SetupUUID;references:UUID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" schema:"readonly"`
+	SetupUUID ImageUUID  `gorm:"not null;primaryKey" description:"The image setup to boot"`
+	// SetUUID boots an image set instead, it is replaced by the image setup of the set
+	SetUUID ImageUUID `gorm:"-" json:",omitempty" description:"The image set to boot instead of an image setup"`
+
+	// Should the image changes be uploaded to the server? Only persistent boots are uploaded.
+	Update bool `gorm:"not null;" description:"Upload the changes to the images after a persistent boot"`
+
+	// BootMode is persistent when it is left out
+	BootMode BootMode `gorm:"not null;default:'persistent'" description:"What happens to the changes to the disk, persistent when it is left out"`
+
+	// Version selects which version of the images is flashed, see VersionSelector.
+	Version VersionSelector `gorm:"not null;default:''" description:"The version of the images to flash"`
+
+	// TargetDevice selects the disk the images are written to by its device file, UUID or serial number. When it
+	// is left out the disk is chosen by the DiskUUID of the images. It is stored as the device file of the disk.
+	TargetDevice string `gorm:"not null;default:''" description:"The disk to write the images to, by its device file, UUID or serial number"`
+
+	// Metadata is served to the machine on the first boot into the images, it is merged on top of the
+	// metadata template with the name MetadataTemplate when one is given.
+	Metadata         Metadata `gorm:"embedded;embeddedPrefix:metadata_" description:"The metadata served to the machine on the first boot into the images"`
+	MetadataTemplate string   `gorm:"-" description:"The name of the metadata template the metadata is merged on top of"`
+
+	// InjectSSHKeys has the management OS write the SSH keys of the metadata into the images, for images which
+	// do not run cloud-init
+	InjectSSHKeys bool `gorm:"not null;default:false" json:"inject_ssh_keys,omitempty" description:"Write the SSH keys of the metadata into the images"`
+
+	// Encrypt has the images written into LUKS containers, with a passphrase the control server makes when the boot
+	// is claimed. KeepEncrypted uploads the changes as they are stored on the disk, instead of decrypting them.
+	Encrypt       bool `gorm:"not null;default:false" json:"encrypt,omitempty" description:"Write the images into LUKS containers"`
+	KeepEncrypted bool `gorm:"not null;default:false" json:"keep_encrypted,omitempty"`
+
+	// Verify is how the management OS reads the images back after writing them. It is resolved when the boot is
+	// queued, from the group of the machine and then FlashVerify when it is left out.
+	Verify VerifyMode `gorm:"not null;default:''" json:"verify,omitempty"`
+	// Warnings are things the one queueing the boot should know about, which do not stop it from being queued
+	Warnings []string `gorm:"-" json:",omitempty" schema:"readonly"`
+
+	// Template is the boot template of the user the other fields are taken from when they are left out.
+	// TemplateRevision and TemplateOptions are the revision the template had and what the boot ended up with, they
+	// are set when the boot is queued.
+	Template         string           `gorm:"not null;default:''" json:",omitempty" description:"The boot template the left out fields are taken from, owner/name for the templates of others"`
+	TemplateRevision uint             `gorm:"not null;default:0" json:",omitempty" schema:"readonly"`
+	TemplateOptions  *TemplateOptions `gorm:"type:text" json:",omitempty" schema:"readonly"`
+}
+
+// MultiDisk checks whether the images of the setup are written to disks of their own, as those of image sets are
+func (setup *ImageSetup) MultiDisk() bool {
+	for _, frozen := range setup.Images {
+		if frozen.TargetDevice != "" {
+			return true
+		}
+	}
 
-	// Should the image changes be uploaded to the server?
-	Update bool `gorm:"not null;"`
+	return false
 }
 
 // CreateImageSetup creates an ImageSetup of a specified name.
@@ -0,0 +1,96 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+
+	"gorm.io/gorm"
+)
+
+// BootOptions are the fields of a boot setup which do not depend on the machine it is queued on, they carry the
+// same names as in the boot setup
+type BootOptions struct {
+	SetupUUID ImageUUID `gorm:"not null;default:''" json:",omitempty" description:"The image setup the template boots"`
+	SetUUID   ImageUUID `gorm:"not null;default:''" json:",omitempty" description:"The image set the template boots instead of an image setup"`
+
+	Update       bool            `gorm:"not null;default:false"`
+	BootMode     BootMode        `gorm:"not null;default:''" json:",omitempty" description:"What happens to the changes to the disk"`
+	Version      VersionSelector `gorm:"not null;default:''" json:",omitempty"`
+	TargetDevice string          `gorm:"not null;default:''" json:",omitempty"`
+
+	Metadata         Metadata `gorm:"embedded;embeddedPrefix:metadata_"`
+	MetadataTemplate string   `gorm:"not null;default:''" json:",omitempty"`
+
+	InjectSSHKeys bool       `gorm:"not null;default:false" json:"inject_ssh_keys,omitempty"`
+	Encrypt       bool       `gorm:"not null;default:false" json:"encrypt,omitempty"`
+	KeepEncrypted bool       `gorm:"not null;default:false" json:"keep_encrypted,omitempty"`
+	Verify        VerifyMode `gorm:"not null;default:''" json:"verify,omitempty" description:"How the images are read back after writing them"`
+}
+
+// NewBootOptions takes the options of a boot setup
+func NewBootOptions(bootSetup *BootSetup) BootOptions {
+	return BootOptions{
+		SetupUUID:        bootSetup.SetupUUID,
+		SetUUID:          bootSetup.SetUUID,
+		Update:           bootSetup.Update,
+		BootMode:         bootSetup.BootMode,
+		Version:          bootSetup.Version,
+		TargetDevice:     bootSetup.TargetDevice,
+		Metadata:         bootSetup.Metadata,
+		MetadataTemplate: bootSetup.MetadataTemplate,
+		InjectSSHKeys:    bootSetup.InjectSSHKeys,
+		Encrypt:          bootSetup.Encrypt,
+		KeepEncrypted:    bootSetup.KeepEncrypted,
+		Verify:           bootSetup.Verify,
+	}
+}
+
+// BootSetup is a boot setup with these options, which is not queued on any machine yet
+func (o *BootOptions) BootSetup() BootSetup {
+	return BootSetup{
+		SetupUUID:        o.SetupUUID,
+		SetUUID:          o.SetUUID,
+		Update:           o.Update,
+		BootMode:         o.BootMode,
+		Version:          o.Version,
+		TargetDevice:     o.TargetDevice,
+		Metadata:         o.Metadata,
+		MetadataTemplate: o.MetadataTemplate,
+		InjectSSHKeys:    o.InjectSSHKeys,
+		Encrypt:          o.Encrypt,
+		KeepEncrypted:    o.KeepEncrypted,
+		Verify:           o.Verify,
+	}
+}
+
+// TemplateOptions are the options a boot got from its boot template together with those the request overrode,
+// which is stored as JSON in a single column
+type TemplateOptions BootOptions
+
+// Value serialises the options for the database
+func (o TemplateOptions) Value() (driver.Value, error) {
+	b, err := json.Marshal(BootOptions(o))
+	return string(b), err
+}
+
+// Scan deserialises the options from the database
+func (o *TemplateOptions) Scan(value interface{}) error {
+	return scanJSON(value, o)
+}
+
+// BootTemplate is a combination of boot options a user saved under a name. Boots which reference it take the
+// options they leave out from the template.
+type BootTemplate struct {
+	gorm.Model `json:"-"`
+	Name       string `gorm:"not null;uniqueIndex:idx_boot_template" description:"The name of the template, unique among those of the user"`
+	Username   string `gorm:"not null;uniqueIndex:idx_boot_template" json:"-"`
+
+	// Revision counts the changes to the template, the boots record the revision they were queued with
+	Revision uint `gorm:"not null;default:1" schema:"readonly"`
+
+	BootOptions `gorm:"embedded"`
+}
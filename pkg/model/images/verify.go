@@ -0,0 +1,69 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+)
+
+// VerifyMode is how the management OS reads the images back after writing them, to find disks which dropped writes
+type VerifyMode string
+
+const (
+	// VerifyNone trusts the disk, nothing is read back
+	VerifyNone VerifyMode = "none"
+	// VerifyQuick reads back a sample of the blocks of every image and the partition table of the disk
+	VerifyQuick VerifyMode = "quick"
+	// VerifyFull reads back everything which was written, which takes about as long as writing it
+	VerifyFull VerifyMode = "full"
+)
+
+// VerifyModes are the modes the management OS knows
+var VerifyModes = []VerifyMode{VerifyNone, VerifyQuick, VerifyFull}
+
+// Valid reports whether the mode is one the management OS knows, an empty mode leaves it to the defaults
+func (m VerifyMode) Valid() bool {
+	return m == "" || m == VerifyNone || m == VerifyQuick || m == VerifyFull
+}
+
+// MaxMismatches bounds the offsets a verification reports, a disk which dropped everything would list every block
+const MaxMismatches = 64
+
+// FlashVerification is what reading back an image found
+type FlashVerification struct {
+	ImageUUID ImageUUID
+	Version   uint64
+	Mode      VerifyMode
+	// Verified is set when everything which was read back matches what was written
+	Verified bool
+	// Checked is the number of bytes which were read back, out of Written
+	Checked uint64
+	Written uint64
+	// Mismatches are the offsets of the blocks which did not match, up to MaxMismatches of them. PartitionTable
+	// tells what is wrong with the partition table of the disk.
+	Mismatches     []uint64 `json:",omitempty"`
+	PartitionTable string   `json:",omitempty"`
+	// Error is set when the image could not be read back at all
+	Error string `json:",omitempty"`
+}
+
+// FlashVerifications is a list of verifications which is stored as JSON in a single column
+type FlashVerifications []FlashVerification
+
+// Value serialises the list for the database
+func (v FlashVerifications) Value() (driver.Value, error) {
+	if v == nil {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Scan deserialises the list from the database
+func (v *FlashVerifications) Scan(value interface{}) error {
+	return scanJSON(value, v)
+}
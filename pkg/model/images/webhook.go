@@ -0,0 +1,56 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package images
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/secrets"
+)
+
+// WebhookEvent is something which happened to an image that its webhooks are told about
+type WebhookEvent string
+
+const (
+	// WebhookVersionCreated is sent once a new version of the image is stored and can be booted
+	WebhookVersionCreated WebhookEvent = "version-created"
+	// WebhookVersionDeleted is sent when a version of the image is deleted
+	WebhookVersionDeleted WebhookEvent = "version-deleted"
+	// WebhookVisibilityChanged is sent when the image is made public or private
+	WebhookVisibilityChanged WebhookEvent = "visibility-changed"
+)
+
+// ImageWebhook posts the events of a single image to a URL, signed with its secret
+type ImageWebhook struct {
+	ID        uint       `gorm:"primaryKey"`
+	ImageUUID ImageUUID  `gorm:"not null;index"`
+	Image     ImageModel `gorm:"foreignKey:ImageUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	// Username is who created the webhook, it counts against their MaxWebhooks
+	Username string `gorm:"not null;index"`
+	URL      string `gorm:"not null"`
+	// Secret is the key of the HMAC-SHA256 signature of the deliveries, it is only handed out when the webhook is
+	// created
+	Secret    secrets.Secret `json:"-"`
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is an attempt to post an event to a webhook, the last ones of every webhook are kept
+type WebhookDelivery struct {
+	ID        uint         `gorm:"primaryKey"`
+	WebhookID uint         `gorm:"not null;index"`
+	Webhook   ImageWebhook `gorm:"constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	Event     WebhookEvent `gorm:"not null"`
+	// StatusCode is what the URL answered, it is zero when it could not be reached
+	StatusCode int    `gorm:"not null;default:0"`
+	Error      string `gorm:"not null;default:''" json:",omitempty"`
+	// Duration is how long the delivery took in milliseconds
+	Duration  int64 `gorm:"not null;default:0"`
+	CreatedAt time.Time
+}
+
+// Succeeded checks whether the URL accepted the delivery
+func (d *WebhookDelivery) Succeeded() bool {
+	return d.StatusCode >= 200 && d.StatusCode < 300
+}
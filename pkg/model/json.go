@@ -40,6 +40,14 @@ type GitHubLogin struct {
 	UpdatedAt         string
 }
 
+// GitLabLogin represents the JSON structure sent by the GitLab user API
+type GitLabLogin struct {
+	ID       int
+	Username string
+	Name     string
+	Email    string
+}
+
 // ImageSetupMessage is a stripped down version of the ImageSetup
 // model which can be used as a JSON response
 type ImageSetupMessage struct {
@@ -0,0 +1,128 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import "time"
+
+// CommandOutputMaxBytes is the most output of a diagnostic which is kept, the rest is cut off
+const CommandOutputMaxBytes = 64 * 1024
+
+// commandResultGrace is how long past its timeout the result of a diagnostic may take to come in
+const commandResultGrace = time.Minute
+
+// Diagnostic is a command the management OS can be asked to run. Only the names are sent to the machine, the
+// management OS knows what each of them runs.
+type Diagnostic struct {
+	Name        string
+	Description string
+	// TimeoutSeconds is how long the management OS lets the diagnostic run before it is killed
+	TimeoutSeconds uint
+}
+
+// Timeout is how long the diagnostic can run
+func (d *Diagnostic) Timeout() time.Duration {
+	return time.Duration(d.TimeoutSeconds) * time.Second
+}
+
+// Diagnostics are the commands administrators can have a machine in the management OS run
+var Diagnostics = []Diagnostic{
+	{Name: "lsblk", Description: "Lists the block devices of the machine", TimeoutSeconds: 10},
+	{Name: "smartctl", Description: "Reads the SMART health of the disk the images are written to",
+		TimeoutSeconds: 30},
+	{Name: "dmesg", Description: "Shows the warnings and errors in the kernel log", TimeoutSeconds: 10},
+	{Name: "speedtest", Description: "Measures how fast the machine downloads from the control server",
+		TimeoutSeconds: 120},
+}
+
+// FindDiagnostic finds a diagnostic by its name
+func FindDiagnostic(name string) (*Diagnostic, bool) {
+	for i := range Diagnostics {
+		if Diagnostics[i].Name == name {
+			return &Diagnostics[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// CommandState is where a command is between being queued and its result coming in
+type CommandState string
+
+const (
+	// CommandQueued commands wait for the machine to pick them up
+	CommandQueued CommandState = "queued"
+	// CommandSent commands were picked up by the machine, which has yet to report the result
+	CommandSent CommandState = "sent"
+	// CommandCompleted commands ran, whatever their exit code was
+	CommandCompleted CommandState = "completed"
+	// CommandFailed commands could not be run or did not finish in time
+	CommandFailed CommandState = "failed"
+	// CommandExpired commands were not picked up or answered before they expired, the machine was not around
+	CommandExpired CommandState = "expired"
+)
+
+// MachineCommand is a diagnostic an administrator asked a machine to run, together with its result. It goes with
+// the machine.
+// nolint: golint
+type MachineCommand struct {
+	ID         uint         `gorm:"primaryKey"`
+	MachineMAC string       `gorm:"not null;index"`
+	Machine    MachineModel `gorm:"foreignKey:MachineMAC;references:Address;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+	Diagnostic string       `gorm:"not null"`
+	// RequestedBy is the administrator who queued the command
+	RequestedBy string       `gorm:"not null"`
+	State       CommandState `gorm:"not null;default:'queued';index"`
+	// ExpiresAt is when the command expires if the machine did not pick it up, or when it did, report its result
+	ExpiresAt time.Time `gorm:"not null"`
+
+	ExitCode int `gorm:"not null;default:0"`
+	// Output is what the diagnostic wrote, Truncated tells whether it was cut off at CommandOutputMaxBytes
+	Output    string `gorm:"not null;default:''"`
+	Truncated bool   `gorm:"not null;default:false"`
+	// Error is why the diagnostic could not be run or finish
+	Error string `gorm:"not null;default:''"`
+
+	CreatedAt  time.Time
+	SentAt     *time.Time
+	FinishedAt *time.Time
+}
+
+// CommandResult is what the management OS reports after running a command
+type CommandResult struct {
+	ExitCode  int
+	Output    string
+	Truncated bool
+	Error     string `json:",omitempty"`
+}
+
+// Send hands the command to the machine, which has until the timeout of the diagnostic to report its result
+func (c *MachineCommand) Send(now time.Time) {
+	timeout := time.Duration(0)
+	if diagnostic, ok := FindDiagnostic(c.Diagnostic); ok {
+		timeout = diagnostic.Timeout()
+	}
+
+	c.State = CommandSent
+	c.SentAt = &now
+	c.ExpiresAt = now.Add(timeout + commandResultGrace)
+}
+
+// Finish stores the result the machine reported, the output is cut off at CommandOutputMaxBytes
+func (c *MachineCommand) Finish(result *CommandResult, now time.Time) {
+	c.State = CommandCompleted
+	if result.Error != "" {
+		c.State = CommandFailed
+	}
+
+	c.ExitCode = result.ExitCode
+	c.Output = result.Output
+	c.Truncated = result.Truncated
+	if len(c.Output) > CommandOutputMaxBytes {
+		c.Output = c.Output[:CommandOutputMaxBytes]
+		c.Truncated = true
+	}
+	c.Error = result.Error
+	c.FinishedAt = &now
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import "strings"
+
+// DiskModel is a block device which the management OS found in a machine.
+type DiskModel struct {
+	ID         uint   `gorm:"primaryKey" json:"-"`
+	MachineMAC string `gorm:"not null;index" json:"-"`
+
+	// Device is the device file of the disk, for example /dev/sda
+	Device string `gorm:"not null"`
+	// Size of the disk in bytes
+	Size uint64 `gorm:"not null"`
+	// UUID is the identifier of the partition table on the disk, Serial the serial number of the disk itself.
+	// Either is empty when the management OS cannot find it.
+	UUID   string `gorm:"not null;default:''"`
+	Serial string `gorm:"not null;default:''"`
+}
+
+// Matches checks whether the selector is the device file, the UUID or the serial number of the disk
+func (d *DiskModel) Matches(selector string) bool {
+	return selector != "" && (selector == d.Device || strings.EqualFold(selector, d.UUID) ||
+		selector == d.Serial)
+}
+
+// Inventory is the hardware the management OS reports after booting a machine.
+type Inventory struct {
+	// TargetDevice is the disk the management OS writes the images to
+	TargetDevice string
+	Disks        []DiskModel
+}
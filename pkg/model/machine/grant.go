@@ -0,0 +1,23 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import "time"
+
+// MachineGrant lets a single user boot a restricted machine, independent of any course
+// nolint: golint
+type MachineGrant struct {
+	MachineMAC string `gorm:"primaryKey"`
+	Username   string `gorm:"primaryKey"`
+	CreatedAt  time.Time
+}
+
+// MachineAccess is what lets a user boot a restricted machine
+type MachineAccess struct {
+	// Granted is whether the user was granted the machine directly
+	Granted bool
+	// Course is a course which has not expired with both the user and the machine in it, or empty when there is none
+	Course string
+}
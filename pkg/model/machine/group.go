@@ -0,0 +1,35 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import "time"
+
+// DefaultImage is the image a machine boots when it network-boots while nothing is queued for it. The boot mode is
+// one of the boot modes of the images package, which cannot be referred to from here.
+type DefaultImage struct {
+	ImageUUID string `gorm:"not null;default:''"`
+	BootMode  string `gorm:"not null;default:''"`
+}
+
+// Set reports whether a default image was chosen
+func (d DefaultImage) Set() bool {
+	return d.ImageUUID != ""
+}
+
+// MachineGroup holds the settings of the machines which share a Group label. Groups are not created on their own,
+// the machines name them and a group is only stored once something is set for it.
+// nolint: golint
+type MachineGroup struct {
+	Name string `gorm:"primaryKey"`
+
+	// DefaultImage is booted by the machines of the group which have no default image of their own
+	DefaultImage DefaultImage `gorm:"embedded;embeddedPrefix:default_"`
+	// Verify is how the boots of the machines of the group read their images back when they do not say, one of the
+	// verify modes of the images package. It is left to FlashVerify when it is empty.
+	Verify string `gorm:"not null;default:''"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -6,6 +6,9 @@
 package machine
 
 import (
+	"strings"
+	"time"
+
 	"github.com/baas-project/baas/pkg/util"
 )
 
@@ -21,6 +24,54 @@ const (
 	Unknown SystemArchitecture = "unknown"
 )
 
+// Architectures are the architectures a machine or an image can have
+var Architectures = []SystemArchitecture{X86_64, Arm64, Unknown}
+
+// ParseArchitecture finds the architecture with a name regardless of its case, an empty name is unknown
+func ParseArchitecture(name string) (SystemArchitecture, bool) {
+	if name == "" {
+		return Unknown, true
+	}
+
+	for _, arch := range Architectures {
+		if strings.EqualFold(name, string(arch)) {
+			return arch, true
+		}
+	}
+
+	return "", false
+}
+
+// Conflicts reports whether something built for one architecture cannot run on the other. Nothing is known to
+// conflict with an architecture which was not identified.
+func (id SystemArchitecture) Conflicts(other SystemArchitecture) bool {
+	if id == "" || other == "" || strings.EqualFold(string(id), string(Unknown)) ||
+		strings.EqualFold(string(other), string(Unknown)) {
+		return false
+	}
+
+	return !strings.EqualFold(string(id), string(other))
+}
+
+// RegistrationStatus tells whether a machine may be booted by BAAS
+type RegistrationStatus string
+
+const (
+	// MachineApproved machines were added by an admin, or approved after they registered themselves
+	MachineApproved RegistrationStatus = "approved"
+	// MachinePending machines registered themselves and wait until an admin approves or rejects them
+	MachinePending RegistrationStatus = "pending"
+	// MachineRejected machines registered themselves, but an admin does not want BAAS to boot them
+	MachineRejected RegistrationStatus = "rejected"
+)
+
+// Registration is what a machine which registered itself is told. Key is only given to pending machines, it is
+// their only credential until an admin approves them.
+type Registration struct {
+	Status RegistrationStatus
+	Key    string `json:",omitempty"`
+}
+
 // Name gets the name of an architecture as a string. Convenience function,
 // but actually does very little as the name is also the value of the constant.
 func (id *SystemArchitecture) Name() string {
@@ -31,13 +82,100 @@ func (id *SystemArchitecture) Name() string {
 // nolint: golint
 type MachineModel struct {
 	// General Info
-	Name         string `gorm:"unique"`
-	Architecture SystemArchitecture
+	Name         string             `gorm:"unique" description:"The unique name of the machine"`
+	Architecture SystemArchitecture `description:"The architecture of the machine, in any case"`
+
+	// Group is a free-form label which sorts the machines of a lab, such as the room or the rack they are in
+	Group string `gorm:"not null;default:''" description:"The group which sorts the machines of a lab, such as their room or rack"`
 
 	// Managed indicates that a machine should be managed by BAAS (if false baas will not touch the machine in any way)
-	Managed bool
+	Managed bool `description:"BAAS only boots managed machines"`
 
 	// MacAddress is the mac address associated with this machine
-	MacAddress util.MacAddress `gorm:"embedded;unique;primaryKey"`
+	MacAddress util.MacAddress `gorm:"embedded;unique;primaryKey" description:"The MAC address the machine network-boots with"`
 	ImageUUID  string
+
+	// Disks are the block devices reported by the management OS, images are written to TargetDevice.
+	Disks        []DiskModel `gorm:"foreignKey:MachineMAC;references:Address;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" schema:"readonly" description:"The disks the management OS reported"`
+	TargetDevice string      `description:"The device file of the disk the images are written to"`
+
+	// Dirty machines finished a discard boot, their disk holds changes which were never uploaded. The next flash
+	// cleans it up.
+	Dirty bool `gorm:"not null;default:false" schema:"readonly" description:"Dirty machines hold changes of a discard boot which were never uploaded"`
+
+	// Restricted machines can only be booted by moderators, admins and the users who were granted access, directly
+	// or through a course which has not expired. Anyone can boot the other machines.
+	Restricted bool `gorm:"not null;default:false" description:"Restricted machines can only be booted by moderators, admins and the users granted access"`
+
+	// DefaultImage is booted when the machine network-boots with nothing queued, it overrides the default image
+	// of its group
+	DefaultImage DefaultImage `gorm:"embedded;embeddedPrefix:default_"`
+
+	// ClockSkewMillis is how far the clock of the management OS was ahead of the control server at its last
+	// heartbeat, negative when it was behind. ClockCheckedAt is when that was, it is nil for machines which never
+	// reported their clock.
+	ClockSkewMillis int64      `gorm:"not null;default:0" schema:"readonly"`
+	ClockCheckedAt  *time.Time `schema:"readonly"`
+
+	// VersionStamp is what the management OS and the control server were running at the last boot claim or
+	// heartbeat of the machine, AgentSeenAt is when that was. It is nil for machines which never checked in since.
+	VersionStamp
+	AgentSeenAt *time.Time `schema:"readonly"`
+
+	// Status is approved for the machines which BAAS may boot. Machines which registered themselves are pending
+	// until an admin approves or rejects them, RegistrationKeyHash is the SHA-256 of the key they were given to
+	// report their inventory and to ask for their status with. Neither is set through the machine itself.
+	Status              RegistrationStatus `gorm:"not null;default:'approved'" json:"-"`
+	RegistrationKeyHash string             `json:"-"`
+
+	// CreatedAt is when the machine was registered, UpdatedAt when it was last changed or reported its disks
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// VersionStamp records which release of the management OS agent talked to which build of the control server, and
+// the protocol they spoke
+type VersionStamp struct {
+	AgentVersion  string `gorm:"not null;default:''" schema:"readonly"`
+	AgentProtocol uint   `gorm:"not null;default:0" schema:"readonly"`
+	ServerVersion string `gorm:"not null;default:''" schema:"readonly"`
+	ServerCommit  string `gorm:"not null;default:''" schema:"readonly"`
+}
+
+// RegistrationStatus is the status of the machine, the machines from before they could register themselves have
+// none and are approved
+func (m *MachineModel) RegistrationStatus() RegistrationStatus {
+	if m.Status == "" {
+		return MachineApproved
+	}
+
+	return m.Status
+}
+
+// Approved reports whether BAAS may boot the machine
+func (m *MachineModel) Approved() bool {
+	return m.RegistrationStatus() == MachineApproved
+}
+
+// TargetDiskSize returns the size of the disk the images are written to, or zero when it is not known.
+func (m *MachineModel) TargetDiskSize() uint64 {
+	for _, disk := range m.Disks {
+		if disk.Device == m.TargetDevice {
+			return disk.Size
+		}
+	}
+
+	return 0
+}
+
+// FindDisks returns the disks of the machine which match the selector, see DiskModel.Matches
+func (m *MachineModel) FindDisks(selector string) []DiskModel {
+	var disks []DiskModel
+	for _, disk := range m.Disks {
+		if disk.Matches(selector) {
+			disks = append(disks, disk)
+		}
+	}
+
+	return disks
 }
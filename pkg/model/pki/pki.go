@@ -0,0 +1,83 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pki declares the certificate authorities the management OS uses to verify the control server
+package pki
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+)
+
+// CertificateAuthority is a CA chain which signs the certificate of the control server. Uploading a new one retires
+// the previous one, which is still served to the machines for a grace window so those which pinned it keep working
+// while the certificate of the control server is replaced.
+type CertificateAuthority struct {
+	ID uint `gorm:"primaryKey" json:"-"`
+	// Fingerprint is the SHA-256 fingerprint of the first certificate of the chain
+	Fingerprint string `gorm:"not null;uniqueIndex"`
+	Subject     string `gorm:"not null"`
+	// PEM is the chain as it was uploaded
+	PEM string `gorm:"not null" json:"-"`
+	// NotAfter is when the first certificate of the chain to expire does so
+	NotAfter  time.Time
+	RetiredAt *time.Time `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+// Trusted checks whether the machines are still given the chain, either as the current chain or within the grace
+// window after it was retired
+func (c *CertificateAuthority) Trusted(grace time.Duration, now time.Time) bool {
+	return c.RetiredAt == nil || c.RetiredAt.Add(grace).After(now)
+}
+
+// ParseBundle reads the certificates of a PEM file, anything which is not a certificate is refused
+func ParseBundle(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.New("the file holds a " + strings.ToLower(block.Type) + " instead of certificates")
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("the file does not hold any PEM encoded certificates")
+	}
+
+	return certs, nil
+}
+
+// Fingerprint is the hex encoded SHA-256 digest of a certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Fingerprints lists the fingerprints of the certificates in a bundle separated by commas
+func Fingerprints(certs []*x509.Certificate) string {
+	var fingerprints []string
+	for _, cert := range certs {
+		fingerprints = append(fingerprints, Fingerprint(cert))
+	}
+
+	return strings.Join(fingerprints, ",")
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package replication declares how a standby control server keeps a copy of the database of its primary
+package replication
+
+import "time"
+
+// LogEntry records that a row changed. Triggers on the replicated tables write the entries, every change of a row
+// replaces its earlier entry, so a replica which is behind only fetches the latest state of each row once. The
+// sequence numbers are never reused, the entry a replica saw last may since have been replaced.
+type LogEntry struct {
+	Seq   uint64 `gorm:"primaryKey"`
+	Table string `gorm:"column:table_name"`
+	// Key is the primary key of the row as a JSON object
+	Key     string `gorm:"column:row_key"`
+	Deleted bool
+}
+
+// TableName keeps the log apart from the tables it records
+func (LogEntry) TableName() string {
+	return "replication_log"
+}
+
+// Change is a row which changed on the primary since the cursor of a replica
+type Change struct {
+	Seq   uint64
+	Table string
+	// Key is the primary key of the row, Row all of its columns unless it was deleted
+	Key     map[string]interface{}
+	Deleted bool                   `json:",omitempty"`
+	Row     map[string]interface{} `json:",omitempty"`
+}
+
+// State is how far a replica got in copying its primary. There is a single row, a database with a primary in it
+// is a replica and only serves reads.
+type State struct {
+	ID uint `gorm:"primaryKey"`
+	// PrimaryURL is the control server the replica copies, it is cleared when the replica is promoted
+	PrimaryURL string `gorm:"not null;default:''"`
+	// Cursor is the sequence number of the last change which was applied
+	Cursor uint64 `gorm:"not null;default:0"`
+	// SyncedAt is when the replica last caught up with all changes of the primary
+	SyncedAt time.Time
+	// PromotedAt is when the replica was promoted, a promoted database does not become a replica again
+	PromotedAt *time.Time
+}
+
+// Replica reports whether the database is a replica of another control server
+func (s *State) Replica() bool {
+	return s.PrimaryURL != ""
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package telemetry declares what a control server remembers of the anonymous reports it sends to the BAAS project
+package telemetry
+
+import "time"
+
+// State is the single row holding the install ID and how sending the reports went
+type State struct {
+	ID uint `gorm:"primaryKey"`
+	// InstallID is a random identifier of the deployment, the only thing which ties its reports together. It is
+	// empty until the first report is made.
+	InstallID string
+	// SentAt is when a report was last sent, AttemptedAt when sending one was last tried and LastError why that
+	// failed, if it did
+	SentAt      *time.Time
+	AttemptedAt *time.Time
+	LastError   string
+}
+
+// TableName keeps the name short, there is only one row
+func (State) TableName() string {
+	return "telemetry_state"
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"time"
+
+	images2 "github.com/baas-project/baas/pkg/model/images"
+)
+
+// FavoriteImage is an image a user marked as a favorite, it goes when the image is removed for good
+type FavoriteImage struct {
+	Username  string             `gorm:"primaryKey"`
+	ImageUUID images2.ImageUUID  `gorm:"primaryKey"`
+	Image     images2.ImageModel `gorm:"foreignKey:ImageUUID;references:UUID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;" json:"-"`
+
+	CreatedAt time.Time
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import "time"
+
+// OAuthProvider is the name of an external service users can log in with.
+type OAuthProvider string
+
+const (
+	// ProviderGitHub logs users in using their GitHub account
+	ProviderGitHub OAuthProvider = "github"
+	// ProviderGitLab logs users in using a (self-hosted) GitLab instance
+	ProviderGitLab OAuthProvider = "gitlab"
+	// ProviderDev logs users in as whoever they say they are, it is only there for local development and tests
+	ProviderDev OAuthProvider = "dev"
+)
+
+// IdentityModel links an account at an OAuth provider to a BAAS user.
+// A user can have multiple identities, but each identity belongs to exactly one user.
+type IdentityModel struct {
+	ID uint `gorm:"primaryKey"`
+
+	// Provider and ProviderID together uniquely identify the external account. The
+	// provider ID is the stable numeric id of the account, never the (changeable) login name.
+	Provider   OAuthProvider `gorm:"not null;uniqueIndex:idx_identity_provider"`
+	ProviderID string        `gorm:"not null;uniqueIndex:idx_identity_provider"`
+
+	// Login is the name of the account at the provider, only used for display purposes.
+	Login string
+
+	// Username of the user owning this identity
+	Username string `gorm:"not null;index"`
+
+	CreatedAt time.Time
+}
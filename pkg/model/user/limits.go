@@ -0,0 +1,69 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+// Limits caps the resources a user can claim on the server, a limit of zero means there is no limit.
+type Limits struct {
+	// StorageBytes is the total size of all versions of all images of the user, including those in the trash
+	StorageBytes uint64 `gorm:"not null;default:0"`
+	MaxImages    uint   `gorm:"not null;default:0"`
+	// MaxVersions is the amount of versions a single image can have
+	MaxVersions uint `gorm:"not null;default:0"`
+	// MaxQueuedBoots is the amount of boot setups of the user which can be queued on all machines together
+	MaxQueuedBoots uint `gorm:"not null;default:0"`
+	// MaxActiveBoots is the amount of boot setups of the user which can be queued or being flashed at the same
+	// time. At zero the cap of the server configuration applies instead.
+	MaxActiveBoots uint `gorm:"not null;default:0"`
+	// MaxWebhooks is the amount of image webhooks the user can create. At zero the cap of the server configuration
+	// applies instead.
+	MaxWebhooks uint `gorm:"not null;default:0"`
+}
+
+// RoleLimits are the default limits of every user with the role.
+type RoleLimits struct {
+	Role   UserRole `gorm:"primaryKey"`
+	Limits `gorm:"embedded"`
+}
+
+// LimitOverrides replace the limits of the role of a single user, limits which are not set are taken from the role.
+type LimitOverrides struct {
+	Username string `gorm:"primaryKey"`
+
+	StorageBytes   *uint64
+	MaxImages      *uint
+	MaxVersions    *uint
+	MaxQueuedBoots *uint
+	MaxActiveBoots *uint
+	MaxWebhooks    *uint
+}
+
+// Apply returns the limits with the overrides which are set replacing them
+func (o *LimitOverrides) Apply(limits Limits) Limits {
+	if o.StorageBytes != nil {
+		limits.StorageBytes = *o.StorageBytes
+	}
+
+	if o.MaxImages != nil {
+		limits.MaxImages = *o.MaxImages
+	}
+
+	if o.MaxVersions != nil {
+		limits.MaxVersions = *o.MaxVersions
+	}
+
+	if o.MaxQueuedBoots != nil {
+		limits.MaxQueuedBoots = *o.MaxQueuedBoots
+	}
+
+	if o.MaxActiveBoots != nil {
+		limits.MaxActiveBoots = *o.MaxActiveBoots
+	}
+
+	if o.MaxWebhooks != nil {
+		limits.MaxWebhooks = *o.MaxWebhooks
+	}
+
+	return limits
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+// TokenScope limits what the token of a command line login may be used for, next to what its owner may do
+type TokenScope string
+
+const (
+	// ScopeImagesRead lets a token look at images, their versions and the image setups
+	ScopeImagesRead TokenScope = "images:read"
+	// ScopeImagesWrite lets a token create and change images, and upload their versions
+	ScopeImagesWrite TokenScope = "images:write"
+	// ScopeMachinesRead lets a token look at machines, their queues and their history
+	ScopeMachinesRead TokenScope = "machines:read"
+	// ScopeMachinesBoot lets a token queue and cancel boots
+	ScopeMachinesBoot TokenScope = "machines:boot"
+	// ScopeMachinesWrite lets a token change machines and their groups
+	ScopeMachinesWrite TokenScope = "machines:write"
+	// ScopeUsersRead lets a token look at users, their sessions and courses
+	ScopeUsersRead TokenScope = "users:read"
+	// ScopeUsersWrite lets a token change users, their sessions and courses
+	ScopeUsersWrite TokenScope = "users:write"
+	// ScopeAdmin lets a token do everything, including the routes only administrators can use
+	ScopeAdmin TokenScope = "admin"
+)
+
+// TokenScopes are all the scopes a token can be given
+var TokenScopes = []TokenScope{ScopeImagesRead, ScopeImagesWrite, ScopeMachinesRead, ScopeMachinesBoot,
+	ScopeMachinesWrite, ScopeUsersRead, ScopeUsersWrite, ScopeAdmin}
+
+// Valid reports whether the scope is one of TokenScopes
+func (s TokenScope) Valid() bool {
+	for _, scope := range TokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Grants reports whether a token with this scope may use a route which needs the other scope. Writing includes
+// reading, and booting or changing machines includes looking at them.
+func (s TokenScope) Grants(needed TokenScope) bool {
+	switch s {
+	case needed, ScopeAdmin:
+		return true
+	case ScopeImagesWrite:
+		return needed == ScopeImagesRead
+	case ScopeMachinesBoot:
+		return needed == ScopeMachinesRead
+	case ScopeMachinesWrite:
+		return needed == ScopeMachinesRead || needed == ScopeMachinesBoot
+	case ScopeUsersWrite:
+		return needed == ScopeUsersRead
+	default:
+		return false
+	}
+}
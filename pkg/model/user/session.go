@@ -0,0 +1,44 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+)
+
+// SessionKind tells how a session was handed out
+type SessionKind string
+
+const (
+	// SessionBrowser sessions are the cookies of logins in the browser
+	SessionBrowser SessionKind = "browser"
+	// SessionToken sessions are the tokens of command line logins
+	SessionToken SessionKind = "token"
+)
+
+// SessionModel records where a session of a user was created and last used from. The session itself lives in its
+// cookie or token, this is only what the user gets to see of it.
+type SessionModel struct {
+	// ID is the random identifier stored in the cookie or token
+	ID       string      `gorm:"primaryKey"`
+	Username string      `gorm:"not null;index"`
+	Kind     SessionKind `gorm:"not null"`
+
+	// CreatedFrom and LastUsedFrom are the addresses of the client, behind the trusted proxies
+	CreatedFrom  string `gorm:"not null;default:''"`
+	UserAgent    string `gorm:"not null;default:''"`
+	LastUsedFrom string `gorm:"not null;default:''"`
+	LastUsedAt   time.Time
+	// AnomalyAt is when the session was first used from another network than the one it was created on
+	AnomalyAt *time.Time
+	// Scopes limit what a token may be used for, tokens without any may do everything their owner can. The token
+	// carries its scopes itself, these are only shown.
+	Scopes images.StringList `gorm:"type:text"`
+
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import "time"
+
+// SSHKeyModel is a public key of a user, it is added to every machine the user boots
+type SSHKeyModel struct {
+	ID uint `gorm:"primaryKey"`
+
+	// Username of the user owning this key, a user can add a key only once
+	Username string `gorm:"not null;uniqueIndex:idx_ssh_key"`
+
+	// Key is the key in the format of authorized_keys, including its comment
+	Key string `gorm:"not null"`
+
+	// Fingerprint is the SHA256 fingerprint of the key, as ssh-keygen -l shows it
+	Fingerprint string `gorm:"not null;uniqueIndex:idx_ssh_key"`
+
+	CreatedAt time.Time
+}
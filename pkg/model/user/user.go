@@ -6,6 +6,11 @@
 package user
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
 	images2 "github.com/baas-project/baas/pkg/model/images"
 )
 
@@ -17,19 +22,139 @@ const (
 	// User can just use images and change their own image
 	User UserRole = "user"
 	// Moderator can change or upload system images
-	Moderator = "moderator"
+	Moderator UserRole = "moderator"
 	// Admin can do anything on the system
-	Admin = "admin"
+	Admin UserRole = "admin"
+	// Anonymous is the role of visitors without a session. It can never be granted through the permissions of a
+	// route, only routes which set AnonymousAllowed accept it.
+	Anonymous UserRole = "anonymous"
 )
 
+// Roles are the roles which can be granted to a user, from the least to the most privileged
+var Roles = []UserRole{User, Moderator, Admin}
+
+// InvalidRoleError is returned for roles which are not one of the roles a user can have
+type InvalidRoleError struct {
+	Role string
+}
+
+func (e *InvalidRoleError) Error() string {
+	return fmt.Sprintf("unknown role %q, a role is one of %s, %s or %s", e.Role, User, Moderator, Admin)
+}
+
+// ParseRole checks that a role can be granted to a user. Anonymous is not one of them.
+func ParseRole(role string) (UserRole, error) {
+	if parsed := UserRole(role); parsed.Valid() {
+		return parsed, nil
+	}
+
+	return "", &InvalidRoleError{Role: role}
+}
+
+// Valid reports whether the role can be granted to a user
+func (role UserRole) Valid() bool {
+	for _, granted := range Roles {
+		if role == granted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Outranks reports whether a role grants more than another one, users rank below moderators and moderators below
+// admins. Invalid roles rank below all of them.
+func (role UserRole) Outranks(other UserRole) bool {
+	return role.rank() > other.rank()
+}
+
+func (role UserRole) rank() int {
+	switch role {
+	case User:
+		return 1
+	case Moderator:
+		return 2
+	case Admin:
+		return 3
+	}
+
+	return 0
+}
+
+// UnmarshalJSON refuses roles which cannot be granted. An empty role is left to the handler, for whom it means
+// that no role was given.
+func (role *UserRole) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	if s == "" {
+		*role = ""
+		return nil
+	}
+
+	parsed, err := ParseRole(s)
+	if err != nil {
+		return err
+	}
+
+	*role = parsed
+	return nil
+}
+
+// NormalizeEmail is the form email addresses are stored in, without surrounding whitespace and with the domain in
+// lower case. The local part keeps its case, addresses are compared without it.
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	return email[:at+1] + strings.ToLower(email[at+1:])
+}
+
 // UserModel (noun) one who uses, not necessarily a single person
 // nolint: golint
 type UserModel struct {
 	// Name is a human-readable identifier for a user (or entity) of the system
-	Username string               `gorm:"unique;not null;primaryKey"`
-	Name     string               `gorm:"not null"`
-	Email    string               `gorm:"unique;not null"`
-	Role     UserRole             `gorm:"not null;"`
+	Username string               `gorm:"unique;not null;primaryKey" schema:"username" description:"The name the user logs in with, it is part of the URIs of their resources"`
+	Name     string               `gorm:"not null" description:"The full name of the user"`
+	Email    string               `gorm:"unique;not null" schema:"email" description:"The email address of the user, the notifications are sent to it"`
+	Role     UserRole             `gorm:"not null;" description:"What the user may do, moderators manage the public images and admins everything"`
 	Images   []images2.ImageModel `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Setups   []images2.ImageSetup `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	MetadataTemplates []images2.MetadataTemplate `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	BootTemplates     []images2.BootTemplate     `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// Identities are the OAuth accounts which can be used to log in as this user
+	Identities []IdentityModel `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// SSHKeys are added to the images the user boots
+	SSHKeys []SSHKeyModel `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// LimitOverrides holds at most one row, it is a slice to keep gorm from mistaking it for a belongs-to relation
+	LimitOverrides []LimitOverrides `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// Favorites are the images the user sees first when choosing one to boot
+	Favorites []FavoriteImage `json:"-" gorm:"foreignKey:Username;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// SessionsRevokedAt invalidates the sessions and tokens of the user which were handed out before it
+	SessionsRevokedAt *time.Time `json:"-"`
+
+	// MergedInto is the user this account was merged into as a duplicate, merged accounts cannot be used anymore
+	MergedInto string `gorm:"not null;default:''" json:",omitempty" schema:"readonly" description:"The user this account was merged into"`
+
+	// Disabled accounts cannot log in and their sessions are refused, the LDAP synchronization disables the users
+	// who left all of its groups
+	Disabled bool `gorm:"not null;default:false" json:",omitempty" description:"Disabled accounts cannot log in"`
+
+	// LDAPRole is the role the LDAP synchronization last gave the user, it is empty for users it does not manage
+	LDAPRole UserRole `gorm:"not null;default:''" json:",omitempty" schema:"readonly" description:"The role the LDAP synchronization last gave the user"`
+
+	// CreatedAt and UpdatedAt are kept by gorm, they are left out of the JSON so requests cannot set them
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
 }
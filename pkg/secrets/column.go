@@ -0,0 +1,121 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secrets
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
+
+// Use sets the keyring the Secret columns are sealed and opened with. The database driver gives the columns no
+// context to find it in, so it is set once on start.
+func Use(r *Keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = r
+}
+
+// current is the keyring set with Use, it is nil when no key is configured
+func current() *Keyring {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	return keyring
+}
+
+// Enabled checks whether secrets can be stored, which needs a keyring set with Use
+func Enabled() bool {
+	return current() != nil
+}
+
+// Secret is a column which is stored sealed and read back in the clear. It never shows its value by accident: it is
+// printed and marshalled to JSON as redacted, only Reveal gives the value itself.
+type Secret struct {
+	value string
+}
+
+// NewSecret wraps a value which is to be stored as a secret
+func NewSecret(value string) Secret {
+	return Secret{value: value}
+}
+
+// Reveal gives the value of the secret
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+// Empty checks whether no secret was set
+func (s Secret) Empty() bool {
+	return s.value == ""
+}
+
+// String keeps secrets out of logs and error messages
+func (s Secret) String() string {
+	if s.Empty() {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// MarshalJSON leaves the value out of responses, endpoints which hand out a secret once do so explicitly
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// GormDataType stores secrets as text
+func (s Secret) GormDataType() string {
+	return "string"
+}
+
+// Value seals the secret with the primary key of the keyring, empty secrets are stored as they are
+func (s Secret) Value() (driver.Value, error) {
+	if s.Empty() {
+		return "", nil
+	}
+
+	r := current()
+	if r == nil {
+		return nil, ErrNoKey
+	}
+
+	return r.Seal(s.value)
+}
+
+// Scan opens a sealed secret read from the database
+func (s *Secret) Scan(src interface{}) error {
+	var sealed string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		sealed = v
+	case []byte:
+		sealed = string(v)
+	default:
+		return fmt.Errorf("cannot read a secret from %T", src)
+	}
+
+	if sealed == "" {
+		s.value = ""
+		return nil
+	}
+
+	r := current()
+	if r == nil {
+		return ErrNoKey
+	}
+
+	value, err := r.Open(sealed)
+	if err != nil {
+		return err
+	}
+
+	s.value = value
+	return nil
+}
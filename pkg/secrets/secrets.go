@@ -0,0 +1,334 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package secrets encrypts the secrets stored in the database. Every secret is encrypted with a data key of its
+// own, which is in turn encrypted with a key of the keyring. The sealed secret names the key it was sealed with, so
+// the keyring can be rotated by encrypting the data keys again without touching the secrets themselves.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// prefix starts every sealed secret, together with the version of the format
+const prefix = "baas-secret:v1:"
+
+// KeySize is the size of the keys in bytes, they are AES-256 keys
+const KeySize = 32
+
+// validKeyID keeps the key IDs apart from the separators of the sealed secrets
+var validKeyID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var (
+	// ErrNoKey is returned when a secret is sealed or opened without a keyring
+	ErrNoKey = errors.New("no secret key is configured")
+	// ErrNotSealed is returned for values which are not sealed secrets
+	ErrNotSealed = errors.New("the value is not a sealed secret")
+)
+
+// UnknownKeyError is returned when a secret was sealed with a key which is not in the keyring
+type UnknownKeyError struct {
+	KeyID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("the secret was sealed with key %q, which is not configured", e.KeyID)
+}
+
+// Key is a key of the keyring, the ID is stored with every secret it seals
+type Key struct {
+	ID  string
+	key []byte
+}
+
+// NewKey checks a key and its ID
+func NewKey(id string, key []byte) (*Key, error) {
+	if !validKeyID.MatchString(id) {
+		return nil, fmt.Errorf("invalid key ID %q, use letters, digits, dots, dashes and underscores", id)
+	}
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key %s is %d bytes, it has to be %d", id, len(key), KeySize)
+	}
+
+	return &Key{ID: id, key: key}, nil
+}
+
+// GenerateKey makes a new random key
+func GenerateKey(id string) (*Key, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return NewKey(id, key)
+}
+
+// ParseKey reads a key written as id:base64
+func ParseKey(line string) (*Key, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("keys are written as id:base64")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("key %s is not valid base64: %v", parts[0], err)
+	}
+
+	return NewKey(parts[0], key)
+}
+
+// String writes the key as id:base64, the form ParseKey reads
+func (k *Key) String() string {
+	return k.ID + ":" + base64.StdEncoding.EncodeToString(k.key)
+}
+
+// seal encrypts plaintext with the key, the additional data binds it to where it is used
+func (k *Key) seal(plaintext []byte, additional []byte) ([]byte, error) {
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// open decrypts what seal encrypted
+func (k *Key) open(sealed []byte, additional []byte) ([]byte, error) {
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("the sealed value is truncated")
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Keyring holds the key new secrets are sealed with, and the older keys secrets may still be sealed with
+type Keyring struct {
+	primary *Key
+	keys    map[string]*Key
+}
+
+// NewKeyring makes a keyring which seals with the last of the keys, the others only open secrets
+func NewKeyring(keys ...*Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKey
+	}
+
+	ring := &Keyring{primary: keys[len(keys)-1], keys: map[string]*Key{}}
+	for _, key := range keys {
+		if _, ok := ring.keys[key.ID]; ok {
+			return nil, fmt.Errorf("key %s is given twice", key.ID)
+		}
+		ring.keys[key.ID] = key
+	}
+
+	return ring, nil
+}
+
+// LoadKeyring reads a key file, which has a key per line written as id:base64. The last key seals new secrets, the
+// keys before it are kept to open the secrets which have not been rotated yet. Empty lines and lines starting with
+// # are skipped.
+func LoadKeyring(path string) (*Keyring, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, i+1, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return NewKeyring(keys...)
+}
+
+// Primary is the ID of the key new secrets are sealed with
+func (r *Keyring) Primary() string {
+	return r.primary.ID
+}
+
+// Has checks whether the keyring can open the secrets sealed with a key
+func (r *Keyring) Has(id string) bool {
+	_, ok := r.keys[id]
+	return ok
+}
+
+// envelope is a sealed secret taken apart
+type envelope struct {
+	keyID string
+	// dataKey is the data key sealed with the key, data the secret sealed with the data key
+	dataKey []byte
+	data    []byte
+}
+
+func (e envelope) String() string {
+	return prefix + e.keyID + ":" + base64.RawStdEncoding.EncodeToString(e.dataKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(e.data)
+}
+
+func parseEnvelope(sealed string) (envelope, error) {
+	if !IsSealed(sealed) {
+		return envelope{}, ErrNotSealed
+	}
+
+	parts := strings.Split(strings.TrimPrefix(sealed, prefix), ":")
+	if len(parts) != 3 {
+		return envelope{}, errors.New("the sealed secret is malformed")
+	}
+
+	dataKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return envelope{}, errors.New("the sealed secret is malformed")
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return envelope{}, errors.New("the sealed secret is malformed")
+	}
+
+	return envelope{parts[0], dataKey, data}, nil
+}
+
+// IsSealed checks whether a value stored in the database is a sealed secret
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// KeyID tells which key a secret was sealed with
+func KeyID(sealed string) (string, error) {
+	e, err := parseEnvelope(sealed)
+	return e.keyID, err
+}
+
+// Seal encrypts a secret with a new data key, which is sealed with the primary key
+func (r *Keyring) Seal(plaintext string) (string, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	data, err := (&Key{key: dataKey}).seal([]byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	// The data key is bound to the key ID, so it cannot be passed off as sealed by another key
+	sealedKey, err := r.primary.seal(dataKey, []byte(r.primary.ID))
+	if err != nil {
+		return "", err
+	}
+
+	return envelope{r.primary.ID, sealedKey, data}.String(), nil
+}
+
+// openDataKey decrypts the data key of a secret
+func (r *Keyring) openDataKey(e envelope) ([]byte, error) {
+	key, ok := r.keys[e.keyID]
+	if !ok {
+		return nil, &UnknownKeyError{KeyID: e.keyID}
+	}
+
+	dataKey, err := key.open(e.dataKey, []byte(e.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the secret with key %s: %v", e.keyID, err)
+	}
+
+	return dataKey, nil
+}
+
+// Open decrypts a sealed secret
+func (r *Keyring) Open(sealed string) (string, error) {
+	e, err := parseEnvelope(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := r.openDataKey(e)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := (&Key{key: dataKey}).open(e.data, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot open the secret: %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Rotate seals the data key of a secret with the primary key again, it reports whether anything changed. The secret
+// itself stays encrypted with the same data key.
+func (r *Keyring) Rotate(sealed string) (string, bool, error) {
+	e, err := parseEnvelope(sealed)
+	if err != nil {
+		return "", false, err
+	}
+
+	if e.keyID == r.primary.ID {
+		return sealed, false, nil
+	}
+
+	dataKey, err := r.openDataKey(e)
+	if err != nil {
+		return "", false, err
+	}
+
+	if e.dataKey, err = r.primary.seal(dataKey, []byte(r.primary.ID)); err != nil {
+		return "", false, err
+	}
+	e.keyID = r.primary.ID
+
+	return e.String(), true, nil
+}
+
+// Missing lists the keys which secrets were sealed with but which the keyring lacks, all of them when there is no
+// keyring
+func Missing(r *Keyring, ids []string) []string {
+	missing := []string{}
+	for _, id := range ids {
+		if r == nil || !r.Has(id) {
+			missing = append(missing, id)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring(t *testing.T) {
+	old, err := GenerateKey("2022-01")
+	assert.NoError(t, err)
+	current, err := GenerateKey("2022-06")
+	assert.NoError(t, err)
+
+	parsed, err := ParseKey(current.String())
+	assert.NoError(t, err)
+	assert.Equal(t, current, parsed)
+
+	_, err = ParseKey("bad:id:" + strings.SplitN(current.String(), ":", 2)[1])
+	assert.Error(t, err)
+	_, err = ParseKey("short:c2hvcnQ=")
+	assert.Error(t, err)
+	_, err = NewKeyring(old, old)
+	assert.Error(t, err)
+
+	oldRing, err := NewKeyring(old)
+	assert.NoError(t, err)
+	sealed, err := oldRing.Seal("hunter2")
+	assert.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, sealed, "hunter2")
+
+	id, err := KeyID(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "2022-01", id)
+
+	// The new keyring seals with its last key and still opens what the old key sealed
+	ring, err := NewKeyring(old, current)
+	assert.NoError(t, err)
+	assert.Equal(t, "2022-06", ring.Primary())
+	opened, err := ring.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", opened)
+
+	rotated, changed, err := ring.Rotate(sealed)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	_, changed, err = ring.Rotate(rotated)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// Only the data key was sealed again, so only the new key is needed from now on
+	currentRing, err := NewKeyring(current)
+	assert.NoError(t, err)
+	opened, err = currentRing.Open(rotated)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", opened)
+
+	var unknown *UnknownKeyError
+	_, err = currentRing.Open(sealed)
+	assert.True(t, errors.As(err, &unknown))
+	assert.Equal(t, []string{"2022-01"}, Missing(currentRing, []string{"2022-01", "2022-06"}))
+	assert.Equal(t, []string{"2022-06"}, Missing(nil, []string{"2022-06"}))
+
+	// Tampering with the secret or passing it off as sealed by another key is noticed
+	tampered := []byte(rotated)
+	tampered[len(tampered)-10] ^= 'A' ^ 'B'
+	_, err = currentRing.Open(string(tampered))
+	assert.Error(t, err)
+	impostor, err := NewKey("2022-01", current.key)
+	assert.NoError(t, err)
+	impostorRing, err := NewKeyring(impostor)
+	assert.NoError(t, err)
+	_, err = impostorRing.Open(strings.Replace(rotated, ":2022-06:", ":2022-01:", 1))
+	assert.Error(t, err)
+	_, err = ring.Open("plain text")
+	assert.Equal(t, ErrNotSealed, err)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	first, err := GenerateKey("first")
+	assert.NoError(t, err)
+	second, err := GenerateKey("second")
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "keys")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintf(f, "# rotated in june\n%s\n\n%s\n", first, second)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	ring, err := LoadKeyring(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "second", ring.Primary())
+	assert.True(t, ring.Has("first"))
+}
+
+func TestSecret(t *testing.T) {
+	key, err := GenerateKey("test")
+	assert.NoError(t, err)
+	ring, err := NewKeyring(key)
+	assert.NoError(t, err)
+
+	defer Use(nil)
+	secret := NewSecret("hunter2")
+	_, err = secret.Value()
+	assert.Equal(t, ErrNoKey, err)
+
+	Use(ring)
+	value, err := secret.Value()
+	assert.NoError(t, err)
+	assert.True(t, IsSealed(value.(string)))
+
+	var read Secret
+	assert.NoError(t, read.Scan([]byte(value.(string))))
+	assert.Equal(t, "hunter2", read.Reveal())
+
+	empty, err := Secret{}.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "", empty)
+	assert.NoError(t, read.Scan(nil))
+	assert.True(t, read.Empty())
+
+	// Secrets do not show up in responses or logs
+	body, err := json.Marshal(struct{ Password Secret }{secret})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Password":null}`, string(body))
+	assert.Equal(t, "[redacted]", fmt.Sprint(secret))
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
+
+// shardLength is the length of the names of shards, the first byte of a hash in hexadecimal makes 256 shards
+const shardLength = 2
+
+// Shard is the shard a directory belongs in, named after the first byte of the SHA-256 of its name. UUIDs are
+// random already, but the names of machine images and of tests are not.
+func Shard(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:shardLength]
+}
+
+// IsShard checks whether a directory in the root of a tier is a shard
+func IsShard(name string) bool {
+	if len(name) != shardLength {
+		return false
+	}
+
+	decoded, err := hex.DecodeString(name)
+	return err == nil && hex.EncodeToString(decoded) == name
+}
+
+// FlatDir is where a directory was stored before the shards, straight in the root
+func FlatDir(root, name string) string {
+	return root + "/" + name
+}
+
+// ShardDir is where a directory is stored in its shard: root/3f/name
+func ShardDir(root, name string) string {
+	return root + "/" + Shard(name) + "/" + name
+}
+
+// Dir is the directory of name below root. A directory in the flat layout is used for as long as it is there, until
+// it is moved into its shard. Everything else is stored in its shard.
+func Dir(root, name string) string {
+	if info, err := os.Stat(FlatDir(root, name)); err == nil && info.IsDir() {
+		return FlatDir(root, name)
+	}
+
+	return ShardDir(root, name)
+}
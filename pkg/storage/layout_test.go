@@ -0,0 +1,41 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShard(t *testing.T) {
+	// The first byte of the SHA-256 of "course"
+	assert.Equal(t, "a9", Shard("course"))
+	assert.Equal(t, Shard("course"), Shard("course"))
+	assert.True(t, IsShard(Shard("57bf0cd3-c2bf-4257-acdd-b7f1c8633fcf")))
+
+	for _, name := range []string{"", "5", "5g", "AB", "abc", "course"} {
+		assert.False(t, IsShard(name), name)
+	}
+}
+
+func TestDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "layout")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// Directories which do not exist yet are put in their shard
+	assert.Equal(t, root+"/"+Shard("course")+"/course", Dir(root, "course"))
+
+	// A directory from before the shards is found where it is
+	assert.NoError(t, os.Mkdir(FlatDir(root, "course"), os.ModePerm))
+	assert.Equal(t, root+"/course", Dir(root, "course"))
+
+	// Files by that name do not count
+	assert.NoError(t, ioutil.WriteFile(FlatDir(root, "notes"), nil, 0644))
+	assert.Equal(t, ShardDir(root, "notes"), Dir(root, "notes"))
+}
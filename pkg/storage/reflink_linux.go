@@ -0,0 +1,53 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ficlone is the ioctl which makes a file share the blocks of another, see ioctl_ficlone(2)
+const ficlone = 0x40049409
+
+// filesystems names the filesystems by the magic number statfs reports for them
+var filesystems = map[uint32]string{
+	0x9123683e: "btrfs",
+	0x58465342: "xfs",
+	0x2fc12fc1: "zfs",
+	0xef53:     "ext4",
+	0x01021994: "tmpfs",
+	0x794c7630: "overlayfs",
+	0x6969:     "nfs",
+}
+
+// filesystem finds the type of the filesystem of a directory
+func filesystem(dir string) string {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return ""
+	}
+
+	if name, ok := filesystems[uint32(stat.Type)]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%#x", uint32(stat.Type))
+}
+
+// reflink makes dst share the blocks of src
+func reflink(dst *os.File, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS:
+		// Other filesystems, files on different filesystems, or a filesystem which was made without reflinks
+		return fmt.Errorf("%w: %v", ErrNotSupported, errno)
+	default:
+		return errno
+	}
+}
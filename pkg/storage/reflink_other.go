@@ -0,0 +1,20 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "os"
+
+// filesystem is not known outside Linux
+func filesystem(string) string {
+	return ""
+}
+
+// reflink is only made on Linux, the files are copied elsewhere
+func reflink(*os.File, *os.File) error {
+	return ErrNotSupported
+}
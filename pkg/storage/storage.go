@@ -0,0 +1,162 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package storage copies the files of images in the cheapest way the filesystem they are on allows. Filesystems with
+// reflinks, such as btrfs, XFS and ZFS with block cloning, make a copy which shares the blocks of the original until
+// either is written. Other filesystems get a byte copy which leaves holes for the zeroes.
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Mechanism is how a file was copied
+type Mechanism string
+
+const (
+	// Reflink copies share the blocks of the original, they take no time and no space
+	Reflink Mechanism = "reflink"
+	// Copy copies read and write every byte
+	Copy Mechanism = "copy"
+)
+
+// sparseBlock is the size of the blocks which are checked for zeroes when a file is copied
+const sparseBlock = 1 << 20
+
+// ErrNotSupported is returned when the filesystem cannot make a reflink between the files
+var ErrNotSupported = errors.New("the filesystem does not support reflinks between these files")
+
+// Capabilities are what the filesystem of a directory can do
+type Capabilities struct {
+	// Filesystem is the type of the filesystem, such as btrfs, xfs, zfs or ext4, it is empty when it is not known
+	Filesystem string
+	// Reflink is whether files in the directory can be cloned
+	Reflink bool
+}
+
+// detected keeps the capabilities of the directories which were probed, a directory does not change filesystem
+var detected sync.Map
+
+// Detect finds the capabilities of the filesystem a directory is on. Reflinks are tried on two small files in the
+// directory, since support depends on the version and the options of the filesystem rather than its type.
+func Detect(dir string) Capabilities {
+	if found, ok := detected.Load(dir); ok {
+		return found.(Capabilities)
+	}
+
+	capabilities := Capabilities{Filesystem: filesystem(dir), Reflink: probe(dir) == nil}
+	detected.Store(dir, capabilities)
+	return capabilities
+}
+
+// probe clones a small file in dir
+func probe(dir string) error {
+	src, err := ioutil.TempFile(dir, ".reflink-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	if _, err = src.Write(make([]byte, 4096)); err != nil {
+		return err
+	}
+
+	dst, err := ioutil.TempFile(dir, ".reflink-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	return reflink(dst, src)
+}
+
+// Share makes dst, which has to be empty, a reflink of src. ErrNotSupported is returned when the filesystem cannot
+// make one, for instance because the files are on different filesystems.
+func Share(dst *os.File, src *os.File) error {
+	return reflink(dst, src)
+}
+
+// Clone makes dst, which has to be empty, a copy of src. A reflink is tried first, the bytes are copied when the
+// filesystem cannot make one.
+func Clone(dst *os.File, src *os.File) (Mechanism, error) {
+	err := Share(dst, src)
+	if err == nil {
+		return Reflink, nil
+	} else if !errors.Is(err, ErrNotSupported) {
+		return "", err
+	}
+
+	_, err = CopySparse(dst, src)
+	return Copy, err
+}
+
+// CloneFile copies the file src to a new file dst like Clone, the copy is on disk once it returns
+func CloneFile(src string, dst string) (Mechanism, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	mechanism, err := Clone(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+
+	return mechanism, err
+}
+
+// CopySparse copies in to out, leaving holes where in only has zeroes. Fresh versions are mostly empty, they would
+// take up all of their size otherwise.
+func CopySparse(out *os.File, in io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlock)
+	zeroes := make([]byte, sparseBlock)
+
+	var total int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			var writeErr error
+			if bytes.Equal(buf[:n], zeroes[:n]) {
+				_, writeErr = out.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, writeErr = out.Write(buf[:n])
+			}
+
+			if writeErr != nil {
+				return total, writeErr
+			}
+			total += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// A hole at the end only counts once the file is as long as the original
+			return total, out.Truncate(total)
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
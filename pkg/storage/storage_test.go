@@ -0,0 +1,99 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testContent has data around a run of zeroes long enough to become a hole
+func testContent() []byte {
+	content := append([]byte("boot sector"), make([]byte, 3*sparseBlock)...)
+	return append(content, []byte("root filesystem")...)
+}
+
+func TestCloneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "0.img")
+	assert.NoError(t, ioutil.WriteFile(src, testContent(), 0644))
+
+	// Whatever the filesystem, the copy has the content of the original
+	mechanism, err := CloneFile(src, filepath.Join(dir, "1.img"))
+	assert.NoError(t, err)
+	assert.Contains(t, []Mechanism{Reflink, Copy}, mechanism)
+	assert.Equal(t, Detect(dir).Reflink, mechanism == Reflink)
+
+	copied, err := ioutil.ReadFile(filepath.Join(dir, "1.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, testContent(), copied)
+
+	// An existing file is not overwritten
+	_, err = CloneFile(src, filepath.Join(dir, "1.img"))
+	assert.True(t, os.IsExist(err))
+	_, err = CloneFile(filepath.Join(dir, "missing.img"), filepath.Join(dir, "2.img"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "2.img"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReflink(t *testing.T) {
+	dir := os.Getenv("BAAS_REFLINK_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	if !Detect(dir).Reflink {
+		t.Skipf("%s (%s) does not support reflinks, set BAAS_REFLINK_DIR to a directory on btrfs or xfs", dir,
+			Detect(dir).Filesystem)
+	}
+
+	dir, err := ioutil.TempDir(dir, "storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "0.img")
+	assert.NoError(t, ioutil.WriteFile(src, testContent(), 0644))
+	mechanism, err := CloneFile(src, filepath.Join(dir, "1.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, Reflink, mechanism)
+
+	// Writing the clone leaves the original alone
+	f, err := os.OpenFile(filepath.Join(dir, "1.img"), os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("BOOT"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	original, err := ioutil.ReadFile(src)
+	assert.NoError(t, err)
+	assert.Equal(t, testContent(), original)
+}
+
+func TestCopySparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out, err := os.Create(filepath.Join(dir, "sparse.img"))
+	assert.NoError(t, err)
+	n, err := CopySparse(out, bytes.NewReader(make([]byte, 2*sparseBlock)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*sparseBlock), n)
+	assert.NoError(t, out.Close())
+
+	// A file of only zeroes is all hole, yet as long as the original
+	info, err := os.Stat(filepath.Join(dir, "sparse.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*sparseBlock), info.Size())
+}
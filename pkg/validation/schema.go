@@ -0,0 +1,297 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package validation
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/machine"
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// Dialect is the version of JSON Schema the schemas are written in
+const Dialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Types is the type keyword of a schema, it is written as a single type when there is only one
+type Types []string
+
+// MarshalJSON writes a single type as a string
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+
+	return json.Marshal([]string(t))
+}
+
+// UnmarshalJSON reads either a single type or a list of them
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+// Schema is a JSON Schema of the body of a request. It only has the keywords the control server needs, and the
+// same schema validates the bodies the control server is sent.
+type Schema struct {
+	Dialect     string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Type        Types  `json:"type,omitempty"`
+	// Format is date-time, email or username for strings, and byte for base64 encoded binary data
+	Format  string   `json:"format,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+
+	MaxLength *int     `json:"maxLength,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	// ReadOnly fields are set by the control server, whatever a request gives for them is ignored
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+
+	// ContentMediaType is set for the bodies which are not JSON, they are not validated
+	ContentMediaType string `json:"contentMediaType,omitempty"`
+
+	// foldCase validates the enum regardless of the case of the value, as the control server reads it
+	foldCase bool
+}
+
+// JSON reports whether the schema describes a JSON body which can be validated
+func (s *Schema) JSON() bool {
+	return s.ContentMediaType == "" && len(s.Type) > 0
+}
+
+// Require returns a copy of an object schema which requires the given properties
+func (s *Schema) Require(properties ...string) *Schema {
+	required := *s
+	required.Required = append(append([]string{}, s.Required...), properties...)
+	return &required
+}
+
+// Describe returns a copy of the schema as the document of a resource, with its title and description
+func (s *Schema) Describe(title string, description string) *Schema {
+	described := *s
+	described.Dialect = Dialect
+	described.Title = title
+	described.Description = description
+	return &described
+}
+
+// NoBody is the schema of the requests which take no body
+func NoBody() *Schema {
+	return &Schema{Dialect: Dialect, Title: "none", Description: "The request takes no body"}
+}
+
+// Binary is the schema of the requests which upload a file as it is, of the given media type
+func Binary(mediaType string) *Schema {
+	return &Schema{Dialect: Dialect, Title: "file", Description: "The request uploads the file as its body",
+		ContentMediaType: mediaType}
+}
+
+// enums are the schemas of the string types which only take some values. An empty value leaves it to the
+// default, or to the handler to complain about it missing.
+var enums = map[reflect.Type]func() *Schema{
+	reflect.TypeOf(user.UserRole("")): func() *Schema {
+		return enum("role", user.Roles)
+	},
+	reflect.TypeOf(images.BootMode("")): func() *Schema {
+		return enum("boot mode", images.BootModes)
+	},
+	reflect.TypeOf(images.VerifyMode("")): func() *Schema {
+		return enum("verify mode", images.VerifyModes)
+	},
+	reflect.TypeOf(images.LicenseKind("")): func() *Schema {
+		return enum("license kind", images.LicenseKinds)
+	},
+	reflect.TypeOf(machine.SystemArchitecture("")): architecture,
+}
+
+// enum is the schema of a string which takes the values of a slice of string constants, or the empty value. The
+// title names what the values are in the reasons a value is refused.
+func enum(title string, values interface{}) *Schema {
+	v := reflect.ValueOf(values)
+	list := []string{""}
+	for i := 0; i < v.Len(); i++ {
+		list = append(list, v.Index(i).String())
+	}
+
+	return &Schema{Title: title, Type: Types{"string"}, Enum: list}
+}
+
+// architecture is the schema of the architectures, which the control server takes in any case
+func architecture() *Schema {
+	schema := enum("architecture", machine.Architectures)
+	schema.foldCase = true
+	return schema
+}
+
+// typeSchemas are the schemas of the types which decode themselves from JSON in a way of their own
+var typeSchemas = map[reflect.Type]func() *Schema{
+	reflect.TypeOf(time.Time{}): func() *Schema {
+		return &Schema{Type: Types{"string"}, Format: "date-time"}
+	},
+	reflect.TypeOf(images.VersionSelector("")): func() *Schema {
+		zero := 0.0
+		return &Schema{Type: Types{"string", "integer"}, Pattern: `^(latest|[0-9]*)$`, Minimum: &zero,
+			Description: `Either "latest" or the number of a version`}
+	},
+}
+
+// options are the schemas the schema tag of a field can give a string, with the same checks the handlers make
+var options = map[string]func() *Schema{
+	"username": func() *Schema {
+		length := MaxUsernameLength
+		return &Schema{Type: Types{"string"}, Format: "username", Pattern: UsernamePattern, MaxLength: &length}
+	},
+	"email": func() *Schema {
+		return &Schema{Type: Types{"string"}, Format: "email"}
+	},
+	"architecture": architecture,
+}
+
+// unmarshaler is implemented by the types which decode their JSON themselves
+var unmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// generator makes the schema of a Go type in the way encoding/json decodes it. It remembers the structs it is in, so
+// types which contain themselves end.
+type generator struct {
+	within map[reflect.Type]bool
+}
+
+// Generate makes the schema of the JSON a value of the type of v is decoded from. The fields are named as
+// encoding/json names them, and may be tagged with:
+//   - description: the description of the field
+//   - schema: a comma separated list of required, readonly, username, email and architecture
+func Generate(v interface{}) *Schema {
+	g := generator{within: map[reflect.Type]bool{}}
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *generator) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if schema, ok := typeSchemas[t]; ok {
+		return schema()
+	}
+
+	if schema, ok := enums[t]; ok {
+		return schema()
+	}
+
+	// Whatever decodes itself is left to the decoder
+	if reflect.PtrTo(t).Implements(unmarshaler) {
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: Types{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: Types{"integer"}}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		zero := 0.0
+		return &Schema{Type: Types{"integer"}, Minimum: &zero}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: Types{"number"}}
+	case reflect.String:
+		return &Schema{Type: Types{"string"}}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: Types{"string"}, Format: "byte"}
+		}
+		return &Schema{Type: Types{"array"}, Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: Types{"object"}, AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.object(t)
+	}
+
+	return &Schema{}
+}
+
+func (g *generator) object(t reflect.Type) *Schema {
+	schema := &Schema{Type: Types{"object"}}
+	if g.within[t] {
+		return schema
+	}
+
+	g.within[t] = true
+	defer delete(g.within, t)
+
+	schema.Properties = map[string]*Schema{}
+	g.fields(t, schema)
+	return schema
+}
+
+// fields adds the fields of a struct to the properties of its schema, those of embedded structs as well
+func (g *generator) fields(t reflect.Type, schema *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct &&
+			!reflect.PtrTo(fieldType).Implements(unmarshaler) {
+			g.fields(fieldType, schema)
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		property := g.schema(field.Type)
+		if description := field.Tag.Get("description"); description != "" {
+			property.Description = description
+		}
+
+		for _, option := range strings.Split(field.Tag.Get("schema"), ",") {
+			switch option {
+			case "":
+			case "required":
+				schema.Required = append(schema.Required, name)
+			case "readonly":
+				property.ReadOnly = true
+			default:
+				replace, ok := options[option]
+				if !ok {
+					panic("unknown schema option " + option + " of " + t.String() + "." + field.Name)
+				}
+
+				replaced := replace()
+				replaced.Description = property.Description
+				property = replaced
+			}
+		}
+
+		schema.Properties[name] = property
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package validation
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/baas-project/baas/pkg/model/images"
+	"github.com/baas-project/baas/pkg/model/user"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	schema := Generate(user.UserModel{})
+	assert.Equal(t, Types{"object"}, schema.Type)
+	assert.Equal(t, []string{"", "user", "moderator", "admin"}, schema.Properties["Role"].Enum)
+	assert.NotEmpty(t, schema.Properties["Role"].Description)
+	assert.Equal(t, "username", schema.Properties["Username"].Format)
+	assert.Equal(t, UsernamePattern, schema.Properties["Username"].Pattern)
+	assert.True(t, schema.Properties["LDAPRole"].ReadOnly)
+	assert.NotContains(t, schema.Properties, "Images")
+	assert.NotContains(t, schema.Properties, "CreatedAt")
+
+	// Embedded structs are flattened, the names follow the JSON tags
+	template := Generate(images.BootTemplate{})
+	assert.Contains(t, template.Properties, "SetupUUID")
+	assert.Contains(t, template.Properties, "verify")
+	assert.NotContains(t, template.Properties, "Model")
+	assert.Equal(t, Types{"string", "integer"}, template.Properties["Version"].Type)
+
+	b, err := json.Marshal(template.Properties["Revision"])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "integer", "minimum": 0, "readOnly": true}`, string(b))
+}
+
+func TestSchema_Validate(t *testing.T) {
+	schema := Generate(user.UserModel{}).Require("Username", "Role")
+
+	assert.Empty(t, schema.ValidateJSON([]byte(`{"username": "jan", "Role": "admin", "Unknown": 1, "Name": null}`)))
+	assert.Equal(t, []string{"Role is missing"}, schema.ValidateJSON([]byte(`{"Username": "jan"}`)))
+	assert.Equal(t, []string{`Role: unknown role "root", it is one of "user", "moderator", "admin"`},
+		schema.ValidateJSON([]byte(`{"Username": "jan", "Role": "root"}`)))
+	assert.Equal(t, []string{"Disabled: must be a boolean"},
+		schema.ValidateJSON([]byte(`{"Username": "jan", "Role": "user", "Disabled": "yes"}`)))
+	assert.Equal(t, Username("jan doe"), strip(schema.ValidateJSON([]byte(`{"Username": "jan doe", "Role": "user"}`)),
+		"Username: "))
+	assert.Equal(t, []string{"the body must be an object"}, schema.ValidateJSON([]byte(`[]`)))
+	assert.NotEmpty(t, schema.ValidateJSON([]byte(`{"Username": `)))
+
+	boot := Generate(images.BootSetup{})
+	assert.Empty(t, boot.ValidateJSON([]byte(`{"Version": 3, "BootMode": "", "verify": "full"}`)))
+	assert.Empty(t, boot.ValidateJSON([]byte(`{"Version": "latest", "Machine": {"Architecture": "X86_64"}}`)))
+	assert.Len(t, boot.ValidateJSON([]byte(`{"Version": 1.5, "BootMode": "twice", "verify": "all"}`)), 3)
+	assert.Equal(t, []string{"TemplateRevision: must be at least 0"},
+		boot.ValidateJSON([]byte(`{"TemplateRevision": -1}`)))
+}
+
+func strip(reasons []string, prefix string) []string {
+	stripped := make([]string, len(reasons))
+	for i, reason := range reasons {
+		stripped[i] = reason[len(prefix):]
+	}
+
+	return stripped
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package validation holds the rules for the names and addresses users give, and the schemas of the request bodies.
+// Creating a user, checking whether a name is available and the published schemas all go through it, so they cannot
+// disagree.
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/baas-project/baas/pkg/model/user"
+)
+
+// MaxUsernameLength is the longest username which is accepted
+const MaxUsernameLength = 64
+
+// reservedUsernames would be taken for a route rather than the user, /user/me is the logged-in user
+var reservedUsernames = map[string]bool{"me": true}
+
+// UsernamePattern are the characters a username consists of. Usernames are part of URIs and directory names, and
+// GitHub and GitLab logins only consist of these.
+const UsernamePattern = `^[A-Za-z0-9._-]*$`
+
+var usernameRegexp = regexp.MustCompile(UsernamePattern)
+
+// Username returns the reasons a username cannot be used, it is valid when there are none
+func Username(name string) []string {
+	if name == "" {
+		return []string{"the username is empty"}
+	}
+
+	var reasons []string
+	if len(name) > MaxUsernameLength {
+		reasons = append(reasons, fmt.Sprintf("the username is longer than %d characters", MaxUsernameLength))
+	}
+
+	if !usernameRegexp.MatchString(name) {
+		reasons = append(reasons, "the username can only contain letters, digits, '.', '-' and '_'")
+	}
+
+	if strings.Trim(name, ".") == "" {
+		reasons = append(reasons, "the username cannot consist of dots only")
+	}
+
+	if reservedUsernames[strings.ToLower(name)] {
+		reasons = append(reasons, fmt.Sprintf("the username %q is reserved", name))
+	}
+
+	return reasons
+}
+
+// Email normalizes an email address and returns the reasons it cannot be used, it is valid when there are none
+func Email(email string) (string, []string) {
+	email = user.NormalizeEmail(email)
+	if email == "" {
+		return email, []string{"the email address is empty"}
+	}
+
+	var reasons []string
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		reasons = append(reasons, "the email address needs a name and a domain around the @")
+	}
+
+	if strings.ContainsAny(email, " \t\r\n") {
+		reasons = append(reasons, "the email address cannot contain spaces")
+	}
+
+	return email, reasons
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsername(t *testing.T) {
+	for _, name := range []string{"wnarchi", "ValentijnvdBeek", "jan-github", "j.doe_2"} {
+		assert.Empty(t, Username(name), name)
+	}
+
+	for _, name := range []string{"", "me", "Me", "..", "jan doe", "jan/../admin", "jän",
+		strings.Repeat("a", MaxUsernameLength+1)} {
+		assert.NotEmpty(t, Username(name), name)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	email, reasons := Email(" W.Narchi@TUDelft.NL ")
+	assert.Empty(t, reasons)
+	assert.Equal(t, "W.Narchi@tudelft.nl", email)
+
+	for _, email := range []string{"", "   ", "narchi", "@tudelft.nl", "narchi@", "w narchi@tudelft.nl"} {
+		_, reasons = Email(email)
+		assert.NotEmpty(t, reasons, email)
+	}
+}
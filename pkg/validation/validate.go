@@ -0,0 +1,260 @@
+// Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatChecks are the formats whose rules are richer than a pattern, they make the checks the handlers make
+var formatChecks = map[string]func(string) []string{
+	"username": Username,
+	"email": func(email string) []string {
+		_, reasons := Email(email)
+		return reasons
+	},
+}
+
+// Decode reads a body the way encoding/json reads it into the type a schema was generated from, only its first value
+// counts
+func Decode(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+// Validate returns the reasons a decoded body does not match the schema, it is valid when there are none. The
+// names of the properties may be in any case, unknown properties are ignored and null leaves a field as it is, as
+// with encoding/json.
+func (s *Schema) Validate(value interface{}) []string {
+	var reasons []string
+	s.validate("", value, &reasons)
+	return reasons
+}
+
+// ValidateJSON decodes a body and validates it
+func (s *Schema) ValidateJSON(body []byte) []string {
+	value, err := Decode(body)
+	if err != nil {
+		return []string{fmt.Sprintf("the body is not valid JSON: %v", err)}
+	}
+
+	return s.Validate(value)
+}
+
+func (s *Schema) validate(path string, value interface{}, reasons *[]string) {
+	if value == nil {
+		return
+	}
+
+	fail := func(format string, args ...interface{}) {
+		*reasons = append(*reasons, describe(path)+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.hasType(value) {
+		fail("must be %s", typeNames(s.Type))
+		return
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.validateString(path, v, reasons)
+	case json.Number:
+		if s.Minimum != nil {
+			if n, err := v.Float64(); err == nil && n < *s.Minimum {
+				fail("must be at least %v", *s.Minimum)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, reasons)
+			}
+		}
+	case map[string]interface{}:
+		s.validateObject(path, v, reasons)
+	}
+}
+
+func (s *Schema) validateString(path string, value string, reasons *[]string) {
+	if len(s.Enum) > 0 && !s.inEnum(value) {
+		noun := s.Title
+		if noun == "" {
+			noun = "value"
+		}
+		*reasons = append(*reasons, fmt.Sprintf("%sunknown %s %q, it is one of %s", describe(path), noun, value,
+			strings.Join(quote(s.Enum), ", ")))
+	}
+
+	// The formats which have checks of their own leave the empty value to the required properties
+	if check, ok := formatChecks[s.Format]; ok {
+		if value != "" {
+			for _, reason := range check(value) {
+				*reasons = append(*reasons, describe(path)+reason)
+			}
+		}
+		return
+	}
+
+	if s.MaxLength != nil && utf8.RuneCountInString(value) > *s.MaxLength {
+		*reasons = append(*reasons, fmt.Sprintf("%sis longer than %d characters", describe(path), *s.MaxLength))
+	}
+
+	if s.Pattern != "" {
+		if pattern, err := regexp.Compile(s.Pattern); err == nil && !pattern.MatchString(value) {
+			*reasons = append(*reasons, fmt.Sprintf("%sdoes not match %s", describe(path), s.Pattern))
+		}
+	}
+}
+
+func (s *Schema) validateObject(path string, value map[string]interface{}, reasons *[]string) {
+	for _, required := range s.Required {
+		if _, ok := lookup(value, required); !ok {
+			*reasons = append(*reasons, fmt.Sprintf("%s is missing", join(path, required)))
+		}
+	}
+
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		property := s.property(key)
+		if property == nil {
+			property = s.AdditionalProperties
+		}
+
+		if property != nil {
+			property.validate(join(path, key), value[key], reasons)
+		}
+	}
+}
+
+// describe starts a reason about the value at a path, the body itself has none
+func describe(path string) string {
+	if path == "" {
+		return "the body "
+	}
+
+	return path + ": "
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// property finds the schema of a property the way encoding/json finds the field, preferring the exact name
+func (s *Schema) property(name string) *Schema {
+	if property, ok := s.Properties[name]; ok {
+		return property
+	}
+
+	for key, property := range s.Properties {
+		if strings.EqualFold(key, name) {
+			return property
+		}
+	}
+
+	return nil
+}
+
+// lookup finds a property of a value regardless of its case
+func lookup(value map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := value[name]; ok {
+		return v, true
+	}
+
+	for key, v := range value {
+		if strings.EqualFold(key, name) {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *Schema) hasType(value interface{}) bool {
+	for _, t := range s.Type {
+		switch v := value.(type) {
+		case string:
+			if t == "string" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if _, err := strconv.ParseInt(v.String(), 10, 64); t == "integer" && err == nil {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *Schema) inEnum(value string) bool {
+	for _, allowed := range s.Enum {
+		if value == allowed || (s.foldCase && strings.EqualFold(value, allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// typeNames joins the types of a schema for a reason, as "a string or an integer"
+func typeNames(types Types) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		article := "a"
+		if strings.ContainsAny(t[:1], "aeiou") {
+			article = "an"
+		}
+		names[i] = article + " " + t
+	}
+
+	return strings.Join(names, " or ")
+}
+
+// quote quotes the values of an enum for a reason, leaving out the empty value which stands for the default
+func quote(values []string) []string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			quoted = append(quoted, strconv.Quote(value))
+		}
+	}
+
+	return quoted
+}
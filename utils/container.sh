@@ -7,8 +7,8 @@
 function generateImage {
     echo "building docker container"
 
-    # Build the docker container
-    docker build -t container -f "$1/Dockerfile" .
+    # Build the docker container, AGENT_VERSION is the version the management OS agent reports
+    docker build -t container --build-arg AGENT_VERSION="${AGENT_VERSION:-dev}" -f "$1/Dockerfile" .
 
     # Run the container to get a container id
     CID=$(docker run -d container /bin/true)
@@ -0,0 +1,115 @@
+#!/usr/bin/env bash
+# Copyright (c) 2020-2022 TU Delft & Valentijn van de Beek <v.d.vandebeek@student.tudelft.nl> All rights reserved.
+# Use of this source code is governed by a BSD-style
+# license that can be found in the LICENSE file.
+
+# Turns a root file system into a bootable raw disk image with a GPT, an EFI system partition holding the kernel and
+# the bootloader, and an ext4 root partition. The partitions are built as files and copied into the disk image, so
+# neither loop devices nor mounts are needed.
+#
+# Usage: rootfs2image.sh <root file system> <disk image> <most bytes the build may take> <systemd-boot|grub>
+#
+# Needs mkfs.fat, mtools, mkfs.ext4 (e2fsprogs 1.43 or later), sgdisk and, for grub, grub-mkstandalone.
+
+set -euo pipefail
+
+ROOTFS=$1
+IMAGE=$2
+LIMIT=$3
+BOOTLOADER=$4
+
+WORK=$(dirname "$IMAGE")
+ESP="$WORK/esp.img"
+ROOT="$WORK/root.img"
+ESP_MIB=256
+
+function cleanup {
+    rm -f "$ESP" "$ROOT" "$WORK/BOOTX64.EFI" "$WORK/grub.cfg" "$WORK/loader.conf" "$WORK/baas.conf"
+}
+trap cleanup EXIT
+
+# The newest kernel and its initial ram disk, if the distribution uses one
+KERNEL=$(find "$ROOTFS/boot" -maxdepth 1 -name 'vmlinuz*' | sort -V | tail -n 1)
+INITRD=$(find "$ROOTFS/boot" -maxdepth 1 \( -name 'initrd.img*' -o -name 'initramfs*' \) | sort -V | tail -n 1)
+
+# Leave room for the files the machine writes once it runs
+USED_MIB=$(du -s --block-size=1M "$ROOTFS" | cut -f 1)
+ROOT_MIB=$((USED_MIB + USED_MIB / 5 + 256))
+TOTAL_MIB=$((1 + ESP_MIB + ROOT_MIB + 1))
+
+# The partitions exist twice until they are copied into the disk image
+if ((2 * TOTAL_MIB * 1024 * 1024 > LIMIT)); then
+    echo "The disk image needs twice ${TOTAL_MIB} MiB while it is built, the build may only take ${LIMIT} bytes" >&2
+    exit 1
+fi
+
+ROOT_UUID=$(cat /proc/sys/kernel/random/uuid)
+OPTIONS="root=UUID=$ROOT_UUID rootfstype=ext4 rw"
+
+echo "Creating the EFI system partition of ${ESP_MIB} MiB"
+truncate -s "${ESP_MIB}M" "$ESP"
+mkfs.fat -F 32 -n ESP "$ESP"
+mmd -i "$ESP" ::/EFI ::/EFI/BOOT
+mcopy -i "$ESP" "$KERNEL" ::/vmlinuz
+INITRD_LINE=""
+if [[ -n $INITRD ]]; then
+    mcopy -i "$ESP" "$INITRD" ::/initrd
+    INITRD_LINE="/initrd"
+fi
+
+echo "Installing $BOOTLOADER"
+case "$BOOTLOADER" in
+systemd-boot)
+    LOADER=$(find "$ROOTFS/usr/lib/systemd/boot/efi" -name 'systemd-bootx64.efi' 2>/dev/null | head -n 1)
+    if [[ -z $LOADER ]]; then
+        echo "systemd-boot is not installed in the root file system, install the systemd-boot package" >&2
+        exit 1
+    fi
+
+    printf "default baas.conf\ntimeout 0\neditor no\n" >"$WORK/loader.conf"
+    printf "title   Linux\nlinux   /vmlinuz\n" >"$WORK/baas.conf"
+    if [[ -n $INITRD_LINE ]]; then
+        printf "initrd  %s\n" "$INITRD_LINE" >>"$WORK/baas.conf"
+    fi
+    printf "options %s\n" "$OPTIONS" >>"$WORK/baas.conf"
+
+    mmd -i "$ESP" ::/loader ::/loader/entries
+    mcopy -i "$ESP" "$LOADER" ::/EFI/BOOT/BOOTX64.EFI
+    mcopy -i "$ESP" "$WORK/loader.conf" ::/loader/loader.conf
+    mcopy -i "$ESP" "$WORK/baas.conf" ::/loader/entries/baas.conf
+    ;;
+grub)
+    # The configuration is built into the bootloader, which finds the kernel on the EFI system partition by its label
+    {
+        echo "search --no-floppy --label --set=root ESP"
+        echo "linux /vmlinuz $OPTIONS"
+        if [[ -n $INITRD_LINE ]]; then
+            echo "initrd $INITRD_LINE"
+        fi
+        echo "boot"
+    } >"$WORK/grub.cfg"
+
+    grub-mkstandalone -O x86_64-efi -o "$WORK/BOOTX64.EFI" "boot/grub/grub.cfg=$WORK/grub.cfg"
+    mcopy -i "$ESP" "$WORK/BOOTX64.EFI" ::/EFI/BOOT/BOOTX64.EFI
+    ;;
+*)
+    echo "Unsupported bootloader $BOOTLOADER, use systemd-boot or grub" >&2
+    exit 1
+    ;;
+esac
+
+echo "Creating the root partition of ${ROOT_MIB} MiB"
+truncate -s "${ROOT_MIB}M" "$ROOT"
+mkfs.ext4 -q -F -U "$ROOT_UUID" -L root -d "$ROOTFS" "$ROOT"
+
+echo "Partitioning the disk image"
+truncate -s "${TOTAL_MIB}M" "$IMAGE"
+sgdisk --clear \
+    --new=1:1MiB:+${ESP_MIB}MiB --typecode=1:ef00 --change-name=1:ESP \
+    --new=2:0:+${ROOT_MIB}MiB --typecode=2:8300 --change-name=2:root \
+    "$IMAGE"
+
+dd if="$ESP" of="$IMAGE" bs=1M seek=1 conv=notrunc,sparse status=none
+dd if="$ROOT" of="$IMAGE" bs=1M seek=$((1 + ESP_MIB)) conv=notrunc,sparse status=none
+
+echo "Built a disk image of ${TOTAL_MIB} MiB"